@@ -4,41 +4,78 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
+	"strconv"
 	"sync"
 
 	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/archive/archiver"
+	"github.com/develar/app-builder/pkg/archive/squashfs"
 	"github.com/develar/app-builder/pkg/archive/zipx"
+	"github.com/develar/app-builder/pkg/artifact"
+	"github.com/develar/app-builder/pkg/asar"
+	"github.com/develar/app-builder/pkg/attestation"
 	"github.com/develar/app-builder/pkg/blockmap"
 	"github.com/develar/app-builder/pkg/codesign"
+	"github.com/develar/app-builder/pkg/crash"
+	"github.com/develar/app-builder/pkg/docker"
+	"github.com/develar/app-builder/pkg/doctor"
 	"github.com/develar/app-builder/pkg/download"
 	"github.com/develar/app-builder/pkg/electron"
+	"github.com/develar/app-builder/pkg/fakes"
 	"github.com/develar/app-builder/pkg/fs"
 	"github.com/develar/app-builder/pkg/icons"
+	"github.com/develar/app-builder/pkg/inspect"
+	"github.com/develar/app-builder/pkg/keychain"
 	"github.com/develar/app-builder/pkg/linuxTools"
+	"github.com/develar/app-builder/pkg/localization"
 	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/metadata"
 	"github.com/develar/app-builder/pkg/node-modules"
+	"github.com/develar/app-builder/pkg/nsis"
 	"github.com/develar/app-builder/pkg/package-format/appimage"
 	"github.com/develar/app-builder/pkg/package-format/dmg"
+	"github.com/develar/app-builder/pkg/package-format/flatpak"
 	"github.com/develar/app-builder/pkg/package-format/fpm"
+	"github.com/develar/app-builder/pkg/package-format/msix"
 	"github.com/develar/app-builder/pkg/package-format/proton-native"
 	"github.com/develar/app-builder/pkg/package-format/snap"
+	"github.com/develar/app-builder/pkg/pipeline"
 	"github.com/develar/app-builder/pkg/plist"
 	"github.com/develar/app-builder/pkg/publisher"
 	"github.com/develar/app-builder/pkg/rcedit"
 	"github.com/develar/app-builder/pkg/remoteBuild"
+	"github.com/develar/app-builder/pkg/report"
+	"github.com/develar/app-builder/pkg/reproducible"
+	"github.com/develar/app-builder/pkg/reputation"
+	"github.com/develar/app-builder/pkg/sbom"
+	"github.com/develar/app-builder/pkg/staging"
+	"github.com/develar/app-builder/pkg/universal"
 	"github.com/develar/app-builder/pkg/util"
 	"github.com/develar/app-builder/pkg/wine"
 	"github.com/develar/errors"
 	"github.com/segmentio/ksuid"
 )
 
+const version = "3.5.10"
+
 func main() {
 	log.InitLogger()
 	defer func() {
 		_ = log.LOG.Sync()
 	}()
 
+	crash.AppVersion = version
+	wine.AppVersion = version
+	sbom.AppVersion = version
+	attestation.AppVersion = version
+	crash.BeforeExit = util.CleanupTemp
+	defer crash.HandlePanic()
+	defer util.CleanupTemp()
+
+	util.HandleCancelSignals()
+
 	if os.Getenv("SZA_ARCHIVE_TYPE") != "" {
 		err := compress()
 		if err != nil {
@@ -47,21 +84,43 @@ func main() {
 		return
 	}
 
-	var app = kingpin.New("app-builder", "app-builder").Version("3.5.10")
+	var app = kingpin.New("app-builder", "app-builder").Version(version)
+	log.ConfigureFlags(app)
+	fakes.ConfigureFlag(app)
+	reproducible.ConfigureFlag(app)
+	reproducible.ConfigureNormalizeCommand(app)
 
 	node_modules.ConfigureCommand(app)
 	node_modules.ConfigureRebuildCommand(app)
-	//codesign.ConfigureCommand(app)
+	asar.ConfigureCommand(app)
+	codesign.ConfigureCommand(app)
+	codesign.ConfigureSignWindowsCommand(app)
+	keychain.ConfigureCommand(app)
 	publisher.ConfigurePublishToS3Command(app)
+	publisher.ConfigurePublishCommand(app)
+	publisher.ConfigureInvalidateCdnCommand(app)
+	publisher.ConfigureVerifyPublishCommand(app)
+	publisher.ConfigureUpdateInfoCommand(app)
+	publisher.ConfigureChannelCommand(app)
+	reputation.ConfigurePrewarmCommand(app)
+	reputation.ConfigureScanCommand(app)
 	remoteBuild.ConfigureBuildCommand(app)
 
 	download.ConfigureCommand(app)
 	download.ConfigureArtifactCommand(app)
+	download.ConfigureApplyBlockMapCommand(app)
 
 	electron.ConfigureCommand(app)
 	electron.ConfigureUnpackCommand(app)
+	electron.ConfigureSandboxCommand(app)
+	electron.ConfigureFusesCommand(app)
 
 	zipx.ConfigureUnzipCommand(app)
+	zipx.ConfigureEncryptCommand(app)
+	squashfs.ConfigureUnsquashfsCommand(app)
+	squashfs.ConfigureMksquashfsCommand(app)
+	archiver.ConfigureCommand(app)
+	archiver.ConfigureDittoCommand(app)
 	proton_native.ConfigureCommand(app)
 
 	configurePrefetchToolsCommand(app)
@@ -70,7 +129,12 @@ func main() {
 	appimage.ConfigureCommand(app)
 	snap.ConfigureCommand(app)
 	snap.ConfigurePublishCommand(app)
+	snap.ConfigureDeltaCommand(app)
 	fpm.ConfigureCommand(app)
+	flatpak.ConfigureCommand(app)
+	msix.ConfigureCommand(app)
+	nsis.ConfigureCommand(app)
+	localization.ConfigureCommand(app)
 
 	err := icons.ConfigureCommand(app)
 	if err != nil {
@@ -78,17 +142,40 @@ func main() {
 	}
 
 	dmg.ConfigureCommand(app)
+	artifact.ConfigureCheckNamesCommand(app)
+	inspect.ConfigureCommand(app)
+	universal.ConfigureCommand(app)
+	staging.ConfigureCommand(app)
+	pipeline.ConfigureCommand(app)
+	report.ConfigureCommand(app)
+	sbom.ConfigureCommand(app)
+	attestation.ConfigureCommand(app)
 	blockmap.ConfigureCommand(app)
+	doctor.ConfigureCommand(app)
 	codesign.ConfigureCertificateInfoCommand(app)
+	codesign.ConfigureCertCommand(app)
 
 	wine.ConfigureCommand(app)
+	docker.ConfigureCommand(app)
 	rcedit.ConfigureCommand(app)
 	configureKsUidCommand(app)
+	util.ConfigureCleanupStaleTempCommand(app)
 
 	plist.ConfigurePlistCommand(app)
+	metadata.ConfigureCommand(app)
+
+	// app action is called first and only if command line is valid, pre-action errors are wrapped or have error code
+	isCommandLineValid := false
+	app.Action(func(context *kingpin.ParseContext) error {
+		isCommandLineValid = true
+		return nil
+	})
 
 	_, err = app.Parse(os.Args[1:])
 	if err != nil {
+		if _, isMessageError := err.(util.MessageError); !isCommandLineValid && !isMessageError && errors.Cause(err) == err {
+			err = util.NewCommandLineError(err)
+		}
 		util.LogErrorAndExit(err)
 	}
 }
@@ -96,13 +183,57 @@ func main() {
 func ConfigureCopyCommand(app *kingpin.Application) {
 	command := app.Command("copy", "Copy file or dir.")
 	from := command.Flag("from", "").Required().Short('f').String()
-	to := command.Flag("to", "").Required().Short('t').String()
+	to := command.Flag("to", "").Short('t').String()
 	isUseHardLinks := command.Flag("hard-link", "Whether to use hard-links if possible").Bool()
+	filters := command.Flag("filter", "The gitignore pattern of files to exclude (\"!\" to re-include), relative to the copied dir.").Strings()
+	filterFiles := command.Flag("filter-file", "The file with gitignore patterns (e.g. .gitignore).").ExistingFiles()
+	symlinkPolicy := command.Flag("symlinks", "How to copy symlinks (default: preserve or the default of the target).").Enum(fs.SymlinkPolicies...)
+	target := command.Flag("target", "The target (e.g. appimage, asar, nsis) to use the default symlink policy of.").String()
+	isPreserveHardLinks := command.Flag("preserve-hard-links", "Copy hard linked files once and hard link them in the destination.").Bool()
+	isValidateWindowsNames := command.Flag("validate-windows-names", "Check before copying that file names are valid on Windows (reserved device names, invalid characters). Enabled by default on Windows and for Windows targets.").
+		Default(strconv.FormatBool(runtime.GOOS == "windows")).Bool()
+	explain := command.Flag("explain", "Do not copy, print which rule includes or excludes the path (relative to the copied dir) as JSON.").String()
 
 	command.Action(func(context *kingpin.ParseContext) error {
 		var fileCopier fs.FileCopier
 		fileCopier.IsUseHardLinks = *isUseHardLinks
-		return errors.WithStack(fileCopier.CopyDirOrFile(*from, *to))
+		fileCopier.IsPreserveHardLinks = *isPreserveHardLinks
+		fileCopier.SymlinkPolicy = *symlinkPolicy
+		if len(fileCopier.SymlinkPolicy) == 0 {
+			fileCopier.SymlinkPolicy = fs.GetDefaultSymlinkPolicy(*target)
+		}
+
+		filter := fs.NewIgnoreMatcher()
+		for _, file := range *filterFiles {
+			err := filter.AddFile(file)
+			if err != nil {
+				return err
+			}
+		}
+		err := filter.AddPatterns(*filters, "")
+		if err != nil {
+			return err
+		}
+		fileCopier.Filter = filter
+
+		if len(*explain) != 0 {
+			info, err := os.Lstat(filepath.Join(*from, *explain))
+			if err != nil && !os.IsNotExist(err) {
+				return errors.WithStack(err)
+			}
+			return util.WriteJsonToStdOut(filter.Explain(filepath.ToSlash(*explain), info != nil && info.IsDir()))
+		}
+		if len(*to) == 0 {
+			return util.NewMessageError("required flag --to not provided", "ERR_COPY_TO_MISSING")
+		}
+
+		if *isValidateWindowsNames || fs.IsWindowsTarget(*target) {
+			err = fs.CheckWindowsNames(fs.ToLongPath(*from), filter)
+			if err != nil {
+				return err
+			}
+		}
+		return fileCopier.CopyDirOrFile(*from, *to)
 	})
 }
 
@@ -161,6 +292,7 @@ func compress() error {
 func configurePrefetchToolsCommand(app *kingpin.Application) {
 	command := app.Command("prefetch-tools", "Prefetch all required tools")
 	osName := command.Flag("osName", "").Default(runtime.GOOS).Enum("darwin", "linux", "win32")
+	download.ConfigurePriorityFlag(command, "background")
 	command.Action(func(context *kingpin.ParseContext) error {
 		_, err := linuxTools.GetAppImageToolDir()
 		if err != nil {
@@ -0,0 +1,113 @@
+package archiver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+)
+
+// AppleDouble (as written by copyfile(3) with COPYFILE_PACK): Finder info entry followed by extended attributes and resource fork entry
+const (
+	appleDoubleMagic   = 0x00051607
+	appleDoubleVersion = 0x00020000
+	attrHeaderMagic    = 0x41545452 // ATTR
+
+	entryIdResourceFork = 2
+	entryIdFinderInfo   = 9
+
+	finderInfoSize = 32
+	// magic, version, filler, number of entries and two entries
+	finderInfoOffset = 4 + 4 + 16 + 2 + 2*12
+	// finder info and 2 bytes of pad
+	attrHeaderOffset = finderInfoOffset + finderInfoSize + 2
+	// magic, debug tag, total size, data start, data length, 3 reserved, flags and number of attributes
+	firstAttrEntryOffset = attrHeaderOffset + 4*8 + 2 + 2
+
+	attrNameFinderInfo   = "com.apple.FinderInfo"
+	attrNameResourceFork = "com.apple.ResourceFork"
+)
+
+type extendedAttribute struct {
+	name string
+	data []byte
+}
+
+// createAppleDouble packs extended attributes (Finder info and resource fork are stored as own AppleDouble entries) the way ditto does, attributes are sorted by name
+func createAppleDouble(attributes []extendedAttribute) []byte {
+	var finderInfo []byte
+	var resourceFork []byte
+	var list []extendedAttribute
+	for _, attribute := range attributes {
+		switch attribute.name {
+		case attrNameFinderInfo:
+			finderInfo = attribute.data
+		case attrNameResourceFork:
+			resourceFork = attribute.data
+		default:
+			list = append(list, attribute)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].name < list[j].name
+	})
+
+	entriesSize := 0
+	for _, attribute := range list {
+		entriesSize += getAttrEntrySize(attribute.name)
+	}
+	dataStart := firstAttrEntryOffset + entriesSize
+	dataLength := 0
+	for _, attribute := range list {
+		dataLength += len(attribute.data)
+	}
+	totalSize := dataStart + dataLength
+
+	buffer := &bytes.Buffer{}
+	write := func(data interface{}) {
+		_ = binary.Write(buffer, binary.BigEndian, data)
+	}
+
+	write(uint32(appleDoubleMagic))
+	write(uint32(appleDoubleVersion))
+	buffer.WriteString("Mac OS X        ")
+	write(uint16(2))
+	// Finder info entry includes attributes
+	write([]uint32{entryIdFinderInfo, finderInfoOffset, uint32(totalSize - finderInfoOffset)})
+	write([]uint32{entryIdResourceFork, uint32(totalSize), uint32(len(resourceFork))})
+
+	paddedFinderInfo := make([]byte, finderInfoSize+2)
+	copy(paddedFinderInfo, finderInfo)
+	buffer.Write(paddedFinderInfo)
+
+	write(uint32(attrHeaderMagic))
+	// debug tag
+	write(uint32(0))
+	write([]uint32{uint32(totalSize), uint32(dataStart), uint32(dataLength), 0, 0, 0})
+	// flags
+	write(uint16(0))
+	write(uint16(len(list)))
+
+	offset := dataStart
+	for _, attribute := range list {
+		entrySize := getAttrEntrySize(attribute.name)
+		write([]uint32{uint32(offset), uint32(len(attribute.data))})
+		// flags
+		write(uint16(0))
+		buffer.WriteByte(byte(len(attribute.name) + 1))
+		buffer.WriteString(attribute.name)
+		// null-terminated and aligned to 4 bytes
+		buffer.Write(make([]byte, entrySize-(4+4+2+1+len(attribute.name))))
+		offset += len(attribute.data)
+	}
+
+	for _, attribute := range list {
+		buffer.Write(attribute.data)
+	}
+	buffer.Write(resourceFork)
+	return buffer.Bytes()
+}
+
+// offset, length, flags, name length, null-terminated name, aligned to 4 bytes
+func getAttrEntrySize(name string) int {
+	return (4 + 4 + 2 + 1 + len(name) + 1 + 3) &^ 3
+}
@@ -0,0 +1,287 @@
+package archiver
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/fs"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/reproducible"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+	"go.uber.org/zap"
+)
+
+const (
+	FormatZip      = "zip"
+	FormatSevenZip = "7z"
+
+	MethodDeflate = "deflate"
+	MethodZstd    = "zstd"
+)
+
+// already compressed content - compression only wastes time
+var DefaultStorePatterns = []string{
+	"*.zip", "*.7z", "*.gz", "*.tgz", "*.xz", "*.bz2", "*.zst", "*.br", "*.lz4",
+	"*.png", "*.jpg", "*.jpeg", "*.gif", "*.webp", "*.avif", "*.heic",
+	"*.mp3", "*.mp4", "*.m4a", "*.webm", "*.ogg", "*.opus",
+	"*.woff", "*.woff2",
+	"*.dmg", "*.AppImage", "*.snap", "*.nupkg", "*.msix", "*.appx",
+}
+
+type Options struct {
+	Dir    string
+	Output string
+	// zip or 7z, computed from output extension if not specified
+	Format string
+	// 0 (store) - 9
+	Level int
+	// compression method of zip: deflate or zstd (7z uses LZMA2)
+	Method string
+	// gitignore patterns (relative to the dir) of files stored without compression
+	StorePatterns []string
+	// gitignore patterns of files and dirs that are not added
+	Excludes []string
+	// number of compression workers, result doesn't depend on it
+	Threads int
+
+	// entry names are prefixed (the dir itself is added as entry, e.g. App.app for ditto --keepParent)
+	Prefix string
+	// permissions are not normalized
+	IsPreservePermissions bool
+}
+
+type Result struct {
+	File   string `json:"file"`
+	Format string `json:"format"`
+	// files, dirs and symlinks
+	EntryCount       int   `json:"entryCount"`
+	StoredCount      int   `json:"storedCount"`
+	UncompressedSize int64 `json:"uncompressedSize"`
+	Size             int64 `json:"size"`
+}
+
+type entry struct {
+	// slash separated path relative to the dir, without trailing slash
+	name string
+	file string
+	// normalized: 0755 or 0644 for files, 0755 for dirs, 0777 for symlinks
+	mode       os.FileMode
+	size       int64
+	modTime    time.Time
+	linkTarget string
+	isStore    bool
+	// generated content (AppleDouble), file is not used
+	data []byte
+}
+
+func (t *entry) isDir() bool {
+	return t.mode.IsDir()
+}
+
+func (t *entry) isSymlink() bool {
+	return t.mode&os.ModeSymlink != 0
+}
+
+func ConfigureCommand(app *kingpin.Application) {
+	command := app.Command("archive", "Create deterministic zip or 7z archive of the dir using parallel compression (per-file workers for zip, LZMA2 solid blocks for 7z). Result is written to stdout as JSON.")
+
+	options := Options{}
+	command.Flag("dir", "The dir to archive.").Short('d').Required().ExistingDirVar(&options.Dir)
+	command.Flag("output", "The archive file.").Short('o').Required().StringVar(&options.Output)
+	command.Flag("format", "The archive format (default: computed from the output extension).").EnumVar(&options.Format, FormatZip, FormatSevenZip)
+	command.Flag("level", "The compression level: 0 (store) - 9.").Default("7").IntVar(&options.Level)
+	command.Flag("method", "The compression method of zip.").Default(MethodDeflate).EnumVar(&options.Method, MethodDeflate, MethodZstd)
+	command.Flag("store", "The gitignore pattern of files to store without compression, can be specified several times (default: common compressed formats).").StringsVar(&options.StorePatterns)
+	command.Flag("exclude", "The gitignore pattern of files to exclude, can be specified several times.").StringsVar(&options.Excludes)
+	command.Flag("threads", "The number of compression workers.").Default("0").IntVar(&options.Threads)
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		result, err := Create(options)
+		if err != nil {
+			return err
+		}
+		return util.WriteJsonToStdOut(result)
+	})
+}
+
+func Create(options Options) (*Result, error) {
+	if len(options.Format) == 0 {
+		if strings.HasSuffix(strings.ToLower(options.Output), ".7z") {
+			options.Format = FormatSevenZip
+		} else {
+			options.Format = FormatZip
+		}
+	}
+	if options.Level < 0 || options.Level > 9 {
+		return nil, util.NewMessageError("compression level must be in range 0-9", "ERR_ARCHIVE_INVALID_LEVEL")
+	}
+	if options.Threads <= 0 {
+		options.Threads = runtime.NumCPU()
+	}
+	if options.StorePatterns == nil {
+		options.StorePatterns = DefaultStorePatterns
+	}
+
+	modTime, err := getModTime()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := collectEntries(&options, modTime)
+	if err != nil {
+		return nil, err
+	}
+	return writeArchive(entries, &options, modTime)
+}
+
+func writeArchive(entries []*entry, options *Options, modTime time.Time) (*Result, error) {
+	err := fsutil.EnsureDir(filepath.Dir(options.Output))
+	if err != nil {
+		return nil, err
+	}
+
+	// written to temp file to not leave invalid archive if failed or canceled
+	tempFile := options.Output + ".tmp"
+	defer util.RemoveOnCancel(tempFile)()
+	file, err := os.Create(tempFile)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if options.Format == FormatSevenZip {
+		err = writeSevenZip(entries, file, options)
+	} else {
+		err = writeZip(entries, file, options)
+	}
+	err = fsutil.CloseAndCheckError(err, file)
+	if err != nil {
+		_ = os.Remove(tempFile)
+		return nil, err
+	}
+
+	err = os.Rename(tempFile, options.Output)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	result := &Result{File: options.Output, Format: options.Format, EntryCount: len(entries)}
+	for _, item := range entries {
+		result.UncompressedSize += item.size
+		if item.isStore {
+			result.StoredCount++
+		}
+	}
+
+	info, err := os.Stat(options.Output)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	result.Size = info.Size()
+	log.Debug("archive created", zap.String("file", options.Output), zap.Int("entries", len(entries)), zap.Int64("size", result.Size))
+
+	if !modTime.IsZero() {
+		report := reproducible.NewReport(options.Output, options.Format, modTime)
+		report.Add("mtime", len(entries))
+		report.Add("mode", len(entries))
+		return result, report.Write()
+	}
+	return result, nil
+}
+
+// zero - modification time of files is preserved
+func getModTime() (time.Time, error) {
+	if reproducible.IsEnabled() {
+		return reproducible.GetTime()
+	}
+	return time.Time{}, nil
+}
+
+// collectEntries walks the dir in lexical order, so, entry order doesn't depend on file system
+func collectEntries(options *Options, modTime time.Time) ([]*entry, error) {
+	excludes := fs.NewIgnoreMatcher()
+	err := excludes.AddPatterns(options.Excludes, "")
+	if err != nil {
+		return nil, err
+	}
+	storeMatcher := fs.NewIgnoreMatcher()
+	err = storeMatcher.AddPatterns(options.StorePatterns, "")
+	if err != nil {
+		return nil, err
+	}
+
+	rootDir := filepath.Clean(options.Dir)
+	var result []*entry
+	err = filepath.Walk(rootDir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		var name string
+		if file == rootDir {
+			if len(options.Prefix) == 0 {
+				return nil
+			}
+		} else {
+			relativePath, err := filepath.Rel(rootDir, file)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			name = filepath.ToSlash(relativePath)
+			if excludes.IsExcluded(name, info.IsDir()) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+
+		if len(options.Prefix) != 0 {
+			name = strings.TrimSuffix(options.Prefix+"/"+name, "/")
+		}
+
+		item := &entry{name: name, file: file, modTime: info.ModTime()}
+		if !modTime.IsZero() {
+			item.modTime = modTime
+		}
+
+		switch {
+		case info.IsDir():
+			item.mode = os.ModeDir | 0755
+			if options.IsPreservePermissions {
+				item.mode = os.ModeDir | info.Mode().Perm()
+			}
+		case info.Mode()&os.ModeSymlink != 0:
+			item.linkTarget, err = os.Readlink(file)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			item.mode = os.ModeSymlink | 0777
+			item.size = int64(len(item.linkTarget))
+			item.isStore = options.Level == 0
+		case info.Mode().IsRegular():
+			item.mode = 0644
+			if info.Mode()&0111 != 0 {
+				item.mode = 0755
+			}
+			if options.IsPreservePermissions {
+				item.mode = info.Mode().Perm()
+			}
+			item.size = info.Size()
+			item.isStore = options.Level == 0 || storeMatcher.IsExcluded(name, false)
+		default:
+			log.Warn("special file is not added to archive", zap.String("file", file))
+			return nil
+		}
+		result = append(result, item)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
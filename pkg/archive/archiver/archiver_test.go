@@ -0,0 +1,229 @@
+package archiver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/klauspost/compress/zip"
+	"github.com/klauspost/compress/zstd"
+	. "github.com/onsi/gomega"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+func createTestDir(g *GomegaWithT) string {
+	dir, err := ioutil.TempDir("", "archiver")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	var data strings.Builder
+	for i := 0; i < 20000; i++ {
+		data.WriteString("line " + strconv.Itoa(i) + "\n")
+	}
+
+	g.Expect(os.MkdirAll(filepath.Join(dir, "app", "bin"), 0755)).NotTo(HaveOccurred())
+	g.Expect(os.MkdirAll(filepath.Join(dir, "empty"), 0755)).NotTo(HaveOccurred())
+	g.Expect(ioutil.WriteFile(filepath.Join(dir, "app", "data.txt"), []byte(data.String()), 0600)).NotTo(HaveOccurred())
+	g.Expect(ioutil.WriteFile(filepath.Join(dir, "app", "bin", "run"), []byte("#!/bin/sh\necho run\n"), 0700)).NotTo(HaveOccurred())
+	g.Expect(ioutil.WriteFile(filepath.Join(dir, "app", "icon.png"), []byte("not really png"), 0644)).NotTo(HaveOccurred())
+	g.Expect(ioutil.WriteFile(filepath.Join(dir, "app", "empty.txt"), nil, 0644)).NotTo(HaveOccurred())
+	g.Expect(ioutil.WriteFile(filepath.Join(dir, "debug.log"), []byte("excluded"), 0644)).NotTo(HaveOccurred())
+	g.Expect(os.Symlink("app/bin/run", filepath.Join(dir, "link"))).NotTo(HaveOccurred())
+	return dir
+}
+
+func createArchive(g *GomegaWithT, dir string, options Options) []byte {
+	options.Dir = dir
+	options.Output = filepath.Join(dir+"-out", "test."+options.Format)
+	options.Excludes = []string{"*.log"}
+	defer os.RemoveAll(dir + "-out")
+
+	result, err := Create(options)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.EntryCount).To(Equal(8))
+
+	data, err := ioutil.ReadFile(options.Output)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.Size).To(Equal(int64(len(data))))
+	return data
+}
+
+func TestZip(t *testing.T) {
+	log.InitLogger()
+	g := NewGomegaWithT(t)
+
+	dir := createTestDir(g)
+	defer os.RemoveAll(dir)
+
+	for _, method := range []string{MethodDeflate, MethodZstd} {
+		data := createArchive(g, dir, Options{Format: FormatZip, Level: 9, Method: method, Threads: 4})
+		// result doesn't depend on thread count
+		g.Expect(createArchive(g, dir, Options{Format: FormatZip, Level: 9, Method: method, Threads: 1})).To(Equal(data))
+
+		reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		g.Expect(err).NotTo(HaveOccurred())
+		reader.RegisterDecompressor(zstd.ZipMethodWinZip, zstd.ZipDecompressor())
+
+		var list []string
+		for _, file := range reader.File {
+			list = append(list, file.Name+" "+file.Mode().String()+" "+strconv.Itoa(int(file.Method)))
+		}
+		compressedMethod := strconv.Itoa(int(zip.Deflate))
+		if method == MethodZstd {
+			compressedMethod = strconv.Itoa(zstd.ZipMethodWinZip)
+		}
+		g.Expect(list).To(Equal([]string{
+			"app/ drwxr-xr-x 0",
+			"app/bin/ drwxr-xr-x 0",
+			// too small to be compressed - stored
+			"app/bin/run -rwxr-xr-x 0",
+			"app/data.txt -rw-r--r-- " + compressedMethod,
+			"app/empty.txt -rw-r--r-- 0",
+			"app/icon.png -rw-r--r-- 0",
+			"empty/ drwxr-xr-x 0",
+			"link Lrwxrwxrwx 0",
+		}))
+
+		file, err := reader.Open("app/data.txt")
+		g.Expect(err).NotTo(HaveOccurred())
+		content, err := ioutil.ReadAll(file)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(string(content)).To(HavePrefix("line 0\nline 1\n"))
+		g.Expect(strings.Count(string(content), "\n")).To(Equal(20000))
+	}
+}
+
+func TestSevenZip(t *testing.T) {
+	log.InitLogger()
+	g := NewGomegaWithT(t)
+
+	dir := createTestDir(g)
+	defer os.RemoveAll(dir)
+
+	data := createArchive(g, dir, Options{Format: FormatSevenZip, Level: 5, Threads: 4})
+	g.Expect(createArchive(g, dir, Options{Format: FormatSevenZip, Level: 5, Threads: 1})).To(Equal(data))
+
+	g.Expect(data[0:6]).To(Equal(sevenZipSignature))
+	g.Expect(binary.LittleEndian.Uint32(data[8:])).To(Equal(crc32.ChecksumIEEE(data[12:32])))
+	nextHeaderOffset := binary.LittleEndian.Uint64(data[12:])
+	nextHeaderSize := binary.LittleEndian.Uint64(data[20:])
+	header := data[32+nextHeaderOffset:]
+	g.Expect(uint64(len(header))).To(Equal(nextHeaderSize))
+	g.Expect(binary.LittleEndian.Uint32(data[28:])).To(Equal(crc32.ChecksumIEEE(header)))
+	g.Expect(header[0]).To(Equal(byte(idHeader)))
+
+	// the first folder - compressed entries (run, data.txt and link), stored icon.png is in the last copy folder
+	options := &Options{Level: 5, StorePatterns: DefaultStorePatterns, Excludes: []string{"*.log"}, Dir: dir}
+	entries, err := collectEntries(options, time.Time{})
+	g.Expect(err).NotTo(HaveOccurred())
+	_, folders := splitToFolders(entries, options)
+	g.Expect(folders).To(HaveLen(2))
+	g.Expect(folders[1].isCopy).To(BeTrue())
+
+	reader, err := lzma.NewReader2(bytes.NewReader(data[32:]))
+	g.Expect(err).NotTo(HaveOccurred())
+	content, err := ioutil.ReadAll(reader)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(int64(len(content))).To(Equal(folders[0].unpackSize))
+	g.Expect(string(content)).To(HavePrefix("#!/bin/sh\necho run\nline 0\n"))
+	g.Expect(string(content)).To(HaveSuffix("line 19999\napp/bin/run"))
+}
+
+func TestDittoZip(t *testing.T) {
+	log.InitLogger()
+	g := NewGomegaWithT(t)
+
+	dir := createTestDir(g)
+	defer os.RemoveAll(dir)
+	// AppleDouble of file copied from macOS to a file system without extended attributes support
+	g.Expect(ioutil.WriteFile(filepath.Join(dir, "app", "._data.txt"), createAppleDouble([]extendedAttribute{{name: "com.apple.cs.CodeSignature", data: []byte("sig")}}), 0644)).NotTo(HaveOccurred())
+	outDir := dir + "-out"
+	defer os.RemoveAll(outDir)
+
+	for _, isSequester := range []bool{false, true} {
+		output := filepath.Join(outDir, "test.zip")
+		_, err := CreateDittoZip(DittoOptions{Input: dir, Output: output, IsKeepParent: true, IsSequesterResources: isSequester, Level: 6, Threads: 2})
+		g.Expect(err).NotTo(HaveOccurred())
+
+		reader, err := zip.OpenReader(output)
+		g.Expect(err).NotTo(HaveOccurred())
+		var list []string
+		for _, file := range reader.File {
+			list = append(list, file.Name+" "+file.Mode().String())
+		}
+		g.Expect(reader.Close()).NotTo(HaveOccurred())
+
+		parent := filepath.Base(dir)
+		expected := []string{
+			parent + "/ drwx------",
+			parent + "/app/ drwxr-xr-x",
+			parent + "/app/bin/ drwxr-xr-x",
+			// permissions are preserved
+			parent + "/app/bin/run -rwx------",
+			parent + "/app/data.txt -rw-------",
+		}
+		if isSequester {
+			expected = append(expected,
+				parent+"/app/empty.txt -rw-r--r--",
+				parent+"/app/icon.png -rw-r--r--",
+				parent+"/debug.log -rw-r--r--",
+				parent+"/empty/ drwxr-xr-x",
+				parent+"/link Lrwxrwxrwx",
+				"__MACOSX/ drwxr-xr-x",
+				"__MACOSX/"+parent+"/ drwxr-xr-x",
+				"__MACOSX/"+parent+"/app/ drwxr-xr-x",
+				"__MACOSX/"+parent+"/app/._data.txt -rw-r--r--",
+			)
+		} else {
+			expected = append(expected,
+				parent+"/app/._data.txt -rw-r--r--",
+				parent+"/app/empty.txt -rw-r--r--",
+				parent+"/app/icon.png -rw-r--r--",
+				parent+"/debug.log -rw-r--r--",
+				parent+"/empty/ drwxr-xr-x",
+				parent+"/link Lrwxrwxrwx",
+			)
+		}
+		g.Expect(list).To(Equal(expected))
+	}
+}
+
+func TestAppleDouble(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	finderInfo := make([]byte, 32)
+	finderInfo[8] = 4
+	data := createAppleDouble([]extendedAttribute{
+		{name: "com.apple.cs.CodeSignature", data: []byte("signature")},
+		{name: attrNameFinderInfo, data: finderInfo},
+		{name: "com.apple.cs.CodeDirectory", data: []byte("cd")},
+		{name: attrNameResourceFork, data: []byte("rsrc")},
+	})
+
+	g.Expect(binary.BigEndian.Uint32(data)).To(Equal(uint32(appleDoubleMagic)))
+	g.Expect(string(data[8:24])).To(Equal("Mac OS X        "))
+	g.Expect(binary.BigEndian.Uint16(data[24:])).To(Equal(uint16(2)))
+	g.Expect(data[finderInfoOffset : finderInfoOffset+32]).To(Equal(finderInfo))
+	g.Expect(string(data[attrHeaderOffset : attrHeaderOffset+4])).To(Equal("ATTR"))
+
+	totalSize := binary.BigEndian.Uint32(data[attrHeaderOffset+8:])
+	dataStart := binary.BigEndian.Uint32(data[attrHeaderOffset+12:])
+	// Finder info entry covers attributes, resource fork follows
+	g.Expect(binary.BigEndian.Uint32(data[26+8:])).To(Equal(totalSize - finderInfoOffset))
+	g.Expect(binary.BigEndian.Uint32(data[38+4:])).To(Equal(totalSize))
+	g.Expect(string(data[totalSize:])).To(Equal("rsrc"))
+	g.Expect(binary.BigEndian.Uint16(data[firstAttrEntryOffset-2:])).To(Equal(uint16(2)))
+
+	// sorted by name, entries are aligned to 4 bytes
+	g.Expect(binary.BigEndian.Uint32(data[firstAttrEntryOffset:])).To(Equal(dataStart))
+	g.Expect(string(data[firstAttrEntryOffset+11 : firstAttrEntryOffset+11+26])).To(Equal("com.apple.cs.CodeDirectory"))
+	g.Expect(dataStart).To(Equal(uint32(firstAttrEntryOffset + 40 + 40)))
+	g.Expect(string(data[dataStart:totalSize])).To(Equal("cdsignature"))
+}
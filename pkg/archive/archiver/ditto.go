@@ -0,0 +1,233 @@
+package archiver
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/pkg/xattr"
+	"go.uber.org/zap"
+)
+
+const sequesterDir = "__MACOSX"
+
+// max length of attribute name in AppleDouble (including null terminator)
+const maxAttributeNameLength = 127
+
+// quarantine (set by the browser on download) must not be transferred to users, last used date is not a content
+var skippedAttributes = []string{"com.apple.quarantine", "com.apple.lastuseddate#PS"}
+
+type DittoOptions struct {
+	Input  string
+	Output string
+	// --keepParent: entries are prefixed with the input dir name (e.g. App.app/Contents/...)
+	IsKeepParent bool
+	// --sequesterRsrc: AppleDouble entries are stored in __MACOSX instead of next to the file
+	IsSequesterResources bool
+	Level                int
+	Threads              int
+}
+
+func ConfigureDittoCommand(app *kingpin.Application) {
+	command := app.Command("ditto-zip", "Create zip as `ditto -c -k --keepParent` does (required for notarization): symlinks, permissions, extended attributes and resource forks (AppleDouble) are preserved. Works on any host.")
+
+	options := DittoOptions{}
+	command.Flag("input", "The dir to archive (e.g. App.app).").Short('i').Required().ExistingDirVar(&options.Input)
+	command.Flag("output", "The zip file.").Short('o').Required().StringVar(&options.Output)
+	command.Flag("keep-parent", "Whether to add the input dir itself as the top-level entry.").Default("true").BoolVar(&options.IsKeepParent)
+	command.Flag("sequester-rsrc", "Whether to store extended attributes and resource forks in __MACOSX.").BoolVar(&options.IsSequesterResources)
+	command.Flag("level", "The compression level: 0 (store) - 9.").Default("6").IntVar(&options.Level)
+	command.Flag("threads", "The number of compression workers.").Default("0").IntVar(&options.Threads)
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		result, err := CreateDittoZip(options)
+		if err != nil {
+			return err
+		}
+		return util.WriteJsonToStdOut(result)
+	})
+}
+
+func CreateDittoZip(options DittoOptions) (*Result, error) {
+	archiveOptions := Options{
+		Dir:    options.Input,
+		Output: options.Output,
+		Format: FormatZip,
+		Level:  options.Level,
+		Method: MethodDeflate,
+		// ditto compresses everything
+		StorePatterns:         []string{},
+		Threads:               options.Threads,
+		IsPreservePermissions: true,
+	}
+	if options.IsKeepParent {
+		archiveOptions.Prefix = filepath.Base(filepath.Clean(options.Input))
+	}
+	if archiveOptions.Level < 0 || archiveOptions.Level > 9 {
+		return nil, util.NewMessageError("compression level must be in range 0-9", "ERR_ARCHIVE_INVALID_LEVEL")
+	}
+	if archiveOptions.Threads <= 0 {
+		archiveOptions.Threads = runtime.NumCPU()
+	}
+
+	modTime, err := getModTime()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := collectEntries(&archiveOptions, modTime)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err = addAppleDoubleEntries(entries, options.IsSequesterResources)
+	if err != nil {
+		return nil, err
+	}
+	return writeArchive(entries, &archiveOptions, modTime)
+}
+
+// addAppleDoubleEntries adds ._name entry for every entry with extended attributes.
+// Existing ._name files (source was copied from macOS to a file system without extended attributes support) are used as is if entry doesn't have own attributes.
+func addAppleDoubleEntries(entries []*entry, isSequester bool) ([]*entry, error) {
+	names := make(map[string]bool, len(entries))
+	for _, item := range entries {
+		names[item.name] = true
+	}
+
+	existingSidecars := make(map[string]*entry)
+	for _, item := range entries {
+		dir, name := path.Split(item.name)
+		if strings.HasPrefix(name, "._") && !item.isDir() && names[dir+name[2:]] {
+			existingSidecars[dir+name[2:]] = item
+		}
+	}
+
+	var result []*entry
+	var sequestered []*entry
+	for _, item := range entries {
+		if existingSidecars[getSidecarTarget(item.name)] == item {
+			continue
+		}
+		result = append(result, item)
+
+		sidecar, err := createSidecar(item)
+		if err != nil {
+			return nil, err
+		}
+		if sidecar == nil {
+			sidecar = existingSidecars[item.name]
+			if sidecar == nil {
+				continue
+			}
+		}
+
+		dir, name := path.Split(item.name)
+		if isSequester {
+			sidecar.name = sequesterDir + "/" + dir + "._" + name
+			sequestered = append(sequestered, sidecar)
+		} else {
+			sidecar.name = dir + "._" + name
+			result = append(result, sidecar)
+		}
+	}
+
+	if len(sequestered) != 0 {
+		addedDirs := make(map[string]bool)
+		for _, sidecar := range sequestered {
+			result = appendParentDirs(result, path.Dir(sidecar.name), sidecar, addedDirs)
+			result = append(result, sidecar)
+		}
+	}
+	return result, nil
+}
+
+func getSidecarTarget(name string) string {
+	dir, base := path.Split(name)
+	if !strings.HasPrefix(base, "._") {
+		return ""
+	}
+	return dir + base[2:]
+}
+
+// appendParentDirs adds dir entries of __MACOSX tree (parent first)
+func appendParentDirs(result []*entry, dir string, sidecar *entry, addedDirs map[string]bool) []*entry {
+	if dir == "." || addedDirs[dir] {
+		return result
+	}
+	result = appendParentDirs(result, path.Dir(dir), sidecar, addedDirs)
+	addedDirs[dir] = true
+	return append(result, &entry{name: dir, mode: os.ModeDir | 0755, modTime: sidecar.modTime})
+}
+
+func createSidecar(item *entry) (*entry, error) {
+	attributes, err := readExtendedAttributes(item.file)
+	if err != nil {
+		return nil, err
+	}
+	if len(attributes) == 0 {
+		return nil, nil
+	}
+
+	data := createAppleDouble(attributes)
+	return &entry{data: data, size: int64(len(data)), mode: 0644, modTime: item.modTime}, nil
+}
+
+func readExtendedAttributes(file string) ([]extendedAttribute, error) {
+	if !xattr.XATTR_SUPPORTED {
+		return nil, nil
+	}
+
+	names, err := xattr.LList(file)
+	if err != nil {
+		if isXattrNotSupported(err) {
+			return nil, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+
+	var result []extendedAttribute
+	for _, name := range names {
+		appleName, ok := getAppleAttributeName(name)
+		if !ok {
+			continue
+		}
+		if len(appleName)+1 > maxAttributeNameLength {
+			log.Warn("extended attribute name is too long for AppleDouble, skipped", zap.String("file", file), zap.String("name", appleName))
+			continue
+		}
+
+		data, err := xattr.LGet(file, name)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		result = append(result, extendedAttribute{name: appleName, data: data})
+	}
+	return result, nil
+}
+
+// on Linux only user namespace can be used for macOS attributes (e.g. user.com.apple.cs.CodeSignature)
+func getAppleAttributeName(name string) (string, bool) {
+	if runtime.GOOS == "linux" {
+		if !strings.HasPrefix(name, "user.") {
+			return "", false
+		}
+		name = name[len("user."):]
+	}
+	return name, !util.ContainsString(skippedAttributes, name)
+}
+
+func isXattrNotSupported(err error) bool {
+	xattrError, ok := err.(*xattr.Error)
+	if !ok {
+		return false
+	}
+	return xattrError.Err == syscall.ENOTSUP || xattrError.Err == syscall.EOPNOTSUPP
+}
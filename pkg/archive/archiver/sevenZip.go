@@ -0,0 +1,513 @@
+package archiver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// solid block: files are compressed in parallel by blocks, so, block size is fixed (doesn't depend on thread count) to get the same output
+const sevenZipBlockSize = 64 * 1024 * 1024
+
+// the same dictionary sizes as 7-Zip uses for level (capped by block size)
+var sevenZipDictSizes = []int{0, 64 * 1024, 1 << 20, 1 << 20, 4 << 20, 16 << 20, 16 << 20, 32 << 20, 32 << 20, 64 << 20}
+
+var sevenZipSignature = []byte{'7', 'z', 0xBC, 0xAF, 0x27, 0x1C}
+
+const sevenZipStartHeaderSize = 32
+
+// 7z property ids
+const (
+	idEnd              = 0x00
+	idHeader           = 0x01
+	idMainStreamsInfo  = 0x04
+	idFilesInfo        = 0x05
+	idPackInfo         = 0x06
+	idUnpackInfo       = 0x07
+	idSubStreamsInfo   = 0x08
+	idSize             = 0x09
+	idCrc              = 0x0A
+	idFolder           = 0x0B
+	idCodersUnpackSize = 0x0C
+	idNumUnpackStream  = 0x0D
+	idEmptyStream      = 0x0E
+	idEmptyFile        = 0x0F
+	idName             = 0x11
+	idMTime            = 0x14
+	idWinAttributes    = 0x15
+)
+
+var (
+	coderCopy  = []byte{0x00}
+	coderLzma2 = []byte{0x21}
+)
+
+const (
+	windowsAttributeDirectory     = 0x10
+	windowsAttributeUnixExtension = 0x8000
+)
+
+type sevenZipFolder struct {
+	entries    []*entry
+	isCopy     bool
+	unpackSize int64
+	dictSize   int
+
+	// computed on compress (for copy folder - on write)
+	crcs     []uint32
+	packSize int64
+	tempFile string
+}
+
+func writeSevenZip(entries []*entry, file *os.File, options *Options) error {
+	files, folders := splitToFolders(entries, options)
+
+	// compressed in parallel to temp files, written in order
+	err := util.MapAsyncConcurrency(len(folders), options.Threads, func(taskIndex int) (func() error, error) {
+		folder := folders[taskIndex]
+		if folder.isCopy {
+			return nil, nil
+		}
+		return func() error {
+			return compressFolder(folder)
+		}, nil
+	})
+	defer func() {
+		for _, folder := range folders {
+			if len(folder.tempFile) != 0 {
+				_ = os.Remove(folder.tempFile)
+			}
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(make([]byte, sevenZipStartHeaderSize))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	bufferedWriter := bufio.NewWriterSize(file, 1024*1024)
+	for _, folder := range folders {
+		if folder.isCopy {
+			err = copyFolder(folder, bufferedWriter)
+		} else {
+			err = copyFile(folder.tempFile, bufferedWriter)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	header := createSevenZipHeader(files, folders)
+	_, err = bufferedWriter.Write(header)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = bufferedWriter.Flush()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	var packSize int64
+	for _, folder := range folders {
+		packSize += folder.packSize
+	}
+	_, err = file.WriteAt(createStartHeader(packSize, header), 0)
+	return errors.WithStack(err)
+}
+
+// splitToFolders returns files in the header order - empty streams (dirs, empty files) and compressed entries in the original order, stored after
+func splitToFolders(entries []*entry, options *Options) ([]*entry, []*sevenZipFolder) {
+	var files []*entry
+	var stored []*entry
+	var folders []*sevenZipFolder
+	var current *sevenZipFolder
+	for _, item := range entries {
+		if !hasStream(item) {
+			files = append(files, item)
+			continue
+		}
+		if item.isStore {
+			stored = append(stored, item)
+			continue
+		}
+
+		files = append(files, item)
+		if current == nil || current.unpackSize >= sevenZipBlockSize {
+			current = &sevenZipFolder{}
+			folders = append(folders, current)
+		}
+		current.entries = append(current.entries, item)
+		current.unpackSize += item.size
+	}
+
+	for _, folder := range folders {
+		folder.dictSize = sevenZipDictSizes[options.Level]
+		if int64(folder.dictSize) > folder.unpackSize {
+			folder.dictSize = int(folder.unpackSize)
+		}
+		if folder.dictSize < lzma.MinDictCap {
+			folder.dictSize = lzma.MinDictCap
+		}
+	}
+
+	if len(stored) != 0 {
+		// copy coder doesn't benefit from solid block, so, single folder
+		folder := &sevenZipFolder{entries: stored, isCopy: true}
+		for _, item := range stored {
+			folder.unpackSize += item.size
+		}
+		files = append(files, stored...)
+		folders = append(folders, folder)
+	}
+	return files, folders
+}
+
+func hasStream(item *entry) bool {
+	return !item.isDir() && item.size > 0
+}
+
+func openEntry(item *entry) (io.ReadCloser, error) {
+	if item.isSymlink() {
+		return ioutil.NopCloser(strings.NewReader(item.linkTarget)), nil
+	}
+	if item.data != nil {
+		return ioutil.NopCloser(bytes.NewReader(item.data)), nil
+	}
+	file, err := os.Open(item.file)
+	return file, errors.WithStack(err)
+}
+
+// writeEntryData writes data of entry and returns CRC32, size mismatch is an error - size is already used to split to folders
+func writeEntryData(item *entry, out io.Writer) (uint32, error) {
+	reader, err := openEntry(item)
+	if err != nil {
+		return 0, err
+	}
+	defer util.Close(reader)
+
+	hash := crc32.NewIEEE()
+	n, err := io.Copy(io.MultiWriter(out, hash), reader)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if n != item.size {
+		return 0, errors.Errorf("file %s was modified during archiving (expected size: %d, actual: %d)", item.file, item.size, n)
+	}
+	return hash.Sum32(), nil
+}
+
+func compressFolder(folder *sevenZipFolder) error {
+	tempFile, err := util.CreateTempFile("archive-*.7z-folder")
+	if err != nil {
+		return err
+	}
+	folder.tempFile = tempFile.Name()
+
+	err = fsutil.CloseAndCheckError(compressFolderTo(folder, tempFile), tempFile)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(folder.tempFile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	folder.packSize = info.Size()
+	return nil
+}
+
+func compressFolderTo(folder *sevenZipFolder, out io.Writer) error {
+	bufferedWriter := bufio.NewWriterSize(out, 1024*1024)
+	config := lzma.Writer2Config{DictCap: folder.dictSize}
+	writer, err := config.NewWriter2(bufferedWriter)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, item := range folder.entries {
+		crc, err := writeEntryData(item, writer)
+		if err != nil {
+			return err
+		}
+		folder.crcs = append(folder.crcs, crc)
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(bufferedWriter.Flush())
+}
+
+func copyFolder(folder *sevenZipFolder, out io.Writer) error {
+	for _, item := range folder.entries {
+		crc, err := writeEntryData(item, out)
+		if err != nil {
+			return err
+		}
+		folder.crcs = append(folder.crcs, crc)
+	}
+	folder.packSize = folder.unpackSize
+	return nil
+}
+
+func createStartHeader(nextHeaderOffset int64, header []byte) []byte {
+	result := make([]byte, sevenZipStartHeaderSize)
+	copy(result, sevenZipSignature)
+	// version 0.4
+	result[6] = 0
+	result[7] = 4
+	binary.LittleEndian.PutUint64(result[12:], uint64(nextHeaderOffset))
+	binary.LittleEndian.PutUint64(result[20:], uint64(len(header)))
+	binary.LittleEndian.PutUint32(result[28:], crc32.ChecksumIEEE(header))
+	binary.LittleEndian.PutUint32(result[8:], crc32.ChecksumIEEE(result[12:]))
+	return result
+}
+
+type headerWriter struct {
+	bytes.Buffer
+}
+
+// writeNumber writes 7z variable length number: count of leading 1 bits of the first byte is the number of following bytes
+func (t *headerWriter) writeNumber(value uint64) {
+	firstByte := byte(0)
+	mask := byte(0x80)
+	i := 0
+	for ; i < 8; i++ {
+		if value < uint64(1)<<(7*(uint(i)+1)) {
+			firstByte |= byte(value >> (8 * uint(i)))
+			break
+		}
+		firstByte |= mask
+		mask >>= 1
+	}
+	t.WriteByte(firstByte)
+	for ; i > 0; i-- {
+		t.WriteByte(byte(value))
+		value >>= 8
+	}
+}
+
+func (t *headerWriter) writeUint32(value uint32) {
+	var buffer [4]byte
+	binary.LittleEndian.PutUint32(buffer[:], value)
+	t.Write(buffer[:])
+}
+
+func (t *headerWriter) writeUint64(value uint64) {
+	var buffer [8]byte
+	binary.LittleEndian.PutUint64(buffer[:], value)
+	t.Write(buffer[:])
+}
+
+func (t *headerWriter) writeBits(bits []bool) {
+	var b byte
+	mask := byte(0x80)
+	for _, bit := range bits {
+		if bit {
+			b |= mask
+		}
+		mask >>= 1
+		if mask == 0 {
+			t.WriteByte(b)
+			b = 0
+			mask = 0x80
+		}
+	}
+	if mask != 0x80 {
+		t.WriteByte(b)
+	}
+}
+
+// writeProperty writes property id, size and data
+func (t *headerWriter) writeProperty(id byte, data []byte) {
+	t.WriteByte(id)
+	t.writeNumber(uint64(len(data)))
+	t.Write(data)
+}
+
+func createSevenZipHeader(files []*entry, folders []*sevenZipFolder) []byte {
+	header := &headerWriter{}
+	header.WriteByte(idHeader)
+	if len(folders) != 0 {
+		header.WriteByte(idMainStreamsInfo)
+		writePackInfo(header, folders)
+		writeUnpackInfo(header, folders)
+		writeSubStreamsInfo(header, folders)
+		header.WriteByte(idEnd)
+	}
+	if len(files) != 0 {
+		writeFilesInfo(header, files)
+	}
+	header.WriteByte(idEnd)
+	return header.Bytes()
+}
+
+func writePackInfo(header *headerWriter, folders []*sevenZipFolder) {
+	header.WriteByte(idPackInfo)
+	// pack position
+	header.writeNumber(0)
+	header.writeNumber(uint64(len(folders)))
+	header.WriteByte(idSize)
+	for _, folder := range folders {
+		header.writeNumber(uint64(folder.packSize))
+	}
+	header.WriteByte(idEnd)
+}
+
+func writeUnpackInfo(header *headerWriter, folders []*sevenZipFolder) {
+	header.WriteByte(idUnpackInfo)
+	header.WriteByte(idFolder)
+	header.writeNumber(uint64(len(folders)))
+	// not external
+	header.WriteByte(0)
+	for _, folder := range folders {
+		// single coder with one in and one out stream
+		header.writeNumber(1)
+		if folder.isCopy {
+			header.WriteByte(byte(len(coderCopy)))
+			header.Write(coderCopy)
+		} else {
+			// 0x20 - has properties
+			header.WriteByte(byte(len(coderLzma2)) | 0x20)
+			header.Write(coderLzma2)
+			header.writeNumber(1)
+			header.WriteByte(lzma.EncodeDictCap(int64(folder.dictSize)))
+		}
+	}
+
+	header.WriteByte(idCodersUnpackSize)
+	for _, folder := range folders {
+		header.writeNumber(uint64(folder.unpackSize))
+	}
+	header.WriteByte(idEnd)
+}
+
+func writeSubStreamsInfo(header *headerWriter, folders []*sevenZipFolder) {
+	header.WriteByte(idSubStreamsInfo)
+	header.WriteByte(idNumUnpackStream)
+	hasSeveralStreams := false
+	for _, folder := range folders {
+		header.writeNumber(uint64(len(folder.entries)))
+		if len(folder.entries) > 1 {
+			hasSeveralStreams = true
+		}
+	}
+
+	if hasSeveralStreams {
+		// size of last stream is computed from folder unpack size
+		header.WriteByte(idSize)
+		for _, folder := range folders {
+			for _, item := range folder.entries[:len(folder.entries)-1] {
+				header.writeNumber(uint64(item.size))
+			}
+		}
+	}
+
+	// folder CRC is not set, so, CRC for each stream
+	header.WriteByte(idCrc)
+	// all defined
+	header.WriteByte(1)
+	for _, folder := range folders {
+		for _, crc := range folder.crcs {
+			header.writeUint32(crc)
+		}
+	}
+	header.WriteByte(idEnd)
+}
+
+func writeFilesInfo(header *headerWriter, files []*entry) {
+	header.WriteByte(idFilesInfo)
+	header.writeNumber(uint64(len(files)))
+
+	emptyStreams := make([]bool, len(files))
+	var emptyFiles []bool
+	hasEmptyStream := false
+	hasEmptyFile := false
+	for index, item := range files {
+		if !hasStream(item) {
+			emptyStreams[index] = true
+			hasEmptyStream = true
+			emptyFiles = append(emptyFiles, !item.isDir())
+			if !item.isDir() {
+				hasEmptyFile = true
+			}
+		}
+	}
+
+	if hasEmptyStream {
+		data := &headerWriter{}
+		data.writeBits(emptyStreams)
+		header.writeProperty(idEmptyStream, data.Bytes())
+		if hasEmptyFile {
+			data = &headerWriter{}
+			data.writeBits(emptyFiles)
+			header.writeProperty(idEmptyFile, data.Bytes())
+		}
+	}
+
+	data := &headerWriter{}
+	// not external
+	data.WriteByte(0)
+	for _, item := range files {
+		for _, c := range utf16.Encode([]rune(item.name)) {
+			data.WriteByte(byte(c))
+			data.WriteByte(byte(c >> 8))
+		}
+		data.Write([]byte{0, 0})
+	}
+	header.writeProperty(idName, data.Bytes())
+
+	data = &headerWriter{}
+	// all defined, not external
+	data.Write([]byte{1, 0})
+	for _, item := range files {
+		data.writeUint64(toFileTime(item))
+	}
+	header.writeProperty(idMTime, data.Bytes())
+
+	data = &headerWriter{}
+	data.Write([]byte{1, 0})
+	for _, item := range files {
+		attributes := uint32(windowsAttributeUnixExtension) | toUnixMode(item.mode)<<16
+		if item.isDir() {
+			attributes |= windowsAttributeDirectory
+		}
+		data.writeUint32(attributes)
+	}
+	header.writeProperty(idWinAttributes, data.Bytes())
+
+	header.WriteByte(idEnd)
+}
+
+// FILETIME - 100-nanosecond intervals since January 1, 1601
+func toFileTime(item *entry) uint64 {
+	return uint64(item.modTime.UnixNano()/100) + 116444736000000000
+}
+
+func toUnixMode(mode os.FileMode) uint32 {
+	result := uint32(mode.Perm())
+	switch {
+	case mode.IsDir():
+		result |= 0040000
+	case mode&os.ModeSymlink != 0:
+		result |= 0120000
+	default:
+		result |= 0100000
+	}
+	return result
+}
@@ -0,0 +1,291 @@
+package archiver
+
+import (
+	"bytes"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/zip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressed data of larger files is written to temp file - memory usage must not depend on file size
+const maxInMemoryCompressedSize = 8 * 1024 * 1024
+
+type zipJob struct {
+	entry *entry
+
+	done           chan struct{}
+	method         uint16
+	crc            uint32
+	compressedSize int64
+	// compressed data, if not in memory - tempFile
+	data     []byte
+	tempFile string
+	err      error
+}
+
+// fileCompressor is owned by worker, so, compressor state is reused between files
+type fileCompressor interface {
+	method() uint16
+	compress(in io.Reader, out io.Writer) error
+}
+
+type deflateCompressor struct {
+	writer *flate.Writer
+}
+
+func (t *deflateCompressor) method() uint16 {
+	return zip.Deflate
+}
+
+func (t *deflateCompressor) compress(in io.Reader, out io.Writer) error {
+	t.writer.Reset(out)
+	_, err := io.Copy(t.writer, in)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(t.writer.Close())
+}
+
+type zstdCompressor struct {
+	encoder *zstd.Encoder
+}
+
+func (t *zstdCompressor) method() uint16 {
+	return zstd.ZipMethodWinZip
+}
+
+func (t *zstdCompressor) compress(in io.Reader, out io.Writer) error {
+	t.encoder.Reset(out)
+	_, err := io.Copy(t.encoder, in)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(t.encoder.Close())
+}
+
+func createFileCompressor(options *Options) (fileCompressor, error) {
+	if options.Method == MethodZstd {
+		encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(getZstdLevel(options.Level)), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return &zstdCompressor{encoder: encoder}, nil
+	}
+
+	writer, err := flate.NewWriter(nil, options.Level)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &deflateCompressor{writer: writer}, nil
+}
+
+func getZstdLevel(level int) zstd.EncoderLevel {
+	switch {
+	case level <= 2:
+		return zstd.SpeedFastest
+	case level <= 5:
+		return zstd.SpeedDefault
+	case level <= 8:
+		return zstd.SpeedBetterCompression
+	default:
+		return zstd.SpeedBestCompression
+	}
+}
+
+// files are compressed in parallel, but written in the order of entries - output doesn't depend on scheduling and thread count
+func writeZip(entries []*entry, out io.Writer, options *Options) error {
+	jobs := make(chan *zipJob, options.Threads*2)
+	ordered := make(chan *zipJob, options.Threads*2)
+
+	compressors := make([]fileCompressor, options.Threads)
+	for i := range compressors {
+		compressor, err := createFileCompressor(options)
+		if err != nil {
+			return err
+		}
+		compressors[i] = compressor
+	}
+
+	for _, compressor := range compressors {
+		go func(compressor fileCompressor) {
+			for job := range jobs {
+				compressZipEntry(job, compressor)
+				close(job.done)
+			}
+		}(compressor)
+	}
+
+	writer := zip.NewWriter(out)
+	writeResult := make(chan error, 1)
+	go func() {
+		var result error
+		for job := range ordered {
+			<-job.done
+			if result == nil {
+				result = job.err
+				if result == nil {
+					result = writeZipEntry(writer, job)
+				}
+			}
+			if len(job.tempFile) != 0 {
+				_ = os.Remove(job.tempFile)
+			}
+		}
+		writeResult <- result
+	}()
+
+	for _, item := range entries {
+		job := &zipJob{entry: item, done: make(chan struct{})}
+		ordered <- job
+		jobs <- job
+	}
+
+	close(jobs)
+	close(ordered)
+	err := <-writeResult
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(writer.Close())
+}
+
+func compressZipEntry(job *zipJob, compressor fileCompressor) {
+	item := job.entry
+	job.method = zip.Store
+	switch {
+	case item.isDir():
+		return
+	case item.isSymlink():
+		job.data = []byte(item.linkTarget)
+		job.crc = crc32.ChecksumIEEE(job.data)
+		job.compressedSize = int64(len(job.data))
+		return
+	}
+
+	var file io.Reader
+	if item.data == nil {
+		reader, err := os.Open(item.file)
+		if err != nil {
+			job.err = errors.WithStack(err)
+			return
+		}
+		defer util.Close(reader)
+		file = reader
+	} else {
+		file = bytes.NewReader(item.data)
+	}
+
+	hash := crc32.NewIEEE()
+	if item.isStore || item.size == 0 {
+		// data is copied from the source file on write
+		_, err := io.Copy(hash, file)
+		job.crc = hash.Sum32()
+		job.compressedSize = item.size
+		job.data = item.data
+		job.err = errors.WithStack(err)
+		return
+	}
+
+	err := compressToBuffer(job, compressor, io.TeeReader(file, hash))
+	if err != nil {
+		job.err = err
+		return
+	}
+
+	job.crc = hash.Sum32()
+	if job.compressedSize >= item.size {
+		// incompressible - stored
+		job.data = item.data
+		if len(job.tempFile) != 0 {
+			_ = os.Remove(job.tempFile)
+			job.tempFile = ""
+		}
+		job.compressedSize = item.size
+		return
+	}
+	job.method = compressor.method()
+}
+
+func compressToBuffer(job *zipJob, compressor fileCompressor, in io.Reader) error {
+	if job.entry.size <= maxInMemoryCompressedSize {
+		var buffer bytes.Buffer
+		err := compressor.compress(in, &buffer)
+		if err != nil {
+			return err
+		}
+		job.data = buffer.Bytes()
+		job.compressedSize = int64(len(job.data))
+		return nil
+	}
+
+	tempFile, err := util.CreateTempFile("archive-*.zip-entry")
+	if err != nil {
+		return err
+	}
+	job.tempFile = tempFile.Name()
+
+	err = fsutil.CloseAndCheckError(compressor.compress(in, tempFile), tempFile)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(job.tempFile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	job.compressedSize = info.Size()
+	return nil
+}
+
+func writeZipEntry(writer *zip.Writer, job *zipJob) error {
+	item := job.entry
+	header := &zip.FileHeader{
+		Name:   item.name,
+		Method: job.method,
+		// UTF-8 names
+		Flags:              0x800,
+		CRC32:              job.crc,
+		CompressedSize64:   uint64(job.compressedSize),
+		UncompressedSize64: uint64(item.size),
+	}
+	if item.isDir() {
+		header.Name += "/"
+	}
+	header.SetModTime(item.modTime)
+	header.SetMode(item.mode)
+
+	entryWriter, err := writer.CreateRaw(header)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	switch {
+	case item.isDir():
+		return nil
+	case job.data != nil:
+		_, err = entryWriter.Write(job.data)
+		return errors.WithStack(err)
+	case len(job.tempFile) != 0:
+		return copyFile(job.tempFile, entryWriter)
+	default:
+		return copyFile(item.file, entryWriter)
+	}
+}
+
+func copyFile(file string, out io.Writer) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(in)
+
+	_, err = io.Copy(out, in)
+	return errors.WithStack(err)
+}
@@ -0,0 +1,65 @@
+package squashfs
+
+import (
+	"bytes"
+	"compress/zlib"
+
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// compressor must be safe for concurrent use - data blocks are compressed in parallel
+type compressor func(data []byte) ([]byte, error)
+
+func getCompressor(compression string, blockSize int) (uint16, compressor, error) {
+	switch compression {
+	case "", "gzip":
+		return compressionGzip, func(data []byte) ([]byte, error) {
+			var buffer bytes.Buffer
+			writer, err := zlib.NewWriterLevel(&buffer, zlib.BestCompression)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			_, err = writer.Write(data)
+			if err == nil {
+				err = writer.Close()
+			}
+			return buffer.Bytes(), errors.WithStack(err)
+		}, nil
+
+	case "xz":
+		// kernel expects dictionary not larger than block size if compression options are not stored, CRC64 is not supported by old kernels
+		config := xz.WriterConfig{DictCap: blockSize, CheckSum: xz.CRC32}
+		err := config.Verify()
+		if err != nil {
+			return 0, nil, errors.WithStack(err)
+		}
+		return compressionXz, func(data []byte) ([]byte, error) {
+			var buffer bytes.Buffer
+			writer, err := config.NewWriter(&buffer)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			_, err = writer.Write(data)
+			if err == nil {
+				err = writer.Close()
+			}
+			return buffer.Bytes(), errors.WithStack(err)
+		}, nil
+
+	case "zstd":
+		// EncodeAll is safe for concurrent use
+		encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression), zstd.WithWindowSize(blockSize), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return 0, nil, errors.WithStack(err)
+		}
+		return compressionZstd, func(data []byte) ([]byte, error) {
+			return encoder.EncodeAll(data, nil), nil
+		}, nil
+
+	default:
+		return 0, nil, util.NewMessageError("squashfs compression "+compression+" is not supported (gzip, xz and zstd are supported)", "ERR_SQUASHFS_UNSUPPORTED_COMPRESSION")
+	}
+}
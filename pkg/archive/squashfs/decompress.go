@@ -0,0 +1,85 @@
+package squashfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+const (
+	compressionGzip = 1
+	compressionLzma = 2
+	compressionLzo  = 3
+	compressionXz   = 4
+	compressionLz4  = 5
+	compressionZstd = 6
+)
+
+type decompressor func(data []byte, maxSize int) ([]byte, error)
+
+func getDecompressor(compressionId uint16) (decompressor, error) {
+	switch compressionId {
+	case compressionGzip:
+		return func(data []byte, maxSize int) ([]byte, error) {
+			reader, err := zlib.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			return readLimited(reader, maxSize)
+		}, nil
+
+	case compressionLzma:
+		return func(data []byte, maxSize int) ([]byte, error) {
+			reader, err := lzma.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			return readLimited(reader, maxSize)
+		}, nil
+
+	case compressionXz:
+		return func(data []byte, maxSize int) ([]byte, error) {
+			reader, err := xz.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			return readLimited(reader, maxSize)
+		}, nil
+
+	case compressionZstd:
+		decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(64*1024*1024))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return func(data []byte, maxSize int) ([]byte, error) {
+			result, err := decoder.DecodeAll(data, make([]byte, 0, maxSize))
+			return result, errors.WithStack(err)
+		}, nil
+
+	case compressionLzo, compressionLz4:
+		name := "lzo"
+		if compressionId == compressionLz4 {
+			name = "lz4"
+		}
+		return nil, util.NewMessageError("squashfs image is compressed using "+name+", that is not supported, please install unsquashfs", "ERR_SQUASHFS_UNSUPPORTED_COMPRESSION")
+
+	default:
+		return nil, errors.Errorf("unknown squashfs compression %d", compressionId)
+	}
+}
+
+// decompressed block cannot be larger than block size, limit to not allocate memory for malformed input
+func readLimited(reader io.Reader, maxSize int) ([]byte, error) {
+	result, err := ioutil.ReadAll(io.LimitReader(reader, int64(maxSize)+1))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return result, nil
+}
@@ -0,0 +1,112 @@
+package squashfs
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+	"go.uber.org/zap"
+)
+
+func ConfigureUnsquashfsCommand(app *kingpin.Application) {
+	command := app.Command("unsquashfs", "Extract squashfs image (e.g. base or core snap) without unsquashfs installed.")
+	input := command.Flag("input", "The squashfs image.").Short('i').Required().ExistingFile()
+	output := command.Flag("output", "The output dir.").Short('o').Required().String()
+	paths := command.Flag("path", "Extract only this file or dir (slash-separated, relative to the image root).").Strings()
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		// empty dir must be not used to ensure that some dir will be not removed by mistake, client should clean if need
+		err := fsutil.EnsureDir(*output)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return ExtractFile(*input, *output, *paths)
+	})
+}
+
+// ExtractFile extracts image to the output dir. If paths are specified, only these files or dirs (and parent dirs) are extracted.
+func ExtractFile(file string, outputDir string, paths []string) error {
+	reader, closer, err := OpenFile(file)
+	if err != nil {
+		return err
+	}
+
+	defer util.Close(closer)
+	return reader.Extract(outputDir, paths)
+}
+
+func (t *Reader) Extract(outputDir string, paths []string) error {
+	outputDir = filepath.Clean(outputDir)
+	normalizedPaths := make([]string, len(paths))
+	for i, p := range paths {
+		normalizedPaths[i] = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(p)), "/")
+	}
+
+	count := 0
+	err := t.Walk(func(entry *Entry) error {
+		if !isIncluded(entry.Path, normalizedPaths) {
+			return nil
+		}
+
+		count++
+		return t.extractEntry(entry, filepath.Join(outputDir, filepath.FromSlash(entry.Path)))
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Debug("squashfs extracted", zap.String("outputDir", outputDir), zap.Int("entries", count))
+	return nil
+}
+
+// entry is included if it is one of the requested paths, inside or a parent of it
+func isIncluded(entryPath string, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+
+	for _, p := range paths {
+		if p == "" || entryPath == p || strings.HasPrefix(entryPath, p+"/") || strings.HasPrefix(p, entryPath+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Reader) extractEntry(entry *Entry, filePath string) error {
+	switch {
+	case entry.IsDir():
+		// owner must be able to write to dir to extract its content
+		err := os.MkdirAll(filePath, entry.Mode.Perm()|0700)
+		return errors.WithStack(err)
+
+	case entry.Mode&os.ModeSymlink != 0:
+		err := os.Symlink(entry.LinkTarget, filePath)
+		return errors.WithStack(err)
+
+	case entry.Mode.IsRegular():
+		file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, entry.Mode.Perm())
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		writer := bufio.NewWriterSize(file, 64*1024)
+		err = t.WriteTo(entry, writer)
+		if err == nil {
+			err = writer.Flush()
+		}
+		return fsutil.CloseAndCheckError(err, file)
+
+	default:
+		// devices, fifo and sockets cannot be created without root and not required for packaging
+		log.Debug("special file is skipped", zap.String("path", entry.Path), zap.Stringer("mode", entry.Mode))
+		return nil
+	}
+}
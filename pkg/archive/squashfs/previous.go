@@ -0,0 +1,181 @@
+package squashfs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync/atomic"
+
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"go.uber.org/zap"
+)
+
+// markUnchanged compares files with the previous image and sets previous inode for files with the same content.
+// Only files without tail in a fragment are reused (snap is packed without fragments).
+func (t *Writer) markUnchanged(previous *Reader) error {
+	if previous.super.BlockSize != uint32(t.options.BlockSize) || previous.super.CompressionId != t.compressionId {
+		log.Warn("previous image uses another compression or block size, data is not reused", zap.String("file", t.options.PreviousImage))
+		return nil
+	}
+
+	previousFiles := make(map[string]*Entry)
+	err := previous.Walk(func(entry *Entry) error {
+		if entry.Mode.IsRegular() {
+			previousFiles[entry.Path] = entry
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	type candidate struct {
+		entry    *sourceEntry
+		previous *inode
+	}
+	var candidates []candidate
+	var collect func(dir *sourceEntry, dirPath string)
+	collect = func(dir *sourceEntry, dirPath string) {
+		for _, entry := range dir.children {
+			entryPath := path.Join(dirPath, entry.name)
+			if entry.mode.IsDir() {
+				collect(entry, entryPath)
+				continue
+			}
+
+			previousEntry := previousFiles[entryPath]
+			if previousEntry == nil || !entry.mode.IsRegular() || previousEntry.Size != entry.size || !t.isWholeBlocks(entry.size) {
+				continue
+			}
+			if previousEntry.inode.fragmentIndex != noFragment {
+				continue
+			}
+			candidates = append(candidates, candidate{entry: entry, previous: previousEntry.inode})
+		}
+	}
+	collect(t.root, "")
+
+	// data blocks are read without metadata cache, so, safe for concurrent use
+	var unchangedCount int32
+	err = util.MapAsync(len(candidates), func(taskIndex int) (func() error, error) {
+		item := candidates[taskIndex]
+		return func() error {
+			isEqual, err := t.isSameContent(item.entry, item.previous, previous)
+			if err != nil {
+				return err
+			}
+			if isEqual {
+				item.entry.previous = item.previous
+				atomic.AddInt32(&unchangedCount, 1)
+			}
+			return nil
+		}, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Debug("unchanged files", zap.Int32("count", unchangedCount), zap.Int("candidates", len(candidates)))
+	return nil
+}
+
+// file is not packed into fragment
+func (t *Writer) isWholeBlocks(size int64) bool {
+	return t.options.NoFragments || size%int64(t.options.BlockSize) == 0
+}
+
+func (t *Writer) isSameContent(entry *sourceEntry, previousInode *inode, previous *Reader) (bool, error) {
+	file, err := os.Open(entry.file)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	defer util.Close(file)
+
+	blockSize := int64(t.options.BlockSize)
+	data := make([]byte, blockSize)
+	remaining := entry.size
+	offset := previousInode.blocksStart
+	for _, storedSize := range previousInode.blockSizes {
+		size := blockSize
+		if remaining < size {
+			size = remaining
+		}
+		_, err = io.ReadFull(file, data[:size])
+		if err != nil {
+			return false, errors.WithMessage(err, "cannot read "+entry.file+" (modified during packaging?)")
+		}
+		remaining -= size
+
+		var previousData []byte
+		diskSize := storedSize &^ uncompressedBlockFlag
+		if diskSize == 0 {
+			if !isZero(data[:size]) {
+				return false, nil
+			}
+			continue
+		}
+
+		previousData, err = previous.readBlock(offset, diskSize, storedSize&uncompressedBlockFlag == 0, t.options.BlockSize)
+		if err != nil {
+			return false, err
+		}
+		offset += uint64(diskSize)
+		if !bytes.Equal(previousData, data[:size]) {
+			return false, nil
+		}
+	}
+	return remaining == 0, nil
+}
+
+// addPreviousData copies data blocks of unchanged files as is, in the same order as in the previous image - if files before are also unchanged, location is the same
+func (t *imageWriter) addPreviousData(previous *Reader, submit func(job *blockJob)) error {
+	var unchanged []*sourceEntry
+	var collect func(dir *sourceEntry)
+	collect = func(dir *sourceEntry) {
+		for _, entry := range dir.children {
+			if entry.mode.IsDir() {
+				collect(entry)
+			} else if entry.previous != nil {
+				unchanged = append(unchanged, entry)
+			}
+		}
+	}
+	collect(t.root)
+
+	sort.SliceStable(unchanged, func(i, j int) bool {
+		return unchanged[i].previous.blocksStart < unchanged[j].previous.blocksStart
+	})
+
+	for _, entry := range unchanged {
+		entry := entry
+		offset := entry.previous.blocksStart
+		for _, storedSize := range entry.previous.blockSizes {
+			job := &blockJob{
+				isRaw:   true,
+				rawSize: storedSize,
+				onWritten: func(start uint64, size uint32) {
+					if len(entry.blockSizes) == 0 {
+						entry.blocksStart = start
+					}
+					entry.blockSizes = append(entry.blockSizes, size)
+				},
+			}
+
+			diskSize := storedSize &^ uncompressedBlockFlag
+			if diskSize != 0 {
+				job.data = make([]byte, diskSize)
+				_, err := previous.file.ReadAt(job.data, int64(offset))
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				offset += uint64(diskSize)
+			}
+			submit(job)
+		}
+	}
+	return nil
+}
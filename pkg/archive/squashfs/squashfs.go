@@ -0,0 +1,694 @@
+package squashfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+)
+
+// https://dr-emann.github.io/squashfs/
+
+const (
+	magic             = 0x73717368
+	superblockSize    = 96
+	metadataBlockSize = 8192
+
+	// superblock flags
+	flagNoFragments = 0x0010
+
+	// block size bit indicating that block is stored uncompressed
+	uncompressedBlockFlag    = 1 << 24
+	uncompressedMetadataFlag = 0x8000
+
+	noFragment = 0xFFFFFFFF
+)
+
+type inodeType uint16
+
+const (
+	inodeDir         inodeType = 1
+	inodeFile        inodeType = 2
+	inodeSymlink     inodeType = 3
+	inodeBlockDevice inodeType = 4
+	inodeCharDevice  inodeType = 5
+	inodeFifo        inodeType = 6
+	inodeSocket      inodeType = 7
+	// extended types are basic type + 7
+	inodeExtendedDir     inodeType = 8
+	inodeExtendedFile    inodeType = 9
+	inodeExtendedSymlink inodeType = 10
+)
+
+type superblock struct {
+	Magic               uint32
+	InodeCount          uint32
+	ModificationTime    uint32
+	BlockSize           uint32
+	FragmentEntryCount  uint32
+	CompressionId       uint16
+	BlockLog            uint16
+	Flags               uint16
+	IdCount             uint16
+	VersionMajor        uint16
+	VersionMinor        uint16
+	RootInodeRef        uint64
+	BytesUsed           uint64
+	IdTableStart        uint64
+	XattrIdTableStart   uint64
+	InodeTableStart     uint64
+	DirectoryTableStart uint64
+	FragmentTableStart  uint64
+	ExportTableStart    uint64
+}
+
+type fragmentEntry struct {
+	Start  uint64
+	Size   uint32
+	Unused uint32
+}
+
+// Reader reads squashfs image (e.g. snap) without unsquashfs installed on the host.
+type Reader struct {
+	file       io.ReaderAt
+	super      superblock
+	decompress decompressor
+
+	fragments []fragmentEntry
+	ids       []uint32
+
+	// inode and directory tables are small, decompressed blocks are cached to not decompress the same block for each entry
+	metadataCache map[uint64]metadataBlock
+	// files are packed to fragments in the directory order, so, the last fragment is the one that most likely will be requested next
+	lastFragmentIndex uint32
+	lastFragment      []byte
+}
+
+type metadataBlock struct {
+	data []byte
+	// size on disk including header
+	size uint64
+}
+
+// Entry is a file, directory or symlink in the image
+type Entry struct {
+	// slash-separated path relative to the image root
+	Path string
+	Mode os.FileMode
+	Uid  uint32
+	Gid  uint32
+	// for regular files
+	Size int64
+	// for symlinks
+	LinkTarget string
+
+	inode *inode
+}
+
+func (t *Entry) IsDir() bool {
+	return t.Mode.IsDir()
+}
+
+type inode struct {
+	kind inodeType
+	mode os.FileMode
+	uid  uint32
+	gid  uint32
+
+	// directory
+	dirBlockIndex  uint32
+	dirBlockOffset uint16
+	dirSize        uint32
+
+	// file
+	blocksStart    uint64
+	fileSize       uint64
+	fragmentIndex  uint32
+	fragmentOffset uint32
+	blockSizes     []uint32
+
+	linkTarget string
+}
+
+func NewReader(file io.ReaderAt) (*Reader, error) {
+	header := make([]byte, superblockSize)
+	_, err := file.ReadAt(header, 0)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	t := &Reader{file: file, metadataCache: make(map[uint64]metadataBlock), lastFragmentIndex: noFragment}
+	err = binary.Read(bytes.NewReader(header), binary.LittleEndian, &t.super)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if t.super.Magic != magic {
+		return nil, errors.New("not a squashfs image")
+	}
+	if t.super.VersionMajor != 4 {
+		return nil, errors.Errorf("squashfs %d.%d is not supported", t.super.VersionMajor, t.super.VersionMinor)
+	}
+	if t.super.BlockSize == 0 || t.super.BlockSize > 1024*1024 {
+		return nil, errors.Errorf("invalid block size %d", t.super.BlockSize)
+	}
+
+	t.decompress, err = getDecompressor(t.super.CompressionId)
+	if err != nil {
+		return nil, err
+	}
+
+	t.ids, err = t.readIds()
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Walk calls fn for each entry of the image in the directory order (parent before its children)
+func (t *Reader) Walk(fn func(entry *Entry) error) error {
+	root, err := t.readInode(t.super.RootInodeRef)
+	if err != nil {
+		return err
+	}
+	if root.kind != inodeDir && root.kind != inodeExtendedDir {
+		return errors.New("root inode is not a directory")
+	}
+	return t.walkDir("", root, fn)
+}
+
+func (t *Reader) walkDir(dirPath string, dir *inode, fn func(entry *Entry) error) error {
+	entries, err := t.readDir(dirPath, dir, "")
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		err = fn(entry)
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			err = t.walkDir(entry.Path, entry.inode, fn)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Open returns entry by slash-separated path relative to the image root
+func (t *Reader) Open(name string) (*Entry, error) {
+	current, err := t.readInode(t.super.RootInodeRef)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Entry{Path: "", Mode: current.mode, Uid: current.uid, Gid: current.gid, inode: current}
+	currentPath := ""
+	for _, segment := range strings.Split(path.Clean("/"+name), "/") {
+		if segment == "" {
+			continue
+		}
+
+		if !result.IsDir() {
+			return nil, errors.Errorf("%s is not a directory", currentPath)
+		}
+
+		entries, err := t.readDir(currentPath, result.inode, segment)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			// without stack to allow client to check using os.IsNotExist
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		result = entries[0]
+		currentPath = result.Path
+	}
+	return result, nil
+}
+
+// ReadFile returns content of a regular file
+func (t *Reader) ReadFile(name string) ([]byte, error) {
+	entry, err := t.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	buffer := bytes.NewBuffer(make([]byte, 0, int(entry.Size)))
+	err = t.WriteTo(entry, buffer)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// WriteTo writes content of a regular file
+func (t *Reader) WriteTo(entry *Entry, writer io.Writer) error {
+	node := entry.inode
+	if node.kind != inodeFile && node.kind != inodeExtendedFile {
+		return errors.Errorf("%s is not a regular file", entry.Path)
+	}
+
+	remaining := node.fileSize
+	offset := node.blocksStart
+	for _, blockSize := range node.blockSizes {
+		expectedSize := uint64(t.super.BlockSize)
+		if remaining < expectedSize {
+			expectedSize = remaining
+		}
+
+		var data []byte
+		size := blockSize &^ uncompressedBlockFlag
+		if size == 0 {
+			// sparse block
+			data = make([]byte, expectedSize)
+		} else {
+			var err error
+			data, err = t.readBlock(offset, size, blockSize&uncompressedBlockFlag == 0, int(t.super.BlockSize))
+			if err != nil {
+				return err
+			}
+			offset += uint64(size)
+		}
+
+		if uint64(len(data)) != expectedSize {
+			return errors.Errorf("%s: block size %d doesn't match expected %d", entry.Path, len(data), expectedSize)
+		}
+
+		_, err := writer.Write(data)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		remaining -= expectedSize
+	}
+
+	if remaining == 0 {
+		return nil
+	}
+
+	if node.fragmentIndex == noFragment {
+		return errors.Errorf("%s is truncated: %d bytes are missing", entry.Path, remaining)
+	}
+
+	fragment, err := t.readFragment(node.fragmentIndex)
+	if err != nil {
+		return err
+	}
+
+	end := uint64(node.fragmentOffset) + remaining
+	if end > uint64(len(fragment)) {
+		return errors.Errorf("%s: fragment is out of bounds", entry.Path)
+	}
+
+	_, err = writer.Write(fragment[node.fragmentOffset:end])
+	return errors.WithStack(err)
+}
+
+// if onlyName is specified, inode is read only for the entry with this name
+func (t *Reader) readDir(dirPath string, dir *inode, onlyName string) ([]*Entry, error) {
+	// size includes 3 bytes for implicit . and .. entries
+	if dir.dirSize <= 3 {
+		return nil, nil
+	}
+
+	reader := t.newMetadataReader(t.super.DirectoryTableStart, uint64(dir.dirBlockIndex), dir.dirBlockOffset)
+	data, err := reader.read(int(dir.dirSize - 3))
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*Entry
+	for len(data) > 0 {
+		if len(data) < 12 {
+			return nil, errors.New("directory header is truncated")
+		}
+
+		count := binary.LittleEndian.Uint32(data) + 1
+		inodeBlock := binary.LittleEndian.Uint32(data[4:])
+		data = data[12:]
+
+		for i := uint32(0); i < count; i++ {
+			if len(data) < 8 {
+				return nil, errors.New("directory entry is truncated")
+			}
+
+			inodeOffset := binary.LittleEndian.Uint16(data)
+			nameSize := int(binary.LittleEndian.Uint16(data[6:])) + 1
+			if len(data) < 8+nameSize {
+				return nil, errors.New("directory entry name is truncated")
+			}
+
+			name := string(data[8 : 8+nameSize])
+			data = data[8+nameSize:]
+			if name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+				return nil, errors.Errorf("invalid directory entry name %q", name)
+			}
+			if len(onlyName) != 0 && name != onlyName {
+				continue
+			}
+
+			node, err := t.readInode(uint64(inodeBlock)<<16 | uint64(inodeOffset))
+			if err != nil {
+				return nil, err
+			}
+
+			entry := &Entry{
+				Path:       path.Join(dirPath, name),
+				Mode:       node.mode,
+				Uid:        node.uid,
+				Gid:        node.gid,
+				Size:       int64(node.fileSize),
+				LinkTarget: node.linkTarget,
+				inode:      node,
+			}
+			result = append(result, entry)
+		}
+	}
+	return result, nil
+}
+
+func (t *Reader) readInode(ref uint64) (*inode, error) {
+	reader := t.newMetadataReader(t.super.InodeTableStart, ref>>16, uint16(ref&0xFFFF))
+	header, err := reader.read(16)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &inode{kind: inodeType(binary.LittleEndian.Uint16(header))}
+	permissions := os.FileMode(binary.LittleEndian.Uint16(header[2:]))
+	result.mode = permissions & os.ModePerm
+	if permissions&04000 != 0 {
+		result.mode |= os.ModeSetuid
+	}
+	if permissions&02000 != 0 {
+		result.mode |= os.ModeSetgid
+	}
+	if permissions&01000 != 0 {
+		result.mode |= os.ModeSticky
+	}
+
+	result.uid, err = t.getId(binary.LittleEndian.Uint16(header[4:]))
+	if err != nil {
+		return nil, err
+	}
+	result.gid, err = t.getId(binary.LittleEndian.Uint16(header[6:]))
+	if err != nil {
+		return nil, err
+	}
+
+	switch result.kind {
+	case inodeDir:
+		data, err := reader.read(16)
+		if err != nil {
+			return nil, err
+		}
+		result.mode |= os.ModeDir
+		result.dirBlockIndex = binary.LittleEndian.Uint32(data)
+		result.dirSize = uint32(binary.LittleEndian.Uint16(data[8:]))
+		result.dirBlockOffset = binary.LittleEndian.Uint16(data[10:])
+
+	case inodeExtendedDir:
+		data, err := reader.read(24)
+		if err != nil {
+			return nil, err
+		}
+		result.mode |= os.ModeDir
+		result.dirSize = binary.LittleEndian.Uint32(data[4:])
+		result.dirBlockIndex = binary.LittleEndian.Uint32(data[8:])
+		result.dirBlockOffset = binary.LittleEndian.Uint16(data[18:])
+
+	case inodeFile:
+		data, err := reader.read(16)
+		if err != nil {
+			return nil, err
+		}
+		result.blocksStart = uint64(binary.LittleEndian.Uint32(data))
+		result.fragmentIndex = binary.LittleEndian.Uint32(data[4:])
+		result.fragmentOffset = binary.LittleEndian.Uint32(data[8:])
+		result.fileSize = uint64(binary.LittleEndian.Uint32(data[12:]))
+		err = t.readBlockSizes(reader, result)
+		if err != nil {
+			return nil, err
+		}
+
+	case inodeExtendedFile:
+		data, err := reader.read(40)
+		if err != nil {
+			return nil, err
+		}
+		result.blocksStart = binary.LittleEndian.Uint64(data)
+		result.fileSize = binary.LittleEndian.Uint64(data[8:])
+		result.fragmentIndex = binary.LittleEndian.Uint32(data[28:])
+		result.fragmentOffset = binary.LittleEndian.Uint32(data[32:])
+		err = t.readBlockSizes(reader, result)
+		if err != nil {
+			return nil, err
+		}
+
+	case inodeSymlink, inodeExtendedSymlink:
+		data, err := reader.read(8)
+		if err != nil {
+			return nil, err
+		}
+		targetSize := binary.LittleEndian.Uint32(data[4:])
+		if targetSize > 4096 {
+			return nil, errors.Errorf("invalid symlink target size %d", targetSize)
+		}
+		target, err := reader.read(int(targetSize))
+		if err != nil {
+			return nil, err
+		}
+		result.mode |= os.ModeSymlink
+		result.linkTarget = string(target)
+
+	case inodeBlockDevice, inodeBlockDevice + 7:
+		result.mode |= os.ModeDevice
+	case inodeCharDevice, inodeCharDevice + 7:
+		result.mode |= os.ModeDevice | os.ModeCharDevice
+	case inodeFifo, inodeFifo + 7:
+		result.mode |= os.ModeNamedPipe
+	case inodeSocket, inodeSocket + 7:
+		result.mode |= os.ModeSocket
+
+	default:
+		return nil, errors.Errorf("unknown inode type %d", result.kind)
+	}
+	return result, nil
+}
+
+func (t *Reader) readBlockSizes(reader *metadataReader, node *inode) error {
+	blockSize := uint64(t.super.BlockSize)
+	blockCount := node.fileSize / blockSize
+	if node.fragmentIndex == noFragment && node.fileSize%blockSize != 0 {
+		blockCount++
+	}
+	if blockCount > t.super.BytesUsed {
+		return errors.Errorf("invalid file size %d", node.fileSize)
+	}
+
+	data, err := reader.read(int(blockCount) * 4)
+	if err != nil {
+		return err
+	}
+
+	node.blockSizes = make([]uint32, blockCount)
+	for i := range node.blockSizes {
+		node.blockSizes[i] = binary.LittleEndian.Uint32(data[i*4:])
+	}
+	return nil
+}
+
+func (t *Reader) getId(index uint16) (uint32, error) {
+	if int(index) >= len(t.ids) {
+		return 0, errors.Errorf("id index %d is out of bounds", index)
+	}
+	return t.ids[index], nil
+}
+
+func (t *Reader) readIds() ([]uint32, error) {
+	data, err := t.readLookupTable(t.super.IdTableStart, int(t.super.IdCount)*4)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot read id table")
+	}
+
+	result := make([]uint32, t.super.IdCount)
+	for i := range result {
+		result[i] = binary.LittleEndian.Uint32(data[i*4:])
+	}
+	return result, nil
+}
+
+func (t *Reader) readFragment(index uint32) ([]byte, error) {
+	if t.fragments == nil {
+		if t.super.Flags&flagNoFragments != 0 {
+			return nil, errors.New("image doesn't contain fragments")
+		}
+
+		data, err := t.readLookupTable(t.super.FragmentTableStart, int(t.super.FragmentEntryCount)*16)
+		if err != nil {
+			return nil, errors.WithMessage(err, "cannot read fragment table")
+		}
+
+		fragments := make([]fragmentEntry, t.super.FragmentEntryCount)
+		err = binary.Read(bytes.NewReader(data), binary.LittleEndian, fragments)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		t.fragments = fragments
+	}
+
+	if int(index) >= len(t.fragments) {
+		return nil, errors.Errorf("fragment index %d is out of bounds", index)
+	}
+
+	if index == t.lastFragmentIndex {
+		return t.lastFragment, nil
+	}
+
+	entry := t.fragments[index]
+	data, err := t.readBlock(entry.Start, entry.Size&^uncompressedBlockFlag, entry.Size&uncompressedBlockFlag == 0, int(t.super.BlockSize))
+	if err != nil {
+		return nil, err
+	}
+
+	t.lastFragmentIndex = index
+	t.lastFragment = data
+	return data, nil
+}
+
+// lookup table (ids, fragments) is a list of metadata block locations followed by the metadata blocks
+func (t *Reader) readLookupTable(start uint64, size int) ([]byte, error) {
+	if size == 0 {
+		return nil, nil
+	}
+
+	blockCount := (size + metadataBlockSize - 1) / metadataBlockSize
+	locations := make([]byte, blockCount*8)
+	_, err := t.file.ReadAt(locations, int64(start))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	result := make([]byte, 0, size)
+	for i := 0; i < blockCount; i++ {
+		block, _, err := t.readMetadataBlock(binary.LittleEndian.Uint64(locations[i*8:]))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, block...)
+	}
+
+	if len(result) < size {
+		return nil, errors.Errorf("table is truncated: %d bytes expected, got %d", size, len(result))
+	}
+	return result[:size], nil
+}
+
+// returns uncompressed data and size of the block on disk
+func (t *Reader) readMetadataBlock(offset uint64) ([]byte, uint64, error) {
+	cached, ok := t.metadataCache[offset]
+	if ok {
+		return cached.data, cached.size, nil
+	}
+
+	header := make([]byte, 2)
+	_, err := t.file.ReadAt(header, int64(offset))
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+
+	value := binary.LittleEndian.Uint16(header)
+	size := uint32(value &^ uncompressedMetadataFlag)
+	data, err := t.readBlock(offset+2, size, value&uncompressedMetadataFlag == 0, metadataBlockSize)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	t.metadataCache[offset] = metadataBlock{data: data, size: uint64(size) + 2}
+	return data, uint64(size) + 2, nil
+}
+
+func (t *Reader) readBlock(offset uint64, size uint32, isCompressed bool, maxSize int) ([]byte, error) {
+	if size > uint32(maxSize)+uint32(maxSize)/16+1024 {
+		return nil, errors.Errorf("invalid block size %d at %d", size, offset)
+	}
+
+	data := make([]byte, size)
+	_, err := t.file.ReadAt(data, int64(offset))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if !isCompressed {
+		return data, nil
+	}
+
+	result, err := t.decompress(data, maxSize)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "cannot decompress block at %d", offset)
+	}
+	if len(result) > maxSize {
+		return nil, errors.Errorf("block at %d is larger than %d", offset, maxSize)
+	}
+	return result, nil
+}
+
+type metadataReader struct {
+	reader *Reader
+	// next block location (absolute)
+	next   uint64
+	buffer []byte
+	// offset in the first block
+	skip int
+}
+
+func (t *Reader) newMetadataReader(tableStart uint64, blockOffset uint64, offset uint16) *metadataReader {
+	return &metadataReader{reader: t, next: tableStart + blockOffset, skip: int(offset)}
+}
+
+func (t *metadataReader) read(size int) ([]byte, error) {
+	for len(t.buffer) < size+t.skip {
+		block, blockSize, err := t.reader.readMetadataBlock(t.next)
+		if err != nil {
+			return nil, err
+		}
+		if len(block) == 0 {
+			return nil, errors.New("empty metadata block")
+		}
+		t.next += blockSize
+		t.buffer = append(t.buffer, block...)
+	}
+
+	if t.skip > 0 {
+		t.buffer = t.buffer[t.skip:]
+		t.skip = 0
+	}
+
+	result := t.buffer[:size:size]
+	t.buffer = t.buffer[size:]
+	return result, nil
+}
+
+// OpenFile opens squashfs image, returned closer must be closed after use
+func OpenFile(file string) (*Reader, io.Closer, error) {
+	reader, err := os.Open(file)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	result, err := NewReader(reader)
+	if err != nil {
+		util.Close(reader)
+		return nil, nil, errors.WithMessage(err, "cannot read "+file)
+	}
+	return result, reader, nil
+}
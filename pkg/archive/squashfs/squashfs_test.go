@@ -0,0 +1,223 @@
+package squashfs
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+)
+
+func TestWalk(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	reader, closer, err := OpenFile(filepath.Join("testData", "template.snap"))
+	g.Expect(err).NotTo(HaveOccurred())
+	defer closer.Close()
+
+	var list []string
+	err = reader.Walk(func(entry *Entry) error {
+		list = append(list, fmt.Sprintf("%s %s %d", entry.Path, entry.Mode, entry.Size))
+		return nil
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(list).To(Equal([]string{
+		"README.md -rw-r--r-- 14",
+		"app drwxr-xr-x 0",
+		"app/bin drwxr-xr-x 0",
+		"app/bin/run -rwxr-xr-x 19",
+		"app/data.txt -rw-r--r-- 10000",
+		"empty drwxr-xr-x 0",
+		"link Lrwxrwxrwx 0",
+	}))
+
+	// file is larger than block size - stored as blocks and tail in the fragment
+	data, err := reader.ReadFile("app/data.txt")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(data).To(HaveLen(10000))
+	g.Expect(string(data)).To(HavePrefix("line 0\nline 1\n"))
+	g.Expect(strings.Count(string(data), "\n")).To(Equal(1111))
+
+	_, err = reader.Open("app/missing")
+	g.Expect(os.IsNotExist(err)).To(BeTrue())
+}
+
+func TestExtract(t *testing.T) {
+	log.InitLogger()
+	g := NewGomegaWithT(t)
+
+	outDir, err := ioutil.TempDir("", "squashfs")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(outDir)
+
+	err = ExtractFile(filepath.Join("testData", "template.snap"), outDir, []string{"app/bin", "link"})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	data, err := ioutil.ReadFile(filepath.Join(outDir, "app", "bin", "run"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(data)).To(Equal("#!/bin/sh\necho run\n"))
+
+	info, err := os.Stat(filepath.Join(outDir, "app", "bin", "run"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(info.Mode().Perm()).To(Equal(os.FileMode(0755)))
+
+	target, err := os.Readlink(filepath.Join(outDir, "link"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(target).To(Equal("README.md"))
+
+	// not requested
+	_, err = os.Stat(filepath.Join(outDir, "app", "data.txt"))
+	g.Expect(os.IsNotExist(err)).To(BeTrue())
+	_, err = os.Stat(filepath.Join(outDir, "empty"))
+	g.Expect(os.IsNotExist(err)).To(BeTrue())
+}
+
+func TestWriter(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	sourceDir, err := ioutil.TempDir("", "squashfs-source")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(sourceDir)
+
+	// several blocks, sparse block and tail
+	data := make([]byte, 3*4096+100)
+	for i := range data[:4096] {
+		data[i] = byte(i % 251)
+	}
+	copy(data[2*4096:], strings.Repeat("tail", 1100))
+
+	g.Expect(os.MkdirAll(filepath.Join(sourceDir, "app", "bin"), 0755)).To(Succeed())
+	g.Expect(os.MkdirAll(filepath.Join(sourceDir, "empty"), 0700)).To(Succeed())
+	g.Expect(ioutil.WriteFile(filepath.Join(sourceDir, "app", "data"), data, 0644)).To(Succeed())
+	g.Expect(ioutil.WriteFile(filepath.Join(sourceDir, "app", "bin", "run"), []byte("#!/bin/sh\necho run\n"), 0755)).To(Succeed())
+	g.Expect(os.Symlink("app/bin/run", filepath.Join(sourceDir, "link"))).To(Succeed())
+	// more than 256 entries and inodes in several metadata blocks
+	for i := 0; i < 300; i++ {
+		g.Expect(ioutil.WriteFile(filepath.Join(sourceDir, "app", fmt.Sprintf("file-%03d", i)), []byte(strconv.Itoa(i)), 0644)).To(Succeed())
+	}
+
+	for _, options := range []WriterOptions{{Compression: "gzip"}, {Compression: "xz", BlockSize: 4096, NoFragments: true}, {Compression: "zstd", BlockSize: 4096}} {
+		image := writeImage(g, sourceDir, options)
+
+		reader, err := NewReader(bytes.NewReader(image))
+		g.Expect(err).NotTo(HaveOccurred())
+
+		count := 0
+		err = reader.Walk(func(entry *Entry) error {
+			count++
+			g.Expect(entry.Uid).To(BeZero())
+			return nil
+		})
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(count).To(Equal(306))
+
+		content, err := reader.ReadFile("app/data")
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(content).To(Equal(data))
+
+		content, err = reader.ReadFile("app/file-299")
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(string(content)).To(Equal("299"))
+
+		entry, err := reader.Open("app/bin/run")
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(entry.Mode).To(Equal(os.FileMode(0755)))
+
+		entry, err = reader.Open("empty")
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(entry.Mode).To(Equal(os.ModeDir | 0700))
+
+		entry, err = reader.Open("link")
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(entry.LinkTarget).To(Equal("app/bin/run"))
+
+		// reproducible
+		g.Expect(writeImage(g, sourceDir, options)).To(Equal(image))
+	}
+}
+
+func writeImage(g *GomegaWithT, sourceDir string, options WriterOptions) []byte {
+	writer, err := NewWriter(options)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(writer.AddDir(sourceDir, nil)).To(Succeed())
+
+	outFile, err := ioutil.TempFile("", "squashfs")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.Remove(outFile.Name())
+	g.Expect(outFile.Close()).To(Succeed())
+
+	g.Expect(writer.WriteFile(outFile.Name(), 0)).To(Succeed())
+	data, err := ioutil.ReadFile(outFile.Name())
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(len(data) % imagePadding).To(BeZero())
+	return data
+}
+
+func TestWriterPrevious(t *testing.T) {
+	log.InitLogger()
+	g := NewGomegaWithT(t)
+
+	sourceDir, err := ioutil.TempDir("", "squashfs-source")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(sourceDir)
+
+	data := make([]byte, 5*4096)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	asar := []byte(strings.Repeat("asar v1\n", 1024))
+	g.Expect(os.MkdirAll(filepath.Join(sourceDir, "app"), 0755)).To(Succeed())
+	g.Expect(os.MkdirAll(filepath.Join(sourceDir, "resources"), 0755)).To(Succeed())
+	g.Expect(ioutil.WriteFile(filepath.Join(sourceDir, "app", "data"), data, 0644)).To(Succeed())
+	g.Expect(ioutil.WriteFile(filepath.Join(sourceDir, "resources", "app.asar"), asar, 0644)).To(Succeed())
+
+	options := WriterOptions{Compression: "xz", BlockSize: 4096, NoFragments: true}
+	previousImage, err := ioutil.TempFile("", "squashfs")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.Remove(previousImage.Name())
+	_, err = previousImage.Write(writeImage(g, sourceDir, options))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(previousImage.Close()).To(Succeed())
+
+	// only asar is changed
+	asar = []byte(strings.Repeat("asar v2\n", 1024))
+	g.Expect(ioutil.WriteFile(filepath.Join(sourceDir, "resources", "app.asar"), asar, 0644)).To(Succeed())
+
+	options.PreviousImage = previousImage.Name()
+	image := writeImage(g, sourceDir, options)
+
+	previous, closer, err := OpenFile(previousImage.Name())
+	g.Expect(err).NotTo(HaveOccurred())
+	defer closer.Close()
+
+	writer, err := NewWriter(options)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(writer.AddDir(sourceDir, nil)).To(Succeed())
+	g.Expect(writer.markUnchanged(previous)).To(Succeed())
+	g.Expect(writer.root.children[0].children[0].previous).NotTo(BeNil())
+	g.Expect(writer.root.children[1].children[0].previous).To(BeNil())
+
+	reader, err := NewReader(bytes.NewReader(image))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	content, err := reader.ReadFile("app/data")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(content).To(Equal(data))
+	content, err = reader.ReadFile("resources/app.asar")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(content).To(Equal(asar))
+
+	// unchanged data has the same location
+	previousEntry, err := previous.Open("app/data")
+	g.Expect(err).NotTo(HaveOccurred())
+	entry, err := reader.Open("app/data")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(entry.inode.blocksStart).To(Equal(previousEntry.inode.blocksStart))
+	g.Expect(entry.inode.blockSizes).To(Equal(previousEntry.inode.blockSizes))
+}
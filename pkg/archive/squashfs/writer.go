@@ -0,0 +1,926 @@
+package squashfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/reproducible"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+)
+
+const (
+	defaultBlockSize = 128 * 1024
+	// the image is padded to 4 KB, as mksquashfs does, to be usable as loop device
+	imagePadding = 4096
+	maxNameSize  = 256
+
+	flagNoXattrs = 0x0200
+
+	noTable = 0xFFFFFFFFFFFFFFFF
+	noXattr = 0xFFFFFFFF
+)
+
+type WriterOptions struct {
+	// gzip (default), xz or zstd
+	Compression string
+	// power of two from 4 KB to 1 MB, 128 KB by default
+	BlockSize int
+	// do not pack tails of files into shared fragment blocks (mksquashfs -no-fragments)
+	NoFragments bool
+	// applied to all entries and to the image itself, SOURCE_DATE_EPOCH (1980-01-01 in the reproducible mode) or 0 if not specified
+	ModificationTime time.Time
+	// the previous revision: data of unchanged files is copied as is (not compressed again) in the same order and data of changed files is appended after,
+	// so, unchanged data has the same location as in the previous image and delta between revisions is minimal
+	PreviousImage string
+}
+
+// Writer creates squashfs image (snap, AppImage) without mksquashfs.
+// Image is reproducible - entries are sorted by name, inodes are numbered in the traversal order, all entries are owned by root (mksquashfs -all-root)
+// and have the same modification time. Extended attributes are not stored.
+type Writer struct {
+	options          WriterOptions
+	compressionId    uint16
+	compress         compressor
+	modificationTime uint32
+
+	root *sourceEntry
+}
+
+type sourceEntry struct {
+	name       string
+	file       string
+	mode       os.FileMode
+	size       int64
+	linkTarget string
+	children   []*sourceEntry
+
+	inodeNumber uint32
+	inodeRef    uint64
+
+	// regular file, set on write
+	blocksStart    uint64
+	blockSizes     []uint32
+	fragmentIndex  uint32
+	fragmentOffset uint32
+
+	// inode of the same file in the previous image, if content is not changed
+	previous *inode
+}
+
+func ConfigureMksquashfsCommand(app *kingpin.Application) {
+	command := app.Command("mksquashfs", "Create reproducible squashfs image without mksquashfs installed.")
+	inputs := command.Flag("input", "The dir, content is added to the image root. Can be specified several times, dirs with the same name are merged.").Short('i').Required().ExistingDirs()
+	output := command.Flag("output", "The output file.").Short('o').Required().String()
+	compression := command.Flag("compression", "The compression.").Default("gzip").Enum("gzip", "xz", "zstd")
+	blockSize := command.Flag("block-size", "The block size.").Default(strconv.Itoa(defaultBlockSize)).Int()
+	noFragments := command.Flag("no-fragments", "Do not pack small files and tails into fragments.").Bool()
+	offset := command.Flag("offset", "Write image at the offset in the output file.").Int64()
+	previous := command.Flag("previous", "The previous revision of the image to reuse data of unchanged files (minimal delta).").ExistingFile()
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		writer, err := NewWriter(WriterOptions{
+			Compression:   *compression,
+			BlockSize:     *blockSize,
+			NoFragments:   *noFragments,
+			PreviousImage: *previous,
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, dir := range *inputs {
+			err = writer.AddDir(dir, nil)
+			if err != nil {
+				return err
+			}
+		}
+		return writer.WriteFile(*output, *offset)
+	})
+}
+
+func NewWriter(options WriterOptions) (*Writer, error) {
+	if options.BlockSize == 0 {
+		options.BlockSize = defaultBlockSize
+	}
+	if options.BlockSize < 4096 || options.BlockSize > 1024*1024 || options.BlockSize&(options.BlockSize-1) != 0 {
+		return nil, util.NewMessageError("squashfs block size must be a power of two from 4096 to 1048576, got "+strconv.Itoa(options.BlockSize), "ERR_SQUASHFS_INVALID_BLOCK_SIZE")
+	}
+
+	compressionId, compress, err := getCompressor(options.Compression, options.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+
+	modificationTime, err := getModificationTime(options.ModificationTime)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		options:          options,
+		compressionId:    compressionId,
+		compress:         compress,
+		modificationTime: modificationTime,
+		root:             &sourceEntry{mode: os.ModeDir | 0755},
+	}, nil
+}
+
+func getModificationTime(value time.Time) (uint32, error) {
+	if value.IsZero() && reproducible.IsEnabled() {
+		t, err := reproducible.GetTime()
+		if err != nil {
+			return 0, err
+		}
+		value = t
+	}
+
+	if value.IsZero() {
+		sourceDateEpoch := os.Getenv("SOURCE_DATE_EPOCH")
+		if len(sourceDateEpoch) == 0 {
+			return 0, nil
+		}
+
+		result, err := strconv.ParseUint(sourceDateEpoch, 10, 32)
+		if err != nil {
+			return 0, errors.WithMessage(err, "invalid SOURCE_DATE_EPOCH")
+		}
+		return uint32(result), nil
+	}
+
+	if value.Unix() < 0 || value.Unix() > math.MaxUint32 {
+		return 0, errors.Errorf("modification time %s cannot be stored in squashfs", value)
+	}
+	return uint32(value.Unix()), nil
+}
+
+// AddDir adds content of the dir to the image root (as source dir of mksquashfs). Dirs with the same name are merged.
+// If filter is specified, only accepted top-level names are added.
+func (t *Writer) AddDir(dir string, filter func(name string) bool) error {
+	entries, err := readSourceDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if filter == nil || filter(entry.name) {
+			err = mergeEntry(t.root, entry)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func mergeEntry(parent *sourceEntry, entry *sourceEntry) error {
+	for _, existing := range parent.children {
+		if existing.name != entry.name {
+			continue
+		}
+
+		if !existing.mode.IsDir() || !entry.mode.IsDir() {
+			return errors.Errorf("cannot add %s: %s is already added", entry.file, existing.file)
+		}
+
+		for _, child := range entry.children {
+			err := mergeEntry(existing, child)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	parent.children = append(parent.children, entry)
+	// kernel stops lookup on the first entry that is greater than the name, so, entries must be sorted
+	sort.Slice(parent.children, func(i, j int) bool {
+		return parent.children[i].name < parent.children[j].name
+	})
+	return nil
+}
+
+func readSourceDir(dir string) ([]*sourceEntry, error) {
+	// sorted by name
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	result := make([]*sourceEntry, 0, len(infos))
+	for _, info := range infos {
+		if len(info.Name()) > maxNameSize {
+			return nil, errors.Errorf("file name %s is too long (max %d bytes)", info.Name(), maxNameSize)
+		}
+
+		entry := &sourceEntry{
+			name:          info.Name(),
+			file:          filepath.Join(dir, info.Name()),
+			mode:          info.Mode(),
+			fragmentIndex: noFragment,
+		}
+
+		switch {
+		case info.IsDir():
+			entry.children, err = readSourceDir(entry.file)
+			if err != nil {
+				return nil, err
+			}
+
+		case info.Mode()&os.ModeSymlink != 0:
+			entry.linkTarget, err = os.Readlink(entry.file)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+
+		case info.Mode().IsRegular():
+			entry.size = info.Size()
+
+		default:
+			return nil, errors.Errorf("cannot add %s: file type %s is not supported", entry.file, info.Mode()&os.ModeType)
+		}
+
+		result = append(result, entry)
+	}
+	return result, nil
+}
+
+// WriteFile writes image to the file at the specified offset (e.g. after AppImage runtime). Data before offset is not written.
+func (t *Writer) WriteFile(outFile string, offset int64) error {
+	file, err := os.Create(outFile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = file.Seek(offset, io.SeekStart)
+	if err == nil {
+		err = t.Write(file)
+	}
+	err = fsutil.CloseAndCheckError(err, file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if reproducible.IsEnabled() {
+		// the image is always reproducible, report what is normalized in the reproducible mode: root is numbered last, so, its inode number is the entry count
+		report := reproducible.NewReport(outFile, "squashfs", time.Unix(int64(t.modificationTime), 0))
+		report.Add("mtime", int(t.root.inodeNumber))
+		report.Add("ownership", int(t.root.inodeNumber))
+		return report.Write()
+	}
+	return nil
+}
+
+// Write writes image starting at the current position of the writer
+func (t *Writer) Write(out io.WriteSeeker) error {
+	start, err := out.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	writer := &imageWriter{Writer: t, out: bufio.NewWriterSize(out, 1024*1024)}
+	if len(t.options.PreviousImage) != 0 {
+		previous, closer, err := OpenFile(t.options.PreviousImage)
+		if err != nil {
+			return err
+		}
+		defer util.Close(closer)
+
+		err = t.markUnchanged(previous)
+		if err != nil {
+			return err
+		}
+		writer.previous = previous
+	}
+
+	// superblock is written at the end, when table locations are known
+	err = writer.write(make([]byte, superblockSize))
+	if err != nil {
+		return err
+	}
+
+	err = writer.writeData()
+	if err != nil {
+		return err
+	}
+
+	super, err := writer.writeTables()
+	if err != nil {
+		return err
+	}
+
+	if writer.position%imagePadding != 0 {
+		err = writer.write(make([]byte, imagePadding-writer.position%imagePadding))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = writer.out.Flush()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = out.Seek(start, io.SeekStart)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = binary.Write(out, binary.LittleEndian, super)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = out.Seek(start+int64(writer.position), io.SeekStart)
+	return errors.WithStack(err)
+}
+
+type imageWriter struct {
+	*Writer
+
+	out *bufio.Writer
+	// relative to the image start
+	position uint64
+
+	previous *Reader
+
+	fragment      []byte
+	fragmentCount uint32
+	fragments     []fragmentEntry
+	inodeCount    uint32
+}
+
+func (t *imageWriter) write(data []byte) error {
+	_, err := t.out.Write(data)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	t.position += uint64(len(data))
+	return nil
+}
+
+type blockJob struct {
+	data []byte
+	// all-zero block of file is not stored (sparse block)
+	isSparseAllowed bool
+	// data is already compressed block of the previous image, rawSize is the stored size (with uncompressed flag)
+	isRaw   bool
+	rawSize uint32
+	// called in the order of submission with location of written block
+	onWritten func(start uint64, size uint32)
+
+	done       chan struct{}
+	compressed []byte
+	size       uint32
+	err        error
+}
+
+// data blocks are compressed in parallel, but written in the order of submission - output doesn't depend on scheduling
+func (t *imageWriter) writeData() error {
+	workerCount := runtime.NumCPU()
+	jobs := make(chan *blockJob, workerCount*2)
+	ordered := make(chan *blockJob, workerCount*2)
+
+	for i := 0; i < workerCount; i++ {
+		go func() {
+			for job := range jobs {
+				t.compressBlock(job)
+				close(job.done)
+			}
+		}()
+	}
+
+	writeResult := make(chan error, 1)
+	go func() {
+		var result error
+		for job := range ordered {
+			<-job.done
+			if result != nil {
+				continue
+			}
+
+			result = job.err
+			if result == nil {
+				job.onWritten(t.position, job.size)
+				result = t.write(job.compressed)
+			}
+		}
+		writeResult <- result
+	}()
+
+	submit := func(job *blockJob) {
+		job.done = make(chan struct{})
+		ordered <- job
+		jobs <- job
+	}
+
+	var err error
+	if t.previous != nil {
+		err = t.addPreviousData(t.previous, submit)
+	}
+	if err == nil {
+		err = t.addDirData(t.root, submit)
+	}
+	if err == nil {
+		t.flushFragment(submit)
+	}
+
+	close(jobs)
+	close(ordered)
+	writeErr := <-writeResult
+	if err != nil {
+		return err
+	}
+	return writeErr
+}
+
+func (t *imageWriter) compressBlock(job *blockJob) {
+	if job.isRaw {
+		job.compressed = job.data
+		job.size = job.rawSize
+		return
+	}
+
+	if job.isSparseAllowed && isZero(job.data) {
+		return
+	}
+
+	compressed, err := t.compress(job.data)
+	if err != nil {
+		job.err = err
+		return
+	}
+
+	if len(compressed) < len(job.data) {
+		job.compressed = compressed
+		job.size = uint32(len(compressed))
+	} else {
+		job.compressed = job.data
+		job.size = uint32(len(job.data)) | uncompressedBlockFlag
+	}
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *imageWriter) addDirData(dir *sourceEntry, submit func(job *blockJob)) error {
+	for _, entry := range dir.children {
+		var err error
+		if entry.mode.IsDir() {
+			err = t.addDirData(entry, submit)
+		} else if entry.mode.IsRegular() && entry.previous == nil {
+			err = t.addFileData(entry, submit)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *imageWriter) addFileData(entry *sourceEntry, submit func(job *blockJob)) error {
+	file, err := os.Open(entry.file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(file)
+
+	blockSize := int64(t.options.BlockSize)
+	for remaining := entry.size; remaining > 0; {
+		size := remaining
+		if size > blockSize {
+			size = blockSize
+		}
+
+		data := make([]byte, size)
+		_, err = io.ReadFull(file, data)
+		if err != nil {
+			return errors.WithMessage(err, "cannot read "+entry.file+" (modified during packaging?)")
+		}
+		remaining -= size
+
+		if size < blockSize && !t.options.NoFragments {
+			t.addToFragment(entry, data, submit)
+			break
+		}
+
+		submit(&blockJob{
+			data:            data,
+			isSparseAllowed: true,
+			onWritten: func(start uint64, size uint32) {
+				if len(entry.blockSizes) == 0 {
+					entry.blocksStart = start
+				}
+				entry.blockSizes = append(entry.blockSizes, size)
+			},
+		})
+	}
+	return nil
+}
+
+func (t *imageWriter) addToFragment(entry *sourceEntry, data []byte, submit func(job *blockJob)) {
+	if len(t.fragment)+len(data) > t.options.BlockSize {
+		t.flushFragment(submit)
+	}
+
+	entry.fragmentIndex = t.fragmentCount
+	entry.fragmentOffset = uint32(len(t.fragment))
+	t.fragment = append(t.fragment, data...)
+}
+
+func (t *imageWriter) flushFragment(submit func(job *blockJob)) {
+	if len(t.fragment) == 0 {
+		return
+	}
+
+	submit(&blockJob{
+		data: t.fragment,
+		onWritten: func(start uint64, size uint32) {
+			t.fragments = append(t.fragments, fragmentEntry{Start: start, Size: size})
+		},
+	})
+	t.fragment = nil
+	t.fragmentCount++
+}
+
+func (t *imageWriter) writeTables() (*superblock, error) {
+	t.inodeCount = assignInodeNumbers(t.root, 0)
+
+	inodes := newMetadataWriter(t.compress)
+	directories := newMetadataWriter(t.compress)
+	// parent of root is not an inode, the same value as mksquashfs uses
+	err := t.writeDirInodes(t.root, t.inodeCount+1, inodes, directories)
+	if err != nil {
+		return nil, err
+	}
+
+	flags := uint16(flagNoXattrs)
+	if t.options.NoFragments {
+		flags |= flagNoFragments
+	}
+
+	super := &superblock{
+		Magic:             magic,
+		InodeCount:        t.inodeCount,
+		ModificationTime:  t.modificationTime,
+		BlockSize:         uint32(t.options.BlockSize),
+		CompressionId:     t.compressionId,
+		BlockLog:          uint16(bitLength(t.options.BlockSize) - 1),
+		Flags:             flags,
+		VersionMajor:      4,
+		VersionMinor:      0,
+		RootInodeRef:      t.root.inodeRef,
+		XattrIdTableStart: noTable,
+		ExportTableStart:  noTable,
+	}
+
+	// order of tables is checked by kernel
+	super.InodeTableStart = t.position
+	data, err := inodes.finish()
+	if err != nil {
+		return nil, err
+	}
+	err = t.write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	super.DirectoryTableStart = t.position
+	data, err = directories.finish()
+	if err != nil {
+		return nil, err
+	}
+	err = t.write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var fragmentTable bytes.Buffer
+	err = binary.Write(&fragmentTable, binary.LittleEndian, t.fragments)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	super.FragmentEntryCount = uint32(len(t.fragments))
+	super.FragmentTableStart, err = t.writeLookupTable(fragmentTable.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	// the only id - root
+	super.IdCount = 1
+	super.IdTableStart, err = t.writeLookupTable(make([]byte, 4))
+	if err != nil {
+		return nil, err
+	}
+
+	super.BytesUsed = t.position
+	return super, nil
+}
+
+func bitLength(value int) int {
+	result := 0
+	for ; value != 0; value >>= 1 {
+		result++
+	}
+	return result
+}
+
+// metadata blocks followed by the list of their locations, returns location of the list
+func (t *imageWriter) writeLookupTable(data []byte) (uint64, error) {
+	writer := newMetadataWriter(t.compress)
+	err := writer.write(data)
+	if err != nil {
+		return 0, err
+	}
+
+	blocks, err := writer.finish()
+	if err != nil {
+		return 0, err
+	}
+
+	blocksStart := t.position
+	err = t.write(blocks)
+	if err != nil {
+		return 0, err
+	}
+
+	result := t.position
+	locations := make([]byte, 8*len(writer.blockStarts))
+	for i, blockStart := range writer.blockStarts {
+		binary.LittleEndian.PutUint64(locations[i*8:], blocksStart+blockStart)
+	}
+	return result, t.write(locations)
+}
+
+// inodes are numbered in the order they are written: subdirectories, other entries, then the directory itself (root is the last)
+func assignInodeNumbers(dir *sourceEntry, last uint32) uint32 {
+	for _, entry := range dir.children {
+		if entry.mode.IsDir() {
+			last = assignInodeNumbers(entry, last)
+		}
+	}
+	for _, entry := range dir.children {
+		if !entry.mode.IsDir() {
+			last++
+			entry.inodeNumber = last
+		}
+	}
+	last++
+	dir.inodeNumber = last
+	return last
+}
+
+// directory listing refers to inodes of children and directory inode refers to the listing, so, children are written first
+func (t *imageWriter) writeDirInodes(dir *sourceEntry, parentInodeNumber uint32, inodes *metadataWriter, directories *metadataWriter) error {
+	subDirCount := 0
+	for _, entry := range dir.children {
+		if entry.mode.IsDir() {
+			subDirCount++
+			err := t.writeDirInodes(entry, dir.inodeNumber, inodes, directories)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, entry := range dir.children {
+		if entry.mode.IsDir() {
+			continue
+		}
+
+		entry.inodeRef = inodes.position()
+		err := inodes.write(t.encodeInode(entry))
+		if err != nil {
+			return err
+		}
+	}
+
+	listingRef := directories.position()
+	listing := encodeDirListing(dir.children)
+	err := directories.write(listing)
+	if err != nil {
+		return err
+	}
+
+	linkCount := uint32(2 + subDirCount)
+	// size includes 3 bytes for implicit . and .. entries
+	listingSize := uint32(len(listing) + 3)
+	blockIndex := uint32(listingRef >> 16)
+	blockOffset := uint16(listingRef)
+
+	var data []byte
+	if listingSize <= math.MaxUint16 {
+		data = t.encodeInodeHeader(inodeDir, dir, 16)
+		binary.LittleEndian.PutUint32(data[16:], blockIndex)
+		binary.LittleEndian.PutUint32(data[20:], linkCount)
+		binary.LittleEndian.PutUint16(data[24:], uint16(listingSize))
+		binary.LittleEndian.PutUint16(data[26:], blockOffset)
+		binary.LittleEndian.PutUint32(data[28:], parentInodeNumber)
+	} else {
+		// directory index is optional, kernel scans the listing if there is no index
+		data = t.encodeInodeHeader(inodeExtendedDir, dir, 24)
+		binary.LittleEndian.PutUint32(data[16:], linkCount)
+		binary.LittleEndian.PutUint32(data[20:], listingSize)
+		binary.LittleEndian.PutUint32(data[24:], blockIndex)
+		binary.LittleEndian.PutUint32(data[28:], parentInodeNumber)
+		binary.LittleEndian.PutUint16(data[32:], 0)
+		binary.LittleEndian.PutUint16(data[34:], blockOffset)
+		binary.LittleEndian.PutUint32(data[36:], noXattr)
+	}
+
+	dir.inodeRef = inodes.position()
+	return inodes.write(data)
+}
+
+func (t *imageWriter) encodeInodeHeader(kind inodeType, entry *sourceEntry, bodySize int) []byte {
+	mode := entry.mode
+	permissions := uint16(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		permissions |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		permissions |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		permissions |= 01000
+	}
+
+	// uid and gid are indices in the id table
+	result := make([]byte, 16+bodySize)
+	binary.LittleEndian.PutUint16(result, uint16(kind))
+	binary.LittleEndian.PutUint16(result[2:], permissions)
+	binary.LittleEndian.PutUint32(result[8:], t.modificationTime)
+	binary.LittleEndian.PutUint32(result[12:], entry.inodeNumber)
+	return result
+}
+
+func (t *imageWriter) encodeInode(entry *sourceEntry) []byte {
+	if entry.mode&os.ModeSymlink != 0 {
+		data := t.encodeInodeHeader(inodeSymlink, entry, 8+len(entry.linkTarget))
+		binary.LittleEndian.PutUint32(data[16:], 1)
+		binary.LittleEndian.PutUint32(data[20:], uint32(len(entry.linkTarget)))
+		copy(data[24:], entry.linkTarget)
+		return data
+	}
+
+	var data []byte
+	if entry.blocksStart <= math.MaxUint32 && entry.size <= math.MaxUint32 {
+		data = t.encodeInodeHeader(inodeFile, entry, 16+4*len(entry.blockSizes))
+		binary.LittleEndian.PutUint32(data[16:], uint32(entry.blocksStart))
+		binary.LittleEndian.PutUint32(data[20:], entry.fragmentIndex)
+		binary.LittleEndian.PutUint32(data[24:], entry.fragmentOffset)
+		binary.LittleEndian.PutUint32(data[28:], uint32(entry.size))
+	} else {
+		data = t.encodeInodeHeader(inodeExtendedFile, entry, 40+4*len(entry.blockSizes))
+		binary.LittleEndian.PutUint64(data[16:], entry.blocksStart)
+		binary.LittleEndian.PutUint64(data[24:], uint64(entry.size))
+		// sparse byte count (data[32:]) is informational and not computed
+		binary.LittleEndian.PutUint32(data[40:], 1)
+		binary.LittleEndian.PutUint32(data[44:], entry.fragmentIndex)
+		binary.LittleEndian.PutUint32(data[48:], entry.fragmentOffset)
+		binary.LittleEndian.PutUint32(data[52:], noXattr)
+	}
+
+	blockSizes := data[len(data)-4*len(entry.blockSizes):]
+	for i, size := range entry.blockSizes {
+		binary.LittleEndian.PutUint32(blockSizes[i*4:], size)
+	}
+	return data
+}
+
+// entries are grouped by runs with header (inode block and base inode number),
+// new run is started if entry inode is in another block, inode number delta doesn't fit into int16 or run has 256 entries
+func encodeDirListing(entries []*sourceEntry) []byte {
+	var result []byte
+	headerOffset := 0
+	count := uint32(0)
+	var block uint32
+	var baseInodeNumber uint32
+	for _, entry := range entries {
+		entryBlock := uint32(entry.inodeRef >> 16)
+		delta := int64(entry.inodeNumber) - int64(baseInodeNumber)
+		entrySize := 8 + len(entry.name)
+		if count == 0 || count == 256 || entryBlock != block || delta > math.MaxInt16 || delta < math.MinInt16 || len(result)-headerOffset+entrySize > metadataBlockSize {
+			headerOffset = len(result)
+			header := make([]byte, 12)
+			binary.LittleEndian.PutUint32(header[4:], entryBlock)
+			binary.LittleEndian.PutUint32(header[8:], entry.inodeNumber)
+			result = append(result, header...)
+			count = 0
+			block = entryBlock
+			baseInodeNumber = entry.inodeNumber
+			delta = 0
+		}
+
+		data := make([]byte, 8, entrySize)
+		binary.LittleEndian.PutUint16(data, uint16(entry.inodeRef))
+		binary.LittleEndian.PutUint16(data[2:], uint16(int16(delta)))
+		binary.LittleEndian.PutUint16(data[4:], uint16(getBasicInodeType(entry)))
+		binary.LittleEndian.PutUint16(data[6:], uint16(len(entry.name)-1))
+		result = append(result, append(data, entry.name...)...)
+
+		binary.LittleEndian.PutUint32(result[headerOffset:], count)
+		count++
+	}
+	return result
+}
+
+// listing always uses basic type
+func getBasicInodeType(entry *sourceEntry) inodeType {
+	switch {
+	case entry.mode.IsDir():
+		return inodeDir
+	case entry.mode&os.ModeSymlink != 0:
+		return inodeSymlink
+	default:
+		return inodeFile
+	}
+}
+
+// metadata (inodes, directories, lookup tables) is stored in blocks of 8 KB (before compression) with 2 bytes header
+type metadataWriter struct {
+	compress compressor
+
+	output  bytes.Buffer
+	current []byte
+	// relative to the start of output
+	blockStarts []uint64
+}
+
+func newMetadataWriter(compress compressor) *metadataWriter {
+	return &metadataWriter{compress: compress, current: make([]byte, 0, metadataBlockSize)}
+}
+
+// reference to the current position - location of the block relative to the table start and offset in the uncompressed block
+func (t *metadataWriter) position() uint64 {
+	return uint64(t.output.Len())<<16 | uint64(len(t.current))
+}
+
+func (t *metadataWriter) write(data []byte) error {
+	for len(data) > 0 {
+		n := metadataBlockSize - len(t.current)
+		if n > len(data) {
+			n = len(data)
+		}
+
+		t.current = append(t.current, data[:n]...)
+		data = data[n:]
+		if len(t.current) == metadataBlockSize {
+			err := t.flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (t *metadataWriter) flush() error {
+	t.blockStarts = append(t.blockStarts, uint64(t.output.Len()))
+
+	compressed, err := t.compress(t.current)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, 2)
+	if len(compressed) < len(t.current) {
+		binary.LittleEndian.PutUint16(header, uint16(len(compressed)))
+	} else {
+		compressed = t.current
+		binary.LittleEndian.PutUint16(header, uint16(len(compressed))|uncompressedMetadataFlag)
+	}
+
+	t.output.Write(header)
+	t.output.Write(compressed)
+	t.current = t.current[:0]
+	return nil
+}
+
+func (t *metadataWriter) finish() ([]byte, error) {
+	if len(t.current) != 0 {
+		err := t.flush()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return t.output.Bytes(), nil
+}
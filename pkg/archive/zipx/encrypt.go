@@ -0,0 +1,324 @@
+package zipx
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/credentials"
+	"github.com/develar/app-builder/pkg/reproducible"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+)
+
+// WinZip AES encryption (https://www.winzip.com/en/support/aes-encryption/), supported by 7-Zip, WinZip, macOS Archive Utility (via libarchive) and others
+const (
+	aesMethod        = 99
+	aesExtraHeaderId = 0x9901
+	// AE-1 - CRC of plain data is stored (Go zip writer computes it), AE-2 stores zero CRC
+	aesVendorVersion = 1
+	aesStrength256   = 3
+	aesKeyLength     = 32
+	aesSaltLength    = 16
+	aesMacLength     = 10
+	// PBKDF2 iteration count is fixed by the format
+	aesIterationCount = 1000
+)
+
+const ArchivePasswordCredentialName = "archive-password"
+
+func ConfigureEncryptCommand(app *kingpin.Application) {
+	command := app.Command("zip-encrypt", "Encrypt zip using AES-256 (for restricted distribution, e.g. enterprise side-loading portals). "+
+		"Password is taken from "+credentials.ToEnvName(ArchivePasswordCredentialName)+" env or credentials helper.")
+	input := command.Flag("input", "The zip file.").Short('i').Required().String()
+	output := command.Flag("output", "The encrypted zip file (input file is replaced if not specified).").Short('o').String()
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		password, err := credentials.GetRequired(ArchivePasswordCredentialName)
+		if err != nil {
+			return err
+		}
+
+		outFile := *output
+		if len(outFile) == 0 {
+			outFile = *input
+		}
+		return EncryptZip(*input, outFile, password)
+	})
+}
+
+// EncryptZip writes copy of zip with all files deflated and encrypted using AES-256. outFile can be the same as inFile.
+func EncryptZip(inFile string, outFile string, password string) error {
+	if len(password) == 0 {
+		return errors.New("password must be not empty")
+	}
+
+	reader, err := zip.OpenReader(inFile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(reader)
+
+	tempFile := outFile + ".encrypted"
+	file, err := os.Create(tempFile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// zero - times of entries are preserved
+	var modTime time.Time
+	if reproducible.IsEnabled() {
+		modTime, err = reproducible.GetTime()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = writeEncryptedZip(&reader.Reader, file, []byte(password), modTime)
+	err = fsutil.CloseAndCheckError(err, file)
+	if err != nil {
+		_ = os.Remove(tempFile)
+		return err
+	}
+
+	util.Close(reader)
+	err = os.Rename(tempFile, outFile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if !modTime.IsZero() {
+		report := reproducible.NewReport(outFile, "zip", modTime)
+		report.Add("mtime", len(reader.File))
+		// random salt is required by AES encryption (the same salt for different builds weakens encryption)
+		report.NotNormalized = []string{"aesSalt"}
+		return report.Write()
+	}
+	return nil
+}
+
+func writeEncryptedZip(reader *zip.Reader, out io.Writer, password []byte, modTime time.Time) error {
+	writer := zip.NewWriter(out)
+	writer.RegisterCompressor(aesMethod, func(out io.Writer) (io.WriteCloser, error) {
+		return newAesWriter(out, password)
+	})
+
+	for _, file := range reader.File {
+		modified := file.Modified
+		if !modTime.IsZero() {
+			modified = modTime
+		}
+
+		header := &zip.FileHeader{
+			Name:          file.Name,
+			Comment:       file.Comment,
+			Modified:      modified,
+			ExternalAttrs: file.ExternalAttrs,
+
+			CreatorVersion: file.CreatorVersion,
+		}
+		if strings.HasSuffix(file.Name, "/") {
+			header.Method = zip.Store
+			_, err := writer.CreateHeader(header)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			continue
+		}
+
+		header.Method = aesMethod
+		// encrypted
+		header.Flags = 0x1
+		header.Extra = createAesExtra(zip.Deflate)
+		entryWriter, err := writer.CreateHeader(header)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		err = copyZipFile(file, entryWriter)
+		if err != nil {
+			return err
+		}
+	}
+	return errors.WithStack(writer.Close())
+}
+
+func copyZipFile(file *zip.File, writer io.Writer) error {
+	reader, err := file.Open()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(reader)
+
+	_, err = io.Copy(writer, reader)
+	return errors.WithStack(err)
+}
+
+func createAesExtra(actualMethod uint16) []byte {
+	extra := make([]byte, 11)
+	binary.LittleEndian.PutUint16(extra[0:], aesExtraHeaderId)
+	binary.LittleEndian.PutUint16(extra[2:], 7)
+	binary.LittleEndian.PutUint16(extra[4:], aesVendorVersion)
+	extra[6] = 'A'
+	extra[7] = 'E'
+	extra[8] = aesStrength256
+	binary.LittleEndian.PutUint16(extra[9:], actualMethod)
+	return extra
+}
+
+// entry data: salt, password verifier, deflated and encrypted data, authentication code
+type aesWriter struct {
+	out        io.Writer
+	compressor *flate.Writer
+	stream     cipher.Stream
+	mac        hash.Hash
+	buffer     []byte
+	// salt and password verifier
+	header []byte
+}
+
+func newAesWriter(out io.Writer, password []byte) (io.WriteCloser, error) {
+	salt := make([]byte, aesSaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	key := pbkdf2Sha1(password, salt, aesIterationCount, 2*aesKeyLength+2)
+	block, err := aes.NewCipher(key[:aesKeyLength])
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	result := &aesWriter{
+		out: out,
+		// zip writer creates compressor before writing local file header, so, written on first write
+		header: append(salt, key[2*aesKeyLength:]...),
+		stream: newWinZipCtr(block),
+		mac:    hmac.New(sha1.New, key[aesKeyLength:2*aesKeyLength]),
+	}
+	result.compressor, err = flate.NewWriter(writerFunc(result.writeEncrypted), flate.BestCompression)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return result, nil
+}
+
+func (t *aesWriter) Write(p []byte) (int, error) {
+	return t.compressor.Write(p)
+}
+
+func (t *aesWriter) writeHeader() error {
+	if t.header == nil {
+		return nil
+	}
+
+	_, err := t.out.Write(t.header)
+	t.header = nil
+	return errors.WithStack(err)
+}
+
+func (t *aesWriter) writeEncrypted(p []byte) (int, error) {
+	err := t.writeHeader()
+	if err != nil {
+		return 0, err
+	}
+
+	if cap(t.buffer) < len(p) {
+		t.buffer = make([]byte, len(p))
+	}
+	encrypted := t.buffer[:len(p)]
+	t.stream.XORKeyStream(encrypted, p)
+	_, _ = t.mac.Write(encrypted)
+	return t.out.Write(encrypted)
+}
+
+func (t *aesWriter) Close() error {
+	err := t.compressor.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// empty file
+	err = t.writeHeader()
+	if err != nil {
+		return err
+	}
+
+	_, err = t.out.Write(t.mac.Sum(nil)[:aesMacLength])
+	return errors.WithStack(err)
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+// WinZip uses CTR mode with little-endian counter starting from 1 (crypto/cipher.NewCTR is big-endian)
+type winZipCtr struct {
+	block     cipher.Block
+	counter   [aes.BlockSize]byte
+	keyStream [aes.BlockSize]byte
+	used      int
+}
+
+func newWinZipCtr(block cipher.Block) *winZipCtr {
+	return &winZipCtr{block: block, used: aes.BlockSize}
+}
+
+func (t *winZipCtr) XORKeyStream(dst, src []byte) {
+	for i := range src {
+		if t.used == aes.BlockSize {
+			for j := range t.counter {
+				t.counter[j]++
+				if t.counter[j] != 0 {
+					break
+				}
+			}
+			t.block.Encrypt(t.keyStream[:], t.counter[:])
+			t.used = 0
+		}
+		dst[i] = src[i] ^ t.keyStream[t.used]
+		t.used++
+	}
+}
+
+// RFC 8018, golang.org/x/crypto is not a dependency
+func pbkdf2Sha1(password []byte, salt []byte, iterationCount int, keyLength int) []byte {
+	prf := hmac.New(sha1.New, password)
+	result := make([]byte, 0, keyLength+sha1.Size)
+	u := make([]byte, sha1.Size)
+	t := make([]byte, sha1.Size)
+	var blockIndex [4]byte
+	for block := uint32(1); len(result) < keyLength; block++ {
+		binary.BigEndian.PutUint32(blockIndex[:], block)
+		prf.Reset()
+		_, _ = prf.Write(salt)
+		_, _ = prf.Write(blockIndex[:])
+		u = prf.Sum(u[:0])
+		copy(t, u)
+		for i := 1; i < iterationCount; i++ {
+			prf.Reset()
+			_, _ = prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		result = append(result, t...)
+	}
+	return result[:keyLength]
+}
@@ -0,0 +1,89 @@
+package zipx
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestPbkdf2(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	// RFC 6070
+	g.Expect(hex.EncodeToString(pbkdf2Sha1([]byte("password"), []byte("salt"), 1, 20))).To(Equal("0c60c80f961f0e71f3a9b524af6012062fe037a6"))
+	g.Expect(hex.EncodeToString(pbkdf2Sha1([]byte("password"), []byte("salt"), 4096, 20))).To(Equal("4b007901b765489abead49d926f721d065a429c1"))
+	g.Expect(hex.EncodeToString(pbkdf2Sha1([]byte("passwordPASSWORDpassword"), []byte("saltSALTsaltSALTsaltSALTsaltSALTsalt"), 4096, 25))).To(Equal("3d2eec4fe41c849b80c8d83662c0e44a8b291a964cf2f07038"))
+}
+
+func TestEncryptZip(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "encrypt")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	content := strings.Repeat("hello world\n", 1000)
+	var buffer bytes.Buffer
+	writer := zip.NewWriter(&buffer)
+	_, err = writer.Create("dir/")
+	g.Expect(err).NotTo(HaveOccurred())
+	entryWriter, err := writer.Create("dir/file.txt")
+	g.Expect(err).NotTo(HaveOccurred())
+	_, err = entryWriter.Write([]byte(content))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(writer.Close()).NotTo(HaveOccurred())
+
+	file := filepath.Join(dir, "test.zip")
+	g.Expect(ioutil.WriteFile(file, buffer.Bytes(), 0644)).NotTo(HaveOccurred())
+	g.Expect(EncryptZip(file, file, "secret")).NotTo(HaveOccurred())
+
+	reader, err := zip.OpenReader(file)
+	g.Expect(err).NotTo(HaveOccurred())
+	defer reader.Close()
+
+	g.Expect(reader.File).To(HaveLen(2))
+	g.Expect(reader.File[0].Method).To(Equal(zip.Store))
+
+	entry := reader.File[1]
+	g.Expect(entry.Method).To(Equal(uint16(aesMethod)))
+	g.Expect(entry.Flags & 0x1).To(Equal(uint16(1)))
+	g.Expect(entry.Extra).To(ContainSubstring(string(createAesExtra(zip.Deflate))))
+	g.Expect(entry.UncompressedSize64).To(Equal(uint64(len(content))))
+
+	dataOffset, err := entry.DataOffset()
+	g.Expect(err).NotTo(HaveOccurred())
+	encryptedZip, err := ioutil.ReadFile(file)
+	g.Expect(err).NotTo(HaveOccurred())
+	raw := encryptedZip[dataOffset : dataOffset+int64(entry.CompressedSize64)]
+
+	salt := raw[:aesSaltLength]
+	verifier := raw[aesSaltLength : aesSaltLength+2]
+	data := raw[aesSaltLength+2 : len(raw)-aesMacLength]
+	key := pbkdf2Sha1([]byte("secret"), salt, aesIterationCount, 2*aesKeyLength+2)
+	g.Expect(verifier).To(Equal(key[2*aesKeyLength:]))
+
+	mac := hmac.New(sha1.New, key[aesKeyLength:2*aesKeyLength])
+	_, _ = mac.Write(data)
+	g.Expect(raw[len(raw)-aesMacLength:]).To(Equal(mac.Sum(nil)[:aesMacLength]))
+
+	block, err := aes.NewCipher(key[:aesKeyLength])
+	g.Expect(err).NotTo(HaveOccurred())
+	decrypted := make([]byte, len(data))
+	newWinZipCtr(block).XORKeyStream(decrypted, data)
+	var result bytes.Buffer
+	_, err = io.Copy(&result, flate.NewReader(bytes.NewReader(decrypted)))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.String()).To(Equal(content))
+}
@@ -0,0 +1,31 @@
+//go:build go1.18
+// +build go1.18
+
+package zipx
+
+import (
+	"archive/zip"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// go test -run=^$ -fuzz=FuzzComputeExtractPath ./pkg/archive/zipx
+func FuzzComputeExtractPath(f *testing.F) {
+	f.Add("foo/bar.txt")
+	f.Add("../out-evil/file")
+	f.Add("/etc/passwd")
+
+	outputDir := filepath.Join("test", "out")
+	extractor := &Extractor{outputDir: outputDir}
+	f.Fuzz(func(t *testing.T, name string) {
+		filePath, err := extractor.computeExtractPath(&zip.File{FileHeader: zip.FileHeader{Name: name}})
+		if err != nil {
+			return
+		}
+
+		if filePath != outputDir && !strings.HasPrefix(filePath, outputDir+string(filepath.Separator)) {
+			t.Fatalf("%q is extracted outside of output dir: %s", name, filePath)
+		}
+	})
+}
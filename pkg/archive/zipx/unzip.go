@@ -201,7 +201,8 @@ func (t *Extractor) addWithParentsToCreated(dir string) {
 func (t *Extractor) computeExtractPath(zipFile *zip.File) (string, error) {
 	// #nosec G305
 	filePath := filepath.Join(t.outputDir, zipFile.Name)
-	if strings.HasPrefix(filePath, t.outputDir) {
+	// check separator to not allow sibling dir with the same prefix (e.g. /out-evil for /out)
+	if filePath == t.outputDir || strings.HasPrefix(filePath, t.outputDir+string(filepath.Separator)) {
 		return filePath, nil
 	} else {
 		return "", errors.Errorf("%s: illegal file path", filePath)
@@ -249,8 +250,16 @@ func (t *Extractor) extractAndWriteFile(zipFile *zip.File, filePath string) erro
 	return nil
 }
 
+// symlink target cannot be larger than max path length, larger size means that zip is corrupted
+const maxSymlinkTargetSize = 4096
+
 func (t *Extractor) createSymlink(reader io.Reader, zipFile *zip.File, filePath string) error {
-	buffer := make([]byte, zipFile.FileInfo().Size())
+	size := zipFile.FileInfo().Size()
+	if size <= 0 || size > maxSymlinkTargetSize {
+		return errors.Errorf("%s: invalid symlink target size %d", zipFile.Name, size)
+	}
+
+	buffer := make([]byte, size)
 	_, err := io.ReadFull(reader, buffer)
 	if err != nil {
 		return err
@@ -0,0 +1,227 @@
+package artifact
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/json-iterator/go"
+)
+
+const (
+	// fail if several artifacts have the same name
+	CollisionPolicyFail = "fail"
+	// append arch to the name of colliding artifacts (and target if arch is the same)
+	CollisionPolicyAppendArch = "append-arch"
+	// append target to the name of colliding artifacts (and arch if target is the same)
+	CollisionPolicyAppendTarget = "append-target"
+)
+
+// extensions that must be kept as is when suffix is inserted into the file name (compound ones first),
+// name is not split on other dots - version (e.g. "App-1.2.3") is not an extension
+var artifactExtensions = []string{".tar.gz", ".tar.xz", ".tar.bz2", ".tar.lz", ".tar.7z", ".blockmap",
+	".exe", ".msi", ".msix", ".appx", ".msixbundle", ".appxbundle", ".nupkg", ".dmg", ".pkg", ".zip", ".7z", ".tar",
+	".appimage", ".deb", ".rpm", ".snap", ".flatpak", ".apk", ".pacman", ".freebsd", ".p5p", ".zsync", ".yml", ".json"}
+
+type Artifact struct {
+	Target string `json:"target"`
+	Arch   string `json:"arch,omitempty"`
+	// relative to output dir
+	File string `json:"file"`
+}
+
+type NameCheckRequest struct {
+	Policy    string      `json:"policy"`
+	Artifacts []*Artifact `json:"artifacts"`
+}
+
+type Collision struct {
+	File string `json:"file"`
+	// target and arch of each artifact, e.g. "nsis (x64)"
+	Targets []string `json:"targets"`
+}
+
+type NameCheckResult struct {
+	// in the request order, file names are changed if colliding names were disambiguated
+	Artifacts  []*Artifact  `json:"artifacts"`
+	Collisions []*Collision `json:"collisions"`
+
+	Error     string `json:"error,omitempty"`
+	ErrorCode string `json:"errorCode,omitempty"`
+}
+
+func ConfigureCheckNamesCommand(app *kingpin.Application) {
+	command := app.Command("check-artifact-names", "detect artifacts of different targets or archs with the same output file name (request is read from stdin)")
+	policy := command.Flag("policy", "what to do if names collide, overrides policy specified in the request").Enum(CollisionPolicyFail, CollisionPolicyAppendArch, CollisionPolicyAppendTarget)
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		var request NameCheckRequest
+		err := jsoniter.NewDecoder(os.Stdin).Decode(&request)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if *policy != "" {
+			request.Policy = *policy
+		}
+
+		result, err := CheckNames(&request)
+		if err != nil {
+			messageError, ok := errors.Cause(err).(util.MessageError)
+			if !ok || result == nil {
+				return err
+			}
+
+			result.Error = messageError.Error()
+			result.ErrorCode = messageError.ErrorCode()
+		}
+		return util.WriteJsonToStdOut(result)
+	})
+}
+
+// CheckNames detects artifacts that would overwrite each other. Names are compared case-insensitively because default file systems
+// on macOS and Windows are case-insensitive. If policy is "fail", result contains collisions and error is returned.
+func CheckNames(request *NameCheckRequest) (*NameCheckResult, error) {
+	policy := request.Policy
+	if policy == "" {
+		policy = CollisionPolicyFail
+	}
+
+	result := &NameCheckResult{Artifacts: make([]*Artifact, len(request.Artifacts)), Collisions: []*Collision{}}
+	for index, artifact := range request.Artifacts {
+		copied := *artifact
+		result.Artifacts[index] = &copied
+	}
+
+	result.Collisions = findCollisions(result.Artifacts)
+	if len(result.Collisions) == 0 {
+		return result, nil
+	}
+
+	switch policy {
+	case CollisionPolicyFail:
+		return result, collisionError(result.Collisions)
+
+	case CollisionPolicyAppendArch, CollisionPolicyAppendTarget:
+		disambiguate(result.Artifacts, policy == CollisionPolicyAppendArch)
+		remaining := findCollisions(result.Artifacts)
+		if len(remaining) != 0 {
+			// the same target and arch produce several artifacts with the same name - cannot be fixed by suffix,
+			// or suffixed name equals to name of another artifact (e.g. explicitly named "app-x64.zip")
+			result.Collisions = remaining
+			return result, collisionError(remaining)
+		}
+		return result, nil
+
+	default:
+		return nil, util.NewMessageError("unknown artifact name collision policy "+policy, "ERR_ARTIFACT_UNKNOWN_COLLISION_POLICY")
+	}
+}
+
+func collisionError(collisions []*Collision) error {
+	var builder strings.Builder
+	builder.WriteString("several targets produce artifacts with the same name, artifacts would be overwritten:")
+	for _, collision := range collisions {
+		builder.WriteString("\n  ")
+		builder.WriteString(collision.File)
+		builder.WriteString(": ")
+		builder.WriteString(strings.Join(collision.Targets, ", "))
+	}
+	builder.WriteString("\nuse different artifactName for targets or set policy to append arch or target")
+	return util.NewMessageError(builder.String(), "ERR_ARTIFACT_NAME_COLLISION")
+}
+
+func findCollisions(artifacts []*Artifact) []*Collision {
+	keyToIndices := make(map[string][]int)
+	var keys []string
+	for index, artifact := range artifacts {
+		key := normalizeName(artifact.File)
+		if _, ok := keyToIndices[key]; !ok {
+			keys = append(keys, key)
+		}
+		keyToIndices[key] = append(keyToIndices[key], index)
+	}
+
+	result := []*Collision{}
+	for _, key := range keys {
+		indices := keyToIndices[key]
+		if len(indices) < 2 {
+			continue
+		}
+
+		collision := &Collision{File: artifacts[indices[0]].File}
+		for _, index := range indices {
+			collision.Targets = append(collision.Targets, artifacts[index].describe())
+		}
+		result = append(result, collision)
+	}
+	return result
+}
+
+func disambiguate(artifacts []*Artifact, isArchFirst bool) {
+	keyToIndices := make(map[string][]int)
+	for index, artifact := range artifacts {
+		key := normalizeName(artifact.File)
+		keyToIndices[key] = append(keyToIndices[key], index)
+	}
+
+	for _, indices := range keyToIndices {
+		if len(indices) < 2 {
+			continue
+		}
+
+		isArchDiffers := !isSame(artifacts, indices, func(artifact *Artifact) string { return artifact.Arch })
+		isTargetDiffers := !isSame(artifacts, indices, func(artifact *Artifact) string { return artifact.Target })
+
+		for _, index := range indices {
+			artifact := artifacts[index]
+			suffix := artifact.Target
+			if isArchDiffers && (isArchFirst || !isTargetDiffers) {
+				suffix = artifact.Arch
+			}
+			if suffix != "" {
+				artifact.File = appendToName(artifact.File, suffix)
+			}
+		}
+	}
+}
+
+func isSame(artifacts []*Artifact, indices []int, getter func(artifact *Artifact) string) bool {
+	first := getter(artifacts[indices[0]])
+	for _, index := range indices[1:] {
+		if getter(artifacts[index]) != first {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *Artifact) describe() string {
+	if t.Arch == "" {
+		return t.Target
+	}
+	return t.Target + " (" + t.Arch + ")"
+}
+
+func normalizeName(file string) string {
+	return strings.ToLower(filepath.ToSlash(filepath.Clean(file)))
+}
+
+// appendToName inserts suffix before extension: "App 1.0.0.tar.gz" -> "App 1.0.0-arm64.tar.gz", "App-1.2.3" -> "App-1.2.3-arm64"
+func appendToName(file string, suffix string) string {
+	lowerCaseFile := strings.ToLower(file)
+	for _, extension := range artifactExtensions {
+		if strings.HasSuffix(lowerCaseFile, extension) {
+			extensionStart := len(file) - len(extension)
+			if extension == ".blockmap" {
+				// blockmap name is the artifact name plus .blockmap
+				return appendToName(file[:extensionStart], suffix) + file[extensionStart:]
+			}
+			return file[:extensionStart] + "-" + suffix + file[extensionStart:]
+		}
+	}
+	return file + "-" + suffix
+}
@@ -0,0 +1,73 @@
+package artifact
+
+import (
+	"testing"
+
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	. "github.com/onsi/gomega"
+)
+
+func TestCollisionFail(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	result, err := CheckNames(&NameCheckRequest{
+		Artifacts: []*Artifact{
+			{Target: "nsis", Arch: "x64", File: "App Setup 1.0.0.exe"},
+			{Target: "nsis", Arch: "ia32", File: "App Setup 1.0.0.exe"},
+			{Target: "portable", Arch: "x64", File: "App 1.0.0.exe"},
+			{Target: "zip", Arch: "x64", File: "app 1.0.0.EXE"},
+		},
+	})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(errors.Cause(err).(util.MessageError).ErrorCode()).To(Equal("ERR_ARTIFACT_NAME_COLLISION"))
+	g.Expect(result.Collisions).To(Equal([]*Collision{
+		{File: "App Setup 1.0.0.exe", Targets: []string{"nsis (x64)", "nsis (ia32)"}},
+		{File: "App 1.0.0.exe", Targets: []string{"portable (x64)", "zip (x64)"}},
+	}))
+}
+
+func TestCollisionAppendArch(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	result, err := CheckNames(&NameCheckRequest{
+		Policy: CollisionPolicyAppendArch,
+		Artifacts: []*Artifact{
+			{Target: "tar.gz", Arch: "x64", File: "app-1.0.0.tar.gz"},
+			{Target: "tar.gz", Arch: "arm64", File: "app-1.0.0.tar.gz"},
+			{Target: "nsis", Arch: "x64", File: "App Setup.exe.blockmap"},
+			{Target: "nsis-web", Arch: "x64", File: "App Setup.exe.blockmap"},
+			{Target: "dmg", Arch: "x64", File: "App.dmg"},
+		},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.Artifacts).To(Equal([]*Artifact{
+		{Target: "tar.gz", Arch: "x64", File: "app-1.0.0-x64.tar.gz"},
+		{Target: "tar.gz", Arch: "arm64", File: "app-1.0.0-arm64.tar.gz"},
+		{Target: "nsis", Arch: "x64", File: "App Setup-nsis.exe.blockmap"},
+		{Target: "nsis-web", Arch: "x64", File: "App Setup-nsis-web.exe.blockmap"},
+		{Target: "dmg", Arch: "x64", File: "App.dmg"},
+	}))
+}
+
+func TestCollisionCannotBeResolved(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	_, err := CheckNames(&NameCheckRequest{
+		Policy: CollisionPolicyAppendTarget,
+		Artifacts: []*Artifact{
+			{Target: "zip", Arch: "x64", File: "app.zip"},
+			{Target: "zip", Arch: "x64", File: "app.zip"},
+		},
+	})
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestAppendToName(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	g.Expect(appendToName("App-1.2.3", "arm64")).To(Equal("App-1.2.3-arm64"))
+	g.Expect(appendToName("out/App-1.2.3.AppImage", "arm64")).To(Equal("out/App-1.2.3-arm64.AppImage"))
+	g.Expect(appendToName("App-1.2.3.tar.xz", "arm64")).To(Equal("App-1.2.3-arm64.tar.xz"))
+	g.Expect(appendToName("App Setup 1.2.3.exe.blockmap", "ia32")).To(Equal("App Setup 1.2.3-ia32.exe.blockmap"))
+}
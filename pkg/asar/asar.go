@@ -0,0 +1,96 @@
+package asar
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/errors"
+)
+
+// https://github.com/electron/asar - archive is a header (JSON, Chromium pickle) followed by concatenated data of packed files.
+// File offset in the header is relative to the end of the header.
+
+const (
+	IntegrityAlgorithm = "SHA256"
+	// asar uses 4 MB blocks for file integrity
+	IntegrityBlockSize = 4 * 1024 * 1024
+)
+
+// Integrity of the file data, checked by Electron if asar integrity fuse is enabled
+type Integrity struct {
+	Algorithm string   `json:"algorithm"`
+	Hash      string   `json:"hash"`
+	BlockSize int      `json:"blockSize"`
+	Blocks    []string `json:"blocks"`
+}
+
+// HeaderIntegrity is a hash of the header JSON, stored in ElectronAsarIntegrity of Info.plist (macOS) or resources of exe (Windows)
+type HeaderIntegrity struct {
+	Algorithm string `json:"algorithm"`
+	Hash      string `json:"hash"`
+}
+
+func ConfigureCommand(app *kingpin.Application) {
+	command := app.Command("asar", "Create and read asar archives (Electron app archive).")
+	configurePackCommand(command)
+	configureIntegrityCommand(command)
+	configureListCommand(command)
+	configureExtractCommand(command)
+	configureVerifyCommand(command)
+}
+
+func computeIntegrity(reader io.Reader, buffer []byte) (*Integrity, int64, error) {
+	fileHash := sha256.New()
+	result := &Integrity{Algorithm: IntegrityAlgorithm, BlockSize: IntegrityBlockSize}
+	var size int64
+	for {
+		n, err := io.ReadFull(reader, buffer)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, 0, errors.WithStack(err)
+		}
+
+		size += int64(n)
+		_, _ = fileHash.Write(buffer[:n])
+		// as asar does, the last block is always hashed, even if empty (empty file or size is a multiple of block size)
+		blockHash := sha256.Sum256(buffer[:n])
+		result.Blocks = append(result.Blocks, hex.EncodeToString(blockHash[:]))
+		if err != nil {
+			break
+		}
+	}
+
+	result.Hash = hex.EncodeToString(fileHash.Sum(nil))
+	return result, size, nil
+}
+
+func computeHeaderIntegrity(header []byte) *HeaderIntegrity {
+	hash := sha256.Sum256(header)
+	return &HeaderIntegrity{Algorithm: IntegrityAlgorithm, Hash: hex.EncodeToString(hash[:])}
+}
+
+// encodeHeader returns header as written to the archive: size pickle (uint32 size of header pickle) and header pickle (string).
+// Pickle payload is prefixed by payload size and aligned to 4 bytes.
+func encodeHeader(header []byte) []byte {
+	alignedSize := (len(header) + 3) &^ 3
+	headerPickleSize := 4 + 4 + alignedSize
+
+	var buffer bytes.Buffer
+	buffer.Grow(8 + headerPickleSize)
+	writeUint32(&buffer, 4)
+	writeUint32(&buffer, uint32(headerPickleSize))
+	writeUint32(&buffer, uint32(4+alignedSize))
+	writeUint32(&buffer, uint32(len(header)))
+	buffer.Write(header)
+	buffer.Write(make([]byte, alignedSize-len(header)))
+	return buffer.Bytes()
+}
+
+func writeUint32(buffer *bytes.Buffer, value uint32) {
+	var data [4]byte
+	binary.LittleEndian.PutUint32(data[:], value)
+	buffer.Write(data[:])
+}
@@ -0,0 +1,117 @@
+package asar
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+)
+
+// ReadFile returns data of the file (packed or unpacked) by slash-separated path relative to the archive root
+func (t *Archive) ReadFile(p string) ([]byte, error) {
+	item := t.findEntry(p)
+	if item == nil || item.mode.IsDir() || len(item.link) != 0 {
+		return nil, errors.WithStack(&os.PathError{Op: "read", Path: t.File + "/" + p, Err: os.ErrNotExist})
+	}
+
+	archiveFile, err := os.Open(t.File)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer util.Close(archiveFile)
+
+	reader, err := t.openFile(archiveFile, item)
+	if err != nil {
+		return nil, err
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer util.Close(closer)
+	}
+	data, err := ioutil.ReadAll(reader)
+	return data, errors.WithStack(err)
+}
+
+// DiffPacked returns sorted paths of entries that differ. Packed files are compared by integrity hash (by content if archive is created by old asar without integrity).
+// Content of unpacked files is not compared - they are stored on disk and must be compared as files, only presence is checked.
+func DiffPacked(a *Archive, b *Archive) ([]string, error) {
+	aEntries := collectEntries(a)
+	bEntries := collectEntries(b)
+
+	var result []string
+	for p, aItem := range aEntries {
+		bItem := bEntries[p]
+		if bItem == nil {
+			result = append(result, p)
+			continue
+		}
+
+		isSame, err := isSameEntry(a, aItem, b, bItem)
+		if err != nil {
+			return nil, err
+		}
+		if !isSame {
+			result = append(result, p)
+		}
+	}
+	for p := range bEntries {
+		if aEntries[p] == nil {
+			result = append(result, p)
+		}
+	}
+
+	sort.Strings(result)
+	return result, nil
+}
+
+func collectEntries(archive *Archive) map[string]*entry {
+	result := make(map[string]*entry)
+	walkEntries(archive.root, true, nil, func(item *entry) {
+		result[item.path] = item
+	})
+	return result
+}
+
+func isSameEntry(a *Archive, aItem *entry, b *Archive, bItem *entry) (bool, error) {
+	switch {
+	case aItem.mode.IsDir() || bItem.mode.IsDir():
+		return aItem.mode.IsDir() == bItem.mode.IsDir(), nil
+	case len(aItem.link) != 0 || len(bItem.link) != 0:
+		return aItem.link == bItem.link, nil
+	case aItem.isUnpacked || bItem.isUnpacked:
+		return aItem.isUnpacked == bItem.isUnpacked, nil
+	case aItem.size != bItem.size || aItem.isExecutable != bItem.isExecutable:
+		return false, nil
+	case aItem.integrity != nil && bItem.integrity != nil && aItem.integrity.Algorithm == bItem.integrity.Algorithm:
+		return aItem.integrity.Hash == bItem.integrity.Hash, nil
+	}
+
+	aHash, err := a.computeHash(aItem)
+	if err != nil {
+		return false, err
+	}
+	bHash, err := b.computeHash(bItem)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(aHash, bHash), nil
+}
+
+func (t *Archive) computeHash(item *entry) ([]byte, error) {
+	archiveFile, err := os.Open(t.File)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer util.Close(archiveFile)
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, io.NewSectionReader(archiveFile, t.DataOffset+item.offset, item.size))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return hash.Sum(nil), nil
+}
@@ -0,0 +1,193 @@
+package asar
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/fs"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+)
+
+type ListItem struct {
+	Path string `json:"path"`
+	// file, dir or link
+	Type       string `json:"type"`
+	Size       int64  `json:"size,omitempty"`
+	Unpacked   bool   `json:"unpacked,omitempty"`
+	Executable bool   `json:"executable,omitempty"`
+	Link       string `json:"link,omitempty"`
+}
+
+func configureListCommand(asarCommand *kingpin.CmdClause) {
+	command := asarCommand.Command("list", "List entries of asar archive.")
+	file := command.Flag("file", "The asar archive.").Short('f').Required().ExistingFile()
+	patterns := command.Flag("pattern", "List only entries matching the glob pattern, can be specified several times.").Strings()
+	isJson := command.Flag("json", "Write entries with size and flags as JSON.").Bool()
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		archive, err := OpenArchive(*file)
+		if err != nil {
+			return err
+		}
+
+		items := archive.List(NewPatterns(*patterns))
+		if *isJson {
+			return util.WriteJsonToStdOut(items)
+		}
+
+		writer := bufio.NewWriter(os.Stdout)
+		for _, item := range items {
+			// the same format as asar list
+			_, _ = fmt.Fprintln(writer, "/"+item.Path)
+		}
+		return errors.WithStack(writer.Flush())
+	})
+}
+
+func configureExtractCommand(asarCommand *kingpin.CmdClause) {
+	command := asarCommand.Command("extract", "Extract asar archive (unpacked files are taken from the <archive>.unpacked dir).")
+	file := command.Flag("file", "The asar archive.").Short('f').Required().ExistingFile()
+	output := command.Flag("output", "The output dir.").Short('o').Required().String()
+	patterns := command.Flag("pattern", "Extract only entries matching the glob pattern (dir is extracted with content), can be specified several times.").Strings()
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		archive, err := OpenArchive(*file)
+		if err != nil {
+			return err
+		}
+		return archive.Extract(*output, NewPatterns(*patterns))
+	})
+}
+
+// List returns entries in the header order, all entries if patterns are not specified
+func (t *Archive) List(patterns []*Pattern) []*ListItem {
+	var result []*ListItem
+	walkEntries(t.root, len(patterns) == 0, patterns, func(item *entry) {
+		listItem := &ListItem{Path: item.path, Unpacked: item.isUnpacked}
+		switch {
+		case item.mode.IsDir():
+			listItem.Type = "dir"
+		case len(item.link) != 0:
+			listItem.Type = "link"
+			listItem.Link = item.link
+		default:
+			listItem.Type = "file"
+			listItem.Size = item.size
+			listItem.Executable = item.isExecutable
+		}
+		result = append(result, listItem)
+	})
+	return result
+}
+
+// walkEntries calls consumer for all entries (parent before children) matching patterns, entries of matched dir are matched
+func walkEntries(dir *entry, isParentMatched bool, patterns []*Pattern, consumer func(item *entry)) {
+	for _, child := range dir.children {
+		isMatched := isParentMatched || matchAny(patterns, child.path)
+		if isMatched {
+			consumer(child)
+		}
+		if child.mode.IsDir() {
+			walkEntries(child, isMatched, patterns, consumer)
+		}
+	}
+}
+
+// Extract extracts entries matching patterns (all if not specified) to the output dir
+func (t *Archive) Extract(outDir string, patterns []*Pattern) error {
+	archiveFile, err := os.Open(t.File)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(archiveFile)
+
+	err = fsutil.EnsureDir(outDir)
+	if err != nil {
+		return err
+	}
+
+	walkEntries(t.root, len(patterns) == 0, patterns, func(item *entry) {
+		if err != nil {
+			return
+		}
+
+		target := filepath.Join(outDir, filepath.FromSlash(item.path))
+		switch {
+		case item.mode.IsDir():
+			err = errors.WithStack(os.MkdirAll(target, 0755))
+		case len(item.link) != 0:
+			err = t.extractLink(item, target)
+		default:
+			err = t.extractFile(archiveFile, item, target)
+		}
+	})
+	return err
+}
+
+func (t *Archive) extractFile(archiveFile *os.File, item *entry, target string) error {
+	reader, err := t.openFile(archiveFile, item)
+	if err != nil {
+		return err
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer util.Close(closer)
+	}
+
+	mode := os.FileMode(0644)
+	if item.isExecutable {
+		mode = 0755
+	}
+	return fs.WriteFileAndRestoreNormalPermissions(reader, target, mode, nil)
+}
+
+// openFile returns reader of file data: unpacked file or section of the archive
+func (t *Archive) openFile(archiveFile *os.File, item *entry) (io.Reader, error) {
+	if item.isUnpacked {
+		file, err := os.Open(filepath.Join(t.File+".unpacked", filepath.FromSlash(item.path)))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return file, nil
+	}
+	return io.NewSectionReader(archiveFile, t.DataOffset+item.offset, item.size), nil
+}
+
+// link is stored relative to the archive root, symlink is created relative to the link dir
+func (t *Archive) extractLink(item *entry, target string) error {
+	if !isLinkInArchive(item.link) {
+		return createInvalidArchiveError(t.File, "link "+item.path+" points outside of the archive")
+	}
+
+	linkTarget, err := filepath.Rel(filepath.FromSlash(path.Dir(item.path)), filepath.FromSlash(item.link))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = fsutil.EnsureDir(filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(os.Symlink(linkTarget, target))
+}
+
+func isLinkInArchive(link string) bool {
+	link = path.Clean(link)
+	return link != ".." && !strings.HasPrefix(link, "../") && !path.IsAbs(link)
+}
+
+// findEntry returns entry by slash-separated path relative to the archive root
+func (t *Archive) findEntry(p string) *entry {
+	p = path.Clean(p)
+	if p == "." {
+		return t.root
+	}
+	return findChild(t.root, p)
+}
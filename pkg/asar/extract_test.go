@@ -0,0 +1,135 @@
+package asar
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+)
+
+func createTestArchive(g *GomegaWithT, dir string) string {
+	appDir := filepath.Join(dir, "app")
+	writeTestFile(g, filepath.Join(appDir, "index.js"), "console.log(1)", 0644)
+	writeTestFile(g, filepath.Join(appDir, "index.js.map"), "{}", 0644)
+	writeTestFile(g, filepath.Join(appDir, "lib", "a.js"), "module.exports = 1", 0644)
+	writeTestFile(g, filepath.Join(appDir, "lib", "test", "a.test.js"), "test()", 0644)
+	writeTestFile(g, filepath.Join(appDir, "bin", "tool"), "#!/bin/sh", 0755)
+	writeTestFile(g, filepath.Join(appDir, "native.node"), "binary", 0644)
+	g.Expect(os.Symlink("lib/a.js", filepath.Join(appDir, "link.js"))).To(Succeed())
+
+	output := filepath.Join(dir, "app.asar")
+	_, err := Pack(PackOptions{Dir: appDir, Output: output, Unpack: []string{"*.node"}})
+	g.Expect(err).NotTo(HaveOccurred())
+	return output
+}
+
+func TestListAndExtract(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "asar")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	archive, err := OpenArchive(createTestArchive(g, dir))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	var paths []string
+	for _, item := range archive.List(nil) {
+		paths = append(paths, item.Path)
+	}
+	g.Expect(paths).To(Equal([]string{"bin", "bin/tool", "index.js", "index.js.map", "lib", "lib/a.js", "lib/test", "lib/test/a.test.js", "link.js", "native.node"}))
+	g.Expect(archive.List(NewPatterns([]string{"*.map", "native.node"}))).To(Equal([]*ListItem{
+		{Path: "index.js.map", Type: "file", Size: 2},
+		{Path: "native.node", Type: "file", Size: 6, Unpacked: true},
+	}))
+
+	outDir := filepath.Join(dir, "all")
+	g.Expect(archive.Extract(outDir, nil)).To(Succeed())
+	for file, expected := range map[string]string{"index.js": "console.log(1)", "lib/test/a.test.js": "test()", "native.node": "binary", "link.js": "module.exports = 1"} {
+		data, err := ioutil.ReadFile(filepath.Join(outDir, filepath.FromSlash(file)))
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(string(data)).To(Equal(expected))
+	}
+	info, err := os.Stat(filepath.Join(outDir, "bin", "tool"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(info.Mode().Perm() & 0100).NotTo(BeZero())
+	g.Expect(os.Readlink(filepath.Join(outDir, "link.js"))).To(Equal(filepath.Join("lib", "a.js")))
+
+	// matched dir is extracted with content
+	outDir = filepath.Join(dir, "lib")
+	g.Expect(archive.Extract(outDir, NewPatterns([]string{"lib"}))).To(Succeed())
+	g.Expect(filepath.Join(outDir, "lib", "test", "a.test.js")).To(BeAnExistingFile())
+	g.Expect(filepath.Join(outDir, "index.js")).NotTo(BeAnExistingFile())
+}
+
+func TestVerify(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "asar")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	file := createTestArchive(g, dir)
+	result, err := Verify(file, VerifyOptions{})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.IsValid).To(BeTrue())
+	g.Expect(result.FileCount).To(Equal(6))
+	g.Expect(result.Summary.Findings).To(BeEmpty())
+
+	result, err = Verify(file, VerifyOptions{Disallow: []string{"*.map", "**/test/**"}})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.IsValid).To(BeFalse())
+	g.Expect(result.Summary.Findings).To(HaveLen(1))
+	g.Expect(result.Summary.Findings[0].Code).To(Equal("ERR_ASAR_DISALLOWED_FILE"))
+	g.Expect(result.Summary.Findings[0].Locations).To(Equal([]string{"index.js.map", "lib/test/a.test.js"}))
+
+	// tamper packed and unpacked data
+	archive, err := OpenArchive(file)
+	g.Expect(err).NotTo(HaveOccurred())
+	data, err := ioutil.ReadFile(file)
+	g.Expect(err).NotTo(HaveOccurred())
+	data[archive.DataOffset+archive.findEntry("index.js").offset] = 'X'
+	g.Expect(ioutil.WriteFile(file, data, 0644)).To(Succeed())
+	g.Expect(ioutil.WriteFile(filepath.Join(file+".unpacked", "native.node"), []byte("binarY"), 0644)).To(Succeed())
+
+	result, err = Verify(file, VerifyOptions{})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.IsValid).To(BeFalse())
+	g.Expect(result.Summary.Findings).To(HaveLen(1))
+	g.Expect(result.Summary.Findings[0].Code).To(Equal("ERR_ASAR_INTEGRITY_MISMATCH"))
+	g.Expect(result.Summary.Findings[0].Locations).To(Equal([]string{"index.js", "native.node"}))
+
+	result, err = Verify(file, VerifyOptions{IsSkipIntegrity: true})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.IsValid).To(BeTrue())
+
+	g.Expect(os.Remove(filepath.Join(file+".unpacked", "native.node"))).To(Succeed())
+	result, err = Verify(file, VerifyOptions{IsSkipIntegrity: true})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.Summary.Findings[0].Code).To(Equal("ERR_ASAR_UNPACKED_MISSING"))
+}
+
+func TestInvalidArchive(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "asar")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "evil.asar")
+	header := encodeHeader([]byte(`{"files":{"..":{"files":{"evil.js":{"size":0,"offset":"0"}}}}}`))
+	g.Expect(ioutil.WriteFile(file, header, 0644)).To(Succeed())
+
+	_, err = OpenArchive(file)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.(interface{ ErrorCode() string }).ErrorCode()).To(Equal("ERR_ASAR_INVALID"))
+
+	g.Expect(ioutil.WriteFile(file, []byte("not an archive"), 0644)).To(Succeed())
+	_, err = OpenArchive(file)
+	g.Expect(err).To(HaveOccurred())
+}
@@ -0,0 +1,124 @@
+package asar
+
+import (
+	"path"
+	"strings"
+)
+
+// Pattern is a glob pattern as used by asar (minimatch with matchBase): pattern without slash matches file name,
+// ** matches any number of path segments and {a,b} alternatives are expanded.
+type Pattern struct {
+	alternatives [][]string
+	isMatchBase  bool
+}
+
+func NewPattern(pattern string) *Pattern {
+	pattern = strings.TrimPrefix(pattern, "./")
+	result := &Pattern{isMatchBase: !strings.Contains(pattern, "/")}
+	for _, alternative := range expandBraces(pattern) {
+		result.alternatives = append(result.alternatives, strings.Split(alternative, "/"))
+	}
+	return result
+}
+
+func NewPatterns(patterns []string) []*Pattern {
+	result := make([]*Pattern, 0, len(patterns))
+	for _, pattern := range patterns {
+		if len(pattern) != 0 {
+			result = append(result, NewPattern(pattern))
+		}
+	}
+	return result
+}
+
+// Match reports whether slash-separated path (relative to the archive root) is matched
+func (t *Pattern) Match(file string) bool {
+	segments := strings.Split(file, "/")
+	if t.isMatchBase {
+		segments = segments[len(segments)-1:]
+	}
+
+	for _, alternative := range t.alternatives {
+		if matchSegments(alternative, segments) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []*Pattern, file string) bool {
+	for _, pattern := range patterns {
+		if pattern.Match(file) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchSegments(pattern []string, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// ** matches zero or more segments
+			for i := 0; i <= len(segments); i++ {
+				if matchSegments(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(segments) == 0 {
+			return false
+		}
+		isMatched, err := path.Match(pattern[0], segments[0])
+		if err != nil || !isMatched {
+			return false
+		}
+		pattern = pattern[1:]
+		segments = segments[1:]
+	}
+	return len(segments) == 0
+}
+
+// expandBraces expands {a,b} alternatives (including nested), e.g. *.{node,dll} to *.node and *.dll
+func expandBraces(pattern string) []string {
+	start := strings.IndexByte(pattern, '{')
+	if start < 0 {
+		return []string{pattern}
+	}
+
+	depth := 0
+	itemStart := start + 1
+	var items []string
+	for i := start; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '{':
+			depth++
+		case ',':
+			if depth == 1 {
+				items = append(items, pattern[itemStart:i])
+				itemStart = i + 1
+			}
+		case '}':
+			depth--
+			if depth == 0 {
+				items = append(items, pattern[itemStart:i])
+				if len(items) == 1 {
+					// {a} is not an alternative - kept as is
+					var result []string
+					for _, rest := range expandBraces(pattern[i+1:]) {
+						result = append(result, pattern[:i+1]+rest)
+					}
+					return result
+				}
+
+				var result []string
+				for _, item := range items {
+					result = append(result, expandBraces(pattern[:start]+item+pattern[i+1:])...)
+				}
+				return result
+			}
+		}
+	}
+	return []string{pattern}
+}
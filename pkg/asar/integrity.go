@@ -0,0 +1,247 @@
+package asar
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+	"github.com/json-iterator/go"
+	"howett.net/plist"
+)
+
+type ArchiveIntegrity struct {
+	File string `json:"file"`
+	// path of the archive relative to the base dir (Contents on macOS, app dir on Windows), slash-separated
+	Key       string           `json:"key"`
+	Integrity *HeaderIntegrity `json:"integrity"`
+	// files without integrity in the header (archive is created by old asar), computed if update is requested
+	UpdatedFileCount int `json:"updatedFileCount"`
+}
+
+type IntegrityResult struct {
+	Archives []*ArchiveIntegrity `json:"archives"`
+	// value of ElectronAsarIntegrity in Info.plist (macOS)
+	Plist map[string]*HeaderIntegrity `json:"plist"`
+	// JSON value of INTEGRITY/ELECTRONASAR resource of the executable (Windows)
+	WindowsResource string `json:"windowsResource"`
+}
+
+// https://github.com/electron/electron/blob/main/shell/common/asar/archive_win.cc
+type windowsIntegrityItem struct {
+	File      string `json:"file"`
+	Algorithm string `json:"alg"`
+	Value     string `json:"value"`
+}
+
+func configureIntegrityCommand(asarCommand *kingpin.CmdClause) {
+	command := asarCommand.Command("integrity", "Compute header hashes of asar archives for the asar integrity fuse (ElectronAsarIntegrity). "+
+		"Values for Info.plist (macOS) and INTEGRITY resource (Windows) are written to stdout as JSON.")
+	files := command.Flag("file", "The asar archive, can be specified several times.").Short('f').Required().ExistingFiles()
+	baseDir := command.Flag("base", "The dir archive path is relative to: Contents dir of macOS app or app dir on Windows (default: parent of the archive dir).").String()
+	isUpdate := command.Flag("update", "Add integrity of files to the header if missing (archive created by old asar), Electron refuses such archive if fuse is enabled.").Bool()
+	plistFile := command.Flag("plist", "Set ElectronAsarIntegrity in the Info.plist.").ExistingFile()
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		result, err := ComputeIntegrity(*files, *baseDir, *isUpdate)
+		if err != nil {
+			return err
+		}
+
+		if len(*plistFile) != 0 {
+			err = SetPlistIntegrity(*plistFile, result.Plist)
+			if err != nil {
+				return err
+			}
+		}
+		return util.WriteJsonToStdOut(result)
+	})
+}
+
+func ComputeIntegrity(files []string, baseDir string, isUpdate bool) (*IntegrityResult, error) {
+	result := &IntegrityResult{Plist: make(map[string]*HeaderIntegrity)}
+	var windowsItems []windowsIntegrityItem
+	for _, file := range files {
+		archiveIntegrity, err := computeArchiveIntegrity(file, isUpdate)
+		if err != nil {
+			return nil, err
+		}
+
+		dir := baseDir
+		if len(dir) == 0 {
+			dir = filepath.Dir(filepath.Dir(file))
+		}
+		key, err := filepath.Rel(dir, file)
+		if err != nil || strings.HasPrefix(key, "..") {
+			return nil, util.NewMessageError("asar archive "+file+" is not in the base dir "+dir, "ERR_ASAR_INTEGRITY_BASE_DIR")
+		}
+
+		archiveIntegrity.Key = filepath.ToSlash(key)
+		result.Archives = append(result.Archives, archiveIntegrity)
+		result.Plist[archiveIntegrity.Key] = archiveIntegrity.Integrity
+		windowsItems = append(windowsItems, windowsIntegrityItem{
+			File:      strings.Replace(archiveIntegrity.Key, "/", "\\", -1),
+			Algorithm: strings.ToLower(archiveIntegrity.Integrity.Algorithm),
+			Value:     archiveIntegrity.Integrity.Hash,
+		})
+	}
+
+	windowsResource, err := jsoniter.ConfigFastest.MarshalToString(windowsItems)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	result.WindowsResource = windowsResource
+	return result, nil
+}
+
+func computeArchiveIntegrity(file string, isUpdate bool) (*ArchiveIntegrity, error) {
+	archive, err := OpenArchive(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []*entry
+	walkFiles(archive.root, func(item *entry) {
+		if item.integrity == nil {
+			missing = append(missing, item)
+		}
+	})
+
+	header := archive.Header
+	if len(missing) != 0 {
+		if !isUpdate {
+			return nil, util.NewMessageError(strconv.Itoa(len(missing))+" files of "+file+" have no integrity in the header (archive is created by old asar), "+
+				"Electron refuses such archive if asar integrity fuse is enabled (use --update or recreate the archive)", "ERR_ASAR_INTEGRITY_MISSING")
+		}
+
+		err = archive.computeFileIntegrity(missing)
+		if err != nil {
+			return nil, err
+		}
+
+		header = encodeHeaderJson(archive.root)
+		err = archive.rewriteHeader(header)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &ArchiveIntegrity{
+		File:             file,
+		Integrity:        computeHeaderIntegrity(header),
+		UpdatedFileCount: len(missing),
+	}, nil
+}
+
+func (t *Archive) computeFileIntegrity(items []*entry) error {
+	archiveFile, err := os.Open(t.File)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(archiveFile)
+
+	return util.MapAsync(len(items), func(taskIndex int) (func() error, error) {
+		item := items[taskIndex]
+		return func() error {
+			var reader io.Reader
+			if item.isUnpacked {
+				file, err := os.Open(filepath.Join(t.File+".unpacked", filepath.FromSlash(item.path)))
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				defer util.Close(file)
+				reader = file
+			} else {
+				reader = io.NewSectionReader(archiveFile, t.DataOffset+item.offset, item.size)
+			}
+
+			buffer := blockBufferPool.Get().([]byte)
+			defer blockBufferPool.Put(buffer)
+
+			integrity, size, err := computeIntegrity(reader, buffer)
+			if err != nil {
+				return err
+			}
+			if size != item.size {
+				return createInvalidArchiveError(t.File, "size of "+item.path+" doesn't match the header")
+			}
+			item.integrity = integrity
+			return nil
+		}, nil
+	})
+}
+
+// rewriteHeader replaces the header, file data is not changed (offsets are relative to the end of the header)
+func (t *Archive) rewriteHeader(header []byte) error {
+	archiveFile, err := os.Open(t.File)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(archiveFile)
+
+	info, err := archiveFile.Stat()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	tempFile := t.File + ".tmp"
+	out, err := os.Create(tempFile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = out.Write(encodeHeader(header))
+	if err == nil {
+		_, err = io.Copy(out, io.NewSectionReader(archiveFile, t.DataOffset, info.Size()-t.DataOffset))
+	}
+	err = fsutil.CloseAndCheckError(err, out)
+	if err == nil {
+		err = os.Rename(tempFile, t.File)
+	}
+	if err != nil {
+		_ = os.Remove(tempFile)
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// SetPlistIntegrity sets ElectronAsarIntegrity in the Info.plist, format of the file is preserved
+func SetPlistIntegrity(file string, value map[string]*HeaderIntegrity) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	var info map[string]interface{}
+	format, err := plist.Unmarshal(data, &info)
+	if err != nil {
+		return errors.WithMessage(err, "cannot decode plist "+file)
+	}
+	if format != plist.BinaryFormat {
+		format = plist.XMLFormat
+	}
+
+	integrity := make(map[string]interface{}, len(value))
+	for key, item := range value {
+		integrity[key] = map[string]interface{}{"algorithm": item.Algorithm, "hash": item.Hash}
+	}
+	info["ElectronAsarIntegrity"] = integrity
+
+	var out bytes.Buffer
+	encoder := plist.NewEncoderForFormat(&out, format)
+	if format == plist.XMLFormat {
+		encoder.Indent("\t")
+	}
+	err = encoder.Encode(info)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(ioutil.WriteFile(file, out.Bytes(), 0644))
+}
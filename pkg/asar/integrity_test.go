@@ -0,0 +1,99 @@
+package asar
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+	"howett.net/plist"
+)
+
+func TestIntegrity(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "asar")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	appDir := filepath.Join(dir, "app")
+	writeTestFile(g, filepath.Join(appDir, "index.js"), "console.log(1)", 0644)
+	writeTestFile(g, filepath.Join(appDir, "lib", "a.js"), "module.exports = 1", 0644)
+	writeTestFile(g, filepath.Join(appDir, "native.node"), "binary", 0755)
+
+	output := filepath.Join(dir, "Test.app", "Contents", "Resources", "app.asar")
+	packResult, err := Pack(PackOptions{Dir: appDir, Output: output, Unpack: []string{"*.node"}})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	result, err := ComputeIntegrity([]string{output}, "", false)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.Archives[0].Key).To(Equal("Resources/app.asar"))
+	g.Expect(result.Archives[0].Integrity).To(Equal(packResult.Integrity))
+	g.Expect(result.Plist).To(Equal(map[string]*HeaderIntegrity{"Resources/app.asar": packResult.Integrity}))
+	g.Expect(result.WindowsResource).To(Equal(`[{"file":"Resources\\app.asar","alg":"sha256","value":"` + packResult.Integrity.Hash + `"}]`))
+
+	// archive created by old asar - without integrity of files
+	archive, err := OpenArchive(output)
+	g.Expect(err).NotTo(HaveOccurred())
+	walkFiles(archive.root, func(item *entry) {
+		item.integrity = nil
+	})
+	g.Expect(archive.rewriteHeader(encodeHeaderJson(archive.root))).To(Succeed())
+
+	_, err = ComputeIntegrity([]string{output}, "", false)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.(interface{ ErrorCode() string }).ErrorCode()).To(Equal("ERR_ASAR_INTEGRITY_MISSING"))
+
+	result, err = ComputeIntegrity([]string{output}, filepath.Join(dir, "Test.app"), true)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.Archives[0].Key).To(Equal("Contents/Resources/app.asar"))
+	g.Expect(result.Archives[0].UpdatedFileCount).To(Equal(3))
+	g.Expect(result.Archives[0].Integrity).To(Equal(packResult.Integrity))
+
+	// data is not changed
+	archive, err = OpenArchive(output)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(archive.root.children[1].children[0].integrity).To(Equal(mustComputeIntegrity(g, "module.exports = 1")))
+}
+
+func mustComputeIntegrity(g *GomegaWithT, data string) *Integrity {
+	file, err := ioutil.TempFile("", "integrity")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.Remove(file.Name())
+	defer file.Close()
+	_, err = file.WriteString(data)
+	g.Expect(err).NotTo(HaveOccurred())
+	_, err = file.Seek(0, 0)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	integrity, _, err := computeIntegrity(file, make([]byte, IntegrityBlockSize))
+	g.Expect(err).NotTo(HaveOccurred())
+	return integrity
+}
+
+func TestSetPlistIntegrity(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "asar")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "Info.plist")
+	data, err := plist.MarshalIndent(map[string]interface{}{"CFBundleName": "Test"}, plist.XMLFormat, "\t")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(ioutil.WriteFile(file, data, 0644)).To(Succeed())
+
+	g.Expect(SetPlistIntegrity(file, map[string]*HeaderIntegrity{"Resources/app.asar": {Algorithm: "SHA256", Hash: "abc"}})).To(Succeed())
+
+	data, err = ioutil.ReadFile(file)
+	g.Expect(err).NotTo(HaveOccurred())
+	var info map[string]interface{}
+	format, err := plist.Unmarshal(data, &info)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(format).To(Equal(plist.XMLFormat))
+	g.Expect(info["CFBundleName"]).To(Equal("Test"))
+	g.Expect(info["ElectronAsarIntegrity"]).To(Equal(map[string]interface{}{"Resources/app.asar": map[string]interface{}{"algorithm": "SHA256", "hash": "abc"}}))
+}
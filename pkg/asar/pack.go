@@ -0,0 +1,615 @@
+package asar
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/fs"
+	"github.com/develar/app-builder/pkg/reproducible"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+	"github.com/json-iterator/go"
+)
+
+type PackOptions struct {
+	Dir    string
+	Output string
+	// files (glob, name is matched if pattern doesn't contain slash) to store in the <output>.unpacked dir instead of archive (e.g. native modules)
+	Unpack []string
+	// dirs (glob, relative path) to store in the <output>.unpacked dir
+	UnpackDir []string
+	// file with list of paths - data of the listed files is placed first (the same format as asar --ordering)
+	Ordering string
+	// detect native modules, shared libraries and executables that must be unpacked
+	IsSmartUnpack bool
+	// fs.SymlinkDereference to pack content of link targets, otherwise links are stored as links (link outside of the dir is an error, asar cannot store it)
+	SymlinkPolicy string
+	// data of hard linked files is stored once (entries share offset), unpacked files are hard linked
+	IsDedupeHardLinks bool
+}
+
+type PackResult struct {
+	File              string           `json:"file"`
+	HeaderSize        int              `json:"headerSize"`
+	Integrity         *HeaderIntegrity `json:"integrity"`
+	FileCount         int              `json:"fileCount"`
+	UnpackedFileCount int              `json:"unpackedFileCount"`
+	// paths (package dirs or files) unpacked by smart unpack
+	SmartUnpacked []string `json:"smartUnpacked,omitempty"`
+	// files which data is not duplicated because they are hard links of other files
+	HardLinkCount int `json:"hardLinkCount,omitempty"`
+}
+
+type entry struct {
+	name string
+	// slash-separated path relative to the archive root
+	path string
+	file string
+	mode os.FileMode
+	size int64
+	// slash-separated path of the link target relative to the archive root
+	link     string
+	children []*entry
+
+	isUnpacked   bool
+	isExecutable bool
+	offset       int64
+	integrity    *Integrity
+	// the first file with the same data (hard link), data of the file is not stored
+	hardLinkOf *entry
+}
+
+var blockBufferPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, IntegrityBlockSize)
+	},
+}
+
+func configurePackCommand(asarCommand *kingpin.CmdClause) {
+	command := asarCommand.Command("pack", "Create asar archive from the dir. Integrity of files and the header hash (for asar integrity fuse) are computed in parallel. "+
+		"Result (header integrity, file counts) is written to stdout as JSON.")
+	options := PackOptions{}
+	command.Flag("dir", "The dir to pack.").Required().ExistingDirVar(&options.Dir)
+	command.Flag("output", "The output file.").Short('o').Required().StringVar(&options.Output)
+	command.Flag("unpack", "Do not pack files matching the glob pattern (e.g. *.node), can be specified several times.").StringsVar(&options.Unpack)
+	command.Flag("unpack-dir", "Do not pack dirs matching the glob pattern (relative path), can be specified several times.").StringsVar(&options.UnpackDir)
+	command.Flag("ordering", "The file with list of paths to place first (asar ordering file).").ExistingFileVar(&options.Ordering)
+	command.Flag("smart-unpack", "Unpack native modules (.node), shared libraries and executables. Package in node_modules is unpacked as a whole, detected paths are reported as smartUnpacked.").BoolVar(&options.IsSmartUnpack)
+	command.Flag("symlinks", "How to pack symlinks: preserve (link outside of the dir is an error) or dereference (pack content of the target).").
+		Default(fs.SymlinkPreserve).EnumVar(&options.SymlinkPolicy, fs.SymlinkPreserve, fs.SymlinkDereference, fs.SymlinkErrorOnExternal)
+	command.Flag("dedupe-hard-links", "Store data of hard linked files once.").BoolVar(&options.IsDedupeHardLinks)
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		result, err := Pack(options)
+		if err != nil {
+			return err
+		}
+		return util.WriteJsonToStdOut(result)
+	})
+}
+
+// Pack creates asar archive. Entries are sorted by name, there is no time or ownership in asar, so, archive is reproducible
+// (in the reproducible mode modification time of unpacked files is normalized).
+func Pack(options PackOptions) (*PackResult, error) {
+	// deep node_modules exceed MAX_PATH on Windows (reported file is kept as specified)
+	outputFile := options.Output
+	options.Dir = fs.ToLongPath(options.Dir)
+	options.Output = fs.ToLongPath(options.Output)
+
+	rootRealDir, err := filepath.EvalSymlinks(options.Dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	p := &packer{
+		rootRealDir:   rootRealDir,
+		unpack:        NewPatterns(options.Unpack),
+		unpackDir:     NewPatterns(options.UnpackDir),
+		isDereference: options.SymlinkPolicy == fs.SymlinkDereference,
+	}
+	if options.IsDedupeHardLinks {
+		p.hardLinks = make(map[fs.FileId]*entry)
+	}
+	root := &entry{mode: os.ModeDir}
+	root.children, err = p.readDir(options.Dir, "", false)
+	if err != nil {
+		return nil, err
+	}
+
+	var smartUnpacked []string
+	if options.IsSmartUnpack {
+		smartUnpacked, err = p.smartUnpack(root)
+		if err != nil {
+			return nil, err
+		}
+	}
+	p.collectUnpacked(root)
+	hardLinkCount := p.resolveHardLinks()
+
+	err = p.computeIntegrity()
+	if err != nil {
+		return nil, err
+	}
+
+	ordering, err := readOrdering(options.Ordering)
+	if err != nil {
+		return nil, err
+	}
+	packedFiles := p.getPackedFiles(ordering)
+
+	var offset int64
+	for _, file := range packedFiles {
+		file.offset = offset
+		offset += file.size
+	}
+	for _, file := range p.files {
+		if file.hardLinkOf != nil {
+			file.offset = file.hardLinkOf.offset
+		}
+	}
+
+	header := encodeHeaderJson(root)
+	err = writeArchive(options.Output, encodeHeader(header), packedFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	unpackedDir := options.Output + ".unpacked"
+	unpackedCount, err := p.writeUnpacked(unpackedDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if reproducible.IsEnabled() {
+		err = writeReproducibleReport(options.Output, unpackedDir, len(p.unpacked) != 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &PackResult{
+		File:              outputFile,
+		HeaderSize:        len(header),
+		Integrity:         computeHeaderIntegrity(header),
+		FileCount:         len(p.files),
+		UnpackedFileCount: unpackedCount,
+		SmartUnpacked:     smartUnpacked,
+		HardLinkCount:     hardLinkCount,
+	}, nil
+}
+
+type packer struct {
+	rootRealDir string
+	unpack      []*Pattern
+	unpackDir   []*Pattern
+
+	isDereference bool
+	// nil if hard links are not detected
+	hardLinks map[fs.FileId]*entry
+
+	// all regular files, in the walk order
+	files []*entry
+	// unpacked entries (files, links and empty dirs), in the walk order
+	unpacked []*entry
+}
+
+func (t *packer) readDir(dir string, dirPath string, isUnpackedDir bool) ([]*entry, error) {
+	// sorted by name
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	result := make([]*entry, 0, len(infos))
+	for _, info := range infos {
+		item := &entry{
+			name:       info.Name(),
+			path:       path.Join(dirPath, info.Name()),
+			file:       filepath.Join(dir, info.Name()),
+			mode:       info.Mode(),
+			isUnpacked: isUnpackedDir,
+		}
+
+		switch {
+		case info.IsDir():
+			item.isUnpacked = isUnpackedDir || matchAny(t.unpackDir, item.path)
+			item.children, err = t.readDir(item.file, item.path, item.isUnpacked)
+			if err != nil {
+				return nil, err
+			}
+
+		case info.Mode()&os.ModeSymlink != 0 && t.isDereference:
+			info, err = t.dereference(item)
+			if err != nil {
+				return nil, err
+			}
+			if info.IsDir() {
+				item.mode = os.ModeDir
+				item.isUnpacked = isUnpackedDir || matchAny(t.unpackDir, item.path)
+				item.children, err = t.readDir(item.file, item.path, item.isUnpacked)
+				if err != nil {
+					return nil, err
+				}
+			} else {
+				item.mode = info.Mode()
+				err = t.addFile(item, info, isUnpackedDir)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+		case info.Mode()&os.ModeSymlink != 0:
+			item.link, err = t.resolveLink(item)
+			if err != nil {
+				return nil, err
+			}
+
+		case info.Mode().IsRegular():
+			err = t.addFile(item, info, isUnpackedDir)
+			if err != nil {
+				return nil, err
+			}
+
+		default:
+			// sockets and pipes cannot be packed, asar skips them too
+			continue
+		}
+
+		result = append(result, item)
+	}
+	return result, nil
+}
+
+func (t *packer) addFile(item *entry, info os.FileInfo, isUnpackedDir bool) error {
+	if info.Size() > math.MaxUint32 {
+		return util.NewMessageError("cannot pack "+item.file+": file size is more than 4 GB, use --unpack to not pack it", "ERR_ASAR_FILE_TOO_LARGE")
+	}
+	item.size = info.Size()
+	item.isExecutable = info.Mode()&0100 != 0 && runtime.GOOS != "windows"
+	item.isUnpacked = isUnpackedDir || matchAny(t.unpack, item.path)
+	t.files = append(t.files, item)
+
+	if t.hardLinks != nil {
+		fileId, isHardLinked := fs.GetFileId(info)
+		if isHardLinked {
+			if first := t.hardLinks[fileId]; first != nil {
+				item.hardLinkOf = first
+			} else {
+				t.hardLinks[fileId] = item
+			}
+		}
+	}
+	return nil
+}
+
+// dereference returns info of the link target, item.file is kept (reading follows links)
+func (t *packer) dereference(item *entry) (os.FileInfo, error) {
+	target, err := filepath.EvalSymlinks(item.file)
+	if err != nil {
+		return nil, util.NewMessageError("cannot pack "+item.file+": cannot dereference link: "+err.Error(), "ERR_LINK_BROKEN")
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if info.IsDir() {
+		parentRealDir, err := filepath.EvalSymlinks(filepath.Dir(item.file))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if fs.IsPathInside(parentRealDir, target) {
+			return nil, util.NewMessageError("cannot pack "+item.file+": link to the parent dir "+target+" creates a cycle", "ERR_LINK_CYCLE")
+		}
+	}
+	return info, nil
+}
+
+// resolveHardLinks keeps hard link only if both files are packed or both are unpacked (smart unpack can unpack one of them), returns count of hard links
+func (t *packer) resolveHardLinks() int {
+	count := 0
+	for _, item := range t.files {
+		if item.hardLinkOf == nil {
+			continue
+		}
+		if item.hardLinkOf.isUnpacked != item.isUnpacked {
+			item.hardLinkOf = nil
+		} else {
+			count++
+		}
+	}
+	return count
+}
+
+// link is stored as the path of the real file relative to the archive root, link out of the archive cannot be resolved by Electron
+func (t *packer) resolveLink(item *entry) (string, error) {
+	target, err := filepath.EvalSymlinks(item.file)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	relativePath, err := filepath.Rel(t.rootRealDir, target)
+	if err != nil || relativePath == ".." || strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+		return "", util.NewMessageError("cannot pack "+item.file+": link to "+target+" is out of the packed dir", "ERR_ASAR_LINK_OUTSIDE")
+	}
+	return filepath.ToSlash(relativePath), nil
+}
+
+// collectUnpacked collects unpacked files, links and empty dirs (to create in the unpacked dir), in the walk order
+func (t *packer) collectUnpacked(dir *entry) {
+	for _, item := range dir.children {
+		if item.mode.IsDir() {
+			if item.isUnpacked && len(item.children) == 0 {
+				t.unpacked = append(t.unpacked, item)
+			}
+			t.collectUnpacked(item)
+		} else if item.isUnpacked {
+			t.unpacked = append(t.unpacked, item)
+		}
+	}
+}
+
+func (t *packer) computeIntegrity() error {
+	err := util.MapAsync(len(t.files), func(taskIndex int) (func() error, error) {
+		item := t.files[taskIndex]
+		if item.hardLinkOf != nil {
+			return nil, nil
+		}
+		return func() error {
+			file, err := os.Open(item.file)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			defer util.Close(file)
+
+			buffer := blockBufferPool.Get().([]byte)
+			defer blockBufferPool.Put(buffer)
+
+			integrity, size, err := computeIntegrity(file, buffer)
+			if err != nil {
+				return err
+			}
+			if size != item.size {
+				return errors.Errorf("file %s is modified during packing", item.file)
+			}
+			item.integrity = integrity
+			return nil
+		}, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, item := range t.files {
+		if item.hardLinkOf != nil {
+			item.integrity = item.hardLinkOf.integrity
+		}
+	}
+	return nil
+}
+
+// readOrdering reads asar ordering file: a path per line, optionally prefixed by "something:"
+func readOrdering(file string) ([]string, error) {
+	if len(file) == 0 {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var result []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if index := strings.LastIndexByte(line, ':'); index >= 0 {
+			line = line[index+1:]
+		}
+		line = strings.TrimPrefix(strings.TrimSpace(filepath.ToSlash(line)), "/")
+		if len(line) != 0 {
+			result = append(result, line)
+		}
+	}
+	return result, nil
+}
+
+// getPackedFiles returns files to write to the archive: files from ordering first, then others in the walk order
+func (t *packer) getPackedFiles(ordering []string) []*entry {
+	result := make([]*entry, 0, len(t.files))
+	isAdded := make(map[*entry]bool, len(ordering))
+	if len(ordering) != 0 {
+		pathToEntry := make(map[string]*entry, len(t.files))
+		for _, item := range t.files {
+			pathToEntry[item.path] = item
+		}
+
+		for _, p := range ordering {
+			item := pathToEntry[p]
+			if item != nil && !item.isUnpacked && item.hardLinkOf == nil && !isAdded[item] {
+				isAdded[item] = true
+				result = append(result, item)
+			}
+		}
+	}
+
+	for _, item := range t.files {
+		if !item.isUnpacked && item.hardLinkOf == nil && !isAdded[item] {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func encodeHeaderJson(root *entry) []byte {
+	stream := jsoniter.NewStream(jsoniter.ConfigFastest, nil, 64*1024)
+	writeHeaderEntry(stream, root)
+	return stream.Buffer()
+}
+
+func writeHeaderEntry(stream *jsoniter.Stream, item *entry) {
+	stream.WriteObjectStart()
+	switch {
+	case item.mode.IsDir():
+		stream.WriteObjectField("files")
+		stream.WriteObjectStart()
+		for index, child := range item.children {
+			if index != 0 {
+				stream.WriteMore()
+			}
+			stream.WriteObjectField(child.name)
+			writeHeaderEntry(stream, child)
+		}
+		stream.WriteObjectEnd()
+		if item.isUnpacked {
+			stream.WriteMore()
+			stream.WriteObjectField("unpacked")
+			stream.WriteBool(true)
+		}
+
+	case len(item.link) != 0:
+		stream.WriteObjectField("link")
+		stream.WriteString(item.link)
+
+	default:
+		stream.WriteObjectField("size")
+		stream.WriteInt64(item.size)
+		stream.WriteMore()
+		if item.isUnpacked {
+			stream.WriteObjectField("unpacked")
+			stream.WriteBool(true)
+		} else {
+			// offset is a string - JS number cannot represent uint64
+			stream.WriteObjectField("offset")
+			stream.WriteString(strconv.FormatInt(item.offset, 10))
+		}
+		if item.isExecutable {
+			stream.WriteMore()
+			stream.WriteObjectField("executable")
+			stream.WriteBool(true)
+		}
+		if item.integrity != nil {
+			stream.WriteMore()
+			stream.WriteObjectField("integrity")
+			stream.WriteVal(item.integrity)
+		}
+	}
+	stream.WriteObjectEnd()
+}
+
+func writeArchive(outFile string, header []byte, files []*entry) error {
+	err := fsutil.EnsureDir(filepath.Dir(outFile))
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(outFile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	writer := bufio.NewWriterSize(file, 1024*1024)
+	_, err = writer.Write(header)
+	for _, item := range files {
+		if err != nil {
+			break
+		}
+		err = copyFileData(writer, item)
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	return errors.WithStack(fsutil.CloseAndCheckError(err, file))
+}
+
+func copyFileData(writer io.Writer, item *entry) error {
+	file, err := os.Open(item.file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(file)
+
+	n, err := io.Copy(writer, io.LimitReader(file, item.size))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if n != item.size {
+		return errors.Errorf("file %s is modified during packing", item.file)
+	}
+	return nil
+}
+
+// writeUnpacked copies unpacked files to the <output>.unpacked dir, stale dir of the previous build is removed. Returns the number of unpacked files.
+func (t *packer) writeUnpacked(unpackedDir string) (int, error) {
+	err := os.RemoveAll(unpackedDir)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if len(t.unpacked) == 0 {
+		return 0, nil
+	}
+
+	count := 0
+	for _, item := range t.unpacked {
+		target := filepath.Join(unpackedDir, filepath.FromSlash(item.path))
+		switch {
+		case item.mode.IsDir():
+			err = os.MkdirAll(target, 0755)
+
+		case len(item.link) != 0:
+			err = createUnpackedLink(item, target)
+
+		case item.hardLinkOf != nil && os.Link(filepath.Join(unpackedDir, filepath.FromSlash(item.hardLinkOf.path)), target) == nil:
+			count++
+
+		default:
+			count++
+			err = fs.CopyFileAndRestoreNormalPermissions(item.file, target, item.mode)
+		}
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+	}
+
+	return count, nil
+}
+
+// asar doesn't store time and ownership, only modification time of unpacked files is normalized
+func writeReproducibleReport(outFile string, unpackedDir string, isUnpacked bool) error {
+	modTime, err := reproducible.GetTime()
+	if err != nil {
+		return err
+	}
+
+	report := reproducible.NewReport(outFile, "asar", modTime)
+	if isUnpacked {
+		count, err := reproducible.NormalizeDir(unpackedDir, modTime)
+		if err != nil {
+			return err
+		}
+		report.Add("mtime", count)
+	}
+	return report.Write()
+}
+
+func createUnpackedLink(item *entry, target string) error {
+	linkTarget, err := os.Readlink(item.file)
+	if err != nil {
+		return err
+	}
+
+	err = fsutil.EnsureDir(filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+	return os.Symlink(linkTarget, target)
+}
@@ -0,0 +1,213 @@
+package asar
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/fs"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/json-iterator/go"
+	. "github.com/onsi/gomega"
+)
+
+type testHeaderEntry struct {
+	Files      map[string]*testHeaderEntry `json:"files"`
+	Size       int64                       `json:"size"`
+	Offset     string                      `json:"offset"`
+	Unpacked   bool                        `json:"unpacked"`
+	Executable bool                        `json:"executable"`
+	Link       string                      `json:"link"`
+	Integrity  *Integrity                  `json:"integrity"`
+}
+
+func writeTestFile(g *GomegaWithT, file string, content string, mode os.FileMode) {
+	g.Expect(os.MkdirAll(filepath.Dir(file), 0755)).To(Succeed())
+	g.Expect(ioutil.WriteFile(file, []byte(content), mode)).To(Succeed())
+}
+
+func readTestArchive(g *GomegaWithT, file string) (*testHeaderEntry, []byte, []byte) {
+	data, err := ioutil.ReadFile(file)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(binary.LittleEndian.Uint32(data[0:4])).To(Equal(uint32(4)))
+	headerPickleSize := binary.LittleEndian.Uint32(data[4:8])
+	g.Expect(binary.LittleEndian.Uint32(data[8:12])).To(Equal(headerPickleSize - 4))
+	headerSize := binary.LittleEndian.Uint32(data[12:16])
+	header := data[16 : 16+headerSize]
+
+	var root testHeaderEntry
+	g.Expect(jsoniter.Unmarshal(header, &root)).To(Succeed())
+	return &root, header, data[8+headerPickleSize:]
+}
+
+func TestPack(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "asar")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	appDir := filepath.Join(dir, "app")
+	writeTestFile(g, filepath.Join(appDir, "package.json"), `{"name": "app"}`, 0644)
+	writeTestFile(g, filepath.Join(appDir, "index.js"), "require('./lib/a')", 0644)
+	writeTestFile(g, filepath.Join(appDir, "lib", "a.js"), "module.exports = 1", 0644)
+	writeTestFile(g, filepath.Join(appDir, "bin", "tool"), "#!/bin/sh", 0755)
+	writeTestFile(g, filepath.Join(appDir, "node_modules", "native", "build", "native.node"), "binary", 0644)
+	writeTestFile(g, filepath.Join(appDir, "assets", "big.bin"), strings.Repeat("a", IntegrityBlockSize+1), 0644)
+	writeTestFile(g, filepath.Join(appDir, "empty"), "", 0644)
+	g.Expect(os.MkdirAll(filepath.Join(appDir, "unpacked-dir", "sub"), 0755)).To(Succeed())
+	g.Expect(os.Symlink("lib/a.js", filepath.Join(appDir, "link.js"))).To(Succeed())
+
+	ordering := filepath.Join(dir, "ordering.txt")
+	writeTestFile(g, ordering, "1: /lib/a.js\nindex.js\nmissing.js\n", 0644)
+
+	output := filepath.Join(dir, "out", "app.asar")
+	// stale file of the previous build must be removed
+	writeTestFile(g, filepath.Join(output+".unpacked", "stale"), "", 0644)
+
+	result, err := Pack(PackOptions{
+		Dir:       appDir,
+		Output:    output,
+		Unpack:    []string{"*.{node,dll}"},
+		UnpackDir: []string{"unpacked-*"},
+		Ordering:  ordering,
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.FileCount).To(Equal(7))
+	g.Expect(result.UnpackedFileCount).To(Equal(1))
+
+	root, header, data := readTestArchive(g, output)
+	g.Expect(result.HeaderSize).To(Equal(len(header)))
+	headerHash := sha256.Sum256(header)
+	g.Expect(result.Integrity).To(Equal(&HeaderIntegrity{Algorithm: "SHA256", Hash: hex.EncodeToString(headerHash[:])}))
+
+	// ordered files are first
+	a := root.Files["lib"].Files["a.js"]
+	g.Expect(a.Offset).To(Equal("0"))
+	g.Expect(root.Files["index.js"].Offset).To(Equal(strconv.Itoa(len("module.exports = 1"))))
+
+	readData := func(item *testHeaderEntry) string {
+		offset, err := strconv.Atoi(item.Offset)
+		g.Expect(err).NotTo(HaveOccurred())
+		return string(data[offset : offset+int(item.Size)])
+	}
+	g.Expect(readData(a)).To(Equal("module.exports = 1"))
+	g.Expect(readData(root.Files["package.json"])).To(Equal(`{"name": "app"}`))
+	g.Expect(len(readData(root.Files["assets"].Files["big.bin"]))).To(Equal(IntegrityBlockSize + 1))
+	g.Expect(root.Files["bin"].Files["tool"].Executable).To(BeTrue())
+	g.Expect(root.Files["link.js"].Link).To(Equal("lib/a.js"))
+
+	hash := sha256.Sum256([]byte("module.exports = 1"))
+	g.Expect(a.Integrity).To(Equal(&Integrity{Algorithm: "SHA256", Hash: hex.EncodeToString(hash[:]), BlockSize: IntegrityBlockSize, Blocks: []string{hex.EncodeToString(hash[:])}}))
+	g.Expect(root.Files["assets"].Files["big.bin"].Integrity.Blocks).To(HaveLen(2))
+	emptyHash := sha256.Sum256(nil)
+	g.Expect(root.Files["empty"].Integrity.Blocks).To(Equal([]string{hex.EncodeToString(emptyHash[:])}))
+
+	native := root.Files["node_modules"].Files["native"].Files["build"].Files["native.node"]
+	g.Expect(native.Unpacked).To(BeTrue())
+	g.Expect(native.Offset).To(Equal(""))
+	g.Expect(native.Integrity).NotTo(BeNil())
+	g.Expect(root.Files["unpacked-dir"].Unpacked).To(BeTrue())
+	g.Expect(root.Files["unpacked-dir"].Files["sub"].Unpacked).To(BeTrue())
+
+	unpacked, err := ioutil.ReadFile(filepath.Join(output+".unpacked", "node_modules", "native", "build", "native.node"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(unpacked)).To(Equal("binary"))
+	g.Expect(filepath.Join(output+".unpacked", "unpacked-dir", "sub")).To(BeADirectory())
+	g.Expect(filepath.Join(output+".unpacked", "stale")).NotTo(BeAnExistingFile())
+
+	// the same input - the same archive
+	firstData, err := ioutil.ReadFile(output)
+	g.Expect(err).NotTo(HaveOccurred())
+	secondOutput := filepath.Join(dir, "second.asar")
+	_, err = Pack(PackOptions{Dir: appDir, Output: secondOutput, Unpack: []string{"*.node"}, UnpackDir: []string{"unpacked-*"}, Ordering: ordering})
+	g.Expect(err).NotTo(HaveOccurred())
+	secondData, err := ioutil.ReadFile(secondOutput)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(secondData).To(Equal(firstData))
+}
+
+func TestPackLinkOutside(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "asar")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	appDir := filepath.Join(dir, "app")
+	writeTestFile(g, filepath.Join(dir, "outside.js"), "", 0644)
+	g.Expect(os.MkdirAll(appDir, 0755)).To(Succeed())
+	g.Expect(os.Symlink("../outside.js", filepath.Join(appDir, "link.js"))).To(Succeed())
+
+	_, err = Pack(PackOptions{Dir: appDir, Output: filepath.Join(dir, "app.asar")})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.(interface{ ErrorCode() string }).ErrorCode()).To(Equal("ERR_ASAR_LINK_OUTSIDE"))
+}
+
+func TestPackDereferenceAndHardLinks(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "asar")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	appDir := filepath.Join(dir, "app")
+	writeTestFile(g, filepath.Join(dir, "shared", "outside.js"), "outside", 0644)
+	writeTestFile(g, filepath.Join(appDir, "big.bin"), strings.Repeat("b", 1024), 0644)
+	g.Expect(os.Link(filepath.Join(appDir, "big.bin"), filepath.Join(appDir, "copy.bin"))).To(Succeed())
+	g.Expect(os.Symlink("../shared", filepath.Join(appDir, "shared"))).To(Succeed())
+
+	output := filepath.Join(dir, "app.asar")
+	result, err := Pack(PackOptions{Dir: appDir, Output: output, SymlinkPolicy: fs.SymlinkDereference, IsDedupeHardLinks: true})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.HardLinkCount).To(Equal(1))
+	g.Expect(result.FileCount).To(Equal(3))
+
+	archive, err := OpenArchive(output)
+	g.Expect(err).NotTo(HaveOccurred())
+	for _, p := range []string{"big.bin", "copy.bin"} {
+		data, err := archive.ReadFile(p)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(string(data)).To(Equal(strings.Repeat("b", 1024)))
+	}
+	data, err := archive.ReadFile("shared/outside.js")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(data)).To(Equal("outside"))
+
+	// data of hard linked file is stored once
+	info, err := os.Stat(output)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(info.Size() - archive.DataOffset).To(Equal(int64(1024 + len("outside"))))
+	verifyResult, err := Verify(output, VerifyOptions{})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(verifyResult.IsValid).To(BeTrue())
+
+	g.Expect(os.Symlink(".", filepath.Join(appDir, "self"))).To(Succeed())
+	_, err = Pack(PackOptions{Dir: appDir, Output: output, SymlinkPolicy: fs.SymlinkDereference})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.(interface{ ErrorCode() string }).ErrorCode()).To(Equal("ERR_LINK_CYCLE"))
+}
+
+func TestPattern(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	g.Expect(NewPattern("*.node").Match("node_modules/a/build/a.node")).To(BeTrue())
+	g.Expect(NewPattern("*.node").Match("a.js")).To(BeFalse())
+	g.Expect(NewPattern("**/build/*.node").Match("node_modules/a/build/a.node")).To(BeTrue())
+	g.Expect(NewPattern("**/build/*.node").Match("build/a.node")).To(BeTrue())
+	g.Expect(NewPattern("node_modules/*/build").Match("node_modules/a/build")).To(BeTrue())
+	g.Expect(NewPattern("node_modules/*/build").Match("node_modules/a/b/build")).To(BeFalse())
+	g.Expect(NewPattern("{*.node,*.dll}").Match("lib/a.dll")).To(BeTrue())
+	g.Expect(NewPattern("node_modules/{a,b/{c,d}}/**").Match("node_modules/b/d/index.js")).To(BeTrue())
+	g.Expect(NewPattern("node_modules/{a,b/{c,d}}/**").Match("node_modules/b/e/index.js")).To(BeFalse())
+	g.Expect(NewPattern("{a}/*.js").Match("{a}/x.js")).To(BeTrue())
+}
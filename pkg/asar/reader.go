@@ -0,0 +1,146 @@
+package asar
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/json-iterator/go"
+)
+
+// header larger than that is not a valid archive (header of a huge app is a few MB)
+const maxHeaderSize = 256 * 1024 * 1024
+
+// Archive is an asar archive with parsed header
+type Archive struct {
+	File   string
+	Header []byte
+	// offset of the file data (end of the header) in the archive file
+	DataOffset int64
+
+	root *entry
+}
+
+func OpenArchive(file string) (*Archive, error) {
+	reader, err := os.Open(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer util.Close(reader)
+
+	var sizePickle [8]byte
+	_, err = io.ReadFull(reader, sizePickle[:])
+	if err != nil {
+		return nil, createInvalidArchiveError(file, "cannot read header size")
+	}
+
+	headerPickleSize := binary.LittleEndian.Uint32(sizePickle[4:])
+	if binary.LittleEndian.Uint32(sizePickle[:4]) != 4 || headerPickleSize < 8 || headerPickleSize > maxHeaderSize {
+		return nil, createInvalidArchiveError(file, "unexpected header size")
+	}
+
+	headerPickle := make([]byte, headerPickleSize)
+	_, err = io.ReadFull(reader, headerPickle)
+	if err != nil {
+		return nil, createInvalidArchiveError(file, "cannot read header")
+	}
+
+	headerSize := binary.LittleEndian.Uint32(headerPickle[4:8])
+	if headerSize > headerPickleSize-8 {
+		return nil, createInvalidArchiveError(file, "unexpected header string size")
+	}
+
+	archive := &Archive{
+		File:       file,
+		Header:     headerPickle[8 : 8+headerSize],
+		DataOffset: int64(8 + headerPickleSize),
+		root:       &entry{mode: os.ModeDir},
+	}
+
+	iterator := jsoniter.ParseBytes(jsoniter.ConfigFastest, archive.Header)
+	readHeaderEntry(iterator, archive.root)
+	if iterator.Error != nil && iterator.Error != io.EOF {
+		return nil, createInvalidArchiveError(file, "cannot parse header: "+iterator.Error.Error())
+	}
+	return archive, nil
+}
+
+func createInvalidArchiveError(file string, message string) error {
+	return util.NewMessageError(file+" is not a valid asar archive: "+message, "ERR_ASAR_INVALID")
+}
+
+// readHeaderEntry reads entry keeping the order of children (the order affects header hash if header is rewritten)
+func readHeaderEntry(iterator *jsoniter.Iterator, item *entry) {
+	iterator.ReadObjectCB(func(iterator *jsoniter.Iterator, field string) bool {
+		switch field {
+		case "files":
+			item.mode = os.ModeDir
+			item.children = []*entry{}
+			iterator.ReadObjectCB(func(iterator *jsoniter.Iterator, name string) bool {
+				// must be checked - name is used as path on extraction
+				if len(name) == 0 || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+					iterator.ReportError("files", "invalid file name "+strconv.Quote(name))
+					return false
+				}
+
+				child := &entry{name: name, path: path.Join(item.path, name), mode: 0644}
+				readHeaderEntry(iterator, child)
+				item.children = append(item.children, child)
+				return iterator.Error == nil
+			})
+
+		case "size":
+			item.size = iterator.ReadInt64()
+
+		case "offset":
+			// string in archives created by asar, number in very old archives
+			if iterator.WhatIsNext() == jsoniter.StringValue {
+				value, err := strconv.ParseInt(iterator.ReadString(), 10, 64)
+				if err != nil {
+					iterator.ReportError("offset", err.Error())
+				}
+				item.offset = value
+			} else {
+				item.offset = iterator.ReadInt64()
+			}
+
+		case "unpacked":
+			item.isUnpacked = iterator.ReadBool()
+
+		case "executable":
+			item.isExecutable = iterator.ReadBool()
+			if item.isExecutable {
+				item.mode = 0755
+			}
+
+		case "link":
+			item.link = iterator.ReadString()
+			item.mode = os.ModeSymlink
+
+		case "integrity":
+			item.integrity = &Integrity{}
+			iterator.ReadVal(item.integrity)
+
+		default:
+			iterator.Skip()
+		}
+		return iterator.Error == nil
+	})
+}
+
+// walkFiles calls consumer for each regular file, in the header order
+func walkFiles(item *entry, consumer func(item *entry)) {
+	for _, child := range item.children {
+		switch {
+		case child.mode.IsDir():
+			walkFiles(child, consumer)
+		case len(child.link) == 0:
+			consumer(child)
+		}
+	}
+}
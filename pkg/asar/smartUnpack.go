@@ -0,0 +1,177 @@
+package asar
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/develar/app-builder/pkg/codesign"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"go.uber.org/zap"
+)
+
+// native files cannot be loaded from asar (dlopen, spawn) - Electron redirects only .node loading and child_process to the unpacked dir
+var nativeExtensions = []string{".node", ".dll", ".so", ".dylib"}
+
+// smartUnpack unpacks packages (dir in node_modules) that contain native files, native file outside of node_modules is unpacked alone -
+// native module loads sibling shared libraries (sharp and libvips) and spawns bundled executables by path relative to itself.
+// Returns unpacked paths.
+func (t *packer) smartUnpack(root *entry) ([]string, error) {
+	var result []string
+	isAdded := make(map[string]bool)
+	for _, item := range t.files {
+		if item.isUnpacked {
+			continue
+		}
+
+		isNative, err := isNativeFile(item)
+		if err != nil {
+			return nil, err
+		}
+		if !isNative {
+			continue
+		}
+
+		unpackPath := getPackageDir(item.path)
+		if len(unpackPath) == 0 {
+			unpackPath = item.path
+		}
+		if isAdded[unpackPath] {
+			continue
+		}
+
+		isAdded[unpackPath] = true
+		result = append(result, unpackPath)
+		log.Debug("unpack native", zap.String("file", item.path), zap.String("unpacked", unpackPath))
+	}
+
+	result = removeNestedPaths(result)
+	for _, p := range result {
+		item := findChild(root, p)
+		if item != nil {
+			markUnpacked(item)
+		}
+	}
+	return result, nil
+}
+
+// removeNestedPaths removes paths inside of other paths (nested package of unpacked package)
+func removeNestedPaths(paths []string) []string {
+	// shorter path first
+	sort.Strings(paths)
+	var result []string
+	for _, p := range paths {
+		isNested := false
+		for _, parent := range result {
+			if strings.HasPrefix(p, parent+"/") {
+				isNested = true
+				break
+			}
+		}
+		if !isNested {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+func isNativeFile(item *entry) (bool, error) {
+	if IsNativeFileName(item.name) {
+		return true, nil
+	}
+
+	// executables usually have no extension, magic is checked to not unpack scripts with executable bit
+	if IsExecutableCandidate(item.name) && item.size >= 8 {
+		return isNativeExecutable(item.file)
+	}
+	return false, nil
+}
+
+// IsNativeFileName returns true for native module or shared library (by extension)
+func IsNativeFileName(name string) bool {
+	name = strings.ToLower(name)
+	return util.ContainsString(nativeExtensions, path.Ext(name)) || strings.Contains(name, ".so.")
+}
+
+// IsExecutableCandidate returns true if file can be an executable (no extension or .exe), magic must be checked using IsNativeExecutableMagic
+func IsExecutableCandidate(name string) bool {
+	extension := strings.ToLower(path.Ext(name))
+	return len(extension) == 0 || extension == ".exe"
+}
+
+func isNativeExecutable(file string) (bool, error) {
+	reader, err := os.Open(file)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	defer util.Close(reader)
+
+	var magic [8]byte
+	_, err = io.ReadFull(reader, magic[:])
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return IsNativeExecutableMagic(magic[:]), nil
+}
+
+// IsNativeExecutableMagic checks ELF, PE and Mach-O magic of the first 8 bytes of the file
+func IsNativeExecutableMagic(magic []byte) bool {
+	if len(magic) < 8 {
+		return false
+	}
+	if bytes.HasPrefix(magic, []byte("\x7fELF")) || bytes.HasPrefix(magic, []byte("MZ")) {
+		return true
+	}
+	return codesign.GetMachOKind(magic) != codesign.NotMachO
+}
+
+// getPackageDir returns dir of the package (node_modules/name or node_modules/@scope/name) the file belongs to, empty if file is not in node_modules
+func getPackageDir(file string) string {
+	segments := strings.Split(file, "/")
+	for i := len(segments) - 2; i >= 0; i-- {
+		if segments[i] != "node_modules" {
+			continue
+		}
+
+		end := i + 2
+		if strings.HasPrefix(segments[i+1], "@") {
+			end++
+		}
+		// file directly in node_modules (or @scope dir) is not a package
+		if end >= len(segments) {
+			continue
+		}
+		return strings.Join(segments[:end], "/")
+	}
+	return ""
+}
+
+func findChild(dir *entry, p string) *entry {
+	current := dir
+	for _, name := range strings.Split(p, "/") {
+		var next *entry
+		for _, child := range current.children {
+			if child.name == name {
+				next = child
+				break
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		current = next
+	}
+	return current
+}
+
+func markUnpacked(item *entry) {
+	item.isUnpacked = true
+	for _, child := range item.children {
+		markUnpacked(child)
+	}
+}
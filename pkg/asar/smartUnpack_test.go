@@ -0,0 +1,57 @@
+package asar
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+)
+
+func TestSmartUnpack(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "asar")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	appDir := filepath.Join(dir, "app")
+	nodeModules := filepath.Join(appDir, "node_modules")
+	writeTestFile(g, filepath.Join(appDir, "index.js"), "", 0644)
+	writeTestFile(g, filepath.Join(appDir, "helper"), "\x7fELF\x02\x01\x01\x00", 0755)
+	writeTestFile(g, filepath.Join(nodeModules, "native", "build", "Release", "native.node"), "", 0644)
+	writeTestFile(g, filepath.Join(nodeModules, "native", "index.js"), "", 0644)
+	writeTestFile(g, filepath.Join(nodeModules, "native", "node_modules", "nested", "lib.so.1.2"), "", 0644)
+	writeTestFile(g, filepath.Join(nodeModules, "@img", "sharp-libvips", "lib", "libvips-cpp.dylib"), "", 0644)
+	writeTestFile(g, filepath.Join(nodeModules, "pty", "spawn-helper"), "\xcf\xfa\xed\xfe\x07\x00\x00\x01", 0755)
+	// script with executable bit and Java class are not native
+	writeTestFile(g, filepath.Join(nodeModules, "cli", "bin", "cli"), "#!/usr/bin/env node\n", 0755)
+	writeTestFile(g, filepath.Join(nodeModules, "java", "Main"), "\xca\xfe\xba\xbe\x00\x00\x00\x34", 0644)
+
+	output := filepath.Join(dir, "app.asar")
+	result, err := Pack(PackOptions{Dir: appDir, Output: output, IsSmartUnpack: true})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.SmartUnpacked).To(Equal([]string{"helper", "node_modules/@img/sharp-libvips", "node_modules/native", "node_modules/pty"}))
+	g.Expect(result.UnpackedFileCount).To(Equal(6))
+
+	root, _, _ := readTestArchive(g, output)
+	g.Expect(root.Files["node_modules"].Files["native"].Unpacked).To(BeTrue())
+	g.Expect(root.Files["node_modules"].Files["native"].Files["index.js"].Unpacked).To(BeTrue())
+	g.Expect(root.Files["node_modules"].Files["cli"].Files["bin"].Files["cli"].Unpacked).To(BeFalse())
+	g.Expect(root.Files["index.js"].Unpacked).To(BeFalse())
+	g.Expect(filepath.Join(output+".unpacked", "node_modules", "native", "node_modules", "nested", "lib.so.1.2")).To(BeAnExistingFile())
+}
+
+func TestGetPackageDir(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	g.Expect(getPackageDir("node_modules/a/build/a.node")).To(Equal("node_modules/a"))
+	g.Expect(getPackageDir("node_modules/@scope/a/a.node")).To(Equal("node_modules/@scope/a"))
+	g.Expect(getPackageDir("node_modules/a/node_modules/b/b.node")).To(Equal("node_modules/a/node_modules/b"))
+	g.Expect(getPackageDir("node_modules/a.node")).To(Equal(""))
+	g.Expect(getPackageDir("lib/a.node")).To(Equal(""))
+	g.Expect(removeNestedPaths([]string{"a/b/c", "a/b-c", "a/b"})).To(Equal([]string{"a/b", "a/b-c"}))
+}
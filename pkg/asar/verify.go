@@ -0,0 +1,192 @@
+package asar
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/diagnostics"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+)
+
+type VerifyOptions struct {
+	// files that must be not packed (e.g. *.map, **/test/**)
+	Disallow        []string
+	IsSkipIntegrity bool
+	MaxErrors       int
+}
+
+type VerifyResult struct {
+	File      string              `json:"file"`
+	FileCount int                 `json:"fileCount"`
+	IsValid   bool                `json:"isValid"`
+	Summary   *diagnostics.Report `json:"summary"`
+}
+
+func configureVerifyCommand(asarCommand *kingpin.CmdClause) {
+	command := asarCommand.Command("verify", "Check asar archive: header, data and integrity of files, unpacked files, links and files that must be not packed. "+
+		"Result is written to stdout as JSON, exit code is not zero if there are errors.")
+	file := command.Flag("file", "The asar archive.").Short('f').Required().ExistingFile()
+	options := VerifyOptions{}
+	command.Flag("disallow", "Report files matching the glob pattern (e.g. *.map or **/test/**) as errors, can be specified several times.").StringsVar(&options.Disallow)
+	command.Flag("skip-integrity", "Do not check integrity of file data (only header is checked).").BoolVar(&options.IsSkipIntegrity)
+	maxErrors := diagnostics.ConfigureMaxErrorsFlag(command)
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		options.MaxErrors = *maxErrors
+		result, err := Verify(*file, options)
+		if err != nil {
+			return err
+		}
+
+		err = util.WriteJsonToStdOut(result)
+		if err != nil {
+			return err
+		}
+		if !result.IsValid {
+			return util.NewMessageError("asar archive "+*file+" is not valid: "+strconv.Itoa(result.Summary.ErrorCount)+" errors", "ERR_ASAR_VERIFY_FAILED")
+		}
+		return nil
+	})
+}
+
+// Verify reports all problems of the archive, error is returned only if archive cannot be read
+func Verify(file string, options VerifyOptions) (*VerifyResult, error) {
+	archive, err := OpenArchive(file)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	dataSize := info.Size() - archive.DataOffset
+
+	collector := diagnostics.NewCollector(options.MaxErrors)
+	disallowed := NewPatterns(options.Disallow)
+	var files []*entry
+	walkEntries(archive.root, true, nil, func(item *entry) {
+		if !item.mode.IsDir() && matchAny(disallowed, item.path) {
+			collector.Add(diagnostics.SeverityError, "ERR_ASAR_DISALLOWED_FILE", item.path, "file must be not packed")
+		}
+
+		switch {
+		case item.mode.IsDir():
+			return
+
+		case len(item.link) != 0:
+			if !isLinkInArchive(item.link) {
+				collector.Addf(diagnostics.SeverityError, "ERR_ASAR_LINK_OUTSIDE", item.path, "link target %s is outside of the archive", item.link)
+			} else if archive.findEntry(item.link) == nil {
+				collector.Addf(diagnostics.SeverityError, "ERR_ASAR_LINK_BROKEN", item.path, "link target %s is not found", item.link)
+			}
+			return
+		}
+
+		files = append(files, item)
+		if item.integrity == nil {
+			collector.Add(diagnostics.SeverityWarning, "ERR_ASAR_INTEGRITY_MISSING", item.path, "integrity is missing, archive is refused if asar integrity fuse is enabled")
+		}
+
+		if item.isUnpacked {
+			unpackedInfo, err := os.Stat(filepath.Join(file+".unpacked", filepath.FromSlash(item.path)))
+			switch {
+			case err != nil:
+				collector.Add(diagnostics.SeverityError, "ERR_ASAR_UNPACKED_MISSING", item.path, "unpacked file is not found")
+			case unpackedInfo.Size() != item.size:
+				collector.Add(diagnostics.SeverityError, "ERR_ASAR_UNPACKED_SIZE", item.path, "size of unpacked file doesn't match the header")
+			}
+		} else if item.offset < 0 || item.size < 0 || item.offset+item.size > dataSize {
+			collector.Add(diagnostics.SeverityError, "ERR_ASAR_DATA_OUT_OF_BOUNDS", item.path, "file data is out of the archive bounds")
+		}
+	})
+
+	if !options.IsSkipIntegrity && !collector.IsLimitReached() {
+		err = archive.checkIntegrity(files, collector)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if collector.IsLimitReached() {
+		collector.MarkTruncated()
+	}
+
+	return &VerifyResult{
+		File:      file,
+		FileCount: len(files),
+		IsValid:   !collector.HasErrors(),
+		Summary:   collector.Report(),
+	}, nil
+}
+
+// checkIntegrity computes integrity of files in parallel, mismatches are reported in the header order
+func (t *Archive) checkIntegrity(files []*entry, collector *diagnostics.Collector) error {
+	archiveFile, err := os.Open(t.File)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(archiveFile)
+
+	var expected []*entry
+	for _, item := range files {
+		if item.integrity != nil {
+			expected = append(expected, item)
+		}
+	}
+
+	mismatches := make([]string, len(expected))
+	err = util.MapAsync(len(expected), func(taskIndex int) (func() error, error) {
+		item := expected[taskIndex]
+		return func() error {
+			reader, err := t.openFile(archiveFile, item)
+			if err != nil {
+				// missing unpacked file is already reported
+				return nil
+			}
+			if file, ok := reader.(*os.File); ok {
+				defer util.Close(file)
+			}
+
+			buffer := blockBufferPool.Get().([]byte)
+			defer blockBufferPool.Put(buffer)
+
+			actual, _, err := computeIntegrity(reader, buffer)
+			if err != nil {
+				return err
+			}
+			if actual.Hash != item.integrity.Hash || !isSameBlocks(actual, item.integrity) {
+				mismatches[taskIndex] = item.path
+			}
+			return nil
+		}, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, p := range mismatches {
+		if len(p) != 0 && !collector.Add(diagnostics.SeverityError, "ERR_ASAR_INTEGRITY_MISMATCH", p, "file data doesn't match integrity in the header") {
+			break
+		}
+	}
+	return nil
+}
+
+func isSameBlocks(actual *Integrity, expected *Integrity) bool {
+	// blocks of another size are not recomputed, file hash is enough to detect modification
+	if expected.BlockSize != actual.BlockSize {
+		return true
+	}
+	if len(expected.Blocks) != len(actual.Blocks) {
+		return false
+	}
+	for index, block := range expected.Blocks {
+		if block != actual.Blocks[index] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,305 @@
+package attestation
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/credentials"
+	"github.com/develar/app-builder/pkg/download"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+	"github.com/json-iterator/go"
+)
+
+// AppVersion is the version of app-builder (reported as builder version)
+var AppVersion = "dev"
+
+const (
+	StatementType     = "https://in-toto.io/Statement/v1"
+	PredicateTypeSlsa = "https://slsa.dev/provenance/v1"
+	DefaultBuildType  = "https://github.com/develar/app-builder/attestation/build/v1"
+
+	SigningKeyCredentialName = "attestation-signing-key"
+)
+
+type Statement struct {
+	Type          string          `json:"_type"`
+	Subject       []*Subject      `json:"subject"`
+	PredicateType string          `json:"predicateType"`
+	Predicate     *SlsaProvenance `json:"predicate"`
+}
+
+type Subject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type SlsaProvenance struct {
+	BuildDefinition *BuildDefinition `json:"buildDefinition"`
+	RunDetails      *RunDetails      `json:"runDetails"`
+}
+
+type BuildDefinition struct {
+	BuildType            string                `json:"buildType"`
+	ExternalParameters   map[string]string     `json:"externalParameters"`
+	ResolvedDependencies []*ResourceDescriptor `json:"resolvedDependencies,omitempty"`
+}
+
+type ResourceDescriptor struct {
+	Uri    string            `json:"uri,omitempty"`
+	Name   string            `json:"name,omitempty"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+type RunDetails struct {
+	Builder  *Builder     `json:"builder"`
+	Metadata *RunMetadata `json:"metadata,omitempty"`
+}
+
+type Builder struct {
+	Id      string            `json:"id"`
+	Version map[string]string `json:"version,omitempty"`
+}
+
+type RunMetadata struct {
+	InvocationId string `json:"invocationId,omitempty"`
+	FinishedOn   string `json:"finishedOn,omitempty"`
+}
+
+type Options struct {
+	Files []string
+	// files the artifacts are built from (e.g. app.asar, lock file), reported as resolved dependencies
+	Inputs []string
+	// see download.ProvenanceFileEnvName, downloaded tools are reported as resolved dependencies
+	ProvenanceFile string
+
+	BuilderId    string
+	BuildType    string
+	InvocationId string
+	Parameters   map[string]string
+
+	// PEM private key, taken from SigningKeyCredentialName if not specified
+	KeyFile string
+	// dir to write <artifact name>.intoto.jsonl to, dir of the artifact by default
+	OutputDir string
+	// e.g. https://rekor.sigstore.dev, attestations are not uploaded if not specified
+	RekorUrl string
+}
+
+type Result struct {
+	File        string      `json:"file"`
+	Sha256      string      `json:"sha256"`
+	Attestation string      `json:"attestation"`
+	Rekor       *RekorEntry `json:"rekor,omitempty"`
+}
+
+func ConfigureCommand(app *kingpin.Application) {
+	command := app.Command("attest", "Generate signed in-toto SLSA provenance (DSSE envelope <artifact>.intoto.jsonl) for each artifact and optionally upload it to Rekor transparency log. "+
+		"Signing key (PEM, ECDSA or Ed25519) is taken from --key or "+credentials.ToEnvName(SigningKeyCredentialName)+" env or credentials helper.")
+
+	options := &Options{}
+	command.Flag("file", "The artifact file.").Short('f').Required().ExistingFilesVar(&options.Files)
+	command.Flag("input", "The input file the artifacts are built from (e.g. app.asar, lock file), can be specified several times.").ExistingFilesVar(&options.Inputs)
+	command.Flag("provenance", "The file with provenance of downloaded tools (default: "+download.ProvenanceFileEnvName+" env).").Envar(download.ProvenanceFileEnvName).StringVar(&options.ProvenanceFile)
+	command.Flag("builder-id", "The builder identity (default: workflow on GitHub Actions).").StringVar(&options.BuilderId)
+	command.Flag("build-type", "The build type.").Default(DefaultBuildType).StringVar(&options.BuildType)
+	command.Flag("invocation-id", "The build invocation id (default: workflow run on GitHub Actions).").StringVar(&options.InvocationId)
+	command.Flag("parameter", "The build parameter (e.g. target=nsis), can be specified several times.").StringMapVar(&options.Parameters)
+	command.Flag("key", "The PEM private key file.").ExistingFileVar(&options.KeyFile)
+	command.Flag("output", "The dir to write attestations to (default: dir of the artifact).").Short('o').StringVar(&options.OutputDir)
+	command.Flag("rekor-url", "The Rekor URL to upload attestations to (e.g. https://rekor.sigstore.dev).").StringVar(&options.RekorUrl)
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		results, err := Attest(options)
+		if err != nil {
+			return err
+		}
+		return util.WriteJsonToStdOut(results)
+	})
+}
+
+func Attest(options *Options) ([]*Result, error) {
+	signer, err := loadSigner(options.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	predicate, err := createPredicate(options)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*Result
+	for _, file := range options.Files {
+		hash, err := computeSha256(file)
+		if err != nil {
+			return nil, err
+		}
+
+		statement := &Statement{
+			Type:          StatementType,
+			Subject:       []*Subject{{Name: filepath.Base(file), Digest: map[string]string{"sha256": hash}}},
+			PredicateType: PredicateTypeSlsa,
+			Predicate:     predicate,
+		}
+		payload, err := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(statement)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		envelope, err := signer.sign(payload)
+		if err != nil {
+			return nil, err
+		}
+		envelopeData, err := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(envelope)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		outputDir := options.OutputDir
+		if outputDir == "" {
+			outputDir = filepath.Dir(file)
+		}
+		err = fsutil.EnsureDir(outputDir)
+		if err != nil {
+			return nil, err
+		}
+		output := filepath.Join(outputDir, filepath.Base(file)+".intoto.jsonl")
+		err = ioutil.WriteFile(output, append(envelopeData, '\n'), 0644)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		result := &Result{File: file, Sha256: hash, Attestation: output}
+		if options.RekorUrl != "" {
+			result.Rekor, err = uploadToRekor(options.RekorUrl, filepath.Base(file), hash, envelopeData, signer.publicKeyPem)
+			if err != nil {
+				return nil, err
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func createPredicate(options *Options) (*SlsaProvenance, error) {
+	parameters := options.Parameters
+	if parameters == nil {
+		parameters = make(map[string]string)
+	}
+	buildDefinition := &BuildDefinition{BuildType: options.BuildType, ExternalParameters: parameters}
+	if buildDefinition.BuildType == "" {
+		buildDefinition.BuildType = DefaultBuildType
+	}
+
+	builderId := options.BuilderId
+	invocationId := options.InvocationId
+	ci := getGithubActionsInfo()
+	if ci != nil {
+		if builderId == "" {
+			builderId = ci.builderId
+		}
+		if invocationId == "" {
+			invocationId = ci.invocationId
+		}
+		buildDefinition.ResolvedDependencies = append(buildDefinition.ResolvedDependencies, ci.source)
+	}
+	if builderId == "" {
+		return nil, util.NewMessageError("builder id is not specified (--builder-id) and cannot be detected", "ERR_ATTESTATION_BUILDER_ID_MISSING")
+	}
+
+	for _, file := range options.Inputs {
+		hash, err := computeSha256(file)
+		if err != nil {
+			return nil, err
+		}
+		buildDefinition.ResolvedDependencies = append(buildDefinition.ResolvedDependencies, &ResourceDescriptor{Name: filepath.Base(file), Digest: map[string]string{"sha256": hash}})
+	}
+
+	if options.ProvenanceFile != "" {
+		_, err := os.Stat(options.ProvenanceFile)
+		if err == nil {
+			records, err := download.ReadProvenance(options.ProvenanceFile)
+			if err != nil {
+				return nil, err
+			}
+			for _, record := range records {
+				buildDefinition.ResolvedDependencies = append(buildDefinition.ResolvedDependencies, createToolDescriptor(record))
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	return &SlsaProvenance{
+		BuildDefinition: buildDefinition,
+		RunDetails: &RunDetails{
+			Builder:  &Builder{Id: builderId, Version: map[string]string{"app-builder": AppVersion}},
+			Metadata: &RunMetadata{InvocationId: invocationId, FinishedOn: time.Now().UTC().Format(time.RFC3339)},
+		},
+	}, nil
+}
+
+func createToolDescriptor(record *download.Provenance) *ResourceDescriptor {
+	result := &ResourceDescriptor{Uri: record.Url, Name: record.Name}
+	if record.Sha512 != "" {
+		data, err := base64.StdEncoding.DecodeString(record.Sha512)
+		if err == nil {
+			result.Digest = map[string]string{"sha512": hex.EncodeToString(data)}
+		}
+	}
+	return result
+}
+
+type githubActionsInfo struct {
+	builderId    string
+	invocationId string
+	source       *ResourceDescriptor
+}
+
+// builder is the workflow, invocation is the run attempt, source is the checked out commit
+func getGithubActionsInfo() *githubActionsInfo {
+	if os.Getenv("GITHUB_ACTIONS") != "true" {
+		return nil
+	}
+
+	server := os.Getenv("GITHUB_SERVER_URL")
+	repository := os.Getenv("GITHUB_REPOSITORY")
+	result := &githubActionsInfo{
+		builderId: server + "/" + os.Getenv("GITHUB_WORKFLOW_REF"),
+		source: &ResourceDescriptor{
+			Uri:    "git+" + server + "/" + repository + "@" + os.Getenv("GITHUB_REF"),
+			Digest: map[string]string{"gitCommit": os.Getenv("GITHUB_SHA")},
+		},
+	}
+	if os.Getenv("GITHUB_WORKFLOW_REF") == "" {
+		result.builderId = server + "/" + repository + "/actions"
+	}
+	runId := os.Getenv("GITHUB_RUN_ID")
+	if runId != "" {
+		result.invocationId = server + "/" + repository + "/actions/runs/" + runId + "/attempts/" + os.Getenv("GITHUB_RUN_ATTEMPT")
+	}
+	return result
+}
+
+func computeSha256(file string) (string, error) {
+	reader, err := os.Open(file)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer util.Close(reader)
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, reader)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,170 @@
+package attestation
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/json-iterator/go"
+	. "github.com/onsi/gomega"
+)
+
+func TestAttest(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "attestation")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	g.Expect(err).NotTo(HaveOccurred())
+	keyData, err := x509.MarshalPKCS8PrivateKey(key)
+	g.Expect(err).NotTo(HaveOccurred())
+	keyFile := filepath.Join(dir, "key.pem")
+	g.Expect(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyData}), 0600)).To(Succeed())
+
+	artifact := filepath.Join(dir, "App Setup.exe")
+	g.Expect(ioutil.WriteFile(artifact, []byte("installer"), 0644)).To(Succeed())
+	input := filepath.Join(dir, "app.asar")
+	g.Expect(ioutil.WriteFile(input, []byte("asar"), 0644)).To(Succeed())
+	provenanceFile := filepath.Join(dir, "provenance.jsonl")
+	g.Expect(ioutil.WriteFile(provenanceFile, []byte(`{"name":"nsis","url":"https://example.com/nsis.7z","sha512":"AAEC"}`+"\n"), 0644)).To(Succeed())
+
+	var rekorRequest map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		g.Expect(request.URL.Path).To(Equal("/api/v1/log/entries"))
+		g.Expect(jsoniter.NewDecoder(request.Body).Decode(&rekorRequest)).To(Succeed())
+		writer.WriteHeader(http.StatusCreated)
+		_, _ = writer.Write([]byte(`{"24296fb2": {"logIndex": 42, "integratedTime": 1700000000, "body": "e30="}}`))
+	}))
+	defer server.Close()
+
+	results, err := Attest(&Options{
+		Files:          []string{artifact},
+		Inputs:         []string{input},
+		ProvenanceFile: provenanceFile,
+		BuilderId:      "https://ci.example.com/builder",
+		BuildType:      DefaultBuildType,
+		Parameters:     map[string]string{"target": "nsis"},
+		KeyFile:        keyFile,
+		OutputDir:      filepath.Join(dir, "out"),
+		RekorUrl:       server.URL + "/",
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(results).To(HaveLen(1))
+	result := results[0]
+	g.Expect(result.Sha256).To(Equal("9c0d294c05fc1d88d698034609bb81c0c69196327594e4c69d2915c80fd9850c"))
+	g.Expect(result.Attestation).To(Equal(filepath.Join(dir, "out", "App Setup.exe.intoto.jsonl")))
+	g.Expect(result.Rekor).To(Equal(&RekorEntry{Uuid: "24296fb2", LogIndex: 42, IntegratedTime: 1700000000, Url: server.URL + "/api/v1/log/entries/24296fb2"}))
+
+	data, err := ioutil.ReadFile(result.Attestation)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(strings.Count(string(data), "\n")).To(Equal(1))
+	var envelope Envelope
+	g.Expect(jsoniter.Unmarshal(data, &envelope)).To(Succeed())
+	g.Expect(envelope.PayloadType).To(Equal(PayloadType))
+	g.Expect(envelope.Signatures).To(HaveLen(1))
+
+	// signature is over PAE of the payload
+	payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+	g.Expect(err).NotTo(HaveOccurred())
+	signature, err := base64.StdEncoding.DecodeString(envelope.Signatures[0].Sig)
+	g.Expect(err).NotTo(HaveOccurred())
+	digest := sha256.Sum256(PreAuthEncode(PayloadType, payload))
+	g.Expect(ecdsa.VerifyASN1(&key.PublicKey, digest[:], signature)).To(BeTrue())
+
+	var statement Statement
+	g.Expect(jsoniter.Unmarshal(payload, &statement)).To(Succeed())
+	g.Expect(statement.Type).To(Equal(StatementType))
+	g.Expect(statement.PredicateType).To(Equal(PredicateTypeSlsa))
+	g.Expect(statement.Subject).To(Equal([]*Subject{{Name: "App Setup.exe", Digest: map[string]string{"sha256": result.Sha256}}}))
+	g.Expect(statement.Predicate.BuildDefinition.ExternalParameters).To(Equal(map[string]string{"target": "nsis"}))
+	g.Expect(statement.Predicate.RunDetails.Builder.Id).To(Equal("https://ci.example.com/builder"))
+	dependencies := statement.Predicate.BuildDefinition.ResolvedDependencies
+	g.Expect(dependencies[len(dependencies)-2].Name).To(Equal("app.asar"))
+	g.Expect(dependencies[len(dependencies)-1]).To(Equal(&ResourceDescriptor{Uri: "https://example.com/nsis.7z", Name: "nsis", Digest: map[string]string{"sha512": "000102"}}))
+
+	// Rekor verifies the envelope by the public key
+	proposedContent := rekorRequest["spec"].(map[string]interface{})["proposedContent"].(map[string]interface{})
+	g.Expect(rekorRequest["kind"]).To(Equal("dsse"))
+	g.Expect(proposedContent["envelope"]).To(Equal(strings.TrimSpace(string(data))))
+	publicKeyPem, err := base64.StdEncoding.DecodeString(proposedContent["verifiers"].([]interface{})[0].(string))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(publicKeyPem)).To(HavePrefix("-----BEGIN PUBLIC KEY-----"))
+}
+
+func TestSigner(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	g.Expect(err).NotTo(HaveOccurred())
+	keyData, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	g.Expect(err).NotTo(HaveOccurred())
+	signer, err := parseSigner(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyData}))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(signer.keyId).To(HaveLen(64))
+
+	envelope, err := signer.sign([]byte("{}"))
+	g.Expect(err).NotTo(HaveOccurred())
+	signature, err := base64.StdEncoding.DecodeString(envelope.Signatures[0].Sig)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(ed25519.Verify(publicKey, PreAuthEncode(PayloadType, []byte("{}")), signature)).To(BeTrue())
+	g.Expect(string(PreAuthEncode(PayloadType, []byte("{}")))).To(Equal("DSSEv1 28 application/vnd.in-toto+json 2 {}"))
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	g.Expect(err).NotTo(HaveOccurred())
+	_, err = parseSigner(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}))
+	g.Expect(err).To(HaveOccurred())
+	_, err = parseSigner([]byte("not a key"))
+	g.Expect(err).To(MatchError(ContainSubstring("signing key is not a PEM private key")))
+}
+
+func TestGithubActions(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	env := map[string]string{
+		"GITHUB_ACTIONS":      "true",
+		"GITHUB_SERVER_URL":   "https://github.com",
+		"GITHUB_REPOSITORY":   "foo/bar",
+		"GITHUB_WORKFLOW_REF": "foo/bar/.github/workflows/release.yml@refs/tags/v1.0.0",
+		"GITHUB_REF":          "refs/tags/v1.0.0",
+		"GITHUB_SHA":          "abc",
+		"GITHUB_RUN_ID":       "123",
+		"GITHUB_RUN_ATTEMPT":  "2",
+	}
+	for name, value := range env {
+		previous, isSet := os.LookupEnv(name)
+		g.Expect(os.Setenv(name, value)).To(Succeed())
+		if isSet {
+			defer os.Setenv(name, previous)
+		} else {
+			defer os.Unsetenv(name)
+		}
+	}
+
+	predicate, err := createPredicate(&Options{})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(predicate.BuildDefinition.BuildType).To(Equal(DefaultBuildType))
+	g.Expect(predicate.RunDetails.Builder.Id).To(Equal("https://github.com/foo/bar/.github/workflows/release.yml@refs/tags/v1.0.0"))
+	g.Expect(predicate.RunDetails.Metadata.InvocationId).To(Equal("https://github.com/foo/bar/actions/runs/123/attempts/2"))
+	g.Expect(predicate.BuildDefinition.ResolvedDependencies).To(Equal([]*ResourceDescriptor{{Uri: "git+https://github.com/foo/bar@refs/tags/v1.0.0", Digest: map[string]string{"gitCommit": "abc"}}}))
+
+	g.Expect(os.Setenv("GITHUB_ACTIONS", "")).To(Succeed())
+	_, err = createPredicate(&Options{})
+	g.Expect(err).To(MatchError(ContainSubstring("builder id is not specified")))
+}
@@ -0,0 +1,127 @@
+package attestation
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/develar/app-builder/pkg/credentials"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+)
+
+const PayloadType = "application/vnd.in-toto+json"
+
+// Envelope is DSSE envelope (https://github.com/secure-systems-lab/dsse)
+type Envelope struct {
+	PayloadType string       `json:"payloadType"`
+	Payload     string       `json:"payload"`
+	Signatures  []*Signature `json:"signatures"`
+}
+
+type Signature struct {
+	KeyId string `json:"keyid"`
+	Sig   string `json:"sig"`
+}
+
+type signer struct {
+	key crypto.Signer
+	// hex sha256 of PKIX public key
+	keyId        string
+	publicKeyPem []byte
+}
+
+func loadSigner(keyFile string) (*signer, error) {
+	var data []byte
+	if keyFile == "" {
+		value, err := credentials.GetRequired(SigningKeyCredentialName)
+		if err != nil {
+			return nil, err
+		}
+		data = []byte(value)
+	} else {
+		var err error
+		data, err = ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return parseSigner(data)
+}
+
+// PKCS#8 (ECDSA or Ed25519) or SEC 1 (ECDSA) PEM
+func parseSigner(data []byte) (*signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, util.NewMessageError("signing key is not a PEM private key", "ERR_ATTESTATION_INVALID_KEY")
+	}
+
+	var key interface{}
+	var err error
+	if block.Type == "EC PRIVATE KEY" {
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, util.NewMessageError("cannot parse signing key: "+err.Error(), "ERR_ATTESTATION_INVALID_KEY")
+	}
+
+	var result crypto.Signer
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		result = k
+	case ed25519.PrivateKey:
+		result = k
+	default:
+		return nil, util.NewMessageError("signing key must be ECDSA or Ed25519", "ERR_ATTESTATION_KEY_UNSUPPORTED")
+	}
+
+	publicKey, err := x509.MarshalPKIXPublicKey(result.Public())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	keyId := sha256.Sum256(publicKey)
+	return &signer{
+		key:          result,
+		keyId:        hex.EncodeToString(keyId[:]),
+		publicKeyPem: pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey}),
+	}, nil
+}
+
+func (t *signer) sign(payload []byte) (*Envelope, error) {
+	message := PreAuthEncode(PayloadType, payload)
+
+	var signature []byte
+	var err error
+	if _, isEd25519 := t.key.(ed25519.PrivateKey); isEd25519 {
+		// Ed25519 signs the message itself
+		signature, err = t.key.Sign(rand.Reader, message, crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256(message)
+		signature, err = t.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &Envelope{
+		PayloadType: PayloadType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures:  []*Signature{{KeyId: t.keyId, Sig: base64.StdEncoding.EncodeToString(signature)}},
+	}, nil
+}
+
+// PreAuthEncode returns DSSE PAE - signed message, not the payload itself
+func PreAuthEncode(payloadType string, payload []byte) []byte {
+	prefix := "DSSEv1 " + strconv.Itoa(len(payloadType)) + " " + payloadType + " " + strconv.Itoa(len(payload)) + " "
+	return append([]byte(prefix), payload...)
+}
@@ -0,0 +1,96 @@
+package attestation
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/develar/app-builder/pkg/fakes"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/json-iterator/go"
+	"go.uber.org/zap"
+)
+
+type RekorEntry struct {
+	Uuid           string `json:"uuid"`
+	LogIndex       int64  `json:"logIndex"`
+	IntegratedTime int64  `json:"integratedTime"`
+	Url            string `json:"url"`
+}
+
+type rekorLogEntry struct {
+	LogIndex       int64 `json:"logIndex"`
+	IntegratedTime int64 `json:"integratedTime"`
+}
+
+// uploadToRekor creates dsse entry (envelope and public key to verify it), response is the log entry keyed by UUID
+func uploadToRekor(rekorUrl string, name string, hash string, envelope []byte, publicKeyPem []byte) (*RekorEntry, error) {
+	if fakes.IsEnabled() {
+		return nil, fakes.Record(fakes.ServiceRekor, "Upload", map[string]interface{}{
+			"name":   name,
+			"sha256": hash,
+		})
+	}
+
+	body, err := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(map[string]interface{}{
+		"apiVersion": "0.0.1",
+		"kind":       "dsse",
+		"spec": map[string]interface{}{
+			"proposedContent": map[string]interface{}{
+				"envelope":  string(envelope),
+				"verifiers": []string{base64.StdEncoding.EncodeToString(publicKeyPem)},
+			},
+		},
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	url := strings.TrimSuffix(rekorUrl, "/") + "/api/v1/log/entries"
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	requestContext, cancel := util.CreateContextWithTimeout(2 * time.Minute)
+	defer cancel()
+	request = request.WithContext(requestContext)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Accept", "application/json")
+
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: util.ProxyFromEnvironmentAndNpm,
+		},
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer util.Close(response.Body)
+
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if response.StatusCode != http.StatusCreated {
+		return nil, util.NewMessageError("Rekor responded with "+response.Status+" for "+name+": "+strings.TrimSpace(string(responseBody)), "ERR_ATTESTATION_REKOR_FAILED")
+	}
+
+	var entries map[string]*rekorLogEntry
+	err = jsoniter.Unmarshal(responseBody, &entries)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot parse Rekor response")
+	}
+	for uuid, entry := range entries {
+		result := &RekorEntry{Uuid: uuid, LogIndex: entry.LogIndex, IntegratedTime: entry.IntegratedTime, Url: url + "/" + uuid}
+		log.Info("attestation uploaded to Rekor", zap.String("file", name), zap.Int64("logIndex", result.LogIndex))
+		return result, nil
+	}
+	return nil, util.NewMessageError("Rekor response doesn't contain log entry for "+name, "ERR_ATTESTATION_REKOR_FAILED")
+}
@@ -10,12 +10,14 @@ import (
 	"fmt"
 	"hash"
 	"io"
+	"math/bits"
 	"os"
 
 	"github.com/aclements/go-rabin/rabin"
 	"github.com/develar/app-builder/pkg/util"
 	"github.com/develar/errors"
 	"github.com/json-iterator/go"
+	"github.com/klauspost/compress/zstd"
 	"github.com/minio/blake2b-simd"
 )
 
@@ -46,6 +48,42 @@ type ChunkerConfiguration struct {
 	Avg    int
 	Min    int
 	Max    int
+	// rolling hash irreducible polynomial over GF(2), rabin.Poly64 if not set.
+	// Old and new file must be chunked using the same configuration, otherwise no block will match.
+	Polynomial uint64
+}
+
+// Validate reports invalid configuration as error instead of panic in the chunker.
+func (t ChunkerConfiguration) Validate() error {
+	switch {
+	case t.Window <= 0:
+		return newChunkerConfigurationError("window must be > 0")
+	case t.Min < t.Window:
+		return newChunkerConfigurationError(fmt.Sprintf("min chunk size (%d) must be >= window size (%d)", t.Min, t.Window))
+	case t.Avg < t.Min || t.Avg > t.Max:
+		return newChunkerConfigurationError(fmt.Sprintf("avg chunk size (%d) must be in range [min (%d), max (%d)]", t.Avg, t.Min, t.Max))
+	case t.Avg&(t.Avg-1) != 0:
+		return newChunkerConfigurationError(fmt.Sprintf("avg chunk size (%d) must be a power of two", t.Avg))
+	case t.Max > maxChunkSize:
+		return newChunkerConfigurationError(fmt.Sprintf("max chunk size (%d) must be <= %d", t.Max, maxChunkSize))
+	}
+
+	if t.Polynomial != 0 && (bits.Len64(t.Polynomial) <= 8 || t.Polynomial&1 == 0) {
+		// not a full irreducibility test, but polynomial without constant term is divisible by x
+		return newChunkerConfigurationError(fmt.Sprintf("polynomial 0x%x must have degree >= 8 and constant term", t.Polynomial))
+	}
+	return nil
+}
+
+func (t ChunkerConfiguration) polynomial() uint64 {
+	if t.Polynomial == 0 {
+		return rabin.Poly64
+	}
+	return t.Polynomial
+}
+
+func newChunkerConfigurationError(message string) error {
+	return util.NewMessageError("invalid chunker configuration: "+message, "ERR_BLOCKMAP_INVALID_CHUNKER_CONFIGURATION")
 }
 
 type CompressionFormat int
@@ -53,6 +91,19 @@ type CompressionFormat int
 const (
 	GZIP    = 0
 	DEFLATE = 1
+	// smaller and faster to decode than gzip for large block maps, requires reader that supports block map version 3
+	ZSTD = 2
+)
+
+// block is downloaded using a single range request
+const maxChunkSize = 64 * 1024 * 1024
+
+// protects from decompression bomb, block map of 10 GB file is about 40 MB
+const maxDecodedBlockMapSize = 256 * 1024 * 1024
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
 )
 
 var DefaultChunkerConfiguration = ChunkerConfiguration{
@@ -60,6 +111,8 @@ var DefaultChunkerConfiguration = ChunkerConfiguration{
 	Avg:    16 * 1024,
 	Min:    8 * 1024,
 	Max:    32 * 1024,
+
+	Polynomial: rabin.Poly64,
 }
 
 func BuildBlockMap(inFile string, chunkerConfiguration ChunkerConfiguration, compressionFormat CompressionFormat, outFile string) (*InputFileInfo, error) {
@@ -67,20 +120,19 @@ func BuildBlockMap(inFile string, chunkerConfiguration ChunkerConfiguration, com
 	if err != nil {
 		return nil, err
 	}
+	return writeBlockMap(*checksums, *sizes, inputInfo, inFile, compressionFormat, outFile)
+}
 
-	blockMap := BlockMap{
-		Version: "2",
-		Files: []BlockMapFile{
-			{
-				Name:      "file",
-				Offset:    0,
-				Checksums: *checksums,
-				Sizes:     *sizes,
-			},
-		},
+// writes block map to outFile or appends to inFile if outFile is not specified
+func writeBlockMap(checksums []string, sizes []int, inputInfo *InputFileInfo, inFile string, compressionFormat CompressionFormat, outFile string) (*InputFileInfo, error) {
+	// version is bumped for zstd to let old readers (that support only gzip and deflate) report unsupported version instead of corrupted data
+	version := "2"
+	if compressionFormat == ZSTD {
+		version = "3"
 	}
 
-	serializedBlockMap, err := jsoniter.ConfigFastest.Marshal(&blockMap)
+	blockMap := newBlockMap(version, checksums, sizes)
+	serializedBlockMap, err := jsoniter.ConfigFastest.Marshal(blockMap)
 	if err != nil {
 		return nil, err
 	}
@@ -104,6 +156,34 @@ func BuildBlockMap(inFile string, chunkerConfiguration ChunkerConfiguration, com
 	return inputInfo, nil
 }
 
+func newBlockMap(version string, checksums []string, sizes []int) *BlockMap {
+	return &BlockMap{
+		Version: version,
+		Files: []BlockMapFile{
+			{
+				Name:      "file",
+				Offset:    0,
+				Checksums: checksums,
+				Sizes:     sizes,
+			},
+		},
+	}
+}
+
+// CreateBlockMap computes block map of the file without writing it (e.g. for the old file if its block map is not available)
+func CreateBlockMap(inFile string, chunkerConfiguration ChunkerConfiguration) (*BlockMap, error) {
+	checksums, sizes, _, err := computeBlocks(inFile, chunkerConfiguration)
+	if err != nil {
+		return nil, err
+	}
+	return newBlockMap("2", *checksums, *sizes), nil
+}
+
+// NewBlockHash returns hash that is used to compute block checksum
+func NewBlockHash() (hash.Hash, error) {
+	return blake2b.New(&blake2b.Config{Size: 18})
+}
+
 func appendResult(data []byte, inFile string, compressionFormat CompressionFormat, hash *hash.Hash) (int, error) {
 	archiveBuffer := new(bytes.Buffer)
 	err := archiveData(data, compressionFormat, archiveBuffer)
@@ -157,9 +237,12 @@ func writeResult(data []byte, outFile string, compressionFormat CompressionForma
 func archiveData(data []byte, compressionFormat CompressionFormat, destinationWriter io.Writer) error {
 	var archiveWriter io.WriteCloser
 	var err error
-	if compressionFormat == DEFLATE {
+	switch compressionFormat {
+	case DEFLATE:
 		archiveWriter, err = flate.NewWriter(destinationWriter, flate.BestCompression)
-	} else {
+	case ZSTD:
+		archiveWriter, err = zstd.NewWriter(destinationWriter, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	default:
 		archiveWriter, err = gzip.NewWriterLevel(destinationWriter, gzip.BestCompression)
 	}
 	if err != nil {
@@ -176,6 +259,80 @@ func archiveData(data []byte, compressionFormat CompressionFormat, destinationWr
 	return nil
 }
 
+// DetectCompressionFormat returns format by magic number, raw deflate doesn't have it, so, specified default format is returned in this case
+func DetectCompressionFormat(data []byte, defaultFormat CompressionFormat) CompressionFormat {
+	switch {
+	case bytes.HasPrefix(data, zstdMagic):
+		return ZSTD
+	case bytes.HasPrefix(data, gzipMagic):
+		return GZIP
+	default:
+		return defaultFormat
+	}
+}
+
+// DecodeBlockMap decompresses and parses serialized block map. Structure is validated to report corrupted input as error and not to fail later.
+// Gzip and zstd are detected by magic number, so, specified format matters only for deflate (block map appended to AppImage).
+func DecodeBlockMap(data []byte, compressionFormat CompressionFormat) (*BlockMap, error) {
+	var reader io.ReadCloser
+	switch DetectCompressionFormat(data, compressionFormat) {
+	case DEFLATE:
+		reader = flate.NewReader(bytes.NewReader(data))
+	case ZSTD:
+		decoder, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxDecodedBlockMapSize))
+		if err != nil {
+			return nil, errors.WithMessage(err, "cannot decompress block map")
+		}
+		reader = decoder.IOReadCloser()
+	default:
+		var err error
+		reader, err = gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, errors.WithMessage(err, "cannot decompress block map")
+		}
+	}
+
+	// close error for decompressor means only that stream is corrupted and it is reported by decode
+	defer func() {
+		_ = reader.Close()
+	}()
+
+	var blockMap BlockMap
+	err := jsoniter.ConfigFastest.NewDecoder(reader).Decode(&blockMap)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot decode block map")
+	}
+
+	err = blockMap.validate()
+	if err != nil {
+		return nil, err
+	}
+	return &blockMap, nil
+}
+
+func (t *BlockMap) validate() error {
+	switch t.Version {
+	case "":
+		return errors.New("block map version is not specified")
+	case "1", "2", "3":
+	default:
+		return errors.Errorf("block map version %s is not supported", t.Version)
+	}
+
+	for index, file := range t.Files {
+		if len(file.Checksums) != len(file.Sizes) {
+			return errors.Errorf("block map file #%d (%s) is corrupted: %d checksums, but %d sizes", index, file.Name, len(file.Checksums), len(file.Sizes))
+		}
+
+		for blockIndex, size := range file.Sizes {
+			if size <= 0 {
+				return errors.Errorf("block map file #%d (%s) is corrupted: block #%d has invalid size %d", index, file.Name, blockIndex, size)
+			}
+		}
+	}
+	return nil
+}
+
 func computeBlocks(inFile string, configuration ChunkerConfiguration) (*[]string, *[]int, *InputFileInfo, error) {
 	inputFileDescriptor, err := os.Open(inFile)
 	if err != nil {
@@ -183,10 +340,33 @@ func computeBlocks(inFile string, configuration ChunkerConfiguration) (*[]string
 	}
 	defer util.Close(inputFileDescriptor)
 
+	checksums, sizes, inputInfo, err := chunk(inputFileDescriptor, configuration)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	inputFileStat, err := inputFileDescriptor.Stat()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	fileSize := int(inputFileStat.Size())
+	if inputInfo.Size != fileSize {
+		return nil, nil, nil, fmt.Errorf("expected size sum: %d. Actual: %d", fileSize, inputInfo.Size)
+	}
+	return &checksums, &sizes, inputInfo, nil
+}
+
+func chunk(reader io.Reader, configuration ChunkerConfiguration) ([]string, []int, *InputFileInfo, error) {
+	err := configuration.Validate()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
 	var checksums []string
 	var sizes []int
 
-	chunkHash, err := blake2b.New(&blake2b.Config{Size: 18})
+	chunkHash, err := NewBlockHash()
 	if err != nil {
 		return nil, nil, nil, err
 	}
@@ -194,8 +374,9 @@ func computeBlocks(inFile string, configuration ChunkerConfiguration) (*[]string
 	inputHash := sha512.New()
 
 	copyBuffer := new(bytes.Buffer)
-	r := io.TeeReader(inputFileDescriptor, copyBuffer)
-	c := rabin.NewChunker(rabin.NewTable(rabin.Poly64, configuration.Window), r, configuration.Min, configuration.Avg, configuration.Max)
+	r := io.TeeReader(reader, copyBuffer)
+	c := rabin.NewChunker(rabin.NewTable(configuration.polynomial(), configuration.Window), r, configuration.Min, configuration.Avg, configuration.Max)
+	sum := 0
 	for i := 0; ; i++ {
 		copyLength, err := c.Next()
 		if err == io.EOF {
@@ -204,6 +385,11 @@ func computeBlocks(inFile string, configuration ChunkerConfiguration) (*[]string
 			return nil, nil, nil, err
 		}
 
+		if copyLength == 0 {
+			// chunker can report empty chunk at the end of input, it must not be written (invalid block for reader)
+			continue
+		}
+
 		_, err = io.Copy(chunkHash, io.TeeReader(io.LimitReader(copyBuffer, int64(copyLength)), inputHash))
 		if err != nil {
 			return nil, nil, nil, errors.New("error writing hash")
@@ -211,27 +397,56 @@ func computeBlocks(inFile string, configuration ChunkerConfiguration) (*[]string
 
 		checksums = append(checksums, base64.StdEncoding.EncodeToString(chunkHash.Sum(nil)))
 		sizes = append(sizes, copyLength)
+		sum += copyLength
 
 		chunkHash.Reset()
 	}
 
-	inputFileStat, err := inputFileDescriptor.Stat()
+	return checksums, sizes, &InputFileInfo{
+		Size: sum,
+		hash: &inputHash,
+	}, nil
+}
+
+// GetAppendedBlockMapSize returns size of the block map appended to the file (see writeBlockMap) or 0 if block map is not appended.
+// Block map is decoded to not treat trailing bytes of arbitrary file as size.
+func GetAppendedBlockMapSize(file string) (int, error) {
+	reader, err := os.Open(file)
 	if err != nil {
-		return nil, nil, nil, err
+		return 0, errors.WithStack(err)
 	}
+	defer util.Close(reader)
 
-	sum := 0
-	for _, s := range sizes {
-		sum += s
+	info, err := reader.Stat()
+	if err != nil {
+		return 0, errors.WithStack(err)
 	}
 
-	fileSize := int(inputFileStat.Size())
-	if sum != fileSize {
-		return nil, nil, nil, fmt.Errorf("expected size sum: %d. Actual: %d", fileSize, sum)
+	fileSize := info.Size()
+	if fileSize <= 4 {
+		return 0, nil
 	}
 
-	return &checksums, &sizes, &InputFileInfo{
-		Size: fileSize,
-		hash: &inputHash,
-	}, nil
+	sizeBytes := make([]byte, 4)
+	_, err = reader.ReadAt(sizeBytes, fileSize-4)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	blockMapSize := int64(binary.BigEndian.Uint32(sizeBytes))
+	if blockMapSize == 0 || blockMapSize > fileSize-4 || blockMapSize > maxDecodedBlockMapSize {
+		return 0, nil
+	}
+
+	data := make([]byte, blockMapSize)
+	_, err = reader.ReadAt(data, fileSize-4-blockMapSize)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	_, err = DecodeBlockMap(data, DEFLATE)
+	if err != nil {
+		return 0, nil
+	}
+	return int(blockMapSize), nil
 }
@@ -4,6 +4,8 @@ import (
 	"crypto/sha512"
 	"encoding/base64"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -12,9 +14,11 @@ import (
 	. "github.com/onsi/gomega"
 
 	. "github.com/develar/app-builder/pkg/blockmap"
+	"github.com/develar/app-builder/pkg/log"
 )
 
 func TestBlockmap(t *testing.T) {
+	log.InitLogger()
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Blockmap Suite")
 }
@@ -46,4 +50,131 @@ var _ = Describe("Blockmap", func() {
 		//noinspection SpellCheckingInspection
 		Expect(string(serializedInputInfo)).To(Equal("{\"size\":13423,\"sha512\":\"zPFW3WAFUKFvAfBdNXHDIuZekSW/qf33lf5OgKXBKg9oOobwVH9X/DRHExC9087Cxkp3nqFrwtreWZHLso3D6g==\",\"blockMapSize\":107}"))
 	})
+
+	It("zstd", func() {
+		file, err := ioutil.TempFile("", "zstd")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.Remove(file.Name())
+
+		_, err = file.WriteString(strings.Repeat("hello world. ", 1024*64))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(file.Close()).NotTo(HaveOccurred())
+
+		outFile := file.Name() + ".blockmap"
+		defer os.Remove(outFile)
+		_, err = BuildBlockMap(file.Name(), DefaultChunkerConfiguration, ZSTD, outFile)
+		Expect(err).NotTo(HaveOccurred())
+
+		data, err := ioutil.ReadFile(outFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(DetectCompressionFormat(data, GZIP)).To(Equal(CompressionFormat(ZSTD)))
+
+		// format is detected, so, reader that expects gzip can read zstd block map
+		blockMap, err := DecodeBlockMap(data, GZIP)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(blockMap.Version).To(Equal("3"))
+		Expect(len(blockMap.Files)).To(Equal(1))
+
+		total := 0
+		for _, size := range blockMap.Files[0].Sizes {
+			total += size
+		}
+		Expect(total).To(Equal(len("hello world. ") * 1024 * 64))
+	})
+	It("dir", func() {
+		dir, err := ioutil.TempDir("", "blockmap-dir")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		Expect(os.MkdirAll(filepath.Join(dir, "resources"), 0755)).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "app.exe"), []byte(strings.Repeat("exe ", 1024*32)), 0644)).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "resources", "app.asar"), []byte(strings.Repeat("asar ", 1024*16)), 0644)).NotTo(HaveOccurred())
+
+		index, err := BuildDirBlockMaps(dir, DefaultChunkerConfiguration, GZIP, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(index.Files)).To(Equal(2))
+		Expect(index.Files[0].Name).To(Equal("app.exe"))
+		Expect(index.Files[0].Size).To(Equal(1024 * 32 * 4))
+		Expect(index.Files[1].Name).To(Equal("resources/app.asar"))
+		Expect(index.Files[1].BlockMap).To(Equal("resources/app.asar.blockmap"))
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, "resources", "app.asar.blockmap"))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = DecodeBlockMap(data, GZIP)
+		Expect(err).NotTo(HaveOccurred())
+
+		// generated block maps and index are not included on rebuild
+		index, err = BuildDirBlockMaps(dir, DefaultChunkerConfiguration, GZIP, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(index.Files)).To(Equal(2))
+
+		data, err = ioutil.ReadFile(filepath.Join(dir, DirIndexFileName))
+		Expect(err).NotTo(HaveOccurred())
+		var savedIndex DirIndex
+		Expect(jsoniter.Unmarshal(data, &savedIndex)).NotTo(HaveOccurred())
+		Expect(savedIndex).To(Equal(*index))
+	})
+
+	It("inline", func() {
+		dir, err := ioutil.TempDir("", "inline")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		data := strings.Repeat("hello world. ", 1024*64)
+		file := filepath.Join(dir, "file")
+		Expect(ioutil.WriteFile(file, []byte(data), 0644)).NotTo(HaveOccurred())
+		expectedInfo, err := BuildBlockMap(file, DefaultChunkerConfiguration, GZIP, file+".blockmap")
+		Expect(err).NotTo(HaveOccurred())
+
+		inlineFile := filepath.Join(dir, "inline")
+		inputInfo, err := BuildBlockMapInline(strings.NewReader(data), inlineFile, DefaultChunkerConfiguration, GZIP, inlineFile+".blockmap")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(inputInfo).To(Equal(expectedInfo))
+
+		writtenData, err := ioutil.ReadFile(inlineFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(writtenData)).To(Equal(data))
+
+		expectedBlockMap, err := ioutil.ReadFile(file + ".blockmap")
+		Expect(err).NotTo(HaveOccurred())
+		blockMap, err := ioutil.ReadFile(inlineFile + ".blockmap")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(blockMap).To(Equal(expectedBlockMap))
+	})
+
+	It("chunker configuration", func() {
+		Expect(DefaultChunkerConfiguration.Validate()).NotTo(HaveOccurred())
+
+		configuration := DefaultChunkerConfiguration
+		configuration.Avg = 10000
+		Expect(configuration.Validate()).To(HaveOccurred())
+
+		configuration = DefaultChunkerConfiguration
+		configuration.Min = 32
+		Expect(configuration.Validate()).To(HaveOccurred())
+
+		configuration = DefaultChunkerConfiguration
+		configuration.Polynomial = 0x100
+		Expect(configuration.Validate()).To(HaveOccurred())
+
+		file, err := ioutil.TempFile("", "chunker")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.Remove(file.Name())
+		_, err = file.WriteString(strings.Repeat("hello world. ", 1024*64))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(file.Close()).NotTo(HaveOccurred())
+
+		_, err = CreateBlockMap(file.Name(), configuration)
+		Expect(err).To(HaveOccurred())
+
+		configuration = ChunkerConfiguration{Window: 32, Min: 1024, Avg: 2048, Max: 4096, Polynomial: 0x3DA3358B4DC173}
+		blockMap, err := CreateBlockMap(file.Name(), configuration)
+		Expect(err).NotTo(HaveOccurred())
+		defaultBlockMap, err := CreateBlockMap(file.Name(), DefaultChunkerConfiguration)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(blockMap.Files[0].Sizes)).To(BeNumerically(">", len(defaultBlockMap.Files[0].Sizes)))
+		for _, size := range blockMap.Files[0].Sizes {
+			Expect(size).To(BeNumerically("<=", configuration.Max))
+		}
+	})
 })
@@ -2,32 +2,77 @@ package blockmap
 
 import (
 	"fmt"
+	"os"
+	"strconv"
 
 	"github.com/alecthomas/kingpin"
 	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
 )
 
 func ConfigureCommand(app *kingpin.Application) {
 	command := app.Command("blockmap", "Generates file block map for differential update using content defined chunking (that is robust to insertions, deletions, and changes to input file)")
-	inFile := command.Flag("input", "input file").Short('i').Required().String()
-	outFile := command.Flag("output", "output file").Short('o').String()
-	compression := command.Flag("compression", "compression, one of: gzip, deflate").Short('c').Default("gzip").Enum("gzip", "deflate")
+	inFile := command.Flag("input", "input file or dir (block map is generated for each file and "+DirIndexFileName+" index is written)").Short('i').Required().String()
+	outFile := command.Flag("output", "output file, or output dir if input is a dir (input dir by default)").Short('o').String()
+	compression := command.Flag("compression", "compression, one of: gzip, deflate, zstd (block map version 3, smaller for large files)").Short('c').Default("gzip").Enum("gzip", "deflate", "zstd")
+	chunkerConfiguration := ConfigureChunkerFlags(command)
+	isInline := command.Flag("blockmap-inline", "read artifact data from stdin (e.g. 7za -so), write it to input file and compute block map in the same pass").Bool()
 
 	command.Action(func(context *kingpin.ParseContext) error {
+		err := chunkerConfiguration.Validate()
+		if err != nil {
+			return err
+		}
+
 		var compressionFormat CompressionFormat
 		switch *compression {
 		case "gzip":
 			compressionFormat = GZIP
 		case "deflate":
 			compressionFormat = DEFLATE
+		case "zstd":
+			compressionFormat = ZSTD
 		default:
 			return fmt.Errorf("unknown compression format %s", *compression)
 		}
 
-		inputInfo, err := BuildBlockMap(*inFile, DefaultChunkerConfiguration, compressionFormat, *outFile)
+		if *isInline {
+			inputInfo, err := BuildBlockMapInline(os.Stdin, *inFile, *chunkerConfiguration, compressionFormat, *outFile)
+			if err != nil {
+				return err
+			}
+			return util.WriteJsonToStdOut(inputInfo)
+		}
+
+		info, err := os.Stat(*inFile)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if info.IsDir() {
+			index, err := BuildDirBlockMaps(*inFile, *chunkerConfiguration, compressionFormat, *outFile)
+			if err != nil {
+				return err
+			}
+			return util.WriteJsonToStdOut(index)
+		}
+
+		inputInfo, err := BuildBlockMap(*inFile, *chunkerConfiguration, compressionFormat, *outFile)
 		if err != nil {
 			return err
 		}
 		return util.WriteJsonToStdOut(inputInfo)
 	})
 }
+
+// ConfigureChunkerFlags adds flags to tune content defined chunking (DefaultChunkerConfiguration is used by default).
+// Smaller chunks improve delta efficiency for small payloads, larger chunks reduce block map size and count of range requests for very large ones.
+func ConfigureChunkerFlags(command *kingpin.CmdClause) *ChunkerConfiguration {
+	configuration := DefaultChunkerConfiguration
+	command.Flag("chunk-min", "min chunk size in bytes").Default(strconv.Itoa(DefaultChunkerConfiguration.Min)).IntVar(&configuration.Min)
+	command.Flag("chunk-avg", "average chunk size in bytes, must be a power of two").Default(strconv.Itoa(DefaultChunkerConfiguration.Avg)).IntVar(&configuration.Avg)
+	command.Flag("chunk-max", "max chunk size in bytes").Default(strconv.Itoa(DefaultChunkerConfiguration.Max)).IntVar(&configuration.Max)
+	command.Flag("chunk-window", "rolling hash window size in bytes").Default(strconv.Itoa(DefaultChunkerConfiguration.Window)).IntVar(&configuration.Window)
+	command.Flag("chunk-polynomial", "rolling hash irreducible polynomial (e.g. 0xbfe6b8a5bf378d83)").Default(fmt.Sprintf("0x%x", DefaultChunkerConfiguration.Polynomial)).Uint64Var(&configuration.Polynomial)
+	return &configuration
+}
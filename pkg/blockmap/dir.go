@@ -0,0 +1,108 @@
+package blockmap
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+	"github.com/json-iterator/go"
+)
+
+const DirIndexFileName = "blockmap-index.json"
+
+const blockMapExtension = ".blockmap"
+
+// DirIndex lists block maps of all files of multi-file artifact (e.g. unpacked app dir), so, each file can be updated differentially
+type DirIndex struct {
+	Version string         `json:"version"`
+	Files   []DirIndexFile `json:"files"`
+}
+
+type DirIndexFile struct {
+	// slash-separated path relative to the input dir
+	Name   string `json:"name"`
+	Size   int    `json:"size"`
+	Sha512 string `json:"sha512"`
+	// slash-separated path of the block map file relative to the output dir
+	BlockMap string `json:"blockMap"`
+}
+
+// BuildDirBlockMaps writes block map for each regular file of the input dir (to the output dir preserving relative path) and index of them.
+// Existing block maps in the input dir are skipped to allow output dir to be the same as the input one.
+func BuildDirBlockMaps(inDir string, chunkerConfiguration ChunkerConfiguration, compressionFormat CompressionFormat, outDir string) (*DirIndex, error) {
+	if len(outDir) == 0 {
+		outDir = inDir
+	}
+
+	var names []string
+	err := filepath.Walk(inDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() || strings.HasSuffix(path, blockMapExtension) {
+			return nil
+		}
+
+		name, err := filepath.Rel(inDir, path)
+		if err != nil {
+			return err
+		}
+		if name == DirIndexFileName {
+			return nil
+		}
+
+		names = append(names, filepath.ToSlash(name))
+		return nil
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	index := &DirIndex{
+		Version: "1",
+		Files:   make([]DirIndexFile, len(names)),
+	}
+	err = util.MapAsync(len(names), func(taskIndex int) (func() error, error) {
+		name := names[taskIndex]
+		blockMapName := name + blockMapExtension
+		outFile := filepath.Join(outDir, filepath.FromSlash(blockMapName))
+		return func() error {
+			err := fsutil.EnsureDir(filepath.Dir(outFile))
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			inputInfo, err := BuildBlockMap(filepath.Join(inDir, filepath.FromSlash(name)), chunkerConfiguration, compressionFormat, outFile)
+			if err != nil {
+				return errors.WithMessage(err, "cannot build block map for "+name)
+			}
+
+			index.Files[taskIndex] = DirIndexFile{
+				Name:     name,
+				Size:     inputInfo.Size,
+				Sha512:   inputInfo.Sha512,
+				BlockMap: blockMapName,
+			}
+			return nil
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := jsoniter.ConfigFastest.Marshal(index)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(outDir, DirIndexFileName), data, 0644)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return index, nil
+}
@@ -0,0 +1,36 @@
+//go:build go1.18
+// +build go1.18
+
+package blockmap_test
+
+import (
+	"testing"
+
+	. "github.com/develar/app-builder/pkg/blockmap"
+)
+
+// go test -run=^$ -fuzz=FuzzDecodeBlockMap ./pkg/blockmap
+func FuzzDecodeBlockMap(f *testing.F) {
+	f.Add([]byte{}, false)
+	f.Add([]byte("\x1f\x8b\x08\x00\x00\x00\x00\x00"), false)
+	f.Add([]byte{0xab, 0x56, 0x2a, 0x4b, 0x2d}, true)
+	f.Add([]byte{0x28, 0xb5, 0x2f, 0xfd, 0x04, 0x00}, false)
+
+	f.Fuzz(func(t *testing.T, data []byte, isDeflate bool) {
+		format := CompressionFormat(GZIP)
+		if isDeflate {
+			format = DEFLATE
+		}
+
+		blockMap, err := DecodeBlockMap(data, format)
+		if err != nil {
+			return
+		}
+
+		for _, file := range blockMap.Files {
+			if len(file.Checksums) != len(file.Sizes) {
+				t.Fatalf("invalid block map accepted: %+v", file)
+			}
+		}
+	})
+}
@@ -0,0 +1,89 @@
+package blockmap
+
+import (
+	"io"
+	"os"
+
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+)
+
+// Writer computes content defined chunks of data written to it, so, block map can be built while artifact is being written
+// (use io.MultiWriter to tee archive output) instead of re-reading a multi-GB file after.
+type Writer struct {
+	pipe *io.PipeWriter
+	done chan struct{}
+
+	checksums []string
+	sizes     []int
+	inputInfo *InputFileInfo
+	err       error
+}
+
+func NewWriter(configuration ChunkerConfiguration) *Writer {
+	reader, writer := io.Pipe()
+	t := &Writer{
+		pipe: writer,
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(t.done)
+		t.checksums, t.sizes, t.inputInfo, t.err = chunk(reader, configuration)
+		if t.err != nil {
+			// unblock and fail Write
+			_ = reader.CloseWithError(t.err)
+		} else {
+			_ = reader.Close()
+		}
+	}()
+	return t
+}
+
+func (t *Writer) Write(p []byte) (int, error) {
+	return t.pipe.Write(p)
+}
+
+// Close waits until all written data is chunked. Must be called before WriteBlockMap.
+func (t *Writer) Close() error {
+	err := t.pipe.Close()
+	<-t.done
+	if t.err != nil {
+		return t.err
+	}
+	return err
+}
+
+// WriteBlockMap writes block map to outFile or appends it to inFile (the file that the data was written to) if outFile is not specified.
+func (t *Writer) WriteBlockMap(inFile string, compressionFormat CompressionFormat, outFile string) (*InputFileInfo, error) {
+	if t.inputInfo == nil {
+		return nil, errors.New("writer is not closed or chunking failed")
+	}
+	return writeBlockMap(t.checksums, t.sizes, t.inputInfo, inFile, compressionFormat, outFile)
+}
+
+// BuildBlockMapInline copies reader to inFile and computes block map in the same pass.
+func BuildBlockMapInline(reader io.Reader, inFile string, chunkerConfiguration ChunkerConfiguration, compressionFormat CompressionFormat, outFile string) (*InputFileInfo, error) {
+	file, err := os.Create(inFile)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	blockMapWriter := NewWriter(chunkerConfiguration)
+	_, err = io.Copy(io.MultiWriter(file, blockMapWriter), reader)
+	closeErr := blockMapWriter.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		util.Close(file)
+		return nil, errors.WithStack(err)
+	}
+
+	err = file.Close()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return blockMapWriter.WriteBlockMap(inFile, compressionFormat, outFile)
+}
@@ -0,0 +1,498 @@
+package codesign
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/xml"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+)
+
+const (
+	appxSignaturePartName    = "AppxSignature.p7x"
+	appxContentTypesPartName = "[Content_Types].xml"
+	appxBlockMapPartName     = "AppxBlockMap.xml"
+	appxManifestPartName     = "AppxManifest.xml"
+	appxCodeIntegrityName    = "AppxMetadata/CodeIntegrity.cat"
+
+	zipLocalHeaderSignature   = 0x04034b50
+	zipCentralHeaderSignature = 0x02014b50
+	zipEndSignature           = 0x06054b50
+	zip64EndSignature         = 0x06064b50
+	zip64LocatorSignature     = 0x07064b50
+)
+
+// SIP of APPX/MSIX packages
+var appxSipGuid = []byte{0x4b, 0xdf, 0xc5, 0x0a, 0x07, 0xce, 0xe2, 0x4d, 0xb7, 0x6e, 0x23, 0xc8, 0x39, 0xa0, 0x9f, 0xd1}
+
+type spcSipInfo struct {
+	Version   int
+	Guid      []byte
+	Reserved1 int
+	Reserved2 int
+	Reserved3 int
+	Reserved4 int
+	Reserved5 int
+}
+
+type zipCentralEntry struct {
+	name        string
+	raw         []byte
+	localOffset uint64
+	// offset of local header offset field in raw (in zip64 extra if offset doesn't fit into 32 bits)
+	localOffsetField int
+	isZip64Offset    bool
+}
+
+// signAppx signs MSIX/APPX package: signature (AppxSignature.p7x) covers hashes of local file records (AXPC), central directory (AXCD),
+// content types (AXCT), block map (AXBM) and code integrity catalog (AXCI) of the package without the signature file.
+// Existing signature is replaced, content types are updated to declare the signature part if needed.
+func signAppx(requestContext context.Context, file string, signer Signer, timestamps *timestampPool) error {
+	outFile, err := util.TempFile(filepath.Dir(file), ".msix")
+	if err != nil {
+		return err
+	}
+
+	err = writeSignedAppx(requestContext, file, outFile, signer, timestamps)
+	if err != nil {
+		_ = os.Remove(outFile)
+		return err
+	}
+	return errors.WithStack(os.Rename(outFile, file))
+}
+
+func writeSignedAppx(requestContext context.Context, file string, outFile string, signer Signer, timestamps *timestampPool) error {
+	reader, err := os.Open(file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(reader)
+
+	info, err := reader.Stat()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	zipReader, err := zip.NewReader(reader, info.Size())
+	if err != nil {
+		return errors.WithMessage(err, "cannot read package "+file)
+	}
+
+	parts := make(map[string]*zip.File)
+	for _, item := range zipReader.File {
+		parts[item.Name] = item
+	}
+
+	err = checkAppxPublisher(parts[appxManifestPartName], signer.Certificates()[0])
+	if err != nil {
+		return err
+	}
+
+	contentTypes, err := readZipPart(parts[appxContentTypesPartName])
+	if err != nil {
+		return errors.WithMessage(err, "cannot read content types of "+file)
+	}
+	isContentTypesChanged := false
+	if !strings.Contains(contentTypes, "application/vnd.ms-appx.signature") {
+		index := strings.LastIndex(contentTypes, "</Types>")
+		if index < 0 {
+			return errors.New("invalid content types of " + file)
+		}
+		contentTypes = contentTypes[:index] + `<Override PartName="/` + appxSignaturePartName + `" ContentType="application/vnd.ms-appx.signature"/>` + contentTypes[index:]
+		isContentTypesChanged = true
+	}
+
+	centralEntries, centralDirectoryOffset, err := readZipCentralDirectory(reader, info.Size())
+	if err != nil {
+		return errors.WithMessage(err, file)
+	}
+
+	writer, err := os.Create(outFile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	bufferedWriter := bufio.NewWriterSize(writer, 1024*1024)
+	err = doWriteSignedAppx(requestContext, reader, bufferedWriter, centralEntries, centralDirectoryOffset, parts, contentTypes, isContentTypesChanged, signer, timestamps)
+	if err == nil {
+		err = errors.WithStack(bufferedWriter.Flush())
+	}
+	return fsutil.CloseAndCheckError(err, writer)
+}
+
+func doWriteSignedAppx(requestContext context.Context, reader io.ReaderAt, writer io.Writer, centralEntries []*zipCentralEntry, centralDirectoryOffset uint64,
+	parts map[string]*zip.File, contentTypes string, isContentTypesChanged bool, signer Signer, timestamps *timestampPool) error {
+	// local records in the original order, signature is excluded
+	var localEntries []*zipCentralEntry
+	for _, entry := range centralEntries {
+		if entry.name != appxSignaturePartName {
+			localEntries = append(localEntries, entry)
+		}
+	}
+	sort.Slice(localEntries, func(i, j int) bool {
+		return localEntries[i].localOffset < localEntries[j].localOffset
+	})
+
+	allOffsets := make([]uint64, 0, len(centralEntries)+1)
+	for _, entry := range centralEntries {
+		allOffsets = append(allOffsets, entry.localOffset)
+	}
+	allOffsets = append(allOffsets, centralDirectoryOffset)
+
+	localHash := sha256.New()
+	out := &offsetWriter{writer: io.MultiWriter(writer, localHash)}
+	newCentralEntries := make(map[*zipCentralEntry][]byte)
+	for _, entry := range localEntries {
+		newOffset := out.offset
+		if entry.name == appxContentTypesPartName && isContentTypesChanged {
+			localHeader, centralHeader := createStoredZipHeaders(entry.name, []byte(contentTypes), newOffset)
+			_, err := out.Write(append(localHeader, contentTypes...))
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			newCentralEntries[entry] = centralHeader
+			continue
+		}
+
+		end := centralDirectoryOffset
+		for _, offset := range allOffsets {
+			if offset > entry.localOffset && offset < end {
+				end = offset
+			}
+		}
+		_, err := io.Copy(out, io.NewSectionReader(reader, int64(entry.localOffset), int64(end-entry.localOffset)))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		newCentralEntries[entry] = entry.withLocalOffset(newOffset)
+	}
+	localRecordsSize := out.offset
+
+	var centralDirectory bytes.Buffer
+	entryCount := 0
+	for _, entry := range centralEntries {
+		if entry.name != appxSignaturePartName {
+			centralDirectory.Write(newCentralEntries[entry])
+			entryCount++
+		}
+	}
+
+	centralDirectoryHash := sha256.New()
+	centralDirectoryHash.Write(centralDirectory.Bytes())
+	centralDirectoryHash.Write(createZipEnd(entryCount, uint64(centralDirectory.Len()), localRecordsSize))
+
+	digest := []byte("APPX")
+	digest = appendAppxHash(digest, "AXPC", localHash)
+	digest = appendAppxHash(digest, "AXCD", centralDirectoryHash)
+	for _, item := range []struct{ tag, name string }{{"AXCT", appxContentTypesPartName}, {"AXBM", appxBlockMapPartName}, {"AXCI", appxCodeIntegrityName}} {
+		var data []byte
+		if item.name == appxContentTypesPartName {
+			data = []byte(contentTypes)
+		} else if part := parts[item.name]; part != nil {
+			content, err := readZipPart(part)
+			if err != nil {
+				return err
+			}
+			data = []byte(content)
+		} else if item.tag == "AXBM" {
+			return util.NewMessageError("package has no block map", "ERR_SIGN_INVALID_PACKAGE")
+		} else {
+			continue
+		}
+
+		partHash := sha256.New()
+		partHash.Write(data)
+		digest = appendAppxHash(digest, item.tag, partHash)
+	}
+
+	sipInfo, err := asn1.Marshal(spcSipInfo{Version: 0x01010000, Guid: appxSipGuid})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	signature, err := createAuthenticodeSignature(requestContext, spcIndirectDataContent{
+		Data:          spcAttributeTypeAndOptionalValue{Type: oidSpcSipInfo, Value: asn1.RawValue{FullBytes: sipInfo}},
+		MessageDigest: digestInfo{DigestAlgorithm: sha256AlgorithmIdentifier, Digest: digest},
+	}, signer)
+	if err != nil {
+		return err
+	}
+	if timestamps != nil {
+		err = timestamps.addTimestamp(requestContext, signature)
+		if err != nil {
+			return err
+		}
+	}
+
+	signatureData, err := signature.encode()
+	if err != nil {
+		return err
+	}
+
+	p7x := append([]byte("PKCX"), signatureData...)
+	localHeader, centralHeader := createStoredZipHeaders(appxSignaturePartName, p7x, out.offset)
+	_, err = out.Write(append(localHeader, p7x...))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	centralDirectory.Write(centralHeader)
+	signedCentralDirectoryOffset := out.offset
+	_, err = out.Write(centralDirectory.Bytes())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = out.Write(createZipEnd(entryCount+1, uint64(centralDirectory.Len()), signedCentralDirectoryOffset))
+	return errors.WithStack(err)
+}
+
+func appendAppxHash(digest []byte, tag string, hash hash.Hash) []byte {
+	return append(append(digest, tag...), hash.Sum(nil)...)
+}
+
+type offsetWriter struct {
+	writer io.Writer
+	offset uint64
+}
+
+func (t *offsetWriter) Write(p []byte) (int, error) {
+	n, err := t.writer.Write(p)
+	t.offset += uint64(n)
+	return n, err
+}
+
+func readZipPart(file *zip.File) (string, error) {
+	if file == nil {
+		return "", errors.New("part is not found")
+	}
+
+	reader, err := file.Open()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer util.Close(reader)
+
+	data, err := ioutil.ReadAll(reader)
+	return string(data), errors.WithStack(err)
+}
+
+// checkAppxPublisher checks that publisher of the package identity equals to the certificate subject, otherwise Windows refuses to install the package
+func checkAppxPublisher(manifestPart *zip.File, certificate *x509.Certificate) error {
+	data, err := readZipPart(manifestPart)
+	if err != nil {
+		return errors.WithMessage(err, "cannot read package manifest")
+	}
+
+	var manifest struct {
+		Identity struct {
+			Publisher string `xml:"Publisher,attr"`
+		} `xml:"Identity"`
+	}
+	err = xml.Unmarshal([]byte(data), &manifest)
+	if err != nil {
+		return errors.WithMessage(err, "cannot parse package manifest")
+	}
+
+	subject := BloodyMsString(certificate.Subject.ToRDNSequence())
+	if manifest.Identity.Publisher != subject {
+		return util.NewMessageError("package publisher "+manifest.Identity.Publisher+" doesn't match certificate subject "+subject, "ERR_SIGN_PUBLISHER_MISMATCH")
+	}
+	return nil
+}
+
+func readZipCentralDirectory(reader io.ReaderAt, size int64) ([]*zipCentralEntry, uint64, error) {
+	// end of central directory record with the max comment
+	tailSize := int64(22 + 65535)
+	if tailSize > size {
+		tailSize = size
+	}
+	tail := make([]byte, tailSize)
+	_, err := reader.ReadAt(tail, size-tailSize)
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+
+	endOffset := -1
+	for i := len(tail) - 22; i >= 0; i-- {
+		if binary.LittleEndian.Uint32(tail[i:]) == zipEndSignature {
+			endOffset = i
+			break
+		}
+	}
+	if endOffset < 0 {
+		return nil, 0, errors.New("not a zip file")
+	}
+
+	end := tail[endOffset:]
+	entryCount := uint64(binary.LittleEndian.Uint16(end[10:]))
+	directorySize := uint64(binary.LittleEndian.Uint32(end[12:]))
+	directoryOffset := uint64(binary.LittleEndian.Uint32(end[16:]))
+
+	locatorOffset := endOffset - 20
+	if locatorOffset >= 0 && binary.LittleEndian.Uint32(tail[locatorOffset:]) == zip64LocatorSignature {
+		zip64End := make([]byte, 56)
+		_, err = reader.ReadAt(zip64End, int64(binary.LittleEndian.Uint64(tail[locatorOffset+8:])))
+		if err != nil {
+			return nil, 0, errors.WithStack(err)
+		}
+		if binary.LittleEndian.Uint32(zip64End) != zip64EndSignature {
+			return nil, 0, errors.New("invalid zip64 end of central directory")
+		}
+		entryCount = binary.LittleEndian.Uint64(zip64End[32:])
+		directorySize = binary.LittleEndian.Uint64(zip64End[40:])
+		directoryOffset = binary.LittleEndian.Uint64(zip64End[48:])
+	}
+
+	directory := make([]byte, directorySize)
+	_, err = reader.ReadAt(directory, int64(directoryOffset))
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+
+	result := make([]*zipCentralEntry, 0, entryCount)
+	for offset := 0; offset < len(directory); {
+		if offset+46 > len(directory) || binary.LittleEndian.Uint32(directory[offset:]) != zipCentralHeaderSignature {
+			return nil, 0, errors.New("invalid central directory")
+		}
+
+		header := directory[offset:]
+		nameLength := int(binary.LittleEndian.Uint16(header[28:]))
+		extraLength := int(binary.LittleEndian.Uint16(header[30:]))
+		commentLength := int(binary.LittleEndian.Uint16(header[32:]))
+		entrySize := 46 + nameLength + extraLength + commentLength
+		if offset+entrySize > len(directory) {
+			return nil, 0, errors.New("invalid central directory")
+		}
+
+		entry := &zipCentralEntry{
+			name:             string(header[46 : 46+nameLength]),
+			raw:              header[:entrySize],
+			localOffset:      uint64(binary.LittleEndian.Uint32(header[42:])),
+			localOffsetField: 42,
+		}
+		if entry.localOffset == 0xffffffff {
+			err = entry.readZip64Offset(46+nameLength, extraLength)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		result = append(result, entry)
+		offset += entrySize
+	}
+	return result, directoryOffset, nil
+}
+
+// zip64 extra field contains only fields that are set to 0xffffffff in the header: uncompressed size, compressed size, local header offset
+func (t *zipCentralEntry) readZip64Offset(extraOffset int, extraLength int) error {
+	extra := t.raw[extraOffset : extraOffset+extraLength]
+	for i := 0; i+4 <= len(extra); {
+		id := binary.LittleEndian.Uint16(extra[i:])
+		size := int(binary.LittleEndian.Uint16(extra[i+2:]))
+		if id == 0x0001 {
+			fieldOffset := i + 4
+			for _, sizeFieldOffset := range []int{24, 20} {
+				if binary.LittleEndian.Uint32(t.raw[sizeFieldOffset:]) == 0xffffffff {
+					fieldOffset += 8
+				}
+			}
+			if fieldOffset+8 > i+4+size {
+				break
+			}
+			t.localOffset = binary.LittleEndian.Uint64(extra[fieldOffset:])
+			t.localOffsetField = extraOffset + fieldOffset
+			t.isZip64Offset = true
+			return nil
+		}
+		i += 4 + size
+	}
+	return errors.New("invalid zip64 extra field of " + t.name)
+}
+
+func (t *zipCentralEntry) withLocalOffset(offset uint64) []byte {
+	result := append([]byte(nil), t.raw...)
+	if t.isZip64Offset {
+		binary.LittleEndian.PutUint64(result[t.localOffsetField:], offset)
+	} else {
+		// package is not expected to grow beyond 4 GB because of the signature
+		binary.LittleEndian.PutUint32(result[t.localOffsetField:], uint32(offset))
+	}
+	return result
+}
+
+func createStoredZipHeaders(name string, data []byte, localOffset uint64) ([]byte, []byte) {
+	checksum := crc32.ChecksumIEEE(data)
+
+	local := make([]byte, 30, 30+len(name))
+	binary.LittleEndian.PutUint32(local, zipLocalHeaderSignature)
+	binary.LittleEndian.PutUint16(local[4:], 20)
+	// 1980-01-01, the same as the package writer uses
+	binary.LittleEndian.PutUint16(local[12:], 1<<5|1)
+	binary.LittleEndian.PutUint32(local[14:], checksum)
+	binary.LittleEndian.PutUint32(local[18:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(local[22:], uint32(len(data)))
+	binary.LittleEndian.PutUint16(local[26:], uint16(len(name)))
+	local = append(local, name...)
+
+	central := make([]byte, 46, 46+len(name))
+	binary.LittleEndian.PutUint32(central, zipCentralHeaderSignature)
+	binary.LittleEndian.PutUint16(central[4:], 20)
+	binary.LittleEndian.PutUint16(central[6:], 20)
+	binary.LittleEndian.PutUint16(central[14:], 1<<5|1)
+	binary.LittleEndian.PutUint32(central[16:], checksum)
+	binary.LittleEndian.PutUint32(central[20:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(central[24:], uint32(len(data)))
+	binary.LittleEndian.PutUint16(central[28:], uint16(len(name)))
+	binary.LittleEndian.PutUint32(central[42:], uint32(localOffset))
+	central = append(central, name...)
+	return local, central
+}
+
+// createZipEnd returns zip64 end of central directory record, zip64 locator and end of central directory record (MakeAppx always writes zip64 records)
+func createZipEnd(entryCount int, directorySize uint64, directoryOffset uint64) []byte {
+	result := make([]byte, 56+20+22)
+	zip64End := result
+	binary.LittleEndian.PutUint32(zip64End, zip64EndSignature)
+	binary.LittleEndian.PutUint64(zip64End[4:], 44)
+	binary.LittleEndian.PutUint16(zip64End[12:], 45)
+	binary.LittleEndian.PutUint16(zip64End[14:], 45)
+	binary.LittleEndian.PutUint64(zip64End[24:], uint64(entryCount))
+	binary.LittleEndian.PutUint64(zip64End[32:], uint64(entryCount))
+	binary.LittleEndian.PutUint64(zip64End[40:], directorySize)
+	binary.LittleEndian.PutUint64(zip64End[48:], directoryOffset)
+
+	locator := result[56:]
+	binary.LittleEndian.PutUint32(locator, zip64LocatorSignature)
+	binary.LittleEndian.PutUint64(locator[8:], directoryOffset+directorySize)
+	binary.LittleEndian.PutUint32(locator[16:], 1)
+
+	end := result[76:]
+	binary.LittleEndian.PutUint32(end, zipEndSignature)
+	binary.LittleEndian.PutUint16(end[8:], uint16(minUint64(uint64(entryCount), 0xffff)))
+	binary.LittleEndian.PutUint16(end[10:], uint16(minUint64(uint64(entryCount), 0xffff)))
+	binary.LittleEndian.PutUint32(end[12:], uint32(minUint64(directorySize, 0xffffffff)))
+	binary.LittleEndian.PutUint32(end[16:], uint32(minUint64(directoryOffset, 0xffffffff)))
+	return result
+}
+
+func minUint64(a uint64, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
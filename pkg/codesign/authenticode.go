@@ -0,0 +1,269 @@
+package codesign
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"math/big"
+	"sort"
+
+	"github.com/develar/errors"
+)
+
+var (
+	oidData                 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidContentType          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSha256               = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRsaEncryption        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidEcdsaWithSha256      = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidSpcIndirectData      = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 4}
+	oidSpcStatementType     = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 11}
+	oidSpcSpOpusInfo        = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 12}
+	oidSpcPeImageData       = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 15}
+	oidSpcIndividualSigning = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 21}
+	oidSpcSipInfo           = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 30}
+	// the same attribute as signtool /tr adds
+	oidRfc3161CounterSignature = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 3, 3, 1}
+)
+
+// SpcPeImageData with obsolete file link, exactly as signtool encodes it: flags (empty bit string), file [0] { [2] { [0] "<<<Obsolete>>>" (BMPString) } }
+var spcPeImageData = []byte{
+	0x30, 0x25, 0x03, 0x01, 0x00, 0xa0, 0x20, 0xa2, 0x1e, 0x80, 0x1c,
+	0x00, 0x3c, 0x00, 0x3c, 0x00, 0x3c, 0x00, 0x4f, 0x00, 0x62, 0x00, 0x73, 0x00, 0x6f, 0x00, 0x6c, 0x00, 0x65, 0x00, 0x74, 0x00, 0x65, 0x00, 0x3e, 0x00, 0x3e, 0x00, 0x3e,
+}
+
+// Signer signs SHA-256 digest. Private key may be not available locally (HSM, cloud KMS).
+type Signer interface {
+	// signing certificate first, then intermediate certificates to embed
+	Certificates() []*x509.Certificate
+	// Sign returns PKCS#1 v1.5 signature for RSA key or ASN.1 DER signature for EC key
+	Sign(requestContext context.Context, digest []byte) ([]byte, error)
+}
+
+type algorithmIdentifier struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+var sha256AlgorithmIdentifier = algorithmIdentifier{Algorithm: oidSha256, Parameters: asn1.NullRawValue}
+
+type digestInfo struct {
+	DigestAlgorithm algorithmIdentifier
+	Digest          []byte
+}
+
+type spcAttributeTypeAndOptionalValue struct {
+	Type  asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+type spcIndirectDataContent struct {
+	Data          spcAttributeTypeAndOptionalValue
+	MessageDigest digestInfo
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	// [0] EXPLICIT, see newExplicitContent (encoding/asn1 ignores tag of raw value)
+	Content asn1.RawValue `asn1:"optional"`
+}
+
+func newExplicitContent(data []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: data}
+}
+
+type issuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+type signerInfo struct {
+	Version                   int
+	IssuerAndSerialNumber     issuerAndSerialNumber
+	DigestAlgorithm           algorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue
+	DigestEncryptionAlgorithm algorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttributes asn1.RawValue `asn1:"optional"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []algorithmIdentifier `asn1:"set"`
+	ContentInfo      contentInfo
+	Certificates     asn1.RawValue `asn1:"optional"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+// createPeIndirectData returns SpcIndirectDataContent for Authenticode hash of PE file
+func createPeIndirectData(digest []byte) spcIndirectDataContent {
+	return spcIndirectDataContent{
+		Data:          spcAttributeTypeAndOptionalValue{Type: oidSpcPeImageData, Value: asn1.RawValue{FullBytes: spcPeImageData}},
+		MessageDigest: digestInfo{DigestAlgorithm: sha256AlgorithmIdentifier, Digest: digest},
+	}
+}
+
+// createAuthenticodeSignature returns DER PKCS#7 SignedData with the indirect data content signed by signer.
+// Signature is not timestamped - timestamp is added as unauthenticated attribute after signing (see addTimestamp).
+func createAuthenticodeSignature(requestContext context.Context, indirectData spcIndirectDataContent, signer Signer) (*signedData, error) {
+	content, err := asn1.Marshal(indirectData)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// Authenticode quirk: message digest is computed over the content octets of SpcIndirectDataContent, tag and length are excluded
+	var contentValue asn1.RawValue
+	_, err = asn1.Unmarshal(content, &contentValue)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	contentDigest := sha256.Sum256(contentValue.Bytes)
+
+	attributes, err := encodeAttributes([]attributeValue{
+		{oidContentType, oidSpcIndirectData},
+		{oidSpcSpOpusInfo, asn1.RawValue{FullBytes: []byte{0x30, 0x00}}},
+		{oidSpcStatementType, []asn1.ObjectIdentifier{oidSpcIndividualSigning}},
+		{oidMessageDigest, contentDigest[:]},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// signature is computed over attributes encoded as SET OF, but stored as [0] IMPLICIT
+	attributesDigest := sha256.Sum256(attributes)
+	signature, err := signer.Sign(requestContext, attributesDigest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	certificates := signer.Certificates()
+	if len(certificates) == 0 {
+		return nil, errors.New("signer has no certificate")
+	}
+	signingCertificate := certificates[0]
+
+	signatureAlgorithm, err := getSignatureAlgorithm(signingCertificate)
+	if err != nil {
+		return nil, err
+	}
+
+	var certificateData []byte
+	for _, certificate := range certificates {
+		certificateData = append(certificateData, certificate.Raw...)
+	}
+
+	authenticatedAttributes := attributes
+	authenticatedAttributes[0] = 0xa0
+	return &signedData{
+		Version:          1,
+		DigestAlgorithms: []algorithmIdentifier{sha256AlgorithmIdentifier},
+		ContentInfo: contentInfo{
+			ContentType: oidSpcIndirectData,
+			Content:     newExplicitContent(content),
+		},
+		Certificates: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certificateData},
+		SignerInfos: []signerInfo{{
+			Version: 1,
+			IssuerAndSerialNumber: issuerAndSerialNumber{
+				Issuer:       asn1.RawValue{FullBytes: signingCertificate.RawIssuer},
+				SerialNumber: signingCertificate.SerialNumber,
+			},
+			DigestAlgorithm:           sha256AlgorithmIdentifier,
+			AuthenticatedAttributes:   asn1.RawValue{FullBytes: authenticatedAttributes},
+			DigestEncryptionAlgorithm: signatureAlgorithm,
+			EncryptedDigest:           signature,
+		}},
+	}, nil
+}
+
+func getSignatureAlgorithm(certificate *x509.Certificate) (algorithmIdentifier, error) {
+	switch certificate.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return algorithmIdentifier{Algorithm: oidRsaEncryption, Parameters: asn1.NullRawValue}, nil
+	case *ecdsa.PublicKey:
+		return algorithmIdentifier{Algorithm: oidEcdsaWithSha256}, nil
+	default:
+		return algorithmIdentifier{}, errors.Errorf("unsupported key type of certificate %s", certificate.Subject.CommonName)
+	}
+}
+
+// setUnauthenticatedAttribute sets the only unauthenticated attribute (timestamp)
+func (t *signedData) setUnauthenticatedAttribute(attributeType asn1.ObjectIdentifier, value interface{}) error {
+	attributes, err := encodeAttributes([]attributeValue{{attributeType, value}})
+	if err != nil {
+		return err
+	}
+	attributes[0] = 0xa1
+	t.SignerInfos[0].UnauthenticatedAttributes = asn1.RawValue{FullBytes: attributes}
+	return nil
+}
+
+func (t *signedData) encode() ([]byte, error) {
+	data, err := asn1.Marshal(*t)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	result, err := asn1.Marshal(contentInfo{ContentType: oidSignedData, Content: newExplicitContent(data)})
+	return result, errors.WithStack(err)
+}
+
+type attributeValue struct {
+	attributeType asn1.ObjectIdentifier
+	value         interface{}
+}
+
+// encodeAttributes returns DER SET OF attributes (sorted as DER requires)
+func encodeAttributes(values []attributeValue) ([]byte, error) {
+	encoded := make([][]byte, 0, len(values))
+	for _, item := range values {
+		value, err := asn1.Marshal(item.value)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		data, err := asn1.Marshal(attribute{
+			Type:   item.attributeType,
+			Values: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: value},
+		})
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		encoded = append(encoded, data)
+	}
+
+	sort.Slice(encoded, func(i, j int) bool {
+		return bytes.Compare(encoded[i], encoded[j]) < 0
+	})
+
+	result, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: bytes.Join(encoded, nil)})
+	return result, errors.WithStack(err)
+}
+
+// localSigner signs using private key in memory (PKCS#12 file)
+type localSigner struct {
+	key          crypto.Signer
+	certificates []*x509.Certificate
+}
+
+func (t *localSigner) Certificates() []*x509.Certificate {
+	return t.certificates
+}
+
+func (t *localSigner) Sign(requestContext context.Context, digest []byte) ([]byte, error) {
+	signature, err := t.key.Sign(rand.Reader, digest, crypto.SHA256)
+	return signature, errors.WithStack(err)
+}
@@ -0,0 +1,523 @@
+package codesign
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"debug/pe"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+)
+
+func createTestSigner(g *GomegaWithT, key crypto.Signer) *localSigner {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "Test", Organization: []string{"Test Org"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	g.Expect(err).NotTo(HaveOccurred())
+	certificate, err := x509.ParseCertificate(der)
+	g.Expect(err).NotTo(HaveOccurred())
+	return &localSigner{key: key, certificates: []*x509.Certificate{certificate}}
+}
+
+// PE32+ with one section and 3 bytes of overlay (not aligned to 8 bytes)
+func writeTestPe(g *GomegaWithT, file string) {
+	data := make([]byte, 512+512+3)
+	copy(data, "MZ")
+	binary.LittleEndian.PutUint32(data[0x3c:], 64)
+	copy(data[64:], "PE\x00\x00")
+	coff := data[68:]
+	binary.LittleEndian.PutUint16(coff, 0x8664)
+	binary.LittleEndian.PutUint16(coff[2:], 1)
+	binary.LittleEndian.PutUint16(coff[16:], 240)
+	optional := data[88:]
+	binary.LittleEndian.PutUint16(optional, 0x20b)
+	binary.LittleEndian.PutUint32(optional[32:], 0x1000)
+	binary.LittleEndian.PutUint32(optional[36:], 0x200)
+	binary.LittleEndian.PutUint32(optional[56:], 0x2000)
+	binary.LittleEndian.PutUint32(optional[60:], 0x200)
+	binary.LittleEndian.PutUint32(optional[108:], 16)
+	section := data[88+240:]
+	copy(section, ".text")
+	binary.LittleEndian.PutUint32(section[8:], 0x200)
+	binary.LittleEndian.PutUint32(section[12:], 0x1000)
+	binary.LittleEndian.PutUint32(section[16:], 0x200)
+	binary.LittleEndian.PutUint32(section[20:], 0x200)
+	for i := 512; i < len(data); i++ {
+		data[i] = byte(i)
+	}
+	g.Expect(ioutil.WriteFile(file, data, 0644)).To(Succeed())
+}
+
+type testSignature struct {
+	indirectData spcIndirectDataContent
+	signedData   signedData
+}
+
+// verifyTestSignature checks signature of authenticated attributes and message digest of the indirect data content
+func verifyTestSignature(g *GomegaWithT, data []byte, publicKey *rsa.PublicKey) *testSignature {
+	var info contentInfo
+	_, err := asn1.Unmarshal(data, &info)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(info.ContentType).To(Equal(oidSignedData))
+
+	result := &testSignature{}
+	_, err = asn1.Unmarshal(info.Content.Bytes, &result.signedData)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.signedData.ContentInfo.ContentType).To(Equal(oidSpcIndirectData))
+
+	content := result.signedData.ContentInfo.Content.Bytes
+	_, err = asn1.Unmarshal(content, &result.indirectData)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	signerInfo := result.signedData.SignerInfos[0]
+	attributes := append([]byte(nil), signerInfo.AuthenticatedAttributes.FullBytes...)
+	attributes[0] = 0x31
+	digest := sha256.Sum256(attributes)
+	g.Expect(rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signerInfo.EncryptedDigest)).To(Succeed())
+
+	var contentValue asn1.RawValue
+	_, err = asn1.Unmarshal(content, &contentValue)
+	g.Expect(err).NotTo(HaveOccurred())
+	contentDigest := sha256.Sum256(contentValue.Bytes)
+	g.Expect(bytes.Contains(attributes, contentDigest[:])).To(BeTrue())
+	return result
+}
+
+func TestSignPe(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "sign-pe")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	g.Expect(err).NotTo(HaveOccurred())
+	signer := createTestSigner(g, key)
+
+	file := filepath.Join(dir, "test.exe")
+	writeTestPe(g, file)
+	g.Expect(signPe(context.Background(), file, signer, nil)).To(Succeed())
+	firstSigned, err := ioutil.ReadFile(file)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// re-signing replaces the signature
+	g.Expect(signPe(context.Background(), file, signer, nil)).To(Succeed())
+	data, err := ioutil.ReadFile(file)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(data).To(Equal(firstSigned))
+
+	peFile, err := pe.Open(file)
+	g.Expect(err).NotTo(HaveOccurred())
+	directory := peFile.OptionalHeader.(*pe.OptionalHeader64).DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_SECURITY]
+	g.Expect(peFile.OptionalHeader.(*pe.OptionalHeader64).CheckSum).NotTo(BeZero())
+	g.Expect(peFile.Close()).To(Succeed())
+
+	// padded to 8 bytes
+	g.Expect(directory.VirtualAddress).To(BeNumerically("==", 1032))
+	g.Expect(int(directory.VirtualAddress + directory.Size)).To(Equal(len(data)))
+	certificate := data[directory.VirtualAddress:]
+	g.Expect(binary.LittleEndian.Uint32(certificate)).To(Equal(directory.Size))
+	g.Expect(binary.LittleEndian.Uint16(certificate[6:])).To(BeNumerically("==", winCertTypePkcsSignedData))
+
+	signature := verifyTestSignature(g, certificate[8:], &key.PublicKey)
+	g.Expect(signature.indirectData.Data.Type).To(Equal(oidSpcPeImageData))
+	layout, err := readPeLayout(bytes.NewReader(data), int64(len(data)))
+	g.Expect(err).NotTo(HaveOccurred())
+	digest, err := computePeDigest(bytes.NewReader(data), layout, int64(directory.VirtualAddress))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(signature.indirectData.MessageDigest.Digest).To(Equal(digest))
+	g.Expect(signature.signedData.SignerInfos[0].UnauthenticatedAttributes.FullBytes).To(BeEmpty())
+}
+
+// checksum field is ignored, odd trailing byte is padded with zero
+func TestComputePeChecksum(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	checksum, err := ComputePeChecksum(bytes.NewReader([]byte{1, 0, 2, 0, 0xff, 0xff, 0xff, 0xff, 3}), 4)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(checksum).To(Equal(uint32(1 + 2 + 3 + 9)))
+
+	checksum, err = ComputePeChecksum(bytes.NewReader([]byte{1, 0, 2, 0, 0, 0, 0, 0, 3}), 4)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(checksum).To(Equal(uint32(1 + 2 + 3 + 9)))
+}
+
+func TestTimestampRotation(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	timestampRetryDelay = time.Millisecond
+	timestampServerCooldown = time.Minute
+	defer func() {
+		timestampRetryDelay = time.Second
+		timestampServerCooldown = 10 * time.Second
+	}()
+
+	failedRequestCount := 0
+	failedServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		failedRequestCount++
+		writer.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer failedServer.Close()
+
+	token, err := asn1.Marshal(contentInfo{ContentType: oidSignedData, Content: newExplicitContent([]byte{0x30, 0x00})})
+	g.Expect(err).NotTo(HaveOccurred())
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		g.Expect(request.Header.Get("Content-Type")).To(Equal("application/timestamp-query"))
+		body, _ := ioutil.ReadAll(request.Body)
+		var timestampRequest timeStampReq
+		_, err := asn1.Unmarshal(body, &timestampRequest)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(timestampRequest.CertReq).To(BeTrue())
+
+		response, err := asn1.Marshal(timeStampResp{Status: pkiStatusInfo{Status: 0}, TimeStampToken: asn1.RawValue{FullBytes: token}})
+		g.Expect(err).NotTo(HaveOccurred())
+		_, _ = writer.Write(response)
+	}))
+	defer server.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	g.Expect(err).NotTo(HaveOccurred())
+	signer := createTestSigner(g, key)
+
+	pool := newTimestampPool([]string{failedServer.URL, server.URL}, nil, 0)
+	for i := 0; i < 3; i++ {
+		signature, err := createAuthenticodeSignature(context.Background(), createPeIndirectData(make([]byte, 32)), signer)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(pool.addTimestamp(context.Background(), signature)).To(Succeed())
+		g.Expect(bytes.Contains(signature.SignerInfos[0].UnauthenticatedAttributes.FullBytes, token)).To(BeTrue())
+	}
+	// throttled server is not used until cooldown is over
+	g.Expect(failedRequestCount).To(Equal(1))
+	g.Expect(pool.Stats()).To(Equal([]TimestampServerStats{
+		{Url: failedServer.URL, Protocol: TimestampRfc3161, Requests: 1, Failures: 1},
+		{Url: server.URL, Protocol: TimestampRfc3161, Requests: 3},
+	}))
+
+	timestampServerCooldown = time.Millisecond
+	signature, err := createAuthenticodeSignature(context.Background(), createPeIndirectData(make([]byte, 32)), signer)
+	g.Expect(err).NotTo(HaveOccurred())
+	err = newTimestampPool([]string{failedServer.URL}, nil, 0).addTimestamp(context.Background(), signature)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.(interface{ ErrorCode() string }).ErrorCode()).To(Equal("ERR_SIGN_TIMESTAMP_FAILED"))
+}
+
+func TestTimestampRateLimit(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	pool := newTimestampPool([]string{"http://a", "http://b"}, nil, 100)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		server, err := pool.acquire(context.Background())
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(server.Url).To(Equal([]string{"http://a", "http://b"}[i%2]))
+	}
+	g.Expect(time.Since(start)).To(BeNumerically(">=", 40*time.Millisecond))
+}
+
+func TestAuthenticodeTimestamp(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	g.Expect(err).NotTo(HaveOccurred())
+	timestampSigner := createTestSigner(g, key)
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := ioutil.ReadAll(request.Body)
+		data, err := base64.StdEncoding.DecodeString(string(body))
+		g.Expect(err).NotTo(HaveOccurred())
+		var timestampRequest authenticodeTimestampRequest
+		_, err = asn1.Unmarshal(data, &timestampRequest)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(timestampRequest.CountersignatureType).To(Equal(oidAuthenticodeTimestampRequest))
+
+		response, err := createAuthenticodeSignature(context.Background(), createPeIndirectData(make([]byte, 32)), timestampSigner)
+		g.Expect(err).NotTo(HaveOccurred())
+		responseData, err := response.encode()
+		g.Expect(err).NotTo(HaveOccurred())
+		_, _ = writer.Write([]byte(base64.StdEncoding.EncodeToString(responseData) + "\r\n"))
+	}))
+	defer server.Close()
+
+	signature, err := createAuthenticodeSignature(context.Background(), createPeIndirectData(make([]byte, 32)), createTestSigner(g, key))
+	g.Expect(err).NotTo(HaveOccurred())
+	certificateCount := len(signature.Certificates.Bytes)
+	g.Expect(newTimestampPool(nil, []string{server.URL}, 0).addTimestamp(context.Background(), signature)).To(Succeed())
+	g.Expect(len(signature.Certificates.Bytes)).To(Equal(certificateCount + len(timestampSigner.Certificates()[0].Raw)))
+
+	encoded, err := signature.encode()
+	g.Expect(err).NotTo(HaveOccurred())
+	var parsed contentInfo
+	_, err = asn1.Unmarshal(encoded, &parsed)
+	g.Expect(err).NotTo(HaveOccurred())
+	var parsedSignature signedData
+	_, err = asn1.Unmarshal(parsed.Content.Bytes, &parsedSignature)
+	g.Expect(err).NotTo(HaveOccurred())
+	var attributes []attribute
+	_, err = asn1.UnmarshalWithParams(parsedSignature.SignerInfos[0].UnauthenticatedAttributes.FullBytes, &attributes, "tag:1,set")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(attributes[0].Type).To(Equal(oidCounterSignature))
+}
+
+func writeTestAppx(g *GomegaWithT, file string, publisher string) {
+	var buffer bytes.Buffer
+	writer := zip.NewWriter(&buffer)
+	for _, part := range []struct{ name, data string }{
+		{"app.exe", "MZ binary"},
+		{appxManifestPartName, `<?xml version="1.0" encoding="utf-8"?><Package xmlns="http://schemas.microsoft.com/appx/manifest/foundation/windows10"><Identity Name="Test" Publisher="` + publisher + `" Version="1.0.0.0"/></Package>`},
+		{appxBlockMapPartName, `<?xml version="1.0" encoding="UTF-8"?><BlockMap HashMethod="http://www.w3.org/2001/04/xmlenc#sha256"></BlockMap>`},
+		{appxContentTypesPartName, `<?xml version="1.0" encoding="UTF-8"?><Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="exe" ContentType="application/x-msdownload"/></Types>`},
+	} {
+		entryWriter, err := writer.Create(part.name)
+		g.Expect(err).NotTo(HaveOccurred())
+		_, err = entryWriter.Write([]byte(part.data))
+		g.Expect(err).NotTo(HaveOccurred())
+	}
+	g.Expect(writer.Close()).To(Succeed())
+	g.Expect(ioutil.WriteFile(file, buffer.Bytes(), 0644)).To(Succeed())
+}
+
+func TestSignAppx(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "sign-appx")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	g.Expect(err).NotTo(HaveOccurred())
+	signer := createTestSigner(g, key)
+
+	file := filepath.Join(dir, "test.msix")
+	writeTestAppx(g, file, "CN=Test,O=Test Org")
+	// second signing replaces the signature
+	for i := 0; i < 2; i++ {
+		g.Expect(signAppx(context.Background(), file, signer, nil)).To(Succeed())
+	}
+
+	data, err := ioutil.ReadFile(file)
+	g.Expect(err).NotTo(HaveOccurred())
+	zipReader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(zipReader.File).To(HaveLen(5))
+	signaturePart := zipReader.File[4]
+	g.Expect(signaturePart.Name).To(Equal(appxSignaturePartName))
+
+	contentTypes, err := readZipPart(zipReader.File[3])
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(contentTypes).To(ContainSubstring(`<Override PartName="/AppxSignature.p7x" ContentType="application/vnd.ms-appx.signature"/></Types>`))
+	// other parts are not changed
+	executable, err := readZipPart(zipReader.File[0])
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(executable).To(Equal("MZ binary"))
+
+	p7x, err := readZipPart(signaturePart)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(p7x[:4]).To(Equal("PKCX"))
+	signature := verifyTestSignature(g, []byte(p7x[4:]), &key.PublicKey)
+	g.Expect(signature.indirectData.Data.Type).To(Equal(oidSpcSipInfo))
+
+	digest := signature.indirectData.MessageDigest.Digest
+	g.Expect(string(digest[:8])).To(Equal("APPXAXPC"))
+	signatureOffset, err := signaturePart.DataOffset()
+	g.Expect(err).NotTo(HaveOccurred())
+	signatureOffset -= int64(30 + len(appxSignaturePartName))
+	localHash := sha256.Sum256(data[:signatureOffset])
+	g.Expect(digest[8:40]).To(Equal(localHash[:]))
+
+	centralEntries, centralDirectoryOffset, err := readZipCentralDirectory(bytes.NewReader(data), int64(len(data)))
+	g.Expect(err).NotTo(HaveOccurred())
+	var centralDirectory []byte
+	for _, entry := range centralEntries[:4] {
+		centralDirectory = append(centralDirectory, entry.raw...)
+	}
+	g.Expect(centralEntries[4].localOffset).To(BeNumerically("==", signatureOffset))
+	g.Expect(centralDirectoryOffset).To(BeNumerically(">", signatureOffset))
+	centralDirectoryHash := sha256.Sum256(append(centralDirectory, createZipEnd(4, uint64(len(centralDirectory)), uint64(signatureOffset))...))
+	g.Expect(string(digest[40:44])).To(Equal("AXCD"))
+	g.Expect(digest[44:76]).To(Equal(centralDirectoryHash[:]))
+	contentTypesHash := sha256.Sum256([]byte(contentTypes))
+	g.Expect(digest[76:112]).To(Equal(append([]byte("AXCT"), contentTypesHash[:]...)))
+	g.Expect(string(digest[112:116])).To(Equal("AXBM"))
+	g.Expect(digest).To(HaveLen(148))
+
+	otherFile := filepath.Join(dir, "other.msix")
+	writeTestAppx(g, otherFile, "CN=Other")
+	err = signAppx(context.Background(), otherFile, signer, nil)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.(interface{ ErrorCode() string }).ErrorCode()).To(Equal("ERR_SIGN_PUBLISHER_MISMATCH"))
+}
+
+func createTestCfbStream(name string, data []byte) *cfbEntry {
+	return &cfbEntry{name: utf16.Encode([]rune(name)), size: int64(len(data)), data: data}
+}
+
+// root with mini and regular streams, storage with CLSID, stale signature and enough sectors to use DIFAT
+func writeTestMsi(g *GomegaWithT, file string, majorVersion uint16) {
+	largeStream := make([]byte, 8*1024*1024+3)
+	for i := range largeStream {
+		largeStream[i] = byte(i % 251)
+	}
+	storageEntry := make([]byte, cfbDirectoryEntrySize)
+	copy(storageEntry[80:], "storage clsid 16")
+	root := &cfbEntry{name: utf16.Encode([]rune("Root Entry")), isStorage: true, children: []*cfbEntry{
+		createTestCfbStream("\x05SummaryInformation", []byte("summary")),
+		createTestCfbStream("䡀㼿䕷", largeStream),
+		createTestCfbStream("\x05DigitalSignature", []byte("stale")),
+		createTestCfbStream("empty", nil),
+		{name: utf16.Encode([]rune("Binary")), raw: storageEntry, isStorage: true, children: []*cfbEntry{createTestCfbStream("icon", bytes.Repeat([]byte("i"), 5000))}},
+	}}
+	for i := 0; i < 20; i++ {
+		root.children = append(root.children, createTestCfbStream("table"+string(rune('a'+i)), []byte{byte(i)}))
+	}
+
+	sectorSize := int64(512)
+	if majorVersion == 4 {
+		sectorSize = 4096
+	}
+	var buffer bytes.Buffer
+	g.Expect((&compoundFile{majorVersion: majorVersion, sectorSize: sectorSize, root: root}).write(&buffer)).To(Succeed())
+	g.Expect(ioutil.WriteFile(file, buffer.Bytes(), 0644)).To(Succeed())
+}
+
+func readTestCfbStream(g *GomegaWithT, compound *compoundFile, entry *cfbEntry) []byte {
+	data, err := ioutil.ReadAll(compound.openStream(entry))
+	g.Expect(err).NotTo(HaveOccurred())
+	return data
+}
+
+func TestSignMsi(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "sign-msi")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	g.Expect(err).NotTo(HaveOccurred())
+	signer := createTestSigner(g, key)
+
+	for _, majorVersion := range []uint16{3, 4} {
+		file := filepath.Join(dir, "test"+strconv.Itoa(int(majorVersion))+".msi")
+		writeTestMsi(g, file, majorVersion)
+		g.Expect(signMsi(context.Background(), file, signer, nil)).To(Succeed())
+		firstSigned, err := ioutil.ReadFile(file)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		// re-signing replaces the signature
+		g.Expect(signMsi(context.Background(), file, signer, nil)).To(Succeed())
+		data, err := ioutil.ReadFile(file)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(data).To(Equal(firstSigned))
+
+		compound, err := readCompoundFile(bytes.NewReader(data), int64(len(data)))
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(compound.majorVersion).To(Equal(majorVersion))
+		entries := make(map[string]*cfbEntry)
+		for _, entry := range compound.root.children {
+			entries[string(utf16.Decode(entry.name))] = entry
+		}
+		g.Expect(entries).To(HaveLen(25))
+
+		// streams are not changed
+		g.Expect(readTestCfbStream(g, compound, entries["\x05SummaryInformation"])).To(Equal([]byte("summary")))
+		g.Expect(readTestCfbStream(g, compound, entries["empty"])).To(BeEmpty())
+		largeStream := readTestCfbStream(g, compound, entries["䡀㼿䕷"])
+		g.Expect(largeStream).To(HaveLen(8*1024*1024 + 3))
+		g.Expect(largeStream[1000]).To(Equal(byte(1000 % 251)))
+		storage := entries["Binary"]
+		g.Expect(storage.isStorage).To(BeTrue())
+		g.Expect(string(storage.clsid())).To(Equal("storage clsid 16"))
+		g.Expect(storage.children).To(HaveLen(1))
+		g.Expect(readTestCfbStream(g, compound, storage.children[0])).To(Equal(bytes.Repeat([]byte("i"), 5000)))
+
+		signatureEntry := entries["\x05DigitalSignature"]
+		signature := verifyTestSignature(g, readTestCfbStream(g, compound, signatureEntry), &key.PublicKey)
+		g.Expect(signature.indirectData.Data.Type).To(Equal(oidSpcSipInfo))
+		var sipInfo spcSipInfo
+		_, err = asn1.Unmarshal(signature.indirectData.Data.Value.FullBytes, &sipInfo)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(sipInfo.Guid).To(Equal(msiSipGuid))
+
+		// digest doesn't include the signature
+		var children []*cfbEntry
+		for _, entry := range compound.root.children {
+			if entry != signatureEntry {
+				children = append(children, entry)
+			}
+		}
+		compound.root.children = children
+		digest := sha256.New()
+		g.Expect(compound.hashStorage(compound.root, digest)).To(Succeed())
+		g.Expect(signature.indirectData.MessageDigest.Digest).To(Equal(digest.Sum(nil)))
+	}
+}
+
+func TestCfbTree(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	g.Expect(compareCfbNames(utf16.Encode([]rune("b")), utf16.Encode([]rune("AA")))).To(BeNumerically("<", 0))
+	g.Expect(compareCfbNames(utf16.Encode([]rune("ab")), utf16.Encode([]rune("AB")))).To(BeZero())
+
+	// siblings form red-black tree: black root, no red node with red child, the same number of black nodes on every path
+	for count := 1; count < 40; count++ {
+		var siblings []*cfbEntry
+		ids := make(map[*cfbEntry]uint32)
+		for i := 0; i < count; i++ {
+			entry := &cfbEntry{}
+			siblings = append(siblings, entry)
+			ids[entry] = uint32(i)
+		}
+		directory := make([]byte, count*cfbDirectoryEntrySize)
+		for i := 0; i < count; i++ {
+			directory[i*cfbDirectoryEntrySize+67] = 1
+		}
+		rootId := buildCfbTree(directory, ids, siblings, 0, maxCfbTreeDepth(count))
+		g.Expect(directory[int(rootId)*cfbDirectoryEntrySize+67]).To(Equal(byte(1)))
+
+		var visit func(id uint32, isParentRed bool) int
+		visit = func(id uint32, isParentRed bool) int {
+			if id == cfbNoStream {
+				return 0
+			}
+			raw := directory[int(id)*cfbDirectoryEntrySize:]
+			isRed := raw[67] == 0
+			g.Expect(isRed && isParentRed).To(BeFalse())
+			left := visit(binary.LittleEndian.Uint32(raw[68:]), isRed)
+			g.Expect(visit(binary.LittleEndian.Uint32(raw[72:]), isRed)).To(Equal(left))
+			if isRed {
+				return left
+			}
+			return left + 1
+		}
+		visit(rootId, false)
+	}
+}
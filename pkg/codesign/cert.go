@@ -0,0 +1,411 @@
+package codesign
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/credentials"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/develar/go-pkcs12"
+)
+
+const (
+	CertificateSourceFile         = "file"
+	CertificateSourceKeychain     = "keychain"
+	CertificateSourceWindowsStore = "windows-store"
+)
+
+// the same stores as searched by signtool /a
+var windowsStoreScript = `foreach ($store in @("Cert:\CurrentUser\My", "Cert:\LocalMachine\My")) { Get-ChildItem $store -CodeSigningCert | ForEach-Object { [Convert]::ToBase64String($_.RawData) } }`
+
+type CertificateSearchOptions struct {
+	Source string
+	// PKCS#12 file for file source
+	File string
+	// keychain to search in, search list of the user by default
+	Keychain string
+	// additional trusted roots (PEM), e.g. Apple Root CA on Linux
+	Roots string
+	// warning is reported if certificate expires earlier
+	ExpiryWarning time.Duration
+}
+
+type CertificateInfo struct {
+	// SHA-1 of the certificate (identity hash used by codesign and signtool /sha1)
+	Hash       string `json:"hash"`
+	CommonName string `json:"commonName"`
+	// subject DN in the format expected by AppX/MSIX publisher
+	Subject string `json:"subject"`
+	Issuer  string `json:"issuer"`
+	// Apple team ID (subject OU)
+	TeamId    string    `json:"teamId,omitempty"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+
+	IsValid  bool     `json:"valid"`
+	Problems []string `json:"problems,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+type certificateSet struct {
+	leafs         []*x509.Certificate
+	intermediates *x509.CertPool
+}
+
+// ConfigureCertCommand registers cert command - invalid or not matching certificate is reported before a long build, not at signing
+func ConfigureCertCommand(app *kingpin.Application) {
+	command := app.Command("cert", "Find and validate code signing certificates (macOS keychain, Windows certificate store or PKCS#12 file).")
+	configureCertListCommand(command)
+	configureCertValidateCommand(command)
+}
+
+func configureCertSearchFlags(command *kingpin.CmdClause, options *CertificateSearchOptions) {
+	command.Flag("source", "Where to find certificates: file, keychain or windows-store (default: file if --file is specified, otherwise store of the current OS).").
+		EnumVar(&options.Source, CertificateSourceFile, CertificateSourceKeychain, CertificateSourceWindowsStore)
+	command.Flag("file", "The PKCS#12 file (password: "+credentials.ToEnvName(CertificatePasswordCredentialName)+").").ExistingFileVar(&options.File)
+	command.Flag("keychain", "The keychain to search in (default: search list).").StringVar(&options.Keychain)
+	command.Flag("roots", "The additional trusted root certificates (PEM).").ExistingFileVar(&options.Roots)
+	command.Flag("expiry-warning", "Warn if certificate expires earlier.").Default("720h").DurationVar(&options.ExpiryWarning)
+}
+
+func configureCertListCommand(certCommand *kingpin.CmdClause) {
+	command := certCommand.Command("list", "List code signing certificates with validation problems as JSON.")
+	options := &CertificateSearchOptions{}
+	configureCertSearchFlags(command, options)
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		result, err := ListCertificates(options)
+		if err != nil {
+			return err
+		}
+		return util.WriteJsonToStdOut(result)
+	})
+}
+
+func configureCertValidateCommand(certCommand *kingpin.CmdClause) {
+	command := certCommand.Command("validate", "Check that valid certificate matching the identity or publisher exists. The found certificate is written to stdout as JSON.")
+	options := &CertificateSearchOptions{}
+	configureCertSearchFlags(command, options)
+	identity := command.Flag("identity", "The identity: SHA-1 hash or (part of) common name, e.g. \"Developer ID Application: Foo\".").String()
+	publisher := command.Flag("publisher-name", "The publisher: common name or subject DN (Windows).").String()
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		result, err := ValidateCertificate(options, *identity, *publisher)
+		if result != nil {
+			writeError := util.WriteJsonToStdOut(result)
+			if err == nil {
+				err = writeError
+			}
+		}
+		return err
+	})
+}
+
+func ListCertificates(options *CertificateSearchOptions) ([]*CertificateInfo, error) {
+	set, err := findCertificates(options)
+	if err != nil {
+		return nil, err
+	}
+
+	roots, err := getRoots(options.Roots)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*CertificateInfo, 0, len(set.leafs))
+	for _, certificate := range set.leafs {
+		result = append(result, checkCertificate(certificate, set.intermediates, roots, time.Now(), options.ExpiryWarning))
+	}
+	return result, nil
+}
+
+// ValidateCertificate returns the first valid certificate that matches identity and publisher, or, if no valid, the first matching to report problems
+func ValidateCertificate(options *CertificateSearchOptions, identity string, publisher string) (*CertificateInfo, error) {
+	all, err := ListCertificates(options)
+	if err != nil {
+		return nil, err
+	}
+
+	var matched *CertificateInfo
+	for _, item := range all {
+		if !isCertificateMatched(item, identity, publisher) {
+			continue
+		}
+		if item.IsValid {
+			return item, nil
+		}
+		if matched == nil {
+			matched = item
+		}
+	}
+
+	if matched == nil {
+		description := "code signing certificate"
+		if len(identity) != 0 {
+			description += " for identity \"" + identity + "\""
+		}
+		if len(publisher) != 0 {
+			description += " for publisher \"" + publisher + "\""
+		}
+		return nil, util.NewMessageError(description+" not found (certificates found: "+strconv.Itoa(len(all))+")", "ERR_SIGN_IDENTITY_NOT_FOUND")
+	}
+	return matched, util.NewMessageError("certificate "+matched.CommonName+" is not valid: "+strings.Join(matched.Problems, "; "), "ERR_SIGN_INVALID_CERTIFICATE")
+}
+
+func isCertificateMatched(item *CertificateInfo, identity string, publisher string) bool {
+	if len(identity) != 0 && !strings.EqualFold(item.Hash, identity) && !strings.Contains(item.CommonName, identity) {
+		return false
+	}
+	if len(publisher) != 0 && item.CommonName != publisher && item.Subject != publisher {
+		return false
+	}
+	return true
+}
+
+// checkCertificate checks validity period, extended key usage and chain to a trusted root
+func checkCertificate(certificate *x509.Certificate, intermediates *x509.CertPool, roots *x509.CertPool, now time.Time, expiryWarning time.Duration) *CertificateInfo {
+	hash := sha1.Sum(certificate.Raw)
+	result := &CertificateInfo{
+		Hash:       strings.ToUpper(hex.EncodeToString(hash[:])),
+		CommonName: certificate.Subject.CommonName,
+		Subject:    BloodyMsString(certificate.Subject.ToRDNSequence()),
+		Issuer:     certificate.Issuer.CommonName,
+		NotBefore:  certificate.NotBefore,
+		NotAfter:   certificate.NotAfter,
+	}
+	if len(certificate.Subject.OrganizationalUnit) != 0 {
+		result.TeamId = certificate.Subject.OrganizationalUnit[0]
+	}
+
+	switch {
+	case now.After(certificate.NotAfter):
+		result.Problems = append(result.Problems, "expired on "+certificate.NotAfter.Format("2006-01-02"))
+	case now.Before(certificate.NotBefore):
+		result.Problems = append(result.Problems, "not valid before "+certificate.NotBefore.Format("2006-01-02"))
+	case now.Add(expiryWarning).After(certificate.NotAfter):
+		result.Warnings = append(result.Warnings, "expires on "+certificate.NotAfter.Format("2006-01-02"))
+	}
+
+	if !isCodeSigningCertificate(certificate) {
+		result.Problems = append(result.Problems, "extended key usage doesn't allow code signing")
+	}
+
+	// validity period is reported above, so, chain of not valid now certificate is checked at the time when it is valid
+	verifyTime := now
+	if now.After(certificate.NotAfter) || now.Before(certificate.NotBefore) {
+		verifyTime = certificate.NotAfter.Add(-time.Second)
+	}
+	_, err := certificate.Verify(x509.VerifyOptions{
+		Intermediates: intermediates,
+		Roots:         roots,
+		CurrentTime:   verifyTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+	if err != nil {
+		result.Problems = append(result.Problems, "chain to a trusted root is not valid: "+err.Error())
+	}
+
+	result.IsValid = len(result.Problems) == 0
+	return result
+}
+
+func isCodeSigningCertificate(certificate *x509.Certificate) bool {
+	// no EKU means any usage
+	if len(certificate.ExtKeyUsage) == 0 && len(certificate.UnknownExtKeyUsage) == 0 {
+		return true
+	}
+	for _, usage := range certificate.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageCodeSigning || usage == x509.ExtKeyUsageAny {
+			return true
+		}
+	}
+	return false
+}
+
+func getRoots(file string) (*x509.CertPool, error) {
+	roots, err := x509.SystemCertPool()
+	if err != nil || roots == nil {
+		roots = x509.NewCertPool()
+	}
+
+	if len(file) != 0 {
+		certificates, err := readCertificateChain(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, certificate := range certificates {
+			roots.AddCert(certificate)
+		}
+	}
+	return roots, nil
+}
+
+func findCertificates(options *CertificateSearchOptions) (*certificateSet, error) {
+	source := options.Source
+	if len(source) == 0 {
+		switch {
+		case len(options.File) != 0:
+			source = CertificateSourceFile
+		case util.GetCurrentOs() == util.MAC:
+			source = CertificateSourceKeychain
+		case util.GetCurrentOs() == util.WINDOWS:
+			source = CertificateSourceWindowsStore
+		default:
+			return nil, createSignerOptionsError("PKCS#12 file must be specified (no certificate store on this OS)")
+		}
+	}
+
+	switch source {
+	case CertificateSourceFile:
+		return readPkcs12Certificates(options.File)
+	case CertificateSourceKeychain:
+		return findKeychainCertificates(options.Keychain)
+	default:
+		return findWindowsStoreCertificates()
+	}
+}
+
+// readPkcs12Certificates returns code signing certificates as leafs and the rest as intermediates
+func readPkcs12Certificates(file string) (*certificateSet, error) {
+	if len(file) == 0 {
+		return nil, createSignerOptionsError("PKCS#12 certificate file must be specified")
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	password, err := credentials.Get(CertificatePasswordCredentialName)
+	if err != nil {
+		return nil, err
+	}
+
+	certificates, err := pkcs12.DecodeAllCerts(data, password)
+	if err != nil {
+		return nil, util.NewMessageError("cannot decode "+file+": "+err.Error(), "ERR_SIGN_INVALID_CERTIFICATE")
+	}
+	return splitCertificates(certificates, nil), nil
+}
+
+// findKeychainCertificates returns identities (certificate with private key) as leafs, other certificates of keychain are used as intermediates
+func findKeychainCertificates(keychain string) (*certificateSet, error) {
+	args := []string{"find-identity", "-p", "codesigning"}
+	if len(keychain) != 0 {
+		args = append(args, keychain)
+	}
+	output, err := util.Execute(exec.Command("security", args...))
+	if err != nil {
+		return nil, err
+	}
+	identities := parseIdentityHashes(output)
+
+	args = []string{"find-certificate", "-a", "-p"}
+	if len(keychain) != 0 {
+		args = append(args, keychain)
+	}
+	output, err = util.Execute(exec.Command("security", args...))
+	if err != nil {
+		return nil, err
+	}
+
+	return splitCertificates(parsePemCertificates(output), identities), nil
+}
+
+func findWindowsStoreCertificates() (*certificateSet, error) {
+	output, err := util.Execute(exec.Command("powershell.exe", "-NoProfile", "-NonInteractive", "-Command", windowsStoreScript))
+	if err != nil {
+		return nil, err
+	}
+
+	var certificates []*x509.Certificate
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+
+		der, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		certificate, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		certificates = append(certificates, certificate)
+	}
+	// intermediates are resolved by system store
+	return splitCertificates(certificates, nil), nil
+}
+
+// splitCertificates returns certificates with SHA-1 from identities (or, if identities are not specified, code signing certificates) as leafs
+func splitCertificates(certificates []*x509.Certificate, identities map[string]bool) *certificateSet {
+	result := &certificateSet{intermediates: x509.NewCertPool()}
+	for _, certificate := range certificates {
+		var isLeaf bool
+		if identities == nil {
+			isLeaf = !certificate.IsCA && isCodeSigningCertificate(certificate)
+		} else {
+			hash := sha1.Sum(certificate.Raw)
+			isLeaf = identities[strings.ToUpper(hex.EncodeToString(hash[:]))]
+		}
+
+		if isLeaf {
+			result.leafs = append(result.leafs, certificate)
+		} else {
+			result.intermediates.AddCert(certificate)
+		}
+	}
+	return result
+}
+
+// parseIdentityHashes parses output of find-identity (  1) 0123456789ABCDEF0123456789ABCDEF01234567 "Developer ID Application: Foo (TEAMID)" (CSSMERR_TP_CERT_EXPIRED)),
+// not valid identities are included to report the reason
+func parseIdentityHashes(output []byte) map[string]bool {
+	result := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 3 && strings.HasSuffix(fields[0], ")") && len(fields[1]) == 40 {
+			result[strings.ToUpper(fields[1])] = true
+		}
+	}
+	return result
+}
+
+func parsePemCertificates(data []byte) []*x509.Certificate {
+	var result []*x509.Certificate
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			// keychain can contain certificates not supported by Go (e.g. with negative serial number), they cannot be a signing identity
+			continue
+		}
+		result = append(result, certificate)
+	}
+	return result
+}
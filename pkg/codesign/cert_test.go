@@ -0,0 +1,126 @@
+package codesign
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	. "github.com/onsi/gomega"
+)
+
+func createTestCertificate(g *GomegaWithT, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	g.Expect(err).NotTo(HaveOccurred())
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	g.Expect(err).NotTo(HaveOccurred())
+	certificate, err := x509.ParseCertificate(der)
+	g.Expect(err).NotTo(HaveOccurred())
+	return certificate, key
+}
+
+func encodePem(certificates ...*x509.Certificate) string {
+	var result strings.Builder
+	for _, certificate := range certificates {
+		_ = pem.Encode(&result, &pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw})
+	}
+	return result.String()
+}
+
+func getCertificateHash(certificate *x509.Certificate) string {
+	hash := sha1.Sum(certificate.Raw)
+	return strings.ToUpper(hex.EncodeToString(hash[:]))
+}
+
+func TestValidateKeychainCertificate(t *testing.T) {
+	log.InitLogger()
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "cert")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	root, rootKey := createTestCertificate(g, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Root CA"},
+		NotBefore:             now.Add(-24 * time.Hour),
+		NotAfter:              now.Add(10 * 365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	createLeaf := func(serial int64, name string, notAfter time.Time, usage x509.ExtKeyUsage) *x509.Certificate {
+		certificate, _ := createTestCertificate(g, &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name, OrganizationalUnit: []string{"TEAMID1234"}, Organization: []string{"Foo, Inc."}},
+			NotBefore:    now.Add(-2 * time.Hour),
+			NotAfter:     notAfter,
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}, root, rootKey)
+		return certificate
+	}
+	expired := createLeaf(2, "Developer ID Application: Foo, Inc. (TEAMID1234)", now.Add(-time.Hour), x509.ExtKeyUsageCodeSigning)
+	expiresSoon := createLeaf(3, "Developer ID Application: Foo, Inc. (TEAMID1234)", now.Add(24*time.Hour), x509.ExtKeyUsageCodeSigning)
+	server := createLeaf(4, "Developer ID Installer: Foo, Inc. (TEAMID1234)", now.Add(24*time.Hour), x509.ExtKeyUsageServerAuth)
+
+	roots := filepath.Join(dir, "roots.pem")
+	writeFile(g, roots, encodePem(root))
+
+	// fake security lists identities and prints certificates of keychain as PEM
+	binDir := filepath.Join(dir, "bin")
+	writeFile(g, filepath.Join(dir, "identities"), "  1) "+getCertificateHash(expired)+" \"Developer ID Application: Foo, Inc. (TEAMID1234)\" (CSSMERR_TP_CERT_EXPIRED)\n"+
+		"  2) "+getCertificateHash(expiresSoon)+" \"Developer ID Application: Foo, Inc. (TEAMID1234)\"\n"+
+		"  3) "+getCertificateHash(server)+" \"Developer ID Installer: Foo, Inc. (TEAMID1234)\"\n     3 identities found\n")
+	writeFile(g, filepath.Join(dir, "certificates.pem"), encodePem(expired, root, expiresSoon, server))
+	writeFile(g, filepath.Join(binDir, "security"), "#!/bin/sh\ncase \"$1\" in\n  find-identity) cat '"+filepath.Join(dir, "identities")+"' ;;\n  find-certificate) cat '"+filepath.Join(dir, "certificates.pem")+"' ;;\nesac\n")
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	g.Expect(os.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))).To(Succeed())
+
+	options := &CertificateSearchOptions{Source: CertificateSourceKeychain, Keychain: "build.keychain", Roots: roots, ExpiryWarning: 30 * 24 * time.Hour}
+	all, err := ListCertificates(options)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(all).To(HaveLen(3))
+	g.Expect(all[0].Problems).To(Equal([]string{"expired on " + expired.NotAfter.Format("2006-01-02")}))
+	g.Expect(all[1].IsValid).To(BeTrue())
+	g.Expect(all[1].TeamId).To(Equal("TEAMID1234"))
+	g.Expect(all[1].Warnings).To(HaveLen(1))
+	g.Expect(all[2].Problems[0]).To(Equal("extended key usage doesn't allow code signing"))
+
+	certificate, err := ValidateCertificate(options, "Developer ID Application: Foo", "")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(certificate.Hash).To(Equal(getCertificateHash(expiresSoon)))
+
+	certificate, err = ValidateCertificate(options, getCertificateHash(expired), "")
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.(util.MessageError).ErrorCode()).To(Equal("ERR_SIGN_INVALID_CERTIFICATE"))
+	g.Expect(certificate.Hash).To(Equal(getCertificateHash(expired)))
+
+	_, err = ValidateCertificate(options, "", "Bar")
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.(util.MessageError).ErrorCode()).To(Equal("ERR_SIGN_IDENTITY_NOT_FOUND"))
+
+	// chain is not trusted without root
+	options.Roots = ""
+	all, err = ListCertificates(options)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(all[1].IsValid).To(BeFalse())
+	g.Expect(all[1].Problems[0]).To(HavePrefix("chain to a trusted root is not valid"))
+}
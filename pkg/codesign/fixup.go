@@ -0,0 +1,216 @@
+package codesign
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	FixupRemoveFile       = "removeFile"
+	FixupRemoveAttributes = "removeAttributes"
+	FixupStripSignature   = "stripSignature"
+	FixupAdHocSign        = "adHocSign"
+)
+
+type MacFixupOptions struct {
+	App         string
+	IsDryRun    bool
+	Concurrency int
+}
+
+type FixupChange struct {
+	// relative to the app
+	Path   string `json:"path"`
+	Action string `json:"action"`
+	// removed attributes or why signature is stripped
+	Detail string `json:"detail,omitempty"`
+}
+
+type MacFixupReport struct {
+	DryRun bool `json:"dryRun"`
+	// codesign is not available, signatures are not checked
+	SignaturesSkipped bool           `json:"signaturesSkipped,omitempty"`
+	Changes           []*FixupChange `json:"changes"`
+}
+
+func configureFixupCommand(codesignCommand *kingpin.CmdClause) {
+	command := codesignCommand.Command("fixup", "Prepare unpacked macOS app for signing: remove AppleDouble files and extended attributes (quarantine, resource forks, Finder info), "+
+		"strip invalid inherited signatures and ad-hoc sign binaries that must be signed to run. Report of changes is written to stdout as JSON.")
+	options := MacFixupOptions{}
+	command.Flag("app", "The .app bundle.").Required().ExistingDirVar(&options.App)
+	command.Flag("dry-run", "Only report what would be changed.").BoolVar(&options.IsDryRun)
+	command.Flag("concurrency", "The number of parallel codesign processes.").Default(strconv.Itoa(runtime.NumCPU())).IntVar(&options.Concurrency)
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		report, err := FixupMacApp(options)
+		if err != nil {
+			return err
+		}
+		return util.WriteJsonToStdOut(report)
+	})
+}
+
+// FixupMacApp fixes issues that make codesign fail or app be killed on launch. Nested bundles are not re-signed - they are signed by "codesign mac" anyway,
+// only standalone executables and libraries (e.g. prebuilt native modules with signature invalidated by install_name_tool) are checked.
+func FixupMacApp(options MacFixupOptions) (*MacFixupReport, error) {
+	appDir := filepath.Clean(options.App)
+	report := &MacFixupReport{DryRun: options.IsDryRun}
+
+	err := cleanFiles(appDir, report, options.IsDryRun)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = exec.LookPath("codesign")
+	if err != nil {
+		log.Warn("codesign is not available, signatures are not checked")
+		report.SignaturesSkipped = true
+		return report, nil
+	}
+
+	items, err := collectSignItems(appDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var binaries []*signItem
+	for _, item := range items {
+		if item.Kind == KindExecutable || item.Kind == KindLibrary {
+			binaries = append(binaries, item)
+		}
+	}
+
+	concurrency := options.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	itemChanges := make([][]*FixupChange, len(binaries))
+	err = util.MapAsyncConcurrency(len(binaries), concurrency, func(taskIndex int) (func() error, error) {
+		item := binaries[taskIndex]
+		return func() error {
+			changes, err := fixupSignature(item, options.IsDryRun)
+			if err != nil {
+				return err
+			}
+
+			itemChanges[taskIndex] = changes
+			return nil
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, changes := range itemChanges {
+		report.Changes = append(report.Changes, changes...)
+	}
+	return report, nil
+}
+
+// cleanFiles removes AppleDouble files (created when app is copied via non-HFS file system) and extended attributes:
+// codesign fails with "resource fork, Finder information, or similar detritus not allowed" and quarantine makes Gatekeeper to reject the app.
+func cleanFiles(appDir string, report *MacFixupReport, isDryRun bool) error {
+	return filepath.Walk(appDir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		relativePath := filepath.ToSlash(strings.TrimPrefix(file[len(appDir):], string(filepath.Separator)))
+		if info.Mode().IsRegular() && strings.HasPrefix(info.Name(), "._") {
+			report.Changes = append(report.Changes, &FixupChange{Path: relativePath, Action: FixupRemoveFile, Detail: "AppleDouble file"})
+			if isDryRun {
+				return nil
+			}
+			return errors.WithStack(os.Remove(file))
+		}
+
+		attributes, err := listAttributes(file)
+		if err != nil {
+			return err
+		}
+		if len(attributes) == 0 {
+			return nil
+		}
+
+		report.Changes = append(report.Changes, &FixupChange{Path: relativePath, Action: FixupRemoveAttributes, Detail: strings.Join(attributes, ", ")})
+		if isDryRun {
+			return nil
+		}
+		for _, name := range attributes {
+			err = removeAttribute(file, name)
+			if err != nil {
+				return errors.WithMessage(err, "cannot remove attribute "+name+" of "+file)
+			}
+		}
+		return nil
+	})
+}
+
+// fixupSignature strips signature that doesn't pass verification (modified after signing, expired or revoked certificate) and ad-hoc signs
+// the binary if it has arm64 code - unsigned arm64 code is killed on launch.
+func fixupSignature(item *signItem, isDryRun bool) ([]*FixupChange, error) {
+	info, err := readMachOSignatureInfo(item.file)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []*FixupChange
+	isAdHocRequired := info.hasArm64
+	if info.isSigned {
+		_, err = util.Execute(exec.Command("codesign", "--verify", "--strict", item.file))
+		if err == nil {
+			return nil, nil
+		}
+
+		changes = append(changes, &FixupChange{Path: item.Path, Action: FixupStripSignature, Detail: getVerifyFailureReason(err, item.file)})
+		if !isDryRun {
+			_, err = util.Execute(exec.Command("codesign", "--remove-signature", item.file))
+			if err != nil {
+				return nil, errors.WithMessage(err, "cannot remove signature of "+item.file)
+			}
+		}
+		isAdHocRequired = true
+	}
+
+	if !isAdHocRequired {
+		return changes, nil
+	}
+
+	changes = append(changes, &FixupChange{Path: item.Path, Action: FixupAdHocSign})
+	if !isDryRun {
+		_, err = util.Execute(exec.Command("codesign", "--sign", "-", "--force", item.file))
+		if err != nil {
+			return nil, errors.WithMessage(err, "cannot sign "+item.file)
+		}
+	}
+
+	for _, change := range changes {
+		log.Info("fix up", zap.String("file", change.Path), zap.String("action", change.Action), zap.String("detail", change.Detail))
+	}
+	return changes, nil
+}
+
+// codesign reports "<file>: invalid signature (code or signature have been modified)"
+func getVerifyFailureReason(err error, file string) string {
+	execError, ok := err.(*util.ExecError)
+	if !ok {
+		return err.Error()
+	}
+
+	output := strings.TrimSpace(string(execError.ErrorOutput))
+	if index := strings.IndexByte(output, '\n'); index > 0 {
+		output = output[:index]
+	}
+	return strings.TrimPrefix(output, file+": ")
+}
@@ -0,0 +1,104 @@
+// +build darwin linux
+
+package codesign
+
+import (
+	"debug/macho"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+	"golang.org/x/sys/unix"
+)
+
+// 64-bit executable, optionally with (empty) LC_CODE_SIGNATURE
+func writeMachO64(g *GomegaWithT, file string, cpu macho.Cpu, isSigned bool) {
+	header := make([]byte, 32)
+	binary.LittleEndian.PutUint32(header[0:], macho.Magic64)
+	binary.LittleEndian.PutUint32(header[4:], uint32(cpu))
+	binary.LittleEndian.PutUint32(header[12:], uint32(macho.TypeExec))
+	if isSigned {
+		binary.LittleEndian.PutUint32(header[16:], 1)
+		binary.LittleEndian.PutUint32(header[20:], 16)
+		command := make([]byte, 16)
+		binary.LittleEndian.PutUint32(command[0:], loadCmdCodeSignature)
+		binary.LittleEndian.PutUint32(command[4:], 16)
+		header = append(header, command...)
+	}
+	writeFile(g, file, string(header))
+}
+
+func TestFixupMacApp(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "codesign")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	// fake codesign records arguments, signature of "broken" binary is invalid
+	binDir := filepath.Join(dir, "bin")
+	logFile := filepath.Join(dir, "codesign.log")
+	writeFile(g, filepath.Join(binDir, "codesign"), "#!/bin/sh\necho \"$@\" >> '"+logFile+"'\n"+
+		"case \"$1 $3\" in\n  \"--verify \"*broken) echo \"$3: invalid signature (code or signature have been modified)\" >&2; echo \"In architecture: arm64\" >&2; exit 1;;\nesac\n")
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	g.Expect(os.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))).NotTo(HaveOccurred())
+
+	appDir := filepath.Join(dir, "Test.app")
+	writeFile(g, filepath.Join(appDir, "Contents", "Info.plist"), `<?xml version="1.0" encoding="UTF-8"?><plist version="1.0"><dict><key>CFBundleExecutable</key><string>Test</string></dict></plist>`)
+	writeMachO64(g, filepath.Join(appDir, "Contents", "MacOS", "Test"), macho.CpuArm64, false)
+	resourceDir := filepath.Join(appDir, "Contents", "Resources")
+	writeMachO64(g, filepath.Join(resourceDir, "unsigned-arm64"), macho.CpuArm64, false)
+	writeMachO64(g, filepath.Join(resourceDir, "unsigned-x64"), macho.CpuAmd64, false)
+	writeMachO64(g, filepath.Join(resourceDir, "signed"), macho.CpuAmd64, true)
+	writeMachO64(g, filepath.Join(resourceDir, "broken"), macho.CpuAmd64, true)
+	writeFile(g, filepath.Join(resourceDir, "._icon.icns"), "detritus")
+
+	// user namespace is required on Linux, file system may not support extended attributes at all
+	isAttributeSet := unix.Lsetxattr(filepath.Join(resourceDir, "signed"), "user.test", []byte("1"), 0) == nil
+
+	report, err := FixupMacApp(MacFixupOptions{App: appDir, IsDryRun: true, Concurrency: 2})
+	g.Expect(err).NotTo(HaveOccurred())
+	if isAttributeSet {
+		g.Expect(report.Changes).To(HaveLen(5))
+	} else {
+		g.Expect(report.Changes).To(HaveLen(4))
+	}
+	g.Expect(filepath.Join(resourceDir, "._icon.icns")).To(BeAnExistingFile())
+	codesignLog, err := ioutil.ReadFile(logFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(codesignLog)).NotTo(ContainSubstring("--sign"))
+
+	report, err = FixupMacApp(MacFixupOptions{App: appDir, Concurrency: 2})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(report.SignaturesSkipped).To(BeFalse())
+
+	expected := []*FixupChange{
+		{Path: "Contents/Resources/._icon.icns", Action: FixupRemoveFile, Detail: "AppleDouble file"},
+		{Path: "Contents/Resources/broken", Action: FixupStripSignature, Detail: "invalid signature (code or signature have been modified)"},
+		{Path: "Contents/Resources/broken", Action: FixupAdHocSign},
+		{Path: "Contents/Resources/unsigned-arm64", Action: FixupAdHocSign},
+	}
+	if isAttributeSet {
+		expected = append(expected[:1], append([]*FixupChange{{Path: "Contents/Resources/signed", Action: FixupRemoveAttributes, Detail: "user.test"}}, expected[1:]...)...)
+	}
+	g.Expect(report.Changes).To(Equal(expected))
+	g.Expect(filepath.Join(resourceDir, "._icon.icns")).NotTo(BeAnExistingFile())
+
+	attributes, err := listAttributes(filepath.Join(resourceDir, "signed"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(attributes).To(BeEmpty())
+
+	codesignLog, err = ioutil.ReadFile(logFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(strings.Count(string(codesignLog), "--remove-signature")).To(Equal(1))
+	g.Expect(string(codesignLog)).To(ContainSubstring("--sign - --force " + filepath.Join(resourceDir, "unsigned-arm64")))
+	g.Expect(string(codesignLog)).NotTo(ContainSubstring("--sign - --force " + filepath.Join(resourceDir, "unsigned-x64")))
+	// main executable is signed with the bundle
+	g.Expect(string(codesignLog)).NotTo(ContainSubstring(filepath.Join(appDir, "Contents", "MacOS", "Test")))
+}
@@ -0,0 +1,457 @@
+package codesign
+
+import (
+	"debug/macho"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"go.uber.org/zap"
+	"howett.net/plist"
+)
+
+const (
+	KindApp         = "app"
+	KindHelper      = "helper"
+	KindLoginHelper = "loginHelper"
+	KindFramework   = "framework"
+	KindExtension   = "extension"
+	KindBundle      = "bundle"
+	KindExecutable  = "executable"
+	KindLibrary     = "library"
+)
+
+// the same default as electron-builder - V8 requires JIT with hardened runtime
+const defaultEntitlements = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+  <dict>
+    <key>com.apple.security.cs.allow-jit</key>
+    <true/>
+    <key>com.apple.security.cs.allow-unsigned-executable-memory</key>
+    <true/>
+  </dict>
+</plist>
+`
+
+type MacSignOptions struct {
+	App string
+	// name or SHA-1 of the identity, - for ad-hoc signing
+	Identity string
+	Keychain string
+
+	// entitlements of the main app
+	Entitlements string
+	// entitlements of helper apps and executables (default: main entitlements)
+	EntitlementsInherit string
+	// entitlements of login helper (Contents/Library/LoginItems, default: inherit entitlements)
+	EntitlementsLoginHelper string
+
+	// provisioning profile to validate and embed (Mac App Store)
+	ProvisioningProfile  string
+	IsDevelopmentProfile bool
+
+	IsHardenedRuntime bool
+	IsTimestamp       bool
+	Concurrency       int
+	IsSkipVerify      bool
+}
+
+type SignedItem struct {
+	// relative to the app dir, slash-separated, empty for the app itself
+	Path         string `json:"path"`
+	Kind         string `json:"kind"`
+	Entitlements string `json:"entitlements,omitempty"`
+	// signing level, the deepest level is signed first, items of the same level are signed in parallel
+	Level    int   `json:"level"`
+	Duration int64 `json:"durationMs"`
+}
+
+type MacSignReport struct {
+	App      string        `json:"app"`
+	Identity string        `json:"identity"`
+	Items    []*SignedItem `json:"items"`
+	Verified bool          `json:"verified"`
+	Duration int64         `json:"durationMs"`
+}
+
+func ConfigureCommand(app *kingpin.Application) {
+	command := app.Command("codesign", "Code signing.")
+	configureMacCommand(command)
+	configureFixupCommand(command)
+	configureNotarizeCommand(command)
+	configureStapleCommand(command)
+	configureProvisioningProfileCommand(command)
+}
+
+func configureMacCommand(codesignCommand *kingpin.CmdClause) {
+	command := codesignCommand.Command("mac", "Sign macOS app bundle bottom-up (nested binaries, frameworks, helpers, the app) with entitlements per binary type and verify. "+
+		"Signing report is written to stdout as JSON.")
+	options := MacSignOptions{}
+	command.Flag("app", "The .app bundle.").Required().ExistingDirVar(&options.App)
+	command.Flag("identity", "The signing identity (name or SHA-1 hash), - for ad-hoc signing.").Required().StringVar(&options.Identity)
+	command.Flag("keychain", "The keychain to find the identity in.").StringVar(&options.Keychain)
+	command.Flag("entitlements", "The entitlements of the app (default: allow JIT if hardened runtime is enabled).").ExistingFileVar(&options.Entitlements)
+	command.Flag("entitlements-inherit", "The entitlements of helper apps and executables (default: app entitlements).").ExistingFileVar(&options.EntitlementsInherit)
+	command.Flag("entitlements-login-helper", "The entitlements of login helper (default: inherit entitlements).").ExistingFileVar(&options.EntitlementsLoginHelper)
+	command.Flag("provisioning-profile", "The provisioning profile to validate and embed (Mac App Store).").ExistingFileVar(&options.ProvisioningProfile)
+	command.Flag("development-profile", "The provisioning profile is a development one (allowed to be restricted to devices).").BoolVar(&options.IsDevelopmentProfile)
+	command.Flag("hardened-runtime", "Enable hardened runtime (required for notarization).").Default("true").BoolVar(&options.IsHardenedRuntime)
+	command.Flag("timestamp", "Use secure timestamp (ignored for ad-hoc signing).").Default("true").BoolVar(&options.IsTimestamp)
+	command.Flag("concurrency", "The number of parallel codesign processes.").Default(strconv.Itoa(runtime.NumCPU())).IntVar(&options.Concurrency)
+	command.Flag("skip-verify", "Do not verify the signed app.").BoolVar(&options.IsSkipVerify)
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		report, err := SignMacApp(options)
+		if report != nil {
+			writeError := util.WriteJsonToStdOut(report)
+			if err == nil {
+				err = writeError
+			}
+		}
+		return err
+	})
+}
+
+type signItem struct {
+	SignedItem
+	file string
+}
+
+// SignMacApp signs nested code before the code that contains it (codesign --deep is deprecated and doesn't apply entitlements per binary).
+// Items of the same level don't contain each other and are signed in parallel.
+func SignMacApp(options MacSignOptions) (*MacSignReport, error) {
+	start := time.Now()
+	appDir, err := filepath.Abs(options.App)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	isAdHoc := options.Identity == "-"
+	if options.ProvisioningProfile != "" {
+		// the profile must include signing certificate, but it can be checked only if the identity is specified by hash
+		identity := ""
+		if _, decodeErr := hex.DecodeString(options.Identity); decodeErr == nil && len(options.Identity) == 40 {
+			identity = options.Identity
+		}
+		_, err = ValidateProvisioningProfile(&ProvisioningProfileOptions{
+			Profile:       options.ProvisioningProfile,
+			App:           appDir,
+			Entitlements:  options.Entitlements,
+			Identity:      identity,
+			IsDevelopment: options.IsDevelopmentProfile,
+			IsEmbed:       true,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	entitlements, cleanup, err := resolveEntitlements(&options)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	items, err := collectSignItems(appDir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range items {
+		item.Entitlements = entitlements[item.Kind]
+	}
+
+	report := &MacSignReport{
+		App:      appDir,
+		Identity: options.Identity,
+	}
+
+	concurrency := options.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	for from := 0; from < len(items); {
+		end := from + 1
+		for end < len(items) && items[end].Level == items[from].Level {
+			end++
+		}
+
+		levelItems := items[from:end]
+		err = util.MapAsyncConcurrency(len(levelItems), concurrency, func(taskIndex int) (func() error, error) {
+			item := levelItems[taskIndex]
+			return func() error {
+				return signItemFile(item, &options, isAdHoc)
+			}, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		from = end
+	}
+
+	for _, item := range items {
+		signedItem := item.SignedItem
+		report.Items = append(report.Items, &signedItem)
+	}
+
+	if !options.IsSkipVerify {
+		_, err = util.Execute(exec.Command("codesign", "--verify", "--deep", "--strict", "--verbose=2", appDir))
+		if err != nil {
+			report.Duration = time.Since(start).Milliseconds()
+			if execError, ok := err.(*util.ExecError); ok {
+				log.Error("signed app is not valid", util.CreateExecErrorLogEntry(execError)...)
+			}
+			return report, util.NewMessageError("signed app "+appDir+" is not valid (codesign --verify --deep --strict failed, see errors above)", "ERR_CODESIGN_VERIFY_FAILED")
+		}
+		report.Verified = true
+	}
+
+	report.Duration = time.Since(start).Milliseconds()
+	return report, nil
+}
+
+func signItemFile(item *signItem, options *MacSignOptions, isAdHoc bool) error {
+	start := time.Now()
+	args := []string{"--sign", options.Identity, "--force"}
+	if options.Keychain != "" {
+		args = append(args, "--keychain", options.Keychain)
+	}
+	if options.IsHardenedRuntime {
+		args = append(args, "--options", "runtime")
+	}
+	if options.IsTimestamp && !isAdHoc {
+		args = append(args, "--timestamp")
+	}
+	if item.Entitlements != "" {
+		args = append(args, "--entitlements", item.Entitlements)
+	}
+	args = append(args, item.file)
+
+	log.Debug("sign", zap.String("file", item.file), zap.String("kind", item.Kind))
+	_, err := util.Execute(exec.Command("codesign", args...))
+	if err != nil {
+		return errors.WithMessage(err, "cannot sign "+item.file)
+	}
+	item.Duration = time.Since(start).Milliseconds()
+	return nil
+}
+
+// resolveEntitlements returns entitlements file per item kind. Default entitlements (allow JIT) are written to a temp file if hardened runtime is enabled.
+func resolveEntitlements(options *MacSignOptions) (map[string]string, func(), error) {
+	cleanup := func() {}
+	main := options.Entitlements
+	if main == "" && options.IsHardenedRuntime {
+		file, err := util.CreateTempFile("entitlements-*.plist")
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+
+		_, err = file.WriteString(defaultEntitlements)
+		closeErr := file.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			_ = os.Remove(file.Name())
+			return nil, nil, errors.WithStack(err)
+		}
+
+		main = file.Name()
+		cleanup = func() {
+			_ = os.Remove(main)
+		}
+	}
+
+	inherit := options.EntitlementsInherit
+	if inherit == "" {
+		inherit = main
+	}
+	loginHelper := options.EntitlementsLoginHelper
+	if loginHelper == "" {
+		loginHelper = inherit
+	}
+
+	return map[string]string{
+		KindApp:         main,
+		KindHelper:      inherit,
+		KindExtension:   inherit,
+		KindExecutable:  inherit,
+		KindLoginHelper: loginHelper,
+	}, cleanup, nil
+}
+
+func getBundleKind(name string, relativePath string) string {
+	switch filepath.Ext(name) {
+	case ".app":
+		if strings.Contains(relativePath, "/Contents/Library/LoginItems/") {
+			return KindLoginHelper
+		}
+		return KindHelper
+	case ".framework":
+		return KindFramework
+	case ".appex", ".xpc":
+		return KindExtension
+	case ".bundle", ".plugin":
+		return KindBundle
+	default:
+		return ""
+	}
+}
+
+// collectSignItems returns nested bundles and loose Mach-O binaries of the app (and the app itself) sorted by level - the deepest first.
+// Main executable of a bundle is signed as part of the bundle. Symbolic links are not signed (e.g. Versions/Current of framework).
+func collectSignItems(appDir string) ([]*signItem, error) {
+	var result []*signItem
+	mainExecutables := make(map[string]bool)
+
+	addMainExecutable := func(bundleDir string, kind string) error {
+		executable, err := getBundleMainExecutable(bundleDir, kind)
+		if err != nil {
+			return err
+		}
+		if executable != "" {
+			mainExecutables[executable] = true
+		}
+		return nil
+	}
+
+	err := addMainExecutable(appDir, KindApp)
+	if err != nil {
+		return nil, err
+	}
+
+	// bundle dirs in walk order - parent is visited before child
+	var bundles []string
+	err = filepath.Walk(appDir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if file == appDir || info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+
+		relativePath := filepath.ToSlash(file[len(appDir):])
+		if info.IsDir() {
+			kind := getBundleKind(info.Name(), relativePath)
+			if kind == "" {
+				return nil
+			}
+
+			bundles = append(bundles, file)
+			result = append(result, &signItem{
+				SignedItem: SignedItem{Path: relativePath[1:], Kind: kind, Level: getBundleLevel(bundles, file)},
+				file:       file,
+			})
+			return addMainExecutable(file, kind)
+		}
+
+		if !info.Mode().IsRegular() || mainExecutables[file] {
+			return nil
+		}
+
+		machoType, err := ReadMachOType(file)
+		if err != nil {
+			return err
+		}
+
+		kind := ""
+		switch machoType {
+		case macho.TypeExec:
+			kind = KindExecutable
+		case macho.TypeDylib, macho.TypeBundle:
+			kind = KindLibrary
+		default:
+			return nil
+		}
+
+		result = append(result, &signItem{
+			SignedItem: SignedItem{Path: relativePath[1:], Kind: kind, Level: getBundleLevel(bundles, file) + 1},
+			file:       file,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	result = append(result, &signItem{SignedItem: SignedItem{Kind: KindApp}, file: appDir})
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Level > result[j].Level
+	})
+	return result, nil
+}
+
+// getBundleLevel returns the number of bundles containing the file (file itself included if it is a bundle)
+func getBundleLevel(bundles []string, file string) int {
+	level := 0
+	for _, bundle := range bundles {
+		if file == bundle || strings.HasPrefix(file, bundle+string(filepath.Separator)) {
+			level++
+		}
+	}
+	return level
+}
+
+// getBundleMainExecutable returns Contents/MacOS/<CFBundleExecutable> of app-like bundle and Versions/<version>/<name> of framework, empty if no main executable.
+func getBundleMainExecutable(bundleDir string, kind string) (string, error) {
+	switch kind {
+	case KindFramework:
+		name := strings.TrimSuffix(filepath.Base(bundleDir), ".framework")
+		versionsDir := filepath.Join(bundleDir, "Versions")
+		versions, err := ioutil.ReadDir(versionsDir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return filepath.Join(bundleDir, name), nil
+			}
+			return "", errors.WithStack(err)
+		}
+
+		for _, version := range versions {
+			if version.IsDir() {
+				file := filepath.Join(versionsDir, version.Name(), name)
+				if _, err := os.Stat(file); err == nil {
+					return file, nil
+				}
+			}
+		}
+		return "", nil
+
+	case KindBundle:
+		return "", nil
+	}
+
+	infoPlist := filepath.Join(bundleDir, "Contents", "Info.plist")
+	data, err := ioutil.ReadFile(infoPlist)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", errors.WithStack(err)
+	}
+
+	var info struct {
+		Executable string `plist:"CFBundleExecutable"`
+	}
+	_, err = plist.Unmarshal(data, &info)
+	if err != nil {
+		return "", errors.WithMessage(err, "cannot parse "+infoPlist)
+	}
+	if info.Executable == "" {
+		return "", nil
+	}
+	return filepath.Join(bundleDir, "Contents", "MacOS", info.Executable), nil
+}
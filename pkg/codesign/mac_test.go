@@ -0,0 +1,130 @@
+package codesign
+
+import (
+	"debug/macho"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+)
+
+func writeMachO(g *GomegaWithT, file string, fileType macho.Type) {
+	header := make([]byte, 28)
+	binary.LittleEndian.PutUint32(header[0:], macho.Magic32)
+	binary.LittleEndian.PutUint32(header[4:], uint32(macho.Cpu386))
+	binary.LittleEndian.PutUint32(header[12:], uint32(fileType))
+	writeFile(g, file, string(header))
+}
+
+func writeFile(g *GomegaWithT, file string, data string) {
+	g.Expect(os.MkdirAll(filepath.Dir(file), 0755)).NotTo(HaveOccurred())
+	g.Expect(ioutil.WriteFile(file, []byte(data), 0755)).NotTo(HaveOccurred())
+}
+
+func TestReadMachOType(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "macho")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	writeMachO(g, filepath.Join(dir, "exe"), macho.TypeExec)
+	writeMachO(g, filepath.Join(dir, "lib.dylib"), macho.TypeDylib)
+	writeFile(g, filepath.Join(dir, "text"), "not a binary")
+
+	for name, expected := range map[string]macho.Type{"exe": macho.TypeExec, "lib.dylib": macho.TypeDylib, "text": 0} {
+		fileType, err := ReadMachOType(filepath.Join(dir, name))
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(fileType).To(Equal(expected), name)
+	}
+}
+
+func TestSignMacApp(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "codesign")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	// fake codesign records arguments
+	binDir := filepath.Join(dir, "bin")
+	logFile := filepath.Join(dir, "codesign.log")
+	writeFile(g, filepath.Join(binDir, "codesign"), "#!/bin/sh\necho \"$@\" >> '"+logFile+"'\n")
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	g.Expect(os.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))).NotTo(HaveOccurred())
+
+	plistData := func(executable string) string {
+		return `<?xml version="1.0" encoding="UTF-8"?><plist version="1.0"><dict><key>CFBundleExecutable</key><string>` + executable + `</string></dict></plist>`
+	}
+
+	appDir := filepath.Join(dir, "Test.app")
+	writeFile(g, filepath.Join(appDir, "Contents", "Info.plist"), plistData("Test"))
+	writeMachO(g, filepath.Join(appDir, "Contents", "MacOS", "Test"), macho.TypeExec)
+	helperDir := filepath.Join(appDir, "Contents", "Frameworks", "Test Helper.app")
+	writeFile(g, filepath.Join(helperDir, "Contents", "Info.plist"), plistData("Test Helper"))
+	writeMachO(g, filepath.Join(helperDir, "Contents", "MacOS", "Test Helper"), macho.TypeExec)
+	frameworkDir := filepath.Join(appDir, "Contents", "Frameworks", "Foo.framework")
+	writeMachO(g, filepath.Join(frameworkDir, "Versions", "A", "Foo"), macho.TypeDylib)
+	writeMachO(g, filepath.Join(frameworkDir, "Versions", "A", "Libraries", "libbar.dylib"), macho.TypeDylib)
+	g.Expect(os.Symlink("A", filepath.Join(frameworkDir, "Versions", "Current"))).NotTo(HaveOccurred())
+	loginHelperDir := filepath.Join(appDir, "Contents", "Library", "LoginItems", "Launcher.app")
+	writeFile(g, filepath.Join(loginHelperDir, "Contents", "Info.plist"), plistData("Launcher"))
+	writeMachO(g, filepath.Join(loginHelperDir, "Contents", "MacOS", "Launcher"), macho.TypeExec)
+	writeMachO(g, filepath.Join(appDir, "Contents", "Resources", "tool"), macho.TypeExec)
+	writeFile(g, filepath.Join(appDir, "Contents", "Resources", "app.asar"), "data")
+
+	inherit := filepath.Join(dir, "inherit.plist")
+	writeFile(g, inherit, "")
+
+	report, err := SignMacApp(MacSignOptions{
+		App:                 appDir,
+		Identity:            "-",
+		EntitlementsInherit: inherit,
+		IsHardenedRuntime:   true,
+		IsTimestamp:         true,
+		Concurrency:         2,
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(report.Verified).To(BeTrue())
+
+	pathToItem := make(map[string]*SignedItem)
+	for _, item := range report.Items {
+		pathToItem[item.Path] = item
+	}
+	g.Expect(pathToItem).To(HaveLen(6))
+	g.Expect(pathToItem["Contents/Frameworks/Foo.framework/Versions/A/Libraries/libbar.dylib"].Kind).To(Equal(KindLibrary))
+	g.Expect(pathToItem["Contents/Frameworks/Foo.framework"].Kind).To(Equal(KindFramework))
+	g.Expect(pathToItem["Contents/Frameworks/Test Helper.app"].Kind).To(Equal(KindHelper))
+	g.Expect(pathToItem["Contents/Frameworks/Test Helper.app"].Entitlements).To(Equal(inherit))
+	g.Expect(pathToItem["Contents/Library/LoginItems/Launcher.app"].Kind).To(Equal(KindLoginHelper))
+	g.Expect(pathToItem["Contents/Resources/tool"].Kind).To(Equal(KindExecutable))
+	g.Expect(pathToItem[""].Kind).To(Equal(KindApp))
+	// default entitlements (temp file) are used for the app
+	g.Expect(pathToItem[""].Entitlements).NotTo(BeEmpty())
+	g.Expect(pathToItem[""].Entitlements).NotTo(Equal(inherit))
+
+	data, err := ioutil.ReadFile(logFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	g.Expect(lines).To(HaveLen(7))
+	// nested dylib is signed before framework, the app is signed last, then verified
+	indexOf := func(suffix string) int {
+		for index, line := range lines {
+			if strings.HasSuffix(line, suffix) {
+				return index
+			}
+		}
+		return -1
+	}
+	g.Expect(indexOf("libbar.dylib")).To(BeNumerically("<", indexOf("Foo.framework")))
+	g.Expect(lines[5]).To(HavePrefix("--sign - --force --options runtime --entitlements "))
+	g.Expect(lines[5]).To(HaveSuffix(appDir))
+	g.Expect(lines[5]).NotTo(ContainSubstring("--timestamp"))
+	g.Expect(lines[6]).To(HavePrefix("--verify --deep --strict"))
+}
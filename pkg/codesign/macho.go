@@ -0,0 +1,123 @@
+package codesign
+
+import (
+	"debug/macho"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+)
+
+type MachOKind int
+
+const (
+	NotMachO MachOKind = iota
+	// thin Mach-O of any byte order
+	MachOThin
+	// universal binary
+	MachOFat
+)
+
+// GetMachOKind checks Mach-O magic of the first 8 bytes of the file, file is not parsed (it can be invalid)
+func GetMachOKind(header []byte) MachOKind {
+	if len(header) < 8 {
+		return NotMachO
+	}
+
+	switch binary.BigEndian.Uint32(header[:4]) {
+	case macho.Magic32, macho.Magic64, 0xcefaedfe, 0xcffaedfe:
+		return MachOThin
+	case macho.MagicFat:
+		// Java class has the same magic, but version (>= 45) instead of small arch count
+		if binary.BigEndian.Uint32(header[4:8]) < 45 {
+			return MachOFat
+		}
+	}
+	return NotMachO
+}
+
+// ReadMachOType returns type of Mach-O file (type of the first architecture for universal binary), 0 if file is not a Mach-O file.
+// Magic is checked before parsing, so, it is cheap to call for every file of the bundle.
+func ReadMachOType(file string) (macho.Type, error) {
+	reader, err := os.Open(file)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer util.Close(reader)
+
+	var header [8]byte
+	_, err = io.ReadFull(reader, header[:])
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, nil
+		}
+		return 0, errors.WithStack(err)
+	}
+
+	switch GetMachOKind(header[:]) {
+	case MachOThin:
+		machoFile, err := macho.NewFile(reader)
+		if err != nil {
+			// not a valid Mach-O, e.g. a data file that starts with the same bytes
+			return 0, nil
+		}
+		return machoFile.Type, nil
+
+	case MachOFat:
+		fatFile, err := macho.NewFatFile(reader)
+		if err != nil || len(fatFile.Arches) == 0 {
+			return 0, nil
+		}
+		return fatFile.Arches[0].Type, nil
+	}
+	return 0, nil
+}
+
+type machOSignatureInfo struct {
+	hasArm64 bool
+	// all architectures have LC_CODE_SIGNATURE
+	isSigned bool
+}
+
+// readMachOSignatureInfo checks whether Mach-O file (thin or universal) is signed and contains arm64 code (arm64 code must be signed, at least ad-hoc, to run).
+func readMachOSignatureInfo(file string) (*machOSignatureInfo, error) {
+	var files []*macho.File
+	fatFile, err := macho.OpenFat(file)
+	if err == nil {
+		defer util.Close(fatFile)
+		for _, arch := range fatFile.Arches {
+			files = append(files, arch.File)
+		}
+	} else if err == macho.ErrNotFat {
+		machoFile, err := macho.Open(file)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		defer util.Close(machoFile)
+		files = append(files, machoFile)
+	} else {
+		return nil, errors.WithStack(err)
+	}
+
+	result := &machOSignatureInfo{isSigned: len(files) != 0}
+	for _, machoFile := range files {
+		if machoFile.Cpu == macho.CpuArm64 {
+			result.hasArm64 = true
+		}
+
+		isSigned := false
+		for _, load := range machoFile.Loads {
+			raw := load.Raw()
+			if len(raw) >= 4 && machoFile.ByteOrder.Uint32(raw) == loadCmdCodeSignature {
+				isSigned = true
+				break
+			}
+		}
+		if !isSigned {
+			result.isSigned = false
+		}
+	}
+	return result, nil
+}
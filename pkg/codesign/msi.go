@@ -0,0 +1,751 @@
+package codesign
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/binary"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"unicode"
+	"unicode/utf16"
+
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+)
+
+// MSI (and MSP) is OLE compound file (https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-cfb), signature is stored in the DigitalSignature stream of the root storage
+const (
+	cfbHeaderSize         = 512
+	cfbDirectoryEntrySize = 128
+	cfbMiniSectorSize     = 64
+	cfbMiniStreamCutoff   = 4096
+	cfbDifatInHeader      = 109
+
+	cfbFreeSector  = 0xFFFFFFFF
+	cfbEndOfChain  = 0xFFFFFFFE
+	cfbFatSector   = 0xFFFFFFFD
+	cfbDifatSector = 0xFFFFFFFC
+	cfbNoStream    = 0xFFFFFFFF
+
+	cfbTypeStorage = 1
+	cfbTypeStream  = 2
+	cfbTypeRoot    = 5
+)
+
+var cfbSignature = []byte{0xd0, 0xcf, 0x11, 0xe0, 0xa1, 0xb1, 0x1a, 0xe1}
+
+// SIP of MSI packages
+var msiSipGuid = []byte{0xf1, 0x10, 0x0c, 0x00, 0x00, 0x00, 0x00, 0x00, 0xc0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x46}
+
+var (
+	msiDigitalSignatureName   = utf16.Encode([]rune("\x05DigitalSignature"))
+	msiDigitalSignatureExName = utf16.Encode([]rune("\x05MsiDigitalSignatureEx"))
+)
+
+type cfbEntry struct {
+	name []uint16
+	// directory entry as read, CLSID, state bits and times are preserved
+	raw       []byte
+	isStorage bool
+	children  []*cfbEntry
+
+	size int64
+	// sectors of stream stored in the file, data of mini stream (or of added stream) otherwise
+	sectors []uint32
+	data    []byte
+}
+
+type compoundFile struct {
+	reader       io.ReaderAt
+	majorVersion uint16
+	sectorSize   int64
+	root         *cfbEntry
+}
+
+// signMsi signs MSI package: signature covers content of all streams (sorted by name, recursively) and CLSID of storages except the signature streams.
+// Existing signature (and MsiDigitalSignatureEx, not produced) is replaced. File is rewritten, layout of sectors is not preserved.
+func signMsi(requestContext context.Context, file string, signer Signer, timestamps *timestampPool) error {
+	outFile, err := util.TempFile(filepath.Dir(file), ".msi")
+	if err != nil {
+		return err
+	}
+
+	err = writeSignedMsi(requestContext, file, outFile, signer, timestamps)
+	if err != nil {
+		_ = os.Remove(outFile)
+		return err
+	}
+	return errors.WithStack(os.Rename(outFile, file))
+}
+
+func writeSignedMsi(requestContext context.Context, file string, outFile string, signer Signer, timestamps *timestampPool) error {
+	reader, err := os.Open(file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(reader)
+
+	info, err := reader.Stat()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	compound, err := readCompoundFile(reader, info.Size())
+	if err != nil {
+		return errors.WithMessage(err, file)
+	}
+
+	root := compound.root
+	children := root.children[:0]
+	for _, child := range root.children {
+		if !isMsiSignatureEntry(child) {
+			children = append(children, child)
+		}
+	}
+	root.children = children
+
+	digest := sha256.New()
+	err = compound.hashStorage(root, digest)
+	if err != nil {
+		return err
+	}
+
+	sipInfo, err := asn1.Marshal(spcSipInfo{Version: 1, Guid: msiSipGuid})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	signature, err := createAuthenticodeSignature(requestContext, spcIndirectDataContent{
+		Data:          spcAttributeTypeAndOptionalValue{Type: oidSpcSipInfo, Value: asn1.RawValue{FullBytes: sipInfo}},
+		MessageDigest: digestInfo{DigestAlgorithm: sha256AlgorithmIdentifier, Digest: digest.Sum(nil)},
+	}, signer)
+	if err != nil {
+		return err
+	}
+	if timestamps != nil {
+		err = timestamps.addTimestamp(requestContext, signature)
+		if err != nil {
+			return err
+		}
+	}
+
+	signatureData, err := signature.encode()
+	if err != nil {
+		return err
+	}
+	root.children = append(root.children, &cfbEntry{name: msiDigitalSignatureName, size: int64(len(signatureData)), data: signatureData})
+
+	writer, err := os.Create(outFile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	bufferedWriter := bufio.NewWriter(writer)
+	err = compound.write(bufferedWriter)
+	if err == nil {
+		err = errors.WithStack(bufferedWriter.Flush())
+	}
+	return fsutil.CloseAndCheckError(err, writer)
+}
+
+func isMsiSignatureEntry(entry *cfbEntry) bool {
+	return !entry.isStorage && (equalUtf16(entry.name, msiDigitalSignatureName) || equalUtf16(entry.name, msiDigitalSignatureExName))
+}
+
+// hashStorage hashes children sorted by binary name (shorter first if one is prefix of another), CLSID of the storage is hashed after children
+func (t *compoundFile) hashStorage(storage *cfbEntry, hash hash.Hash) error {
+	children := append([]*cfbEntry(nil), storage.children...)
+	sort.Slice(children, func(i, j int) bool {
+		return bytes.Compare(utf16Bytes(children[i].name), utf16Bytes(children[j].name)) < 0
+	})
+
+	for _, child := range children {
+		if child.isStorage {
+			err := t.hashStorage(child, hash)
+			if err != nil {
+				return err
+			}
+		} else {
+			_, err := io.CopyN(hash, t.openStream(child), child.size)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+	hash.Write(storage.clsid())
+	return nil
+}
+
+func (t *cfbEntry) clsid() []byte {
+	if t.raw == nil {
+		return make([]byte, 16)
+	}
+	return t.raw[80:96]
+}
+
+func (t *compoundFile) openStream(entry *cfbEntry) io.Reader {
+	if entry.sectors == nil {
+		return bytes.NewReader(entry.data)
+	}
+
+	var readers []io.Reader
+	remaining := entry.size
+	for _, sector := range entry.sectors {
+		size := t.sectorSize
+		if remaining < size {
+			size = remaining
+		}
+		readers = append(readers, io.NewSectionReader(t.reader, t.sectorOffset(sector), size))
+		remaining -= size
+	}
+	return io.MultiReader(readers...)
+}
+
+func (t *compoundFile) sectorOffset(sector uint32) int64 {
+	// header occupies the first sector (512 bytes of 4096 in version 4)
+	return (int64(sector) + 1) * t.sectorSize
+}
+
+func readCompoundFile(reader io.ReaderAt, size int64) (*compoundFile, error) {
+	header := make([]byte, cfbHeaderSize)
+	_, err := reader.ReadAt(header, 0)
+	if err != nil || !bytes.Equal(header[:8], cfbSignature) {
+		return nil, util.NewMessageError("not a compound file (MSI)", "ERR_SIGN_INVALID_PACKAGE")
+	}
+
+	result := &compoundFile{reader: reader, majorVersion: binary.LittleEndian.Uint16(header[26:])}
+	sectorShift := binary.LittleEndian.Uint16(header[30:])
+	if !(result.majorVersion == 3 && sectorShift == 9) && !(result.majorVersion == 4 && sectorShift == 12) {
+		return nil, util.NewMessageError("unsupported compound file version", "ERR_SIGN_INVALID_PACKAGE")
+	}
+	result.sectorSize = 1 << sectorShift
+	// header is not counted
+	sectorCount := (size+result.sectorSize-1)/result.sectorSize - 1
+
+	readSector := func(sector uint32) ([]byte, error) {
+		if int64(sector) >= sectorCount {
+			return nil, util.NewMessageError("sector is out of file", "ERR_SIGN_INVALID_PACKAGE")
+		}
+		data := make([]byte, result.sectorSize)
+		_, err := reader.ReadAt(data, result.sectorOffset(sector))
+		if err != nil && err != io.EOF {
+			return nil, errors.WithStack(err)
+		}
+		return data, nil
+	}
+
+	// FAT sectors are listed in the header and DIFAT chain
+	var fatSectors []uint32
+	for i := 0; i < cfbDifatInHeader; i++ {
+		fatSectors = append(fatSectors, binary.LittleEndian.Uint32(header[76+i*4:]))
+	}
+	difatSector := binary.LittleEndian.Uint32(header[68:])
+	for i := binary.LittleEndian.Uint32(header[72:]); i > 0 && difatSector < cfbDifatSector; i-- {
+		data, err := readSector(difatSector)
+		if err != nil {
+			return nil, err
+		}
+		last := len(data) - 4
+		for offset := 0; offset < last; offset += 4 {
+			fatSectors = append(fatSectors, binary.LittleEndian.Uint32(data[offset:]))
+		}
+		difatSector = binary.LittleEndian.Uint32(data[last:])
+	}
+
+	fatSectorCount := int(binary.LittleEndian.Uint32(header[44:]))
+	if fatSectorCount > len(fatSectors) {
+		return nil, util.NewMessageError("FAT is truncated", "ERR_SIGN_INVALID_PACKAGE")
+	}
+	var fat []uint32
+	for _, sector := range fatSectors[:fatSectorCount] {
+		data, err := readSector(sector)
+		if err != nil {
+			return nil, err
+		}
+		fat = appendUint32s(fat, data)
+	}
+
+	readChain := func(table []uint32, start uint32) ([]uint32, error) {
+		var chain []uint32
+		if start == cfbFreeSector {
+			return nil, nil
+		}
+		for sector := start; sector != cfbEndOfChain; sector = table[sector] {
+			if int(sector) >= len(table) || len(chain) >= len(table) {
+				return nil, util.NewMessageError("sector chain is corrupted", "ERR_SIGN_INVALID_PACKAGE")
+			}
+			chain = append(chain, sector)
+		}
+		return chain, nil
+	}
+	readChainData := func(start uint32) ([]byte, error) {
+		chain, err := readChain(fat, start)
+		if err != nil {
+			return nil, err
+		}
+		var result []byte
+		for _, sector := range chain {
+			data, err := readSector(sector)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, data...)
+		}
+		return result, nil
+	}
+
+	directory, err := readChainData(binary.LittleEndian.Uint32(header[48:]))
+	if err != nil {
+		return nil, err
+	}
+	miniFatData, err := readChainData(binary.LittleEndian.Uint32(header[60:]))
+	if err != nil {
+		return nil, err
+	}
+	miniFat := appendUint32s(nil, miniFatData)
+
+	entryCount := uint32(len(directory) / cfbDirectoryEntrySize)
+	if entryCount == 0 {
+		return nil, util.NewMessageError("compound file has no root storage", "ERR_SIGN_INVALID_PACKAGE")
+	}
+	rawEntries := make([][]byte, entryCount)
+	for i := range rawEntries {
+		rawEntries[i] = directory[i*cfbDirectoryEntrySize : (i+1)*cfbDirectoryEntrySize]
+	}
+
+	var miniStream []byte
+	visited := make([]bool, entryCount)
+	var readEntry func(id uint32) (*cfbEntry, error)
+	// children of storage are red-black tree, order is not important - storage is hashed and written sorted
+	var readChildren func(id uint32, storage *cfbEntry) error
+	readChildren = func(id uint32, storage *cfbEntry) error {
+		if id == cfbNoStream {
+			return nil
+		}
+		if id >= entryCount || visited[id] {
+			return util.NewMessageError("directory is corrupted", "ERR_SIGN_INVALID_PACKAGE")
+		}
+		visited[id] = true
+
+		raw := rawEntries[id]
+		entry, err := readEntry(id)
+		if err != nil {
+			return err
+		}
+		storage.children = append(storage.children, entry)
+		err = readChildren(binary.LittleEndian.Uint32(raw[68:]), storage)
+		if err != nil {
+			return err
+		}
+		return readChildren(binary.LittleEndian.Uint32(raw[72:]), storage)
+	}
+	readEntry = func(id uint32) (*cfbEntry, error) {
+		raw := rawEntries[id]
+		nameLength := int(binary.LittleEndian.Uint16(raw[64:]))/2 - 1
+		if nameLength < 0 || nameLength > 31 {
+			return nil, util.NewMessageError("directory entry name is invalid", "ERR_SIGN_INVALID_PACKAGE")
+		}
+		entry := &cfbEntry{name: appendUint16s(nil, raw[:nameLength*2]), raw: raw}
+		entryType := raw[66]
+		start := binary.LittleEndian.Uint32(raw[116:])
+		entry.size = int64(binary.LittleEndian.Uint64(raw[120:]))
+		if result.majorVersion == 3 {
+			entry.size &= 0xFFFFFFFF
+		}
+
+		switch {
+		case entryType == cfbTypeStorage || entryType == cfbTypeRoot:
+			entry.isStorage = true
+			if entryType == cfbTypeRoot {
+				// mini stream is the stream of the root storage
+				var err error
+				miniStream, err = readChainData(start)
+				if err != nil {
+					return nil, err
+				}
+			}
+			return entry, readChildren(binary.LittleEndian.Uint32(raw[76:]), entry)
+
+		case entryType != cfbTypeStream:
+			return nil, util.NewMessageError("directory entry type is invalid", "ERR_SIGN_INVALID_PACKAGE")
+
+		case entry.size >= cfbMiniStreamCutoff:
+			var err error
+			entry.sectors, err = readChain(fat, start)
+			if err != nil {
+				return nil, err
+			}
+			if int64(len(entry.sectors))*result.sectorSize < entry.size {
+				return nil, util.NewMessageError("stream is truncated", "ERR_SIGN_INVALID_PACKAGE")
+			}
+
+		case entry.size > 0:
+			chain, err := readChain(miniFat, start)
+			if err != nil {
+				return nil, err
+			}
+			for _, sector := range chain {
+				offset := int(sector) * cfbMiniSectorSize
+				if offset+cfbMiniSectorSize > len(miniStream) {
+					return nil, util.NewMessageError("mini stream is truncated", "ERR_SIGN_INVALID_PACKAGE")
+				}
+				entry.data = append(entry.data, miniStream[offset:offset+cfbMiniSectorSize]...)
+			}
+			if int64(len(entry.data)) < entry.size {
+				return nil, util.NewMessageError("stream is truncated", "ERR_SIGN_INVALID_PACKAGE")
+			}
+			entry.data = entry.data[:entry.size]
+		}
+		return entry, nil
+	}
+
+	if rawEntries[0][66] != cfbTypeRoot {
+		return nil, util.NewMessageError("compound file has no root storage", "ERR_SIGN_INVALID_PACKAGE")
+	}
+	visited[0] = true
+	result.root, err = readEntry(0)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// write writes compound file of the same version: stream sectors, mini stream, mini FAT, directory, FAT and DIFAT
+func (t *compoundFile) write(writer io.Writer) error {
+	entries := flattenCfbEntries(t.root, nil)
+	sectorSize := t.sectorSize
+	sectorCountOf := func(size int64) uint32 {
+		return uint32((size + sectorSize - 1) / sectorSize)
+	}
+
+	var fat []uint32
+	allocate := func(count uint32, marker uint32) uint32 {
+		start := uint32(len(fat))
+		for i := uint32(0); i < count; i++ {
+			next := start + i + 1
+			if marker != 0 {
+				next = marker
+			} else if i == count-1 {
+				next = cfbEndOfChain
+			}
+			fat = append(fat, next)
+		}
+		if count == 0 {
+			return cfbEndOfChain
+		}
+		return start
+	}
+
+	starts := make([]uint32, len(entries))
+	var miniStream []byte
+	var miniFat []uint32
+	for index, entry := range entries {
+		if entry.isStorage {
+			continue
+		}
+		if entry.size >= cfbMiniStreamCutoff {
+			starts[index] = allocate(sectorCountOf(entry.size), 0)
+			continue
+		}
+		if entry.size == 0 {
+			starts[index] = cfbEndOfChain
+			continue
+		}
+
+		start := uint32(len(miniFat))
+		count := uint32((entry.size + cfbMiniSectorSize - 1) / cfbMiniSectorSize)
+		for i := uint32(0); i < count; i++ {
+			if i == count-1 {
+				miniFat = append(miniFat, cfbEndOfChain)
+			} else {
+				miniFat = append(miniFat, start+i+1)
+			}
+		}
+		starts[index] = start
+		miniStream = append(miniStream, entry.data...)
+		miniStream = append(miniStream, make([]byte, int(count)*cfbMiniSectorSize-len(entry.data))...)
+	}
+
+	starts[0] = allocate(sectorCountOf(int64(len(miniStream))), 0)
+	miniFatSectorCount := sectorCountOf(int64(len(miniFat) * 4))
+	miniFatStart := allocate(miniFatSectorCount, 0)
+	directorySectorCount := sectorCountOf(int64(len(entries) * cfbDirectoryEntrySize))
+	directoryStart := allocate(directorySectorCount, 0)
+
+	// FAT covers itself and DIFAT
+	entriesPerSector := uint32(sectorSize / 4)
+	dataSectorCount := uint32(len(fat))
+	var fatSectorCount, difatSectorCount uint32
+	for {
+		newFatSectorCount := (dataSectorCount + fatSectorCount + difatSectorCount + entriesPerSector - 1) / entriesPerSector
+		newDifatSectorCount := uint32(0)
+		if newFatSectorCount > cfbDifatInHeader {
+			newDifatSectorCount = (newFatSectorCount - cfbDifatInHeader + entriesPerSector - 2) / (entriesPerSector - 1)
+		}
+		if newFatSectorCount == fatSectorCount && newDifatSectorCount == difatSectorCount {
+			break
+		}
+		fatSectorCount, difatSectorCount = newFatSectorCount, newDifatSectorCount
+	}
+	fatStart := allocate(fatSectorCount, cfbFatSector)
+	difatStart := allocate(difatSectorCount, cfbDifatSector)
+	if difatSectorCount == 0 {
+		difatStart = cfbEndOfChain
+	}
+
+	headerSize := int(sectorSize)
+	header := make([]byte, headerSize)
+	copy(header, cfbSignature)
+	binary.LittleEndian.PutUint16(header[24:], 0x3e)
+	binary.LittleEndian.PutUint16(header[26:], t.majorVersion)
+	binary.LittleEndian.PutUint16(header[28:], 0xfffe)
+	if t.majorVersion == 4 {
+		binary.LittleEndian.PutUint16(header[30:], 12)
+		binary.LittleEndian.PutUint32(header[40:], directorySectorCount)
+	} else {
+		binary.LittleEndian.PutUint16(header[30:], 9)
+	}
+	binary.LittleEndian.PutUint16(header[32:], 6)
+	binary.LittleEndian.PutUint32(header[44:], fatSectorCount)
+	binary.LittleEndian.PutUint32(header[48:], directoryStart)
+	binary.LittleEndian.PutUint32(header[56:], cfbMiniStreamCutoff)
+	binary.LittleEndian.PutUint32(header[60:], miniFatStart)
+	binary.LittleEndian.PutUint32(header[64:], miniFatSectorCount)
+	binary.LittleEndian.PutUint32(header[68:], difatStart)
+	binary.LittleEndian.PutUint32(header[72:], difatSectorCount)
+
+	var difat []uint32
+	for i := uint32(0); i < fatSectorCount; i++ {
+		difat = append(difat, fatStart+i)
+	}
+	for i := 0; i < cfbDifatInHeader; i++ {
+		value := uint32(cfbFreeSector)
+		if i < len(difat) {
+			value = difat[i]
+		}
+		binary.LittleEndian.PutUint32(header[76+i*4:], value)
+	}
+	_, err := writer.Write(header)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, entry := range entries {
+		if entry.isStorage || entry.size < cfbMiniStreamCutoff {
+			continue
+		}
+		_, err = io.CopyN(writer, t.openStream(entry), entry.size)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if padding := entry.size % sectorSize; padding != 0 {
+			_, err = writer.Write(make([]byte, sectorSize-padding))
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+
+	_, err = writer.Write(miniStream)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if padding := int64(len(miniStream)) % sectorSize; padding != 0 {
+		_, err = writer.Write(make([]byte, sectorSize-padding))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	_, err = writer.Write(uint32sToBytes(miniFat, cfbFreeSector, int(miniFatSectorCount)*int(entriesPerSector)))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	directory := make([]byte, int64(directorySectorCount)*sectorSize)
+	ids := make(map[*cfbEntry]uint32, len(entries))
+	for index, entry := range entries {
+		ids[entry] = uint32(index)
+	}
+	for index, entry := range entries {
+		raw := directory[index*cfbDirectoryEntrySize : (index+1)*cfbDirectoryEntrySize]
+		if entry.raw != nil {
+			copy(raw, entry.raw)
+		}
+		for i := range raw[:64] {
+			raw[i] = 0
+		}
+		for i, c := range entry.name {
+			binary.LittleEndian.PutUint16(raw[i*2:], c)
+		}
+		binary.LittleEndian.PutUint16(raw[64:], uint16(len(entry.name)*2+2))
+		switch {
+		case index == 0:
+			raw[66] = cfbTypeRoot
+		case entry.isStorage:
+			raw[66] = cfbTypeStorage
+		default:
+			raw[66] = cfbTypeStream
+		}
+		raw[67] = 1
+		binary.LittleEndian.PutUint32(raw[68:], cfbNoStream)
+		binary.LittleEndian.PutUint32(raw[72:], cfbNoStream)
+		binary.LittleEndian.PutUint32(raw[76:], cfbNoStream)
+
+		if entry.isStorage {
+			binary.LittleEndian.PutUint32(raw[116:], 0)
+			binary.LittleEndian.PutUint64(raw[120:], 0)
+		} else {
+			binary.LittleEndian.PutUint32(raw[116:], starts[index])
+			binary.LittleEndian.PutUint64(raw[120:], uint64(entry.size))
+		}
+	}
+	// root entry holds mini stream
+	binary.LittleEndian.PutUint32(directory[116:], starts[0])
+	binary.LittleEndian.PutUint64(directory[120:], uint64(len(miniStream)))
+	for index := len(entries); index < len(directory)/cfbDirectoryEntrySize; index++ {
+		raw := directory[index*cfbDirectoryEntrySize:]
+		binary.LittleEndian.PutUint32(raw[68:], cfbNoStream)
+		binary.LittleEndian.PutUint32(raw[72:], cfbNoStream)
+		binary.LittleEndian.PutUint32(raw[76:], cfbNoStream)
+	}
+	for _, entry := range entries {
+		if entry.isStorage && len(entry.children) != 0 {
+			children := append([]*cfbEntry(nil), entry.children...)
+			sort.Slice(children, func(i, j int) bool {
+				return compareCfbNames(children[i].name, children[j].name) < 0
+			})
+			child := buildCfbTree(directory, ids, children, 0, maxCfbTreeDepth(len(children)))
+			binary.LittleEndian.PutUint32(directory[int(ids[entry])*cfbDirectoryEntrySize+76:], child)
+		}
+	}
+	_, err = writer.Write(directory)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = writer.Write(uint32sToBytes(fat, cfbFreeSector, int(fatSectorCount)*int(entriesPerSector)))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// DIFAT sector holds FAT sectors not listed in the header and the next DIFAT sector
+	remaining := difat[minInt(len(difat), cfbDifatInHeader):]
+	for i := uint32(0); i < difatSectorCount; i++ {
+		count := minInt(len(remaining), int(entriesPerSector-1))
+		next := uint32(cfbEndOfChain)
+		if i < difatSectorCount-1 {
+			next = difatStart + i + 1
+		}
+		data := uint32sToBytes(remaining[:count], cfbFreeSector, int(entriesPerSector-1))
+		remaining = remaining[count:]
+		_, err = writer.Write(append(data, uint32sToBytes([]uint32{next}, 0, 0)...))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+func flattenCfbEntries(entry *cfbEntry, result []*cfbEntry) []*cfbEntry {
+	result = append(result, entry)
+	for _, child := range entry.children {
+		result = flattenCfbEntries(child, result)
+	}
+	return result
+}
+
+// buildCfbTree links sorted siblings as balanced tree: all nodes are black except the deepest level, so, it is valid red-black tree
+func buildCfbTree(directory []byte, ids map[*cfbEntry]uint32, siblings []*cfbEntry, depth int, maxDepth int) uint32 {
+	if len(siblings) == 0 {
+		return cfbNoStream
+	}
+
+	middle := len(siblings) / 2
+	id := ids[siblings[middle]]
+	raw := directory[int(id)*cfbDirectoryEntrySize:]
+	if depth == maxDepth && depth > 0 {
+		raw[67] = 0
+	}
+	binary.LittleEndian.PutUint32(raw[68:], buildCfbTree(directory, ids, siblings[:middle], depth+1, maxDepth))
+	binary.LittleEndian.PutUint32(raw[72:], buildCfbTree(directory, ids, siblings[middle+1:], depth+1, maxDepth))
+	return id
+}
+
+func maxCfbTreeDepth(count int) int {
+	depth := -1
+	for ; count > 0; count /= 2 {
+		depth++
+	}
+	return depth
+}
+
+// names in directory are compared by length first, then by upper-cased UTF-16 code units
+func compareCfbNames(a []uint16, b []uint16) int {
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+	for i := range a {
+		x := unicode.ToUpper(rune(a[i]))
+		y := unicode.ToUpper(rune(b[i]))
+		if x != y {
+			return int(x) - int(y)
+		}
+	}
+	return 0
+}
+
+func equalUtf16(a []uint16, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func utf16Bytes(name []uint16) []byte {
+	result := make([]byte, len(name)*2)
+	for i, c := range name {
+		binary.LittleEndian.PutUint16(result[i*2:], c)
+	}
+	return result
+}
+
+func appendUint16s(result []uint16, data []byte) []uint16 {
+	for offset := 0; offset+2 <= len(data); offset += 2 {
+		result = append(result, binary.LittleEndian.Uint16(data[offset:]))
+	}
+	return result
+}
+
+func appendUint32s(result []uint32, data []byte) []uint32 {
+	for offset := 0; offset+4 <= len(data); offset += 4 {
+		result = append(result, binary.LittleEndian.Uint32(data[offset:]))
+	}
+	return result
+}
+
+// uint32sToBytes encodes values, filling up to count with filler
+func uint32sToBytes(values []uint32, filler uint32, count int) []byte {
+	if count < len(values) {
+		count = len(values)
+	}
+	result := make([]byte, count*4)
+	for i := 0; i < count; i++ {
+		value := filler
+		if i < len(values) {
+			value = values[i]
+		}
+		binary.LittleEndian.PutUint32(result[i*4:], value)
+	}
+	return result
+}
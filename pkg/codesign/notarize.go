@@ -0,0 +1,518 @@
+package codesign
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	appBuilderCredentials "github.com/develar/app-builder/pkg/credentials"
+	"github.com/develar/app-builder/pkg/fakes"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/json-iterator/go"
+	"go.uber.org/zap"
+)
+
+// content of .p8 file (App Store Connect API key), used if --api-key is not specified
+const NotarizeApiKeyCredentialName = "notarize-api-key"
+
+const (
+	NotarizeStatusInProgress = "In Progress"
+	NotarizeStatusAccepted   = "Accepted"
+	NotarizeStatusInvalid    = "Invalid"
+	NotarizeStatusRejected   = "Rejected"
+)
+
+// the same API as used by notarytool
+var notaryApiUrl = "https://appstoreconnect.apple.com/notary/v2"
+
+// uploadSubmission is replaced in tests
+var uploadSubmission = uploadSubmissionToS3
+
+type NotarizeOptions struct {
+	// zip, dmg or pkg
+	File string
+
+	// .p8 file of App Store Connect API key
+	ApiKey    string
+	ApiKeyId  string
+	ApiIssuer string
+
+	// .app or .dmg to staple ticket to after acceptance, not stapled if empty
+	Staple string
+	// file to save developer log to (the log is always fetched if submission is not accepted)
+	LogFile string
+
+	Timeout time.Duration
+	// initial interval between status requests, doubled up to max interval
+	PollInterval    time.Duration
+	MaxPollInterval time.Duration
+}
+
+type NotarizeIssue struct {
+	Severity     string      `json:"severity"`
+	Code         interface{} `json:"code,omitempty"`
+	Path         string      `json:"path,omitempty"`
+	Message      string      `json:"message"`
+	DocUrl       string      `json:"docUrl,omitempty"`
+	Architecture string      `json:"architecture,omitempty"`
+}
+
+type NotarizeResult struct {
+	Id      string           `json:"id"`
+	File    string           `json:"file"`
+	Sha256  string           `json:"sha256"`
+	Status  string           `json:"status"`
+	Summary string           `json:"summary,omitempty"`
+	Issues  []*NotarizeIssue `json:"issues,omitempty"`
+	Stapled string           `json:"stapled,omitempty"`
+	// duration of waiting for the notarization result
+	Duration int64 `json:"durationMs"`
+}
+
+type submissionCredentials struct {
+	AccessKeyId     string `json:"awsAccessKeyId"`
+	SecretAccessKey string `json:"awsSecretAccessKey"`
+	SessionToken    string `json:"awsSessionToken"`
+	Bucket          string `json:"bucket"`
+	Object          string `json:"object"`
+}
+
+type developerLog struct {
+	Status        string           `json:"status"`
+	StatusSummary string           `json:"statusSummary"`
+	Issues        []*NotarizeIssue `json:"issues"`
+}
+
+func configureNotarizeCommand(codesignCommand *kingpin.CmdClause) {
+	command := codesignCommand.Command("notarize", "Submit zip, dmg or pkg for notarization (App Store Connect API key auth), wait for the result and staple the ticket. "+
+		"Xcode is not required. Result is written to stdout as JSON.")
+	options := NotarizeOptions{}
+	command.Flag("file", "The file to notarize (zip, dmg or pkg).").Required().ExistingFileVar(&options.File)
+	command.Flag("api-key", "The .p8 file of App Store Connect API key (default: "+appBuilderCredentials.ToEnvName(NotarizeApiKeyCredentialName)+" env or credentials helper).").ExistingFileVar(&options.ApiKey)
+	command.Flag("api-key-id", "The App Store Connect API key ID.").Envar("APPLE_API_KEY_ID").Required().StringVar(&options.ApiKeyId)
+	command.Flag("api-issuer", "The App Store Connect API issuer ID.").Envar("APPLE_API_ISSUER").Required().StringVar(&options.ApiIssuer)
+	command.Flag("staple", "The .app (for zip) or .dmg to staple the ticket to.").StringVar(&options.Staple)
+	command.Flag("log", "The file to save the notarization log to.").StringVar(&options.LogFile)
+	command.Flag("timeout", "The max time to wait for the result.").Default("1h").DurationVar(&options.Timeout)
+	command.Flag("poll-interval", "The initial interval between status requests.").Default("15s").DurationVar(&options.PollInterval)
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		result, err := Notarize(options)
+		if result != nil {
+			writeError := util.WriteJsonToStdOut(result)
+			if err == nil {
+				err = writeError
+			}
+		}
+		return err
+	})
+}
+
+// Notarize uploads the file and waits for the result. Error is returned if notarization is not accepted (result is returned as well, with issues from the developer log).
+func Notarize(options NotarizeOptions) (*NotarizeResult, error) {
+	hash, err := computeFileSha256(options.File)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &NotarizeResult{File: options.File, Sha256: hash}
+	if fakes.IsEnabled() {
+		result.Status = NotarizeStatusAccepted
+		return result, fakes.Record(fakes.ServiceNotary, "Submit", map[string]interface{}{
+			"name":   filepath.Base(options.File),
+			"sha256": hash,
+			"staple": options.Staple,
+		})
+	}
+
+	client, err := newNotaryClient(&options)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.Timeout <= 0 {
+		options.Timeout = time.Hour
+	}
+	requestContext, cancel := util.CreateContextWithTimeout(options.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	var submission struct {
+		Data struct {
+			Id         string                `json:"id"`
+			Attributes submissionCredentials `json:"attributes"`
+		} `json:"data"`
+	}
+	err = client.request(requestContext, http.MethodPost, notaryApiUrl+"/submissions", map[string]string{
+		"submissionName": filepath.Base(options.File),
+		"sha256":         hash,
+	}, &submission)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot create notarization submission")
+	}
+
+	result.Id = submission.Data.Id
+	logger := log.LOG.With(zap.String("file", options.File), zap.String("id", result.Id))
+	logger.Info("uploading for notarization")
+	err = uploadSubmission(requestContext, &submission.Data.Attributes, options.File)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot upload file for notarization")
+	}
+
+	result.Status, err = client.waitForResult(requestContext, result.Id, &options, logger)
+	result.Duration = time.Since(start).Milliseconds()
+	if err != nil {
+		return result, err
+	}
+
+	if result.Status != NotarizeStatusAccepted || options.LogFile != "" {
+		logData, err := client.fetchLog(requestContext, result.Id)
+		if err != nil {
+			logger.Warn("cannot fetch notarization log", zap.Error(err))
+		} else {
+			err = applyDeveloperLog(result, logData, options.LogFile)
+			if err != nil {
+				return result, err
+			}
+		}
+	}
+
+	if result.Status != NotarizeStatusAccepted {
+		for _, issue := range result.Issues {
+			logger.Error("notarization issue", zap.String("severity", issue.Severity), zap.String("path", issue.Path), zap.String("message", issue.Message))
+		}
+		message := "notarization of " + filepath.Base(options.File) + " failed: " + result.Status
+		if result.Summary != "" {
+			message += " (" + result.Summary + ")"
+		}
+		return result, util.NewMessageError(message, "ERR_NOTARIZE_REJECTED")
+	}
+
+	logger.Info("notarization accepted", zap.Duration("duration", time.Since(start)))
+	if options.Staple != "" {
+		err = Staple(requestContext, options.Staple)
+		if err != nil {
+			return result, err
+		}
+		result.Stapled = options.Staple
+	}
+	return result, nil
+}
+
+type notaryClient struct {
+	keyId      string
+	issuer     string
+	privateKey *ecdsa.PrivateKey
+	httpClient *http.Client
+}
+
+func newNotaryClient(options *NotarizeOptions) (*notaryClient, error) {
+	var keyData []byte
+	if options.ApiKey == "" {
+		value, err := appBuilderCredentials.GetRequired(NotarizeApiKeyCredentialName)
+		if err != nil {
+			return nil, err
+		}
+		keyData = []byte(value)
+	} else {
+		var err error
+		keyData, err = ioutil.ReadFile(options.ApiKey)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	privateKey, err := parseApiKey(keyData)
+	if err != nil {
+		return nil, err
+	}
+
+	return &notaryClient{
+		keyId:      options.ApiKeyId,
+		issuer:     options.ApiIssuer,
+		privateKey: privateKey,
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				Proxy: util.ProxyFromEnvironmentAndNpm,
+			},
+		},
+	}, nil
+}
+
+func parseApiKey(data []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, util.NewMessageError("App Store Connect API key must be in PEM format (.p8 file)", "ERR_NOTARIZE_INVALID_KEY")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, util.NewMessageError("cannot parse App Store Connect API key: "+err.Error(), "ERR_NOTARIZE_INVALID_KEY")
+	}
+
+	ecdsaKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, util.NewMessageError("App Store Connect API key must be an EC key", "ERR_NOTARIZE_INVALID_KEY")
+	}
+	return ecdsaKey, nil
+}
+
+// createToken returns JWT signed with ES256, token is valid for 20 minutes (max allowed by App Store Connect), so, a new token is created for every request
+func (t *notaryClient) createToken() (string, error) {
+	now := time.Now()
+	header, err := jsoniter.Marshal(map[string]string{"alg": "ES256", "kid": t.keyId, "typ": "JWT"})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	payload, err := jsoniter.Marshal(map[string]interface{}{
+		"iss": t.issuer,
+		"iat": now.Unix(),
+		"exp": now.Add(20 * time.Minute).Unix(),
+		"aud": "appstoreconnect-v1",
+	})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	encoding := base64.RawURLEncoding
+	signingInput := encoding.EncodeToString(header) + "." + encoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, t.privateKey, digest[:])
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	// JWS signature is R || S, each is padded to the curve size
+	size := (t.privateKey.Curve.Params().BitSize + 7) / 8
+	signature := make([]byte, 2*size)
+	writeBigInt(signature[:size], r)
+	writeBigInt(signature[size:], s)
+	return signingInput + "." + encoding.EncodeToString(signature), nil
+}
+
+func writeBigInt(buffer []byte, value *big.Int) {
+	data := value.Bytes()
+	copy(buffer[len(buffer)-len(data):], data)
+}
+
+func (t *notaryClient) request(requestContext context.Context, method string, url string, body interface{}, result interface{}) error {
+	var bodyReader io.Reader
+	if body != nil {
+		data, err := jsoniter.Marshal(body)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		bodyReader = bytes.NewReader(data)
+	}
+
+	request, err := http.NewRequest(method, url, bodyReader)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	token, err := t.createToken()
+	if err != nil {
+		return err
+	}
+
+	request = request.WithContext(requestContext)
+	request.Header.Set("Accept", "application/json")
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "Bearer "+token)
+
+	response, err := t.httpClient.Do(request)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(response.Body)
+
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return &notaryApiError{statusCode: response.StatusCode, body: strings.TrimSpace(string(responseBody))}
+	}
+	return errors.WithStack(jsoniter.Unmarshal(responseBody, result))
+}
+
+type notaryApiError struct {
+	statusCode int
+	body       string
+}
+
+func (t *notaryApiError) Error() string {
+	return "notary service responded with " + http.StatusText(t.statusCode) + ": " + t.body
+}
+
+func (t *notaryApiError) isTransient() bool {
+	return t.statusCode >= 500 || t.statusCode == http.StatusTooManyRequests
+}
+
+// waitForResult polls status with exponential backoff. Transient errors (5xx, 429) are retried until timeout.
+func (t *notaryClient) waitForResult(requestContext context.Context, id string, options *NotarizeOptions, logger *zap.Logger) (string, error) {
+	interval := options.PollInterval
+	if interval <= 0 {
+		interval = 15 * time.Second
+	}
+	maxInterval := options.MaxPollInterval
+	if maxInterval <= 0 {
+		maxInterval = 2 * time.Minute
+	}
+
+	for {
+		var status struct {
+			Data struct {
+				Attributes struct {
+					Status string `json:"status"`
+				} `json:"attributes"`
+			} `json:"data"`
+		}
+		err := t.request(requestContext, http.MethodGet, notaryApiUrl+"/submissions/"+id, nil, &status)
+		if err != nil {
+			apiError, ok := errors.Cause(err).(*notaryApiError)
+			if !ok || !apiError.isTransient() {
+				if requestContext.Err() != nil {
+					return NotarizeStatusInProgress, createNotarizeTimeoutError(id, options)
+				}
+				return "", errors.WithMessage(err, "cannot get notarization status")
+			}
+			logger.Warn("cannot get notarization status, retrying", zap.Error(err))
+		} else if status.Data.Attributes.Status != NotarizeStatusInProgress {
+			return status.Data.Attributes.Status, nil
+		}
+
+		logger.Debug("notarization is in progress", zap.Duration("nextCheck", interval))
+		select {
+		case <-requestContext.Done():
+			return NotarizeStatusInProgress, createNotarizeTimeoutError(id, options)
+		case <-time.After(interval):
+		}
+
+		interval *= 2
+		if interval > maxInterval {
+			interval = maxInterval
+		}
+	}
+}
+
+func createNotarizeTimeoutError(id string, options *NotarizeOptions) error {
+	return util.NewMessageError("notarization "+id+" is not completed in "+options.Timeout.String(), "ERR_NOTARIZE_TIMEOUT")
+}
+
+func (t *notaryClient) fetchLog(requestContext context.Context, id string) ([]byte, error) {
+	var logInfo struct {
+		Data struct {
+			Attributes struct {
+				DeveloperLogUrl string `json:"developerLogUrl"`
+			} `json:"attributes"`
+		} `json:"data"`
+	}
+	err := t.request(requestContext, http.MethodGet, notaryApiUrl+"/submissions/"+id+"/logs", nil, &logInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	// pre-signed URL, authorization header must not be sent
+	request, err := http.NewRequest(http.MethodGet, logInfo.Data.Attributes.DeveloperLogUrl, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	response, err := t.httpClient.Do(request.WithContext(requestContext))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer util.Close(response.Body)
+
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("cannot download notarization log: %s", response.Status)
+	}
+	data, err := ioutil.ReadAll(response.Body)
+	return data, errors.WithStack(err)
+}
+
+func applyDeveloperLog(result *NotarizeResult, data []byte, logFile string) error {
+	if logFile != "" {
+		err := ioutil.WriteFile(logFile, data, 0644)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	var developerLog developerLog
+	err := jsoniter.Unmarshal(data, &developerLog)
+	if err != nil {
+		log.Warn("cannot parse notarization log", zap.Error(err))
+		return nil
+	}
+
+	result.Summary = developerLog.StatusSummary
+	result.Issues = developerLog.Issues
+	return nil
+}
+
+// uploadSubmissionToS3 uploads the file using temporary credentials of the submission (notarytool uses the same bucket in us-west-2)
+func uploadSubmissionToS3(requestContext context.Context, submission *submissionCredentials, file string) error {
+	awsSession, err := session.NewSession(&aws.Config{
+		Region:      aws.String("us-west-2"),
+		Credentials: credentials.NewStaticCredentials(submission.AccessKeyId, submission.SecretAccessKey, submission.SessionToken),
+		HTTPClient: &http.Client{
+			Transport: &http.Transport{
+				Proxy: util.ProxyFromEnvironmentAndNpm,
+			},
+		},
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	reader, err := os.Open(file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(reader)
+
+	_, err = s3manager.NewUploader(awsSession).UploadWithContext(requestContext, &s3manager.UploadInput{
+		Bucket: aws.String(submission.Bucket),
+		Key:    aws.String(submission.Object),
+		Body:   reader,
+	})
+	return errors.WithStack(err)
+}
+
+func computeFileSha256(file string) (string, error) {
+	reader, err := os.Open(file)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer util.Close(reader)
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, reader)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,156 @@
+package codesign
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/json-iterator/go"
+	. "github.com/onsi/gomega"
+)
+
+func verifyTestToken(g *GomegaWithT, token string, publicKey *ecdsa.PublicKey) {
+	parts := strings.Split(token, ".")
+	g.Expect(parts).To(HaveLen(3))
+
+	payloadData, err := base64.RawURLEncoding.DecodeString(parts[1])
+	g.Expect(err).NotTo(HaveOccurred())
+	var payload map[string]interface{}
+	g.Expect(jsoniter.Unmarshal(payloadData, &payload)).To(Succeed())
+	g.Expect(payload).To(HaveKeyWithValue("iss", "issuer"))
+	g.Expect(payload).To(HaveKeyWithValue("aud", "appstoreconnect-v1"))
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(signature).To(HaveLen(64))
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	g.Expect(ecdsa.Verify(publicKey, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:]))).To(BeTrue())
+}
+
+func TestNotarize(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "notarize")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	g.Expect(err).NotTo(HaveOccurred())
+	keyData, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	g.Expect(err).NotTo(HaveOccurred())
+	keyFile := filepath.Join(dir, "AuthKey.p8")
+	writeFile(g, keyFile, string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyData})))
+
+	dmgSignature := createTestSignature(hashTypeSha256, 1)
+	dmgFile := filepath.Join(dir, "Test.dmg")
+	writeTestDmg(g, dmgFile, dmgSignature)
+	ticketServer := startTicketServer(g, map[string]string{getTestRecordName(dmgSignature): "ticket"})
+	defer ticketServer.Close()
+
+	// submission "rejected" is invalid, "accepted" is accepted after one in progress response and one server error
+	statusRequestCount := 0
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path != "/developer-log" {
+			g.Expect(request.Header.Get("Authorization")).To(HavePrefix("Bearer "))
+			verifyTestToken(g, strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer "), &privateKey.PublicKey)
+		}
+
+		switch request.URL.Path {
+		case "/submissions":
+			body, _ := ioutil.ReadAll(request.Body)
+			id := "accepted"
+			if strings.Contains(string(body), "Rejected.zip") {
+				id = "rejected"
+			}
+			_, _ = writer.Write([]byte(`{"data": {"id": "` + id + `", "type": "newSubmissions", "attributes": {"awsAccessKeyId": "key", "bucket": "notary-submissions", "object": "prod/` + id + `"}}}`))
+		case "/submissions/rejected":
+			_, _ = writer.Write([]byte(`{"data": {"id": "rejected", "attributes": {"status": "Invalid"}}}`))
+		case "/submissions/accepted":
+			statusRequestCount++
+			switch statusRequestCount {
+			case 1:
+				_, _ = writer.Write([]byte(`{"data": {"id": "accepted", "attributes": {"status": "In Progress"}}}`))
+			case 2:
+				writer.WriteHeader(http.StatusServiceUnavailable)
+			default:
+				_, _ = writer.Write([]byte(`{"data": {"id": "accepted", "attributes": {"status": "Accepted"}}}`))
+			}
+		case "/submissions/rejected/logs":
+			_, _ = writer.Write([]byte(`{"data": {"attributes": {"developerLogUrl": "` + server.URL + `/developer-log"}}}`))
+		case "/developer-log":
+			g.Expect(request.Header.Get("Authorization")).To(BeEmpty())
+			_, _ = writer.Write([]byte(`{"status": "Invalid", "statusSummary": "Archive contains critical validation errors", "issues": [
+				{"severity": "error", "code": null, "path": "Rejected.zip/Test.app/Contents/MacOS/Test", "message": "The binary is not signed.", "architecture": "arm64"}
+			]}`))
+		default:
+			writer.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	notaryApiUrl = server.URL
+
+	var uploaded []string
+	uploadSubmission = func(requestContext context.Context, submission *submissionCredentials, file string) error {
+		uploaded = append(uploaded, submission.Bucket+"/"+submission.Object+":"+filepath.Base(file))
+		return nil
+	}
+	defer func() {
+		uploadSubmission = uploadSubmissionToS3
+	}()
+
+	options := NotarizeOptions{
+		File:         dmgFile,
+		ApiKey:       keyFile,
+		ApiKeyId:     "keyId",
+		ApiIssuer:    "issuer",
+		Staple:       dmgFile,
+		Timeout:      time.Minute,
+		PollInterval: time.Millisecond,
+	}
+	result, err := Notarize(options)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.Id).To(Equal("accepted"))
+	g.Expect(result.Status).To(Equal(NotarizeStatusAccepted))
+	g.Expect(result.Stapled).To(Equal(dmgFile))
+	g.Expect(statusRequestCount).To(Equal(3))
+
+	signature, _, err := readDmgCodeSignature(dmgFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	entries, err := parseSuperBlob(signature)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(entries[len(entries)-1].data)).To(Equal("ticket"))
+
+	rejectedFile := filepath.Join(dir, "Rejected.zip")
+	writeFile(g, rejectedFile, "zip")
+	options.File = rejectedFile
+	options.Staple = ""
+	options.LogFile = filepath.Join(dir, "log.json")
+	result, err = Notarize(options)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.(interface{ ErrorCode() string }).ErrorCode()).To(Equal("ERR_NOTARIZE_REJECTED"))
+	g.Expect(err.Error()).To(ContainSubstring("Archive contains critical validation errors"))
+	g.Expect(result.Status).To(Equal(NotarizeStatusInvalid))
+	g.Expect(result.Issues).To(HaveLen(1))
+	g.Expect(result.Issues[0].Message).To(Equal("The binary is not signed."))
+	g.Expect(result.Issues[0].Architecture).To(Equal("arm64"))
+	g.Expect(options.LogFile).To(BeAnExistingFile())
+
+	g.Expect(uploaded).To(Equal([]string{"notary-submissions/prod/accepted:Test.dmg", "notary-submissions/prod/rejected:Rejected.zip"}))
+}
@@ -67,17 +67,7 @@ func readInfo(inFile string, password string) error {
 		return fmt.Errorf("no certificates")
 	}
 
-	var firstCert *x509.Certificate
-certLoop:
-	for _, cert := range certificates {
-		for _, usage := range cert.ExtKeyUsage {
-			if usage == x509.ExtKeyUsageCodeSigning {
-				firstCert = cert
-				break certLoop
-			}
-		}
-	}
-
+	firstCert := FindCodeSigningCertificate(certificates)
 	if firstCert == nil {
 		return fmt.Errorf("no certificates with ExtKeyUsageCodeSigning")
 	}
@@ -96,6 +86,18 @@ certLoop:
 	return util.FlushJsonWriterAndCloseOut(jsonWriter)
 }
 
+// FindCodeSigningCertificate returns the first certificate with ExtKeyUsageCodeSigning or nil
+func FindCodeSigningCertificate(certificates []*x509.Certificate) *x509.Certificate {
+	for _, cert := range certificates {
+		for _, usage := range cert.ExtKeyUsage {
+			if usage == x509.ExtKeyUsageCodeSigning {
+				return cert
+			}
+		}
+	}
+	return nil
+}
+
 func writeError(error string) error {
 	jsonWriter := jsoniter.NewStream(jsoniter.ConfigFastest, os.Stdout, 16*1024)
 	jsonWriter.WriteObjectStart()
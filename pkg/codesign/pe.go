@@ -0,0 +1,244 @@
+package codesign
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+)
+
+const (
+	winCertificateRevision2   = 0x0200
+	winCertTypePkcsSignedData = 0x0002
+)
+
+// peLayout describes offsets of fields excluded from Authenticode hash
+type peLayout struct {
+	checksumOffset int64
+	// offset of IMAGE_DIRECTORY_ENTRY_SECURITY data directory
+	securityDirectoryOffset int64
+	certificateTableOffset  int64
+	certificateTableSize    int64
+}
+
+func readPeLayout(reader io.ReaderAt, fileSize int64) (*peLayout, error) {
+	header := make([]byte, 64)
+	_, err := reader.ReadAt(header, 0)
+	if err != nil || header[0] != 'M' || header[1] != 'Z' {
+		return nil, errors.New("not a PE file (MZ signature is not found)")
+	}
+
+	peOffset := int64(binary.LittleEndian.Uint32(header[0x3c:]))
+	// PE signature, COFF header (20 bytes), optional header magic
+	peHeader := make([]byte, 4+20+2)
+	_, err = reader.ReadAt(peHeader, peOffset)
+	if err != nil || string(peHeader[:4]) != "PE\x00\x00" {
+		return nil, errors.New("not a PE file (PE signature is not found)")
+	}
+
+	optionalHeaderOffset := peOffset + 24
+	var directoriesOffset int64
+	var numberOfRvaAndSizesOffset int64
+	switch binary.LittleEndian.Uint16(peHeader[24:]) {
+	case 0x10b:
+		numberOfRvaAndSizesOffset = optionalHeaderOffset + 92
+		directoriesOffset = optionalHeaderOffset + 96
+	case 0x20b:
+		numberOfRvaAndSizesOffset = optionalHeaderOffset + 108
+		directoriesOffset = optionalHeaderOffset + 112
+	default:
+		return nil, errors.New("unsupported PE optional header")
+	}
+
+	buffer := make([]byte, 4)
+	_, err = reader.ReadAt(buffer, numberOfRvaAndSizesOffset)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if binary.LittleEndian.Uint32(buffer) < 5 {
+		return nil, errors.New("PE file has no security data directory")
+	}
+
+	result := &peLayout{
+		checksumOffset:          optionalHeaderOffset + 64,
+		securityDirectoryOffset: directoriesOffset + 4*8,
+	}
+
+	directory := make([]byte, 8)
+	_, err = reader.ReadAt(directory, result.securityDirectoryOffset)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	result.certificateTableOffset = int64(binary.LittleEndian.Uint32(directory))
+	result.certificateTableSize = int64(binary.LittleEndian.Uint32(directory[4:]))
+	if result.certificateTableSize != 0 && result.certificateTableOffset+result.certificateTableSize != fileSize {
+		return nil, errors.New("certificate table is not located at the end of the file")
+	}
+	return result, nil
+}
+
+// signPe replaces existing signature (if any). Authenticode hash covers the whole file except checksum, security data directory and certificate table.
+// File is padded to 8 bytes before hashing (certificate table must be aligned), the same as signtool and osslsigncode do.
+func signPe(requestContext context.Context, file string, signer Signer, timestamps *timestampPool) error {
+	writer, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = doSignPe(requestContext, writer, signer, timestamps)
+	return fsutil.CloseAndCheckError(err, writer)
+}
+
+func doSignPe(requestContext context.Context, writer *os.File, signer Signer, timestamps *timestampPool) error {
+	info, err := writer.Stat()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	layout, err := readPeLayout(writer, info.Size())
+	if err != nil {
+		return errors.WithMessage(err, writer.Name())
+	}
+
+	contentSize := info.Size()
+	if layout.certificateTableSize != 0 {
+		contentSize = layout.certificateTableOffset
+	}
+	if padding := contentSize % 8; padding != 0 {
+		contentSize += 8 - padding
+	}
+
+	// clear security directory, so, the file is valid (unsigned) if signing fails after truncation
+	err = writeSecurityDirectory(writer, layout, 0, 0)
+	if err != nil {
+		return err
+	}
+	err = writer.Truncate(contentSize)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	digest, err := computePeDigest(writer, layout, contentSize)
+	if err != nil {
+		return err
+	}
+
+	signature, err := createAuthenticodeSignature(requestContext, createPeIndirectData(digest), signer)
+	if err != nil {
+		return err
+	}
+	if timestamps != nil {
+		err = timestamps.addTimestamp(requestContext, signature)
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := signature.encode()
+	if err != nil {
+		return err
+	}
+
+	// WIN_CERTIFICATE: dwLength, wRevision, wCertificateType, bCertificate (padded to 8 bytes)
+	length := 8 + len(data)
+	if padding := length % 8; padding != 0 {
+		length += 8 - padding
+	}
+	certificate := make([]byte, length)
+	binary.LittleEndian.PutUint32(certificate, uint32(length))
+	binary.LittleEndian.PutUint16(certificate[4:], winCertificateRevision2)
+	binary.LittleEndian.PutUint16(certificate[6:], winCertTypePkcsSignedData)
+	copy(certificate[8:], data)
+
+	_, err = writer.WriteAt(certificate, contentSize)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = writeSecurityDirectory(writer, layout, contentSize, int64(length))
+	if err != nil {
+		return err
+	}
+	return updatePeChecksum(writer, layout)
+}
+
+func writeSecurityDirectory(writer io.WriterAt, layout *peLayout, offset int64, size int64) error {
+	directory := make([]byte, 8)
+	binary.LittleEndian.PutUint32(directory, uint32(offset))
+	binary.LittleEndian.PutUint32(directory[4:], uint32(size))
+	_, err := writer.WriteAt(directory, layout.securityDirectoryOffset)
+	return errors.WithStack(err)
+}
+
+func computePeDigest(reader io.ReaderAt, layout *peLayout, size int64) ([]byte, error) {
+	hash := sha256.New()
+	ranges := [][2]int64{
+		{0, layout.checksumOffset},
+		{layout.checksumOffset + 4, layout.securityDirectoryOffset},
+		{layout.securityDirectoryOffset + 8, size},
+	}
+	for _, r := range ranges {
+		_, err := io.Copy(hash, io.NewSectionReader(reader, r[0], r[1]-r[0]))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return hash.Sum(nil), nil
+}
+
+func updatePeChecksum(file *os.File, layout *peLayout) error {
+	_, err := file.Seek(0, io.SeekStart)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	checksum, err := ComputePeChecksum(file, layout.checksumOffset)
+	if err != nil {
+		return err
+	}
+
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint32(data, checksum)
+	_, err = file.WriteAt(data, layout.checksumOffset)
+	return errors.WithStack(err)
+}
+
+// ComputePeChecksum computes the same checksum as CheckSumMappedFile: 16-bit one's complement sum of the file (checksum field is treated as zero) plus file size
+func ComputePeChecksum(reader io.Reader, checksumOffset int64) (uint32, error) {
+	var sum uint64
+	buffer := make([]byte, 64*1024)
+	var offset int64
+	for {
+		n, err := io.ReadFull(reader, buffer)
+		if n > 0 {
+			chunk := buffer[:n]
+			// checksum field is 4-byte aligned, chunk size is even
+			if checksumOffset >= offset && checksumOffset+4 <= offset+int64(n) {
+				relative := checksumOffset - offset
+				copy(chunk[relative:relative+4], []byte{0, 0, 0, 0})
+			}
+			if n%2 != 0 {
+				chunk = append(chunk, 0)
+			}
+			for i := 0; i < len(chunk); i += 2 {
+				sum += uint64(binary.LittleEndian.Uint16(chunk[i:]))
+				sum = (sum & 0xffff) + (sum >> 16)
+			}
+			offset += int64(n)
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+	}
+
+	sum = (sum & 0xffff) + (sum >> 16)
+	return uint32(sum) + uint32(offset), nil
+}
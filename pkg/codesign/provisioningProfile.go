@@ -0,0 +1,390 @@
+package codesign
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/asn1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/fs"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"howett.net/plist"
+)
+
+const (
+	EntitlementMatch        = "match"
+	EntitlementMismatch     = "mismatch"
+	EntitlementMissing      = "missing"
+	EntitlementUnrestricted = "unrestricted"
+	EntitlementProfileOnly  = "profileOnly"
+
+	provisioningProfileExpiryWarning = 30 * 24 * time.Hour
+)
+
+type ProvisioningProfile struct {
+	Name                  string                 `plist:"Name" json:"name"`
+	Uuid                  string                 `plist:"UUID" json:"uuid"`
+	TeamName              string                 `plist:"TeamName" json:"teamName,omitempty"`
+	TeamIdentifier        []string               `plist:"TeamIdentifier" json:"teamIdentifier"`
+	Platform              []string               `plist:"Platform" json:"platform,omitempty"`
+	CreationDate          time.Time              `plist:"CreationDate" json:"creationDate"`
+	ExpirationDate        time.Time              `plist:"ExpirationDate" json:"expirationDate"`
+	ProvisionedDevices    []string               `plist:"ProvisionedDevices" json:"provisionedDevices,omitempty"`
+	ProvisionsAllDevices  bool                   `plist:"ProvisionsAllDevices" json:"provisionsAllDevices,omitempty"`
+	Entitlements          map[string]interface{} `plist:"Entitlements" json:"entitlements"`
+	DeveloperCertificates [][]byte               `plist:"DeveloperCertificates" json:"-"`
+}
+
+type ProvisioningProfileOptions struct {
+	Profile string
+	// bundle ID to check, default: CFBundleIdentifier of the app
+	BundleId string
+	App      string
+	TeamId   string
+	// requested entitlements of the app
+	Entitlements string
+	// SHA-1 of the signing certificate, the profile must include it
+	Identity string
+	// development profile is allowed to be restricted to devices
+	IsDevelopment bool
+	IsEmbed       bool
+}
+
+type EntitlementDiff struct {
+	Key       string      `json:"key"`
+	Status    string      `json:"status"`
+	Requested interface{} `json:"requested,omitempty"`
+	Profile   interface{} `json:"profile,omitempty"`
+}
+
+type ProvisioningProfileReport struct {
+	Profile  *ProvisioningProfile `json:"profile"`
+	BundleId string               `json:"bundleId,omitempty"`
+	TeamId   string               `json:"teamId,omitempty"`
+	Problems []string             `json:"problems,omitempty"`
+	Warnings []string             `json:"warnings,omitempty"`
+	// sorted by key
+	Entitlements []*EntitlementDiff `json:"entitlements,omitempty"`
+	// path of embedded.provisionprofile if the profile was embedded
+	Embedded string `json:"embedded,omitempty"`
+}
+
+func configureProvisioningProfileCommand(codesignCommand *kingpin.CmdClause) {
+	command := codesignCommand.Command("provisioning-profile", "Validate provisioning profile for Mac App Store build (bundle ID, team ID, entitlements, expiry, devices) and embed it into the app. "+
+		"Report with the entitlements diff is written to stdout as JSON.")
+	options := ProvisioningProfileOptions{}
+	command.Flag("profile", "The .provisionprofile file.").Required().ExistingFileVar(&options.Profile)
+	command.Flag("app", "The .app bundle (bundle ID is read from Info.plist if --bundle-id is not set).").ExistingDirVar(&options.App)
+	command.Flag("bundle-id", "The bundle ID.").StringVar(&options.BundleId)
+	command.Flag("team-id", "The team ID (default: team of the profile).").StringVar(&options.TeamId)
+	command.Flag("entitlements", "The requested entitlements of the app.").ExistingFileVar(&options.Entitlements)
+	command.Flag("identity", "SHA-1 of the signing certificate, the profile must include it.").StringVar(&options.Identity)
+	command.Flag("development", "Development profile (allowed to be restricted to devices).").BoolVar(&options.IsDevelopment)
+	command.Flag("embed", "Copy the profile to Contents/embedded.provisionprofile of the app if it is valid.").BoolVar(&options.IsEmbed)
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		if options.IsEmbed && options.App == "" {
+			return util.NewMessageError("--app is required to embed provisioning profile", "ERR_PROVISIONING_PROFILE_INVALID_OPTIONS")
+		}
+
+		report, err := ValidateProvisioningProfile(&options)
+		if report != nil {
+			writeError := util.WriteJsonToStdOut(report)
+			if err == nil {
+				err = writeError
+			}
+		}
+		return err
+	})
+}
+
+// ValidateProvisioningProfile checks the profile against the app and embeds it if requested.
+// Report is returned even if the profile is not valid (error code ERR_PROVISIONING_PROFILE_INVALID).
+func ValidateProvisioningProfile(options *ProvisioningProfileOptions) (*ProvisioningProfileReport, error) {
+	profile, err := ReadProvisioningProfile(options.Profile)
+	if err != nil {
+		return nil, err
+	}
+
+	bundleId := options.BundleId
+	if bundleId == "" && options.App != "" {
+		bundleId, err = readBundleId(options.App)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var requested map[string]interface{}
+	if options.Entitlements != "" {
+		requested, err = readEntitlements(options.Entitlements)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	report := checkProvisioningProfile(profile, bundleId, options.TeamId, requested, options, time.Now())
+	if len(report.Problems) != 0 {
+		return report, util.NewMessageError("provisioning profile "+options.Profile+" is not valid: "+strings.Join(report.Problems, "; "), "ERR_PROVISIONING_PROFILE_INVALID")
+	}
+
+	if options.IsEmbed {
+		report.Embedded, err = EmbedProvisioningProfile(options.Profile, options.App)
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// EmbedProvisioningProfile copies the profile to Contents/embedded.provisionprofile (must be done before signing, the file is sealed by the app signature).
+func EmbedProvisioningProfile(profile string, appDir string) (string, error) {
+	file := filepath.Join(appDir, "Contents", "embedded.provisionprofile")
+	_ = os.Remove(file)
+	err := fs.CopyFileAndRestoreNormalPermissions(profile, file, 0644)
+	if err != nil {
+		return "", errors.WithMessage(err, "cannot embed provisioning profile")
+	}
+	return file, nil
+}
+
+// ReadProvisioningProfile reads the property list signed by Apple (CMS SignedData, the signature itself is checked by the system on install).
+func ReadProvisioningProfile(file string) (*ProvisioningProfile, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	content, err := getSignedDataContent(data)
+	if err != nil {
+		return nil, util.NewMessageError("cannot read provisioning profile "+file+": "+err.Error(), "ERR_PROVISIONING_PROFILE_INVALID_FORMAT")
+	}
+
+	profile := &ProvisioningProfile{}
+	_, err = plist.Unmarshal(content, profile)
+	if err != nil {
+		return nil, util.NewMessageError("cannot parse provisioning profile "+file+": "+err.Error(), "ERR_PROVISIONING_PROFILE_INVALID_FORMAT")
+	}
+	return profile, nil
+}
+
+func getSignedDataContent(data []byte) ([]byte, error) {
+	var info contentInfo
+	_, err := asn1.Unmarshal(data, &info)
+	if err == nil {
+		var signed signedData
+		_, err = asn1.Unmarshal(info.Content.Bytes, &signed)
+		if err == nil {
+			var content []byte
+			_, err = asn1.Unmarshal(signed.ContentInfo.Content.Bytes, &content)
+			if err == nil {
+				return content, nil
+			}
+		}
+	}
+
+	// BER with indefinite length is not supported by encoding/asn1, but content is stored as is
+	start := bytes.Index(data, []byte("<?xml"))
+	end := bytes.LastIndex(data, []byte("</plist>"))
+	if start < 0 || end < start {
+		return nil, errors.WithMessage(err, "signed property list not found")
+	}
+	return data[start : end+len("</plist>")], nil
+}
+
+func checkProvisioningProfile(profile *ProvisioningProfile, bundleId string, teamId string, requested map[string]interface{}, options *ProvisioningProfileOptions, now time.Time) *ProvisioningProfileReport {
+	report := &ProvisioningProfileReport{Profile: profile, BundleId: bundleId, TeamId: teamId}
+	addProblem := func(message string) {
+		report.Problems = append(report.Problems, message)
+	}
+
+	if len(profile.Platform) != 0 && !util.ContainsString(profile.Platform, "OSX") {
+		addProblem("profile is for " + strings.Join(profile.Platform, ", ") + ", not for macOS")
+	}
+
+	if teamId == "" {
+		if len(profile.TeamIdentifier) != 0 {
+			report.TeamId = profile.TeamIdentifier[0]
+		}
+	} else if !util.ContainsString(profile.TeamIdentifier, teamId) {
+		addProblem("team ID " + teamId + " doesn't match team of the profile (" + strings.Join(profile.TeamIdentifier, ", ") + ")")
+	}
+
+	applicationIdentifier, _ := profile.Entitlements["com.apple.application-identifier"].(string)
+	if applicationIdentifier == "" {
+		addProblem("profile doesn't specify application identifier")
+	} else {
+		prefix, pattern := applicationIdentifier, ""
+		if index := strings.IndexByte(applicationIdentifier, '.'); index > 0 {
+			prefix, pattern = applicationIdentifier[:index], applicationIdentifier[index+1:]
+		}
+		if report.TeamId != "" && prefix != report.TeamId {
+			addProblem("application identifier " + applicationIdentifier + " doesn't belong to team " + report.TeamId)
+		}
+		if bundleId == "" {
+			report.Warnings = append(report.Warnings, "bundle ID is not specified and not checked")
+		} else if !isEntitlementValueMatched(pattern, bundleId) {
+			addProblem("bundle ID " + bundleId + " doesn't match application identifier " + applicationIdentifier)
+		}
+	}
+
+	if now.After(profile.ExpirationDate) {
+		addProblem("expired on " + profile.ExpirationDate.Format("2006-01-02"))
+	} else if profile.ExpirationDate.Sub(now) < provisioningProfileExpiryWarning {
+		report.Warnings = append(report.Warnings, "expires on "+profile.ExpirationDate.Format("2006-01-02"))
+	}
+
+	if !options.IsDevelopment {
+		if len(profile.ProvisionedDevices) != 0 {
+			addProblem("profile is restricted to " + strconv.Itoa(len(profile.ProvisionedDevices)) + " devices and cannot be used for Mac App Store distribution")
+		} else if profile.ProvisionsAllDevices {
+			addProblem("profile provisions all devices (Developer ID) and cannot be used for Mac App Store distribution")
+		}
+	}
+
+	if options.Identity != "" && !isCertificateInProfile(profile, options.Identity) {
+		addProblem("signing certificate " + options.Identity + " is not included in the profile")
+	}
+
+	if requested != nil {
+		report.Entitlements = diffEntitlements(requested, profile.Entitlements)
+		for _, item := range report.Entitlements {
+			switch item.Status {
+			case EntitlementMismatch:
+				addProblem("entitlement " + item.Key + " is not allowed by the profile")
+			case EntitlementMissing:
+				addProblem("entitlement " + item.Key + " is not granted by the profile")
+			}
+		}
+	}
+	return report
+}
+
+func isCertificateInProfile(profile *ProvisioningProfile, identity string) bool {
+	for _, certificate := range profile.DeveloperCertificates {
+		hash := sha1.Sum(certificate)
+		if strings.EqualFold(hex.EncodeToString(hash[:]), identity) {
+			return true
+		}
+	}
+	return false
+}
+
+// diffEntitlements compares requested entitlements with entitlements granted by the profile.
+// Sandbox and hardened runtime entitlements (com.apple.security.*) are not restricted and don't have to be granted.
+func diffEntitlements(requested map[string]interface{}, granted map[string]interface{}) []*EntitlementDiff {
+	keys := make([]string, 0, len(requested)+len(granted))
+	for key := range requested {
+		keys = append(keys, key)
+	}
+	for key := range granted {
+		if _, ok := requested[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := make([]*EntitlementDiff, 0, len(keys))
+	for _, key := range keys {
+		requestedValue, isRequested := requested[key]
+		grantedValue, isGranted := granted[key]
+		item := &EntitlementDiff{Key: key, Requested: requestedValue, Profile: grantedValue}
+		switch {
+		case !isRequested:
+			item.Status = EntitlementProfileOnly
+		case isGranted:
+			if isEntitlementAllowed(requestedValue, grantedValue) {
+				item.Status = EntitlementMatch
+			} else {
+				item.Status = EntitlementMismatch
+			}
+		case strings.HasPrefix(key, "com.apple.security."):
+			item.Status = EntitlementUnrestricted
+		default:
+			item.Status = EntitlementMissing
+		}
+		result = append(result, item)
+	}
+	return result
+}
+
+// isEntitlementAllowed checks that every requested value is granted, granted string value can end with * (e.g. TEAMID.*).
+func isEntitlementAllowed(requested interface{}, granted interface{}) bool {
+	switch requestedValue := requested.(type) {
+	case bool:
+		// false is the same as not requested
+		grantedValue, _ := granted.(bool)
+		return !requestedValue || grantedValue
+
+	case string:
+		switch grantedValue := granted.(type) {
+		case string:
+			return isEntitlementValueMatched(grantedValue, requestedValue)
+		case []interface{}:
+			for _, item := range grantedValue {
+				if pattern, ok := item.(string); ok && isEntitlementValueMatched(pattern, requestedValue) {
+					return true
+				}
+			}
+		}
+		return false
+
+	case []interface{}:
+		for _, item := range requestedValue {
+			if !isEntitlementAllowed(item, granted) {
+				return false
+			}
+		}
+		return true
+
+	default:
+		return reflect.DeepEqual(requested, granted)
+	}
+}
+
+func isEntitlementValueMatched(pattern string, value string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(value, pattern[:len(pattern)-1])
+	}
+	return pattern == value
+}
+
+func readEntitlements(file string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var result map[string]interface{}
+	_, err = plist.Unmarshal(data, &result)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot parse "+file)
+	}
+	return result, nil
+}
+
+func readBundleId(appDir string) (string, error) {
+	infoPlist := filepath.Join(appDir, "Contents", "Info.plist")
+	data, err := ioutil.ReadFile(infoPlist)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	var info struct {
+		BundleId string `plist:"CFBundleIdentifier"`
+	}
+	_, err = plist.Unmarshal(data, &info)
+	if err != nil {
+		return "", errors.WithMessage(err, "cannot parse "+infoPlist)
+	}
+	return info.BundleId, nil
+}
@@ -0,0 +1,130 @@
+package codesign
+
+import (
+	"crypto/sha1"
+	"encoding/asn1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/develar/app-builder/pkg/util"
+	. "github.com/onsi/gomega"
+	"howett.net/plist"
+)
+
+// writeProvisioningProfile writes the profile as CMS SignedData without signers (the signature is not checked)
+func writeProvisioningProfile(g *GomegaWithT, file string, profile *ProvisioningProfile) {
+	content, err := plist.Marshal(profile, plist.XMLFormat)
+	g.Expect(err).NotTo(HaveOccurred())
+	octetString, err := asn1.Marshal(content)
+	g.Expect(err).NotTo(HaveOccurred())
+	signed, err := asn1.Marshal(signedData{
+		Version:          1,
+		DigestAlgorithms: []algorithmIdentifier{sha256AlgorithmIdentifier},
+		ContentInfo:      contentInfo{ContentType: oidData, Content: newExplicitContent(octetString)},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	data, err := asn1.Marshal(contentInfo{ContentType: oidSignedData, Content: newExplicitContent(signed)})
+	g.Expect(err).NotTo(HaveOccurred())
+	writeFile(g, file, string(data))
+}
+
+const requestedEntitlements = `<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0">
+  <dict>
+    <key>com.apple.security.app-sandbox</key>
+    <true/>
+    <key>com.apple.application-identifier</key>
+    <string>TEAMID1234.com.example.app</string>
+    <key>keychain-access-groups</key>
+    <array>
+      <string>TEAMID1234.com.example.app</string>
+    </array>
+    <key>com.apple.developer.icloud-services</key>
+    <array>
+      <string>CloudKit</string>
+    </array>
+  </dict>
+</plist>
+`
+
+func TestValidateProvisioningProfile(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "profile")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	appDir := filepath.Join(dir, "Foo.app")
+	writeFile(g, filepath.Join(appDir, "Contents", "Info.plist"), `<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0"><dict><key>CFBundleIdentifier</key><string>com.example.app</string></dict></plist>`)
+	entitlements := filepath.Join(dir, "entitlements.plist")
+	writeFile(g, entitlements, requestedEntitlements)
+
+	certificate := []byte("certificate")
+	hash := sha1.Sum(certificate)
+	profile := &ProvisioningProfile{
+		Name:           "Foo MAS",
+		Uuid:           "D1E2",
+		TeamIdentifier: []string{"TEAMID1234"},
+		Platform:       []string{"OSX"},
+		CreationDate:   time.Now().Add(-time.Hour).UTC().Truncate(time.Second),
+		ExpirationDate: time.Now().Add(365 * 24 * time.Hour).UTC().Truncate(time.Second),
+		Entitlements: map[string]interface{}{
+			"com.apple.application-identifier":    "TEAMID1234.com.example.*",
+			"com.apple.developer.team-identifier": "TEAMID1234",
+			"keychain-access-groups":              []interface{}{"TEAMID1234.*"},
+		},
+		DeveloperCertificates: [][]byte{certificate},
+	}
+	profileFile := filepath.Join(dir, "foo.provisionprofile")
+	writeProvisioningProfile(g, profileFile, profile)
+
+	options := &ProvisioningProfileOptions{Profile: profileFile, App: appDir, Entitlements: entitlements, Identity: hex.EncodeToString(hash[:])}
+	report, err := ValidateProvisioningProfile(options)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.(util.MessageError).ErrorCode()).To(Equal("ERR_PROVISIONING_PROFILE_INVALID"))
+	g.Expect(report.Profile.Name).To(Equal("Foo MAS"))
+	g.Expect(report.BundleId).To(Equal("com.example.app"))
+	g.Expect(report.TeamId).To(Equal("TEAMID1234"))
+	g.Expect(report.Problems).To(Equal([]string{"entitlement com.apple.developer.icloud-services is not granted by the profile"}))
+	statuses := make(map[string]string)
+	for _, item := range report.Entitlements {
+		statuses[item.Key] = item.Status
+	}
+	g.Expect(statuses).To(Equal(map[string]string{
+		"com.apple.application-identifier":    EntitlementMatch,
+		"com.apple.developer.icloud-services": EntitlementMissing,
+		"com.apple.developer.team-identifier": EntitlementProfileOnly,
+		"com.apple.security.app-sandbox":      EntitlementUnrestricted,
+		"keychain-access-groups":              EntitlementMatch,
+	}))
+
+	// requested iCloud services are subset of granted ones
+	profile.Entitlements["com.apple.application-identifier"] = "TEAMID1234.com.example.app"
+	profile.Entitlements["com.apple.developer.icloud-services"] = []interface{}{"CloudKit", "CloudDocuments"}
+	writeProvisioningProfile(g, profileFile, profile)
+	options.IsEmbed = true
+	report, err = ValidateProvisioningProfile(options)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(report.Embedded).To(Equal(filepath.Join(appDir, "Contents", "embedded.provisionprofile")))
+	g.Expect(report.Embedded).To(BeAnExistingFile())
+
+	// development profile restricted to devices, other team and bundle ID
+	profile.ProvisionedDevices = []string{"00008020-0001"}
+	profile.ExpirationDate = time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	writeProvisioningProfile(g, profileFile, profile)
+	report, err = ValidateProvisioningProfile(&ProvisioningProfileOptions{Profile: profileFile, BundleId: "com.example.other", TeamId: "OTHERTEAM1", Identity: "0000000000000000000000000000000000000000"})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(report.Problems).To(Equal([]string{
+		"team ID OTHERTEAM1 doesn't match team of the profile (TEAMID1234)",
+		"application identifier TEAMID1234.com.example.app doesn't belong to team OTHERTEAM1",
+		"bundle ID com.example.other doesn't match application identifier TEAMID1234.com.example.app",
+		"expired on " + profile.ExpirationDate.Format("2006-01-02"),
+		"profile is restricted to 1 devices and cannot be used for Mac App Store distribution",
+		"signing certificate 0000000000000000000000000000000000000000 is not included in the profile",
+	}))
+}
@@ -0,0 +1,178 @@
+package codesign
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/credentials"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"go.uber.org/zap"
+)
+
+type SignWindowsOptions struct {
+	Files  []string
+	Signer SignerOptions
+
+	TimestampServers             []string
+	AuthenticodeTimestampServers []string
+	// requests per second to all timestamp servers
+	TimestampRateLimit float64
+	IsNoTimestamp      bool
+	Concurrency        int
+	Timeout            time.Duration
+}
+
+type SignedFile struct {
+	File   string `json:"file"`
+	Format string `json:"format"`
+	// duration of signing including timestamping
+	Duration int64 `json:"durationMs"`
+}
+
+type SignWindowsReport struct {
+	Signer string `json:"signer"`
+	// subject of the signing certificate
+	Subject string `json:"subject"`
+	// SHA-256 of the signing certificate
+	Thumbprint       string                 `json:"thumbprint"`
+	Timestamped      bool                   `json:"timestamped"`
+	TimestampServers []TimestampServerStats `json:"timestampServers,omitempty"`
+	Files            []*SignedFile          `json:"files"`
+}
+
+func ConfigureSignWindowsCommand(app *kingpin.Application) {
+	command := app.Command("sign-windows", "Sign PE files (exe, dll, node), MSI/MSP and MSIX/APPX packages with Authenticode without signtool. "+
+		"Key can be stored in PKCS#12 file, Azure Key Vault, AWS KMS, Google Cloud KMS or PKCS#11 token. Signing report is written to stdout as JSON.")
+	options := SignWindowsOptions{}
+	command.Flag("file", "The file to sign.").Short('f').Required().ExistingFilesVar(&options.Files)
+	command.Flag("signer", "Where the key is stored.").Default(SignerPkcs12).EnumVar(&options.Signer.Kind, SignerPkcs12, SignerAzureKeyVault, SignerAwsKms, SignerGoogleKms, SignerPkcs11)
+	command.Flag("certificate", "PKCS#12 file for pkcs12 signer (password: "+credentials.ToEnvName(CertificatePasswordCredentialName)+"), "+
+		"certificate chain (PEM or DER) for other signers.").ExistingFileVar(&options.Signer.Certificate)
+
+	command.Flag("azure-vault-url", "The Azure Key Vault URL (e.g. https://name.vault.azure.net).").StringVar(&options.Signer.AzureVaultUrl)
+	command.Flag("azure-certificate-name", "The name of the certificate in Azure Key Vault.").StringVar(&options.Signer.AzureCertificateName)
+	command.Flag("azure-tenant-id", "The Azure tenant ID (client secret: "+credentials.ToEnvName(AzureClientSecretCredentialName)+").").Envar("AZURE_TENANT_ID").StringVar(&options.Signer.AzureTenantId)
+	command.Flag("azure-client-id", "The Azure client ID.").Envar("AZURE_CLIENT_ID").StringVar(&options.Signer.AzureClientId)
+
+	command.Flag("aws-key-id", "The AWS KMS key ID or ARN.").StringVar(&options.Signer.AwsKeyId)
+	command.Flag("aws-region", "The AWS region (default: from AWS config).").StringVar(&options.Signer.AwsRegion)
+
+	command.Flag("google-key-version", "The Google Cloud KMS key version resource name.").StringVar(&options.Signer.GoogleKeyVersion)
+
+	command.Flag("pkcs11-module", "The PKCS#11 module (e.g. /usr/lib/opensc-pkcs11.so, PIN: "+credentials.ToEnvName(Pkcs11PinCredentialName)+").").StringVar(&options.Signer.Pkcs11Module)
+	command.Flag("pkcs11-key-id", "The ID of the key on PKCS#11 token (hex).").StringVar(&options.Signer.Pkcs11KeyId)
+
+	command.Flag("timestamp-server", "The RFC 3161 timestamp server. Servers are rotated, failed or throttled server is not used for a while "+
+		"(default: "+strings.Join(DefaultTimestampServers, ", ")+").").StringsVar(&options.TimestampServers)
+	command.Flag("authenticode-timestamp-server", "The legacy Authenticode timestamp server (signtool /t).").StringsVar(&options.AuthenticodeTimestampServers)
+	command.Flag("timestamp-rate-limit", "The maximum number of timestamp requests per second for all servers (0 - unlimited).").Default("5").Float64Var(&options.TimestampRateLimit)
+	command.Flag("no-timestamp", "Do not timestamp (signature becomes invalid when certificate expires).").BoolVar(&options.IsNoTimestamp)
+	command.Flag("concurrency", "The number of files signed in parallel.").Default(strconv.Itoa(runtime.NumCPU())).IntVar(&options.Concurrency)
+	command.Flag("timeout", "").Default("30m").DurationVar(&options.Timeout)
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		report, err := SignWindows(options)
+		if err != nil {
+			return err
+		}
+		return util.WriteJsonToStdOut(report)
+	})
+}
+
+func SignWindows(options SignWindowsOptions) (*SignWindowsReport, error) {
+	formats := make([]string, len(options.Files))
+	for index, file := range options.Files {
+		format, err := getWindowsSignFormat(file)
+		if err != nil {
+			return nil, err
+		}
+		formats[index] = format
+	}
+
+	if options.Timeout <= 0 {
+		options.Timeout = 30 * time.Minute
+	}
+	requestContext, cancel := util.CreateContextWithTimeout(options.Timeout)
+	defer cancel()
+
+	signer, err := CreateSigner(requestContext, &options.Signer)
+	if err != nil {
+		return nil, err
+	}
+
+	var timestamps *timestampPool
+	if !options.IsNoTimestamp {
+		rfc3161Servers := options.TimestampServers
+		if len(rfc3161Servers) == 0 && len(options.AuthenticodeTimestampServers) == 0 {
+			rfc3161Servers = DefaultTimestampServers
+		}
+		timestamps = newTimestampPool(rfc3161Servers, options.AuthenticodeTimestampServers, options.TimestampRateLimit)
+	}
+
+	certificate := signer.Certificates()[0]
+	thumbprint := sha256.Sum256(certificate.Raw)
+	report := &SignWindowsReport{
+		Signer:      options.Signer.Kind,
+		Subject:     certificate.Subject.String(),
+		Thumbprint:  hex.EncodeToString(thumbprint[:]),
+		Timestamped: timestamps != nil,
+		Files:       make([]*SignedFile, len(options.Files)),
+	}
+
+	concurrency := options.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	err = util.MapAsyncConcurrency(len(options.Files), concurrency, func(taskIndex int) (func() error, error) {
+		file := options.Files[taskIndex]
+		format := formats[taskIndex]
+		return func() error {
+			start := time.Now()
+			var err error
+			switch format {
+			case "msix":
+				err = signAppx(requestContext, file, signer, timestamps)
+			case "msi":
+				err = signMsi(requestContext, file, signer, timestamps)
+			default:
+				err = signPe(requestContext, file, signer, timestamps)
+			}
+			if err != nil {
+				return errors.WithMessage(err, "cannot sign "+file)
+			}
+
+			report.Files[taskIndex] = &SignedFile{File: file, Format: format, Duration: time.Since(start).Milliseconds()}
+			log.Info("signed", zap.String("file", file))
+			return nil
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if timestamps != nil {
+		report.TimestampServers = timestamps.Stats()
+	}
+	return report, nil
+}
+
+func getWindowsSignFormat(file string) (string, error) {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".msix", ".appx":
+		return "msix", nil
+	case ".msi", ".msp":
+		return "msi", nil
+	case ".msixbundle", ".appxbundle":
+		return "", util.NewMessageError("signing of "+filepath.Ext(file)+" is not supported yet ("+file+"), use signtool or osslsigncode", "ERR_SIGN_UNSUPPORTED_FORMAT")
+	default:
+		return "pe", nil
+	}
+}
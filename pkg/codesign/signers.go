@@ -0,0 +1,550 @@
+package codesign
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/develar/app-builder/pkg/credentials"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/develar/go-pkcs12"
+	"github.com/json-iterator/go"
+)
+
+const (
+	SignerPkcs12        = "pkcs12"
+	SignerAzureKeyVault = "azure-key-vault"
+	SignerAwsKms        = "aws-kms"
+	SignerGoogleKms     = "google-kms"
+	SignerPkcs11        = "pkcs11"
+
+	CertificatePasswordCredentialName = "certificate-password"
+	AzureClientSecretCredentialName   = "azure-client-secret"
+	AzureAccessTokenCredentialName    = "azure-access-token"
+	GoogleAccessTokenCredentialName   = "google-access-token"
+	Pkcs11PinCredentialName           = "pkcs11-pin"
+)
+
+var (
+	azureAuthorityUrl = "https://login.microsoftonline.com"
+	googleKmsApiUrl   = "https://cloudkms.googleapis.com/v1"
+)
+
+type SignerOptions struct {
+	Kind string
+	// PKCS#12 file for pkcs12 signer, certificate chain (PEM or DER) for other signers (additional intermediate certificates for Azure Key Vault)
+	Certificate string
+
+	AzureVaultUrl        string
+	AzureCertificateName string
+	AzureTenantId        string
+	AzureClientId        string
+
+	AwsKeyId  string
+	AwsRegion string
+
+	// projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>/cryptoKeyVersions/<version>
+	GoogleKeyVersion string
+
+	Pkcs11Module string
+	Pkcs11KeyId  string
+}
+
+func CreateSigner(requestContext context.Context, options *SignerOptions) (Signer, error) {
+	switch options.Kind {
+	case SignerPkcs12:
+		return createPkcs12Signer(options.Certificate)
+	case SignerAzureKeyVault:
+		return createAzureKeyVaultSigner(requestContext, options)
+	}
+
+	var certificates []*x509.Certificate
+	var err error
+	if options.Certificate != "" {
+		certificates, err = readCertificateChain(options.Certificate)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch options.Kind {
+	case SignerAwsKms:
+		if len(certificates) == 0 || options.AwsKeyId == "" {
+			return nil, createSignerOptionsError("certificate and AWS KMS key ID must be specified")
+		}
+		return createAwsKmsSigner(options, certificates)
+
+	case SignerGoogleKms:
+		if len(certificates) == 0 || options.GoogleKeyVersion == "" {
+			return nil, createSignerOptionsError("certificate and Google Cloud KMS key version must be specified")
+		}
+		return &googleKmsSigner{keyVersion: options.GoogleKeyVersion, certificates: certificates, httpClient: createSignerHttpClient()}, nil
+
+	case SignerPkcs11:
+		if options.Pkcs11Module == "" || options.Pkcs11KeyId == "" {
+			return nil, createSignerOptionsError("PKCS#11 module and key ID must be specified")
+		}
+		return createPkcs11Signer(options, certificates)
+
+	default:
+		return nil, createSignerOptionsError("unknown signer " + options.Kind)
+	}
+}
+
+func createSignerOptionsError(message string) error {
+	return util.NewMessageError(message, "ERR_SIGN_INVALID_OPTIONS")
+}
+
+func createSignerHttpClient() *http.Client {
+	return &http.Client{
+		Timeout: 5 * time.Minute,
+		Transport: &http.Transport{
+			Proxy: util.ProxyFromEnvironmentAndNpm,
+		},
+	}
+}
+
+func createPkcs12Signer(file string) (Signer, error) {
+	if file == "" {
+		return nil, createSignerOptionsError("PKCS#12 certificate file must be specified")
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	password, err := credentials.Get(CertificatePasswordCredentialName)
+	if err != nil {
+		return nil, err
+	}
+
+	key, certificate, err := pkcs12.Decode(data, password)
+	if err != nil {
+		return nil, util.NewMessageError("cannot decode "+file+": "+err.Error(), "ERR_SIGN_INVALID_CERTIFICATE")
+	}
+
+	privateKey, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, util.NewMessageError("unsupported private key in "+file, "ERR_SIGN_INVALID_CERTIFICATE")
+	}
+
+	// intermediate certificates
+	certificates := []*x509.Certificate{certificate}
+	all, err := pkcs12.DecodeAllCerts(data, password)
+	if err == nil {
+		for _, item := range all {
+			if !bytes.Equal(item.Raw, certificate.Raw) {
+				certificates = append(certificates, item)
+			}
+		}
+	}
+	return &localSigner{key: privateKey, certificates: certificates}, nil
+}
+
+// readCertificateChain reads PEM (one or more certificates) or DER certificate file
+func readCertificateChain(file string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var der []byte
+	if bytes.Contains(data, []byte("-----BEGIN")) {
+		for rest := data; ; {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			if block.Type == "CERTIFICATE" {
+				der = append(der, block.Bytes...)
+			}
+		}
+	} else {
+		der = data
+	}
+
+	certificates, err := x509.ParseCertificates(der)
+	if err != nil || len(certificates) == 0 {
+		return nil, util.NewMessageError("cannot read certificate from "+file, "ERR_SIGN_INVALID_CERTIFICATE")
+	}
+	return certificates, nil
+}
+
+// JWS and PKCS#11 use raw r || s, PKCS#7 requires ASN.1 DER
+func encodeEcdsaSignature(raw []byte) ([]byte, error) {
+	if len(raw) == 0 || len(raw)%2 != 0 {
+		return nil, errors.New("invalid ECDSA signature")
+	}
+
+	size := len(raw) / 2
+	result, err := asn1.Marshal(struct{ R, S *big.Int }{new(big.Int).SetBytes(raw[:size]), new(big.Int).SetBytes(raw[size:])})
+	return result, errors.WithStack(err)
+}
+
+func isEcdsaCertificate(certificate *x509.Certificate) bool {
+	_, ok := certificate.PublicKey.(*ecdsa.PublicKey)
+	return ok
+}
+
+func doSignerRequest(requestContext context.Context, httpClient *http.Client, method string, url string, body []byte, contentType string, token string, result interface{}) error {
+	request, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	request = request.WithContext(requestContext)
+	if body != nil {
+		request.Header.Set("Content-Type", contentType)
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(response.Body)
+
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return errors.Errorf("%s %s responded with %s: %s", method, request.URL.Host, response.Status, strings.TrimSpace(string(responseBody)))
+	}
+	return errors.WithStack(jsoniter.Unmarshal(responseBody, result))
+}
+
+// Azure Key Vault: certificate is downloaded from the vault, digest is signed by the key of the certificate.
+// Access token is taken from azure-access-token credential or obtained using client credentials (service principal).
+type azureKeyVaultSigner struct {
+	keyId        string
+	token        string
+	certificates []*x509.Certificate
+	httpClient   *http.Client
+}
+
+func createAzureKeyVaultSigner(requestContext context.Context, options *SignerOptions) (Signer, error) {
+	if options.AzureVaultUrl == "" || options.AzureCertificateName == "" {
+		return nil, createSignerOptionsError("Azure Key Vault URL and certificate name must be specified")
+	}
+
+	httpClient := createSignerHttpClient()
+	token, err := getAzureAccessToken(requestContext, httpClient, options)
+	if err != nil {
+		return nil, err
+	}
+
+	var certificate struct {
+		Kid string `json:"kid"`
+		Cer string `json:"cer"`
+	}
+	vaultUrl := strings.TrimSuffix(options.AzureVaultUrl, "/")
+	err = doSignerRequest(requestContext, httpClient, http.MethodGet, vaultUrl+"/certificates/"+url.PathEscape(options.AzureCertificateName)+"?api-version=7.4", nil, "", token, &certificate)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot get certificate from Azure Key Vault")
+	}
+
+	der, err := base64.StdEncoding.DecodeString(certificate.Cer)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	signingCertificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot parse certificate from Azure Key Vault")
+	}
+
+	certificates := []*x509.Certificate{signingCertificate}
+	if options.Certificate != "" {
+		intermediates, err := readCertificateChain(options.Certificate)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, intermediates...)
+	}
+	return &azureKeyVaultSigner{keyId: certificate.Kid, token: token, certificates: certificates, httpClient: httpClient}, nil
+}
+
+func getAzureAccessToken(requestContext context.Context, httpClient *http.Client, options *SignerOptions) (string, error) {
+	token, err := credentials.Get(AzureAccessTokenCredentialName)
+	if err != nil || token != "" {
+		return token, err
+	}
+
+	if options.AzureTenantId == "" || options.AzureClientId == "" {
+		return "", createSignerOptionsError("Azure tenant and client ID must be specified (or access token using " + credentials.ToEnvName(AzureAccessTokenCredentialName) + " env)")
+	}
+	secret, err := credentials.GetRequired(AzureClientSecretCredentialName)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {options.AzureClientId},
+		"client_secret": {secret},
+		"scope":         {"https://vault.azure.net/.default"},
+	}
+	var result struct {
+		AccessToken string `json:"access_token"`
+	}
+	err = doSignerRequest(requestContext, httpClient, http.MethodPost, azureAuthorityUrl+"/"+url.PathEscape(options.AzureTenantId)+"/oauth2/v2.0/token", []byte(form.Encode()), "application/x-www-form-urlencoded", "", &result)
+	if err != nil {
+		return "", errors.WithMessage(err, "cannot get Azure access token")
+	}
+	return result.AccessToken, nil
+}
+
+func (t *azureKeyVaultSigner) Certificates() []*x509.Certificate {
+	return t.certificates
+}
+
+func (t *azureKeyVaultSigner) Sign(requestContext context.Context, digest []byte) ([]byte, error) {
+	isEcdsa := isEcdsaCertificate(t.certificates[0])
+	algorithm := "RS256"
+	if isEcdsa {
+		algorithm = "ES256"
+	}
+
+	body, err := jsoniter.Marshal(map[string]string{"alg": algorithm, "value": base64.RawURLEncoding.EncodeToString(digest)})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var result struct {
+		Value string `json:"value"`
+	}
+	err = doSignerRequest(requestContext, t.httpClient, http.MethodPost, t.keyId+"/sign?api-version=7.4", body, "application/json", t.token, &result)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot sign using Azure Key Vault")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(result.Value, "="))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if isEcdsa {
+		return encodeEcdsaSignature(signature)
+	}
+	return signature, nil
+}
+
+// AWS KMS: credentials and region are taken from the standard AWS environment (env, shared config, instance role)
+type awsKmsSigner struct {
+	keyId        string
+	client       *kms.KMS
+	certificates []*x509.Certificate
+}
+
+func createAwsKmsSigner(options *SignerOptions, certificates []*x509.Certificate) (Signer, error) {
+	config := &aws.Config{HTTPClient: createSignerHttpClient()}
+	if options.AwsRegion != "" {
+		config.Region = aws.String(options.AwsRegion)
+	}
+	awsSession, err := session.NewSessionWithOptions(session.Options{Config: *config, SharedConfigState: session.SharedConfigEnable})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &awsKmsSigner{keyId: options.AwsKeyId, client: kms.New(awsSession), certificates: certificates}, nil
+}
+
+func (t *awsKmsSigner) Certificates() []*x509.Certificate {
+	return t.certificates
+}
+
+func (t *awsKmsSigner) Sign(requestContext context.Context, digest []byte) ([]byte, error) {
+	algorithm := kms.SigningAlgorithmSpecRsassaPkcs1V15Sha256
+	if isEcdsaCertificate(t.certificates[0]) {
+		algorithm = kms.SigningAlgorithmSpecEcdsaSha256
+	}
+
+	// ECDSA signature is returned in DER
+	result, err := t.client.SignWithContext(requestContext, &kms.SignInput{
+		KeyId:            aws.String(t.keyId),
+		Message:          digest,
+		MessageType:      aws.String(kms.MessageTypeDigest),
+		SigningAlgorithm: aws.String(algorithm),
+	})
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot sign using AWS KMS")
+	}
+	return result.Signature, nil
+}
+
+// Google Cloud KMS: access token is taken from google-access-token credential or from gcloud CLI
+type googleKmsSigner struct {
+	keyVersion   string
+	certificates []*x509.Certificate
+	httpClient   *http.Client
+
+	tokenMutex sync.Mutex
+	token      string
+}
+
+func (t *googleKmsSigner) Certificates() []*x509.Certificate {
+	return t.certificates
+}
+
+func (t *googleKmsSigner) getToken() (string, error) {
+	t.tokenMutex.Lock()
+	defer t.tokenMutex.Unlock()
+
+	if t.token != "" {
+		return t.token, nil
+	}
+
+	token, err := credentials.Get(GoogleAccessTokenCredentialName)
+	if err != nil {
+		return "", err
+	}
+	if token == "" {
+		output, err := util.Execute(exec.Command("gcloud", "auth", "print-access-token"))
+		if err != nil {
+			return "", util.NewMessageError("cannot get Google Cloud access token: set "+credentials.ToEnvName(GoogleAccessTokenCredentialName)+" env or login using gcloud", "ERR_SIGN_INVALID_OPTIONS")
+		}
+		token = strings.TrimSpace(string(output))
+	}
+	t.token = token
+	return token, nil
+}
+
+func (t *googleKmsSigner) Sign(requestContext context.Context, digest []byte) ([]byte, error) {
+	token, err := t.getToken()
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := jsoniter.Marshal(map[string]interface{}{"digest": map[string]string{"sha256": base64.StdEncoding.EncodeToString(digest)}})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var result struct {
+		Signature string `json:"signature"`
+	}
+	err = doSignerRequest(requestContext, t.httpClient, http.MethodPost, googleKmsApiUrl+"/"+t.keyVersion+":asymmetricSign", body, "application/json", token, &result)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot sign using Google Cloud KMS")
+	}
+
+	// ECDSA signature is returned in DER
+	signature, err := base64.StdEncoding.DecodeString(result.Signature)
+	return signature, errors.WithStack(err)
+}
+
+// PKCS#11 token (USB token, HSM) is used via pkcs11-tool (OpenSC, PKCS11_TOOL_PATH env to use custom) - no cgo.
+// Tokens usually don't support concurrent sessions, so, signing is serialized.
+type pkcs11Signer struct {
+	module       string
+	keyId        string
+	pin          string
+	certificates []*x509.Certificate
+
+	mutex sync.Mutex
+}
+
+func createPkcs11Signer(options *SignerOptions, certificates []*x509.Certificate) (Signer, error) {
+	pin, err := credentials.Get(Pkcs11PinCredentialName)
+	if err != nil {
+		return nil, err
+	}
+
+	signer := &pkcs11Signer{module: options.Pkcs11Module, keyId: options.Pkcs11KeyId, pin: pin, certificates: certificates}
+	if len(certificates) == 0 {
+		// the certificate stored on the token with the same ID as the key
+		output, err := signer.execute("--read-object", "--type", "cert", "--id", signer.keyId)
+		if err != nil {
+			return nil, errors.WithMessage(err, "cannot read certificate from PKCS#11 token (specify certificate file)")
+		}
+		certificate, err := x509.ParseCertificate(output)
+		if err != nil {
+			return nil, errors.WithMessage(err, "cannot parse certificate from PKCS#11 token")
+		}
+		signer.certificates = []*x509.Certificate{certificate}
+	}
+	return signer, nil
+}
+
+func (t *pkcs11Signer) Certificates() []*x509.Certificate {
+	return t.certificates
+}
+
+func (t *pkcs11Signer) execute(args ...string) ([]byte, error) {
+	args = append([]string{"--module", t.module}, args...)
+	command := exec.Command(util.GetEnvOrDefault("PKCS11_TOOL_PATH", "pkcs11-tool"))
+	if t.pin != "" {
+		// PIN is passed using env to not expose it in the process list and logged command line
+		pinEnvName := credentials.ToEnvName(Pkcs11PinCredentialName)
+		args = append(args, "--login", "--pin", "env:"+pinEnvName)
+		command.Env = append(os.Environ(), pinEnvName+"="+t.pin)
+	}
+	command.Args = append(command.Args, args...)
+	return util.Execute(command)
+}
+
+func (t *pkcs11Signer) Sign(requestContext context.Context, digest []byte) ([]byte, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	tempDir, err := util.CreateTempDir("pkcs11")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(tempDir)
+	}()
+
+	input := digest
+	args := []string{"--sign", "--id", t.keyId}
+	if isEcdsaCertificate(t.certificates[0]) {
+		args = append(args, "--mechanism", "ECDSA", "--signature-format", "openssl")
+	} else {
+		if _, ok := t.certificates[0].PublicKey.(*rsa.PublicKey); !ok {
+			return nil, errors.New("unsupported key type")
+		}
+		// raw RSA-PKCS mechanism signs DigestInfo as is
+		input, err = asn1.Marshal(digestInfo{DigestAlgorithm: sha256AlgorithmIdentifier, Digest: digest})
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		args = append(args, "--mechanism", "RSA-PKCS")
+	}
+
+	inputFile := filepath.Join(tempDir, "input")
+	outputFile := filepath.Join(tempDir, "signature")
+	err = ioutil.WriteFile(inputFile, input, 0600)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	_, err = t.execute(append(args, "--input-file", inputFile, "--output-file", outputFile)...)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot sign using PKCS#11 token")
+	}
+
+	signature, err := ioutil.ReadFile(outputFile)
+	return signature, errors.WithStack(err)
+}
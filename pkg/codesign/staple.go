@@ -0,0 +1,395 @@
+package codesign
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"debug/macho"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/json-iterator/go"
+	"go.uber.org/zap"
+)
+
+// the same service as used by stapler to download ticket by CDHash
+var ticketLookupUrl = "https://api.apple-cloudkit.com/database/1/com.apple.gk.ticket-delivery/production/public/records/lookup"
+
+const (
+	superBlobMagic     = 0xfade0cc0
+	codeDirectoryMagic = 0xfade0c02
+
+	slotCodeDirectory          = 0
+	slotAlternateCodeDirectory = 0x1000
+	slotTicket                 = 0x10002
+
+	hashTypeSha1   = 1
+	hashTypeSha256 = 2
+
+	loadCmdCodeSignature = 0x1d
+
+	kolySize = 512
+	// code signature offset and length are stored in the reserved area of koly trailer (right after XML offset and length)
+	kolyCodeSignatureOffset = 232
+)
+
+func configureStapleCommand(codesignCommand *kingpin.CmdClause) {
+	command := codesignCommand.Command("staple", "Download notarization ticket and staple it to .app or .dmg (Xcode is not required).")
+	file := command.Flag("file", "The notarized .app or .dmg.").Required().ExistingFileOrDir()
+	command.Action(func(context *kingpin.ParseContext) error {
+		requestContext, cancel := util.CreateContextWithTimeout(5 * time.Minute)
+		defer cancel()
+		return Staple(requestContext, *file)
+	})
+}
+
+// Staple downloads ticket of the notarized .app or .dmg and stores it: Contents/CodeResources of app, ticket slot of dmg code signature.
+func Staple(requestContext context.Context, file string) error {
+	isDmg := strings.HasSuffix(strings.ToLower(file), ".dmg")
+	var signature []byte
+	var err error
+	if isDmg {
+		signature, _, err = readDmgCodeSignature(file)
+	} else {
+		signature, err = readAppCodeSignature(file)
+	}
+	if err != nil {
+		return err
+	}
+
+	recordName, err := getTicketRecordName(signature)
+	if err != nil {
+		return errors.WithMessage(err, file)
+	}
+
+	ticket, err := lookupTicket(requestContext, recordName)
+	if err != nil {
+		return err
+	}
+
+	log.Info("stapling notarization ticket", zap.String("file", file), zap.String("record", recordName))
+	if isDmg {
+		return stapleDmg(file, ticket)
+	}
+	return errors.WithStack(ioutil.WriteFile(filepath.Join(file, "Contents", "CodeResources"), ticket, 0644))
+}
+
+func readAppCodeSignature(appDir string) ([]byte, error) {
+	executable, err := getBundleMainExecutable(appDir, KindApp)
+	if err != nil {
+		return nil, err
+	}
+	if executable == "" {
+		return nil, util.NewMessageError("main executable of "+appDir+" is not found (CFBundleExecutable is not set)", "ERR_STAPLE_UNSUPPORTED")
+	}
+	return readMachOCodeSignature(executable)
+}
+
+// readMachOCodeSignature returns the code signature super blob (LC_CODE_SIGNATURE) of the Mach-O file (of the first architecture for universal binary)
+func readMachOCodeSignature(file string) ([]byte, error) {
+	reader, err := os.Open(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer util.Close(reader)
+
+	var machoFile *macho.File
+	var archOffset int64
+	fatFile, err := macho.NewFatFile(reader)
+	if err == nil {
+		machoFile = fatFile.Arches[0].File
+		archOffset = int64(fatFile.Arches[0].Offset)
+	} else {
+		machoFile, err = macho.NewFile(reader)
+		if err != nil {
+			return nil, errors.WithMessage(err, "cannot parse "+file)
+		}
+	}
+
+	for _, load := range machoFile.Loads {
+		raw := load.Raw()
+		if len(raw) < 16 || machoFile.ByteOrder.Uint32(raw) != loadCmdCodeSignature {
+			continue
+		}
+
+		offset := int64(machoFile.ByteOrder.Uint32(raw[8:]))
+		size := machoFile.ByteOrder.Uint32(raw[12:])
+		data := make([]byte, size)
+		_, err = reader.ReadAt(data, archOffset+offset)
+		if err != nil {
+			return nil, errors.WithMessage(err, "cannot read code signature of "+file)
+		}
+		return data, nil
+	}
+	return nil, util.NewMessageError(file+" is not signed", "ERR_STAPLE_NOT_SIGNED")
+}
+
+// readDmgCodeSignature returns the code signature super blob and its offset
+func readDmgCodeSignature(file string) ([]byte, int64, error) {
+	reader, err := os.Open(file)
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	defer util.Close(reader)
+
+	koly, err := readKoly(reader)
+	if err != nil {
+		return nil, 0, errors.WithMessage(err, file)
+	}
+
+	offset := int64(binary.BigEndian.Uint64(koly[kolyCodeSignatureOffset:]))
+	size := binary.BigEndian.Uint64(koly[kolyCodeSignatureOffset+8:])
+	if size == 0 {
+		return nil, 0, util.NewMessageError(file+" is not signed", "ERR_STAPLE_NOT_SIGNED")
+	}
+
+	data := make([]byte, size)
+	_, err = reader.ReadAt(data, offset)
+	if err != nil {
+		return nil, 0, errors.WithMessage(err, "cannot read code signature of "+file)
+	}
+	return data, offset, nil
+}
+
+func readKoly(reader *os.File) ([]byte, error) {
+	info, err := reader.Stat()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if info.Size() < kolySize {
+		return nil, errors.New("not a disk image")
+	}
+
+	koly := make([]byte, kolySize)
+	_, err = reader.ReadAt(koly, info.Size()-kolySize)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if string(koly[:4]) != "koly" {
+		return nil, errors.New("not a disk image (koly trailer is not found)")
+	}
+	return koly, nil
+}
+
+type blobIndexEntry struct {
+	slot uint32
+	data []byte
+}
+
+func parseSuperBlob(data []byte) ([]*blobIndexEntry, error) {
+	if len(data) < 12 || binary.BigEndian.Uint32(data) != superBlobMagic {
+		return nil, errors.New("invalid code signature")
+	}
+
+	length := binary.BigEndian.Uint32(data[4:])
+	count := binary.BigEndian.Uint32(data[8:])
+	if uint64(length) > uint64(len(data)) || 12+uint64(count)*8 > uint64(length) {
+		return nil, errors.New("invalid code signature")
+	}
+	data = data[:length]
+
+	offsets := make([]uint32, count)
+	for i := range offsets {
+		offsets[i] = binary.BigEndian.Uint32(data[12+i*8+4:])
+		if offsets[i] < 12+count*8 || offsets[i] > length {
+			return nil, errors.New("invalid code signature blob offset")
+		}
+	}
+
+	// ticket is not a generic blob (no length field), so, blob ends where the next one starts
+	result := make([]*blobIndexEntry, count)
+	for i, offset := range offsets {
+		end := length
+		for _, otherOffset := range offsets {
+			if otherOffset > offset && otherOffset < end {
+				end = otherOffset
+			}
+		}
+		result[i] = &blobIndexEntry{slot: binary.BigEndian.Uint32(data[12+i*8:]), data: data[offset:end]}
+	}
+	return result, nil
+}
+
+func encodeSuperBlob(entries []*blobIndexEntry) []byte {
+	headerSize := 12 + 8*len(entries)
+	size := headerSize
+	for _, entry := range entries {
+		size += len(entry.data)
+	}
+
+	result := make([]byte, headerSize, size)
+	binary.BigEndian.PutUint32(result, superBlobMagic)
+	binary.BigEndian.PutUint32(result[4:], uint32(size))
+	binary.BigEndian.PutUint32(result[8:], uint32(len(entries)))
+	for i, entry := range entries {
+		binary.BigEndian.PutUint32(result[12+i*8:], entry.slot)
+		binary.BigEndian.PutUint32(result[12+i*8+4:], uint32(len(result)))
+		result = append(result, entry.data...)
+	}
+	return result
+}
+
+// getTicketRecordName returns 2/<hash type>/<CDHash> - CDHash of the strongest code directory (SHA-256 is preferred), truncated to 20 bytes
+func getTicketRecordName(signature []byte) (string, error) {
+	entries, err := parseSuperBlob(signature)
+	if err != nil {
+		return "", err
+	}
+
+	var codeDirectory []byte
+	hashType := byte(0)
+	for _, entry := range entries {
+		if entry.slot != slotCodeDirectory && (entry.slot < slotAlternateCodeDirectory || entry.slot >= slotAlternateCodeDirectory+5) {
+			continue
+		}
+		if len(entry.data) < 38 || binary.BigEndian.Uint32(entry.data) != codeDirectoryMagic {
+			continue
+		}
+
+		// hashSize (36) and hashType (37) follow magic, length, version, flags, hashOffset, identOffset, nSpecialSlots, nCodeSlots and codeLimit
+		entryHashType := entry.data[37]
+		cdLength := binary.BigEndian.Uint32(entry.data[4:])
+		if (entryHashType == hashTypeSha1 || entryHashType == hashTypeSha256) && entryHashType > hashType && uint64(cdLength) <= uint64(len(entry.data)) {
+			hashType = entryHashType
+			// blob may be followed by padding
+			codeDirectory = entry.data[:cdLength]
+		}
+	}
+
+	var cdHash []byte
+	switch hashType {
+	case hashTypeSha256:
+		hash := sha256.Sum256(codeDirectory)
+		cdHash = hash[:20]
+	case hashTypeSha1:
+		hash := sha1.Sum(codeDirectory)
+		cdHash = hash[:]
+	default:
+		return "", errors.New("code directory is not found in the code signature")
+	}
+	return "2/" + strconv.Itoa(int(hashType)) + "/" + hex.EncodeToString(cdHash), nil
+}
+
+func lookupTicket(requestContext context.Context, recordName string) ([]byte, error) {
+	body, err := jsoniter.Marshal(map[string]interface{}{"records": []map[string]string{{"recordName": recordName}}})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, ticketLookupUrl, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: util.ProxyFromEnvironmentAndNpm,
+		},
+	}
+	response, err := httpClient.Do(request.WithContext(requestContext))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer util.Close(response.Body)
+
+	responseBody, err := ioutil.ReadAll(io.LimitReader(response.Body, 16*1024*1024))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("cannot download notarization ticket: %s %s", response.Status, strings.TrimSpace(string(responseBody)))
+	}
+
+	var result struct {
+		Records []struct {
+			ServerErrorCode string `json:"serverErrorCode"`
+			Reason          string `json:"reason"`
+			Fields          struct {
+				SignedTicket struct {
+					Value string `json:"value"`
+				} `json:"signedTicket"`
+			} `json:"fields"`
+		} `json:"records"`
+	}
+	err = jsoniter.Unmarshal(responseBody, &result)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if len(result.Records) == 0 || result.Records[0].ServerErrorCode != "" || result.Records[0].Fields.SignedTicket.Value == "" {
+		reason := "not found"
+		if len(result.Records) != 0 && result.Records[0].Reason != "" {
+			reason = result.Records[0].Reason
+		}
+		return nil, util.NewMessageError("notarization ticket "+recordName+" is not available ("+reason+"), the file is not notarized or ticket is not published yet", "ERR_STAPLE_TICKET_NOT_FOUND")
+	}
+
+	ticket, err := base64.StdEncoding.DecodeString(result.Records[0].Fields.SignedTicket.Value)
+	if err != nil {
+		return nil, errors.WithMessage(err, "invalid notarization ticket")
+	}
+	return ticket, nil
+}
+
+// stapleDmg adds ticket to the code signature (replacing existing one). Code signature must be located at the end of the image, right before koly trailer.
+func stapleDmg(file string, ticket []byte) error {
+	signature, offset, err := readDmgCodeSignature(file)
+	if err != nil {
+		return err
+	}
+
+	entries, err := parseSuperBlob(signature)
+	if err != nil {
+		return errors.WithMessage(err, file)
+	}
+
+	newEntries := make([]*blobIndexEntry, 0, len(entries)+1)
+	for _, entry := range entries {
+		if entry.slot != slotTicket {
+			newEntries = append(newEntries, entry)
+		}
+	}
+	newEntries = append(newEntries, &blobIndexEntry{slot: slotTicket, data: ticket})
+	newSignature := encodeSuperBlob(newEntries)
+
+	writer, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(writer)
+
+	koly, err := readKoly(writer)
+	if err != nil {
+		return errors.WithMessage(err, file)
+	}
+
+	info, err := writer.Stat()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if offset+int64(len(signature)) != info.Size()-kolySize {
+		return util.NewMessageError("code signature of "+file+" is not located at the end of the image, cannot staple", "ERR_STAPLE_UNSUPPORTED")
+	}
+
+	binary.BigEndian.PutUint64(koly[kolyCodeSignatureOffset+8:], uint64(len(newSignature)))
+	_, err = writer.WriteAt(append(newSignature, koly...), offset)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(writer.Truncate(offset + int64(len(newSignature)) + kolySize))
+}
@@ -0,0 +1,129 @@
+package codesign
+
+import (
+	"context"
+	"crypto/sha256"
+	"debug/macho"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+)
+
+func createTestSignature(hashType byte, id byte) []byte {
+	codeDirectory := make([]byte, 44)
+	binary.BigEndian.PutUint32(codeDirectory, codeDirectoryMagic)
+	binary.BigEndian.PutUint32(codeDirectory[4:], uint32(len(codeDirectory)))
+	codeDirectory[37] = hashType
+	codeDirectory[40] = id
+	requirements := []byte{0xfa, 0xde, 0x0c, 0x01, 0, 0, 0, 12, 0, 0, 0, 0}
+	return encodeSuperBlob([]*blobIndexEntry{{slot: slotCodeDirectory, data: codeDirectory}, {slot: 2, data: requirements}})
+}
+
+func getTestRecordName(signature []byte) string {
+	entries, _ := parseSuperBlob(signature)
+	hash := sha256.Sum256(entries[0].data)
+	return "2/2/" + hex.EncodeToString(hash[:20])
+}
+
+// image data, code signature and koly trailer
+func writeTestDmg(g *GomegaWithT, file string, signature []byte) {
+	data := make([]byte, 1024)
+	koly := make([]byte, kolySize)
+	copy(koly, "koly")
+	binary.BigEndian.PutUint64(koly[kolyCodeSignatureOffset:], uint64(len(data)))
+	binary.BigEndian.PutUint64(koly[kolyCodeSignatureOffset+8:], uint64(len(signature)))
+	writeFile(g, file, string(data)+string(signature)+string(koly))
+}
+
+// 32-bit executable with the only load command LC_CODE_SIGNATURE
+func writeSignedMachO(g *GomegaWithT, file string, signature []byte) {
+	data := make([]byte, 44)
+	binary.LittleEndian.PutUint32(data[0:], macho.Magic32)
+	binary.LittleEndian.PutUint32(data[4:], uint32(macho.Cpu386))
+	binary.LittleEndian.PutUint32(data[12:], uint32(macho.TypeExec))
+	binary.LittleEndian.PutUint32(data[16:], 1)
+	binary.LittleEndian.PutUint32(data[20:], 16)
+	binary.LittleEndian.PutUint32(data[28:], loadCmdCodeSignature)
+	binary.LittleEndian.PutUint32(data[32:], 16)
+	binary.LittleEndian.PutUint32(data[36:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(data[40:], uint32(len(signature)))
+	writeFile(g, file, string(data)+string(signature))
+}
+
+func startTicketServer(g *GomegaWithT, tickets map[string]string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := ioutil.ReadAll(request.Body)
+		for recordName, ticket := range tickets {
+			if strings.Contains(string(body), `"recordName":"`+recordName+`"`) {
+				_, _ = writer.Write([]byte(`{"records": [{"recordName": "` + recordName + `", "fields": {"signedTicket": {"type": "BYTES", "value": "` + base64.StdEncoding.EncodeToString([]byte(ticket)) + `"}}}]}`))
+				return
+			}
+		}
+		_, _ = writer.Write([]byte(`{"records": [{"serverErrorCode": "NOT_FOUND", "reason": "Record not found"}]}`))
+	}))
+	ticketLookupUrl = server.URL
+	return server
+}
+
+func TestStaple(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "staple")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	appSignature := createTestSignature(hashTypeSha256, 1)
+	dmgSignature := createTestSignature(hashTypeSha256, 2)
+
+	server := startTicketServer(g, map[string]string{getTestRecordName(appSignature): "app ticket", getTestRecordName(dmgSignature): "dmg ticket"})
+	defer server.Close()
+
+	appDir := filepath.Join(dir, "Test.app")
+	writeFile(g, filepath.Join(appDir, "Contents", "Info.plist"), `<?xml version="1.0" encoding="UTF-8"?><plist version="1.0"><dict><key>CFBundleExecutable</key><string>Test</string></dict></plist>`)
+	writeSignedMachO(g, filepath.Join(appDir, "Contents", "MacOS", "Test"), appSignature)
+	g.Expect(Staple(context.Background(), appDir)).To(Succeed())
+	data, err := ioutil.ReadFile(filepath.Join(appDir, "Contents", "CodeResources"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(data)).To(Equal("app ticket"))
+
+	dmgFile := filepath.Join(dir, "Test.dmg")
+	writeTestDmg(g, dmgFile, dmgSignature)
+	// stapling twice replaces the ticket
+	for i := 0; i < 2; i++ {
+		g.Expect(Staple(context.Background(), dmgFile)).To(Succeed())
+	}
+
+	signature, offset, err := readDmgCodeSignature(dmgFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(offset).To(BeNumerically("==", 1024))
+	entries, err := parseSuperBlob(signature)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(entries).To(HaveLen(3))
+	g.Expect(entries[2].slot).To(BeNumerically("==", slotTicket))
+	g.Expect(string(entries[2].data)).To(Equal("dmg ticket"))
+	// record name is not changed by stapling
+	recordName, err := getTicketRecordName(signature)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(recordName).To(Equal(getTestRecordName(dmgSignature)))
+
+	info, err := os.Stat(dmgFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(info.Size()).To(BeNumerically("==", 1024+len(signature)+kolySize))
+
+	unknownFile := filepath.Join(dir, "Unknown.dmg")
+	writeTestDmg(g, unknownFile, createTestSignature(hashTypeSha1, 3))
+	err = Staple(context.Background(), unknownFile)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.(interface{ ErrorCode() string }).ErrorCode()).To(Equal("ERR_STAPLE_TICKET_NOT_FOUND"))
+}
@@ -0,0 +1,390 @@
+package codesign
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	mathRand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	TimestampRfc3161 = "rfc3161"
+	// legacy protocol (signtool /t), some corporate timestamp authorities support only it
+	TimestampAuthenticode = "authenticode"
+)
+
+// used if timestamp servers are not specified
+var DefaultTimestampServers = []string{
+	"http://timestamp.digicert.com",
+	"http://timestamp.sectigo.com",
+	"http://timestamp.globalsign.com/tsa/r6advanced1",
+}
+
+var (
+	// base delay between attempts, doubled on each attempt (with jitter to not retry in lockstep when many files are signed in parallel)
+	timestampRetryDelay = time.Second
+	// failed or throttled server is not used for this duration, doubled on each consecutive failure
+	timestampServerCooldown    = 10 * time.Second
+	maxTimestampServerCooldown = 5 * time.Minute
+)
+
+var (
+	oidAuthenticodeTimestampRequest = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 3, 2, 1}
+	oidCounterSignature             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 6}
+)
+
+// https://tools.ietf.org/html/rfc3161#section-2.4.1
+type timeStampReq struct {
+	Version        int
+	MessageImprint messageImprint
+	Nonce          *big.Int `asn1:"optional"`
+	CertReq        bool     `asn1:"optional,default:false"`
+}
+
+type messageImprint struct {
+	HashAlgorithm algorithmIdentifier
+	HashedMessage []byte
+}
+
+type pkiStatusInfo struct {
+	Status       int
+	StatusString []asn1.RawValue `asn1:"optional"`
+	FailInfo     asn1.BitString  `asn1:"optional"`
+}
+
+type timeStampResp struct {
+	Status         pkiStatusInfo
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+// https://docs.microsoft.com/en-us/windows/win32/seccrypto/time-stamping-authenticode-signatures
+type authenticodeTimestampRequest struct {
+	CountersignatureType asn1.ObjectIdentifier
+	Content              contentInfo
+}
+
+type timestampHttpError struct {
+	status     string
+	retryAfter time.Duration
+}
+
+func (t *timestampHttpError) Error() string {
+	return "timestamp server responded with " + t.status
+}
+
+type TimestampServerStats struct {
+	Url      string `json:"url"`
+	Protocol string `json:"protocol"`
+	Requests int    `json:"requests"`
+	Failures int    `json:"failures"`
+}
+
+type timestampServer struct {
+	TimestampServerStats
+
+	consecutiveFailures int
+	disabledUntil       time.Time
+}
+
+// timestampPool is shared by all files signed in parallel. Servers are rotated to spread the load (a single timestamp authority throttles),
+// failed or throttled server is not used until its cooldown is over, and requests are not sent more often than the rate limit allows.
+type timestampPool struct {
+	mutex   sync.Mutex
+	servers []*timestampServer
+	next    int
+
+	interval        time.Duration
+	nextRequestTime time.Time
+}
+
+// newTimestampPool returns nil if there are no servers (do not timestamp). Rate limit is a number of requests per second for all servers, 0 means unlimited.
+func newTimestampPool(rfc3161Servers []string, authenticodeServers []string, rateLimit float64) *timestampPool {
+	pool := &timestampPool{}
+	for _, url := range rfc3161Servers {
+		pool.servers = append(pool.servers, &timestampServer{TimestampServerStats: TimestampServerStats{Url: url, Protocol: TimestampRfc3161}})
+	}
+	for _, url := range authenticodeServers {
+		pool.servers = append(pool.servers, &timestampServer{TimestampServerStats: TimestampServerStats{Url: url, Protocol: TimestampAuthenticode}})
+	}
+	if len(pool.servers) == 0 {
+		return nil
+	}
+
+	if rateLimit > 0 {
+		pool.interval = time.Duration(float64(time.Second) / rateLimit)
+	}
+	return pool
+}
+
+func (t *timestampPool) Stats() []TimestampServerStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	result := make([]TimestampServerStats, len(t.servers))
+	for index, server := range t.servers {
+		result[index] = server.TimestampServerStats
+	}
+	return result
+}
+
+// acquire returns the next healthy server and waits until request is allowed by the rate limit.
+// If all servers are in cooldown, waits for the one that becomes available first.
+func (t *timestampPool) acquire(requestContext context.Context) (*timestampServer, error) {
+	t.mutex.Lock()
+	now := time.Now()
+	var server *timestampServer
+	for i := 0; i < len(t.servers); i++ {
+		index := (t.next + i) % len(t.servers)
+		if !t.servers[index].disabledUntil.After(now) {
+			server = t.servers[index]
+			t.next = index + 1
+			break
+		}
+	}
+	if server == nil {
+		for _, candidate := range t.servers {
+			if server == nil || candidate.disabledUntil.Before(server.disabledUntil) {
+				server = candidate
+			}
+		}
+	}
+
+	requestTime := now
+	if server.disabledUntil.After(requestTime) {
+		requestTime = server.disabledUntil
+	}
+	if t.nextRequestTime.After(requestTime) {
+		requestTime = t.nextRequestTime
+	}
+	t.nextRequestTime = requestTime.Add(t.interval)
+	t.mutex.Unlock()
+
+	return server, sleepWithContext(requestContext, time.Until(requestTime))
+}
+
+func (t *timestampPool) report(server *timestampServer, err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	server.Requests++
+	if err == nil {
+		server.consecutiveFailures = 0
+		return
+	}
+
+	server.Failures++
+	server.consecutiveFailures++
+	cooldown := timestampServerCooldown << uint(minInt(server.consecutiveFailures-1, 10))
+	if cooldown > maxTimestampServerCooldown {
+		cooldown = maxTimestampServerCooldown
+	}
+	if httpError, ok := errors.Cause(err).(*timestampHttpError); ok && httpError.retryAfter > cooldown {
+		cooldown = httpError.retryAfter
+	}
+	server.disabledUntil = time.Now().Add(cooldown)
+}
+
+// addTimestamp requests timestamp of the signature and adds it as unauthenticated attribute.
+// Every server is tried at least twice before giving up - timestamp servers are often temporarily unavailable.
+func (t *timestampPool) addTimestamp(requestContext context.Context, signature *signedData) error {
+	maxAttempts := 2 * len(t.servers)
+	if maxAttempts < 3 {
+		maxAttempts = 3
+	}
+
+	var lastError error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if attempt > 0 {
+			err := sleepWithContext(requestContext, jitter(timestampRetryDelay<<uint(minInt(attempt-1, 5))))
+			if err != nil {
+				return err
+			}
+		}
+
+		server, err := t.acquire(requestContext)
+		if err != nil {
+			return err
+		}
+
+		if server.Protocol == TimestampAuthenticode {
+			err = addAuthenticodeTimestamp(requestContext, server.Url, signature)
+		} else {
+			err = addRfc3161Timestamp(requestContext, server.Url, signature)
+		}
+		t.report(server, err)
+		if err == nil {
+			return nil
+		}
+
+		if requestContext.Err() != nil {
+			return errors.WithStack(requestContext.Err())
+		}
+		lastError = err
+		log.Warn("cannot get timestamp", zap.String("server", server.Url), zap.Int("attempt", attempt+1), zap.Error(err))
+	}
+	return util.NewMessageError("cannot get timestamp from any server: "+lastError.Error(), "ERR_SIGN_TIMESTAMP_FAILED")
+}
+
+func addRfc3161Timestamp(requestContext context.Context, server string, signature *signedData) error {
+	digest := sha256.Sum256(signature.SignerInfos[0].EncryptedDigest)
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 63))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	body, err := asn1.Marshal(timeStampReq{
+		Version:        1,
+		MessageImprint: messageImprint{HashAlgorithm: sha256AlgorithmIdentifier, HashedMessage: digest[:]},
+		Nonce:          nonce,
+		CertReq:        true,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	responseBody, err := doTimestampRequest(requestContext, server, "application/timestamp-query", body)
+	if err != nil {
+		return err
+	}
+
+	var result timeStampResp
+	_, err = asn1.Unmarshal(responseBody, &result)
+	if err != nil {
+		return errors.WithMessage(err, "invalid timestamp response")
+	}
+	// granted (0) or grantedWithMods (1)
+	if result.Status.Status > 1 || len(result.TimeStampToken.FullBytes) == 0 {
+		return errors.Errorf("timestamp is not granted (status %d)", result.Status.Status)
+	}
+	return signature.setUnauthenticatedAttribute(oidRfc3161CounterSignature, asn1.RawValue{FullBytes: result.TimeStampToken.FullBytes})
+}
+
+// addAuthenticodeTimestamp adds signer info of timestamp authority as countersignature and its certificates to the signature.
+// Request and response are base64 encoded.
+func addAuthenticodeTimestamp(requestContext context.Context, server string, signature *signedData) error {
+	encryptedDigest, err := asn1.Marshal(signature.SignerInfos[0].EncryptedDigest)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	body, err := asn1.Marshal(authenticodeTimestampRequest{
+		CountersignatureType: oidAuthenticodeTimestampRequest,
+		Content:              contentInfo{ContentType: oidData, Content: newExplicitContent(encryptedDigest)},
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	responseBody, err := doTimestampRequest(requestContext, server, "application/octet-stream", []byte(base64.StdEncoding.EncodeToString(body)))
+	if err != nil {
+		return err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(responseBody)), ""))
+	if err != nil {
+		return errors.WithMessage(err, "invalid timestamp response")
+	}
+
+	var response contentInfo
+	_, err = asn1.Unmarshal(data, &response)
+	if err != nil {
+		return errors.WithMessage(err, "invalid timestamp response")
+	}
+	var timestamp signedData
+	_, err = asn1.Unmarshal(response.Content.Bytes, &timestamp)
+	if err != nil {
+		return errors.WithMessage(err, "invalid timestamp response")
+	}
+	if len(timestamp.SignerInfos) == 0 {
+		return errors.New("timestamp response doesn't contain signer info")
+	}
+
+	err = signature.setUnauthenticatedAttribute(oidCounterSignature, timestamp.SignerInfos[0])
+	if err != nil {
+		return err
+	}
+	signature.Certificates.FullBytes = nil
+	signature.Certificates.Bytes = append(signature.Certificates.Bytes, timestamp.Certificates.Bytes...)
+	return nil
+}
+
+func doTimestampRequest(requestContext context.Context, server string, contentType string, body []byte) ([]byte, error) {
+	request, err := http.NewRequest(http.MethodPost, server, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	request.Header.Set("Content-Type", contentType)
+
+	requestContext, cancel := context.WithTimeout(requestContext, time.Minute)
+	defer cancel()
+
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: util.ProxyFromEnvironmentAndNpm,
+		},
+	}
+	response, err := httpClient.Do(request.WithContext(requestContext))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer util.Close(response.Body)
+
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if response.StatusCode != http.StatusOK {
+		result := &timestampHttpError{status: response.Status}
+		seconds, err := strconv.Atoi(response.Header.Get("Retry-After"))
+		if err == nil && seconds > 0 {
+			result.retryAfter = time.Duration(seconds) * time.Second
+		}
+		return nil, result
+	}
+	return responseBody, nil
+}
+
+// jitter returns random duration in [delay/2, delay*3/2)
+func jitter(delay time.Duration) time.Duration {
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(mathRand.Int63n(int64(delay)))
+}
+
+func sleepWithContext(requestContext context.Context, duration time.Duration) error {
+	if duration <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-requestContext.Done():
+		return errors.WithStack(requestContext.Err())
+	case <-timer.C:
+		return nil
+	}
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,48 @@
+// +build darwin linux
+
+package codesign
+
+import (
+	"bytes"
+
+	"github.com/develar/errors"
+	"golang.org/x/sys/unix"
+)
+
+// listAttributes returns names of extended attributes of the file (symlinks are not followed)
+func listAttributes(file string) ([]string, error) {
+	for {
+		size, err := unix.Llistxattr(file, nil)
+		if err != nil {
+			if err == unix.ENOTSUP || err == unix.EOPNOTSUPP {
+				return nil, nil
+			}
+			return nil, errors.WithStack(err)
+		}
+		if size == 0 {
+			return nil, nil
+		}
+
+		buffer := make([]byte, size)
+		size, err = unix.Llistxattr(file, buffer)
+		if err == unix.ERANGE {
+			// attribute was added in between
+			continue
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		var result []string
+		for _, name := range bytes.Split(buffer[:size], []byte{0}) {
+			if len(name) != 0 {
+				result = append(result, string(name))
+			}
+		}
+		return result, nil
+	}
+}
+
+func removeAttribute(file string, name string) error {
+	return errors.WithStack(unix.Lremovexattr(file, name))
+}
@@ -0,0 +1,12 @@
+// +build !darwin,!linux
+
+package codesign
+
+// extended attributes are not used on this platform
+func listAttributes(file string) ([]string, error) {
+	return nil, nil
+}
+
+func removeAttribute(file string, name string) error {
+	return nil
+}
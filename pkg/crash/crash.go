@@ -0,0 +1,224 @@
+package crash
+
+import (
+	"archive/zip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/json-iterator/go"
+)
+
+// set by main
+var AppVersion = ""
+
+// set by main, called before exit on panic (e.g. to remove temp files), log is synced after it
+var BeforeExit func()
+
+const redacted = "<redacted>"
+
+const minSensitiveValueLength = 6
+
+var sensitiveNameParts = []string{"secret", "password", "passwd", "token", "credential", "auth", "accesskey", "access_key", "apikey", "api_key", "private", "csc_key", "_key_id"}
+
+type report struct {
+	Time    string   `json:"time"`
+	Panic   string   `json:"panic"`
+	Command []string `json:"command"`
+
+	AppVersion string `json:"appVersion"`
+	GoVersion  string `json:"goVersion"`
+	Os         string `json:"os"`
+	Arch       string `json:"arch"`
+	CpuCount   int    `json:"cpuCount"`
+	WorkingDir string `json:"workingDir"`
+
+	Env []string `json:"env"`
+}
+
+// HandlePanic must be deferred directly (recover works only if called by deferred function): `defer crash.HandlePanic()`.
+// Process is terminated if panic is recovered.
+func HandlePanic() {
+	value := recover()
+	if value == nil {
+		return
+	}
+
+	stack := debug.Stack()
+	file, err := writeBundle(value, stack)
+
+	_, _ = fmt.Fprintf(os.Stderr, "app-builder crashed: %v\n%s\n", value, stack)
+	if err == nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Crash report is saved to %s\nPlease attach it to the issue report (https://github.com/develar/app-builder/issues). Check that it doesn't contain sensitive data before sharing.\n", file)
+	} else {
+		_, _ = fmt.Fprintf(os.Stderr, "cannot write crash report: %v\n", err)
+	}
+	// os.Exit doesn't run deferred functions of main - temp files are removed and buffered log is flushed here
+	if BeforeExit != nil {
+		BeforeExit()
+	}
+	if log.LOG != nil {
+		_ = log.LOG.Sync()
+	}
+	os.Exit(2)
+}
+
+// APP_BUILDER_CRASH_DIR or app-builder-crash in the system temp dir
+func GetCrashDir() string {
+	result := os.Getenv("APP_BUILDER_CRASH_DIR")
+	if result == "" {
+		result = filepath.Join(os.TempDir(), "app-builder-crash")
+	}
+	return result
+}
+
+func writeBundle(value interface{}, stack []byte) (string, error) {
+	crashDir := GetCrashDir()
+	err := os.MkdirAll(crashDir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	file := filepath.Join(crashDir, fmt.Sprintf("crash-%s-%d.zip", now.Format("20060102-150405"), os.Getpid()))
+
+	workingDir, _ := os.Getwd()
+	reportData, err := jsoniter.ConfigFastest.MarshalIndent(report{
+		Time:       now.Format(time.RFC3339),
+		Panic:      fmt.Sprintf("%v", value),
+		Command:    sanitizeArgs(os.Args),
+		AppVersion: AppVersion,
+		GoVersion:  runtime.Version(),
+		Os:         runtime.GOOS,
+		Arch:       runtime.GOARCH,
+		CpuCount:   runtime.NumCPU(),
+		WorkingDir: workingDir,
+		Env:        sanitizeEnv(os.Environ()),
+	}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	outFile, err := os.Create(file)
+	if err != nil {
+		return "", err
+	}
+
+	writer := zip.NewWriter(outFile)
+	for _, entry := range []struct {
+		name string
+		data []byte
+	}{
+		{"report.json", reportData},
+		{"stack.txt", stack},
+		{"log.txt", sanitizeLog(log.RecentLog(), os.Environ(), os.Args)},
+	} {
+		entryWriter, err := writer.Create(entry.name)
+		if err == nil {
+			_, err = entryWriter.Write(entry.data)
+		}
+		if err != nil {
+			_ = writer.Close()
+			_ = outFile.Close()
+			return "", err
+		}
+	}
+
+	err = writer.Close()
+	closeErr := outFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return file, err
+}
+
+func isSensitiveName(name string) bool {
+	name = strings.ToLower(name)
+	for _, part := range sensitiveNameParts {
+		if strings.Contains(name, part) {
+			return true
+		}
+	}
+	return false
+}
+
+func isSensitiveEnvName(name string) bool {
+	return isSensitiveName(name) || strings.HasSuffix(strings.ToLower(name), "_key")
+}
+
+func sanitizeEnv(env []string) []string {
+	result := make([]string, 0, len(env))
+	for _, entry := range env {
+		name := entry
+		index := strings.IndexRune(entry, '=')
+		if index > 0 {
+			name = entry[:index]
+		}
+
+		if isSensitiveEnvName(name) {
+			result = append(result, name+"="+redacted)
+		} else {
+			result = append(result, entry)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func sanitizeArgs(args []string) []string {
+	result := make([]string, len(args))
+	isValueSensitive := false
+	for index, arg := range args {
+		switch {
+		case isValueSensitive:
+			result[index] = redacted
+			isValueSensitive = false
+
+		case strings.HasPrefix(arg, "-") && isSensitiveName(arg):
+			if equalIndex := strings.IndexRune(arg, '='); equalIndex > 0 {
+				result[index] = arg[:equalIndex+1] + redacted
+			} else {
+				result[index] = arg
+				isValueSensitive = true
+			}
+
+		default:
+			result[index] = arg
+		}
+	}
+	return result
+}
+
+// values of sensitive env vars and args are redacted in the log (e.g. token can be logged as part of URL or command line of child process),
+// short values are kept - it is unlikely a secret, but redacting it would make log unreadable
+func sanitizeLog(data []byte, env []string, args []string) []byte {
+	var values []string
+	for _, entry := range env {
+		index := strings.IndexRune(entry, '=')
+		if index > 0 && isSensitiveEnvName(entry[:index]) {
+			values = append(values, entry[index+1:])
+		}
+	}
+	for index, arg := range sanitizeArgs(args) {
+		if arg != args[index] {
+			values = append(values, args[index][len(arg)-len(redacted):])
+		}
+	}
+
+	// longer first - value can contain another one
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+
+	result := string(data)
+	for _, value := range values {
+		if len(value) >= minSensitiveValueLength {
+			result = strings.ReplaceAll(result, value, redacted)
+		}
+	}
+	return []byte(result)
+}
@@ -0,0 +1,54 @@
+package credentials
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/develar/app-builder/pkg/util"
+)
+
+// Executable that prints secret for the requested name to stdout: `<helper> get <name>` (the same convention as git credential helpers).
+// Allows to fetch secrets from a vault or keychain on demand instead of keeping them in env of the whole build.
+const HelperEnvName = "APP_BUILDER_CREDENTIALS_HELPER"
+
+// Get returns secret from env (name in upper snake case with APP_BUILDER_ prefix, e.g. archive-password -> APP_BUILDER_ARCHIVE_PASSWORD)
+// or, if not set, from the credentials helper. Empty string is returned if secret is not configured.
+func Get(name string) (string, error) {
+	value := os.Getenv(ToEnvName(name))
+	if len(value) != 0 {
+		return value, nil
+	}
+
+	helper := os.Getenv(HelperEnvName)
+	if len(helper) == 0 {
+		return "", nil
+	}
+
+	command := exec.Command(helper, "get", name)
+	var errorOutput bytes.Buffer
+	command.Stderr = &errorOutput
+	// util.Execute is not used - output must not be logged
+	output, err := command.Output()
+	if err != nil {
+		return "", util.NewMessageError("credentials helper cannot get "+name+": "+strings.TrimSpace(errorOutput.String()), "ERR_CREDENTIALS_HELPER_FAILED")
+	}
+	return strings.TrimRight(string(output), "\r\n"), nil
+}
+
+// GetRequired is the same as Get, but reports error if secret is not configured.
+func GetRequired(name string) (string, error) {
+	value, err := Get(name)
+	if err != nil {
+		return "", err
+	}
+	if len(value) == 0 {
+		return "", util.NewMessageError(name+" is not set: set "+ToEnvName(name)+" env or configure credentials helper using "+HelperEnvName+" env", "ERR_CREDENTIALS_NOT_SET")
+	}
+	return value, nil
+}
+
+func ToEnvName(name string) string {
+	return "APP_BUILDER_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
@@ -0,0 +1,109 @@
+package deprecation
+
+import (
+	"os"
+	"sync"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/json-iterator/go"
+	"go.uber.org/zap"
+)
+
+// if set, each warning is appended to the file as JSON line - electron-builder reads it after build to surface migration guidance to user
+const WarningsFileEnvName = "APP_BUILDER_WARNINGS_FILE"
+
+const (
+	KindFlag   = "flag"
+	KindEnv    = "env"
+	KindTarget = "target"
+	KindConfig = "config"
+)
+
+type Warning struct {
+	// stable id to allow client to match warning, e.g. "snap-extraAppArgs-flag"
+	Id   string `json:"id"`
+	Kind string `json:"kind"`
+	// deprecated flag, env or config name
+	Name        string `json:"name"`
+	Message     string `json:"message"`
+	Replacement string `json:"replacement,omitempty"`
+	Url         string `json:"url,omitempty"`
+}
+
+var mutex sync.Mutex
+var reportedIds = make(map[string]bool)
+
+// Report logs warning (once per process) and writes it to the warnings file if APP_BUILDER_WARNINGS_FILE is set
+func Report(warning Warning) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if reportedIds[warning.Id] {
+		return
+	}
+	reportedIds[warning.Id] = true
+
+	fields := []zap.Field{zap.String("id", warning.Id)}
+	if len(warning.Replacement) != 0 {
+		fields = append(fields, zap.String("replacement", warning.Replacement))
+	}
+	if len(warning.Url) != 0 {
+		fields = append(fields, zap.String("see", warning.Url))
+	}
+	log.Warn(warning.Message, fields...)
+
+	file := os.Getenv(WarningsFileEnvName)
+	if len(file) == 0 {
+		return
+	}
+
+	err := appendToFile(file, &warning)
+	if err != nil {
+		// warning is already logged, failed report must not fail the build
+		log.Debug("cannot write deprecation warning", zap.String("file", file), zap.Error(err))
+	}
+}
+
+func appendToFile(file string, warning *Warning) error {
+	data, err := jsoniter.ConfigFastest.Marshal(warning)
+	if err != nil {
+		return err
+	}
+
+	// append mode - several app-builder processes of the same build write to the same file, each line is written by a single write call
+	writer, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.Write(append(data, '\n'))
+	closeErr := writer.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// StringFlagAlias registers hidden deprecated name of the flag. If old name is used, warning is reported and value is applied to the new flag (unless it is set explicitly).
+func StringFlagAlias(command *kingpin.CmdClause, oldName string, newName string, target *string) {
+	value := command.Flag(oldName, "Deprecated, use --"+newName+".").Hidden().String()
+	// pre action - must be applied before command action
+	command.PreAction(func(context *kingpin.ParseContext) error {
+		if len(*value) == 0 {
+			return nil
+		}
+
+		Report(Warning{
+			Id:          command.FullCommand() + "-" + oldName + "-flag",
+			Kind:        KindFlag,
+			Name:        "--" + oldName,
+			Message:     "--" + oldName + " is deprecated, use --" + newName,
+			Replacement: "--" + newName,
+		})
+		if len(*target) == 0 {
+			*target = *value
+		}
+		return nil
+	})
+}
@@ -0,0 +1,59 @@
+package deprecation
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/json-iterator/go"
+	. "github.com/onsi/gomega"
+)
+
+func TestStringFlagAlias(t *testing.T) {
+	log.InitLogger()
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "deprecation")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	warningsFile := filepath.Join(dir, "warnings.jsonl")
+	g.Expect(os.Setenv(WarningsFileEnvName, warningsFile)).NotTo(HaveOccurred())
+	defer os.Unsetenv(WarningsFileEnvName)
+
+	app := kingpin.New("test", "")
+	command := app.Command("build", "")
+	newValue := command.Flag("new-name", "").String()
+	StringFlagAlias(command, "oldName", "new-name", newValue)
+	var actionValue string
+	command.Action(func(context *kingpin.ParseContext) error {
+		actionValue = *newValue
+		return nil
+	})
+
+	_, err = app.Parse([]string{"build", "--oldName", "foo"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(actionValue).To(Equal("foo"))
+
+	// reported once
+	Report(Warning{Id: "build-oldName-flag"})
+
+	data, err := ioutil.ReadFile(warningsFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	g.Expect(lines).To(HaveLen(1))
+
+	var warning Warning
+	g.Expect(jsoniter.UnmarshalFromString(lines[0], &warning)).NotTo(HaveOccurred())
+	g.Expect(warning).To(Equal(Warning{
+		Id:          "build-oldName-flag",
+		Kind:        KindFlag,
+		Name:        "--oldName",
+		Message:     "--oldName is deprecated, use --new-name",
+		Replacement: "--new-name",
+	}))
+}
@@ -0,0 +1,121 @@
+package diagnostics
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/util"
+)
+
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+	SeverityInfo    = "info"
+)
+
+// Finding is a group of the same problems (same severity, code and message) found in different locations (e.g. files)
+type Finding struct {
+	Severity  string   `json:"severity"`
+	Code      string   `json:"code"`
+	Message   string   `json:"message"`
+	Locations []string `json:"locations,omitempty"`
+	// number of occurrences, can be greater than count of locations if problem is reported several times for the same location
+	Count int `json:"count"`
+}
+
+type Report struct {
+	Findings     []*Finding `json:"findings"`
+	ErrorCount   int        `json:"errorCount"`
+	WarningCount int        `json:"warningCount"`
+	// max errors limit was reached and validation was stopped, not all problems are reported
+	IsTruncated bool `json:"isTruncated,omitempty"`
+}
+
+// Collector collects all problems instead of exiting on the first error, so, user can fix everything in one pass.
+type Collector struct {
+	// 0 to collect all, 1 to stop on the first error
+	MaxErrors int
+
+	findings     []*Finding
+	keyToFinding map[string]*Finding
+	errorCount   int
+	warningCount int
+	isTruncated  bool
+}
+
+func NewCollector(maxErrors int) *Collector {
+	return &Collector{MaxErrors: maxErrors, keyToFinding: make(map[string]*Finding)}
+}
+
+// ConfigureMaxErrorsFlag adds --max-errors flag to the validation command
+func ConfigureMaxErrorsFlag(command *kingpin.CmdClause) *int {
+	return command.Flag("max-errors", "stop after this number of errors, 0 to report all problems").Default("0").Int()
+}
+
+// Add records problem, returns false if max errors limit is reached and validation should be stopped.
+func (t *Collector) Add(severity string, code string, location string, message string) bool {
+	if t.IsLimitReached() {
+		t.isTruncated = true
+		return false
+	}
+
+	key := severity + "\x00" + code + "\x00" + message
+	finding := t.keyToFinding[key]
+	if finding == nil {
+		finding = &Finding{Severity: severity, Code: code, Message: message}
+		t.keyToFinding[key] = finding
+		t.findings = append(t.findings, finding)
+	}
+
+	finding.Count++
+	if len(location) != 0 && !util.ContainsString(finding.Locations, location) {
+		finding.Locations = append(finding.Locations, location)
+	}
+
+	switch severity {
+	case SeverityError:
+		t.errorCount++
+	case SeverityWarning:
+		t.warningCount++
+	}
+	return !t.IsLimitReached()
+}
+
+func (t *Collector) Addf(severity string, code string, location string, format string, args ...interface{}) bool {
+	return t.Add(severity, code, location, fmt.Sprintf(format, args...))
+}
+
+func (t *Collector) IsLimitReached() bool {
+	return t.MaxErrors > 0 && t.errorCount >= t.MaxErrors
+}
+
+// MarkTruncated is called if validation is stopped because limit is reached
+func (t *Collector) MarkTruncated() {
+	t.isTruncated = true
+}
+
+func (t *Collector) HasErrors() bool {
+	return t.errorCount > 0
+}
+
+// Report returns findings sorted by severity (errors first), in order of the first occurrence within the same severity
+func (t *Collector) Report() *Report {
+	findings := make([]*Finding, len(t.findings))
+	copy(findings, t.findings)
+	sort.SliceStable(findings, func(i, j int) bool {
+		return severityOrder(findings[i].Severity) < severityOrder(findings[j].Severity)
+	})
+	return &Report{Findings: findings, ErrorCount: t.errorCount, WarningCount: t.warningCount, IsTruncated: t.isTruncated}
+}
+
+func severityOrder(severity string) int {
+	switch severity {
+	case SeverityError:
+		return 0
+	case SeverityWarning:
+		return 1
+	default:
+		return 2
+	}
+}
@@ -0,0 +1,40 @@
+package diagnostics
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestCollector(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	collector := NewCollector(0)
+	collector.Add(SeverityWarning, "W", "a.ico", "16x16 is missing")
+	collector.Add(SeverityError, "E", "a.ico", "256x256 is required")
+	collector.Add(SeverityWarning, "W", "b.ico", "16x16 is missing")
+	collector.Add(SeverityWarning, "W", "b.ico", "16x16 is missing")
+
+	report := collector.Report()
+	g.Expect(report.ErrorCount).To(Equal(1))
+	g.Expect(report.WarningCount).To(Equal(3))
+	g.Expect(report.Findings).To(Equal([]*Finding{
+		{Severity: SeverityError, Code: "E", Message: "256x256 is required", Locations: []string{"a.ico"}, Count: 1},
+		{Severity: SeverityWarning, Code: "W", Message: "16x16 is missing", Locations: []string{"a.ico", "b.ico"}, Count: 3},
+	}))
+}
+
+func TestMaxErrors(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	collector := NewCollector(2)
+	g.Expect(collector.Add(SeverityError, "E1", "", "first")).To(BeTrue())
+	g.Expect(collector.Add(SeverityWarning, "W", "", "warning")).To(BeTrue())
+	g.Expect(collector.Add(SeverityError, "E2", "", "second")).To(BeFalse())
+	g.Expect(collector.Add(SeverityError, "E3", "", "third")).To(BeFalse())
+
+	report := collector.Report()
+	g.Expect(report.ErrorCount).To(Equal(2))
+	g.Expect(report.IsTruncated).To(BeTrue())
+	g.Expect(report.Findings).To(HaveLen(3))
+}
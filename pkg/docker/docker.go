@@ -0,0 +1,459 @@
+package docker
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/download"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/json-iterator/go"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	imageRepository = "electronuserland/builder"
+
+	containerProjectDir    = "/project"
+	containerBuilderCache  = "/root/.cache/electron-builder"
+	containerElectronCache = "/root/.cache/electron"
+)
+
+// image variant per target, Windows targets require wine, Squirrel.Windows requires mono
+var targetVariants = map[string]string{
+	"appimage": "",
+	"deb":      "",
+	"rpm":      "",
+	"pacman":   "",
+	"apk":      "",
+	"freebsd":  "",
+	"p5p":      "",
+	"snap":     "",
+	"dir":      "",
+	"zip":      "",
+	"7z":       "",
+	"tar.gz":   "",
+	"tar.xz":   "",
+	"tar.lz":   "",
+	"tar.bz2":  "",
+
+	"nsis":     "wine",
+	"nsis-web": "wine",
+	"portable": "wine",
+	"appx":     "wine",
+	"msi":      "wine",
+	"squirrel": "wine-mono",
+}
+
+var windowsVariants = map[string]bool{"wine": true, "wine-mono": true}
+
+// env of the host passed to the container (only names, so, values are not visible in the process list)
+var forwardedEnvPrefixes = []string{"ELECTRON_", "BUILD_", "CSC_", "WIN_CSC_", "GH_", "GITHUB_", "GITLAB_", "BT_", "AWS_", "DO_KEY_", "SNAP_", "NPM_", "YARN_", "npm_config_", "TRAVIS", "APPVEYOR", "CIRCLE", "BITBUCKET"}
+var forwardedEnvNames = map[string]bool{"CI": true, "DEBUG": true, "USE_HARD_LINKS": true, "NODE_OPTIONS": true}
+
+var nodeVersionRegExp = regexp.MustCompile(`^\d+(\.\d+){0,2}$`)
+
+type RunOptions struct {
+	ProjectDir string
+	Targets    []string
+	// node major version of the image (e.g. 18), latest if not set
+	NodeVersion string
+	// custom image for all targets
+	Image string
+	// command to run in the container, electron-builder for the targets by default
+	Command []string
+	// additional env (NAME=VALUE or NAME to pass value of the host)
+	Env []string
+	// print docker commands without running
+	IsDryRun bool
+}
+
+type ContainerRun struct {
+	Image     string   `json:"image"`
+	Targets   []string `json:"targets"`
+	Container string   `json:"container"`
+	// docker args (without executable)
+	Args     []string `json:"args"`
+	Duration string   `json:"duration,omitempty"`
+}
+
+type RunReport struct {
+	Runs     []*ContainerRun `json:"runs"`
+	IsDryRun bool            `json:"dryRun,omitempty"`
+}
+
+func ConfigureCommand(app *kingpin.Application) {
+	command := app.Command("run-in-docker", "Build Linux (and Windows using wine) targets in electronuserland/builder docker container, log of container is streamed as structured log. "+
+		"Report is written to stdout as JSON.")
+	options := &RunOptions{}
+	command.Flag("project-dir", "The project dir to mount.").Default(".").ExistingDirVar(&options.ProjectDir)
+	targets := command.Flag("target", "The comma-separated list of targets (e.g. deb,rpm,appimage).").Required().Strings()
+	command.Flag("node", "The node version of the image (e.g. 18).").StringVar(&options.NodeVersion)
+	command.Flag("image", "The image to use for all targets instead of the default.").StringVar(&options.Image)
+	command.Flag("env", "The env to pass to the container (NAME=VALUE or NAME).").StringsVar(&options.Env)
+	command.Flag("dry-run", "Print docker commands without running.").BoolVar(&options.IsDryRun)
+	command.Arg("command", "The command to run in the container (default: electron-builder for the targets).").StringsVar(&options.Command)
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		for _, value := range *targets {
+			for _, target := range strings.Split(value, ",") {
+				target = strings.TrimSpace(target)
+				if target != "" {
+					options.Targets = append(options.Targets, target)
+				}
+			}
+		}
+
+		report, err := RunInDocker(options)
+		if err != nil {
+			return err
+		}
+		return util.WriteJsonToStdOut(report)
+	})
+}
+
+// groupTargets groups targets by image, targets of the same image are built in one container
+func groupTargets(options *RunOptions) ([]*ContainerRun, error) {
+	if options.NodeVersion != "" && !nodeVersionRegExp.MatchString(options.NodeVersion) {
+		return nil, util.NewMessageError("node version "+options.NodeVersion+" is invalid (expected e.g. 18)", "ERR_DOCKER_INVALID_NODE_VERSION")
+	}
+
+	var result []*ContainerRun
+	imageToRun := make(map[string]*ContainerRun)
+	for _, target := range options.Targets {
+		variant, ok := targetVariants[strings.ToLower(target)]
+		if !ok {
+			switch strings.ToLower(target) {
+			case "dmg", "pkg", "mas", "mas-dev":
+				return nil, util.NewMessageError("macOS target "+target+" cannot be built in docker", "ERR_DOCKER_TARGET_UNSUPPORTED")
+			}
+			return nil, util.NewMessageError("unknown target "+target, "ERR_DOCKER_TARGET_UNSUPPORTED")
+		}
+
+		image := options.Image
+		if image == "" {
+			image = getImage(options.NodeVersion, variant)
+		}
+
+		run := imageToRun[image]
+		if run == nil {
+			run = &ContainerRun{Image: image}
+			imageToRun[image] = run
+			result = append(result, run)
+		}
+		if !util.ContainsString(run.Targets, target) {
+			run.Targets = append(run.Targets, target)
+		}
+	}
+	return result, nil
+}
+
+// getImage returns electronuserland/builder tag: latest, wine, 18, 18-wine
+func getImage(nodeVersion string, variant string) string {
+	tag := nodeVersion
+	if variant != "" {
+		if tag != "" {
+			tag += "-"
+		}
+		tag += variant
+	}
+	if tag == "" {
+		tag = "latest"
+	}
+	return imageRepository + ":" + tag
+}
+
+func getPlatformFlag(run *ContainerRun) string {
+	for _, target := range run.Targets {
+		if windowsVariants[targetVariants[strings.ToLower(target)]] {
+			return "--win"
+		}
+	}
+	return "--linux"
+}
+
+type hostDirs struct {
+	project        string
+	builderCache   string
+	electronCache  string
+	nodeModulesVol string
+}
+
+func getHostDirs(projectDir string) (*hostDirs, error) {
+	project, err := filepath.Abs(projectDir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	builderCache, err := download.GetCacheDirectory("electron-builder", "ELECTRON_BUILDER_CACHE", true)
+	if err != nil {
+		return nil, err
+	}
+	electronCache, err := download.GetCacheDirectory("electron", "ELECTRON_CACHE", true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hostDirs{
+		project:       project,
+		builderCache:  builderCache,
+		electronCache: electronCache,
+		// node_modules of the host contains native modules built for the host, so, container uses own node_modules (named volume to reuse between runs)
+		nodeModulesVol: sanitizeVolumeName(filepath.Base(project)) + "-node-modules",
+	}, nil
+}
+
+var invalidVolumeCharRegExp = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+func sanitizeVolumeName(name string) string {
+	result := invalidVolumeCharRegExp.ReplaceAllString(name, "_")
+	if result == "" || !(result[0] >= 'a' && result[0] <= 'z' || result[0] >= 'A' && result[0] <= 'Z' || result[0] >= '0' && result[0] <= '9') {
+		result = "project" + result
+	}
+	return result
+}
+
+// getForwardedEnv returns names of host env to pass to the container, sorted for stable args
+func getForwardedEnv(environ []string) []string {
+	var result []string
+	for _, item := range environ {
+		name := item
+		if index := strings.IndexRune(item, '='); index > 0 {
+			name = item[:index]
+		}
+		// cache dirs of the host are mounted to fixed locations
+		if name == "ELECTRON_CACHE" || name == "ELECTRON_BUILDER_CACHE" {
+			continue
+		}
+		if forwardedEnvNames[name] {
+			result = append(result, name)
+			continue
+		}
+		for _, prefix := range forwardedEnvPrefixes {
+			if strings.HasPrefix(name, prefix) {
+				result = append(result, name)
+				break
+			}
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func createRunArgs(run *ContainerRun, options *RunOptions, dirs *hostDirs, environ []string) []string {
+	args := []string{"run", "--rm", "--name", run.Container,
+		"--volume", dirs.project + ":" + containerProjectDir,
+		"--volume", dirs.nodeModulesVol + ":" + containerProjectDir + "/node_modules",
+		"--volume", dirs.builderCache + ":" + containerBuilderCache,
+		"--volume", dirs.electronCache + ":" + containerElectronCache,
+		"--workdir", containerProjectDir,
+		"--env", "ELECTRON_BUILDER_CACHE=" + containerBuilderCache,
+		"--env", "ELECTRON_CACHE=" + containerElectronCache,
+		// app-builder in the container logs as JSON, so, log entries are forwarded with level and fields
+		"--env", log.FormatEnvName + "=json",
+	}
+	for _, name := range getForwardedEnv(environ) {
+		args = append(args, "--env", name)
+	}
+	for _, env := range options.Env {
+		args = append(args, "--env", env)
+	}
+	args = append(args, run.Image)
+
+	if len(options.Command) != 0 {
+		return append(args, options.Command...)
+	}
+	// install dependencies for the container platform, then build
+	return append(args, "/bin/bash", "-c", "yarn install --frozen-lockfile && yarn electron-builder "+getPlatformFlag(run)+" "+strings.Join(run.Targets, " "))
+}
+
+// RunInDocker runs a container per image, containers are run sequentially because share node_modules volume and output dir
+func RunInDocker(options *RunOptions) (*RunReport, error) {
+	runs, err := groupTargets(options)
+	if err != nil {
+		return nil, err
+	}
+
+	dirs, err := getHostDirs(options.ProjectDir)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RunReport{Runs: runs, IsDryRun: options.IsDryRun}
+	for _, run := range runs {
+		run.Container, err = createContainerName()
+		if err != nil {
+			return nil, err
+		}
+		run.Args = createRunArgs(run, options, dirs, os.Environ())
+	}
+	if options.IsDryRun {
+		return report, nil
+	}
+
+	docker, err := exec.LookPath("docker")
+	if err != nil {
+		return nil, util.NewMessageError("docker is required to build in container, please see https://electron.build/multi-platform-build#docker", "ERR_DOCKER_NOT_INSTALLED")
+	}
+
+	// cache dirs must exist, otherwise docker creates them owned by root
+	for _, dir := range []string{dirs.builderCache, dirs.electronCache} {
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	for _, run := range runs {
+		start := time.Now()
+		log.Info("building in docker", zap.String("image", run.Image), zap.Strings("targets", run.Targets))
+		err = runContainer(docker, run)
+		if err != nil {
+			return nil, err
+		}
+		run.Duration = time.Since(start).Round(time.Millisecond).String()
+	}
+	return report, nil
+}
+
+func createContainerName() (string, error) {
+	suffix := make([]byte, 6)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return "app-builder-" + hex.EncodeToString(suffix), nil
+}
+
+func runContainer(docker string, run *ContainerRun) error {
+	ctx, cancel := util.CreateContext()
+	defer cancel()
+
+	// killing docker client doesn't stop the container
+	defer util.OnCancel(func() {
+		_ = exec.Command(docker, "rm", "--force", run.Container).Run()
+	})()
+
+	command := exec.CommandContext(ctx, docker, run.Args...)
+	stdout, err := command.StdoutPipe()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	stderr, err := command.StderrPipe()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	log.Debug("execute command", zap.String("command", docker+" "+strings.Join(run.Args, " ")))
+	err = command.Start()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(2)
+	// last lines are included into error, so, the reason is visible even if build log is not printed
+	tail := newTail(20)
+	for _, reader := range []io.Reader{stdout, stderr} {
+		go func(reader io.Reader) {
+			defer waitGroup.Done()
+			streamLog(reader, run.Image, tail)
+		}(reader)
+	}
+	waitGroup.Wait()
+
+	err = command.Wait()
+	if err != nil {
+		return util.NewMessageError("build in docker ("+run.Image+") failed: "+err.Error()+"\n"+tail.String(), "ERR_DOCKER_BUILD_FAILED")
+	}
+	return nil
+}
+
+func streamLog(reader io.Reader, image string, tail *lineTail) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		tail.add(line)
+		level, message, fields := parseLogLine(line)
+		fields = append(fields, zap.String("image", image))
+		if entry := log.LOG.Check(level, message); entry != nil {
+			entry.Write(fields...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Debug("cannot read container output", zap.Error(err))
+	}
+}
+
+// parseLogLine converts JSON log entry of app-builder in the container to level, message and fields, other lines are logged as is
+func parseLogLine(line string) (zapcore.Level, string, []zapcore.Field) {
+	if strings.HasPrefix(line, "{") {
+		var entry map[string]interface{}
+		if jsoniter.UnmarshalFromString(line, &entry) == nil {
+			message, isMessage := entry["message"].(string)
+			levelName, isLevel := entry["level"].(string)
+			var level zapcore.Level
+			if isMessage && isLevel && level.UnmarshalText([]byte(levelName)) == nil {
+				var fields []zapcore.Field
+				for _, key := range sortedKeys(entry) {
+					if key != "message" && key != "level" && key != "time" {
+						fields = append(fields, zap.Any(key, entry[key]))
+					}
+				}
+				return level, message, fields
+			}
+		}
+	}
+	return zapcore.InfoLevel, line, nil
+}
+
+func sortedKeys(value map[string]interface{}) []string {
+	result := make([]string, 0, len(value))
+	for key := range value {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	return result
+}
+
+type lineTail struct {
+	mutex    sync.Mutex
+	lines    []string
+	maxLines int
+}
+
+func newTail(maxLines int) *lineTail {
+	return &lineTail{maxLines: maxLines}
+}
+
+func (t *lineTail) add(line string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.lines = append(t.lines, line)
+	if len(t.lines) > t.maxLines {
+		t.lines = t.lines[len(t.lines)-t.maxLines:]
+	}
+}
+
+func (t *lineTail) String() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return strings.Join(t.lines, "\n")
+}
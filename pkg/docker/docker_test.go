@@ -0,0 +1,112 @@
+package docker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+	"go.uber.org/zap/zapcore"
+)
+
+// fake docker logs args, prints JSON log entry and text line, fails if FAKE_EXIT is set
+const fakeDocker = `#!/bin/sh
+echo "$@" >> "$FAKE_DIR/docker.log"
+echo '{"level":"warn","time":"2026-01-01T00:00:00.000Z","message":"cannot find icon","command":"icon convert","file":"build/icon.png"}' >&2
+echo "  • building        target=deb arch=x64"
+exit ${FAKE_EXIT:-0}
+`
+
+func TestGroupTargets(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	runs, err := groupTargets(&RunOptions{Targets: []string{"deb", "nsis", "AppImage", "squirrel", "deb"}, NodeVersion: "18"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(runs).To(Equal([]*ContainerRun{
+		{Image: "electronuserland/builder:18", Targets: []string{"deb", "AppImage"}},
+		{Image: "electronuserland/builder:18-wine", Targets: []string{"nsis"}},
+		{Image: "electronuserland/builder:18-wine-mono", Targets: []string{"squirrel"}},
+	}))
+	g.Expect(getPlatformFlag(runs[0])).To(Equal("--linux"))
+	g.Expect(getPlatformFlag(runs[1])).To(Equal("--win"))
+
+	runs, err = groupTargets(&RunOptions{Targets: []string{"rpm", "nsis"}, Image: "custom/image"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(runs).To(Equal([]*ContainerRun{{Image: "custom/image", Targets: []string{"rpm", "nsis"}}}))
+
+	g.Expect(getImage("", "")).To(Equal("electronuserland/builder:latest"))
+
+	_, err = groupTargets(&RunOptions{Targets: []string{"deb", "dmg"}})
+	g.Expect(err).To(MatchError(ContainSubstring("macOS target dmg cannot be built in docker")))
+	_, err = groupTargets(&RunOptions{Targets: []string{"deb"}, NodeVersion: "18; rm -rf /"})
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestForwardedEnv(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	names := getForwardedEnv([]string{"PATH=/usr/bin", "GH_TOKEN=secret", "CI=true", "CIPHER=x", "ELECTRON_CACHE=/tmp", "CSC_LINK=cert.p12", "HOME=/root"})
+	g.Expect(names).To(Equal([]string{"CI", "CSC_LINK", "GH_TOKEN"}))
+	g.Expect(sanitizeVolumeName("my app")).To(Equal("my_app"))
+	g.Expect(sanitizeVolumeName(".hidden")).To(Equal("project.hidden"))
+}
+
+func TestParseLogLine(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	level, message, fields := parseLogLine(`{"level":"error","time":"2026-01-01T00:00:00.000Z","message":"cannot sign","file":"app.exe"}`)
+	g.Expect(level).To(Equal(zapcore.ErrorLevel))
+	g.Expect(message).To(Equal("cannot sign"))
+	g.Expect(fields).To(HaveLen(1))
+	g.Expect(fields[0].Key).To(Equal("file"))
+
+	// not a log entry
+	level, message, fields = parseLogLine(`{"foo": 1}`)
+	g.Expect(level).To(Equal(zapcore.InfoLevel))
+	g.Expect(message).To(Equal(`{"foo": 1}`))
+	g.Expect(fields).To(BeEmpty())
+}
+
+func TestRunInDocker(t *testing.T) {
+	log.InitLogger()
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "docker")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	binDir := filepath.Join(dir, "bin")
+	g.Expect(os.MkdirAll(binDir, 0755)).To(Succeed())
+	g.Expect(ioutil.WriteFile(filepath.Join(binDir, "docker"), []byte(fakeDocker), 0755)).To(Succeed())
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	g.Expect(os.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))).To(Succeed())
+	for name, value := range map[string]string{"FAKE_DIR": dir, "ELECTRON_BUILDER_CACHE": filepath.Join(dir, "cache"), "ELECTRON_CACHE": filepath.Join(dir, "electron")} {
+		defer os.Unsetenv(name)
+		g.Expect(os.Setenv(name, value)).To(Succeed())
+	}
+
+	projectDir := filepath.Join(dir, "my-app")
+	g.Expect(os.MkdirAll(projectDir, 0755)).To(Succeed())
+	report, err := RunInDocker(&RunOptions{ProjectDir: projectDir, Targets: []string{"deb", "rpm"}, Env: []string{"FOO=bar"}})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(report.Runs).To(HaveLen(1))
+	g.Expect(report.Runs[0].Duration).NotTo(BeEmpty())
+	g.Expect(filepath.Join(dir, "cache")).To(BeADirectory())
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "docker.log"))
+	g.Expect(err).NotTo(HaveOccurred())
+	args := strings.TrimSpace(string(data))
+	g.Expect(args).To(HavePrefix("run --rm --name " + report.Runs[0].Container + " --volume " + projectDir + ":/project --volume my-app-node-modules:/project/node_modules --volume " + filepath.Join(dir, "cache") + ":/root/.cache/electron-builder"))
+	g.Expect(args).To(ContainSubstring("--env APP_BUILDER_LOG_FORMAT=json"))
+	g.Expect(args).To(HaveSuffix("--env FOO=bar electronuserland/builder:latest /bin/bash -c yarn install --frozen-lockfile && yarn electron-builder --linux deb rpm"))
+
+	// output of the failed container is included into error
+	defer os.Unsetenv("FAKE_EXIT")
+	g.Expect(os.Setenv("FAKE_EXIT", "2")).To(Succeed())
+	_, err = RunInDocker(&RunOptions{ProjectDir: projectDir, Targets: []string{"nsis"}, Command: []string{"yarn", "dist"}})
+	g.Expect(err).To(MatchError(ContainSubstring("build in docker (electronuserland/builder:wine) failed: exit status 2")))
+	g.Expect(err.Error()).To(ContainSubstring("building        target=deb"))
+}
@@ -0,0 +1,18 @@
+// +build !windows
+
+package doctor
+
+import (
+	"github.com/develar/errors"
+	"golang.org/x/sys/unix"
+)
+
+// getFreeSpace returns bytes available to the current user on the filesystem of the existing dir
+func getFreeSpace(dir string) (uint64, error) {
+	var stat unix.Statfs_t
+	err := unix.Statfs(dir, &stat)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,21 @@
+package doctor
+
+import (
+	"github.com/develar/errors"
+	"golang.org/x/sys/windows"
+)
+
+// getFreeSpace returns bytes available to the current user (quotas are respected) on the volume of the existing dir
+func getFreeSpace(dir string) (uint64, error) {
+	dirPointer, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	var freeBytes uint64
+	err = windows.GetDiskFreeSpaceEx(dirPointer, &freeBytes, nil, nil)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return freeBytes, nil
+}
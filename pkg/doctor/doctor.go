@@ -0,0 +1,386 @@
+package doctor
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/diagnostics"
+	"github.com/develar/app-builder/pkg/download"
+	"github.com/develar/app-builder/pkg/package-format/snap"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/app-builder/pkg/wine"
+	"github.com/develar/errors"
+)
+
+const (
+	StatusPass = "pass"
+	StatusWarn = "warn"
+	StatusFail = "fail"
+)
+
+var Targets = []string{"appimage", "snap", "flatpak", "deb", "rpm", "pacman", "apk", "dmg", "mas", "pkg", "zip", "7z", "tar.gz", "nsis", "nsis-web", "portable", "squirrel", "msix", "appx"}
+
+type Options struct {
+	Targets []string
+	// in bytes, for cache and temp dirs
+	MinFreeSpace uint64
+	// do not check that not cached tools can be downloaded
+	IsOffline bool
+}
+
+type Check struct {
+	Name string `json:"name"`
+	// requested targets that require the check, empty for common checks
+	Targets []string `json:"targets,omitempty"`
+	Status  string   `json:"status"`
+	Message string   `json:"message"`
+	Code    string   `json:"code,omitempty"`
+}
+
+type Report struct {
+	Os       string              `json:"os"`
+	Arch     string              `json:"arch"`
+	Checks   []*Check            `json:"checks"`
+	IsPassed bool                `json:"passed"`
+	Summary  *diagnostics.Report `json:"summary"`
+}
+
+type requirement struct {
+	name  string
+	check func(options *Options) *Check
+}
+
+var commonRequirements = []string{"cache-dir", "temp-dir", "7za"}
+
+var requirements = map[string]requirement{
+	"cache-dir": {"cache dir", checkCacheDir},
+	"temp-dir": {"temp dir", func(options *Options) *Check {
+		return checkDir(os.TempDir(), options.MinFreeSpace)
+	}},
+	"7za": {"7za", func(options *Options) *Check {
+		return checkExecutable(util.Get7zPath(), "set SZA_PATH to the 7za executable", "ERR_DOCTOR_7ZA_MISSING")
+	}},
+
+	"appimage-tool": {"AppImage tools", func(options *Options) *Check {
+		return checkArtifact("appimage-12.0.1", options)
+	}},
+	"snapcraft": {"snapcraft", checkSnapcraft},
+	"snapd": {"snapd", func(options *Options) *Check {
+		check := checkExecutable("snap", "smoke test of the built snap is not possible", "ERR_DOCTOR_SNAPD_MISSING")
+		if check.Status == StatusFail {
+			check.Status = StatusWarn
+		}
+		return check
+	}},
+	"flatpak-builder": {"flatpak-builder", func(options *Options) *Check {
+		check := checkExecutable("flatpak", "install flatpak", "ERR_DOCTOR_FLATPAK_MISSING")
+		if check.Status != StatusPass {
+			return check
+		}
+		return checkExecutable("flatpak-builder", "install flatpak-builder", "ERR_DOCTOR_FLATPAK_MISSING")
+	}},
+
+	"macos-host": {"macOS", func(options *Options) *Check {
+		if runtime.GOOS == "darwin" {
+			return &Check{Status: StatusPass, Message: "running on macOS"}
+		}
+		return &Check{Status: StatusFail, Message: "can be built only on macOS", Code: "ERR_DOCTOR_MACOS_REQUIRED"}
+	}},
+	"xcode-clt": {"Xcode Command Line Tools", checkXcodeCommandLineTools},
+	"macos-dmg": {"hdiutil", func(options *Options) *Check {
+		if runtime.GOOS == "darwin" {
+			return checkExecutable("hdiutil", "", "ERR_DOCTOR_HDIUTIL_MISSING")
+		}
+		return &Check{Status: StatusWarn, Message: "not macOS, DMG is created using the built-in writer (no Finder window layout is applied)"}
+	}},
+
+	"nsis": {"NSIS", func(options *Options) *Check {
+		custom := strings.TrimSpace(os.Getenv("ELECTRON_BUILDER_NSIS_DIR"))
+		if len(custom) == 0 {
+			return checkArtifact("nsis-3.0.4.1", options)
+		}
+		if _, err := os.Stat(custom); err != nil {
+			return &Check{Status: StatusFail, Message: "ELECTRON_BUILDER_NSIS_DIR " + custom + " doesn't exist", Code: "ERR_DOCTOR_TOOL_MISSING"}
+		}
+		return &Check{Status: StatusPass, Message: "custom NSIS " + custom}
+	}},
+	"win-code-sign": {"winCodeSign (rcedit, signtool)", func(options *Options) *Check {
+		return checkArtifact("winCodeSign-2.6.0", options)
+	}},
+	"wine": {"Wine", checkWine},
+	"mono": {"Mono", func(options *Options) *Check {
+		if runtime.GOOS == "windows" {
+			return &Check{Status: StatusPass, Message: "not required on Windows"}
+		}
+		return checkExecutable("mono", "install mono, Squirrel.Windows tools are .NET executables", "ERR_DOCTOR_MONO_MISSING")
+	}},
+}
+
+func getTargetRequirements(target string) []string {
+	switch target {
+	case "appimage":
+		return []string{"appimage-tool"}
+	case "snap":
+		return []string{"snapcraft", "snapd"}
+	case "flatpak":
+		return []string{"flatpak-builder"}
+	case "dmg":
+		return []string{"macos-dmg"}
+	case "mas", "pkg":
+		return []string{"macos-host", "xcode-clt"}
+	case "nsis", "nsis-web", "portable":
+		return []string{"nsis", "win-code-sign", "wine"}
+	case "squirrel":
+		return []string{"win-code-sign", "wine", "mono"}
+	case "msix", "appx":
+		return []string{"win-code-sign", "wine"}
+	default:
+		// deb, rpm, pacman and apk are written natively, archives using 7za
+		return nil
+	}
+}
+
+func ConfigureCommand(app *kingpin.Application) {
+	command := app.Command("doctor", "Check the environment for the targets: required tools are installed or can be downloaded, free space in cache and temp dirs, Wine/Mono for cross builds, Xcode Command Line Tools, snapcraft.")
+	targets := command.Flag("target", "The target, can be specified several times.").Short('t').Enums(Targets...)
+	format := command.Flag("format", "The output format.").Default("text").Enum("text", "json")
+	minFreeSpace := command.Flag("min-free-space", "The minimum free space in cache and temp dirs (MB).").Default("2048").Uint64()
+	isOffline := command.Flag("offline", "Do not check that tools can be downloaded (not cached tools are reported as failed).").Bool()
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		report, err := Run(Options{Targets: *targets, MinFreeSpace: *minFreeSpace * 1024 * 1024, IsOffline: *isOffline})
+		if err != nil {
+			return err
+		}
+
+		if *format == "json" {
+			err = util.WriteJsonToStdOut(report)
+		} else {
+			err = writeText(os.Stdout, report)
+		}
+		if err != nil {
+			return err
+		}
+
+		if !report.IsPassed {
+			return util.NewMessageError(fmt.Sprintf("%d of %d checks failed", report.Summary.ErrorCount, len(report.Checks)), "ERR_DOCTOR_FAILED")
+		}
+		return nil
+	})
+}
+
+// Run performs checks in parallel, a failed check doesn't stop others
+func Run(options Options) (*Report, error) {
+	var ids []string
+	idToTargets := make(map[string][]string)
+	ids = append(ids, commonRequirements...)
+	for _, target := range options.Targets {
+		for _, id := range getTargetRequirements(target) {
+			if _, isAdded := idToTargets[id]; !isAdded && !util.ContainsString(ids, id) {
+				ids = append(ids, id)
+			}
+			if !util.ContainsString(idToTargets[id], target) {
+				idToTargets[id] = append(idToTargets[id], target)
+			}
+		}
+	}
+
+	checks := make([]*Check, len(ids))
+	err := util.MapAsync(len(ids), func(taskIndex int) (func() error, error) {
+		id := ids[taskIndex]
+		return func() error {
+			item := requirements[id]
+			check := item.check(&options)
+			check.Name = item.name
+			check.Targets = idToTargets[id]
+			checks[taskIndex] = check
+			return nil
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	collector := diagnostics.NewCollector(0)
+	for _, check := range checks {
+		switch check.Status {
+		case StatusFail:
+			collector.Add(diagnostics.SeverityError, check.Code, check.Name, check.Message)
+		case StatusWarn:
+			collector.Add(diagnostics.SeverityWarning, check.Code, check.Name, check.Message)
+		}
+	}
+
+	return &Report{
+		Os:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		Checks:   checks,
+		IsPassed: !collector.HasErrors(),
+		Summary:  collector.Report(),
+	}, nil
+}
+
+func writeText(writer io.Writer, report *Report) error {
+	var builder strings.Builder
+	for _, check := range report.Checks {
+		name := check.Name
+		if len(check.Targets) != 0 {
+			name += " (" + strings.Join(check.Targets, ", ") + ")"
+		}
+		builder.WriteString(fmt.Sprintf("%-5s %s: %s\n", strings.ToUpper(check.Status), name, check.Message))
+	}
+
+	if report.IsPassed {
+		builder.WriteString(fmt.Sprintf("\nall checks passed (%d warnings)\n", report.Summary.WarningCount))
+	} else {
+		builder.WriteString(fmt.Sprintf("\n%d checks failed, %d warnings\n", report.Summary.ErrorCount, report.Summary.WarningCount))
+	}
+	_, err := io.WriteString(writer, builder.String())
+	return errors.WithStack(err)
+}
+
+func checkCacheDir(options *Options) *Check {
+	dir, err := download.GetCacheDirectory("electron-builder", "ELECTRON_BUILDER_CACHE", true)
+	if err != nil {
+		return &Check{Status: StatusFail, Message: "cannot compute cache dir: " + err.Error(), Code: "ERR_DOCTOR_DIR"}
+	}
+	return checkDir(dir, options.MinFreeSpace)
+}
+
+// checkDir checks free space and that dir is writable (not existing dir is checked using the nearest existing parent, it will be created)
+func checkDir(dir string, minFreeSpace uint64) *Check {
+	existingDir := dir
+	for {
+		if _, err := os.Stat(existingDir); err == nil {
+			break
+		}
+		parent := filepath.Dir(existingDir)
+		if parent == existingDir {
+			return &Check{Status: StatusFail, Message: dir + " and its parents do not exist", Code: "ERR_DOCTOR_DIR"}
+		}
+		existingDir = parent
+	}
+
+	freeSpace, err := getFreeSpace(existingDir)
+	if err != nil {
+		return &Check{Status: StatusWarn, Message: dir + ": cannot get free space: " + err.Error(), Code: "ERR_DOCTOR_DIR"}
+	}
+
+	file, err := ioutil.TempFile(existingDir, ".doctor-")
+	if err != nil {
+		return &Check{Status: StatusFail, Message: existingDir + " is not writable: " + err.Error(), Code: "ERR_DOCTOR_DIR_NOT_WRITABLE"}
+	}
+	_ = file.Close()
+	_ = os.Remove(file.Name())
+
+	message := fmt.Sprintf("%s: %s free", dir, formatSize(freeSpace))
+	if freeSpace < minFreeSpace {
+		return &Check{Status: StatusFail, Message: message + ", at least " + formatSize(minFreeSpace) + " is required", Code: "ERR_DOCTOR_LOW_DISK_SPACE"}
+	}
+	return &Check{Status: StatusPass, Message: message}
+}
+
+func formatSize(size uint64) string {
+	return fmt.Sprintf("%.1f GB", float64(size)/(1024*1024*1024))
+}
+
+func checkExecutable(name string, hint string, code string) *Check {
+	file, err := exec.LookPath(name)
+	if err != nil {
+		message := name + " is not found in PATH"
+		if len(hint) != 0 {
+			message += ", " + hint
+		}
+		return &Check{Status: StatusFail, Message: message, Code: code}
+	}
+	return &Check{Status: StatusPass, Message: file}
+}
+
+// checkArtifact checks that tool is in the cache or can be downloaded (the first byte is requested to not download the whole archive)
+func checkArtifact(dirName string, options *Options) *Check {
+	cacheDir, err := download.GetCacheDirectoryForArtifact(dirName)
+	if err != nil {
+		return &Check{Status: StatusFail, Message: "cannot compute cache dir: " + err.Error(), Code: "ERR_DOCTOR_DIR"}
+	}
+
+	file := filepath.Join(cacheDir, dirName)
+	if _, err := os.Stat(file); err == nil {
+		return &Check{Status: StatusPass, Message: "cached in " + file}
+	}
+
+	if options.IsOffline {
+		return &Check{Status: StatusFail, Message: dirName + " is not cached", Code: "ERR_DOCTOR_TOOL_NOT_CACHED"}
+	}
+
+	url := download.GetGithubBaseUrl() + dirName + "/" + dirName + ".7z"
+	err = checkUrl(url)
+	if err != nil {
+		return &Check{Status: StatusFail, Message: dirName + " is not cached and cannot be downloaded: " + err.Error(), Code: "ERR_DOCTOR_TOOL_NOT_DOWNLOADABLE"}
+	}
+	return &Check{Status: StatusPass, Message: "not cached, can be downloaded from " + url}
+}
+
+var checkUrl = func(url string) error {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	request.Header.Set("Range", "bytes=0-0")
+
+	client := &http.Client{Timeout: 30 * time.Second, Transport: &http.Transport{Proxy: util.ProxyFromEnvironmentAndNpm}}
+	response, err := client.Do(request)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(response.Body)
+
+	if response.StatusCode >= 400 {
+		return errors.Errorf("%s: %s", url, response.Status)
+	}
+	return nil
+}
+
+func checkSnapcraft(options *Options) *Check {
+	err := snap.CheckSnapcraftVersion(true)
+	if err != nil {
+		// snap can be built using template without snapcraft
+		return &Check{Status: StatusWarn, Message: err.Error() + " (not required if template is used)", Code: util.GetErrorInfo(err).Code}
+	}
+	return &Check{Status: StatusPass, Message: "snapcraft is installed"}
+}
+
+func checkXcodeCommandLineTools(options *Options) *Check {
+	if runtime.GOOS != "darwin" {
+		return &Check{Status: StatusFail, Message: "not macOS", Code: "ERR_DOCTOR_MACOS_REQUIRED"}
+	}
+
+	output, err := exec.Command("xcode-select", "-p").Output()
+	if err != nil {
+		return &Check{Status: StatusFail, Message: "not installed, please: xcode-select --install", Code: "ERR_DOCTOR_XCODE_CLT_MISSING"}
+	}
+	return &Check{Status: StatusPass, Message: strings.TrimSpace(string(output))}
+}
+
+func checkWine(options *Options) *Check {
+	switch {
+	case runtime.GOOS == "windows":
+		return &Check{Status: StatusPass, Message: "not required on Windows"}
+	case runtime.GOOS == "darwin" && !util.IsEnvTrue("USE_SYSTEM_WINE"):
+		return checkArtifact("wine-4.0.1-mac", options)
+	}
+
+	err := wine.CheckSystemWine()
+	if err != nil {
+		return &Check{Status: StatusFail, Message: err.Error(), Code: util.GetErrorInfo(err).Code}
+	}
+	return &Check{Status: StatusPass, Message: "wine is installed"}
+}
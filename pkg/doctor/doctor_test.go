@@ -0,0 +1,67 @@
+package doctor
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+)
+
+func TestRun(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	cacheDir, err := ioutil.TempDir("", "doctor-cache")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(cacheDir)
+	_ = os.Setenv("ELECTRON_BUILDER_CACHE", cacheDir)
+	defer os.Unsetenv("ELECTRON_BUILDER_CACHE")
+
+	report, err := Run(Options{Targets: []string{"deb", "nsis", "portable", "appimage"}, IsOffline: true})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	var names []string
+	for _, check := range report.Checks {
+		names = append(names, check.Name)
+	}
+	g.Expect(names[:3]).To(Equal([]string{"cache dir", "temp dir", "7za"}))
+	g.Expect(names).To(ContainElement("NSIS"))
+	g.Expect(names).To(ContainElement("AppImage tools"))
+
+	for _, check := range report.Checks {
+		switch check.Name {
+		case "NSIS":
+			g.Expect(check.Targets).To(Equal([]string{"nsis", "portable"}))
+			g.Expect(check.Status).To(Equal(StatusFail))
+			g.Expect(check.Code).To(Equal("ERR_DOCTOR_TOOL_NOT_CACHED"))
+		case "cache dir":
+			g.Expect(check.Status).To(Equal(StatusPass))
+		}
+	}
+	g.Expect(report.IsPassed).To(BeFalse())
+	g.Expect(report.Summary.ErrorCount).To(BeNumerically(">=", 2))
+
+	var buffer bytes.Buffer
+	g.Expect(writeText(&buffer, report)).To(Succeed())
+	g.Expect(buffer.String()).To(ContainSubstring("FAIL  NSIS (nsis, portable): nsis-3.0.4.1 is not cached"))
+	g.Expect(buffer.String()).To(ContainSubstring("checks failed"))
+}
+
+func TestCheckDir(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "doctor")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	// not existing dir is checked using existing parent
+	check := checkDir(dir+"/not/created", 0)
+	g.Expect(check.Status).To(Equal(StatusPass))
+
+	check = checkDir(dir, 1<<62)
+	g.Expect(check.Status).To(Equal(StatusFail))
+	g.Expect(check.Code).To(Equal("ERR_DOCTOR_LOW_DISK_SPACE"))
+}
@@ -163,7 +163,7 @@ func (actualLocation *ActualLocation) concatenateParts(expectedSha512 string) er
 	if hasCheckSum {
 		actualCheckSum := base64.StdEncoding.EncodeToString((inputHash).Sum(nil))
 		if actualCheckSum != expectedSha512 {
-			return errors.Errorf("sha512 checksum mismatch, expected %s, got %s", expectedSha512, actualCheckSum)
+			return errors.WithStack(&ChecksumMismatchError{Expected: expectedSha512, Actual: actualCheckSum})
 		}
 	}
 
@@ -3,6 +3,7 @@ package download
 import (
 	"context"
 	"fmt"
+	"hash"
 	"io"
 	"net/http"
 	"os"
@@ -25,13 +26,19 @@ type Part struct {
 
 	Skip   bool
 	isFail bool
+
+	// part is written to the output file at Start offset (streaming mode)
+	isSharedFile bool
+	// sha512 computed while data is received (streaming mode, single part)
+	hash     hash.Hash
+	progress *downloadProgress
 }
 
 func (part *Part) getRange() string {
 	return fmt.Sprintf("bytes=%d-%d", part.Start, part.End-1)
 }
 
-func (part *Part) download(context context.Context, url string, index int, client *http.Client) error {
+func (part *Part) download(context context.Context, url string, index int, client *http.Client, stallTimeout time.Duration, ticket *schedulerTicket) error {
 	// request cannot be reused because Range header is set
 	request, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
@@ -40,74 +47,94 @@ func (part *Part) download(context context.Context, url string, index int, clien
 
 	request = request.WithContext(context)
 	request.Header.Set("User-Agent", getUserAgent())
+	GetGithubServer().authorize(request)
 	if part.End > 0 {
 		request.Header.Set("Range", part.getRange())
 	}
 
-	response, err := part.doRequest(request, client, index)
-	if err != nil {
-		return err
-	}
-	if response == nil {
-		return nil
+	// part file contains data starting from the initial Start, unless file is shared
+	fileOffsetBase := part.Start
+	if part.isSharedFile {
+		fileOffsetBase = 0
 	}
 
-	partFile, err := os.OpenFile(part.Name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
-	if err != nil {
-		return fsutil.CloseAndCheckError(err, response.Body)
-	}
-
-	defer util.Close(partFile)
+	var partFile *os.File
+	defer func() {
+		if partFile != nil {
+			util.Close(partFile)
+		}
+	}()
 
-	buf := make([]byte, 32*1024)
 	for attemptNumber := 0; ; attemptNumber++ {
 		if attemptNumber != 0 {
 			time.Sleep(2 * time.Second)
-			log.Info("retrying", zap.Int("attempt", attemptNumber))
-			response, err = part.doRequest(request, client, index)
-			if err != nil {
-				if response != nil {
-					err = fsutil.CloseAndCheckError(err, response.Body)
+			log.Info("retrying", zap.Int("attempt", attemptNumber), zap.Error(err))
+		}
+
+		var response *http.Response
+		response, err = part.doRequest(request, client, index, stallTimeout, ticket)
+		if err == nil {
+			if response == nil {
+				// part is skipped
+				return nil
+			}
+
+			if partFile == nil {
+				partFile, err = part.openFile()
+				if err != nil {
+					return fsutil.CloseAndCheckError(err, response.Body)
 				}
-				if attemptNumber == maxAttemptNumber {
-					return errors.WithStack(err)
+			}
+
+			var written int64
+			written, err = part.writeToFile(partFile, response)
+			if err == nil {
+				return nil
+			}
+
+			// resume from the last received byte
+			if part.End > 0 {
+				part.Start += written
+				_, seekErr := partFile.Seek(part.Start-fileOffsetBase, io.SeekStart)
+				if seekErr != nil {
+					return errors.WithStack(seekErr)
+				}
+				request.Header.Set("Range", part.getRange())
+			} else {
+				_, seekErr := partFile.Seek(0, io.SeekStart)
+				if seekErr != nil {
+					return errors.WithStack(seekErr)
+				}
+				if part.hash != nil {
+					part.hash.Reset()
 				}
-				continue
 			}
 		}
 
-		written, err := writeToFile(partFile, response, &buf)
-		if err == nil || request.Context().Err() != nil {
-			return nil
+		// download is canceled or hard timeout is exceeded - no sense to retry
+		if request.Context().Err() != nil {
+			return errors.WithStack(request.Context().Err())
 		}
 
 		if attemptNumber == maxAttemptNumber {
 			return errors.WithStack(err)
 		}
-
-		if part.End > 0 {
-			part.Start += written
-			_, err = partFile.Seek(part.Start, io.SeekStart)
-			if err != nil {
-				return errors.WithStack(err)
-			}
-			request.Header.Set("Range", part.getRange())
-		} else {
-			_, err = partFile.Seek(0, io.SeekStart)
-			if err != nil {
-				return errors.WithStack(err)
-			}
-		}
 	}
 }
 
-func (part *Part) doRequest(request *http.Request, client *http.Client, index int) (*http.Response, error) {
+func (part *Part) doRequest(request *http.Request, client *http.Client, index int, stallTimeout time.Duration, ticket *schedulerTicket) (*http.Response, error) {
 	log.Debug("download part", zap.String("range", request.Header.Get("Range")), zap.Int("index", index))
-	response, err := client.Do(request)
+
+	attemptContext, watchdog, stop := newStallWatchdog(request.Context(), stallTimeout)
+	response, err := client.Do(request.WithContext(attemptContext))
 	if err != nil {
-		return nil, errors.WithStack(err)
+		stop()
+		return nil, errors.WithStack(watchdog.convertError(err))
 	}
 
+	watchdog.heartbeat()
+	response.Body = &stallDetectingReader{ReadCloser: response.Body, watchdog: watchdog, stop: stop, ticket: ticket, context: attemptContext}
+
 	switch response.StatusCode {
 	case http.StatusPartialContent:
 		return response, nil
@@ -127,7 +154,33 @@ func (part *Part) doRequest(request *http.Request, client *http.Client, index in
 	}
 }
 
-func writeToFile(file *os.File, response *http.Response, buffer *[]byte) (int64, error) {
+func (part *Part) openFile() (*os.File, error) {
+	if !part.isSharedFile {
+		return os.OpenFile(part.Name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	}
+
+	file, err := os.OpenFile(part.Name, os.O_WRONLY, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = file.Seek(part.Start, io.SeekStart)
+	if err != nil {
+		return nil, fsutil.CloseAndCheckError(err, file)
+	}
+	return file, nil
+}
+
+// body is always wrapped (stall detection, progress, hash), so, zero-copy (splice) is not possible and io.Copy uses own buffer
+func (part *Part) writeToFile(file *os.File, response *http.Response) (int64, error) {
 	defer util.Close(response.Body)
-	return io.CopyBuffer(file, response.Body, *buffer)
+
+	var reader io.Reader = response.Body
+	if part.progress != nil {
+		reader = &progressReader{ReadCloser: response.Body, progress: part.progress}
+	}
+	if part.hash != nil {
+		reader = io.TeeReader(reader, part.hash)
+	}
+	return io.Copy(file, reader)
 }
@@ -9,6 +9,7 @@ import (
 	"strings"
 
 	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/archive/squashfs"
 	"github.com/develar/app-builder/pkg/log"
 	"github.com/develar/app-builder/pkg/util"
 	"github.com/develar/errors"
@@ -22,6 +23,8 @@ func ConfigureArtifactCommand(app *kingpin.Application) {
 	name := command.Flag("name", "The artifact name.").Short('n').Required().String()
 	url := command.Flag("url", "The artifact URL.").Short('u').String()
 	sha512 := command.Flag("sha512", "The expected sha512 of file.").String()
+	ConfigureGithubServerFlags(command)
+	ConfigurePriorityFlag(command, "interactive")
 
 	command.Action(func(context *kingpin.ParseContext) error {
 		dirPath, err := DownloadArtifact(*name, *url, *sha512)
@@ -61,6 +64,19 @@ func GetCacheDirectoryForArtifactCustom(dirName string) (string, error) {
 // * don't pollute user project dir (important in case of 1-package.json project structure)
 // * simplify/speed-up tests (don't download fpm for each test project)
 func DownloadArtifact(dirName string, url string, checksum string) (string, error) {
+	result, err := downloadArtifact(dirName, url, checksum)
+	// without url the artifact is downloaded by the tool function, that calls DownloadArtifact with url
+	if err == nil && len(url) != 0 {
+		name := dirName
+		if len(name) == 0 {
+			name = filepath.Base(result)
+		}
+		RecordProvenance(&Provenance{Name: name, Url: url, Sha512: checksum, File: result})
+	}
+	return result, err
+}
+
+func downloadArtifact(dirName string, url string, checksum string) (string, error) {
 	if len(url) == 0 {
 		// if no url is provided download these artifacts from Github. Otherwise use the provided url to download the artifacts.
 		switch dirName {
@@ -78,6 +94,7 @@ func DownloadArtifact(dirName string, url string, checksum string) (string, erro
 		// cannot simply find fist dot because file name can contains version like 9.1.0
 		dirName = strings.TrimSuffix(dirName, ".7z")
 		dirName = strings.TrimSuffix(dirName, ".tar")
+		dirName = strings.TrimSuffix(dirName, ".snap")
 	}
 
 	cacheDir, err := GetCacheDirectoryForArtifact(dirName)
@@ -88,6 +105,14 @@ func DownloadArtifact(dirName string, url string, checksum string) (string, erro
 	filePath := filepath.Join(cacheDir, dirName)
 	logFields := log.LOG.With(zap.String("path", filePath))
 
+	encryptionKey, err := getCacheEncryptionKey()
+	if err != nil {
+		return "", err
+	}
+	if encryptionKey != nil {
+		return downloadEncryptedArtifact(dirName, url, checksum, cacheDir, encryptionKey, logFields)
+	}
+
 	isFound, err := CheckCache(filePath, cacheDir, logFields)
 	if isFound {
 		return filePath, nil
@@ -103,24 +128,18 @@ func DownloadArtifact(dirName string, url string, checksum string) (string, erro
 	}
 
 	archiveName := tempUnpackDir + ".7z"
+	defer util.RemoveOnCancel(archiveName, tempUnpackDir)()
 
-	err = NewDownloader().Download(url, archiveName, checksum)
+	err = newArtifactDownloader().Download(url, archiveName, checksum)
 	if err != nil {
+		removeTempFiles(logFields, archiveName, tempUnpackDir)
 		return "", err
 	}
 
-	if strings.HasSuffix(url, ".tar.7z") {
-		err = unpackTar7z(archiveName, tempUnpackDir)
-		if err != nil {
-			return "", err
-		}
-	} else {
-		command := exec.Command(util.Get7zPath(), "x", "-bd", archiveName, "-o"+tempUnpackDir)
-		command.Dir = cacheDir
-		_, err := util.Execute(command)
-		if err != nil {
-			return "", err
-		}
+	err = extractArtifact(url, archiveName, tempUnpackDir, cacheDir)
+	if err != nil {
+		removeTempFiles(logFields, archiveName, tempUnpackDir)
+		return "", err
 	}
 
 	RemoveArchiveFile(archiveName, tempUnpackDir, logFields)
@@ -129,6 +148,34 @@ func DownloadArtifact(dirName string, url string, checksum string) (string, erro
 	return filePath, nil
 }
 
+// archive is extracted to the cache and removed, so, large archives (e.g. Electron, snap) are streamed to the file without concatenation of parts
+// set by ConfigurePriorityFlag
+var artifactPriority = PriorityInteractive
+
+func newArtifactDownloader() *Downloader {
+	downloader := NewDownloader()
+	downloader.StreamingThreshold = getStreamingThresholdFromEnv()
+	downloader.Priority = artifactPriority
+	return downloader
+}
+
+func extractArtifact(url string, archiveName string, unpackDir string, workingDir string) error {
+	if strings.HasSuffix(url, ".tar.7z") {
+		return unpackTar7z(archiveName, unpackDir)
+	} else if strings.HasSuffix(url, ".tar.gz") || strings.HasSuffix(url, ".tgz") {
+		// 7z extracts only tar from tar.gz (prebuilt binaries of native node modules)
+		return unpackTarGz(archiveName, unpackDir)
+	} else if strings.HasSuffix(url, ".snap") {
+		// base and core snaps are squashfs images, extracted in-process to not require unsquashfs on the host
+		return squashfs.ExtractFile(archiveName, unpackDir, nil)
+	} else {
+		command := exec.Command(util.Get7zPath(), "x", "-bd", archiveName, "-o"+unpackDir)
+		command.Dir = workingDir
+		_, err := util.Execute(command)
+		return err
+	}
+}
+
 func RemoveArchiveFile(archiveName string, tempUnpackDir string, logger *zap.Logger) {
 	err := os.Remove(archiveName)
 	if err != nil {
@@ -136,6 +183,16 @@ func RemoveArchiveFile(archiveName string, tempUnpackDir string, logger *zap.Log
 	}
 }
 
+// removeTempFiles removes download and unpack dir of failed download, so, garbage doesn't accumulate in the cache dir
+func removeTempFiles(logger *zap.Logger, files ...string) {
+	for _, file := range files {
+		err := os.RemoveAll(file)
+		if err != nil {
+			logger.Debug("cannot remove temp file", zap.String("file", file), zap.Error(err))
+		}
+	}
+}
+
 func CheckCache(filePath string, cacheDir string, logger *zap.Logger) (bool, error) {
 	dirStat, err := os.Stat(filePath)
 	if err == nil && dirStat.IsDir() {
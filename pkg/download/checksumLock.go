@@ -0,0 +1,169 @@
+package download
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+	"github.com/json-iterator/go"
+	"go.uber.org/zap"
+)
+
+const checksumLockVersion = 1
+
+// ChecksumLock implements trust-on-first-use pinning: if checksum is not provided, sha512 of the first successful download is recorded
+// and enforced on subsequent downloads of the same URL.
+type ChecksumLock struct {
+	file  string
+	mutex sync.Mutex
+}
+
+type checksumLockData struct {
+	Version int `json:"version"`
+	// url -> base64 encoded sha512
+	Checksums map[string]string `json:"checksums"`
+}
+
+func NewChecksumLock(file string) *ChecksumLock {
+	return &ChecksumLock{file: file}
+}
+
+// ChecksumMismatchError is returned if downloaded file doesn't match expected checksum
+type ChecksumMismatchError struct {
+	Expected string
+	Actual   string
+}
+
+func (t *ChecksumMismatchError) Error() string {
+	return "sha512 checksum mismatch, expected " + t.Expected + ", got " + t.Actual
+}
+
+func (t *ChecksumMismatchError) ErrorCode() string {
+	return "ERR_DOWNLOAD_CHECKSUM_MISMATCH"
+}
+
+func (t *ChecksumLock) File() string {
+	return t.file
+}
+
+func (t *ChecksumLock) Get(url string) (string, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	data, err := t.read()
+	if err != nil {
+		return "", err
+	}
+	return data.Checksums[url], nil
+}
+
+func (t *ChecksumLock) Pin(url string, checksum string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// re-read to not lose entries pinned by another process
+	data, err := t.read()
+	if err != nil {
+		return err
+	}
+
+	existing := data.Checksums[url]
+	if existing == checksum {
+		return nil
+	}
+	if existing != "" {
+		return errors.WithStack(&ChecksumMismatchError{Expected: existing, Actual: checksum})
+	}
+
+	data.Checksums[url] = checksum
+	return t.write(data)
+}
+
+func (t *ChecksumLock) read() (*checksumLockData, error) {
+	result := &checksumLockData{Version: checksumLockVersion}
+	content, err := ioutil.ReadFile(t.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			result.Checksums = make(map[string]string)
+			return result, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+
+	err = jsoniter.ConfigFastest.Unmarshal(content, result)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot parse checksum lock file "+t.file)
+	}
+	if result.Version > checksumLockVersion {
+		return nil, errors.Errorf("checksum lock file %s has unsupported version %d", t.file, result.Version)
+	}
+	if result.Checksums == nil {
+		result.Checksums = make(map[string]string)
+	}
+	return result, nil
+}
+
+func (t *ChecksumLock) write(data *checksumLockData) error {
+	content, err := jsoniter.ConfigCompatibleWithStandardLibrary.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	dir := filepath.Dir(t.file)
+	err = fsutil.EnsureDir(dir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// write to temp file and rename to not corrupt lock file if several processes write it at the same time
+	tempFile, err := util.TempFile(dir, ".lock")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = ioutil.WriteFile(tempFile, append(content, '\n'), 0644)
+	if err == nil {
+		err = os.Rename(tempFile, t.file)
+	}
+	if err != nil {
+		_ = os.Remove(tempFile)
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func computeSha512(file string) (string, error) {
+	reader, err := os.Open(file)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	defer util.Close(reader)
+
+	hash := sha512.New()
+	_, err = io.Copy(hash, reader)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil)), nil
+}
+
+func reportPinnedChecksumMismatch(url string, lockFile string, err error) error {
+	mismatchError, ok := errors.Cause(err).(*ChecksumMismatchError)
+	if !ok {
+		return err
+	}
+
+	log.Warn("!!! checksum of downloaded file doesn't match checksum recorded on first download — file on server was changed or download is tampered with. "+
+		"If change is expected, remove entry from the checksum lock file",
+		zap.String("url", url), zap.String("lockFile", lockFile), zap.String("pinned", mismatchError.Expected), zap.String("actual", mismatchError.Actual))
+	return util.NewMessageError("checksum of "+url+" doesn't match pinned checksum "+mismatchError.Expected+" (see "+lockFile+")", "ERR_CHECKSUM_PIN_MISMATCH")
+}
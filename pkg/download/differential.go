@@ -0,0 +1,410 @@
+package download
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/blockmap"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+	"go.uber.org/zap"
+)
+
+// gap between changed blocks that is downloaded instead of copied, to not issue a request per each small changed block
+const maxRangeGap = 64 * 1024
+
+type blockOperationKind int
+
+const (
+	copyOperation blockOperationKind = iota
+	downloadOperation
+)
+
+type blockOperation struct {
+	kind blockOperationKind
+	// offset in the old file (copy) or in the new file (download)
+	start int64
+	end   int64
+	// checksums and sizes of new file blocks covered by the operation, to verify downloaded data
+	checksums []string
+	sizes     []int
+}
+
+type DifferentialDownloadResult struct {
+	Size           int64  `json:"size"`
+	Sha512         string `json:"sha512"`
+	DownloadedSize int64  `json:"downloadedSize"`
+	CopiedSize     int64  `json:"copiedSize"`
+	// differential download was not possible (e.g. server doesn't support ranges) and the whole file was downloaded
+	IsFullDownload bool `json:"isFullDownload,omitempty"`
+}
+
+func ConfigureApplyBlockMapCommand(app *kingpin.Application) {
+	command := app.Command("apply-blockmap", "Reconstruct new file from the old one, only changed blocks are downloaded (differential download).")
+	oldFile := command.Flag("old-file", "The old (installed) file.").Required().ExistingFile()
+	oldBlockMapFile := command.Flag("old-blockmap", "The block map of the old file. If not specified, computed from the old file.").ExistingFile()
+	blockMapUrl := command.Flag("blockmap-url", "The URL of the new file block map.").Required().String()
+	fileUrl := command.Flag("url", "The URL of the new file.").Short('u').Required().String()
+	output := command.Flag("output", "The output file.").Short('o').Required().String()
+	sha512 := command.Flag("sha512", "The expected sha512 of the new file.").String()
+	noFallback := command.Flag("no-fallback", "Fail instead of downloading the whole file if differential download is not possible.").Bool()
+	ConfigureGithubServerFlags(command)
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		downloader := NewDownloader()
+		result, err := downloader.ApplyBlockMap(*oldFile, *oldBlockMapFile, *blockMapUrl, *fileUrl, *output, *sha512)
+		if err != nil {
+			if *noFallback {
+				return err
+			}
+
+			log.Warn("cannot download differentially, fallback to full download", zap.Error(err))
+			err = downloader.Download(*fileUrl, *output, *sha512)
+			if err != nil {
+				return err
+			}
+
+			result, err = createFullDownloadResult(*output)
+			if err != nil {
+				return err
+			}
+		}
+		return util.WriteJsonToStdOut(result)
+	})
+}
+
+func createFullDownloadResult(file string) (*DifferentialDownloadResult, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	checksum, err := computeSha512(file)
+	if err != nil {
+		return nil, err
+	}
+	return &DifferentialDownloadResult{Size: info.Size(), Sha512: checksum, DownloadedSize: info.Size(), IsFullDownload: true}, nil
+}
+
+// ApplyBlockMap downloads changed blocks of the new file (according to its block map) and copies unchanged from the old file.
+// Result is written to a temp file and renamed to the output only if checksum is verified.
+func (t *Downloader) ApplyBlockMap(oldFile string, oldBlockMapFile string, blockMapUrl string, fileUrl string, output string, expectedSha512 string) (*DifferentialDownloadResult, error) {
+	start := time.Now()
+
+	oldBlockMap, err := readOldBlockMap(oldFile, oldBlockMapFile)
+	if err != nil {
+		return nil, err
+	}
+
+	newBlockMap, err := t.downloadBlockMap(blockMapUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(oldBlockMap.Files) == 0 || len(newBlockMap.Files) == 0 {
+		return nil, errors.New("block map doesn't contain files")
+	}
+
+	operations := computeBlockOperations(&oldBlockMap.Files[0], &newBlockMap.Files[0])
+
+	location, err := t.follow(fileUrl, getUserAgent(), output)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fsutil.EnsureDir(filepath.Dir(output))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	tempFile := output + ".differential"
+	result, err := t.writeDifferential(location.Url, oldFile, operations, tempFile)
+	if err == nil && len(expectedSha512) != 0 && result.Sha512 != expectedSha512 {
+		err = errors.WithStack(&ChecksumMismatchError{Expected: expectedSha512, Actual: result.Sha512})
+	}
+	if err == nil {
+		err = errors.WithStack(os.Rename(tempFile, output))
+	}
+	if err != nil {
+		_ = os.Remove(tempFile)
+		return nil, err
+	}
+
+	log.Info("downloaded differentially", zap.String("url", fileUrl), zap.Int64("downloaded", result.DownloadedSize), zap.Int64("copied", result.CopiedSize),
+		zap.Duration("duration", time.Since(start).Round(time.Millisecond)))
+	return result, nil
+}
+
+func readOldBlockMap(oldFile string, oldBlockMapFile string) (*blockmap.BlockMap, error) {
+	if len(oldBlockMapFile) == 0 {
+		return blockmap.CreateBlockMap(oldFile, blockmap.DefaultChunkerConfiguration)
+	}
+
+	data, err := ioutil.ReadFile(oldBlockMapFile)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return blockmap.DecodeBlockMap(data, blockmap.GZIP)
+}
+
+func (t *Downloader) downloadBlockMap(url string) (*blockmap.BlockMap, error) {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	request.Header.Set("User-Agent", getUserAgent())
+	GetGithubServer().authorize(request)
+	// client of downloader doesn't follow redirects
+	client := &http.Client{Transport: t.Transport}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	defer util.Close(response.Body)
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cannot download block map %s: status code %d", url, response.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return blockmap.DecodeBlockMap(data, blockmap.GZIP)
+}
+
+func computeBlockOperations(oldFile *blockmap.BlockMapFile, newFile *blockmap.BlockMapFile) []*blockOperation {
+	// same content can be in several blocks, the first one is used
+	checksumToOldOffset := make(map[string]int64, len(oldFile.Checksums))
+	var offset int64
+	for index, checksum := range oldFile.Checksums {
+		key := blockKey(checksum, oldFile.Sizes[index])
+		if _, ok := checksumToOldOffset[key]; !ok {
+			checksumToOldOffset[key] = offset
+		}
+		offset += int64(oldFile.Sizes[index])
+	}
+
+	var operations []*blockOperation
+	var last *blockOperation
+	offset = 0
+	for index, checksum := range newFile.Checksums {
+		size := int64(newFile.Sizes[index])
+		kind := downloadOperation
+		blockStart := offset
+		oldOffset, ok := checksumToOldOffset[blockKey(checksum, newFile.Sizes[index])]
+		if ok {
+			kind = copyOperation
+			blockStart = oldOffset
+		}
+
+		if last != nil && last.kind == kind && last.end == blockStart {
+			last.end += size
+		} else {
+			last = &blockOperation{kind: kind, start: blockStart, end: blockStart + size}
+			operations = append(operations, last)
+		}
+		if kind == downloadOperation {
+			last.checksums = append(last.checksums, checksum)
+			last.sizes = append(last.sizes, newFile.Sizes[index])
+		}
+		offset += size
+	}
+	return mergeSmallGaps(operations, newFile)
+}
+
+// small copied block between two downloaded ranges is downloaded too, so, the ranges are merged to one request
+func mergeSmallGaps(operations []*blockOperation, newFile *blockmap.BlockMapFile) []*blockOperation {
+	if len(operations) < 3 {
+		return operations
+	}
+
+	result := operations[:0]
+	var newOffset int64
+	for index := 0; index < len(operations); index++ {
+		operation := operations[index]
+		if operation.kind == copyOperation && len(result) != 0 && result[len(result)-1].kind == downloadOperation && index+1 < len(operations) &&
+			operations[index+1].kind == downloadOperation && operation.end-operation.start <= maxRangeGap {
+			previous := result[len(result)-1]
+			next := operations[index+1]
+			gapSize := operation.end - operation.start
+			previous.checksums, previous.sizes = appendBlocks(previous.checksums, previous.sizes, newFile, newOffset, gapSize)
+			previous.checksums = append(previous.checksums, next.checksums...)
+			previous.sizes = append(previous.sizes, next.sizes...)
+			previous.end = next.end
+			newOffset += gapSize + (next.end - next.start)
+			index++
+			continue
+		}
+
+		result = append(result, operation)
+		newOffset += operation.end - operation.start
+	}
+	return result
+}
+
+// appends checksums and sizes of new file blocks in the range [start, start + length)
+func appendBlocks(checksums []string, sizes []int, newFile *blockmap.BlockMapFile, start int64, length int64) ([]string, []int) {
+	var offset int64
+	for index, size := range newFile.Sizes {
+		if offset >= start+length {
+			break
+		}
+		if offset >= start {
+			checksums = append(checksums, newFile.Checksums[index])
+			sizes = append(sizes, size)
+		}
+		offset += int64(size)
+	}
+	return checksums, sizes
+}
+
+func blockKey(checksum string, size int) string {
+	return checksum + "-" + strconv.Itoa(size)
+}
+
+func (t *Downloader) writeDifferential(url string, oldFile string, operations []*blockOperation, outFile string) (*DifferentialDownloadResult, error) {
+	oldReader, err := os.Open(oldFile)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	defer util.Close(oldReader)
+
+	writer, err := os.Create(outFile)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var downloadContext context.Context
+	var cancel context.CancelFunc
+	if t.Timeout > 0 {
+		downloadContext, cancel = util.CreateContextWithTimeout(t.Timeout)
+	} else {
+		downloadContext, cancel = util.CreateContext()
+	}
+	defer cancel()
+
+	result := &DifferentialDownloadResult{}
+	hash := sha512.New()
+	output := io.MultiWriter(writer, hash)
+	for _, operation := range operations {
+		size := operation.end - operation.start
+		if operation.kind == copyOperation {
+			_, err = io.Copy(output, io.NewSectionReader(oldReader, operation.start, size))
+			if err != nil {
+				return nil, fsutil.CloseAndCheckError(errors.WithStack(err), writer)
+			}
+			result.CopiedSize += size
+		} else {
+			err = t.downloadRange(downloadContext, url, operation, output)
+			if err != nil {
+				return nil, fsutil.CloseAndCheckError(err, writer)
+			}
+			result.DownloadedSize += size
+		}
+		result.Size += size
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	result.Sha512 = base64.StdEncoding.EncodeToString(hash.Sum(nil))
+	return result, nil
+}
+
+func (t *Downloader) downloadRange(context context.Context, url string, operation *blockOperation, writer io.Writer) error {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	request = request.WithContext(context)
+	request.Header.Set("User-Agent", getUserAgent())
+	request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", operation.start, operation.end-1))
+	GetGithubServer().authorize(request)
+
+	var data []byte
+	for attemptNumber := 0; ; attemptNumber++ {
+		data, err = t.doRangeRequest(request)
+		if err == nil || request.Context().Err() != nil || attemptNumber == maxAttemptNumber {
+			break
+		}
+		// server doesn't support ranges - retry will not help
+		if _, ok := errors.Cause(err).(util.MessageError); ok {
+			break
+		}
+
+		log.Info("retrying", zap.Int("attempt", attemptNumber+1), zap.Error(err))
+		time.Sleep(2 * time.Second)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = verifyBlocks(data, operation)
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.Write(data)
+	return errors.WithStack(err)
+}
+
+func (t *Downloader) doRangeRequest(request *http.Request) ([]byte, error) {
+	response, err := t.client.Do(request)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	defer util.Close(response.Body)
+	if response.StatusCode != http.StatusPartialContent {
+		// 200 means that range is ignored - downloading of the whole file for each range makes no sense
+		return nil, util.NewMessageError(fmt.Sprintf("server doesn't support range requests (status code %d)", response.StatusCode), "ERR_DIFFERENTIAL_RANGE_NOT_SUPPORTED")
+	}
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return data, nil
+}
+
+// downloaded data is verified per block to detect that file on server doesn't match block map
+func verifyBlocks(data []byte, operation *blockOperation) error {
+	if int64(len(data)) != operation.end-operation.start {
+		return errors.Errorf("range %d-%d: expected %d bytes, got %d", operation.start, operation.end, operation.end-operation.start, len(data))
+	}
+
+	hash, err := blockmap.NewBlockHash()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	offset := 0
+	for index, size := range operation.sizes {
+		hash.Reset()
+		_, _ = hash.Write(data[offset : offset+size])
+		actual := base64.StdEncoding.EncodeToString(hash.Sum(nil))
+		if actual != operation.checksums[index] {
+			return util.NewMessageError(fmt.Sprintf("block at offset %d doesn't match block map checksum", operation.start+int64(offset)), "ERR_DIFFERENTIAL_BLOCK_CHECKSUM_MISMATCH")
+		}
+		offset += size
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package download
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/develar/app-builder/pkg/blockmap"
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+)
+
+func TestApplyBlockMap(t *testing.T) {
+	log.InitLogger()
+	g := NewGomegaWithT(t)
+
+	tempDir, err := ioutil.TempDir("", "differential")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer func() {
+		_ = os.RemoveAll(tempDir)
+	}()
+
+	random := rand.New(rand.NewSource(42))
+	oldData := make([]byte, 4*1024*1024)
+	_, _ = random.Read(oldData)
+
+	// change in the middle and insertion near the end
+	newData := append([]byte{}, oldData[:1024*1024]...)
+	changed := make([]byte, 100*1024)
+	_, _ = random.Read(changed)
+	newData = append(newData, changed...)
+	newData = append(newData, oldData[1024*1024+100*1024:3*1024*1024]...)
+	newData = append(newData, []byte("inserted")...)
+	newData = append(newData, oldData[3*1024*1024:]...)
+
+	oldFile := filepath.Join(tempDir, "old")
+	newFile := filepath.Join(tempDir, "new")
+	g.Expect(ioutil.WriteFile(oldFile, oldData, 0666)).NotTo(HaveOccurred())
+	g.Expect(ioutil.WriteFile(newFile, newData, 0666)).NotTo(HaveOccurred())
+
+	newInfo, err := blockmap.BuildBlockMap(newFile, blockmap.DefaultChunkerConfiguration, blockmap.GZIP, newFile+".blockmap")
+	g.Expect(err).NotTo(HaveOccurred())
+	blockMapData, err := ioutil.ReadFile(newFile + ".blockmap")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	isRangeSupported := true
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if strings.HasSuffix(request.URL.Path, ".blockmap") {
+			_, _ = writer.Write(blockMapData)
+			return
+		}
+		if !isRangeSupported {
+			request.Header.Del("Range")
+		}
+		http.ServeContent(writer, request, "", time.Time{}, bytes.NewReader(newData))
+	}))
+	defer server.Close()
+
+	downloader := NewDownloader()
+	outFile := filepath.Join(tempDir, "out")
+	result, err := downloader.ApplyBlockMap(oldFile, "", server.URL+"/file.blockmap", server.URL+"/file", outFile, newInfo.Sha512)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.Size).To(Equal(int64(len(newData))))
+	g.Expect(result.Sha512).To(Equal(newInfo.Sha512))
+	g.Expect(result.CopiedSize + result.DownloadedSize).To(Equal(int64(len(newData))))
+	g.Expect(result.DownloadedSize).To(BeNumerically("<", len(newData)/2))
+
+	outData, err := ioutil.ReadFile(outFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(bytes.Equal(outData, newData)).To(BeTrue())
+
+	// output is not modified if checksum doesn't match
+	_, err = downloader.ApplyBlockMap(oldFile, "", server.URL+"/file.blockmap", server.URL+"/file", filepath.Join(tempDir, "mismatch"), "foo")
+	g.Expect(err).To(HaveOccurred())
+	_, err = os.Stat(filepath.Join(tempDir, "mismatch"))
+	g.Expect(os.IsNotExist(err)).To(BeTrue())
+
+	isRangeSupported = false
+	_, err = downloader.ApplyBlockMap(oldFile, "", server.URL+"/file.blockmap", server.URL+"/file", filepath.Join(tempDir, "noRanges"), newInfo.Sha512)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("range requests"))
+}
@@ -1,6 +1,7 @@
 package download
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
@@ -75,15 +76,45 @@ func ConfigureCommand(app *kingpin.Application) {
 	fileUrl := command.Flag("url", "The URL.").Short('u').Required().String()
 	output := command.Flag("output", "The output file.").Short('o').Required().String()
 	sha512 := command.Flag("sha512", "The expected sha512 of file.").String()
+	stallTimeout := command.Flag("stall-timeout", "Reconnect and resume if no data received during this time, 0 to disable.").Duration()
+	timeout := command.Flag("timeout", "Hard timeout for the whole download, 0 to disable.").Duration()
+	checksumLockFile := command.Flag("checksum-lock-file", "If sha512 is not specified, record checksum of the first download to the file and enforce it on subsequent downloads.").String()
+	ConfigureGithubServerFlags(command)
 
 	command.Action(func(context *kingpin.ParseContext) error {
-		return NewDownloader().Download(*fileUrl, *output, *sha512)
+		downloader := NewDownloader()
+		if *stallTimeout != 0 {
+			downloader.StallTimeout = *stallTimeout
+		}
+		if *timeout != 0 {
+			downloader.Timeout = *timeout
+		}
+		if *checksumLockFile != "" {
+			downloader.ChecksumLock = NewChecksumLock(*checksumLockFile)
+		}
+		return downloader.Download(*fileUrl, *output, *sha512)
 	})
 }
 
 type Downloader struct {
 	client    *http.Client
 	Transport *http.Transport
+
+	// no data received during this time - connection is considered as stalled, and download is resumed using new connection
+	StallTimeout time.Duration
+	// hard timeout for the whole download (including retries)
+	Timeout time.Duration
+
+	// downloads of this size and larger are streamed to the output file, 0 to disable (default, enabled for artifacts, see newArtifactDownloader)
+	StreamingThreshold int64
+
+	// trust-on-first-use checksum pinning for downloads without checksum, nil if disabled
+	ChecksumLock *ChecksumLock
+
+	// shared by all downloaders of the process by default, nil to not limit
+	Scheduler *Scheduler
+	// scheduler is per process, so, background priority makes sense only if several downloads are performed by the same process
+	Priority Priority
 }
 
 func NewDownloader() *Downloader {
@@ -98,7 +129,12 @@ func NewDownloader() *Downloader {
 
 func NewDownloaderWithTransport(transport *http.Transport) *Downloader {
 	return &Downloader{
-		Transport: transport,
+		Transport:    transport,
+		StallTimeout: getDurationFromEnv("DOWNLOADER_STALL_TIMEOUT", defaultStallTimeout),
+		Timeout:      getDurationFromEnv("DOWNLOADER_TIMEOUT", 0),
+		ChecksumLock: getChecksumLockFromEnv(),
+		Scheduler:    sharedScheduler,
+
 		client: &http.Client{
 			CheckRedirect: func(_ *http.Request, _ []*http.Request) error {
 				return http.ErrUseLastResponse
@@ -108,7 +144,37 @@ func NewDownloaderWithTransport(transport *http.Transport) *Downloader {
 	}
 }
 
+func getChecksumLockFromEnv() *ChecksumLock {
+	file := os.Getenv("APP_BUILDER_CHECKSUM_LOCK_FILE")
+	if file == "" {
+		return nil
+	}
+	return NewChecksumLock(file)
+}
+
 func (t *Downloader) Download(url string, output string, sha512 string) error {
+	if len(sha512) != 0 || t.ChecksumLock == nil {
+		return t.downloadWithCaFallback(url, output, sha512)
+	}
+
+	pinnedSha512, err := t.ChecksumLock.Get(url)
+	if err != nil {
+		return err
+	}
+
+	err = t.downloadWithCaFallback(url, output, pinnedSha512)
+	if err == nil && len(pinnedSha512) == 0 {
+		var actualSha512 string
+		actualSha512, err = computeSha512(output)
+		if err == nil {
+			log.Debug("pin checksum", zap.String("url", url), zap.String("sha512", actualSha512), zap.String("lockFile", t.ChecksumLock.File()))
+			err = t.ChecksumLock.Pin(url, actualSha512)
+		}
+	}
+	return reportPinnedChecksumMismatch(url, t.ChecksumLock.File(), err)
+}
+
+func (t *Downloader) downloadWithCaFallback(url string, output string, sha512 string) error {
 	err := t.DownloadNoRetry(url, output, sha512)
 	if err != nil {
 		if t.Transport.TLSClientConfig != nil && t.Transport.TLSClientConfig.RootCAs != nil {
@@ -145,14 +211,53 @@ func (t *Downloader) DownloadResolved(location *ActualLocation, sha512 string, u
 		return errors.WithStack(err)
 	}
 
-	downloadContext, cancel := util.CreateContext()
+	var downloadContext context.Context
+	var cancel context.CancelFunc
+	if t.Timeout > 0 {
+		downloadContext, cancel = util.CreateContextWithTimeout(t.Timeout)
+	} else {
+		downloadContext, cancel = util.CreateContext()
+	}
+	defer cancel()
 
 	location.computeParts(minPartSize)
-	log.Info("downloading", zap.String("url", urlToLog), zap.String("size", humanize.Bytes(uint64(location.ContentLength))), zap.Int("parts", len(location.Parts)))
+
+	// partially downloaded file and parts must not remain if canceled
+	files := []string{location.OutFileName}
+	for _, part := range location.Parts {
+		files = append(files, part.Name)
+	}
+	defer util.RemoveOnCancel(files...)()
+
+	ticket := t.Scheduler.begin(t.Priority)
+	defer ticket.end()
+
+	isStreaming := t.StreamingThreshold > 0 && location.ContentLength >= t.StreamingThreshold
+	var progress *downloadProgress
+	if isStreaming {
+		err = location.prepareStreaming(sha512)
+		if err != nil {
+			return err
+		}
+
+		progress = startProgressReporting(urlToLog, location.ContentLength)
+		defer progress.stop()
+		for _, part := range location.Parts {
+			part.progress = progress
+		}
+	}
+
+	log.Info("downloading", zap.String("url", urlToLog), zap.String("size", humanize.Bytes(uint64(location.ContentLength))), zap.Int("parts", len(location.Parts)), zap.Bool("streaming", isStreaming))
 	err = util.MapAsyncConcurrency(len(location.Parts), getMaxPartCount(), func(index int) (func() error, error) {
 		part := location.Parts[index]
 		return func() error {
-			err = part.download(downloadContext, location.Url, index, t.client)
+			err := ticket.acquire(downloadContext)
+			if err != nil {
+				return err
+			}
+			defer ticket.release()
+
+			err = part.download(downloadContext, location.Url, index, t.client, t.StallTimeout, ticket)
 			if err != nil {
 				part.isFail = true
 				log.Debug("part download error", zap.Int("id", index), zap.Error(err))
@@ -162,14 +267,14 @@ func (t *Downloader) DownloadResolved(location *ActualLocation, sha512 string, u
 	})
 
 	if err != nil {
+		if downloadContext.Err() == context.DeadlineExceeded {
+			return util.NewMessageError(fmt.Sprintf("cannot download %s in %s", urlToLog, t.Timeout), "ERR_DOWNLOAD_TIMEOUT")
+		}
 		return errors.WithStack(err)
 	}
 
-	for _, part := range location.Parts {
-		if part.isFail {
-			cancel()
-			break
-		}
+	if isStreaming {
+		return location.verifyStreamed(sha512)
 	}
 
 	location.deleteUnnecessaryParts()
@@ -196,7 +301,15 @@ func (t *Downloader) follow(initialUrl, userAgent, outFileName string) (*ActualL
 		}
 
 		request.Header.Set("User-Agent", userAgent)
+		GetGithubServer().authorize(request)
 		actualLocation, err := func() (*ActualLocation, error) {
+			if t.StallTimeout > 0 {
+				// only headers are read, so, stall timeout is used as a timeout for the whole request
+				requestContext, cancel := util.CreateContextWithTimeout(t.StallTimeout)
+				defer cancel()
+				request = request.WithContext(requestContext)
+			}
+
 			response, err := t.client.Do(request)
 			if response != nil {
 				util.Close(response.Body)
@@ -215,7 +328,7 @@ func (t *Downloader) follow(initialUrl, userAgent, outFileName string) (*ActualL
 				currentUrl = loc.String()
 				return nil, nil
 			} else if response.StatusCode != http.StatusOK {
-				return nil, fmt.Errorf("cannot resolve %s: status code %d", initialUrl, response.StatusCode)
+				return nil, util.NewMessageError(fmt.Sprintf("cannot resolve %s: status code %d", initialUrl, response.StatusCode), "ERR_DOWNLOAD_FAILED")
 			}
 
 			actualLocation := NewResolvedLocation(currentUrl, response.ContentLength, outFileName, response.Header.Get("Accept-Ranges") != "")
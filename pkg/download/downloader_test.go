@@ -0,0 +1,220 @@
+package download
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	. "github.com/onsi/gomega"
+)
+
+func TestResumeStalledDownload(t *testing.T) {
+	testResumeStalledDownload(t, 0)
+}
+
+func TestResumeStalledStreamingDownload(t *testing.T) {
+	testResumeStalledDownload(t, 1)
+}
+
+func testResumeStalledDownload(t *testing.T, streamingThreshold int64) {
+	log.InitLogger()
+	g := NewGomegaWithT(t)
+
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	var rangeRequestCount int32
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("Range") != "" && atomic.AddInt32(&rangeRequestCount, 1) == 1 {
+			// send half and hang
+			writer.Header().Set("Content-Range", "bytes 0-999/1000")
+			writer.Header().Set("Content-Length", "1000")
+			writer.WriteHeader(http.StatusPartialContent)
+			_, _ = writer.Write(data[:500])
+			writer.(http.Flusher).Flush()
+			<-request.Context().Done()
+			return
+		}
+		http.ServeContent(writer, request, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "download")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer func() {
+		_ = os.RemoveAll(tempDir)
+	}()
+
+	downloader := NewDownloader()
+	downloader.StallTimeout = 200 * time.Millisecond
+	downloader.StreamingThreshold = streamingThreshold
+	outFile := filepath.Join(tempDir, "file")
+	err = downloader.DownloadNoRetry(server.URL, outFile, computeTestSha512(data))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	result, err := ioutil.ReadFile(outFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result).To(Equal(data))
+	g.Expect(atomic.LoadInt32(&rangeRequestCount)).To(Equal(int32(2)))
+}
+
+func TestDownloadTimeout(t *testing.T) {
+	log.InitLogger()
+	g := NewGomegaWithT(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Length", "1000")
+		if request.Header.Get("Range") == "" {
+			return
+		}
+		writer.WriteHeader(http.StatusPartialContent)
+		// heartbeat to avoid stall detection
+		for {
+			select {
+			case <-request.Context().Done():
+				return
+			case <-time.After(50 * time.Millisecond):
+				_, _ = writer.Write([]byte{0})
+				writer.(http.Flusher).Flush()
+			}
+		}
+	}))
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "download")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer func() {
+		_ = os.RemoveAll(tempDir)
+	}()
+
+	downloader := NewDownloader()
+	downloader.StallTimeout = time.Second
+	downloader.Timeout = 500 * time.Millisecond
+	err = downloader.DownloadNoRetry(server.URL, filepath.Join(tempDir, "file"), "")
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("cannot download"))
+}
+
+func TestChecksumPinning(t *testing.T) {
+	log.InitLogger()
+	g := NewGomegaWithT(t)
+
+	data := []byte("first")
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		http.ServeContent(writer, request, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "download")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer func() {
+		_ = os.RemoveAll(tempDir)
+	}()
+
+	downloader := NewDownloader()
+	downloader.ChecksumLock = NewChecksumLock(filepath.Join(tempDir, "checksums.lock"))
+
+	err = downloader.Download(server.URL, filepath.Join(tempDir, "file1"), "")
+	g.Expect(err).NotTo(HaveOccurred())
+	pinned, err := downloader.ChecksumLock.Get(server.URL)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(pinned).To(Equal("f92A293tFWMj02xFnl/RM6TYiMInMgz7cEK+n+s11/ByAeU1aXr5FOadb0ayqIZVyGwjcSiAUszU+pIFiwHT/Q=="))
+
+	// the same content - pinned checksum matches
+	err = downloader.Download(server.URL, filepath.Join(tempDir, "file2"), "")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	data = []byte("second")
+	err = downloader.Download(server.URL, filepath.Join(tempDir, "file3"), "")
+	g.Expect(err).To(HaveOccurred())
+	messageError, ok := errors.Cause(err).(util.MessageError)
+	g.Expect(ok).To(BeTrue())
+	g.Expect(messageError.ErrorCode()).To(Equal("ERR_CHECKSUM_PIN_MISMATCH"))
+}
+
+func TestStreamingMultipartDownload(t *testing.T) {
+	log.InitLogger()
+	g := NewGomegaWithT(t)
+
+	data := make([]byte, minPartSize*2+1024)
+	for index := range data {
+		data[index] = byte(index * 31)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		http.ServeContent(writer, request, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "download")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer func() {
+		_ = os.RemoveAll(tempDir)
+	}()
+
+	downloader := NewDownloader()
+	downloader.StreamingThreshold = minPartSize
+	outFile := filepath.Join(tempDir, "file")
+	err = downloader.DownloadNoRetry(server.URL, outFile, computeTestSha512(data))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	result, err := ioutil.ReadFile(outFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result).To(Equal(data))
+
+	files, err := ioutil.ReadDir(tempDir)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(len(files)).To(Equal(1))
+
+	err = downloader.DownloadNoRetry(server.URL, outFile, computeTestSha512([]byte("other")))
+	g.Expect(errors.Cause(err)).To(BeAssignableToTypeOf(&ChecksumMismatchError{}))
+}
+
+func computeTestSha512(data []byte) string {
+	hash := sha512.Sum512(data)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func TestGithubEnterpriseServer(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	server := NewGithubServer("", "")
+	g.Expect(server.IsEnterprise()).To(BeFalse())
+	g.Expect(server.ApiEndpoint("/repos/o/r/releases")).To(Equal("https://api.github.com/repos/o/r/releases"))
+	g.Expect(server.ReleaseDownloadUrl("electron/electron", "v", "")).To(Equal("https://github.com/electron/electron/releases/download/v"))
+
+	server = NewGithubServer("https://git.example.com/github/", "")
+	server.Token = "secret"
+	g.Expect(server.IsEnterprise()).To(BeTrue())
+	g.Expect(server.ApiEndpoint("/repos/o/r/releases")).To(Equal("https://git.example.com/github/api/v3/repos/o/r/releases"))
+	g.Expect(server.ReleaseDownloadUrl("o/r", "v1.0.0/", "file.7z")).To(Equal("https://git.example.com/github/o/r/releases/download/v1.0.0/file.7z"))
+
+	request, err := http.NewRequest(http.MethodGet, server.ReleaseDownloadUrl("o/r", "v1.0.0/", "file.7z"), nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	server.authorize(request)
+	g.Expect(request.Header.Get("Authorization")).To(Equal("token secret"))
+
+	// token is not sent to redirect location
+	request, err = http.NewRequest(http.MethodGet, "https://storage.example.com/file.7z", nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	server.authorize(request)
+	g.Expect(request.Header.Get("Authorization")).To(BeEmpty())
+
+	// upstream binaries are downloaded from GitHub.com
+	previous := GetGithubServer()
+	SetGithubServer(server)
+	defer SetGithubServer(previous)
+	if os.Getenv("ELECTRON_BUILDER_BINARIES_MIRROR") == "" && os.Getenv("npm_config_electron_builder_binaries_mirror") == "" {
+		g.Expect(GetGithubBaseUrl()).To(Equal("https://github.com/electron-userland/electron-builder-binaries/releases/download/"))
+	}
+	g.Expect(GetPublicGithubServer().IsEnterprise()).To(BeFalse())
+}
@@ -0,0 +1,260 @@
+package download
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/develar/app-builder/pkg/credentials"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+	"go.uber.org/zap"
+)
+
+// If key is configured (APP_BUILDER_CACHE_ENCRYPTION_KEY env or credentials helper, e.g. backed by keyring), downloaded artifacts are stored in the cache only encrypted
+// (for organizations whose policy forbids storing vendor binaries unencrypted on shared CI disks).
+// Artifact is decrypted and unpacked on use to the decrypted cache dir APP_BUILDER_DECRYPTED_CACHE_DIR - it must be set explicitly to a job-local dir removed after the job
+// (unpacked artifact is used after app-builder exits, so, it cannot be the run temp dir, and the shared temp dir would keep decrypted binaries across jobs).
+const CacheEncryptionKeyCredentialName = "cache-encryption-key"
+
+const (
+	encryptedFileMagic = "ABCACHE1"
+	encryptedChunkSize = 64 * 1024
+	baseNonceSize      = 8
+)
+
+func getCacheEncryptionKey() ([]byte, error) {
+	secret, err := credentials.Get(CacheEncryptionKeyCredentialName)
+	if err != nil || len(secret) == 0 {
+		return nil, err
+	}
+
+	key := sha256.Sum256([]byte(secret))
+	return key[:], nil
+}
+
+func getDecryptedCacheDir() (string, error) {
+	result := os.Getenv("APP_BUILDER_DECRYPTED_CACHE_DIR")
+	if result == "" {
+		return "", util.NewMessageError("cache encryption key is configured, but APP_BUILDER_DECRYPTED_CACHE_DIR is not set: set it to a job-local dir that is removed after the job", "ERR_DECRYPTED_CACHE_DIR_MISSING")
+	}
+	return result, nil
+}
+
+// encrypted archive is stored in the cache dir, unpacked artifact - in the decrypted cache dir
+func downloadEncryptedArtifact(dirName string, url string, checksum string, cacheDir string, key []byte, logger *zap.Logger) (string, error) {
+	decryptedCacheDir, err := getDecryptedCacheDir()
+	if err != nil {
+		return "", err
+	}
+	filePath := filepath.Join(decryptedCacheDir, dirName)
+	isFound, err := CheckCache(filePath, decryptedCacheDir, logger)
+	if isFound {
+		return filePath, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	err = os.Chmod(decryptedCacheDir, 0700)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	tempUnpackDir, err := util.TempDir(decryptedCacheDir, "")
+	if err != nil {
+		return "", err
+	}
+
+	archiveName := tempUnpackDir + ".7z"
+	defer util.RemoveOnCancel(archiveName, tempUnpackDir)()
+	encryptedFile := filepath.Join(cacheDir, dirName+".encrypted")
+	_, err = os.Stat(encryptedFile)
+	if err == nil {
+		logger.Debug("decrypt cached artifact")
+		err = decryptFile(encryptedFile, archiveName, key)
+		if err != nil {
+			return "", errors.WithMessage(err, "cannot decrypt cached "+encryptedFile+" (key was changed?), delete it to download again")
+		}
+	} else if os.IsNotExist(err) {
+		err = newArtifactDownloader().Download(url, archiveName, checksum)
+		if err != nil {
+			return "", err
+		}
+
+		err = fsutil.EnsureDir(cacheDir)
+		if err != nil {
+			return "", err
+		}
+
+		tempEncryptedFile := encryptedFile + "." + filepath.Base(tempUnpackDir)
+		defer util.RemoveOnCancel(tempEncryptedFile)()
+		err = encryptFile(archiveName, tempEncryptedFile, key)
+		if err != nil {
+			return "", err
+		}
+		RenameToFinalFile(tempEncryptedFile, encryptedFile, logger)
+	} else {
+		return "", errors.WithStack(err)
+	}
+
+	err = extractArtifact(url, archiveName, tempUnpackDir, cacheDir)
+	if err != nil {
+		return "", err
+	}
+
+	RemoveArchiveFile(archiveName, tempUnpackDir, logger)
+	RenameToFinalFile(tempUnpackDir, filePath, logger)
+	return filePath, nil
+}
+
+// file is split into chunks encrypted using AES-256-GCM, nonce is random prefix and chunk index,
+// the last chunk is marked using additional data to detect truncation
+func encryptFile(inFile string, outFile string, key []byte) error {
+	aead, err := newCacheCipher(key)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(inFile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(in)
+
+	out, err := os.OpenFile(outFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = writeEncrypted(bufio.NewReaderSize(in, encryptedChunkSize), out, aead)
+	return fsutil.CloseAndCheckError(err, out)
+}
+
+func writeEncrypted(reader *bufio.Reader, out io.Writer, aead cipher.AEAD) error {
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce[:baseNonceSize])
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = out.Write(append([]byte(encryptedFileMagic), nonce[:baseNonceSize]...))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	plain := make([]byte, encryptedChunkSize)
+	sealed := make([]byte, 0, encryptedChunkSize+aead.Overhead())
+	for index := uint32(0); ; index++ {
+		n, err := io.ReadFull(reader, plain)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return errors.WithStack(err)
+		}
+
+		isLast := err != nil
+		if !isLast {
+			_, peekErr := reader.Peek(1)
+			isLast = peekErr == io.EOF
+		}
+
+		binary.BigEndian.PutUint32(nonce[baseNonceSize:], index)
+		sealed = aead.Seal(sealed[:0], nonce, plain[:n], chunkAdditionalData(isLast))
+		_, err = out.Write(sealed)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if isLast {
+			return nil
+		}
+	}
+}
+
+func decryptFile(inFile string, outFile string, key []byte) error {
+	aead, err := newCacheCipher(key)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(inFile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(in)
+
+	out, err := os.OpenFile(outFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = writeDecrypted(bufio.NewReaderSize(in, encryptedChunkSize+aead.Overhead()), out, aead)
+	return fsutil.CloseAndCheckError(err, out)
+}
+
+func writeDecrypted(reader *bufio.Reader, out io.Writer, aead cipher.AEAD) error {
+	header := make([]byte, len(encryptedFileMagic)+baseNonceSize)
+	_, err := io.ReadFull(reader, header)
+	if err != nil || string(header[:len(encryptedFileMagic)]) != encryptedFileMagic {
+		return util.NewMessageError("not an encrypted cache file", "ERR_CACHE_DECRYPTION_FAILED")
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	copy(nonce, header[len(encryptedFileMagic):])
+
+	sealed := make([]byte, encryptedChunkSize+aead.Overhead())
+	plain := make([]byte, 0, encryptedChunkSize)
+	for index := uint32(0); ; index++ {
+		n, err := io.ReadFull(reader, sealed)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return errors.WithStack(err)
+		}
+
+		isLast := err != nil
+		if !isLast {
+			_, peekErr := reader.Peek(1)
+			isLast = peekErr == io.EOF
+		}
+
+		binary.BigEndian.PutUint32(nonce[baseNonceSize:], index)
+		plain, err = aead.Open(plain[:0], nonce, sealed[:n], chunkAdditionalData(isLast))
+		if err != nil {
+			return util.NewMessageError("encrypted cache file is corrupted or key is wrong", "ERR_CACHE_DECRYPTION_FAILED")
+		}
+
+		_, err = out.Write(plain)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if isLast {
+			return nil
+		}
+	}
+}
+
+func newCacheCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return aead, nil
+}
+
+func chunkAdditionalData(isLast bool) []byte {
+	if isLast {
+		return []byte{1}
+	}
+	return []byte{0}
+}
@@ -0,0 +1,118 @@
+package download
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	. "github.com/onsi/gomega"
+)
+
+func TestEncryptFile(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "encrypt")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	key := bytes.Repeat([]byte{42}, 32)
+	random := rand.New(rand.NewSource(42))
+	for _, size := range []int{0, 10, encryptedChunkSize, encryptedChunkSize*3 + 7} {
+		data := make([]byte, size)
+		_, _ = random.Read(data)
+
+		plainFile := filepath.Join(dir, "plain")
+		encryptedFile := filepath.Join(dir, "encrypted")
+		decryptedFile := filepath.Join(dir, "decrypted")
+		g.Expect(ioutil.WriteFile(plainFile, data, 0644)).NotTo(HaveOccurred())
+		g.Expect(encryptFile(plainFile, encryptedFile, key)).NotTo(HaveOccurred())
+		g.Expect(decryptFile(encryptedFile, decryptedFile, key)).NotTo(HaveOccurred())
+
+		decrypted, err := ioutil.ReadFile(decryptedFile)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(bytes.Equal(decrypted, data)).To(BeTrue())
+
+		encrypted, err := ioutil.ReadFile(encryptedFile)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		// wrong key
+		g.Expect(decryptFile(encryptedFile, decryptedFile, bytes.Repeat([]byte{1}, 32))).To(HaveOccurred())
+
+		// truncated at chunk boundary
+		if size > encryptedChunkSize {
+			headerSize := len(encryptedFileMagic) + baseNonceSize
+			truncated := encrypted[:headerSize+encryptedChunkSize+16]
+			g.Expect(ioutil.WriteFile(encryptedFile, truncated, 0644)).NotTo(HaveOccurred())
+			g.Expect(decryptFile(encryptedFile, decryptedFile, key)).To(HaveOccurred())
+		}
+	}
+}
+
+func TestDownloadEncryptedArtifact(t *testing.T) {
+	log.InitLogger()
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "encrypted-cache")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	snapData, err := ioutil.ReadFile(filepath.Join("..", "archive", "squashfs", "testData", "template.snap"))
+	g.Expect(err).NotTo(HaveOccurred())
+	requestCount := 0
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		requestCount++
+		_, _ = writer.Write(snapData)
+	}))
+	defer server.Close()
+
+	cacheDir := filepath.Join(dir, "cache")
+	decryptedCacheDir := filepath.Join(dir, "decrypted")
+	defer setEnv("ELECTRON_BUILDER_CACHE", cacheDir)()
+	defer setEnv("APP_BUILDER_DECRYPTED_CACHE_DIR", decryptedCacheDir)()
+	defer setEnv("APP_BUILDER_CACHE_ENCRYPTION_KEY", "secret")()
+
+	result, err := DownloadArtifact("", server.URL+"/template.snap", "")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result).To(Equal(filepath.Join(decryptedCacheDir, "template")))
+	g.Expect(filepath.Join(result, "app", "bin", "run")).To(BeAnExistingFile())
+
+	// only encrypted archive is stored in the cache
+	cacheFiles, err := ioutil.ReadDir(filepath.Join(cacheDir, "template"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(cacheFiles).To(HaveLen(1))
+	g.Expect(cacheFiles[0].Name()).To(Equal("template.encrypted"))
+
+	// decrypted from the cache without download
+	downloadRequestCount := requestCount
+	g.Expect(os.RemoveAll(decryptedCacheDir)).NotTo(HaveOccurred())
+	result, err = DownloadArtifact("", server.URL+"/template.snap", "")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(filepath.Join(result, "app", "bin", "run")).To(BeAnExistingFile())
+	g.Expect(requestCount).To(Equal(downloadRequestCount))
+
+	// decrypted artifact is not stored to the shared temp dir by default
+	g.Expect(os.Unsetenv("APP_BUILDER_DECRYPTED_CACHE_DIR")).To(Succeed())
+	_, err = DownloadArtifact("", server.URL+"/template.snap", "")
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.(util.MessageError).ErrorCode()).To(Equal("ERR_DECRYPTED_CACHE_DIR_MISSING"))
+}
+
+// returns function to restore old value
+func setEnv(name string, value string) func() {
+	oldValue, isSet := os.LookupEnv(name)
+	_ = os.Setenv(name, value)
+	return func() {
+		if isSet {
+			_ = os.Setenv(name, oldValue)
+		} else {
+			_ = os.Unsetenv(name)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package download
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/log"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultGithubUrl    = "https://github.com"
+	defaultGithubApiUrl = "https://api.github.com"
+)
+
+// GitHub.com and GitHub Enterprise Server use different URL schemes for the API:
+// https://api.github.com/ vs https://host/api/v3/ (server can be also served under a path prefix, e.g. https://host/github/)
+type GithubServer struct {
+	// web URL without trailing slash, release assets are downloaded from Url/owner/repo/releases/download/tag/file
+	Url string
+	// API URL without trailing slash
+	ApiUrl string
+	// sent only to the enterprise server host, release assets of private repositories require authorization
+	Token string
+}
+
+var githubServer *GithubServer
+var publicGithubServer = &GithubServer{Url: defaultGithubUrl, ApiUrl: defaultGithubApiUrl}
+var githubServerOnce sync.Once
+
+// GetGithubServer returns server configured using ELECTRON_BUILDER_GITHUB_URL (and optionally ELECTRON_BUILDER_GITHUB_API_URL) or GitHub.com
+func GetGithubServer() *GithubServer {
+	githubServerOnce.Do(func() {
+		if githubServer == nil {
+			githubServer = NewGithubServer(os.Getenv("ELECTRON_BUILDER_GITHUB_URL"), os.Getenv("ELECTRON_BUILDER_GITHUB_API_URL"))
+		}
+	})
+	return githubServer
+}
+
+// GetPublicGithubServer returns GitHub.com - upstream repositories (Electron, electron-builder-binaries) are public and not mirrored to enterprise server,
+// use GetGithubServer for repositories of the user and API calls
+func GetPublicGithubServer() *GithubServer {
+	return publicGithubServer
+}
+
+func SetGithubServer(server *GithubServer) {
+	githubServerOnce.Do(func() {})
+	githubServer = server
+}
+
+func NewGithubServer(serverUrl string, apiUrl string) *GithubServer {
+	serverUrl = strings.TrimSuffix(serverUrl, "/")
+	if serverUrl == "" {
+		serverUrl = defaultGithubUrl
+	}
+
+	apiUrl = strings.TrimSuffix(apiUrl, "/")
+	if apiUrl == "" {
+		if serverUrl == defaultGithubUrl {
+			apiUrl = defaultGithubApiUrl
+		} else {
+			apiUrl = serverUrl + "/api/v3"
+		}
+	}
+
+	result := &GithubServer{Url: serverUrl, ApiUrl: apiUrl}
+	if result.IsEnterprise() {
+		result.Token = os.Getenv("GH_TOKEN")
+		if result.Token == "" {
+			result.Token = os.Getenv("GITHUB_TOKEN")
+		}
+	}
+	return result
+}
+
+// ConfigureGithubServerFlags adds flags to override server configured using env
+func ConfigureGithubServerFlags(command *kingpin.CmdClause) {
+	serverUrl := command.Flag("github-url", "GitHub Enterprise Server URL, e.g. https://github.example.com").String()
+	apiUrl := command.Flag("github-api-url", "GitHub Enterprise Server API URL, SERVER_URL/api/v3 by default").String()
+
+	command.PreAction(func(context *kingpin.ParseContext) error {
+		if *serverUrl != "" || *apiUrl != "" {
+			SetGithubServer(NewGithubServer(*serverUrl, *apiUrl))
+		}
+		return nil
+	})
+}
+
+func (t *GithubServer) IsEnterprise() bool {
+	return t.Url != defaultGithubUrl
+}
+
+// ReleaseDownloadUrl returns URL of release asset, tag and file can be empty to get the base URL (trailing slash is preserved)
+func (t *GithubServer) ReleaseDownloadUrl(repository string, tag string, file string) string {
+	return t.Url + "/" + repository + "/releases/download/" + tag + file
+}
+
+// ApiEndpoint returns URL of API endpoint, path must start with slash, e.g. /repos/owner/repo/releases
+func (t *GithubServer) ApiEndpoint(path string) string {
+	return t.ApiUrl + path
+}
+
+func (t *GithubServer) authorize(request *http.Request) {
+	if t.Token == "" || request.Header.Get("Authorization") != "" {
+		return
+	}
+
+	serverUrl, err := url.Parse(t.Url)
+	if err != nil {
+		log.Debug("cannot parse GitHub server URL", zap.String("url", t.Url), zap.Error(err))
+		return
+	}
+
+	// token must not leak to redirect location (e.g. storage of release assets)
+	if strings.EqualFold(request.URL.Host, serverUrl.Host) {
+		request.Header.Set("Authorization", "token "+t.Token)
+	}
+}
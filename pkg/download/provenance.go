@@ -0,0 +1,88 @@
+package download
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/json-iterator/go"
+	"go.uber.org/zap"
+)
+
+// ProvenanceFileEnvName env to record every used download (downloaded or taken from the cache) to the file as JSON line, the file is used to generate SBOM.
+// Several app-builder processes can append to the same file.
+const ProvenanceFileEnvName = "APP_BUILDER_PROVENANCE_FILE"
+
+type Provenance struct {
+	Name string `json:"name"`
+	Url  string `json:"url"`
+	// base64, as Downloader expects
+	Sha512 string `json:"sha512,omitempty"`
+	// downloaded file or dir the archive is extracted to
+	File string `json:"file,omitempty"`
+}
+
+// RecordProvenance appends the record to the provenance file if ProvenanceFileEnvName is set, error is logged (SBOM is not a reason to fail the build)
+func RecordProvenance(record *Provenance) {
+	file := os.Getenv(ProvenanceFileEnvName)
+	if file == "" {
+		return
+	}
+
+	data, err := jsoniter.ConfigFastest.Marshal(record)
+	if err == nil {
+		err = appendLine(file, data)
+	}
+	if err != nil {
+		log.Warn("cannot record download provenance", zap.String("file", file), zap.Error(err))
+	}
+}
+
+// single write of a small line to file opened in append mode is not interleaved with writes of other processes
+func appendLine(file string, data []byte) error {
+	writer, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = writer.Write(append(data, '\n'))
+	closeErr := writer.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(closeErr)
+}
+
+// ReadProvenance returns records of the provenance file in the order of first use (the same URL is reported once)
+func ReadProvenance(file string) ([]*Provenance, error) {
+	reader, err := os.Open(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer util.Close(reader)
+
+	var result []*Provenance
+	urls := make(map[string]bool)
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var record Provenance
+		err = jsoniter.ConfigFastest.UnmarshalFromString(line, &record)
+		if err != nil {
+			return nil, errors.WithMessage(err, "cannot parse provenance file "+file)
+		}
+		if urls[record.Url] {
+			continue
+		}
+		urls[record.Url] = true
+		result = append(result, &record)
+	}
+	return result, errors.WithStack(scanner.Err())
+}
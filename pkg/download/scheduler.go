@@ -0,0 +1,234 @@
+package download
+
+import (
+	"context"
+	"sync"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/errors"
+)
+
+type Priority int
+
+const (
+	PriorityInteractive Priority = iota
+	PriorityBackground
+)
+
+// Scheduler limits count of parts transferred concurrently by all downloads that share it (e.g. several requests served by one process).
+// Interactive downloads preempt background ones - background transfer is paused (and its slot is released) while any interactive download is in progress.
+// Free slot is given to the download with the least count of running parts, so, downloads of the same priority share bandwidth fairly
+// instead of the first one taking all connections.
+type Scheduler struct {
+	mutex sync.Mutex
+
+	maxActive int
+	active    int
+	waiters   []*slotWaiter
+
+	interactiveCount int
+	// closed when there is no interactive download in progress
+	resume chan struct{}
+}
+
+type slotWaiter struct {
+	ticket  *schedulerTicket
+	granted chan struct{}
+}
+
+// schedulerTicket represents a download, nil ticket (scheduler is not used) doesn't limit anything
+type schedulerTicket struct {
+	scheduler *Scheduler
+	priority  Priority
+	running   int
+}
+
+func NewScheduler(maxActive int) *Scheduler {
+	if maxActive <= 0 {
+		maxActive = 1
+	}
+
+	resume := make(chan struct{})
+	close(resume)
+	return &Scheduler{
+		maxActive: maxActive,
+		resume:    resume,
+	}
+}
+
+var sharedScheduler = NewScheduler(getMaxPartCount() * 2)
+
+// ConfigurePriorityFlag adds flag to set priority of artifact downloads performed by the command
+func ConfigurePriorityFlag(command *kingpin.CmdClause, defaultValue string) {
+	priority := command.Flag("priority", "Download priority, background downloads are paused while interactive download is in progress (scheduler is per process)").
+		Default(defaultValue).
+		Enum("interactive", "background")
+
+	command.PreAction(func(context *kingpin.ParseContext) error {
+		if *priority == "background" {
+			artifactPriority = PriorityBackground
+		} else {
+			artifactPriority = PriorityInteractive
+		}
+		return nil
+	})
+}
+
+func (t *Scheduler) begin(priority Priority) *schedulerTicket {
+	if t == nil {
+		return nil
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if priority == PriorityInteractive {
+		if t.interactiveCount == 0 {
+			t.resume = make(chan struct{})
+		}
+		t.interactiveCount++
+	}
+	return &schedulerTicket{scheduler: t, priority: priority}
+}
+
+func (t *schedulerTicket) end() {
+	if t == nil || t.priority != PriorityInteractive {
+		return
+	}
+
+	scheduler := t.scheduler
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	scheduler.interactiveCount--
+	if scheduler.interactiveCount == 0 {
+		close(scheduler.resume)
+		scheduler.dispatch()
+	}
+}
+
+// acquire waits for a free slot to transfer a part
+func (t *schedulerTicket) acquire(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+
+	scheduler := t.scheduler
+	scheduler.mutex.Lock()
+	waiter := &slotWaiter{ticket: t, granted: make(chan struct{})}
+	scheduler.waiters = append(scheduler.waiters, waiter)
+	scheduler.dispatch()
+	scheduler.mutex.Unlock()
+
+	select {
+	case <-waiter.granted:
+		return nil
+	case <-ctx.Done():
+		scheduler.mutex.Lock()
+		defer scheduler.mutex.Unlock()
+		if !scheduler.removeWaiter(waiter) {
+			// granted concurrently
+			t.releaseLocked()
+		}
+		return errors.WithStack(ctx.Err())
+	}
+}
+
+func (t *schedulerTicket) release() {
+	if t == nil {
+		return
+	}
+
+	t.scheduler.mutex.Lock()
+	defer t.scheduler.mutex.Unlock()
+	t.releaseLocked()
+}
+
+func (t *schedulerTicket) releaseLocked() {
+	t.running--
+	t.scheduler.active--
+	t.scheduler.dispatch()
+}
+
+func (t *schedulerTicket) isPreempted() bool {
+	if t == nil || t.priority != PriorityBackground {
+		return false
+	}
+
+	t.scheduler.mutex.Lock()
+	defer t.scheduler.mutex.Unlock()
+	return t.scheduler.interactiveCount > 0
+}
+
+// releases slot of background download and waits while interactive download is in progress
+func (t *schedulerTicket) yield(ctx context.Context) error {
+	t.release()
+
+	t.scheduler.mutex.Lock()
+	resume := t.scheduler.resume
+	t.scheduler.mutex.Unlock()
+
+	var err error
+	select {
+	case <-resume:
+		err = t.acquire(ctx)
+	case <-ctx.Done():
+		err = errors.WithStack(ctx.Err())
+	}
+
+	if err != nil {
+		// slot is released by the caller as usual, so, take it back regardless of limit (download is canceled anyway)
+		t.scheduler.mutex.Lock()
+		t.running++
+		t.scheduler.active++
+		t.scheduler.mutex.Unlock()
+	}
+	return err
+}
+
+// must be called under lock
+func (t *Scheduler) dispatch() {
+	for t.active < t.maxActive {
+		index := t.selectWaiter()
+		if index < 0 {
+			return
+		}
+
+		waiter := t.waiters[index]
+		t.waiters = append(t.waiters[:index], t.waiters[index+1:]...)
+		t.active++
+		waiter.ticket.running++
+		close(waiter.granted)
+	}
+}
+
+// background downloads wait while interactive download is in progress, then the download with the least count of running parts, then FIFO
+func (t *Scheduler) selectWaiter() int {
+	result := -1
+	for index, waiter := range t.waiters {
+		if waiter.ticket.priority == PriorityBackground && t.interactiveCount > 0 {
+			continue
+		}
+
+		if result == -1 {
+			result = index
+			continue
+		}
+
+		best := t.waiters[result].ticket
+		if waiter.ticket.priority < best.priority || (waiter.ticket.priority == best.priority && waiter.ticket.running < best.running) {
+			result = index
+		}
+	}
+	return result
+}
+
+func (t *Scheduler) removeWaiter(waiter *slotWaiter) bool {
+	for index, item := range t.waiters {
+		if item == waiter {
+			t.waiters = append(t.waiters[:index], t.waiters[index+1:]...)
+			return true
+		}
+	}
+	return false
+}
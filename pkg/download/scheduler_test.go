@@ -0,0 +1,120 @@
+package download
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestSchedulerPreemptsBackground(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	scheduler := NewScheduler(1)
+	background := scheduler.begin(PriorityBackground)
+	g.Expect(background.acquire(context.Background())).NotTo(HaveOccurred())
+	g.Expect(background.isPreempted()).To(BeFalse())
+
+	interactive := scheduler.begin(PriorityInteractive)
+	g.Expect(background.isPreempted()).To(BeTrue())
+
+	yielded := make(chan error, 1)
+	go func() {
+		yielded <- background.yield(context.Background())
+	}()
+
+	// slot is released by background transfer
+	g.Expect(interactive.acquire(context.Background())).NotTo(HaveOccurred())
+	interactive.release()
+	g.Consistently(yielded, 50*time.Millisecond).ShouldNot(Receive())
+
+	interactive.end()
+	g.Eventually(yielded).Should(Receive(BeNil()))
+	background.release()
+	g.Expect(scheduler.active).To(Equal(0))
+}
+
+func TestSchedulerFairness(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	scheduler := NewScheduler(2)
+	first := scheduler.begin(PriorityInteractive)
+	second := scheduler.begin(PriorityInteractive)
+	g.Expect(first.acquire(context.Background())).NotTo(HaveOccurred())
+	g.Expect(first.acquire(context.Background())).NotTo(HaveOccurred())
+
+	firstWaiter := make(chan error, 1)
+	go func() {
+		firstWaiter <- first.acquire(context.Background())
+	}()
+	g.Eventually(func() int {
+		scheduler.mutex.Lock()
+		defer scheduler.mutex.Unlock()
+		return len(scheduler.waiters)
+	}).Should(Equal(1))
+
+	secondWaiter := make(chan error, 1)
+	go func() {
+		secondWaiter <- second.acquire(context.Background())
+	}()
+	g.Eventually(func() int {
+		scheduler.mutex.Lock()
+		defer scheduler.mutex.Unlock()
+		return len(scheduler.waiters)
+	}).Should(Equal(2))
+
+	// second download doesn't have running parts, so, gets the slot although queued later
+	first.release()
+	g.Eventually(secondWaiter).Should(Receive(BeNil()))
+	g.Consistently(firstWaiter, 50*time.Millisecond).ShouldNot(Receive())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	g.Expect(second.acquire(ctx)).To(HaveOccurred())
+	second.release()
+	g.Eventually(firstWaiter).Should(Receive(BeNil()))
+}
+
+func TestSchedulerInteractiveOvertakesQueuedBackground(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	scheduler := NewScheduler(1)
+	running := scheduler.begin(PriorityBackground)
+	queued := scheduler.begin(PriorityBackground)
+	g.Expect(running.acquire(context.Background())).NotTo(HaveOccurred())
+
+	queuedWaiter := make(chan error, 1)
+	go func() {
+		queuedWaiter <- queued.acquire(context.Background())
+	}()
+	g.Eventually(func() int {
+		scheduler.mutex.Lock()
+		defer scheduler.mutex.Unlock()
+		return len(scheduler.waiters)
+	}).Should(Equal(1))
+
+	interactive := scheduler.begin(PriorityInteractive)
+	interactiveWaiter := make(chan error, 1)
+	go func() {
+		interactiveWaiter <- interactive.acquire(context.Background())
+	}()
+	g.Eventually(func() int {
+		scheduler.mutex.Lock()
+		defer scheduler.mutex.Unlock()
+		return len(scheduler.waiters)
+	}).Should(Equal(2))
+
+	// interactive download is queued later, but gets the slot first
+	running.release()
+	g.Eventually(interactiveWaiter).Should(Receive(BeNil()))
+	g.Consistently(queuedWaiter, 50*time.Millisecond).ShouldNot(Receive())
+
+	interactive.release()
+	g.Consistently(queuedWaiter, 50*time.Millisecond).ShouldNot(Receive())
+
+	interactive.end()
+	g.Eventually(queuedWaiter).Should(Receive(BeNil()))
+	queued.release()
+	g.Expect(scheduler.active).To(Equal(0))
+}
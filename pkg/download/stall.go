@@ -0,0 +1,127 @@
+package download
+
+import (
+	"context"
+	"io"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/errors"
+	"go.uber.org/zap"
+)
+
+const defaultStallTimeout = 60 * time.Second
+
+// StallError is returned if no data received during stall timeout, download is resumed from the last received byte
+type StallError struct {
+	Timeout time.Duration
+}
+
+func (t *StallError) Error() string {
+	return "no data received for " + t.Timeout.String()
+}
+
+// duration (e.g. 90s, 5m) or number of seconds
+func getDurationFromEnv(envName string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(envName)
+	if value == "" {
+		return defaultValue
+	}
+
+	seconds, err := strconv.Atoi(value)
+	if err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	result, err := time.ParseDuration(value)
+	if err != nil {
+		log.Warn("cannot parse duration, default is used", zap.String("env", envName), zap.String("value", value), zap.Error(err))
+		return defaultValue
+	}
+	return result
+}
+
+// cancels attempt context if no data received during timeout (heartbeat is every read that returns data)
+type stallWatchdog struct {
+	timeout   time.Duration
+	timer     *time.Timer
+	isStalled int32
+}
+
+// returned context must be used for request, stop must be called when request is completed
+func newStallWatchdog(parent context.Context, timeout time.Duration) (context.Context, *stallWatchdog, func()) {
+	attemptContext, cancel := context.WithCancel(parent)
+	if timeout <= 0 {
+		return attemptContext, nil, cancel
+	}
+
+	watchdog := &stallWatchdog{timeout: timeout}
+	watchdog.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&watchdog.isStalled, 1)
+		cancel()
+	})
+	return attemptContext, watchdog, func() {
+		watchdog.timer.Stop()
+		cancel()
+	}
+}
+
+func (t *stallWatchdog) heartbeat() {
+	if t != nil {
+		t.timer.Reset(t.timeout)
+	}
+}
+
+// time spent waiting for scheduler is not a stall
+func (t *stallWatchdog) pause() {
+	if t != nil {
+		t.timer.Stop()
+	}
+}
+
+// converts cancellation caused by stall to StallError
+func (t *stallWatchdog) convertError(err error) error {
+	if err != nil && t != nil && atomic.LoadInt32(&t.isStalled) == 1 {
+		return errors.WithStack(&StallError{Timeout: t.timeout})
+	}
+	return err
+}
+
+type stallDetectingReader struct {
+	io.ReadCloser
+
+	watchdog *stallWatchdog
+	stop     func()
+
+	// background transfer is paused while interactive download is in progress
+	ticket  *schedulerTicket
+	context context.Context
+}
+
+func (t *stallDetectingReader) Read(p []byte) (int, error) {
+	if t.ticket.isPreempted() {
+		t.watchdog.pause()
+		err := t.ticket.yield(t.context)
+		t.watchdog.heartbeat()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 {
+		t.watchdog.heartbeat()
+	}
+	if err != nil && err != io.EOF {
+		err = t.watchdog.convertError(err)
+	}
+	return n, err
+}
+
+func (t *stallDetectingReader) Close() error {
+	t.stop()
+	return t.ReadCloser.Close()
+}
@@ -0,0 +1,146 @@
+package download
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+	"github.com/dustin/go-humanize"
+	"go.uber.org/zap"
+)
+
+// artifact downloads larger than this are written in place to the output file - parts are not concatenated (no extra copy of data),
+// checksum is computed while data is received (if downloaded as one part), and progress is reported
+const defaultStreamingThreshold = 64 * 1024 * 1024
+
+const progressReportInterval = 5 * time.Second
+
+func getStreamingThresholdFromEnv() int64 {
+	value := os.Getenv("DOWNLOADER_STREAMING_THRESHOLD")
+	if value == "" {
+		return defaultStreamingThreshold
+	}
+
+	result, err := humanize.ParseBytes(value)
+	if err != nil {
+		log.Warn("cannot parse DOWNLOADER_STREAMING_THRESHOLD, default is used", zap.String("value", value), zap.Error(err))
+		return defaultStreamingThreshold
+	}
+	return int64(result)
+}
+
+// all parts are written to the output file at its offsets, file is preallocated to not grow it on each write
+func (actualLocation *ActualLocation) prepareStreaming(expectedSha512 string) error {
+	file, err := os.OpenFile(actualLocation.OutFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = file.Truncate(actualLocation.ContentLength)
+	err = fsutil.CloseAndCheckError(err, file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, part := range actualLocation.Parts {
+		part.Name = actualLocation.OutFileName
+		part.isSharedFile = true
+	}
+
+	if len(expectedSha512) != 0 && len(actualLocation.Parts) == 1 {
+		actualLocation.Parts[0].hash = sha512.New()
+	}
+	return nil
+}
+
+func (actualLocation *ActualLocation) verifyStreamed(expectedSha512 string) error {
+	if len(expectedSha512) == 0 {
+		return nil
+	}
+
+	var actualSha512 string
+	part := actualLocation.Parts[0]
+	if part.hash != nil && !part.Skip {
+		actualSha512 = base64.StdEncoding.EncodeToString(part.hash.Sum(nil))
+	} else {
+		// parts are received in parallel - read file sequentially once
+		var err error
+		actualSha512, err = computeSha512(actualLocation.OutFileName)
+		if err != nil {
+			return err
+		}
+	}
+
+	if actualSha512 != expectedSha512 {
+		return errors.WithStack(&ChecksumMismatchError{Expected: expectedSha512, Actual: actualSha512})
+	}
+	return nil
+}
+
+type downloadProgress struct {
+	url         string
+	total       int64
+	received    int64
+	start       time.Time
+	stopChannel chan struct{}
+}
+
+func startProgressReporting(url string, total int64) *downloadProgress {
+	progress := &downloadProgress{url: url, total: total, start: time.Now(), stopChannel: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(progressReportInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-progress.stopChannel:
+				return
+			case <-ticker.C:
+				progress.report()
+			}
+		}
+	}()
+	return progress
+}
+
+func (t *downloadProgress) add(n int) {
+	if t != nil {
+		atomic.AddInt64(&t.received, int64(n))
+	}
+}
+
+func (t *downloadProgress) report() {
+	received := atomic.LoadInt64(&t.received)
+	elapsed := time.Since(t.start)
+	var speed uint64
+	if elapsed > 0 {
+		speed = uint64(float64(received) / elapsed.Seconds())
+	}
+	log.Info("downloading",
+		zap.String("url", t.url),
+		zap.String("progress", humanize.Bytes(uint64(received))+" / "+humanize.Bytes(uint64(t.total))),
+		zap.Int64("percent", received*100/t.total),
+		zap.String("speed", humanize.Bytes(speed)+"/s"),
+	)
+}
+
+func (t *downloadProgress) stop() {
+	close(t.stopChannel)
+}
+
+type progressReader struct {
+	io.ReadCloser
+
+	progress *downloadProgress
+}
+
+func (t *progressReader) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	t.progress.add(n)
+	return n, err
+}
@@ -0,0 +1,79 @@
+package download
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+	"go.uber.org/zap"
+)
+
+func unpackTarGz(archiveName string, unpackDir string) error {
+	file, err := os.Open(archiveName)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(file)
+
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		// entries outside of unpack dir are not allowed
+		name := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+		if name == "" {
+			continue
+		}
+
+		target := filepath.Join(unpackDir, filepath.FromSlash(name))
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = fsutil.EnsureDir(target)
+		case tar.TypeReg:
+			err = writeTarEntry(tarReader, target, os.FileMode(header.Mode).Perm())
+		case tar.TypeSymlink:
+			err = fsutil.EnsureDir(filepath.Dir(target))
+			if err == nil {
+				err = os.Symlink(header.Linkname, target)
+			}
+		default:
+			log.Debug("unsupported tar entry is skipped", zap.String("name", name), zap.String("archive", archiveName))
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+}
+
+func writeTarEntry(reader io.Reader, file string, mode os.FileMode) error {
+	err := fsutil.EnsureDir(filepath.Dir(file))
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = io.Copy(out, reader)
+	return fsutil.CloseAndCheckError(err, out)
+}
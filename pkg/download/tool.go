@@ -4,7 +4,9 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 
+	"github.com/develar/app-builder/pkg/deprecation"
 	"github.com/develar/app-builder/pkg/util"
 	"github.com/develar/errors"
 )
@@ -58,6 +60,17 @@ func DownloadWinCodeSign() (string, error) {
 	return downloadFromGithub("winCodeSign", "2.6.0", "6LQI2d9BPC3Xs0ZoTQe1o3tPiA28c7+PY69Q9i/pD8lY45psMtHuLwv3vRckiVr3Zx1cbNyLlBR8STwCdcHwtA==")
 }
 
+// ELECTRON_BUILDER_NSIS_DIR env to use custom NSIS (the same layout as the artifact)
+func DownloadNsis() (string, error) {
+	custom := strings.TrimSpace(os.Getenv("ELECTRON_BUILDER_NSIS_DIR"))
+	if len(custom) != 0 {
+		return custom, nil
+	}
+
+	//noinspection SpellCheckingInspection
+	return downloadFromGithub("nsis", "3.0.4.1", "VKMiizYdmNdJOWpRGz4trl4lD++BvYP2irAXpMilheUP0pc93iKlWAoP843Vlraj8YG19CVn0j+dCo/hURz9+Q==")
+}
+
 func downloadFromGithub(name string, version string, checksum string) (string, error) {
 	id := name + "-" + version
 	return DownloadArtifact(id, GetGithubBaseUrl()+id+"/"+id+".7z", checksum)
@@ -70,12 +83,22 @@ func GetGithubBaseUrl() string {
 	}
 	if len(v) == 0 {
 		v = os.Getenv("npm_package_config_electron_builder_binaries_mirror")
+		if len(v) != 0 {
+			// npm 7+ doesn't set npm_package_config_* for dependencies, so, it works only for some package managers
+			deprecation.Report(deprecation.Warning{
+				Id:          "binaries-mirror-package-config-env",
+				Kind:        deprecation.KindEnv,
+				Name:        "npm_package_config_electron_builder_binaries_mirror",
+				Message:     "config.electron_builder_binaries_mirror in package.json is deprecated, it is not supported by npm 7+",
+				Replacement: "ELECTRON_BUILDER_BINARIES_MIRROR",
+			})
+		}
 	}
 	if len(v) == 0 {
 		v = os.Getenv("ELECTRON_BUILDER_BINARIES_MIRROR")
 	}
 	if len(v) == 0 {
-		v = "https://github.com/electron-userland/electron-builder-binaries/releases/download/"
+		v = GetPublicGithubServer().ReleaseDownloadUrl("electron-userland/electron-builder-binaries", "", "")
 	}
 	return v
 }
@@ -130,7 +153,7 @@ func DownloadTool(descriptor ToolDescriptor, osName util.OsName) (string, error)
 	osAndArch := osQualifier + archQualifier
 	return DownloadArtifact(
 		descriptor.Name+"-"+descriptor.Version+"-"+osAndArch, /* ability to use cache dir on any platform (e.g. keep cache under project) */
-		"https://github.com/"+repository+"/releases/download/"+tagPrefix+descriptor.Version+"/"+descriptor.Name+"-v"+descriptor.Version+"-"+osAndArch+".7z",
+		GetPublicGithubServer().ReleaseDownloadUrl(repository, tagPrefix+descriptor.Version+"/", descriptor.Name+"-v"+descriptor.Version+"-"+osAndArch+".7z"),
 		checksum,
 	)
 }
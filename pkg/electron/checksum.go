@@ -0,0 +1,120 @@
+package electron
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/develar/app-builder/pkg/download"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"go.uber.org/zap"
+)
+
+// SHASUMS256.txt is the same for all artifacts of the version, downloaded once
+var checksumFileMutex sync.Mutex
+
+// verifyChecksum checks sha256 of the downloaded file against SHASUMS256.txt of the release
+func (t *ElectronDownloader) verifyChecksum(file string, fileName string, releaseUrl string) error {
+	expected, err := t.getExpectedChecksum(fileName, releaseUrl, false)
+	if err != nil {
+		return err
+	}
+	if len(expected) == 0 {
+		// cached SHASUMS256.txt can be outdated (e.g. artifact is added to the release later)
+		expected, err = t.getExpectedChecksum(fileName, releaseUrl, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(expected) == 0 {
+		if len(t.config.CustomFilename) != 0 || len(os.Getenv("ELECTRON_CUSTOM_FILENAME")) != 0 {
+			log.Warn("checksum of custom Electron file is not found in SHASUMS256.txt, not verified", zap.String("file", fileName))
+			return nil
+		}
+		return util.NewMessageError("checksum of "+fileName+" is not found in "+releaseUrl+"/SHASUMS256.txt", "ERR_ELECTRON_CHECKSUM_MISSING")
+	}
+
+	actual, err := computeSha256(file)
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		return util.NewMessageError("checksum mismatch for "+fileName+": expected "+expected+" (SHASUMS256.txt), got "+actual, "ERR_ELECTRON_CHECKSUM_MISMATCH")
+	}
+	return nil
+}
+
+func (t *ElectronDownloader) getExpectedChecksum(fileName string, releaseUrl string, isForceDownload bool) (string, error) {
+	checksumFileMutex.Lock()
+	defer checksumFileMutex.Unlock()
+
+	cachedFile := filepath.Join(t.cacheDir, "SHASUMS256-"+t.config.Version+".txt")
+	data, err := ioutil.ReadFile(cachedFile)
+	if err != nil || isForceDownload {
+		if err != nil && !os.IsNotExist(err) {
+			return "", errors.WithStack(err)
+		}
+
+		tempFile, err := util.TempFile(t.cacheDir, ".txt")
+		if err != nil {
+			return "", err
+		}
+		defer util.RemoveOnCancel(tempFile)()
+
+		url := releaseUrl + "/SHASUMS256.txt"
+		err = download.NewDownloader().Download(url, tempFile, "")
+		if err != nil {
+			_ = os.Remove(tempFile)
+			return "", errors.WithMessage(err, "cannot download checksums")
+		}
+
+		data, err = ioutil.ReadFile(tempFile)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		download.RenameToFinalFile(tempFile, cachedFile, log.LOG.With(zap.String("url", url), zap.String("path", cachedFile)))
+	}
+	return parseChecksums(data)[fileName], nil
+}
+
+// parseChecksums parses sha256sum output: "<hash> *<file>" (binary mode) or "<hash>  <file>"
+func parseChecksums(data []byte) map[string]string {
+	result := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		index := strings.IndexByte(line, ' ')
+		if index <= 0 {
+			continue
+		}
+
+		name := strings.TrimLeft(line[index:], " ")
+		result[strings.TrimPrefix(name, "*")] = strings.ToLower(line[:index])
+	}
+	return result
+}
+
+func computeSha256(file string) (string, error) {
+	reader, err := os.Open(file)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer util.Close(reader)
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, reader)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -3,6 +3,7 @@ package electron
 import (
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 
 	"github.com/alecthomas/kingpin"
@@ -25,23 +26,91 @@ type ElectronDownloadOptions struct {
 
 	CustomDir      string `json:"customDir"`
 	CustomFilename string `json:"customFilename"`
+
+	// electron (default), chromedriver, ffmpeg or mksnapshot
+	ArtifactName string `json:"artifactName"`
+	// symbols, dsym or pdb (debug symbols of electron)
+	ArtifactSuffix string `json:"artifactSuffix"`
+	// do not verify downloaded file against SHASUMS256.txt of the release
+	IsSkipChecksum bool `json:"skipChecksum"`
+}
+
+type DownloadedArtifact struct {
+	File string `json:"file"`
+	// unpacked to
+	Output string `json:"output,omitempty"`
 }
 
 func ConfigureCommand(app *kingpin.Application) {
-	command := app.Command("download-electron", "")
-	jsonConfig := command.Flag("configuration", "").Short('c').Required().String()
+	command := app.Command("download-electron", "Download Electron (or chromedriver, ffmpeg, mksnapshot, debug symbols) zip to the cache, downloaded file is verified against SHASUMS256.txt of the release. "+
+		"Mirror can be set using ELECTRON_MIRROR, custom dir and file name using ELECTRON_CUSTOM_DIR and ELECTRON_CUSTOM_FILENAME.")
+	jsonConfig := command.Flag("configuration", "The JSON array of download options (instead of flags).").Short('c').String()
+
+	options := ElectronDownloadOptions{}
+	command.Flag("electron-version", "The Electron version.").StringVar(&options.Version)
+	command.Flag("platform", "The platform.").Default(getElectronPlatform(runtime.GOOS)).EnumVar(&options.Platform, "darwin", "mas", "linux", "win32")
+	command.Flag("arch", "The arch.").Default(getElectronArch(runtime.GOARCH)).EnumVar(&options.Arch, "x64", "ia32", "arm64", "armv7l")
+	command.Flag("artifact", "The artifact.").Default("electron").EnumVar(&options.ArtifactName, "electron", "chromedriver", "ffmpeg", "mksnapshot")
+	command.Flag("variant", "Debug symbols of electron artifact.").EnumVar(&options.ArtifactSuffix, "symbols", "dsym", "pdb")
+	command.Flag("mirror", "The mirror (ELECTRON_MIRROR takes precedence).").StringVar(&options.Mirror)
+	command.Flag("cache-dir", "The cache dir (default: ELECTRON_CACHE or electron dir in the user cache dir).").StringVar(&options.CacheDir)
+	command.Flag("skip-checksum", "Do not verify checksum.").BoolVar(&options.IsSkipChecksum)
+	outputDir := command.Flag("output", "Unpack to the dir (emptied before unpacking).").String()
 
 	command.Action(func(context *kingpin.ParseContext) error {
-		configs, err := parseConfig(jsonConfig)
-		if err != nil {
+		if len(*jsonConfig) != 0 {
+			configs, err := parseConfig(jsonConfig)
+			if err != nil {
+				return err
+			}
+
+			_, err = downloadElectron(configs)
 			return err
 		}
 
-		_, err = downloadElectron(configs)
-		return err
+		if len(options.Version) == 0 {
+			return util.NewMessageError("either --electron-version or --configuration must be specified", "ERR_ELECTRON_VERSION_MISSING")
+		}
+		options.Version = strings.TrimPrefix(options.Version, "v")
+
+		result := &DownloadedArtifact{Output: *outputDir}
+		if len(*outputDir) == 0 {
+			files, err := downloadElectron([]ElectronDownloadOptions{options})
+			if err != nil {
+				return err
+			}
+			result.File = files[0]
+		} else {
+			file, err := UnpackElectronArtifact(options, *outputDir)
+			if err != nil {
+				return err
+			}
+			result.File = file
+		}
+		return util.WriteJsonToStdOut(result)
 	})
 }
 
+func getElectronPlatform(goOs string) string {
+	if goOs == "windows" {
+		return "win32"
+	}
+	return goOs
+}
+
+func getElectronArch(goArch string) string {
+	switch goArch {
+	case "amd64":
+		return "x64"
+	case "386":
+		return "ia32"
+	case "arm":
+		return "armv7l"
+	default:
+		return goArch
+	}
+}
+
 func parseConfig(jsonConfig *string) ([]ElectronDownloadOptions, error) {
 	var configs []ElectronDownloadOptions
 	err := jsoniter.UnmarshalFromString(*jsonConfig, &configs)
@@ -95,9 +164,9 @@ func getBaseUrl(config *ElectronDownloadOptions) string {
 	}
 	if len(v) == 0 {
 		if strings.Contains(config.Version, "-nightly.") {
-			return "https://github.com/electron/nightlies/releases/download/v"
+			return download.GetPublicGithubServer().ReleaseDownloadUrl("electron/nightlies", "v", "")
 		} else {
-			return "https://github.com/electron/electron/releases/download/v"
+			return download.GetPublicGithubServer().ReleaseDownloadUrl("electron/electron", "v", "")
 		}
 	}
 	return v
@@ -126,7 +195,15 @@ func getUrlSuffix(config *ElectronDownloadOptions) string {
 }
 
 func getFilename(config *ElectronDownloadOptions) string {
-	return "electron-v" + config.Version + "-" + config.Platform + "-" + config.Arch + ".zip"
+	name := config.ArtifactName
+	if len(name) == 0 {
+		name = "electron"
+	}
+	suffix := ""
+	if len(config.ArtifactSuffix) != 0 {
+		suffix = "-" + config.ArtifactSuffix
+	}
+	return name + "-v" + config.Version + "-" + config.Platform + "-" + config.Arch + suffix + ".zip"
 }
 
 type ElectronDownloader struct {
@@ -161,10 +238,13 @@ func (t *ElectronDownloader) Download() (string, error) {
 		return "", errors.WithStack(err)
 	}
 
+	releaseUrl := getBaseUrl(t.config) + getMiddleUrl(t.config)
+	fileName := getUrlSuffix(t.config)
 	if fileInfo != nil {
 		if fileInfo.IsDir() {
 			return "", errors.New("File expected, but got dir")
 		}
+		download.RecordProvenance(&download.Provenance{Name: filepath.Base(cachedFile), Url: releaseUrl + "/" + fileName, File: cachedFile})
 		return cachedFile, nil
 	}
 
@@ -173,27 +253,37 @@ func (t *ElectronDownloader) Download() (string, error) {
 		return "", errors.WithStack(err)
 	}
 
-	url := getBaseUrl(t.config) + getMiddleUrl(t.config) + "/" + getUrlSuffix(t.config)
-	err = t.doDownload(url, cachedFile)
+	err = t.doDownload(releaseUrl, fileName, cachedFile)
 	if err != nil {
-		return "", errors.WithStack(err)
+		return "", err
 	}
 
+	download.RecordProvenance(&download.Provenance{Name: filepath.Base(cachedFile), Url: releaseUrl + "/" + fileName, File: cachedFile})
 	return cachedFile, nil
 }
 
-func (t *ElectronDownloader) doDownload(url string, cachedFile string) error {
+func (t *ElectronDownloader) doDownload(releaseUrl string, fileName string, cachedFile string) error {
 	tempFile, err := util.TempFile(t.cacheDir, ".zip")
 	if err != nil {
 		return errors.WithStack(err)
 	}
+	defer util.RemoveOnCancel(tempFile)()
 
+	url := releaseUrl + "/" + fileName
 	downloader := download.NewDownloader()
 	err = downloader.Download(url, tempFile, "")
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
+	if !t.config.IsSkipChecksum {
+		err = t.verifyChecksum(tempFile, fileName, releaseUrl)
+		if err != nil {
+			_ = os.Remove(tempFile)
+			return err
+		}
+	}
+
 	download.RenameToFinalFile(tempFile, cachedFile, log.LOG.With(zap.String("url", url), zap.String("path", cachedFile)))
 	return nil
 }
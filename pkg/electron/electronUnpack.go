@@ -31,6 +31,16 @@ func ConfigureUnpackCommand(app *kingpin.Application) {
 }
 
 func UnpackElectron(configs []ElectronDownloadOptions, outputDir string, distMacOsAppName string, isReDownloadOnFileReadError bool) error {
+	_, err := unpackElectron(configs, outputDir, distMacOsAppName, isReDownloadOnFileReadError)
+	return err
+}
+
+// UnpackElectronArtifact downloads (if not cached) and unpacks the artifact, returns the cached zip file
+func UnpackElectronArtifact(options ElectronDownloadOptions, outputDir string) (string, error) {
+	return unpackElectron([]ElectronDownloadOptions{options}, outputDir, "", true)
+}
+
+func unpackElectron(configs []ElectronDownloadOptions, outputDir string, distMacOsAppName string, isReDownloadOnFileReadError bool) (string, error) {
 	cachedElectronZip := make(chan string, 1)
 	err := util.MapAsync(2, func(taskIndex int) (func() error, error) {
 		if taskIndex == 0 {
@@ -51,7 +61,7 @@ func UnpackElectron(configs []ElectronDownloadOptions, outputDir string, distMac
 	})
 
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	if len(distMacOsAppName) == 0 {
@@ -78,11 +88,11 @@ func UnpackElectron(configs []ElectronDownloadOptions, outputDir string, distMac
 				log.Warn("cannot delete", zap.Error(err), zap.String("file", zipFile))
 			}
 
-			return UnpackElectron(configs, outputDir, distMacOsAppName, false)
+			return unpackElectron(configs, outputDir, distMacOsAppName, false)
 		} else {
-			return err
+			return "", err
 		}
 	}
 
-	return nil
+	return zipFile, nil
 }
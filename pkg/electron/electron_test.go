@@ -0,0 +1,100 @@
+package electron
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+)
+
+func createZip(g *GomegaWithT, files map[string]string) []byte {
+	var buffer bytes.Buffer
+	writer := zip.NewWriter(&buffer)
+	for name, data := range files {
+		entryWriter, err := writer.Create(name)
+		g.Expect(err).NotTo(HaveOccurred())
+		_, err = entryWriter.Write([]byte(data))
+		g.Expect(err).NotTo(HaveOccurred())
+	}
+	g.Expect(writer.Close()).To(Succeed())
+	return buffer.Bytes()
+}
+
+func TestDownloadElectron(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	cacheDir, err := ioutil.TempDir("", "electron-cache")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(cacheDir)
+
+	electronZip := createZip(g, map[string]string{"electron": "binary", "version": "v9.0.0", "resources/default_app.asar": "asar"})
+	ffmpegZip := createZip(g, map[string]string{"libffmpeg.so": "ffmpeg"})
+	checksum := sha256.Sum256(electronZip)
+	files := map[string][]byte{
+		"/v9.0.0/electron-v9.0.0-linux-x64.zip": electronZip,
+		"/v9.0.0/ffmpeg-v9.0.0-linux-x64.zip":   ffmpegZip,
+		// wrong checksum of ffmpeg
+		"/v9.0.0/SHASUMS256.txt": []byte(hex.EncodeToString(checksum[:]) + " *electron-v9.0.0-linux-x64.zip\n" +
+			hex.EncodeToString(make([]byte, 32)) + " *ffmpeg-v9.0.0-linux-x64.zip\n"),
+	}
+	requests := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		requests[request.URL.Path]++
+		data, ok := files[request.URL.Path]
+		if !ok {
+			writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = writer.Write(data)
+	}))
+	defer server.Close()
+
+	options := ElectronDownloadOptions{Version: "9.0.0", Platform: "linux", Arch: "x64", CacheDir: cacheDir, Mirror: server.URL + "/v"}
+	result, err := downloadElectron([]ElectronDownloadOptions{options})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result).To(Equal([]string{filepath.Join(cacheDir, "electron-v9.0.0-linux-x64.zip")}))
+
+	electronRequestCount := requests["/v9.0.0/electron-v9.0.0-linux-x64.zip"]
+
+	outputDir := filepath.Join(cacheDir, "out")
+	file, err := UnpackElectronArtifact(options, outputDir)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(file).To(Equal(result[0]))
+	g.Expect(filepath.Join(outputDir, "electron")).To(BeAnExistingFile())
+	g.Expect(filepath.Join(outputDir, "version")).NotTo(BeAnExistingFile())
+	g.Expect(filepath.Join(outputDir, "resources", "default_app.asar")).NotTo(BeAnExistingFile())
+	// cached
+	g.Expect(requests["/v9.0.0/electron-v9.0.0-linux-x64.zip"]).To(Equal(electronRequestCount))
+
+	options.ArtifactName = "ffmpeg"
+	_, err = downloadElectron([]ElectronDownloadOptions{options})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.(interface{ ErrorCode() string }).ErrorCode()).To(Equal("ERR_ELECTRON_CHECKSUM_MISMATCH"))
+	g.Expect(filepath.Join(cacheDir, "ffmpeg-v9.0.0-linux-x64.zip")).NotTo(BeAnExistingFile())
+
+	options.IsSkipChecksum = true
+	_, err = downloadElectron([]ElectronDownloadOptions{options})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	options.ArtifactName = ""
+	options.ArtifactSuffix = "symbols"
+	options.IsSkipChecksum = false
+	_, err = downloadElectron([]ElectronDownloadOptions{options})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("electron-v9.0.0-linux-x64-symbols.zip"))
+}
+
+func TestParseChecksums(t *testing.T) {
+	g := NewGomegaWithT(t)
+	g.Expect(parseChecksums([]byte("ABC *a.zip\r\ndef  b.zip\n\ninvalid\n"))).To(Equal(map[string]string{"a.zip": "abc", "b.zip": "def"}))
+}
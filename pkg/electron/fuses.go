@@ -0,0 +1,306 @@
+package electron
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"go.uber.org/zap"
+)
+
+// fuse wire: sentinel, version, number of fuses, fuse states (one byte per fuse)
+const fuseSentinel = "dL7pKGdnNz796PbbjQWNKmHXBZaB9tsX"
+
+const fuseWireVersion = 1
+
+const (
+	FuseStateDisabled = "disabled"
+	FuseStateEnabled  = "enabled"
+	FuseStateRemoved  = "removed"
+	FuseStateInherit  = "inherit"
+)
+
+var fuseStateBytes = map[byte]string{
+	'0':  FuseStateDisabled,
+	'1':  FuseStateEnabled,
+	'r':  FuseStateRemoved,
+	0x90: FuseStateInherit,
+}
+
+// index in the wire is the fuse id, the same order as FuseV1Options of @electron/fuses
+var fuseNames = []string{
+	"runAsNode",
+	"enableCookieEncryption",
+	"enableNodeOptionsEnvironmentVariable",
+	"enableNodeCliInspectArguments",
+	"enableEmbeddedAsarIntegrityValidation",
+	"onlyLoadAppFromAsar",
+	"loadBrowserProcessSpecificV8Snapshot",
+	"grantFileProtocolExtraPrivileges",
+}
+
+type FuseOptions struct {
+	// Electron binary or .app bundle (fuses are in the Electron Framework binary)
+	Binary string
+	// fuse name to enable or disable
+	Fuses    map[string]bool
+	IsDryRun bool
+	// flipped fuses invalidate signature of Mach-O binary, unsigned binary is not launched on Apple Silicon
+	IsAdHocSign bool
+}
+
+type FuseInfo struct {
+	Name  string `json:"name"`
+	Index int    `json:"index"`
+	State string `json:"state"`
+	// state after flipping, set only if it is changed
+	NewState string `json:"newState,omitempty"`
+}
+
+type FuseReport struct {
+	Binary string `json:"binary"`
+	// number of fuse wires (universal binary contains wire per architecture)
+	Wires    int         `json:"wires"`
+	Fuses    []*FuseInfo `json:"fuses"`
+	IsDryRun bool        `json:"dryRun,omitempty"`
+	IsSigned bool        `json:"adHocSigned,omitempty"`
+}
+
+func ConfigureFusesCommand(app *kingpin.Application) {
+	command := app.Command("fuses", "List and flip Electron fuses in the packaged binary (the same wire format as @electron/fuses). Report is written to stdout as JSON.")
+
+	options := FuseOptions{}
+	command.Flag("binary", "The Electron executable or .app bundle.").Required().ExistingFileOrDirVar(&options.Binary)
+	fuses := command.Flag("fuse", "The fuse to set, name=on|off (names: "+strings.Join(fuseNames, ", ")+"). Can be specified multiple times.").StringMap()
+	command.Flag("dry-run", "Only list current fuse states and the states after flipping, binary is not modified.").BoolVar(&options.IsDryRun)
+	command.Flag("ad-hoc-sign", "Ad-hoc sign the macOS binary after flipping (signature is invalidated by the change).").BoolVar(&options.IsAdHocSign)
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		options.Fuses = make(map[string]bool, len(*fuses))
+		for name, value := range *fuses {
+			switch strings.ToLower(value) {
+			case "on", "true", "enable":
+				options.Fuses[name] = true
+			case "off", "false", "disable":
+				options.Fuses[name] = false
+			default:
+				return util.NewMessageError("invalid value of fuse "+name+": "+value+" (expected on or off)", "ERR_FUSE_INVALID_VALUE")
+			}
+		}
+
+		report, err := FlipFuses(options)
+		if err != nil {
+			return err
+		}
+		return util.WriteJsonToStdOut(report)
+	})
+}
+
+// FlipFuses reads fuse states and sets requested ones in every wire of the binary (only changed bytes are written).
+func FlipFuses(options FuseOptions) (*FuseReport, error) {
+	binary, err := resolveFuseBinary(options.Binary)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(binary)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	wires, err := findFuseWires(data, binary)
+	if err != nil {
+		return nil, err
+	}
+
+	// fuses are the same in all wires of universal binary, states are reported for the first one
+	wire := data[wires[0].offset : wires[0].offset+wires[0].length]
+	report := &FuseReport{Binary: binary, Wires: len(wires), IsDryRun: options.IsDryRun}
+	for index, state := range wire {
+		report.Fuses = append(report.Fuses, &FuseInfo{Name: getFuseName(index), Index: index, State: getFuseState(state)})
+	}
+
+	names := make([]string, 0, len(options.Fuses))
+	for name := range options.Fuses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var changes []int
+	for _, name := range names {
+		index := indexOfFuse(name)
+		if index < 0 {
+			return nil, util.NewMessageError("unknown fuse "+name+" (supported: "+strings.Join(fuseNames, ", ")+")", "ERR_FUSE_UNSUPPORTED")
+		}
+		if index >= len(wire) {
+			return nil, util.NewMessageError("fuse "+name+" is not supported by this Electron version ("+strconv.Itoa(len(wire))+" fuses)", "ERR_FUSE_UNSUPPORTED")
+		}
+
+		info := report.Fuses[index]
+		if info.State == FuseStateRemoved {
+			return nil, util.NewMessageError("fuse "+name+" is removed in this Electron version and cannot be set", "ERR_FUSE_UNSUPPORTED")
+		}
+
+		newState := FuseStateDisabled
+		if options.Fuses[name] {
+			newState = FuseStateEnabled
+		}
+		if newState != info.State {
+			info.NewState = newState
+			changes = append(changes, index)
+		}
+	}
+
+	if options.IsDryRun || len(changes) == 0 {
+		return report, nil
+	}
+
+	err = writeFuses(binary, wires, report.Fuses, changes)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.IsAdHocSign && isMachO(data) {
+		_, err = util.Execute(exec.Command("codesign", "--sign", "-", "--force", "--preserve-metadata=entitlements,requirements,flags,runtime", binary))
+		if err != nil {
+			return nil, err
+		}
+		report.IsSigned = true
+	}
+	return report, nil
+}
+
+type fuseWire struct {
+	offset int
+	length int
+}
+
+// findFuseWires returns location of fuse states for every sentinel
+func findFuseWires(data []byte, binary string) ([]fuseWire, error) {
+	sentinel := []byte(fuseSentinel)
+	var result []fuseWire
+	for offset := 0; ; {
+		index := bytes.Index(data[offset:], sentinel)
+		if index < 0 {
+			break
+		}
+
+		start := offset + index + len(sentinel)
+		if start+2 > len(data) {
+			break
+		}
+		if data[start] != fuseWireVersion {
+			return nil, util.NewMessageError("unsupported fuse wire version "+strconv.Itoa(int(data[start]))+" in "+binary, "ERR_FUSE_UNSUPPORTED_VERSION")
+		}
+		wire := fuseWire{offset: start + 2, length: int(data[start+1])}
+		if wire.offset+wire.length > len(data) {
+			return nil, util.NewMessageError("fuse wire is truncated in "+binary, "ERR_FUSE_INVALID_WIRE")
+		}
+		result = append(result, wire)
+		offset = wire.offset + wire.length
+	}
+
+	if len(result) == 0 {
+		return nil, util.NewMessageError("fuse wire is not found in "+binary+" (Electron < 12 or not an Electron binary)", "ERR_FUSE_SENTINEL_NOT_FOUND")
+	}
+	return result, nil
+}
+
+func writeFuses(binary string, wires []fuseWire, fuses []*FuseInfo, changes []int) error {
+	file, err := os.OpenFile(binary, os.O_WRONLY, 0)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, wire := range wires {
+		for _, index := range changes {
+			if index >= wire.length {
+				continue
+			}
+			state := byte('0')
+			if fuses[index].NewState == FuseStateEnabled {
+				state = '1'
+			}
+			_, err = file.WriteAt([]byte{state}, int64(wire.offset+index))
+			if err != nil {
+				_ = file.Close()
+				return errors.WithStack(err)
+			}
+		}
+	}
+
+	err = file.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, index := range changes {
+		log.Info("fuse flipped", zap.String("name", fuses[index].Name), zap.String("state", fuses[index].NewState))
+	}
+	return nil
+}
+
+// resolveFuseBinary returns Electron Framework binary of .app bundle (fuses are not in the main executable on macOS)
+func resolveFuseBinary(file string) (string, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if !info.IsDir() {
+		return file, nil
+	}
+
+	framework := filepath.Join(file, "Contents", "Frameworks", "Electron Framework.framework", "Electron Framework")
+	result, err := filepath.EvalSymlinks(framework)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", util.NewMessageError("Electron Framework is not found in "+file, "ERR_FUSE_SENTINEL_NOT_FOUND")
+		}
+		return "", errors.WithStack(err)
+	}
+	return result, nil
+}
+
+func getFuseName(index int) string {
+	if index < len(fuseNames) {
+		return fuseNames[index]
+	}
+	return "fuse" + strconv.Itoa(index)
+}
+
+func getFuseState(state byte) string {
+	result, ok := fuseStateBytes[state]
+	if !ok {
+		return "unknown (" + strconv.Itoa(int(state)) + ")"
+	}
+	return result
+}
+
+func indexOfFuse(name string) int {
+	for index, fuseName := range fuseNames {
+		if strings.EqualFold(fuseName, name) {
+			return index
+		}
+	}
+	return -1
+}
+
+func isMachO(data []byte) bool {
+	if len(data) < 4 {
+		return false
+	}
+	switch string(data[:4]) {
+	case "\xcf\xfa\xed\xfe", "\xce\xfa\xed\xfe", "\xca\xfe\xba\xbe":
+		return true
+	}
+	return false
+}
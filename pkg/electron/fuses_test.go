@@ -0,0 +1,58 @@
+package electron
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	. "github.com/onsi/gomega"
+)
+
+func TestFlipFuses(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "fuses")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	// universal binary contains wire per architecture
+	wire := fuseSentinel + "\x01\x081101100r"
+	binary := filepath.Join(dir, "Electron Framework")
+	g.Expect(ioutil.WriteFile(binary, []byte("head"+wire+"middle"+wire+"tail"), 0755)).To(Succeed())
+
+	report, err := FlipFuses(FuseOptions{Binary: binary, Fuses: map[string]bool{"runAsNode": false, "onlyLoadAppFromAsar": true}, IsDryRun: true})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(report.Wires).To(Equal(2))
+	g.Expect(report.Fuses).To(HaveLen(8))
+	g.Expect(report.Fuses[0]).To(Equal(&FuseInfo{Name: "runAsNode", Index: 0, State: FuseStateEnabled, NewState: FuseStateDisabled}))
+	g.Expect(report.Fuses[2].State).To(Equal(FuseStateDisabled))
+	g.Expect(report.Fuses[5].NewState).To(Equal(FuseStateEnabled))
+	g.Expect(report.Fuses[7].State).To(Equal(FuseStateRemoved))
+	data, err := ioutil.ReadFile(binary)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(strings.Count(string(data), wire)).To(Equal(2))
+
+	_, err = FlipFuses(FuseOptions{Binary: binary, Fuses: map[string]bool{"runAsNode": false, "enableCookieEncryption": true, "onlyLoadAppFromAsar": true}})
+	g.Expect(err).NotTo(HaveOccurred())
+	data, err = ioutil.ReadFile(binary)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(strings.Count(string(data), fuseSentinel+"\x01\x080101110r")).To(Equal(2))
+
+	_, err = FlipFuses(FuseOptions{Binary: binary, Fuses: map[string]bool{"grantFileProtocolExtraPrivileges": false}})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("is removed"))
+
+	_, err = FlipFuses(FuseOptions{Binary: binary, Fuses: map[string]bool{"foo": false}})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.(util.MessageError).ErrorCode()).To(Equal("ERR_FUSE_UNSUPPORTED"))
+
+	g.Expect(ioutil.WriteFile(binary, []byte("not electron"), 0755)).To(Succeed())
+	_, err = FlipFuses(FuseOptions{Binary: binary})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.(util.MessageError).ErrorCode()).To(Equal("ERR_FUSE_SENTINEL_NOT_FOUND"))
+}
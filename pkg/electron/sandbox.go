@@ -0,0 +1,239 @@
+package electron
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	chromeSandboxFileName = "chrome-sandbox"
+
+	SandboxActionSetuid      = "setuid"
+	SandboxActionStripSetuid = "strip-setuid"
+	SandboxActionRemove      = "remove"
+	SandboxActionNone        = "none"
+)
+
+// launcher is used only if --no-sandbox-fallback is specified: Chromium aborts if neither setuid helper nor unprivileged user namespaces are available,
+// so, as a last resort, app is started without sandbox (and user is warned about it)
+const sandboxLauncherTemplate = `#!/bin/bash
+# generated by app-builder: starts app without Chromium sandbox only if the sandbox cannot work on this system
+set -e
+
+APP_DIR="$(dirname "$(readlink -f "$0")")"
+BIN="$APP_DIR/{{BIN}}"
+SANDBOX="$APP_DIR/chrome-sandbox"
+
+is_sandbox_available() {
+  # snap confinement and flatpak provide own sandbox support
+  if [ -n "$SNAP" ] || [ -n "$FLATPAK_ID" ] ; then
+    return 0
+  fi
+  # setuid helper owned by root (squashfs of AppImage is mounted with nosuid, setuid doesn't work there)
+  if [ -z "$APPIMAGE" ] && [ -u "$SANDBOX" ] && [ "$(stat -c %u "$SANDBOX" 2>/dev/null)" = "0" ] ; then
+    return 0
+  fi
+  if [ "$(cat /proc/sys/kernel/unprivileged_userns_clone 2>/dev/null)" = "0" ] ; then
+    return 1
+  fi
+  if [ "$(cat /proc/sys/user/max_user_namespaces 2>/dev/null)" = "0" ] ; then
+    return 1
+  fi
+  # Ubuntu 23.10+ restricts unprivileged user namespaces using AppArmor
+  if [ "$(cat /proc/sys/kernel/apparmor_restrict_unprivileged_userns 2>/dev/null)" = "1" ] ; then
+    return 1
+  fi
+  return 0
+}
+
+for arg in "$@" ; do
+  if [ "$arg" = "--no-sandbox" ] ; then
+    exec "$BIN" "$@"
+  fi
+done
+
+if is_sandbox_available ; then
+  exec "$BIN" "$@"
+fi
+
+echo "WARNING: Chromium sandbox is not available (chrome-sandbox is not owned by root with mode 4755 and unprivileged user namespaces are disabled), starting {{NAME}} with --no-sandbox" >&2
+exec "$BIN" --no-sandbox "$@"
+`
+
+type SandboxOptions struct {
+	AppDir string
+	// appimage, snap, flatpak, deb, rpm, pacman, apk or dir (tar.* archives and unpacked dir)
+	Target         string
+	ExecutableName string
+	// install dir of the app (e.g. /opt/App), used to generate after-install script for package managers
+	InstallDir string
+
+	IsNoSandboxFallback bool
+}
+
+type SandboxReport struct {
+	Target string `json:"target"`
+	// relative to the app dir, empty if app doesn't contain chrome-sandbox (Electron < 5)
+	SandboxFile string `json:"sandboxFile,omitempty"`
+	Action      string `json:"action"`
+	// the required mode and owner of installed file
+	Mode  string `json:"mode,omitempty"`
+	Owner string `json:"owner,omitempty"`
+	// must be added to the after-install script of the package if mode and owner cannot be set in the package itself
+	AfterInstallScript string `json:"afterInstallScript,omitempty"`
+
+	// executable is renamed to <name>-bin and replaced with the launcher script
+	IsLauncherPatched bool     `json:"launcherPatched,omitempty"`
+	Notes             []string `json:"notes,omitempty"`
+}
+
+func ConfigureSandboxCommand(app *kingpin.Application) {
+	command := app.Command("chrome-sandbox", "Fix Chromium sandbox helper (chrome-sandbox) of unpacked Electron app for Linux target: "+
+		"set root:root 4755 for packages (deb, rpm, pacman, apk), strip setuid for AppImage, remove for snap and flatpak. Report is written to stdout as JSON.")
+
+	options := SandboxOptions{}
+	command.Flag("app", "The unpacked app dir.").Short('a').Required().ExistingDirVar(&options.AppDir)
+	command.Flag("target", "The target.").Required().EnumVar(&options.Target, "appimage", "snap", "flatpak", "deb", "rpm", "pacman", "apk", "dir")
+	command.Flag("executable-name", "The executable name (required for --no-sandbox-fallback).").StringVar(&options.ExecutableName)
+	command.Flag("install-dir", "The install dir of the app (e.g. /opt/App) to generate after-install script.").StringVar(&options.InstallDir)
+	command.Flag("no-sandbox-fallback", "Replace executable with a launcher that passes --no-sandbox (with a warning) if sandbox is not available at runtime. Last resort, sandbox is a security feature.").
+		BoolVar(&options.IsNoSandboxFallback)
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		report, err := FixChromeSandbox(options)
+		if err != nil {
+			return err
+		}
+		return util.WriteJsonToStdOut(report)
+	})
+}
+
+func FixChromeSandbox(options SandboxOptions) (*SandboxReport, error) {
+	report := &SandboxReport{Target: options.Target, Action: SandboxActionNone}
+
+	sandboxFile := filepath.Join(options.AppDir, chromeSandboxFileName)
+	info, err := os.Lstat(sandboxFile)
+	switch {
+	case err == nil:
+		report.SandboxFile = chromeSandboxFileName
+		err = fixSandboxFile(sandboxFile, info, options, report)
+		if err != nil {
+			return nil, err
+		}
+	case os.IsNotExist(err):
+		report.Notes = append(report.Notes, "chrome-sandbox is not found, Electron < 5 or custom build without setuid sandbox")
+	default:
+		return nil, errors.WithStack(err)
+	}
+
+	if options.IsNoSandboxFallback {
+		if options.Target == "snap" {
+			// snap wrapper (command.sh) already passes --no-sandbox if browser-support plug doesn't allow sandbox
+			report.Notes = append(report.Notes, "launcher is not patched for snap, --no-sandbox is added by snap command wrapper if required")
+			return report, nil
+		}
+
+		err = patchLauncher(options)
+		if err != nil {
+			return nil, err
+		}
+		report.IsLauncherPatched = true
+		log.Warn("executable is replaced with a launcher that disables Chromium sandbox if it is not available at runtime", zap.String("executable", options.ExecutableName))
+	}
+	return report, nil
+}
+
+func fixSandboxFile(sandboxFile string, info os.FileInfo, options SandboxOptions, report *SandboxReport) error {
+	switch options.Target {
+	case "snap", "flatpak":
+		// setuid is not allowed: snap uses browser-support plug, flatpak - own sandbox (zypak)
+		report.Action = SandboxActionRemove
+		report.Notes = append(report.Notes, options.Target+" doesn't allow setuid binaries, chrome-sandbox is removed")
+		return errors.WithStack(os.Remove(sandboxFile))
+
+	case "appimage":
+		// squashfs is mounted using FUSE with nosuid - setuid helper cannot work and Chromium aborts instead of using user namespaces if helper is not configured correctly
+		report.Action = SandboxActionStripSetuid
+		report.Mode = "0755"
+		report.Notes = append(report.Notes, "AppImage is mounted with nosuid, sandbox requires unprivileged user namespaces")
+		return errors.WithStack(os.Chmod(sandboxFile, info.Mode().Perm()|0755))
+	}
+
+	report.Action = SandboxActionSetuid
+	report.Mode = "4755"
+	report.Owner = "root:root"
+	err := os.Chmod(sandboxFile, 0755|os.ModeSetuid)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	isAfterInstallRequired := false
+	switch {
+	case runtime.GOOS == "windows":
+		// file mode cannot be stored on Windows
+		isAfterInstallRequired = true
+		report.Notes = append(report.Notes, "setuid cannot be set on Windows, mode must be set by after-install script")
+	case options.Target == "dir":
+		// archive is unpacked by user, file will be owned by user
+		isAfterInstallRequired = true
+		report.Notes = append(report.Notes, "archive is unpacked by user, sandbox requires chown root:root and chmod 4755 of chrome-sandbox after unpacking")
+	case os.Geteuid() == 0:
+		err = os.Lchown(sandboxFile, 0, 0)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	default:
+		// package formats store files as owned by root regardless of the owner on disk
+		report.Notes = append(report.Notes, "files are owned by root in the package, mode 4755 is preserved")
+	}
+
+	if isAfterInstallRequired && len(options.InstallDir) != 0 {
+		installedFile := strings.TrimSuffix(filepath.ToSlash(options.InstallDir), "/") + "/" + chromeSandboxFileName
+		report.AfterInstallScript = fmt.Sprintf("chown root:root '%s' && chmod 4755 '%s'\n", installedFile, installedFile)
+	}
+	return nil
+}
+
+func patchLauncher(options SandboxOptions) error {
+	if len(options.ExecutableName) == 0 {
+		return util.NewMessageError("--executable-name is required to patch launcher", "ERR_SANDBOX_EXECUTABLE_NAME_MISSING")
+	}
+
+	executable := filepath.Join(options.AppDir, options.ExecutableName)
+	binaryName := options.ExecutableName + "-bin"
+	binary := filepath.Join(options.AppDir, binaryName)
+
+	data, err := ioutil.ReadFile(executable)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if strings.HasPrefix(string(data), "#!") {
+		if strings.Contains(string(data), "generated by app-builder") {
+			// already patched
+			return nil
+		}
+		return util.NewMessageError(executable+" is a script, not Electron executable", "ERR_SANDBOX_LAUNCHER_NOT_BINARY")
+	}
+
+	err = os.Rename(executable, binary)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	launcher := strings.NewReplacer("{{BIN}}", binaryName, "{{NAME}}", options.ExecutableName).Replace(sandboxLauncherTemplate)
+	err = ioutil.WriteFile(executable, []byte(launcher), 0755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Chmod(executable, 0755))
+}
@@ -0,0 +1,61 @@
+package electron
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+)
+
+func createSandboxApp(g *GomegaWithT) string {
+	appDir, err := ioutil.TempDir("", "sandbox")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(ioutil.WriteFile(filepath.Join(appDir, "chrome-sandbox"), []byte("\x7fELF"), 0755)).To(Succeed())
+	g.Expect(ioutil.WriteFile(filepath.Join(appDir, "app"), []byte("\x7fELF"), 0755)).To(Succeed())
+	return appDir
+}
+
+func TestFixChromeSandbox(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	appDir := createSandboxApp(g)
+	defer os.RemoveAll(appDir)
+
+	report, err := FixChromeSandbox(SandboxOptions{AppDir: appDir, Target: "dir", InstallDir: "/opt/App/"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(report.Action).To(Equal(SandboxActionSetuid))
+	g.Expect(report.AfterInstallScript).To(Equal("chown root:root '/opt/App/chrome-sandbox' && chmod 4755 '/opt/App/chrome-sandbox'\n"))
+	info, err := os.Stat(filepath.Join(appDir, "chrome-sandbox"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(info.Mode() & os.ModeSetuid).NotTo(BeZero())
+
+	report, err = FixChromeSandbox(SandboxOptions{AppDir: appDir, Target: "appimage", ExecutableName: "app", IsNoSandboxFallback: true})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(report.Action).To(Equal(SandboxActionStripSetuid))
+	g.Expect(report.IsLauncherPatched).To(BeTrue())
+	info, err = os.Stat(filepath.Join(appDir, "chrome-sandbox"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(info.Mode() & os.ModeSetuid).To(BeZero())
+	g.Expect(filepath.Join(appDir, "app-bin")).To(BeAnExistingFile())
+	launcher, err := ioutil.ReadFile(filepath.Join(appDir, "app"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(launcher)).To(ContainSubstring(`BIN="$APP_DIR/app-bin"`))
+
+	// patched launcher is not patched again
+	_, err = FixChromeSandbox(SandboxOptions{AppDir: appDir, Target: "appimage", ExecutableName: "app", IsNoSandboxFallback: true})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	report, err = FixChromeSandbox(SandboxOptions{AppDir: appDir, Target: "snap"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(report.Action).To(Equal(SandboxActionRemove))
+	g.Expect(filepath.Join(appDir, "chrome-sandbox")).NotTo(BeAnExistingFile())
+
+	report, err = FixChromeSandbox(SandboxOptions{AppDir: appDir, Target: "deb"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(report.Action).To(Equal(SandboxActionNone))
+	g.Expect(report.SandboxFile).To(BeEmpty())
+}
@@ -0,0 +1,106 @@
+package fakes
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/errors"
+	"github.com/json-iterator/go"
+	"go.uber.org/zap"
+)
+
+// if set, publishers and store submissions do not use network, but record requests to the file (JSON array) - end-to-end pipeline tests in CI without credentials.
+// Env is used instead of only flag to apply the mode to child app-builder processes (e.g. started by run-pipeline).
+const EnvName = "APP_BUILDER_FAKE_SERVICES"
+
+const (
+	ServiceS3         = "s3"
+	ServiceGitHub     = "github"
+	ServiceSnapStore  = "snapStore"
+	ServiceCdn        = "cdn"
+	ServiceReputation = "reputation"
+	ServiceNotary     = "notary"
+	ServiceRekor      = "rekor"
+)
+
+type Request struct {
+	Service   string                 `json:"service"`
+	Operation string                 `json:"operation"`
+	Params    map[string]interface{} `json:"params,omitempty"`
+}
+
+var mutex sync.Mutex
+
+func ConfigureFlag(app *kingpin.Application) {
+	var file string
+	app.Flag("fake-services", "Test mode: publishers and store submissions hit built-in fakes, requests are recorded to the specified JSON file.").
+		PlaceHolder("FILE").
+		PreAction(func(context *kingpin.ParseContext) error {
+			absoluteFile, err := filepath.Abs(file)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			return errors.WithStack(os.Setenv(EnvName, absoluteFile))
+		}).
+		StringVar(&file)
+}
+
+func IsEnabled() bool {
+	return len(os.Getenv(EnvName)) != 0
+}
+
+// Record appends request to the requests file. Existing requests are preserved, so, several commands of pipeline are recorded to the same file.
+func Record(service string, operation string, params map[string]interface{}) error {
+	file := os.Getenv(EnvName)
+	if len(file) == 0 {
+		return errors.New("fake services are not enabled")
+	}
+
+	log.Info("fake service request", zap.String("service", service), zap.String("operation", operation))
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	requests, err := ReadRequests(file)
+	if err != nil {
+		return err
+	}
+
+	requests = append(requests, &Request{
+		Service:   service,
+		Operation: operation,
+		Params:    params,
+	})
+
+	// standard library config sorts map keys - stable output to compare in tests
+	data, err := jsoniter.ConfigCompatibleWithStandardLibrary.MarshalIndent(requests, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(ioutil.WriteFile(file, data, 0644))
+}
+
+func ReadRequests(file string) ([]*Request, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	var requests []*Request
+	err = jsoniter.Unmarshal(data, &requests)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot parse fake services requests file "+file)
+	}
+	return requests, nil
+}
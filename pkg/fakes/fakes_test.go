@@ -0,0 +1,35 @@
+package fakes
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+)
+
+func TestRecord(t *testing.T) {
+	log.InitLogger()
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "fakes")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "requests.json")
+	g.Expect(os.Setenv(EnvName, file)).NotTo(HaveOccurred())
+	defer os.Unsetenv(EnvName)
+	g.Expect(IsEnabled()).To(BeTrue())
+
+	g.Expect(Record(ServiceS3, "PutObject", map[string]interface{}{"key": "foo.zip"})).NotTo(HaveOccurred())
+	g.Expect(Record(ServiceSnapStore, "push", nil)).NotTo(HaveOccurred())
+
+	requests, err := ReadRequests(file)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(requests).To(HaveLen(2))
+	g.Expect(requests[0].Service).To(Equal(ServiceS3))
+	g.Expect(requests[0].Params["key"]).To(Equal("foo.zip"))
+	g.Expect(requests[1].Operation).To(Equal("push"))
+}
@@ -0,0 +1,32 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/develar/app-builder/pkg/log"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// cloneFile clones file using clonefile (APFS). Returns false if file must be copied using read/write (e.g. not APFS or another volume).
+func cloneFile(from string, to string) (bool, error) {
+	// clonefile doesn't overwrite existing file
+	err := os.Remove(to)
+	if err != nil && !os.IsNotExist(err) {
+		return false, nil
+	}
+
+	err = unix.Clonefile(from, to, unix.CLONE_NOFOLLOW)
+	if err == unix.ENOENT {
+		dir := filepath.Dir(to)
+		if os.MkdirAll(dir, 0777) == nil && SetNormalDirPermissions(dir) == nil {
+			err = unix.Clonefile(from, to, unix.CLONE_NOFOLLOW)
+		}
+	}
+	if err != nil {
+		log.Debug("cannot clone file", zap.Error(err), zap.String("from", from), zap.String("to", to))
+		return false, nil
+	}
+	return true, nil
+}
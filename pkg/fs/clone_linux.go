@@ -0,0 +1,70 @@
+// +build linux
+
+package fs
+
+import (
+	"os"
+
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// max bytes per copy_file_range call (the kernel limits it anyway)
+const maxCopyRangeSize = 1 << 30
+
+// cloneFile clones file (FICLONE - btrfs, XFS) or copies it in kernel (copy_file_range, reflink is used if supported by the filesystem).
+// Returns false if file must be copied using read/write (e.g. not supported by the filesystem or kernel), the destination file is truncated in this case.
+func cloneFile(from string, to string) (bool, error) {
+	sourceFile, err := os.Open(from)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	defer util.Close(sourceFile)
+
+	sourceInfo, err := sourceFile.Stat()
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	destinationFile, err := createFileAndCreateParentDirIfNeeded(to)
+	if err != nil {
+		return false, err
+	}
+
+	err = unix.IoctlFileClone(int(destinationFile.Fd()), int(sourceFile.Fd()))
+	if err != nil {
+		err = copyFileRange(sourceFile, destinationFile, sourceInfo.Size())
+	}
+
+	closeErr := destinationFile.Close()
+	if err != nil {
+		log.Debug("cannot clone file", zap.Error(err), zap.String("from", from), zap.String("to", to))
+		return false, nil
+	}
+	return true, errors.WithStack(closeErr)
+}
+
+func copyFileRange(sourceFile *os.File, destinationFile *os.File, size int64) error {
+	sourceFd := int(sourceFile.Fd())
+	destinationFd := int(destinationFile.Fd())
+	for size > 0 {
+		length := size
+		if length > maxCopyRangeSize {
+			length = maxCopyRangeSize
+		}
+
+		n, err := unix.CopyFileRange(sourceFd, nil, destinationFd, nil, int(length), 0)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			// some filesystems (e.g. procfs) report zero size or do not support copy_file_range silently
+			return errors.New("copy_file_range copied 0 bytes")
+		}
+		size -= int64(n)
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+// +build !linux,!darwin
+
+package fs
+
+// cloneFile is not supported, file must be copied using read/write
+func cloneFile(from string, to string) (bool, error) {
+	return false, nil
+}
@@ -2,6 +2,7 @@ package fs
 
 import (
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
 
@@ -17,10 +18,20 @@ var bufferPool = bpool.NewBytePool(runtime.NumCPU(), 64*1024)
 
 type FileCopier struct {
 	IsUseHardLinks bool
+	// excluded files and dirs are not copied, paths are matched relative to the copied dir
+	Filter *IgnoreMatcher
+	// SymlinkPreserve (default), SymlinkDereference or SymlinkErrorOnExternal
+	SymlinkPolicy string
+	// files hard linked in the source are copied once and hard linked in the destination
+	IsPreserveHardLinks bool
+
+	rootRealDir string
+	// source file id to the copied file
+	copiedFiles map[FileId]string
 }
 
-// go doesn't provide native copy operation (CoW)
-func (t *FileCopier) copyDir(from string, to string) error {
+// go doesn't provide native copy operation (CoW), files are cloned using platform API if possible (see cloneFile)
+func (t *FileCopier) copyDir(from string, to string, relativePath string) error {
 	fileNames, err := fsutil.ReadDirContent(from)
 	if err != nil {
 		return errors.WithStack(err)
@@ -31,9 +42,10 @@ func (t *FileCopier) copyDir(from string, to string) error {
 			continue
 		}
 
-		err = t.copyDirOrFile(filepath.Join(from, name), filepath.Join(to, name), false)
+		// error is not wrapped to keep error code of message error
+		err = t.copyDirOrFile(filepath.Join(from, name), filepath.Join(to, name), path.Join(relativePath, name), false)
 		if err != nil {
-			return errors.WithStack(err)
+			return err
 		}
 	}
 
@@ -56,20 +68,39 @@ func (t *FileCopier) CopyDirOrFile(from string, to string) error {
 		t.IsUseHardLinks = false
 	}
 
-	log.Debug("copy files", zap.String("from", from), zap.String("to", to), zap.Bool("isUseHardLinks", t.IsUseHardLinks))
-	err := t.copyDirOrFile(from, to, true)
-	if err != nil {
-		return errors.WithStack(err)
+	// deep node_modules exceed MAX_PATH on Windows
+	from = ToLongPath(from)
+	to = ToLongPath(to)
+
+	log.Debug("copy files", zap.String("from", from), zap.String("to", to), zap.Bool("isUseHardLinks", t.IsUseHardLinks), zap.String("symlinkPolicy", t.SymlinkPolicy))
+	if t.SymlinkPolicy != "" && t.SymlinkPolicy != SymlinkPreserve {
+		rootRealDir, err := filepath.EvalSymlinks(from)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		t.rootRealDir = ToLongPath(rootRealDir)
 	}
-	return nil
+	if t.IsPreserveHardLinks {
+		t.copiedFiles = make(map[FileId]string)
+	}
+	return t.copyDirOrFile(from, to, "", true)
 }
 
-func (t *FileCopier) copyDirOrFile(from string, to string, isCreateParentDirs bool) error {
+func (t *FileCopier) copyDirOrFile(from string, to string, relativePath string, isCreateParentDirs bool) error {
 	fromInfo, err := os.Lstat(from)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
+	// parents are not checked - excluded dir is not walked
+	if len(relativePath) != 0 {
+		rule := t.Filter.getExcludingRule(relativePath, fromInfo.IsDir())
+		if rule != nil {
+			log.Debug("excluded", zap.String("file", relativePath), zap.String("pattern", rule.Pattern))
+			return nil
+		}
+	}
+
 	if fromInfo.IsDir() {
 		// cannot use file mode as is because of *** *** *** umask
 		if isCreateParentDirs {
@@ -86,7 +117,7 @@ func (t *FileCopier) copyDirOrFile(from string, to string, isCreateParentDirs bo
 			return err
 		}
 
-		return t.copyDir(from, to)
+		return t.copyDir(from, to, relativePath)
 	}
 
 	if isCreateParentDirs {
@@ -97,10 +128,65 @@ func (t *FileCopier) copyDirOrFile(from string, to string, isCreateParentDirs bo
 	}
 
 	if (fromInfo.Mode() & os.ModeSymlink) != 0 {
-		return t.createSymlink(from, to)
-	} else {
+		return t.copySymlink(from, to, relativePath, isCreateParentDirs)
+	}
+
+	if t.copiedFiles == nil {
 		return t.CopyFile(from, to, isCreateParentDirs, fromInfo)
 	}
+
+	fileId, isHardLinked := GetFileId(fromInfo)
+	if isHardLinked {
+		copiedFile := t.copiedFiles[fileId]
+		if len(copiedFile) != 0 {
+			err = os.Link(copiedFile, to)
+			if err == nil {
+				return nil
+			}
+			log.Debug("cannot preserve hard link", zap.Error(err), zap.String("file", copiedFile), zap.String("link", to))
+		}
+	}
+
+	err = t.CopyFile(from, to, isCreateParentDirs, fromInfo)
+	if err == nil && isHardLinked {
+		t.copiedFiles[fileId] = to
+	}
+	return err
+}
+
+func (t *FileCopier) copySymlink(from string, to string, relativePath string, isCreateParentDirs bool) error {
+	switch t.SymlinkPolicy {
+	case SymlinkDereference:
+		target, err := filepath.EvalSymlinks(from)
+		if err != nil {
+			return util.NewMessageError("cannot dereference link "+from+": "+err.Error(), "ERR_LINK_BROKEN")
+		}
+
+		targetInfo, err := os.Stat(target)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if targetInfo.IsDir() {
+			parentRealDir, err := filepath.EvalSymlinks(filepath.Dir(from))
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if IsPathInside(parentRealDir, target) {
+				return util.NewMessageError("cannot dereference link "+from+": link to the parent dir "+target+" creates a cycle", "ERR_LINK_CYCLE")
+			}
+		}
+		return t.copyDirOrFile(target, to, relativePath, isCreateParentDirs)
+
+	case SymlinkErrorOnExternal:
+		target, err := ResolveLinkTarget(from)
+		if err != nil {
+			return err
+		}
+		if !IsPathInside(target, t.rootRealDir) {
+			return util.NewMessageError("link "+from+" points to "+target+" outside of "+t.rootRealDir, "ERR_LINK_OUTSIDE")
+		}
+	}
+	return t.createSymlink(from, to)
 }
 
 func (t *FileCopier) CopyFile(from string, to string, isCreateParentDirs bool, fromInfo os.FileInfo) error {
@@ -118,6 +204,15 @@ func (t *FileCopier) CopyFile(from string, to string, isCreateParentDirs bool, f
 }
 
 func CopyFileAndRestoreNormalPermissions(from string, to string, fileMode os.FileMode) error {
+	// near-instant for large files if source and destination are on the same filesystem with copy-on-write support (APFS, btrfs, XFS)
+	isCloned, err := cloneFile(from, to)
+	if err != nil {
+		return err
+	}
+	if isCloned {
+		return fixPermissions(to, fileMode)
+	}
+
 	sourceFile, err := os.Open(from)
 	if err != nil {
 		return errors.WithStack(err)
@@ -140,7 +235,7 @@ func (t *FileCopier) createSymlink(from string, to string) error {
 	}
 
 	if filepath.IsAbs(link) {
-		link, err = filepath.Rel(filepath.Dir(from), link)
+		link, err = filepath.Rel(filepath.Dir(from), ToLongPath(link))
 		if err != nil {
 			return errors.WithStack(err)
 		}
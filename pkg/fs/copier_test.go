@@ -0,0 +1,94 @@
+package fs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+)
+
+func TestCopyDirOrFile(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "copier")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64*1024+1)
+	source := filepath.Join(dir, "source")
+	g.Expect(os.MkdirAll(filepath.Join(source, "sub"), 0755)).To(Succeed())
+	g.Expect(ioutil.WriteFile(filepath.Join(source, "sub", "large"), data, 0700)).To(Succeed())
+	g.Expect(ioutil.WriteFile(filepath.Join(source, "empty"), nil, 0600)).To(Succeed())
+
+	destination := filepath.Join(dir, "a", "b")
+	g.Expect(CopyDirOrFile(source, destination)).To(Succeed())
+
+	copied, err := ioutil.ReadFile(filepath.Join(destination, "sub", "large"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(bytes.Equal(copied, data)).To(BeTrue())
+	info, err := os.Stat(filepath.Join(destination, "sub", "large"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(info.Mode().Perm()).To(Equal(os.FileMode(0755)))
+
+	info, err = os.Stat(filepath.Join(destination, "empty"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(info.Size()).To(BeZero())
+	g.Expect(info.Mode().Perm()).To(Equal(os.FileMode(0644)))
+
+	// existing file is overwritten
+	g.Expect(CopyFileAndRestoreNormalPermissions(filepath.Join(source, "empty"), filepath.Join(destination, "sub", "large"), 0644)).To(Succeed())
+	copied, err = ioutil.ReadFile(filepath.Join(destination, "sub", "large"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(copied).To(BeEmpty())
+}
+
+func TestCopySymlinkPolicies(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "copier")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "source")
+	g.Expect(os.MkdirAll(filepath.Join(dir, "external"), 0755)).To(Succeed())
+	g.Expect(os.MkdirAll(source, 0755)).To(Succeed())
+	g.Expect(ioutil.WriteFile(filepath.Join(dir, "external", "file.txt"), []byte("external"), 0644)).To(Succeed())
+	g.Expect(ioutil.WriteFile(filepath.Join(source, "a.bin"), []byte("data"), 0644)).To(Succeed())
+	g.Expect(os.Link(filepath.Join(source, "a.bin"), filepath.Join(source, "b.bin"))).To(Succeed())
+	g.Expect(os.Symlink("a.bin", filepath.Join(source, "internal"))).To(Succeed())
+	g.Expect(os.Symlink("../external", filepath.Join(source, "external"))).To(Succeed())
+
+	fileCopier := FileCopier{SymlinkPolicy: SymlinkDereference, IsPreserveHardLinks: true}
+	destination := filepath.Join(dir, "dereference")
+	g.Expect(fileCopier.CopyDirOrFile(source, destination)).To(Succeed())
+	data, err := ioutil.ReadFile(filepath.Join(destination, "external", "file.txt"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(data)).To(Equal("external"))
+	info, err := os.Lstat(filepath.Join(destination, "internal"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(info.Mode().IsRegular()).To(BeTrue())
+
+	aInfo, err := os.Stat(filepath.Join(destination, "a.bin"))
+	g.Expect(err).NotTo(HaveOccurred())
+	bInfo, err := os.Stat(filepath.Join(destination, "b.bin"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(os.SameFile(aInfo, bInfo)).To(BeTrue())
+
+	fileCopier = FileCopier{SymlinkPolicy: SymlinkErrorOnExternal}
+	err = fileCopier.CopyDirOrFile(source, filepath.Join(dir, "error"))
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.(interface{ ErrorCode() string }).ErrorCode()).To(Equal("ERR_LINK_OUTSIDE"))
+
+	destination = filepath.Join(dir, "preserve")
+	g.Expect(CopyDirOrFile(source, destination)).To(Succeed())
+	link, err := os.Readlink(filepath.Join(destination, "external"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(link).To(Equal("../external"))
+	g.Expect(GetDefaultSymlinkPolicy("nsis")).To(Equal(SymlinkDereference))
+}
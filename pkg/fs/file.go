@@ -35,9 +35,13 @@ func ReadFile(file string, size int) ([]byte, error) {
 		return nil, errors.WithStack(err)
 	}
 
+	// file can be smaller than requested size, so, result is truncated to actually read bytes
 	result := make([]byte, size)
-	_, err = reader.Read(result)
-	return result, fsutil.CloseAndCheckError(err, reader)
+	n, err := io.ReadFull(reader, result)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		err = nil
+	}
+	return result[:n], fsutil.CloseAndCheckError(err, reader)
 }
 
 func createFileAndCreateParentDirIfNeeded(name string) (*os.File, error) {
@@ -0,0 +1,17 @@
+// +build !windows
+
+package fs
+
+import (
+	"os"
+	"syscall"
+)
+
+// GetFileId returns false if file doesn't have other hard links
+func GetFileId(info os.FileInfo) (FileId, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || uint64(stat.Nlink) < 2 {
+		return FileId{}, false
+	}
+	return FileId{device: uint64(stat.Dev), inode: uint64(stat.Ino)}, true
+}
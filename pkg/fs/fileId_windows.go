@@ -0,0 +1,10 @@
+package fs
+
+import (
+	"os"
+)
+
+// GetFileId is not supported - file index is not provided by os.FileInfo on Windows, hard links are not detected
+func GetFileId(info os.FileInfo) (FileId, bool) {
+	return FileId{}, false
+}
@@ -0,0 +1,305 @@
+package fs
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+)
+
+// IgnoreRule is a compiled gitignore pattern
+type IgnoreRule struct {
+	Pattern string `json:"pattern"`
+	// file of the rule (empty if specified as an argument) and 1-based line number
+	Source string `json:"source,omitempty"`
+	Line   int    `json:"line,omitempty"`
+
+	IsNegated bool `json:"negated,omitempty"`
+	IsDirOnly bool `json:"dirOnly,omitempty"`
+
+	regexp *regexp.Regexp
+}
+
+// IgnoreMatcher matches slash-separated paths relative to the root against gitignore rules: the last matching rule wins, "!" re-includes,
+// trailing "/" matches only dirs, pattern with slash is anchored to the root and a file cannot be re-included if its parent dir is excluded.
+// Matcher is compiled once and safe for concurrent use.
+type IgnoreMatcher struct {
+	rules []*IgnoreRule
+
+	// dir path to the rule that excludes it (or to nil if dir is not excluded)
+	dirCache sync.Map
+}
+
+type IgnoreExplanation struct {
+	Path       string `json:"path"`
+	IsExcluded bool   `json:"excluded"`
+	// the last matched rule, nil if no rule matches
+	Rule *IgnoreRule `json:"rule,omitempty"`
+	// the parent dir is excluded by the rule (and so the path cannot be re-included)
+	ExcludedDir string `json:"excludedDir,omitempty"`
+}
+
+func NewIgnoreMatcher() *IgnoreMatcher {
+	return &IgnoreMatcher{}
+}
+
+// AddPatterns compiles rules, source is used only for explanation
+func (t *IgnoreMatcher) AddPatterns(lines []string, source string) error {
+	for index, line := range lines {
+		rule, err := compileIgnoreRule(line)
+		if err != nil {
+			return util.NewMessageError("invalid ignore pattern "+line+" ("+source+"): "+err.Error(), "ERR_INVALID_IGNORE_PATTERN")
+		}
+		if rule == nil {
+			continue
+		}
+
+		rule.Source = source
+		if len(source) != 0 {
+			rule.Line = index + 1
+		}
+		t.rules = append(t.rules, rule)
+	}
+	return nil
+}
+
+func (t *IgnoreMatcher) AddFile(file string) error {
+	reader, err := os.Open(file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(reader)
+
+	var lines []string
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimSuffix(scanner.Text(), "\r"))
+	}
+	if scanner.Err() != nil {
+		return errors.WithStack(scanner.Err())
+	}
+	return t.AddPatterns(lines, file)
+}
+
+// IsEmpty reports whether there are no rules
+func (t *IgnoreMatcher) IsEmpty() bool {
+	return t == nil || len(t.rules) == 0
+}
+
+// IsExcluded reports whether the path is excluded, parents of the path are checked too
+func (t *IgnoreMatcher) IsExcluded(file string, isDir bool) bool {
+	return t.Explain(file, isDir).IsExcluded
+}
+
+func (t *IgnoreMatcher) Explain(file string, isDir bool) *IgnoreExplanation {
+	file = strings.Trim(path.Clean("/"+file), "/")
+	result := &IgnoreExplanation{Path: file}
+	if t.IsEmpty() {
+		return result
+	}
+
+	for index := strings.IndexByte(file, '/'); index > 0; index = nextSlash(file, index) {
+		dir := file[:index]
+		rule := t.getDirExcludingRule(dir)
+		if rule != nil {
+			result.IsExcluded = true
+			result.Rule = rule
+			result.ExcludedDir = dir
+			return result
+		}
+	}
+
+	result.Rule = t.match(file, isDir)
+	result.IsExcluded = result.Rule != nil && !result.Rule.IsNegated
+	return result
+}
+
+func nextSlash(file string, index int) int {
+	next := strings.IndexByte(file[index+1:], '/')
+	if next < 0 {
+		return -1
+	}
+	return index + 1 + next
+}
+
+func (t *IgnoreMatcher) getDirExcludingRule(dir string) *IgnoreRule {
+	if value, ok := t.dirCache.Load(dir); ok {
+		return value.(*IgnoreRule)
+	}
+
+	rule := t.getExcludingRule(dir, true)
+	t.dirCache.Store(dir, rule)
+	return rule
+}
+
+// getExcludingRule returns the rule that excludes the path (nil if not excluded or filter is nil), parents are not checked
+func (t *IgnoreMatcher) getExcludingRule(file string, isDir bool) *IgnoreRule {
+	if t.IsEmpty() {
+		return nil
+	}
+
+	rule := t.match(file, isDir)
+	if rule == nil || rule.IsNegated {
+		return nil
+	}
+	return rule
+}
+
+// match returns the last matched rule without checking parents (caller walks the tree and doesn't descend into excluded dirs)
+func (t *IgnoreMatcher) match(file string, isDir bool) *IgnoreRule {
+	for i := len(t.rules) - 1; i >= 0; i-- {
+		rule := t.rules[i]
+		if rule.IsDirOnly && !isDir {
+			continue
+		}
+		if rule.regexp.MatchString(file) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// compileIgnoreRule returns nil for blank lines and comments
+func compileIgnoreRule(line string) (*IgnoreRule, error) {
+	pattern := trimTrailingSpaces(line)
+	if len(pattern) == 0 || pattern[0] == '#' {
+		return nil, nil
+	}
+
+	rule := &IgnoreRule{Pattern: pattern}
+	if pattern[0] == '!' {
+		rule.IsNegated = true
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, `\!`) || strings.HasPrefix(pattern, `\#`) {
+		pattern = pattern[1:]
+	}
+
+	if strings.HasSuffix(pattern, "/") && !strings.HasSuffix(pattern, `\/`) {
+		rule.IsDirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if len(pattern) == 0 {
+		return nil, nil
+	}
+
+	// pattern with slash at the beginning or middle is relative to the root, otherwise matches at any level
+	isAnchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	var builder strings.Builder
+	builder.WriteByte('^')
+	if !isAnchored {
+		builder.WriteString("(?:.*/)?")
+	}
+
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' && (i == 0 || pattern[i-1] == '/') && (i+2 == len(pattern) || pattern[i+2] == '/') {
+				switch {
+				case i+2 == len(pattern):
+					// trailing /** - everything inside
+					builder.WriteString(".*")
+				default:
+					// leading **/ or /**/ - zero or more dirs
+					builder.WriteString("(?:.*/)?")
+					i++
+				}
+				i++
+			} else {
+				// other consecutive asterisks are regular asterisks
+				for i+1 < len(pattern) && pattern[i+1] == '*' {
+					i++
+				}
+				builder.WriteString("[^/]*")
+			}
+		case '?':
+			builder.WriteString("[^/]")
+		case '[':
+			end := findClassEnd(pattern, i)
+			if end < 0 {
+				builder.WriteString(`\[`)
+				continue
+			}
+
+			class := pattern[i+1 : end]
+			builder.WriteByte('[')
+			if len(class) != 0 && (class[0] == '!' || class[0] == '^') {
+				builder.WriteByte('^')
+				class = class[1:]
+			}
+			chars := []rune(class)
+			for j := 0; j < len(chars); j++ {
+				switch chars[j] {
+				case '\\':
+					if j+1 < len(chars) {
+						j++
+						fmt.Fprintf(&builder, `\x{%x}`, chars[j])
+					}
+				case '-':
+					builder.WriteByte('-')
+				default:
+					// escaped as hex to not care about chars special in regexp class
+					fmt.Fprintf(&builder, `\x{%x}`, chars[j])
+				}
+			}
+			builder.WriteByte(']')
+			i = end
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				builder.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+			}
+		default:
+			builder.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	builder.WriteByte('$')
+
+	compiled, err := regexp.Compile(builder.String())
+	if err != nil {
+		return nil, err
+	}
+	rule.regexp = compiled
+	return rule, nil
+}
+
+// trailing spaces are ignored unless escaped with backslash
+func trimTrailingSpaces(line string) string {
+	end := len(line)
+	for end > 0 && line[end-1] == ' ' {
+		if end > 1 && line[end-2] == '\\' {
+			break
+		}
+		end--
+	}
+	return line[:end]
+}
+
+// findClassEnd returns index of "]" closing the bracket expression started at start, -1 if not closed
+func findClassEnd(pattern string, start int) int {
+	i := start + 1
+	if i < len(pattern) && (pattern[i] == '!' || pattern[i] == '^') {
+		i++
+	}
+	// "]" as the first char is a literal
+	if i < len(pattern) && pattern[i] == ']' {
+		i++
+	}
+	for ; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case ']':
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,88 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+)
+
+func TestIgnoreMatcher(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	matcher := NewIgnoreMatcher()
+	g.Expect(matcher.AddPatterns([]string{
+		"# comment",
+		"",
+		"*.log",
+		"!important.log",
+		"build/",
+		"/root.txt",
+		"docs/**/*.md",
+		"!docs/keep.md",
+		`\#hash`,
+		`\!bang`,
+		"trailing\\ ",
+		"[!a-c]?.bin",
+		"node_modules/**/test",
+		"**/cache",
+	}, ".gitignore")).To(Succeed())
+
+	excluded := []string{"a.log", "x/y/a.log", "build", "x/build/file.js", "root.txt", "docs/a.md", "docs/x/y/b.md", "#hash", "!bang", "trailing ",
+		"dx.bin", "node_modules/test", "node_modules/a/test", "node_modules/a/b/test/index.js", "cache", "a/b/cache"}
+	for _, p := range excluded {
+		g.Expect(matcher.IsExcluded(p, p == "build")).To(BeTrue(), p)
+	}
+
+	included := []string{"important.log", "x/important.log", "build.js", "x/root.txt", "docs/keep.md", "readme.md", "hash", "trailing",
+		"ax.bin", "node_modules/tests", "cached"}
+	for _, p := range included {
+		g.Expect(matcher.IsExcluded(p, false)).To(BeFalse(), p)
+	}
+
+	// build/ matches only dir
+	g.Expect(matcher.IsExcluded("x/build", false)).To(BeFalse())
+
+	explanation := matcher.Explain("x/build/important.log", false)
+	g.Expect(explanation.IsExcluded).To(BeTrue())
+	g.Expect(explanation.ExcludedDir).To(Equal("x/build"))
+	g.Expect(explanation.Rule.Pattern).To(Equal("build/"))
+	g.Expect(explanation.Rule.Line).To(Equal(5))
+
+	explanation = matcher.Explain("important.log", false)
+	g.Expect(explanation.IsExcluded).To(BeFalse())
+	g.Expect(explanation.Rule.IsNegated).To(BeTrue())
+
+	g.Expect(matcher.Explain("src/index.js", false).Rule).To(BeNil())
+}
+
+func TestCopyWithFilter(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "copier")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "source")
+	for _, file := range []string{"index.js", "debug.log", "important.log", "out/a.js", "src/out.js"} {
+		g.Expect(os.MkdirAll(filepath.Dir(filepath.Join(source, file)), 0755)).To(Succeed())
+		g.Expect(ioutil.WriteFile(filepath.Join(source, file), nil, 0644)).To(Succeed())
+	}
+
+	filter := NewIgnoreMatcher()
+	g.Expect(filter.AddPatterns([]string{"*.log", "!important.log", "/out"}, "")).To(Succeed())
+	fileCopier := FileCopier{Filter: filter}
+	destination := filepath.Join(dir, "destination")
+	g.Expect(fileCopier.CopyDirOrFile(source, destination)).To(Succeed())
+
+	for _, file := range []string{"index.js", "important.log", "src/out.js"} {
+		g.Expect(filepath.Join(destination, file)).To(BeAnExistingFile())
+	}
+	for _, file := range []string{"debug.log", "out"} {
+		g.Expect(filepath.Join(destination, file)).NotTo(BeAnExistingFile())
+	}
+}
@@ -0,0 +1,71 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/develar/errors"
+)
+
+const (
+	// link is copied as link (absolute target is converted to relative)
+	SymlinkPreserve = "preserve"
+	// link is replaced with a copy of the target file or dir
+	SymlinkDereference = "dereference"
+	// link is copied as link, but link pointing outside of the copied dir is an error
+	SymlinkErrorOnExternal = "error-on-external"
+)
+
+var SymlinkPolicies = []string{SymlinkPreserve, SymlinkDereference, SymlinkErrorOnExternal}
+
+// FileId identifies file data on the filesystem (device and inode), hard links have the same id
+type FileId struct {
+	device uint64
+	inode  uint64
+}
+
+// GetDefaultSymlinkPolicy returns how links must be handled for the target:
+// squashfs (AppImage, snap), packages and archives store links, asar stores only links inside the archive, Windows installers cannot store links at all.
+func GetDefaultSymlinkPolicy(target string) string {
+	switch target {
+	case "asar":
+		return SymlinkErrorOnExternal
+	default:
+		if IsWindowsTarget(target) {
+			return SymlinkDereference
+		}
+		return SymlinkPreserve
+	}
+}
+
+// ResolveLinkTarget returns the real path of the link target. Target of broken link is resolved lexically.
+func ResolveLinkTarget(file string) (string, error) {
+	target, err := filepath.EvalSymlinks(file)
+	if err == nil {
+		return ToLongPath(target), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", errors.WithStack(err)
+	}
+
+	link, err := os.Readlink(file)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if filepath.IsAbs(link) {
+		return ToLongPath(filepath.Clean(link)), nil
+	}
+
+	dir, err := filepath.EvalSymlinks(filepath.Dir(file))
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return ToLongPath(filepath.Join(dir, link)), nil
+}
+
+// IsPathInside reports whether file is the dir or inside the dir (both paths must be clean)
+func IsPathInside(file string, dir string) bool {
+	relativePath, err := filepath.Rel(dir, file)
+	return err == nil && relativePath != ".." && !strings.HasPrefix(relativePath, ".."+string(filepath.Separator))
+}
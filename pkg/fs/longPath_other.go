@@ -0,0 +1,8 @@
+// +build !windows
+
+package fs
+
+// ToLongPath returns path as is, path length is not limited by MAX_PATH
+func ToLongPath(p string) string {
+	return p
+}
@@ -0,0 +1,23 @@
+package fs
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// ToLongPath converts path to the extended-length path (\\?\C:\... or \\?\UNC\server\share\...) to not be limited by MAX_PATH (deep node_modules).
+// Extended-length path is not normalized by Windows, so, path is made absolute and cleaned.
+func ToLongPath(p string) string {
+	if strings.HasPrefix(p, `\\?\`) || strings.HasPrefix(p, `\\.\`) {
+		return p
+	}
+
+	absolutePath, err := filepath.Abs(p)
+	if err != nil {
+		return p
+	}
+	if strings.HasPrefix(absolutePath, `\\`) {
+		return `\\?\UNC\` + absolutePath[2:]
+	}
+	return `\\?\` + absolutePath
+}
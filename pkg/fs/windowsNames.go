@@ -0,0 +1,145 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/develar/app-builder/pkg/diagnostics"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+)
+
+// NTFS limit of a path component (in UTF-16 code units)
+const maxWindowsFileNameLength = 255
+
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// IsWindowsTarget reports whether files of the target are written on Windows (installer or archive unpacked on Windows)
+func IsWindowsTarget(target string) bool {
+	switch target {
+	case "nsis", "nsis-web", "portable", "msi", "msix", "appx", "squirrel":
+		return true
+	default:
+		return false
+	}
+}
+
+// ValidateWindowsFileName returns error code and message, or empty code if name can be used on Windows
+func ValidateWindowsFileName(name string) (string, string) {
+	// reserved with any extension: "aux.js" is the device too
+	baseName := name
+	if index := strings.IndexByte(baseName, '.'); index >= 0 {
+		baseName = baseName[:index]
+	}
+	if windowsReservedNames[strings.ToUpper(strings.TrimRight(baseName, " "))] {
+		return "ERR_WINDOWS_RESERVED_NAME", fmt.Sprintf("%q is a reserved device name", name)
+	}
+
+	for _, c := range name {
+		if c < 32 || strings.ContainsRune(`<>:"|?*\`, c) {
+			return "ERR_WINDOWS_INVALID_CHAR", fmt.Sprintf("%q contains character %q not allowed on Windows", name, c)
+		}
+	}
+
+	if strings.HasSuffix(name, " ") || strings.HasSuffix(name, ".") {
+		return "ERR_WINDOWS_TRAILING_DOT_OR_SPACE", fmt.Sprintf("%q ends with a dot or space (removed by Windows)", name)
+	}
+
+	length := 0
+	for _, c := range name {
+		length++
+		// surrogate pair in UTF-16
+		if c > 0xffff {
+			length++
+		}
+	}
+	if length > maxWindowsFileNameLength {
+		return "ERR_WINDOWS_NAME_TOO_LONG", fmt.Sprintf("name is longer than %d characters", maxWindowsFileNameLength)
+	}
+	return "", ""
+}
+
+// ValidateWindowsNames checks names of all files in the dir (excluded by filter are skipped) before copying,
+// problems are reported with the package (node_modules/<name>) that contains the file.
+func ValidateWindowsNames(dir string, filter *IgnoreMatcher, maxErrors int) (*diagnostics.Report, error) {
+	collector := diagnostics.NewCollector(maxErrors)
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if file == dir {
+			return nil
+		}
+		if collector.IsLimitReached() {
+			collector.MarkTruncated()
+			return filepath.SkipDir
+		}
+
+		relativePath := filepath.ToSlash(file[len(dir)+1:])
+		if filter.getExcludingRule(relativePath, info.IsDir()) != nil {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		code, message := ValidateWindowsFileName(info.Name())
+		if len(code) != 0 {
+			packageName := getPackageName(relativePath)
+			if len(packageName) != 0 {
+				message += " (package " + packageName + ")"
+			}
+			collector.Add(diagnostics.SeverityError, code, relativePath, message)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return collector.Report(), nil
+}
+
+// CheckWindowsNames returns message error ERR_WINDOWS_INVALID_FILE_NAMES with all found problems
+func CheckWindowsNames(dir string, filter *IgnoreMatcher) error {
+	report, err := ValidateWindowsNames(dir, filter, 0)
+	if err != nil {
+		return err
+	}
+	if report.ErrorCount == 0 {
+		return nil
+	}
+
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("%d file names in %s cannot be used on Windows:", report.ErrorCount, dir))
+	for _, finding := range report.Findings {
+		builder.WriteString("\n  ")
+		builder.WriteString(finding.Message)
+		builder.WriteString(": ")
+		builder.WriteString(strings.Join(finding.Locations, ", "))
+	}
+	return util.NewMessageError(builder.String(), "ERR_WINDOWS_INVALID_FILE_NAMES")
+}
+
+// getPackageName returns the name of the innermost package in node_modules (including scope), empty if file is not in node_modules
+func getPackageName(relativePath string) string {
+	segments := strings.Split(relativePath, "/")
+	result := ""
+	for i := 0; i < len(segments)-1; i++ {
+		if segments[i] != "node_modules" {
+			continue
+		}
+
+		name := segments[i+1]
+		if strings.HasPrefix(name, "@") && i+2 < len(segments) {
+			name += "/" + segments[i+2]
+		}
+		result = name
+	}
+	return result
+}
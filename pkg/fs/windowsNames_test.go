@@ -0,0 +1,70 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestValidateWindowsFileName(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	for _, name := range []string{"index.js", "console.js", "con-fig", "LPT10", ".aux"} {
+		code, _ := ValidateWindowsFileName(name)
+		g.Expect(code).To(BeEmpty(), name)
+	}
+
+	expected := map[string]string{
+		"CON":      "ERR_WINDOWS_RESERVED_NAME",
+		"aux.js":   "ERR_WINDOWS_RESERVED_NAME",
+		"nul.d.ts": "ERR_WINDOWS_RESERVED_NAME",
+		"a:b":      "ERR_WINDOWS_INVALID_CHAR",
+		"what?":    "ERR_WINDOWS_INVALID_CHAR",
+		"tab\t":    "ERR_WINDOWS_INVALID_CHAR",
+		"name.":    "ERR_WINDOWS_TRAILING_DOT_OR_SPACE",
+	}
+	for name, expectedCode := range expected {
+		code, _ := ValidateWindowsFileName(name)
+		g.Expect(code).To(Equal(expectedCode), name)
+	}
+
+	g.Expect(getPackageName("node_modules/@scope/pkg/node_modules/dep/lib/aux.js")).To(Equal("dep"))
+	g.Expect(getPackageName("node_modules/@scope/pkg/lib/aux.js")).To(Equal("@scope/pkg"))
+	g.Expect(getPackageName("lib/aux.js")).To(BeEmpty())
+}
+
+func TestCheckWindowsNames(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("invalid names cannot be created on Windows")
+	}
+
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "names")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	for _, file := range []string{"index.js", "node_modules/foo/aux.js", "node_modules/foo/test/con.js", "node_modules/bar/a:b.js"} {
+		g.Expect(os.MkdirAll(filepath.Dir(filepath.Join(dir, file)), 0755)).To(Succeed())
+		g.Expect(ioutil.WriteFile(filepath.Join(dir, file), nil, 0644)).To(Succeed())
+	}
+
+	report, err := ValidateWindowsNames(dir, nil, 0)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(report.ErrorCount).To(Equal(3))
+
+	filter := NewIgnoreMatcher()
+	g.Expect(filter.AddPatterns([]string{"test/", "bar"}, "")).To(Succeed())
+	err = CheckWindowsNames(dir, filter)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.(interface{ ErrorCode() string }).ErrorCode()).To(Equal("ERR_WINDOWS_INVALID_FILE_NAMES"))
+	g.Expect(err.Error()).To(ContainSubstring(`"aux.js" is a reserved device name (package foo): node_modules/foo/aux.js`))
+	g.Expect(err.Error()).NotTo(ContainSubstring("con.js"))
+
+	g.Expect(filter.AddPatterns([]string{"aux.js"}, "")).To(Succeed())
+	g.Expect(CheckWindowsNames(dir, filter)).To(Succeed())
+}
@@ -0,0 +1,168 @@
+package icons
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"path/filepath"
+
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+	"github.com/disintegration/imaging"
+	"github.com/json-iterator/go"
+	"go.uber.org/zap"
+)
+
+const adaptiveManifestFileName = "adaptive-icons.json"
+
+// notification area icon sizes for 100%, 125%, 150% and 200% scale
+var trayIconSizes = []int{16, 20, 24, 32}
+
+var symbolicIconSizes = []int{16, 24, 32, 48}
+
+var (
+	// dark glyph is visible on light taskbar and vice versa
+	trayLightColor = color.NRGBA{A: 0xff}
+	trayDarkColor  = color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+	// desktop environment recolors symbolic icons according to theme, #bebebe is the conventional source color (as in Adwaita)
+	symbolicColor = color.NRGBA{R: 0xbe, G: 0xbe, B: 0xbe, A: 0xff}
+)
+
+type AdaptiveIconRequest struct {
+	Foreground string
+	Background string
+
+	OutputDir string
+}
+
+type AdaptiveIconResult struct {
+	// foreground layer composed over background layer, set only if background is specified
+	Composite string `json:"composite,omitempty"`
+
+	TrayLight []IconInfo `json:"trayLight"`
+	TrayDark  []IconInfo `json:"trayDark"`
+	Symbolic  []IconInfo `json:"symbolic"`
+
+	Manifest string `json:"manifest"`
+}
+
+type monochromeVariant struct {
+	outFileNameFormat string
+	color             color.NRGBA
+	sizeList          []int
+	result            *[]IconInfo
+}
+
+func CreateAdaptiveIcons(request *AdaptiveIconRequest) (*AdaptiveIconResult, error) {
+	foreground, err := loadImage(request.Foreground, symbolicIconSizes[len(symbolicIconSizes)-1])
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	err = fsutil.EnsureDir(request.OutputDir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	result := &AdaptiveIconResult{}
+
+	if request.Background != "" {
+		result.Composite, err = composeLayers(foreground, request.Background, request.OutputDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	variants := []monochromeVariant{
+		{outFileNameFormat: "tray-light_%dx%d.png", color: trayLightColor, sizeList: trayIconSizes, result: &result.TrayLight},
+		{outFileNameFormat: "tray-dark_%dx%d.png", color: trayDarkColor, sizeList: trayIconSizes, result: &result.TrayDark},
+		{outFileNameFormat: "icon-symbolic_%dx%d.png", color: symbolicColor, sizeList: symbolicIconSizes, result: &result.Symbolic},
+	}
+
+	type task struct {
+		variant   *monochromeVariant
+		sizeIndex int
+	}
+
+	var tasks []task
+	for index := range variants {
+		variant := &variants[index]
+		*variant.result = make([]IconInfo, len(variant.sizeList))
+		for sizeIndex := range variant.sizeList {
+			tasks = append(tasks, task{variant: variant, sizeIndex: sizeIndex})
+		}
+	}
+
+	err = mapCpuBound(len(tasks), func(taskIndex int) error {
+		variant := tasks[taskIndex].variant
+		sizeIndex := tasks[taskIndex].sizeIndex
+		size := variant.sizeList[sizeIndex]
+		outFile := filepath.Join(request.OutputDir, fmt.Sprintf(variant.outFileNameFormat, size, size))
+		(*variant.result)[sizeIndex] = IconInfo{File: outFile, Size: size}
+		// resize before recoloring to keep antialiasing of the glyph edges
+		return SaveImage(CreateMonochromeImage(imaging.Resize(foreground, size, size, imaging.Lanczos), variant.color), outFile, PNG)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result.Manifest = filepath.Join(request.OutputDir, adaptiveManifestFileName)
+	err = writeAdaptiveManifest(result)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug("adaptive icons created", zap.String("manifest", result.Manifest))
+	return result, nil
+}
+
+func composeLayers(foreground image.Image, backgroundFile string, outDir string) (string, error) {
+	background, err := LoadImage(backgroundFile)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	bounds := foreground.Bounds()
+	background = imaging.Resize(background, bounds.Dx(), bounds.Dy(), imaging.Lanczos)
+
+	outFile := filepath.Join(outDir, "icon-composite.png")
+	err = SaveImage(imaging.Overlay(background, foreground, image.Pt(0, 0), 1), outFile, PNG)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return outFile, nil
+}
+
+// CreateMonochromeImage keeps only alpha of source, color is replaced with the specified one
+func CreateMonochromeImage(source image.Image, fillColor color.NRGBA) *image.NRGBA {
+	bounds := source.Bounds()
+	result := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			_, _, _, alpha := source.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			result.SetNRGBA(x, y, color.NRGBA{
+				R: fillColor.R,
+				G: fillColor.G,
+				B: fillColor.B,
+				A: uint8(alpha * uint32(fillColor.A) / 0xffff),
+			})
+		}
+	}
+	return result
+}
+
+func writeAdaptiveManifest(result *AdaptiveIconResult) error {
+	data, err := jsoniter.ConfigFastest.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	file, err := fsutil.CreateFile(result.Manifest)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = file.Write(data)
+	return errors.WithStack(fsutil.CloseAndCheckError(err, file))
+}
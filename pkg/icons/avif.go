@@ -0,0 +1,121 @@
+package icons
+
+import (
+	"bufio"
+	"bytes"
+	"image"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+	"go.uber.org/zap"
+)
+
+// AVIF decoder is not implemented in go (x/image doesn't support it, existing decoders require cgo and libaom/dav1d or WebAssembly runtime),
+// so, as for SVG, external tool is used to convert it to PNG - avifdec (libavif), ImageMagick or sips (macOS 13+), AVIF_DECODER_PATH to use a custom one.
+// ERR_ICON_AVIF_DECODER_NOT_FOUND is returned if no decoder is available.
+// Format is not registered in the image package (image.Decode of other packages must not spawn a tool) - only icons are decoded (see LoadImage and DecodeImageConfig).
+func createAvifDecodeCommand(inFile string, outFile string) (*exec.Cmd, error) {
+	customPath := os.Getenv("AVIF_DECODER_PATH")
+	if customPath != "" {
+		return exec.Command(customPath, inFile, outFile), nil
+	}
+
+	//noinspection SpellCheckingInspection
+	path, err := exec.LookPath("avifdec")
+	if err == nil {
+		return exec.Command(path, inFile, outFile), nil
+	}
+
+	path, err = exec.LookPath("magick")
+	if err == nil {
+		return exec.Command(path, inFile, "png:"+outFile), nil
+	}
+
+	if runtime.GOOS == "darwin" {
+		path, err = exec.LookPath("sips")
+		if err == nil {
+			return exec.Command(path, "-s", "format", "png", inFile, "--out", outFile), nil
+		}
+	}
+
+	return nil, createAvifDecoderNotFoundError()
+}
+
+func createAvifDecoderNotFoundError() error {
+	return util.NewMessageError("cannot decode AVIF icon: no AVIF decoder found, please install avifdec (libavif) or ImageMagick, set AVIF_DECODER_PATH, or use PNG", "ERR_ICON_AVIF_DECODER_NOT_FOUND")
+}
+
+// still image and image sequence brands
+func isAvif(reader *bufio.Reader) bool {
+	data, err := reader.Peek(12)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(data[4:12], []byte("ftypavif")) || bytes.Equal(data[4:12], []byte("ftypavis"))
+}
+
+func decodeAvif(reader io.Reader) (image.Image, error) {
+	tempDir, err := util.TempDir("", ".avif")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	defer func() {
+		_ = os.RemoveAll(tempDir)
+	}()
+
+	inFile := filepath.Join(tempDir, "icon.avif")
+	err = writeToFile(reader, inFile)
+	if err != nil {
+		return nil, err
+	}
+
+	outFile := filepath.Join(tempDir, "icon.png")
+	command, err := createAvifDecodeCommand(inFile, outFile)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug("decode avif", zap.String("decoder", command.Path))
+	_, err = util.Execute(command)
+	if err != nil {
+		if filepath.Base(command.Path) == "sips" {
+			// sips of macOS before 13 doesn't support AVIF
+			log.Debug("sips cannot decode AVIF", zap.Error(err))
+			return nil, createAvifDecoderNotFoundError()
+		}
+		return nil, err
+	}
+
+	outReader, err := os.Open(outFile)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return DecodeImageAndClose(outReader, outReader)
+}
+
+// full decode - external tool cannot report size without decoding, and config is requested only for source icons
+func decodeAvifConfig(reader io.Reader) (image.Config, error) {
+	result, err := decodeAvif(reader)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: result.ColorModel(), Width: result.Bounds().Dx(), Height: result.Bounds().Dy()}, nil
+}
+
+func writeToFile(reader io.Reader, file string) error {
+	outFile, err := os.Create(file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = io.Copy(outFile, reader)
+	return errors.WithStack(fsutil.CloseAndCheckError(err, outFile))
+}
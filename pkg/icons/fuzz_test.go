@@ -0,0 +1,64 @@
+//go:build go1.18
+// +build go1.18
+
+package icons
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func addTestDataSeed(f *testing.F, name string) {
+	data, err := ioutil.ReadFile(filepath.Join("..", "..", "testData", name))
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(data)
+}
+
+// go test -run=^$ -fuzz=FuzzGetIcoSizes ./pkg/icons
+func FuzzGetIcoSizes(f *testing.F) {
+	addTestDataSeed(f, "icon.ico")
+	f.Add([]byte{0, 0, 1, 0, 2, 0})
+	f.Add([]byte{0, 0, 1})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if !IsIco(data) {
+			return
+		}
+
+		sizes, err := GetIcoSizes(data)
+		if err == nil && len(sizes) == 0 {
+			t.Fatal("no sizes and no error")
+		}
+	})
+}
+
+// go test -run=^$ -fuzz=FuzzReadIcns ./pkg/icons
+func FuzzReadIcns(f *testing.F) {
+	addTestDataSeed(f, "icon.icns")
+	f.Add([]byte("icns\x00\x00\x00\x10ic08\x00\x00\x00\x04"))
+	f.Add([]byte("icns\x00\x00\x00\x10ic08\xff\xff\xff\xff"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		reader := bufio.NewReader(bytes.NewReader(data))
+		isIcns, err := IsIcns(reader)
+		if err != nil || !isIcns {
+			return
+		}
+
+		subImages, err := ReadIcns(reader)
+		if err != nil {
+			return
+		}
+
+		for osType, subImage := range subImages {
+			if subImage.Length < 0 || subImage.Offset+subImage.Length > len(data) {
+				t.Fatalf("sub image %s is out of bounds: %+v", osType, subImage)
+			}
+		}
+	})
+}
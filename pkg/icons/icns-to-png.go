@@ -57,6 +57,10 @@ func ConvertIcnsToPng(inFile string, outDir string) ([]IconInfo, error) {
 		}
 	}
 
+	if len(result) == 0 {
+		return nil, errors.WithStack(&ImageFormatError{inFile, "ERR_ICON_UNKNOWN_FORMAT"})
+	}
+
 	maxIconInfo := result[len(result)-1]
 	err = multiResizeImage(maxIconInfo.File, filepath.Join(outDir, "icon_%dx%d.png"), &result, sizeList)
 	if err != nil {
@@ -129,21 +133,22 @@ func multiResizeImage2(originalImage *image.Image, outFileNameFormat string, res
 
 	maxSize := (*originalImage).Bounds().Max.X
 
-	return util.MapAsync(imageCount, func(taskIndex int) (func() error, error) {
-		size := sizeList[taskIndex]
-		if size > maxSize {
-			return nil, nil
+	var resizedList []IconInfo
+	for _, size := range sizeList {
+		if size <= maxSize {
+			resizedList = append(resizedList, IconInfo{File: fmt.Sprintf(outFileNameFormat, size, size), Size: size})
 		}
+	}
 
-		outFilePath := fmt.Sprintf(outFileNameFormat, size, size)
-		*result = append(*result, IconInfo{
-			File: outFilePath,
-			Size: size,
-		})
-
-		return func() error {
-			newImage := imaging.Resize(*originalImage, size, size, imaging.Lanczos)
-			return SaveImage(newImage, outFilePath, PNG)
-		}, nil
+	err := mapCpuBound(len(resizedList), func(taskIndex int) error {
+		info := resizedList[taskIndex]
+		newImage := imaging.Resize(*originalImage, info.Size, info.Size, imaging.Lanczos)
+		return SaveImage(newImage, info.File, PNG)
 	})
+	if err != nil {
+		return err
+	}
+
+	*result = append(*result, resizedList...)
+	return nil
 }
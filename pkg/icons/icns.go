@@ -4,10 +4,15 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"image"
 	"image/png"
 	"io"
 	"io/ioutil"
+	"os"
+	"strings"
 
+	"github.com/develar/app-builder/pkg/util"
 	"github.com/develar/errors"
 	"github.com/develar/go-fs-util"
 	"github.com/disintegration/imaging"
@@ -27,78 +32,87 @@ var (
 
 	icnsExpectedSizes = []int{16, 32, 64, 128, 256, 512, 1024}
 
-	// all icon sizes mapped to their respective possible OSTypes, this includes old OSTypes such as ic08 recognized on 10.5
-	// https://github.com/electron-userland/electron-builder/issues/2533
-	// AppIcon Generator also doesn't produce 16x16 from 1024x1025 PNG source (only 16x16@2x "retina" icon)
-	sizeToType = map[int][]string{
-		16:   {"icp4"},
-		32:   {"ic11"}, // icp5 is not generated by AppIcon Generator
-		64:   {"ic12"}, // icp6 is not generated by AppIcon Generator
-		128:  {"ic07"},
-		256:  {ICNS_256, ICNS_256_RETINA},
-		512:  {ICNS_512, ICNS_512_RETINA},
-		1024: {ICNS_1024},
+	// full modern iconset (as iconutil produces from .iconset dir), each point size has normal and @2x (retina) slot
+	// https://en.wikipedia.org/wiki/Apple_Icon_Image_format#Icon_types
+	icnsSlots = []icnsSlot{
+		{"icp4", 16, false},
+		{"ic11", 32, true},
+		{"icp5", 32, false},
+		{"ic12", 64, true},
+		{"ic07", 128, false},
+		{ICNS_256_RETINA, 256, true},
+		{ICNS_256, 256, false},
+		{ICNS_512_RETINA, 512, true},
+		{ICNS_512, 512, false},
+		{ICNS_1024, 1024, true},
 	}
 )
 
+type icnsSlot struct {
+	osType string
+	// pixel size (for retina slot it is point size * 2)
+	size     int
+	isRetina bool
+}
+
 func ConvertToIcns(inputInfo InputFileInfo, outFilePath string) error {
 	// create a new buffer to hold the series of icons generated via resizing
 	icns := new(bytes.Buffer)
 
-	for _, size := range icnsExpectedSizes {
-		if size > inputInfo.MaxIconSize {
-			// do not upscale
-			continue
-		}
-
-		var imageData []byte
-		var err error
-		existingFile, exists := inputInfo.SizeToPath[size]
-		if exists {
-			imageData, err = ioutil.ReadFile(existingFile)
-			if err != nil {
-				return errors.WithStack(err)
-			}
-		} else {
-			if size == 16 {
-				// https://github.com/electron-userland/electron-builder/issues/2533
-				// AppIcon Generator also doesn't produce 16x16 from 1024x1025 PNG source (only 16x16@2x "retina" icon)
-				continue
+	// retina slot of smaller point size has the same pixel size as normal slot of bigger one (e.g. 16@2x and 32), so, image is encoded only once
+	var writtenSlots []icnsSlot
+	var sizeList []int
+	sizeToIndex := make(map[int]int)
+	isMaxImageRequired := false
+	for _, slot := range icnsSlots {
+		// do not upscale
+		if slot.size <= inputInfo.MaxIconSize {
+			writtenSlots = append(writtenSlots, slot)
+			if _, ok := sizeToIndex[slot.size]; !ok {
+				sizeToIndex[slot.size] = len(sizeList)
+				sizeList = append(sizeList, slot.size)
+				isMaxImageRequired = isMaxImageRequired || !hasPngForSize(&inputInfo, slot.size)
 			}
+		}
+	}
 
-			maxImage, err := inputInfo.GetMaxImage()
-			if err != nil {
-				return errors.WithStack(err)
-			}
+	// decode once before resizing in parallel
+	if isMaxImageRequired {
+		_, err := inputInfo.GetMaxImage()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
 
-			imageBuffer := new(bytes.Buffer)
-			err = png.Encode(imageBuffer, imaging.Resize(maxImage, size, size, imaging.Lanczos))
-			if err != nil {
-				return errors.WithStack(err)
-			}
+	imageDataList := make([][]byte, len(sizeList))
+	err := mapCpuBound(len(sizeList), func(taskIndex int) error {
+		var err error
+		imageDataList[taskIndex], err = getIcnsImageData(&inputInfo, sizeList[taskIndex])
+		return err
+	})
+	if err != nil {
+		return err
+	}
 
-			imageData = imageBuffer.Bytes()
-		}
+	for _, slot := range writtenSlots {
+		imageData := imageDataList[sizeToIndex[slot.size]]
 
 		// each icon type is prefixed with a 4-byte OSType marker and a 4-byte size header (which includes the ostype/size header).
 		// add the size of the total icon to lengthBytes in big-endian format.
 		lengthBytes := make([]byte, 4)
 		binary.BigEndian.PutUint32(lengthBytes, uint32(len(imageData)+8))
 
-		// iterate through every OSType and append the icon to icns
-		for _, ostype := range sizeToType[size] {
-			_, err = icns.Write([]byte(ostype))
-			if err != nil {
-				return errors.WithStack(err)
-			}
-			_, err = icns.Write(lengthBytes)
-			if err != nil {
-				return errors.WithStack(err)
-			}
-			_, err = icns.Write(imageData)
-			if err != nil {
-				return errors.WithStack(err)
-			}
+		_, err = icns.Write([]byte(slot.osType))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		_, err = icns.Write(lengthBytes)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		_, err = icns.Write(imageData)
+		if err != nil {
+			return errors.WithStack(err)
 		}
 	}
 
@@ -126,9 +140,96 @@ func ConvertToIcns(inputInfo InputFileInfo, outFilePath string) error {
 		return errors.WithStack(err)
 	}
 
+	return validateIcns(outFilePath, writtenSlots)
+}
+
+func hasPngForSize(inputInfo *InputFileInfo, size int) bool {
+	existingFile, exists := inputInfo.SizeToPath[size]
+	return exists && strings.HasSuffix(strings.ToLower(existingFile), ".png")
+}
+
+func getIcnsImageData(inputInfo *InputFileInfo, size int) ([]byte, error) {
+	if hasPngForSize(inputInfo, size) {
+		imageData, err := ioutil.ReadFile(inputInfo.SizeToPath[size])
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return imageData, nil
+	}
+
+	maxImage, err := inputInfo.GetMaxImage()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	imageBuffer := new(bytes.Buffer)
+	err = png.Encode(imageBuffer, imaging.Resize(maxImage, size, size, imaging.Lanczos))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return imageBuffer.Bytes(), nil
+}
+
+// check that written file is readable and each slot contains image of expected size
+func validateIcns(file string, expectedSlots []icnsSlot) error {
+	reader, err := os.Open(file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	defer util.Close(reader)
+
+	bufferedReader := bufio.NewReader(reader)
+	isIcns, err := IsIcns(bufferedReader)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if !isIcns {
+		return errors.Errorf("generated icns %s has invalid header", file)
+	}
+
+	typeToImage, err := ReadIcns(bufferedReader)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for osType := range typeToImage {
+		if !isKnownIcnsType(osType) {
+			return errors.Errorf("generated icns %s contains unknown type %s", file, osType)
+		}
+	}
+
+	for _, slot := range expectedSlots {
+		subImage, ok := typeToImage[slot.osType]
+		if !ok {
+			return errors.Errorf("generated icns %s doesn't contain %s (%dx%d)", file, slot.osType, slot.size, slot.size)
+		}
+
+		_, err = reader.Seek(int64(subImage.Offset), io.SeekStart)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		config, _, err := image.DecodeConfig(io.LimitReader(reader, int64(subImage.Length)))
+		if err != nil {
+			return errors.WithMessage(err, fmt.Sprintf("generated icns %s contains invalid %s image", file, slot.osType))
+		}
+		if config.Width != slot.size || config.Height != slot.size {
+			return errors.Errorf("generated icns %s: %s must be %dx%d, but %dx%d", file, slot.osType, slot.size, slot.size, config.Width, config.Height)
+		}
+	}
 	return nil
 }
 
+func isKnownIcnsType(osType string) bool {
+	for _, slot := range icnsSlots {
+		if slot.osType == osType {
+			return true
+		}
+	}
+	return false
+}
+
 func IsIcns(reader *bufio.Reader) (bool, error) {
 	data, err := reader.Peek(4)
 	if err != nil {
@@ -160,14 +261,20 @@ func ReadIcns(reader *bufio.Reader) (map[string]SubImage, error) {
 		err = binary.Read(reader, binary.BigEndian, &icon)
 		if err == io.EOF {
 			break
+		} else if err == io.ErrUnexpectedEOF {
+			return nil, errors.Errorf("icns is truncated: incomplete entry header at offset %d", offset)
 		} else if err != nil {
 			return nil, errors.WithStack(err)
 		}
 
+		osType := string(icon.Type[:])
+		if icon.Length < 8 {
+			return nil, errors.Errorf("icns is corrupted: entry %q at offset %d has invalid length %d", osType, offset, icon.Length)
+		}
+
 		offset += 8
 		imageDataLength := int(icon.Length) - 8
 
-		osType := string(icon.Type[:])
 		if osType != "info" && osType != "TOC" && osType != "icnV" && osType != "name" {
 			typeToImage[osType] = SubImage{
 				Offset: offset,
@@ -179,6 +286,9 @@ func ReadIcns(reader *bufio.Reader) (map[string]SubImage, error) {
 
 		_, err = reader.Discard(imageDataLength)
 		if err != nil {
+			if err == io.EOF {
+				return nil, errors.Errorf("icns is truncated: entry %q declares %d bytes of data", osType, imageDataLength)
+			}
 			return nil, errors.WithStack(err)
 		}
 	}
@@ -42,12 +42,12 @@ var typeToSize = map[string]int{
 
 func ConvertIcnsToPngUsingOpenJpeg(icnsPath string, outDir string) ([]IconInfo, error) {
 	reader, err := os.Open(icnsPath)
-	defer util.Close(reader)
-
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
+	defer util.Close(reader)
+
 	bufferedReader := bufio.NewReader(reader)
 	subImageInfoList, err := ReadIcns(bufferedReader)
 	if err != nil {
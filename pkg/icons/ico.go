@@ -1,27 +1,57 @@
 package icons
 
 import (
+	"bytes"
 	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+
+	"github.com/develar/errors"
+	"github.com/disintegration/imaging"
 )
 
+const icoHeaderSize = 6
+const icoDirEntrySize = 16
+
 type Sizes struct {
-	Width  int
-	Height int
+	Width  int `json:"width"`
+	Height int `json:"height"`
 }
 
 func IsIco(data []byte) bool {
-	return binary.LittleEndian.Uint16(data) == 0 && binary.LittleEndian.Uint16(data[:2]) == 0
+	// reserved field must be 0 and image type must be 1 (icon)
+	return len(data) >= icoHeaderSize && binary.LittleEndian.Uint16(data) == 0 && binary.LittleEndian.Uint16(data[2:]) == 1
+}
+
+// GetIcoDirSize returns expected size of ico header and directory (data must contain at least ico header)
+func GetIcoDirSize(data []byte) int {
+	return icoHeaderSize + int(binary.LittleEndian.Uint16(data[4:]))*icoDirEntrySize
 }
 
-func GetIcoSizes(data []byte) []Sizes {
+func GetIcoSizes(data []byte) ([]Sizes, error) {
+	if len(data) < icoHeaderSize {
+		return nil, errors.Errorf("ico header is truncated: %d bytes", len(data))
+	}
+
 	n := int(binary.LittleEndian.Uint16(data[4:]))
-	var sizes []Sizes
+	if n == 0 {
+		return nil, errors.New("ico doesn't contain images")
+	}
+
+	if GetIcoDirSize(data) > len(data) {
+		return nil, errors.Errorf("ico directory is truncated: %d images declared, but only %d bytes available", n, len(data))
+	}
+
+	sizes := make([]Sizes, 0, n)
 	for i := 0; i < n; i++ {
-		w := int(data[6+i*16] & 0xff)
+		entryOffset := icoHeaderSize + i*icoDirEntrySize
+		w := int(data[entryOffset])
 		if w == 0 {
 			w = 256
 		}
-		h := int(data[7+i*16] & 0xff)
+		h := int(data[entryOffset+1])
 		if h == 0 {
 			h = 256
 		}
@@ -31,5 +61,135 @@ func GetIcoSizes(data []byte) []Sizes {
 			Height: h,
 		})
 	}
-	return sizes
+	return sizes, nil
+}
+
+// sizes of frames in generated ico (as Visual Studio template icon)
+var icoFrameSizes = []int{16, 24, 32, 48, 64, 128, 256}
+
+// frames with size equal or greater than threshold are PNG-compressed (supported since Windows Vista),
+// smaller frames are stored as BMP for compatibility with legacy consumers (e.g. some installer and resource tools)
+const DefaultIcoPngThreshold = 256
+
+// CreateIcoFrames returns frames for all standard sizes not greater than the source image size
+func CreateIcoFrames(maxImage image.Image) []image.Image {
+	maxSize := maxImage.Bounds().Dx()
+	var sizeList []int
+	for _, size := range icoFrameSizes {
+		if size > maxSize {
+			break
+		}
+		sizeList = append(sizeList, size)
+	}
+	if len(sizeList) == 0 {
+		return []image.Image{maxImage}
+	}
+
+	result := make([]image.Image, len(sizeList))
+	// resize doesn't fail
+	_ = mapCpuBound(len(sizeList), func(taskIndex int) error {
+		size := sizeList[taskIndex]
+		if size == maxSize {
+			result[taskIndex] = maxImage
+		} else {
+			result[taskIndex] = imaging.Resize(maxImage, size, size, imaging.Lanczos)
+		}
+		return nil
+	})
+	return result
+}
+
+func EncodeIco(writer io.Writer, frames []image.Image, pngThreshold int) error {
+	frameDataList := make([][]byte, len(frames))
+	err := mapCpuBound(len(frames), func(index int) error {
+		frame := frames[index]
+		var err error
+		if frame.Bounds().Dx() >= pngThreshold {
+			frameDataList[index], err = encodeIcoPngFrame(frame)
+		} else {
+			frameDataList[index], err = encodeIcoBmpFrame(frame)
+		}
+		return errors.WithStack(err)
+	})
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, icoHeaderSize+len(frames)*icoDirEntrySize)
+	binary.LittleEndian.PutUint16(header[2:], 1)
+	binary.LittleEndian.PutUint16(header[4:], uint16(len(frames)))
+
+	offset := len(header)
+	for index, frame := range frames {
+		entry := header[icoHeaderSize+index*icoDirEntrySize:]
+		bounds := frame.Bounds()
+		// 0 means 256
+		entry[0] = uint8(bounds.Dx())
+		entry[1] = uint8(bounds.Dy())
+		// planes
+		binary.LittleEndian.PutUint16(entry[4:], 1)
+		// bits per pixel
+		binary.LittleEndian.PutUint16(entry[6:], 32)
+		binary.LittleEndian.PutUint32(entry[8:], uint32(len(frameDataList[index])))
+		binary.LittleEndian.PutUint32(entry[12:], uint32(offset))
+		offset += len(frameDataList[index])
+	}
+
+	_, err = writer.Write(header)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, data := range frameDataList {
+		_, err = writer.Write(data)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+func encodeIcoPngFrame(frame image.Image) ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	err := encoder.Encode(buffer, frame)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return buffer.Bytes(), nil
+}
+
+// 32-bit BGRA DIB without file header, followed by AND mask (all zeros - alpha channel is used)
+func encodeIcoBmpFrame(frame image.Image) ([]byte, error) {
+	bounds := frame.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+
+	// mask row is 1 bit per pixel, padded to 4 bytes
+	maskRowSize := ((width + 31) / 32) * 4
+	pixelDataSize := width * height * 4
+	result := make([]byte, 40+pixelDataSize+maskRowSize*height)
+
+	// BITMAPINFOHEADER, height includes AND mask
+	binary.LittleEndian.PutUint32(result, 40)
+	binary.LittleEndian.PutUint32(result[4:], uint32(width))
+	binary.LittleEndian.PutUint32(result[8:], uint32(height*2))
+	binary.LittleEndian.PutUint16(result[12:], 1)
+	binary.LittleEndian.PutUint16(result[14:], 32)
+	binary.LittleEndian.PutUint32(result[20:], uint32(pixelDataSize+maskRowSize*height))
+
+	pixels := result[40:]
+	offset := 0
+	// bottom-up
+	for y := height - 1; y >= 0; y-- {
+		for x := 0; x < width; x++ {
+			c := color.NRGBAModel.Convert(frame.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+			pixels[offset] = c.B
+			pixels[offset+1] = c.G
+			pixels[offset+2] = c.R
+			pixels[offset+3] = c.A
+			offset += 4
+		}
+	}
+	return result, nil
 }
@@ -1,8 +1,11 @@
 package icons
 
 import (
+	"fmt"
 	"image"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/alecthomas/kingpin"
@@ -10,50 +13,92 @@ import (
 	"github.com/develar/app-builder/pkg/log"
 	"github.com/develar/app-builder/pkg/util"
 	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
 	"github.com/disintegration/imaging"
 	"go.uber.org/zap"
 )
 
 func ConfigureCommand(app *kingpin.Application) error {
-	command := app.Command("icon", "create ICNS or ICO or icon set from PNG files")
+	iconCommand := app.Command("icon", "create ICNS or ICO or icon set from PNG files")
+	configureValidateCommand(iconCommand)
+
+	// default subcommand to keep `icon --format` working
+	command := iconCommand.Command("convert", "create ICNS or ICO or icon set from PNG files").Default()
 
 	configuration := &IconConvertRequest{
-		Sources:         command.Flag("input", "input source file or directory").Short('i').Strings(),
+		Sources:         command.Flag("input", "input source file or directory (AVIF requires avifdec, ImageMagick or sips on macOS, see AVIF_DECODER_PATH)").Short('i').Strings(),
 		FallbackSources: command.Flag("fallback-input", "fallback source file or directory").Strings(),
 		Roots:           command.Flag("root", "base directory to resolve relative path").Strings(),
 	}
 
 	iconOutFormat := command.Flag("format", "output format").Short('f').Required().Enum("icns", "ico", "set")
 	outDir := command.Flag("out", "output directory").Required().String()
+	icoPngThreshold := command.Flag("ico-png-threshold", "ICO frames of this size and larger are PNG-compressed, smaller frames are stored as BMP").Default(strconv.Itoa(DefaultIcoPngThreshold)).Int()
+
+	shape := &IconShapeOptions{}
+	command.Flag("padding", "icon set only: margin on each side as fraction of icon size, e.g. 0.1").Default("0").Float64Var(&shape.Padding)
+	command.Flag("mask", "icon set only: mask applied to artwork").Default(MaskNone).EnumVar(&shape.Mask, MaskNone, MaskRounded, MaskCircle)
+	command.Flag("mask-radius", "icon set only: corner radius of rounded mask as fraction of artwork size").Default("0.2").Float64Var(&shape.MaskRadius)
+
+	adaptiveForeground := command.Flag("adaptive-foreground", "foreground layer to create Windows light/dark tray and Linux symbolic icons from").String()
+	adaptiveBackground := command.Flag("adaptive-background", "background layer, foreground composed over it is used as fallback input for the standard set").String()
 
 	command.Action(func(context *kingpin.ParseContext) error {
 		configuration.OutputFormat = *iconOutFormat
 		configuration.OutputDir = *outDir
+		configuration.IcoPngThreshold = *icoPngThreshold
+		configuration.Shape = shape
+
+		var adaptiveResult *AdaptiveIconResult
+		if *adaptiveForeground != "" {
+			var err error
+			adaptiveResult, err = CreateAdaptiveIcons(&AdaptiveIconRequest{
+				Foreground: *adaptiveForeground,
+				Background: *adaptiveBackground,
+				OutputDir:  *outDir,
+			})
+			if err != nil {
+				return handleConvertError(err)
+			}
+
+			if adaptiveResult.Composite != "" {
+				*configuration.FallbackSources = append(*configuration.FallbackSources, adaptiveResult.Composite)
+			}
+		}
 
 		result, err := ConvertIcon(configuration)
 		if err != nil {
-			switch t := errors.Cause(err).(type) {
-			case *ImageSizeError:
-				log.Debug("cannot convert icon", zap.Error(err))
-				return writeUserError(t)
-
-			case *ImageFormatError:
-				log.Debug("cannot convert icon", zap.Error(err))
-				return writeUserError(t)
-
-			default:
-				return err
-			}
+			return handleConvertError(err)
 		}
 
+		result.Adaptive = adaptiveResult
 		return util.WriteJsonToStdOut(result)
 	})
 
 	return nil
 }
 
+func handleConvertError(err error) error {
+	switch t := errors.Cause(err).(type) {
+	case *ImageSizeError:
+		log.Debug("cannot convert icon", zap.Error(err))
+		return writeUserError(t)
+
+	case *ImageFormatError:
+		log.Debug("cannot convert icon", zap.Error(err))
+		return writeUserError(t)
+
+	case util.MessageError:
+		log.Debug("cannot convert icon", zap.Error(err))
+		return writeUserError(t)
+
+	default:
+		return err
+	}
+}
+
 func ConvertIcon(configuration *IconConvertRequest) (*IconConvertResult, error) {
-	result, err := doConvertIcon(createCommonIconSources(*configuration.Sources, configuration.OutputFormat), *configuration.Roots, configuration.OutputFormat, configuration.OutputDir)
+	result, err := doConvertIcon(createCommonIconSources(*configuration.Sources, configuration.OutputFormat), *configuration.Roots, configuration.OutputFormat, configuration.OutputDir, configuration.IcoPngThreshold)
 	if err != nil {
 		return nil, err
 	}
@@ -63,7 +108,7 @@ func ConvertIcon(configuration *IconConvertRequest) (*IconConvertResult, error)
 	// try using fallback sources
 	if result == nil {
 		log.Debug("no icons found, using provided fallback sources")
-		result, err = doConvertIcon(*configuration.FallbackSources, *configuration.Roots, configuration.OutputFormat, configuration.OutputDir)
+		result, err = doConvertIcon(*configuration.FallbackSources, *configuration.Roots, configuration.OutputFormat, configuration.OutputDir, configuration.IcoPngThreshold)
 		if err != nil {
 			return nil, err
 		}
@@ -71,11 +116,28 @@ func ConvertIcon(configuration *IconConvertRequest) (*IconConvertResult, error)
 		isFallback = true
 	}
 
+	if configuration.Shape.isEnabled() {
+		if configuration.OutputFormat == "set" {
+			result, err = applyIconShape(result, configuration.OutputDir, configuration.Shape)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			log.Warn("padding and mask are applied only to icon set", zap.String("format", configuration.OutputFormat))
+		}
+	}
+
 	return &IconConvertResult{Icons: result, IsFallback: isFallback}, nil
 }
 
 func isFileHasImageFormatExtension(name string, outputFormat string) bool {
-	return strings.HasSuffix(name, "."+outputFormat) || strings.HasSuffix(name, ".png") || strings.HasSuffix(name, ".ico") || strings.HasSuffix(name, ".svg") || strings.HasSuffix(name, ".icns")
+	return strings.HasSuffix(name, "."+outputFormat) || strings.HasSuffix(name, ".png") || strings.HasSuffix(name, ".ico") || strings.HasSuffix(name, ".svg") || strings.HasSuffix(name, ".icns") || isDecodeOnlyFormat(name)
+}
+
+// formats that are accepted as source, but not used as is for any output format
+func isDecodeOnlyFormat(name string) bool {
+	lowerCaseName := strings.ToLower(name)
+	return strings.HasSuffix(lowerCaseName, ".webp") || strings.HasSuffix(lowerCaseName, ".avif")
 }
 
 func createCommonIconSources(sources []string, outputFormat string) []string {
@@ -125,7 +187,20 @@ func validateImageSize(file string, recommendedMinSize int) error {
 	}
 
 	if IsIco(firstFileBytes) {
-		for _, size := range GetIcoSizes(firstFileBytes) {
+		dirSize := GetIcoDirSize(firstFileBytes)
+		if dirSize > len(firstFileBytes) {
+			firstFileBytes, err = fs.ReadFile(file, dirSize)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+
+		sizes, err := GetIcoSizes(firstFileBytes)
+		if err != nil {
+			return errors.WithStack(&ImageFormatError{file, "ERR_ICON_UNKNOWN_FORMAT"})
+		}
+
+		for _, size := range sizes {
 			if size.Width >= recommendedMinSize && size.Height >= recommendedMinSize {
 				return nil
 			}
@@ -151,7 +226,7 @@ func outputFormatToSingleFileExtension(outputFormat string) string {
 	return "." + outputFormat
 }
 
-func doConvertIcon(sourceFiles []string, roots []string, outputFormat string, outDir string) ([]IconInfo, error) {
+func doConvertIcon(sourceFiles []string, roots []string, outputFormat string, outDir string, icoPngThreshold int) ([]IconInfo, error) {
 	// allowed to specify path to icns without extension, so, if file not resolved, try to add ".icns" extension
 	outExt := outputFormatToSingleFileExtension(outputFormat)
 	resolvedPath, fileInfo, err := resolveSourceFile(sourceFiles, roots)
@@ -220,31 +295,55 @@ func doConvertIcon(sourceFiles []string, roots []string, outputFormat string, ou
 		maxIcon := icons[len(icons)-1]
 		inputInfo.MaxIconPath = maxIcon.File
 		inputInfo.MaxIconSize = maxIcon.Size
-	} else {
+	} else if strings.HasSuffix(resolvedPath, ".svg") {
 		if outputFormat == "set" {
-			if strings.HasSuffix(resolvedPath, ".icns") {
-				result, err := ConvertIcnsToPng(resolvedPath, outDir)
-				if err != nil {
-					return nil, errors.WithStack(err)
-				}
-				return result, nil
-			} else if strings.HasSuffix(resolvedPath, ".svg") {
-				return []IconInfo{
-					{
-						File: resolvedPath,
-						Size: 1024,
-					},
-				}, nil
+			return rasterizeSvgForLinux(resolvedPath, outDir)
+		}
+
+		err = fsutil.EnsureDir(outDir)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		tempDir, err := util.TempDir(outDir, ".svg")
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		defer func() {
+			_ = os.RemoveAll(tempDir)
+		}()
+
+		err = configureInputInfoFromSvg(resolvedPath, tempDir, isOutputFormatIco, &inputInfo)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if outputFormat == "set" && strings.HasSuffix(resolvedPath, ".icns") {
+			result, err := ConvertIcnsToPng(resolvedPath, outDir)
+			if err != nil {
+				return nil, errors.WithStack(err)
 			}
+			return result, nil
 		}
 
 		err = configureInputInfoFromSingleFile(resolvedPath, isOutputFormatIco, &inputInfo)
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
+
+		if outputFormat == "set" && isDecodeOnlyFormat(resolvedPath) {
+			// icon set consists of PNG files
+			maxIconFile := filepath.Join(outDir, fmt.Sprintf("icon_%dx%d.png", inputInfo.MaxIconSize, inputInfo.MaxIconSize))
+			err = SaveImage(inputInfo.maxImage, maxIconFile, PNG)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			return resizePngForLinux(&inputInfo, maxIconFile, outDir)
+		}
 	}
 
-	return convertSingleFile(&inputInfo, filepath.Join(outDir, "icon"+outExt), outputFormat)
+	return convertSingleFile(&inputInfo, filepath.Join(outDir, "icon"+outExt), outputFormat, icoPngThreshold)
 }
 
 // https://github.com/electron-userland/electron-builder/issues/2654#issuecomment-369972916
@@ -280,7 +379,7 @@ func resizePngForLinux(inputInfo *InputFileInfo, iconFileName string, outDir str
 	return result, nil
 }
 
-func convertSingleFile(inputInfo *InputFileInfo, outFile string, outputFormat string) ([]IconInfo, error) {
+func convertSingleFile(inputInfo *InputFileInfo, outFile string, outputFormat string, icoPngThreshold int) ([]IconInfo, error) {
 	switch outputFormat {
 	case "icns":
 		err := ConvertToIcns(*inputInfo, outFile)
@@ -295,7 +394,7 @@ func convertSingleFile(inputInfo *InputFileInfo, outFile string, outputFormat st
 			return nil, errors.WithStack(err)
 		}
 
-		err = SaveImage(maxImage, outFile, ICO)
+		err = SaveIco(CreateIcoFrames(maxImage), outFile, icoPngThreshold)
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
@@ -307,12 +406,6 @@ func convertSingleFile(inputInfo *InputFileInfo, outFile string, outputFormat st
 }
 
 func configureInputInfoFromSingleFile(file string, isOutputFormatIco bool, inputInfo *InputFileInfo) error {
-	if strings.HasSuffix(file, ".svg") {
-		inputInfo.MaxIconSize = 1024
-		inputInfo.SizeToPath[inputInfo.MaxIconSize] = file
-		return nil
-	}
-
 	maxImage, err := loadImage(file, inputInfo.recommendedMinSize)
 	if err != nil {
 		return errors.WithStack(err)
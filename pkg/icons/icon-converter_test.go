@@ -1,9 +1,15 @@
 package icons
 
 import (
+	"bufio"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -61,12 +67,12 @@ var _ = Describe("Blockmap", func() {
 	})
 
 	It("CheckIcoImageSize", func() {
-		_, err := doConvertIcon([]string{filepath.Join(getTestDataPath(), "icon.ico")}, nil, "ico", tmpDir)
+		_, err := doConvertIcon([]string{filepath.Join(getTestDataPath(), "icon.ico")}, nil, "ico", tmpDir, DefaultIcoPngThreshold)
 		Expect(err).NotTo(HaveOccurred())
 	})
 
 	It("IcnsToIco", func() {
-		files, err := doConvertIcon([]string{filepath.Join(getTestDataPath(), "icon.icns")}, nil, "ico", tmpDir)
+		files, err := doConvertIcon([]string{filepath.Join(getTestDataPath(), "icon.icns")}, nil, "ico", tmpDir, DefaultIcoPngThreshold)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(len(files)).To(Equal(1))
 		file := files[0].File
@@ -76,6 +82,12 @@ var _ = Describe("Blockmap", func() {
 		data, err := ioutil.ReadFile(file)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(GetIcoSizes(data)).To(Equal([]Sizes{
+			{Width: 16, Height: 16},
+			{Width: 24, Height: 24},
+			{Width: 32, Height: 32},
+			{Width: 48, Height: 48},
+			{Width: 64, Height: 64},
+			{Width: 128, Height: 128},
 			{Width: 256, Height: 256},
 		}))
 	})
@@ -94,7 +106,7 @@ var _ = Describe("Blockmap", func() {
 	})
 
 	It("LargePngTo256Ico", func() {
-		files, err := doConvertIcon([]string{filepath.Join(getTestDataPath(), "512x512.png")}, nil, "ico", tmpDir)
+		files, err := doConvertIcon([]string{filepath.Join(getTestDataPath(), "512x512.png")}, nil, "ico", tmpDir, DefaultIcoPngThreshold)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(len(files)).To(Equal(1))
 		file := files[0].File
@@ -106,10 +118,203 @@ var _ = Describe("Blockmap", func() {
 		images, err := ico.DecodeAll(reader)
 		Expect(err).NotTo(HaveOccurred())
 
-		Expect(len(images)).To(Equal(1))
+		Expect(len(images)).To(Equal(len(icoFrameSizes)))
 
-		imageSize := images[0].Bounds().Max
+		imageSize := images[len(images)-1].Bounds().Max
 		Expect(imageSize.X).To(Equal(256))
 		Expect(imageSize.Y).To(Equal(256))
 	})
+
+	It("PngToIcnsRetinaSlots", func() {
+		files, err := doConvertIcon([]string{filepath.Join(getTestDataPath(), "512x512.png")}, nil, "icns", tmpDir, DefaultIcoPngThreshold)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(files)).To(Equal(1))
+
+		reader, err := os.Open(files[0].File)
+		Expect(err).NotTo(HaveOccurred())
+		defer util.Close(reader)
+
+		bufferedReader := bufio.NewReader(reader)
+		isIcns, err := IsIcns(bufferedReader)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(isIcns).To(BeTrue())
+
+		typeToImage, err := ReadIcns(bufferedReader)
+		Expect(err).NotTo(HaveOccurred())
+
+		var types []string
+		for osType := range typeToImage {
+			types = append(types, osType)
+		}
+		// 512@2x (ic10) is not generated - source is not upscaled
+		Expect(types).To(ConsistOf("icp4", "ic11", "icp5", "ic12", "ic07", "ic13", "ic08", "ic14", "ic09"))
+	})
+
+	It("DeterministicOutput", func() {
+		// sizes are resized in parallel, but output must not depend on completion order
+		source := filepath.Join(getTestDataPath(), "512x512.png")
+		var previous []byte
+		for i := 0; i < 3; i++ {
+			outDir := filepath.Join(tmpDir, strconv.Itoa(i))
+			files, err := doConvertIcon([]string{source}, nil, "icns", outDir, DefaultIcoPngThreshold)
+			Expect(err).NotTo(HaveOccurred())
+
+			data, err := ioutil.ReadFile(files[0].File)
+			Expect(err).NotTo(HaveOccurred())
+			if previous != nil {
+				Expect(data).To(Equal(previous))
+			}
+			previous = data
+		}
+
+		files, err := doConvertIcon([]string{source}, nil, "ico", tmpDir, DefaultIcoPngThreshold)
+		Expect(err).NotTo(HaveOccurred())
+		data, err := ioutil.ReadFile(files[0].File)
+		Expect(err).NotTo(HaveOccurred())
+		sizes, err := GetIcoSizes(data)
+		Expect(err).NotTo(HaveOccurred())
+		var widths []int
+		for _, size := range sizes {
+			widths = append(widths, size.Width)
+		}
+		Expect(widths).To(Equal([]int{16, 24, 32, 48, 64, 128, 256}))
+	})
+
+	It("WebpToIco", func() {
+		files, err := doConvertIcon([]string{filepath.Join(getTestDataPath(), "icon.webp")}, nil, "ico", tmpDir, DefaultIcoPngThreshold)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files[0].File).To(Equal(filepath.Join(tmpDir, "icon.ico")))
+
+		data, err := ioutil.ReadFile(files[0].File)
+		Expect(err).NotTo(HaveOccurred())
+		sizes, err := GetIcoSizes(data)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sizes[len(sizes)-1]).To(Equal(Sizes{Width: 256, Height: 256}))
+	})
+
+	It("WebpToSet", func() {
+		files, err := ConvertIcon(&IconConvertRequest{
+			Sources:      &[]string{filepath.Join(getTestDataPath(), "icon.webp")},
+			Roots:        &[]string{},
+			OutputFormat: "set",
+			OutputDir:    tmpDir,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		for _, icon := range files.Icons {
+			Expect(filepath.Dir(icon.File)).To(Equal(tmpDir))
+			Expect(strings.HasSuffix(icon.File, ".png")).To(BeTrue())
+		}
+		Expect(files.Icons[len(files.Icons)-1].Size).To(Equal(400))
+	})
+
+	It("AdaptiveIcons", func() {
+		sourceFile := filepath.Join(getTestDataPath(), "512x512.png")
+		result, err := CreateAdaptiveIcons(&AdaptiveIconRequest{Foreground: sourceFile, Background: sourceFile, OutputDir: tmpDir})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Composite).To(BeAnExistingFile())
+		Expect(result.Manifest).To(BeAnExistingFile())
+		Expect(len(result.TrayLight)).To(Equal(len(trayIconSizes)))
+		Expect(len(result.TrayDark)).To(Equal(len(trayIconSizes)))
+		Expect(len(result.Symbolic)).To(Equal(len(symbolicIconSizes)))
+
+		trayDark, err := LoadImage(result.TrayDark[len(result.TrayDark)-1].File)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(trayDark.Bounds().Dx()).To(Equal(32))
+		for y := 0; y < 32; y++ {
+			for x := 0; x < 32; x++ {
+				r, g, b, a := trayDark.At(x, y).RGBA()
+				if a != 0 {
+					// premultiplied, white glyph has all channels equal to alpha
+					Expect([]uint32{r, g, b}).To(Equal([]uint32{a, a, a}))
+				}
+			}
+		}
+	})
+
+	It("IcoPngThreshold", func() {
+		sourceFile := filepath.Join(getTestDataPath(), "512x512.png")
+		for _, threshold := range []int{DefaultIcoPngThreshold, 48} {
+			files, err := doConvertIcon([]string{sourceFile}, nil, "ico", tmpDir, threshold)
+			Expect(err).NotTo(HaveOccurred())
+
+			data, err := ioutil.ReadFile(files[0].File)
+			Expect(err).NotTo(HaveOccurred())
+
+			sizes, err := GetIcoSizes(data)
+			Expect(err).NotTo(HaveOccurred())
+			for index, size := range sizes {
+				entry := data[icoHeaderSize+index*icoDirEntrySize:]
+				offset := binary.LittleEndian.Uint32(entry[12:])
+				isPng := string(data[offset+1:offset+4]) == "PNG"
+				Expect(isPng).To(Equal(size.Width >= threshold), "frame %d", size.Width)
+			}
+		}
+	})
+
+	It("Validate", func() {
+		nonSquareFile := filepath.Join(tmpDir, "non-square.png")
+		err := SaveImage(image.NewNRGBA(image.Rect(0, 0, 300, 200)), nonSquareFile, PNG)
+		Expect(err).NotTo(HaveOccurred())
+
+		result, err := ValidateIcons([]string{filepath.Join(getTestDataPath(), "icon.ico"), filepath.Join(getTestDataPath(), "icon.icns"), nonSquareFile}, 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.IsValid).To(BeFalse())
+		Expect(result.Files[0].Issues).To(BeEmpty())
+		Expect(result.Files[1].Format).To(Equal("icns"))
+		Expect(result.Files[1].Issues).To(ContainElement(IconIssue{Severity: SeverityWarning, Code: "ICNS_MISSING_SIZE", Message: "icp4 (16x16) is missing"}))
+		Expect(result.Files[2].Issues).To(ContainElement(IconIssue{Severity: SeverityError, Code: "ICON_NOT_SQUARE", Message: "image is not square (300x200)"}))
+		Expect(result.Summary.Findings[0].Severity).To(Equal(SeverityError))
+		Expect(result.Summary.IsTruncated).To(BeFalse())
+
+		// stop on the first error
+		result, err = ValidateIcons([]string{nonSquareFile, filepath.Join(getTestDataPath(), "icon.icns")}, 1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Files).To(HaveLen(1))
+		Expect(result.Summary.IsTruncated).To(BeTrue())
+	})
 })
+
+func TestShapeImage(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	source := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+	draw.Draw(source, source.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+
+	result := shapeImage(source, &IconShapeOptions{Padding: 0.1, Mask: MaskCircle})
+	g.Expect(result.Bounds().Dx()).To(Equal(100))
+	// padding
+	g.Expect(result.NRGBAAt(5, 50).A).To(Equal(uint8(0)))
+	// outside of circle
+	g.Expect(result.NRGBAAt(11, 11).A).To(Equal(uint8(0)))
+	g.Expect(result.NRGBAAt(50, 50).A).To(Equal(uint8(255)))
+	g.Expect(result.NRGBAAt(11, 50).A).To(Equal(uint8(255)))
+
+	result = shapeImage(source, &IconShapeOptions{Mask: MaskRounded, MaskRadius: 0.1})
+	g.Expect(result.NRGBAAt(0, 0).A).To(Equal(uint8(0)))
+	g.Expect(result.NRGBAAt(0, 50).A).To(Equal(uint8(255)))
+	g.Expect(result.NRGBAAt(5, 5).A).To(Equal(uint8(255)))
+}
+
+func TestAvifIsNotRegistered(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	data := "\x00\x00\x00\x1cftypavif\x00\x00\x00\x00"
+	g.Expect(isAvif(bufio.NewReader(strings.NewReader(data)))).To(BeTrue())
+	g.Expect(isAvif(bufio.NewReader(strings.NewReader("\x00\x00\x00\x1cftypheic")))).To(BeFalse())
+	// decoding requires external tool, so, image.Decode of other packages doesn't decode AVIF
+	_, _, err := image.DecodeConfig(strings.NewReader(data))
+	g.Expect(err).To(Equal(image.ErrFormat))
+}
+
+func TestAvifDecoderNotFound(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	for name, value := range map[string]string{"PATH": "", "AVIF_DECODER_PATH": ""} {
+		defer os.Setenv(name, os.Getenv(name))
+		g.Expect(os.Setenv(name, value)).To(Succeed())
+	}
+
+	_, err := decodeAvif(strings.NewReader("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00"))
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.(util.MessageError).ErrorCode()).To(Equal("ERR_ICON_AVIF_DECODER_NOT_FOUND"))
+}
@@ -23,11 +23,18 @@ type IconConvertRequest struct {
 
 	OutputFormat string
 	OutputDir    string
+
+	IcoPngThreshold int
+
+	// applied only to icon set
+	Shape *IconShapeOptions
 }
 
 type IconConvertResult struct {
 	Icons      []IconInfo `json:"icons"`
 	IsFallback bool       `json:"isFallback"`
+
+	Adaptive *AdaptiveIconResult `json:"adaptive,omitempty"`
 }
 
 type MisConfigurationError struct {
@@ -11,6 +11,8 @@ import (
 	"github.com/develar/app-builder/pkg/util"
 	"github.com/develar/errors"
 	"github.com/develar/go-fs-util"
+	// register WebP decoder for source images
+	_ "golang.org/x/image/webp"
 )
 
 const (
@@ -58,6 +60,9 @@ func LoadImage(file string) (image.Image, error) {
 		return nil, NewImageSizeError(file, 256)
 	}
 
+	if isAvif(bufferedReader) {
+		return decodeAvif(bufferedReader)
+	}
 	return DecodeImageAndClose(bufferedReader, reader)
 }
 
@@ -67,7 +72,13 @@ func DecodeImageConfig(file string) (*image.Config, error) {
 		return nil, errors.WithStack(err)
 	}
 
-	result, _, err := image.DecodeConfig(reader)
+	var result image.Config
+	bufferedReader := bufio.NewReader(reader)
+	if isAvif(bufferedReader) {
+		result, err = decodeAvifConfig(bufferedReader)
+	} else {
+		result, _, err = image.DecodeConfig(bufferedReader)
+	}
 	if err != nil {
 		util.Close(reader)
 
@@ -99,6 +110,20 @@ func SaveImage(image image.Image, outFileName string, format int) error {
 	return SaveImage2(image, outFile, format)
 }
 
+func SaveIco(frames []image.Image, outFileName string, pngThreshold int) error {
+	outFile, err := fsutil.CreateFile(outFileName)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(outFile)
+	err = EncodeIco(writer, frames, pngThreshold)
+	if err != nil {
+		return fsutil.CloseAndCheckError(err, outFile)
+	}
+	return fsutil.CloseAndCheckError(writer.Flush(), outFile)
+}
+
 func SaveImage2(image image.Image, outFile io.WriteCloser, format int) error {
 	writer := bufio.NewWriter(outFile)
 
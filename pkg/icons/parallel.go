@@ -0,0 +1,17 @@
+package icons
+
+import (
+	"runtime"
+
+	"github.com/develar/app-builder/pkg/util"
+)
+
+// mapCpuBound runs resize/encode tasks on a pool sized to GOMAXPROCS - such tasks are CPU-bound, so, more workers only increase
+// peak memory usage (each task holds own resized image). Task must write result by own index to keep output order deterministic.
+func mapCpuBound(taskCount int, task func(taskIndex int) error) error {
+	return util.MapAsyncConcurrency(taskCount, runtime.GOMAXPROCS(0), func(taskIndex int) (func() error, error) {
+		return func() error {
+			return task(taskIndex)
+		}, nil
+	})
+}
@@ -0,0 +1,134 @@
+package icons
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"path/filepath"
+	"strings"
+
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/disintegration/imaging"
+	"go.uber.org/zap"
+)
+
+const (
+	MaskNone    = "none"
+	MaskRounded = "rounded"
+	MaskCircle  = "circle"
+)
+
+// Linux icon themes and snap store expect artwork not to be edge-to-edge
+type IconShapeOptions struct {
+	// margin on each side as fraction of icon size (0.1 means that artwork occupies 80% of icon)
+	Padding float64
+	Mask    string
+	// corner radius of rounded mask as fraction of artwork size (0.5 is a circle)
+	MaskRadius float64
+}
+
+func (t *IconShapeOptions) isEnabled() bool {
+	return t != nil && (t.Padding > 0 || (t.Mask != "" && t.Mask != MaskNone))
+}
+
+func (t *IconShapeOptions) validate() error {
+	if t.Padding < 0 || t.Padding >= 0.5 {
+		return util.NewMessageError(fmt.Sprintf("padding must be in range [0, 0.5), but %v", t.Padding), "ERR_ICON_INVALID_PADDING")
+	}
+	if t.MaskRadius < 0 || t.MaskRadius > 0.5 {
+		return util.NewMessageError(fmt.Sprintf("mask radius must be in range [0, 0.5], but %v", t.MaskRadius), "ERR_ICON_INVALID_MASK_RADIUS")
+	}
+	return nil
+}
+
+// applyIconShape pads and masks each PNG of the icon set, result is written to the outDir (source files are not modified)
+func applyIconShape(icons []IconInfo, outDir string, options *IconShapeOptions) ([]IconInfo, error) {
+	err := options.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]IconInfo, len(icons))
+	err = mapCpuBound(len(icons), func(taskIndex int) error {
+		icon := icons[taskIndex]
+		result[taskIndex] = icon
+		if !strings.HasSuffix(strings.ToLower(icon.File), ".png") {
+			log.Warn("padding and mask are supported only for PNG icons, icon is used as is", zap.String("file", icon.File))
+			return nil
+		}
+
+		sourceImage, err := LoadImage(icon.File)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		size := sourceImage.Bounds().Dx()
+		outFile := filepath.Join(outDir, fmt.Sprintf("icon_%dx%d.png", size, size))
+		err = SaveImage(shapeImage(sourceImage, options), outFile, PNG)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		result[taskIndex] = IconInfo{File: outFile, Size: icon.Size}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func shapeImage(sourceImage image.Image, options *IconShapeOptions) *image.NRGBA {
+	bounds := sourceImage.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+
+	margin := int(math.Round(float64(width) * options.Padding))
+	artworkWidth := width - margin*2
+	artworkHeight := height - margin*2
+
+	var artwork *image.NRGBA
+	if margin == 0 {
+		artwork = imaging.Clone(sourceImage)
+	} else {
+		artwork = imaging.Resize(sourceImage, artworkWidth, artworkHeight, imaging.Lanczos)
+	}
+
+	switch options.Mask {
+	case MaskCircle:
+		applyRoundedMask(artwork, 0.5)
+	case MaskRounded:
+		applyRoundedMask(artwork, options.MaskRadius)
+	}
+
+	result := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(result, image.Rect(margin, margin, margin+artworkWidth, margin+artworkHeight), artwork, image.Point{}, draw.Src)
+	return result
+}
+
+// radius is a fraction of the smaller side, edges are antialiased using signed distance to the rounded rectangle
+func applyRoundedMask(img *image.NRGBA, radiusFraction float64) {
+	bounds := img.Bounds()
+	halfWidth := float64(bounds.Dx()) / 2
+	halfHeight := float64(bounds.Dy()) / 2
+	radius := math.Min(halfWidth, halfHeight) * 2 * radiusFraction
+
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			qx := math.Abs(float64(x)+0.5-halfWidth) - (halfWidth - radius)
+			qy := math.Abs(float64(y)+0.5-halfHeight) - (halfHeight - radius)
+			distance := math.Hypot(math.Max(qx, 0), math.Max(qy, 0)) + math.Min(math.Max(qx, qy), 0) - radius
+			coverage := math.Min(math.Max(0.5-distance, 0), 1)
+			if coverage == 1 {
+				continue
+			}
+
+			c := img.NRGBAAt(bounds.Min.X+x, bounds.Min.Y+y)
+			c.A = uint8(math.Round(float64(c.A) * coverage))
+			img.SetNRGBA(bounds.Min.X+x, bounds.Min.Y+y, c)
+		}
+	}
+}
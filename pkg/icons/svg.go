@@ -0,0 +1,115 @@
+package icons
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"go.uber.org/zap"
+)
+
+// sizes rendered directly from vector source for the icon set (each size rendered from vector instead of downscaling to keep small sizes crisp)
+var svgSetSizes = []int{16, 32, 48, 64, 128, 256, 512, 1024}
+
+type svgRasterizer struct {
+	path string
+	name string
+}
+
+// go doesn't have maintained SVG renderer, so, as for other formats (iconutil, opj_decompress), external tool is used
+func findSvgRasterizer() (*svgRasterizer, error) {
+	customPath := os.Getenv("SVG_RASTERIZER_PATH")
+	if customPath != "" {
+		return &svgRasterizer{path: customPath, name: filepath.Base(customPath)}, nil
+	}
+
+	//noinspection SpellCheckingInspection
+	for _, name := range []string{"rsvg-convert", "resvg", "inkscape"} {
+		path, err := exec.LookPath(name)
+		if err == nil {
+			return &svgRasterizer{path: path, name: name}, nil
+		}
+	}
+
+	return nil, util.NewMessageError("cannot rasterize SVG icon: please install rsvg-convert (librsvg), resvg or inkscape, or set SVG_RASTERIZER_PATH", "ERR_ICON_SVG_RASTERIZER_NOT_FOUND")
+}
+
+func (t *svgRasterizer) createCommand(inFile string, size int, outFile string) *exec.Cmd {
+	sizeString := strconv.Itoa(size)
+	//noinspection SpellCheckingInspection
+	switch t.name {
+	case "resvg", "resvg.exe":
+		return exec.Command(t.path, "-w", sizeString, "-h", sizeString, inFile, outFile)
+	case "inkscape", "inkscape.exe":
+		return exec.Command(t.path, inFile, "--export-type=png", "--export-filename="+outFile, "-w", sizeString, "-h", sizeString)
+	default:
+		return exec.Command(t.path, "--keep-aspect-ratio", "-w", sizeString, "-h", sizeString, "-f", "png", "-o", outFile, inFile)
+	}
+}
+
+func rasterizeSvg(inFile string, outFileNameFormat string, sizeList []int) ([]IconInfo, error) {
+	rasterizer, err := findSvgRasterizer()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug("rasterize svg", zap.String("file", inFile), zap.String("rasterizer", rasterizer.path), zap.Ints("sizes", sizeList))
+
+	result := make([]IconInfo, len(sizeList))
+	err = util.MapAsync(len(sizeList), func(taskIndex int) (func() error, error) {
+		size := sizeList[taskIndex]
+		outFile := fmt.Sprintf(outFileNameFormat, size, size)
+		result[taskIndex] = IconInfo{File: outFile, Size: size}
+		return func() error {
+			_, err := util.Execute(rasterizer.createCommand(inFile, size, outFile))
+			return err
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sortBySize(result)
+	return result, nil
+}
+
+func rasterizeSvgForLinux(inFile string, outDir string) ([]IconInfo, error) {
+	result, err := rasterizeSvg(inFile, filepath.Join(outDir, "icon_%dx%d.png"), svgSetSizes)
+	if err != nil {
+		if _, ok := errors.Cause(err).(util.MessageError); ok {
+			// linux desktop environments support scalable icons, so, svg can be used as is
+			log.Debug("svg will be used as is", zap.Error(err))
+			return []IconInfo{{File: inFile, Size: 1024}}, nil
+		}
+		return nil, err
+	}
+	return result, nil
+}
+
+func configureInputInfoFromSvg(inFile string, tempDir string, isOutputFormatIco bool, inputInfo *InputFileInfo) error {
+	var sizeList []int
+	if isOutputFormatIco {
+		sizeList = []int{256}
+	} else {
+		sizeList = icnsExpectedSizes
+	}
+
+	icons, err := rasterizeSvg(inFile, filepath.Join(tempDir, "icon_%dx%d.png"), sizeList)
+	if err != nil {
+		return err
+	}
+
+	for _, icon := range icons {
+		inputInfo.SizeToPath[icon.Size] = icon.File
+	}
+
+	maxIcon := icons[len(icons)-1]
+	inputInfo.MaxIconSize = maxIcon.Size
+	inputInfo.MaxIconPath = maxIcon.File
+	return nil
+}
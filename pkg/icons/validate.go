@@ -0,0 +1,337 @@
+package icons
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/diagnostics"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+)
+
+const (
+	SeverityError   = diagnostics.SeverityError
+	SeverityWarning = diagnostics.SeverityWarning
+	SeverityInfo    = diagnostics.SeverityInfo
+)
+
+var pngSignature = []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}
+
+// sizes that Windows uses for shell (explorer, taskbar, start menu) at 100% scale
+var icoRecommendedSizes = []int{16, 32, 48, 256}
+
+// types written by iconutil for legacy systems, valid but not required
+var icnsLegacyTypes = []string{"ICON", "ICN#", "icm#", "icm4", "icm8", "ics#", "ics4", "ics8", "is32", "s8mk", "icl4", "icl8", "il32", "l8mk", "ich#", "ich4", "ich8", "ih32", "h8mk", "it32", "t8mk", "ic04", "ic05", "icsb", "icsB", "sb24", "SB24", "TOC "}
+
+type IconValidationResult struct {
+	Files   []*IconFileDiagnostics `json:"files"`
+	IsValid bool                   `json:"isValid"`
+	// issues of all files grouped and deduplicated (e.g. the same missing size in several icons)
+	Summary *diagnostics.Report `json:"summary"`
+}
+
+type IconFileDiagnostics struct {
+	File   string      `json:"file"`
+	Format string      `json:"format"`
+	Sizes  []Sizes     `json:"sizes"`
+	Issues []IconIssue `json:"issues"`
+}
+
+type IconIssue struct {
+	Severity string `json:"severity"`
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+}
+
+func (t *IconFileDiagnostics) add(severity string, code string, message string, args ...interface{}) {
+	t.Issues = append(t.Issues, IconIssue{Severity: severity, Code: code, Message: fmt.Sprintf(message, args...)})
+}
+
+func configureValidateCommand(iconCommand *kingpin.CmdClause) {
+	command := iconCommand.Command("validate", "inspect ICNS, ICO and PNG files and report problems as JSON")
+	inputs := command.Flag("input", "input file").Short('i').Required().ExistingFiles()
+	maxErrors := diagnostics.ConfigureMaxErrorsFlag(command)
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		result, err := ValidateIcons(*inputs, *maxErrors)
+		if err != nil {
+			return err
+		}
+		return util.WriteJsonToStdOut(result)
+	})
+}
+
+// ValidateIcons validates all files and reports all issues, unless maxErrors (0 - no limit) is reached.
+// Unreadable file is reported as an issue and doesn't stop validation of other files.
+func ValidateIcons(files []string, maxErrors int) (*IconValidationResult, error) {
+	result := &IconValidationResult{IsValid: true}
+	collector := diagnostics.NewCollector(maxErrors)
+	for _, file := range files {
+		if collector.IsLimitReached() {
+			collector.MarkTruncated()
+			break
+		}
+
+		fileDiagnostics, err := ValidateIcon(file)
+		if err != nil {
+			fileDiagnostics = &IconFileDiagnostics{File: file, Format: "unknown", Sizes: []Sizes{}, Issues: []IconIssue{}}
+			fileDiagnostics.add(SeverityError, "ERR_ICON_READ", "cannot read: %v", errors.Cause(err))
+		}
+
+		for _, issue := range fileDiagnostics.Issues {
+			collector.Add(issue.Severity, issue.Code, file, issue.Message)
+		}
+		result.Files = append(result.Files, fileDiagnostics)
+	}
+
+	result.IsValid = !collector.HasErrors()
+	result.Summary = collector.Report()
+	return result, nil
+}
+
+func ValidateIcon(file string) (*IconFileDiagnostics, error) {
+	// icons are small, so, it is ok to read the whole file
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	result := &IconFileDiagnostics{File: file, Sizes: []Sizes{}, Issues: []IconIssue{}}
+	switch {
+	case bytes.HasPrefix(data, icnsHeader):
+		result.Format = "icns"
+		validateIcnsData(data, result)
+	case IsIco(data):
+		result.Format = "ico"
+		validateIcoData(data, result)
+	case bytes.HasPrefix(data, pngSignature):
+		result.Format = "png"
+		validatePngData(data, "", 256, result)
+	default:
+		result.Format = "unknown"
+		result.add(SeverityError, "ERR_ICON_UNKNOWN_FORMAT", "%s is not ICNS, ICO or PNG", filepath.Base(file))
+	}
+	return result, nil
+}
+
+func validateIcnsData(data []byte, result *IconFileDiagnostics) {
+	typeToImage, err := ReadIcns(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		result.add(SeverityError, "ERR_ICON_CORRUPTED", "%v", err)
+		return
+	}
+
+	for osType, subImage := range typeToImage {
+		if isKnownIcnsType(osType) || containsString(icnsLegacyTypes, osType) {
+			continue
+		}
+		result.add(SeverityWarning, "ICNS_UNKNOWN_TYPE", "unknown icon type %q (%d bytes) will be ignored by macOS", osType, subImage.Length)
+	}
+
+	for _, slot := range icnsSlots {
+		subImage, ok := typeToImage[slot.osType]
+		if !ok {
+			severity := SeverityWarning
+			if slot.size == 512 && !slot.isRetina {
+				// required for Finder and Dock
+				severity = SeverityError
+			}
+			result.add(severity, "ICNS_MISSING_SIZE", "%s (%s) is missing", slot.osType, slot.label())
+			continue
+		}
+
+		imageData := data[subImage.Offset : subImage.Offset+subImage.Length]
+		if !bytes.HasPrefix(imageData, pngSignature) {
+			// JPEG 2000 or ARGB - cannot be decoded by Go, but valid for macOS
+			result.Sizes = append(result.Sizes, Sizes{Width: slot.size, Height: slot.size})
+			continue
+		}
+
+		validatePngData(imageData, slot.osType+": ", slot.size, result)
+	}
+}
+
+func (t icnsSlot) label() string {
+	if t.isRetina {
+		return fmt.Sprintf("%dx%d@2x", t.size/2, t.size/2)
+	}
+	return fmt.Sprintf("%dx%d", t.size, t.size)
+}
+
+func validateIcoData(data []byte, result *IconFileDiagnostics) {
+	sizes, err := GetIcoSizes(data)
+	if err != nil {
+		result.add(SeverityError, "ERR_ICON_CORRUPTED", "%v", err)
+		return
+	}
+
+	hasSize := make(map[int]bool)
+	for index, size := range sizes {
+		entry := data[icoHeaderSize+index*icoDirEntrySize:]
+		bitCount := int(binary.LittleEndian.Uint16(entry[6:]))
+		dataSize := int(binary.LittleEndian.Uint32(entry[8:]))
+		offset := int(binary.LittleEndian.Uint32(entry[12:]))
+		context := fmt.Sprintf("frame %dx%d: ", size.Width, size.Height)
+		if offset < 0 || dataSize < 0 || offset+dataSize > len(data) || offset+dataSize < offset {
+			result.add(SeverityError, "ERR_ICON_CORRUPTED", "%sdata is out of file bounds", context)
+			continue
+		}
+
+		frameData := data[offset : offset+dataSize]
+		if bytes.HasPrefix(frameData, pngSignature) {
+			validatePngData(frameData, context, 0, result)
+		} else {
+			result.Sizes = append(result.Sizes, size)
+			if size.Width != size.Height {
+				result.add(SeverityError, "ICON_NOT_SQUARE", "%simage is not square", context)
+			}
+			if len(frameData) >= 16 {
+				// ico directory bit count is often 0, use value from bitmap header
+				bitCount = int(binary.LittleEndian.Uint16(frameData[14:]))
+			}
+			if bitCount != 32 {
+				result.add(SeverityWarning, "ICON_COLOR_DEPTH", "%s%d-bit color depth, 32-bit (with alpha channel) is expected, edges will look jagged", context, bitCount)
+			}
+		}
+		hasSize[size.Width] = true
+	}
+
+	for _, size := range icoRecommendedSizes {
+		if hasSize[size] {
+			continue
+		}
+
+		if size == 256 {
+			result.add(SeverityError, "ICO_MISSING_SIZE", "256x256 is required")
+		} else {
+			result.add(SeverityWarning, "ICO_MISSING_SIZE", "%dx%d is missing, Windows will scale other size", size, size)
+		}
+	}
+}
+
+type pngHeader struct {
+	width      int
+	height     int
+	bitDepth   int
+	colorType  int
+	interlaced bool
+	hasIccp    bool
+}
+
+func validatePngData(data []byte, context string, expectedSize int, result *IconFileDiagnostics) {
+	header, err := readPngHeader(data)
+	if err != nil {
+		result.add(SeverityError, "ERR_ICON_CORRUPTED", "%s%v", context, err)
+		return
+	}
+
+	result.Sizes = append(result.Sizes, Sizes{Width: header.width, Height: header.height})
+
+	if header.width != header.height {
+		result.add(SeverityError, "ICON_NOT_SQUARE", "%simage is not square (%dx%d)", context, header.width, header.height)
+	}
+
+	if result.Format == "png" {
+		if header.width < expectedSize || header.height < expectedSize {
+			result.add(SeverityError, "ICON_TOO_SMALL", "image must be at least %dx%d, but %dx%d", expectedSize, expectedSize, header.width, header.height)
+		}
+	} else if expectedSize > 0 && (header.width != expectedSize || header.height != expectedSize) {
+		result.add(SeverityError, "ICON_WRONG_SIZE", "%simage must be %dx%d, but %dx%d", context, expectedSize, expectedSize, header.width, header.height)
+	}
+
+	// color type 6 - truecolor with alpha
+	if header.colorType != 6 || header.bitDepth != 8 {
+		result.add(SeverityWarning, "ICON_COLOR_DEPTH", "%s%s, %d-bit per channel, 8-bit RGBA is expected", context, pngColorTypeName(header.colorType), header.bitDepth)
+	}
+	if header.interlaced {
+		result.add(SeverityError, "ICON_PNG_INTERLACED", "%sinterlaced PNG is not supported by Windows icon loader and some installers, save image without interlacing", context)
+	}
+	if header.hasIccp {
+		if result.Format == "icns" {
+			result.add(SeverityInfo, "ICON_PNG_COLOR_PROFILE", "%sembedded ICC color profile, fine for macOS, but image must be converted to sRGB if used for ICO", context)
+		} else {
+			result.add(SeverityWarning, "ICON_PNG_COLOR_PROFILE", "%sembedded ICC color profile is ignored on Windows (colors will differ) and may break ICO frame loading, convert image to sRGB and strip profile", context)
+		}
+	}
+}
+
+func pngColorTypeName(colorType int) string {
+	switch colorType {
+	case 0:
+		return "grayscale"
+	case 2:
+		return "RGB without alpha"
+	case 3:
+		return "palette"
+	case 4:
+		return "grayscale with alpha"
+	case 6:
+		return "RGBA"
+	default:
+		return fmt.Sprintf("color type %d", colorType)
+	}
+}
+
+// only chunks before image data are inspected (IHDR and ancillary chunks like iCCP)
+func readPngHeader(data []byte) (*pngHeader, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, errors.New("not a PNG")
+	}
+
+	offset := len(pngSignature)
+	var result *pngHeader
+	for offset+8 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[offset:]))
+		chunkType := string(data[offset+4 : offset+8])
+		chunkDataOffset := offset + 8
+		if length < 0 || chunkDataOffset+length > len(data) {
+			return nil, errors.Errorf("PNG chunk %q is truncated", chunkType)
+		}
+
+		switch chunkType {
+		case "IHDR":
+			if length < 13 {
+				return nil, errors.New("PNG header is truncated")
+			}
+			chunk := data[chunkDataOffset:]
+			result = &pngHeader{
+				width:      int(binary.BigEndian.Uint32(chunk)),
+				height:     int(binary.BigEndian.Uint32(chunk[4:])),
+				bitDepth:   int(chunk[8]),
+				colorType:  int(chunk[9]),
+				interlaced: chunk[12] != 0,
+			}
+		case "iCCP":
+			if result != nil {
+				result.hasIccp = true
+			}
+		case "IDAT", "IEND":
+			if result == nil {
+				return nil, errors.New("PNG header is missing")
+			}
+			return result, nil
+		}
+
+		// data + crc
+		offset = chunkDataOffset + length + 4
+	}
+
+	if result == nil {
+		return nil, errors.New("PNG header is missing")
+	}
+	return result, nil
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
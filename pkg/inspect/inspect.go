@@ -0,0 +1,298 @@
+package inspect
+
+import (
+	"debug/macho"
+	"debug/pe"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/codesign"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	FormatMachO = "macho"
+	FormatPe    = "pe"
+
+	loadCmdVersionMinMacOs = 0x24
+	loadCmdBuildVersion    = 0x32
+
+	peFileDll = 0x2000
+)
+
+type Binary struct {
+	// relative to the inspected dir
+	Path   string `json:"path"`
+	Format string `json:"format"`
+	// executable, library or bundle (Mach-O loadable bundle, e.g. Node.js native module)
+	Type string `json:"type"`
+	// x64, ia32, arm64 or armv7l, several for universal Mach-O
+	Architectures []string `json:"architectures"`
+	Universal     bool     `json:"universal,omitempty"`
+
+	// Mach-O: the highest minimum macOS version of the slices
+	MinOsVersion string `json:"minOsVersion,omitempty"`
+	// Mach-O: linked dylibs except system ones (/usr/lib, /System)
+	Dylibs []string `json:"dylibs,omitempty"`
+
+	// PE: gui, console or a number for other subsystems
+	Subsystem string `json:"subsystem,omitempty"`
+	Bits      int    `json:"bits,omitempty"`
+}
+
+type Report struct {
+	Binaries []*Binary `json:"binaries"`
+	// binaries that do not contain all required architectures
+	Mismatches []string `json:"mismatches,omitempty"`
+}
+
+func ConfigureCommand(app *kingpin.Application) {
+	command := app.Command("inspect-binaries", "Report architectures, minimum OS version, linked non-system dylibs (Mach-O), subsystem and bitness (PE) of every executable in the dir as JSON.")
+	dir := command.Arg("dir", "The dir (e.g. unpacked app).").Required().ExistingDir()
+	requiredArchitectures := command.Flag("require-arch", "Fail if a binary doesn't contain the architecture (e.g. x64 and arm64 for universal build).").Enums("x64", "ia32", "arm64", "armv7l")
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		report, err := Inspect(*dir, *requiredArchitectures)
+		if report != nil {
+			writeError := util.WriteJsonToStdOut(report)
+			if err == nil {
+				err = writeError
+			}
+		}
+		return err
+	})
+}
+
+func Inspect(dir string, requiredArchitectures []string) (*Report, error) {
+	dir = filepath.Clean(dir)
+	var files []string
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, file)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	binaries := make([]*Binary, len(files))
+	err = util.MapAsync(len(files), func(taskIndex int) (func() error, error) {
+		file := files[taskIndex]
+		return func() error {
+			result, err := inspectFile(file)
+			if err != nil {
+				return errors.WithMessage(err, "cannot inspect "+file)
+			}
+			if result != nil {
+				result.Path = filepath.ToSlash(file[len(dir)+1:])
+				binaries[taskIndex] = result
+			}
+			return nil
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{Binaries: make([]*Binary, 0)}
+	for _, item := range binaries {
+		if item == nil {
+			continue
+		}
+
+		report.Binaries = append(report.Binaries, item)
+		for _, arch := range requiredArchitectures {
+			if !util.ContainsString(item.Architectures, arch) {
+				report.Mismatches = append(report.Mismatches, item.Path)
+				log.Warn("binary doesn't contain required architecture", zap.String("file", item.Path), zap.String("arch", arch), zap.Strings("architectures", item.Architectures))
+				break
+			}
+		}
+	}
+
+	if len(report.Mismatches) != 0 {
+		return report, util.NewMessageError(fmt.Sprintf("%d binaries do not contain all required architectures (%s): %s",
+			len(report.Mismatches), strings.Join(requiredArchitectures, ", "), strings.Join(report.Mismatches, ", ")), "ERR_INSPECT_ARCH_MISMATCH")
+	}
+	return report, nil
+}
+
+// inspectFile returns nil if file is not a Mach-O or PE file. Magic is checked before parsing, so, it is cheap to call for every file.
+func inspectFile(file string) (*Binary, error) {
+	reader, err := os.Open(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer util.Close(reader)
+
+	var header [8]byte
+	_, err = io.ReadFull(reader, header[:])
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+
+	if header[0] == 'M' && header[1] == 'Z' {
+		peFile, err := pe.NewFile(reader)
+		if err != nil {
+			// not a valid PE, e.g. a data file that starts with the same bytes
+			return nil, nil
+		}
+		return inspectPe(peFile), nil
+	}
+
+	switch codesign.GetMachOKind(header[:]) {
+	case codesign.MachOThin:
+		machoFile, err := macho.NewFile(reader)
+		if err != nil {
+			return nil, nil
+		}
+		return inspectMachO([]*macho.File{machoFile}), nil
+
+	case codesign.MachOFat:
+		fatFile, err := macho.NewFatFile(reader)
+		if err != nil || len(fatFile.Arches) == 0 {
+			return nil, nil
+		}
+
+		var files []*macho.File
+		for _, arch := range fatFile.Arches {
+			files = append(files, arch.File)
+		}
+		result := inspectMachO(files)
+		result.Universal = true
+		return result, nil
+	}
+	return nil, nil
+}
+
+func inspectMachO(files []*macho.File) *Binary {
+	result := &Binary{Format: FormatMachO}
+	switch files[0].Type {
+	case macho.TypeExec:
+		result.Type = "executable"
+	case macho.TypeDylib:
+		result.Type = "library"
+	case macho.TypeBundle:
+		result.Type = "bundle"
+	default:
+		result.Type = files[0].Type.String()
+	}
+
+	var minOsVersion uint32
+	dylibs := make(map[string]bool)
+	for _, file := range files {
+		result.Architectures = append(result.Architectures, getMachOArch(file.Cpu))
+
+		for _, load := range file.Loads {
+			raw := load.Raw()
+			if len(raw) < 12 {
+				continue
+			}
+
+			// version is encoded in nibbles xxxx.yy.zz
+			var version uint32
+			switch file.ByteOrder.Uint32(raw) {
+			case loadCmdBuildVersion:
+				version = file.ByteOrder.Uint32(raw[12:])
+			case loadCmdVersionMinMacOs:
+				version = file.ByteOrder.Uint32(raw[8:])
+			default:
+				continue
+			}
+			if version > minOsVersion {
+				minOsVersion = version
+			}
+		}
+
+		libraries, err := file.ImportedLibraries()
+		if err != nil {
+			continue
+		}
+		for _, library := range libraries {
+			if !strings.HasPrefix(library, "/usr/lib/") && !strings.HasPrefix(library, "/System/") {
+				dylibs[library] = true
+			}
+		}
+	}
+
+	if minOsVersion != 0 {
+		result.MinOsVersion = fmt.Sprintf("%d.%d.%d", minOsVersion>>16, (minOsVersion>>8)&0xff, minOsVersion&0xff)
+	}
+	for library := range dylibs {
+		result.Dylibs = append(result.Dylibs, library)
+	}
+	sort.Strings(result.Dylibs)
+	return result
+}
+
+func getMachOArch(cpu macho.Cpu) string {
+	switch cpu {
+	case macho.CpuAmd64:
+		return "x64"
+	case macho.CpuArm64:
+		return "arm64"
+	case macho.Cpu386:
+		return "ia32"
+	case macho.CpuArm:
+		return "armv7l"
+	default:
+		return cpu.String()
+	}
+}
+
+func inspectPe(file *pe.File) *Binary {
+	result := &Binary{Format: FormatPe, Type: "executable"}
+	if file.Characteristics&peFileDll != 0 {
+		result.Type = "library"
+	}
+
+	switch file.Machine {
+	case pe.IMAGE_FILE_MACHINE_AMD64:
+		result.Architectures = []string{"x64"}
+	case pe.IMAGE_FILE_MACHINE_I386:
+		result.Architectures = []string{"ia32"}
+	// IMAGE_FILE_MACHINE_ARM64
+	case 0xaa64:
+		result.Architectures = []string{"arm64"}
+	case pe.IMAGE_FILE_MACHINE_ARMNT:
+		result.Architectures = []string{"armv7l"}
+	default:
+		result.Architectures = []string{fmt.Sprintf("0x%x", file.Machine)}
+	}
+
+	var subsystem uint16
+	switch header := file.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		result.Bits = 32
+		subsystem = header.Subsystem
+	case *pe.OptionalHeader64:
+		result.Bits = 64
+		subsystem = header.Subsystem
+	}
+
+	switch subsystem {
+	case 0:
+	case 2:
+		result.Subsystem = "gui"
+	case 3:
+		result.Subsystem = "console"
+	default:
+		result.Subsystem = fmt.Sprintf("%d", subsystem)
+	}
+	return result
+}
@@ -0,0 +1,134 @@
+package inspect
+
+import (
+	"bytes"
+	"debug/macho"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+)
+
+// 64-bit Mach-O with LC_BUILD_VERSION and LC_LOAD_DYLIB commands
+func createMachO(cpu macho.Cpu, fileType macho.Type, minOsVersion uint32, dylibs ...string) []byte {
+	var commands bytes.Buffer
+	commandCount := 1
+	_ = binary.Write(&commands, binary.LittleEndian, []uint32{loadCmdBuildVersion, 24, 1, minOsVersion, minOsVersion, 0})
+	for _, dylib := range dylibs {
+		name := append([]byte(dylib), 0)
+		for len(name)%8 != 0 {
+			name = append(name, 0)
+		}
+		_ = binary.Write(&commands, binary.LittleEndian, []uint32{uint32(macho.LoadCmdDylib), uint32(24 + len(name)), 24, 0, 0, 0})
+		commands.Write(name)
+		commandCount++
+	}
+
+	var result bytes.Buffer
+	_ = binary.Write(&result, binary.LittleEndian, []uint32{macho.Magic64, uint32(cpu), 0, uint32(fileType), uint32(commandCount), uint32(commands.Len()), 0, 0})
+	result.Write(commands.Bytes())
+	return result.Bytes()
+}
+
+func createFatMachO(slices ...[]byte) []byte {
+	var result bytes.Buffer
+	_ = binary.Write(&result, binary.BigEndian, []uint32{macho.MagicFat, uint32(len(slices))})
+	offset := uint32(4096)
+	for _, slice := range slices {
+		cpu := binary.LittleEndian.Uint32(slice[4:])
+		_ = binary.Write(&result, binary.BigEndian, []uint32{cpu, 0, offset, uint32(len(slice)), 12})
+		offset += 4096
+	}
+	for _, slice := range slices {
+		result.Write(make([]byte, 4096-result.Len()%4096))
+		result.Write(slice)
+	}
+	return result.Bytes()
+}
+
+// minimal PE: DOS header, COFF header and optional header without sections
+func createPe(machine uint16, characteristics uint16, is64 bool, subsystem uint16) []byte {
+	data := make([]byte, 0x40)
+	data[0] = 'M'
+	data[1] = 'Z'
+	binary.LittleEndian.PutUint32(data[0x3c:], 0x40)
+
+	optionalHeaderSize := 224
+	magic := uint16(0x10b)
+	if is64 {
+		optionalHeaderSize = 240
+		magic = 0x20b
+	}
+
+	var result bytes.Buffer
+	result.Write(data)
+	result.WriteString("PE\x00\x00")
+	_ = binary.Write(&result, binary.LittleEndian, []uint16{machine, 0, 0, 0, 0, 0, 0, 0, uint16(optionalHeaderSize), characteristics})
+	optionalHeader := make([]byte, optionalHeaderSize)
+	binary.LittleEndian.PutUint16(optionalHeader, magic)
+	binary.LittleEndian.PutUint16(optionalHeader[68:], subsystem)
+	// NumberOfRvaAndSizes
+	binary.LittleEndian.PutUint32(optionalHeader[optionalHeaderSize-16*8-4:], 16)
+	result.Write(optionalHeader)
+	return result.Bytes()
+}
+
+func TestInspect(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "inspect")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	writeFile := func(name string, data []byte) {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		g.Expect(os.MkdirAll(filepath.Dir(file), 0755)).To(Succeed())
+		g.Expect(ioutil.WriteFile(file, data, 0644)).To(Succeed())
+	}
+
+	// 11.0.0 and 10.15.0
+	writeFile("Test.app/Contents/MacOS/Test", createFatMachO(
+		createMachO(macho.CpuArm64, macho.TypeExec, 0xb0000, "/usr/lib/libSystem.B.dylib", "@rpath/Electron Framework.framework/Electron Framework"),
+		createMachO(macho.CpuAmd64, macho.TypeExec, 0xa0f00, "@rpath/Electron Framework.framework/Electron Framework"),
+	))
+	writeFile("Test.app/Contents/Resources/app.asar.unpacked/node_modules/foo/build/Release/foo.node", createMachO(macho.CpuAmd64, macho.TypeBundle, 0xa0d00))
+	writeFile("Test.app/Contents/Resources/app.asar", []byte("not a binary"))
+	writeFile("Test.app/Contents/Resources/Foo.class", []byte{0xca, 0xfe, 0xba, 0xbe, 0, 0, 0, 52})
+	writeFile("win/Test.exe", createPe(0x8664, 0x22, true, 2))
+	writeFile("win/foo.dll", createPe(0x14c, 0x2102, false, 3))
+	writeFile("win/README.md", []byte("MZ is not always PE"))
+
+	report, err := Inspect(dir, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(report.Mismatches).To(BeEmpty())
+	g.Expect(report.Binaries).To(Equal([]*Binary{
+		{
+			Path:          "Test.app/Contents/MacOS/Test",
+			Format:        FormatMachO,
+			Type:          "executable",
+			Architectures: []string{"arm64", "x64"},
+			Universal:     true,
+			MinOsVersion:  "11.0.0",
+			Dylibs:        []string{"@rpath/Electron Framework.framework/Electron Framework"},
+		},
+		{
+			Path:          "Test.app/Contents/Resources/app.asar.unpacked/node_modules/foo/build/Release/foo.node",
+			Format:        FormatMachO,
+			Type:          "bundle",
+			Architectures: []string{"x64"},
+			MinOsVersion:  "10.13.0",
+		},
+		{Path: "win/Test.exe", Format: FormatPe, Type: "executable", Architectures: []string{"x64"}, Subsystem: "gui", Bits: 64},
+		{Path: "win/foo.dll", Format: FormatPe, Type: "library", Architectures: []string{"ia32"}, Subsystem: "console", Bits: 32},
+	}))
+
+	report, err = Inspect(filepath.Join(dir, "Test.app"), []string{"x64", "arm64"})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.(interface{ ErrorCode() string }).ErrorCode()).To(Equal("ERR_INSPECT_ARCH_MISMATCH"))
+	g.Expect(report.Mismatches).To(Equal([]string{"Contents/Resources/app.asar.unpacked/node_modules/foo/build/Release/foo.node"}))
+}
@@ -0,0 +1,419 @@
+package keychain
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/credentials"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"go.uber.org/zap"
+)
+
+// password of the created keychain, random password is generated if not set
+const PasswordCredentialName = "keychain-password"
+
+// password of imported P12 files
+const CertificatePasswordCredentialName = "certificate-password"
+
+// keychains created by app-builder, stale ones (process was killed) are deleted by "keychain delete" without --keychain
+const namePrefix = "app-builder-"
+
+// the same env as used by electron-builder to specify keychain for codesign
+const keychainEnvName = "CSC_KEYCHAIN"
+
+// apps allowed to use imported keys without prompt
+var trustedApps = []string{"/usr/bin/codesign", "/usr/bin/productbuild", "/usr/bin/productsign", "/usr/bin/pkgbuild"}
+
+type CreateOptions struct {
+	// path of the keychain, app-builder-<random>.keychain in the temp dir by default
+	Keychain string
+	Password string
+	// keychain is locked after timeout of inactivity
+	Timeout time.Duration
+
+	Certificates        []string
+	CertificatePassword string
+
+	IsAddToSearchList bool
+}
+
+type Keychain struct {
+	Path string `json:"keychain"`
+	// only if generated - caller needs it to unlock keychain
+	Password string `json:"password,omitempty"`
+	// SHA-1 and name of valid code signing identities
+	Identities []*Identity `json:"identities"`
+}
+
+type Identity struct {
+	Hash string `json:"hash"`
+	Name string `json:"name"`
+}
+
+func ConfigureCommand(app *kingpin.Application) {
+	command := app.Command("keychain", "Manage temporary keychain for code signing on CI (macOS). Passwords are taken from "+
+		credentials.ToEnvName(PasswordCredentialName)+" and "+credentials.ToEnvName(CertificatePasswordCredentialName)+" env or credentials helper.")
+	configureCreateCommand(command)
+	configureUnlockCommand(command)
+	configureDeleteCommand(command)
+	configureRunCommand(command)
+}
+
+func configureCreateFlags(command *kingpin.CmdClause, options *CreateOptions) {
+	command.Flag("keychain", "The keychain file, app-builder-<random>.keychain in the temp dir by default.").StringVar(&options.Keychain)
+	command.Flag("timeout", "The keychain is locked after the specified time of inactivity.").Default("1h").DurationVar(&options.Timeout)
+	command.Flag("certificate", "The P12 file to import, can be specified several times.").ExistingFilesVar(&options.Certificates)
+	command.Flag("search-list", "Add keychain to the user search list (codesign finds identity without --keychain).").Default("true").BoolVar(&options.IsAddToSearchList)
+}
+
+func configureCreateCommand(keychainCommand *kingpin.CmdClause) {
+	command := keychainCommand.Command("create", "Create and unlock keychain, import certificates and allow codesign to use keys without prompt. "+
+		"Partially created keychain is deleted on failure. Result is written to stdout as JSON.")
+	options := &CreateOptions{}
+	configureCreateFlags(command, options)
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		err := readPasswords(options)
+		if err != nil {
+			return err
+		}
+
+		result, err := Create(options)
+		if err != nil {
+			return err
+		}
+		return util.WriteJsonToStdOut(result)
+	})
+}
+
+func configureUnlockCommand(keychainCommand *kingpin.CmdClause) {
+	command := keychainCommand.Command("unlock", "Unlock keychain and extend timeout (long builds).")
+	keychain := command.Flag("keychain", "The keychain file.").Required().String()
+	timeout := command.Flag("timeout", "The keychain is locked after the specified time of inactivity.").Default("1h").Duration()
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		password, err := credentials.GetRequired(PasswordCredentialName)
+		if err != nil {
+			return err
+		}
+		return Unlock(*keychain, password, *timeout)
+	})
+}
+
+func configureDeleteCommand(keychainCommand *kingpin.CmdClause) {
+	command := keychainCommand.Command("delete", "Delete keychain and remove it from the search list.")
+	keychains := command.Flag("keychain", "The keychain file, can be specified several times. If not specified, all keychains created by app-builder are deleted (stale after killed build).").Strings()
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		if len(*keychains) != 0 {
+			return Delete(*keychains...)
+		}
+		return DeleteStale()
+	})
+}
+
+func configureRunCommand(keychainCommand *kingpin.CmdClause) {
+	command := keychainCommand.Command("run", "Create keychain, run the command ("+keychainEnvName+" env is set to the keychain) and delete keychain even if the command failed or was canceled.")
+	options := &CreateOptions{}
+	configureCreateFlags(command, options)
+	args := command.Arg("command", "The command and its arguments.").Required().Strings()
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		err := readPasswords(options)
+		if err != nil {
+			return err
+		}
+		return Run(options, *args)
+	})
+}
+
+func readPasswords(options *CreateOptions) error {
+	var err error
+	options.Password, err = credentials.Get(PasswordCredentialName)
+	if err != nil {
+		return err
+	}
+	if len(options.Certificates) != 0 {
+		options.CertificatePassword, err = credentials.Get(CertificatePasswordCredentialName)
+	}
+	return err
+}
+
+// Create deletes keychain if any step failed or process is canceled - locked keychain in the search list causes prompts on the next build
+func Create(options *CreateOptions) (result *Keychain, err error) {
+	result = &Keychain{Path: options.Keychain, Password: options.Password}
+	if len(result.Path) == 0 {
+		result.Path = filepath.Join(os.TempDir(), namePrefix+randomString()+".keychain")
+	}
+	if len(result.Password) == 0 {
+		result.Password = randomString()
+	}
+
+	_, err = executeSecurity("create-keychain", "-p", result.Password, result.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	unregisterCleanup := util.OnCancel(func() {
+		_ = Delete(result.Path)
+	})
+	defer unregisterCleanup()
+	defer func() {
+		if err != nil {
+			deleteError := Delete(result.Path)
+			if deleteError != nil {
+				log.Warn("cannot delete keychain", zap.String("keychain", result.Path), zap.Error(deleteError))
+			}
+			result = nil
+		}
+	}()
+
+	err = Unlock(result.Path, result.Password, options.Timeout)
+	if err != nil {
+		return
+	}
+
+	for _, file := range options.Certificates {
+		err = importCertificate(result.Path, file, options.CertificatePassword)
+		if err != nil {
+			return
+		}
+	}
+
+	if len(options.Certificates) != 0 {
+		// since macOS Sierra codesign prompts for access to the key without it
+		_, err = executeSecurity("set-key-partition-list", "-S", "apple-tool:,apple:,codesign:", "-s", "-k", result.Password, result.Path)
+		if err != nil {
+			return
+		}
+	}
+
+	if options.IsAddToSearchList {
+		err = addToSearchList(result.Path)
+		if err != nil {
+			return
+		}
+	}
+
+	result.Identities, err = findIdentities(result.Path)
+	if err != nil {
+		return
+	}
+
+	log.Info("keychain created", zap.String("keychain", result.Path), zap.Int("identities", len(result.Identities)))
+	if len(options.Password) != 0 {
+		// password is known to caller
+		result.Password = ""
+	}
+	return
+}
+
+// Unlock unlocks keychain and sets lock timeout (lock on sleep), timeout is extended on each call
+func Unlock(keychain string, password string, timeout time.Duration) error {
+	_, err := executeSecurity("unlock-keychain", "-p", password, keychain)
+	if err != nil {
+		return err
+	}
+
+	_, err = executeSecurity("set-keychain-settings", "-lut", strconv.Itoa(int(timeout.Seconds())), keychain)
+	return err
+}
+
+// Delete removes keychains from the search list and deletes them, not existing keychain is not an error
+func Delete(keychains ...string) error {
+	err := removeFromSearchList(keychains)
+	if err != nil {
+		return err
+	}
+
+	for _, keychain := range keychains {
+		_, err = os.Stat(keychain)
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		_, err = executeSecurity("delete-keychain", keychain)
+		if err != nil {
+			return err
+		}
+		log.Debug("keychain deleted", zap.String("keychain", keychain))
+	}
+	return nil
+}
+
+// DeleteStale deletes keychains created by app-builder (in the search list and in the temp dir)
+func DeleteStale() error {
+	searchList, err := getSearchList()
+	if err != nil {
+		return err
+	}
+
+	var stale []string
+	for _, keychain := range searchList {
+		if isCreatedByAppBuilder(keychain) {
+			stale = append(stale, keychain)
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(os.TempDir(), namePrefix+"*.keychain*"))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, file := range files {
+		if !util.ContainsString(stale, file) {
+			stale = append(stale, file)
+		}
+	}
+
+	if len(stale) == 0 {
+		return nil
+	}
+	log.Info("deleting stale keychains", zap.Strings("keychains", stale))
+	return Delete(stale...)
+}
+
+// Run deletes keychain after the command exits, the command is stopped and keychain deleted on cancel
+func Run(options *CreateOptions, args []string) error {
+	keychain, err := Create(options)
+	if err != nil {
+		return err
+	}
+
+	unregisterCleanup := util.OnCancel(func() {
+		_ = Delete(keychain.Path)
+	})
+	defer unregisterCleanup()
+
+	command := exec.Command(args[0], args[1:]...)
+	command.Env = append(os.Environ(), keychainEnvName+"="+keychain.Path)
+	err = util.ExecuteAndPipeStdOutAndStdErr(command)
+
+	deleteError := Delete(keychain.Path)
+	if err != nil {
+		if deleteError != nil {
+			log.Warn("cannot delete keychain", zap.String("keychain", keychain.Path), zap.Error(deleteError))
+		}
+		return err
+	}
+	return deleteError
+}
+
+func importCertificate(keychain string, file string, password string) error {
+	args := []string{"import", file, "-k", keychain, "-f", "pkcs12", "-P", password}
+	for _, app := range trustedApps {
+		args = append(args, "-T", app)
+	}
+	_, err := executeSecurity(args...)
+	if err != nil {
+		return errors.WithMessage(err, "cannot import "+filepath.Base(file))
+	}
+	return nil
+}
+
+// findIdentities parses output of find-identity (  1) 0123456789ABCDEF0123456789ABCDEF01234567 "Developer ID Application: Foo (TEAMID)")
+func findIdentities(keychain string) ([]*Identity, error) {
+	output, err := executeSecurity("find-identity", "-v", "-p", "codesigning", keychain)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*Identity, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.SplitN(strings.TrimSpace(scanner.Text()), " ", 3)
+		if len(fields) != 3 || !strings.HasSuffix(fields[0], ")") || len(fields[1]) != 40 {
+			continue
+		}
+		result = append(result, &Identity{Hash: fields[1], Name: strings.Trim(fields[2], "\"")})
+	}
+	return result, nil
+}
+
+func getSearchList() ([]string, error) {
+	output, err := executeSecurity("list-keychains", "-d", "user")
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		keychain := strings.Trim(strings.TrimSpace(scanner.Text()), "\"")
+		if len(keychain) != 0 {
+			result = append(result, keychain)
+		}
+	}
+	return result, nil
+}
+
+// the first keychain in the search list is searched first
+func addToSearchList(keychain string) error {
+	searchList, err := getSearchList()
+	if err != nil {
+		return err
+	}
+	if util.ContainsString(searchList, keychain) {
+		return nil
+	}
+	_, err = executeSecurity(append([]string{"list-keychains", "-d", "user", "-s", keychain}, searchList...)...)
+	return err
+}
+
+func removeFromSearchList(keychains []string) error {
+	searchList, err := getSearchList()
+	if err != nil {
+		return err
+	}
+
+	newList := make([]string, 0, len(searchList))
+	for _, item := range searchList {
+		if !util.ContainsString(keychains, item) {
+			newList = append(newList, item)
+		}
+	}
+	if len(newList) == len(searchList) {
+		return nil
+	}
+	_, err = executeSecurity(append([]string{"list-keychains", "-d", "user", "-s"}, newList...)...)
+	return err
+}
+
+func isCreatedByAppBuilder(keychain string) bool {
+	return strings.HasPrefix(filepath.Base(keychain), namePrefix)
+}
+
+// security is executed without util.Execute - arguments contain passwords and must not be logged
+func executeSecurity(args ...string) ([]byte, error) {
+	command := exec.Command("security", args...)
+	var errorOutput bytes.Buffer
+	command.Stderr = &errorOutput
+	output, err := command.Output()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return nil, errors.WithStack(err)
+		}
+		return nil, util.NewMessageError("security "+args[0]+" failed: "+strings.TrimSpace(errorOutput.String()), "ERR_KEYCHAIN_FAILED")
+	}
+	return output, nil
+}
+
+func randomString() string {
+	data := make([]byte, 16)
+	_, err := rand.Read(data)
+	if err != nil {
+		// crypto/rand doesn't fail on supported platforms
+		panic(err)
+	}
+	return hex.EncodeToString(data)
+}
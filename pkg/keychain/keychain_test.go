@@ -0,0 +1,86 @@
+package keychain
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+)
+
+// fake security keeps search list in a file, import of bad.p12 fails
+const fakeSecurity = `#!/bin/sh
+echo "$@" >> "$FAKE_DIR/security.log"
+case "$1" in
+  create-keychain) touch "$4" ;;
+  delete-keychain) rm "$2" ;;
+  import) case "$2" in *bad.p12) echo "MAC verification failed" >&2; exit 1 ;; esac ;;
+  find-identity) echo '  1) 0123456789ABCDEF0123456789ABCDEF01234567 "Developer ID Application: Foo (TEAMID)"'; echo '     1 valid identities found' ;;
+  list-keychains)
+    if [ "$4" = "-s" ]; then
+      shift 4
+      : > "$FAKE_DIR/search-list"
+      for keychain in "$@"; do echo "    \"$keychain\"" >> "$FAKE_DIR/search-list"; done
+    else
+      cat "$FAKE_DIR/search-list"
+    fi ;;
+esac
+`
+
+func TestKeychain(t *testing.T) {
+	log.InitLogger()
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "keychain")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	binDir := filepath.Join(dir, "bin")
+	g.Expect(os.MkdirAll(binDir, 0755)).To(Succeed())
+	g.Expect(ioutil.WriteFile(filepath.Join(binDir, "security"), []byte(fakeSecurity), 0755)).To(Succeed())
+	g.Expect(ioutil.WriteFile(filepath.Join(dir, "search-list"), []byte("    \"/Users/foo/Library/Keychains/login.keychain-db\"\n"), 0644)).To(Succeed())
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	g.Expect(os.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))).To(Succeed())
+	defer os.Unsetenv("FAKE_DIR")
+	g.Expect(os.Setenv("FAKE_DIR", dir)).To(Succeed())
+
+	certificate := filepath.Join(dir, "cert.p12")
+	keychainFile := filepath.Join(dir, namePrefix+"test.keychain")
+	keychain, err := Create(&CreateOptions{Keychain: keychainFile, Timeout: 2 * time.Hour, Certificates: []string{certificate}, CertificatePassword: "secret", IsAddToSearchList: true})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(keychain.Password).To(HaveLen(32))
+	g.Expect(keychain.Identities).To(Equal([]*Identity{{Hash: "0123456789ABCDEF0123456789ABCDEF01234567", Name: "Developer ID Application: Foo (TEAMID)"}}))
+
+	searchList, err := getSearchList()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(searchList).To(Equal([]string{keychainFile, "/Users/foo/Library/Keychains/login.keychain-db"}))
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "security.log"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(data)).To(ContainSubstring("set-keychain-settings -lut 7200 " + keychainFile))
+	g.Expect(string(data)).To(ContainSubstring("import " + certificate + " -k " + keychainFile + " -f pkcs12 -P secret -T /usr/bin/codesign"))
+	g.Expect(string(data)).To(ContainSubstring("set-key-partition-list -S apple-tool:,apple:,codesign: -s -k " + keychain.Password))
+
+	// stale keychain is deleted
+	g.Expect(DeleteStale()).To(Succeed())
+	g.Expect(keychainFile).NotTo(BeAnExistingFile())
+	searchList, err = getSearchList()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(searchList).To(Equal([]string{"/Users/foo/Library/Keychains/login.keychain-db"}))
+
+	// partially created keychain is deleted
+	_, err = Create(&CreateOptions{Keychain: keychainFile, Password: "pass", Certificates: []string{filepath.Join(dir, "bad.p12")}, IsAddToSearchList: true})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("cannot import bad.p12: security import failed: MAC verification failed"))
+	g.Expect(err.Error()).NotTo(ContainSubstring("pass"))
+	g.Expect(keychainFile).NotTo(BeAnExistingFile())
+
+	// keychain is deleted after the command even if it failed
+	err = Run(&CreateOptions{Keychain: keychainFile, Password: "pass"}, []string{"sh", "-c", "test -f \"$CSC_KEYCHAIN\" && exit 3"})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("exit status 3"))
+	g.Expect(keychainFile).NotTo(BeAnExistingFile())
+}
@@ -38,6 +38,11 @@ func GetLinuxTool(name string) (string, error) {
 	return filepath.Join(GetAppImageToolBin(toolDir), name), nil
 }
 
+// built-in squashfs writer is used unless mksquashfs is explicitly requested
+func IsMksquashfsRequested() bool {
+	return util.IsEnvTrue("USE_SYSTEM_MKSQUASHFS") || len(os.Getenv("MKSQUASHFS_PATH")) != 0
+}
+
 func GetMksquashfs() (string, error) {
 	result := "mksquashfs"
 	if !util.IsEnvTrue("USE_SYSTEM_MKSQUASHFS") {
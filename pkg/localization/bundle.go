@@ -0,0 +1,303 @@
+package localization
+
+import (
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/develar/app-builder/pkg/diagnostics"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"gopkg.in/yaml.v2"
+)
+
+const defaultLanguage = "en_US"
+
+// Bundle is a map of language (en, de-DE or de_DE) to map of message id to text.
+// Message id can be prefixed with target (nsis., msi. or dmg.) to use it only for the target, prefix is removed.
+type Bundle map[string]map[string]string
+
+type language struct {
+	// Windows language id
+	lcid int
+	// ANSI code page of MSI database
+	codepage int
+	// native name (DMG license language menu)
+	name string
+}
+
+// languages supported by all targets (the same as NSIS)
+var languages = map[string]*language{
+	"ar_SA": {1025, 1256, "العربية"},
+	"bg_BG": {1026, 1251, "Български"},
+	"ca_ES": {1027, 1252, "Català"},
+	"cs_CZ": {1029, 1250, "Čeština"},
+	"da_DK": {1030, 1252, "Dansk"},
+	"de_DE": {1031, 1252, "Deutsch"},
+	"el_GR": {1032, 1253, "Ελληνικά"},
+	"en_US": {1033, 1252, "English"},
+	"es_ES": {3082, 1252, "Español"},
+	"et_EE": {1061, 1257, "Eesti"},
+	"fa_IR": {1065, 1256, "فارسی"},
+	"fi_FI": {1035, 1252, "Suomi"},
+	"fr_FR": {1036, 1252, "Français"},
+	"he_IL": {1037, 1255, "עברית"},
+	"hr_HR": {1050, 1250, "Hrvatski"},
+	"hu_HU": {1038, 1250, "Magyar"},
+	"id_ID": {1057, 1252, "Bahasa Indonesia"},
+	"it_IT": {1040, 1252, "Italiano"},
+	"ja_JP": {1041, 932, "日本語"},
+	"ko_KR": {1042, 949, "한국어"},
+	"lt_LT": {1063, 1257, "Lietuvių"},
+	"lv_LV": {1062, 1257, "Latviešu"},
+	"nb_NO": {1044, 1252, "Norsk"},
+	"nl_NL": {1043, 1252, "Nederlands"},
+	"pl_PL": {1045, 1250, "Polski"},
+	"pt_BR": {1046, 1252, "Português (Brasil)"},
+	"pt_PT": {2070, 1252, "Português"},
+	"ro_RO": {1048, 1250, "Română"},
+	"ru_RU": {1049, 1251, "Русский"},
+	"sk_SK": {1051, 1250, "Slovenčina"},
+	"sl_SI": {1060, 1250, "Slovenščina"},
+	"sr_RS": {9242, 1250, "Srpski"},
+	"sv_SE": {1053, 1252, "Svenska"},
+	"th_TH": {1054, 874, "ไทย"},
+	"tr_TR": {1055, 1254, "Türkçe"},
+	"uk_UA": {1058, 1251, "Українська"},
+	"vi_VN": {1066, 1258, "Tiếng Việt"},
+	"zh_CN": {2052, 936, "简体中文"},
+	"zh_TW": {1028, 950, "繁體中文"},
+}
+
+// language without region to the default region, if there are several regions for the language
+var defaultRegions = map[string]string{
+	"pt": "pt_PT",
+	"zh": "zh_CN",
+	"no": "nb_NO",
+}
+
+var placeholderRegExp = regexp.MustCompile(`\$\{[\w.]+\}|\$\([\w.]+\)|\[[A-Za-z_][\w.]*\]|\{[\w.]+\}|%[0-9]+|%[sd]`)
+
+var targets = []string{"nsis", "msi", "dmg"}
+
+// Resolved contains text of every message for every language (missing messages are taken from English)
+type Resolved struct {
+	// English is the first
+	Languages []string `json:"languages"`
+	// language to message id to text, target prefix is not removed
+	Messages map[string]map[string]string `json:"-"`
+	// language to ids of messages taken from English
+	Fallbacks map[string][]string `json:"fallbacks,omitempty"`
+}
+
+func ReadBundle(file string) (Bundle, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// JSON is YAML
+	var result Bundle
+	err = yaml.UnmarshalStrict(data, &result)
+	if err != nil {
+		return nil, util.NewMessageError("cannot parse "+file+": "+err.Error(), "ERR_LOCALIZATION_INVALID_FORMAT")
+	}
+	return result, nil
+}
+
+// NormalizeLanguage returns language code in form de_DE (region is added if not specified) or empty string if language is not supported
+func NormalizeLanguage(code string) string {
+	code = strings.Replace(strings.TrimSpace(code), "-", "_", 1)
+	parts := strings.SplitN(code, "_", 2)
+	parts[0] = strings.ToLower(parts[0])
+	if len(parts) == 2 {
+		code = parts[0] + "_" + strings.ToUpper(parts[1])
+		if languages[code] == nil {
+			return ""
+		}
+		return code
+	}
+
+	if result, ok := defaultRegions[parts[0]]; ok {
+		return result
+	}
+	result := ""
+	for candidate := range languages {
+		if strings.HasPrefix(candidate, parts[0]+"_") {
+			if result != "" {
+				// ambiguous
+				return ""
+			}
+			result = candidate
+		}
+	}
+	return result
+}
+
+// Resolve validates placeholders and fills missing messages from English, warning is reported for every missing message.
+// If requestedLanguages is empty, all languages of the bundle are used.
+func (t Bundle) Resolve(requestedLanguages []string, collector *diagnostics.Collector) *Resolved {
+	messages := make(map[string]map[string]string, len(t))
+	sourceCodes := make(map[string]string, len(t))
+	codes := make([]string, 0, len(t))
+	for code := range t {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		normalized := NormalizeLanguage(code)
+		if normalized == "" {
+			collector.Addf(diagnostics.SeverityError, "ERR_LOCALIZATION_UNSUPPORTED_LANGUAGE", code, "language %q is not supported", code)
+			continue
+		}
+		if existing, ok := sourceCodes[normalized]; ok {
+			collector.Addf(diagnostics.SeverityError, "ERR_LOCALIZATION_LANGUAGE_CONFLICT", code, "language %q is the same as %q (%s)", code, existing, normalized)
+			continue
+		}
+		sourceCodes[normalized] = code
+		messages[normalized] = t[code]
+	}
+
+	english := messages[defaultLanguage]
+	if len(english) == 0 {
+		collector.Add(diagnostics.SeverityError, "ERR_LOCALIZATION_ENGLISH_MISSING", defaultLanguage, "English messages are required, they are used for missing translations")
+		return nil
+	}
+
+	for _, id := range sortedKeys(english) {
+		if !isValidId(id) {
+			collector.Addf(diagnostics.SeverityError, "ERR_LOCALIZATION_INVALID_ID", sourceCodes[defaultLanguage]+": "+id, "message id %q is invalid (letters, digits and _ are allowed, target prefix is optional)", id)
+		}
+	}
+
+	result := &Resolved{Languages: []string{defaultLanguage}, Messages: map[string]map[string]string{defaultLanguage: english}, Fallbacks: make(map[string][]string)}
+	var otherLanguages []string
+	if len(requestedLanguages) == 0 {
+		for code := range messages {
+			otherLanguages = append(otherLanguages, code)
+		}
+	} else {
+		for _, code := range requestedLanguages {
+			normalized := NormalizeLanguage(code)
+			if normalized == "" {
+				collector.Addf(diagnostics.SeverityError, "ERR_LOCALIZATION_UNSUPPORTED_LANGUAGE", code, "language %q is not supported", code)
+				continue
+			}
+			if messages[normalized] == nil {
+				collector.Addf(diagnostics.SeverityWarning, "ERR_LOCALIZATION_LANGUAGE_MISSING", normalized, "there are no messages for %s, English is used", normalized)
+			}
+			otherLanguages = append(otherLanguages, normalized)
+		}
+	}
+	sort.Strings(otherLanguages)
+
+	for _, code := range otherLanguages {
+		if code == defaultLanguage || result.Messages[code] != nil {
+			continue
+		}
+
+		translations := messages[code]
+		location := sourceCodes[code]
+		if location == "" {
+			location = code
+		}
+
+		resolved := make(map[string]string, len(english))
+		for _, id := range sortedKeys(english) {
+			text, ok := translations[id]
+			if !ok {
+				resolved[id] = english[id]
+				result.Fallbacks[code] = append(result.Fallbacks[code], id)
+				if translations != nil {
+					collector.Addf(diagnostics.SeverityWarning, "ERR_LOCALIZATION_MESSAGE_MISSING", location+": "+id, "message %s is not translated, English is used", id)
+				}
+				continue
+			}
+
+			expected := placeholders(english[id])
+			actual := placeholders(text)
+			if expected != actual {
+				collector.Addf(diagnostics.SeverityError, "ERR_LOCALIZATION_PLACEHOLDER_MISMATCH", location+": "+id, "placeholders [%s] don't match English [%s]", actual, expected)
+			}
+			resolved[id] = text
+		}
+
+		for _, id := range sortedKeys(translations) {
+			if _, ok := english[id]; !ok {
+				collector.Addf(diagnostics.SeverityWarning, "ERR_LOCALIZATION_UNKNOWN_MESSAGE", location+": "+id, "message %s is not defined in English, ignored", id)
+			}
+		}
+
+		result.Languages = append(result.Languages, code)
+		result.Messages[code] = resolved
+	}
+	return result
+}
+
+// TargetMessages returns message id to map of language to text for the target (messages of other targets are excluded, target prefix is removed)
+func (t *Resolved) TargetMessages(target string) map[string]map[string]string {
+	result := make(map[string]map[string]string)
+	for _, code := range t.Languages {
+		for id, text := range t.Messages[code] {
+			targetId, ok := getTargetId(id, target)
+			if !ok {
+				continue
+			}
+
+			translations := result[targetId]
+			if translations == nil {
+				translations = make(map[string]string, len(t.Languages))
+				result[targetId] = translations
+			}
+			// message for the target overrides shared message
+			if _, isExisting := translations[code]; !isExisting || targetId != id {
+				translations[code] = text
+			}
+		}
+	}
+	return result
+}
+
+func getTargetId(id string, target string) (string, bool) {
+	index := strings.IndexByte(id, '.')
+	if index < 0 {
+		return id, true
+	}
+	return id[index+1:], id[:index] == target
+}
+
+func isValidId(id string) bool {
+	index := strings.IndexByte(id, '.')
+	if index >= 0 {
+		if !util.ContainsString(targets, id[:index]) {
+			return false
+		}
+		id = id[index+1:]
+	}
+	if id == "" {
+		return false
+	}
+	for _, c := range id {
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+// placeholders returns sorted placeholders of the text (order of placeholders in translation can be different)
+func placeholders(text string) string {
+	result := placeholderRegExp.FindAllString(text, -1)
+	sort.Strings(result)
+	return strings.Join(result, ", ")
+}
+
+func sortedKeys(m map[string]string) []string {
+	result := make([]string, 0, len(m))
+	for key := range m {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,155 @@
+package localization
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"strings"
+
+	"github.com/develar/app-builder/pkg/diagnostics"
+	"github.com/develar/errors"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"howett.net/plist"
+)
+
+const dmgLicenseBaseId = 5000
+
+type macLanguage struct {
+	// Mac OS region code (LPic)
+	region int
+	// license text and buttons are in legacy Mac OS encoding
+	encoding    encoding.Encoding
+	isMultiByte bool
+}
+
+// languages that are supported by DMG license agreement
+var macLanguages = map[string]*macLanguage{
+	"bg_BG": {72, charmap.MacintoshCyrillic, false},
+	"ca_ES": {73, charmap.Macintosh, false},
+	"da_DK": {9, charmap.Macintosh, false},
+	"de_DE": {3, charmap.Macintosh, false},
+	"en_US": {0, charmap.Macintosh, false},
+	"es_ES": {8, charmap.Macintosh, false},
+	"fi_FI": {17, charmap.Macintosh, false},
+	"fr_FR": {1, charmap.Macintosh, false},
+	"it_IT": {4, charmap.Macintosh, false},
+	"ja_JP": {14, japanese.ShiftJIS, true},
+	"ko_KR": {51, korean.EUCKR, true},
+	"nb_NO": {12, charmap.Macintosh, false},
+	"nl_NL": {5, charmap.Macintosh, false},
+	"pt_BR": {71, charmap.Macintosh, false},
+	"pt_PT": {10, charmap.Macintosh, false},
+	"ru_RU": {49, charmap.MacintoshCyrillic, false},
+	"sv_SE": {7, charmap.Macintosh, false},
+	"uk_UA": {62, charmap.MacintoshCyrillic, false},
+	"zh_CN": {52, simplifiedchinese.GBK, true},
+	"zh_TW": {53, traditionalchinese.Big5, true},
+}
+
+// message ids of license agreement buttons (STR# resource, after language name), English text is used if message is not defined
+var dmgLicenseButtons = []struct {
+	id          string
+	defaultText string
+}{
+	{"licenseAgree", "Agree"},
+	{"licenseDisagree", "Disagree"},
+	{"licensePrint", "Print"},
+	{"licenseSave", "Save..."},
+	{"licenseDescription", `If you agree with the terms of this license, press "Agree" to install the software. If you do not agree, press "Disagree".`},
+}
+
+type dmgResource struct {
+	Attributes string `plist:"Attributes"`
+	Data       []byte `plist:"Data"`
+	Id         string `plist:"ID"`
+	Name       string `plist:"Name"`
+}
+
+// RenderDmgLicense returns license agreement resources (LPic, STR# and TEXT) to add using `hdiutil udifrez -xml`.
+// License text is the "license" message.
+func RenderDmgLicense(resolved *Resolved, collector *diagnostics.Collector) ([]byte, error) {
+	messages := resolved.TargetMessages("dmg")
+	if messages["license"] == nil {
+		collector.Add(diagnostics.SeverityError, "ERR_LOCALIZATION_DMG_LICENSE_MISSING", "license", "license message is required for DMG license agreement")
+		return nil, nil
+	}
+
+	var lpic bytes.Buffer
+	var buttons []dmgResource
+	var texts []dmgResource
+	var entries [][3]uint16
+	for _, code := range resolved.Languages {
+		macInfo := macLanguages[code]
+		if macInfo == nil {
+			collector.Addf(diagnostics.SeverityWarning, "ERR_LOCALIZATION_DMG_LANGUAGE_UNSUPPORTED", code, "language %s is not supported by DMG license agreement, skipped", code)
+			continue
+		}
+
+		encoder := macInfo.encoding.NewEncoder()
+		encode := func(id string, text string) []byte {
+			result, err := encoder.Bytes([]byte(text))
+			if err != nil {
+				collector.Addf(diagnostics.SeverityError, "ERR_LOCALIZATION_DMG_ENCODING_UNSUPPORTED", code+": "+id, "text cannot be represented in legacy Mac OS encoding of the language")
+			}
+			return result
+		}
+
+		var buttonData bytes.Buffer
+		_ = binary.Write(&buttonData, binary.BigEndian, uint16(1+len(dmgLicenseButtons)))
+		for i := -1; i < len(dmgLicenseButtons); i++ {
+			id, text := "licenseLanguage", languages[code].name
+			if i >= 0 {
+				id, text = dmgLicenseButtons[i].id, dmgLicenseButtons[i].defaultText
+			}
+			if translations, ok := messages[id]; ok {
+				text = translations[code]
+			}
+
+			data := encode(id, text)
+			if len(data) > 255 {
+				collector.Addf(diagnostics.SeverityError, "ERR_LOCALIZATION_DMG_INVALID_STRING", code+": "+id, "text is too long (%d bytes, max 255)", len(data))
+				data = data[:255]
+			}
+			buttonData.WriteByte(byte(len(data)))
+			buttonData.Write(data)
+		}
+
+		id := dmgLicenseBaseId + len(entries)
+		name := languages[code].name
+		buttons = append(buttons, dmgResource{Attributes: "0x0000", Data: buttonData.Bytes(), Id: strconv.Itoa(id), Name: name + " buttons"})
+		texts = append(texts, dmgResource{Attributes: "0x0000", Data: encode("license", normalizeLineBreaks(messages["license"][code])), Id: strconv.Itoa(id), Name: name})
+
+		isMultiByte := uint16(0)
+		if macInfo.isMultiByte {
+			isMultiByte = 1
+		}
+		entries = append(entries, [3]uint16{uint16(macInfo.region), uint16(id - dmgLicenseBaseId), isMultiByte})
+	}
+
+	// default language (English), count, then region, resource id offset and multi-byte flag for every language
+	_ = binary.Write(&lpic, binary.BigEndian, []uint16{uint16(macLanguages[defaultLanguage].region), uint16(len(entries))})
+	for _, entry := range entries {
+		_ = binary.Write(&lpic, binary.BigEndian, entry[:])
+	}
+
+	resources := map[string][]dmgResource{
+		"LPic": {{Attributes: "0x0000", Data: lpic.Bytes(), Id: strconv.Itoa(dmgLicenseBaseId), Name: ""}},
+		"STR#": buttons,
+		"TEXT": texts,
+	}
+	result, err := plist.MarshalIndent(resources, plist.XMLFormat, "\t")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return result, nil
+}
+
+// classic Mac OS line break
+func normalizeLineBreaks(text string) string {
+	return strings.Replace(strings.Replace(text, "\r\n", "\r", -1), "\n", "\r", -1)
+}
@@ -0,0 +1,126 @@
+package localization
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/diagnostics"
+	"github.com/develar/app-builder/pkg/nsis"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+)
+
+type Options struct {
+	Input     string
+	Languages []string
+
+	// NSIS include with languages and LangString for each message
+	NsisOutput string
+	IsMui      bool
+	// dir for <culture>.wxl files
+	WixOutputDir string
+	// license resources for `hdiutil udifrez -xml`
+	DmgLicenseOutput string
+}
+
+type Report struct {
+	Languages []string            `json:"languages"`
+	Fallbacks map[string][]string `json:"fallbacks,omitempty"`
+	Outputs   []string            `json:"outputs"`
+	Summary   *diagnostics.Report `json:"summary"`
+}
+
+func ConfigureCommand(app *kingpin.Application) {
+	command := app.Command("localize", "Generate installer resources for every language from a localization bundle (JSON or YAML, language to message id to text): "+
+		"NSIS languages include, WiX localization files and DMG license agreement. "+
+		"Placeholders are validated, missing messages are taken from English. Report is written to stdout as JSON.")
+
+	options := &Options{}
+	command.Flag("input", "The localization bundle.").Short('i').Required().ExistingFileVar(&options.Input)
+	command.Flag("language", "The language to generate resources for (e.g. de_DE), all languages of the bundle if not specified.").StringsVar(&options.Languages)
+	command.Flag("nsis-output", "The NSIS include (languages and LangString for each message).").StringVar(&options.NsisOutput)
+	command.Flag("mui", "NSIS languages are inserted using MUI_LANGUAGE macro (Modern UI).").BoolVar(&options.IsMui)
+	command.Flag("wix-output", "The dir to write WiX localization files (<culture>.wxl) to.").StringVar(&options.WixOutputDir)
+	command.Flag("dmg-license-output", "The DMG license agreement resources (license message is used as license text) to add using `hdiutil udifrez -xml`.").StringVar(&options.DmgLicenseOutput)
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		report, err := Localize(options)
+		if err != nil {
+			return err
+		}
+
+		err = util.WriteJsonToStdOut(report)
+		if err != nil {
+			return err
+		}
+		if report.Summary.ErrorCount > 0 {
+			return util.NewMessageError("localization bundle is invalid: "+strconv.Itoa(report.Summary.ErrorCount)+" errors (see report)", "ERR_LOCALIZATION_INVALID_BUNDLE")
+		}
+		return nil
+	})
+}
+
+// Localize writes outputs only if there are no errors, the report is returned in any case
+func Localize(options *Options) (*Report, error) {
+	bundle, err := ReadBundle(options.Input)
+	if err != nil {
+		return nil, err
+	}
+
+	collector := diagnostics.NewCollector(0)
+	report := &Report{Languages: []string{}, Outputs: []string{}}
+	resolved := bundle.Resolve(options.Languages, collector)
+	if resolved == nil {
+		report.Summary = collector.Report()
+		return report, nil
+	}
+
+	report.Languages = resolved.Languages
+	if len(resolved.Fallbacks) != 0 {
+		report.Fallbacks = resolved.Fallbacks
+	}
+
+	outputs := make(map[string][]byte)
+	if options.NsisOutput != "" {
+		text, err := nsis.CreateLanguagesFile(resolved.Languages, resolved.TargetMessages("nsis"), options.IsMui)
+		if err != nil {
+			return nil, err
+		}
+		outputs[options.NsisOutput] = []byte(text)
+	}
+	if options.WixOutputDir != "" {
+		for culture, data := range RenderWxl(resolved, collector) {
+			outputs[filepath.Join(options.WixOutputDir, culture+".wxl")] = data
+		}
+	}
+	if options.DmgLicenseOutput != "" {
+		data, err := RenderDmgLicense(resolved, collector)
+		if err != nil {
+			return nil, err
+		}
+		outputs[options.DmgLicenseOutput] = data
+	}
+
+	report.Summary = collector.Report()
+	if collector.HasErrors() {
+		return report, nil
+	}
+
+	for file, data := range outputs {
+		err = fsutil.EnsureDir(filepath.Dir(file))
+		if err != nil {
+			return nil, err
+		}
+		err = ioutil.WriteFile(file, data, 0644)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		report.Outputs = append(report.Outputs, file)
+	}
+	sort.Strings(report.Outputs)
+	return report, nil
+}
@@ -0,0 +1,162 @@
+package localization
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/diagnostics"
+	. "github.com/onsi/gomega"
+	"howett.net/plist"
+)
+
+const testBundle = `
+en:
+  appRunning: "${PRODUCT_NAME} is running"
+  msi.welcome: "Welcome to [ProductName] Setup"
+  dmg.license: "License\nline 2"
+de-DE:
+  appRunning: "${PRODUCT_NAME} läuft"
+  msi.welcome: "Willkommen bei [ProductName]"
+ja:
+  appRunning: "${PRODUCT_NAME} は実行中です"
+  dmg.license: "ライセンス"
+`
+
+func TestNormalizeLanguage(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	g.Expect(NormalizeLanguage("en")).To(Equal("en_US"))
+	g.Expect(NormalizeLanguage("de-de")).To(Equal("de_DE"))
+	g.Expect(NormalizeLanguage("pt")).To(Equal("pt_PT"))
+	g.Expect(NormalizeLanguage("pt-BR")).To(Equal("pt_BR"))
+	g.Expect(NormalizeLanguage("de_AT")).To(BeEmpty())
+	g.Expect(NormalizeLanguage("xx")).To(BeEmpty())
+}
+
+func TestResolve(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	bundle := Bundle{
+		"en":    {"title": "Install {0}", "nsis.finish": "Done", "bad id": "x"},
+		"en_US": {"title": "Install"},
+		"de":    {"title": "{0} installieren", "unknown": "x"},
+		"fr":    {"title": "Installer"},
+	}
+	collector := diagnostics.NewCollector(0)
+	resolved := bundle.Resolve([]string{"de", "fr", "it"}, collector)
+	g.Expect(resolved.Languages).To(Equal([]string{"en_US", "de_DE", "fr_FR", "it_IT"}))
+	g.Expect(resolved.Messages["de_DE"]).To(Equal(map[string]string{"title": "{0} installieren", "nsis.finish": "Done", "bad id": "x"}))
+	g.Expect(resolved.Fallbacks["it_IT"]).To(Equal([]string{"bad id", "nsis.finish", "title"}))
+
+	g.Expect(findingCodes(collector)).To(Equal(map[string]string{
+		"ERR_LOCALIZATION_LANGUAGE_CONFLICT":    diagnostics.SeverityError,
+		"ERR_LOCALIZATION_INVALID_ID":           diagnostics.SeverityError,
+		"ERR_LOCALIZATION_PLACEHOLDER_MISMATCH": diagnostics.SeverityError,
+		"ERR_LOCALIZATION_MESSAGE_MISSING":      diagnostics.SeverityWarning,
+		"ERR_LOCALIZATION_UNKNOWN_MESSAGE":      diagnostics.SeverityWarning,
+		"ERR_LOCALIZATION_LANGUAGE_MISSING":     diagnostics.SeverityWarning,
+	}))
+
+	messages := resolved.TargetMessages("msi")
+	g.Expect(messages).To(HaveKey("title"))
+	g.Expect(messages).NotTo(HaveKey("finish"))
+	g.Expect(resolved.TargetMessages("nsis")["finish"]["fr_FR"]).To(Equal("Done"))
+
+	collector = diagnostics.NewCollector(0)
+	g.Expect(Bundle{"de": {"title": "Titel"}}.Resolve(nil, collector)).To(BeNil())
+	g.Expect(findingCodes(collector)).To(HaveKey("ERR_LOCALIZATION_ENGLISH_MISSING"))
+}
+
+func TestRenderWxl(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	bundle := Bundle{"en": {"title": "Install <app> & run", "nsis.finish": "Done"}, "ru": {"title": "Установить"}, "cs": {"title": "Установить"}}
+	collector := diagnostics.NewCollector(0)
+	result := RenderWxl(bundle.Resolve(nil, collector), collector)
+	g.Expect(result).To(HaveLen(3))
+	g.Expect(string(result["ru-RU"])).To(Equal(`<?xml version="1.0" encoding="UTF-8"?>
+<!-- generated by app-builder -->
+<WixLocalization Culture="ru-RU" Codepage="1251" Language="1049" xmlns="http://schemas.microsoft.com/wix/2006/localization">
+  <String Id="title">Установить</String>
+</WixLocalization>
+`))
+	g.Expect(string(result["en-US"])).To(ContainSubstring(`<String Id="title">Install &lt;app&gt; &amp; run</String>`))
+
+	// cyrillic text cannot be represented in central european code page
+	report := collector.Report()
+	g.Expect(report.ErrorCount).To(Equal(1))
+	g.Expect(report.Findings[0].Code).To(Equal("ERR_LOCALIZATION_CODEPAGE_UNSUPPORTED"))
+	g.Expect(report.Findings[0].Locations).To(Equal([]string{"cs_CZ: title"}))
+}
+
+func TestLocalize(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "localization")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "bundle.yml")
+	g.Expect(ioutil.WriteFile(input, []byte(testBundle), 0644)).To(Succeed())
+
+	options := &Options{
+		Input:            input,
+		NsisOutput:       filepath.Join(dir, "out", "languages.nsh"),
+		WixOutputDir:     filepath.Join(dir, "out", "wix"),
+		DmgLicenseOutput: filepath.Join(dir, "out", "license.plist"),
+	}
+	report, err := Localize(options)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(report.Summary.ErrorCount).To(Equal(0))
+	g.Expect(report.Summary.WarningCount).To(Equal(2))
+	g.Expect(report.Languages).To(Equal([]string{"en_US", "de_DE", "ja_JP"}))
+	g.Expect(report.Fallbacks).To(Equal(map[string][]string{"de_DE": {"dmg.license"}, "ja_JP": {"msi.welcome"}}))
+	g.Expect(report.Outputs).To(HaveLen(5))
+
+	data, err := ioutil.ReadFile(options.NsisOutput)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(data)).To(Equal(`LoadLanguageFile "${NSISDIR}\Contrib\Language files\English.nlf"
+LoadLanguageFile "${NSISDIR}\Contrib\Language files\German.nlf"
+LoadLanguageFile "${NSISDIR}\Contrib\Language files\Japanese.nlf"
+LangString appRunning ${LANG_ENGLISH} "$${PRODUCT_NAME} is running"
+LangString appRunning ${LANG_GERMAN} "$${PRODUCT_NAME} läuft"
+LangString appRunning ${LANG_JAPANESE} "$${PRODUCT_NAME} は実行中です"
+`))
+
+	data, err = ioutil.ReadFile(filepath.Join(options.WixOutputDir, "ja-JP.wxl"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(data)).To(ContainSubstring(`<String Id="welcome">Welcome to [ProductName] Setup</String>`))
+
+	data, err = ioutil.ReadFile(options.DmgLicenseOutput)
+	g.Expect(err).NotTo(HaveOccurred())
+	var resources map[string][]dmgResource
+	_, err = plist.Unmarshal(data, &resources)
+	g.Expect(err).NotTo(HaveOccurred())
+	// English is default, German (region 3) and Japanese (region 14, multi-byte)
+	g.Expect(resources["LPic"][0].Data).To(Equal([]byte{0, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0, 3, 0, 1, 0, 0, 0, 14, 0, 2, 0, 1}))
+	g.Expect(resources["TEXT"]).To(HaveLen(3))
+	g.Expect(resources["TEXT"][0].Data).To(Equal([]byte("License\rline 2")))
+	g.Expect(resources["TEXT"][2].Id).To(Equal("5002"))
+	// Shift JIS
+	g.Expect(resources["TEXT"][2].Data).To(Equal([]byte{0x83, 0x89, 0x83, 0x43, 0x83, 0x5a, 0x83, 0x93, 0x83, 0x58}))
+	g.Expect(resources["STR#"][1].Data[:10]).To(Equal([]byte{0, 6, 7, 'D', 'e', 'u', 't', 's', 'c', 'h'}))
+
+	// outputs are not written if bundle is invalid
+	g.Expect(os.RemoveAll(filepath.Join(dir, "out"))).To(Succeed())
+	g.Expect(ioutil.WriteFile(input, []byte("de:\n  title: Titel\n"), 0644)).To(Succeed())
+	report, err = Localize(options)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(report.Summary.ErrorCount).To(Equal(1))
+	g.Expect(report.Outputs).To(BeEmpty())
+	g.Expect(filepath.Join(dir, "out")).NotTo(BeADirectory())
+}
+
+func findingCodes(collector *diagnostics.Collector) map[string]string {
+	result := make(map[string]string)
+	for _, finding := range collector.Report().Findings {
+		result[finding.Code] = finding.Severity
+	}
+	return result
+}
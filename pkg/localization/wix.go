@@ -0,0 +1,74 @@
+package localization
+
+import (
+	"bytes"
+	"encoding/xml"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/develar/app-builder/pkg/diagnostics"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+)
+
+var windowsCodepages = map[int]encoding.Encoding{
+	874:  charmap.Windows874,
+	932:  japanese.ShiftJIS,
+	936:  simplifiedchinese.GBK,
+	949:  korean.EUCKR,
+	950:  traditionalchinese.Big5,
+	1250: charmap.Windows1250,
+	1251: charmap.Windows1251,
+	1252: charmap.Windows1252,
+	1253: charmap.Windows1253,
+	1254: charmap.Windows1254,
+	1255: charmap.Windows1255,
+	1256: charmap.Windows1256,
+	1257: charmap.Windows1257,
+	1258: charmap.Windows1258,
+}
+
+// Culture returns culture name (de-DE) of the language
+func Culture(language string) string {
+	return strings.Replace(language, "_", "-", 1)
+}
+
+// RenderWxl returns WiX localization file (culture.wxl) for every language.
+// MSI database uses ANSI code page of the language, so, error is reported if text cannot be encoded.
+func RenderWxl(resolved *Resolved, collector *diagnostics.Collector) map[string][]byte {
+	messages := resolved.TargetMessages("msi")
+	ids := make([]string, 0, len(messages))
+	for id := range messages {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	result := make(map[string][]byte, len(resolved.Languages))
+	for _, code := range resolved.Languages {
+		info := languages[code]
+		encoder := windowsCodepages[info.codepage].NewEncoder()
+
+		var buffer bytes.Buffer
+		buffer.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<!-- generated by app-builder -->\n")
+		buffer.WriteString(`<WixLocalization Culture="` + Culture(code) + `" Codepage="` + strconv.Itoa(info.codepage) + `" Language="` + strconv.Itoa(info.lcid) + `" xmlns="http://schemas.microsoft.com/wix/2006/localization">` + "\n")
+		for _, id := range ids {
+			text := messages[id][code]
+			_, err := encoder.String(text)
+			if err != nil {
+				collector.Addf(diagnostics.SeverityError, "ERR_LOCALIZATION_CODEPAGE_UNSUPPORTED", code+": "+id, "text cannot be represented in code page %d of MSI database", info.codepage)
+			}
+
+			buffer.WriteString(`  <String Id="` + id + `">`)
+			_ = xml.EscapeText(&buffer, []byte(text))
+			buffer.WriteString("</String>\n")
+		}
+		buffer.WriteString("</WixLocalization>\n")
+		result[Culture(code)] = buffer.Bytes()
+	}
+	return result
+}
@@ -4,15 +4,35 @@ import (
 	"io"
 	"os"
 
+	"github.com/alecthomas/kingpin"
 	"github.com/develar/app-builder/pkg/zap-cli-encoder"
+	"github.com/develar/errors"
 	"github.com/mattn/go-colorable"
 	"github.com/mattn/go-isatty"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
+// env is used in addition to flags to apply the same format to child app-builder processes
+const (
+	FormatEnvName     = "APP_BUILDER_LOG_FORMAT"
+	LevelEnvName      = "APP_BUILDER_LOG_LEVEL"
+	TimestampsEnvName = "APP_BUILDER_LOG_TIMESTAMPS"
+)
+
+var Formats = []string{"text", "json"}
+var Levels = []string{"debug", "info", "warn", "error"}
+
 var LOG *zap.Logger
 
+var level zapcore.Level
+
+// the selected command (e.g. "download-artifact"), added to each JSON log entry
+var command string
+
+// last log lines of the configured level, used for crash report
+var recentLog = newRingBuffer(500)
+
 func InitLogger() {
 	encoderConfig := zapcore.EncoderConfig{
 		TimeKey:        "T",
@@ -25,26 +45,98 @@ func InitLogger() {
 		EncodeDuration: zapcore.StringDurationEncoder,
 	}
 
-	level := zapcore.InfoLevel
-	debugEnv, isDebugDefined := os.LookupEnv("DEBUG")
-	if isDebugDefined && debugEnv != "false" {
-		level = zapcore.DebugLevel
-	}
+	level = getLevel()
 
-	colored := isColored()
-	var writer io.Writer
-	if colored {
-		writer = colorable.NewColorableStderr()
+	var core zapcore.Core
+	if os.Getenv(FormatEnvName) == "json" {
+		core = zapcore.NewCore(zapcore.NewJSONEncoder(zapcore.EncoderConfig{
+			TimeKey:        "time",
+			LevelKey:       "level",
+			MessageKey:     "message",
+			StacktraceKey:  "stack",
+			LineEnding:     zapcore.DefaultLineEnding,
+			EncodeLevel:    zapcore.LowercaseLevelEncoder,
+			EncodeTime:     zapcore.ISO8601TimeEncoder,
+			EncodeDuration: zapcore.StringDurationEncoder,
+		}), zapcore.AddSync(os.Stderr), level)
+		if len(command) != 0 {
+			core = core.With([]zapcore.Field{zap.String("command", command)})
+		}
 	} else {
-		writer = os.Stderr
+		textEncoderConfig := encoderConfig
+		if os.Getenv(TimestampsEnvName) == "true" {
+			textEncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+		}
+
+		colored := isColored()
+		var writer io.Writer
+		if colored {
+			writer = colorable.NewColorableStderr()
+		} else {
+			writer = os.Stderr
+		}
+		core = zapcore.NewCore(zap_cli_encoder.NewConsoleEncoder(textEncoderConfig, colored), zapcore.AddSync(writer), level)
 	}
-	LOG = zap.New(zapcore.NewCore(
-		zap_cli_encoder.NewConsoleEncoder(encoderConfig, colored),
-		zapcore.AddSync(writer),
-		level,
+
+	LOG = zap.New(zapcore.NewTee(
+		core,
+		zapcore.NewCore(zap_cli_encoder.NewConsoleEncoder(encoderConfig, false), zapcore.AddSync(recentLog), level),
 	))
 }
 
+// ConfigureFlags adds global log flags, logger is re-initialized before the command is executed
+func ConfigureFlags(app *kingpin.Application) {
+	format := app.Flag("log-format", "The log format (stderr): text or json (one object per line with time, level, message, command and fields).").
+		Envar(FormatEnvName).
+		Default("text").
+		Enum(Formats...)
+	logLevel := app.Flag("log-level", "The log level (default: info, debug if DEBUG env is set).").
+		Envar(LevelEnvName).
+		Enum(Levels...)
+	isTimestamps := app.Flag("log-timestamps", "Prefix text log lines with timestamp (JSON log always contains timestamp).").
+		Envar(TimestampsEnvName).
+		Bool()
+
+	app.PreAction(func(context *kingpin.ParseContext) error {
+		err := os.Setenv(FormatEnvName, *format)
+		if err == nil && len(*logLevel) != 0 {
+			err = os.Setenv(LevelEnvName, *logLevel)
+		}
+		if err == nil && *isTimestamps {
+			err = os.Setenv(TimestampsEnvName, "true")
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if context.SelectedCommand != nil {
+			command = context.SelectedCommand.FullCommand()
+		}
+		_ = LOG.Sync()
+		InitLogger()
+		return nil
+	})
+}
+
+func getLevel() zapcore.Level {
+	var result zapcore.Level
+	levelEnv := os.Getenv(LevelEnvName)
+	if len(levelEnv) != 0 && result.UnmarshalText([]byte(levelEnv)) == nil {
+		return result
+	}
+
+	debugEnv, isDebugDefined := os.LookupEnv("DEBUG")
+	if isDebugDefined && debugEnv != "false" {
+		return zapcore.DebugLevel
+	}
+	return zapcore.InfoLevel
+}
+
+// RecentLog returns last log lines (debug messages only if debug is enabled), not sanitized
+func RecentLog() []byte {
+	return recentLog.Bytes()
+}
+
 func isColored() bool {
 	forceColor, ok := os.LookupEnv("FORCE_COLOR")
 	if ok && (forceColor == "1" || forceColor == "true" || forceColor == "") {
@@ -74,5 +166,5 @@ func Debug(msg string, fields ...zapcore.Field) {
 }
 
 func IsDebugEnabled() bool {
-	return LOG.Core().Enabled(zap.DebugLevel)
+	return level.Enabled(zap.DebugLevel)
 }
\ No newline at end of file
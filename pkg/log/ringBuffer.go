@@ -0,0 +1,50 @@
+package log
+
+import (
+	"bytes"
+	"sync"
+)
+
+// keeps only last N written entries (zap writes one entry per Write call)
+type ringBuffer struct {
+	mutex   sync.Mutex
+	entries [][]byte
+	next    int
+	isFull  bool
+}
+
+func newRingBuffer(capacity int) *ringBuffer {
+	return &ringBuffer{entries: make([][]byte, capacity)}
+}
+
+func (t *ringBuffer) Write(p []byte) (int, error) {
+	// zap reuses buffer, so, copy is required
+	entry := make([]byte, len(p))
+	copy(entry, p)
+
+	t.mutex.Lock()
+	t.entries[t.next] = entry
+	t.next++
+	if t.next == len(t.entries) {
+		t.next = 0
+		t.isFull = true
+	}
+	t.mutex.Unlock()
+	return len(p), nil
+}
+
+func (t *ringBuffer) Bytes() []byte {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var result bytes.Buffer
+	if t.isFull {
+		for _, entry := range t.entries[t.next:] {
+			result.Write(entry)
+		}
+	}
+	for _, entry := range t.entries[:t.next] {
+		result.Write(entry)
+	}
+	return result.Bytes()
+}
@@ -0,0 +1,378 @@
+package metadata
+
+import (
+	"bytes"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/develar/app-builder/pkg/diagnostics"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Associations is a declarative input for file associations and URL schemes, metadata for all platforms is generated from it
+type Associations struct {
+	AppId       string `yaml:"appId"`
+	ProductName string `yaml:"productName"`
+	// Windows executable, $INSTDIR\<productName>.exe by default
+	Executable string `yaml:"executable"`
+
+	FileAssociations []*FileAssociation `yaml:"fileAssociations"`
+	Protocols        []*Protocol        `yaml:"protocols"`
+}
+
+type FileAssociation struct {
+	// extensions without dot
+	Ext         []string `yaml:"ext"`
+	Name        string   `yaml:"name"`
+	Description string   `yaml:"description"`
+	// application/x-<app>-<ext> is used if not set
+	MimeType string `yaml:"mimeType"`
+	// Editor, Viewer, Shell or None (macOS CFBundleTypeRole)
+	Role string `yaml:"role"`
+	// Owner, Default, Alternate or None (macOS LSHandlerRank)
+	Rank string `yaml:"rank"`
+	// macOS icns file name in Resources
+	Icon string `yaml:"icon"`
+	// Windows icon (ico) path, the executable icon by default
+	WindowsIcon string `yaml:"windowsIcon"`
+	// type is defined by the app (exported UTI on macOS, shared MIME-info on Linux)
+	IsExported bool `yaml:"exported"`
+	// UTI, <appId>.<ext> by default for exported type
+	Uti string `yaml:"uti"`
+	// directory that is presented as a file (macOS LSTypeIsPackage)
+	IsPackage bool `yaml:"isPackage"`
+	// Windows ProgID, <appId>.<ext> by default
+	ProgId string `yaml:"progId"`
+}
+
+type Protocol struct {
+	Name    string   `yaml:"name"`
+	Schemes []string `yaml:"schemes"`
+	Role    string   `yaml:"role"`
+}
+
+var (
+	schemeRegExp   = regexp.MustCompile(`^[a-z][a-z0-9+.-]*$`)
+	extRegExp      = regexp.MustCompile(`^[A-Za-z0-9_+-]+(\.[A-Za-z0-9_+-]+)*$`)
+	mimeTypeRegExp = regexp.MustCompile(`^[a-z0-9][a-z0-9!#$&^_.+-]*/[a-zA-Z0-9][a-zA-Z0-9!#$&^_.+-]*$`)
+	utiRegExp      = regexp.MustCompile(`^[A-Za-z0-9-]+(\.[A-Za-z0-9-]+)+$`)
+
+	roles = []string{"Editor", "Viewer", "Shell", "None"}
+	ranks = []string{"Owner", "Default", "Alternate", "None"}
+)
+
+// schemes handled by the system or browsers, registration of such scheme breaks expected behaviour
+var reservedSchemes = map[string]bool{"http": true, "https": true, "file": true, "ftp": true, "mailto": true, "data": true, "javascript": true, "about": true, "blob": true, "ws": true, "wss": true}
+
+func ReadAssociations(file string) (*Associations, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// JSON is YAML
+	var result Associations
+	err = yaml.UnmarshalStrict(data, &result)
+	if err != nil {
+		return nil, util.NewMessageError("cannot parse "+file+": "+err.Error(), "ERR_METADATA_INVALID_FORMAT")
+	}
+	return &result, nil
+}
+
+// Validate normalizes extensions and schemes, applies defaults and reports conflicts
+func (t *Associations) Validate(collector *diagnostics.Collector) {
+	if t.AppId == "" {
+		collector.Add(diagnostics.SeverityError, "ERR_ASSOCIATION_APP_ID_MISSING", "appId", "appId is required to generate UTI and ProgID")
+	}
+
+	extToLocation := make(map[string]string)
+	utiToLocation := make(map[string]string)
+	mimeTypeToLocation := make(map[string]string)
+	for index, association := range t.FileAssociations {
+		location := "fileAssociations[" + strconv.Itoa(index) + "]"
+		if len(association.Ext) == 0 {
+			collector.Add(diagnostics.SeverityError, "ERR_ASSOCIATION_EXT_MISSING", location, "at least one extension is required")
+			continue
+		}
+
+		for extIndex, ext := range association.Ext {
+			ext = strings.TrimPrefix(ext, ".")
+			association.Ext[extIndex] = ext
+			if !extRegExp.MatchString(ext) {
+				collector.Addf(diagnostics.SeverityError, "ERR_ASSOCIATION_INVALID_EXT", location, "extension %q is invalid", ext)
+				continue
+			}
+
+			// extensions are case-insensitive on Windows and macOS
+			key := strings.ToLower(ext)
+			if existing, ok := extToLocation[key]; ok {
+				collector.Addf(diagnostics.SeverityError, "ERR_ASSOCIATION_EXT_CONFLICT", location, "extension %q is already associated in %s", ext, existing)
+				continue
+			}
+			extToLocation[key] = location
+		}
+
+		if association.Role == "" {
+			association.Role = "Editor"
+		} else if !util.ContainsString(roles, association.Role) {
+			collector.Addf(diagnostics.SeverityError, "ERR_ASSOCIATION_INVALID_ROLE", location, "role %q is invalid (expected %s)", association.Role, strings.Join(roles, ", "))
+		}
+		if association.Rank != "" && !util.ContainsString(ranks, association.Rank) {
+			collector.Addf(diagnostics.SeverityError, "ERR_ASSOCIATION_INVALID_RANK", location, "rank %q is invalid (expected %s)", association.Rank, strings.Join(ranks, ", "))
+		}
+		if association.Name == "" {
+			association.Name = strings.ToUpper(association.Ext[0]) + " document"
+		}
+
+		appPrefix := t.AppId + "." + strings.ToLower(association.Ext[0])
+		if association.MimeType == "" {
+			association.MimeType = "application/x-" + strings.ToLower(sanitizeName(t.ProductName, t.AppId)) + "-" + strings.ToLower(association.Ext[0])
+		} else if !mimeTypeRegExp.MatchString(association.MimeType) {
+			collector.Addf(diagnostics.SeverityError, "ERR_ASSOCIATION_INVALID_MIME_TYPE", location, "MIME type %q is invalid", association.MimeType)
+		}
+		if association.ProgId == "" {
+			association.ProgId = appPrefix
+		}
+		// the same standard MIME type can be handled for different extensions, but exported type must be declared once
+		if association.IsExported {
+			if existing, ok := mimeTypeToLocation[association.MimeType]; ok {
+				collector.Addf(diagnostics.SeverityError, "ERR_ASSOCIATION_MIME_TYPE_CONFLICT", location, "MIME type %q is already exported in %s", association.MimeType, existing)
+			} else {
+				mimeTypeToLocation[association.MimeType] = location
+			}
+		}
+
+		if association.IsExported && association.Uti == "" {
+			association.Uti = appPrefix
+		}
+		if association.Uti != "" {
+			if !utiRegExp.MatchString(association.Uti) {
+				collector.Addf(diagnostics.SeverityError, "ERR_ASSOCIATION_INVALID_UTI", location, "UTI %q is invalid", association.Uti)
+			} else if existing, ok := utiToLocation[association.Uti]; ok {
+				collector.Addf(diagnostics.SeverityError, "ERR_ASSOCIATION_UTI_CONFLICT", location, "UTI %q is already declared in %s", association.Uti, existing)
+			} else {
+				utiToLocation[association.Uti] = location
+			}
+		}
+	}
+
+	schemeToLocation := make(map[string]string)
+	for index, protocol := range t.Protocols {
+		location := "protocols[" + strconv.Itoa(index) + "]"
+		if len(protocol.Schemes) == 0 {
+			collector.Add(diagnostics.SeverityError, "ERR_ASSOCIATION_SCHEME_MISSING", location, "at least one scheme is required")
+		}
+		for schemeIndex, scheme := range protocol.Schemes {
+			// schemes are case-insensitive, lower case is canonical
+			scheme = strings.ToLower(strings.TrimSuffix(scheme, "://"))
+			protocol.Schemes[schemeIndex] = scheme
+			switch {
+			case !schemeRegExp.MatchString(scheme):
+				collector.Addf(diagnostics.SeverityError, "ERR_ASSOCIATION_INVALID_SCHEME", location, "scheme %q is invalid (letter followed by letters, digits, +, - or .)", scheme)
+			case schemeToLocation[scheme] != "":
+				collector.Addf(diagnostics.SeverityError, "ERR_ASSOCIATION_SCHEME_CONFLICT", location, "scheme %q is already registered in %s", scheme, schemeToLocation[scheme])
+			case reservedSchemes[scheme]:
+				collector.Addf(diagnostics.SeverityWarning, "ERR_ASSOCIATION_SCHEME_RESERVED", location, "scheme %q is handled by the system or browser", scheme)
+			default:
+				schemeToLocation[scheme] = location
+			}
+		}
+
+		if protocol.Name == "" {
+			protocol.Name = t.ProductName
+		}
+		if protocol.Role == "" {
+			protocol.Role = "Viewer"
+		} else if !util.ContainsString(roles, protocol.Role) {
+			collector.Addf(diagnostics.SeverityError, "ERR_ASSOCIATION_INVALID_ROLE", location, "role %q is invalid (expected %s)", protocol.Role, strings.Join(roles, ", "))
+		}
+	}
+}
+
+// InfoPlist returns Info.plist fragment (to merge with `metadata merge-plist`)
+func (t *Associations) InfoPlist() map[string]interface{} {
+	result := make(map[string]interface{})
+
+	var documentTypes, exportedTypes []interface{}
+	for _, association := range t.FileAssociations {
+		documentType := map[string]interface{}{
+			"CFBundleTypeName":       association.Name,
+			"CFBundleTypeRole":       association.Role,
+			"CFBundleTypeExtensions": toInterfaceList(association.Ext),
+			"CFBundleTypeMIMETypes":  []interface{}{association.MimeType},
+		}
+		if association.Uti != "" {
+			documentType["LSItemContentTypes"] = []interface{}{association.Uti}
+		}
+		if association.Rank != "" {
+			documentType["LSHandlerRank"] = association.Rank
+		}
+		if association.Icon != "" {
+			documentType["CFBundleTypeIconFile"] = association.Icon
+		}
+		if association.IsPackage {
+			documentType["LSTypeIsPackage"] = true
+		}
+		documentTypes = append(documentTypes, documentType)
+
+		if association.IsExported {
+			conformsTo := []interface{}{"public.data"}
+			if association.IsPackage {
+				conformsTo = []interface{}{"com.apple.package"}
+			}
+			exportedType := map[string]interface{}{
+				"UTTypeIdentifier":  association.Uti,
+				"UTTypeDescription": firstNotEmpty(association.Description, association.Name),
+				"UTTypeConformsTo":  conformsTo,
+				"UTTypeTagSpecification": map[string]interface{}{
+					"public.filename-extension": toInterfaceList(association.Ext),
+					"public.mime-type":          []interface{}{association.MimeType},
+				},
+			}
+			if association.Icon != "" {
+				exportedType["UTTypeIconFile"] = association.Icon
+			}
+			exportedTypes = append(exportedTypes, exportedType)
+		}
+	}
+
+	var urlTypes []interface{}
+	for _, protocol := range t.Protocols {
+		urlTypes = append(urlTypes, map[string]interface{}{
+			"CFBundleURLName":    protocol.Name,
+			"CFBundleURLSchemes": toInterfaceList(protocol.Schemes),
+			"CFBundleTypeRole":   protocol.Role,
+		})
+	}
+
+	if documentTypes != nil {
+		result["CFBundleDocumentTypes"] = documentTypes
+	}
+	if exportedTypes != nil {
+		result["UTExportedTypeDeclarations"] = exportedTypes
+	}
+	if urlTypes != nil {
+		result["CFBundleURLTypes"] = urlTypes
+	}
+	return result
+}
+
+// Registry returns registry keys to register file associations and URL schemes (SHCTX - per-user or per-machine depending on install mode)
+func (t *Associations) Registry() *Registry {
+	executable := t.Executable
+	if executable == "" {
+		executable = "$INSTDIR\\" + t.ProductName + ".exe"
+	}
+	command := `"` + executable + `" "%1"`
+
+	result := &Registry{}
+	add := func(subKey string, name string, entryType string, value interface{}) {
+		key := result.getKey("SHCTX", `Software\Classes\`+subKey)
+		key.Entries = append(key.Entries, &RegistryEntry{Name: name, Type: entryType, Value: value})
+	}
+
+	for _, association := range t.FileAssociations {
+		progId := association.ProgId
+		for _, ext := range association.Ext {
+			add("."+ext, "", RegistrySz, progId)
+			// keep other apps in "Open with" list
+			add("."+ext+`\OpenWithProgids`, progId, RegistrySz, "")
+		}
+		add(progId, "", RegistrySz, firstNotEmpty(association.Description, association.Name))
+		icon := executable + ",0"
+		if association.WindowsIcon != "" {
+			icon = association.WindowsIcon
+		}
+		add(progId+`\DefaultIcon`, "", RegistrySz, icon)
+		add(progId+`\shell\open\command`, "", RegistrySz, command)
+	}
+
+	for _, protocol := range t.Protocols {
+		for _, scheme := range protocol.Schemes {
+			add(scheme, "", RegistrySz, "URL:"+protocol.Name)
+			add(scheme, "URL Protocol", RegistrySz, "")
+			add(scheme+`\DefaultIcon`, "", RegistrySz, executable+",0")
+			add(scheme+`\shell\open\command`, "", RegistrySz, command)
+		}
+	}
+
+	sort.SliceStable(result.Keys, func(i, j int) bool {
+		return strings.ToLower(result.Keys[i].path()) < strings.ToLower(result.Keys[j].path())
+	})
+	return result
+}
+
+// DesktopMimeTypes returns value of MimeType key of Linux .desktop file
+func (t *Associations) DesktopMimeTypes() string {
+	var result []string
+	for _, association := range t.FileAssociations {
+		if !util.ContainsString(result, association.MimeType) {
+			result = append(result, association.MimeType)
+		}
+	}
+	for _, protocol := range t.Protocols {
+		for _, scheme := range protocol.Schemes {
+			result = append(result, "x-scheme-handler/"+scheme)
+		}
+	}
+	if len(result) == 0 {
+		return ""
+	}
+	return strings.Join(result, ";") + ";"
+}
+
+// MimeInfo returns shared MIME-info package (/usr/share/mime/packages/<app>.xml) for exported types, nil if there are no such types
+func (t *Associations) MimeInfo() []byte {
+	var buffer bytes.Buffer
+	for _, association := range t.FileAssociations {
+		if !association.IsExported {
+			continue
+		}
+
+		buffer.WriteString("  <mime-type type=\"" + escapeXml(association.MimeType) + "\">\n")
+		buffer.WriteString("    <comment>" + escapeXml(firstNotEmpty(association.Description, association.Name)) + "</comment>\n")
+		for _, ext := range association.Ext {
+			buffer.WriteString("    <glob pattern=\"*." + escapeXml(ext) + "\"/>\n")
+		}
+		buffer.WriteString("  </mime-type>\n")
+	}
+	if buffer.Len() == 0 {
+		return nil
+	}
+
+	return []byte("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<mime-info xmlns=\"http://www.freedesktop.org/standards/shared-mime-info\">\n" + buffer.String() + "</mime-info>\n")
+}
+
+var invalidNameCharRegExp = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// sanitizeName returns name usable in MIME type (product name or the last part of app id)
+func sanitizeName(productName string, appId string) string {
+	result := invalidNameCharRegExp.ReplaceAllString(productName, "-")
+	result = strings.Trim(result, "-")
+	if result == "" {
+		result = appId[strings.LastIndex(appId, ".")+1:]
+	}
+	return result
+}
+
+func toInterfaceList(list []string) []interface{} {
+	result := make([]interface{}, len(list))
+	for index, item := range list {
+		result[index] = item
+	}
+	return result
+}
+
+func firstNotEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
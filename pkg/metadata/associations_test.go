@@ -0,0 +1,115 @@
+package metadata
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/diagnostics"
+	. "github.com/onsi/gomega"
+)
+
+const testAssociations = `
+appId: com.example.notes
+productName: Example Notes
+fileAssociations:
+  - ext: [.note, notes]
+    name: Example Note
+    exported: true
+    icon: note.icns
+    rank: Owner
+  - ext: [md]
+    mimeType: text/markdown
+    role: Viewer
+    rank: Alternate
+protocols:
+  - schemes: ["Example-Notes://"]
+`
+
+func TestAssociations(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "associations")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "associations.yml")
+	g.Expect(ioutil.WriteFile(file, []byte(testAssociations), 0644)).To(Succeed())
+	associations, err := ReadAssociations(file)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	collector := diagnostics.NewCollector(0)
+	associations.Validate(collector)
+	g.Expect(collector.Report().Findings).To(BeEmpty())
+
+	info := associations.InfoPlist()
+	documentTypes := info["CFBundleDocumentTypes"].([]interface{})
+	g.Expect(documentTypes).To(HaveLen(2))
+	g.Expect(documentTypes[0]).To(Equal(map[string]interface{}{
+		"CFBundleTypeName":       "Example Note",
+		"CFBundleTypeRole":       "Editor",
+		"CFBundleTypeExtensions": []interface{}{"note", "notes"},
+		"CFBundleTypeMIMETypes":  []interface{}{"application/x-example-notes-note"},
+		"CFBundleTypeIconFile":   "note.icns",
+		"LSItemContentTypes":     []interface{}{"com.example.notes.note"},
+		"LSHandlerRank":          "Owner",
+	}))
+	exportedTypes := info["UTExportedTypeDeclarations"].([]interface{})
+	g.Expect(exportedTypes).To(HaveLen(1))
+	g.Expect(exportedTypes[0]).To(HaveKeyWithValue("UTTypeIdentifier", "com.example.notes.note"))
+	g.Expect(info["CFBundleURLTypes"]).To(Equal([]interface{}{map[string]interface{}{
+		"CFBundleURLName":    "Example Notes",
+		"CFBundleURLSchemes": []interface{}{"example-notes"},
+		"CFBundleTypeRole":   "Viewer",
+	}}))
+
+	// generated fragment is valid for Info.plist schema
+	schemaCollector := diagnostics.NewCollector(0)
+	validateSchema(info, "", compileSchema(infoPlistSchema), schemaCollector, "associations")
+	g.Expect(schemaCollector.HasErrors()).To(BeFalse())
+
+	nsis := string(RenderNsis(associations.Registry()))
+	g.Expect(nsis).To(ContainSubstring(`WriteRegStr SHCTX "Software\Classes\.md" "" "com.example.notes.md"`))
+	g.Expect(nsis).To(ContainSubstring(`WriteRegStr SHCTX "Software\Classes\.note\OpenWithProgids" "com.example.notes.note" ""`))
+	g.Expect(nsis).To(ContainSubstring(`WriteRegStr SHCTX "Software\Classes\com.example.notes.note\shell\open\command" "" "$\"$INSTDIR\Example Notes.exe$\" $\"%1$\""`))
+	g.Expect(nsis).To(ContainSubstring(`WriteRegStr SHCTX "Software\Classes\example-notes" "URL Protocol" ""`))
+	g.Expect(nsis).To(ContainSubstring(`DeleteRegKey /ifempty SHCTX "Software\Classes\example-notes\shell\open\command"`))
+
+	g.Expect(associations.DesktopMimeTypes()).To(Equal("application/x-example-notes-note;text/markdown;x-scheme-handler/example-notes;"))
+	mimeInfo := string(associations.MimeInfo())
+	g.Expect(mimeInfo).To(ContainSubstring(`<mime-type type="application/x-example-notes-note">`))
+	g.Expect(mimeInfo).To(ContainSubstring(`<glob pattern="*.notes"/>`))
+	g.Expect(mimeInfo).NotTo(ContainSubstring("text/markdown"))
+}
+
+func TestAssociationConflicts(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	associations := &Associations{
+		AppId: "com.example.app",
+		FileAssociations: []*FileAssociation{
+			{Ext: []string{"foo"}, IsExported: true, MimeType: "application/x-foo"},
+			{Ext: []string{"FOO", "bar baz"}, Role: "Owner"},
+			{Ext: []string{"qux"}, IsExported: true, MimeType: "application/x-foo", Uti: "com.example.app.foo"},
+		},
+		Protocols: []*Protocol{
+			{Schemes: []string{"example", "http"}},
+			{Schemes: []string{"Example", "1abc"}},
+		},
+	}
+	collector := diagnostics.NewCollector(0)
+	associations.Validate(collector)
+
+	codes := findingCodes(collector)
+	g.Expect(codes).To(Equal(map[string]string{
+		"ERR_ASSOCIATION_EXT_CONFLICT":       diagnostics.SeverityError,
+		"ERR_ASSOCIATION_INVALID_EXT":        diagnostics.SeverityError,
+		"ERR_ASSOCIATION_INVALID_ROLE":       diagnostics.SeverityError,
+		"ERR_ASSOCIATION_MIME_TYPE_CONFLICT": diagnostics.SeverityError,
+		"ERR_ASSOCIATION_UTI_CONFLICT":       diagnostics.SeverityError,
+		"ERR_ASSOCIATION_SCHEME_RESERVED":    diagnostics.SeverityWarning,
+		"ERR_ASSOCIATION_SCHEME_CONFLICT":    diagnostics.SeverityError,
+		"ERR_ASSOCIATION_INVALID_SCHEME":     diagnostics.SeverityError,
+	}))
+}
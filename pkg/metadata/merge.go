@@ -0,0 +1,293 @@
+package metadata
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/develar/app-builder/pkg/diagnostics"
+)
+
+const (
+	ArrayAppend  = "append"
+	ArrayReplace = "replace"
+
+	TypeDict   = "dict"
+	TypeArray  = "array"
+	TypeString = "string"
+	TypeBool   = "bool"
+	TypeNumber = "number"
+	TypeDate   = "date"
+	TypeData   = "data"
+)
+
+type MergeOptions struct {
+	// default strategy for arrays, append by default (items equal to existing ones are not duplicated)
+	ArrayStrategy string
+	// strategy per key path (array items are denoted as [], e.g. CFBundleURLTypes[].CFBundleURLSchemes)
+	ArrayStrategies map[string]string
+	// value overridden by a fragment is reported as error instead of warning
+	IsStrict bool
+	// expected type per key path, * matches any part of a key
+	Schema map[string]string
+}
+
+type merger struct {
+	options   *MergeOptions
+	collector *diagnostics.Collector
+	// fragment file to report as location of a conflict
+	source string
+}
+
+var arrayIndexRegExp = regexp.MustCompile(`\[\d+]`)
+
+// schemaPath returns path without array indices (CFBundleURLTypes[0].CFBundleURLSchemes -> CFBundleURLTypes[].CFBundleURLSchemes)
+func schemaPath(path string) string {
+	return arrayIndexRegExp.ReplaceAllString(path, "[]")
+}
+
+func joinPath(parent string, key string) string {
+	if parent == "" {
+		return key
+	}
+	return parent + "." + key
+}
+
+func (t *merger) location(path string) string {
+	return path + " (" + t.source + ")"
+}
+
+// merge merges override into base, value of override wins, but every change of existing value is reported.
+// Dicts are merged recursively, arrays are appended or replaced, null removes the key.
+func (t *merger) merge(path string, base interface{}, override interface{}) interface{} {
+	baseType, overrideType := getType(base), getType(override)
+	if baseType != overrideType {
+		t.collector.Addf(diagnostics.SeverityError, "ERR_METADATA_TYPE_MISMATCH", t.location(path), "%s is expected, but %s is specified", baseType, overrideType)
+		return base
+	}
+
+	switch overrideValue := override.(type) {
+	case map[string]interface{}:
+		baseValue := base.(map[string]interface{})
+		result := make(map[string]interface{}, len(baseValue)+len(overrideValue))
+		for key, value := range baseValue {
+			result[key] = value
+		}
+		for _, key := range sortedKeys(overrideValue) {
+			value := overrideValue[key]
+			keyPath := joinPath(path, key)
+			existing, isExisting := result[key]
+			switch {
+			case value == nil:
+				if isExisting {
+					delete(result, key)
+					t.collector.Add(diagnostics.SeverityInfo, "ERR_METADATA_KEY_REMOVED", t.location(keyPath), "key is removed")
+				}
+			case isExisting:
+				result[key] = t.merge(keyPath, existing, value)
+			default:
+				result[key] = value
+			}
+		}
+		return result
+
+	case []interface{}:
+		baseValue := base.([]interface{})
+		if t.getArrayStrategy(path) == ArrayReplace {
+			if !reflect.DeepEqual(baseValue, overrideValue) {
+				t.collector.Add(diagnostics.SeverityInfo, "ERR_METADATA_ARRAY_REPLACED", t.location(path), "array is replaced")
+			}
+			return overrideValue
+		}
+
+		result := make([]interface{}, len(baseValue), len(baseValue)+len(overrideValue))
+		copy(result, baseValue)
+		for _, item := range overrideValue {
+			if !containsValue(result, item) {
+				result = append(result, item)
+			}
+		}
+		return result
+
+	default:
+		if !reflect.DeepEqual(base, override) {
+			severity := diagnostics.SeverityWarning
+			if t.options.IsStrict {
+				severity = diagnostics.SeverityError
+			}
+			t.collector.Addf(severity, "ERR_METADATA_VALUE_CONFLICT", t.location(path), "generated value %s is overridden with %s", formatValue(base), formatValue(override))
+		}
+		return override
+	}
+}
+
+func (t *merger) getArrayStrategy(path string) string {
+	if strategy, ok := t.options.ArrayStrategies[schemaPath(path)]; ok {
+		return strategy
+	}
+	if t.options.ArrayStrategy == "" {
+		return ArrayAppend
+	}
+	return t.options.ArrayStrategy
+}
+
+// validateSchema checks types of the fragment value, * in schema path matches any part of a key (e.g. NS*UsageDescription).
+// Keys of wrong type are removed from the fragment, so, the same problem is not reported again on merge.
+func validateSchema(value interface{}, path string, schema []*schemaRule, collector *diagnostics.Collector, source string) bool {
+	// null removes the key
+	if value == nil {
+		return true
+	}
+
+	if path != "" {
+		if rule := findSchemaRule(schema, schemaPath(path)); rule != nil {
+			if actual := getType(value); actual != rule.valueType {
+				collector.Addf(diagnostics.SeverityError, "ERR_METADATA_TYPE_MISMATCH", path+" ("+source+")", "%s is expected, but %s is specified", rule.valueType, actual)
+				return false
+			}
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, key := range sortedKeys(v) {
+			if !validateSchema(v[key], joinPath(path, key), schema, collector, source) {
+				delete(v, key)
+			}
+		}
+	case []interface{}:
+		for index, item := range v {
+			validateSchema(item, path+"["+strconv.Itoa(index)+"]", schema, collector, source)
+		}
+	}
+	return true
+}
+
+type schemaRule struct {
+	path      *regexp.Regexp
+	valueType string
+}
+
+func compileSchema(schema map[string]string) []*schemaRule {
+	result := make([]*schemaRule, 0, len(schema))
+	for _, path := range sortedStringKeys(schema) {
+		result = append(result, &schemaRule{path: regexp.MustCompile("^" + strings.Replace(regexp.QuoteMeta(path), `\*`, `[^.\[\]]*`, -1) + "$"), valueType: schema[path]})
+	}
+	return result
+}
+
+func findSchemaRule(schema []*schemaRule, path string) *schemaRule {
+	for _, rule := range schema {
+		if rule.path.MatchString(path) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func getType(value interface{}) string {
+	switch value.(type) {
+	case map[string]interface{}:
+		return TypeDict
+	case []interface{}:
+		return TypeArray
+	case string:
+		return TypeString
+	case bool:
+		return TypeBool
+	case int64, float64:
+		return TypeNumber
+	case time.Time:
+		return TypeDate
+	case []byte:
+		return TypeData
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// normalizeValue converts values decoded from plist, JSON or YAML to the same representation (map[string]interface{}, []interface{}, int64 for integers)
+func normalizeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			result[key] = normalizeValue(item)
+		}
+		return result
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			result[fmt.Sprint(key)] = normalizeValue(item)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for index, item := range v {
+			result[index] = normalizeValue(item)
+		}
+		return result
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case uint64:
+		if v <= math.MaxInt64 {
+			return int64(v)
+		}
+		return float64(v)
+	case float32:
+		return normalizeValue(float64(v))
+	case float64:
+		// JSON doesn't distinguish integer and real
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return int64(v)
+		}
+		return v
+	default:
+		return value
+	}
+}
+
+func containsValue(list []interface{}, value interface{}) bool {
+	for _, item := range list {
+		if reflect.DeepEqual(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return strconv.Quote(v)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func sortedKeys(value map[string]interface{}) []string {
+	result := make([]string, 0, len(value))
+	for key := range value {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func sortedStringKeys(value map[string]string) []string {
+	result := make([]string, 0, len(value))
+	for key := range value {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,220 @@
+package metadata
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/diagnostics"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/json-iterator/go"
+	"howett.net/plist"
+)
+
+type MergeReport struct {
+	Output  string              `json:"output,omitempty"`
+	Summary *diagnostics.Report `json:"summary"`
+}
+
+type AssociationsReport struct {
+	Outputs []string            `json:"outputs"`
+	Summary *diagnostics.Report `json:"summary"`
+}
+
+func ConfigureCommand(app *kingpin.Application) {
+	command := app.Command("metadata", "Merge user-provided metadata fragments with generated defaults (deep merge, type validation, conflict report).")
+	configureMergePlistCommand(command)
+	configureMergeRegistryCommand(command)
+	configureAssociationsCommand(command)
+}
+
+type mergeFlags struct {
+	base          *string
+	fragments     *[]string
+	output        *string
+	arrayStrategy *string
+	appendArrays  *[]string
+	replaceArrays *[]string
+	isStrict      *bool
+}
+
+func configureMergeFlags(command *kingpin.CmdClause) *mergeFlags {
+	return &mergeFlags{
+		base:          command.Flag("base", "The generated defaults.").ExistingFile(),
+		fragments:     command.Flag("fragment", "The user-provided fragment (plist, JSON or YAML), applied in order. Null value removes the key.").ExistingFiles(),
+		output:        command.Flag("output", "The output file.").Short('o').Required().String(),
+		arrayStrategy: command.Flag("array-strategy", "The default strategy for arrays.").Default(ArrayAppend).Enum(ArrayAppend, ArrayReplace),
+		appendArrays:  command.Flag("append-array", "The key path of array to append to (array items are denoted as [], e.g. CFBundleURLTypes[].CFBundleURLSchemes).").Strings(),
+		replaceArrays: command.Flag("replace-array", "The key path of array to replace.").Strings(),
+		isStrict:      command.Flag("strict", "Fail if generated value is overridden by a fragment.").Bool(),
+	}
+}
+
+func (t *mergeFlags) options() *MergeOptions {
+	result := &MergeOptions{ArrayStrategy: *t.arrayStrategy, ArrayStrategies: make(map[string]string), IsStrict: *t.isStrict}
+	for _, path := range *t.appendArrays {
+		result.ArrayStrategies[path] = ArrayAppend
+	}
+	for _, path := range *t.replaceArrays {
+		result.ArrayStrategies[path] = ArrayReplace
+	}
+	return result
+}
+
+func configureMergePlistCommand(metadataCommand *kingpin.CmdClause) {
+	command := metadataCommand.Command("merge-plist", "Merge Info.plist fragments. Report is written to stdout as JSON.")
+	flags := configureMergeFlags(command)
+	isBinary := command.Flag("binary", "Write binary plist.").Bool()
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		collector := diagnostics.NewCollector(0)
+		result, err := MergePlist(*flags.base, *flags.fragments, flags.options(), collector)
+		if err != nil {
+			return err
+		}
+
+		format := plist.XMLFormat
+		if *isBinary {
+			format = plist.BinaryFormat
+		}
+		return writeMergeResult(*flags.output, collector, func() ([]byte, error) {
+			return encodePlist(result, format)
+		})
+	})
+}
+
+func configureMergeRegistryCommand(metadataCommand *kingpin.CmdClause) {
+	command := metadataCommand.Command("merge-registry", "Merge registry fragments and write NSIS include (registryInstall and registryUninstall macros), WiX include or JSON. "+
+		"Report is written to stdout as JSON.")
+	flags := configureMergeFlags(command)
+	format := command.Flag("format", "The output format.").Default("nsis").Enum("nsis", "wix", "json")
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		collector := diagnostics.NewCollector(0)
+		result, err := MergeRegistry(*flags.base, *flags.fragments, flags.options(), collector)
+		if err != nil {
+			return err
+		}
+
+		return writeMergeResult(*flags.output, collector, func() ([]byte, error) {
+			return renderRegistry(result, *format)
+		})
+	})
+}
+
+func configureAssociationsCommand(metadataCommand *kingpin.CmdClause) {
+	command := metadataCommand.Command("associations", "Generate file associations and URL schemes metadata for all platforms from a declarative file (JSON or YAML): "+
+		"Info.plist fragment, registry (NSIS or WiX include), MimeType of .desktop file and shared MIME-info. Report is written to stdout as JSON.")
+	input := command.Flag("input", "The file with appId, productName, executable, fileAssociations and protocols.").Short('i').Required().ExistingFile()
+	plistOutput := command.Flag("plist-output", "The Info.plist fragment to merge using `metadata merge-plist`.").String()
+	registryOutput := command.Flag("registry-output", "The registry include.").String()
+	registryFormat := command.Flag("registry-format", "The registry include format.").Default("nsis").Enum("nsis", "wix", "json")
+	desktopOutput := command.Flag("desktop-output", "The file to write MimeType entry of .desktop file to.").String()
+	mimeInfoOutput := command.Flag("mime-info-output", "The shared MIME-info package for exported types (not written if there are no such types).").String()
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		associations, err := ReadAssociations(*input)
+		if err != nil {
+			return err
+		}
+
+		collector := diagnostics.NewCollector(0)
+		associations.Validate(collector)
+
+		report := &AssociationsReport{Outputs: []string{}}
+		if !collector.HasErrors() {
+			outputs := []struct {
+				file   string
+				encode func() ([]byte, error)
+			}{
+				{*plistOutput, func() ([]byte, error) {
+					return encodePlist(associations.InfoPlist(), plist.XMLFormat)
+				}},
+				{*registryOutput, func() ([]byte, error) {
+					return renderRegistry(associations.Registry(), *registryFormat)
+				}},
+				{*desktopOutput, func() ([]byte, error) {
+					return []byte("MimeType=" + associations.DesktopMimeTypes() + "\n"), nil
+				}},
+				{*mimeInfoOutput, func() ([]byte, error) {
+					return associations.MimeInfo(), nil
+				}},
+			}
+			for _, output := range outputs {
+				if output.file == "" {
+					continue
+				}
+				data, err := output.encode()
+				if err != nil {
+					return err
+				}
+				if data == nil {
+					continue
+				}
+				err = writeFile(output.file, data)
+				if err != nil {
+					return err
+				}
+				report.Outputs = append(report.Outputs, output.file)
+			}
+		}
+
+		report.Summary = collector.Report()
+		err = util.WriteJsonToStdOut(report)
+		if err != nil {
+			return err
+		}
+		if report.Summary.ErrorCount > 0 {
+			return util.NewMessageError("file associations are invalid: "+strconv.Itoa(report.Summary.ErrorCount)+" errors (see report)", "ERR_ASSOCIATION_CONFLICT")
+		}
+		return nil
+	})
+}
+
+func renderRegistry(registry *Registry, format string) ([]byte, error) {
+	switch format {
+	case "wix":
+		return RenderWix(registry)
+	case "json":
+		return jsoniter.ConfigCompatibleWithStandardLibrary.MarshalIndent(registry, "", "  ")
+	default:
+		return RenderNsis(registry), nil
+	}
+}
+
+func writeFile(file string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(ioutil.WriteFile(file, data, 0644))
+}
+
+// writeMergeResult writes the output only if there are no errors, the report is written in any case
+func writeMergeResult(output string, collector *diagnostics.Collector, encode func() ([]byte, error)) error {
+	report := &MergeReport{}
+	if !collector.HasErrors() {
+		data, err := encode()
+		if err != nil {
+			return err
+		}
+		err = writeFile(output, data)
+		if err != nil {
+			return err
+		}
+		report.Output = output
+	}
+
+	report.Summary = collector.Report()
+	err := util.WriteJsonToStdOut(report)
+	if err != nil {
+		return err
+	}
+	if report.Summary.ErrorCount > 0 {
+		return util.NewMessageError("cannot merge metadata: "+strconv.Itoa(report.Summary.ErrorCount)+" errors (see report)", "ERR_METADATA_CONFLICT")
+	}
+	return nil
+}
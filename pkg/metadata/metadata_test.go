@@ -0,0 +1,219 @@
+package metadata
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/diagnostics"
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+	"howett.net/plist"
+)
+
+const testInfoPlist = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+  <key>CFBundleIdentifier</key>
+  <string>com.example.app</string>
+  <key>CFBundleURLTypes</key>
+  <array>
+    <dict>
+      <key>CFBundleURLName</key>
+      <string>Example</string>
+      <key>CFBundleURLSchemes</key>
+      <array>
+        <string>example</string>
+      </array>
+    </dict>
+  </array>
+  <key>LSEnvironment</key>
+  <dict>
+    <key>MallocNanoZone</key>
+    <string>0</string>
+  </dict>
+  <key>NSHighResolutionCapable</key>
+  <true/>
+</dict>
+</plist>
+`
+
+func writeTestFiles(g *GomegaWithT, dir string, files map[string]string) {
+	for name, content := range files {
+		g.Expect(ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)).To(Succeed())
+	}
+}
+
+func findingCodes(collector *diagnostics.Collector) map[string]string {
+	result := make(map[string]string)
+	for _, finding := range collector.Report().Findings {
+		result[finding.Code] = finding.Severity
+	}
+	return result
+}
+
+func TestMergePlist(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "metadata")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	writeTestFiles(g, dir, map[string]string{
+		"Info.plist": testInfoPlist,
+		"user.json": `{
+			"CFBundleIdentifier": "com.example.custom",
+			"CFBundleURLTypes": [{"CFBundleURLName": "Custom", "CFBundleURLSchemes": ["custom"]}],
+			"LSEnvironment": {"MallocNanoZone": null, "FOO": "bar"},
+			"NSCameraUsageDescription": "Video calls",
+			"LSMinimumSystemVersion": "10.13"
+		}`,
+		"replace.yml": "CFBundleURLTypes:\n  - CFBundleURLName: Only\n",
+	})
+
+	base := filepath.Join(dir, "Info.plist")
+	collector := diagnostics.NewCollector(0)
+	result, err := MergePlist(base, []string{filepath.Join(dir, "user.json")}, &MergeOptions{}, collector)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result["CFBundleIdentifier"]).To(Equal("com.example.custom"))
+	g.Expect(result["CFBundleURLTypes"]).To(HaveLen(2))
+	g.Expect(result["LSEnvironment"]).To(Equal(map[string]interface{}{"FOO": "bar"}))
+	g.Expect(result["NSHighResolutionCapable"]).To(Equal(true))
+	g.Expect(findingCodes(collector)).To(Equal(map[string]string{
+		"ERR_METADATA_VALUE_CONFLICT": diagnostics.SeverityWarning,
+		"ERR_METADATA_KEY_REMOVED":    diagnostics.SeverityInfo,
+	}))
+
+	// encoded plist is readable
+	data, err := encodePlist(result, plist.XMLFormat)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(ioutil.WriteFile(filepath.Join(dir, "result.plist"), data, 0644)).To(Succeed())
+	decoded, err := readValueFile(filepath.Join(dir, "result.plist"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(decoded).To(Equal(result))
+
+	// replace strategy for the specified path
+	collector = diagnostics.NewCollector(0)
+	result, err = MergePlist(base, []string{filepath.Join(dir, "replace.yml")}, &MergeOptions{ArrayStrategies: map[string]string{"CFBundleURLTypes": ArrayReplace}}, collector)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result["CFBundleURLTypes"]).To(Equal([]interface{}{map[string]interface{}{"CFBundleURLName": "Only"}}))
+	g.Expect(findingCodes(collector)).To(HaveKeyWithValue("ERR_METADATA_ARRAY_REPLACED", diagnostics.SeverityInfo))
+
+	// override is an error in strict mode
+	collector = diagnostics.NewCollector(0)
+	result, err = MergePlist(base, []string{filepath.Join(dir, "user.json")}, &MergeOptions{IsStrict: true}, collector)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result).To(BeNil())
+	g.Expect(findingCodes(collector)).To(HaveKeyWithValue("ERR_METADATA_VALUE_CONFLICT", diagnostics.SeverityError))
+}
+
+func TestMergePlistTypeMismatch(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "metadata")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	writeTestFiles(g, dir, map[string]string{
+		"Info.plist": testInfoPlist,
+		"user.yaml":  "LSUIElement: \"true\"\nNSMicrophoneUsageDescription: 1\nCFBundleURLTypes:\n  - CFBundleURLSchemes: foo\nLSEnvironment: []\n",
+	})
+
+	collector := diagnostics.NewCollector(0)
+	result, err := MergePlist(filepath.Join(dir, "Info.plist"), []string{filepath.Join(dir, "user.yaml")}, &MergeOptions{}, collector)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result).To(BeNil())
+
+	report := collector.Report()
+	g.Expect(report.ErrorCount).To(Equal(4))
+	var locations []string
+	for _, finding := range report.Findings {
+		g.Expect(finding.Code).To(Equal("ERR_METADATA_TYPE_MISMATCH"))
+		locations = append(locations, finding.Locations...)
+	}
+	userFile := filepath.Join(dir, "user.yaml")
+	g.Expect(locations).To(ConsistOf(
+		"LSUIElement ("+userFile+")",
+		"NSMicrophoneUsageDescription ("+userFile+")",
+		"CFBundleURLTypes[0].CFBundleURLSchemes ("+userFile+")",
+		"LSEnvironment ("+userFile+")",
+	))
+}
+
+func TestMergeRegistry(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "metadata")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	writeTestFiles(g, dir, map[string]string{
+		"base.json": `{
+			"SHCTX\\Software\\Example": {"@": "Example", "InstallLocation": "$INSTDIR", "Flags": ["a"]},
+			"HKCU\\Software\\Classes\\example": {"URL Protocol": "", "Obsolete": "1"}
+		}`,
+		"user.yml": `
+HKEY_CURRENT_USER/software/classes/EXAMPLE:
+  obsolete: null
+  EditFlags: {type: dword, value: 2}
+SHCTX\Software\Example:
+  Flags: [b, a]
+  Path: {type: expandSz, value: "%ProgramFiles%\\Example"}
+  Debug: true
+`,
+		"bad.yml": "HKXX\\Software: {a: b}\nHKCU\\Software\\Example:\n  Size: {type: dword, value: -1}\n",
+	})
+
+	collector := diagnostics.NewCollector(0)
+	registry, err := MergeRegistry(filepath.Join(dir, "base.json"), []string{filepath.Join(dir, "user.yml")}, &MergeOptions{}, collector)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(collector.HasErrors()).To(BeFalse())
+	g.Expect(registry.Keys).To(HaveLen(2))
+	g.Expect(registry.Keys[0].SubKey).To(Equal(`Software\Classes\example`))
+	g.Expect(registry.Keys[1].Entries[2]).To(Equal(&RegistryEntry{Name: "Flags", Type: RegistryMultiSz, Value: []interface{}{"a", "b"}}))
+
+	g.Expect(string(RenderNsis(registry))).To(Equal(`; generated by app-builder
+!macro registryInstall
+  WriteRegDWORD HKCU "Software\Classes\example" "EditFlags" 2
+  WriteRegStr HKCU "Software\Classes\example" "URL Protocol" ""
+  WriteRegStr SHCTX "Software\Example" "" "Example"
+  WriteRegDWORD SHCTX "Software\Example" "Debug" 1
+  WriteRegMultiStr /REGEDIT5 SHCTX "Software\Example" "Flags" 61,00,00,00,62,00,00,00,00,00
+  WriteRegStr SHCTX "Software\Example" "InstallLocation" "$INSTDIR"
+  WriteRegExpandStr SHCTX "Software\Example" "Path" "%ProgramFiles%\Example"
+!macroend
+
+!macro registryUninstall
+  DeleteRegValue HKCU "Software\Classes\example" "EditFlags"
+  DeleteRegValue HKCU "Software\Classes\example" "URL Protocol"
+  DeleteRegKey /ifempty HKCU "Software\Classes\example"
+  DeleteRegValue SHCTX "Software\Example" ""
+  DeleteRegValue SHCTX "Software\Example" "Debug"
+  DeleteRegValue SHCTX "Software\Example" "Flags"
+  DeleteRegValue SHCTX "Software\Example" "InstallLocation"
+  DeleteRegValue SHCTX "Software\Example" "Path"
+  DeleteRegKey /ifempty SHCTX "Software\Example"
+!macroend
+`))
+
+	wix, err := RenderWix(registry)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(wix)).To(ContainSubstring(`<RegistryKey Root="HKMU" Key="Software\Example">`))
+	g.Expect(string(wix)).To(ContainSubstring(`<RegistryValue Type="string" Value="Example"/>`))
+	g.Expect(string(wix)).To(ContainSubstring(`<RegistryValue Type="integer" Name="EditFlags" Value="2"/>`))
+	g.Expect(string(wix)).To(ContainSubstring("<MultiStringValue>b</MultiStringValue>"))
+
+	collector = diagnostics.NewCollector(0)
+	registry, err = MergeRegistry("", []string{filepath.Join(dir, "bad.yml")}, &MergeOptions{}, collector)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(registry).To(BeNil())
+	g.Expect(findingCodes(collector)).To(Equal(map[string]string{
+		"ERR_METADATA_INVALID_REGISTRY_KEY":   diagnostics.SeverityError,
+		"ERR_METADATA_INVALID_REGISTRY_VALUE": diagnostics.SeverityError,
+	}))
+}
@@ -0,0 +1,132 @@
+package metadata
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/develar/app-builder/pkg/diagnostics"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/json-iterator/go"
+	"gopkg.in/yaml.v2"
+	"howett.net/plist"
+)
+
+// types of well-known Info.plist keys, value of wrong type is ignored or breaks the app (e.g. LSUIElement as string)
+var infoPlistSchema = map[string]string{
+	"CFBundleIdentifier":                    TypeString,
+	"CFBundleName":                          TypeString,
+	"CFBundleDisplayName":                   TypeString,
+	"CFBundleExecutable":                    TypeString,
+	"CFBundleVersion":                       TypeString,
+	"CFBundleShortVersionString":            TypeString,
+	"CFBundlePackageType":                   TypeString,
+	"CFBundleIconFile":                      TypeString,
+	"CFBundleDevelopmentRegion":             TypeString,
+	"LSMinimumSystemVersion":                TypeString,
+	"LSApplicationCategoryType":             TypeString,
+	"NSHumanReadableCopyright":              TypeString,
+	"NSPrincipalClass":                      TypeString,
+	"NSMainNibFile":                         TypeString,
+	"NS*UsageDescription":                   TypeString,
+	"NSHighResolutionCapable":               TypeBool,
+	"NSSupportsAutomaticGraphicsSwitching":  TypeBool,
+	"NSRequiresAquaSystemAppearance":        TypeBool,
+	"LSUIElement":                           TypeBool,
+	"LSBackgroundOnly":                      TypeBool,
+	"LSMultipleInstancesProhibited":         TypeBool,
+	"LSRequiresNativeExecution":             TypeBool,
+	"ITSAppUsesNonExemptEncryption":         TypeBool,
+	"NSAppTransportSecurity":                TypeDict,
+	"LSEnvironment":                         TypeDict,
+	"LSArchitecturePriority":                TypeArray,
+	"CFBundleURLTypes":                      TypeArray,
+	"CFBundleURLTypes[]":                    TypeDict,
+	"CFBundleURLTypes[].CFBundleURLName":    TypeString,
+	"CFBundleURLTypes[].CFBundleURLSchemes": TypeArray,
+	"CFBundleDocumentTypes":                 TypeArray,
+	"CFBundleDocumentTypes[]":               TypeDict,
+	"UTExportedTypeDeclarations":            TypeArray,
+	"UTImportedTypeDeclarations":            TypeArray,
+}
+
+// readValueFile reads plist (XML, binary or OpenStep), JSON or YAML file as normalized value
+func readValueFile(file string) (interface{}, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var value interface{}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json":
+		err = jsoniter.Unmarshal(data, &value)
+	case ".yml", ".yaml":
+		err = yaml.Unmarshal(data, &value)
+	default:
+		_, err = plist.Unmarshal(data, &value)
+	}
+	if err != nil {
+		return nil, util.NewMessageError("cannot parse "+file+": "+err.Error(), "ERR_METADATA_INVALID_FORMAT")
+	}
+	return normalizeValue(value), nil
+}
+
+// MergePlist merges fragments into the base plist in order, the last fragment wins. Result is nil if there are errors.
+func MergePlist(base string, fragments []string, options *MergeOptions, collector *diagnostics.Collector) (map[string]interface{}, error) {
+	result := make(map[string]interface{})
+	if base != "" {
+		value, err := readValueFile(base)
+		if err != nil {
+			return nil, err
+		}
+		dict, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, util.NewMessageError(base+": dict is expected at the top level", "ERR_METADATA_INVALID_FORMAT")
+		}
+		result = dict
+	}
+
+	schemaTypes := make(map[string]string, len(infoPlistSchema)+len(options.Schema))
+	for path, valueType := range infoPlistSchema {
+		schemaTypes[path] = valueType
+	}
+	for path, valueType := range options.Schema {
+		schemaTypes[path] = valueType
+	}
+	schema := compileSchema(schemaTypes)
+	for _, fragment := range fragments {
+		value, err := readValueFile(fragment)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := value.(map[string]interface{}); !ok {
+			return nil, util.NewMessageError(fragment+": dict is expected at the top level", "ERR_METADATA_INVALID_FORMAT")
+		}
+
+		// fragment is validated before merge, so, the wrong type is reported for the fragment, not for the result
+		validateSchema(value, "", schema, collector, fragment)
+		merger := &merger{options: options, collector: collector, source: fragment}
+		result = merger.merge("", result, value).(map[string]interface{})
+	}
+
+	if collector.HasErrors() {
+		return nil, nil
+	}
+	return result, nil
+}
+
+func encodePlist(value interface{}, format int) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := plist.NewEncoderForFormat(&buffer, format)
+	if format == plist.XMLFormat {
+		encoder.Indent("\t")
+	}
+	err := encoder.Encode(value)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return buffer.Bytes(), nil
+}
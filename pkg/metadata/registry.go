@@ -0,0 +1,353 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/develar/app-builder/pkg/diagnostics"
+	"github.com/develar/app-builder/pkg/util"
+)
+
+const (
+	RegistrySz       = "sz"
+	RegistryExpandSz = "expandSz"
+	RegistryDword    = "dword"
+	RegistryMultiSz  = "multiSz"
+	RegistryBinary   = "binary"
+)
+
+// SHCTX is HKLM or HKCU depending on install mode (per-machine or per-user)
+var registryRoots = map[string]string{
+	"HKCU":                "HKCU",
+	"HKEY_CURRENT_USER":   "HKCU",
+	"HKLM":                "HKLM",
+	"HKEY_LOCAL_MACHINE":  "HKLM",
+	"HKCR":                "HKCR",
+	"HKEY_CLASSES_ROOT":   "HKCR",
+	"HKU":                 "HKU",
+	"HKEY_USERS":          "HKU",
+	"SHCTX":               "SHCTX",
+	"HKEY_CURRENT_CONFIG": "HKCC",
+	"HKCC":                "HKCC",
+}
+
+var wixRoots = map[string]string{
+	"HKCU":  "HKCU",
+	"HKLM":  "HKLM",
+	"HKCR":  "HKCR",
+	"HKU":   "HKU",
+	"SHCTX": "HKMU",
+}
+
+type RegistryEntry struct {
+	// empty for the default value
+	Name  string      `json:"name"`
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+type RegistryKey struct {
+	Root    string           `json:"root"`
+	SubKey  string           `json:"subKey"`
+	Entries []*RegistryEntry `json:"entries"`
+}
+
+// Registry keys and value names are case-insensitive, keys are sorted to produce stable output
+type Registry struct {
+	Keys []*RegistryKey `json:"keys"`
+}
+
+func (t *RegistryKey) path() string {
+	return t.Root + `\` + t.SubKey
+}
+
+func (t *Registry) getKey(root string, subKey string) *RegistryKey {
+	for _, key := range t.Keys {
+		if key.Root == root && strings.EqualFold(key.SubKey, subKey) {
+			return key
+		}
+	}
+	key := &RegistryKey{Root: root, SubKey: subKey}
+	t.Keys = append(t.Keys, key)
+	return key
+}
+
+func (t *RegistryKey) getEntryIndex(name string) int {
+	for index, entry := range t.Entries {
+		if strings.EqualFold(entry.Name, name) {
+			return index
+		}
+	}
+	return -1
+}
+
+// MergeRegistry merges registry fragments (key path -> value name -> value) into the base in order, the last fragment wins.
+// Value is a string (sz), integer or bool (dword), array of strings (multiSz) or {type, value}, null removes the value. Result is nil if there are errors.
+func MergeRegistry(base string, fragments []string, options *MergeOptions, collector *diagnostics.Collector) (*Registry, error) {
+	result := &Registry{}
+	for index, file := range append([]string{base}, fragments...) {
+		if file == "" {
+			continue
+		}
+
+		value, err := readValueFile(file)
+		if err != nil {
+			return nil, err
+		}
+		keys, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, util.NewMessageError(file+": dict of registry keys is expected at the top level", "ERR_METADATA_INVALID_FORMAT")
+		}
+
+		merger := &merger{options: options, collector: collector, source: file}
+		for _, keyPath := range sortedKeys(keys) {
+			mergeRegistryKey(result, keyPath, keys[keyPath], merger, index == 0 && base != "")
+		}
+	}
+
+	if collector.HasErrors() {
+		return nil, nil
+	}
+
+	for _, key := range result.Keys {
+		sort.SliceStable(key.Entries, func(i, j int) bool {
+			return strings.ToLower(key.Entries[i].Name) < strings.ToLower(key.Entries[j].Name)
+		})
+	}
+	sort.SliceStable(result.Keys, func(i, j int) bool {
+		return strings.ToLower(result.Keys[i].path()) < strings.ToLower(result.Keys[j].path())
+	})
+	return result, nil
+}
+
+func mergeRegistryKey(registry *Registry, keyPath string, rawValues interface{}, merger *merger, isBase bool) {
+	collector := merger.collector
+	separator := strings.IndexAny(keyPath, `\/`)
+	root := ""
+	if separator > 0 {
+		root = registryRoots[strings.ToUpper(keyPath[:separator])]
+	}
+	if root == "" || separator == len(keyPath)-1 {
+		collector.Add(diagnostics.SeverityError, "ERR_METADATA_INVALID_REGISTRY_KEY", merger.location(keyPath), "key must start with HKCU, HKLM, HKCR, HKU or SHCTX followed by subkey")
+		return
+	}
+
+	values, ok := rawValues.(map[string]interface{})
+	if !ok {
+		collector.Addf(diagnostics.SeverityError, "ERR_METADATA_TYPE_MISMATCH", merger.location(keyPath), "dict of values is expected, but %s is specified", getType(rawValues))
+		return
+	}
+
+	key := registry.getKey(root, strings.Replace(keyPath[separator+1:], "/", `\`, -1))
+	for _, name := range sortedKeys(values) {
+		valueName := name
+		if valueName == "@" {
+			valueName = ""
+		}
+		path := key.path() + `\` + name
+
+		index := key.getEntryIndex(valueName)
+		if values[name] == nil {
+			if index >= 0 {
+				key.Entries = append(key.Entries[:index], key.Entries[index+1:]...)
+				collector.Add(diagnostics.SeverityInfo, "ERR_METADATA_KEY_REMOVED", merger.location(path), "value is removed")
+			}
+			continue
+		}
+
+		entry, err := parseRegistryEntry(valueName, values[name])
+		if err != nil {
+			collector.Add(diagnostics.SeverityError, "ERR_METADATA_INVALID_REGISTRY_VALUE", merger.location(path), err.Error())
+			continue
+		}
+
+		if index < 0 || isBase {
+			if index < 0 {
+				key.Entries = append(key.Entries, entry)
+			} else {
+				key.Entries[index] = entry
+			}
+			continue
+		}
+
+		existing := key.Entries[index]
+		if existing.Type != entry.Type {
+			collector.Addf(diagnostics.SeverityError, "ERR_METADATA_TYPE_MISMATCH", merger.location(path), "%s is expected, but %s is specified", existing.Type, entry.Type)
+			continue
+		}
+		existing.Value = merger.merge(path, existing.Value, entry.Value)
+	}
+}
+
+func parseRegistryEntry(name string, raw interface{}) (*RegistryEntry, error) {
+	entry := &RegistryEntry{Name: name}
+	value := raw
+	switch v := raw.(type) {
+	case string:
+		entry.Type = RegistrySz
+	case bool:
+		entry.Type = RegistryDword
+		if v {
+			value = int64(1)
+		} else {
+			value = int64(0)
+		}
+	case int64:
+		entry.Type = RegistryDword
+	case []interface{}:
+		entry.Type = RegistryMultiSz
+	case map[string]interface{}:
+		valueType, _ := v["type"].(string)
+		entry.Type = valueType
+		value = v["value"]
+		if b, ok := value.(bool); ok && valueType == RegistryDword {
+			value = int64(0)
+			if b {
+				value = int64(1)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported value type %s", getType(raw))
+	}
+	entry.Value = value
+
+	switch entry.Type {
+	case RegistrySz, RegistryExpandSz:
+		if _, ok := value.(string); !ok {
+			return nil, fmt.Errorf("string is expected for %s, but %s is specified", entry.Type, getType(value))
+		}
+	case RegistryDword:
+		number, ok := value.(int64)
+		if !ok || number < 0 || number > 0xffffffff {
+			return nil, fmt.Errorf("integer in range 0-4294967295 is expected for dword, but %s is specified", formatValue(value))
+		}
+	case RegistryMultiSz:
+		list, ok := value.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("array of strings is expected for multiSz, but %s is specified", getType(value))
+		}
+		for _, item := range list {
+			if _, ok := item.(string); !ok {
+				return nil, fmt.Errorf("array of strings is expected for multiSz, but %s item is specified", getType(item))
+			}
+		}
+	case RegistryBinary:
+		data, ok := value.(string)
+		if _, err := hex.DecodeString(data); !ok || err != nil {
+			return nil, fmt.Errorf("hex string is expected for binary")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported registry value type %q (expected sz, expandSz, dword, multiSz or binary)", entry.Type)
+	}
+	return entry, nil
+}
+
+// RenderNsis returns NSIS include with registryInstall and registryUninstall macros. Values are not escaped for $ (NSIS variables, e.g. $INSTDIR, are allowed).
+func RenderNsis(registry *Registry) []byte {
+	var install, uninstall bytes.Buffer
+	for _, key := range registry.Keys {
+		for _, entry := range key.Entries {
+			prefix := key.Root + " " + quoteNsis(key.SubKey) + " " + quoteNsis(entry.Name)
+			switch entry.Type {
+			case RegistrySz:
+				install.WriteString("  WriteRegStr " + prefix + " " + quoteNsis(entry.Value.(string)) + "\n")
+			case RegistryExpandSz:
+				install.WriteString("  WriteRegExpandStr " + prefix + " " + quoteNsis(entry.Value.(string)) + "\n")
+			case RegistryDword:
+				install.WriteString("  WriteRegDWORD " + prefix + " " + strconv.FormatInt(entry.Value.(int64), 10) + "\n")
+			case RegistryBinary:
+				install.WriteString("  WriteRegBin " + prefix + " " + strings.ToLower(entry.Value.(string)) + "\n")
+			case RegistryMultiSz:
+				install.WriteString("  WriteRegMultiStr /REGEDIT5 " + prefix + " " + encodeMultiSz(entry.Value.([]interface{})) + "\n")
+			}
+			uninstall.WriteString("  DeleteRegValue " + prefix + "\n")
+		}
+		uninstall.WriteString("  DeleteRegKey /ifempty " + key.Root + " " + quoteNsis(key.SubKey) + "\n")
+	}
+
+	var result bytes.Buffer
+	result.WriteString("; generated by app-builder\n!macro registryInstall\n")
+	result.Write(install.Bytes())
+	result.WriteString("!macroend\n\n!macro registryUninstall\n")
+	result.Write(uninstall.Bytes())
+	result.WriteString("!macroend\n")
+	return result.Bytes()
+}
+
+// RenderWix returns WiX include with RegistryKey elements (to be included into a component)
+func RenderWix(registry *Registry) ([]byte, error) {
+	var result bytes.Buffer
+	result.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<!-- generated by app-builder -->\n<Include>\n")
+	for _, key := range registry.Keys {
+		root, ok := wixRoots[key.Root]
+		if !ok {
+			return nil, util.NewMessageError("registry root "+key.Root+" is not supported by WiX", "ERR_METADATA_UNSUPPORTED_REGISTRY_KEY")
+		}
+
+		result.WriteString("  <RegistryKey Root=\"" + root + "\" Key=\"" + escapeXml(key.SubKey) + "\">\n")
+		for _, entry := range key.Entries {
+			name := ""
+			if entry.Name != "" {
+				name = " Name=\"" + escapeXml(entry.Name) + "\""
+			}
+
+			switch entry.Type {
+			case RegistryMultiSz:
+				result.WriteString("    <RegistryValue Type=\"multiString\"" + name + ">\n")
+				for _, item := range entry.Value.([]interface{}) {
+					result.WriteString("      <MultiStringValue>" + escapeXml(item.(string)) + "</MultiStringValue>\n")
+				}
+				result.WriteString("    </RegistryValue>\n")
+			default:
+				wixType, value := "string", ""
+				switch entry.Type {
+				case RegistrySz:
+					value = entry.Value.(string)
+				case RegistryExpandSz:
+					wixType, value = "expandable", entry.Value.(string)
+				case RegistryDword:
+					wixType, value = "integer", strconv.FormatInt(entry.Value.(int64), 10)
+				case RegistryBinary:
+					wixType, value = "binary", strings.ToLower(entry.Value.(string))
+				}
+				result.WriteString("    <RegistryValue Type=\"" + wixType + "\"" + name + " Value=\"" + escapeXml(value) + "\"/>\n")
+			}
+		}
+		result.WriteString("  </RegistryKey>\n")
+	}
+	result.WriteString("</Include>\n")
+	return result.Bytes(), nil
+}
+
+func quoteNsis(value string) string {
+	replacer := strings.NewReplacer(`"`, `$\"`, "\r", `$\r`, "\n", `$\n`, "\t", `$\t`)
+	return `"` + replacer.Replace(value) + `"`
+}
+
+// encodeMultiSz returns comma-separated hex bytes of UTF-16 strings terminated by double null (REGEDIT5 format)
+func encodeMultiSz(list []interface{}) string {
+	var units []uint16
+	for _, item := range list {
+		units = append(units, utf16.Encode([]rune(item.(string)))...)
+		units = append(units, 0)
+	}
+	units = append(units, 0)
+
+	parts := make([]string, 0, len(units)*2)
+	for _, unit := range units {
+		parts = append(parts, fmt.Sprintf("%02x", byte(unit)), fmt.Sprintf("%02x", byte(unit>>8)))
+	}
+	return strings.Join(parts, ",")
+}
+
+func escapeXml(value string) string {
+	var buffer bytes.Buffer
+	_ = xml.EscapeText(&buffer, []byte(value))
+	return buffer.String()
+}
@@ -0,0 +1,181 @@
+package node_modules
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/develar/errors"
+)
+
+// packageResolver resolves dependency of the package to the real package dir (pnpm store, unpacked Yarn PnP zip).
+// Returned dependency is shared - a copy is placed to the tree.
+type packageResolver interface {
+	resolve(parent *Dependency, name string) (*Dependency, error)
+}
+
+// a package placed to the logical (hoisted) node_modules tree
+type hoistedNode struct {
+	dependency *Dependency
+	// dir of the package in the logical tree (dir of the project for root)
+	logicalDir string
+	// owner of node_modules where the package is placed
+	parent *hoistedNode
+}
+
+// readHoistedDependencyTree is used if real layout of packages is not a node_modules tree (pnpm, Yarn PnP).
+// Packages are placed to the logical node_modules tree as npm does: to the root node_modules if there is no other version of the package up the tree,
+// otherwise to the node_modules of the dependent package. Real dir of the package is reported as path.
+func (t *Collector) readHoistedDependencyTree(root *Dependency, resolver packageResolver) error {
+	queue := []*hoistedNode{{dependency: root, logicalDir: root.dir}}
+	rootNode := queue[0]
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+
+		for _, isOptional := range []bool{false, true} {
+			list := node.dependency.Dependencies
+			if isOptional {
+				list = node.dependency.OptionalDependencies
+			}
+
+			for _, name := range sortedKeys(list) {
+				if strings.HasPrefix(name, "@types/") || t.excludedDependencies[name] {
+					continue
+				}
+				if isOptional && node.dependency.Dependencies[name] != "" {
+					continue
+				}
+
+				resolved, err := resolver.resolve(node.dependency, name)
+				if err != nil {
+					return err
+				}
+				if resolved == nil {
+					if !isOptional {
+						t.unresolvedDependencies[name] = true
+					}
+					continue
+				}
+
+				existing := t.findPlaced(node, name)
+				if existing != nil && existing.realDir == resolved.realDir {
+					correctOptionalState(isOptional, existing)
+					continue
+				}
+
+				owner := rootNode
+				if existing != nil {
+					// another version is visible for the package - nest to not shadow it
+					owner = node
+				}
+
+				child := *resolved
+				child.isOptional = 0
+				correctOptionalState(isOptional, &child)
+				nodeModuleDir := filepath.Join(owner.logicalDir, "node_modules")
+				child.dir = filepath.Join(nodeModuleDir, name)
+				t.place(nodeModuleDir, name, &child)
+				queue = append(queue, &hoistedNode{dependency: &child, logicalDir: child.dir, parent: owner})
+			}
+		}
+	}
+	return nil
+}
+
+// findPlaced returns the package visible for the node (as node resolves it from the logical dir)
+func (t *Collector) findPlaced(node *hoistedNode, name string) *Dependency {
+	for current := node; current != nil; current = current.parent {
+		dependencyMap := t.NodeModuleDirToDependencyMap[filepath.Join(current.logicalDir, "node_modules")]
+		if dependencyMap != nil && (*dependencyMap)[name] != nil {
+			return (*dependencyMap)[name]
+		}
+	}
+	return nil
+}
+
+func (t *Collector) place(nodeModuleDir string, name string, dependency *Dependency) {
+	dependencyMap := t.NodeModuleDirToDependencyMap[nodeModuleDir]
+	if dependencyMap == nil {
+		m := make(map[string]*Dependency)
+		t.NodeModuleDirToDependencyMap[nodeModuleDir] = &m
+		dependencyMap = &m
+	}
+	(*dependencyMap)[name] = dependency
+}
+
+// pnpm links packages from the store (node_modules/.pnpm/<name>@<version>/node_modules/<name>), dependencies of the package are siblings in the store.
+type pnpmResolver struct {
+	realDirToDependency map[string]*Dependency
+}
+
+func newPnpmResolver() *pnpmResolver {
+	return &pnpmResolver{realDirToDependency: make(map[string]*Dependency)}
+}
+
+// isPnpmLayout returns true if node_modules is created by pnpm with isolated layout (node-linker=hoisted produces regular node_modules)
+func isPnpmLayout(dir string) (bool, error) {
+	nodeModuleDir, err := findNearestNodeModuleDir(dir)
+	if err != nil || len(nodeModuleDir) == 0 {
+		return false, err
+	}
+
+	info, err := os.Stat(filepath.Join(nodeModuleDir, ".pnpm"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, errors.WithStack(err)
+	}
+	return info.IsDir(), nil
+}
+
+func (t *pnpmResolver) resolve(parent *Dependency, name string) (*Dependency, error) {
+	fromDir := parent.realDir
+	if len(fromDir) == 0 {
+		fromDir = parent.dir
+	}
+
+	// the same lookup as node does, but from the real dir - dependencies are resolved by symlinks in the store
+	for dir := fromDir; len(dir) != 0; dir = getParentDir(dir) {
+		if filepath.Base(dir) == "node_modules" {
+			continue
+		}
+
+		candidate := filepath.Join(dir, "node_modules", name)
+		if _, err := os.Stat(filepath.Join(candidate, "package.json")); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, errors.WithStack(err)
+		}
+
+		realDir, err := filepath.EvalSymlinks(candidate)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		dependency := t.realDirToDependency[realDir]
+		if dependency == nil {
+			dependency, err = readPackageJson(realDir)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			dependency.realDir = realDir
+			t.realDirToDependency[realDir] = dependency
+		}
+		return dependency, nil
+	}
+	return nil, nil
+}
+
+// order of placement determines which version is hoisted, so, dependencies are processed in a stable order
+func sortedKeys(m map[string]string) []string {
+	result := make([]string, 0, len(m))
+	for key := range m {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,198 @@
+package node_modules
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+)
+
+type packageMetadata struct {
+	// SPDX expression from package.json or detected by license file, empty if unknown
+	license string
+	// name of license file in the package dir
+	licenseFile string
+
+	// unpacked size of the package files (nested node_modules are not included - these are reported as separate packages)
+	size      int64
+	fileCount int
+}
+
+// collectMetadata computes license and size of collected packages, package dir shared by several places in the tree (pnpm store, linked package) is processed once
+func (t *Collector) collectMetadata(isLicense bool, isSize bool) error {
+	dirToDependencies := make(map[string][]*Dependency)
+	for _, dependencyMap := range t.NodeModuleDirToDependencyMap {
+		for _, dependency := range *dependencyMap {
+			dir := dependency.realDir
+			if len(dir) == 0 {
+				dir = dependency.dir
+			}
+			dirToDependencies[dir] = append(dirToDependencies[dir], dependency)
+		}
+	}
+
+	dirs := make([]string, 0, len(dirToDependencies))
+	for dir := range dirToDependencies {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	return util.MapAsync(len(dirs), func(taskIndex int) (func() error, error) {
+		dir := dirs[taskIndex]
+		dependencies := dirToDependencies[dir]
+		return func() error {
+			metadata := &packageMetadata{}
+			var err error
+			if isLicense {
+				metadata.license, metadata.licenseFile, err = readLicense(dir, dependencies[0])
+				if err != nil {
+					return err
+				}
+			}
+			if isSize {
+				metadata.size, metadata.fileCount, err = computePackageSize(dir)
+				if err != nil {
+					return err
+				}
+			}
+
+			for _, dependency := range dependencies {
+				dependency.metadata = metadata
+			}
+			return nil
+		}, nil
+	})
+}
+
+func readLicense(dir string, dependency *Dependency) (string, string, error) {
+	licenseFile, err := findLicenseFile(dir)
+	if err != nil {
+		return "", "", err
+	}
+
+	license := getDeclaredLicense(dependency)
+	if len(license) != 0 || len(licenseFile) == 0 {
+		return license, licenseFile, nil
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, licenseFile))
+	if err != nil {
+		return "", "", errors.WithStack(err)
+	}
+	return detectLicense(string(data)), licenseFile, nil
+}
+
+// license is a SPDX expression or (deprecated) an object with type, licenses is a deprecated list of objects with type
+func getDeclaredLicense(dependency *Dependency) string {
+	switch value := dependency.License.(type) {
+	case string:
+		return strings.TrimSpace(value)
+	case map[string]interface{}:
+		if licenseType, ok := value["type"].(string); ok {
+			return licenseType
+		}
+	}
+
+	list, ok := dependency.Licenses.([]interface{})
+	if !ok {
+		return ""
+	}
+
+	var types []string
+	for _, item := range list {
+		if object, ok := item.(map[string]interface{}); ok {
+			if licenseType, ok := object["type"].(string); ok && len(licenseType) != 0 {
+				types = append(types, licenseType)
+			}
+		}
+	}
+	if len(types) > 1 {
+		return "(" + strings.Join(types, " OR ") + ")"
+	}
+	return strings.Join(types, "")
+}
+
+var licenseFilePattern = regexp.MustCompile(`(?i)^(licen[cs]e|copying)([-._].*)?$`)
+
+func findLicenseFile(dir string) (string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	for _, file := range files {
+		if !file.IsDir() && licenseFilePattern.MatchString(file.Name()) {
+			return file.Name(), nil
+		}
+	}
+	return "", nil
+}
+
+var licenseTextToId = []struct {
+	id    string
+	texts []string
+}{
+	{"MIT", []string{"permission is hereby granted, free of charge"}},
+	{"ISC", []string{"permission to use, copy, modify, and/or distribute this software for any purpose with or without fee is hereby granted, provided that the above copyright notice"}},
+	{"Apache-2.0", []string{"apache license", "version 2.0"}},
+	{"BSD-3-Clause", []string{"redistribution and use in source and binary forms", "neither the name"}},
+	{"BSD-2-Clause", []string{"redistribution and use in source and binary forms"}},
+	{"MPL-2.0", []string{"mozilla public license", "version 2.0"}},
+	{"LGPL-3.0", []string{"gnu lesser general public license", "version 3"}},
+	{"LGPL-2.1", []string{"gnu lesser general public license", "version 2.1"}},
+	{"GPL-3.0", []string{"gnu general public license", "version 3"}},
+	{"GPL-2.0", []string{"gnu general public license", "version 2"}},
+	{"Unlicense", []string{"this is free and unencumbered software released into the public domain"}},
+	// ISC without notice requirement
+	{"0BSD", []string{"permission to use, copy, modify, and/or distribute this software for any purpose with or without fee is hereby granted"}},
+}
+
+var whitespacePattern = regexp.MustCompile(`\s+`)
+
+// detectLicense identifies common licenses by the distinctive text, empty if license is not recognized
+func detectLicense(text string) string {
+	text = whitespacePattern.ReplaceAllString(strings.ToLower(text), " ")
+	for _, item := range licenseTextToId {
+		isMatched := true
+		for _, s := range item.texts {
+			if !strings.Contains(text, s) {
+				isMatched = false
+				break
+			}
+		}
+		if isMatched {
+			return item.id
+		}
+	}
+	return ""
+}
+
+func computePackageSize(dir string) (int64, int, error) {
+	var size int64
+	fileCount := 0
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if info.Name() == "node_modules" && file != dir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		size += info.Size()
+		fileCount++
+		return nil
+	})
+	if err != nil {
+		return 0, 0, errors.WithStack(err)
+	}
+	return size, fileCount, nil
+}
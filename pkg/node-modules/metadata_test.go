@@ -0,0 +1,77 @@
+package node_modules
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/json-iterator/go"
+	. "github.com/onsi/gomega"
+)
+
+func TestMetadata(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "metadata")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	nodeModuleDir := filepath.Join(dir, "node_modules")
+	writePackageJson(g, dir, `{"name": "app", "dependencies": {"a": "1.0.0", "b": "1.0.0", "c": "1.0.0"}}`)
+	writePackageJson(g, filepath.Join(nodeModuleDir, "a"), `{"name": "a", "version": "1.0.0", "license": "MIT", "dependencies": {"d": "1.0.0"}}`)
+	writePackageJson(g, filepath.Join(nodeModuleDir, "b"), `{"name": "b", "version": "1.0.0"}`)
+	writePackageJson(g, filepath.Join(nodeModuleDir, "c"), `{"name": "c", "version": "1.0.0", "licenses": [{"type": "MIT"}, {"type": "Apache-2.0"}]}`)
+	writePackageJson(g, filepath.Join(nodeModuleDir, "a", "node_modules", "d"), `{"name": "d", "version": "1.0.0"}`)
+	g.Expect(ioutil.WriteFile(filepath.Join(nodeModuleDir, "b", "LICENSE.txt"), []byte("Apache License\n   Version 2.0, January 2004\n"), 0644)).To(Succeed())
+	g.Expect(ioutil.WriteFile(filepath.Join(nodeModuleDir, "a", "index.js"), []byte("module.exports = 42"), 0644)).To(Succeed())
+
+	collector := collectTree(g, dir)
+	g.Expect(collector.collectMetadata(true, true)).To(Succeed())
+
+	var buffer bytes.Buffer
+	jsonWriter := jsoniter.NewStream(jsoniter.ConfigFastest, &buffer, 1024)
+	writeResult(jsonWriter, collector)
+	g.Expect(jsonWriter.Flush()).To(Succeed())
+
+	var result []struct {
+		Dir  string `json:"dir"`
+		Deps []struct {
+			Name        string `json:"name"`
+			License     string `json:"license"`
+			LicenseFile string `json:"licenseFile"`
+			Size        int64  `json:"size"`
+			FileCount   int    `json:"fileCount"`
+		} `json:"deps"`
+	}
+	g.Expect(jsoniter.Unmarshal(buffer.Bytes(), &result)).To(Succeed())
+	g.Expect(result).To(HaveLen(2))
+	g.Expect(result[0].Deps).To(HaveLen(3))
+
+	a := result[0].Deps[0]
+	g.Expect(a.License).To(Equal("MIT"))
+	g.Expect(a.LicenseFile).To(Equal(""))
+	// nested node_modules is not included
+	g.Expect(a.FileCount).To(Equal(2))
+	g.Expect(a.Size).To(Equal(int64(len(`{"name": "a", "version": "1.0.0", "license": "MIT", "dependencies": {"d": "1.0.0"}}`) + len("module.exports = 42"))))
+
+	b := result[0].Deps[1]
+	g.Expect(b.License).To(Equal("Apache-2.0"))
+	g.Expect(b.LicenseFile).To(Equal("LICENSE.txt"))
+	g.Expect(result[0].Deps[2].License).To(Equal("(MIT OR Apache-2.0)"))
+	g.Expect(result[1].Deps[0].Name).To(Equal("d"))
+}
+
+func TestDetectLicense(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	g.Expect(detectLicense("Permission is hereby granted, free of charge, to any person")).To(Equal("MIT"))
+	g.Expect(detectLicense("Permission to use, copy, modify, and/or distribute this software for any\npurpose with or without fee is hereby granted, provided that the above\ncopyright notice")).To(Equal("ISC"))
+	g.Expect(detectLicense("Permission to use, copy, modify, and/or distribute this software for any\npurpose with or without fee is hereby granted.")).To(Equal("0BSD"))
+	g.Expect(detectLicense("Redistribution and use in source and binary forms, with or without modification, are permitted. Neither the name of")).To(Equal("BSD-3-Clause"))
+	g.Expect(detectLicense("GNU LESSER GENERAL PUBLIC LICENSE\n Version 3, 29 June 2007 ... GNU General Public License")).To(Equal("LGPL-3.0"))
+	g.Expect(detectLicense("Copyright (c) Proprietary")).To(Equal(""))
+}
@@ -21,10 +21,20 @@ type Dependency struct {
 	Version              string            `json:"version"`
 	Dependencies         map[string]string `json:"dependencies"`
 	OptionalDependencies map[string]string `json:"optionalDependencies"`
-	Binary*              DependencyBinary  `json:"binary`
+	Binary*              DependencyBinary  `json:"binary"`
+	License              interface{}       `json:"license"`
+	Licenses             interface{}       `json:"licenses"`
 
 	dir string
 	isOptional int
+
+	// real dir of the package if it differs from the dir in the tree (pnpm store, unpacked Yarn PnP zip)
+	realDir string
+	// Yarn PnP package
+	locator *pnpLocator
+
+	// license and size, if requested
+	metadata *packageMetadata
 }
 
 type Collector struct {
@@ -32,6 +42,12 @@ type Collector struct {
 
 	excludedDependencies map[string]bool
 
+	// npm/yarn workspace root, dependencies are not resolved outside of it
+	workspaceRoot  string
+	projectRealDir string
+	// real dir of linked (workspace) package to node_modules dir where it is collected
+	linkedPackageToNodeModuleDir map[string]string
+
 	NodeModuleDirToDependencyMap map[string]*map[string]*Dependency `json:"nodeModuleDirToDependencyMap"`
 }
 
@@ -46,6 +62,9 @@ func (t *Collector) readDependencyTree(dependency *Dependency) error {
 	if err != nil {
 		return err
 	}
+	if len(nodeModuleDir) != 0 && t.workspaceRoot != "" && !isDirOrChild(getParentDir(nodeModuleDir), t.workspaceRoot) {
+		nodeModuleDir = ""
+	}
 
 	if len(nodeModuleDir) == 0 {
 		for name := range dependency.Dependencies {
@@ -114,7 +133,7 @@ func (t *Collector) processDependencies(list *map[string]string, nodeModuleDir s
 	var err error
 	guardCount := 0
 	for len(unresolved) > 0 {
-		nodeModuleDir, err = findNearestNodeModuleDir(getParentDir(getParentDir(nodeModuleDir)))
+		nodeModuleDir, err = t.findParentNodeModuleDir(nodeModuleDir)
 		if err != nil {
 			return queueIndex, err
 		}
@@ -204,6 +223,12 @@ func (t *Collector) resolveDependency(parentNodeModuleDir string, name string) (
 		delete(dependency.Dependencies, "libui-download")
 	}
 
+	dependency.dir = dependencyDir
+	isCollected, err := t.checkLinkedPackage(dependency, parentNodeModuleDir)
+	if err != nil || !isCollected {
+		return nil, err
+	}
+
 	if dependencyNameToDependency == nil {
 		m := make(map[string]*Dependency)
 		t.NodeModuleDirToDependencyMap[parentNodeModuleDir] = &m
@@ -211,7 +236,6 @@ func (t *Collector) resolveDependency(parentNodeModuleDir string, name string) (
 	}
 
 	(*dependencyNameToDependency)[name] = dependency
-	dependency.dir = dependencyDir
 	return dependency, nil
 }
 
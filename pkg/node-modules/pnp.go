@@ -0,0 +1,367 @@
+package node_modules
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/develar/app-builder/pkg/fs"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+	"github.com/json-iterator/go"
+)
+
+type pnpLocator struct {
+	name      string
+	reference string
+}
+
+type pnpPackage struct {
+	// relative to the dir of .pnp.cjs
+	location string
+	// dependency name to locator, nil if dependency is not provided (missing peer dependency)
+	dependencies map[string]*pnpLocator
+}
+
+// Yarn Berry Plug'n'Play: there is no node_modules, packages are resolved using the runtime state of .pnp.cjs and are stored in zip archives (.yarn/cache).
+// Zip is unpacked to the unpack dir (archive name contains checksum, so, unpacked package is reused by next builds).
+type pnpResolver struct {
+	rootDir   string
+	unpackDir string
+	packages  map[pnpLocator]*pnpPackage
+
+	locatorToDependency map[pnpLocator]*Dependency
+}
+
+// findPnpFile returns .pnp.cjs (or .pnp.data.json if state is not inlined) of the project, empty if project doesn't use PnP
+func findPnpFile(dir string) string {
+	for ; len(dir) != 0; dir = getParentDir(dir) {
+		for _, name := range []string{".pnp.data.json", ".pnp.cjs", ".pnp.js"} {
+			file := filepath.Join(dir, name)
+			if _, err := os.Stat(file); err == nil {
+				return file
+			}
+		}
+	}
+	return ""
+}
+
+func newPnpResolver(pnpFile string, unpackDir string) (*pnpResolver, error) {
+	data, err := ioutil.ReadFile(pnpFile)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if !strings.HasSuffix(pnpFile, ".json") {
+		data, err = extractPnpRuntimeState(data)
+		if err != nil {
+			return nil, errors.WithMessage(err, pnpFile)
+		}
+	}
+
+	packages, err := parsePnpRuntimeState(data)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot parse PnP runtime state of "+pnpFile)
+	}
+
+	return &pnpResolver{
+		rootDir:             filepath.Dir(pnpFile),
+		unpackDir:           unpackDir,
+		packages:            packages,
+		locatorToDependency: make(map[pnpLocator]*Dependency),
+	}, nil
+}
+
+// state is inlined into .pnp.cjs as JS string literal: const RAW_RUNTIME_STATE =\n'{...}';
+func extractPnpRuntimeState(data []byte) ([]byte, error) {
+	prefix := []byte("RAW_RUNTIME_STATE =")
+	start := bytes.Index(data, prefix)
+	if start < 0 {
+		return nil, util.NewMessageError("PnP runtime state is not found (Yarn 2 .pnp.js is not supported, please upgrade Yarn or set pnpEnableInlining: false)", "ERR_PNP_UNSUPPORTED")
+	}
+
+	data = data[start+len(prefix):]
+	start = bytes.IndexByte(data, '\'')
+	if start < 0 {
+		return nil, errors.New("PnP runtime state must be a string literal")
+	}
+
+	var result bytes.Buffer
+	for i := start + 1; i < len(data); i++ {
+		c := data[i]
+		if c == '\'' {
+			return result.Bytes(), nil
+		}
+		if c != '\\' || i+1 == len(data) {
+			result.WriteByte(c)
+			continue
+		}
+
+		i++
+		switch data[i] {
+		case '\n':
+			// line continuation
+		case 'n':
+			result.WriteByte('\n')
+		case 't':
+			result.WriteByte('\t')
+		case 'r':
+			result.WriteByte('\r')
+		default:
+			result.WriteByte(data[i])
+		}
+	}
+	return nil, errors.New("PnP runtime state string literal is not terminated")
+}
+
+func parsePnpRuntimeState(data []byte) (map[pnpLocator]*pnpPackage, error) {
+	var state struct {
+		// [name, [[reference, {packageLocation, packageDependencies}]]]
+		PackageRegistryData []interface{} `json:"packageRegistryData"`
+	}
+	err := jsoniter.Unmarshal(data, &state)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	result := make(map[pnpLocator]*pnpPackage)
+	for _, entry := range state.PackageRegistryData {
+		pair, ok := entry.([]interface{})
+		if !ok || len(pair) != 2 {
+			return nil, errors.New("unexpected package registry entry")
+		}
+
+		name, _ := pair[0].(string)
+		references, ok := pair[1].([]interface{})
+		if !ok {
+			return nil, errors.Errorf("unexpected references of package %s", name)
+		}
+
+		for _, referenceEntry := range references {
+			referencePair, ok := referenceEntry.([]interface{})
+			if !ok || len(referencePair) != 2 {
+				return nil, errors.Errorf("unexpected reference entry of package %s", name)
+			}
+
+			reference, _ := referencePair[0].(string)
+			info, ok := referencePair[1].(map[string]interface{})
+			if !ok {
+				return nil, errors.Errorf("unexpected info of package %s@%s", name, reference)
+			}
+
+			location, _ := info["packageLocation"].(string)
+			pnpPackage := &pnpPackage{location: location, dependencies: make(map[string]*pnpLocator)}
+			dependencies, _ := info["packageDependencies"].([]interface{})
+			for _, dependency := range dependencies {
+				dependencyPair, ok := dependency.([]interface{})
+				if !ok || len(dependencyPair) != 2 {
+					return nil, errors.Errorf("unexpected dependency entry of package %s@%s", name, reference)
+				}
+
+				dependencyName, ok := dependencyPair[0].(string)
+				if !ok {
+					return nil, errors.Errorf("unexpected dependency name of package %s@%s", name, reference)
+				}
+				pnpPackage.dependencies[dependencyName], err = parsePnpDependencyTarget(dependencyName, dependencyPair[1])
+				if err != nil {
+					return nil, err
+				}
+			}
+			result[pnpLocator{name: name, reference: reference}] = pnpPackage
+		}
+	}
+	return result, nil
+}
+
+// reference, [aliased name, reference] or null
+func parsePnpDependencyTarget(name string, target interface{}) (*pnpLocator, error) {
+	switch value := target.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return &pnpLocator{name: name, reference: value}, nil
+	case []interface{}:
+		if len(value) == 2 {
+			aliasedName, isNameString := value[0].(string)
+			reference, isReferenceString := value[1].(string)
+			if isNameString && isReferenceString {
+				return &pnpLocator{name: aliasedName, reference: reference}, nil
+			}
+		}
+	}
+	return nil, errors.Errorf("unexpected target of dependency %s: %v", name, target)
+}
+
+// initRoot sets locator of the project (workspace located in the project dir)
+func (t *pnpResolver) initRoot(root *Dependency) error {
+	for locator, info := range t.packages {
+		if locator.name == "" || locator.name != root.Name {
+			continue
+		}
+
+		location := filepath.Join(t.rootDir, filepath.FromSlash(info.location))
+		if filepath.Clean(location) == filepath.Clean(root.dir) {
+			rootLocator := locator
+			root.locator = &rootLocator
+			return nil
+		}
+	}
+
+	// top-level package of the project, if project is not a named workspace
+	if info := t.packages[pnpLocator{}]; info != nil && filepath.Clean(t.rootDir) == filepath.Clean(root.dir) {
+		root.locator = &pnpLocator{}
+		return nil
+	}
+	return util.NewMessageError("package "+root.Name+" ("+root.dir+") is not found in the PnP runtime state, please run yarn install", "ERR_PNP_PACKAGE_NOT_FOUND")
+}
+
+func (t *pnpResolver) resolve(parent *Dependency, name string) (*Dependency, error) {
+	if parent.locator == nil {
+		return nil, nil
+	}
+
+	parentPackage := t.packages[*parent.locator]
+	if parentPackage == nil {
+		return nil, nil
+	}
+
+	locator := parentPackage.dependencies[name]
+	// self-reference
+	if locator == nil || *locator == *parent.locator {
+		return nil, nil
+	}
+
+	dependency := t.locatorToDependency[*locator]
+	if dependency != nil {
+		return dependency, nil
+	}
+
+	info := t.packages[*locator]
+	if info == nil {
+		return nil, errors.Errorf("package %s@%s is not found in the PnP runtime state", locator.name, locator.reference)
+	}
+
+	realDir, err := t.getPackageDir(info.location)
+	if err != nil {
+		return nil, err
+	}
+
+	dependency, err = readPackageJson(realDir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	dependency.realDir = realDir
+	dependency.locator = locator
+	t.locatorToDependency[*locator] = dependency
+	return dependency, nil
+}
+
+// package in zip (./.yarn/cache/name-npm-1.0.0-checksum.zip/node_modules/name/) is unpacked, unplugged and linked packages are used as is
+func (t *pnpResolver) getPackageDir(location string) (string, error) {
+	index := strings.Index(location, ".zip/")
+	if index < 0 {
+		return filepath.Join(t.rootDir, filepath.FromSlash(location)), nil
+	}
+
+	zipFile := filepath.Join(t.rootDir, filepath.FromSlash(location[:index+len(".zip")]))
+	innerPath := strings.Trim(location[index+len(".zip/"):], "/")
+	archiveDir := filepath.Join(t.unpackDir, strings.TrimSuffix(filepath.Base(zipFile), ".zip"))
+	result := filepath.Join(archiveDir, filepath.FromSlash(innerPath))
+	if _, err := os.Stat(result); err == nil {
+		return result, nil
+	}
+
+	err := fsutil.EnsureDir(t.unpackDir)
+	if err != nil {
+		return "", err
+	}
+
+	// unpack to temp dir and rename to not use partially unpacked package
+	tempDir, err := util.TempDir(t.unpackDir, ".unpack")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = os.RemoveAll(tempDir)
+	}()
+
+	err = unzipPackage(zipFile, innerPath, filepath.Join(tempDir, filepath.FromSlash(innerPath)))
+	if err != nil {
+		return "", err
+	}
+
+	// temp dir is created with 0700
+	err = os.Chmod(tempDir, 0755)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	err = os.Rename(tempDir, archiveDir)
+	if err != nil {
+		// unpacked by another process
+		if _, statError := os.Stat(result); statError != nil {
+			return "", errors.WithStack(err)
+		}
+	}
+	return result, nil
+}
+
+func unzipPackage(zipFile string, innerPath string, outDir string) error {
+	reader, err := zip.OpenReader(zipFile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(reader)
+
+	prefix := innerPath + "/"
+	for _, file := range reader.File {
+		name := path.Clean("/" + file.Name)[1:]
+		if !strings.HasPrefix(name+"/", prefix) || file.FileInfo().IsDir() {
+			continue
+		}
+
+		relativePath := strings.TrimPrefix(name, prefix)
+		if relativePath == name || relativePath == "" {
+			continue
+		}
+
+		err = unzipPackageFile(file, filepath.Join(outDir, filepath.FromSlash(relativePath)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unzipPackageFile(file *zip.File, target string) error {
+	reader, err := file.Open()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(reader)
+
+	mode := file.Mode().Perm()
+	if mode == 0 {
+		mode = 0644
+	}
+
+	if file.Mode()&os.ModeSymlink != 0 {
+		linkTarget, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = fsutil.EnsureDir(filepath.Dir(target))
+		if err != nil {
+			return err
+		}
+		return errors.WithStack(os.Symlink(string(linkTarget), target))
+	}
+
+	return fs.WriteFileAndRestoreNormalPermissions(reader, target, mode, nil)
+}
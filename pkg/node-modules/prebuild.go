@@ -0,0 +1,291 @@
+package node_modules
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/develar/app-builder/pkg/download"
+	"github.com/develar/app-builder/pkg/fs"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/json-iterator/go"
+	"go.uber.org/zap"
+)
+
+// https://github.com/electron/node-abi/blob/main/abi_registry.json (major version to ABI)
+var electronAbis = map[int]int{
+	2: 57, 3: 64, 4: 69, 5: 70, 6: 73, 7: 75, 8: 76, 9: 80, 10: 82, 11: 85, 12: 87, 13: 89, 14: 97, 15: 98, 16: 99, 17: 101, 18: 103, 19: 106,
+	20: 107, 21: 109, 22: 110, 23: 113, 24: 114, 25: 116, 26: 116, 27: 118, 28: 119, 29: 121, 30: 123, 31: 125, 32: 128, 33: 130, 34: 132, 35: 133,
+	36: 135, 37: 136,
+}
+
+// target runtime of native modules, the same env as used by node-gyp and prebuild-install (set by electron-builder)
+type targetRuntime struct {
+	platform string
+	arch     string
+	// electron or node
+	name    string
+	version string
+	// empty if unknown - only N-API binaries are used
+	abi string
+}
+
+func getTargetRuntime(configuration *RebuildConfiguration) *targetRuntime {
+	result := &targetRuntime{
+		platform: configuration.Platform,
+		arch:     configuration.Arch,
+		name:     util.GetEnvOrDefault("npm_config_runtime", "electron"),
+		version:  os.Getenv("npm_config_target"),
+	}
+	if result.name == "electron" {
+		result.abi = getElectronAbi(result.version)
+	}
+	return result
+}
+
+func getElectronAbi(version string) string {
+	end := strings.IndexRune(version, '.')
+	if end < 0 {
+		end = len(version)
+	}
+	major, err := strconv.Atoi(strings.TrimPrefix(version[:end], "v"))
+	if err != nil {
+		return ""
+	}
+	abi, ok := electronAbis[major]
+	if !ok {
+		return ""
+	}
+	return strconv.Itoa(abi)
+}
+
+// resolvePrebuilt checks prebuildify binaries shipped in the package (prebuilds dir, loaded by node-gyp-build) and downloads node-pre-gyp binary (binary field of package.json).
+// prebuild-install is handled separately - it is a tool of the package. Returns false if there is no prebuilt binary for the target runtime.
+func resolvePrebuilt(dependency *DepInfo, runtime *targetRuntime) (bool, error) {
+	logger := log.LOG.With(zap.String("name", dependency.Name), zap.String("version", dependency.Version), zap.String("platform", runtime.platform), zap.String("arch", runtime.arch))
+
+	file, err := findPrebuildifyBinary(dependency.dir, runtime)
+	if err != nil {
+		return false, err
+	}
+	if file != "" {
+		logger.Info("prebuilt binary is found in the package", zap.String("file", file))
+		return true, nil
+	}
+
+	binary, err := readNodePreGypBinary(dependency.dir)
+	if err != nil || binary == nil {
+		return false, err
+	}
+
+	tarballUrl, modulePath, err := binary.resolve(dependency, runtime)
+	if err != nil || tarballUrl == "" {
+		return false, err
+	}
+
+	logger.Info("download prebuilt binary", zap.String("url", tarballUrl))
+	hash := sha256.Sum256([]byte(tarballUrl))
+	cacheName := "prebuilt-" + strings.NewReplacer("/", "_", "@", "").Replace(dependency.Name) + "_" + hex.EncodeToString(hash[:8])
+	dir, err := download.DownloadArtifact(cacheName, tarballUrl, "")
+	if err != nil {
+		// not published for the platform or arch
+		logger.Debug("cannot download prebuilt binary", zap.Error(err))
+		return false, nil
+	}
+
+	// node-pre-gyp archive contains the module dir, the same as tar --strip 1 by node-pre-gyp install
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		err = fs.CopyDirOrFile(filepath.Join(dir, entry.Name()), modulePath)
+		if err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// https://github.com/prebuild/node-gyp-build - prebuilds/<platform>-<arch>[+<arch>]/<runtime>.<tag>.node
+func findPrebuildifyBinary(dir string, runtime *targetRuntime) (string, error) {
+	prebuildsDir := filepath.Join(dir, "prebuilds")
+	dirs, err := ioutil.ReadDir(prebuildsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", errors.WithStack(err)
+	}
+
+	for _, platformDir := range dirs {
+		if !platformDir.IsDir() || !isPrebuildsDirMatched(platformDir.Name(), runtime) {
+			continue
+		}
+
+		files, err := ioutil.ReadDir(filepath.Join(prebuildsDir, platformDir.Name()))
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		for _, file := range files {
+			if !file.IsDir() && isPrebuildifyBinaryMatched(file.Name(), runtime) {
+				return filepath.Join(prebuildsDir, platformDir.Name(), file.Name()), nil
+			}
+		}
+	}
+	return "", nil
+}
+
+func isPrebuildsDirMatched(name string, runtime *targetRuntime) bool {
+	index := strings.IndexRune(name, '-')
+	if index < 0 || name[:index] != runtime.platform {
+		return false
+	}
+	return util.ContainsString(strings.Split(name[index+1:], "+"), runtime.arch)
+}
+
+// the same rules as node-gyp-build: runtime must match unless it is N-API binary for node, ABI must match unless it is N-API binary
+func isPrebuildifyBinaryMatched(name string, runtime *targetRuntime) bool {
+	if !strings.HasSuffix(name, ".node") {
+		return false
+	}
+
+	tags := strings.Split(strings.TrimSuffix(name, ".node"), ".")
+	binaryRuntime := "node"
+	isNapi := false
+	abi := ""
+	for _, tag := range tags {
+		switch {
+		case tag == "napi":
+			isNapi = true
+		case strings.HasPrefix(tag, "abi"):
+			abi = tag[3:]
+		case tag == "node" || tag == "electron" || tag == "node-webkit":
+			binaryRuntime = tag
+		case tag == "musl":
+			// not supported by Electron
+			return false
+		}
+	}
+
+	if binaryRuntime != runtime.name && !(binaryRuntime == "node" && isNapi) {
+		return false
+	}
+	return isNapi || (abi != "" && abi == runtime.abi)
+}
+
+// https://github.com/mapbox/node-pre-gyp#configuring
+type nodePreGypBinary struct {
+	ModuleName   string `json:"module_name"`
+	ModulePath   string `json:"module_path"`
+	Host         string `json:"host"`
+	RemotePath   string `json:"remote_path"`
+	PackageName  string `json:"package_name"`
+	NapiVersions []uint `json:"napi_versions"`
+}
+
+func readNodePreGypBinary(dir string) (*nodePreGypBinary, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "package.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+
+	var packageJson struct {
+		Binary *nodePreGypBinary `json:"binary"`
+	}
+	err = jsoniter.Unmarshal(data, &packageJson)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot parse package.json of "+dir)
+	}
+	if packageJson.Binary == nil || packageJson.Binary.Host == "" || packageJson.Binary.ModulePath == "" {
+		return nil, nil
+	}
+	return packageJson.Binary, nil
+}
+
+// resolve returns URL of the tarball and module path (where tarball content is extracted to), the same variables as node-pre-gyp versioning evaluate
+func (t *nodePreGypBinary) resolve(dependency *DepInfo, runtime *targetRuntime) (string, string, error) {
+	var nodeAbi string
+	switch {
+	case runtime.name == "electron":
+		// electron-v<major>.<minor>
+		parts := strings.SplitN(strings.TrimPrefix(runtime.version, "v"), ".", 3)
+		if len(parts) >= 2 {
+			nodeAbi = "electron-v" + parts[0] + "." + parts[1]
+		}
+	case runtime.abi != "":
+		nodeAbi = runtime.name + "-v" + runtime.abi
+	}
+
+	napiBuildVersion := ""
+	nodeNapiLabel := nodeAbi
+	for _, version := range t.NapiVersions {
+		if current, _ := strconv.Atoi(napiBuildVersion); int(version) > current {
+			napiBuildVersion = strconv.FormatUint(uint64(version), 10)
+			nodeNapiLabel = "napi-v" + napiBuildVersion
+		}
+	}
+	if nodeNapiLabel == "" {
+		return "", "", nil
+	}
+
+	libc := "unknown"
+	if runtime.platform == "linux" {
+		libc = "glibc"
+	}
+
+	version := dependency.Version
+	major, minor, patch := version, "", ""
+	if parts := strings.SplitN(strings.SplitN(version, "-", 2)[0], ".", 3); len(parts) == 3 {
+		major, minor, patch = parts[0], parts[1], parts[2]
+	}
+
+	replacer := strings.NewReplacer(
+		"{module_name}", t.ModuleName,
+		"{name}", dependency.Name,
+		"{version}", version,
+		"{major}", major,
+		"{minor}", minor,
+		"{patch}", patch,
+		"{node_abi}", nodeAbi,
+		"{napi_build_version}", napiBuildVersion,
+		"{node_napi_label}", nodeNapiLabel,
+		"{platform}", runtime.platform,
+		"{arch}", runtime.arch,
+		"{target_arch}", runtime.arch,
+		"{libc}", libc,
+		"{configuration}", "Release",
+		"{toolset}", "",
+	)
+
+	host, err := url.Parse(strings.TrimSuffix(t.Host, "/") + "/")
+	if err != nil {
+		return "", "", errors.WithMessage(err, "invalid binary host of "+dependency.Name)
+	}
+	remotePath := strings.Trim(strings.TrimPrefix(replacer.Replace(t.RemotePath), "./"), "/")
+	if remotePath != "" {
+		remotePath += "/"
+	}
+	tarball, err := url.Parse(remotePath + replacer.Replace(t.PackageName))
+	if err != nil {
+		return "", "", errors.WithMessage(err, "invalid binary package name of "+dependency.Name)
+	}
+
+	modulePath := filepath.Join(dependency.dir, filepath.FromSlash(replacer.Replace(t.ModulePath)))
+	return host.ResolveReference(tarball).String(), modulePath, nil
+}
@@ -0,0 +1,116 @@
+package node_modules
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+)
+
+func TestIsPrebuildifyBinaryMatched(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	runtime := &targetRuntime{platform: "linux", arch: "x64", name: "electron", version: "22.3.1", abi: getElectronAbi("22.3.1")}
+	g.Expect(runtime.abi).To(Equal("110"))
+	g.Expect(getElectronAbi("v100.0.0")).To(BeEmpty())
+
+	g.Expect(isPrebuildsDirMatched("linux-x64", runtime)).To(BeTrue())
+	g.Expect(isPrebuildsDirMatched("darwin-x64+arm64", runtime)).To(BeFalse())
+	g.Expect(isPrebuildsDirMatched("linux-arm64", runtime)).To(BeFalse())
+
+	g.Expect(isPrebuildifyBinaryMatched("node.napi.node", runtime)).To(BeTrue())
+	g.Expect(isPrebuildifyBinaryMatched("node.napi.glibc.node", runtime)).To(BeTrue())
+	g.Expect(isPrebuildifyBinaryMatched("node.napi.musl.node", runtime)).To(BeFalse())
+	g.Expect(isPrebuildifyBinaryMatched("electron.abi110.node", runtime)).To(BeTrue())
+	g.Expect(isPrebuildifyBinaryMatched("electron.abi109.node", runtime)).To(BeFalse())
+	// node ABI binary cannot be loaded by Electron
+	g.Expect(isPrebuildifyBinaryMatched("node.abi110.node", runtime)).To(BeFalse())
+	g.Expect(isPrebuildifyBinaryMatched("electron.napi.node", runtime)).To(BeTrue())
+	g.Expect(isPrebuildifyBinaryMatched("README.md", runtime)).To(BeFalse())
+}
+
+func TestNodePreGypBinaryResolve(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	binary := &nodePreGypBinary{
+		ModuleName:  "sqlite3",
+		ModulePath:  "./lib/binding/{node_abi}-{platform}-{arch}",
+		Host:        "https://example.com/releases",
+		RemotePath:  "./v{version}/",
+		PackageName: "{module_name}-v{version}-{node_abi}-{platform}-{libc}-{arch}.tar.gz",
+	}
+	dependency := &DepInfo{Name: "sqlite3", Version: "5.1.6", dir: filepath.FromSlash("/project/node_modules/sqlite3")}
+	runtime := &targetRuntime{platform: "linux", arch: "x64", name: "electron", version: "22.3.1", abi: "110"}
+	tarballUrl, modulePath, err := binary.resolve(dependency, runtime)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(tarballUrl).To(Equal("https://example.com/releases/v5.1.6/sqlite3-v5.1.6-electron-v22.3-linux-glibc-x64.tar.gz"))
+	g.Expect(modulePath).To(Equal(filepath.FromSlash("/project/node_modules/sqlite3/lib/binding/electron-v22.3-linux-x64")))
+
+	binary.ModulePath = "./lib/binding/{node_napi_label}"
+	binary.PackageName = "{module_name}-{node_napi_label}-{platform}-{arch}.tar.gz"
+	binary.NapiVersions = []uint{3, 6}
+	tarballUrl, modulePath, err = binary.resolve(dependency, runtime)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(tarballUrl).To(Equal("https://example.com/releases/v5.1.6/sqlite3-napi-v6-linux-x64.tar.gz"))
+	g.Expect(modulePath).To(Equal(filepath.FromSlash("/project/node_modules/sqlite3/lib/binding/napi-v6")))
+}
+
+func TestResolvePrebuilt(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "prebuild")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	g.Expect(os.Setenv("ELECTRON_BUILDER_CACHE", filepath.Join(dir, "cache"))).To(Succeed())
+	defer os.Unsetenv("ELECTRON_BUILDER_CACHE")
+
+	var tarball bytes.Buffer
+	gzipWriter := gzip.NewWriter(&tarball)
+	tarWriter := tar.NewWriter(gzipWriter)
+	g.Expect(tarWriter.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "napi-v6/", Mode: 0755})).To(Succeed())
+	g.Expect(tarWriter.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "napi-v6/native.node", Mode: 0755, Size: 6})).To(Succeed())
+	_, err = tarWriter.Write([]byte("binary"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(tarWriter.Close()).To(Succeed())
+	g.Expect(gzipWriter.Close()).To(Succeed())
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path != "/v1.0.0/native-napi-v6-linux-x64.tar.gz" {
+			http.NotFound(writer, request)
+			return
+		}
+		_, _ = writer.Write(tarball.Bytes())
+	}))
+	defer server.Close()
+
+	runtime := &targetRuntime{platform: "linux", arch: "x64", name: "electron", version: "22.3.1", abi: "110"}
+
+	// prebuildify
+	prebuildifyDir := filepath.Join(dir, "node_modules", "prebuildified")
+	g.Expect(os.MkdirAll(filepath.Join(prebuildifyDir, "prebuilds", "linux-x64"), 0755)).To(Succeed())
+	g.Expect(ioutil.WriteFile(filepath.Join(prebuildifyDir, "prebuilds", "linux-x64", "electron.abi110.node"), []byte("binary"), 0644)).To(Succeed())
+	g.Expect(resolvePrebuilt(&DepInfo{Name: "prebuildified", Version: "1.0.0", dir: prebuildifyDir}, runtime)).To(BeTrue())
+
+	// node-pre-gyp
+	moduleDir := filepath.Join(dir, "node_modules", "native")
+	g.Expect(os.MkdirAll(moduleDir, 0755)).To(Succeed())
+	packageJson := `{"name": "native", "binary": {"module_name": "native", "module_path": "./lib/{node_napi_label}", "host": "` + server.URL + `", "remote_path": "v{version}", "package_name": "{module_name}-{node_napi_label}-{platform}-{arch}.tar.gz", "napi_versions": [6]}}`
+	g.Expect(ioutil.WriteFile(filepath.Join(moduleDir, "package.json"), []byte(packageJson), 0644)).To(Succeed())
+	g.Expect(resolvePrebuilt(&DepInfo{Name: "native", Version: "1.0.0", dir: moduleDir}, runtime)).To(BeTrue())
+	data, err := ioutil.ReadFile(filepath.Join(moduleDir, "lib", "napi-v6", "native.node"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(data)).To(Equal("binary"))
+
+	// not published for the arch - built from sources
+	g.Expect(resolvePrebuilt(&DepInfo{Name: "native", Version: "1.0.0", dir: moduleDir}, &targetRuntime{platform: "linux", arch: "arm64", name: "electron", version: "22.3.1"})).To(BeFalse())
+}
@@ -28,6 +28,9 @@ type RebuildConfiguration struct {
 	NodeExecPath string `json:"nodeExecPath"`
 
 	AdditionalArgs []string `json:"additionalArgs"`
+
+	// max number of native dependencies rebuilt in parallel, 1 on Windows and 2 on other platforms by default (npm rebuild is always sequential)
+	Concurrency int `json:"concurrency"`
 }
 
 type DependencyList struct {
@@ -41,6 +44,8 @@ type DepInfo struct {
 	Optional bool   `json:"optional"`
 	HasPrebuildInstall bool   `json:"hasPrebuildInstall"`
 	NapiVersions []uint `json:"napiVersions"`
+	// real dir of the package if it is not in the dir (see node-dep-tree)
+	Path string `json:"path"`
 
 	parentDir string
 	dir string
@@ -48,12 +53,16 @@ type DepInfo struct {
 
 func ConfigureRebuildCommand(app *kingpin.Application) {
 	command := app.Command("rebuild-node-modules", "")
+	concurrency := command.Flag("concurrency", "Max number of native dependencies rebuilt in parallel (overrides concurrency of the configuration, not applicable to npm rebuild).").Envar("APP_BUILDER_REBUILD_CONCURRENCY").Int()
 	command.Action(func(context *kingpin.ParseContext) error {
 		var configuration RebuildConfiguration
 		err := jsoniter.NewDecoder(os.Stdin).Decode(&configuration)
 		if err != nil {
 			return err
 		}
+		if *concurrency > 0 {
+			configuration.Concurrency = *concurrency
+		}
 
 		err = rebuild(&configuration)
 		if err != nil {
@@ -104,69 +113,73 @@ func rebuild(configuration *RebuildConfiguration) error {
 	if err != nil {
 		return fmt.Errorf("Could not compute exec path: %w", err)
 	}
+	concurrency := getRebuildConcurrency(configuration)
+	createCommand := createNpmRebuildCommandFactory(execPath, execArgs, configuration)
 	if isRunningYarn {
-		err := rebuildUsingYarn(dependencies, execPath, execArgs, configuration)
-		if err != nil {
-			return err
-		}
+		createCommand = createYarnRebuildCommandFactory(execPath, execArgs, configuration)
 	} else {
-		execArgs = append(execArgs, "rebuild")
-		if log.IsDebugEnabled() {
-			execArgs = append(execArgs, "--verbose")
-		}
-		if configuration.AdditionalArgs != nil {
-			execArgs = append(execArgs, configuration.AdditionalArgs...)
-		}
+		// npm rebuild is executed in the project dir for each dependency and updates shared node_modules state (e.g. .package-lock.json), so, not in parallel
+		concurrency = 1
+	}
+	return scheduleRebuild(dependencies, concurrency, func(dependency *DepInfo) error {
+		return rebuildDependency(dependency, createCommand(dependency))
+	})
+}
 
-		for _, item := range dependencies {
-			execArgs = append(execArgs, item.Name+"@"+item.Version)
-		}
+// each dependency is rebuilt by own command, output is captured and logged per dependency (not interleaved)
+func rebuildDependency(dependency *DepInfo, command *exec.Cmd) error {
+	logger := log.LOG.With(zap.String("name", dependency.Name), zap.String("version", dependency.Version))
+	logger.Info("rebuilding native dependency")
 
-		command := exec.Command(execPath, execArgs...)
-		_, err := util.Execute(command)
-		if err != nil {
-			return err
+	output, err := util.Execute(command)
+	if err != nil {
+		if execError, ok := err.(*util.ExecError); ok && dependency.Optional {
+			logger.Warn("cannot build optional native dependency", util.CreateExecErrorLogEntry(execError)...)
+			return nil
 		}
+		return err
 	}
 
+	if log.IsDebugEnabled() && len(output) > 0 {
+		logger.Debug("native dependency rebuilt", zap.ByteString("out", output))
+	}
 	return nil
 }
 
-func rebuildUsingYarn(dependencies []*DepInfo, execPath string, execArgs []string, configuration *RebuildConfiguration) error {
-	execArgs = append(execArgs, "run", "install")
+func createNpmRebuildCommandFactory(execPath string, execArgs []string, configuration *RebuildConfiguration) func(dependency *DepInfo) *exec.Cmd {
+	execArgs = append(execArgs, "rebuild")
+	if log.IsDebugEnabled() {
+		execArgs = append(execArgs, "--verbose")
+	}
 	if configuration.AdditionalArgs != nil {
 		execArgs = append(execArgs, configuration.AdditionalArgs...)
 	}
 
-	err := util.MapAsyncConcurrency(len(dependencies), getRebuildConcurrency(), func(index int) (func() error, error) {
-		dependency := dependencies[index]
-		if dependency == nil {
-			return nil, nil
-		}
-
-		return func() error {
-			logger := log.LOG.With(zap.String("name", dependency.Name), zap.String("version", dependency.Version))
-			logger.Info("rebuilding native dependency")
+	return func(dependency *DepInfo) *exec.Cmd {
+		args := make([]string, 0, len(execArgs)+1)
+		args = append(args, execArgs...)
+		return exec.Command(execPath, append(args, dependency.Name+"@"+dependency.Version)...)
+	}
+}
 
-			command := exec.Command(execPath, execArgs...)
-			command.Dir = dependency.dir
-			_, err := util.Execute(command)
-			if err != nil {
-				if dependency.Optional {
-					execError, _ := err.(*util.ExecError)
-					logger.Warn("cannot build optional native dependency", util.CreateExecErrorLogEntry(execError)...)
-				} else {
-					return err
-				}
-			}
+func createYarnRebuildCommandFactory(execPath string, execArgs []string, configuration *RebuildConfiguration) func(dependency *DepInfo) *exec.Cmd {
+	execArgs = append(execArgs, "run", "install")
+	if configuration.AdditionalArgs != nil {
+		execArgs = append(execArgs, configuration.AdditionalArgs...)
+	}
 
-			return nil
-		}, nil
-	})
-	return err
+	return func(dependency *DepInfo) *exec.Cmd {
+		command := exec.Command(execPath, execArgs...)
+		command.Dir = dependency.dir
+		return command
+	}
 }
 
-func getRebuildConcurrency() int {
+func getRebuildConcurrency(configuration *RebuildConfiguration) int {
+	if configuration.Concurrency > 0 {
+		return configuration.Concurrency
+	}
+
 	if util.GetCurrentOs() == util.WINDOWS {
 		return 1
 	} else {
@@ -174,6 +187,8 @@ func getRebuildConcurrency() int {
 	}
 }
 
+// prebuilt binary for the target platform, arch and runtime is resolved in order: prebuildify (shipped in the package), node-pre-gyp (downloaded to the cache) and prebuild-install.
+// Returns dependencies without prebuilt binary - to build from sources.
 func installUsingPrebuild(dependencies []*DepInfo, configuration *RebuildConfiguration) ([]*DepInfo, error) {
 	isRebuildPossible := checkRebuildPossible(configuration)
 	if configuration.BuildFromSource {
@@ -188,13 +203,23 @@ func installUsingPrebuild(dependencies []*DepInfo, configuration *RebuildConfigu
 		)
 	}
 
-	err := util.MapAsyncConcurrency(len(dependencies), getRebuildConcurrency(), func(index int) (func() error, error) {
+	runtime := getTargetRuntime(configuration)
+	err := util.MapAsyncConcurrency(len(dependencies), getRebuildConcurrency(configuration), func(index int) (func() error, error) {
 		dependency := dependencies[index]
-		if !dependency.HasPrebuildInstall {
-			return nil, nil
-		}
-
 		return func() error {
+			isResolved, err := resolvePrebuilt(dependency, runtime)
+			if err != nil {
+				return err
+			}
+			if isResolved {
+				dependencies[index] = nil
+				return nil
+			}
+
+			if !dependency.HasPrebuildInstall {
+				return nil
+			}
+
 			logger := log.LOG.With(zap.String("name", dependency.Name), zap.String("version", dependency.Version), zap.String("platform", configuration.Platform), zap.String("arch", configuration.Arch), zap.Uints("napi", dependency.NapiVersions),)
 			logger.Info("install prebuilt binary")
 
@@ -217,7 +242,7 @@ func installUsingPrebuild(dependencies []*DepInfo, configuration *RebuildConfigu
 				bin = filepath.Join(parentDir, "prebuild-install", "bin.js")
 			}
 
-			_, err := util.Execute(createPrebuildInstallCommand(bin, "--force", dependency, configuration))
+			_, err = util.Execute(createPrebuildInstallCommand(bin, "--force", dependency, configuration))
 			if err != nil {
 				execError, _ := err.(*util.ExecError)
 				switch {
@@ -334,6 +359,10 @@ func computeNativeDependenciesFromNameList(dirInfo *DependencyList) ([]*DepInfo,
 		item := dirInfo.Dependencies[index]
 		item.parentDir = dirInfo.Dir
 		item.dir = filepath.Join(dirInfo.Dir, item.Name)
+		if len(item.Path) != 0 {
+			// pnpm store or unpacked Yarn PnP package
+			item.dir = item.Path
+		}
 		return func() error {
 			info, err := os.Stat(filepath.Join(item.dir, "binding.gyp"))
 			if err != nil || info.IsDir() {
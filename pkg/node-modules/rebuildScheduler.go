@@ -0,0 +1,218 @@
+package node_modules
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/json-iterator/go"
+	"go.uber.org/zap"
+)
+
+type rebuildTask struct {
+	dependency *DepInfo
+	// indices of native dependencies that must be rebuilt before (e.g. module uses headers or binary of another native module)
+	requires   []int
+	dependents []int
+
+	pendingCount int
+	isStarted    bool
+	isDone       bool
+	err          error
+}
+
+type rebuildResult struct {
+	index int
+	err   error
+}
+
+// scheduleRebuild rebuilds independent native dependencies in parallel (up to concurrency), a dependency is rebuilt only after native dependencies it depends on.
+// Failures do not stop the rebuild of other dependencies, dependents of failed dependency are skipped. All failures are logged and reported as one error.
+func scheduleRebuild(dependencies []*DepInfo, concurrency int, rebuildDependency func(dependency *DepInfo) error) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	tasks := createRebuildTasks(dependencies)
+	ready := make([]int, 0, len(tasks))
+	for index, task := range tasks {
+		if task.pendingCount == 0 {
+			ready = append(ready, index)
+		}
+	}
+
+	results := make(chan rebuildResult)
+	running := 0
+	doneCount := 0
+
+	var complete func(index int, err error)
+	complete = func(index int, err error) {
+		task := tasks[index]
+		task.isDone = true
+		task.err = err
+		doneCount++
+		for _, dependentIndex := range task.dependents {
+			dependent := tasks[dependentIndex]
+			// started dependent is possible only for dependency cycle
+			if dependent.isStarted || dependent.isDone {
+				continue
+			}
+
+			dependent.pendingCount--
+			if err != nil {
+				// not rebuilt - build will fail anyway, but with an unclear error
+				complete(dependentIndex, &skippedRebuildError{dependency: task.dependency})
+			} else if dependent.pendingCount == 0 {
+				ready = append(ready, dependentIndex)
+			}
+		}
+	}
+
+	for doneCount < len(tasks) {
+		for running < concurrency && len(ready) > 0 {
+			index := ready[0]
+			ready = ready[1:]
+			if tasks[index].isStarted || tasks[index].isDone {
+				continue
+			}
+
+			tasks[index].isStarted = true
+			running++
+			go func(index int) {
+				results <- rebuildResult{index: index, err: rebuildDependency(tasks[index].dependency)}
+			}(index)
+		}
+
+		if running == 0 {
+			if len(ready) > 0 {
+				continue
+			}
+
+			// dependency cycle - rebuild the first not done dependency without waiting
+			for index, task := range tasks {
+				if !task.isStarted && !task.isDone {
+					log.Warn("native dependencies depend on each other, rebuild order is not guaranteed", zap.String("name", task.dependency.Name))
+					task.pendingCount = 0
+					ready = append(ready, index)
+					break
+				}
+			}
+			continue
+		}
+
+		result := <-results
+		running--
+		complete(result.index, result.err)
+	}
+
+	return createRebuildError(tasks)
+}
+
+func createRebuildTasks(dependencies []*DepInfo) []*rebuildTask {
+	tasks := make([]*rebuildTask, len(dependencies))
+	dirToIndex := make(map[string]int, len(dependencies))
+	for index, dependency := range dependencies {
+		tasks[index] = &rebuildTask{dependency: dependency}
+		dirToIndex[filepath.Clean(dependency.dir)] = index
+	}
+
+	for index, task := range tasks {
+		for _, name := range readDependencyNames(task.dependency.dir) {
+			requiredIndex, ok := resolveNativeDependency(task.dependency.dir, name, dirToIndex)
+			if !ok || requiredIndex == index {
+				continue
+			}
+
+			task.requires = append(task.requires, requiredIndex)
+			tasks[requiredIndex].dependents = append(tasks[requiredIndex].dependents, index)
+		}
+		task.pendingCount = len(task.requires)
+	}
+	return tasks
+}
+
+// resolveNativeDependency resolves module as node does (node_modules of the dir and all its parents) and returns index of native dependency if module is one of them
+func resolveNativeDependency(dir string, name string, dirToIndex map[string]int) (int, bool) {
+	for {
+		if filepath.Base(dir) != "node_modules" {
+			candidate := filepath.Join(dir, "node_modules", name)
+			if index, ok := dirToIndex[candidate]; ok {
+				return index, true
+			}
+			if _, err := os.Stat(candidate); err == nil {
+				return 0, false
+			}
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return 0, false
+		}
+		dir = parent
+	}
+}
+
+func readDependencyNames(dir string) []string {
+	file, err := os.Open(filepath.Join(dir, "package.json"))
+	if err != nil {
+		return nil
+	}
+	defer util.Close(file)
+
+	var packageJson struct {
+		Dependencies         map[string]string `json:"dependencies"`
+		OptionalDependencies map[string]string `json:"optionalDependencies"`
+	}
+	err = jsoniter.NewDecoder(file).Decode(&packageJson)
+	if err != nil {
+		log.Debug("cannot read package.json of native dependency", zap.String("dir", dir), zap.Error(err))
+		return nil
+	}
+
+	var result []string
+	for name := range packageJson.Dependencies {
+		result = append(result, name)
+	}
+	for name := range packageJson.OptionalDependencies {
+		result = append(result, name)
+	}
+	return result
+}
+
+type skippedRebuildError struct {
+	dependency *DepInfo
+}
+
+func (t *skippedRebuildError) Error() string {
+	return "not rebuilt because " + t.dependency.Name + "@" + t.dependency.Version + " is failed"
+}
+
+func createRebuildError(tasks []*rebuildTask) error {
+	var failed []*rebuildTask
+	for _, task := range tasks {
+		if task.err != nil {
+			failed = append(failed, task)
+		}
+	}
+
+	switch len(failed) {
+	case 0:
+		return nil
+	case 1:
+		return failed[0].err
+	}
+
+	names := make([]string, 0, len(failed))
+	for _, task := range failed {
+		names = append(names, task.dependency.Name+"@"+task.dependency.Version)
+		logger := log.LOG.With(zap.String("name", task.dependency.Name), zap.String("version", task.dependency.Version))
+		if execError, ok := task.err.(*util.ExecError); ok {
+			logger.Error("cannot rebuild native dependency", util.CreateExecErrorLogEntry(execError)...)
+		} else {
+			logger.Error("cannot rebuild native dependency", zap.Error(task.err))
+		}
+	}
+	return util.NewMessageError("cannot rebuild native dependencies: "+strings.Join(names, ", ")+" (see errors above)", "ERR_NATIVE_REBUILD_FAILED")
+}
@@ -0,0 +1,102 @@
+package node_modules
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	. "github.com/onsi/gomega"
+)
+
+func createNativeDependencies(g *GomegaWithT, dir string) []*DepInfo {
+	nodeModulesDir := filepath.Join(dir, "node_modules")
+	var result []*DepInfo
+	for name, packageJson := range map[string]string{
+		"a":    `{"name": "a", "dependencies": {"b": "1.0.0", "nan": "2.0.0"}}`,
+		"b":    `{"name": "b"}`,
+		"@s/c": `{"name": "@s/c", "optionalDependencies": {"b": "1.0.0"}}`,
+		"d":    `{"name": "d"}`,
+		"nan":  `{"name": "nan"}`,
+	} {
+		moduleDir := filepath.Join(nodeModulesDir, filepath.FromSlash(name))
+		g.Expect(os.MkdirAll(moduleDir, 0755)).To(Succeed())
+		g.Expect(ioutil.WriteFile(filepath.Join(moduleDir, "package.json"), []byte(packageJson), 0644)).To(Succeed())
+	}
+	for _, name := range []string{"a", "b", "@s/c", "d"} {
+		result = append(result, &DepInfo{Name: name, Version: "1.0.0", dir: filepath.Join(nodeModulesDir, filepath.FromSlash(name))})
+	}
+	return result
+}
+
+func TestScheduleRebuild(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "rebuild")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	dependencies := createNativeDependencies(g, dir)
+	tasks := createRebuildTasks(dependencies)
+	// a and c depend on b, nan is not native
+	g.Expect(tasks[0].requires).To(Equal([]int{1}))
+	g.Expect(tasks[1].dependents).To(ConsistOf(0, 2))
+	g.Expect(tasks[3].requires).To(BeEmpty())
+
+	var mutex sync.Mutex
+	var order []string
+	err = scheduleRebuild(dependencies, 2, func(dependency *DepInfo) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		order = append(order, dependency.Name)
+		return nil
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(order).To(HaveLen(4))
+	indexOf := func(name string) int {
+		for index, item := range order {
+			if item == name {
+				return index
+			}
+		}
+		return -1
+	}
+	g.Expect(indexOf("b")).To(BeNumerically("<", indexOf("a")))
+	g.Expect(indexOf("b")).To(BeNumerically("<", indexOf("@s/c")))
+}
+
+func TestScheduleRebuildFailure(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "rebuild")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	dependencies := createNativeDependencies(g, dir)
+	var mutex sync.Mutex
+	var rebuilt []string
+	err = scheduleRebuild(dependencies, 3, func(dependency *DepInfo) error {
+		if dependency.Name == "b" {
+			return errors.New("gyp failed")
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		rebuilt = append(rebuilt, dependency.Name)
+		return nil
+	})
+	// dependents of b are skipped, d is rebuilt
+	g.Expect(rebuilt).To(Equal([]string{"d"}))
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.(util.MessageError).ErrorCode()).To(Equal("ERR_NATIVE_REBUILD_FAILED"))
+	g.Expect(err.Error()).To(Equal("cannot rebuild native dependencies: a@1.0.0, b@1.0.0, @s/c@1.0.0 (see errors above)"))
+
+	err = scheduleRebuild(dependencies[3:], 1, func(dependency *DepInfo) error {
+		return errors.New("gyp failed")
+	})
+	g.Expect(err).To(MatchError("gyp failed"))
+}
@@ -11,10 +11,16 @@ import (
 )
 
 func ConfigureCommand(app *kingpin.Application) {
-	command := app.Command("node-dep-tree", "")
+	command := app.Command("node-dep-tree", "Production dependencies as node_modules tree. "+
+		"For pnpm and Yarn Plug'n'Play the tree is computed (hoisted as npm does) and path of the package is reported if it differs from the dir in the tree.")
 
 	dir := command.Flag("dir", "").Required().String()
 	excludedDependencies := command.Flag("exclude-dep", "").Strings()
+	workspaceRoot := command.Flag("workspace-root", "The root of npm or yarn workspaces the project belongs to, dependencies are not resolved outside of it (default: detected by workspaces field of package.json).").String()
+	pnpUnpackDir := command.Flag("pnp-unpack-dir", "The dir to unpack Yarn Plug'n'Play zip archives of dependencies to (default: .yarn/app-builder-unpacked in the project).").String()
+
+	isLicense := command.Flag("license", "Report license of dependencies (SPDX expression from package.json or detected by the license file) and the license file name.").Bool()
+	isSize := command.Flag("size", "Report unpacked size and file count of dependencies (nested node_modules are not included).").Bool()
 
 	command.Action(func(context *kingpin.ParseContext) error {
 		var excluded map[string]bool
@@ -30,6 +36,7 @@ func ConfigureCommand(app *kingpin.Application) {
 		collector := &Collector{
 			unresolvedDependencies:       make(map[string]bool),
 			excludedDependencies:         excluded,
+			workspaceRoot:                *workspaceRoot,
 			NodeModuleDirToDependencyMap: make(map[string]*map[string]*Dependency),
 		}
 		dependency, err := readPackageJson(*dir)
@@ -38,11 +45,18 @@ func ConfigureCommand(app *kingpin.Application) {
 		}
 
 		dependency.dir = *dir
-		err = collector.readDependencyTree(dependency)
+		err = collector.collect(dependency, *pnpUnpackDir)
 		if err != nil {
 			return err
 		}
 
+		if *isLicense || *isSize {
+			err = collector.collectMetadata(*isLicense, *isSize)
+			if err != nil {
+				return err
+			}
+		}
+
 		jsonWriter := jsoniter.NewStream(jsoniter.ConfigFastest, os.Stdout, 32*1024)
 		writeResult(jsonWriter, collector)
 		err = jsonWriter.Flush()
@@ -54,6 +68,40 @@ func ConfigureCommand(app *kingpin.Application) {
 	})
 }
 
+func (t *Collector) collect(root *Dependency, pnpUnpackDir string) error {
+	pnpFile := findPnpFile(root.dir)
+	if pnpFile != "" {
+		if pnpUnpackDir == "" {
+			pnpUnpackDir = filepath.Join(filepath.Dir(pnpFile), ".yarn", "app-builder-unpacked")
+		}
+
+		resolver, err := newPnpResolver(pnpFile, pnpUnpackDir)
+		if err != nil {
+			return err
+		}
+
+		err = resolver.initRoot(root)
+		if err != nil {
+			return err
+		}
+		return t.readHoistedDependencyTree(root, resolver)
+	}
+
+	isPnpm, err := isPnpmLayout(root.dir)
+	if err != nil {
+		return err
+	}
+	if isPnpm {
+		return t.readHoistedDependencyTree(root, newPnpmResolver())
+	}
+
+	err = t.initWorkspace(root)
+	if err != nil {
+		return err
+	}
+	return t.readDependencyTree(root)
+}
+
 func writeResult(jsonWriter *jsoniter.Stream, collector *Collector) {
 	moduleDirs := make([]string, len(collector.NodeModuleDirToDependencyMap))
 	index := 0
@@ -125,6 +173,12 @@ func writeDependencyList(jsonWriter *jsoniter.Stream, dependencyMap *map[string]
 		jsonWriter.WriteObjectField("version")
 		jsonWriter.WriteString(info.Version)
 
+		if len(info.realDir) != 0 {
+			jsonWriter.WriteMore()
+			jsonWriter.WriteObjectField("path")
+			jsonWriter.WriteString(info.realDir)
+		}
+
 		if info.isOptional == 1 {
 			jsonWriter.WriteMore()
 			jsonWriter.WriteObjectField("optional")
@@ -140,6 +194,10 @@ func writeDependencyList(jsonWriter *jsoniter.Stream, dependencyMap *map[string]
 			}
 		}
 
+		if info.metadata != nil {
+			writeMetadata(jsonWriter, info.metadata)
+		}
+
 		if info.Binary != nil {
 			jsonWriter.WriteMore()
 			jsonWriter.WriteObjectField("napiVersions")
@@ -157,6 +215,30 @@ func writeDependencyList(jsonWriter *jsoniter.Stream, dependencyMap *map[string]
 	jsonWriter.WriteArrayEnd()
 }
 
+func writeMetadata(jsonWriter *jsoniter.Stream, metadata *packageMetadata) {
+	if len(metadata.license) != 0 {
+		jsonWriter.WriteMore()
+		jsonWriter.WriteObjectField("license")
+		jsonWriter.WriteString(metadata.license)
+	}
+
+	if len(metadata.licenseFile) != 0 {
+		jsonWriter.WriteMore()
+		jsonWriter.WriteObjectField("licenseFile")
+		jsonWriter.WriteString(metadata.licenseFile)
+	}
+
+	if metadata.fileCount != 0 {
+		jsonWriter.WriteMore()
+		jsonWriter.WriteObjectField("size")
+		jsonWriter.WriteInt64(metadata.size)
+
+		jsonWriter.WriteMore()
+		jsonWriter.WriteObjectField("fileCount")
+		jsonWriter.WriteInt(metadata.fileCount)
+	}
+}
+
 func pathSorter(a []string, b []string) bool {
 	aL := len(a)
 	l := aL
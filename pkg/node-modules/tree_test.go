@@ -0,0 +1,128 @@
+package node_modules
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func writePackageJson(g *GomegaWithT, dir string, data string) {
+	g.Expect(os.MkdirAll(dir, 0755)).To(Succeed())
+	g.Expect(ioutil.WriteFile(filepath.Join(dir, "package.json"), []byte(data), 0644)).To(Succeed())
+}
+
+func collectTree(g *GomegaWithT, dir string) *Collector {
+	collector := &Collector{
+		unresolvedDependencies:       make(map[string]bool),
+		NodeModuleDirToDependencyMap: make(map[string]*map[string]*Dependency),
+	}
+	root, err := readPackageJson(dir)
+	g.Expect(err).NotTo(HaveOccurred())
+	root.dir = dir
+	g.Expect(collector.collect(root, "")).To(Succeed())
+	return collector
+}
+
+func getPlaced(collector *Collector, nodeModuleDir string) map[string]string {
+	result := make(map[string]string)
+	dependencyMap := collector.NodeModuleDirToDependencyMap[nodeModuleDir]
+	if dependencyMap != nil {
+		for name, dependency := range *dependencyMap {
+			result[name] = dependency.Version
+		}
+	}
+	return result
+}
+
+func TestPnpmLayout(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	tempDir, err := ioutil.TempDir("", "pnpm")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(tempDir)
+	dir, err := filepath.EvalSymlinks(tempDir)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	store := filepath.Join(dir, "node_modules", ".pnpm")
+	writePackageJson(g, dir, `{"name": "app", "dependencies": {"a": "1.0.0", "b": "1.0.0", "@types/node": "1.0.0"}}`)
+	writePackageJson(g, filepath.Join(store, "a@1.0.0", "node_modules", "a"), `{"name": "a", "version": "1.0.0", "dependencies": {"c": "1.0.0"}}`)
+	writePackageJson(g, filepath.Join(store, "b@1.0.0", "node_modules", "b"), `{"name": "b", "version": "1.0.0", "dependencies": {"c": "2.0.0", "a": "1.0.0"}}`)
+	writePackageJson(g, filepath.Join(store, "c@1.0.0", "node_modules", "c"), `{"name": "c", "version": "1.0.0"}`)
+	writePackageJson(g, filepath.Join(store, "c@2.0.0", "node_modules", "c"), `{"name": "c", "version": "2.0.0"}`)
+	g.Expect(os.Symlink("../../c@1.0.0/node_modules/c", filepath.Join(store, "a@1.0.0", "node_modules", "c"))).To(Succeed())
+	g.Expect(os.Symlink("../../c@2.0.0/node_modules/c", filepath.Join(store, "b@1.0.0", "node_modules", "c"))).To(Succeed())
+	g.Expect(os.Symlink("../../a@1.0.0/node_modules/a", filepath.Join(store, "b@1.0.0", "node_modules", "a"))).To(Succeed())
+	g.Expect(os.Symlink(".pnpm/a@1.0.0/node_modules/a", filepath.Join(dir, "node_modules", "a"))).To(Succeed())
+	g.Expect(os.Symlink(".pnpm/b@1.0.0/node_modules/b", filepath.Join(dir, "node_modules", "b"))).To(Succeed())
+
+	collector := collectTree(g, dir)
+	// c@1.0.0 is hoisted (a is processed first), c@2.0.0 is nested, a is not duplicated
+	g.Expect(collector.NodeModuleDirToDependencyMap).To(HaveLen(2))
+	g.Expect(getPlaced(collector, filepath.Join(dir, "node_modules"))).To(Equal(map[string]string{"a": "1.0.0", "b": "1.0.0", "c": "1.0.0"}))
+	g.Expect(getPlaced(collector, filepath.Join(dir, "node_modules", "b", "node_modules"))).To(Equal(map[string]string{"c": "2.0.0"}))
+	nested := (*collector.NodeModuleDirToDependencyMap[filepath.Join(dir, "node_modules", "b", "node_modules")])["c"]
+	g.Expect(nested.realDir).To(Equal(filepath.Join(store, "c@2.0.0", "node_modules", "c")))
+}
+
+func TestYarnPnp(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "pnp")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	writePackageJson(g, dir, `{"name": "app", "dependencies": {"a": "1.0.0", "b": "1.0.0"}}`)
+	writePackageJson(g, filepath.Join(dir, ".yarn", "unplugged", "b-npm-1.0.0", "node_modules", "b"), `{"name": "b", "version": "1.0.0", "dependencies": {"a": "2.0.0"}}`)
+
+	cacheDir := filepath.Join(dir, ".yarn", "cache")
+	g.Expect(os.MkdirAll(cacheDir, 0755)).To(Succeed())
+	for _, version := range []string{"1.0.0", "2.0.0"} {
+		file, err := os.Create(filepath.Join(cacheDir, "a-npm-"+version+"-abc.zip"))
+		g.Expect(err).NotTo(HaveOccurred())
+		writer := zip.NewWriter(file)
+		for name, content := range map[string]string{
+			"node_modules/a/package.json": `{"name": "a", "version": "` + version + `"}`,
+			"node_modules/a/index.js":     "module.exports = 1",
+		} {
+			entry, err := writer.Create(name)
+			g.Expect(err).NotTo(HaveOccurred())
+			_, err = entry.Write([]byte(content))
+			g.Expect(err).NotTo(HaveOccurred())
+		}
+		g.Expect(writer.Close()).To(Succeed())
+		g.Expect(file.Close()).To(Succeed())
+	}
+
+	state := `{
+  "packageRegistryData": [
+    [null, [[null, {"packageLocation": "./", "packageDependencies": [["a", "npm:1.0.0"], ["b", "npm:1.0.0"]], "linkType": "SOFT"}]]],
+    ["app", [["workspace:.", {"packageLocation": "./", "packageDependencies": [["a", "npm:1.0.0"], ["b", "npm:1.0.0"], ["app", "workspace:."]], "linkType": "SOFT"}]]],
+    ["a", [
+      ["npm:1.0.0", {"packageLocation": "./.yarn/cache/a-npm-1.0.0-abc.zip/node_modules/a/", "packageDependencies": [["a", "npm:1.0.0"]], "linkType": "HARD"}],
+      ["npm:2.0.0", {"packageLocation": "./.yarn/cache/a-npm-2.0.0-abc.zip/node_modules/a/", "packageDependencies": [["a", "npm:2.0.0"]], "linkType": "HARD"}]
+    ]],
+    ["b", [["npm:1.0.0", {"packageLocation": "./.yarn/unplugged/b-npm-1.0.0/node_modules/b/", "packageDependencies": [["a", "npm:2.0.0"], ["peer", null]], "linkType": "HARD"}]]]
+  ]
+}`
+	pnp := "#!/usr/bin/env node\n/* eslint-disable */\n\"use strict\";\n\nconst RAW_RUNTIME_STATE =\n'" +
+		strings.Replace(strings.Replace(state, "'", "\\'", -1), "\n", "\\\n", -1) + "';\n\nfunction $$SETUP_STATE(hydrateRuntimeState, basePath) {}\n"
+	g.Expect(ioutil.WriteFile(filepath.Join(dir, ".pnp.cjs"), []byte(pnp), 0644)).To(Succeed())
+
+	collector := collectTree(g, dir)
+	g.Expect(getPlaced(collector, filepath.Join(dir, "node_modules"))).To(Equal(map[string]string{"a": "1.0.0", "b": "1.0.0"}))
+	g.Expect(getPlaced(collector, filepath.Join(dir, "node_modules", "b", "node_modules"))).To(Equal(map[string]string{"a": "2.0.0"}))
+
+	nested := (*collector.NodeModuleDirToDependencyMap[filepath.Join(dir, "node_modules", "b", "node_modules")])["a"]
+	g.Expect(nested.realDir).To(Equal(filepath.Join(dir, ".yarn", "app-builder-unpacked", "a-npm-2.0.0-abc", "node_modules", "a")))
+	data, err := ioutil.ReadFile(filepath.Join(nested.realDir, "index.js"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(data)).To(Equal("module.exports = 1"))
+
+	// unpacked package is reused
+	g.Expect(collectTree(g, dir).NodeModuleDirToDependencyMap).To(HaveLen(2))
+}
@@ -0,0 +1,173 @@
+package node_modules
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/errors"
+	"github.com/json-iterator/go"
+	"go.uber.org/zap"
+)
+
+// initWorkspace detects npm/yarn workspace root (if not specified explicitly) - production dependencies of workspace package are hoisted to node_modules of the root,
+// so, dependencies are resolved up to the root, but not outside of it (node_modules of unrelated parent dir must not be packed).
+func (t *Collector) initWorkspace(root *Dependency) error {
+	if t.workspaceRoot == "" {
+		workspaceRoot, err := findWorkspaceRoot(root.dir)
+		if err != nil {
+			return err
+		}
+		t.workspaceRoot = workspaceRoot
+	}
+
+	if t.workspaceRoot != "" {
+		workspaceRoot, err := filepath.Abs(t.workspaceRoot)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		t.workspaceRoot = workspaceRoot
+		log.Debug("workspace root", zap.String("dir", t.workspaceRoot))
+	}
+
+	projectDir, err := filepath.EvalSymlinks(root.dir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	t.projectRealDir = projectDir
+	t.linkedPackageToNodeModuleDir = make(map[string]string)
+	return nil
+}
+
+// findWorkspaceRoot returns the nearest dir with package.json declaring workspaces that include the project dir, empty if project is not a workspace package.
+// The project dir itself is returned if project is the workspace root.
+func findWorkspaceRoot(projectDir string) (string, error) {
+	projectDir, err := filepath.Abs(projectDir)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	for dir := projectDir; len(dir) != 0; dir = getParentDir(dir) {
+		patterns, err := readWorkspacePatterns(dir)
+		if err != nil {
+			return "", err
+		}
+		if patterns == nil {
+			continue
+		}
+
+		if dir == projectDir {
+			return dir, nil
+		}
+
+		relativePath, err := filepath.Rel(dir, projectDir)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		for _, pattern := range patterns {
+			if isWorkspacePatternMatched(pattern, filepath.ToSlash(relativePath)) {
+				return dir, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// workspaces is a list of patterns or (yarn) an object with packages field, nil if package.json doesn't declare workspaces
+func readWorkspacePatterns(dir string) ([]string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "package.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+
+	var packageJson struct {
+		Workspaces interface{} `json:"workspaces"`
+	}
+	err = jsoniter.Unmarshal(data, &packageJson)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot parse package.json of "+dir)
+	}
+
+	list := packageJson.Workspaces
+	if object, ok := list.(map[string]interface{}); ok {
+		list = object["packages"]
+	}
+	items, ok := list.([]interface{})
+	if !ok {
+		return nil, nil
+	}
+
+	result := make([]string, 0, len(items))
+	for _, item := range items {
+		if pattern, ok := item.(string); ok {
+			result = append(result, pattern)
+		}
+	}
+	return result, nil
+}
+
+func isWorkspacePatternMatched(pattern string, relativePath string) bool {
+	pattern = strings.TrimSuffix(strings.TrimPrefix(pattern, "./"), "/")
+	// packages/** - any dir under packages
+	if index := strings.Index(pattern, "**"); index >= 0 {
+		return strings.HasPrefix(relativePath+"/", pattern[:index]) && len(relativePath) >= index
+	}
+
+	isMatched, err := path.Match(pattern, relativePath)
+	return err == nil && isMatched
+}
+
+// findParentNodeModuleDir returns node_modules of parent dirs of the package that owns nodeModuleDir, not outside of workspace root
+func (t *Collector) findParentNodeModuleDir(nodeModuleDir string) (string, error) {
+	result, err := findNearestNodeModuleDir(getParentDir(getParentDir(nodeModuleDir)))
+	if err != nil || len(result) == 0 || t.workspaceRoot == "" {
+		return result, err
+	}
+
+	if !isDirOrChild(getParentDir(result), t.workspaceRoot) {
+		log.Debug("dependency is not resolved inside workspace root", zap.String("nodeModuleDir", nodeModuleDir), zap.String("workspaceRoot", t.workspaceRoot))
+		return "", nil
+	}
+	return result, nil
+}
+
+// checkLinkedPackage handles workspace packages linked to node_modules: real dir is reported as path, the project itself is not packed as own dependency
+// and package linked to several node_modules is collected only once if already visible. Returns false if package must be skipped.
+func (t *Collector) checkLinkedPackage(dependency *Dependency, parentNodeModuleDir string) (bool, error) {
+	info, err := os.Lstat(dependency.dir)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return true, nil
+	}
+
+	realDir, err := filepath.EvalSymlinks(dependency.dir)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	if realDir == t.projectRealDir {
+		return false, nil
+	}
+
+	placedNodeModuleDir, isPlaced := t.linkedPackageToNodeModuleDir[realDir]
+	if isPlaced && isDirOrChild(getParentDir(parentNodeModuleDir), getParentDir(placedNodeModuleDir)) {
+		return false, nil
+	}
+
+	if t.linkedPackageToNodeModuleDir != nil && !isPlaced {
+		t.linkedPackageToNodeModuleDir[realDir] = parentNodeModuleDir
+	}
+	dependency.realDir = realDir
+	return true, nil
+}
+
+func isDirOrChild(file string, dir string) bool {
+	return file == dir || strings.HasPrefix(file, dir+string(filepath.Separator))
+}
@@ -0,0 +1,85 @@
+package node_modules
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func createWorkspaceFixture(g *GomegaWithT) string {
+	tempDir, err := ioutil.TempDir("", "workspace")
+	g.Expect(err).NotTo(HaveOccurred())
+	dir, err := filepath.EvalSymlinks(tempDir)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// node_modules outside of the workspace must be not used
+	writePackageJson(g, filepath.Join(dir, "node_modules", "leak"), `{"name": "leak", "version": "1.0.0"}`)
+
+	root := filepath.Join(dir, "repo")
+	writePackageJson(g, root, `{"name": "root", "private": true, "workspaces": {"packages": ["packages/*"]}}`)
+	writePackageJson(g, filepath.Join(root, "packages", "app"), `{"name": "app", "version": "1.0.0", "dependencies": {"a": "2.0.0", "lib": "1.0.0", "leak": "1.0.0"}}`)
+	writePackageJson(g, filepath.Join(root, "packages", "lib"), `{"name": "lib", "version": "1.0.0", "dependencies": {"a": "1.0.0", "app": "1.0.0"}}`)
+	writePackageJson(g, filepath.Join(root, "packages", "app", "node_modules", "a"), `{"name": "a", "version": "2.0.0"}`)
+	writePackageJson(g, filepath.Join(root, "node_modules", "a"), `{"name": "a", "version": "1.0.0"}`)
+	g.Expect(os.Symlink("../packages/app", filepath.Join(root, "node_modules", "app"))).To(Succeed())
+	g.Expect(os.Symlink("../packages/lib", filepath.Join(root, "node_modules", "lib"))).To(Succeed())
+	return dir
+}
+
+func TestWorkspace(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir := createWorkspaceFixture(g)
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "repo")
+	projectDir := filepath.Join(root, "packages", "app")
+	g.Expect(findWorkspaceRoot(projectDir)).To(Equal(root))
+	g.Expect(findWorkspaceRoot(root)).To(Equal(root))
+	g.Expect(findWorkspaceRoot(dir)).To(Equal(""))
+
+	collector := collectTree(g, projectDir)
+	g.Expect(collector.workspaceRoot).To(Equal(root))
+	g.Expect(collector.NodeModuleDirToDependencyMap).To(HaveLen(2))
+	g.Expect(getPlaced(collector, filepath.Join(projectDir, "node_modules"))).To(Equal(map[string]string{"a": "2.0.0"}))
+	// app itself is not packed as dependency of lib, leak is not resolved outside of the workspace
+	g.Expect(getPlaced(collector, filepath.Join(root, "node_modules"))).To(Equal(map[string]string{"a": "1.0.0", "lib": "1.0.0"}))
+	g.Expect((*collector.NodeModuleDirToDependencyMap[filepath.Join(root, "node_modules")])["lib"].realDir).To(Equal(filepath.Join(root, "packages", "lib")))
+	g.Expect(collector.unresolvedDependencies).To(HaveKey("leak"))
+}
+
+func TestWorkspaceRootOverride(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir := createWorkspaceFixture(g)
+	defer os.RemoveAll(dir)
+
+	projectDir := filepath.Join(dir, "repo", "packages", "app")
+	collector := &Collector{
+		unresolvedDependencies:       make(map[string]bool),
+		NodeModuleDirToDependencyMap: make(map[string]*map[string]*Dependency),
+		workspaceRoot:                projectDir,
+	}
+	root, err := readPackageJson(projectDir)
+	g.Expect(err).NotTo(HaveOccurred())
+	root.dir = projectDir
+	g.Expect(collector.collect(root, "")).To(Succeed())
+
+	g.Expect(collector.NodeModuleDirToDependencyMap).To(HaveLen(1))
+	g.Expect(collector.unresolvedDependencies).To(And(HaveKey("lib"), HaveKey("leak")))
+}
+
+func TestWorkspacePattern(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	g.Expect(isWorkspacePatternMatched("packages/*", "packages/app")).To(BeTrue())
+	g.Expect(isWorkspacePatternMatched("./packages/*/", "packages/app")).To(BeTrue())
+	g.Expect(isWorkspacePatternMatched("packages/*", "packages/app/sub")).To(BeFalse())
+	g.Expect(isWorkspacePatternMatched("packages/**", "packages/app/sub")).To(BeTrue())
+	g.Expect(isWorkspacePatternMatched("packages/**", "packages")).To(BeFalse())
+	g.Expect(isWorkspacePatternMatched("apps/desktop", "apps/desktop")).To(BeTrue())
+	g.Expect(isWorkspacePatternMatched("apps/desktop", "apps/web")).To(BeFalse())
+}
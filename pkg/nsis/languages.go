@@ -0,0 +1,126 @@
+package nsis
+
+import (
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/json-iterator/go"
+)
+
+// language code to NSIS language name (file name in Contrib/Language files)
+var nsisLanguages = map[string]string{
+	"ar_SA": "Arabic",
+	"bg_BG": "Bulgarian",
+	"ca_ES": "Catalan",
+	"cs_CZ": "Czech",
+	"da_DK": "Danish",
+	"de_DE": "German",
+	"el_GR": "Greek",
+	"en_US": "English",
+	"es_ES": "Spanish",
+	"et_EE": "Estonian",
+	"fa_IR": "Farsi",
+	"fi_FI": "Finnish",
+	"fr_FR": "French",
+	"he_IL": "Hebrew",
+	"hr_HR": "Croatian",
+	"hu_HU": "Hungarian",
+	"id_ID": "Indonesian",
+	"it_IT": "Italian",
+	"ja_JP": "Japanese",
+	"ko_KR": "Korean",
+	"lt_LT": "Lithuanian",
+	"lv_LV": "Latvian",
+	"nb_NO": "Norwegian",
+	"nl_NL": "Dutch",
+	"pl_PL": "Polish",
+	"pt_BR": "PortugueseBR",
+	"pt_PT": "Portuguese",
+	"ro_RO": "Romanian",
+	"ru_RU": "Russian",
+	"sk_SK": "Slovak",
+	"sl_SI": "Slovenian",
+	"sr_RS": "Serbian",
+	"sv_SE": "Swedish",
+	"th_TH": "Thai",
+	"tr_TR": "Turkish",
+	"uk_UA": "Ukrainian",
+	"vi_VN": "Vietnamese",
+	"zh_CN": "SimpChinese",
+	"zh_TW": "TradChinese",
+}
+
+func writeLanguagesFile(file string, languages []string, messagesFile string, isMui bool) error {
+	var messages map[string]map[string]string
+	if messagesFile != "" {
+		data, err := ioutil.ReadFile(messagesFile)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = jsoniter.Unmarshal(data, &messages)
+		if err != nil {
+			return errors.WithMessage(err, "cannot parse "+messagesFile)
+		}
+	}
+
+	text, err := CreateLanguagesFile(languages, messages, isMui)
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(ioutil.WriteFile(file, []byte(text), 0644))
+}
+
+// CreateLanguagesFile returns NSIS include that loads languages and defines LangString for each message (message id to map of language to text)
+func CreateLanguagesFile(languages []string, messages map[string]map[string]string, isMui bool) (string, error) {
+	var s strings.Builder
+	names := make([]string, len(languages))
+	for i, language := range languages {
+		name := nsisLanguages[strings.Replace(language, "-", "_", 1)]
+		if name == "" {
+			return "", util.NewMessageError("language "+language+" is not supported", "ERR_NSIS_UNSUPPORTED_LANGUAGE")
+		}
+		names[i] = name
+
+		if isMui {
+			s.WriteString(`!insertmacro MUI_LANGUAGE "` + name + "\"\n")
+		} else {
+			s.WriteString(`LoadLanguageFile "${NSISDIR}\Contrib\Language files\` + name + ".nlf\"\n")
+		}
+	}
+
+	ids := make([]string, 0, len(messages))
+	for id := range messages {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		for i, language := range languages {
+			text, ok := getMessage(messages[id], strings.Replace(language, "-", "_", 1))
+			if !ok {
+				return "", util.NewMessageError("message "+id+" has no text for "+language+" and en", "ERR_NSIS_MISSING_MESSAGE")
+			}
+			s.WriteString("LangString " + id + " ${LANG_" + strings.ToUpper(names[i]) + "} \"" + escapeString(text) + "\"\n")
+		}
+	}
+	return s.String(), nil
+}
+
+// exact language code, then language without region, then English
+func getMessage(translations map[string]string, language string) (string, bool) {
+	for _, key := range []string{language, strings.SplitN(language, "_", 2)[0], "en_US", "en"} {
+		text, ok := translations[key]
+		if ok {
+			return text, true
+		}
+	}
+	return "", false
+}
+
+func escapeString(text string) string {
+	replacer := strings.NewReplacer("$", "$$", `"`, `$\"`, "\r\n", `$\r$\n`, "\n", `$\r$\n`, "\t", `$\t`)
+	return replacer.Replace(text)
+}
@@ -0,0 +1,183 @@
+package nsis
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/download"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/go-fs-util"
+	"go.uber.org/zap"
+)
+
+// define with path to the generated languages file, script includes it after pages: !include "${APP_BUILDER_LANGUAGES_FILE}"
+const languagesFileDefine = "APP_BUILDER_LANGUAGES_FILE"
+
+type NsisOptions struct {
+	script   string
+	stageDir string
+
+	includeDirs []string
+	pluginDirs  []string
+	defines     map[string]string
+	commands    []string
+
+	languages []string
+	// JSON file: message id to map of language (en, de or en_US) to text
+	messagesFile string
+	// MUI_LANGUAGE is used instead of LoadLanguageFile (assisted installer with Modern UI pages)
+	isMui bool
+
+	// full makensis output is written to the file
+	logFile string
+}
+
+func ConfigureCommand(app *kingpin.Application) {
+	command := app.Command("nsis", "Build NSIS installer: makensis (downloaded if ELECTRON_BUILDER_NSIS_DIR or USE_SYSTEM_MAKENSIS env is not set) is executed with includes, defines and generated languages file.")
+
+	options := &NsisOptions{}
+	command.Flag("script", "The .nsi script.").Required().ExistingFileVar(&options.script)
+	command.Flag("stage", "The stage dir for generated files.").Short('s').Required().StringVar(&options.stageDir)
+	command.Flag("include-dir", "The dir to add to include search path.").ExistingDirsVar(&options.includeDirs)
+	command.Flag("plugin-dir", "The dir with x86-unicode plugins.").ExistingDirsVar(&options.pluginDirs)
+	command.Flag("define", "The define (NAME=VALUE).").Short('D').StringMapVar(&options.defines)
+	command.Flag("command", "The command to execute before the script (e.g. Unicode true).").Short('X').StringsVar(&options.commands)
+	command.Flag("language", "The installer language (e.g. en_US).").StringsVar(&options.languages)
+	command.Flag("messages", "The JSON file with localized messages (LangString is generated for each language).").ExistingFileVar(&options.messagesFile)
+	command.Flag("mui", "Languages are inserted using MUI_LANGUAGE macro (Modern UI).").BoolVar(&options.isMui)
+	command.Flag("log-file", "The file to write full makensis output to.").StringVar(&options.logFile)
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		return Build(options)
+	})
+}
+
+func Build(options *NsisOptions) error {
+	err := fsutil.EnsureDir(options.stageDir)
+	if err != nil {
+		return err
+	}
+
+	defines := make(map[string]string, len(options.defines)+1)
+	for name, value := range options.defines {
+		defines[name] = value
+	}
+
+	if len(options.languages) != 0 {
+		languagesFile := filepath.Join(options.stageDir, "languages.nsh")
+		err = writeLanguagesFile(languagesFile, options.languages, options.messagesFile, options.isMui)
+		if err != nil {
+			return err
+		}
+		defines[languagesFileDefine] = languagesFile
+	}
+
+	makensis, nsisDir, err := getMakensis()
+	if err != nil {
+		return err
+	}
+
+	command := exec.Command(makensis, createArgs(options, defines)...)
+	command.Dir = filepath.Dir(options.script)
+	if nsisDir != "" {
+		command.Env = append(os.Environ(), "NSISDIR="+nsisDir)
+	}
+
+	output, err := util.Execute(command)
+	if err != nil {
+		if execError, ok := err.(*util.ExecError); ok {
+			fullOutput := append(append([]byte{}, execError.Output...), execError.ErrorOutput...)
+			writeLog(options.logFile, fullOutput)
+			records := parseOutput(fullOutput)
+			logWarnings(records)
+			explainError(execError, records)
+			return execError
+		}
+		return err
+	}
+
+	writeLog(options.logFile, output)
+	logWarnings(parseOutput(output))
+	return nil
+}
+
+// -WX - warnings are errors (the same as electron-builder), script is in UTF-8
+func createArgs(options *NsisOptions, defines map[string]string) []string {
+	args := []string{"-WX", "-INPUTCHARSET", "UTF8"}
+	if log.IsDebugEnabled() {
+		args = append(args, "-V4")
+	} else {
+		args = append(args, "-V2")
+	}
+
+	names := make([]string, 0, len(defines))
+	for name := range defines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := defines[name]
+		if value == "" {
+			args = append(args, "-D"+name)
+		} else {
+			args = append(args, "-D"+name+"="+value)
+		}
+	}
+
+	for _, dir := range options.includeDirs {
+		args = append(args, "-X!addincludedir "+dir)
+	}
+	for _, dir := range options.pluginDirs {
+		args = append(args, "-X!addplugindir /x86-unicode "+dir)
+	}
+	for _, command := range options.commands {
+		args = append(args, "-X"+command)
+	}
+	return append(args, options.script)
+}
+
+// returns makensis executable and NSISDIR (empty for system makensis)
+func getMakensis() (string, string, error) {
+	if util.IsEnvTrue("USE_SYSTEM_MAKENSIS") {
+		return "makensis", "", nil
+	}
+
+	nsisDir, err := download.DownloadNsis()
+	if err != nil {
+		return "", "", err
+	}
+
+	switch util.GetCurrentOs() {
+	case util.WINDOWS:
+		return filepath.Join(nsisDir, "Bin", "makensis.exe"), nsisDir, nil
+	case util.MAC:
+		return filepath.Join(nsisDir, "mac", "makensis"), nsisDir, nil
+	default:
+		return filepath.Join(nsisDir, "linux", "makensis"), nsisDir, nil
+	}
+}
+
+func writeLog(file string, output []byte) {
+	if file == "" {
+		return
+	}
+
+	err := ioutil.WriteFile(file, output, 0644)
+	if err != nil {
+		log.Warn("cannot write makensis log", zap.String("file", file), zap.Error(err))
+	}
+}
+
+func logWarnings(records []*outputRecord) {
+	for _, record := range records {
+		if record.level == "warning" {
+			log.Warn("makensis: "+strings.TrimSpace(record.message), record.fields()...)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package nsis
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/util"
+	. "github.com/onsi/gomega"
+)
+
+func TestParseOutput(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	output := `Processing config: C:\nsis\nsisconf.nsh
+Processing script file: "installer.nsi" (UTF8)
+warning 6010: install function "foo" not referenced - zeroing code (0-0) out (installer.nsi:12)
+!include: could not find: "missing.nsh"
+Error in script "installer.nsi" on line 5 -- aborting creation process
+`
+	records := parseOutput([]byte(output))
+	g.Expect(records).To(HaveLen(2))
+	g.Expect(*records[0]).To(Equal(outputRecord{level: "warning", code: "6010", message: `install function "foo" not referenced - zeroing code (0-0) out`, file: "installer.nsi", line: 12}))
+	g.Expect(*records[1]).To(Equal(outputRecord{level: "error", message: `!include: could not find: "missing.nsh"`, file: "installer.nsi", line: 5}))
+
+	execError := &util.ExecError{Cause: errors.New("exit status 1"), Output: []byte(output)}
+	explainError(execError, records)
+	g.Expect(execError.Message).To(Equal(`makensis failed: !include: could not find: "missing.nsh" (include file is not found, check include dirs)`))
+	g.Expect(execError.ExtraFields).To(HaveLen(3))
+}
+
+func TestCreateLanguagesFile(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	messages := map[string]map[string]string{
+		"appRunning": {"en": `"${PRODUCT_NAME}" is running`, "de": "Läuft\nnoch"},
+	}
+	text, err := CreateLanguagesFile([]string{"en_US", "de-DE"}, messages, true)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(text).To(Equal(`!insertmacro MUI_LANGUAGE "English"
+!insertmacro MUI_LANGUAGE "German"
+LangString appRunning ${LANG_ENGLISH} "$\"$${PRODUCT_NAME}$\" is running"
+LangString appRunning ${LANG_GERMAN} "Läuft$\r$\nnoch"
+`))
+
+	_, err = CreateLanguagesFile([]string{"xx_XX"}, nil, false)
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestCreateArgs(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	args := createArgs(&NsisOptions{script: "installer.nsi", includeDirs: []string{"include"}, commands: []string{"Unicode true"}}, map[string]string{"VERSION": "1.0.0", "ONE_CLICK": ""})
+	g.Expect(args).To(Equal([]string{"-WX", "-INPUTCHARSET", "UTF8", "-V2", "-DONE_CLICK", "-DVERSION=1.0.0", "-X!addincludedir include", "-XUnicode true", "installer.nsi"}))
+}
@@ -0,0 +1,110 @@
+package nsis
+
+import (
+	"bufio"
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/develar/app-builder/pkg/util"
+	"go.uber.org/zap"
+)
+
+var (
+	warningRegExp       = regexp.MustCompile(`^warning (\d+): (.*?)(?: \(([^()]+):(\d+)\))?$`)
+	errorLocationRegExp = regexp.MustCompile(`^Error in script "(.+)" on line (\d+) -- aborting creation process`)
+)
+
+type outputRecord struct {
+	level   string
+	code    string
+	message string
+	file    string
+	line    int
+}
+
+func (t *outputRecord) fields() []zap.Field {
+	var result []zap.Field
+	if t.code != "" {
+		result = append(result, zap.String("code", t.code))
+	}
+	if t.file != "" {
+		result = append(result, zap.String("file", t.file), zap.Int("line", t.line))
+	}
+	return result
+}
+
+type errorHint struct {
+	marker string
+	code   string
+	hint   string
+}
+
+// the first matched hint is used, so, more specific markers go first
+var errorHints = []errorHint{
+	{"Internal compiler error #12345", "ERR_NSIS_DATA_TOO_LARGE", "installer data exceeds 2 GB that NSIS supports, reduce app size or use web installer (nsis-web)"},
+	{"Can't open output file", "ERR_NSIS_OUTPUT_LOCKED", "output file is used by another process (running installer or antivirus), close it and try again"},
+	{"!include: could not find", "ERR_NSIS_INCLUDE_NOT_FOUND", "include file is not found, check include dirs"},
+	{"Plugin not found, cannot call", "ERR_NSIS_PLUGIN_NOT_FOUND", "plugin is not found, check plugin dirs (x86-unicode build of plugin is required)"},
+	{"Invalid command:", "ERR_NSIS_INVALID_COMMAND", "unknown command, plugin is missing or script requires newer NSIS"},
+	{"no files found", "ERR_NSIS_FILE_NOT_FOUND", "file to pack is not found, paths are relative to the script dir"},
+	{"warning treated as error", "ERR_NSIS_WARNING", "warnings are treated as errors, fix the warning"},
+	{"Can't open script", "ERR_NSIS_SCRIPT_NOT_FOUND", "script file cannot be read"},
+}
+
+// parseOutput extracts warnings and errors from makensis output, other lines are ignored
+func parseOutput(output []byte) []*outputRecord {
+	var result []*outputRecord
+	var previousLine string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if matches := warningRegExp.FindStringSubmatch(line); matches != nil {
+			record := &outputRecord{level: "warning", code: matches[1], message: matches[2], file: matches[3]}
+			record.line, _ = strconv.Atoi(matches[4])
+			result = append(result, record)
+		} else if matches := errorLocationRegExp.FindStringSubmatch(line); matches != nil {
+			// the actual error is printed on the previous line
+			record := &outputRecord{level: "error", message: strings.TrimPrefix(previousLine, "Error: "), file: matches[1]}
+			record.line, _ = strconv.Atoi(matches[2])
+			result = append(result, record)
+		} else if strings.HasPrefix(line, "Internal compiler error") || (strings.HasPrefix(line, "Error") && !strings.HasPrefix(line, "Error: warning treated as error")) {
+			result = append(result, &outputRecord{level: "error", message: strings.TrimPrefix(line, "Error: ")})
+		}
+
+		if strings.TrimSpace(line) != "" {
+			previousLine = line
+		}
+	}
+	return result
+}
+
+// explainError sets message of the exec error to the makensis error and actionable hint
+func explainError(execError *util.ExecError, records []*outputRecord) {
+	var errorRecord *outputRecord
+	for _, record := range records {
+		if record.level == "error" {
+			errorRecord = record
+			break
+		}
+	}
+	if errorRecord == nil {
+		execError.Message = "makensis failed"
+		return
+	}
+
+	message := "makensis failed: " + errorRecord.message
+	fields := errorRecord.fields()
+	allErrors := string(execError.Output) + string(execError.ErrorOutput)
+	for _, hint := range errorHints {
+		if strings.Contains(allErrors, hint.marker) {
+			message += " (" + hint.hint + ")"
+			fields = append(fields, zap.String("errorCode", hint.code))
+			break
+		}
+	}
+	execError.Message = message
+	execError.ExtraFields = append(execError.ExtraFields, fields...)
+}
@@ -1,6 +1,9 @@
 package appimage
 
 import (
+	"bytes"
+	"debug/elf"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -9,10 +12,12 @@ import (
 	"syscall"
 
 	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/archive/squashfs"
 	"github.com/develar/app-builder/pkg/blockmap"
 	"github.com/develar/app-builder/pkg/fs"
 	"github.com/develar/app-builder/pkg/linuxTools"
 	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/app-builder/pkg/zsync"
 	"github.com/develar/errors"
 	"github.com/develar/go-fs-util"
 )
@@ -28,6 +33,9 @@ type AppImageOptions struct {
 	configuration *AppImageConfiguration
 
 	compression *string
+
+	isZsync  *bool
+	zsyncUrl *string
 }
 
 func ConfigureCommand(app *kingpin.Application) {
@@ -44,6 +52,9 @@ func ConfigureCommand(app *kingpin.Application) {
 		license:  command.Flag("license", "The license file.").String(),
 
 		compression: command.Flag("compression", "The compression.").Enum("xz", "gzip"),
+
+		isZsync:  command.Flag("zsync", "Generate .zsync file alongside AppImage for AppImageUpdate.").Bool(),
+		zsyncUrl: command.Flag("zsync-url", "URL of the .zsync file, embedded into the update information section (zsync|URL).").String(),
 	}
 
 	configuration := command.Flag("configuration", "").Required().String()
@@ -105,6 +116,12 @@ func AppImage(options *AppImageOptions) error {
 		return err
 	}
 
+	// metainfo is provided by the app (usr/share/metainfo)
+	err = validateMetainfo(stageDir, options.configuration.ExecutableName+".desktop", options.configuration.ExecutableName)
+	if err != nil {
+		return err
+	}
+
 	runtimeData, err := ioutil.ReadFile(filepath.Join(appImageToolDir, "runtime-"+arch))
 	if err != nil {
 		return errors.WithStack(err)
@@ -115,6 +132,13 @@ func AppImage(options *AppImageOptions) error {
 		return err
 	}
 
+	if *options.zsyncUrl != "" {
+		err = setUpdateInformation(runtimeData, "zsync|"+*options.zsyncUrl)
+		if err != nil {
+			return err
+		}
+	}
+
 	err = writeRuntimeData(outputFile, runtimeData)
 	if err != nil {
 		return err
@@ -125,11 +149,21 @@ func AppImage(options *AppImageOptions) error {
 		return errors.WithStack(err)
 	}
 
-	updateInfo, err := blockmap.BuildBlockMap(outputFile, blockmap.DefaultChunkerConfiguration, blockmap.DEFLATE, "")
+	blockMapInfo, err := blockmap.BuildBlockMap(outputFile, blockmap.DefaultChunkerConfiguration, blockmap.DEFLATE, "")
 	if err != nil {
 		return err
 	}
 
+	updateInfo := &UpdateInfo{InputFileInfo: blockMapInfo}
+	if *options.isZsync {
+		// computed after block map is appended - AppImageUpdate downloads the whole file
+		updateInfo.ZsyncFile = outputFile + ".zsync"
+		err = zsync.Make(outputFile, updateInfo.ZsyncFile, zsync.Options{})
+		if err != nil {
+			return err
+		}
+	}
+
 	err = util.WriteJsonToStdOut(updateInfo)
 	if err != nil {
 		return err
@@ -138,6 +172,36 @@ func AppImage(options *AppImageOptions) error {
 	return nil
 }
 
+type UpdateInfo struct {
+	*blockmap.InputFileInfo
+
+	ZsyncFile string `json:"zsyncFile,omitempty"`
+}
+
+// AppImage runtime reserves .upd_info ELF section for update information (https://github.com/AppImage/AppImageSpec/blob/master/draft.md#update-information)
+func setUpdateInformation(runtimeData []byte, updateInformation string) error {
+	elfFile, err := elf.NewFile(bytes.NewReader(runtimeData))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	section := elfFile.Section(".upd_info")
+	if section == nil {
+		return util.NewMessageError("AppImage runtime doesn't have .upd_info section", "ERR_APPIMAGE_NO_UPDATE_INFO_SECTION")
+	}
+
+	if uint64(len(updateInformation)) >= section.Size {
+		return util.NewMessageError(fmt.Sprintf("update information is too long (%d bytes, max %d)", len(updateInformation), section.Size-1), "ERR_APPIMAGE_UPDATE_INFO_TOO_LONG")
+	}
+
+	data := runtimeData[section.Offset : section.Offset+section.Size]
+	copy(data, updateInformation)
+	for i := len(updateInformation); i < len(data); i++ {
+		data[i] = 0
+	}
+	return nil
+}
+
 func writeRuntimeData(filePath string, runtimeData []byte) error {
 	file, err := os.OpenFile(filePath, os.O_RDWR, 0755)
 	if err != nil {
@@ -149,6 +213,24 @@ func writeRuntimeData(filePath string, runtimeData []byte) error {
 }
 
 func createSquashFs(options *AppImageOptions, offset int) error {
+	if !linuxTools.IsMksquashfsRequested() {
+		writerOptions := squashfs.WriterOptions{Compression: *options.compression, NoFragments: true}
+		if *options.compression == "xz" {
+			writerOptions.BlockSize = 1024 * 1024
+		}
+
+		writer, err := squashfs.NewWriter(writerOptions)
+		if err != nil {
+			return err
+		}
+
+		err = writer.AddDir(*options.stageDir, nil)
+		if err != nil {
+			return err
+		}
+		return writer.WriteFile(*options.output, int64(offset))
+	}
+
 	mksquashfsPath, err := linuxTools.GetMksquashfs()
 	if err != nil {
 		return err
@@ -187,13 +187,18 @@ func writeAppLauncherAndRelatedFiles(options *AppImageOptions) error {
 		}
 	}
 
+	configuration := options.configuration
+	executableName := configuration.ExecutableName
+	err := validateDesktopEntry(executableName+".desktop", configuration.DesktopEntry, executableName)
+	if err != nil {
+		return err
+	}
+
 	desktopFileName, err := writeDesktopFile(options)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
-	configuration := options.configuration
-	executableName := configuration.ExecutableName
 	templateConfiguration := &TemplateConfiguration{
 		DesktopFileName: desktopFileName,
 		ExecutableName:  executableName,
@@ -0,0 +1,393 @@
+package appimage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+)
+
+// desktop environments silently ignore invalid desktop file (and AppImageLauncher / appimaged don't integrate app),
+// so, desktop entry and AppStream metainfo are validated before packing
+
+// https://specifications.freedesktop.org/desktop-entry-spec/latest/ar01s06.html
+var knownDesktopKeys = map[string]bool{
+	"Type": true, "Version": true, "Name": true, "GenericName": true, "NoDisplay": true, "Comment": true, "Icon": true, "Hidden": true,
+	"OnlyShowIn": true, "NotShowIn": true, "DBusActivatable": true, "TryExec": true, "Exec": true, "Path": true, "Terminal": true,
+	"Actions": true, "MimeType": true, "Categories": true, "Implements": true, "Keywords": true, "StartupNotify": true, "StartupWMClass": true,
+	"URL": true, "PrefersNonDefaultGPU": true, "SingleMainWindow": true,
+}
+
+var booleanDesktopKeys = []string{"NoDisplay", "Hidden", "DBusActivatable", "Terminal", "StartupNotify", "PrefersNonDefaultGPU", "SingleMainWindow"}
+
+var listDesktopKeys = []string{"OnlyShowIn", "NotShowIn", "Actions", "MimeType", "Categories", "Implements", "Keywords"}
+
+// https://specifications.freedesktop.org/menu-spec/latest/apa.html
+var mainCategories = []string{"AudioVideo", "Audio", "Video", "Development", "Education", "Game", "Graphics", "Network", "Office", "Science", "Settings", "System", "Utility"}
+
+// https://specifications.freedesktop.org/menu-spec/latest/apas02.html
+var additionalCategories = []string{
+	"Building", "Debugger", "IDE", "GUIDesigner", "Profiling", "RevisionControl", "Translation", "Calendar", "ContactManagement", "Database",
+	"Dictionary", "Chart", "Email", "Finance", "FlowChart", "PDA", "ProjectManagement", "Presentation", "Spreadsheet", "WordProcessor",
+	"2DGraphics", "VectorGraphics", "RasterGraphics", "3DGraphics", "Scanning", "OCR", "Photography", "Publishing", "Viewer", "TextTools",
+	"DesktopSettings", "HardwareSettings", "Printing", "PackageManager", "Dialup", "InstantMessaging", "Chat", "IRCClient", "Feed",
+	"FileTransfer", "HamRadio", "News", "P2P", "RemoteAccess", "Telephony", "TelephonyTools", "VideoConference", "WebBrowser", "WebDevelopment",
+	"Midi", "Mixer", "Sequencer", "Tuner", "TV", "AudioVideoEditing", "Player", "Recorder", "DiscBurning", "ActionGame", "AdventureGame",
+	"ArcadeGame", "BoardGame", "BlocksGame", "CardGame", "KidsGame", "LogicGame", "RolePlaying", "Shooter", "Simulation", "SportsGame",
+	"StrategyGame", "Art", "Construction", "Music", "Languages", "ArtificialIntelligence", "Astronomy", "Biology", "Chemistry",
+	"ComputerScience", "DataVisualization", "Economy", "Electricity", "Geography", "Geology", "Geoscience", "History", "Humanities",
+	"ImageProcessing", "Literature", "Maps", "Math", "NumericalAnalysis", "MedicalSoftware", "Physics", "Robotics", "Spirituality", "Sports",
+	"ParallelComputing", "Amusement", "Archiving", "Compression", "Electronics", "Emulator", "Engineering", "FileTools", "FileManager",
+	"TerminalEmulator", "Filesystem", "Monitor", "Security", "Accessibility", "Calculator", "Clock", "TextEditor", "Documentation", "Adult",
+	"Core", "KDE", "GNOME", "XFCE", "DDE", "GTK", "Qt", "Motif", "Java", "ConsoleOnly",
+}
+
+var desktopKeyRegExp = regexp.MustCompile(`^([A-Za-z0-9-]+)(\[[^\]]+])?$`)
+
+type validationError struct {
+	line    int
+	message string
+}
+
+type validationErrors struct {
+	file   string
+	errors []validationError
+}
+
+func (t *validationErrors) add(line int, format string, args ...interface{}) {
+	t.errors = append(t.errors, validationError{line: line, message: fmt.Sprintf(format, args...)})
+}
+
+// errors are reported in the line order
+func (t *validationErrors) toError(code string) error {
+	if len(t.errors) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(t.errors, func(i, j int) bool {
+		return t.errors[i].line < t.errors[j].line
+	})
+	var s strings.Builder
+	s.WriteString("invalid " + t.file + ":")
+	for _, item := range t.errors {
+		s.WriteString(fmt.Sprintf("\n  %s:%d: %s", t.file, item.line, item.message))
+	}
+	return util.NewMessageError(s.String(), code)
+}
+
+type desktopValue struct {
+	value string
+	line  int
+}
+
+type desktopGroup struct {
+	name    string
+	line    int
+	entries map[string]*desktopValue
+}
+
+// validateDesktopEntry checks desktop file as desktop-file-validate does (errors only) and that icon is the AppImage icon (executable name).
+func validateDesktopEntry(fileName string, content string, iconName string) error {
+	errs := &validationErrors{file: fileName}
+	groups := parseDesktopEntry(content, errs)
+
+	if len(groups) == 0 || groups[0].name != "Desktop Entry" {
+		errs.add(1, "first group must be [Desktop Entry]")
+		return errs.toError("ERR_APPIMAGE_INVALID_DESKTOP_FILE")
+	}
+
+	entry := groups[0]
+	requireKey := func(key string) *desktopValue {
+		value := entry.entries[key]
+		if value == nil || strings.TrimSpace(value.value) == "" {
+			errs.add(entry.line, "required key %s is missing", key)
+			return nil
+		}
+		return value
+	}
+
+	if value := requireKey("Type"); value != nil && value.value != "Application" {
+		errs.add(value.line, "Type must be Application, but %s is set", value.value)
+	}
+	requireKey("Name")
+	requireKey("Exec")
+	if value := requireKey("Icon"); value != nil && value.value != iconName {
+		errs.add(value.line, "Icon %q doesn't match AppImage icon name %q (icon name without extension and path is expected)", value.value, iconName)
+	}
+	if value := entry.entries["Version"]; value != nil && !util.ContainsString([]string{"1.0", "1.1", "1.2", "1.3", "1.4", "1.5"}, value.value) {
+		errs.add(value.line, "unknown Version %q", value.value)
+	}
+
+	for _, key := range booleanDesktopKeys {
+		if value := entry.entries[key]; value != nil && value.value != "true" && value.value != "false" {
+			errs.add(value.line, "value of %s must be true or false, but %q is set", key, value.value)
+		}
+	}
+	for _, key := range listDesktopKeys {
+		if value := entry.entries[key]; value != nil && value.value != "" && !strings.HasSuffix(value.value, ";") {
+			errs.add(value.line, "value of %s must end with semicolon", key)
+		}
+	}
+
+	if value := requireKey("Categories"); value != nil {
+		validateCategories(value, errs)
+	}
+
+	if value := entry.entries["Actions"]; value != nil {
+		for _, action := range splitDesktopList(value.value) {
+			group := findDesktopGroup(groups, "Desktop Action "+action)
+			if group == nil {
+				errs.add(value.line, "action %s is declared, but group [Desktop Action %s] is missing", action, action)
+			} else if group.entries["Name"] == nil {
+				errs.add(group.line, "required key Name is missing")
+			}
+		}
+	}
+	return errs.toError("ERR_APPIMAGE_INVALID_DESKTOP_FILE")
+}
+
+func parseDesktopEntry(content string, errs *validationErrors) []*desktopGroup {
+	var groups []*desktopGroup
+	var current *desktopGroup
+	for index, line := range strings.Split(content, "\n") {
+		lineNumber := index + 1
+		line = strings.TrimSuffix(line, "\r")
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "" || strings.HasPrefix(trimmed, "#"):
+			continue
+
+		case strings.HasPrefix(trimmed, "["):
+			if !strings.HasSuffix(trimmed, "]") {
+				errs.add(lineNumber, "invalid group header %q", trimmed)
+				continue
+			}
+			name := trimmed[1 : len(trimmed)-1]
+			if findDesktopGroup(groups, name) != nil {
+				errs.add(lineNumber, "group [%s] is duplicated", name)
+			}
+			current = &desktopGroup{name: name, line: lineNumber, entries: make(map[string]*desktopValue)}
+			groups = append(groups, current)
+
+		default:
+			if current == nil {
+				errs.add(lineNumber, "key-value pair is outside of group, first line must be [Desktop Entry]")
+				continue
+			}
+
+			separator := strings.IndexRune(line, '=')
+			if separator < 0 {
+				errs.add(lineNumber, "line %q is not a key-value pair", trimmed)
+				continue
+			}
+
+			key := strings.TrimSpace(line[:separator])
+			match := desktopKeyRegExp.FindStringSubmatch(key)
+			if match == nil {
+				errs.add(lineNumber, "invalid key %q", key)
+				continue
+			}
+			if _, exists := current.entries[key]; exists {
+				errs.add(lineNumber, "key %s is duplicated in group [%s]", key, current.name)
+				continue
+			}
+			if current == groups[0] && !knownDesktopKeys[match[1]] && !strings.HasPrefix(match[1], "X-") {
+				errs.add(lineNumber, "unknown key %s (custom keys must start with X-)", match[1])
+			}
+			current.entries[key] = &desktopValue{value: strings.TrimSpace(line[separator+1:]), line: lineNumber}
+		}
+	}
+	return groups
+}
+
+func validateCategories(value *desktopValue, errs *validationErrors) {
+	hasMainCategory := false
+	for _, category := range splitDesktopList(value.value) {
+		switch {
+		case util.ContainsString(mainCategories, category):
+			hasMainCategory = true
+		case util.ContainsString(additionalCategories, category) || strings.HasPrefix(category, "X-"):
+		default:
+			errs.add(value.line, "unknown category %s (custom categories must start with X-)", category)
+		}
+	}
+	if !hasMainCategory {
+		errs.add(value.line, "at least one main category is required (%s), otherwise app is shown in the \"Other\" menu or not shown at all", strings.Join(mainCategories, ", "))
+	}
+}
+
+func splitDesktopList(value string) []string {
+	var result []string
+	for _, item := range strings.Split(value, ";") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func findDesktopGroup(groups []*desktopGroup, name string) *desktopGroup {
+	for _, group := range groups {
+		if group.name == name {
+			return group
+		}
+	}
+	return nil
+}
+
+// https://www.freedesktop.org/software/appstream/docs/chap-Quickstart.html#sect-Quickstart-DesktopApps
+var metadataLicenses = []string{"FSFAP", "MIT", "0BSD", "CC0-1.0", "CC-BY-3.0", "CC-BY-4.0", "CC-BY-SA-3.0", "CC-BY-SA-4.0", "GFDL-1.1", "GFDL-1.1+", "GFDL-1.2", "GFDL-1.2+", "GFDL-1.3", "GFDL-1.3+", "BSL-1.0", "FTL", "FSFUL"}
+
+var componentIdRegExp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+type metainfoElement struct {
+	value string
+	attrs map[string]string
+	line  int
+}
+
+// validateMetainfo validates AppStream metainfo files (usr/share/metainfo/*.xml, legacy usr/share/appdata/*.xml) if any.
+func validateMetainfo(stageDir string, desktopFileName string, iconName string) error {
+	var files []string
+	for _, pattern := range []string{"usr/share/metainfo/*.xml", "usr/share/appdata/*.xml"} {
+		matches, err := filepath.Glob(filepath.Join(stageDir, filepath.FromSlash(pattern)))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		files = append(files, matches...)
+	}
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		relativePath, _ := filepath.Rel(stageDir, file)
+		err = validateMetainfoData(filepath.ToSlash(relativePath), data, desktopFileName, iconName)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateMetainfoData(fileName string, data []byte, desktopFileName string, iconName string) error {
+	errs := &validationErrors{file: fileName}
+	root, elements, err := parseMetainfo(data)
+	if err != nil {
+		errs.add(err.line, "%s", err.message)
+		return errs.toError("ERR_APPIMAGE_INVALID_METAINFO")
+	}
+
+	if root.value != "component" {
+		errs.add(root.line, "root element must be <component>, but <%s> is found", root.value)
+		return errs.toError("ERR_APPIMAGE_INVALID_METAINFO")
+	}
+	componentType := root.attrs["type"]
+	if componentType != "" && componentType != "desktop-application" && componentType != "desktop" {
+		errs.add(root.line, "component type must be desktop-application, but %q is set", componentType)
+	}
+
+	requireElement := func(name string) *metainfoElement {
+		element := elements[name]
+		if element == nil || element.value == "" {
+			errs.add(root.line, "required element <%s> is missing", name)
+			return nil
+		}
+		return element
+	}
+
+	if element := requireElement("id"); element != nil && !componentIdRegExp.MatchString(element.value) {
+		errs.add(element.line, "id %q contains invalid characters (reverse-DNS name is expected, e.g. com.example.App)", element.value)
+	}
+	requireElement("name")
+	requireElement("summary")
+	if element := requireElement("metadata_license"); element != nil && !util.ContainsString(metadataLicenses, element.value) {
+		errs.add(element.line, "metadata_license %q is not a permissive license (e.g. MIT, FSFAP or CC0-1.0)", element.value)
+	}
+
+	if element := elements["launchable"]; element != nil {
+		if element.attrs["type"] == "desktop-id" && element.value != desktopFileName {
+			errs.add(element.line, "launchable %q doesn't match desktop file name %q", element.value, desktopFileName)
+		}
+	} else if componentType == "desktop-application" {
+		errs.add(root.line, "<launchable type=\"desktop-id\">%s</launchable> is required for desktop-application", desktopFileName)
+	}
+
+	if element := elements["icon"]; element != nil && element.attrs["type"] == "stock" && element.value != iconName {
+		errs.add(element.line, "stock icon %q doesn't match AppImage icon name %q", element.value, iconName)
+	}
+	return errs.toError("ERR_APPIMAGE_INVALID_METAINFO")
+}
+
+type metainfoParseError struct {
+	message string
+	line    int
+}
+
+// direct children of the root element (not translated, the first one), line is computed from the decoder offset
+func parseMetainfo(data []byte) (*metainfoElement, map[string]*metainfoElement, *metainfoParseError) {
+	lineAt := func(offset int64) int {
+		return bytes.Count(data[:offset], []byte("\n")) + 1
+	}
+
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	var root *metainfoElement
+	elements := make(map[string]*metainfoElement)
+	var current *metainfoElement
+	depth := 0
+	for {
+		offset := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, &metainfoParseError{message: err.Error(), line: lineAt(decoder.InputOffset())}
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth++
+			element := &metainfoElement{value: t.Name.Local, attrs: make(map[string]string), line: lineAt(offset)}
+			for _, attr := range t.Attr {
+				element.attrs[attr.Name.Local] = attr.Value
+			}
+			switch {
+			case depth == 1:
+				root = element
+			case depth == 2 && element.attrs["lang"] == "" && elements[t.Name.Local] == nil:
+				current = element
+				elements[t.Name.Local] = element
+				element.value = ""
+			}
+
+		case xml.CharData:
+			if current != nil && depth == 2 {
+				current.value += string(t)
+			}
+
+		case xml.EndElement:
+			if depth == 2 && current != nil {
+				current.value = strings.TrimSpace(current.value)
+				current = nil
+			}
+			depth--
+		}
+	}
+
+	if root == nil {
+		return nil, nil, &metainfoParseError{message: "root element is missing", line: 1}
+	}
+	return root, elements, nil
+}
@@ -0,0 +1,73 @@
+package appimage
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestValidateDesktopEntry(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	valid := "[Desktop Entry]\nName=App\nExec=AppRun --no-sandbox %U\nTerminal=false\nType=Application\nIcon=app\nStartupWMClass=App\nX-AppImage-Version=1.0.0\nComment=Test\nName[de]=App\nCategories=Development;IDE;\nActions=new-window;\n\n[Desktop Action new-window]\nName=New Window\nExec=AppRun --new-window\n"
+	g.Expect(validateDesktopEntry("app.desktop", valid, "app")).To(Succeed())
+
+	err := validateDesktopEntry("app.desktop", "[Desktop Entry]\nName=App\nExec=AppRun\nType=Application\nIcon=app.png\nTerminal=no\nCategories=Development;Foo\nCustom=1\nActions=quit;\n", "app")
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(Equal(`invalid app.desktop:
+  app.desktop:5: Icon "app.png" doesn't match AppImage icon name "app" (icon name without extension and path is expected)
+  app.desktop:6: value of Terminal must be true or false, but "no" is set
+  app.desktop:7: value of Categories must end with semicolon
+  app.desktop:7: unknown category Foo (custom categories must start with X-)
+  app.desktop:8: unknown key Custom (custom keys must start with X-)
+  app.desktop:9: action quit is declared, but group [Desktop Action quit] is missing`))
+
+	err = validateDesktopEntry("app.desktop", "# comment\n[Desktop Entry]\nType=Link\nName=App\nName=Other\nCategories=IDE;\n", "app")
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(Equal(`invalid app.desktop:
+  app.desktop:2: required key Exec is missing
+  app.desktop:2: required key Icon is missing
+  app.desktop:3: Type must be Application, but Link is set
+  app.desktop:5: key Name is duplicated in group [Desktop Entry]
+  app.desktop:6: at least one main category is required (AudioVideo, Audio, Video, Development, Education, Game, Graphics, Network, Office, Science, Settings, System, Utility), otherwise app is shown in the "Other" menu or not shown at all`))
+
+	err = validateDesktopEntry("app.desktop", "Name=App\n", "app")
+	g.Expect(err).To(MatchError(ContainSubstring("app.desktop:1: key-value pair is outside of group")))
+}
+
+func TestValidateMetainfo(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	valid := `<?xml version="1.0" encoding="UTF-8"?>
+<component type="desktop-application">
+  <id>com.example.App</id>
+  <metadata_license>MIT</metadata_license>
+  <project_license>MIT</project_license>
+  <name>App</name>
+  <name xml:lang="de">Anwendung</name>
+  <summary>Test app</summary>
+  <description><p>Test</p></description>
+  <launchable type="desktop-id">app.desktop</launchable>
+  <icon type="stock">app</icon>
+</component>
+`
+	g.Expect(validateMetainfoData("usr/share/metainfo/app.appdata.xml", []byte(valid), "app.desktop", "app")).To(Succeed())
+
+	err := validateMetainfoData("app.appdata.xml", []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<component type="desktop-application">
+  <id>com.example App</id>
+  <metadata_license>GPL-3.0</metadata_license>
+  <name>App</name>
+  <launchable type="desktop-id">other.desktop</launchable>
+</component>
+`), "app.desktop", "app")
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(Equal(`invalid app.appdata.xml:
+  app.appdata.xml:2: required element <summary> is missing
+  app.appdata.xml:3: id "com.example App" contains invalid characters (reverse-DNS name is expected, e.g. com.example.App)
+  app.appdata.xml:4: metadata_license "GPL-3.0" is not a permissive license (e.g. MIT, FSFAP or CC0-1.0)
+  app.appdata.xml:6: launchable "other.desktop" doesn't match desktop file name "app.desktop"`))
+
+	err = validateMetainfoData("app.appdata.xml", []byte("<component>\n  <id>app</id>\n</componen>\n"), "app.desktop", "app")
+	g.Expect(err).To(MatchError(ContainSubstring("app.appdata.xml:3: XML syntax error")))
+}
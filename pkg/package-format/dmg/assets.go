@@ -0,0 +1,260 @@
+package dmg
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/icons"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+type AssetsRequest struct {
+	// optional, background color is used if not specified
+	Template        string
+	Width           int
+	Height          int
+	BackgroundColor string
+
+	// app name, not rendered if empty
+	Title     string
+	TextColor string
+	FontSize  float64
+	// TTF or OTF file, Go Bold is used if not specified
+	Font string
+	// baseline of title in points from the top, by default text is placed at 1/6 of height
+	TextY int
+
+	VolumeIcon string
+	OutputDir  string
+}
+
+type AssetsResult struct {
+	Background string `json:"background"`
+	// in points (size of 1x page), use to set window size
+	BackgroundWidth  int    `json:"backgroundWidth"`
+	BackgroundHeight int    `json:"backgroundHeight"`
+	VolumeIcon       string `json:"volumeIcon,omitempty"`
+}
+
+func configureAssetsCommand(dmgCommand *kingpin.CmdClause) {
+	command := dmgCommand.Command("assets", "create retina background and volume icon for dmg")
+
+	request := &AssetsRequest{}
+	command.Flag("template", "background image, scaled to the background size").ExistingFileVar(&request.Template)
+	command.Flag("width", "background width in points").Default("540").IntVar(&request.Width)
+	command.Flag("height", "background height in points").Default("380").IntVar(&request.Height)
+	command.Flag("background-color", "background color if template is not specified").Default("#ffffff").StringVar(&request.BackgroundColor)
+	command.Flag("title", "text (app name) to render on the background").StringVar(&request.Title)
+	command.Flag("text-color", "").Default("#000000").StringVar(&request.TextColor)
+	command.Flag("font-size", "font size in points").Default("24").Float64Var(&request.FontSize)
+	command.Flag("font", "TTF or OTF font file").ExistingFileVar(&request.Font)
+	command.Flag("text-y", "baseline of title in points from the top").Default("0").IntVar(&request.TextY)
+	command.Flag("volume-icon", "PNG, ICNS or directory with icons to create volume icon from").StringVar(&request.VolumeIcon)
+	command.Flag("out", "output directory").Required().StringVar(&request.OutputDir)
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		result, err := CreateAssets(request)
+		if err != nil {
+			return err
+		}
+		return util.WriteJsonToStdOut(result)
+	})
+}
+
+func CreateAssets(request *AssetsRequest) (*AssetsResult, error) {
+	if request.Width <= 0 || request.Height <= 0 {
+		return nil, util.NewMessageError("background size must be positive, but "+strconv.Itoa(request.Width)+"x"+strconv.Itoa(request.Height), "ERR_DMG_INVALID_BACKGROUND_SIZE")
+	}
+
+	err := fsutil.EnsureDir(request.OutputDir)
+	if err != nil {
+		return nil, err
+	}
+
+	pages, err := renderBackgroundPages(request)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &AssetsResult{
+		Background:       filepath.Join(request.OutputDir, "background.tiff"),
+		BackgroundWidth:  request.Width,
+		BackgroundHeight: request.Height,
+	}
+
+	err = writeTiff(result.Background, pages)
+	if err != nil {
+		return nil, err
+	}
+
+	if request.VolumeIcon != "" {
+		result.VolumeIcon, err = createVolumeIcon(request.VolumeIcon, request.OutputDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func writeTiff(file string, pages []TiffPage) error {
+	outFile, err := os.Create(file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = EncodeMultiPageTiff(outFile, pages)
+	return fsutil.CloseAndCheckError(err, outFile)
+}
+
+func renderBackgroundPages(request *AssetsRequest) ([]TiffPage, error) {
+	backgroundColor, err := parseHexColor(request.BackgroundColor)
+	if err != nil {
+		return nil, err
+	}
+	textColor, err := parseHexColor(request.TextColor)
+	if err != nil {
+		return nil, err
+	}
+
+	var template image.Image
+	if request.Template != "" {
+		template, err = icons.LoadImage(request.Template)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var fontData *opentype.Font
+	if request.Title != "" {
+		fontData, err = loadFont(request.Font)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var pages []TiffPage
+	for _, scale := range []int{1, 2} {
+		width := request.Width * scale
+		height := request.Height * scale
+
+		page := image.NewNRGBA(image.Rect(0, 0, width, height))
+		draw.Draw(page, page.Bounds(), image.NewUniform(backgroundColor), image.Point{}, draw.Src)
+		if template != nil {
+			// template is drawn over background color - transparent areas are filled
+			draw.Draw(page, page.Bounds(), imaging.Resize(template, width, height, imaging.Lanczos), image.Point{}, draw.Over)
+		}
+
+		if fontData != nil {
+			err = drawTitle(page, request, fontData, textColor, scale)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		pages = append(pages, TiffPage{Image: page, Dpi: uint32(72 * scale)})
+	}
+	return pages, nil
+}
+
+func loadFont(file string) (*opentype.Font, error) {
+	data := gobold.TTF
+	if file != "" {
+		var err error
+		data, err = ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	result, err := opentype.Parse(data)
+	if err != nil {
+		return nil, util.NewMessageError("cannot parse font "+file+": "+err.Error(), "ERR_DMG_INVALID_FONT")
+	}
+	return result, nil
+}
+
+// font size is specified in points, so, on the 2x page text is rendered using 144 DPI and glyphs are not scaled bitmaps of 1x page
+func drawTitle(page *image.NRGBA, request *AssetsRequest, fontData *opentype.Font, textColor color.Color, scale int) error {
+	face, err := opentype.NewFace(fontData, &opentype.FaceOptions{
+		Size:    request.FontSize,
+		DPI:     float64(72 * scale),
+		Hinting: font.HintingFull,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer face.Close()
+
+	textY := request.TextY
+	if textY <= 0 {
+		textY = request.Height / 6
+	}
+
+	drawer := &font.Drawer{
+		Dst:  page,
+		Src:  image.NewUniform(textColor),
+		Face: face,
+	}
+	textWidth := drawer.MeasureString(request.Title)
+	drawer.Dot = fixed.Point26_6{
+		X: (fixed.I(page.Bounds().Dx()) - textWidth) / 2,
+		Y: fixed.I(textY * scale),
+	}
+	drawer.DrawString(request.Title)
+	return nil
+}
+
+func createVolumeIcon(source string, outDir string) (string, error) {
+	if strings.HasSuffix(strings.ToLower(source), ".icns") {
+		return source, nil
+	}
+
+	sources := []string{source}
+	var roots []string
+	var fallbackSources []string
+	result, err := icons.ConvertIcon(&icons.IconConvertRequest{
+		Sources:         &sources,
+		FallbackSources: &fallbackSources,
+		Roots:           &roots,
+		OutputFormat:    "icns",
+		OutputDir:       outDir,
+	})
+	if err != nil {
+		return "", err
+	}
+	if result == nil || len(result.Icons) == 0 {
+		return "", util.NewMessageError("cannot find volume icon in "+source, "ERR_DMG_VOLUME_ICON_NOT_FOUND")
+	}
+	return result.Icons[0].File, nil
+}
+
+// #rgb, #rrggbb or #rrggbbaa
+func parseHexColor(value string) (color.NRGBA, error) {
+	hex := strings.TrimPrefix(value, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+
+	parsed, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil || len(hex) != 8 {
+		return color.NRGBA{}, util.NewMessageError("invalid color "+value+", expected #rrggbb", "ERR_DMG_INVALID_COLOR")
+	}
+	return color.NRGBA{R: uint8(parsed >> 24), G: uint8(parsed >> 16), B: uint8(parsed >> 8), A: uint8(parsed)}, nil
+}
@@ -0,0 +1,59 @@
+package dmg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+	"golang.org/x/image/tiff"
+)
+
+func TestCreateAssets(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	log.InitLogger()
+
+	tempDir, err := ioutil.TempDir("", "dmg-assets")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer func() {
+		_ = os.RemoveAll(tempDir)
+	}()
+
+	result, err := CreateAssets(&AssetsRequest{
+		Width:           100,
+		Height:          60,
+		BackgroundColor: "#336699",
+		Title:           "Test",
+		TextColor:       "#fff",
+		FontSize:        12,
+		OutputDir:       tempDir,
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.Background).To(Equal(filepath.Join(tempDir, "background.tiff")))
+	g.Expect(result.BackgroundWidth).To(Equal(100))
+
+	data, err := ioutil.ReadFile(result.Background)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// decoder reads only the first page
+	firstPage, err := tiff.Decode(bytes.NewReader(data))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(firstPage.Bounds().Dx()).To(Equal(100))
+	g.Expect(firstPage.Bounds().Dy()).To(Equal(60))
+	r, _, b, a := firstPage.At(0, 0).RGBA()
+	g.Expect([]uint32{r >> 8, b >> 8, a >> 8}).To(Equal([]uint32{0x33, 0x99, 0xff}))
+
+	// second page is 2x
+	firstIfd := binary.LittleEndian.Uint32(data[4:])
+	entryCount := uint32(binary.LittleEndian.Uint16(data[firstIfd:]))
+	secondIfd := binary.LittleEndian.Uint32(data[firstIfd+2+entryCount*12:])
+	g.Expect(secondIfd).NotTo(BeZero())
+	// first entry is image width
+	g.Expect(binary.LittleEndian.Uint16(data[secondIfd+2:])).To(Equal(uint16(tiffTagImageWidth)))
+	g.Expect(binary.LittleEndian.Uint32(data[secondIfd+2+8:])).To(Equal(uint32(200)))
+}
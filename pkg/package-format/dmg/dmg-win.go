@@ -5,4 +5,8 @@ package dmg
 import "github.com/alecthomas/kingpin"
 
 func ConfigureCommand(app *kingpin.Application) {
+	// dmg cannot be built on Windows using hdiutil, but assets can be prepared and experimental portable mode can be used
+	dmgCommand := app.Command("dmg", "Build dmg.")
+	configureAssetsCommand(dmgCommand)
+	configurePortableCommand(dmgCommand)
 }
\ No newline at end of file
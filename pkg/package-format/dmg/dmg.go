@@ -22,7 +22,13 @@ import (
 )
 
 func ConfigureCommand(app *kingpin.Application) {
-	command := app.Command("dmg", "Build dmg.")
+	dmgCommand := app.Command("dmg", "Build dmg.")
+	configureAssetsCommand(dmgCommand)
+	configureHdiutilCommands(dmgCommand)
+	configurePortableCommand(dmgCommand)
+
+	// default subcommand to keep `dmg --volume` working
+	command := dmgCommand.Command("build", "Build dmg.").Default()
 
 	volumePath := command.Flag("volume", "").Required().String()
 	icon := command.Flag("icon", "").String()
@@ -1,9 +1,17 @@
 package dmg
 
 import (
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
 	. "github.com/onsi/gomega"
 )
 
@@ -17,3 +25,83 @@ func TestSize(t *testing.T) {
 	g.Expect(w).To(Equal(1316))
 	g.Expect(h).To(Equal(894))
 }
+
+func TestParseAttachOutput(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	result := parseAttachOutput("/dev/disk4          \tGUID_partition_scheme          \t\n/dev/disk4s1        \tApple_HFS                      \t/Volumes/My App 1.0.0\n")
+	g.Expect(result).To(Equal(&AttachResult{Device: "/dev/disk4s1", MountPoint: "/Volumes/My App 1.0.0"}))
+
+	g.Expect(parseAttachOutput("/dev/disk4\tGUID_partition_scheme\t\n")).To(BeNil())
+}
+
+func TestHdiutilRetry(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	var calls [][]string
+	var delays []time.Duration
+	busyCount := 0
+	originalExecuteHdiutil := executeHdiutil
+	executeHdiutil = func(args []string) ([]byte, error) {
+		calls = append(calls, args)
+		if args[0] == "detach" && len(args) == 2 || args[0] == "attach" && busyCount < 2 {
+			busyCount++
+			return nil, &util.ExecError{Cause: errors.New("exit status 16"), ErrorOutput: []byte("hdiutil: detach failed - Resource busy")}
+		}
+		if args[0] == "attach" {
+			return []byte("/dev/disk4s1\tApple_HFS\t/Volumes/App\n"), nil
+		}
+		return nil, nil
+	}
+	sleep = func(delay time.Duration) {
+		delays = append(delays, delay)
+	}
+	defer func() {
+		executeHdiutil = originalExecuteHdiutil
+		sleep = time.Sleep
+	}()
+
+	result, err := Attach("app.dmg")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.MountPoint).To(Equal("/Volumes/App"))
+	g.Expect(calls).To(HaveLen(3))
+	g.Expect(delays).To(Equal([]time.Duration{1 * time.Second, 2 * time.Second}))
+
+	calls = nil
+	delays = nil
+	g.Expect(Detach("/Volumes/App")).To(Succeed())
+	g.Expect(delays).To(HaveLen(len(hdiutilRetryDelays)))
+	g.Expect(calls[len(calls)-1]).To(Equal([]string{"detach", "-force", "/Volumes/App"}))
+}
+
+func TestConvert(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "dmg")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	output := filepath.Join(dir, "app.dmg")
+	var calls [][]string
+	originalExecuteHdiutil := executeHdiutil
+	executeHdiutil = func(args []string) ([]byte, error) {
+		calls = append(calls, args)
+		if args[0] == "convert" {
+			return nil, ioutil.WriteFile(args[len(args)-1], []byte("dmg"), 0644)
+		}
+		return nil, nil
+	}
+	defer func() {
+		executeHdiutil = originalExecuteHdiutil
+	}()
+
+	result, err := Convert(filepath.Join(dir, "rw.dmg"), "ULMO", 9, output)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(calls).To(Equal([][]string{
+		{"convert", filepath.Join(dir, "rw.dmg"), "-ov", "-format", "ULMO", "-o", output},
+		{"verify", output},
+	}))
+	hash := sha512.Sum512([]byte("dmg"))
+	g.Expect(result).To(Equal(&ImageInfo{File: output, Size: 3, Sha512: base64.StdEncoding.EncodeToString(hash[:])}))
+}
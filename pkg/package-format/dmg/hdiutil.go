@@ -0,0 +1,165 @@
+// +build !windows
+
+package dmg
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"go.uber.org/zap"
+)
+
+// hdiutil fails with "Resource busy" if volume is still used by some detached process (Finder, Spotlight, antivirus) - retried with backoff
+var hdiutilRetryDelays = []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second}
+
+// replaced in tests
+var executeHdiutil = func(args []string) ([]byte, error) {
+	return util.Execute(exec.Command("hdiutil", args...))
+}
+var sleep = time.Sleep
+
+type AttachResult struct {
+	Device     string `json:"device"`
+	MountPoint string `json:"mountPoint"`
+}
+
+func configureHdiutilCommands(dmgCommand *kingpin.CmdClause) {
+	createCommand := dmgCommand.Command("create", "Create writable (UDRW) image from the folder.")
+	srcFolder := createCommand.Flag("src-folder", "").Required().ExistingDir()
+	volumeName := createCommand.Flag("volume-name", "").Required().String()
+	fileSystem := createCommand.Flag("filesystem", "APFS requires macOS 10.13+ to mount.").Default("HFS+").Enum("HFS+", "APFS")
+	size := createCommand.Flag("size", "The image size (e.g. 300m), computed by hdiutil if not specified.").String()
+	createOutput := createCommand.Flag("output", "").Short('o').Required().String()
+	createCommand.Action(func(context *kingpin.ParseContext) error {
+		return CreateImage(*srcFolder, *volumeName, *fileSystem, *size, *createOutput)
+	})
+
+	attachCommand := dmgCommand.Command("attach", "Attach image (read-write, not opened in Finder).")
+	attachFile := attachCommand.Flag("file", "").Required().ExistingFile()
+	attachCommand.Action(func(context *kingpin.ParseContext) error {
+		result, err := Attach(*attachFile)
+		if err != nil {
+			return err
+		}
+		return util.WriteJsonToStdOut(result)
+	})
+
+	detachCommand := dmgCommand.Command("detach", "Detach image, forced if volume is still busy after retries.")
+	mountPoint := detachCommand.Flag("mount-point", "The mount point or device.").Required().String()
+	detachCommand.Action(func(context *kingpin.ParseContext) error {
+		return Detach(*mountPoint)
+	})
+
+	convertCommand := dmgCommand.Command("convert", "Convert image to the final compressed format, verify it and print size and checksum as JSON.")
+	input := convertCommand.Flag("input", "").Required().ExistingFile()
+	format := convertCommand.Flag("format", "UDZO (zlib), UDBZ (bzip2), ULFO (lzfse, macOS 10.11+) or ULMO (lzma, macOS 10.15+).").Default("UDZO").Enum("UDZO", "UDBZ", "ULFO", "ULMO")
+	level := convertCommand.Flag("level", "zlib level for UDZO (1-9).").Default("9").Int()
+	convertOutput := convertCommand.Flag("output", "").Short('o').Required().String()
+	convertCommand.Action(func(context *kingpin.ParseContext) error {
+		result, err := Convert(*input, *format, *level, *convertOutput)
+		if err != nil {
+			return err
+		}
+		return util.WriteJsonToStdOut(result)
+	})
+}
+
+func CreateImage(srcFolder string, volumeName string, fileSystem string, size string, output string) error {
+	args := []string{"create", "-ov", "-srcfolder", srcFolder, "-volname", volumeName, "-fs", fileSystem, "-format", "UDRW", "-anyowners", "-nospotlight"}
+	if size != "" {
+		args = append(args, "-size", size)
+	}
+	_, err := executeHdiutilWithRetry(append(args, output))
+	return err
+}
+
+func Attach(file string) (*AttachResult, error) {
+	output, err := executeHdiutilWithRetry([]string{"attach", "-readwrite", "-noverify", "-noautoopen", file})
+	if err != nil {
+		return nil, err
+	}
+
+	result := parseAttachOutput(string(output))
+	if result == nil {
+		return nil, errors.Errorf("cannot find mount point in hdiutil output: %s", output)
+	}
+	return result, nil
+}
+
+// "/dev/disk4s1 <tab> Apple_HFS <tab> /Volumes/App" - mount point is the last column of the line with it
+func parseAttachOutput(output string) *AttachResult {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 3 {
+			continue
+		}
+
+		mountPoint := strings.TrimSpace(fields[len(fields)-1])
+		if strings.HasPrefix(mountPoint, "/") {
+			return &AttachResult{Device: strings.TrimSpace(fields[0]), MountPoint: mountPoint}
+		}
+	}
+	return nil
+}
+
+func Detach(mountPoint string) error {
+	_, err := executeHdiutilWithRetry([]string{"detach", mountPoint})
+	if err == nil || !isResourceBusy(err) {
+		return err
+	}
+
+	log.Warn("volume is still busy, detaching forcibly", zap.String("mountPoint", mountPoint))
+	_, err = executeHdiutil([]string{"detach", "-force", mountPoint})
+	return err
+}
+
+func Convert(input string, format string, level int, output string) (*ImageInfo, error) {
+	args := []string{"convert", input, "-ov", "-format", format}
+	if format == "UDZO" {
+		args = append(args, "-imagekey", "zlib-level="+strconv.Itoa(level))
+	}
+	_, err := executeHdiutilWithRetry(append(args, "-o", output))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = executeHdiutilWithRetry([]string{"verify", output})
+	if err != nil {
+		return nil, err
+	}
+	return computeImageInfo(output)
+}
+
+func executeHdiutilWithRetry(args []string) ([]byte, error) {
+	attempt := 0
+	for {
+		output, err := executeHdiutil(args)
+		if err == nil || !isResourceBusy(err) || attempt >= len(hdiutilRetryDelays) {
+			return output, err
+		}
+
+		delay := hdiutilRetryDelays[attempt]
+		log.Warn("hdiutil: resource busy, retrying", zap.String("command", args[0]), zap.Int("attempt", attempt+1), zap.Duration("delay", delay))
+		sleep(delay)
+		attempt++
+	}
+}
+
+// hdiutil exits with 16 (EBUSY) and prints "Resource busy" (e.g. "hdiutil: detach failed - Resource busy")
+func isResourceBusy(err error) bool {
+	execError, ok := err.(*util.ExecError)
+	if !ok {
+		return false
+	}
+
+	if exitError, ok := execError.Cause.(*exec.ExitError); ok && exitError.ExitCode() == 16 {
+		return true
+	}
+	return strings.Contains(string(execError.ErrorOutput), "Resource busy") || strings.Contains(string(execError.Output), "Resource busy")
+}
@@ -0,0 +1,142 @@
+package hfsplus
+
+import (
+	"encoding/binary"
+)
+
+type btreeRecord struct {
+	// including key length
+	key  []byte
+	data []byte
+}
+
+type btreeSpec struct {
+	nodeSize       int
+	maxKeyLength   uint16
+	attributes     uint32
+	keyCompareType uint8
+}
+
+type treeLevel struct {
+	firstKeys [][]byte
+	nodes     []uint32
+}
+
+// buildBTree writes the whole tree at once: header node, leaf nodes and then index nodes level by level up to the root.
+// Records must be sorted. Nodes of every level are linked, node 0 map record marks all nodes as used (tree is not expected to grow).
+func buildBTree(records []btreeRecord, spec btreeSpec) []byte {
+	var nodes [][]byte
+	header := btreeHeader{
+		NodeSize:     uint16(spec.nodeSize),
+		MaxKeyLength: spec.maxKeyLength,
+		Attributes:   spec.attributes,
+		// kHFSBinaryCompare for HFSX, ignored for HFS+ (case-insensitive compare is always used)
+		KeyCompareType: spec.keyCompareType,
+		LeafRecords:    uint32(len(records)),
+	}
+
+	if len(records) != 0 {
+		leafRecords := make([][]byte, len(records))
+		for i, record := range records {
+			leafRecords[i] = append(append([]byte{}, record.key...), record.data...)
+		}
+
+		level := writeLevel(&nodes, packRecords(leafRecords, spec.nodeSize), records, leafNodeKind, 1, spec.nodeSize)
+		header.FirstLeafNode = level.nodes[0]
+		header.LastLeafNode = level.nodes[len(level.nodes)-1]
+		header.TreeDepth = 1
+
+		for len(level.nodes) > 1 {
+			indexRecords := make([][]byte, len(level.nodes))
+			keys := make([]btreeRecord, len(level.nodes))
+			for i, node := range level.nodes {
+				pointer := make([]byte, 4)
+				binary.BigEndian.PutUint32(pointer, node)
+				indexRecords[i] = append(append([]byte{}, level.firstKeys[i]...), pointer...)
+				keys[i] = btreeRecord{key: level.firstKeys[i]}
+			}
+			header.TreeDepth++
+			level = writeLevel(&nodes, packRecords(indexRecords, spec.nodeSize), keys, indexNodeKind, uint8(header.TreeDepth), spec.nodeSize)
+		}
+		header.RootNode = level.nodes[0]
+	}
+
+	totalNodes := len(nodes) + 1
+	header.TotalNodes = uint32(totalNodes)
+	header.ClumpSize = uint32(totalNodes * spec.nodeSize)
+
+	result := make([]byte, 0, totalNodes*spec.nodeSize)
+	result = append(result, createHeaderNode(header, totalNodes, spec.nodeSize)...)
+	for _, node := range nodes {
+		result = append(result, node...)
+	}
+	return result
+}
+
+// packRecords splits records into groups fitting into node (descriptor, records and offsets including free space offset)
+func packRecords(records [][]byte, nodeSize int) [][][]byte {
+	var result [][][]byte
+	var current [][]byte
+	used := nodeDescriptorSize + 2
+	for _, record := range records {
+		size := len(record) + 2
+		if used+size > nodeSize && len(current) != 0 {
+			result = append(result, current)
+			current = nil
+			used = nodeDescriptorSize + 2
+		}
+		current = append(current, record)
+		used += size
+	}
+	return append(result, current)
+}
+
+func writeLevel(nodes *[][]byte, groups [][][]byte, records []btreeRecord, kind int8, height uint8, nodeSize int) *treeLevel {
+	level := &treeLevel{}
+	// node 0 is the header node
+	firstNode := uint32(len(*nodes) + 1)
+	recordIndex := 0
+	for i, group := range groups {
+		descriptor := nodeDescriptor{Kind: kind, Height: height, NumRecords: uint16(len(group))}
+		if i > 0 {
+			descriptor.BLink = firstNode + uint32(i) - 1
+		}
+		if i < len(groups)-1 {
+			descriptor.FLink = firstNode + uint32(i) + 1
+		}
+
+		*nodes = append(*nodes, createNode(descriptor, group, nodeSize))
+		level.nodes = append(level.nodes, firstNode+uint32(i))
+		level.firstKeys = append(level.firstKeys, records[recordIndex].key)
+		recordIndex += len(group)
+	}
+	return level
+}
+
+// record offsets are stored at the end of node in reverse order, the last one points to the free space
+func createNode(descriptor nodeDescriptor, records [][]byte, nodeSize int) []byte {
+	node := make([]byte, nodeSize)
+	copy(node, encode(descriptor))
+	offset := nodeDescriptorSize
+	for i, record := range records {
+		binary.BigEndian.PutUint16(node[nodeSize-2*(i+1):], uint16(offset))
+		copy(node[offset:], record)
+		offset += len(record)
+	}
+	binary.BigEndian.PutUint16(node[nodeSize-2*(len(records)+1):], uint16(offset))
+	return node
+}
+
+// header node: header record, user data record and map record (bitmap of used nodes)
+func createHeaderNode(header btreeHeader, usedNodes int, nodeSize int) []byte {
+	mapRecord := make([]byte, nodeSize-nodeDescriptorSize-headerRecordSize-userDataRecordSize-2*4)
+	for i := 0; i < usedNodes; i++ {
+		mapRecord[i/8] |= 0x80 >> uint(i%8)
+	}
+	return createNode(nodeDescriptor{Kind: headerNodeKind, NumRecords: 3}, [][]byte{encode(header), make([]byte, userDataRecordSize), mapRecord}, nodeSize)
+}
+
+// maximum number of nodes that can be described by the header node map record (map nodes are not supported)
+func maxNodeCount(nodeSize int) int {
+	return (nodeSize - nodeDescriptorSize - headerRecordSize - userDataRecordSize - 2*4) * 8
+}
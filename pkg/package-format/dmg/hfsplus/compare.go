@@ -0,0 +1,64 @@
+package hfsplus
+
+import (
+	"unicode"
+)
+
+func compareCatalogKeys(a *catalogRecord, b *catalogRecord) int {
+	if a.parentId != b.parentId {
+		if a.parentId < b.parentId {
+			return -1
+		}
+		return 1
+	}
+	return compareNames(a.name, b.name)
+}
+
+// compareNames compares names in the same way as HFS+ FastUnicodeCompare does - case-insensitive, ignorable characters are skipped.
+// Lower case mapping of the Unicode database is used instead of the Apple table, it is the same for Latin, Greek and Cyrillic letters.
+func compareNames(a []uint16, b []uint16) int {
+	i := 0
+	j := 0
+	for {
+		var c1, c2 uint16
+		for c1 == 0 && i < len(a) {
+			c1 = foldChar(a[i])
+			i++
+		}
+		for c2 == 0 && j < len(b) {
+			c2 = foldChar(b[j])
+			j++
+		}
+
+		if c1 != c2 {
+			return int(c1) - int(c2)
+		}
+		if c1 == 0 {
+			return 0
+		}
+	}
+}
+
+// 0 for ignorable characters
+func foldChar(c uint16) uint16 {
+	switch {
+	case c == 0:
+		// null sorts after everything else
+		return 0xFFFF
+	case c >= 'A' && c <= 'Z':
+		return c + ('a' - 'A')
+	case c < 0x80:
+		return c
+	case c >= 0x200C && c <= 0x200F, c >= 0x202A && c <= 0x202E, c >= 0x206A && c <= 0x206F, c == 0xFEFF:
+		return 0
+	case c >= 0xD800 && c <= 0xDFFF:
+		// surrogates are compared as is
+		return c
+	}
+
+	lower := unicode.ToLower(rune(c))
+	if lower > 0xFFFF {
+		return c
+	}
+	return uint16(lower)
+}
@@ -0,0 +1,221 @@
+package hfsplus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+// on-disk structures (Technical Note TN1150), big-endian
+
+const (
+	blockSize       = 4096
+	catalogNodeSize = 8192
+	extentsNodeSize = 4096
+	sectorSize      = 512
+
+	signatureHfsPlus = 0x482B // H+
+	versionHfsPlus   = 4
+	// non-journaled volume last mounted by Mac OS X
+	lastMountedVersion = 0x31302E30 // 10.0
+
+	volumeUnmountedMask = 1 << 8
+
+	rootParentId           = 1
+	rootFolderId           = 2
+	extentsFileId          = 3
+	catalogFileId          = 4
+	firstUserCatalogNodeId = 16
+
+	folderRecordType       = 1
+	fileRecordType         = 2
+	folderThreadRecordType = 3
+	fileThreadRecordType   = 4
+
+	fileThreadExistsMask = 0x0002
+
+	leafNodeKind   = -1
+	indexNodeKind  = 0
+	headerNodeKind = 1
+
+	bigKeysMask           = 2
+	variableIndexKeysMask = 4
+
+	catalogKeyMaximumLength = 516
+	extentKeyMaximumLength  = 10
+
+	nodeDescriptorSize = 14
+	headerRecordSize   = 106
+	userDataRecordSize = 128
+
+	// Finder flags
+	hasCustomIconFlag = 0x0400
+	isInvisibleFlag   = 0x4000
+
+	// symbolic link is a file with special type and creator, target path is stored in data fork
+	symlinkFileType    = 0x736C6E6B // slnk
+	symlinkFileCreator = 0x72686170 // rhap
+
+	// unknown user and group, dmg volumes are mounted with ownership ignored
+	unknownOwnerId = 99
+
+	modeDirectory = 0040000
+	modeRegular   = 0100000
+	modeSymlink   = 0120000
+)
+
+var hfsEpoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type extentDescriptor struct {
+	StartBlock uint32
+	BlockCount uint32
+}
+
+type forkData struct {
+	LogicalSize uint64
+	ClumpSize   uint32
+	TotalBlocks uint32
+	Extents     [8]extentDescriptor
+}
+
+type volumeHeader struct {
+	Signature          uint16
+	Version            uint16
+	Attributes         uint32
+	LastMountedVersion uint32
+	JournalInfoBlock   uint32
+
+	CreateDate  uint32
+	ModifyDate  uint32
+	BackupDate  uint32
+	CheckedDate uint32
+
+	FileCount   uint32
+	FolderCount uint32
+
+	BlockSize   uint32
+	TotalBlocks uint32
+	FreeBlocks  uint32
+
+	NextAllocation uint32
+	RsrcClumpSize  uint32
+	DataClumpSize  uint32
+	NextCatalogId  uint32
+
+	WriteCount      uint32
+	EncodingsBitmap uint64
+
+	FinderInfo [8]uint32
+
+	AllocationFile forkData
+	ExtentsFile    forkData
+	CatalogFile    forkData
+	AttributesFile forkData
+	StartupFile    forkData
+}
+
+type bsdInfo struct {
+	OwnerId    uint32
+	GroupId    uint32
+	AdminFlags uint8
+	OwnerFlags uint8
+	FileMode   uint16
+	Special    uint32
+}
+
+type folderInfo struct {
+	WindowBounds  [4]int16
+	FinderFlags   uint16
+	Location      [2]int16
+	ReservedField uint16
+}
+
+type fileInfo struct {
+	FileType      uint32
+	FileCreator   uint32
+	FinderFlags   uint16
+	Location      [2]int16
+	ReservedField uint16
+}
+
+type catalogFolder struct {
+	RecordType       int16
+	Flags            uint16
+	Valence          uint32
+	FolderId         uint32
+	CreateDate       uint32
+	ContentModDate   uint32
+	AttributeModDate uint32
+	AccessDate       uint32
+	BackupDate       uint32
+	Permissions      bsdInfo
+	UserInfo         folderInfo
+	FinderInfo       [16]byte
+	TextEncoding     uint32
+	FolderCount      uint32
+}
+
+type catalogFile struct {
+	RecordType       int16
+	Flags            uint16
+	Reserved1        uint32
+	FileId           uint32
+	CreateDate       uint32
+	ContentModDate   uint32
+	AttributeModDate uint32
+	AccessDate       uint32
+	BackupDate       uint32
+	Permissions      bsdInfo
+	UserInfo         fileInfo
+	FinderInfo       [16]byte
+	TextEncoding     uint32
+	Reserved2        uint32
+	DataFork         forkData
+	ResourceFork     forkData
+}
+
+type nodeDescriptor struct {
+	FLink      uint32
+	BLink      uint32
+	Kind       int8
+	Height     uint8
+	NumRecords uint16
+	Reserved   uint16
+}
+
+type btreeHeader struct {
+	TreeDepth      uint16
+	RootNode       uint32
+	LeafRecords    uint32
+	FirstLeafNode  uint32
+	LastLeafNode   uint32
+	NodeSize       uint16
+	MaxKeyLength   uint16
+	TotalNodes     uint32
+	FreeNodes      uint32
+	Reserved1      uint16
+	ClumpSize      uint32
+	BtreeType      uint8
+	KeyCompareType uint8
+	Attributes     uint32
+	Reserved3      [16]uint32
+}
+
+func encode(value interface{}) []byte {
+	var buffer bytes.Buffer
+	// cannot fail for fixed-size structures
+	_ = binary.Write(&buffer, binary.BigEndian, value)
+	return buffer.Bytes()
+}
+
+// seconds since 1904-01-01 GMT
+func toHfsTime(t time.Time) uint32 {
+	seconds := t.Unix() - hfsEpoch.Unix()
+	if seconds < 0 {
+		return 0
+	}
+	if seconds > 0xFFFFFFFF {
+		return 0xFFFFFFFF
+	}
+	return uint32(seconds)
+}
@@ -0,0 +1,516 @@
+// Package hfsplus writes HFS+ volume from a folder without OS support (experimental, used to build dmg on Linux).
+// Volume is not journaled, all forks are contiguous (extents overflow file is empty) and catalog is written at once,
+// so, volume is expected to be used read-only (UDZO).
+package hfsplus
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"golang.org/x/text/unicode/norm"
+)
+
+const volumeIconName = ".VolumeIcon.icns"
+
+type Options struct {
+	VolumeName string
+	// copied to the volume as .VolumeIcon.icns and set as custom volume icon
+	Icon string
+	// if set, the image is reproducible: the time is used for all dates and volume UUID is derived from the catalog.
+	// Otherwise, the current time (file modification time for entries) and random UUID are used.
+	ModificationTime time.Time
+}
+
+type entry struct {
+	id       uint32
+	parentId uint32
+	name     []uint16
+	// for error messages
+	path string
+
+	isDir    bool
+	children []*entry
+
+	mode    os.FileMode
+	modTime time.Time
+	size    int64
+	// file content (not set for folders and symlinks)
+	source     string
+	linkTarget string
+
+	startBlock uint32
+	blockCount uint32
+
+	finderFlags uint16
+}
+
+type volume struct {
+	entries    []*entry
+	nextId     uint32
+	fileCount  uint32
+	dirCount   uint32
+	createTime time.Time
+	// all entries have createTime as modification time
+	isReproducible bool
+}
+
+// CreateVolume writes HFS+ volume with the content of sourceDir to the output file (raw image without partition map, as hdiutil -layout NONE).
+func CreateVolume(sourceDir string, output string, options Options) error {
+	v := &volume{nextId: firstUserCatalogNodeId, createTime: options.ModificationTime, isReproducible: !options.ModificationTime.IsZero()}
+	if !v.isReproducible {
+		v.createTime = time.Now()
+	}
+
+	volumeName, err := encodeName(options.VolumeName)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(sourceDir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	root := &entry{id: rootFolderId, parentId: rootParentId, name: volumeName, path: sourceDir, isDir: true, mode: info.Mode(), modTime: v.createTime}
+	v.entries = append(v.entries, root)
+	err = v.collect(root, sourceDir)
+	if err != nil {
+		return err
+	}
+
+	if options.Icon != "" {
+		err = v.setVolumeIcon(root, options.Icon)
+		if err != nil {
+			return err
+		}
+	} else if findChild(root, volumeIconName) != nil {
+		root.finderFlags |= hasCustomIconFlag
+	}
+
+	return v.write(output)
+}
+
+func (v *volume) collect(parent *entry, dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, file := range files {
+		name, err := encodeName(file.Name())
+		if err != nil {
+			return err
+		}
+
+		child := &entry{
+			id:       v.nextId,
+			parentId: parent.id,
+			name:     name,
+			path:     filepath.Join(dir, file.Name()),
+			mode:     file.Mode(),
+			modTime:  v.getModTime(file),
+		}
+		v.nextId++
+		parent.children = append(parent.children, child)
+		v.entries = append(v.entries, child)
+
+		switch {
+		case file.IsDir():
+			child.isDir = true
+			v.dirCount++
+			err = v.collect(child, child.path)
+			if err != nil {
+				return err
+			}
+
+		case file.Mode()&os.ModeSymlink != 0:
+			child.linkTarget, err = os.Readlink(child.path)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			child.size = int64(len(child.linkTarget))
+			v.fileCount++
+
+		case file.Mode().IsRegular():
+			child.source = child.path
+			child.size = file.Size()
+			v.fileCount++
+
+		default:
+			return errors.Errorf("%s: only regular files, directories and symbolic links are supported", child.path)
+		}
+	}
+	return nil
+}
+
+func (v *volume) setVolumeIcon(root *entry, icon string) error {
+	info, err := os.Stat(icon)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	iconEntry := findChild(root, volumeIconName)
+	if iconEntry == nil {
+		name, _ := encodeName(volumeIconName)
+		iconEntry = &entry{id: v.nextId, parentId: root.id, name: name}
+		v.nextId++
+		v.fileCount++
+		root.children = append(root.children, iconEntry)
+		v.entries = append(v.entries, iconEntry)
+	}
+
+	iconEntry.path = icon
+	iconEntry.source = icon
+	iconEntry.size = info.Size()
+	iconEntry.mode = 0644
+	iconEntry.modTime = v.getModTime(info)
+	iconEntry.finderFlags |= isInvisibleFlag
+	root.finderFlags |= hasCustomIconFlag
+	return nil
+}
+
+func findChild(parent *entry, name string) *entry {
+	encoded, _ := encodeName(name)
+	for _, child := range parent.children {
+		if compareNames(child.name, encoded) == 0 {
+			return child
+		}
+	}
+	return nil
+}
+
+// layout: boot blocks and volume header, allocation file, extents overflow file, catalog file, file data, free space and alternate volume header
+func (v *volume) write(output string) error {
+	// record sizes do not depend on extents, so, catalog is built to compute its size and rebuilt after layout
+	catalogRecords, err := v.createCatalogRecords()
+	if err != nil {
+		return err
+	}
+	catalogSize := len(buildBTree(catalogRecords, catalogBTreeSpec))
+	if catalogSize/catalogNodeSize > maxNodeCount(catalogNodeSize) {
+		return errors.Errorf("too many files (catalog node count %d exceeds %d)", catalogSize/catalogNodeSize, maxNodeCount(catalogNodeSize))
+	}
+
+	extentsTree := buildBTree(nil, extentsBTreeSpec)
+	catalogBlocks := uint32(catalogSize / blockSize)
+	extentsBlocks := uint32(len(extentsTree) / blockSize)
+
+	var dataBlocks uint32
+	for _, e := range v.entries {
+		e.blockCount = uint32((e.size + blockSize - 1) / blockSize)
+		dataBlocks += e.blockCount
+	}
+
+	usedBlocks := 1 + extentsBlocks + catalogBlocks + dataBlocks + 1
+	// some free space, not used for the read-only image but expected by tools (compressed to nothing)
+	freeBlocks := usedBlocks / 100
+	if freeBlocks < 256 {
+		freeBlocks = 256
+	}
+	// allocation file size depends on the total block count
+	var allocationBlocks uint32 = 1
+	var totalBlocks uint32
+	for {
+		totalBlocks = usedBlocks + allocationBlocks + freeBlocks
+		required := (totalBlocks/8 + blockSize - 1) / blockSize
+		if required <= allocationBlocks {
+			break
+		}
+		allocationBlocks = required
+	}
+
+	allocationStart := uint32(1)
+	extentsStart := allocationStart + allocationBlocks
+	catalogStart := extentsStart + extentsBlocks
+	nextBlock := catalogStart + catalogBlocks
+	for _, e := range v.entries {
+		if e.blockCount != 0 {
+			e.startBlock = nextBlock
+			nextBlock += e.blockCount
+		}
+	}
+
+	catalogRecords, err = v.createCatalogRecords()
+	if err != nil {
+		return err
+	}
+	catalogTree := buildBTree(catalogRecords, catalogBTreeSpec)
+
+	file, err := os.Create(output)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(file)
+
+	err = file.Truncate(int64(totalBlocks) * blockSize)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	header := volumeHeader{
+		Signature:          signatureHfsPlus,
+		Version:            versionHfsPlus,
+		Attributes:         volumeUnmountedMask,
+		LastMountedVersion: lastMountedVersion,
+		CreateDate:         toHfsTime(v.createTime),
+		ModifyDate:         toHfsTime(v.createTime),
+		CheckedDate:        toHfsTime(v.createTime),
+		FileCount:          v.fileCount,
+		FolderCount:        v.dirCount,
+		BlockSize:          blockSize,
+		TotalBlocks:        totalBlocks,
+		FreeBlocks:         totalBlocks - nextBlock - 1,
+		NextAllocation:     nextBlock,
+		RsrcClumpSize:      65536,
+		DataClumpSize:      65536,
+		NextCatalogId:      v.nextId,
+		WriteCount:         1,
+		// MacRoman
+		EncodingsBitmap: 1,
+		AllocationFile:  createForkData(allocationStart, allocationBlocks, int64(allocationBlocks)*blockSize),
+		ExtentsFile:     createForkData(extentsStart, extentsBlocks, int64(len(extentsTree))),
+		CatalogFile:     createForkData(catalogStart, catalogBlocks, int64(len(catalogTree))),
+	}
+	// open the root folder window on mount (bless --openfolder)
+	header.FinderInfo[2] = rootFolderId
+	// volume UUID
+	uuid := make([]byte, 8)
+	if v.isReproducible {
+		// catalog contains names, sizes and layout of all entries - different content of the same size doesn't change UUID, but it is not required to be unique
+		hash := sha256.Sum256(catalogTree)
+		copy(uuid, hash[:])
+	} else {
+		_, err = rand.Read(uuid)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	header.FinderInfo[6] = binary.BigEndian.Uint32(uuid)
+	header.FinderInfo[7] = binary.BigEndian.Uint32(uuid[4:])
+
+	headerData := encode(header)
+	for _, item := range []struct {
+		offset int64
+		data   []byte
+	}{
+		{1024, headerData},
+		{int64(allocationStart) * blockSize, createAllocationBitmap(nextBlock, totalBlocks)},
+		{int64(extentsStart) * blockSize, extentsTree},
+		{int64(catalogStart) * blockSize, catalogTree},
+		{int64(totalBlocks)*blockSize - 1024, headerData},
+	} {
+		_, err = file.WriteAt(item.data, item.offset)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	for _, e := range v.entries {
+		err = writeEntryData(file, e)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createForkData(startBlock uint32, blockCount uint32, size int64) forkData {
+	result := forkData{LogicalSize: uint64(size), ClumpSize: blockCount * blockSize, TotalBlocks: blockCount}
+	if blockCount != 0 {
+		result.Extents[0] = extentDescriptor{StartBlock: startBlock, BlockCount: blockCount}
+	}
+	return result
+}
+
+// blocks [0, usedBlocks) and the last block (alternate volume header) are allocated
+func createAllocationBitmap(usedBlocks uint32, totalBlocks uint32) []byte {
+	bitmap := make([]byte, (totalBlocks+7)/8)
+	setBit := func(block uint32) {
+		bitmap[block/8] |= 0x80 >> (block % 8)
+	}
+	for block := uint32(0); block < usedBlocks; block++ {
+		setBit(block)
+	}
+	setBit(totalBlocks - 1)
+	return bitmap
+}
+
+func writeEntryData(file *os.File, e *entry) error {
+	offset := int64(e.startBlock) * blockSize
+	switch {
+	case e.linkTarget != "":
+		_, err := file.WriteAt([]byte(e.linkTarget), offset)
+		return errors.WithStack(err)
+
+	case e.source != "" && e.size != 0:
+		reader, err := os.Open(e.source)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer util.Close(reader)
+
+		_, err = file.Seek(offset, io.SeekStart)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		n, err := io.Copy(file, reader)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if n != e.size {
+			return errors.Errorf("%s: file size changed during image creation", e.source)
+		}
+	}
+	return nil
+}
+
+// HFS+ stores names in UTF-16 decomposed form (NFD), ":" is not allowed (Carbon path separator) and stored as "/"
+func encodeName(name string) ([]uint16, error) {
+	result := utf16.Encode([]rune(strings.Replace(norm.NFD.String(name), ":", "/", -1)))
+	if len(result) > 255 {
+		return nil, errors.Errorf("name is too long (max 255 UTF-16 code units): %s", name)
+	}
+	return result, nil
+}
+
+var catalogBTreeSpec = btreeSpec{
+	nodeSize:     catalogNodeSize,
+	maxKeyLength: catalogKeyMaximumLength,
+	attributes:   bigKeysMask | variableIndexKeysMask,
+}
+
+var extentsBTreeSpec = btreeSpec{
+	nodeSize:     extentsNodeSize,
+	maxKeyLength: extentKeyMaximumLength,
+	attributes:   bigKeysMask,
+}
+
+type catalogRecord struct {
+	parentId uint32
+	name     []uint16
+	data     []byte
+	// for error messages
+	path string
+}
+
+// every file and folder has a record (keyed by parent and name) and a thread record (keyed by own id and empty name)
+func (v *volume) createCatalogRecords() ([]btreeRecord, error) {
+	records := make([]*catalogRecord, 0, len(v.entries)*2)
+	for _, e := range v.entries {
+		var data []byte
+		var threadType int16
+		if e.isDir {
+			data = encode(createCatalogFolder(e))
+			threadType = folderThreadRecordType
+		} else {
+			data = encode(createCatalogFile(e))
+			threadType = fileThreadRecordType
+		}
+		records = append(records, &catalogRecord{parentId: e.parentId, name: e.name, data: data, path: e.path})
+
+		thread := make([]byte, 8, 8+2+2*len(e.name))
+		binary.BigEndian.PutUint16(thread, uint16(threadType))
+		binary.BigEndian.PutUint32(thread[4:], e.parentId)
+		records = append(records, &catalogRecord{parentId: e.id, data: append(thread, encodeUniStr(e.name)...)})
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return compareCatalogKeys(records[i], records[j]) < 0
+	})
+
+	result := make([]btreeRecord, len(records))
+	for i, record := range records {
+		if i > 0 && compareCatalogKeys(records[i-1], record) == 0 {
+			return nil, util.NewMessageError("file names differ only in case or Unicode normalization, but HFS+ volume is case-insensitive: "+records[i-1].path+", "+record.path, "ERR_DMG_NAME_CONFLICT")
+		}
+
+		name := encodeUniStr(record.name)
+		key := make([]byte, 6, 6+len(name))
+		binary.BigEndian.PutUint16(key, uint16(4+len(name)))
+		binary.BigEndian.PutUint32(key[2:], record.parentId)
+		result[i] = btreeRecord{key: append(key, name...), data: record.data}
+	}
+	return result, nil
+}
+
+func encodeUniStr(name []uint16) []byte {
+	result := make([]byte, 2+2*len(name))
+	binary.BigEndian.PutUint16(result, uint16(len(name)))
+	for i, c := range name {
+		binary.BigEndian.PutUint16(result[2+2*i:], c)
+	}
+	return result
+}
+
+func createBsdInfo(e *entry, fileType uint16) bsdInfo {
+	permissions := uint16(e.mode.Perm())
+	if e.mode&os.ModeSetuid != 0 {
+		permissions |= 04000
+	}
+	if e.mode&os.ModeSetgid != 0 {
+		permissions |= 02000
+	}
+	return bsdInfo{OwnerId: unknownOwnerId, GroupId: unknownOwnerId, FileMode: fileType | permissions}
+}
+
+func createCatalogFolder(e *entry) catalogFolder {
+	date := toHfsTime(e.modTime)
+	permissions := createBsdInfo(e, modeDirectory)
+	if e.mode.Perm() == 0 {
+		permissions.FileMode |= 0755
+	}
+	return catalogFolder{
+		RecordType:       folderRecordType,
+		Valence:          uint32(len(e.children)),
+		FolderId:         e.id,
+		CreateDate:       date,
+		ContentModDate:   date,
+		AttributeModDate: date,
+		AccessDate:       date,
+		Permissions:      permissions,
+		UserInfo:         folderInfo{FinderFlags: e.finderFlags},
+	}
+}
+
+func createCatalogFile(e *entry) catalogFile {
+	date := toHfsTime(e.modTime)
+	result := catalogFile{
+		RecordType:       fileRecordType,
+		Flags:            fileThreadExistsMask,
+		FileId:           e.id,
+		CreateDate:       date,
+		ContentModDate:   date,
+		AttributeModDate: date,
+		AccessDate:       date,
+		UserInfo:         fileInfo{FinderFlags: e.finderFlags},
+		DataFork:         createForkData(e.startBlock, e.blockCount, e.size),
+	}
+	if e.linkTarget == "" {
+		result.Permissions = createBsdInfo(e, modeRegular)
+	} else {
+		result.Permissions = bsdInfo{OwnerId: unknownOwnerId, GroupId: unknownOwnerId, FileMode: modeSymlink | 0755}
+		result.UserInfo.FileType = symlinkFileType
+		result.UserInfo.FileCreator = symlinkFileCreator
+	}
+	// fork clump size is not used for files
+	result.DataFork.ClumpSize = 0
+	return result
+}
+
+func (v *volume) getModTime(info os.FileInfo) time.Time {
+	if v.isReproducible {
+		return v.createTime
+	}
+	return info.ModTime()
+}
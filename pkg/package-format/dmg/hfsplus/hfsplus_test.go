@@ -0,0 +1,299 @@
+package hfsplus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/develar/app-builder/pkg/util"
+	. "github.com/onsi/gomega"
+)
+
+type testVolume struct {
+	g       *GomegaWithT
+	data    []byte
+	header  volumeHeader
+	catalog []byte
+	tree    btreeHeader
+}
+
+func TestCreateVolume(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "hfsplus-test")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	srcDir := filepath.Join(dir, "src")
+	resourcesDir := filepath.Join(srcDir, "Test.app", "Contents", "Resources")
+	g.Expect(os.MkdirAll(resourcesDir, 0755)).To(Succeed())
+	g.Expect(os.MkdirAll(filepath.Join(srcDir, "Test.app", "Contents", "MacOS"), 0755)).To(Succeed())
+	g.Expect(ioutil.WriteFile(filepath.Join(srcDir, "Test.app", "Contents", "MacOS", "Test"), []byte("binary"), 0755)).To(Succeed())
+	g.Expect(ioutil.WriteFile(filepath.Join(srcDir, "café.txt"), []byte("text"), 0644)).To(Succeed())
+	g.Expect(os.Symlink("/Applications", filepath.Join(srcDir, "Applications"))).To(Succeed())
+	// enough records to get several leaf nodes and an index node
+	for i := 0; i < 300; i++ {
+		g.Expect(ioutil.WriteFile(filepath.Join(resourcesDir, fmt.Sprintf("file-%d.txt", i)), bytes.Repeat([]byte{'a'}, i*100), 0644)).To(Succeed())
+	}
+	g.Expect(ioutil.WriteFile(filepath.Join(dir, "icon.icns"), []byte("icns"), 0644)).To(Succeed())
+
+	output := filepath.Join(dir, "volume.img")
+	g.Expect(CreateVolume(srcDir, output, Options{VolumeName: "Test 1.0.0", Icon: filepath.Join(dir, "icon.icns")})).To(Succeed())
+
+	volume := readTestVolume(g, output)
+	header := volume.header
+	g.Expect(header.Signature).To(Equal(uint16(signatureHfsPlus)))
+	g.Expect(header.BlockSize).To(Equal(uint32(blockSize)))
+	g.Expect(int64(header.TotalBlocks) * blockSize).To(Equal(int64(len(volume.data))))
+	// Test, café.txt, Applications, resources and .VolumeIcon.icns
+	g.Expect(header.FileCount).To(Equal(uint32(304)))
+	// Test.app, Contents, MacOS and Resources
+	g.Expect(header.FolderCount).To(Equal(uint32(4)))
+	g.Expect(volume.data[len(volume.data)-1024 : len(volume.data)-512]).To(Equal(volume.data[1024:1536]))
+
+	g.Expect(volume.tree.TreeDepth).To(Equal(uint16(2)))
+	g.Expect(volume.tree.LeafRecords).To(Equal(uint32(2 * (1 + 4 + 304))))
+
+	// leaf records are sorted and every record can be found using index
+	records := volume.leafRecords()
+	g.Expect(records).To(HaveLen(int(volume.tree.LeafRecords)))
+	for i, record := range records {
+		if i > 0 {
+			g.Expect(compareCatalogKeys(records[i-1], record)).To(BeNumerically("<", 0))
+		}
+		g.Expect(volume.find(record.parentId, record.name)).To(Equal(record.data))
+	}
+
+	root := volume.findFolder(rootParentId, "Test 1.0.0")
+	g.Expect(root.FolderId).To(Equal(uint32(rootFolderId)))
+	g.Expect(root.Valence).To(Equal(uint32(4)))
+	g.Expect(root.UserInfo.FinderFlags & hasCustomIconFlag).NotTo(BeZero())
+	g.Expect(root.Permissions.FileMode).To(Equal(uint16(modeDirectory | 0755)))
+
+	icon := volume.findFile(rootFolderId, volumeIconName)
+	g.Expect(icon.UserInfo.FinderFlags & isInvisibleFlag).NotTo(BeZero())
+	g.Expect(string(volume.readFork(icon.DataFork))).To(Equal("icns"))
+
+	link := volume.findFile(rootFolderId, "Applications")
+	g.Expect(link.UserInfo.FileType).To(Equal(uint32(symlinkFileType)))
+	g.Expect(link.Permissions.FileMode & 0170000).To(Equal(uint16(modeSymlink)))
+	g.Expect(string(volume.readFork(link.DataFork))).To(Equal("/Applications"))
+
+	// name is decomposed
+	g.Expect(volume.find(rootFolderId, []uint16{'c', 'a', 'f', 'e', 0x0301, '.', 't', 'x', 't'})).NotTo(BeNil())
+	// case-insensitive lookup
+	g.Expect(volume.find(rootFolderId, utf16Name("CAFÉ.TXT"))).NotTo(BeNil())
+
+	app := volume.findFolder(rootFolderId, "Test.app")
+	contents := volume.findFolder(app.FolderId, "Contents")
+	macOs := volume.findFolder(contents.FolderId, "MacOS")
+	executable := volume.findFile(macOs.FolderId, "Test")
+	g.Expect(executable.Permissions.FileMode).To(Equal(uint16(modeRegular | 0755)))
+	g.Expect(string(volume.readFork(executable.DataFork))).To(Equal("binary"))
+
+	resources := volume.findFolder(contents.FolderId, "Resources")
+	g.Expect(resources.Valence).To(Equal(uint32(300)))
+	resource := volume.findFile(resources.FolderId, "file-299.txt")
+	g.Expect(volume.readFork(resource.DataFork)).To(Equal(bytes.Repeat([]byte{'a'}, 29900)))
+
+	// thread record of the file
+	thread := volume.find(executable.FileId, nil)
+	g.Expect(int16(binary.BigEndian.Uint16(thread))).To(Equal(int16(fileThreadRecordType)))
+	g.Expect(binary.BigEndian.Uint32(thread[4:])).To(Equal(macOs.FolderId))
+
+	// catalog and file data blocks are allocated
+	bitmap := volume.readFork(header.AllocationFile)
+	isAllocated := func(block uint32) bool {
+		return bitmap[block/8]&(0x80>>(block%8)) != 0
+	}
+	g.Expect(isAllocated(header.CatalogFile.Extents[0].StartBlock)).To(BeTrue())
+	g.Expect(isAllocated(resource.DataFork.Extents[0].StartBlock + resource.DataFork.Extents[0].BlockCount - 1)).To(BeTrue())
+	g.Expect(isAllocated(header.NextAllocation)).To(BeFalse())
+	g.Expect(isAllocated(header.TotalBlocks - 1)).To(BeTrue())
+}
+
+func TestCreateVolumeNameConflict(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "hfsplus-test")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	srcDir := filepath.Join(dir, "src")
+	g.Expect(os.MkdirAll(srcDir, 0755)).To(Succeed())
+	g.Expect(ioutil.WriteFile(filepath.Join(srcDir, "readme"), []byte("a"), 0644)).To(Succeed())
+	g.Expect(ioutil.WriteFile(filepath.Join(srcDir, "README"), []byte("b"), 0644)).To(Succeed())
+
+	err = CreateVolume(srcDir, filepath.Join(dir, "volume.img"), Options{VolumeName: "Test"})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.(util.MessageError).ErrorCode()).To(Equal("ERR_DMG_NAME_CONFLICT"))
+}
+
+func TestCreateVolumeReproducible(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "hfsplus-test")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	srcDir := filepath.Join(dir, "src")
+	g.Expect(os.MkdirAll(filepath.Join(srcDir, "Test.app"), 0755)).To(Succeed())
+	g.Expect(ioutil.WriteFile(filepath.Join(srcDir, "Test.app", "Test"), []byte("binary"), 0755)).To(Succeed())
+
+	options := Options{VolumeName: "Test", ModificationTime: time.Unix(1600000000, 0)}
+	first := filepath.Join(dir, "first.img")
+	g.Expect(CreateVolume(srcDir, first, options)).To(Succeed())
+
+	modTime := time.Now().Add(-time.Hour)
+	g.Expect(os.Chtimes(filepath.Join(srcDir, "Test.app", "Test"), modTime, modTime)).To(Succeed())
+	second := filepath.Join(dir, "second.img")
+	g.Expect(CreateVolume(srcDir, second, options)).To(Succeed())
+
+	firstData, err := ioutil.ReadFile(first)
+	g.Expect(err).NotTo(HaveOccurred())
+	secondData, err := ioutil.ReadFile(second)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(bytes.Equal(firstData, secondData)).To(BeTrue())
+
+	var header volumeHeader
+	g.Expect(binary.Read(bytes.NewReader(firstData[1024:]), binary.BigEndian, &header)).To(Succeed())
+	g.Expect(header.CreateDate).To(Equal(toHfsTime(options.ModificationTime)))
+	g.Expect(header.FinderInfo[6]).NotTo(BeZero())
+}
+
+func TestStructureSizes(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	g.Expect(encode(volumeHeader{})).To(HaveLen(512))
+	g.Expect(encode(catalogFolder{})).To(HaveLen(88))
+	g.Expect(encode(catalogFile{})).To(HaveLen(248))
+	g.Expect(encode(btreeHeader{})).To(HaveLen(headerRecordSize))
+	g.Expect(encode(nodeDescriptor{})).To(HaveLen(nodeDescriptorSize))
+}
+
+func TestCompareNames(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	g.Expect(compareNames(utf16Name("Info.plist"), utf16Name("info.PLIST"))).To(Equal(0))
+	g.Expect(compareNames(utf16Name("a"), utf16Name("ab"))).To(BeNumerically("<", 0))
+	g.Expect(compareNames(utf16Name("B"), utf16Name("a"))).To(BeNumerically(">", 0))
+	// zero width joiner is ignored
+	g.Expect(compareNames(utf16Name("a\u200db"), utf16Name("ab"))).To(Equal(0))
+	g.Expect(compareNames(utf16Name("ПРИВЕТ"), utf16Name("привет"))).To(Equal(0))
+}
+
+func utf16Name(name string) []uint16 {
+	result, _ := encodeName(name)
+	return result
+}
+
+func readTestVolume(g *GomegaWithT, file string) *testVolume {
+	data, err := ioutil.ReadFile(file)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	volume := &testVolume{g: g, data: data}
+	g.Expect(binary.Read(bytes.NewReader(data[1024:]), binary.BigEndian, &volume.header)).To(Succeed())
+	volume.catalog = volume.readFork(volume.header.CatalogFile)
+	g.Expect(binary.Read(bytes.NewReader(volume.catalog[nodeDescriptorSize:]), binary.BigEndian, &volume.tree)).To(Succeed())
+	g.Expect(int(volume.tree.NodeSize)).To(Equal(catalogNodeSize))
+	return volume
+}
+
+func (v *testVolume) readFork(fork forkData) []byte {
+	v.g.Expect(fork.Extents[1].BlockCount).To(BeZero())
+	start := int64(fork.Extents[0].StartBlock) * blockSize
+	return v.data[start : start+int64(fork.LogicalSize)]
+}
+
+func (v *testVolume) node(number uint32) (nodeDescriptor, [][]byte) {
+	data := v.catalog[int(number)*catalogNodeSize : int(number+1)*catalogNodeSize]
+	var descriptor nodeDescriptor
+	v.g.Expect(binary.Read(bytes.NewReader(data), binary.BigEndian, &descriptor)).To(Succeed())
+
+	offset := func(i int) int {
+		return int(binary.BigEndian.Uint16(data[catalogNodeSize-2*(i+1):]))
+	}
+	var records [][]byte
+	for i := 0; i < int(descriptor.NumRecords); i++ {
+		records = append(records, data[offset(i):offset(i+1)])
+	}
+	return descriptor, records
+}
+
+func parseTestRecord(record []byte) *catalogRecord {
+	keyLength := int(binary.BigEndian.Uint16(record))
+	nameLength := int(binary.BigEndian.Uint16(record[6:]))
+	name := make([]uint16, nameLength)
+	for i := range name {
+		name[i] = binary.BigEndian.Uint16(record[8+2*i:])
+	}
+	return &catalogRecord{parentId: binary.BigEndian.Uint32(record[2:]), name: name, data: record[2+keyLength:]}
+}
+
+func (v *testVolume) leafRecords() []*catalogRecord {
+	var result []*catalogRecord
+	for number := v.tree.FirstLeafNode; number != 0; {
+		descriptor, records := v.node(number)
+		v.g.Expect(descriptor.Kind).To(Equal(int8(leafNodeKind)))
+		for _, record := range records {
+			result = append(result, parseTestRecord(record))
+		}
+		number = descriptor.FLink
+	}
+	return result
+}
+
+// descend from the root using index nodes
+func (v *testVolume) find(parentId uint32, name []uint16) []byte {
+	key := &catalogRecord{parentId: parentId, name: name}
+	number := v.tree.RootNode
+	for {
+		descriptor, records := v.node(number)
+		if descriptor.Kind == leafNodeKind {
+			for _, data := range records {
+				record := parseTestRecord(data)
+				if compareCatalogKeys(record, key) == 0 {
+					return record.data
+				}
+			}
+			return nil
+		}
+
+		v.g.Expect(descriptor.Kind).To(Equal(int8(indexNodeKind)))
+		next := uint32(0)
+		for _, data := range records {
+			record := parseTestRecord(data)
+			if compareCatalogKeys(record, key) > 0 {
+				break
+			}
+			next = binary.BigEndian.Uint32(record.data)
+		}
+		if next == 0 {
+			return nil
+		}
+		number = next
+	}
+}
+
+func (v *testVolume) findFolder(parentId uint32, name string) *catalogFolder {
+	data := v.find(parentId, utf16Name(name))
+	v.g.Expect(data).NotTo(BeNil(), name)
+	var result catalogFolder
+	v.g.Expect(binary.Read(bytes.NewReader(data), binary.BigEndian, &result)).To(Succeed())
+	v.g.Expect(result.RecordType).To(Equal(int16(folderRecordType)))
+	return &result
+}
+
+func (v *testVolume) findFile(parentId uint32, name string) *catalogFile {
+	data := v.find(parentId, utf16Name(name))
+	v.g.Expect(data).NotTo(BeNil(), name)
+	var result catalogFile
+	v.g.Expect(binary.Read(bytes.NewReader(data), binary.BigEndian, &result)).To(Succeed())
+	v.g.Expect(result.RecordType).To(Equal(int16(fileRecordType)))
+	return &result
+}
@@ -0,0 +1,104 @@
+package dmg
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/package-format/dmg/hfsplus"
+	"github.com/develar/app-builder/pkg/package-format/dmg/udif"
+	"github.com/develar/app-builder/pkg/reproducible"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"go.uber.org/zap"
+)
+
+type ImageInfo struct {
+	File string `json:"file"`
+	Size int64  `json:"size"`
+	// base64, the same as in the update info
+	Sha512 string `json:"sha512"`
+}
+
+// experimental mode to build unsigned dmg on Linux (and Windows) without a mac runner
+func configurePortableCommand(dmgCommand *kingpin.CmdClause) {
+	command := dmgCommand.Command("build-portable", "Experimental: build dmg without hdiutil (HFS+ volume and UDIF image are written directly). "+
+		"Finder window layout is not configured, .DS_Store (if needed) must be in the source folder.")
+	srcFolder := command.Flag("src-folder", "").Required().ExistingDir()
+	volumeName := command.Flag("volume-name", "").Required().String()
+	icon := command.Flag("icon", "The volume icon (.icns).").ExistingFile()
+	format := command.Flag("format", "UDZO (zlib) or UDRO (not compressed).").Default("UDZO").Enum("UDZO", "UDRO")
+	level := command.Flag("level", "zlib level for UDZO (1-9).").Default("9").Int()
+	output := command.Flag("output", "").Short('o').Required().String()
+	command.Action(func(context *kingpin.ParseContext) error {
+		result, err := BuildPortable(*srcFolder, *volumeName, *icon, *format, *level, *output)
+		if err != nil {
+			return err
+		}
+		return util.WriteJsonToStdOut(result)
+	})
+}
+
+func BuildPortable(srcFolder string, volumeName string, icon string, format string, level int, output string) (*ImageInfo, error) {
+	log.Warn("dmg is built without hdiutil, this mode is experimental", zap.String("file", output))
+
+	rawImage, err := ioutil.TempFile(filepath.Dir(output), "."+filepath.Base(output)+".raw-")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	_ = rawImage.Close()
+	defer func() {
+		_ = os.Remove(rawImage.Name())
+	}()
+
+	volumeOptions := hfsplus.Options{VolumeName: volumeName, Icon: icon}
+	isReproducible := reproducible.IsEnabled()
+	if isReproducible {
+		volumeOptions.ModificationTime, err = reproducible.GetTime()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = hfsplus.CreateVolume(srcFolder, rawImage.Name(), volumeOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	err = udif.Write(rawImage.Name(), output, format, level, isReproducible)
+	if err != nil {
+		return nil, err
+	}
+
+	if isReproducible {
+		report := reproducible.NewReport(output, format, volumeOptions.ModificationTime)
+		report.Add("volumeDates", 1)
+		report.Add("volumeUuid", 1)
+		report.Add("segmentId", 1)
+		err = report.Write()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return computeImageInfo(output)
+}
+
+func computeImageInfo(file string) (*ImageInfo, error) {
+	reader, err := os.Open(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer util.Close(reader)
+
+	hash := sha512.New()
+	size, err := io.Copy(hash, reader)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &ImageInfo{File: file, Size: size, Sha512: base64.StdEncoding.EncodeToString(hash.Sum(nil))}, nil
+}
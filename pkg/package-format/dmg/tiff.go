@@ -0,0 +1,173 @@
+package dmg
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"io"
+
+	"github.com/develar/errors"
+)
+
+// TIFF tags and field types used to write RGBA pages
+const (
+	tiffTypeShort    = 3
+	tiffTypeLong     = 4
+	tiffTypeRational = 5
+
+	tiffTagImageWidth                = 256
+	tiffTagImageLength               = 257
+	tiffTagBitsPerSample             = 258
+	tiffTagCompression               = 259
+	tiffTagPhotometricInterpretation = 262
+	tiffTagStripOffsets              = 273
+	tiffTagSamplesPerPixel           = 277
+	tiffTagRowsPerStrip              = 278
+	tiffTagStripByteCounts           = 279
+	tiffTagXResolution               = 282
+	tiffTagYResolution               = 283
+	tiffTagPlanarConfiguration       = 284
+	tiffTagResolutionUnit            = 296
+	tiffTagExtraSamples              = 338
+
+	tiffCompressionDeflate           = 8
+	tiffPhotometricRGB               = 2
+	tiffResolutionUnitInch           = 2
+	tiffExtraSampleUnassociatedAlpha = 2
+)
+
+type TiffPage struct {
+	Image *image.NRGBA
+	// 72 for 1x, 144 for 2x - Finder selects page according to the resolution (as for file created by tiffutil -cathidpicheck)
+	Dpi uint32
+}
+
+type tiffEntry struct {
+	tag       uint16
+	fieldType uint16
+	count     uint32
+	// value if fits into 4 bytes, otherwise data is written after IFD
+	value uint32
+	data  []byte
+}
+
+// EncodeMultiPageTiff writes deflate-compressed RGBA pages (Go doesn't provide multi-page TIFF encoder)
+func EncodeMultiPageTiff(writer io.Writer, pages []TiffPage) error {
+	var out bytes.Buffer
+	// little-endian header, first IFD offset is patched later
+	out.Write([]byte{'I', 'I', 42, 0, 0, 0, 0, 0})
+	previousNextIfdOffsetPosition := 4
+
+	for _, page := range pages {
+		bounds := page.Image.Bounds()
+		width := bounds.Dx()
+		height := bounds.Dy()
+
+		stripData, err := compressPixels(page.Image)
+		if err != nil {
+			return err
+		}
+
+		stripOffset := out.Len()
+		out.Write(stripData)
+		if out.Len()%2 != 0 {
+			// IFD must begin on a word boundary
+			out.WriteByte(0)
+		}
+
+		resolution := make([]byte, 8)
+		binary.LittleEndian.PutUint32(resolution, page.Dpi)
+		binary.LittleEndian.PutUint32(resolution[4:], 1)
+
+		bitsPerSample := make([]byte, 8)
+		for i := 0; i < 4; i++ {
+			binary.LittleEndian.PutUint16(bitsPerSample[i*2:], 8)
+		}
+
+		// must be sorted by tag
+		entries := []tiffEntry{
+			{tag: tiffTagImageWidth, fieldType: tiffTypeLong, count: 1, value: uint32(width)},
+			{tag: tiffTagImageLength, fieldType: tiffTypeLong, count: 1, value: uint32(height)},
+			{tag: tiffTagBitsPerSample, fieldType: tiffTypeShort, count: 4, data: bitsPerSample},
+			{tag: tiffTagCompression, fieldType: tiffTypeShort, count: 1, value: tiffCompressionDeflate},
+			{tag: tiffTagPhotometricInterpretation, fieldType: tiffTypeShort, count: 1, value: tiffPhotometricRGB},
+			{tag: tiffTagStripOffsets, fieldType: tiffTypeLong, count: 1, value: uint32(stripOffset)},
+			{tag: tiffTagSamplesPerPixel, fieldType: tiffTypeShort, count: 1, value: 4},
+			{tag: tiffTagRowsPerStrip, fieldType: tiffTypeLong, count: 1, value: uint32(height)},
+			{tag: tiffTagStripByteCounts, fieldType: tiffTypeLong, count: 1, value: uint32(len(stripData))},
+			{tag: tiffTagXResolution, fieldType: tiffTypeRational, count: 1, data: resolution},
+			{tag: tiffTagYResolution, fieldType: tiffTypeRational, count: 1, data: resolution},
+			{tag: tiffTagPlanarConfiguration, fieldType: tiffTypeShort, count: 1, value: 1},
+			{tag: tiffTagResolutionUnit, fieldType: tiffTypeShort, count: 1, value: tiffResolutionUnitInch},
+			{tag: tiffTagExtraSamples, fieldType: tiffTypeShort, count: 1, value: tiffExtraSampleUnassociatedAlpha},
+		}
+
+		ifdOffset := out.Len()
+		patchUint32(&out, previousNextIfdOffsetPosition, uint32(ifdOffset))
+
+		ifdSize := 2 + len(entries)*12 + 4
+		externalDataOffset := ifdOffset + ifdSize
+		var externalData bytes.Buffer
+
+		entryCount := make([]byte, 2)
+		binary.LittleEndian.PutUint16(entryCount, uint16(len(entries)))
+		out.Write(entryCount)
+
+		for _, entry := range entries {
+			entryData := make([]byte, 12)
+			binary.LittleEndian.PutUint16(entryData, entry.tag)
+			binary.LittleEndian.PutUint16(entryData[2:], entry.fieldType)
+			binary.LittleEndian.PutUint32(entryData[4:], entry.count)
+			if entry.data == nil {
+				if entry.fieldType == tiffTypeShort {
+					// value is left-justified
+					binary.LittleEndian.PutUint16(entryData[8:], uint16(entry.value))
+				} else {
+					binary.LittleEndian.PutUint32(entryData[8:], entry.value)
+				}
+			} else {
+				binary.LittleEndian.PutUint32(entryData[8:], uint32(externalDataOffset+externalData.Len()))
+				externalData.Write(entry.data)
+			}
+			out.Write(entryData)
+		}
+
+		previousNextIfdOffsetPosition = out.Len()
+		// next IFD offset, 0 for the last page
+		out.Write([]byte{0, 0, 0, 0})
+		out.Write(externalData.Bytes())
+	}
+
+	_, err := writer.Write(out.Bytes())
+	return errors.WithStack(err)
+}
+
+func patchUint32(buffer *bytes.Buffer, position int, value uint32) {
+	binary.LittleEndian.PutUint32(buffer.Bytes()[position:], value)
+}
+
+func compressPixels(img *image.NRGBA) ([]byte, error) {
+	bounds := img.Bounds()
+	rowSize := bounds.Dx() * 4
+
+	var result bytes.Buffer
+	compressor, err := zlib.NewWriterLevel(&result, zlib.BestCompression)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	for y := 0; y < bounds.Dy(); y++ {
+		rowStart := img.PixOffset(bounds.Min.X, bounds.Min.Y+y)
+		_, err = compressor.Write(img.Pix[rowStart : rowStart+rowSize])
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	err = compressor.Close()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return result.Bytes(), nil
+}
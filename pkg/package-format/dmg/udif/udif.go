@@ -0,0 +1,298 @@
+// Package udif writes Apple disk image (UDIF, dmg) from a raw volume image without hdiutil (experimental, used to build dmg on Linux).
+package udif
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+)
+
+const (
+	sectorSize = 512
+	// 1 MB, the same as hdiutil uses
+	chunkSectors = 2048
+
+	chunkRaw       = 0x00000001
+	chunkIgnore    = 0x00000002
+	chunkZlib      = 0x80000005
+	chunkTerminate = 0xFFFFFFFF
+
+	checksumCrc32 = 2
+
+	kolySignature = 0x6B6F6C79 // koly
+	mishSignature = 0x6D697368 // mish
+
+	flagFlattened   = 1
+	deviceImageType = 1
+
+	// partition-less image (hdiutil -layout NONE)
+	partitionName = "whole disk (Apple_HFS : 0)"
+	// ID -1
+	entireDeviceDescriptor = 0xFFFFFFFE
+)
+
+type checksum struct {
+	Type     uint32
+	BitCount uint32
+	Data     [32]uint32
+}
+
+type blkxTable struct {
+	Signature        uint32
+	Version          uint32
+	SectorNumber     uint64
+	SectorCount      uint64
+	DataOffset       uint64
+	BuffersNeeded    uint32
+	BlockDescriptors uint32
+	Reserved         [6]uint32
+	Checksum         checksum
+	NumberOfChunks   uint32
+}
+
+type blkxChunk struct {
+	EntryType        uint32
+	Comment          uint32
+	SectorNumber     uint64
+	SectorCount      uint64
+	CompressedOffset uint64
+	CompressedLength uint64
+}
+
+type kolyTrailer struct {
+	Signature             uint32
+	Version               uint32
+	HeaderSize            uint32
+	Flags                 uint32
+	RunningDataForkOffset uint64
+	DataForkOffset        uint64
+	DataForkLength        uint64
+	RsrcForkOffset        uint64
+	RsrcForkLength        uint64
+	SegmentNumber         uint32
+	SegmentCount          uint32
+	SegmentId             [16]byte
+	DataForkChecksum      checksum
+	XmlOffset             uint64
+	XmlLength             uint64
+	Reserved1             [120]byte
+	MasterChecksum        checksum
+	ImageVariant          uint32
+	SectorCount           uint64
+	Reserved2             uint32
+	Reserved3             uint32
+	Reserved4             uint32
+}
+
+// Write converts raw volume image to UDIF: UDZO (zlib, level 1-9) or UDRO (not compressed).
+// Layout: data fork (chunks), XML property list with the block table (blkx) and 512-byte koly trailer.
+// If isReproducible, segment ID is derived from the block table (contains checksums of chunks) instead of random.
+func Write(rawImage string, output string, format string, level int, isReproducible bool) error {
+	if format != "UDZO" && format != "UDRO" {
+		return util.NewMessageError("format "+format+" is not supported (only UDZO and UDRO)", "ERR_DMG_UNSUPPORTED_FORMAT")
+	}
+
+	reader, err := os.Open(rawImage)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(reader)
+
+	info, err := reader.Stat()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if info.Size()%sectorSize != 0 {
+		return errors.Errorf("image size %d is not a multiple of sector size", info.Size())
+	}
+	sectorCount := uint64(info.Size() / sectorSize)
+
+	file, err := os.Create(output)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(file)
+
+	dataForkChecksum := crc32.NewIEEE()
+	writer := io.MultiWriter(file, dataForkChecksum)
+	imageChecksum := crc32.NewIEEE()
+
+	var chunks []blkxChunk
+	var offset uint64
+	buffer := make([]byte, chunkSectors*sectorSize)
+	for sector := uint64(0); sector < sectorCount; sector += chunkSectors {
+		n, err := io.ReadFull(reader, buffer)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return errors.WithStack(err)
+		}
+
+		data := buffer[:n]
+		_, _ = imageChecksum.Write(data)
+
+		chunk := blkxChunk{SectorNumber: sector, SectorCount: uint64(n / sectorSize), CompressedOffset: offset}
+		if isZero(data) {
+			chunk.EntryType = chunkIgnore
+			chunks = append(chunks, chunk)
+			continue
+		}
+
+		chunk.EntryType = chunkRaw
+		if format == "UDZO" {
+			compressed, err := compress(data, level)
+			if err != nil {
+				return err
+			}
+			// incompressible data is stored as is (the same as hdiutil does)
+			if len(compressed) < len(data) {
+				chunk.EntryType = chunkZlib
+				data = compressed
+			}
+		}
+
+		_, err = writer.Write(data)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		chunk.CompressedLength = uint64(len(data))
+		offset += chunk.CompressedLength
+		chunks = append(chunks, chunk)
+	}
+	chunks = append(chunks, blkxChunk{EntryType: chunkTerminate, SectorNumber: sectorCount, CompressedOffset: offset})
+
+	table := blkxTable{
+		Signature:        mishSignature,
+		Version:          1,
+		SectorCount:      sectorCount,
+		BuffersNeeded:    chunkSectors + 8,
+		BlockDescriptors: entireDeviceDescriptor,
+		Checksum:         createChecksum(imageChecksum.Sum32()),
+		NumberOfChunks:   uint32(len(chunks)),
+	}
+	var tableData bytes.Buffer
+	_ = binary.Write(&tableData, binary.BigEndian, table)
+	_ = binary.Write(&tableData, binary.BigEndian, chunks)
+
+	xml := []byte(createPropertyList(tableData.Bytes()))
+	_, err = file.Write(xml)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	trailer := kolyTrailer{
+		Signature:        kolySignature,
+		Version:          4,
+		HeaderSize:       512,
+		Flags:            flagFlattened,
+		DataForkLength:   offset,
+		SegmentNumber:    1,
+		SegmentCount:     1,
+		DataForkChecksum: createChecksum(dataForkChecksum.Sum32()),
+		XmlOffset:        offset,
+		XmlLength:        uint64(len(xml)),
+		MasterChecksum:   createChecksum(computeMasterChecksum([]uint32{table.Checksum.Data[0]})),
+		ImageVariant:     deviceImageType,
+		SectorCount:      sectorCount,
+	}
+	if isReproducible {
+		hash := sha256.Sum256(xml)
+		copy(trailer.SegmentId[:], hash[:])
+	} else {
+		_, err = rand.Read(trailer.SegmentId[:])
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return errors.WithStack(binary.Write(file, binary.BigEndian, trailer))
+}
+
+func compress(data []byte, level int) ([]byte, error) {
+	var result bytes.Buffer
+	writer, err := zlib.NewWriterLevel(&result, level)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	_, err = writer.Write(data)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return result.Bytes(), nil
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func createChecksum(value uint32) checksum {
+	result := checksum{Type: checksumCrc32, BitCount: 32}
+	result.Data[0] = value
+	return result
+}
+
+// master checksum is CRC32 of the block table checksums (big-endian)
+func computeMasterChecksum(tableChecksums []uint32) uint32 {
+	data := make([]byte, 4*len(tableChecksums))
+	for i, value := range tableChecksums {
+		binary.BigEndian.PutUint32(data[4*i:], value)
+	}
+	return crc32.ChecksumIEEE(data)
+}
+
+func createPropertyList(table []byte) string {
+	var s strings.Builder
+	s.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>resource-fork</key>
+	<dict>
+		<key>blkx</key>
+		<array>
+			<dict>
+				<key>Attributes</key>
+				<string>0x0050</string>
+				<key>CFName</key>
+				<string>` + partitionName + `</string>
+				<key>Data</key>
+				<data>
+`)
+	encoded := base64.StdEncoding.EncodeToString(table)
+	for len(encoded) > 0 {
+		lineLength := 52
+		if lineLength > len(encoded) {
+			lineLength = len(encoded)
+		}
+		s.WriteString("\t\t\t\t" + encoded[:lineLength] + "\n")
+		encoded = encoded[lineLength:]
+	}
+	s.WriteString(`				</data>
+				<key>ID</key>
+				<string>-1</string>
+				<key>Name</key>
+				<string>` + partitionName + `</string>
+			</dict>
+		</array>
+	</dict>
+</dict>
+</plist>
+`)
+	return s.String()
+}
@@ -0,0 +1,105 @@
+package udif
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"howett.net/plist"
+)
+
+func TestWrite(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "udif-test")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	// zeros, incompressible data, compressible data and not full last chunk
+	random := make([]byte, chunkSectors*sectorSize)
+	rand.New(rand.NewSource(42)).Read(random)
+	var raw []byte
+	raw = append(raw, make([]byte, chunkSectors*sectorSize)...)
+	raw = append(raw, random...)
+	raw = append(raw, bytes.Repeat([]byte("compressible "), chunkSectors*sectorSize/8)...)
+	raw = append(raw, make([]byte, 3*sectorSize-len(raw)%sectorSize)...)
+	rawFile := filepath.Join(dir, "volume.img")
+	g.Expect(ioutil.WriteFile(rawFile, raw, 0644)).To(Succeed())
+
+	output := filepath.Join(dir, "test.dmg")
+	g.Expect(Write(rawFile, output, "UDZO", 9, false)).To(Succeed())
+
+	data, err := ioutil.ReadFile(output)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	var trailer kolyTrailer
+	g.Expect(binary.Read(bytes.NewReader(data[len(data)-512:]), binary.BigEndian, &trailer)).To(Succeed())
+	g.Expect(trailer.Signature).To(Equal(uint32(kolySignature)))
+	g.Expect(trailer.SectorCount).To(Equal(uint64(len(raw) / sectorSize)))
+	g.Expect(trailer.XmlOffset + trailer.XmlLength).To(Equal(uint64(len(data) - 512)))
+	dataFork := data[:trailer.DataForkLength]
+	g.Expect(trailer.DataForkChecksum.Data[0]).To(Equal(crc32.ChecksumIEEE(dataFork)))
+
+	var propertyList struct {
+		ResourceFork struct {
+			Blkx []struct {
+				Name string
+				ID   string
+				Data []byte
+			} `plist:"blkx"`
+		} `plist:"resource-fork"`
+	}
+	_, err = plist.Unmarshal(data[trailer.XmlOffset:trailer.XmlOffset+trailer.XmlLength], &propertyList)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(propertyList.ResourceFork.Blkx).To(HaveLen(1))
+	g.Expect(propertyList.ResourceFork.Blkx[0].ID).To(Equal("-1"))
+
+	reader := bytes.NewReader(propertyList.ResourceFork.Blkx[0].Data)
+	var table blkxTable
+	g.Expect(binary.Read(reader, binary.BigEndian, &table)).To(Succeed())
+	g.Expect(table.Signature).To(Equal(uint32(mishSignature)))
+	g.Expect(table.SectorCount).To(Equal(trailer.SectorCount))
+	g.Expect(table.Checksum.Data[0]).To(Equal(crc32.ChecksumIEEE(raw)))
+	g.Expect(trailer.MasterChecksum.Data[0]).To(Equal(computeMasterChecksum([]uint32{table.Checksum.Data[0]})))
+
+	chunks := make([]blkxChunk, table.NumberOfChunks)
+	g.Expect(binary.Read(reader, binary.BigEndian, chunks)).To(Succeed())
+	g.Expect(chunks[len(chunks)-1].EntryType).To(Equal(uint32(chunkTerminate)))
+
+	var types []uint32
+	var decoded []byte
+	for _, chunk := range chunks[:len(chunks)-1] {
+		g.Expect(chunk.SectorNumber).To(Equal(uint64(len(decoded) / sectorSize)))
+		types = append(types, chunk.EntryType)
+		compressed := dataFork[chunk.CompressedOffset : chunk.CompressedOffset+chunk.CompressedLength]
+		switch chunk.EntryType {
+		case chunkIgnore:
+			decoded = append(decoded, make([]byte, chunk.SectorCount*sectorSize)...)
+		case chunkRaw:
+			decoded = append(decoded, compressed...)
+		case chunkZlib:
+			zlibReader, err := zlib.NewReader(bytes.NewReader(compressed))
+			g.Expect(err).NotTo(HaveOccurred())
+			chunkData, err := ioutil.ReadAll(zlibReader)
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(chunkData).To(HaveLen(int(chunk.SectorCount * sectorSize)))
+			decoded = append(decoded, chunkData...)
+		}
+	}
+	g.Expect(types).To(Equal([]uint32{chunkIgnore, chunkRaw, chunkZlib, chunkZlib}))
+	g.Expect(decoded).To(Equal(raw))
+}
+
+func TestWriteUnsupportedFormat(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	err := Write("volume.img", "test.dmg", "ULFO", 9, false)
+	g.Expect(err).To(MatchError(ContainSubstring("ULFO is not supported")))
+}
@@ -0,0 +1,220 @@
+package flatpak
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/fs"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+	"github.com/json-iterator/go"
+	"go.uber.org/zap"
+)
+
+const (
+	stageFilesDirName = "files"
+	stageAppDirName   = "app"
+	launcherFileName  = "launcher.sh"
+
+	defaultRuntimeRepo = "https://flathub.org/repo/flathub.flatpakrepo"
+)
+
+type FlatpakConfiguration struct {
+	AppId          string `json:"appId"`
+	ProductName    string `json:"productName"`
+	ExecutableName string `json:"executableName"`
+
+	Runtime        string `json:"runtime"`
+	RuntimeVersion string `json:"runtimeVersion"`
+	Sdk            string `json:"sdk"`
+	Base           string `json:"base"`
+	BaseVersion    string `json:"baseVersion"`
+	Branch         string `json:"branch"`
+	// repo file added to the bundle to install runtime on bundle install, flathub by default
+	RuntimeRepo string `json:"runtimeRepo"`
+
+	FinishArgs []string `json:"finishArgs"`
+	// additional flatpak-builder modules, installed before the app
+	Modules []interface{} `json:"modules"`
+
+	DesktopEntry string     `json:"desktopEntry"`
+	Icons        []IconInfo `json:"icons"`
+}
+
+type IconInfo struct {
+	File string `json:"file"`
+	Size int    `json:"size"`
+}
+
+type FlatpakOptions struct {
+	appDir   *string
+	stageDir *string
+	arch     *string
+	output   *string
+
+	// OSTree repo to export build to (e.g. to publish to Flathub-like remote), temporary repo in the stage dir if not specified
+	repo            *string
+	installDepsFrom *string
+	isManifestOnly  *bool
+	gpgSign         *string
+
+	configuration *FlatpakConfiguration
+}
+
+func ConfigureCommand(app *kingpin.Application) {
+	command := app.Command("flatpak", "Build flatpak.")
+
+	options := &FlatpakOptions{
+		appDir:   command.Flag("app", "The app dir.").Short('a').Required().String(),
+		stageDir: command.Flag("stage", "The stage dir.").Short('s').Required().String(),
+		output:   command.Flag("output", "The output .flatpak bundle.").Short('o').String(),
+		arch:     command.Flag("arch", "The arch.").Default("x64").Enum("x64", "ia32", "armv7l", "arm64"),
+
+		repo:            command.Flag("repo", "The OSTree repo to export build to (kept for publishing).").String(),
+		installDepsFrom: command.Flag("install-deps-from", "The remote to install missing runtime and SDK from (e.g. flathub).").String(),
+		isManifestOnly:  command.Flag("manifest-only", "Only generate flatpak-builder manifest (e.g. for Flathub submission) in the stage dir.").Bool(),
+		gpgSign:         command.Flag("gpg-sign", "The GPG key ID to sign the repo commit and bundle.").String(),
+	}
+
+	configuration := command.Flag("configuration", "").Required().String()
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		err := util.DecodeBase64IfNeeded(*configuration, &options.configuration)
+		if err != nil {
+			return err
+		}
+
+		if !*options.isManifestOnly && *options.output == "" && *options.repo == "" {
+			return util.NewMessageError("output bundle or OSTree repo must be specified", "ERR_FLATPAK_NO_OUTPUT")
+		}
+		return Flatpak(options)
+	})
+}
+
+func Flatpak(options *FlatpakOptions) error {
+	configuration := options.configuration
+	if configuration.AppId == "" || configuration.ExecutableName == "" {
+		return util.NewMessageError("appId and executableName must be specified", "ERR_FLATPAK_INVALID_CONFIGURATION")
+	}
+	applyDefaults(configuration)
+
+	stageDir := *options.stageDir
+	err := prepareFiles(options)
+	if err != nil {
+		return err
+	}
+
+	manifestFile := filepath.Join(stageDir, configuration.AppId+".json")
+	data, err := jsoniter.ConfigCompatibleWithStandardLibrary.MarshalIndent(createManifest(configuration), "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = ioutil.WriteFile(manifestFile, data, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if *options.isManifestOnly {
+		return nil
+	}
+
+	repo := *options.repo
+	if repo == "" {
+		repo = filepath.Join(stageDir, "repo")
+	}
+
+	arch := toFlatpakArch(*options.arch)
+	args := []string{"--force-clean", "--disable-rofiles-fuse", "--arch=" + arch, "--repo=" + repo, "--default-branch=" + configuration.Branch}
+	if *options.installDepsFrom != "" {
+		args = append(args, "--user", "--install-deps-from="+*options.installDepsFrom)
+	}
+	if *options.gpgSign != "" {
+		args = append(args, "--gpg-sign="+*options.gpgSign)
+	}
+	args = append(args, filepath.Join(stageDir, "build"), manifestFile)
+
+	command := exec.Command("flatpak-builder", args...)
+	command.Dir = stageDir
+	_, err = util.Execute(command)
+	if err != nil {
+		return err
+	}
+
+	if *options.output == "" {
+		return nil
+	}
+
+	runtimeRepo := configuration.RuntimeRepo
+	if runtimeRepo == "" {
+		runtimeRepo = defaultRuntimeRepo
+	}
+
+	args = []string{"build-bundle", "--arch=" + arch, "--runtime-repo=" + runtimeRepo}
+	if *options.gpgSign != "" {
+		args = append(args, "--gpg-sign="+*options.gpgSign)
+	}
+	args = append(args, repo, *options.output, configuration.AppId, configuration.Branch)
+	_, err = util.Execute(exec.Command("flatpak", args...))
+	if err != nil {
+		return err
+	}
+
+	log.Debug("flatpak bundle created", zap.String("file", *options.output))
+	return nil
+}
+
+func prepareFiles(options *FlatpakOptions) error {
+	configuration := options.configuration
+	filesDir := filepath.Join(*options.stageDir, stageFilesDirName)
+	err := os.RemoveAll(filesDir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = fs.CopyUsingHardlink(*options.appDir, filepath.Join(filesDir, stageAppDirName))
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(filepath.Join(filesDir, launcherFileName), []byte(createLauncher(configuration)), 0755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(filesDir, configuration.AppId+".desktop"), []byte(createDesktopEntry(configuration)), 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, icon := range configuration.Icons {
+		iconFile := filepath.Join(filesDir, filepath.FromSlash(getStageIconFile(icon)))
+		err = fsutil.EnsureDir(filepath.Dir(iconFile))
+		if err != nil {
+			return err
+		}
+
+		err = fs.CopyUsingHardlink(icon.File, iconFile)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func toFlatpakArch(arch string) string {
+	switch arch {
+	case "ia32":
+		return "i386"
+	case "armv7l":
+		return "arm"
+	case "arm64":
+		return "aarch64"
+	default:
+		return "x86_64"
+	}
+}
@@ -0,0 +1,39 @@
+package flatpak
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestCreateManifest(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	configuration := &FlatpakConfiguration{
+		AppId:          "com.example.App",
+		ProductName:    "Example",
+		ExecutableName: "example",
+		Icons:          []IconInfo{{File: "/icons/128x128.png", Size: 128}, {File: "/icons/icon.svg"}},
+	}
+	applyDefaults(configuration)
+
+	manifest := createManifest(configuration)
+	g.Expect(manifest.Runtime).To(Equal("org.freedesktop.Platform"))
+	g.Expect(manifest.BaseVersion).To(Equal(manifest.RuntimeVersion))
+	g.Expect(manifest.Command).To(Equal("example"))
+	g.Expect(manifest.FinishArgs).To(ContainElement("--socket=wayland"))
+	g.Expect(manifest.Modules).To(HaveLen(1))
+
+	module := manifest.Modules[0].(*Module)
+	g.Expect(module.Sources).To(Equal([]Source{{Type: "dir", Path: "files"}}))
+	g.Expect(module.BuildCommands).To(Equal([]string{
+		"mkdir -p /app/lib/com.example.App",
+		"cp -a app/. /app/lib/com.example.App/",
+		"install -Dm755 launcher.sh /app/bin/example",
+		"install -Dm644 com.example.App.desktop /app/share/applications/com.example.App.desktop",
+		"install -Dm644 icons/128x128.png /app/share/icons/hicolor/128x128/apps/com.example.App.png",
+		"install -Dm644 icons/scalable.svg /app/share/icons/hicolor/scalable/apps/com.example.App.svg",
+	}))
+
+	g.Expect(createDesktopEntry(configuration)).To(ContainSubstring("Icon=com.example.App\n"))
+}
@@ -0,0 +1,139 @@
+package flatpak
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// flatpak-builder manifest (https://docs.flatpak.org/en/latest/flatpak-builder-command-reference.html#flatpak-manifest)
+type Manifest struct {
+	Id             string `json:"id"`
+	Runtime        string `json:"runtime"`
+	RuntimeVersion string `json:"runtime-version"`
+	Sdk            string `json:"sdk"`
+	Base           string `json:"base,omitempty"`
+	BaseVersion    string `json:"base-version,omitempty"`
+	Branch         string `json:"branch"`
+	Command        string `json:"command"`
+
+	SeparateLocales bool          `json:"separate-locales"`
+	FinishArgs      []string      `json:"finish-args"`
+	Modules         []interface{} `json:"modules"`
+}
+
+type Module struct {
+	Name          string   `json:"name"`
+	BuildSystem   string   `json:"buildsystem"`
+	Sources       []Source `json:"sources"`
+	BuildCommands []string `json:"build-commands"`
+}
+
+type Source struct {
+	Type string `json:"type"`
+	Path string `json:"path"`
+}
+
+// electron-builder defaults - X11 and Wayland, GPU, sound, network, notifications and home dir
+var defaultFinishArgs = []string{
+	"--socket=wayland",
+	"--socket=x11",
+	"--share=ipc",
+	"--device=dri",
+	"--socket=pulseaudio",
+	"--filesystem=home",
+	"--share=network",
+	"--talk-name=org.freedesktop.Notifications",
+}
+
+func applyDefaults(configuration *FlatpakConfiguration) {
+	if configuration.Runtime == "" {
+		configuration.Runtime = "org.freedesktop.Platform"
+	}
+	if configuration.RuntimeVersion == "" {
+		configuration.RuntimeVersion = "23.08"
+	}
+	if configuration.Sdk == "" {
+		configuration.Sdk = "org.freedesktop.Sdk"
+	}
+	if configuration.Base == "" {
+		// provides zypak - Chromium sandbox inside flatpak
+		configuration.Base = "org.electronjs.Electron2.BaseApp"
+		if configuration.BaseVersion == "" {
+			configuration.BaseVersion = configuration.RuntimeVersion
+		}
+	}
+	if configuration.Branch == "" {
+		configuration.Branch = "master"
+	}
+	if configuration.FinishArgs == nil {
+		configuration.FinishArgs = defaultFinishArgs
+	}
+}
+
+// app files are prepared in the stage dir (see prepareFiles), module only installs them to /app
+func createManifest(configuration *FlatpakConfiguration) *Manifest {
+	appId := configuration.AppId
+	appDir := "/app/lib/" + appId
+
+	buildCommands := []string{
+		"mkdir -p " + appDir,
+		"cp -a " + stageAppDirName + "/. " + appDir + "/",
+		"install -Dm755 " + launcherFileName + " /app/bin/" + configuration.ExecutableName,
+		"install -Dm644 " + appId + ".desktop /app/share/applications/" + appId + ".desktop",
+	}
+	for _, icon := range configuration.Icons {
+		buildCommands = append(buildCommands, fmt.Sprintf("install -Dm644 %s /app/share/icons/hicolor/%s/apps/%s%s", getStageIconFile(icon), getIconSizeDir(icon), appId, path.Ext(icon.File)))
+	}
+
+	modules := make([]interface{}, 0, len(configuration.Modules)+1)
+	modules = append(modules, configuration.Modules...)
+	modules = append(modules, &Module{
+		Name:          strings.ToLower(configuration.ExecutableName),
+		BuildSystem:   "simple",
+		Sources:       []Source{{Type: "dir", Path: stageFilesDirName}},
+		BuildCommands: buildCommands,
+	})
+
+	return &Manifest{
+		Id:             appId,
+		Runtime:        configuration.Runtime,
+		RuntimeVersion: configuration.RuntimeVersion,
+		Sdk:            configuration.Sdk,
+		Base:           configuration.Base,
+		BaseVersion:    configuration.BaseVersion,
+		Branch:         configuration.Branch,
+		Command:        configuration.ExecutableName,
+		FinishArgs:     configuration.FinishArgs,
+		Modules:        modules,
+	}
+}
+
+func getIconSizeDir(icon IconInfo) string {
+	if strings.HasSuffix(icon.File, ".svg") {
+		return "scalable"
+	}
+	return fmt.Sprintf("%dx%d", icon.Size, icon.Size)
+}
+
+func getStageIconFile(icon IconInfo) string {
+	return "icons/" + getIconSizeDir(icon) + path.Ext(icon.File)
+}
+
+func createDesktopEntry(configuration *FlatpakConfiguration) string {
+	if configuration.DesktopEntry != "" {
+		return configuration.DesktopEntry
+	}
+
+	return "[Desktop Entry]\n" +
+		"Name=" + configuration.ProductName + "\n" +
+		"Exec=" + configuration.ExecutableName + " %U\n" +
+		"Terminal=false\n" +
+		"Type=Application\n" +
+		"Icon=" + configuration.AppId + "\n"
+}
+
+// zypak-wrapper (provided by Electron base app) redirects Chromium sandbox to flatpak sandbox
+func createLauncher(configuration *FlatpakConfiguration) string {
+	return "#!/bin/sh\nexec zypak-wrapper /app/lib/" + configuration.AppId + "/" + configuration.ExecutableName + " \"$@\"\n"
+}
@@ -0,0 +1,244 @@
+package fpm
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+)
+
+var apkArchAliases = map[string]string{
+	"x64":    "x86_64",
+	"amd64":  "x86_64",
+	"ia32":   "x86",
+	"i386":   "x86",
+	"arm64":  "aarch64",
+	"armv7l": "armv7",
+	"armhf":  "armv7",
+	"all":    "noarch",
+}
+
+var apkScriptNames = map[string]string{
+	"before-install": ".pre-install",
+	"after-install":  ".post-install",
+	"before-remove":  ".pre-deinstall",
+	"after-remove":   ".post-deinstall",
+}
+
+// apk supports only known pre-release suffixes (_alpha1, _beta2, _rc3 and so on)
+var apkPreReleaseRegExp = regexp.MustCompile(`^(alpha|beta|pre|rc)[.-]?(\d*)$`)
+
+// apk (v2) is a concatenation of gzip streams: control tar (without end-of-archive blocks) and data tar, the same as abuild creates.
+// Package is not signed (apk add --allow-untrusted), signature is prepended by abuild-sign if needed.
+func buildApk(spec *packageSpec, files []*fileEntry, buildTime time.Time) error {
+	version, err := getApkVersion(spec)
+	if err != nil {
+		return err
+	}
+
+	dataFile, err := os.Create(spec.output + ".data")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		_ = dataFile.Close()
+		_ = os.Remove(dataFile.Name())
+	}()
+
+	dataHash := sha256.New()
+	gzipWriter, err := gzip.NewWriterLevel(io.MultiWriter(dataFile, dataHash), gzip.BestCompression)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = writeApkData(files, gzipWriter, buildTime)
+	if err != nil {
+		return err
+	}
+	err = gzipWriter.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	control, err := createApkControl(spec, version, files, hex.EncodeToString(dataHash.Sum(nil)), buildTime)
+	if err != nil {
+		return err
+	}
+
+	outFile, err := os.Create(spec.output)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(outFile)
+
+	_, err = outFile.Write(control)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = dataFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = io.Copy(outFile, dataFile)
+	return errors.WithStack(err)
+}
+
+// "1.0.0-beta.1" with iteration 2 is converted to "1.0.0_beta1-r2"
+func getApkVersion(spec *packageSpec) (string, error) {
+	version := spec.version
+	index := strings.IndexRune(version, '-')
+	if index > 0 {
+		match := apkPreReleaseRegExp.FindStringSubmatch(strings.ToLower(version[index+1:]))
+		if match == nil {
+			return "", util.NewMessageError("version "+version+" is not supported by apk (only alpha, beta, pre and rc pre-release suffixes are allowed)", "ERR_FPM_INVALID_VERSION")
+		}
+		version = version[:index] + "_" + match[1] + match[2]
+	}
+	return version + "-r" + orDefault(spec.iteration, "0"), nil
+}
+
+// each file has SHA1 checksum in PAX header (the same as abuild-tar --hash does), apk verifies it on install
+func writeApkData(files []*fileEntry, writer io.Writer, buildTime time.Time) error {
+	tarWriter := tar.NewWriter(writer)
+	for _, file := range files {
+		header := createTarHeader(file, file.path[1:], buildTime)
+		var checksum []byte
+		switch {
+		case file.linkTo != "":
+			sum := sha1.Sum([]byte(file.linkTo))
+			checksum = sum[:]
+		case file.source != "":
+			var err error
+			checksum, err = copyFile(file, ioutil.Discard, sha1.New())
+			if err != nil {
+				return err
+			}
+		}
+		if checksum != nil {
+			header.Format = tar.FormatPAX
+			header.PAXRecords = map[string]string{"APK-TOOLS.checksum.SHA1": hex.EncodeToString(checksum)}
+		}
+
+		err := tarWriter.WriteHeader(header)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if file.source != "" {
+			_, err = copyFile(file, tarWriter, sha1.New())
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return errors.WithStack(tarWriter.Close())
+}
+
+func createApkControl(spec *packageSpec, version string, files []*fileEntry, dataHash string, buildTime time.Time) ([]byte, error) {
+	var tarData bytes.Buffer
+	tarWriter := tar.NewWriter(&tarData)
+	addFile := func(name string, mode int64, data []byte) error {
+		err := tarWriter.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: mode, Size: int64(len(data)), ModTime: buildTime, Uname: "root", Gname: "root"})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		_, err = tarWriter.Write(data)
+		return errors.WithStack(err)
+	}
+
+	err := addFile(".PKGINFO", 0644, []byte(createApkPkgInfo(spec, version, files, dataHash, buildTime)))
+	if err != nil {
+		return nil, err
+	}
+	for _, scriptType := range []string{"before-install", "after-install", "before-remove", "after-remove"} {
+		script, err := readScript(spec.scripts[scriptType])
+		if err != nil {
+			return nil, err
+		}
+		if script != "" {
+			err = addFile(apkScriptNames[scriptType], 0755, []byte(script))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	// flush, but not close - control part must not have end-of-archive blocks (abuild-tar --cut)
+	err = tarWriter.Flush()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var result bytes.Buffer
+	gzipWriter, err := gzip.NewWriterLevel(&result, gzip.BestCompression)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	_, err = gzipWriter.Write(tarData.Bytes())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = gzipWriter.Close()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return result.Bytes(), nil
+}
+
+func createApkPkgInfo(spec *packageSpec, version string, files []*fileEntry, dataHash string, buildTime time.Time) string {
+	var size int64
+	for _, file := range files {
+		size += file.size
+	}
+
+	architecture := spec.architecture
+	if alias, ok := apkArchAliases[architecture]; ok {
+		architecture = alias
+	} else if architecture == "" {
+		architecture = "noarch"
+	}
+
+	summary, _ := splitDescription(spec.description)
+
+	var s strings.Builder
+	s.WriteString("# Generated by app-builder\n")
+	writeField := func(name string, value string) {
+		if value != "" {
+			s.WriteString(name + " = " + value + "\n")
+		}
+	}
+	writeField("pkgname", spec.name)
+	writeField("pkgver", version)
+	writeField("pkgdesc", orDefault(summary, spec.name))
+	writeField("url", spec.url)
+	writeField("builddate", strconv.FormatInt(buildTime.Unix(), 10))
+	writeField("packager", orDefault(spec.maintainer, "Unknown"))
+	writeField("size", strconv.FormatInt(size, 10))
+	writeField("arch", architecture)
+	writeField("origin", spec.name)
+	writeField("license", orDefault(spec.license, "unknown"))
+	for _, value := range spec.replaces {
+		writeField("replaces", formatCompactDependency(value))
+	}
+	for _, value := range spec.provides {
+		writeField("provides", formatCompactDependency(value))
+	}
+	for _, value := range spec.depends {
+		writeField("depend", formatCompactDependency(value))
+	}
+	// apk expresses conflicts as negative dependency
+	for _, value := range spec.conflicts {
+		writeField("depend", "!"+formatCompactDependency(value))
+	}
+	writeField("datahash", dataHash)
+	return s.String()
+}
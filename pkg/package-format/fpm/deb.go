@@ -0,0 +1,355 @@
+package fpm
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+var debScriptNames = map[string]string{
+	"before-install": "preinst",
+	"after-install":  "postinst",
+	"before-remove":  "prerm",
+	"after-remove":   "postrm",
+}
+
+var debArchAliases = map[string]string{
+	"x64":     "amd64",
+	"x86_64":  "amd64",
+	"ia32":    "i386",
+	"armv7l":  "armhf",
+	"aarch64": "arm64",
+}
+
+// deb is an ar archive: debian-binary, control.tar.gz (control, md5sums, maintainer scripts) and data.tar.<compression>
+func buildDeb(spec *packageSpec, files []*fileEntry, compression string, buildTime time.Time) error {
+	dataFile, err := os.Create(spec.output + ".data")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		_ = dataFile.Close()
+		_ = os.Remove(dataFile.Name())
+	}()
+
+	dataCompressor, extension, err := createCompressor(compression, dataFile)
+	if err != nil {
+		return err
+	}
+	md5sums, err := writeDebData(files, dataCompressor, buildTime)
+	if err != nil {
+		return err
+	}
+	err = dataCompressor.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	dataSize, err := dataFile.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = dataFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	control, err := createDebControlArchive(spec, files, md5sums, buildTime)
+	if err != nil {
+		return err
+	}
+
+	outFile, err := os.Create(spec.output)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(outFile)
+
+	_, err = outFile.WriteString("!<arch>\n")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	modTime := buildTime.Unix()
+	err = writeArMember(outFile, "debian-binary", modTime, int64(4), strings.NewReader("2.0\n"))
+	if err != nil {
+		return err
+	}
+	err = writeArMember(outFile, "control.tar.gz", modTime, int64(len(control)), bytes.NewReader(control))
+	if err != nil {
+		return err
+	}
+	return writeArMember(outFile, "data.tar"+extension, modTime, dataSize, dataFile)
+}
+
+func writeArMember(writer io.Writer, name string, modTime int64, size int64, reader io.Reader) error {
+	_, err := fmt.Fprintf(writer, "%-16s%-12d%-6d%-6d%-8s%-10d`\n", name, modTime, 0, 0, "100644", size)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = io.CopyN(writer, reader, size)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if size%2 != 0 {
+		_, err = writer.Write([]byte{'\n'})
+	}
+	return errors.WithStack(err)
+}
+
+// returns md5sums file content
+func writeDebData(files []*fileEntry, writer io.Writer, buildTime time.Time) ([]byte, error) {
+	tarWriter := tar.NewWriter(writer)
+	err := tarWriter.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "./", Mode: 0755, ModTime: buildTime, Uname: "root", Gname: "root"})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var md5sums bytes.Buffer
+	for _, file := range files {
+		err = tarWriter.WriteHeader(createTarHeader(file, "."+file.path, buildTime))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		if file.source != "" {
+			digest, err := copyFile(file, tarWriter, md5.New())
+			if err != nil {
+				return nil, err
+			}
+			md5sums.WriteString(hex.EncodeToString(digest) + "  " + file.path[1:] + "\n")
+		}
+	}
+	return md5sums.Bytes(), errors.WithStack(tarWriter.Close())
+}
+
+func createDebControlArchive(spec *packageSpec, files []*fileEntry, md5sums []byte, buildTime time.Time) ([]byte, error) {
+	var buffer bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buffer)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	addFile := func(name string, mode int64, data []byte) error {
+		err := tarWriter.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "./" + name, Mode: mode, Size: int64(len(data)), ModTime: buildTime, Uname: "root", Gname: "root"})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		_, err = tarWriter.Write(data)
+		return errors.WithStack(err)
+	}
+
+	err := tarWriter.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "./", Mode: 0755, ModTime: buildTime, Uname: "root", Gname: "root"})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = addFile("control", 0644, []byte(createDebControl(spec, files)))
+	if err != nil {
+		return nil, err
+	}
+	err = addFile("md5sums", 0644, md5sums)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, scriptType := range []string{"before-install", "after-install", "before-remove", "after-remove"} {
+		script, err := readScript(spec.scripts[scriptType])
+		if err != nil {
+			return nil, err
+		}
+		if script != "" {
+			err = addFile(debScriptNames[scriptType], 0755, []byte(script))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	err = tarWriter.Close()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = gzipWriter.Close()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return buffer.Bytes(), nil
+}
+
+func createDebControl(spec *packageSpec, files []*fileEntry) string {
+	version := spec.version
+	if spec.iteration != "" {
+		version += "-" + spec.iteration
+	}
+	if spec.epoch != "" {
+		version = spec.epoch + ":" + version
+	}
+
+	architecture := spec.architecture
+	if alias, ok := debArchAliases[architecture]; ok {
+		architecture = alias
+	} else if architecture == "" {
+		architecture = "all"
+	}
+
+	// the same as dpkg-gencontrol: size of each file rounded up to KiB, 1 KiB for each directory and symlink
+	var installedSize int64
+	for _, file := range files {
+		if file.source == "" {
+			installedSize++
+		} else {
+			installedSize += (file.size + 1023) / 1024
+		}
+	}
+
+	var s strings.Builder
+	writeField := func(name string, value string) {
+		if value != "" {
+			s.WriteString(name + ": " + value + "\n")
+		}
+	}
+	writeField("Package", spec.name)
+	writeField("Version", version)
+	writeField("License", spec.license)
+	writeField("Vendor", spec.vendor)
+	writeField("Architecture", architecture)
+	writeField("Maintainer", spec.maintainer)
+	writeField("Installed-Size", strconv.FormatInt(installedSize, 10))
+	writeField("Depends", formatDebDependencies(spec.depends))
+	writeField("Recommends", formatDebDependencies(spec.recommends))
+	writeField("Suggests", formatDebDependencies(spec.suggests))
+	writeField("Provides", formatDebDependencies(spec.provides))
+	writeField("Conflicts", formatDebDependencies(spec.conflicts))
+	writeField("Replaces", formatDebDependencies(spec.replaces))
+	writeField("Section", orDefault(spec.category, "default"))
+	writeField("Priority", orDefault(spec.priority, "optional"))
+	writeField("Homepage", spec.url)
+
+	summary, description := splitDescription(spec.description)
+	s.WriteString("Description: " + orDefault(summary, spec.name) + "\n")
+	if description != "" {
+		for _, line := range strings.Split(description, "\n") {
+			if line == "" {
+				line = "."
+			}
+			s.WriteString(" " + line + "\n")
+		}
+	}
+	return s.String()
+}
+
+// "name >= 1.0" is converted to "name (>= 1.0)", alternatives ("a | b") are preserved
+func formatDebDependencies(list []string) string {
+	result := make([]string, len(list))
+	for i, value := range list {
+		alternatives := strings.Split(value, "|")
+		for j, alternative := range alternatives {
+			name, operator, version := parseDependency(alternative)
+			if operator == "" {
+				alternatives[j] = name
+			} else {
+				if operator == ">" || operator == "<" {
+					// deb uses >> and << for strict comparison
+					operator += operator
+				}
+				alternatives[j] = name + " (" + operator + " " + version + ")"
+			}
+		}
+		result[i] = strings.Join(alternatives, " | ")
+	}
+	return strings.Join(result, ", ")
+}
+
+func orDefault(value string, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+// returns archive extension
+func createCompressor(compression string, writer io.Writer) (io.WriteCloser, string, error) {
+	switch compression {
+	case "xz":
+		result, err := xz.NewWriter(writer)
+		return result, ".xz", errors.WithStack(err)
+	case "gz", "gzip":
+		result, err := gzip.NewWriterLevel(writer, gzip.BestCompression)
+		return result, ".gz", errors.WithStack(err)
+	case "zstd", "zst":
+		result, err := zstd.NewWriter(writer, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+		return result, ".zst", errors.WithStack(err)
+	case "none":
+		return nopWriteCloser{writer}, "", nil
+	default:
+		return nil, "", util.NewMessageError("compression "+compression+" is not supported by native build, set --use-fpm to build using fpm", "ERR_FPM_UNSUPPORTED_COMPRESSION")
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// files are owned by root, name of directory is suffixed with slash
+func createTarHeader(file *fileEntry, name string, buildTime time.Time) *tar.Header {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    toUnixMode(file.mode) & 07777,
+		ModTime: getModTime(file, buildTime),
+		Uname:   "root",
+		Gname:   "root",
+	}
+	switch {
+	case file.mode.IsDir():
+		header.Typeflag = tar.TypeDir
+		header.Name += "/"
+	case file.linkTo != "":
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = file.linkTo
+	default:
+		header.Typeflag = tar.TypeReg
+		header.Size = file.size
+	}
+	return header
+}
+
+func getModTime(file *fileEntry, buildTime time.Time) time.Time {
+	if file.modTime.IsZero() {
+		return buildTime
+	}
+	return file.modTime
+}
+
+// copies file content to writer and returns digest computed by the hash
+func copyFile(file *fileEntry, writer io.Writer, hash hash.Hash) ([]byte, error) {
+	reader, err := os.Open(file.source)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer util.Close(reader)
+
+	n, err := io.Copy(io.MultiWriter(writer, hash), reader)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if n != file.size {
+		return nil, errors.Errorf("file %s was modified during packaging", file.source)
+	}
+	return hash.Sum(nil), nil
+}
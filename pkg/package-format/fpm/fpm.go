@@ -5,12 +5,15 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/alecthomas/kingpin"
 	"github.com/develar/app-builder/pkg/download"
 	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/reproducible"
 	"github.com/develar/app-builder/pkg/util"
 	"github.com/pkg/errors"
+	"go.uber.org/zap"
 )
 
 type FpmConfiguration struct {
@@ -24,9 +27,10 @@ type FpmConfiguration struct {
 }
 
 func ConfigureCommand(app *kingpin.Application) {
-	command := app.Command("fpm", "Build FPM targets.")
+	command := app.Command("fpm", "Build FPM targets (deb, rpm, pacman and apk are built natively if --use-fpm is not set).")
 
 	configurationJson := command.Flag("configuration", "").Required().String()
+	isUseFpm := command.Flag("use-fpm", "Build deb, rpm, pacman and apk using fpm (USE_FPM env is also supported).").Envar("USE_FPM").Bool()
 	command.Action(func(context *kingpin.ParseContext) error {
 		var configuration FpmConfiguration
 		err := util.DecodeBase64IfNeeded(*configurationJson, &configuration)
@@ -34,69 +38,143 @@ func ConfigureCommand(app *kingpin.Application) {
 			return err
 		}
 
-		var fpmPath string
-		if util.GetCurrentOs() == util.WINDOWS || util.IsEnvTrue("USE_SYSTEM_FPM") {
-			fpmPath = "fpm"
-		} else {
-			fpmDir, err := download.DownloadFpm()
-			if err != nil {
-				return err
-			}
-			fpmPath = filepath.Join(fpmDir, "fpm")
+		if !*isUseFpm && isNativeTarget(configuration.Target) {
+			return buildNative(&configuration)
 		}
+		return buildUsingFpm(&configuration)
+	})
+}
 
-		target := configuration.Target
-
-		// must be first
-		args := []string{"-s", "dir", "--force", "-t", target}
-		if util.IsEnvTrue("FPM_DEBUG") {
-			args = append(args, "--debug")
-		}
-		if log.IsDebugEnabled() {
-			args = append(args, "--log", "debug")
+func buildUsingFpm(configuration *FpmConfiguration) error {
+	var fpmPath string
+	if util.GetCurrentOs() == util.WINDOWS || util.IsEnvTrue("USE_SYSTEM_FPM") {
+		fpmPath = "fpm"
+	} else {
+		fpmDir, err := download.DownloadFpm()
+		if err != nil {
+			return err
 		}
-		args = configureDependencies(&configuration, target, args)
-		args = configureRecommendations(&configuration, target, args)
+		fpmPath = filepath.Join(fpmDir, "fpm")
+	}
 
-		compression := "xz"
-		if len(configuration.Compression) != 0 {
-			compression = configuration.Compression
-		}
+	target := configuration.Target
 
-		args = configureTargetSpecific(target, args, compression)
+	// must be first
+	args := []string{"-s", "dir", "--force", "-t", target}
+	if util.IsEnvTrue("FPM_DEBUG") {
+		args = append(args, "--debug")
+	}
+	if log.IsDebugEnabled() {
+		args = append(args, "--log", "debug")
+	}
+	args = configureDependencies(configuration, target, args)
+	args = configureRecommendations(configuration, target, args)
 
-		args = append(args, configuration.Args...)
+	args = configureTargetSpecific(target, args, getCompression(configuration))
 
-		command := exec.Command(fpmPath, args...)
+	args = append(args, configuration.Args...)
 
-		executablePath, err := os.Executable()
-		if err != nil {
-			return errors.WithStack(err)
+	command := exec.Command(fpmPath, args...)
+
+	executablePath, err := os.Executable()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	env := os.Environ()
+	env = append(env,
+		"SZA_ARCHIVE_TYPE=xz",
+		"FPM_COMPRESS_PROGRAM="+executablePath,
+	)
+	command.Env = env
+
+	_, err = util.Execute(command)
+	if err != nil {
+		if execError, ok := err.(*util.ExecError); ok && strings.Contains(string(execError.Output), `"Need executable 'rpmbuild' to convert dir to rpm"`) {
+			var installHint string
+			if util.GetCurrentOs() == util.MAC {
+				installHint = "brew install rpm"
+			} else {
+				installHint = "sudo apt-get install rpm"
+			}
+			log.LOG.Fatal("to build rpm, executable rpmbuild is required, please install: " + installHint)
 		}
+		return err
+	}
 
-		env := os.Environ()
-		env = append(env,
-			"SZA_ARCHIVE_TYPE=xz",
-			"FPM_COMPRESS_PROGRAM="+executablePath,
-		)
-		command.Env = env
+	return nil
+}
 
-		_, err = util.Execute(command)
-		if err != nil {
-			if execError, ok := err.(*util.ExecError); ok && strings.Contains(string(execError.Output), `"Need executable 'rpmbuild' to convert dir to rpm"`) {
-				var installHint string
-				if util.GetCurrentOs() == util.MAC {
-					installHint = "brew install rpm"
-				} else {
-					installHint = "sudo apt-get install rpm"
-				}
-				log.LOG.Fatal("to build rpm, executable rpmbuild is required, please install: " + installHint)
+func isNativeTarget(target string) bool {
+	return target == "deb" || target == "rpm" || target == "pacman" || target == "apk"
+}
+
+// the same args as for fpm are used to describe the package, dependencies and recommendations are set the same way as for fpm
+func buildNative(configuration *FpmConfiguration) error {
+	spec, err := parseArgs(configuration.Args)
+	if err != nil {
+		return err
+	}
+	if len(spec.unsupportedOptions) != 0 {
+		// custom fpm args of the user must not break the build
+		log.Info("fpm options are not supported by native build, fpm is used", zap.Strings("options", spec.unsupportedOptions))
+		return buildUsingFpm(configuration)
+	}
+
+	spec.depends = append(getDepends(configuration, configuration.Target), spec.depends...)
+	if configuration.Target == "deb" {
+		spec.recommends = append(getRecommends(configuration, configuration.Target), spec.recommends...)
+	}
+
+	files, err := collectFiles(spec.mappings)
+	if err != nil {
+		return err
+	}
+
+	buildTime, err := reproducible.GetBuildTime()
+	if err != nil {
+		return err
+	}
+
+	var report *reproducible.Report
+	if reproducible.IsEnabled() {
+		// files are already sorted and owned by root, only time is build-specific
+		report = reproducible.NewReport(spec.output, configuration.Target, buildTime)
+		for _, file := range files {
+			if !file.modTime.IsZero() && !file.modTime.Equal(buildTime) {
+				report.Add("mtime", 1)
 			}
-			return err
+			file.modTime = time.Time{}
 		}
+	}
 
-		return nil
-	})
+	switch configuration.Target {
+	case "rpm":
+		err = buildRpm(spec, files, getCompression(configuration), buildTime)
+	case "pacman":
+		err = buildPacman(spec, files, getCompression(configuration), buildTime)
+	case "apk":
+		err = buildApk(spec, files, buildTime)
+	default:
+		err = buildDeb(spec, files, getCompression(configuration), buildTime)
+	}
+	if err != nil {
+		_ = os.Remove(spec.output)
+		return err
+	}
+
+	log.Debug("package created", zap.String("file", spec.output), zap.Int("fileCount", len(files)))
+	if report != nil {
+		return report.Write()
+	}
+	return nil
+}
+
+func getCompression(configuration *FpmConfiguration) string {
+	if len(configuration.Compression) != 0 {
+		return configuration.Compression
+	}
+	return "xz"
 }
 
 func configureTargetSpecific(target string, args []string, compression string) []string {
@@ -117,11 +195,7 @@ func configureTargetSpecific(target string, args []string, compression string) [
 }
 
 func configureDependencies(configuration *FpmConfiguration, target string, args []string) []string {
-	depends := configuration.CustomDepends
-	if len(depends) == 0 {
-		depends = getDefaultDepends(target)
-	}
-	for _, value := range depends {
+	for _, value := range getDepends(configuration, target) {
 		args = append(args, "-d", value)
 	}
 	return args
@@ -129,17 +203,27 @@ func configureDependencies(configuration *FpmConfiguration, target string, args
 
 func configureRecommendations(configuration *FpmConfiguration, target string, args []string) []string {
 	if target == "deb" {
-		recommends := configuration.CustomRecommends
-		if len(recommends) == 0 {
-			recommends = getDefaultRecommends(target)
-		}
-		for _, value := range recommends {
+		for _, value := range getRecommends(configuration, target) {
 			args = append(args, "--deb-recommends", value)
 		}
 	}
 	return args
 }
 
+func getDepends(configuration *FpmConfiguration, target string) []string {
+	if len(configuration.CustomDepends) != 0 {
+		return configuration.CustomDepends
+	}
+	return getDefaultDepends(target)
+}
+
+func getRecommends(configuration *FpmConfiguration, target string) []string {
+	if len(configuration.CustomRecommends) != 0 {
+		return configuration.CustomRecommends
+	}
+	return getDefaultRecommends(target)
+}
+
 //noinspection SpellCheckingInspection
 func getDefaultDepends(target string) []string {
 	switch target {
@@ -156,6 +240,9 @@ func getDefaultDepends(target string) []string {
 			"libuuid",      /* since 4.0.0 */
 		}
 
+	case "apk":
+		return []string{"gtk+3.0", "libnotify", "nss", "libxscrnsaver", "libxtst", "xdg-utils", "at-spi2-core", "libuuid", "libsecret"}
+
 	case "pacman":
 		return []string{"c-ares", "ffmpeg", "gtk3", "http-parser", "libevent", "libvpx", "libxslt", "libxss", "minizip", "nss", "re2", "snappy", "libnotify", "libappindicator-gtk3"}
 
@@ -0,0 +1,406 @@
+package fpm
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/klauspost/compress/zstd"
+	. "github.com/onsi/gomega"
+	"github.com/ulikunitz/xz"
+)
+
+func createTestPackage(g *GomegaWithT, dir string, output string) *packageSpec {
+	appDir := filepath.Join(dir, "app")
+	g.Expect(os.MkdirAll(filepath.Join(appDir, "locales"), 0755)).To(Succeed())
+	g.Expect(ioutil.WriteFile(filepath.Join(appDir, "myapp"), []byte("binary"), 0700)).To(Succeed())
+	g.Expect(ioutil.WriteFile(filepath.Join(appDir, "locales", "en.pak"), []byte("en"), 0600)).To(Succeed())
+	g.Expect(os.Symlink("myapp", filepath.Join(appDir, "link"))).To(Succeed())
+	g.Expect(ioutil.WriteFile(filepath.Join(dir, "icon.png"), []byte("png"), 0644)).To(Succeed())
+	g.Expect(ioutil.WriteFile(filepath.Join(dir, "after-install.sh"), []byte("#!/bin/sh\necho installed\n"), 0644)).To(Succeed())
+
+	spec, err := parseArgs([]string{
+		"--name", "myapp", "--version", "1.0.0-beta.1", "--architecture", "x64",
+		"--description", "Synopsis\n Long description\n\n Second paragraph",
+		"--maintainer=Dev <dev@example.com>",
+		"--after-install", filepath.Join(dir, "after-install.sh"),
+		"--package", output,
+		"-d", "libc6 >= 2.17",
+		appDir + "/=/opt/MyApp",
+		filepath.Join(dir, "icon.png") + "=/usr/share/icons/hicolor/16x16/apps/myapp.png",
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	return spec
+}
+
+func TestParseArgs(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	spec, err := parseArgs([]string{"--name", "a", "--version", "1.0.0", "--package", "a.rpm", "--rpm-summary", "A app", "a=/opt/a"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(spec.summary).To(Equal("A app"))
+	g.Expect(spec.unsupportedOptions).To(BeEmpty())
+
+	// package is built using fpm
+	spec, err = parseArgs([]string{"--name", "a", "--version", "1.0.0", "--package", "a.deb", "--deb-field", "Bugs: https://example.com", "--rpm-auto-add-directories", "a=/opt/a"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(spec.unsupportedOptions).To(Equal([]string{"--deb-field", "--rpm-auto-add-directories"}))
+
+	_, err = parseArgs([]string{"--name", "a", "--version", "1.0.0", "a=/opt/a"})
+	g.Expect(err).To(HaveOccurred())
+
+	g.Expect(formatDebDependencies([]string{"libc6 >= 2.17", "libgtk-3-0", "a (> 1) | b"})).To(Equal("libc6 (>= 2.17), libgtk-3-0, a (>> 1) | b"))
+	g.Expect(parseRpmDependencies([]string{"libc6 (>= 2.17)", "gtk3"})).To(Equal([]rpmDependency{
+		{"libc6", rpmSenseGreater | rpmSenseEqual, "2.17"},
+		{"gtk3", 0, ""},
+	}))
+}
+
+func TestBuildDeb(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "fpm")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	output := filepath.Join(dir, "myapp.deb")
+	spec := createTestPackage(g, dir, output)
+	files, err := collectFiles(spec.mappings)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(buildDeb(spec, files, "xz", time.Now())).To(Succeed())
+
+	members := readArMembers(g, output)
+	g.Expect(string(members["debian-binary"])).To(Equal("2.0\n"))
+
+	control := readTarFiles(g, gzipReader(g, members["control.tar.gz"]))
+	g.Expect(string(control["./control"].data)).To(Equal("Package: myapp\n" +
+		"Version: 1.0.0-beta.1\n" +
+		"Architecture: amd64\n" +
+		"Maintainer: Dev <dev@example.com>\n" +
+		"Installed-Size: 13\n" +
+		"Depends: libc6 (>= 2.17)\n" +
+		"Section: default\n" +
+		"Priority: optional\n" +
+		"Description: Synopsis\n" +
+		" Long description\n" +
+		" .\n" +
+		" Second paragraph\n"))
+	g.Expect(control["./postinst"].header.Mode).To(Equal(int64(0755)))
+	binaryHash := md5.Sum([]byte("binary"))
+	g.Expect(string(control["./md5sums"].data)).To(ContainSubstring(hex.EncodeToString(binaryHash[:]) + "  opt/MyApp/myapp\n"))
+
+	xzReader, err := xz.NewReader(bytes.NewReader(members["data.tar.xz"]))
+	g.Expect(err).NotTo(HaveOccurred())
+	data := readTarFiles(g, xzReader)
+	g.Expect(data["./opt/MyApp/myapp"].header.Mode).To(Equal(int64(0755)))
+	g.Expect(data["./opt/MyApp/myapp"].header.Uname).To(Equal("root"))
+	g.Expect(data["./opt/MyApp/locales/en.pak"].header.Mode).To(Equal(int64(0644)))
+	g.Expect(data["./opt/MyApp/link"].header.Linkname).To(Equal("myapp"))
+	g.Expect(data).To(HaveKey("./usr/share/icons/hicolor/16x16/apps/"))
+	g.Expect(string(data["./usr/share/icons/hicolor/16x16/apps/myapp.png"].data)).To(Equal("png"))
+}
+
+func TestBuildRpm(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "fpm")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	output := filepath.Join(dir, "myapp.rpm")
+	spec := createTestPackage(g, dir, output)
+	files, err := collectFiles(spec.mappings)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(buildRpm(spec, files, "gz", time.Now())).To(Succeed())
+
+	data, err := ioutil.ReadFile(output)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(data[:4]).To(Equal([]byte{0xed, 0xab, 0xee, 0xdb}))
+	g.Expect(string(bytes.TrimRight(data[10:76], "\x00"))).To(Equal("myapp-1.0.0_beta.1-1"))
+
+	signature, signatureSize := readRpmHeader(g, data[96:], rpmTagHeaderSignatures)
+	headerStart := 96 + signatureSize
+	if headerStart%8 != 0 {
+		headerStart += 8 - headerStart%8
+	}
+	header, headerSize := readRpmHeader(g, data[headerStart:], rpmTagHeaderImmutable)
+	payload := data[headerStart+headerSize:]
+
+	headerSha256 := sha256.Sum256(data[headerStart : headerStart+headerSize])
+	g.Expect(signature[rpmSigTagSha256]).To(Equal([]string{hex.EncodeToString(headerSha256[:])}))
+	g.Expect(signature[rpmSigTagSize]).To(Equal([]string{strconv.Itoa(headerSize + len(payload))}))
+	md5Sum := md5.Sum(data[headerStart:])
+	g.Expect(signature[rpmSigTagMd5]).To(Equal([]string{string(md5Sum[:])}))
+
+	g.Expect(header[rpmTagName]).To(Equal([]string{"myapp"}))
+	g.Expect(header[rpmTagVersion]).To(Equal([]string{"1.0.0_beta.1"}))
+	g.Expect(header[rpmTagArch]).To(Equal([]string{"x86_64"}))
+	g.Expect(header[rpmTagSummary]).To(Equal([]string{"Synopsis"}))
+	g.Expect(header[rpmTagDescription]).To(Equal([]string{"Long description\n\nSecond paragraph"}))
+	g.Expect(header[rpmTagPostIn]).To(Equal([]string{"#!/bin/sh\necho installed\n"}))
+	g.Expect(header[rpmTagPayloadCompressor]).To(Equal([]string{"gzip"}))
+	g.Expect(header[rpmTagRequireName]).To(ContainElement("libc6"))
+	// parent dirs (/opt, /usr/share/icons) are not owned
+	g.Expect(header[rpmTagDirNames]).To(Equal([]string{"/opt/", "/opt/MyApp/", "/opt/MyApp/locales/", "/usr/share/icons/hicolor/16x16/apps/"}))
+	g.Expect(header[rpmTagBaseNames]).To(Equal([]string{"MyApp", "link", "locales", "en.pak", "myapp", "myapp.png"}))
+	g.Expect(header[rpmTagFileModes]).To(Equal([]string{
+		strconv.Itoa(040755), strconv.Itoa(0120777), strconv.Itoa(040755), strconv.Itoa(0100644), strconv.Itoa(0100755), strconv.Itoa(0100644),
+	}))
+	binaryHash := sha256.Sum256([]byte("binary"))
+	g.Expect(header[rpmTagFileDigests][4]).To(Equal(hex.EncodeToString(binaryHash[:])))
+
+	cpio, err := ioutil.ReadAll(gzipReader(g, payload))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(signature[rpmSigTagPayloadSize]).To(Equal([]string{strconv.Itoa(len(cpio))}))
+	g.Expect(string(cpio)).To(HavePrefix("070701"))
+	g.Expect(string(cpio)).To(ContainSubstring("./opt/MyApp/myapp\x00"))
+	g.Expect(string(cpio)).To(ContainSubstring("TRAILER!!!"))
+}
+
+// returns tag to values (numbers are formatted as decimal strings) and header size
+func readRpmHeader(g *GomegaWithT, data []byte, regionTag int32) (map[int32][]string, int) {
+	g.Expect(data[:4]).To(Equal([]byte{0x8e, 0xad, 0xe8, 0x01}))
+	indexCount := int(binary.BigEndian.Uint32(data[8:]))
+	storeSize := int(binary.BigEndian.Uint32(data[12:]))
+	store := data[16+indexCount*16 : 16+indexCount*16+storeSize]
+
+	result := make(map[int32][]string)
+	previousTag := int32(0)
+	for i := 0; i < indexCount; i++ {
+		entry := data[16+i*16:]
+		tag := int32(binary.BigEndian.Uint32(entry))
+		dataType := int32(binary.BigEndian.Uint32(entry[4:]))
+		offset := int(int32(binary.BigEndian.Uint32(entry[8:])))
+		count := int(binary.BigEndian.Uint32(entry[12:]))
+		g.Expect(tag).To(BeNumerically(">", previousTag))
+		previousTag = tag
+
+		if i == 0 {
+			// region trailer is the last 16 bytes of the store
+			g.Expect(tag).To(Equal(regionTag))
+			g.Expect(offset).To(Equal(storeSize - 16))
+			g.Expect(int32(binary.BigEndian.Uint32(store[offset+8:]))).To(Equal(int32(-16 * indexCount)))
+			continue
+		}
+
+		var values []string
+		switch dataType {
+		case rpmTypeInt16:
+			g.Expect(offset % 2).To(Equal(0))
+			for j := 0; j < count; j++ {
+				values = append(values, strconv.Itoa(int(binary.BigEndian.Uint16(store[offset+j*2:]))))
+			}
+		case rpmTypeInt32:
+			g.Expect(offset % 4).To(Equal(0))
+			for j := 0; j < count; j++ {
+				values = append(values, strconv.Itoa(int(int32(binary.BigEndian.Uint32(store[offset+j*4:])))))
+			}
+		case rpmTypeBinary:
+			values = []string{string(store[offset : offset+count])}
+		default:
+			values = strings.SplitN(string(store[offset:]), "\x00", count+1)[:count]
+		}
+		result[tag] = values
+	}
+	return result, 16 + indexCount*16 + storeSize
+}
+
+func readArMembers(g *GomegaWithT, file string) map[string][]byte {
+	data, err := ioutil.ReadFile(file)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(data[:8])).To(Equal("!<arch>\n"))
+
+	result := make(map[string][]byte)
+	for offset := 8; offset < len(data); {
+		name := strings.TrimSpace(string(data[offset : offset+16]))
+		size, err := strconv.Atoi(strings.TrimSpace(string(data[offset+48 : offset+58])))
+		g.Expect(err).NotTo(HaveOccurred())
+		offset += 60
+		result[name] = data[offset : offset+size]
+		offset += size + size%2
+	}
+	return result
+}
+
+type tarFile struct {
+	header *tar.Header
+	data   []byte
+}
+
+func readTarFiles(g *GomegaWithT, reader io.Reader) map[string]*tarFile {
+	result := make(map[string]*tarFile)
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return result
+		}
+		g.Expect(err).NotTo(HaveOccurred())
+		data, err := ioutil.ReadAll(tarReader)
+		g.Expect(err).NotTo(HaveOccurred())
+		result[header.Name] = &tarFile{header: header, data: data}
+	}
+}
+
+func gzipReader(g *GomegaWithT, data []byte) io.Reader {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	g.Expect(err).NotTo(HaveOccurred())
+	return reader
+}
+
+func TestBuildPacman(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "fpm")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	output := filepath.Join(dir, "myapp.pkg.tar.zst")
+	spec := createTestPackage(g, dir, output)
+	files, err := collectFiles(spec.mappings)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(buildPacman(spec, files, "xz", time.Unix(1600000000, 0))).To(Succeed())
+
+	data, err := ioutil.ReadFile(output)
+	g.Expect(err).NotTo(HaveOccurred())
+	zstdReader, err := zstd.NewReader(bytes.NewReader(data))
+	g.Expect(err).NotTo(HaveOccurred())
+	defer zstdReader.Close()
+
+	var names []string
+	tarReader := tar.NewReader(zstdReader)
+	entries := make(map[string][]byte)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		g.Expect(err).NotTo(HaveOccurred())
+		names = append(names, header.Name)
+		entries[header.Name], err = ioutil.ReadAll(tarReader)
+		g.Expect(err).NotTo(HaveOccurred())
+	}
+	g.Expect(names[:5]).To(Equal([]string{".INSTALL", ".MTREE", ".PKGINFO", "opt/", "opt/MyApp/"}))
+	g.Expect(string(entries[".PKGINFO"])).To(Equal("# Generated by app-builder\n" +
+		"pkgname = myapp\n" +
+		"pkgbase = myapp\n" +
+		"pkgver = 1.0.0_beta.1-1\n" +
+		"pkgdesc = Synopsis\n" +
+		"builddate = 1600000000\n" +
+		"packager = Dev <dev@example.com>\n" +
+		"size = 16\n" +
+		"arch = x86_64\n" +
+		"license = unknown\n" +
+		"depend = libc6>=2.17\n"))
+	g.Expect(string(entries[".INSTALL"])).To(Equal("post_install() {\n#!/bin/sh\necho installed\n}\n\npost_upgrade() {\n  post_install\n}\n\n"))
+
+	mtree, err := ioutil.ReadAll(gzipReader(g, entries[".MTREE"]))
+	g.Expect(err).NotTo(HaveOccurred())
+	binaryHash := sha256.Sum256([]byte("binary"))
+	g.Expect(string(mtree)).To(ContainSubstring("./opt/MyApp/myapp time="))
+	g.Expect(string(mtree)).To(ContainSubstring(" mode=755 size=6 md5digest="))
+	g.Expect(string(mtree)).To(ContainSubstring("sha256digest=" + hex.EncodeToString(binaryHash[:])))
+	g.Expect(string(mtree)).To(MatchRegexp(`\./opt/MyApp/link time=\d+\.0 mode=777 type=link link=myapp\n`))
+}
+
+func TestBuildApk(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "fpm")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	output := filepath.Join(dir, "myapp.apk")
+	spec := createTestPackage(g, dir, output)
+	files, err := collectFiles(spec.mappings)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(buildApk(spec, files, time.Unix(1600000000, 0))).To(Succeed())
+
+	data, err := ioutil.ReadFile(output)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// control is the first gzip stream
+	reader := bytes.NewReader(data)
+	controlReader, err := gzip.NewReader(reader)
+	g.Expect(err).NotTo(HaveOccurred())
+	controlReader.Multistream(false)
+	controlTar, err := ioutil.ReadAll(controlReader)
+	g.Expect(err).NotTo(HaveOccurred())
+	// no end-of-archive blocks
+	g.Expect(controlTar[len(controlTar)-512:]).NotTo(Equal(make([]byte, 512)))
+	control := readTarFiles(g, bytes.NewReader(append(controlTar, make([]byte, 1024)...)))
+
+	dataStream := data[len(data)-reader.Len():]
+	dataHash := sha256.Sum256(dataStream)
+	g.Expect(string(control[".PKGINFO"].data)).To(Equal("# Generated by app-builder\n" +
+		"pkgname = myapp\n" +
+		"pkgver = 1.0.0_beta1-r0\n" +
+		"pkgdesc = Synopsis\n" +
+		"builddate = 1600000000\n" +
+		"packager = Dev <dev@example.com>\n" +
+		"size = 16\n" +
+		"arch = x86_64\n" +
+		"origin = myapp\n" +
+		"license = unknown\n" +
+		"depend = libc6>=2.17\n" +
+		"datahash = " + hex.EncodeToString(dataHash[:]) + "\n"))
+	g.Expect(string(control[".post-install"].data)).To(Equal("#!/bin/sh\necho installed\n"))
+
+	dataFiles := readTarFiles(g, gzipReader(g, dataStream))
+	binaryHash := sha1.Sum([]byte("binary"))
+	g.Expect(dataFiles["opt/MyApp/myapp"].header.PAXRecords).To(HaveKeyWithValue("APK-TOOLS.checksum.SHA1", hex.EncodeToString(binaryHash[:])))
+	g.Expect(string(dataFiles["opt/MyApp/myapp"].data)).To(Equal("binary"))
+
+	_, err = getApkVersion(&packageSpec{version: "1.0.0-nightly.20200101"})
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestBuildReproducible(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	g.Expect(os.Setenv("SOURCE_DATE_EPOCH", "1600000000")).To(Succeed())
+	defer os.Unsetenv("SOURCE_DATE_EPOCH")
+
+	dir, err := ioutil.TempDir("", "fpm")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	targets := []string{"deb", "rpm", "pacman", "apk"}
+	build := func(target string) []byte {
+		output := filepath.Join(dir, "myapp."+target)
+		args := []string{"--name", "myapp", "--version", "1.0.0", "--package", output, filepath.Join(dir, target, "app") + "/=/opt/MyApp"}
+		g.Expect(buildNative(&FpmConfiguration{Target: target, Args: args})).To(Succeed())
+		data, err := ioutil.ReadFile(output)
+		g.Expect(err).NotTo(HaveOccurred())
+		return data
+	}
+
+	first := make(map[string][]byte)
+	for _, target := range targets {
+		createTestPackage(g, filepath.Join(dir, target), "unused")
+		first[target] = build(target)
+	}
+
+	// the second build is done later (build time differs) and with changed modification time
+	time.Sleep(1100 * time.Millisecond)
+	for _, target := range targets {
+		modTime := time.Now().Add(-time.Hour)
+		g.Expect(os.Chtimes(filepath.Join(dir, target, "app", "myapp"), modTime, modTime)).To(Succeed())
+		g.Expect(bytes.Equal(first[target], build(target))).To(BeTrue(), target)
+	}
+}
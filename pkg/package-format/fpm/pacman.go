@@ -0,0 +1,264 @@
+package fpm
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+)
+
+var pacmanArchAliases = map[string]string{
+	"x64":    "x86_64",
+	"amd64":  "x86_64",
+	"ia32":   "i686",
+	"arm64":  "aarch64",
+	"armv7l": "armv7h",
+	"armhf":  "armv7h",
+	"all":    "any",
+}
+
+// pacman install script is a set of functions
+var pacmanScriptFunctions = map[string]string{
+	"before-install": "pre_install",
+	"after-install":  "post_install",
+	"before-remove":  "pre_remove",
+	"after-remove":   "post_remove",
+}
+
+// compression is determined by the output file extension (.pkg.tar.zst since pacman 5.2), configured compression is used for unknown extension
+func getPacmanCompression(output string, compression string) string {
+	switch {
+	case strings.HasSuffix(output, ".zst"):
+		return "zstd"
+	case strings.HasSuffix(output, ".xz"):
+		return "xz"
+	case strings.HasSuffix(output, ".gz"):
+		return "gz"
+	default:
+		return compression
+	}
+}
+
+// package is a tar archive: .INSTALL, .MTREE and .PKGINFO (the same order as makepkg uses) and files without leading slash
+func buildPacman(spec *packageSpec, files []*fileEntry, compression string, buildTime time.Time) error {
+	installScript, err := createPacmanInstallScript(spec)
+	if err != nil {
+		return err
+	}
+
+	pkgInfo := []byte(createPacmanPkgInfo(spec, files, buildTime))
+
+	metaFiles := []*fileEntry{{path: "/.PKGINFO", mode: 0644, size: int64(len(pkgInfo))}}
+	metaData := map[string][]byte{"/.PKGINFO": pkgInfo}
+	if installScript != "" {
+		metaFiles = append([]*fileEntry{{path: "/.INSTALL", mode: 0644, size: int64(len(installScript))}}, metaFiles...)
+		metaData["/.INSTALL"] = []byte(installScript)
+	}
+
+	mtree, err := createPacmanMtree(metaFiles, metaData, files, buildTime)
+	if err != nil {
+		return err
+	}
+	mtreeFile := &fileEntry{path: "/.MTREE", mode: 0644, size: int64(len(mtree))}
+	metaData[mtreeFile.path] = mtree
+	// .MTREE is after .INSTALL and before .PKGINFO
+	metaFiles = append(metaFiles[:len(metaFiles)-1], mtreeFile, metaFiles[len(metaFiles)-1])
+
+	outFile, err := os.Create(spec.output)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(outFile)
+
+	compressor, _, err := createCompressor(getPacmanCompression(spec.output, compression), outFile)
+	if err != nil {
+		return err
+	}
+
+	tarWriter := tar.NewWriter(compressor)
+	for _, file := range metaFiles {
+		err = tarWriter.WriteHeader(createTarHeader(file, file.path[1:], buildTime))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		_, err = tarWriter.Write(metaData[file.path])
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	for _, file := range files {
+		err = tarWriter.WriteHeader(createTarHeader(file, file.path[1:], buildTime))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if file.source != "" {
+			_, err = copyFile(file, tarWriter, md5.New())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = tarWriter.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(compressor.Close())
+}
+
+func getPacmanVersion(spec *packageSpec) string {
+	// "-" is not allowed in pkgver
+	version := strings.Replace(spec.version, "-", "_", -1) + "-" + orDefault(spec.iteration, "1")
+	if spec.epoch != "" {
+		version = spec.epoch + ":" + version
+	}
+	return version
+}
+
+func createPacmanPkgInfo(spec *packageSpec, files []*fileEntry, buildTime time.Time) string {
+	var size int64
+	for _, file := range files {
+		size += file.size
+	}
+
+	architecture := spec.architecture
+	if alias, ok := pacmanArchAliases[architecture]; ok {
+		architecture = alias
+	} else if architecture == "" {
+		architecture = "any"
+	}
+
+	summary, _ := splitDescription(spec.description)
+
+	var s strings.Builder
+	s.WriteString("# Generated by app-builder\n")
+	writeField := func(name string, value string) {
+		if value != "" {
+			s.WriteString(name + " = " + value + "\n")
+		}
+	}
+	writeField("pkgname", spec.name)
+	writeField("pkgbase", spec.name)
+	writeField("pkgver", getPacmanVersion(spec))
+	writeField("pkgdesc", orDefault(summary, spec.name))
+	writeField("url", spec.url)
+	writeField("builddate", strconv.FormatInt(buildTime.Unix(), 10))
+	writeField("packager", orDefault(spec.maintainer, "Unknown Packager"))
+	writeField("size", strconv.FormatInt(size, 10))
+	writeField("arch", architecture)
+	writeField("license", orDefault(spec.license, "unknown"))
+	for _, list := range []struct {
+		name   string
+		values []string
+	}{{"replaces", spec.replaces}, {"conflict", spec.conflicts}, {"provides", spec.provides}, {"depend", spec.depends}} {
+		for _, value := range list.values {
+			writeField(list.name, formatCompactDependency(value))
+		}
+	}
+	return s.String()
+}
+
+// script content is used as function body, post_upgrade calls post_install (the same as fpm does)
+func createPacmanInstallScript(spec *packageSpec) (string, error) {
+	var s strings.Builder
+	for _, scriptType := range []string{"before-install", "after-install", "before-remove", "after-remove"} {
+		script, err := readScript(spec.scripts[scriptType])
+		if err != nil {
+			return "", err
+		}
+		if script == "" {
+			continue
+		}
+
+		function := pacmanScriptFunctions[scriptType]
+		s.WriteString(function + "() {\n" + strings.TrimRight(script, "\n") + "\n}\n\n")
+		if function == "post_install" {
+			s.WriteString("post_upgrade() {\n  post_install\n}\n\n")
+		}
+	}
+	return s.String(), nil
+}
+
+// .MTREE is used by pacman to verify installed files (pacman -Qkk), gzip compressed mtree
+func createPacmanMtree(metaFiles []*fileEntry, metaData map[string][]byte, files []*fileEntry, buildTime time.Time) ([]byte, error) {
+	var s strings.Builder
+	s.WriteString("#mtree\n/set type=file uid=0 gid=0 mode=644\n")
+
+	writeEntry := func(file *fileEntry, data []byte) error {
+		s.WriteString("." + escapeMtreePath(file.path))
+		s.WriteString(fmt.Sprintf(" time=%d.0", getModTime(file, buildTime).Unix()))
+		switch {
+		case file.mode.IsDir():
+			s.WriteString(fmt.Sprintf(" mode=%o type=dir", toUnixMode(file.mode)&07777))
+		case file.linkTo != "":
+			s.WriteString(" mode=777 type=link link=" + escapeMtreePath(file.linkTo))
+		default:
+			if toUnixMode(file.mode)&07777 != 0644 {
+				s.WriteString(fmt.Sprintf(" mode=%o", toUnixMode(file.mode)&07777))
+			}
+			md5Hash := md5.New()
+			sha256Hash := sha256.New()
+			if data == nil {
+				_, err := copyFile(file, md5Hash, sha256Hash)
+				if err != nil {
+					return err
+				}
+			} else {
+				_, _ = io.MultiWriter(md5Hash, sha256Hash).Write(data)
+			}
+			s.WriteString(fmt.Sprintf(" size=%d md5digest=%s sha256digest=%s", file.size, hex.EncodeToString(md5Hash.Sum(nil)), hex.EncodeToString(sha256Hash.Sum(nil))))
+		}
+		s.WriteString("\n")
+		return nil
+	}
+
+	for _, file := range metaFiles {
+		err := writeEntry(file, metaData[file.path])
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, file := range files {
+		err := writeEntry(file, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var buffer bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buffer)
+	_, err := gzipWriter.Write([]byte(s.String()))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = gzipWriter.Close()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return buffer.Bytes(), nil
+}
+
+// mtree uses octal escapes for whitespace, non-printable characters and backslash
+func escapeMtreePath(value string) string {
+	var s strings.Builder
+	for _, b := range []byte(value) {
+		if b <= ' ' || b >= 0x7f || b == '\\' || b == '#' || b == '=' {
+			s.WriteString(fmt.Sprintf("\\%03o", b))
+		} else {
+			s.WriteByte(b)
+		}
+	}
+	return s.String()
+}
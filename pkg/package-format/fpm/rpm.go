@@ -0,0 +1,531 @@
+package fpm
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+)
+
+// https://github.com/rpm-software-management/rpm/blob/master/include/rpm/rpmtag.h
+const (
+	rpmSigTagSha1        = 269
+	rpmSigTagSha256      = 273
+	rpmSigTagSize        = 1000
+	rpmSigTagMd5         = 1004
+	rpmSigTagPayloadSize = 1007
+
+	rpmTagI18nTable         = 100
+	rpmTagName              = 1000
+	rpmTagVersion           = 1001
+	rpmTagRelease           = 1002
+	rpmTagEpoch             = 1003
+	rpmTagSummary           = 1004
+	rpmTagDescription       = 1005
+	rpmTagBuildTime         = 1006
+	rpmTagBuildHost         = 1007
+	rpmTagSize              = 1009
+	rpmTagVendor            = 1011
+	rpmTagLicense           = 1014
+	rpmTagPackager          = 1015
+	rpmTagGroup             = 1016
+	rpmTagUrl               = 1020
+	rpmTagOs                = 1021
+	rpmTagArch              = 1022
+	rpmTagPreIn             = 1023
+	rpmTagPostIn            = 1024
+	rpmTagPreUn             = 1025
+	rpmTagPostUn            = 1026
+	rpmTagFileSizes         = 1028
+	rpmTagFileModes         = 1030
+	rpmTagFileRdevs         = 1033
+	rpmTagFileMtimes        = 1034
+	rpmTagFileDigests       = 1035
+	rpmTagFileLinkTos       = 1036
+	rpmTagFileFlags         = 1037
+	rpmTagFileUserName      = 1039
+	rpmTagFileGroupName     = 1040
+	rpmTagSourceRpm         = 1044
+	rpmTagProvideName       = 1047
+	rpmTagRequireFlags      = 1048
+	rpmTagRequireName       = 1049
+	rpmTagRequireVersion    = 1050
+	rpmTagConflictFlags     = 1053
+	rpmTagConflictName      = 1054
+	rpmTagConflictVersion   = 1055
+	rpmTagPreInProg         = 1085
+	rpmTagPostInProg        = 1086
+	rpmTagPreUnProg         = 1087
+	rpmTagPostUnProg        = 1088
+	rpmTagObsoleteName      = 1090
+	rpmTagFileDevices       = 1095
+	rpmTagFileInodes        = 1096
+	rpmTagFileLangs         = 1097
+	rpmTagProvideFlags      = 1112
+	rpmTagProvideVersion    = 1113
+	rpmTagObsoleteFlags     = 1114
+	rpmTagObsoleteVersion   = 1115
+	rpmTagDirIndexes        = 1116
+	rpmTagBaseNames         = 1117
+	rpmTagDirNames          = 1118
+	rpmTagPayloadFormat     = 1124
+	rpmTagPayloadCompressor = 1125
+	rpmTagPayloadFlags      = 1126
+	rpmTagFileDigestAlgo    = 5011
+
+	rpmSenseLess    = 1 << 1
+	rpmSenseGreater = 1 << 2
+	rpmSenseEqual   = 1 << 3
+	rpmSenseRpmLib  = 1 << 24
+
+	rpmDigestAlgoSha256 = 8
+)
+
+var rpmArchAliases = map[string]string{
+	"x64":    "x86_64",
+	"amd64":  "x86_64",
+	"ia32":   "i386",
+	"arm64":  "aarch64",
+	"armv7l": "armv7hl",
+	"armhf":  "armv7hl",
+}
+
+type rpmCompressor struct {
+	name    string
+	flags   string
+	feature rpmDependency
+}
+
+type rpmDependency struct {
+	name    string
+	flags   int32
+	version string
+}
+
+// rpm payload is not an arbitrary compression - rpm must support it (zstd since rpm 4.14)
+var rpmCompressors = map[string]rpmCompressor{
+	"xz":   {"xz", "6", rpmDependency{"rpmlib(PayloadIsXz)", rpmSenseRpmLib | rpmSenseLess | rpmSenseEqual, "5.2-1"}},
+	"gz":   {"gzip", "9", rpmDependency{}},
+	"gzip": {"gzip", "9", rpmDependency{}},
+	"zstd": {"zstd", "19", rpmDependency{"rpmlib(PayloadIsZstd)", rpmSenseRpmLib | rpmSenseLess | rpmSenseEqual, "5.4.18-1"}},
+}
+
+// rpm is lead, signature header, header and compressed cpio payload.
+// Payload is written first (to temp file) because header contains file digests and signature contains digests of header and payload.
+func buildRpm(spec *packageSpec, files []*fileEntry, compression string, buildTime time.Time) error {
+	compressor, ok := rpmCompressors[compression]
+	if !ok {
+		return util.NewMessageError("compression "+compression+" is not supported by native rpm build, set --use-fpm to build using fpm", "ERR_FPM_UNSUPPORTED_COMPRESSION")
+	}
+
+	// only own directories are listed in rpm, otherwise package conflicts with filesystem package (e.g. /usr/share/icons)
+	var packageFiles []*fileEntry
+	for _, file := range files {
+		if !file.mode.IsDir() || file.isOwnDir {
+			packageFiles = append(packageFiles, file)
+		}
+	}
+
+	payloadFile, err := os.Create(spec.output + ".payload")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		_ = payloadFile.Close()
+		_ = os.Remove(payloadFile.Name())
+	}()
+
+	payloadWriter, _, err := createCompressor(compression, payloadFile)
+	if err != nil {
+		return err
+	}
+	digests, payloadSize, err := writeCpio(packageFiles, payloadWriter, buildTime)
+	if err != nil {
+		return err
+	}
+	err = payloadWriter.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	compressedPayloadSize, err := payloadFile.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	header, err := createRpmHeader(spec, packageFiles, digests, compressor, buildTime)
+	if err != nil {
+		return err
+	}
+
+	if int64(len(header))+compressedPayloadSize > math.MaxInt32 || payloadSize > math.MaxInt32 {
+		return util.NewMessageError("package is too large for native rpm build (more than 2 GB), set --use-fpm to build using fpm", "ERR_FPM_RPM_TOO_LARGE")
+	}
+
+	// md5 of header and payload
+	_, err = payloadFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	md5Hash := md5.New()
+	md5Hash.Write(header)
+	_, err = io.Copy(md5Hash, payloadFile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	sha1Sum := sha1.Sum(header)
+	sha256Sum := sha256.Sum256(header)
+	signature := &rpmHeader{}
+	signature.addString(rpmSigTagSha1, hex.EncodeToString(sha1Sum[:]))
+	signature.addString(rpmSigTagSha256, hex.EncodeToString(sha256Sum[:]))
+	signature.addInt32(rpmSigTagSize, int32(int64(len(header))+compressedPayloadSize))
+	signature.addBinary(rpmSigTagMd5, md5Hash.Sum(nil))
+	signature.addInt32(rpmSigTagPayloadSize, int32(payloadSize))
+	signatureData := signature.bytes(rpmTagHeaderSignatures)
+	// signature header is padded to 8 bytes
+	if len(signatureData)%8 != 0 {
+		signatureData = append(signatureData, make([]byte, 8-len(signatureData)%8)...)
+	}
+
+	outFile, err := os.Create(spec.output)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(outFile)
+
+	for _, data := range [][]byte{createRpmLead(spec), signatureData, header} {
+		_, err = outFile.Write(data)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	_, err = payloadFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = io.Copy(outFile, payloadFile)
+	return errors.WithStack(err)
+}
+
+func getRpmVersion(spec *packageSpec) (string, string) {
+	// "-" is not allowed in rpm version (the same conversion as fpm does)
+	version := strings.Replace(spec.version, "-", "_", -1)
+	release := spec.iteration
+	if release == "" {
+		release = "1"
+	}
+	return version, release
+}
+
+func getRpmArch(spec *packageSpec) string {
+	if alias, ok := rpmArchAliases[spec.architecture]; ok {
+		return alias
+	}
+	if spec.architecture == "" || spec.architecture == "all" {
+		return "noarch"
+	}
+	return spec.architecture
+}
+
+// lead is obsolete, but still must be present
+func createRpmLead(spec *packageSpec) []byte {
+	version, release := getRpmVersion(spec)
+	lead := make([]byte, 96)
+	copy(lead, []byte{0xed, 0xab, 0xee, 0xdb, 3, 0})
+	// type binary (0), arch 1
+	binary.BigEndian.PutUint16(lead[6:], 0)
+	binary.BigEndian.PutUint16(lead[8:], 1)
+	name := spec.name + "-" + version + "-" + release
+	if len(name) > 65 {
+		name = name[:65]
+	}
+	copy(lead[10:], name)
+	// os linux, signature type header signature
+	binary.BigEndian.PutUint16(lead[76:], 1)
+	binary.BigEndian.PutUint16(lead[78:], 5)
+	return lead
+}
+
+func createRpmHeader(spec *packageSpec, files []*fileEntry, digests []string, compressor rpmCompressor, buildTime time.Time) ([]byte, error) {
+	version, release := getRpmVersion(spec)
+	arch := getRpmArch(spec)
+	summary, description := splitDescription(spec.description)
+	if spec.summary != "" {
+		// the same as fpm - description is not split if summary is specified explicitly
+		summary = spec.summary
+		description = strings.TrimSpace(spec.description)
+	}
+
+	header := &rpmHeader{}
+	header.addStringArray(rpmTagI18nTable, []string{"C"})
+	header.addString(rpmTagName, spec.name)
+	header.addString(rpmTagVersion, version)
+	header.addString(rpmTagRelease, release)
+	if spec.epoch != "" {
+		var epoch int32
+		_, err := fmt.Sscanf(spec.epoch, "%d", &epoch)
+		if err != nil {
+			return nil, util.NewMessageError("epoch "+spec.epoch+" is not a number", "ERR_FPM_INVALID_ARGS")
+		}
+		header.addInt32(rpmTagEpoch, epoch)
+	}
+	header.addI18nString(rpmTagSummary, orDefault(summary, spec.name))
+	header.addI18nString(rpmTagDescription, orDefault(description, orDefault(summary, spec.name)))
+	header.addInt32(rpmTagBuildTime, int32(buildTime.Unix()))
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	header.addString(rpmTagBuildHost, hostname)
+	header.addString(rpmTagVendor, orDefault(spec.vendor, "none"))
+	header.addString(rpmTagLicense, orDefault(spec.license, "unknown"))
+	if spec.maintainer != "" {
+		header.addString(rpmTagPackager, spec.maintainer)
+	}
+	header.addI18nString(rpmTagGroup, orDefault(spec.category, "default"))
+	if spec.url != "" {
+		header.addString(rpmTagUrl, spec.url)
+	}
+	header.addString(rpmTagOs, "linux")
+	header.addString(rpmTagArch, arch)
+	// binary package is identified by presence of source rpm tag
+	header.addString(rpmTagSourceRpm, spec.name+"-"+version+"-"+release+".src.rpm")
+
+	err = addRpmScripts(header, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	addRpmFiles(header, files, digests, buildTime)
+
+	requires := []rpmDependency{
+		{"rpmlib(CompressedFileNames)", rpmSenseRpmLib | rpmSenseLess | rpmSenseEqual, "3.0.4-1"},
+		{"rpmlib(FileDigests)", rpmSenseRpmLib | rpmSenseLess | rpmSenseEqual, "4.6.0-1"},
+		{"rpmlib(PayloadFilesHavePrefix)", rpmSenseRpmLib | rpmSenseLess | rpmSenseEqual, "4.0-1"},
+	}
+	if compressor.feature.name != "" {
+		requires = append(requires, compressor.feature)
+	}
+	requires = append(requires, parseRpmDependencies(spec.depends)...)
+	addRpmDependencies(header, rpmTagRequireName, rpmTagRequireFlags, rpmTagRequireVersion, requires)
+
+	provides := append([]rpmDependency{{spec.name, rpmSenseEqual, version + "-" + release}}, parseRpmDependencies(spec.provides)...)
+	addRpmDependencies(header, rpmTagProvideName, rpmTagProvideFlags, rpmTagProvideVersion, provides)
+	if len(spec.conflicts) != 0 {
+		addRpmDependencies(header, rpmTagConflictName, rpmTagConflictFlags, rpmTagConflictVersion, parseRpmDependencies(spec.conflicts))
+	}
+	if len(spec.replaces) != 0 {
+		addRpmDependencies(header, rpmTagObsoleteName, rpmTagObsoleteFlags, rpmTagObsoleteVersion, parseRpmDependencies(spec.replaces))
+	}
+
+	header.addString(rpmTagPayloadFormat, "cpio")
+	header.addString(rpmTagPayloadCompressor, compressor.name)
+	header.addString(rpmTagPayloadFlags, compressor.flags)
+	return header.bytes(rpmTagHeaderImmutable), nil
+}
+
+func addRpmScripts(header *rpmHeader, spec *packageSpec) error {
+	scriptTags := []struct {
+		scriptType string
+		tag        int32
+		programTag int32
+	}{
+		{"before-install", rpmTagPreIn, rpmTagPreInProg},
+		{"after-install", rpmTagPostIn, rpmTagPostInProg},
+		{"before-remove", rpmTagPreUn, rpmTagPreUnProg},
+		{"after-remove", rpmTagPostUn, rpmTagPostUnProg},
+	}
+	for _, item := range scriptTags {
+		script, err := readScript(spec.scripts[item.scriptType])
+		if err != nil {
+			return err
+		}
+		if script != "" {
+			header.addString(item.tag, script)
+			header.addString(item.programTag, "/bin/sh")
+		}
+	}
+	return nil
+}
+
+func addRpmFiles(header *rpmHeader, files []*fileEntry, digests []string, buildTime time.Time) {
+	count := len(files)
+	sizes := make([]int32, count)
+	modes := make([]int16, count)
+	rdevs := make([]int16, count)
+	mtimes := make([]int32, count)
+	linkTos := make([]string, count)
+	flags := make([]int32, count)
+	users := make([]string, count)
+	groups := make([]string, count)
+	devices := make([]int32, count)
+	inodes := make([]int32, count)
+	langs := make([]string, count)
+	dirIndexes := make([]int32, count)
+	baseNames := make([]string, count)
+	var dirNames []string
+	dirNameToIndex := make(map[string]int32)
+
+	var totalSize int64
+	for i, file := range files {
+		sizes[i] = int32(file.size)
+		totalSize += file.size
+		modes[i] = int16(uint16(toUnixMode(file.mode)))
+		mtimes[i] = int32(getModTime(file, buildTime).Unix())
+		linkTos[i] = file.linkTo
+		users[i] = "root"
+		groups[i] = "root"
+		devices[i] = 1
+		inodes[i] = int32(i + 1)
+
+		dir := path.Dir(file.path)
+		if dir != "/" {
+			dir += "/"
+		}
+		dirIndex, ok := dirNameToIndex[dir]
+		if !ok {
+			dirIndex = int32(len(dirNames))
+			dirNames = append(dirNames, dir)
+			dirNameToIndex[dir] = dirIndex
+		}
+		dirIndexes[i] = dirIndex
+		baseNames[i] = path.Base(file.path)
+	}
+
+	header.addInt32(rpmTagSize, int32(totalSize))
+	header.addInt32(rpmTagFileSizes, sizes...)
+	header.addInt16(rpmTagFileModes, modes...)
+	header.addInt16(rpmTagFileRdevs, rdevs...)
+	header.addInt32(rpmTagFileMtimes, mtimes...)
+	header.addStringArray(rpmTagFileDigests, digests)
+	header.addStringArray(rpmTagFileLinkTos, linkTos)
+	header.addInt32(rpmTagFileFlags, flags...)
+	header.addStringArray(rpmTagFileUserName, users)
+	header.addStringArray(rpmTagFileGroupName, groups)
+	header.addInt32(rpmTagFileDevices, devices...)
+	header.addInt32(rpmTagFileInodes, inodes...)
+	header.addStringArray(rpmTagFileLangs, langs)
+	header.addInt32(rpmTagDirIndexes, dirIndexes...)
+	header.addStringArray(rpmTagBaseNames, baseNames)
+	header.addStringArray(rpmTagDirNames, dirNames)
+	header.addInt32(rpmTagFileDigestAlgo, rpmDigestAlgoSha256)
+}
+
+func parseRpmDependencies(list []string) []rpmDependency {
+	result := make([]rpmDependency, 0, len(list))
+	for _, value := range list {
+		name, operator, version := parseDependency(value)
+		var flags int32
+		switch operator {
+		case "<", "<<":
+			flags = rpmSenseLess
+		case ">", ">>":
+			flags = rpmSenseGreater
+		case "=", "==":
+			flags = rpmSenseEqual
+		case "<=":
+			flags = rpmSenseLess | rpmSenseEqual
+		case ">=":
+			flags = rpmSenseGreater | rpmSenseEqual
+		}
+		result = append(result, rpmDependency{name: name, flags: flags, version: version})
+	}
+	return result
+}
+
+func addRpmDependencies(header *rpmHeader, nameTag int32, flagsTag int32, versionTag int32, list []rpmDependency) {
+	names := make([]string, len(list))
+	flags := make([]int32, len(list))
+	versions := make([]string, len(list))
+	for i, item := range list {
+		names[i] = item.name
+		flags[i] = item.flags
+		versions[i] = item.version
+	}
+	header.addStringArray(nameTag, names)
+	header.addInt32(flagsTag, flags...)
+	header.addStringArray(versionTag, versions)
+}
+
+// cpio "new ASCII" format, file names are prefixed with "./". Returns hex sha256 digests of files (empty for directories and symlinks) and uncompressed size.
+func writeCpio(files []*fileEntry, writer io.Writer, buildTime time.Time) ([]string, int64, error) {
+	counter := &countingWriter{writer: writer}
+	digests := make([]string, len(files))
+	for i, file := range files {
+		nlink := 1
+		if file.mode.IsDir() {
+			nlink = 2
+		}
+		err := writeCpioHeader(counter, "."+file.path, i+1, toUnixMode(file.mode), nlink, getModTime(file, buildTime).Unix(), file.size)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		switch {
+		case file.linkTo != "":
+			_, err = counter.Write([]byte(file.linkTo))
+		case file.source != "":
+			var digest []byte
+			digest, err = copyFile(file, counter, sha256.New())
+			digests[i] = hex.EncodeToString(digest)
+		}
+		if err != nil {
+			return nil, 0, errors.WithStack(err)
+		}
+
+		err = writeCpioPadding(counter)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	err := writeCpioHeader(counter, "TRAILER!!!", 0, 0, 1, 0, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	return digests, counter.size, nil
+}
+
+func writeCpioHeader(writer *countingWriter, name string, inode int, mode int64, nlink int, modTime int64, size int64) error {
+	var buffer bytes.Buffer
+	_, _ = fmt.Fprintf(&buffer, "070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X", inode, mode, 0, 0, nlink, modTime, size, 0, 0, 0, 0, len(name)+1, 0)
+	buffer.WriteString(name)
+	buffer.WriteByte(0)
+	_, err := writer.Write(buffer.Bytes())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return writeCpioPadding(writer)
+}
+
+func writeCpioPadding(writer *countingWriter) error {
+	if writer.size%4 == 0 {
+		return nil
+	}
+	_, err := writer.Write(make([]byte, 4-writer.size%4))
+	return errors.WithStack(err)
+}
+
+type countingWriter struct {
+	writer io.Writer
+	size   int64
+}
+
+func (t *countingWriter) Write(p []byte) (int, error) {
+	n, err := t.writer.Write(p)
+	t.size += int64(n)
+	return n, err
+}
@@ -0,0 +1,131 @@
+package fpm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+)
+
+const (
+	rpmTypeInt16       = 3
+	rpmTypeInt32       = 4
+	rpmTypeString      = 6
+	rpmTypeBinary      = 7
+	rpmTypeStringArray = 8
+	rpmTypeI18nString  = 9
+
+	// region tags
+	rpmTagHeaderSignatures = 62
+	rpmTagHeaderImmutable  = 63
+)
+
+type rpmEntry struct {
+	tag      int32
+	dataType int32
+	count    int32
+	data     []byte
+}
+
+// rpmHeader is a header structure (used for both signature and main headers): index entries sorted by tag and data store.
+// Region tag is the first index entry, its trailer (pointing back to the index start) is the last data item.
+type rpmHeader struct {
+	entries []*rpmEntry
+}
+
+func (t *rpmHeader) addString(tag int32, value string) {
+	t.entries = append(t.entries, &rpmEntry{tag: tag, dataType: rpmTypeString, count: 1, data: append([]byte(value), 0)})
+}
+
+func (t *rpmHeader) addI18nString(tag int32, value string) {
+	t.entries = append(t.entries, &rpmEntry{tag: tag, dataType: rpmTypeI18nString, count: 1, data: append([]byte(value), 0)})
+}
+
+func (t *rpmHeader) addStringArray(tag int32, values []string) {
+	var data []byte
+	for _, value := range values {
+		data = append(append(data, value...), 0)
+	}
+	t.entries = append(t.entries, &rpmEntry{tag: tag, dataType: rpmTypeStringArray, count: int32(len(values)), data: data})
+}
+
+func (t *rpmHeader) addInt32(tag int32, values ...int32) {
+	data := make([]byte, 4*len(values))
+	for i, value := range values {
+		binary.BigEndian.PutUint32(data[i*4:], uint32(value))
+	}
+	t.entries = append(t.entries, &rpmEntry{tag: tag, dataType: rpmTypeInt32, count: int32(len(values)), data: data})
+}
+
+func (t *rpmHeader) addInt16(tag int32, values ...int16) {
+	data := make([]byte, 2*len(values))
+	for i, value := range values {
+		binary.BigEndian.PutUint16(data[i*2:], uint16(value))
+	}
+	t.entries = append(t.entries, &rpmEntry{tag: tag, dataType: rpmTypeInt16, count: int32(len(values)), data: data})
+}
+
+func (t *rpmHeader) addBinary(tag int32, data []byte) {
+	t.entries = append(t.entries, &rpmEntry{tag: tag, dataType: rpmTypeBinary, count: int32(len(data)), data: data})
+}
+
+func (t *rpmHeader) bytes(regionTag int32) []byte {
+	entries := make([]*rpmEntry, len(t.entries))
+	copy(entries, t.entries)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].tag < entries[j].tag
+	})
+
+	indexCount := len(entries) + 1
+
+	var store bytes.Buffer
+	index := make([]byte, 0, indexCount*16)
+	appendIndexEntry := func(tag int32, dataType int32, offset int32, count int32) {
+		var entry [16]byte
+		binary.BigEndian.PutUint32(entry[0:], uint32(tag))
+		binary.BigEndian.PutUint32(entry[4:], uint32(dataType))
+		binary.BigEndian.PutUint32(entry[8:], uint32(offset))
+		binary.BigEndian.PutUint32(entry[12:], uint32(count))
+		index = append(index, entry[:]...)
+	}
+
+	for _, entry := range entries {
+		alignment := 1
+		switch entry.dataType {
+		case rpmTypeInt16:
+			alignment = 2
+		case rpmTypeInt32:
+			alignment = 4
+		}
+		for store.Len()%alignment != 0 {
+			store.WriteByte(0)
+		}
+		appendIndexEntry(entry.tag, entry.dataType, int32(store.Len()), entry.count)
+		store.Write(entry.data)
+	}
+
+	// region trailer
+	regionOffset := int32(store.Len())
+	var trailer [16]byte
+	binary.BigEndian.PutUint32(trailer[0:], uint32(regionTag))
+	binary.BigEndian.PutUint32(trailer[4:], uint32(rpmTypeBinary))
+	binary.BigEndian.PutUint32(trailer[8:], uint32(int32(-16*indexCount)))
+	binary.BigEndian.PutUint32(trailer[12:], 16)
+	store.Write(trailer[:])
+
+	var result bytes.Buffer
+	result.Write([]byte{0x8e, 0xad, 0xe8, 0x01, 0, 0, 0, 0})
+	var sizes [8]byte
+	binary.BigEndian.PutUint32(sizes[0:], uint32(indexCount))
+	binary.BigEndian.PutUint32(sizes[4:], uint32(store.Len()))
+	result.Write(sizes[:])
+
+	var regionEntry [16]byte
+	binary.BigEndian.PutUint32(regionEntry[0:], uint32(regionTag))
+	binary.BigEndian.PutUint32(regionEntry[4:], uint32(rpmTypeBinary))
+	binary.BigEndian.PutUint32(regionEntry[8:], uint32(regionOffset))
+	binary.BigEndian.PutUint32(regionEntry[12:], 16)
+	result.Write(regionEntry[:])
+	result.Write(index)
+	result.Write(store.Bytes())
+	return result.Bytes()
+}
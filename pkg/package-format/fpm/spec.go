@@ -0,0 +1,322 @@
+package fpm
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+)
+
+// packageSpec is created from the fpm args (the same args are passed by electron-builder), so, fpm can be used as a fallback without any changes on the client side
+type packageSpec struct {
+	name         string
+	version      string
+	iteration    string
+	epoch        string
+	architecture string
+	description  string
+	maintainer   string
+	vendor       string
+	url          string
+	license      string
+	category     string
+	priority     string
+
+	depends    []string
+	recommends []string
+	suggests   []string
+	provides   []string
+	conflicts  []string
+	replaces   []string
+
+	// script type (after-install, before-install, after-remove, before-remove) to file
+	scripts map[string]string
+
+	// rpm Summary, the first line of the description if not specified
+	summary string
+
+	output string
+	// source=destination
+	mappings []string
+
+	// fpm options the native build doesn't support (e.g. --deb-field, --rpm-attr), package is built using fpm if any
+	unsupportedOptions []string
+}
+
+type fileEntry struct {
+	// absolute path in the package, e.g. /opt/App/app
+	path string
+	mode os.FileMode
+	size int64
+
+	// empty for directories and symlinks
+	source   string
+	linkTo   string
+	modTime  time.Time
+	isOwnDir bool
+}
+
+// fpm options that are set by this command itself or not applicable to native build
+var ignoredOptions = map[string]bool{
+	"-s": true, "--input-type": true, "-t": true, "--output-type": true,
+	"--log": true, "--rpm-os": true, "--deb-compression": true, "--rpm-compression": true, "--pacman-compression": true,
+}
+
+var ignoredFlags = map[string]bool{
+	"--force": true, "-f": true, "--debug": true,
+}
+
+func parseArgs(args []string) (*packageSpec, error) {
+	spec := &packageSpec{scripts: make(map[string]string)}
+	stringOptions := map[string]*string{
+		"-n": &spec.name, "--name": &spec.name,
+		"-v": &spec.version, "--version": &spec.version,
+		"--iteration": &spec.iteration,
+		"--epoch":     &spec.epoch,
+		"-a":          &spec.architecture, "--architecture": &spec.architecture,
+		"--description": &spec.description,
+		"-m":            &spec.maintainer, "--maintainer": &spec.maintainer,
+		"--vendor":       &spec.vendor,
+		"--url":          &spec.url,
+		"--license":      &spec.license,
+		"--category":     &spec.category,
+		"--deb-priority": &spec.priority,
+		"--rpm-summary":  &spec.summary,
+		"-p":             &spec.output, "--package": &spec.output,
+	}
+	listOptions := map[string]*[]string{
+		"-d": &spec.depends, "--depends": &spec.depends,
+		"--deb-recommends": &spec.recommends,
+		"--deb-suggests":   &spec.suggests,
+		"--provides":       &spec.provides,
+		"--conflicts":      &spec.conflicts,
+		"--replaces":       &spec.replaces,
+	}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") {
+			spec.mappings = append(spec.mappings, arg)
+			continue
+		}
+		if ignoredFlags[arg] {
+			continue
+		}
+
+		name := arg
+		var value string
+		index := strings.IndexRune(arg, '=')
+		if index > 0 {
+			name = arg[:index]
+		}
+		if !isSupportedOption(name, stringOptions, listOptions) {
+			// it is not known whether option has a value - args are not parsed further, fpm is used anyway
+			spec.unsupportedOptions = append(spec.unsupportedOptions, name)
+			continue
+		}
+
+		if index > 0 {
+			value = arg[index+1:]
+		} else {
+			if i+1 >= len(args) {
+				return nil, util.NewMessageError("value for "+arg+" is not specified", "ERR_FPM_INVALID_ARGS")
+			}
+			i++
+			value = args[i]
+		}
+
+		switch {
+		case stringOptions[name] != nil:
+			*stringOptions[name] = value
+		case listOptions[name] != nil:
+			*listOptions[name] = append(*listOptions[name], value)
+		case name == "--after-install" || name == "--before-install" || name == "--after-remove" || name == "--before-remove":
+			spec.scripts[name[2:]] = value
+		}
+	}
+
+	if len(spec.unsupportedOptions) != 0 {
+		return spec, nil
+	}
+	if spec.name == "" || spec.version == "" || spec.output == "" {
+		return nil, util.NewMessageError("name, version and package must be specified", "ERR_FPM_INVALID_ARGS")
+	}
+	if len(spec.mappings) == 0 {
+		return nil, util.NewMessageError("no files to package", "ERR_FPM_INVALID_ARGS")
+	}
+	return spec, nil
+}
+
+func isSupportedOption(name string, stringOptions map[string]*string, listOptions map[string]*[]string) bool {
+	return stringOptions[name] != nil || listOptions[name] != nil || ignoredOptions[name] ||
+		name == "--after-install" || name == "--before-install" || name == "--after-remove" || name == "--before-remove"
+}
+
+// "source=destination" the same as fpm dir input: if source is a dir, its content is placed into destination.
+// Directories of the destination are owned by the package, parent directories (e.g. /usr/share/icons) are not (only created in deb data archive).
+func collectFiles(mappings []string) ([]*fileEntry, error) {
+	entries := make(map[string]*fileEntry)
+	addParents := func(file string) {
+		for dir := path.Dir(file); dir != "/" && entries[dir] == nil; dir = path.Dir(dir) {
+			entries[dir] = &fileEntry{path: dir, mode: os.ModeDir | 0755}
+		}
+	}
+
+	for _, mapping := range mappings {
+		index := strings.IndexRune(mapping, '=')
+		var source, destination string
+		if index < 0 {
+			source = mapping
+			destination = "/" + strings.TrimPrefix(filepath.ToSlash(mapping), "/")
+		} else {
+			source = mapping[:index]
+			destination = mapping[index+1:]
+		}
+		destination = path.Clean("/" + filepath.ToSlash(destination))
+
+		err := filepath.Walk(source, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			relativePath, err := filepath.Rel(source, file)
+			if err != nil {
+				return err
+			}
+			entry := &fileEntry{path: path.Join(destination, filepath.ToSlash(relativePath)), modTime: info.ModTime()}
+			if entry.path == "/" {
+				return nil
+			}
+
+			switch {
+			case info.IsDir():
+				entry.mode = os.ModeDir | 0755
+				entry.isOwnDir = true
+			case info.Mode()&os.ModeSymlink != 0:
+				entry.linkTo, err = os.Readlink(file)
+				if err != nil {
+					return err
+				}
+				entry.mode = os.ModeSymlink | 0777
+				entry.size = int64(len(entry.linkTo))
+			case info.Mode().IsRegular():
+				entry.mode = normalizeFileMode(info.Mode())
+				entry.size = info.Size()
+				entry.source = file
+			default:
+				return nil
+			}
+
+			existing := entries[entry.path]
+			if existing != nil && !(existing.mode.IsDir() && entry.mode.IsDir()) {
+				return util.NewMessageError("file "+entry.path+" is specified more than once", "ERR_FPM_DUPLICATED_FILE")
+			}
+			entries[entry.path] = entry
+			addParents(entry.path)
+			return nil
+		})
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	result := make([]*fileEntry, 0, len(entries))
+	for _, entry := range entries {
+		result = append(result, entry)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].path < result[j].path
+	})
+	return result, nil
+}
+
+// files are owned by root, executable bit and setuid (chrome-sandbox) are preserved
+func normalizeFileMode(mode os.FileMode) os.FileMode {
+	result := os.FileMode(0644)
+	if mode&0111 != 0 {
+		result = 0755
+	}
+	if mode&os.ModeSetuid != 0 {
+		result |= os.ModeSetuid
+	}
+	return result
+}
+
+// unix mode (as in tar, cpio and rpm header)
+func toUnixMode(mode os.FileMode) int64 {
+	result := int64(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		result |= 04000
+	}
+	switch {
+	case mode.IsDir():
+		result |= 040000
+	case mode&os.ModeSymlink != 0:
+		result |= 0120000
+	default:
+		result |= 0100000
+	}
+	return result
+}
+
+// summary is the first line, the rest is the description (electron-builder passes "synopsis\n description" for deb)
+func splitDescription(description string) (string, string) {
+	lines := strings.Split(strings.TrimSpace(description), "\n")
+	summary := strings.TrimSpace(lines[0])
+	var rest []string
+	for _, line := range lines[1:] {
+		rest = append(rest, strings.TrimSpace(line))
+	}
+	return summary, strings.TrimSpace(strings.Join(rest, "\n"))
+}
+
+// dependency "name >= 1.0" or "name (>= 1.0)" to name, operator and version
+func parseDependency(value string) (string, string, string) {
+	value = strings.TrimSpace(value)
+	index := strings.IndexAny(value, " (<>=")
+	if index < 0 {
+		return value, "", ""
+	}
+
+	name := value[:index]
+	constraint := strings.Trim(strings.TrimSpace(value[index:]), "()")
+	constraint = strings.TrimSpace(constraint)
+	operatorEnd := strings.LastIndexAny(constraint, "<>=") + 1
+	if operatorEnd == 0 {
+		return name, "", ""
+	}
+	return name, strings.TrimSpace(constraint[:operatorEnd]), strings.TrimSpace(constraint[operatorEnd:])
+}
+
+func readScript(file string) (string, error) {
+	if file == "" {
+		return "", nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return string(data), nil
+}
+
+// "name >= 1.0" or "name (>= 1.0)" to "name>=1.0" (pacman and apk)
+func formatCompactDependency(value string) string {
+	name, operator, version := parseDependency(value)
+	switch operator {
+	case "":
+		return name
+	case ">>":
+		operator = ">"
+	case "<<":
+		operator = "<"
+	case "==":
+		operator = "="
+	}
+	return name + operator + version
+}
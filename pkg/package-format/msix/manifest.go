@@ -0,0 +1,168 @@
+package msix
+
+import (
+	"encoding/xml"
+	"strconv"
+	"strings"
+
+	"github.com/develar/app-builder/pkg/util"
+)
+
+type MsixConfiguration struct {
+	IdentityName string `json:"identityName"`
+	// CN=..., subject of the certificate if not specified
+	Publisher            string `json:"publisher"`
+	PublisherDisplayName string `json:"publisherDisplayName"`
+	DisplayName          string `json:"displayName"`
+	Description          string `json:"description"`
+	Version              string `json:"version"`
+	// relative to the app dir, e.g. MyApp.exe
+	ExecutableName string `json:"executableName"`
+
+	ApplicationId    string   `json:"applicationId"`
+	BackgroundColor  string   `json:"backgroundColor"`
+	MinVersion       string   `json:"minVersion"`
+	MaxVersionTested string   `json:"maxVersionTested"`
+	Languages        []string `json:"languages"`
+	// in addition to runFullTrust, uap: and rescap: prefixes are preserved (e.g. internetClient, uap:picturesLibrary)
+	Capabilities []string `json:"capabilities"`
+
+	// source image for the logo assets (PNG, at least 310x310 is recommended)
+	Icon string `json:"icon"`
+	// generate contrast-black and contrast-white logo variants and resources.pri to select them in high contrast mode
+	HighContrast bool `json:"highContrast"`
+	// VFS folder name (e.g. ProgramFilesX64, Windows) to the dir to be placed into it
+	Vfs map[string]string `json:"vfs"`
+}
+
+type logoAsset struct {
+	file   string
+	width  int
+	height int
+}
+
+var logoAssets = []logoAsset{
+	{"Assets\\StoreLogo.png", 50, 50},
+	{"Assets\\Square44x44Logo.png", 44, 44},
+	{"Assets\\Square150x150Logo.png", 150, 150},
+	{"Assets\\Wide310x150Logo.png", 310, 150},
+}
+
+func applyDefaults(configuration *MsixConfiguration) {
+	if configuration.ApplicationId == "" {
+		configuration.ApplicationId = "App"
+	}
+	if configuration.DisplayName == "" {
+		configuration.DisplayName = configuration.IdentityName
+	}
+	if configuration.PublisherDisplayName == "" {
+		configuration.PublisherDisplayName = configuration.DisplayName
+	}
+	if configuration.Description == "" {
+		configuration.Description = configuration.DisplayName
+	}
+	if configuration.BackgroundColor == "" {
+		configuration.BackgroundColor = "transparent"
+	}
+	// Windows 10 1809, the first version that supports MSIX natively
+	if configuration.MinVersion == "" {
+		configuration.MinVersion = "10.0.17763.0"
+	}
+	if configuration.MaxVersionTested == "" {
+		configuration.MaxVersionTested = "10.0.22621.0"
+	}
+	if len(configuration.Languages) == 0 {
+		configuration.Languages = []string{"en-US"}
+	}
+}
+
+// package version must be in quad notation, pre-release part is dropped (Microsoft Store requires revision to be 0)
+func toPackageVersion(version string) (string, error) {
+	index := strings.IndexAny(version, "-+")
+	if index >= 0 {
+		version = version[:index]
+	}
+
+	parts := strings.Split(version, ".")
+	if len(parts) > 4 {
+		return "", util.NewMessageError("version "+version+" has more than 4 parts", "ERR_MSIX_INVALID_VERSION")
+	}
+	for _, part := range parts {
+		value, err := strconv.Atoi(part)
+		if err != nil || value < 0 || value > 65535 {
+			return "", util.NewMessageError("version "+version+" is not valid (each part must be a number from 0 to 65535)", "ERR_MSIX_INVALID_VERSION")
+		}
+	}
+	for len(parts) < 4 {
+		parts = append(parts, "0")
+	}
+	return strings.Join(parts, "."), nil
+}
+
+func toPackageArch(arch string) string {
+	switch arch {
+	case "ia32":
+		return "x86"
+	default:
+		return arch
+	}
+}
+
+func createManifest(configuration *MsixConfiguration, version string, arch string) string {
+	var s strings.Builder
+	s.WriteString(`<?xml version="1.0" encoding="utf-8"?>
+<Package xmlns="http://schemas.microsoft.com/appx/manifest/foundation/windows10" xmlns:uap="http://schemas.microsoft.com/appx/manifest/uap/windows10" xmlns:rescap="http://schemas.microsoft.com/appx/manifest/foundation/windows10/restrictedcapabilities" IgnorableNamespaces="uap rescap">
+`)
+	s.WriteString(`  <Identity Name="` + escape(configuration.IdentityName) + `" Publisher="` + escape(configuration.Publisher) + `" Version="` + version + `" ProcessorArchitecture="` + toPackageArch(arch) + "\"/>\n")
+	s.WriteString("  <Properties>\n")
+	s.WriteString("    <DisplayName>" + escape(configuration.DisplayName) + "</DisplayName>\n")
+	s.WriteString("    <PublisherDisplayName>" + escape(configuration.PublisherDisplayName) + "</PublisherDisplayName>\n")
+	s.WriteString("    <Logo>" + logoAssets[0].file + "</Logo>\n")
+	s.WriteString("    <Description>" + escape(configuration.Description) + "</Description>\n")
+	s.WriteString("  </Properties>\n")
+
+	s.WriteString("  <Resources>\n")
+	for _, language := range configuration.Languages {
+		s.WriteString(`    <Resource Language="` + escape(language) + "\"/>\n")
+	}
+	s.WriteString("  </Resources>\n")
+
+	s.WriteString("  <Dependencies>\n")
+	s.WriteString(`    <TargetDeviceFamily Name="Windows.Desktop" MinVersion="` + escape(configuration.MinVersion) + `" MaxVersionTested="` + escape(configuration.MaxVersionTested) + "\"/>\n")
+	s.WriteString("  </Dependencies>\n")
+
+	s.WriteString("  <Capabilities>\n")
+	for _, capability := range configuration.Capabilities {
+		if capability == "runFullTrust" || capability == "rescap:runFullTrust" {
+			continue
+		}
+
+		element := "Capability"
+		index := strings.IndexRune(capability, ':')
+		if index > 0 {
+			element = capability[:index+1] + element
+			capability = capability[index+1:]
+		}
+		s.WriteString("    <" + element + ` Name="` + escape(capability) + "\"/>\n")
+	}
+	// Electron app is a desktop (full trust) app
+	s.WriteString(`    <rescap:Capability Name="runFullTrust"/>` + "\n")
+	s.WriteString("  </Capabilities>\n")
+
+	s.WriteString("  <Applications>\n")
+	s.WriteString(`    <Application Id="` + escape(configuration.ApplicationId) + `" Executable="` + escape(strings.Replace(configuration.ExecutableName, "/", "\\", -1)) + `" EntryPoint="Windows.FullTrustApplication">` + "\n")
+	s.WriteString(`      <uap:VisualElements DisplayName="` + escape(configuration.DisplayName) + `" Description="` + escape(configuration.Description) + `" BackgroundColor="` + escape(configuration.BackgroundColor) +
+		`" Square150x150Logo="` + logoAssets[2].file + `" Square44x44Logo="` + logoAssets[1].file + "\">\n")
+	s.WriteString(`        <uap:DefaultTile Wide310x150Logo="` + logoAssets[3].file + "\"/>\n")
+	s.WriteString("      </uap:VisualElements>\n")
+	s.WriteString("    </Application>\n")
+	s.WriteString("  </Applications>\n")
+	s.WriteString("</Package>\n")
+	return s.String()
+}
+
+func escape(value string) string {
+	var s strings.Builder
+	_ = xml.EscapeText(&s, []byte(value))
+	return s.String()
+}
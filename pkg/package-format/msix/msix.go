@@ -0,0 +1,295 @@
+package msix
+
+import (
+	"image"
+	"image/draw"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/codesign"
+	"github.com/develar/app-builder/pkg/credentials"
+	"github.com/develar/app-builder/pkg/download"
+	"github.com/develar/app-builder/pkg/icons"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+	"github.com/develar/go-pkcs12"
+	"github.com/disintegration/imaging"
+	"go.uber.org/zap"
+)
+
+const CertificatePasswordCredentialName = "windows-certificate-password"
+
+type MsixOptions struct {
+	appDir   *string
+	stageDir *string
+	arch     *string
+	output   *string
+
+	certificateFile *string
+	timestampServer *string
+
+	configuration *MsixConfiguration
+}
+
+func ConfigureCommand(app *kingpin.Application) {
+	command := app.Command("msix", "Build MSIX package (e.g. for Microsoft Store submission). "+
+		"Package is signed if certificate is specified (password is taken from "+credentials.ToEnvName(CertificatePasswordCredentialName)+" env or credentials helper), "+
+		"Microsoft Store signs submitted packages itself.")
+
+	options := &MsixOptions{
+		appDir:   command.Flag("app", "The unpacked app dir.").Short('a').Required().String(),
+		stageDir: command.Flag("stage", "The stage dir.").Short('s').Required().String(),
+		output:   command.Flag("output", "The output .msix file.").Short('o').Required().String(),
+		arch:     command.Flag("arch", "The arch.").Default("x64").Enum("x64", "ia32", "arm64"),
+
+		certificateFile: command.Flag("certificate-file", "The PKCS#12 code signing certificate.").String(),
+		timestampServer: command.Flag("timestamp-server", "The RFC 3161 timestamp server.").Default("http://timestamp.digicert.com").String(),
+	}
+
+	configuration := command.Flag("configuration", "").Required().String()
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		err := util.DecodeBase64IfNeeded(*configuration, &options.configuration)
+		if err != nil {
+			return err
+		}
+		return Msix(options)
+	})
+}
+
+func Msix(options *MsixOptions) error {
+	configuration := options.configuration
+	if configuration.IdentityName == "" || configuration.ExecutableName == "" || configuration.Icon == "" {
+		return util.NewMessageError("identityName, executableName and icon must be specified", "ERR_MSIX_INVALID_CONFIGURATION")
+	}
+	applyDefaults(configuration)
+
+	version, err := toPackageVersion(configuration.Version)
+	if err != nil {
+		return err
+	}
+
+	var password string
+	if *options.certificateFile != "" {
+		password, err = credentials.Get(CertificatePasswordCredentialName)
+		if err != nil {
+			return err
+		}
+
+		err = checkPublisher(configuration, *options.certificateFile, password)
+		if err != nil {
+			return err
+		}
+	} else if configuration.Publisher == "" {
+		return util.NewMessageError("publisher must be specified if certificate is not specified (see Publisher ID in Microsoft Partner Center)", "ERR_MSIX_INVALID_CONFIGURATION")
+	}
+
+	stageDir := *options.stageDir
+	err = fsutil.EnsureEmptyDir(stageDir)
+	if err != nil {
+		return err
+	}
+
+	files, err := collectFiles(*options.appDir, configuration.Vfs)
+	if err != nil {
+		return err
+	}
+
+	assetFiles, err := createLogoAssets(configuration.Icon, stageDir, configuration.HighContrast)
+	if err != nil {
+		return err
+	}
+
+	manifest := []byte(createManifest(configuration, version, *options.arch))
+	files = append(files, assetFiles...)
+	files = append(files, packageFile{name: manifestPartName, data: manifest})
+	if configuration.HighContrast {
+		priFile, err := createResourceIndex(stageDir, manifest, configuration.Languages[0])
+		if err != nil {
+			return err
+		}
+		files = append(files, packageFile{name: priFileName, file: priFile})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].name < files[j].name
+	})
+	for i := 1; i < len(files); i++ {
+		if strings.EqualFold(files[i-1].name, files[i].name) {
+			return util.NewMessageError("duplicated package file "+files[i].name, "ERR_MSIX_DUPLICATED_FILE")
+		}
+	}
+
+	err = writePackage(files, *options.output)
+	if err != nil {
+		return err
+	}
+
+	if *options.certificateFile != "" {
+		err = sign(*options.output, *options.certificateFile, password, *options.timestampServer)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Debug("msix created", zap.String("file", *options.output), zap.Int("fileCount", len(files)))
+	return nil
+}
+
+// app files are placed into the package root (executable is launched with package root as working dir), VFS dirs - into VFS/<folder>
+func collectFiles(appDir string, vfs map[string]string) ([]packageFile, error) {
+	var result []packageFile
+	err := addDir(appDir, "", &result)
+	if err != nil {
+		return nil, err
+	}
+
+	for folder, dir := range vfs {
+		err = addDir(dir, "VFS/"+folder+"/", &result)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func addDir(dir string, prefix string, result *[]packageFile) error {
+	return errors.WithStack(filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			// directories are not stored, symlinks are not supported by the format
+			if info.Mode()&os.ModeSymlink != 0 {
+				return util.NewMessageError("symlink "+file+" is not supported by MSIX", "ERR_MSIX_SYMLINK")
+			}
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		*result = append(*result, packageFile{name: prefix + filepath.ToSlash(relativePath), file: file})
+		return nil
+	}))
+}
+
+// logo is centered on transparent background for non-square assets.
+// Assets are referenced without qualifiers, so, resources.pri is required only for high contrast variants.
+func createLogoAssets(iconFile string, stageDir string, isHighContrast bool) ([]packageFile, error) {
+	icon, err := icons.LoadImage(iconFile)
+	if err != nil {
+		return nil, err
+	}
+
+	variants := []contrastVariant{{}}
+	if isHighContrast {
+		variants = append(variants, contrastVariants...)
+	}
+
+	result := make([]packageFile, len(logoAssets)*len(variants))
+	err = util.MapAsync(len(result), func(taskIndex int) (func() error, error) {
+		asset := logoAssets[taskIndex/len(variants)]
+		variant := variants[taskIndex%len(variants)]
+		name := strings.Replace(asset.file, "\\", "/", -1)
+		if variant.qualifier != "" {
+			name = strings.TrimSuffix(name, ".png") + "." + variant.qualifier + ".png"
+		}
+		file := filepath.Join(stageDir, filepath.FromSlash(name))
+		result[taskIndex] = packageFile{name: name, file: file}
+		return func() error {
+			size := asset.height
+			if asset.width < size {
+				size = asset.width
+			}
+
+			var resized image.Image = imaging.Resize(icon, size, size, imaging.Lanczos)
+			if variant.qualifier != "" {
+				resized = icons.CreateMonochromeImage(resized, variant.color)
+			}
+			canvas := image.NewNRGBA(image.Rect(0, 0, asset.width, asset.height))
+			offset := image.Pt((asset.width-size)/2, (asset.height-size)/2)
+			draw.Draw(canvas, resized.Bounds().Add(offset), resized, image.Point{}, draw.Over)
+
+			err := fsutil.EnsureDir(filepath.Dir(file))
+			if err != nil {
+				return err
+			}
+			return icons.SaveImage(canvas, file, icons.PNG)
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// publisher in the manifest must be equal to the certificate subject, otherwise package cannot be installed
+func checkPublisher(configuration *MsixConfiguration, certificateFile string, password string) error {
+	data, err := ioutil.ReadFile(certificateFile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	certificates, err := pkcs12.DecodeAllCerts(data, password)
+	if err != nil {
+		return errors.WithMessage(err, "cannot read certificate "+certificateFile)
+	}
+
+	certificate := codesign.FindCodeSigningCertificate(certificates)
+	if certificate == nil {
+		return util.NewMessageError("no code signing certificates in "+certificateFile, "ERR_MSIX_NO_CERTIFICATE")
+	}
+
+	subject := codesign.BloodyMsString(certificate.Subject.ToRDNSequence())
+	if configuration.Publisher == "" {
+		configuration.Publisher = subject
+	} else if configuration.Publisher != subject {
+		return util.NewMessageError("publisher "+configuration.Publisher+" doesn't match certificate subject "+subject, "ERR_MSIX_PUBLISHER_MISMATCH")
+	}
+	return nil
+}
+
+// signtool is used on Windows, osslsigncode 2.3+ (MSIX support) on other platforms (OSSLSIGNCODE_PATH env to use custom)
+func sign(file string, certificateFile string, password string, timestampServer string) error {
+	if util.GetCurrentOs() == util.WINDOWS {
+		vendor, err := download.DownloadWinCodeSign()
+		if err != nil {
+			return err
+		}
+
+		args := []string{"sign", "/fd", "sha256", "/f", certificateFile}
+		if password != "" {
+			args = append(args, "/p", password)
+		}
+		if timestampServer != "" {
+			args = append(args, "/tr", timestampServer, "/td", "sha256")
+		}
+		args = append(args, file)
+		_, err = util.Execute(exec.Command(filepath.Join(vendor, "windows-10", "x64", "signtool.exe"), args...))
+		return err
+	}
+
+	signedFile := file + ".signed"
+	args := []string{"sign", "-pkcs12", certificateFile, "-h", "sha256"}
+	if password != "" {
+		args = append(args, "-pass", password)
+	}
+	if timestampServer != "" {
+		args = append(args, "-ts", timestampServer)
+	}
+	args = append(args, "-in", file, "-out", signedFile)
+	_, err := util.Execute(exec.Command(util.GetEnvOrDefault("OSSLSIGNCODE_PATH", "osslsigncode"), args...))
+	if err != nil {
+		_ = os.Remove(signedFile)
+		return err
+	}
+	return errors.WithStack(os.Rename(signedFile, file))
+}
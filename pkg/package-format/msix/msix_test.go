@@ -0,0 +1,200 @@
+package msix
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/icons"
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+)
+
+func TestToPackageVersion(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	version, err := toPackageVersion("1.2.3")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(version).To(Equal("1.2.3.0"))
+
+	version, err = toPackageVersion("2.0.0-beta.1")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(version).To(Equal("2.0.0.0"))
+
+	_, err = toPackageVersion("1.70000.0")
+	g.Expect(err).To(HaveOccurred())
+
+	_, err = toPackageVersion("1.2.3.4.5")
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestCreateManifest(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	configuration := &MsixConfiguration{
+		IdentityName:   "Foo.App",
+		Publisher:      "CN=Foo & Bar",
+		ExecutableName: "Foo.exe",
+		Capabilities:   []string{"internetClient", "uap:picturesLibrary", "runFullTrust"},
+	}
+	applyDefaults(configuration)
+	manifest := createManifest(configuration, "1.0.0.0", "ia32")
+	g.Expect(manifest).To(ContainSubstring(`<Identity Name="Foo.App" Publisher="CN=Foo &amp; Bar" Version="1.0.0.0" ProcessorArchitecture="x86"/>`))
+	g.Expect(manifest).To(ContainSubstring(`    <Capability Name="internetClient"/>
+    <uap:Capability Name="picturesLibrary"/>
+    <rescap:Capability Name="runFullTrust"/>
+`))
+	g.Expect(manifest).To(ContainSubstring(`<Application Id="App" Executable="Foo.exe" EntryPoint="Windows.FullTrustApplication">`))
+}
+
+func TestCreateLogoAssets(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "msix")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	// red square with transparent border
+	icon := image.NewNRGBA(image.Rect(0, 0, 320, 320))
+	draw.Draw(icon, image.Rect(40, 40, 280, 280), image.NewUniform(color.NRGBA{R: 255, A: 255}), image.Point{}, draw.Src)
+	iconFile := filepath.Join(dir, "icon.png")
+	g.Expect(icons.SaveImage(icon, iconFile, icons.PNG)).To(Succeed())
+
+	stageDir := filepath.Join(dir, "stage")
+	files, err := createLogoAssets(iconFile, stageDir, true)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(files).To(HaveLen(12))
+	g.Expect(files[1].name).To(Equal("Assets/StoreLogo.contrast-black.png"))
+	g.Expect(files[2].name).To(Equal("Assets/StoreLogo.contrast-white.png"))
+
+	logo, err := icons.LoadImage(files[1].file)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(logo.Bounds().Dx()).To(Equal(50))
+	g.Expect(color.NRGBAModel.Convert(logo.At(25, 25))).To(Equal(color.NRGBA{R: 255, G: 255, B: 255, A: 255}))
+	g.Expect(color.NRGBAModel.Convert(logo.At(0, 0)).(color.NRGBA).A).To(Equal(uint8(0)))
+
+	logo, err = icons.LoadImage(files[11].file)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(logo.Bounds().Dx()).To(Equal(310))
+	g.Expect(color.NRGBAModel.Convert(logo.At(155, 75))).To(Equal(color.NRGBA{A: 255}))
+}
+
+func TestWritePackage(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "msix")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	// not compressible and compressible parts, not multiple of block size
+	large := make([]byte, 3*blockSize+100)
+	seed := uint32(1)
+	for i := range large {
+		if i < blockSize {
+			seed = seed*1664525 + 1013904223
+			large[i] = byte(seed >> 24)
+		} else {
+			large[i] = byte(i % 7)
+		}
+	}
+	largeFile := filepath.Join(dir, "large.bin")
+	g.Expect(ioutil.WriteFile(largeFile, large, 0644)).To(Succeed())
+
+	files := []packageFile{
+		{name: "AppxManifest.xml", data: []byte("<Package/>")},
+		{name: "LICENSE", data: []byte("license")},
+		{name: "empty.txt", data: []byte{}},
+		{name: "locales/en US.pak", data: bytes.Repeat([]byte("en"), blockSize)},
+		{name: "resources/large.bin", file: largeFile},
+	}
+
+	outFile := filepath.Join(dir, "test.msix")
+	g.Expect(writePackage(files, outFile)).To(Succeed())
+
+	reader, err := zip.OpenReader(outFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	defer reader.Close()
+
+	rawFile, err := os.Open(outFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	defer rawFile.Close()
+
+	var names []string
+	entries := make(map[string]*zip.File)
+	for _, file := range reader.File {
+		names = append(names, file.Name)
+		entries[file.Name] = file
+	}
+	g.Expect(names).To(Equal([]string{"AppxManifest.xml", "LICENSE", "empty.txt", "locales/en%20US.pak", "resources/large.bin", "AppxBlockMap.xml", "[Content_Types].xml"}))
+
+	g.Expect(readEntry(g, entries["resources/large.bin"])).To(Equal(large))
+
+	contentTypes := string(readEntry(g, entries["[Content_Types].xml"]))
+	g.Expect(contentTypes).To(ContainSubstring(`<Default Extension="bin" ContentType="application/octet-stream"/><Default Extension="pak" ContentType="application/octet-stream"/><Default Extension="txt" ContentType="text/plain"/>`))
+	g.Expect(contentTypes).To(ContainSubstring(`<Override PartName="/LICENSE" ContentType="application/octet-stream"/>`))
+
+	// each block must be decompressed independently and match the hash
+	blockMap := string(readEntry(g, entries["AppxBlockMap.xml"]))
+	fileRegExp := regexp.MustCompile(`<File Name="([^"]+)" Size="(\d+)" LfhSize="(\d+)">(.*?)</File>`)
+	blockRegExp := regexp.MustCompile(`<Block Hash="([^"]+)" Size="(\d+)"/>`)
+	fileMatches := fileRegExp.FindAllStringSubmatch(blockMap, -1)
+	g.Expect(fileMatches).To(HaveLen(5))
+	for _, fileMatch := range fileMatches {
+		entry := entries[encodePartName(strings.Replace(fileMatch[1], "\\", "/", -1))]
+		g.Expect(entry).NotTo(BeNil())
+		g.Expect(fileMatch[2]).To(Equal(strconv.FormatUint(entry.UncompressedSize64, 10)))
+
+		dataOffset, err := entry.DataOffset()
+		g.Expect(err).NotTo(HaveOccurred())
+		lfhSize, err := strconv.ParseInt(fileMatch[3], 10, 64)
+		g.Expect(err).NotTo(HaveOccurred())
+		localHeader := make([]byte, 30)
+		_, err = rawFile.ReadAt(localHeader, dataOffset-lfhSize)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(string(localHeader[0:4])).To(Equal("PK\x03\x04"))
+		g.Expect(int64(30 + int(binary.LittleEndian.Uint16(localHeader[26:])) + int(binary.LittleEndian.Uint16(localHeader[28:])))).To(Equal(lfhSize))
+
+		offset := dataOffset
+		var total uint64
+		for _, blockMatch := range blockRegExp.FindAllStringSubmatch(fileMatch[4], -1) {
+			size, err := strconv.ParseInt(blockMatch[2], 10, 64)
+			g.Expect(err).NotTo(HaveOccurred())
+
+			compressed := make([]byte, size)
+			_, err = rawFile.ReadAt(compressed, offset)
+			g.Expect(err).NotTo(HaveOccurred())
+			data, err := ioutil.ReadAll(flate.NewReader(io.MultiReader(bytes.NewReader(compressed), bytes.NewReader([]byte{3, 0}))))
+			g.Expect(err).NotTo(HaveOccurred())
+			hash := sha256.Sum256(data)
+			g.Expect(base64.StdEncoding.EncodeToString(hash[:])).To(Equal(blockMatch[1]))
+
+			offset += size
+			total += uint64(size)
+		}
+		g.Expect(total).To(Equal(entry.CompressedSize64))
+	}
+}
+
+func readEntry(g *WithT, file *zip.File) []byte {
+	reader, err := file.Open()
+	g.Expect(err).NotTo(HaveOccurred())
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	g.Expect(err).NotTo(HaveOccurred())
+	return data
+}
@@ -0,0 +1,330 @@
+package msix
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+)
+
+// https://docs.microsoft.com/en-us/uwp/schemas/blockmapschema/element-blockmap
+const (
+	blockSize = 64 * 1024
+
+	manifestPartName     = "AppxManifest.xml"
+	blockMapPartName     = "AppxBlockMap.xml"
+	contentTypesPartName = "[Content_Types].xml"
+)
+
+var contentTypes = map[string]string{
+	"exe":  "application/x-msdownload",
+	"dll":  "application/x-msdownload",
+	"png":  "image/png",
+	"jpg":  "image/jpeg",
+	"jpeg": "image/jpeg",
+	"gif":  "image/gif",
+	"ico":  "image/vnd.microsoft.icon",
+	"svg":  "image/svg+xml",
+	"html": "text/html",
+	"css":  "text/css",
+	"js":   "application/javascript",
+	"json": "application/json",
+	"txt":  "text/plain",
+	"xml":  "text/xml",
+}
+
+// packageFile is a file of the package payload - either file on disk or data in memory
+type packageFile struct {
+	// relative to the package root, / as separator
+	name string
+	file string
+	data []byte
+}
+
+type blockMapFile struct {
+	name    string
+	size    int64
+	lfhSize int
+	blocks  []blockMapBlock
+}
+
+type blockMapBlock struct {
+	hash []byte
+	// compressed size
+	size int64
+}
+
+type packageWriter struct {
+	zipWriter *zip.Writer
+	blockMap  []*blockMapFile
+
+	current *blockMapFile
+}
+
+// writePackage writes payload files, block map and content types. Files must be sorted and unique.
+func writePackage(files []packageFile, outFile string) error {
+	file, err := os.Create(outFile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	bufferedWriter := bufio.NewWriterSize(file, 1024*1024)
+	err = doWritePackage(files, bufferedWriter)
+	if err == nil {
+		err = bufferedWriter.Flush()
+	}
+	return fsutil.CloseAndCheckError(err, file)
+}
+
+func doWritePackage(files []packageFile, out io.Writer) error {
+	writer := &packageWriter{zipWriter: zip.NewWriter(out)}
+	writer.zipWriter.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		return &blockCompressor{out: &countingWriter{writer: out}, file: writer.current, remaining: writer.current.size}, nil
+	})
+
+	for _, file := range files {
+		err := writer.writeFile(file)
+		if err != nil {
+			return err
+		}
+	}
+
+	// block map and content types are not listed in the block map
+	err := writer.writeStoredPart(blockMapPartName, []byte(createBlockMap(writer.blockMap)))
+	if err != nil {
+		return err
+	}
+
+	err = writer.writeStoredPart(contentTypesPartName, []byte(createContentTypes(files)))
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(writer.zipWriter.Close())
+}
+
+func (t *packageWriter) writeFile(file packageFile) error {
+	var reader io.Reader
+	var size int64
+	if file.data == nil {
+		inputFile, err := os.Open(file.file)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer util.Close(inputFile)
+
+		info, err := inputFile.Stat()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		reader = inputFile
+		size = info.Size()
+	} else {
+		reader = bytes.NewReader(file.data)
+		size = int64(len(file.data))
+	}
+
+	partName := encodePartName(file.name)
+	t.current = &blockMapFile{name: strings.Replace(file.name, "/", "\\", -1), size: size, lfhSize: 30 + len(partName)}
+	t.blockMap = append(t.blockMap, t.current)
+
+	method := zip.Deflate
+	if size == 0 {
+		method = zip.Store
+	}
+
+	entryWriter, err := t.zipWriter.CreateHeader(createHeader(partName, method))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = io.Copy(entryWriter, reader)
+	return errors.WithStack(err)
+}
+
+func (t *packageWriter) writeStoredPart(name string, data []byte) error {
+	entryWriter, err := t.zipWriter.CreateHeader(createHeader(name, zip.Store))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = entryWriter.Write(data)
+	return errors.WithStack(err)
+}
+
+func createHeader(name string, method uint16) *zip.FileHeader {
+	// Modified is not set to avoid extended timestamp extra field - local file header size is recorded in the block map
+	// and constant date is used for reproducible package (1980-01-01)
+	return &zip.FileHeader{
+		Name:         name,
+		Method:       method,
+		ModifiedDate: 1<<5 | 1,
+	}
+}
+
+// each 64 KB block is deflated independently and hash of uncompressed block is recorded, so, installer can verify and decompress block by block
+type blockCompressor struct {
+	out  *countingWriter
+	file *blockMapFile
+	// size of not yet written data, the last block is finished using Close to mark the end of deflate stream
+	remaining int64
+	// zip writer writes using io.Copy with 32 KB buffer, so, writes are collected into block
+	buffer []byte
+}
+
+func (t *blockCompressor) Write(p []byte) (int, error) {
+	if int64(len(p)) > t.remaining-int64(len(t.buffer)) {
+		return 0, errors.Errorf("file %s was modified during packaging", t.file.name)
+	}
+
+	written := 0
+	for len(p) > 0 {
+		if t.buffer == nil {
+			t.buffer = make([]byte, 0, blockSize)
+		}
+
+		n := blockSize - len(t.buffer)
+		if n > len(p) {
+			n = len(p)
+		}
+		t.buffer = append(t.buffer, p[:n]...)
+		written += n
+		p = p[n:]
+
+		if len(t.buffer) == blockSize || int64(len(t.buffer)) == t.remaining {
+			err := t.writeBlock(t.buffer, int64(len(t.buffer)) == t.remaining)
+			if err != nil {
+				return written, err
+			}
+			t.remaining -= int64(len(t.buffer))
+			t.buffer = t.buffer[:0]
+		}
+	}
+	return written, nil
+}
+
+func (t *blockCompressor) writeBlock(data []byte, isLast bool) error {
+	start := t.out.count
+	compressor, err := flate.NewWriter(t.out, flate.BestCompression)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = compressor.Write(data)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if isLast {
+		err = compressor.Close()
+	} else {
+		// sync flush - the next block starts from byte boundary without references to the previous block
+		err = compressor.Flush()
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	hash := sha256.Sum256(data)
+	t.file.blocks = append(t.file.blocks, blockMapBlock{hash: hash[:], size: t.out.count - start})
+	return nil
+}
+
+func (t *blockCompressor) Close() error {
+	if t.remaining != 0 {
+		return errors.Errorf("file %s was modified during packaging", t.file.name)
+	}
+	return nil
+}
+
+type countingWriter struct {
+	writer io.Writer
+	count  int64
+}
+
+func (t *countingWriter) Write(p []byte) (int, error) {
+	n, err := t.writer.Write(p)
+	t.count += int64(n)
+	return n, err
+}
+
+func createBlockMap(files []*blockMapFile) string {
+	var s strings.Builder
+	s.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="no"?>` + "\n")
+	s.WriteString(`<BlockMap xmlns="http://schemas.microsoft.com/appx/2010/blockmap" HashMethod="http://www.w3.org/2001/04/xmlenc#sha256">` + "\n")
+	for _, file := range files {
+		_, _ = fmt.Fprintf(&s, `<File Name="%s" Size="%d" LfhSize="%d">`, escape(file.name), file.size, file.lfhSize)
+		for _, block := range file.blocks {
+			_, _ = fmt.Fprintf(&s, `<Block Hash="%s" Size="%d"/>`, base64.StdEncoding.EncodeToString(block.hash), block.size)
+		}
+		s.WriteString("</File>\n")
+	}
+	s.WriteString("</BlockMap>\n")
+	return s.String()
+}
+
+func createContentTypes(files []packageFile) string {
+	defaults := make(map[string]string)
+	var overrides []string
+	for _, file := range files {
+		if file.name == manifestPartName {
+			continue
+		}
+
+		extension := strings.ToLower(strings.TrimPrefix(path.Ext(file.name), "."))
+		if extension == "" {
+			overrides = append(overrides, "/"+encodePartName(file.name))
+			continue
+		}
+
+		contentType, ok := contentTypes[extension]
+		if !ok {
+			contentType = "application/octet-stream"
+		}
+		defaults[extension] = contentType
+	}
+
+	extensions := make([]string, 0, len(defaults))
+	for extension := range defaults {
+		extensions = append(extensions, extension)
+	}
+	sort.Strings(extensions)
+
+	var s strings.Builder
+	s.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	s.WriteString(`<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">`)
+	for _, extension := range extensions {
+		s.WriteString(`<Default Extension="` + escape(extension) + `" ContentType="` + defaults[extension] + `"/>`)
+	}
+	for _, partName := range overrides {
+		s.WriteString(`<Override PartName="` + escape(partName) + `" ContentType="application/octet-stream"/>`)
+	}
+	s.WriteString(`<Override PartName="/` + manifestPartName + `" ContentType="application/vnd.ms-appx.manifest+xml"/>`)
+	s.WriteString(`<Override PartName="/` + blockMapPartName + `" ContentType="application/vnd.ms-appx.blockmap+xml"/>`)
+	s.WriteString("</Types>\n")
+	return s.String()
+}
+
+// OPC part name is URI - characters except unreserved and sub-delims are percent-encoded
+func encodePartName(name string) string {
+	var s strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || strings.IndexByte("-._~!$&'()*+,;=:@/", c) >= 0 {
+			s.WriteByte(c)
+		} else {
+			_, _ = fmt.Fprintf(&s, "%%%02X", c)
+		}
+	}
+	return s.String()
+}
@@ -0,0 +1,84 @@
+package msix
+
+import (
+	"image/color"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/develar/app-builder/pkg/download"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/app-builder/pkg/wine"
+	"github.com/develar/errors"
+)
+
+const priFileName = "resources.pri"
+
+type contrastVariant struct {
+	// resource qualifier, https://docs.microsoft.com/en-us/windows/uwp/app-resources/tailor-resources-lang-scale-contrast#contrast
+	qualifier string
+	color     color.NRGBA
+}
+
+// high contrast assets are monochrome silhouette of the logo - white for dark themes and black for light ones
+var contrastVariants = []contrastVariant{
+	{qualifier: "contrast-black", color: color.NRGBA{R: 255, G: 255, B: 255, A: 255}},
+	{qualifier: "contrast-white", color: color.NRGBA{A: 255}},
+}
+
+// the same as `makepri createconfig`, but only folder indexer - stage dir contains only generated assets
+func createPriConfig(defaultLanguage string) string {
+	return `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<resources targetOsVersion="10.0.0" majorVersion="1">
+  <index root="\" startIndexAt="\">
+    <default>
+      <qualifier name="Language" value="` + escape(defaultLanguage) + `"/>
+      <qualifier name="Contrast" value="standard"/>
+      <qualifier name="Scale" value="100"/>
+      <qualifier name="HomeRegion" value="001"/>
+      <qualifier name="TargetSize" value="256"/>
+      <qualifier name="LayoutDirection" value="LTR"/>
+      <qualifier name="Theme" value="dark"/>
+      <qualifier name="AlternateForm" value=""/>
+      <qualifier name="DXFeatureLevel" value="DX9"/>
+      <qualifier name="Configuration" value=""/>
+      <qualifier name="DeviceFamily" value="Universal"/>
+      <qualifier name="Custom" value=""/>
+    </default>
+    <indexer-config type="folder" foldernameAsQualifier="true" filenameAsQualifier="true" qualifierDelimiter="."/>
+  </index>
+</resources>
+`
+}
+
+// resources.pri maps asset references of the manifest to qualified files, makepri from winCodeSign is used (using wine if not Windows)
+func createResourceIndex(stageDir string, manifest []byte, defaultLanguage string) (string, error) {
+	manifestFile := filepath.Join(stageDir, manifestPartName)
+	err := ioutil.WriteFile(manifestFile, manifest, 0644)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	configFile := filepath.Join(stageDir, "priconfig.xml")
+	err = ioutil.WriteFile(configFile, []byte(createPriConfig(defaultLanguage)), 0644)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	vendor, err := download.DownloadWinCodeSign()
+	if err != nil {
+		return "", err
+	}
+
+	outFile := filepath.Join(stageDir, priFileName)
+	args := []string{"new", "/Overwrite", "/Manifest", manifestFile, "/ProjectRoot", stageDir, "/ConfigXml", configFile, "/OutputFile", outFile}
+	if util.GetCurrentOs() == util.WINDOWS {
+		_, err = util.Execute(exec.Command(filepath.Join(vendor, "windows-10", "x64", "makepri.exe"), args...))
+	} else {
+		err = wine.ExecWine(filepath.Join(vendor, "windows-10", "ia32", "makepri.exe"), filepath.Join(vendor, "windows-10", "x64", "makepri.exe"), args)
+	}
+	if err != nil {
+		return "", err
+	}
+	return outFile, nil
+}
@@ -203,6 +203,7 @@ func downloadNodeJs(version string, arch string, platform util.OsName) (string,
 	}
 
 	archiveName := tempUnpackDir + "." + format
+	defer util.RemoveOnCancel(archiveName, tempUnpackDir)()
 
 	err = download.NewDownloader().Download(url, archiveName, "")
 	if err != nil {
@@ -217,9 +218,9 @@ func downloadNodeJs(version string, arch string, platform util.OsName) (string,
 	} else {
 		command := exec.Command(util.Get7zPath(), "e", "-bd", archiveName, "-o"+tempUnpackDir, "*/node.exe", "-r")
 		command.Dir = cacheDir
-		output, err := command.CombinedOutput()
+		output, err := util.Execute(command)
 		if err != nil {
-			return "", errors.WithStack(err)
+			return "", err
 		}
 
 		log.Debug(string(output))
@@ -0,0 +1,149 @@
+package snap
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+	"gopkg.in/yaml.v2"
+)
+
+const desktopLaunchFile = "snap/command-chain/desktop-launch"
+
+// base snap and the matching GNOME platform content snap (the same as snapcraft gnome extension uses)
+type baseInfo struct {
+	name string
+	// Ubuntu series to resolve stage packages
+	series           string
+	gnomeContentSnap string
+}
+
+var bases = map[string]*baseInfo{
+	"core22": {name: "core22", series: "jammy", gnomeContentSnap: "gnome-42-2204"},
+	"core24": {name: "core24", series: "noble", gnomeContentSnap: "gnome-46-2404"},
+}
+
+// libraries that Electron requires, but GNOME platform doesn't provide
+var defaultStagePackages = []string{"libnspr4", "libnss3", "libxss1", "libsecret-1-0"}
+
+// nil for the legacy base of the template
+func getBaseInfo(name string) (*baseInfo, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	result := bases[name]
+	if result == nil {
+		return nil, util.NewMessageError("snap base "+name+" is not supported (core22 and core24 are supported)", "ERR_SNAP_UNSUPPORTED_BASE")
+	}
+	return result, nil
+}
+
+// configureBase sets base, adds GNOME platform and themes content plugs and desktop-launch command chain to all apps
+func configureBase(descriptorFile string, base *baseInfo) error {
+	data, err := ioutil.ReadFile(descriptorFile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	var descriptor yaml.MapSlice
+	err = yaml.Unmarshal(data, &descriptor)
+	if err != nil {
+		return errors.WithMessage(err, "cannot parse "+descriptorFile)
+	}
+
+	descriptor = setYamlValue(descriptor, "base", base.name)
+
+	plugs, _ := getYamlValue(descriptor, "plugs").(yaml.MapSlice)
+	contentPlugs := []struct {
+		name     string
+		target   string
+		provider string
+	}{
+		{base.gnomeContentSnap, "$SNAP/gnome-platform", base.gnomeContentSnap},
+		{"gtk-3-themes", "$SNAP/data-dir/themes", "gtk-common-themes"},
+		{"icon-themes", "$SNAP/data-dir/icons", "gtk-common-themes"},
+		{"sound-themes", "$SNAP/data-dir/sounds", "gtk-common-themes"},
+	}
+	for _, plug := range contentPlugs {
+		if getYamlValue(plugs, plug.name) != nil {
+			continue
+		}
+
+		plugs = setYamlValue(plugs, plug.name, yaml.MapSlice{
+			{Key: "interface", Value: "content"},
+			{Key: "target", Value: plug.target},
+			{Key: "default-provider", Value: plug.provider},
+		})
+	}
+	descriptor = setYamlValue(descriptor, "plugs", plugs)
+
+	apps, _ := getYamlValue(descriptor, "apps").(yaml.MapSlice)
+	for i, app := range apps {
+		appDescriptor, ok := app.Value.(yaml.MapSlice)
+		if !ok {
+			continue
+		}
+
+		commandChain, _ := getYamlValue(appDescriptor, "command-chain").([]interface{})
+		if !containsYamlValue(commandChain, desktopLaunchFile) {
+			commandChain = append([]interface{}{desktopLaunchFile}, commandChain...)
+		}
+		apps[i].Value = setYamlValue(appDescriptor, "command-chain", commandChain)
+	}
+
+	data, err = yaml.Marshal(descriptor)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(ioutil.WriteFile(descriptorFile, data, 0644))
+}
+
+func writeDesktopLaunch(stageDir string, base *baseInfo) error {
+	file := filepath.Join(stageDir, filepath.FromSlash(desktopLaunchFile))
+	err := fsutil.EnsureDir(filepath.Dir(file))
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(file, []byte(createDesktopLaunch(base)), 0755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Chmod(file, 0755))
+}
+
+// libraries and data of stage packages and GNOME platform content snap
+func createDesktopLaunch(base *baseInfo) string {
+	return `#!/bin/bash
+if [ ! -d "$SNAP/gnome-platform/usr" ]; then
+  echo "GNOME platform is not available, please run: snap connect $SNAP_INSTANCE_NAME:` + base.gnomeContentSnap + ` ` + base.gnomeContentSnap + `" >&2
+  exit 1
+fi
+
+case "$SNAP_ARCH" in
+  amd64) ARCH_TRIPLET="x86_64-linux-gnu" ;;
+  arm64) ARCH_TRIPLET="aarch64-linux-gnu" ;;
+  armhf) ARCH_TRIPLET="arm-linux-gnueabihf" ;;
+  *) ARCH_TRIPLET="$SNAP_ARCH-linux-gnu" ;;
+esac
+
+GNOME_PLATFORM="$SNAP/gnome-platform"
+export LD_LIBRARY_PATH="$SNAP/usr/lib/$ARCH_TRIPLET:$SNAP/usr/lib/$ARCH_TRIPLET/nss:$GNOME_PLATFORM/usr/lib/$ARCH_TRIPLET:$GNOME_PLATFORM/usr/lib${LD_LIBRARY_PATH:+:$LD_LIBRARY_PATH}"
+export XDG_DATA_DIRS="$SNAP/data-dir:$SNAP/usr/share:$GNOME_PLATFORM/usr/share:${XDG_DATA_DIRS:-/usr/local/share:/usr/share}"
+export XDG_CONFIG_DIRS="$GNOME_PLATFORM/etc/xdg${XDG_CONFIG_DIRS:+:$XDG_CONFIG_DIRS}"
+export GTK_PATH="$GNOME_PLATFORM/usr/lib/$ARCH_TRIPLET/gtk-3.0"
+export GIO_MODULE_DIR="$GNOME_PLATFORM/usr/lib/$ARCH_TRIPLET/gio/modules"
+export GDK_PIXBUF_MODULEDIR="$GNOME_PLATFORM/usr/lib/$ARCH_TRIPLET/gdk-pixbuf-2.0/2.10.0/loaders"
+export GDK_PIXBUF_MODULE_FILE="$GDK_PIXBUF_MODULEDIR.cache"
+export FONTCONFIG_PATH="$GNOME_PLATFORM/etc/fonts"
+export LIBGL_DRIVERS_PATH="$GNOME_PLATFORM/usr/lib/$ARCH_TRIPLET/dri"
+export __EGL_VENDOR_LIBRARY_DIRS="$GNOME_PLATFORM/usr/share/glvnd/egl_vendor.d"
+export XDG_CURRENT_DESKTOP="${XDG_CURRENT_DESKTOP:-GNOME}"
+
+exec "$@"
+`
+}
@@ -0,0 +1,162 @@
+package snap
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+)
+
+// Chromium-based app doesn't work under strict confinement without these plugs
+var browserPlugs = []string{"browser-support", "audio-playback", "desktop", "wayland"}
+
+func getSnapDescriptorFile(stageDir string, isUseTemplateApp bool) string {
+	if isUseTemplateApp {
+		return filepath.Join(stageDir, "meta", "snap.yaml")
+	}
+	return filepath.Join(stageDir, "snap", "snapcraft.yaml")
+}
+
+// configureStrictConfinement adds browser plugs to all apps if confinement is strict (default).
+// Returns true if Chromium sandbox must be disabled - browser-support plug doesn't allow sandbox (allow-sandbox attribute), setuid chrome-sandbox is not packaged.
+func configureStrictConfinement(descriptorFile string) (bool, error) {
+	data, err := ioutil.ReadFile(descriptorFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, errors.WithStack(err)
+	}
+
+	var descriptor yaml.MapSlice
+	err = yaml.Unmarshal(data, &descriptor)
+	if err != nil {
+		return false, errors.WithMessage(err, "cannot parse "+descriptorFile)
+	}
+
+	confinement, _ := getYamlValue(descriptor, "confinement").(string)
+	if confinement != "" && confinement != "strict" {
+		return false, nil
+	}
+
+	apps, _ := getYamlValue(descriptor, "apps").(yaml.MapSlice)
+	for i, app := range apps {
+		appDescriptor, ok := app.Value.(yaml.MapSlice)
+		if !ok {
+			continue
+		}
+
+		plugs, _ := getYamlValue(appDescriptor, "plugs").([]interface{})
+		for _, plug := range browserPlugs {
+			if !containsYamlValue(plugs, plug) {
+				plugs = append(plugs, plug)
+			}
+		}
+		apps[i].Value = setYamlValue(appDescriptor, "plugs", plugs)
+	}
+
+	data, err = yaml.Marshal(descriptor)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	err = ioutil.WriteFile(descriptorFile, data, 0644)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	plugDefinitions, _ := getYamlValue(descriptor, "plugs").(yaml.MapSlice)
+	browserSupport, _ := getYamlValue(plugDefinitions, "browser-support").(yaml.MapSlice)
+	isSandboxAllowed, _ := getYamlValue(browserSupport, "allow-sandbox").(bool)
+	return !isSandboxAllowed, nil
+}
+
+func getYamlValue(data yaml.MapSlice, key string) interface{} {
+	for _, item := range data {
+		if item.Key == key {
+			return item.Value
+		}
+	}
+	return nil
+}
+
+// existing item is updated in place to preserve order, new one is appended
+func setYamlValue(data yaml.MapSlice, key string, value interface{}) yaml.MapSlice {
+	for i, item := range data {
+		if item.Key == key {
+			data[i].Value = value
+			return data
+		}
+	}
+	return append(data, yaml.MapItem{Key: key, Value: value})
+}
+
+func containsYamlValue(list []interface{}, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// snap is installed in dev mode and shell is started in the app confinement, skipped if snapd is not available
+func runSmokeTest(snapFile string, descriptorFile string) error {
+	_, err := exec.LookPath("snap")
+	if err != nil {
+		log.Warn("snap smoke test is skipped: snapd is not available")
+		return nil
+	}
+
+	_, err = os.Stat("/run/snapd.socket")
+	if err != nil {
+		log.Warn("snap smoke test is skipped: snapd is not running")
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(descriptorFile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	var descriptor yaml.MapSlice
+	err = yaml.Unmarshal(data, &descriptor)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	name, _ := getYamlValue(descriptor, "name").(string)
+	apps, _ := getYamlValue(descriptor, "apps").(yaml.MapSlice)
+	if name == "" || len(apps) == 0 {
+		return util.NewMessageError("cannot run snap smoke test: name or apps are not specified in "+descriptorFile, "ERR_SNAP_SMOKE_TEST_FAILED")
+	}
+
+	_, err = util.Execute(exec.Command("snap", "install", "--dangerous", snapFile))
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_, err := util.Execute(exec.Command("snap", "remove", name))
+		if err != nil {
+			log.Warn("cannot remove snap installed for smoke test", zap.Error(err))
+		}
+	}()
+
+	app := name + "." + apps[0].Key.(string)
+	if apps[0].Key == name {
+		app = name
+	}
+
+	_, err = util.Execute(exec.Command("snap", "run", "--shell", app, "-c", "true"))
+	if err != nil {
+		return util.NewMessageError("snap smoke test failed: "+err.Error(), "ERR_SNAP_SMOKE_TEST_FAILED")
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package snap
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/app-builder/pkg/vcdiff"
+	"github.com/develar/errors"
+	"go.uber.org/zap"
+)
+
+type DeltaResult struct {
+	File   string `json:"file"`
+	Format string `json:"format"`
+	Size   int64  `json:"size"`
+
+	SourceSize   int64  `json:"sourceSize"`
+	SourceSha512 string `json:"sourceSha512"`
+	TargetSize   int64  `json:"targetSize"`
+	TargetSha512 string `json:"targetSha512"`
+}
+
+func ConfigureDeltaCommand(app *kingpin.Application) {
+	command := app.Command("snap-delta", "Create delta between two revisions of snap in xdelta3 (VCDIFF) format used by the snap store. Build the new revision with --previous-snap to get minimal delta.")
+
+	source := command.Flag("source", "The previous revision.").Required().ExistingFile()
+	target := command.Flag("target", "The new revision.").Required().ExistingFile()
+	output := command.Flag("output", "The delta file.").Short('o').Required().String()
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		result, err := CreateDelta(*source, *target, *output)
+		if err != nil {
+			return err
+		}
+		return util.WriteJsonToStdOut(result)
+	})
+}
+
+// CreateDelta writes delta and verifies it (the target is restored from the source and delta and compared by hash), so, invalid delta is never uploaded
+func CreateDelta(sourceFile string, targetFile string, outFile string) (*DeltaResult, error) {
+	source, err := ioutil.ReadFile(sourceFile)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	targetSha512, targetSize, err := encodeDelta(source, targetFile, outFile)
+	if err != nil {
+		_ = os.Remove(outFile)
+		return nil, err
+	}
+
+	restoredSha512, err := restoreFromDelta(source, outFile)
+	if err != nil {
+		_ = os.Remove(outFile)
+		return nil, err
+	}
+	if restoredSha512 != targetSha512 {
+		_ = os.Remove(outFile)
+		return nil, util.NewMessageError("snap delta verification failed: restored revision differs from "+targetFile, "ERR_SNAP_DELTA_INVALID")
+	}
+
+	deltaInfo, err := os.Stat(outFile)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	sourceHash := sha512.Sum512(source)
+	result := &DeltaResult{
+		File:         outFile,
+		Format:       "xdelta3",
+		Size:         deltaInfo.Size(),
+		SourceSize:   int64(len(source)),
+		SourceSha512: hex.EncodeToString(sourceHash[:]),
+		TargetSize:   targetSize,
+		TargetSha512: targetSha512,
+	}
+	log.Info("snap delta created", zap.String("file", outFile), zap.Int64("size", result.Size), zap.Int64("targetSize", targetSize))
+	return result, nil
+}
+
+func encodeDelta(source []byte, targetFile string, outFile string) (string, int64, error) {
+	target, err := os.Open(targetFile)
+	if err != nil {
+		return "", 0, errors.WithStack(err)
+	}
+	defer util.Close(target)
+
+	out, err := os.Create(outFile)
+	if err != nil {
+		return "", 0, errors.WithStack(err)
+	}
+	defer util.RemoveOnCancel(outFile)()
+
+	hash := sha512.New()
+	counter := &countingWriter{}
+	err = vcdiff.Encode(source, io.TeeReader(target, io.MultiWriter(hash, counter)), out)
+	if err != nil {
+		_ = out.Close()
+		return "", 0, err
+	}
+
+	err = out.Close()
+	if err != nil {
+		return "", 0, errors.WithStack(err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), counter.size, nil
+}
+
+func restoreFromDelta(source []byte, deltaFile string) (string, error) {
+	delta, err := os.Open(deltaFile)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer util.Close(delta)
+
+	hash := sha512.New()
+	err = vcdiff.Decode(bytes.NewReader(source), delta, hash)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+type countingWriter struct {
+	size int64
+}
+
+func (t *countingWriter) Write(p []byte) (int, error) {
+	t.size += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,99 @@
+package snap
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/develar/app-builder/pkg/fs"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"go.uber.org/zap"
+)
+
+// https://snapcraft.io/docs/supported-snap-hooks
+var supportedHooks = []string{"configure", "default-configure", "install", "post-refresh", "pre-refresh", "remove", "prepare-device", "gate-auto-refresh", "check-health", "fde-setup"}
+
+// interface hooks are suffixed with the plug or slot name
+var supportedInterfaceHookPrefixes = []string{"connect-plug-", "connect-slot-", "disconnect-plug-", "disconnect-slot-", "prepare-plug-", "prepare-slot-", "unprepare-plug-", "unprepare-slot-"}
+
+// installHooks copies hooks from the hooks dir and explicitly specified hooks (name to file, override hooks from the dir) to the snap hooks dir (meta/hooks or snap/hooks).
+// Hook is validated (known name, shebang or ELF binary) and made executable - snapd doesn't run not executable hook.
+func installHooks(hooksDir string, hooks map[string]string, outDir string) error {
+	files := make(map[string]string)
+	if hooksDir != "" {
+		infos, err := ioutil.ReadDir(hooksDir)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		for _, info := range infos {
+			files[info.Name()] = filepath.Join(hooksDir, info.Name())
+		}
+	}
+	for name, file := range hooks {
+		files[name] = file
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		file := files[name]
+		err := validateHook(name, file)
+		if err != nil {
+			return err
+		}
+
+		err = fs.CopyFileAndRestoreNormalPermissions(file, filepath.Join(outDir, name), 0755)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateHook(name string, file string) error {
+	if !isSupportedHook(name) {
+		return util.NewMessageError("snap hook "+name+" ("+file+") is not supported, supported hooks: "+strings.Join(supportedHooks, ", ")+" and interface hooks ("+strings.Join(supportedInterfaceHookPrefixes, "<name>, ")+"<name>)", "ERR_SNAP_UNSUPPORTED_HOOK")
+	}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if !info.Mode().IsRegular() {
+		return util.NewMessageError("snap hook "+name+" ("+file+") must be a file", "ERR_SNAP_INVALID_HOOK")
+	}
+
+	header, err := fs.ReadFile(file, 4)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(header, []byte("#!")) && !bytes.Equal(header, []byte("\x7fELF")) {
+		return util.NewMessageError("snap hook "+name+" ("+file+") must start with shebang (e.g. #!/bin/sh) or be an executable binary", "ERR_SNAP_INVALID_HOOK")
+	}
+
+	if info.Mode().Perm()&0111 == 0 {
+		log.Debug("snap hook is not executable, permissions are fixed", zap.String("hook", name), zap.String("file", file))
+	}
+	return nil
+}
+
+func isSupportedHook(name string) bool {
+	if util.ContainsString(supportedHooks, name) {
+		return true
+	}
+	for _, prefix := range supportedInterfaceHookPrefixes {
+		if strings.HasPrefix(name, prefix) && len(name) > len(prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+package snap
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/json-iterator/go"
+	"gopkg.in/yaml.v2"
+)
+
+// https://snapcraft.io/docs/snap-layouts
+type layoutEntry struct {
+	Bind     string `json:"bind,omitempty" yaml:"bind,omitempty"`
+	BindFile string `json:"bind-file,omitempty" yaml:"bind-file,omitempty"`
+	Type     string `json:"type,omitempty" yaml:"type,omitempty"`
+	Symlink  string `json:"symlink,omitempty" yaml:"symlink,omitempty"`
+	User     string `json:"user,omitempty" yaml:"user,omitempty"`
+	Group    string `json:"group,omitempty" yaml:"group,omitempty"`
+	Mode     uint32 `json:"mode,omitempty" yaml:"mode,omitempty"`
+}
+
+// snapd refuses to install snap with layout in these dirs
+var offLimitsLayoutDirs = []string{"/proc", "/sys", "/dev", "/run", "/boot", "/lost+found", "/media", "/var/lib/snapd", "/var/snap"}
+
+var layoutSourceVariables = []string{"$SNAP", "$SNAP_DATA", "$SNAP_COMMON"}
+
+// configureLayout adds layouts (JSON object, path to the layout entry) to the snap descriptor and validates all layouts of the descriptor -
+// invalid layout is reported now and not as snap install failure.
+func configureLayout(descriptorFile string, layoutJson string) error {
+	var layouts map[string]*layoutEntry
+	if layoutJson != "" {
+		err := jsoniter.UnmarshalFromString(layoutJson, &layouts)
+		if err != nil {
+			return errors.WithMessage(err, "cannot parse layout")
+		}
+	}
+
+	data, err := ioutil.ReadFile(descriptorFile)
+	if err != nil {
+		if os.IsNotExist(err) && len(layouts) == 0 {
+			return nil
+		}
+		return errors.WithStack(err)
+	}
+
+	var descriptor yaml.MapSlice
+	err = yaml.Unmarshal(data, &descriptor)
+	if err != nil {
+		return errors.WithMessage(err, "cannot parse "+descriptorFile)
+	}
+
+	var parsed struct {
+		Layout map[string]*layoutEntry `yaml:"layout"`
+	}
+	err = yaml.Unmarshal(data, &parsed)
+	if err != nil {
+		return errors.WithMessage(err, "cannot parse layout in "+descriptorFile)
+	}
+	if len(layouts) == 0 && len(parsed.Layout) == 0 {
+		return nil
+	}
+
+	if parsed.Layout == nil {
+		parsed.Layout = make(map[string]*layoutEntry)
+	}
+	for layoutPath, entry := range layouts {
+		parsed.Layout[layoutPath] = entry
+	}
+
+	paths := make([]string, 0, len(parsed.Layout))
+	for layoutPath := range parsed.Layout {
+		paths = append(paths, layoutPath)
+	}
+	sort.Strings(paths)
+
+	var layoutValue yaml.MapSlice
+	for _, layoutPath := range paths {
+		err = validateLayout(layoutPath, parsed.Layout[layoutPath])
+		if err != nil {
+			return err
+		}
+		layoutValue = append(layoutValue, yaml.MapItem{Key: layoutPath, Value: parsed.Layout[layoutPath]})
+	}
+
+	if len(layouts) == 0 {
+		return nil
+	}
+
+	data, err = yaml.Marshal(setYamlValue(descriptor, "layout", layoutValue))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(ioutil.WriteFile(descriptorFile, data, 0644))
+}
+
+// the same rules as snapd uses (snap/validate.go, ValidateLayout)
+func validateLayout(layoutPath string, entry *layoutEntry) error {
+	newError := func(message string) error {
+		return util.NewMessageError("layout "+strconv.Quote(layoutPath)+" "+message, "ERR_SNAP_INVALID_LAYOUT")
+	}
+
+	if entry == nil {
+		return newError("must define a bind mount, a filesystem mount or a symlink")
+	}
+
+	mountPoint, ok := expandLayoutPath(layoutPath)
+	if !ok {
+		return newError("uses invalid mount point: must be absolute and clean (only $SNAP, $SNAP_DATA and $SNAP_COMMON variables are allowed)")
+	}
+	for _, dir := range offLimitsLayoutDirs {
+		if mountPoint == dir || strings.HasPrefix(mountPoint, dir+"/") {
+			return newError("is in an off-limits area (" + dir + "), strict confinement doesn't allow it")
+		}
+	}
+	if mountPoint == "/" {
+		return newError("cannot be the root directory")
+	}
+
+	count := 0
+	for _, value := range []string{entry.Bind, entry.BindFile, entry.Type, entry.Symlink} {
+		if value != "" {
+			count++
+		}
+	}
+	if count != 1 {
+		return newError("must define exactly one of bind, bind-file, type (tmpfs) or symlink")
+	}
+
+	for _, source := range []string{entry.Bind, entry.BindFile, entry.Symlink} {
+		if source == "" {
+			continue
+		}
+		if _, ok := expandLayoutPath(source); !ok || !hasLayoutSourceVariable(source) {
+			return newError("uses invalid source " + strconv.Quote(source) + ": must be clean and start with $SNAP, $SNAP_DATA or $SNAP_COMMON")
+		}
+	}
+
+	if entry.Type != "" && entry.Type != "tmpfs" {
+		return newError("uses invalid filesystem " + strconv.Quote(entry.Type) + " (only tmpfs is supported)")
+	}
+	if entry.User != "" && entry.User != "root" {
+		return newError("uses invalid user " + strconv.Quote(entry.User) + " (only root is supported)")
+	}
+	if entry.Group != "" && entry.Group != "root" {
+		return newError("uses invalid group " + strconv.Quote(entry.Group) + " (only root is supported)")
+	}
+	if entry.Mode&01777 != entry.Mode {
+		return newError("uses invalid mode " + strconv.FormatUint(uint64(entry.Mode), 8))
+	}
+	return nil
+}
+
+// variables are replaced with fake absolute dirs to check that path is absolute and clean
+func expandLayoutPath(value string) (string, bool) {
+	expanded := value
+	if strings.HasPrefix(value, "$") {
+		end := strings.IndexRune(value, '/')
+		if end < 0 {
+			end = len(value)
+		}
+		if !util.ContainsString(layoutSourceVariables, value[:end]) {
+			return "", false
+		}
+		expanded = "/snap-variable/" + value[1:end] + value[end:]
+	}
+	if strings.ContainsRune(expanded, '$') {
+		return "", false
+	}
+	return expanded, path.IsAbs(expanded) && path.Clean(expanded) == expanded
+}
+
+func hasLayoutSourceVariable(value string) bool {
+	for _, variable := range layoutSourceVariables {
+		if value == variable || strings.HasPrefix(value, variable+"/") {
+			return true
+		}
+	}
+	return false
+}
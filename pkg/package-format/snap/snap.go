@@ -12,6 +12,8 @@ import (
 	"syscall"
 
 	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/archive/squashfs"
+	"github.com/develar/app-builder/pkg/deprecation"
 	"github.com/develar/app-builder/pkg/download"
 	"github.com/develar/app-builder/pkg/fs"
 	"github.com/develar/app-builder/pkg/linuxTools"
@@ -35,6 +37,8 @@ type SnapOptions struct {
 	stageDir       *string
 	icon           *string
 	hooksDir       *string
+	hooks          *map[string]string
+	layout         *string
 	executableName *string
 
 	extraAppArgs     *string
@@ -42,6 +46,13 @@ type SnapOptions struct {
 
 	arch   *string
 	output *string
+	// the previous revision, data of unchanged files is reused to get minimal delta
+	previousSnap *string
+
+	base          *string
+	stagePackages *[]string
+
+	isSmokeTest *bool
 }
 
 func ConfigureCommand(app *kingpin.Application) {
@@ -58,15 +69,25 @@ func ConfigureCommand(app *kingpin.Application) {
 		stageDir:         command.Flag("stage", "The stage dir.").Short('s').Required().String(),
 		icon:             command.Flag("icon", "The path to the icon.").String(),
 		hooksDir:         command.Flag("hooks", "The hooks dir.").String(),
+		hooks:            command.Flag("hook", "The hook file (e.g. configure=build/snap/configure), overrides the hook from the hooks dir.").StringMap(),
+		layout:           command.Flag("layout", `The layouts as JSON object (e.g. {"/usr/share/foo": {"bind": "$SNAP/usr/share/foo"}}).`).String(),
 		executableName:   command.Flag("executable", "The executable file name to create command wrapper.").String(),
-		extraAppArgs:     command.Flag("extraAppArgs", "The extra app launch arguments").String(),
+		extraAppArgs:     command.Flag("extra-app-args", "The extra app launch arguments").String(),
 		excludedAppFiles: command.Flag("exclude", "The excluded app files.").Strings(),
 
 		arch: command.Flag("arch", "The arch.").Default("amd64").String(),
 
-		output: command.Flag("output", "The output file.").Short('o').Required().String(),
+		output:       command.Flag("output", "The output file.").Short('o').Required().String(),
+		previousSnap: command.Flag("previous-snap", "The previous revision of the snap. Data of unchanged files is copied as is in the same order, so, delta between revisions (snap-delta) is minimal.").ExistingFile(),
+
+		base:          command.Flag("base", "The base snap. If specified, GNOME platform content snap is used instead of template and stage packages are unpacked into the snap.").Enum("core22", "core24"),
+		stagePackages: command.Flag("stage-package", "The Ubuntu package to unpack into the snap (base must be specified). Electron dependencies that GNOME platform doesn't provide by default.").Strings(),
+
+		isSmokeTest: command.Flag("smoke-test", "Install built snap and run shell in the app confinement (snap run --shell) if snapd is available.").Bool(),
 	}
 
+	deprecation.StringFlagAlias(command, "extraAppArgs", "extra-app-args", options.extraAppArgs)
+
 	isRemoveStage := util.ConfigureIsRemoveStageParam(command)
 
 	command.Action(func(context *kingpin.ParseContext) error {
@@ -75,6 +96,16 @@ func ConfigureCommand(app *kingpin.Application) {
 			return errors.WithStack(err)
 		}
 
+		if strings.HasSuffix(resolvedTemplateDir, ".snap") {
+			resolvedTemplateDir, err = extractSnapTemplate(resolvedTemplateDir)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				_ = os.RemoveAll(resolvedTemplateDir)
+			}()
+		}
+
 		err = Snap(resolvedTemplateDir, options)
 		if err != nil {
 			switch e := errors.Cause(err).(type) {
@@ -113,6 +144,21 @@ func ResolveTemplateDir(templateFile string, templateUrl string, templateSha512
 	}
 }
 
+// template can be a snap (squashfs image, e.g. base or core snap) - it is extracted in-process, unsquashfs is not required
+func extractSnapTemplate(file string) (string, error) {
+	dir, err := util.CreateTempDir("snap-template-")
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	err = squashfs.ExtractFile(file, dir, nil)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
 func CheckSnapcraftVersion(isRequireToBeInstalled bool) error {
 	out, err := exec.Command("snapcraft", "--version").Output()
 
@@ -154,7 +200,13 @@ func doCheckSnapVersion(rawVersion string, installMessage string) error {
 
 func Snap(templateDir string, options SnapOptions) error {
 	stageDir := *options.stageDir
-	isUseTemplateApp := len(templateDir) != 0
+	base, err := getBaseInfo(*options.base)
+	if err != nil {
+		return err
+	}
+
+	// the same layout as for template (meta/snap.yaml), but without template
+	isUseTemplateApp := len(templateDir) != 0 || base != nil
 	var snapMetaDir string
 	if isUseTemplateApp {
 		snapMetaDir = filepath.Join(stageDir, "meta")
@@ -170,21 +222,53 @@ func Snap(templateDir string, options SnapOptions) error {
 		}
 	}
 
-	if len(*options.hooksDir) != 0 {
-		err := fs.CopyUsingHardlink(*options.hooksDir, filepath.Join(snapMetaDir, "hooks"))
-		if err != nil {
-			return errors.WithStack(err)
-		}
+	err = installHooks(*options.hooksDir, *options.hooks, filepath.Join(snapMetaDir, "hooks"))
+	if err != nil {
+		return err
 	}
 
 	scriptDir := filepath.Join(stageDir, "scripts")
-	err := fsutil.EnsureEmptyDir(scriptDir)
+	err = fsutil.EnsureEmptyDir(scriptDir)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
+	descriptorFile := getSnapDescriptorFile(stageDir, isUseTemplateApp)
+	if base != nil {
+		err = configureBase(descriptorFile, base)
+		if err != nil {
+			return err
+		}
+
+		err = writeDesktopLaunch(stageDir, base)
+		if err != nil {
+			return err
+		}
+
+		stagePackages := *options.stagePackages
+		if len(stagePackages) == 0 {
+			stagePackages = defaultStagePackages
+		}
+		err = installStagePackages(stagePackages, base, *options.arch, stageDir)
+		if err != nil {
+			return err
+		}
+	} else if len(*options.stagePackages) != 0 {
+		return util.NewMessageError("stage packages are supported only if base is specified", "ERR_SNAP_STAGE_PACKAGES_WITHOUT_BASE")
+	}
+
+	err = configureLayout(descriptorFile, *options.layout)
+	if err != nil {
+		return err
+	}
+
+	isNoSandbox, err := configureStrictConfinement(descriptorFile)
+	if err != nil {
+		return err
+	}
+
 	if len(*options.executableName) != 0 {
-		err := writeCommandWrapper(options, isUseTemplateApp, scriptDir)
+		err := writeCommandWrapper(options, isUseTemplateApp, base != nil, scriptDir, isNoSandbox)
 		if err != nil {
 			return errors.WithStack(err)
 		}
@@ -195,13 +279,21 @@ func Snap(templateDir string, options SnapOptions) error {
 
 	switch {
 	case isUseTemplateApp:
-		return buildUsingTemplate(templateDir, options)
+		err = buildUsingTemplate(templateDir, options)
 	default:
-		return buildWithoutTemplate(options, scriptDir)
+		err = buildWithoutTemplate(options, scriptDir)
+	}
+	if err != nil {
+		return err
+	}
+
+	if *options.isSmokeTest {
+		return runSmokeTest(*options.output, descriptorFile)
 	}
+	return nil
 }
 
-func writeCommandWrapper(options SnapOptions, isUseTemplateApp bool, scriptDir string) error {
+func writeCommandWrapper(options SnapOptions, isUseTemplateApp bool, isUseBase bool, scriptDir string, isNoSandbox bool) error {
 	var appPrefix string
 	var dir string
 	if isUseTemplateApp {
@@ -213,7 +305,18 @@ func writeCommandWrapper(options SnapOptions, isUseTemplateApp bool, scriptDir s
 	}
 
 	commandWrapperFile := filepath.Join(dir, "command.sh")
-	text := "#!/bin/bash -e\n" + `exec "$SNAP/desktop-init.sh" "$SNAP/desktop-common.sh" "$SNAP/desktop-gnome-specific.sh" "$SNAP/` + appPrefix + *options.executableName + `" "$@"`
+	var text string
+	if isUseBase {
+		// desktop environment is set up by desktop-launch command chain
+		text = "#!/bin/bash -e\n" + `exec "$SNAP/` + *options.executableName + `" "$@"`
+	} else {
+		text = "#!/bin/bash -e\n" + `exec "$SNAP/desktop-init.sh" "$SNAP/desktop-common.sh" "$SNAP/desktop-gnome-specific.sh" "$SNAP/` + appPrefix + *options.executableName + `" "$@"`
+	}
+
+	// setuid chrome-sandbox is removed and snapd doesn't allow namespace sandbox without allow-sandbox attribute of browser-support plug
+	if isNoSandbox && !strings.Contains(*options.extraAppArgs, "--no-sandbox") {
+		text += " --no-sandbox"
+	}
 
 	extraAppArgs := *options.extraAppArgs
 	if extraAppArgs != "" {
@@ -236,28 +339,15 @@ func writeCommandWrapper(options SnapOptions, isUseTemplateApp bool, scriptDir s
 func buildUsingTemplate(templateDir string, options SnapOptions) error {
 	stageDir := *options.stageDir
 
-	mksquashfsPath, err := linuxTools.GetMksquashfs()
-	if err != nil {
-		return errors.WithStack(err)
-	}
-
-	var args []string
-
-	args, err = linuxTools.ReadDirContentTo(templateDir, args, nil)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-
-	args, err = linuxTools.ReadDirContentTo(stageDir, args, nil)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-
 	// https://github.com/electron-userland/electron-builder/issues/3608
 	// even if electron-builder will correctly unset setgid/setuid, still, quite a lot of possibilities for user to create such incorrect permissions,
 	// so, just unset it using chmod right before packaging
-	dirs := []string{stageDir, *options.appDir, templateDir}
-	err = util.MapAsync(len(dirs), func(taskIndex int) (func() error, error) {
+	dirs := []string{stageDir, *options.appDir}
+	// no template if base is specified
+	if len(templateDir) != 0 {
+		dirs = append(dirs, templateDir)
+	}
+	err := util.MapAsync(len(dirs), func(taskIndex int) (func() error, error) {
 		dir := dirs[taskIndex]
 		return func() error {
 			command := exec.Command("chmod", "-R", "g-s", dir)
@@ -274,13 +364,41 @@ func buildUsingTemplate(templateDir string, options SnapOptions) error {
 		return errors.WithStack(err)
 	}
 
-	args, err = linuxTools.ReadDirContentTo(*options.appDir, args, func(name string) bool {
+	appFilter := func(name string) bool {
 		if name == "LICENSES.chromium.html" || name == "LICENSE.electron.txt" {
 			return false
 		}
 		return options.excludedAppFiles == nil || !util.ContainsString(*options.excludedAppFiles, name)
-	})
+	}
+
+	if !linuxTools.IsMksquashfsRequested() {
+		return writeSquashFs(templateDir, stageDir, *options.appDir, appFilter, *options.output, *options.previousSnap)
+	}
+
+	mksquashfsPath, err := linuxTools.GetMksquashfs()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if len(*options.previousSnap) != 0 {
+		log.Warn("previous snap is not used if mksquashfs is requested", zap.String("file", *options.previousSnap))
+	}
+
+	var args []string
+
+	if len(templateDir) != 0 {
+		args, err = linuxTools.ReadDirContentTo(templateDir, args, nil)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	args, err = linuxTools.ReadDirContentTo(stageDir, args, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
 
+	args, err = linuxTools.ReadDirContentTo(*options.appDir, args, appFilter)
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -294,6 +412,32 @@ func buildUsingTemplate(templateDir string, options SnapOptions) error {
 	return nil
 }
 
+// the same options as for mksquashfs: xz, no fragments, all files are owned by root
+func writeSquashFs(templateDir string, stageDir string, appDir string, appFilter func(name string) bool, outFile string, previousSnap string) error {
+	writer, err := squashfs.NewWriter(squashfs.WriterOptions{Compression: "xz", NoFragments: true, PreviousImage: previousSnap})
+	if err != nil {
+		return err
+	}
+
+	if len(templateDir) != 0 {
+		err = writer.AddDir(templateDir, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = writer.AddDir(stageDir, nil)
+	if err != nil {
+		return err
+	}
+
+	err = writer.AddDir(appDir, appFilter)
+	if err != nil {
+		return err
+	}
+	return writer.WriteFile(outFile, 0)
+}
+
 func buildWithoutTemplate(options SnapOptions, scriptDir string) error {
 	err := CheckSnapcraftVersion(true)
 	if err != nil {
@@ -1,11 +1,14 @@
 package snap
 
 import (
+	"os"
 	"os/exec"
 	"strings"
 
 	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/fakes"
 	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
 )
 
 func ConfigurePublishCommand(app *kingpin.Application) {
@@ -20,6 +23,18 @@ func ConfigurePublishCommand(app *kingpin.Application) {
 }
 
 func publishToStore(file string, channels []string) error {
+	if fakes.IsEnabled() {
+		fileInfo, err := os.Stat(file)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return fakes.Record(fakes.ServiceSnapStore, "push", map[string]interface{}{
+			"file":     file,
+			"size":     fileInfo.Size(),
+			"channels": channels,
+		})
+	}
+
 	args := []string{"push", file}
 	if len(channels) != 0 {
 		args = append(args, "--release")
@@ -1,8 +1,17 @@
 package snap
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/develar/app-builder/pkg/log"
 	. "github.com/onsi/gomega"
 )
 
@@ -23,4 +32,246 @@ func TestCheckWineVersion(t *testing.T) {
 
 	err = doCheckSnapVersion("2.12", "")
 	g.Expect(err).To(HaveOccurred())
-}
\ No newline at end of file
+}
+
+func TestConfigureStrictConfinement(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "snap")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "snap.yaml")
+	g.Expect(ioutil.WriteFile(file, []byte("name: app\napps:\n  app:\n    command: command.sh\n    plugs: [desktop, x11]\n"), 0644)).To(Succeed())
+
+	isNoSandbox, err := configureStrictConfinement(file)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(isNoSandbox).To(BeTrue())
+
+	data, err := ioutil.ReadFile(file)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(data)).To(Equal("name: app\napps:\n  app:\n    command: command.sh\n    plugs:\n    - desktop\n    - x11\n    - browser-support\n    - audio-playback\n    - wayland\n"))
+
+	g.Expect(ioutil.WriteFile(file, []byte("name: app\nconfinement: strict\nplugs:\n  browser-support:\n    allow-sandbox: true\napps:\n  app:\n    command: command.sh\n"), 0644)).To(Succeed())
+	isNoSandbox, err = configureStrictConfinement(file)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(isNoSandbox).To(BeFalse())
+
+	// classic - not changed
+	g.Expect(ioutil.WriteFile(file, []byte("name: app\nconfinement: classic\napps:\n  app:\n    command: command.sh\n"), 0644)).To(Succeed())
+	isNoSandbox, err = configureStrictConfinement(file)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(isNoSandbox).To(BeFalse())
+	data, err = ioutil.ReadFile(file)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(data)).To(Equal("name: app\nconfinement: classic\napps:\n  app:\n    command: command.sh\n"))
+}
+
+func TestConfigureBase(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "snap")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	base, err := getBaseInfo("core22")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	file := filepath.Join(dir, "snap.yaml")
+	g.Expect(ioutil.WriteFile(file, []byte("name: app\nbase: core18\napps:\n  app:\n    command: command.sh\n"), 0644)).To(Succeed())
+	g.Expect(configureBase(file, base)).To(Succeed())
+	// idempotent
+	g.Expect(configureBase(file, base)).To(Succeed())
+
+	data, err := ioutil.ReadFile(file)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(data)).To(Equal(`name: app
+base: core22
+apps:
+  app:
+    command: command.sh
+    command-chain:
+    - snap/command-chain/desktop-launch
+plugs:
+  gnome-42-2204:
+    interface: content
+    target: $SNAP/gnome-platform
+    default-provider: gnome-42-2204
+  gtk-3-themes:
+    interface: content
+    target: $SNAP/data-dir/themes
+    default-provider: gtk-common-themes
+  icon-themes:
+    interface: content
+    target: $SNAP/data-dir/icons
+    default-provider: gtk-common-themes
+  sound-themes:
+    interface: content
+    target: $SNAP/data-dir/sounds
+    default-provider: gtk-common-themes
+`))
+
+	_, err = getBaseInfo("core18")
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestInstallHooks(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "snap")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	hooksDir := filepath.Join(dir, "hooks")
+	g.Expect(os.MkdirAll(hooksDir, 0755)).To(Succeed())
+	g.Expect(ioutil.WriteFile(filepath.Join(hooksDir, "install"), []byte("#!/bin/sh\necho install\n"), 0644)).To(Succeed())
+	g.Expect(ioutil.WriteFile(filepath.Join(hooksDir, "configure"), []byte("#!/bin/sh\necho old\n"), 0755)).To(Succeed())
+	configure := filepath.Join(dir, "configure.sh")
+	g.Expect(ioutil.WriteFile(configure, []byte("#!/bin/sh\necho new\n"), 0644)).To(Succeed())
+
+	outDir := filepath.Join(dir, "meta", "hooks")
+	g.Expect(installHooks(hooksDir, map[string]string{"configure": configure}, outDir)).To(Succeed())
+
+	data, err := ioutil.ReadFile(filepath.Join(outDir, "configure"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(data)).To(Equal("#!/bin/sh\necho new\n"))
+	for _, name := range []string{"install", "configure"} {
+		info, err := os.Stat(filepath.Join(outDir, name))
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(info.Mode().Perm()).To(Equal(os.FileMode(0755)))
+	}
+
+	// no shebang
+	invalid := filepath.Join(dir, "invalid.sh")
+	g.Expect(ioutil.WriteFile(invalid, []byte("echo test\n"), 0755)).To(Succeed())
+	err = installHooks("", map[string]string{"post-refresh": invalid}, outDir)
+	g.Expect(err).To(MatchError(ContainSubstring("must start with shebang")))
+
+	err = installHooks("", map[string]string{"refresh": configure}, outDir)
+	g.Expect(err).To(MatchError(ContainSubstring("snap hook refresh")))
+
+	g.Expect(installHooks("", map[string]string{"connect-plug-network": configure}, outDir)).To(Succeed())
+}
+
+func TestConfigureLayout(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "snap")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "snap.yaml")
+	g.Expect(ioutil.WriteFile(file, []byte("name: app\nlayout:\n  /var/lib/app:\n    bind: $SNAP_DATA/var/lib/app\napps:\n  app:\n    command: command.sh\n"), 0644)).To(Succeed())
+	g.Expect(configureLayout(file, `{"/usr/share/app": {"symlink": "$SNAP/usr/share/app"}, "/etc/app": {"type": "tmpfs", "mode": 493}}`)).To(Succeed())
+
+	data, err := ioutil.ReadFile(file)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(data)).To(Equal(`name: app
+layout:
+  /etc/app:
+    type: tmpfs
+    mode: 493
+  /usr/share/app:
+    symlink: $SNAP/usr/share/app
+  /var/lib/app:
+    bind: $SNAP_DATA/var/lib/app
+apps:
+  app:
+    command: command.sh
+`))
+
+	for layout, message := range map[string]string{
+		`{"/run/app": {"bind": "$SNAP/run"}}`:                  "off-limits area (/run)",
+		`{"/usr/share/app": {"bind": "/usr/share/app"}}`:       "must be clean and start with $SNAP",
+		`{"/usr/share/app": {"bind": "$HOME/app"}}`:            "must be clean and start with $SNAP",
+		`{"/usr/share/../app": {"bind": "$SNAP/app"}}`:         "must be absolute and clean",
+		`{"/usr/share/app": {}}`:                               "must define exactly one of",
+		`{"/usr/share/app": {"type": "ext4"}}`:                 "invalid filesystem",
+		`{"/usr/share/app": {"type": "tmpfs", "user": "app"}}`: "invalid user",
+	} {
+		err = configureLayout(file, layout)
+		g.Expect(err).To(HaveOccurred(), layout)
+		g.Expect(err.Error()).To(ContainSubstring(message), layout)
+	}
+
+	// existing invalid layout is reported
+	g.Expect(ioutil.WriteFile(file, []byte("name: app\nlayout:\n  /dev/app:\n    bind: $SNAP/dev\n"), 0644)).To(Succeed())
+	g.Expect(configureLayout(file, "")).To(MatchError(ContainSubstring("off-limits area (/dev)")))
+}
+
+func TestParsePackageIndex(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	index := `Package: libnss3
+Version: 2:3.98-1build1
+Filename: pool/main/n/nss/libnss3_3.98-1build1_amd64.deb
+SHA512: 00ff
+
+Package: libnspr4
+Filename: pool/main/n/nspr/libnspr4_4.35-1.1build1_amd64.deb
+SHA512: ff00
+Package: libnss3
+Filename: pool/main/n/nss/libnss3_old_amd64.deb
+SHA512: 0000`
+
+	result := make(map[string]*stagePackage)
+	g.Expect(parsePackageIndex(strings.NewReader(index), "http://mirror", []string{"libnss3", "libxss1"}, result)).To(Succeed())
+	g.Expect(result).To(HaveLen(1))
+	g.Expect(*result["libnss3"]).To(Equal(stagePackage{
+		name:   "libnss3",
+		url:    "http://mirror/pool/main/n/nss/libnss3_3.98-1build1_amd64.deb",
+		sha512: "AP8=",
+	}))
+}
+
+func TestExtractDeb(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "snap")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	var data bytes.Buffer
+	gzipWriter := gzip.NewWriter(&data)
+	tarWriter := tar.NewWriter(gzipWriter)
+	writeTarEntry(g, tarWriter, &tar.Header{Name: "./usr/lib/x86_64-linux-gnu/", Typeflag: tar.TypeDir, Mode: 0755})
+	writeTarEntry(g, tarWriter, &tar.Header{Name: "./usr/lib/x86_64-linux-gnu/libnss3.so", Typeflag: tar.TypeReg, Mode: 0644, Size: 3}, "lib")
+	writeTarEntry(g, tarWriter, &tar.Header{Name: "./usr/lib/x86_64-linux-gnu/libnss3.so.1", Typeflag: tar.TypeSymlink, Linkname: "libnss3.so"})
+	writeTarEntry(g, tarWriter, &tar.Header{Name: "./usr/share/doc/libnss3/copyright", Typeflag: tar.TypeReg, Mode: 0644, Size: 1}, "c")
+	g.Expect(tarWriter.Close()).To(Succeed())
+	g.Expect(gzipWriter.Close()).To(Succeed())
+
+	var deb bytes.Buffer
+	deb.WriteString("!<arch>\n")
+	writeArMember(&deb, "debian-binary", []byte("2.0\n"))
+	writeArMember(&deb, "control.tar.gz", []byte("odd"))
+	writeArMember(&deb, "data.tar.gz", data.Bytes())
+
+	debFile := filepath.Join(dir, "test.deb")
+	g.Expect(ioutil.WriteFile(debFile, deb.Bytes(), 0644)).To(Succeed())
+
+	outDir := filepath.Join(dir, "out")
+	g.Expect(extractDeb(debFile, outDir)).To(Succeed())
+
+	content, err := ioutil.ReadFile(filepath.Join(outDir, "usr/lib/x86_64-linux-gnu/libnss3.so.1"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(content)).To(Equal("lib"))
+	g.Expect(filepath.Join(outDir, "usr/share/doc")).NotTo(BeAnExistingFile())
+}
+
+func writeTarEntry(g *WithT, writer *tar.Writer, header *tar.Header, content ...string) {
+	g.Expect(writer.WriteHeader(header)).To(Succeed())
+	for _, s := range content {
+		_, err := writer.Write([]byte(s))
+		g.Expect(err).NotTo(HaveOccurred())
+	}
+}
+
+func writeArMember(buffer *bytes.Buffer, name string, data []byte) {
+	_, _ = fmt.Fprintf(buffer, "%-16s%-12d%-6d%-6d%-8s%-10d`\n", name+"/", 0, 0, 0, "100644", len(data))
+	buffer.Write(data)
+	if len(data)%2 != 0 {
+		buffer.WriteByte('\n')
+	}
+}
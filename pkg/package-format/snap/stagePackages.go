@@ -0,0 +1,277 @@
+package snap
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/develar/app-builder/pkg/download"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"go.uber.org/zap"
+)
+
+type stagePackage struct {
+	name string
+	url  string
+	// base64, as download.Downloader expects
+	sha512 string
+}
+
+func getUbuntuMirror(arch string) string {
+	if arch == "amd64" || arch == "i386" {
+		return util.GetEnvOrDefault("SNAP_STAGE_PACKAGES_MIRROR", "http://archive.ubuntu.com/ubuntu")
+	}
+	return util.GetEnvOrDefault("SNAP_STAGE_PACKAGES_PORTS_MIRROR", "http://ports.ubuntu.com/ubuntu-ports")
+}
+
+// installStagePackages downloads debs of the base series (updates pocket first) and unpacks them into the stage dir (snap root).
+// Dependencies are not resolved - libraries of the base and GNOME platform are available at runtime.
+func installStagePackages(names []string, base *baseInfo, arch string, stageDir string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	mirror := getUbuntuMirror(arch)
+	packages := make(map[string]*stagePackage)
+	for _, pocket := range []string{base.series + "-updates", base.series} {
+		for _, component := range []string{"main", "universe"} {
+			if len(packages) == len(names) {
+				break
+			}
+
+			err := readPackageIndex(mirror+"/dists/"+pocket+"/"+component+"/binary-"+arch+"/Packages.xz", mirror, names, packages)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	cacheDir, err := download.GetCacheDirectoryForArtifactCustom("snap-stage-packages")
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if packages[name] == nil {
+			return util.NewMessageError("stage package "+name+" is not found in "+base.series+" ("+arch+")", "ERR_SNAP_STAGE_PACKAGE_NOT_FOUND")
+		}
+	}
+
+	return util.MapAsync(len(names), func(taskIndex int) (func() error, error) {
+		stagePackage := packages[names[taskIndex]]
+		return func() error {
+			debFile := filepath.Join(cacheDir, path.Base(stagePackage.url))
+			_, err := os.Stat(debFile)
+			if err != nil {
+				log.Info("downloading stage package", zap.String("url", stagePackage.url))
+				err = fsutil.EnsureDir(cacheDir)
+				if err != nil {
+					return err
+				}
+
+				tempFile := debFile + "." + strconv.Itoa(os.Getpid())
+				err = download.NewDownloader().Download(stagePackage.url, tempFile, stagePackage.sha512)
+				if err != nil {
+					return err
+				}
+
+				err = os.Rename(tempFile, debFile)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+			}
+			return extractDeb(debFile, stageDir)
+		}, nil
+	})
+}
+
+func readPackageIndex(url string, mirror string, names []string, result map[string]*stagePackage) error {
+	client := &http.Client{Transport: &http.Transport{Proxy: util.ProxyFromEnvironmentAndNpm}}
+	response, err := client.Get(url)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(response.Body)
+
+	if response.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return errors.Errorf("cannot download %s: %s", url, response.Status)
+	}
+
+	reader, err := xz.NewReader(bufio.NewReader(response.Body))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return parsePackageIndex(reader, mirror, names, result)
+}
+
+// Packages index is a list of paragraphs separated by empty line, the first paragraph for the name wins
+func parsePackageIndex(reader io.Reader, mirror string, names []string, result map[string]*stagePackage) error {
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		if result[name] == nil {
+			wanted[name] = true
+		}
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	current := &stagePackage{}
+	flush := func() {
+		if wanted[current.name] && current.url != "" && current.sha512 != "" {
+			result[current.name] = current
+			delete(wanted, current.name)
+		}
+		current = &stagePackage{}
+	}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			flush()
+		case strings.HasPrefix(line, "Package: "):
+			current.name = strings.TrimPrefix(line, "Package: ")
+		case strings.HasPrefix(line, "Filename: "):
+			current.url = mirror + "/" + strings.TrimPrefix(line, "Filename: ")
+		case strings.HasPrefix(line, "SHA512: "):
+			checksum, err := hex.DecodeString(strings.TrimPrefix(line, "SHA512: "))
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			current.sha512 = base64.StdEncoding.EncodeToString(checksum)
+		}
+	}
+	flush()
+	return errors.WithStack(scanner.Err())
+}
+
+// deb is ar archive with data.tar.{xz,zst,gz} member
+func extractDeb(file string, outDir string) error {
+	reader, err := os.Open(file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(reader)
+
+	bufferedReader := bufio.NewReader(reader)
+	magic := make([]byte, 8)
+	_, err = io.ReadFull(bufferedReader, magic)
+	if err != nil || string(magic) != "!<arch>\n" {
+		return errors.Errorf("%s is not a deb package", file)
+	}
+
+	header := make([]byte, 60)
+	for {
+		_, err = io.ReadFull(bufferedReader, header)
+		if err != nil {
+			return errors.Errorf("data archive is not found in %s", file)
+		}
+
+		name := strings.TrimSuffix(strings.TrimSpace(string(header[0:16])), "/")
+		size, err := strconv.ParseInt(strings.TrimSpace(string(header[48:58])), 10, 64)
+		if err != nil {
+			return errors.Errorf("%s: invalid ar header", file)
+		}
+
+		if strings.HasPrefix(name, "data.tar") {
+			member := io.LimitReader(bufferedReader, size)
+			var dataReader io.Reader
+			switch path.Ext(name) {
+			case ".xz":
+				dataReader, err = xz.NewReader(member)
+			case ".zst":
+				var decoder *zstd.Decoder
+				decoder, err = zstd.NewReader(member)
+				if err == nil {
+					defer decoder.Close()
+				}
+				dataReader = decoder
+			case ".gz":
+				dataReader, err = gzip.NewReader(member)
+			case ".tar":
+				dataReader = member
+			default:
+				return errors.Errorf("%s: %s is not supported", file, name)
+			}
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			return extractTar(dataReader, outDir)
+		}
+
+		// members are aligned to 2 bytes
+		_, err = bufferedReader.Discard(int(size + size%2))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+}
+
+func extractTar(reader io.Reader, outDir string) error {
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+		// documentation is not needed in snap
+		if name == "" || strings.HasPrefix(name, "usr/share/doc/") || strings.HasPrefix(name, "usr/share/man/") || strings.HasPrefix(name, "usr/share/lintian/") {
+			continue
+		}
+
+		target := filepath.Join(outDir, filepath.FromSlash(name))
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = fsutil.EnsureDir(target)
+		case tar.TypeReg:
+			err = writeTarFile(tarReader, target, os.FileMode(header.Mode).Perm())
+		case tar.TypeSymlink:
+			err = fsutil.EnsureDir(filepath.Dir(target))
+			if err == nil {
+				_ = os.Remove(target)
+				err = os.Symlink(header.Linkname, target)
+			}
+		default:
+			log.Debug("unsupported entry in stage package is skipped", zap.String("name", name))
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+}
+
+func writeTarFile(reader io.Reader, file string, mode os.FileMode) error {
+	err := fsutil.EnsureDir(filepath.Dir(file))
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = io.Copy(out, reader)
+	return fsutil.CloseAndCheckError(err, out)
+}
@@ -0,0 +1,254 @@
+package pipeline
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/json-iterator/go"
+	"go.uber.org/zap"
+)
+
+// Task is executed as soon as all its dependencies are completed - e.g. compression of a directory starts right after all files in it are signed,
+// while other files are still being signed (dataflow instead of strict "sign all, then compress all" phases).
+type Task struct {
+	Id string `json:"id"`
+	// tasks of the same kind share concurrency limit (e.g. "sign" is limited by timestamp server, "compress" by CPU)
+	Kind      string   `json:"kind"`
+	Command   []string `json:"command"`
+	Dir       string   `json:"dir,omitempty"`
+	DependsOn []string `json:"dependsOn,omitempty"`
+}
+
+type Request struct {
+	Tasks []*Task `json:"tasks"`
+	// kind to max parallel tasks, runtime.NumCPU() is used for not specified kinds
+	Concurrency map[string]int `json:"concurrency"`
+}
+
+type TaskResult struct {
+	Id string `json:"id"`
+	// offset from pipeline start, ms
+	Start    int64 `json:"start"`
+	Duration int64 `json:"duration"`
+}
+
+type Result struct {
+	Tasks    []*TaskResult `json:"tasks"`
+	WallTime int64         `json:"wallTime"`
+}
+
+type taskState struct {
+	task       *Task
+	index      int
+	dependents []*taskState
+	// count of not yet completed dependencies
+	pending int
+	// length of the longest chain of dependents, tasks that unblock more work are started first
+	priority int
+	result   *TaskResult
+}
+
+type taskCompletion struct {
+	state *taskState
+	err   error
+}
+
+func ConfigureCommand(app *kingpin.Application) {
+	command := app.Command("run-pipeline", "run tasks (read from stdin as JSON) respecting dependencies and per-kind concurrency")
+	command.Action(func(context *kingpin.ParseContext) error {
+		var request Request
+		err := jsoniter.NewDecoder(os.Stdin).Decode(&request)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		ctx, cancel := util.CreateContext()
+		defer cancel()
+
+		result, err := Run(ctx, &request, executeCommand)
+		if err != nil {
+			return err
+		}
+		return util.WriteJsonToStdOut(result)
+	})
+}
+
+func executeCommand(ctx context.Context, task *Task) error {
+	if len(task.Command) == 0 {
+		return nil
+	}
+
+	command := exec.CommandContext(ctx, task.Command[0], task.Command[1:]...)
+	command.Dir = task.Dir
+	_, err := util.Execute(command)
+	return err
+}
+
+// Run executes tasks, on first failure not started tasks are skipped and running are canceled
+func Run(ctx context.Context, request *Request, executor func(ctx context.Context, task *Task) error) (*Result, error) {
+	states, err := createStates(request.Tasks)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	kindToReady := make(map[string][]*taskState)
+	kindToRunning := make(map[string]int)
+	for _, state := range states {
+		if state.pending == 0 {
+			kindToReady[state.task.Kind] = append(kindToReady[state.task.Kind], state)
+		}
+	}
+
+	start := time.Now()
+	completions := make(chan taskCompletion)
+	runningCount := 0
+	completedCount := 0
+	var firstError error
+
+	dispatch := func() {
+		if ctx.Err() != nil {
+			return
+		}
+
+		for kind, ready := range kindToReady {
+			limit := request.Concurrency[kind]
+			if limit <= 0 {
+				limit = runtime.NumCPU()
+			}
+
+			sortByPriority(ready)
+			for len(ready) > 0 && kindToRunning[kind] < limit {
+				state := ready[0]
+				ready = ready[1:]
+				kindToRunning[kind]++
+				runningCount++
+				state.result = &TaskResult{Id: state.task.Id, Start: time.Since(start).Milliseconds()}
+				log.Debug("start task", zap.String("id", state.task.Id), zap.String("kind", kind))
+				go func(state *taskState) {
+					taskStart := time.Now()
+					err := executor(ctx, state.task)
+					state.result.Duration = time.Since(taskStart).Milliseconds()
+					completions <- taskCompletion{state: state, err: err}
+				}(state)
+			}
+			kindToReady[kind] = ready
+		}
+	}
+
+	dispatch()
+	for runningCount > 0 {
+		completion := <-completions
+		runningCount--
+		kindToRunning[completion.state.task.Kind]--
+
+		if completion.err != nil {
+			if firstError == nil {
+				firstError = errors.WithMessage(completion.err, "task "+completion.state.task.Id+" failed")
+				// wait for running tasks, but do not start new ones
+				cancel()
+			}
+			continue
+		}
+
+		completedCount++
+		if firstError != nil {
+			continue
+		}
+
+		for _, dependent := range completion.state.dependents {
+			dependent.pending--
+			if dependent.pending == 0 {
+				kindToReady[dependent.task.Kind] = append(kindToReady[dependent.task.Kind], dependent)
+			}
+		}
+		dispatch()
+	}
+
+	if firstError != nil {
+		return nil, firstError
+	}
+	if completedCount != len(states) {
+		return nil, errors.WithStack(ctx.Err())
+	}
+
+	result := &Result{WallTime: time.Since(start).Milliseconds()}
+	for _, state := range states {
+		result.Tasks = append(result.Tasks, state.result)
+	}
+	return result, nil
+}
+
+func sortByPriority(list []*taskState) {
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].priority != list[j].priority {
+			return list[i].priority > list[j].priority
+		}
+		return list[i].index < list[j].index
+	})
+}
+
+func createStates(tasks []*Task) ([]*taskState, error) {
+	states := make([]*taskState, len(tasks))
+	idToState := make(map[string]*taskState, len(tasks))
+	for index, task := range tasks {
+		if _, ok := idToState[task.Id]; ok {
+			return nil, util.NewMessageError("duplicated task id "+task.Id, "ERR_PIPELINE_DUPLICATED_TASK")
+		}
+		state := &taskState{task: task, index: index}
+		states[index] = state
+		idToState[task.Id] = state
+	}
+
+	for _, state := range states {
+		for _, dependencyId := range state.task.DependsOn {
+			dependency, ok := idToState[dependencyId]
+			if !ok {
+				return nil, util.NewMessageError("task "+state.task.Id+" depends on unknown task "+dependencyId, "ERR_PIPELINE_UNKNOWN_DEPENDENCY")
+			}
+			dependency.dependents = append(dependency.dependents, state)
+			state.pending++
+		}
+	}
+
+	// topological order (Kahn) to detect cycles and compute priorities from sinks to sources
+	pending := make(map[*taskState]int, len(states))
+	var order []*taskState
+	for _, state := range states {
+		pending[state] = state.pending
+		if state.pending == 0 {
+			order = append(order, state)
+		}
+	}
+	for i := 0; i < len(order); i++ {
+		for _, dependent := range order[i].dependents {
+			pending[dependent]--
+			if pending[dependent] == 0 {
+				order = append(order, dependent)
+			}
+		}
+	}
+	if len(order) != len(states) {
+		return nil, util.NewMessageError("task dependencies contain a cycle", "ERR_PIPELINE_CYCLE")
+	}
+
+	for i := len(order) - 1; i >= 0; i-- {
+		state := order[i]
+		for _, dependent := range state.dependents {
+			if dependent.priority+1 > state.priority {
+				state.priority = dependent.priority + 1
+			}
+		}
+	}
+	return states, nil
+}
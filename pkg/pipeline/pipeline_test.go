@@ -0,0 +1,88 @@
+package pipeline
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/errors"
+	. "github.com/onsi/gomega"
+)
+
+func TestOverlap(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	request := &Request{
+		Tasks: []*Task{
+			{Id: "sign a", Kind: "sign"},
+			{Id: "sign b", Kind: "sign"},
+			{Id: "sign c", Kind: "sign"},
+			{Id: "compress a+b", Kind: "compress", DependsOn: []string{"sign a", "sign b"}},
+			{Id: "compress c", Kind: "compress", DependsOn: []string{"sign c"}},
+		},
+		Concurrency: map[string]int{"sign": 1, "compress": 1},
+	}
+
+	var mutex sync.Mutex
+	var order []string
+	result, err := Run(context.Background(), request, func(ctx context.Context, task *Task) error {
+		time.Sleep(20 * time.Millisecond)
+		mutex.Lock()
+		order = append(order, task.Id)
+		mutex.Unlock()
+		return nil
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(len(result.Tasks)).To(Equal(5))
+
+	// compression of a+b must start before all files are signed
+	var compressStart, signCEnd int64
+	for _, task := range result.Tasks {
+		switch task.Id {
+		case "compress a+b":
+			compressStart = task.Start
+		case "sign c":
+			signCEnd = task.Start + task.Duration
+		}
+	}
+	g.Expect(compressStart).To(BeNumerically("<", signCEnd))
+	g.Expect(order[len(order)-1]).To(Equal("compress c"))
+}
+
+func TestFailure(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	var mutex sync.Mutex
+	var executed []string
+	_, err := Run(context.Background(), &Request{
+		Tasks: []*Task{
+			{Id: "sign", Kind: "sign"},
+			{Id: "compress", Kind: "compress", DependsOn: []string{"sign"}},
+		},
+	}, func(ctx context.Context, task *Task) error {
+		mutex.Lock()
+		executed = append(executed, task.Id)
+		mutex.Unlock()
+		return errors.New("timestamp server is not available")
+	})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("task sign failed"))
+	g.Expect(executed).To(Equal([]string{"sign"}))
+}
+
+func TestCycle(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	_, err := Run(context.Background(), &Request{
+		Tasks: []*Task{
+			{Id: "a", DependsOn: []string{"b"}},
+			{Id: "b", DependsOn: []string{"a"}},
+		},
+	}, nil)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("cycle"))
+}
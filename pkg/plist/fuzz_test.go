@@ -0,0 +1,20 @@
+//go:build go1.18
+// +build go1.18
+
+package plist
+
+import (
+	"bytes"
+	"testing"
+)
+
+// go test -run=^$ -fuzz=FuzzDecodeToJson ./pkg/plist
+func FuzzDecodeToJson(f *testing.F) {
+	f.Add([]byte(`<?xml version="1.0" encoding="UTF-8"?><plist version="1.0"><dict><key>CFBundleName</key><string>Foo</string></dict></plist>`))
+	f.Add([]byte("bplist00\xd1\x01\x02"))
+	f.Add([]byte(`{CFBundleName = Foo;}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, _ = decodeToJson(bytes.NewReader(data))
+	})
+}
@@ -2,6 +2,7 @@ package plist
 
 import (
 	"bytes"
+	"io"
 	"io/ioutil"
 	"os"
 
@@ -80,16 +81,9 @@ func decode(files []string) error {
 			}
 
 			defer util.Close(file)
-			decoder := plist.NewDecoder(file)
-			var value interface{}
-			err = decoder.Decode(&value)
+			jsonData, err := decodeToJson(file)
 			if err != nil {
-				return errors.WithStack(err)
-			}
-
-			jsonData, err := jsoniter.Marshal(value)
-			if err != nil {
-				return errors.WithStack(err)
+				return errors.WithMessage(err, "cannot decode plist "+filePath)
 			}
 
 			results[index] = jsonData
@@ -114,3 +108,17 @@ func decode(files []string) error {
 	_, _ = os.Stdout.Write(b.Bytes())
 	return errors.WithStack(err)
 }
+
+func decodeToJson(reader io.ReadSeeker) ([]byte, error) {
+	var value interface{}
+	err := plist.NewDecoder(reader).Decode(&value)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	jsonData, err := jsoniter.Marshal(value)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return jsonData, nil
+}
@@ -0,0 +1,208 @@
+package publisher
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+	"github.com/develar/app-builder/pkg/credentials"
+	"github.com/develar/app-builder/pkg/fakes"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/json-iterator/go"
+	"go.uber.org/zap"
+)
+
+const (
+	FastlyTokenCredentialName     = "fastly-api-token"
+	CloudflareTokenCredentialName = "cloudflare-api-token"
+)
+
+// overridden in tests
+var (
+	fastlyApiUrl     = "https://api.fastly.com"
+	cloudflareApiUrl = "https://api.cloudflare.com/client/v4"
+)
+
+type InvalidationOptions struct {
+	provider string
+	// paths relative to the distribution root, e.g. /latest.yml
+	paths []string
+
+	// CloudFront
+	distributionId string
+	// Fastly and Cloudflare purge by URL
+	baseUrl string
+	// Cloudflare
+	zoneId string
+}
+
+// After channel metadata is updated, edge caches must be purged, otherwise clients see the new version only after TTL is expired.
+func ConfigureInvalidateCdnCommand(app *kingpin.Application) {
+	command := app.Command("invalidate-cdn", "Invalidate CDN cache for published paths (e.g. channel metadata). "+
+		"CloudFront uses AWS credentials from env, Fastly and Cloudflare tokens are taken from "+credentials.ToEnvName(FastlyTokenCredentialName)+
+		" and "+credentials.ToEnvName(CloudflareTokenCredentialName)+" env or credentials helper.")
+
+	options := &InvalidationOptions{}
+	command.Flag("provider", "The CDN.").Required().EnumVar(&options.provider, "cloudfront", "fastly", "cloudflare")
+	command.Flag("path", "The path to invalidate, relative to the distribution root (e.g. /latest.yml).").Required().StringsVar(&options.paths)
+	command.Flag("distribution-id", "CloudFront distribution ID.").StringVar(&options.distributionId)
+	command.Flag("base-url", "Fastly and Cloudflare: the base URL of the published files, path is resolved against it.").StringVar(&options.baseUrl)
+	command.Flag("zone-id", "Cloudflare zone ID.").StringVar(&options.zoneId)
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		return InvalidateCdn(options)
+	})
+}
+
+func InvalidateCdn(options *InvalidationOptions) error {
+	paths := make([]string, len(options.paths))
+	for i, p := range options.paths {
+		paths[i] = "/" + strings.TrimPrefix(p, "/")
+	}
+
+	err := validateInvalidationOptions(options)
+	if err != nil {
+		return err
+	}
+
+	if fakes.IsEnabled() {
+		return fakes.Record(fakes.ServiceCdn, "Invalidate", map[string]interface{}{
+			"provider":       options.provider,
+			"paths":          paths,
+			"distributionId": options.distributionId,
+			"baseUrl":        options.baseUrl,
+			"zoneId":         options.zoneId,
+		})
+	}
+
+	requestContext, cancel := util.CreateContextWithTimeout(2 * time.Minute)
+	defer cancel()
+
+	log.Info("invalidating CDN cache", zap.String("provider", options.provider), zap.Strings("paths", paths))
+	switch options.provider {
+	case "cloudfront":
+		return invalidateCloudFront(requestContext, options.distributionId, paths)
+	case "fastly":
+		return purgeFastly(requestContext, toUrls(options.baseUrl, paths))
+	default:
+		return purgeCloudflare(requestContext, options.zoneId, toUrls(options.baseUrl, paths))
+	}
+}
+
+func validateInvalidationOptions(options *InvalidationOptions) error {
+	switch options.provider {
+	case "cloudfront":
+		if options.distributionId == "" {
+			return util.NewMessageError("distribution ID is required to invalidate CloudFront cache", "ERR_CDN_INVALID_OPTIONS")
+		}
+	case "cloudflare":
+		if options.zoneId == "" {
+			return util.NewMessageError("zone ID is required to purge Cloudflare cache", "ERR_CDN_INVALID_OPTIONS")
+		}
+	}
+
+	if options.provider != "cloudfront" && options.baseUrl == "" {
+		return util.NewMessageError("base URL is required to purge "+options.provider+" cache", "ERR_CDN_INVALID_OPTIONS")
+	}
+	return nil
+}
+
+func toUrls(baseUrl string, paths []string) []string {
+	result := make([]string, len(paths))
+	for i, p := range paths {
+		result[i] = strings.TrimSuffix(baseUrl, "/") + p
+	}
+	return result
+}
+
+func invalidateCloudFront(requestContext context.Context, distributionId string, paths []string) error {
+	awsSession, err := session.NewSession(&aws.Config{HTTPClient: createHttpClient()})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = cloudfront.New(awsSession).CreateInvalidationWithContext(requestContext, &cloudfront.CreateInvalidationInput{
+		DistributionId: aws.String(distributionId),
+		InvalidationBatch: &cloudfront.InvalidationBatch{
+			// must be unique for each invalidation request
+			CallerReference: aws.String("app-builder-" + strconv.FormatInt(time.Now().UnixNano(), 10)),
+			Paths: &cloudfront.Paths{
+				Items:    aws.StringSlice(paths),
+				Quantity: aws.Int64(int64(len(paths))),
+			},
+		},
+	})
+	return errors.WithStack(err)
+}
+
+// https://developer.fastly.com/reference/api/purging/#purge-single-url
+func purgeFastly(requestContext context.Context, urls []string) error {
+	token, err := credentials.GetRequired(FastlyTokenCredentialName)
+	if err != nil {
+		return err
+	}
+
+	for _, url := range urls {
+		err = doCdnRequest(requestContext, http.MethodPost, fastlyApiUrl+"/purge/"+strings.TrimPrefix(strings.TrimPrefix(url, "https://"), "http://"), nil, map[string]string{
+			"Fastly-Key": token,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// https://developers.cloudflare.com/api/operations/zone-purge
+func purgeCloudflare(requestContext context.Context, zoneId string, urls []string) error {
+	token, err := credentials.GetRequired(CloudflareTokenCredentialName)
+	if err != nil {
+		return err
+	}
+
+	body, err := jsoniter.Marshal(map[string][]string{"files": urls})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return doCdnRequest(requestContext, http.MethodPost, cloudflareApiUrl+"/zones/"+zoneId+"/purge_cache", body, map[string]string{
+		"Authorization": "Bearer " + token,
+		"Content-Type":  "application/json",
+	})
+}
+
+func doCdnRequest(requestContext context.Context, method string, url string, body []byte, headers map[string]string) error {
+	request, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	request = request.WithContext(requestContext)
+	request.Header.Set("Accept", "application/json")
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+
+	response, err := createHttpClient().Do(request)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		responseBody, _ := ioutil.ReadAll(response.Body)
+		return util.NewMessageError(fmt.Sprintf("CDN invalidation request failed (%s): %s", response.Status, strings.TrimSpace(string(responseBody))), "ERR_CDN_INVALIDATION_FAILED")
+	}
+	return nil
+}
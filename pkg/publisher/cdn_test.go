@@ -0,0 +1,56 @@
+package publisher
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+)
+
+func TestPurgeCdn(t *testing.T) {
+	log.InitLogger()
+	g := NewGomegaWithT(t)
+
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := ioutil.ReadAll(request.Body)
+		requests = append(requests, request.Method+" "+request.URL.Path+" "+request.Header.Get("Fastly-Key")+request.Header.Get("Authorization")+" "+string(body))
+		if request.URL.Path == "/zones/unknown/purge_cache" {
+			writer.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	oldFastlyApiUrl, oldCloudflareApiUrl := fastlyApiUrl, cloudflareApiUrl
+	fastlyApiUrl, cloudflareApiUrl = server.URL, server.URL
+	defer func() {
+		fastlyApiUrl, cloudflareApiUrl = oldFastlyApiUrl, oldCloudflareApiUrl
+	}()
+
+	g.Expect(os.Setenv("APP_BUILDER_FASTLY_API_TOKEN", "fastly-token")).To(Succeed())
+	defer os.Unsetenv("APP_BUILDER_FASTLY_API_TOKEN")
+	g.Expect(os.Setenv("APP_BUILDER_CLOUDFLARE_API_TOKEN", "cloudflare-token")).To(Succeed())
+	defer os.Unsetenv("APP_BUILDER_CLOUDFLARE_API_TOKEN")
+
+	err := InvalidateCdn(&InvalidationOptions{provider: "fastly", paths: []string{"latest.yml", "/latest-mac.yml"}, baseUrl: "https://example.com/app/"})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	err = InvalidateCdn(&InvalidationOptions{provider: "cloudflare", paths: []string{"latest.yml"}, baseUrl: "https://example.com/app", zoneId: "zone"})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(requests).To(Equal([]string{
+		"POST /purge/example.com/app/latest.yml fastly-token ",
+		"POST /purge/example.com/app/latest-mac.yml fastly-token ",
+		`POST /zones/zone/purge_cache Bearer cloudflare-token {"files":["https://example.com/app/latest.yml"]}`,
+	}))
+
+	err = InvalidateCdn(&InvalidationOptions{provider: "cloudflare", paths: []string{"latest.yml"}, baseUrl: "https://example.com", zoneId: "unknown"})
+	g.Expect(err).To(HaveOccurred())
+
+	err = InvalidateCdn(&InvalidationOptions{provider: "cloudfront", paths: []string{"latest.yml"}})
+	g.Expect(err).To(HaveOccurred())
+}
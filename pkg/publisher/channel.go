@@ -0,0 +1,383 @@
+package publisher
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+)
+
+// ChannelState describes the published channel file (e.g. beta-mac.yml)
+type ChannelState struct {
+	Channel string `json:"channel"`
+	Url     string `json:"url"`
+	Exists  bool   `json:"exists"`
+
+	Version           string `json:"version,omitempty"`
+	StagingPercentage *int   `json:"stagingPercentage,omitempty"`
+	ReleaseDate       string `json:"releaseDate,omitempty"`
+	ETag              string `json:"etag,omitempty"`
+}
+
+type ChannelOptions struct {
+	// base URL, authentication and headers are the same as for publish http
+	Transfer TransferOptions
+	Platform string
+	Arch     string
+}
+
+// channel file is modified concurrently (If-Match precondition failed) - read-modify-write is repeated
+type channelConflictError struct {
+	url string
+}
+
+func (t *channelConflictError) Error() string {
+	return t.url + ": modified concurrently (ETag precondition failed)"
+}
+
+func (t *channelConflictError) isRetryable() bool {
+	return true
+}
+
+// ConfigureChannelCommand registers channel command - release automation adjusts published update info without regenerating it
+func ConfigureChannelCommand(app *kingpin.Application) {
+	command := app.Command("channel", "Manage update channels on HTTP or WebDAV server. Channel file is changed using ETag precondition (If-Match), so, concurrent change is not lost.")
+	configureListChannelsCommand(command)
+	configureSetStagingCommand(command)
+	configurePromoteChannelCommand(command)
+}
+
+func configureChannelFlags(command *kingpin.CmdClause, options *ChannelOptions) {
+	configureHttpFlags(command, &options.Transfer)
+	command.Flag("platform", "The platform.").Default("win").EnumVar(&options.Platform, "win", "mac", "linux")
+	command.Flag("arch", "The arch (Linux).").StringVar(&options.Arch)
+	command.Flag("retries", "The number of retries of failed or conflicting change.").Default("3").IntVar(&options.Transfer.Retries)
+}
+
+func configureListChannelsCommand(channelCommand *kingpin.CmdClause) {
+	command := channelCommand.Command("list", "Print state of channels as JSON.")
+	options := &ChannelOptions{}
+	configureChannelFlags(command, options)
+	channels := command.Flag("channel", "The channel, can be specified several times.").Default("latest", "beta", "alpha").Strings()
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		result, err := ListChannels(options, *channels)
+		if err != nil {
+			return err
+		}
+		return util.WriteJsonToStdOut(result)
+	})
+}
+
+func configureSetStagingCommand(channelCommand *kingpin.CmdClause) {
+	command := channelCommand.Command("set-staging", "Set percentage of users to get the update (100 removes staging, 0 halts rollout). Result is written to stdout as JSON.")
+	options := &ChannelOptions{}
+	configureChannelFlags(command, options)
+	channel := command.Flag("channel", "The channel.").Default("latest").String()
+	percentage := command.Flag("percentage", "The percentage of users.").Required().Int()
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		result, err := SetStagingPercentage(options, *channel, *percentage)
+		if err != nil {
+			return err
+		}
+		return util.WriteJsonToStdOut(result)
+	})
+}
+
+func configurePromoteChannelCommand(channelCommand *kingpin.CmdClause) {
+	command := channelCommand.Command("promote", "Publish update info of one channel as another (e.g. beta as latest) after checking that listed files are available. Result is written to stdout as JSON.")
+	options := &ChannelOptions{}
+	configureChannelFlags(command, options)
+	from := command.Flag("from", "The source channel.").Default("beta").String()
+	to := command.Flag("to", "The target channel.").Default("latest").String()
+	percentage := command.Flag("staging-percentage", "The staging percentage of the promoted update, the same as of the source channel by default.").Default("-1").Int()
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		result, err := PromoteChannel(options, *from, *to, *percentage)
+		if err != nil {
+			return err
+		}
+		return util.WriteJsonToStdOut(result)
+	})
+}
+
+func ListChannels(options *ChannelOptions, channels []string) ([]*ChannelState, error) {
+	client, err := newChannelClient(options)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*ChannelState, len(channels))
+	err = util.MapAsync(len(channels), func(taskIndex int) (func() error, error) {
+		return func() error {
+			var state *ChannelState
+			err := withRetry(client.uploader.context, options.Transfer.Retries, "read channel "+channels[taskIndex], func() error {
+				var err error
+				state, _, err = client.read(channels[taskIndex])
+				return err
+			})
+			result[taskIndex] = state
+			return err
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// SetStagingPercentage changes only stagingPercentage, other fields (including unknown to app-builder, e.g. releaseNotes) are preserved as is
+func SetStagingPercentage(options *ChannelOptions, channel string, percentage int) (*ChannelState, error) {
+	if percentage < 0 || percentage > 100 {
+		return nil, util.NewMessageError("staging percentage must be between 0 and 100", "ERR_UPDATE_INFO_INVALID_STAGING_PERCENTAGE")
+	}
+
+	client, err := newChannelClient(options)
+	if err != nil {
+		return nil, err
+	}
+
+	var result *ChannelState
+	err = withRetry(client.uploader.context, options.Transfer.Retries, "set staging percentage of "+channel, func() error {
+		state, data, err := client.read(channel)
+		if err != nil || !state.Exists {
+			result = state
+			return err
+		}
+
+		data, err = setStagingPercentageField(data, percentage)
+		if err != nil {
+			return err
+		}
+		result, err = client.write(state, data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !result.Exists {
+		return nil, util.NewMessageError("channel "+channel+" is not published ("+result.Url+")", "ERR_CHANNEL_NOT_FOUND")
+	}
+	log.Info("staging percentage changed", zap.String("channel", channel), zap.Int("percentage", percentage))
+	return result, nil
+}
+
+// PromoteChannel publishes update info of the source channel as the target channel. Files are referenced relative to the channel file, so, they are not copied.
+// Negative percentage means that staging percentage of the source channel is kept.
+func PromoteChannel(options *ChannelOptions, from string, to string, percentage int) (*ChannelState, error) {
+	if percentage > 100 {
+		return nil, util.NewMessageError("staging percentage must be between 0 and 100", "ERR_UPDATE_INFO_INVALID_STAGING_PERCENTAGE")
+	}
+
+	client, err := newChannelClient(options)
+	if err != nil {
+		return nil, err
+	}
+
+	var source *ChannelState
+	var data []byte
+	err = withRetry(client.uploader.context, options.Transfer.Retries, "read channel "+from, func() error {
+		source, data, err = client.read(from)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !source.Exists {
+		return nil, util.NewMessageError("channel "+from+" is not published ("+source.Url+")", "ERR_CHANNEL_NOT_FOUND")
+	}
+
+	err = client.checkFilesAvailable(source.Url, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if percentage >= 0 {
+		data, err = setStagingPercentageField(data, percentage)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var result *ChannelState
+	err = withRetry(client.uploader.context, options.Transfer.Retries, "promote "+from+" to "+to, func() error {
+		target, _, err := client.read(to)
+		if err != nil {
+			return err
+		}
+		result, err = client.write(target, data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Info("channel promoted", zap.String("from", from), zap.String("to", to), zap.String("version", result.Version))
+	return result, nil
+}
+
+type channelClient struct {
+	uploader *httpUploader
+	baseUrl  string
+	platform string
+	arch     string
+}
+
+func newChannelClient(options *ChannelOptions) (*channelClient, error) {
+	baseUrl, err := url.Parse(strings.TrimSuffix(options.Transfer.Target, "/"))
+	if err != nil || (baseUrl.Scheme != "http" && baseUrl.Scheme != "https") {
+		return nil, util.NewMessageError("invalid URL "+options.Transfer.Target, "ERR_PUBLISH_INVALID_OPTIONS")
+	}
+
+	requestContext, _ := util.CreateContext()
+	return &channelClient{
+		uploader: &httpUploader{options: &options.Transfer, httpClient: createHttpClient(), context: requestContext},
+		baseUrl:  baseUrl.String(),
+		platform: options.Platform,
+		arch:     options.Arch,
+	}, nil
+}
+
+// read returns state and content of the channel file, not published channel is not an error
+func (t *channelClient) read(channel string) (*ChannelState, []byte, error) {
+	state := &ChannelState{Channel: channel, Url: t.baseUrl + "/" + GetChannelFileName(channel, t.platform, t.arch)}
+	request, err := t.uploader.newRequest(http.MethodGet, state.Url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	// channel file is cached by CDN and the current ETag is required
+	request.Header.Set("Cache-Control", "no-cache")
+
+	response, err := t.uploader.httpClient.Do(request)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	defer util.Close(response.Body)
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return state, nil, nil
+	default:
+		return nil, nil, &httpStatusError{url: state.Url, statusCode: response.StatusCode}
+	}
+
+	var info UpdateInfo
+	err = yaml.Unmarshal(data, &info)
+	if err != nil {
+		return nil, nil, util.NewMessageError("cannot parse "+state.Url+": "+err.Error(), "ERR_UPDATE_INFO_INVALID_FORMAT")
+	}
+
+	state.Exists = true
+	state.ETag = response.Header.Get("ETag")
+	state.Version = info.Version
+	state.StagingPercentage = info.StagingPercentage
+	state.ReleaseDate = info.ReleaseDate
+	return state, data, nil
+}
+
+// write uploads channel file only if it was not changed since read (If-Match) or, if it was not published, is still not published (If-None-Match)
+func (t *channelClient) write(state *ChannelState, data []byte) (*ChannelState, error) {
+	if state.Exists && len(state.ETag) == 0 {
+		return nil, util.NewMessageError(state.Url+": server doesn't return ETag, channel file cannot be changed safely", "ERR_CHANNEL_CONDITIONAL_UPDATE_UNSUPPORTED")
+	}
+
+	request, err := t.uploader.newRequest(http.MethodPut, state.Url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "text/yaml")
+	request.Header.Set("Cache-Control", "no-cache")
+	if state.Exists {
+		request.Header.Set("If-Match", state.ETag)
+	} else {
+		request.Header.Set("If-None-Match", "*")
+	}
+
+	err = t.uploader.do(request, http.StatusOK, http.StatusCreated, http.StatusNoContent)
+	if err != nil {
+		if statusError, ok := err.(*httpStatusError); ok && statusError.statusCode == http.StatusPreconditionFailed {
+			return nil, &channelConflictError{url: state.Url}
+		}
+		return nil, err
+	}
+
+	var info UpdateInfo
+	err = yaml.Unmarshal(data, &info)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &ChannelState{Channel: state.Channel, Url: state.Url, Exists: true, Version: info.Version, StagingPercentage: info.StagingPercentage, ReleaseDate: info.ReleaseDate}, nil
+}
+
+// checkFilesAvailable checks using HEAD that files listed in the update info are published, so, promoted channel doesn't reference missing files
+func (t *channelClient) checkFilesAvailable(channelUrl string, data []byte) error {
+	var info UpdateInfo
+	err := yaml.Unmarshal(data, &info)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	baseUrl, err := url.Parse(channelUrl)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return util.MapAsync(len(info.Files), func(taskIndex int) (func() error, error) {
+		item := info.Files[taskIndex]
+		fileUrl, err := baseUrl.Parse(item.Url)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return func() error {
+			var size int64
+			err := withRetry(t.uploader.context, t.uploader.options.Retries, "check "+fileUrl.String(), func() error {
+				var err error
+				size, err = t.uploader.getSize(fileUrl.String())
+				return err
+			})
+			if err != nil {
+				return errors.WithMessage(err, "file of update info is not available")
+			}
+			if size >= 0 && size != item.Size {
+				return util.NewMessageError(fileUrl.String()+": size doesn't match size in update info", "ERR_PUBLISH_VERIFICATION_FAILED")
+			}
+			return nil
+		}, nil
+	})
+}
+
+// setStagingPercentageField changes field of YAML document preserving other fields and their order, 100 removes the field
+func setStagingPercentageField(data []byte, percentage int) ([]byte, error) {
+	var document yaml.MapSlice
+	err := yaml.Unmarshal(data, &document)
+	if err != nil {
+		return nil, util.NewMessageError("cannot parse update info: "+err.Error(), "ERR_UPDATE_INFO_INVALID_FORMAT")
+	}
+
+	result := make(yaml.MapSlice, 0, len(document)+1)
+	for _, item := range document {
+		if item.Key != "stagingPercentage" {
+			result = append(result, item)
+		}
+	}
+	if percentage != 100 {
+		result = append(result, yaml.MapItem{Key: "stagingPercentage", Value: percentage})
+	}
+
+	data, err = yaml.Marshal(result)
+	return data, errors.WithStack(err)
+}
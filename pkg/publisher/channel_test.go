@@ -0,0 +1,133 @@
+package publisher
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+	"gopkg.in/yaml.v2"
+)
+
+// fakeUpdateServer supports conditional PUT, concurrentChange is applied to the file before the next PUT (as if another job changed it)
+type fakeUpdateServer struct {
+	mutex            sync.Mutex
+	files            map[string][]byte
+	concurrentChange map[string][]byte
+	conflictCount    int
+}
+
+func (t *fakeUpdateServer) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	data, exists := t.files[request.URL.Path]
+	switch request.Method {
+	case http.MethodGet, http.MethodHead:
+		if !exists {
+			writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writer.Header().Set("ETag", fakeETag(data))
+		writer.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if request.Method == http.MethodGet {
+			_, _ = writer.Write(data)
+		}
+
+	case http.MethodPut:
+		if change, ok := t.concurrentChange[request.URL.Path]; ok {
+			delete(t.concurrentChange, request.URL.Path)
+			t.files[request.URL.Path] = change
+			data, exists = change, true
+		}
+
+		ifMatch := request.Header.Get("If-Match")
+		if (exists && ifMatch != fakeETag(data)) || (!exists && request.Header.Get("If-None-Match") != "*") {
+			t.conflictCount++
+			writer.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		t.files[request.URL.Path], _ = ioutil.ReadAll(request.Body)
+		writer.WriteHeader(http.StatusNoContent)
+
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func fakeETag(data []byte) string {
+	checksum := md5.Sum(data)
+	return "\"" + hex.EncodeToString(checksum[:]) + "\""
+}
+
+func TestChannels(t *testing.T) {
+	log.InitLogger()
+	g := NewGomegaWithT(t)
+
+	retryDelay := uploadRetryDelay
+	uploadRetryDelay = time.Millisecond
+	defer func() {
+		uploadRetryDelay = retryDelay
+	}()
+
+	storage := &fakeUpdateServer{
+		files: map[string][]byte{
+			"/updates/latest-mac.yml": []byte("version: 1.0.0\nfiles:\n- url: App-1.0.0.zip\n  sha512: a\n  size: 3\npath: App-1.0.0.zip\nsha512: a\nreleaseDate: \"2026-10-01T00:00:00.000Z\"\n"),
+			"/updates/beta-mac.yml":   []byte("version: 1.1.0\nfiles:\n- url: App-1.1.0.zip\n  sha512: b\n  size: 5\npath: App-1.1.0.zip\nsha512: b\nreleaseNotes: Fixed crash\nstagingPercentage: 50\n"),
+			"/updates/App-1.1.0.zip":  []byte("hello"),
+		},
+		concurrentChange: make(map[string][]byte),
+	}
+	server := httptest.NewServer(storage)
+	defer server.Close()
+
+	options := &ChannelOptions{Transfer: TransferOptions{Target: server.URL + "/updates/", Retries: 2}, Platform: "mac"}
+
+	channels, err := ListChannels(options, []string{"latest", "beta", "alpha"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(channels[0].Version).To(Equal("1.0.0"))
+	g.Expect(channels[0].StagingPercentage).To(BeNil())
+	g.Expect(*channels[1].StagingPercentage).To(Equal(50))
+	g.Expect(channels[1].Url).To(Equal(server.URL + "/updates/beta-mac.yml"))
+	g.Expect(channels[2].Exists).To(BeFalse())
+
+	// another job changes release notes between read and write - change must not be lost
+	storage.concurrentChange["/updates/beta-mac.yml"] = append(storage.files["/updates/beta-mac.yml"], []byte("releaseName: Beta\n")...)
+	state, err := SetStagingPercentage(options, "beta", 80)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(*state.StagingPercentage).To(Equal(80))
+	g.Expect(storage.conflictCount).To(Equal(1))
+
+	var beta yaml.MapSlice
+	g.Expect(yaml.Unmarshal(storage.files["/updates/beta-mac.yml"], &beta)).To(Succeed())
+	g.Expect(beta[len(beta)-3].Value).To(Equal("Fixed crash"))
+	g.Expect(beta[len(beta)-2].Value).To(Equal("Beta"))
+	g.Expect(beta[len(beta)-1]).To(Equal(yaml.MapItem{Key: "stagingPercentage", Value: 80}))
+
+	state, err = PromoteChannel(options, "beta", "latest", 100)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(state.Version).To(Equal("1.1.0"))
+	g.Expect(state.StagingPercentage).To(BeNil())
+	var latest UpdateInfo
+	g.Expect(yaml.Unmarshal(storage.files["/updates/latest-mac.yml"], &latest)).To(Succeed())
+	g.Expect(latest.Path).To(Equal("App-1.1.0.zip"))
+
+	// listed file is not published
+	_, err = PromoteChannel(options, "latest", "alpha", -1)
+	g.Expect(err).NotTo(HaveOccurred())
+	delete(storage.files, "/updates/App-1.1.0.zip")
+	_, err = PromoteChannel(options, "alpha", "latest", -1)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("App-1.1.0.zip: unexpected status 404"))
+
+	_, err = SetStagingPercentage(options, "nightly", 10)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("channel nightly is not published"))
+}
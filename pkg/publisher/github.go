@@ -0,0 +1,529 @@
+package publisher
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/download"
+	"github.com/develar/app-builder/pkg/fakes"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/json-iterator/go"
+	"go.uber.org/zap"
+)
+
+const (
+	// existing asset is kept if size is the same (e.g. publish is restarted after failure), otherwise replaced
+	AssetPolicySkip    = "skip"
+	AssetPolicyReplace = "replace"
+	AssetPolicyError   = "error"
+)
+
+type GitHubPublishOptions struct {
+	Owner string
+	Repo  string
+	Tag   string
+	Token string
+	// GitHub Enterprise API URL (e.g. https://github.example.com/api/v3), API of download.GetGithubServer() if not specified
+	ApiUrl string
+
+	Files []string
+
+	ReleaseName  string
+	ReleaseNotes string
+	IsPrerelease bool
+
+	ExistingAssetPolicy string
+	Retries             int
+
+	// asset name patterns (glob) that must be present to publish the draft, e.g. "*.exe", "*.dmg", "latest*.yml" - artifacts of all platforms are uploaded by different jobs
+	RequiredAssets []string
+	// publish the draft if all required assets are present
+	IsPublishWhenComplete bool
+}
+
+type GitHubPublishResult struct {
+	ReleaseId  int64  `json:"releaseId"`
+	ReleaseUrl string `json:"releaseUrl"`
+	IsDraft    bool   `json:"isDraft"`
+
+	Uploaded []string `json:"uploaded"`
+	Replaced []string `json:"replaced"`
+	Skipped  []string `json:"skipped"`
+	// required assets (patterns) not uploaded yet, the draft is not published
+	MissingAssets []string `json:"missingAssets,omitempty"`
+}
+
+type githubRelease struct {
+	Id         int64          `json:"id"`
+	TagName    string         `json:"tag_name"`
+	Name       string         `json:"name"`
+	Body       string         `json:"body"`
+	Draft      bool           `json:"draft"`
+	Prerelease bool           `json:"prerelease"`
+	HtmlUrl    string         `json:"html_url"`
+	UploadUrl  string         `json:"upload_url"`
+	Assets     []*githubAsset `json:"assets"`
+}
+
+type githubAsset struct {
+	Id   int64  `json:"id"`
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// "uploaded" or "starter" (upload is failed - asset is broken and must be deleted)
+	State string `json:"state"`
+}
+
+type githubApiError struct {
+	statusCode int
+	body       string
+}
+
+func (t *githubApiError) Error() string {
+	return "GitHub responded with " + strconv.Itoa(t.statusCode) + " " + http.StatusText(t.statusCode) + ": " + t.body
+}
+
+// GitHub often responds with 5xx on asset upload (asset may be even created), rate limit is also temporary
+func (t *githubApiError) isRetryable() bool {
+	return t.statusCode >= 500 || t.statusCode == http.StatusTooManyRequests
+}
+
+func configurePublishGitHubCommand(publishCommand *kingpin.CmdClause) {
+	command := publishCommand.Command("github", "Upload files to the draft GitHub release (created if not exists). "+
+		"The draft is published when all required assets (e.g. of all platforms built by different jobs) are present. Result is written to stdout as JSON.")
+
+	options := &GitHubPublishOptions{}
+	command.Flag("owner", "The repository owner.").Required().StringVar(&options.Owner)
+	command.Flag("repo", "The repository name.").Required().StringVar(&options.Repo)
+	command.Flag("tag", "The release tag (e.g. v1.0.0).").Required().StringVar(&options.Tag)
+	command.Flag("token", "The GitHub token.").Envar("GH_TOKEN").StringVar(&options.Token)
+	command.Flag("api-url", "The GitHub API URL (default: API of GitHub server configured by ELECTRON_BUILDER_GITHUB_URL env, GitHub.com if not set).").StringVar(&options.ApiUrl)
+	command.Flag("file", "The file to upload, can be specified several times.").Short('f').ExistingFilesVar(&options.Files)
+	command.Flag("release-name", "The release name (tag by default).").StringVar(&options.ReleaseName)
+	command.Flag("release-notes", "The release notes (markdown).").StringVar(&options.ReleaseNotes)
+	command.Flag("prerelease", "Whether to mark the release as prerelease.").BoolVar(&options.IsPrerelease)
+	command.Flag("existing-asset", "What to do if asset with the same name exists: skip (if size is the same), replace or error.").
+		Default(AssetPolicySkip).EnumVar(&options.ExistingAssetPolicy, AssetPolicySkip, AssetPolicyReplace, AssetPolicyError)
+	command.Flag("retries", "The number of retries of failed request.").Default("3").IntVar(&options.Retries)
+	command.Flag("required-asset", "The asset name pattern (glob) that must be present to publish the draft, can be specified several times.").StringsVar(&options.RequiredAssets)
+	command.Flag("publish-when-complete", "Publish the draft if all required assets are present.").BoolVar(&options.IsPublishWhenComplete)
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		if len(options.Token) == 0 {
+			options.Token = os.Getenv("GITHUB_TOKEN")
+		}
+
+		result, err := PublishToGitHub(options)
+		if err != nil {
+			return err
+		}
+		return util.WriteJsonToStdOut(result)
+	})
+}
+
+func PublishToGitHub(options *GitHubPublishOptions) (*GitHubPublishResult, error) {
+	if len(options.Token) == 0 {
+		return nil, util.NewMessageError("GitHub token is not specified (GH_TOKEN or GITHUB_TOKEN env)", "ERR_GITHUB_TOKEN_REQUIRED")
+	}
+	for _, pattern := range options.RequiredAssets {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return nil, util.NewMessageError("required asset pattern "+pattern+" is invalid", "ERR_GITHUB_INVALID_OPTIONS")
+		}
+	}
+
+	if fakes.IsEnabled() {
+		return recordFakeGitHubPublish(options)
+	}
+
+	repositoryPath := "/repos/" + options.Owner + "/" + options.Repo
+	apiUrl := download.GetGithubServer().ApiEndpoint(repositoryPath)
+	if options.ApiUrl != "" {
+		apiUrl = strings.TrimSuffix(options.ApiUrl, "/") + repositoryPath
+	}
+
+	publishContext, _ := util.CreateContext()
+	client := &githubClient{
+		httpClient: createHttpClient(),
+		apiUrl:     apiUrl,
+		token:      options.Token,
+		context:    publishContext,
+		retries:    options.Retries,
+	}
+
+	release, err := client.getDraft(options)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &GitHubPublishResult{ReleaseId: release.Id, IsDraft: true, Uploaded: []string{}, Replaced: []string{}, Skipped: []string{}}
+	for _, file := range options.Files {
+		err = client.uploadFile(release, file, options.ExistingAssetPolicy, result)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if options.IsPublishWhenComplete {
+		release, err = client.publishIfComplete(release, options.RequiredAssets, result)
+		if err != nil {
+			return nil, err
+		}
+	}
+	result.ReleaseUrl = release.HtmlUrl
+	return result, nil
+}
+
+type githubClient struct {
+	httpClient *http.Client
+	// repository API URL
+	apiUrl  string
+	token   string
+	context context.Context
+	retries int
+}
+
+// getDraft returns draft release for the tag (created if not exists, name, notes and prerelease flag are updated if changed). Published release is not modified.
+func (t *githubClient) getDraft(options *GitHubPublishOptions) (*githubRelease, error) {
+	name := options.ReleaseName
+	if len(name) == 0 {
+		name = options.Tag
+	}
+
+	release, err := t.findRelease(options.Tag)
+	if err != nil {
+		return nil, err
+	}
+
+	if release == nil {
+		release = &githubRelease{}
+		err = t.request(http.MethodPost, t.apiUrl+"/releases", map[string]interface{}{
+			"tag_name":   options.Tag,
+			"name":       name,
+			"body":       options.ReleaseNotes,
+			"draft":      true,
+			"prerelease": options.IsPrerelease,
+		}, release)
+		if err != nil {
+			return nil, errors.WithMessage(err, "cannot create release "+options.Tag)
+		}
+		log.Info("draft release created", zap.String("tag", options.Tag))
+		return release, nil
+	}
+
+	if !release.Draft {
+		return nil, util.NewMessageError("release "+options.Tag+" is already published, assets are not uploaded to published release", "ERR_GITHUB_RELEASE_PUBLISHED")
+	}
+
+	changes := make(map[string]interface{})
+	if release.Name != name {
+		changes["name"] = name
+	}
+	if len(options.ReleaseNotes) != 0 && release.Body != options.ReleaseNotes {
+		changes["body"] = options.ReleaseNotes
+	}
+	if release.Prerelease != options.IsPrerelease {
+		changes["prerelease"] = options.IsPrerelease
+	}
+	if len(changes) != 0 {
+		updatedRelease := &githubRelease{}
+		err = t.request(http.MethodPatch, t.apiUrl+"/releases/"+strconv.FormatInt(release.Id, 10), changes, updatedRelease)
+		if err != nil {
+			return nil, errors.WithMessage(err, "cannot update release "+options.Tag)
+		}
+		release = updatedRelease
+	}
+	return release, nil
+}
+
+// findRelease lists releases - draft is not returned by /releases/tags/{tag}
+func (t *githubClient) findRelease(tag string) (*githubRelease, error) {
+	for page := 1; ; page++ {
+		var releases []*githubRelease
+		err := t.request(http.MethodGet, t.apiUrl+"/releases?per_page=100&page="+strconv.Itoa(page), nil, &releases)
+		if err != nil {
+			return nil, errors.WithMessage(err, "cannot list releases")
+		}
+
+		for _, release := range releases {
+			if release.TagName == tag {
+				return release, nil
+			}
+		}
+		if len(releases) < 100 {
+			return nil, nil
+		}
+	}
+}
+
+func (t *githubClient) uploadFile(release *githubRelease, file string, policy string, result *GitHubPublishResult) error {
+	name := getGitHubAssetName(filepath.Base(file))
+	fileInfo, err := os.Stat(file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	existing := findAsset(release.Assets, name)
+	if existing != nil {
+		isSame := existing.State == "uploaded" && existing.Size == fileInfo.Size()
+		switch {
+		case policy == AssetPolicyError:
+			return util.NewMessageError("asset "+name+" already exists in release "+release.TagName, "ERR_GITHUB_ASSET_EXISTS")
+		case policy == AssetPolicySkip && isSame:
+			log.Info("asset already exists, skipped", zap.String("name", name))
+			result.Skipped = append(result.Skipped, name)
+			return nil
+		}
+
+		err = t.deleteAsset(existing)
+		if err != nil {
+			return err
+		}
+	}
+
+	attempt := 0
+	asset := &githubAsset{}
+	err = withRetry(t.context, t.retries, "upload "+name, func() error {
+		if attempt > 0 {
+			// failed upload may leave broken asset, upload of asset with the same name is rejected (422 already_exists)
+			err := t.deleteBrokenAsset(release, name)
+			if err != nil {
+				return err
+			}
+		}
+		attempt++
+		return t.uploadAsset(release, file, name, fileInfo.Size(), asset)
+	})
+	if err != nil {
+		return errors.WithMessage(err, "cannot upload "+file)
+	}
+
+	release.Assets = append(removeAsset(release.Assets, name), asset)
+	if existing == nil {
+		result.Uploaded = append(result.Uploaded, name)
+	} else {
+		result.Replaced = append(result.Replaced, name)
+	}
+	log.Info("asset uploaded", zap.String("name", name), zap.Bool("replaced", existing != nil))
+	return nil
+}
+
+func (t *githubClient) uploadAsset(release *githubRelease, file string, name string, size int64, asset *githubAsset) error {
+	reader, err := os.Open(file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(reader)
+
+	// https://uploads.github.com/repos/owner/repo/releases/1/assets{?name,label}
+	uploadUrl := release.UploadUrl
+	index := strings.IndexRune(uploadUrl, '{')
+	if index > 0 {
+		uploadUrl = uploadUrl[:index]
+	}
+
+	request, err := t.newRequest(http.MethodPost, uploadUrl+"?name="+url.QueryEscape(name), reader)
+	if err != nil {
+		return err
+	}
+	request.ContentLength = size
+	request.Header.Set("Content-Type", getMimeType(name))
+	return t.do(request, asset)
+}
+
+func (t *githubClient) deleteBrokenAsset(release *githubRelease, name string) error {
+	var assets []*githubAsset
+	err := t.request(http.MethodGet, t.apiUrl+"/releases/"+strconv.FormatInt(release.Id, 10)+"/assets?per_page=100", nil, &assets)
+	if err != nil {
+		return err
+	}
+
+	asset := findAsset(assets, name)
+	if asset == nil {
+		return nil
+	}
+	log.Debug("delete asset of failed upload", zap.String("name", name), zap.String("state", asset.State))
+	return t.deleteAsset(asset)
+}
+
+func (t *githubClient) deleteAsset(asset *githubAsset) error {
+	err := t.request(http.MethodDelete, t.apiUrl+"/releases/assets/"+strconv.FormatInt(asset.Id, 10), nil, nil)
+	if err != nil {
+		return errors.WithMessage(err, "cannot delete asset "+asset.Name)
+	}
+	return nil
+}
+
+// publishIfComplete publishes the draft if assets matching all required patterns are uploaded (by this and other jobs)
+func (t *githubClient) publishIfComplete(release *githubRelease, requiredAssets []string, result *GitHubPublishResult) (*githubRelease, error) {
+	releaseUrl := t.apiUrl + "/releases/" + strconv.FormatInt(release.Id, 10)
+	actualRelease := &githubRelease{}
+	err := t.request(http.MethodGet, releaseUrl, nil, actualRelease)
+	if err != nil {
+		return nil, err
+	}
+
+	result.MissingAssets = getMissingAssets(actualRelease.Assets, requiredAssets)
+	if len(result.MissingAssets) != 0 {
+		log.Info("draft is not published, required assets are missing", zap.Strings("missing", result.MissingAssets))
+		return actualRelease, nil
+	}
+
+	publishedRelease := &githubRelease{}
+	err = t.request(http.MethodPatch, releaseUrl, map[string]interface{}{"draft": false}, publishedRelease)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot publish release "+release.TagName)
+	}
+	result.IsDraft = false
+	log.Info("release published", zap.String("tag", release.TagName))
+	return publishedRelease, nil
+}
+
+func getMissingAssets(assets []*githubAsset, requiredAssets []string) []string {
+	var result []string
+	for _, pattern := range requiredAssets {
+		isFound := false
+		for _, asset := range assets {
+			// pattern is validated
+			isMatched, _ := path.Match(pattern, asset.Name)
+			if isMatched && asset.State == "uploaded" {
+				isFound = true
+				break
+			}
+		}
+		if !isFound {
+			result = append(result, pattern)
+		}
+	}
+	return result
+}
+
+// request sends JSON (if data is not nil) with retry of transient errors
+func (t *githubClient) request(method string, requestUrl string, data interface{}, result interface{}) error {
+	var body []byte
+	if data != nil {
+		var err error
+		body, err = jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(data)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return withRetry(t.context, t.retries, method+" "+requestUrl, func() error {
+		var reader io.Reader
+		if body != nil {
+			reader = strings.NewReader(string(body))
+		}
+		request, err := t.newRequest(method, requestUrl, reader)
+		if err != nil {
+			return err
+		}
+		if body != nil {
+			request.Header.Set("Content-Type", "application/json")
+		}
+		return t.do(request, result)
+	})
+}
+
+func (t *githubClient) newRequest(method string, requestUrl string, body io.Reader) (*http.Request, error) {
+	request, err := http.NewRequest(method, requestUrl, body)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	request.Header.Set("Authorization", "token "+t.token)
+	request.Header.Set("Accept", "application/vnd.github.v3+json")
+	request.Header.Set("User-Agent", "app-builder")
+	return request.WithContext(t.context), nil
+}
+
+func (t *githubClient) do(request *http.Request, result interface{}) error {
+	response, err := t.httpClient.Do(request)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(response.Body)
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return &githubApiError{statusCode: response.StatusCode, body: string(data)}
+	}
+	if result == nil || len(data) == 0 {
+		return nil
+	}
+	return errors.WithStack(jsoniter.Unmarshal(data, result))
+}
+
+// GitHub replaces spaces in asset name with dots
+func getGitHubAssetName(name string) string {
+	return strings.Replace(name, " ", ".", -1)
+}
+
+func findAsset(assets []*githubAsset, name string) *githubAsset {
+	for _, asset := range assets {
+		if asset.Name == name {
+			return asset
+		}
+	}
+	return nil
+}
+
+func removeAsset(assets []*githubAsset, name string) []*githubAsset {
+	result := assets[:0]
+	for _, asset := range assets {
+		if asset.Name != name {
+			result = append(result, asset)
+		}
+	}
+	return result
+}
+
+func recordFakeGitHubPublish(options *GitHubPublishOptions) (*GitHubPublishResult, error) {
+	result := &GitHubPublishResult{IsDraft: !options.IsPublishWhenComplete, Uploaded: []string{}, Replaced: []string{}, Skipped: []string{}}
+	for _, file := range options.Files {
+		fileInfo, err := os.Stat(file)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		name := getGitHubAssetName(filepath.Base(file))
+		err = fakes.Record(fakes.ServiceGitHub, "UploadAsset", map[string]interface{}{
+			"owner": options.Owner,
+			"repo":  options.Repo,
+			"tag":   options.Tag,
+			"file":  file,
+			"name":  name,
+			"size":  fileInfo.Size(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		result.Uploaded = append(result.Uploaded, name)
+	}
+
+	if options.IsPublishWhenComplete {
+		err := fakes.Record(fakes.ServiceGitHub, "PublishRelease", map[string]interface{}{
+			"owner": options.Owner,
+			"repo":  options.Repo,
+			"tag":   options.Tag,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
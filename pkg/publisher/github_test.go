@@ -0,0 +1,172 @@
+package publisher
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/develar/app-builder/pkg/download"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/json-iterator/go"
+	. "github.com/onsi/gomega"
+)
+
+// fakeGitHub implements releases API for the single release, the first upload of failAssetName creates broken asset and responds with 502
+type fakeGitHub struct {
+	mutex         sync.Mutex
+	url           string
+	release       *githubRelease
+	nextAssetId   int64
+	failAssetName string
+	requests      []string
+}
+
+func (t *fakeGitHub) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	body, _ := ioutil.ReadAll(request.Body)
+	requestPath := strings.TrimPrefix(request.URL.Path, "/repos/owner/repo")
+	t.requests = append(t.requests, request.Method+" "+requestPath)
+	if request.Header.Get("Authorization") != "token secret" {
+		writer.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case request.Method == http.MethodGet && requestPath == "/releases":
+		var releases []*githubRelease
+		if t.release != nil {
+			releases = append(releases, t.release)
+		}
+		writeJson(writer, releases)
+
+	case request.Method == http.MethodPost && requestPath == "/releases":
+		t.release = &githubRelease{Id: 1, HtmlUrl: "https://github.com/owner/repo/releases/1", UploadUrl: t.url + "/upload/1{?name,label}", Assets: []*githubAsset{}}
+		_ = jsoniter.Unmarshal(body, t.release)
+		writeJson(writer, t.release)
+
+	case request.Method == http.MethodPatch && requestPath == "/releases/1":
+		_ = jsoniter.Unmarshal(body, t.release)
+		writeJson(writer, t.release)
+
+	case request.Method == http.MethodGet && requestPath == "/releases/1":
+		writeJson(writer, t.release)
+
+	case request.Method == http.MethodGet && requestPath == "/releases/1/assets":
+		writeJson(writer, t.release.Assets)
+
+	case request.Method == http.MethodDelete && strings.HasPrefix(requestPath, "/releases/assets/"):
+		var assets []*githubAsset
+		for _, asset := range t.release.Assets {
+			if "/releases/assets/"+strconv.FormatInt(asset.Id, 10) != requestPath {
+				assets = append(assets, asset)
+			}
+		}
+		t.release.Assets = assets
+		writer.WriteHeader(http.StatusNoContent)
+
+	case request.Method == http.MethodPost && requestPath == "/upload/1":
+		name := request.URL.Query().Get("name")
+		if findAsset(t.release.Assets, name) != nil {
+			writer.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+
+		t.nextAssetId++
+		asset := &githubAsset{Id: t.nextAssetId, Name: name, Size: int64(len(body)), State: "uploaded"}
+		if name == t.failAssetName {
+			t.failAssetName = ""
+			asset.State = "starter"
+			t.release.Assets = append(t.release.Assets, asset)
+			writer.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		t.release.Assets = append(t.release.Assets, asset)
+		writer.WriteHeader(http.StatusCreated)
+		writeJson(writer, asset)
+
+	default:
+		writer.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func writeJson(writer http.ResponseWriter, data interface{}) {
+	result, _ := jsoniter.Marshal(data)
+	_, _ = writer.Write(result)
+}
+
+func TestPublishToGitHub(t *testing.T) {
+	log.InitLogger()
+	g := NewGomegaWithT(t)
+
+	retryDelay := uploadRetryDelay
+	uploadRetryDelay = time.Millisecond
+	defer func() {
+		uploadRetryDelay = retryDelay
+	}()
+
+	dir, err := ioutil.TempDir("", "publish")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	installerFile := filepath.Join(dir, "App Setup 1.0.0.exe")
+	g.Expect(ioutil.WriteFile(installerFile, []byte("installer"), 0644)).To(Succeed())
+	updateInfoFile := filepath.Join(dir, "latest.yml")
+	g.Expect(ioutil.WriteFile(updateInfoFile, []byte("version: 1.0.0"), 0644)).To(Succeed())
+	dmgFile := filepath.Join(dir, "App-1.0.0.dmg")
+	g.Expect(ioutil.WriteFile(dmgFile, []byte("dmg"), 0644)).To(Succeed())
+
+	github := &fakeGitHub{failAssetName: "latest.yml"}
+	server := httptest.NewServer(github)
+	defer server.Close()
+	github.url = server.URL
+
+	options := &GitHubPublishOptions{
+		Owner:                 "owner",
+		Repo:                  "repo",
+		Tag:                   "v1.0.0",
+		Token:                 "secret",
+		ApiUrl:                server.URL,
+		Files:                 []string{installerFile, updateInfoFile},
+		ExistingAssetPolicy:   AssetPolicySkip,
+		Retries:               2,
+		RequiredAssets:        []string{"*.exe", "latest.yml", "*.dmg"},
+		IsPublishWhenComplete: true,
+	}
+	result, err := PublishToGitHub(options)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.Uploaded).To(Equal([]string{"App.Setup.1.0.0.exe", "latest.yml"}))
+	g.Expect(result.IsDraft).To(BeTrue())
+	g.Expect(result.MissingAssets).To(Equal([]string{"*.dmg"}))
+	// broken asset of failed upload is deleted before retry
+	g.Expect(github.requests).To(ContainElement("DELETE /releases/assets/2"))
+	g.Expect(github.release.Draft).To(BeTrue())
+	g.Expect(github.release.Assets).To(HaveLen(2))
+
+	// another job uploads the last required asset, uploaded assets are skipped
+	options.Files = []string{installerFile, dmgFile}
+	result, err = PublishToGitHub(options)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.Skipped).To(Equal([]string{"App.Setup.1.0.0.exe"}))
+	g.Expect(result.Uploaded).To(Equal([]string{"App-1.0.0.dmg"}))
+	g.Expect(result.IsDraft).To(BeFalse())
+	g.Expect(result.MissingAssets).To(BeEmpty())
+	g.Expect(github.release.Draft).To(BeFalse())
+
+	// published release is not modified, API of configured GitHub server is used by default
+	previousServer := download.GetGithubServer()
+	download.SetGithubServer(download.NewGithubServer("https://github.example.com", server.URL))
+	defer download.SetGithubServer(previousServer)
+	options.ApiUrl = ""
+	_, err = PublishToGitHub(options)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("already published"))
+}
@@ -0,0 +1,86 @@
+package publisher
+
+import (
+	"path"
+	"strings"
+
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+)
+
+// HeaderRule sets headers of published files which key matches the glob pattern (path.Match syntax).
+// Pattern without slash is matched against the file name, e.g. "*.yml" - no-cache for update info, "*.exe" - long immutable caching for installers.
+type HeaderRule struct {
+	Pattern string `json:"pattern"`
+
+	CacheControl       string `json:"cacheControl,omitempty"`
+	ContentType        string `json:"contentType,omitempty"`
+	ContentDisposition string `json:"contentDisposition,omitempty"`
+}
+
+type ObjectHeaders struct {
+	CacheControl       string
+	ContentType        string
+	ContentDisposition string
+}
+
+// rules are JSON array (or base64 encoded JSON), empty string means no rules
+func parseHeaderRules(data string) ([]HeaderRule, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	var rules []HeaderRule
+	err := util.DecodeBase64IfNeeded(data, &rules)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot parse header rules")
+	}
+
+	for _, rule := range rules {
+		if len(rule.Pattern) == 0 {
+			return nil, util.NewMessageError("header rule pattern must be not empty", "ERR_PUBLISH_INVALID_HEADER_RULE")
+		}
+
+		_, err = path.Match(rule.Pattern, "")
+		if err != nil {
+			return nil, util.NewMessageError("header rule pattern "+rule.Pattern+" is invalid", "ERR_PUBLISH_INVALID_HEADER_RULE")
+		}
+	}
+	return rules, nil
+}
+
+// rules are applied in order, the last matched rule that specifies a header wins. Content type is detected by key if not specified by rules.
+func resolveHeaders(key string, rules []HeaderRule) ObjectHeaders {
+	result := ObjectHeaders{}
+	for _, rule := range rules {
+		if !matchKey(rule.Pattern, key) {
+			continue
+		}
+
+		if rule.CacheControl != "" {
+			result.CacheControl = rule.CacheControl
+		}
+		if rule.ContentType != "" {
+			result.ContentType = rule.ContentType
+		}
+		if rule.ContentDisposition != "" {
+			result.ContentDisposition = rule.ContentDisposition
+		}
+	}
+
+	if result.ContentType == "" {
+		result.ContentType = getMimeType(key)
+	}
+	return result
+}
+
+func matchKey(pattern string, key string) bool {
+	name := key
+	if !strings.Contains(pattern, "/") {
+		name = path.Base(key)
+	}
+
+	// pattern is validated on parse
+	isMatched, _ := path.Match(pattern, name)
+	return isMatched
+}
@@ -0,0 +1,29 @@
+package publisher
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestResolveHeaders(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	rules, err := parseHeaderRules(`[
+		{"pattern": "*", "cacheControl": "public, max-age=31536000, immutable"},
+		{"pattern": "*.yml", "cacheControl": "no-cache", "contentType": "text/yaml"},
+		{"pattern": "beta/*.exe", "contentDisposition": "attachment"}
+	]`)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(resolveHeaders("app/latest.yml", rules)).To(Equal(ObjectHeaders{CacheControl: "no-cache", ContentType: "text/yaml"}))
+	g.Expect(resolveHeaders("beta/App Setup.exe", rules)).To(Equal(ObjectHeaders{
+		CacheControl:       "public, max-age=31536000, immutable",
+		ContentType:        "application/octet-stream",
+		ContentDisposition: "attachment",
+	}))
+	g.Expect(resolveHeaders("App Setup.exe", nil)).To(Equal(ObjectHeaders{ContentType: "application/octet-stream"}))
+
+	_, err = parseHeaderRules(`[{"pattern": "[*.yml"}]`)
+	g.Expect(err).To(HaveOccurred())
+}
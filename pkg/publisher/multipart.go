@@ -0,0 +1,583 @@
+package publisher
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/develar/app-builder/pkg/download"
+	"github.com/develar/app-builder/pkg/fakes"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/json-iterator/go"
+	"go.uber.org/zap"
+)
+
+const (
+	// S3 limits: all parts except the last one must be at least 5 MB, no more than 10000 parts
+	minPartSize  = 5 * 1024 * 1024
+	maxPartCount = 10000
+)
+
+// the delay before the first retry, doubled for each next attempt
+var uploadRetryDelay = time.Second
+
+type S3PublishOptions struct {
+	Files []string
+
+	Endpoint string
+	Region   string
+	Bucket   string
+	// files are uploaded as <prefix>/<file name>
+	Prefix string
+
+	Acl          string
+	StorageClass string
+	Encryption   string
+	// see HeaderRule
+	Headers string
+
+	AccessKey string
+	SecretKey string
+
+	PartSize    int64
+	Concurrency int
+	// the number of retries of failed request (in addition to retries of AWS SDK for network errors)
+	Retries int
+
+	// if set, update info (e.g. latest.yml) is generated for the files and uploaded last
+	Version  string
+	Channel  string
+	Platform string
+	Arch     string
+	// percentage of users to get the update (staged rollout), all users if not set
+	StagingPercentage int
+}
+
+type PublishedObject struct {
+	File string `json:"file"`
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+	ETag string `json:"etag,omitempty"`
+
+	PartCount int `json:"partCount,omitempty"`
+	// parts uploaded by the previous failed run and not uploaded again
+	ResumedPartCount int `json:"resumedPartCount,omitempty"`
+}
+
+type S3PublishResult struct {
+	Objects []*PublishedObject `json:"objects"`
+	// key of uploaded update info
+	UpdateInfo string `json:"updateInfo,omitempty"`
+}
+
+// ConfigurePublishCommand registers publish command, every provider is a subcommand
+func ConfigurePublishCommand(app *kingpin.Application) {
+	command := app.Command("publish", "Publish artifacts.")
+	configurePublishS3Command(command)
+	configurePublishGitHubCommand(command)
+	configurePublishHttpCommand(command)
+	configurePublishWebDavCommand(command)
+	configurePublishSftpCommand(command)
+}
+
+func configurePublishS3Command(publishCommand *kingpin.CmdClause) {
+	command := publishCommand.Command("s3", "Upload files to S3 or S3-compatible storage (DigitalOcean Spaces, MinIO) using concurrent multipart upload. "+
+		"Parts are validated by MD5, failed parts are retried and failed upload is resumed on the next run. Result is written to stdout as JSON.")
+
+	options := &S3PublishOptions{}
+	var partSizeMb int64
+	command.Flag("file", "The file to upload, can be specified several times.").Short('f').Required().ExistingFilesVar(&options.Files)
+	command.Flag("bucket", "The bucket (Space).").Required().StringVar(&options.Bucket)
+	command.Flag("prefix", "The key prefix (dir).").StringVar(&options.Prefix)
+	command.Flag("region", "The region, bucket location is requested if not specified.").StringVar(&options.Region)
+	command.Flag("endpoint", "The endpoint of S3-compatible storage (e.g. https://nyc3.digitaloceanspaces.com).").StringVar(&options.Endpoint)
+	command.Flag("acl", "The canned ACL (e.g. public-read).").StringVar(&options.Acl)
+	command.Flag("storage-class", "The storage class.").StringVar(&options.StorageClass)
+	command.Flag("encryption", "The server-side encryption (AES256 or aws:kms).").StringVar(&options.Encryption)
+	command.Flag("headers", "Cache-Control, Content-Type and Content-Disposition rules: JSON array (or base64) of {pattern, cacheControl, contentType, contentDisposition}. Pattern is a glob matched against the key.").StringVar(&options.Headers)
+	command.Flag("access-key", "The access key (AWS_ACCESS_KEY_ID by default).").StringVar(&options.AccessKey)
+	command.Flag("secret-key", "The secret key (AWS_SECRET_ACCESS_KEY by default).").StringVar(&options.SecretKey)
+	command.Flag("part-size", "The part size in MB (at least 5).").Default("8").Int64Var(&partSizeMb)
+	command.Flag("concurrency", "The number of parts uploaded concurrently.").Default("4").IntVar(&options.Concurrency)
+	command.Flag("retries", "The number of retries of failed part.").Default("3").IntVar(&options.Retries)
+	command.Flag("update-info-version", "The version to generate update info (latest.yml) for the uploaded files.").StringVar(&options.Version)
+	command.Flag("channel", "The update channel.").Default("latest").StringVar(&options.Channel)
+	command.Flag("platform", "The platform of update info.").Default("win").EnumVar(&options.Platform, "win", "mac", "linux")
+	command.Flag("arch", "The arch of update info (Linux).").StringVar(&options.Arch)
+	command.Flag("staging-percentage", "The percentage of users to get the update (staged rollout), all users by default.").IntVar(&options.StagingPercentage)
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		options.PartSize = partSizeMb * 1024 * 1024
+		result, err := PublishToS3(options)
+		if err != nil {
+			return err
+		}
+		return util.WriteJsonToStdOut(result)
+	})
+}
+
+// PublishToS3 uploads files one by one (parts of file concurrently). Update info is uploaded last - clients must not see the new version before files are available.
+func PublishToS3(options *S3PublishOptions) (*S3PublishResult, error) {
+	if options.PartSize < minPartSize {
+		return nil, util.NewMessageError("part size must be at least 5 MB", "ERR_PUBLISH_INVALID_PART_SIZE")
+	}
+	if options.Concurrency <= 0 {
+		options.Concurrency = 1
+	}
+
+	headerRules, err := parseHeaderRules(options.Headers)
+	if err != nil {
+		return nil, err
+	}
+
+	files := append([]string{}, options.Files...)
+	updateInfoFile := ""
+	if options.Version != "" {
+		updateInfoFile, err = createUpdateInfoFile(options)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, updateInfoFile)
+	}
+
+	publishContext, _ := util.CreateContext()
+	uploader := &multipartUploader{options: options, context: publishContext}
+	if !fakes.IsEnabled() {
+		awsSession, err := newS3Session(publishContext, options.Endpoint, options.Region, options.Bucket, options.AccessKey, options.SecretKey)
+		if err != nil {
+			return nil, err
+		}
+		uploader.client = s3.New(awsSession)
+	}
+
+	result := &S3PublishResult{Objects: []*PublishedObject{}}
+	for _, file := range files {
+		key := path.Join(strings.Trim(options.Prefix, "/"), filepath.Base(file))
+		headers := resolveHeaders(key, headerRules)
+		if file == updateInfoFile {
+			result.UpdateInfo = key
+			if headers.CacheControl == "" {
+				headers.CacheControl = "no-cache"
+			}
+		}
+
+		object, err := uploader.upload(file, key, headers)
+		if err != nil {
+			return nil, err
+		}
+		result.Objects = append(result.Objects, object)
+	}
+	return result, nil
+}
+
+func createUpdateInfoFile(options *S3PublishOptions) (string, error) {
+	info, err := CreateUpdateInfo(options.Files, options.Version, options.Platform)
+	if err != nil {
+		return "", err
+	}
+
+	if options.StagingPercentage != 0 {
+		err = info.SetStagingPercentage(options.StagingPercentage)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	dir, err := util.CreateTempDir("update-info")
+	if err != nil {
+		return "", err
+	}
+
+	file := filepath.Join(dir, GetChannelFileName(options.Channel, options.Platform, options.Arch))
+	return file, WriteUpdateInfo(info, file)
+}
+
+type multipartUploader struct {
+	client  *s3.S3
+	options *S3PublishOptions
+	context context.Context
+}
+
+// multipartUploadState is saved until upload is completed to resume it on the next run
+type multipartUploadState struct {
+	UploadId string `json:"uploadId"`
+
+	Bucket   string `json:"bucket"`
+	Key      string `json:"key"`
+	Size     int64  `json:"size"`
+	ModTime  int64  `json:"modTime"`
+	PartSize int64  `json:"partSize"`
+}
+
+type uploadedPart struct {
+	etag string
+	md5  []byte
+}
+
+func (t *multipartUploader) upload(file string, key string, headers ObjectHeaders) (*PublishedObject, error) {
+	fileInfo, err := os.Stat(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	size := fileInfo.Size()
+	partCount := int((size + t.options.PartSize - 1) / t.options.PartSize)
+	if partCount > maxPartCount {
+		return nil, util.NewMessageError("file "+file+" requires more than 10000 parts, increase part size", "ERR_PUBLISH_INVALID_PART_SIZE")
+	}
+
+	if fakes.IsEnabled() {
+		return t.recordFakeUpload(file, key, size, partCount, headers)
+	}
+
+	if partCount <= 1 {
+		return t.putObject(file, key, size, headers)
+	}
+
+	state := &multipartUploadState{
+		Bucket:   t.options.Bucket,
+		Key:      key,
+		Size:     size,
+		ModTime:  fileInfo.ModTime().UnixNano(),
+		PartSize: t.options.PartSize,
+	}
+	stateFile, err := t.getStateFile(file, key)
+	if err != nil {
+		return nil, err
+	}
+
+	existingParts := t.resume(stateFile, state)
+	if existingParts == nil {
+		output, err := t.client.CreateMultipartUploadWithContext(t.context, &s3.CreateMultipartUploadInput{
+			Bucket:               aws.String(t.options.Bucket),
+			Key:                  aws.String(key),
+			ContentType:          aws.String(headers.ContentType),
+			CacheControl:         optionalString(headers.CacheControl),
+			ContentDisposition:   optionalString(headers.ContentDisposition),
+			ACL:                  optionalString(t.options.Acl),
+			StorageClass:         optionalString(t.options.StorageClass),
+			ServerSideEncryption: optionalString(t.options.Encryption),
+		})
+		if err != nil {
+			return nil, errors.WithMessage(err, "cannot create multipart upload of "+file)
+		}
+
+		state.UploadId = *output.UploadId
+		err = saveUploadState(stateFile, state)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := &PublishedObject{File: file, Key: key, Size: size, PartCount: partCount}
+	parts, err := t.uploadParts(file, state, partCount, existingParts, result)
+	if err != nil {
+		return nil, errors.WithMessage(err, "upload of "+file+" is not completed, run again to resume")
+	}
+
+	result.ETag, err = t.complete(state, parts)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Remove(stateFile)
+	if err != nil {
+		log.Debug("cannot remove upload state", zap.String("file", stateFile), zap.Error(err))
+	}
+	log.Info("uploaded", zap.String("file", file), zap.String("key", key), zap.Int("parts", partCount), zap.Int("resumedParts", result.ResumedPartCount))
+	return result, nil
+}
+
+func (t *multipartUploader) uploadParts(file string, state *multipartUploadState, partCount int, existingParts map[int64]string, result *PublishedObject) ([]*uploadedPart, error) {
+	reader, err := os.Open(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer util.Close(reader)
+
+	var mutex sync.Mutex
+	parts := make([]*uploadedPart, partCount)
+	err = util.MapAsyncConcurrency(partCount, t.options.Concurrency, func(taskIndex int) (func() error, error) {
+		return func() error {
+			offset := int64(taskIndex) * state.PartSize
+			size := state.Size - offset
+			if size > state.PartSize {
+				size = state.PartSize
+			}
+
+			data := make([]byte, size)
+			_, err := reader.ReadAt(data, offset)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			checksum := md5.Sum(data)
+			partNumber := int64(taskIndex + 1)
+			if t.isMd5ETag() && existingParts[partNumber] == quoteETag(checksum[:]) {
+				parts[taskIndex] = &uploadedPart{etag: existingParts[partNumber], md5: checksum[:]}
+				mutex.Lock()
+				result.ResumedPartCount++
+				mutex.Unlock()
+				return nil
+			}
+
+			return withRetry(t.context, t.options.Retries, "upload part "+strconv.FormatInt(partNumber, 10)+" of "+file, func() error {
+				output, err := t.client.UploadPartWithContext(t.context, &s3.UploadPartInput{
+					Bucket:     aws.String(state.Bucket),
+					Key:        aws.String(state.Key),
+					UploadId:   aws.String(state.UploadId),
+					PartNumber: aws.Int64(partNumber),
+					Body:       bytes.NewReader(data),
+					// S3 rejects part if data is corrupted in transit
+					ContentMD5: aws.String(base64.StdEncoding.EncodeToString(checksum[:])),
+				})
+				if err != nil {
+					return errors.WithStack(err)
+				}
+
+				etag := aws.StringValue(output.ETag)
+				if t.isMd5ETag() && etag != quoteETag(checksum[:]) {
+					return errors.Errorf("part %d: ETag %s doesn't match MD5 %s", partNumber, etag, quoteETag(checksum[:]))
+				}
+				parts[taskIndex] = &uploadedPart{etag: etag, md5: checksum[:]}
+				return nil
+			})
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return parts, nil
+}
+
+// complete checks ETag of the object - MD5 of part MD5s and the number of parts
+func (t *multipartUploader) complete(state *multipartUploadState, parts []*uploadedPart) (string, error) {
+	completedParts := make([]*s3.CompletedPart, len(parts))
+	partChecksums := md5.New()
+	for index, part := range parts {
+		completedParts[index] = &s3.CompletedPart{ETag: aws.String(part.etag), PartNumber: aws.Int64(int64(index + 1))}
+		_, _ = partChecksums.Write(part.md5)
+	}
+
+	var etag string
+	err := withRetry(t.context, t.options.Retries, "complete upload of "+state.Key, func() error {
+		output, err := t.client.CompleteMultipartUploadWithContext(t.context, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(state.Bucket),
+			Key:             aws.String(state.Key),
+			UploadId:        aws.String(state.UploadId),
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: completedParts},
+		})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		etag = aws.StringValue(output.ETag)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	expectedETag := "\"" + hex.EncodeToString(partChecksums.Sum(nil)) + "-" + strconv.Itoa(len(parts)) + "\""
+	if t.isMd5ETag() && etag != expectedETag {
+		return "", util.NewMessageError("checksum of uploaded "+state.Key+" doesn't match: expected ETag "+expectedETag+", got "+etag, "ERR_PUBLISH_CHECKSUM_MISMATCH")
+	}
+	return etag, nil
+}
+
+func (t *multipartUploader) putObject(file string, key string, size int64, headers ObjectHeaders) (*PublishedObject, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	checksum := md5.Sum(data)
+	var etag string
+	err = withRetry(t.context, t.options.Retries, "upload "+file, func() error {
+		output, err := t.client.PutObjectWithContext(t.context, &s3.PutObjectInput{
+			Bucket:               aws.String(t.options.Bucket),
+			Key:                  aws.String(key),
+			Body:                 bytes.NewReader(data),
+			ContentMD5:           aws.String(base64.StdEncoding.EncodeToString(checksum[:])),
+			ContentType:          aws.String(headers.ContentType),
+			CacheControl:         optionalString(headers.CacheControl),
+			ContentDisposition:   optionalString(headers.ContentDisposition),
+			ACL:                  optionalString(t.options.Acl),
+			StorageClass:         optionalString(t.options.StorageClass),
+			ServerSideEncryption: optionalString(t.options.Encryption),
+		})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		etag = aws.StringValue(output.ETag)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if t.isMd5ETag() && etag != quoteETag(checksum[:]) {
+		return nil, util.NewMessageError("checksum of uploaded "+key+" doesn't match: expected ETag "+quoteETag(checksum[:])+", got "+etag, "ERR_PUBLISH_CHECKSUM_MISMATCH")
+	}
+	log.Info("uploaded", zap.String("file", file), zap.String("key", key))
+	return &PublishedObject{File: file, Key: key, Size: size, ETag: etag}, nil
+}
+
+// resume returns uploaded parts (part number to ETag) if upload of the same file was started and not completed, nil otherwise
+func (t *multipartUploader) resume(stateFile string, state *multipartUploadState) map[int64]string {
+	data, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		return nil
+	}
+
+	var savedState multipartUploadState
+	err = jsoniter.Unmarshal(data, &savedState)
+	if err != nil || savedState.UploadId == "" {
+		return nil
+	}
+
+	uploadId := savedState.UploadId
+	savedState.UploadId = ""
+	if savedState != *state {
+		// file is changed
+		return nil
+	}
+	state.UploadId = uploadId
+
+	result := make(map[int64]string)
+	err = t.client.ListPartsPagesWithContext(t.context, &s3.ListPartsInput{
+		Bucket:   aws.String(state.Bucket),
+		Key:      aws.String(state.Key),
+		UploadId: aws.String(state.UploadId),
+	}, func(page *s3.ListPartsOutput, isLastPage bool) bool {
+		for _, part := range page.Parts {
+			result[aws.Int64Value(part.PartNumber)] = aws.StringValue(part.ETag)
+		}
+		return true
+	})
+	if err != nil {
+		// upload is aborted (e.g. by lifecycle rule)
+		log.Debug("cannot resume upload", zap.String("key", state.Key), zap.Error(err))
+		state.UploadId = ""
+		return nil
+	}
+
+	log.Info("resume upload", zap.String("key", state.Key), zap.Int("uploadedParts", len(result)))
+	return result
+}
+
+func (t *multipartUploader) getStateFile(file string, key string) (string, error) {
+	dir, err := download.GetCacheDirectoryForArtifactCustom("s3-upload")
+	if err != nil {
+		return "", err
+	}
+
+	absoluteFile, err := filepath.Abs(file)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	hash := sha256.Sum256([]byte(t.options.Endpoint + "\n" + t.options.Bucket + "\n" + key + "\n" + absoluteFile))
+	return filepath.Join(dir, hex.EncodeToString(hash[:16])+".json"), nil
+}
+
+func saveUploadState(file string, state *multipartUploadState) error {
+	data, err := jsoniter.Marshal(state)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(ioutil.WriteFile(file, data, 0644))
+}
+
+// retryableError is implemented by errors that know whether request can be retried (e.g. GitHub API error - 5xx), other errors (network, S3) are always retried
+type retryableError interface {
+	isRetryable() bool
+}
+
+// withRetry retries failed request with exponential backoff, canceled request is not retried
+func withRetry(requestContext context.Context, retries int, description string, task func() error) error {
+	delay := uploadRetryDelay
+	for attempt := 0; ; attempt++ {
+		err := task()
+		if err == nil || attempt >= retries || requestContext.Err() != nil {
+			return err
+		}
+		if retryable, ok := errors.Cause(err).(retryableError); ok && !retryable.isRetryable() {
+			return err
+		}
+
+		log.Warn("request failed, retrying", zap.String("request", description), zap.Int("attempt", attempt+1), zap.Duration("delay", delay), zap.Error(err))
+		select {
+		case <-requestContext.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// ETag of object uploaded with SSE-KMS is not MD5 of data
+func (t *multipartUploader) isMd5ETag() bool {
+	return t.options.Encryption != "aws:kms"
+}
+
+func (t *multipartUploader) recordFakeUpload(file string, key string, size int64, partCount int, headers ObjectHeaders) (*PublishedObject, error) {
+	operation := "PutObject"
+	if partCount > 1 {
+		operation = "MultipartUpload"
+	}
+
+	err := fakes.Record(fakes.ServiceS3, operation, map[string]interface{}{
+		"file":         file,
+		"size":         size,
+		"partCount":    partCount,
+		"endpoint":     t.options.Endpoint,
+		"region":       t.options.Region,
+		"bucket":       t.options.Bucket,
+		"key":          key,
+		"contentType":  headers.ContentType,
+		"acl":          t.options.Acl,
+		"storageClass": t.options.StorageClass,
+		"encryption":   t.options.Encryption,
+
+		"cacheControl":       headers.CacheControl,
+		"contentDisposition": headers.ContentDisposition,
+		// credentials are not recorded
+		"hasCredentials": t.options.AccessKey != "",
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &PublishedObject{File: file, Key: key, Size: size, PartCount: partCount}, nil
+}
+
+func quoteETag(checksum []byte) string {
+	return "\"" + hex.EncodeToString(checksum) + "\""
+}
+
+func optionalString(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return aws.String(value)
+}
@@ -0,0 +1,184 @@
+package publisher
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+	"gopkg.in/yaml.v2"
+)
+
+// fakeS3 implements multipart upload API (path-style), part with failPartNumber is rejected
+type fakeS3 struct {
+	mutex          sync.Mutex
+	parts          map[int][]byte
+	objects        map[string][]byte
+	cacheControl   map[string]string
+	uploadedParts  []int
+	failPartNumber int
+}
+
+func (t *fakeS3) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	key := strings.TrimPrefix(request.URL.Path, "/bucket/")
+	query := request.URL.Query()
+	body, _ := ioutil.ReadAll(request.Body)
+	switch {
+	case request.Method == http.MethodPost && query.Get("uploads") == "" && query["uploads"] != nil:
+		t.parts = make(map[int][]byte)
+		t.cacheControl[key] = request.Header.Get("Cache-Control")
+		writeXml(writer, `<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>`+key+`</Key><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>`)
+
+	case request.Method == http.MethodPut && query.Get("partNumber") != "":
+		partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+		checksum := md5.Sum(body)
+		if partNumber == t.failPartNumber || request.Header.Get("Content-MD5") != base64.StdEncoding.EncodeToString(checksum[:]) {
+			writer.WriteHeader(http.StatusForbidden)
+			writeXml(writer, `<Error><Code>AccessDenied</Code><Message>denied</Message></Error>`)
+			return
+		}
+		t.parts[partNumber] = body
+		t.uploadedParts = append(t.uploadedParts, partNumber)
+		writer.Header().Set("ETag", quoteETag(checksum[:]))
+
+	case request.Method == http.MethodGet && query.Get("uploadId") != "":
+		var numbers []int
+		for number := range t.parts {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+		result := `<ListPartsResult><IsTruncated>false</IsTruncated>`
+		for _, number := range numbers {
+			checksum := md5.Sum(t.parts[number])
+			result += fmt.Sprintf(`<Part><PartNumber>%d</PartNumber><ETag>%s</ETag><Size>%d</Size></Part>`, number, quoteETag(checksum[:]), len(t.parts[number]))
+		}
+		writeXml(writer, result+`</ListPartsResult>`)
+
+	case request.Method == http.MethodPost && query.Get("uploadId") != "":
+		var completed struct {
+			Parts []struct {
+				PartNumber int
+			} `xml:"Part"`
+		}
+		_ = xml.Unmarshal(body, &completed)
+		var data []byte
+		checksums := md5.New()
+		for _, part := range completed.Parts {
+			data = append(data, t.parts[part.PartNumber]...)
+			checksum := md5.Sum(t.parts[part.PartNumber])
+			checksums.Write(checksum[:])
+		}
+		t.objects[key] = data
+		writeXml(writer, fmt.Sprintf(`<CompleteMultipartUploadResult><ETag>"%s-%d"</ETag></CompleteMultipartUploadResult>`, hex.EncodeToString(checksums.Sum(nil)), len(completed.Parts)))
+
+	case request.Method == http.MethodPut:
+		checksum := md5.Sum(body)
+		t.objects[key] = body
+		t.cacheControl[key] = request.Header.Get("Cache-Control")
+		writer.Header().Set("ETag", quoteETag(checksum[:]))
+
+	default:
+		writer.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func writeXml(writer http.ResponseWriter, data string) {
+	writer.Header().Set("Content-Type", "application/xml")
+	_, _ = writer.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>` + data))
+}
+
+func TestPublishToS3(t *testing.T) {
+	log.InitLogger()
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "publish")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	// upload state is stored in the cache dir
+	cacheDir := os.Getenv("ELECTRON_BUILDER_CACHE")
+	g.Expect(os.Setenv("ELECTRON_BUILDER_CACHE", filepath.Join(dir, "cache"))).To(Succeed())
+	defer os.Setenv("ELECTRON_BUILDER_CACHE", cacheDir)
+
+	installer := make([]byte, 2*minPartSize+1000)
+	rand.New(rand.NewSource(1)).Read(installer)
+	installerFile := filepath.Join(dir, "App Setup 1.0.0.exe")
+	g.Expect(ioutil.WriteFile(installerFile, installer, 0644)).To(Succeed())
+	blockMapFile := installerFile + ".blockmap"
+	g.Expect(ioutil.WriteFile(blockMapFile, []byte("blockmap"), 0644)).To(Succeed())
+
+	storage := &fakeS3{objects: make(map[string][]byte), cacheControl: make(map[string]string), failPartNumber: 3}
+	server := httptest.NewServer(storage)
+	defer server.Close()
+
+	options := &S3PublishOptions{
+		Files:       []string{installerFile, blockMapFile},
+		Endpoint:    server.URL,
+		Region:      "us-east-1",
+		Bucket:      "bucket",
+		Prefix:      "/app/",
+		AccessKey:   "key",
+		SecretKey:   "secret",
+		PartSize:    minPartSize,
+		Concurrency: 2,
+		Version:     "1.0.0",
+		Channel:     "latest",
+		Platform:    "win",
+	}
+	_, err = PublishToS3(options)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("run again to resume"))
+	g.Expect(storage.objects).To(BeEmpty())
+
+	// the next run uploads only the failed part
+	storage.failPartNumber = 0
+	storage.uploadedParts = nil
+	result, err := PublishToS3(options)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(storage.uploadedParts).To(Equal([]int{3}))
+	g.Expect(result.Objects[0].PartCount).To(Equal(3))
+	g.Expect(result.Objects[0].ResumedPartCount).To(Equal(2))
+	g.Expect(result.UpdateInfo).To(Equal("app/latest.yml"))
+
+	g.Expect(storage.objects["app/App Setup 1.0.0.exe"]).To(Equal(installer))
+	g.Expect(string(storage.objects["app/App Setup 1.0.0.exe.blockmap"])).To(Equal("blockmap"))
+	g.Expect(storage.cacheControl["app/latest.yml"]).To(Equal("no-cache"))
+
+	var updateInfo UpdateInfo
+	g.Expect(yaml.Unmarshal(storage.objects["app/latest.yml"], &updateInfo)).To(Succeed())
+	g.Expect(updateInfo.Version).To(Equal("1.0.0"))
+	g.Expect(updateInfo.Path).To(Equal("App Setup 1.0.0.exe"))
+	g.Expect(updateInfo.Files).To(HaveLen(1))
+	g.Expect(updateInfo.Files[0].Size).To(Equal(int64(len(installer))))
+
+	// completed upload is not resumed
+	stateFiles, err := ioutil.ReadDir(filepath.Join(dir, "cache", "s3-upload"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(stateFiles).To(BeEmpty())
+}
+
+func TestChannelFileName(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	g.Expect(GetChannelFileName("latest", "win", "x64")).To(Equal("latest.yml"))
+	g.Expect(GetChannelFileName("beta", "mac", "arm64")).To(Equal("beta-mac.yml"))
+	g.Expect(GetChannelFileName("latest", "linux", "x64")).To(Equal("latest-linux.yml"))
+	g.Expect(GetChannelFileName("latest", "linux", "arm64")).To(Equal("latest-linux-arm64.yml"))
+}
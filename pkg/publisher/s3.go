@@ -15,6 +15,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/develar/app-builder/pkg/fakes"
 	"github.com/develar/app-builder/pkg/util"
 	"github.com/develar/errors"
 )
@@ -31,6 +32,10 @@ type ObjectOptions struct {
 	storageClass *string
 	encryption   *string
 
+	headers *string
+	// invalidate uploaded key in CloudFront distribution (e.g. for channel metadata)
+	cloudFrontDistributionId *string
+
 	accessKey *string
 	secretKey *string
 }
@@ -49,6 +54,9 @@ func ConfigurePublishToS3Command(app *kingpin.Application) {
 		storageClass: command.Flag("storageClass", "").String(),
 		encryption:   command.Flag("encryption", "").String(),
 
+		headers:                  command.Flag("headers", "Cache-Control, Content-Type and Content-Disposition rules: JSON array (or base64) of {pattern, cacheControl, contentType, contentDisposition}. Pattern is a glob matched against the key.").String(),
+		cloudFrontDistributionId: command.Flag("cloudfront-distribution-id", "Invalidate uploaded key in the CloudFront distribution.").String(),
+
 		accessKey: command.Flag("accessKey", "").String(),
 		secretKey: command.Flag("secretKey", "").String(),
 	}
@@ -58,6 +66,10 @@ func ConfigurePublishToS3Command(app *kingpin.Application) {
 		if err != nil {
 			return err
 		}
+
+		if *options.cloudFrontDistributionId != "" {
+			return InvalidateCdn(&InvalidationOptions{provider: "cloudfront", paths: []string{*options.key}, distributionId: *options.cloudFrontDistributionId})
+		}
 		return nil
 	})
 
@@ -68,6 +80,15 @@ func configureResolveBucketLocationCommand(app *kingpin.Application) {
 	command := app.Command("get-bucket-location", "")
 	bucket := command.Flag("bucket", "").Required().String()
 	command.Action(func(parseContext *kingpin.ParseContext) error {
+		if fakes.IsEnabled() {
+			err := fakes.Record(fakes.ServiceS3, "GetBucketLocation", map[string]interface{}{"bucket": *bucket})
+			if err != nil {
+				return err
+			}
+			_, err = os.Stdout.WriteString("us-east-1")
+			return errors.WithStack(err)
+		}
+
 		requestContext, _ := util.CreateContextWithTimeout(30*time.Second)
 		result, err := getBucketRegion(aws.NewConfig(), *bucket, requestContext, createHttpClient())
 		if err != nil {
@@ -103,41 +124,21 @@ func getBucketRegion(awsConfig *aws.Config, bucket string, context context.Conte
 }
 
 func upload(options *ObjectOptions) error {
-	publishContext, _ := util.CreateContext()
-
-	httpClient := createHttpClient()
-
-	awsConfig := &aws.Config{
-		HTTPClient: httpClient,
-	}
-	if *options.endpoint != "" {
-		awsConfig.Endpoint = options.endpoint
-		awsConfig.S3ForcePathStyle = aws.Bool(true)
+	headerRules, err := parseHeaderRules(*options.headers)
+	if err != nil {
+		return err
 	}
+	headers := resolveHeaders(*options.key, headerRules)
 
-	//awsConfig.WithLogLevel(aws.LogDebugWithHTTPBody)
-
-	if *options.accessKey != "" {
-		awsConfig.Credentials = credentials.NewStaticCredentials(*options.accessKey, *options.secretKey, "")
+	if fakes.IsEnabled() {
+		return recordFakeUpload(options, headers)
 	}
 
-	switch {
-	case *options.region != "":
-		awsConfig.Region = options.region
-	case *options.endpoint != "":
-		awsConfig.Region = aws.String("us-east-1")
-	default:
-		// AWS SDK for Go requires region
-		region, err := getBucketRegion(awsConfig, *options.bucket, publishContext, httpClient)
-		if err != nil {
-			return errors.WithStack(err)
-		}
-		awsConfig.Region = &region
-	}
+	publishContext, _ := util.CreateContext()
 
-	awsSession, err := session.NewSession(awsConfig)
+	awsSession, err := newS3Session(publishContext, *options.endpoint, *options.region, *options.bucket, *options.accessKey, *options.secretKey)
 	if err != nil {
-		return errors.WithStack(err)
+		return err
 	}
 
 	uploader := s3manager.NewUploader(awsSession)
@@ -151,9 +152,15 @@ func upload(options *ObjectOptions) error {
 	uploadInput := s3manager.UploadInput{
 		Bucket:      options.bucket,
 		Key:         options.key,
-		ContentType: aws.String(getMimeType(*options.key)),
+		ContentType: aws.String(headers.ContentType),
 		Body:        file,
 	}
+	if headers.CacheControl != "" {
+		uploadInput.CacheControl = aws.String(headers.CacheControl)
+	}
+	if headers.ContentDisposition != "" {
+		uploadInput.ContentDisposition = aws.String(headers.ContentDisposition)
+	}
 	if *options.acl != "" {
 		uploadInput.ACL = options.acl
 	}
@@ -172,6 +179,71 @@ func upload(options *ObjectOptions) error {
 	return nil
 }
 
+// newS3Session resolves region (bucket location is requested if neither region nor endpoint is specified). S3-compatible storage (DigitalOcean Spaces, MinIO) is used via endpoint.
+func newS3Session(publishContext context.Context, endpoint string, region string, bucket string, accessKey string, secretKey string) (*session.Session, error) {
+	httpClient := createHttpClient()
+
+	awsConfig := &aws.Config{
+		HTTPClient: httpClient,
+	}
+	if endpoint != "" {
+		awsConfig.Endpoint = aws.String(endpoint)
+		awsConfig.S3ForcePathStyle = aws.Bool(true)
+	}
+
+	//awsConfig.WithLogLevel(aws.LogDebugWithHTTPBody)
+
+	if accessKey != "" {
+		awsConfig.Credentials = credentials.NewStaticCredentials(accessKey, secretKey, "")
+	}
+
+	switch {
+	case region != "":
+		awsConfig.Region = aws.String(region)
+	case endpoint != "":
+		awsConfig.Region = aws.String("us-east-1")
+	default:
+		// AWS SDK for Go requires region
+		bucketRegion, err := getBucketRegion(awsConfig, bucket, publishContext, httpClient)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		awsConfig.Region = &bucketRegion
+	}
+
+	awsSession, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return awsSession, nil
+}
+
+func recordFakeUpload(options *ObjectOptions, headers ObjectHeaders) error {
+	// file must exist as for real upload
+	fileInfo, err := os.Stat(*options.file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return fakes.Record(fakes.ServiceS3, "PutObject", map[string]interface{}{
+		"file":         *options.file,
+		"size":         fileInfo.Size(),
+		"endpoint":     *options.endpoint,
+		"region":       *options.region,
+		"bucket":       *options.bucket,
+		"key":          *options.key,
+		"contentType":  headers.ContentType,
+		"acl":          *options.acl,
+		"storageClass": *options.storageClass,
+		"encryption":   *options.encryption,
+
+		"cacheControl":       headers.CacheControl,
+		"contentDisposition": headers.ContentDisposition,
+		// credentials are not recorded
+		"hasCredentials": *options.accessKey != "",
+	})
+}
+
 func createHttpClient() *http.Client {
 	return &http.Client{
 		Transport: &http.Transport{
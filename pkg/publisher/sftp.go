@@ -0,0 +1,176 @@
+package publisher
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"go.uber.org/zap"
+)
+
+func configurePublishSftpCommand(publishCommand *kingpin.CmdClause) {
+	command := publishCommand.Command("sftp", "Upload files using sftp (OpenSSH client, key authentication). File is uploaded under temporary name and renamed, so, partially uploaded file is never served. "+
+		"Result is written to stdout as JSON.")
+	options := &TransferOptions{}
+	var bandwidthLimit string
+	command.Flag("target", "The remote dir as user@host:/dir.").Required().StringVar(&options.Target)
+	command.Flag("port", "The port.").Default("22").IntVar(&options.Port)
+	command.Flag("identity", "The private key file.").StringVar(&options.IdentityFile)
+	configureTransferFlags(command, options, &bandwidthLimit)
+	command.Action(func(context *kingpin.ParseContext) error {
+		return publishAndWriteResult(options, bandwidthLimit, PublishToSftp)
+	})
+}
+
+func PublishToSftp(options *TransferOptions) ([]*TransferResult, error) {
+	host, remoteDir, err := parseSftpTarget(options.Target)
+	if err != nil {
+		return nil, err
+	}
+	if options.Verify == VerifyHash && len(options.PublicUrl) == 0 {
+		return nil, util.NewMessageError("public URL is required to verify hash of files uploaded using sftp", "ERR_PUBLISH_INVALID_OPTIONS")
+	}
+
+	publishContext, _ := util.CreateContext()
+	// HEAD and hash verification using public URL
+	uploader := &httpUploader{options: options, httpClient: createHttpClient(), context: publishContext}
+
+	concurrency := getConcurrency(options)
+	result := make([]*TransferResult, len(options.Files))
+	err = util.MapAsyncConcurrency(len(options.Files), concurrency, func(taskIndex int) (func() error, error) {
+		file := options.Files[taskIndex]
+		remoteFile := path.Join(remoteDir, filepath.Base(file))
+		return func() error {
+			fileInfo, err := os.Stat(file)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			var output []byte
+			err = withRetry(publishContext, options.Retries, "upload "+file, func() error {
+				output, err = executeSftp(host, createSftpBatch(file, remoteFile), options, concurrency)
+				return err
+			})
+			if err != nil {
+				return errors.WithMessage(err, "cannot upload "+file)
+			}
+
+			item := &TransferResult{File: file, Url: "sftp://" + host + remoteFile, Size: fileInfo.Size(), Verified: VerifyNone}
+			if options.Verify != VerifyNone {
+				if len(options.PublicUrl) != 0 {
+					item.Verified, err = verifyTransfer(uploader, options, file, "", fileInfo.Size())
+					if err != nil {
+						return err
+					}
+				} else {
+					err = verifySftpListing(output, remoteFile, fileInfo.Size())
+					if err != nil {
+						return err
+					}
+					item.Verified = VerifySize
+				}
+			}
+
+			result[taskIndex] = item
+			log.Info("uploaded", zap.String("file", file), zap.String("url", item.Url), zap.String("verified", item.Verified))
+			return nil
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// user@host:/dir
+func parseSftpTarget(target string) (string, string, error) {
+	index := strings.IndexRune(target, ':')
+	if index <= 0 || index == len(target)-1 {
+		return "", "", util.NewMessageError("invalid sftp target "+target+", expected user@host:/dir", "ERR_PUBLISH_INVALID_OPTIONS")
+	}
+	return target[:index], target[index+1:], nil
+}
+
+// createSftpBatch creates parent dirs (errors are ignored - dir may exist), uploads file under temporary name and renames, listing is used to verify size
+func createSftpBatch(file string, remoteFile string) string {
+	var builder strings.Builder
+	dir := path.Dir(remoteFile)
+	var dirs []string
+	for ; dir != "/" && dir != "." && dir != ""; dir = path.Dir(dir) {
+		dirs = append(dirs, dir)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		builder.WriteString("-mkdir " + quoteSftpPath(dirs[i]) + "\n")
+	}
+
+	temporaryFile := remoteFile + ".partial"
+	builder.WriteString("put " + quoteSftpPath(file) + " " + quoteSftpPath(temporaryFile) + "\n")
+	builder.WriteString("-rm " + quoteSftpPath(remoteFile) + "\n")
+	builder.WriteString("rename " + quoteSftpPath(temporaryFile) + " " + quoteSftpPath(remoteFile) + "\n")
+	builder.WriteString("ls -ln " + quoteSftpPath(remoteFile) + "\n")
+	return builder.String()
+}
+
+func quoteSftpPath(file string) string {
+	return "\"" + strings.Replace(strings.Replace(file, "\\", "\\\\", -1), "\"", "\\\"", -1) + "\""
+}
+
+func executeSftp(host string, batch string, options *TransferOptions, concurrency int) ([]byte, error) {
+	batchFile, err := util.CreateTempFile("sftp-batch")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = os.Remove(batchFile.Name())
+	}()
+
+	_, err = batchFile.WriteString(batch)
+	util.Close(batchFile)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	args := []string{"-b", batchFile.Name(), "-P", strconv.Itoa(options.Port), "-o", "BatchMode=yes"}
+	if len(options.IdentityFile) != 0 {
+		args = append(args, "-i", options.IdentityFile)
+	}
+	if options.BandwidthLimit > 0 {
+		// Kbit/s per process, total limit is shared by concurrent transfers
+		limit := options.BandwidthLimit * 8 / 1024 / int64(concurrency)
+		if limit < 1 {
+			limit = 1
+		}
+		args = append(args, "-l", strconv.FormatInt(limit, 10))
+	}
+	return util.Execute(exec.Command("sftp", append(args, host)...))
+}
+
+// verifySftpListing finds size of the uploaded file in output of "ls -ln" (-rw-r--r-- 1 1000 1000 12345 Jan 1 00:00 /dir/file)
+func verifySftpListing(output []byte, remoteFile string, size int64) error {
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 9 || !strings.HasPrefix(fields[0], "-") || !strings.HasSuffix(scanner.Text(), path.Base(remoteFile)) {
+			continue
+		}
+
+		actualSize, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			continue
+		}
+		if actualSize != size {
+			return util.NewMessageError("published "+remoteFile+" size "+fields[4]+" doesn't match local size "+strconv.FormatInt(size, 10), "ERR_PUBLISH_VERIFICATION_FAILED")
+		}
+		return nil
+	}
+	return util.NewMessageError("cannot verify "+remoteFile+": not found in listing", "ERR_PUBLISH_VERIFICATION_FAILED")
+}
@@ -0,0 +1,82 @@
+package publisher
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/develar/errors"
+)
+
+// max bytes sent without waiting, so, rate is smooth
+const throttleChunkSize = 32 * 1024
+
+// bandwidthLimiter is shared by concurrent transfers - limit is applied to the total rate
+type bandwidthLimiter struct {
+	mutex          sync.Mutex
+	bytesPerSecond int64
+	// time when the next chunk can be sent
+	next time.Time
+}
+
+// newBandwidthLimiter returns nil if rate is not limited
+func newBandwidthLimiter(bytesPerSecond int64) *bandwidthLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &bandwidthLimiter{bytesPerSecond: bytesPerSecond}
+}
+
+// wait reserves time to send n bytes and waits until reserved time
+func (t *bandwidthLimiter) wait(requestContext context.Context, n int) error {
+	t.mutex.Lock()
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	start := t.next
+	t.next = t.next.Add(time.Duration(int64(n) * int64(time.Second) / t.bytesPerSecond))
+	t.mutex.Unlock()
+
+	delay := start.Sub(now)
+	if delay <= 0 {
+		return nil
+	}
+
+	select {
+	case <-requestContext.Done():
+		return errors.WithStack(requestContext.Err())
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// limitReader returns reader as is if limiter is nil
+func (t *bandwidthLimiter) limitReader(requestContext context.Context, reader io.Reader) io.Reader {
+	if t == nil {
+		return reader
+	}
+	return &limitedReader{reader: reader, limiter: t, context: requestContext}
+}
+
+type limitedReader struct {
+	reader  io.Reader
+	limiter *bandwidthLimiter
+	context context.Context
+}
+
+func (t *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunkSize {
+		p = p[:throttleChunkSize]
+	}
+
+	n, err := t.reader.Read(p)
+	if n > 0 {
+		waitErr := t.limiter.wait(t.context, n)
+		if waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
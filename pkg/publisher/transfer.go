@@ -0,0 +1,358 @@
+package publisher
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/dustin/go-humanize"
+	"go.uber.org/zap"
+)
+
+const (
+	VerifyNone = "none"
+	// HEAD request (HTTP, WebDAV) or ls (SFTP), size must be equal to the local file size
+	VerifySize = "size"
+	// published file is downloaded and sha512 is compared with the local file
+	VerifyHash = "hash"
+)
+
+// TransferOptions are common for HTTP PUT, WebDAV and SFTP publishers (self-hosted update servers)
+type TransferOptions struct {
+	Files []string
+	// base URL (HTTP, WebDAV) or user@host:/dir (SFTP)
+	Target string
+	// URL to download published files from for verification, Target by default for HTTP and WebDAV
+	PublicUrl string
+
+	Concurrency int
+	// bytes per second for all transfers, 0 - not limited
+	BandwidthLimit int64
+	Retries        int
+	Verify         string
+
+	// HTTP and WebDAV: basic authentication and extra headers (e.g. Authorization: Bearer)
+	Username string
+	Password string
+	Headers  map[string]string
+
+	// SFTP
+	Port         int
+	IdentityFile string
+}
+
+type TransferResult struct {
+	File string `json:"file"`
+	Url  string `json:"url"`
+	Size int64  `json:"size"`
+	// how published file was verified (none, size or hash)
+	Verified string `json:"verified"`
+}
+
+type httpStatusError struct {
+	url        string
+	statusCode int
+}
+
+func (t *httpStatusError) Error() string {
+	return t.url + ": unexpected status " + strconv.Itoa(t.statusCode) + " " + http.StatusText(t.statusCode)
+}
+
+func (t *httpStatusError) isRetryable() bool {
+	return t.statusCode >= 500 || t.statusCode == http.StatusTooManyRequests
+}
+
+func configureTransferFlags(command *kingpin.CmdClause, options *TransferOptions, bandwidthLimit *string) {
+	command.Flag("file", "The file to upload, can be specified several times.").Short('f').Required().ExistingFilesVar(&options.Files)
+	command.Flag("public-url", "The base URL to download published files from for verification.").StringVar(&options.PublicUrl)
+	command.Flag("concurrency", "The number of files uploaded concurrently.").Default("4").IntVar(&options.Concurrency)
+	command.Flag("limit-rate", "The total bandwidth limit (e.g. 10MB, 500KB), not limited by default.").StringVar(bandwidthLimit)
+	command.Flag("retries", "The number of retries of failed upload.").Default("3").IntVar(&options.Retries)
+	command.Flag("verify", "How to verify published files: none, size or hash (download and compare sha512).").Default(VerifySize).EnumVar(&options.Verify, VerifyNone, VerifySize, VerifyHash)
+}
+
+func configureHttpFlags(command *kingpin.CmdClause, options *TransferOptions) {
+	command.Flag("url", "The base URL, files are uploaded as <url>/<file name>.").Required().StringVar(&options.Target)
+	command.Flag("username", "The username (basic authentication).").Envar("PUBLISH_USERNAME").StringVar(&options.Username)
+	command.Flag("password", "The password (basic authentication).").Envar("PUBLISH_PASSWORD").StringVar(&options.Password)
+	command.Flag("header", "The request header (e.g. Authorization=Bearer token), can be specified several times.").StringMapVar(&options.Headers)
+}
+
+func configurePublishHttpCommand(publishCommand *kingpin.CmdClause) {
+	command := publishCommand.Command("http", "Upload files using HTTP PUT. Result is written to stdout as JSON.")
+	options := &TransferOptions{}
+	var bandwidthLimit string
+	configureHttpFlags(command, options)
+	configureTransferFlags(command, options, &bandwidthLimit)
+	command.Action(func(context *kingpin.ParseContext) error {
+		return publishAndWriteResult(options, bandwidthLimit, PublishToHttp)
+	})
+}
+
+func configurePublishWebDavCommand(publishCommand *kingpin.CmdClause) {
+	command := publishCommand.Command("webdav", "Upload files to WebDAV server (missing collections are created). Result is written to stdout as JSON.")
+	options := &TransferOptions{}
+	var bandwidthLimit string
+	configureHttpFlags(command, options)
+	configureTransferFlags(command, options, &bandwidthLimit)
+	command.Action(func(context *kingpin.ParseContext) error {
+		return publishAndWriteResult(options, bandwidthLimit, PublishToWebDav)
+	})
+}
+
+func publishAndWriteResult(options *TransferOptions, bandwidthLimit string, publish func(options *TransferOptions) ([]*TransferResult, error)) error {
+	if len(bandwidthLimit) != 0 {
+		limit, err := humanize.ParseBytes(bandwidthLimit)
+		if err != nil {
+			return util.NewMessageError("invalid bandwidth limit "+bandwidthLimit, "ERR_PUBLISH_INVALID_OPTIONS")
+		}
+		options.BandwidthLimit = int64(limit)
+	}
+
+	result, err := publish(options)
+	if err != nil {
+		return err
+	}
+	return util.WriteJsonToStdOut(result)
+}
+
+func PublishToHttp(options *TransferOptions) ([]*TransferResult, error) {
+	return publishUsingHttp(options, false)
+}
+
+func PublishToWebDav(options *TransferOptions) ([]*TransferResult, error) {
+	return publishUsingHttp(options, true)
+}
+
+func publishUsingHttp(options *TransferOptions, isWebDav bool) ([]*TransferResult, error) {
+	baseUrl, err := url.Parse(strings.TrimSuffix(options.Target, "/"))
+	if err != nil || (baseUrl.Scheme != "http" && baseUrl.Scheme != "https") {
+		return nil, util.NewMessageError("invalid URL "+options.Target, "ERR_PUBLISH_INVALID_OPTIONS")
+	}
+
+	publishContext, _ := util.CreateContext()
+	uploader := &httpUploader{
+		options:    options,
+		httpClient: createHttpClient(),
+		context:    publishContext,
+		limiter:    newBandwidthLimiter(options.BandwidthLimit),
+	}
+
+	if isWebDav {
+		err = uploader.createCollections(baseUrl)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := make([]*TransferResult, len(options.Files))
+	err = util.MapAsyncConcurrency(len(options.Files), getConcurrency(options), func(taskIndex int) (func() error, error) {
+		file := options.Files[taskIndex]
+		fileUrl := baseUrl.String() + "/" + url.PathEscape(filepath.Base(file))
+		return func() error {
+			size, err := uploader.upload(file, fileUrl)
+			if err != nil {
+				return err
+			}
+
+			item := &TransferResult{File: file, Url: fileUrl, Size: size}
+			item.Verified, err = verifyTransfer(uploader, options, file, fileUrl, size)
+			if err != nil {
+				return err
+			}
+			result[taskIndex] = item
+			log.Info("uploaded", zap.String("file", file), zap.String("url", fileUrl), zap.String("verified", item.Verified))
+			return nil
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+type httpUploader struct {
+	options    *TransferOptions
+	httpClient *http.Client
+	context    context.Context
+	limiter    *bandwidthLimiter
+}
+
+func (t *httpUploader) upload(file string, fileUrl string) (int64, error) {
+	fileInfo, err := os.Stat(file)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	err = withRetry(t.context, t.options.Retries, "upload "+file, func() error {
+		reader, err := os.Open(file)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer util.Close(reader)
+
+		request, err := t.newRequest(http.MethodPut, fileUrl, t.limiter.limitReader(t.context, reader))
+		if err != nil {
+			return err
+		}
+		request.ContentLength = fileInfo.Size()
+		request.Header.Set("Content-Type", getMimeType(file))
+		return t.do(request, http.StatusOK, http.StatusCreated, http.StatusNoContent)
+	})
+	if err != nil {
+		return 0, errors.WithMessage(err, "cannot upload "+file)
+	}
+	return fileInfo.Size(), nil
+}
+
+// createCollections creates collections of the base URL path (MKCOL), existing collection is not an error (405)
+func (t *httpUploader) createCollections(baseUrl *url.URL) error {
+	collectionUrl := *baseUrl
+	collectionPath := ""
+	for _, name := range strings.Split(strings.Trim(baseUrl.Path, "/"), "/") {
+		if name == "" {
+			continue
+		}
+
+		collectionPath += "/" + name
+		collectionUrl.Path = collectionPath + "/"
+		err := withRetry(t.context, t.options.Retries, "create collection "+collectionPath, func() error {
+			request, err := t.newRequest("MKCOL", collectionUrl.String(), nil)
+			if err != nil {
+				return err
+			}
+			return t.do(request, http.StatusCreated, http.StatusMethodNotAllowed)
+		})
+		if err != nil {
+			return errors.WithMessage(err, "cannot create collection "+collectionPath)
+		}
+	}
+	return nil
+}
+
+func (t *httpUploader) getSize(fileUrl string) (int64, error) {
+	request, err := t.newRequest(http.MethodHead, fileUrl, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	response, err := t.httpClient.Do(request)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	util.Close(response.Body)
+	if response.StatusCode != http.StatusOK {
+		return 0, &httpStatusError{url: fileUrl, statusCode: response.StatusCode}
+	}
+	return response.ContentLength, nil
+}
+
+// hash downloads file with the same authentication as for upload
+func (t *httpUploader) hash(fileUrl string) (string, error) {
+	request, err := t.newRequest(http.MethodGet, fileUrl, nil)
+	if err != nil {
+		return "", err
+	}
+
+	response, err := t.httpClient.Do(request)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer util.Close(response.Body)
+	if response.StatusCode != http.StatusOK {
+		return "", &httpStatusError{url: fileUrl, statusCode: response.StatusCode}
+	}
+
+	hash := sha512.New()
+	_, err = io.Copy(hash, response.Body)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (t *httpUploader) newRequest(method string, requestUrl string, body io.Reader) (*http.Request, error) {
+	request, err := http.NewRequest(method, requestUrl, body)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if len(t.options.Username) != 0 {
+		request.SetBasicAuth(t.options.Username, t.options.Password)
+	}
+	for name, value := range t.options.Headers {
+		request.Header.Set(name, value)
+	}
+	return request.WithContext(t.context), nil
+}
+
+func (t *httpUploader) do(request *http.Request, expectedStatuses ...int) error {
+	response, err := t.httpClient.Do(request)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(response.Body)
+	_, _ = ioutil.ReadAll(response.Body)
+
+	for _, status := range expectedStatuses {
+		if response.StatusCode == status {
+			return nil
+		}
+	}
+	return &httpStatusError{url: request.URL.String(), statusCode: response.StatusCode}
+}
+
+// verifyTransfer checks size using HEAD or compares sha512 of downloaded file
+func verifyTransfer(uploader *httpUploader, options *TransferOptions, file string, fileUrl string, size int64) (string, error) {
+	if len(options.PublicUrl) != 0 {
+		fileUrl = strings.TrimSuffix(options.PublicUrl, "/") + "/" + url.PathEscape(filepath.Base(file))
+	}
+
+	switch options.Verify {
+	case VerifySize:
+		actualSize, err := uploader.getSize(fileUrl)
+		if err != nil {
+			return "", errors.WithMessage(err, "cannot verify "+file)
+		}
+		if actualSize != size {
+			return "", util.NewMessageError("published "+path.Base(fileUrl)+" size "+strconv.FormatInt(actualSize, 10)+" doesn't match local size "+strconv.FormatInt(size, 10), "ERR_PUBLISH_VERIFICATION_FAILED")
+		}
+
+	case VerifyHash:
+		expectedHash, err := hashFile(file)
+		if err != nil {
+			return "", err
+		}
+		actualHash, err := uploader.hash(fileUrl)
+		if err != nil {
+			return "", errors.WithMessage(err, "cannot verify "+file)
+		}
+		if actualHash != expectedHash {
+			return "", util.NewMessageError("published "+path.Base(fileUrl)+" sha512 doesn't match local file", "ERR_PUBLISH_VERIFICATION_FAILED")
+		}
+
+	default:
+		return VerifyNone, nil
+	}
+	return options.Verify, nil
+}
+
+func getConcurrency(options *TransferOptions) int {
+	if options.Concurrency <= 0 {
+		return 1
+	}
+	return options.Concurrency
+}
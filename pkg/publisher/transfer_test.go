@@ -0,0 +1,142 @@
+package publisher
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+)
+
+// fakeWebDav stores files in memory, the first PUT of every file fails with 503
+type fakeWebDav struct {
+	mutex       sync.Mutex
+	files       map[string][]byte
+	collections []string
+	failedPuts  map[string]bool
+}
+
+func (t *fakeWebDav) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	username, password, _ := request.BasicAuth()
+	if username != "user" || password != "secret" {
+		writer.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(request.Body)
+	switch request.Method {
+	case "MKCOL":
+		t.collections = append(t.collections, request.URL.Path)
+		writer.WriteHeader(http.StatusCreated)
+
+	case http.MethodPut:
+		if !t.failedPuts[request.URL.Path] {
+			t.failedPuts[request.URL.Path] = true
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		t.files[request.URL.Path] = body
+		writer.WriteHeader(http.StatusCreated)
+
+	case http.MethodHead, http.MethodGet:
+		data, ok := t.files[request.URL.Path]
+		if !ok {
+			writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writer.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if request.Method == http.MethodGet {
+			_, _ = writer.Write(data)
+		}
+
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestPublishToWebDav(t *testing.T) {
+	log.InitLogger()
+	g := NewGomegaWithT(t)
+
+	retryDelay := uploadRetryDelay
+	uploadRetryDelay = time.Millisecond
+	defer func() {
+		uploadRetryDelay = retryDelay
+	}()
+
+	dir, err := ioutil.TempDir("", "publish")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	installerFile := filepath.Join(dir, "App Setup 1.0.0.exe")
+	g.Expect(ioutil.WriteFile(installerFile, make([]byte, 100*1024), 0644)).To(Succeed())
+	updateInfoFile := filepath.Join(dir, "latest.yml")
+	g.Expect(ioutil.WriteFile(updateInfoFile, []byte("version: 1.0.0"), 0644)).To(Succeed())
+
+	storage := &fakeWebDav{files: make(map[string][]byte), failedPuts: make(map[string]bool)}
+	server := httptest.NewServer(storage)
+	defer server.Close()
+
+	for _, verify := range []string{VerifySize, VerifyHash} {
+		storage.files = make(map[string][]byte)
+		storage.failedPuts = make(map[string]bool)
+
+		start := time.Now()
+		result, err := PublishToWebDav(&TransferOptions{
+			Files:          []string{installerFile, updateInfoFile},
+			Target:         server.URL + "/updates/win/",
+			Concurrency:    2,
+			BandwidthLimit: 400 * 1024,
+			Retries:        1,
+			Verify:         verify,
+			Username:       "user",
+			Password:       "secret",
+		})
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(result).To(HaveLen(2))
+		g.Expect(result[0].Url).To(Equal(server.URL + "/updates/win/App%20Setup%201.0.0.exe"))
+		g.Expect(result[0].Verified).To(Equal(verify))
+		g.Expect(storage.files["/updates/win/latest.yml"]).To(Equal([]byte("version: 1.0.0")))
+		g.Expect(storage.files["/updates/win/App Setup 1.0.0.exe"]).To(HaveLen(100 * 1024))
+		// the first attempt is failed - 200 KB is sent at 400 KB/s
+		g.Expect(time.Since(start)).To(BeNumerically(">=", 400*time.Millisecond))
+	}
+	g.Expect(storage.collections[:2]).To(Equal([]string{"/updates/", "/updates/win/"}))
+
+	_, err = PublishToHttp(&TransferOptions{Files: []string{updateInfoFile}, Target: server.URL + "/updates", Verify: VerifySize})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("401"))
+}
+
+func TestSftpBatch(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	host, dir, err := parseSftpTarget("deploy@example.com:/var/www/updates")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(host).To(Equal("deploy@example.com"))
+	g.Expect(dir).To(Equal("/var/www/updates"))
+	_, _, err = parseSftpTarget("example.com")
+	g.Expect(err).To(HaveOccurred())
+
+	g.Expect(createSftpBatch("/tmp/App Setup.exe", "/www/win/App Setup.exe")).To(Equal(`-mkdir "/www"
+-mkdir "/www/win"
+put "/tmp/App Setup.exe" "/www/win/App Setup.exe.partial"
+-rm "/www/win/App Setup.exe"
+rename "/www/win/App Setup.exe.partial" "/www/win/App Setup.exe"
+ls -ln "/www/win/App Setup.exe"
+`))
+
+	output := []byte("sftp> ls -ln \"/www/win/App Setup.exe\"\n-rw-r--r--    1 1000     1000        12345 Oct 17 03:42 /www/win/App Setup.exe\n")
+	g.Expect(verifySftpListing(output, "/www/win/App Setup.exe", 12345)).To(Succeed())
+	g.Expect(verifySftpListing(output, "/www/win/App Setup.exe", 1)).NotTo(Succeed())
+}
@@ -0,0 +1,173 @@
+package publisher
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/develar/app-builder/pkg/blockmap"
+	"github.com/develar/app-builder/pkg/reproducible"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// UpdateInfo is the channel file (e.g. latest.yml) checked by electron-updater. Field order is the same as written by electron-builder.
+type UpdateInfo struct {
+	Version     string           `yaml:"version"`
+	Files       []UpdateFileInfo `yaml:"files"`
+	Path        string           `yaml:"path"`
+	Sha512      string           `yaml:"sha512"`
+	ReleaseDate string           `yaml:"releaseDate"`
+	// percentage of users to get the update (staged rollout), not written if all users get the update
+	StagingPercentage *int `yaml:"stagingPercentage,omitempty"`
+}
+
+type UpdateFileInfo struct {
+	Url string `yaml:"url"`
+	// base64
+	Sha512 string `yaml:"sha512"`
+	Size   int64  `yaml:"size"`
+	// size of the block map appended to the file (e.g. AppImage, NSIS web package), separate .blockmap file is downloaded by the file URL
+	BlockMapSize int64 `yaml:"blockMapSize,omitempty"`
+}
+
+// GetChannelFileName returns latest.yml for Windows, latest-mac.yml for macOS and latest-linux.yml (latest-linux-arm64.yml for not x64) for Linux
+func GetChannelFileName(channel string, platform string, arch string) string {
+	switch platform {
+	case "mac":
+		return channel + "-mac.yml"
+	case "linux":
+		if arch == "" || arch == "x64" {
+			return channel + "-linux.yml"
+		}
+		return channel + "-linux-" + arch + ".yml"
+	default:
+		return channel + ".yml"
+	}
+}
+
+// CreateUpdateInfo computes sha512 and size of published files (blockmaps are not listed, electron-updater gets them by the file URL).
+// Update on macOS is performed using zip, so, zip is the primary file if present.
+func CreateUpdateInfo(files []string, version string, platform string) (*UpdateInfo, error) {
+	var published []string
+	for _, file := range files {
+		if !strings.HasSuffix(file, ".blockmap") {
+			published = append(published, file)
+		}
+	}
+	if len(published) == 0 {
+		return nil, util.NewMessageError("no files to create update info", "ERR_PUBLISH_NO_UPDATE_FILES")
+	}
+
+	result := &UpdateInfo{
+		Version: version,
+		Files:   make([]UpdateFileInfo, len(published)),
+	}
+	err := util.MapAsync(len(published), func(taskIndex int) (func() error, error) {
+		file := published[taskIndex]
+		return func() error {
+			item, err := createUpdateFileInfo(file)
+			if err != nil {
+				return err
+			}
+			result.Files[taskIndex] = *item
+			return nil
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	primary := result.Files[0]
+	if platform == "mac" {
+		for _, item := range result.Files {
+			if strings.HasSuffix(item.Url, ".zip") {
+				primary = item
+				break
+			}
+		}
+	}
+	// legacy fields for old electron-updater versions
+	result.Path = primary.Url
+	result.Sha512 = primary.Sha512
+
+	releaseDate, err := reproducible.GetBuildTime()
+	if err != nil {
+		return nil, err
+	}
+	// the same format as JS toISOString
+	result.ReleaseDate = releaseDate.UTC().Format("2006-01-02T15:04:05.000Z")
+	return result, nil
+}
+
+// WriteUpdateInfo writes update info to the file as YAML
+func WriteUpdateInfo(info *UpdateInfo, file string) error {
+	data, err := yaml.Marshal(info)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(ioutil.WriteFile(file, data, 0644))
+}
+
+// SetStagingPercentage sets percentage of users to get the update, 100 (all users) is not written
+func (t *UpdateInfo) SetStagingPercentage(percentage int) error {
+	if percentage < 0 || percentage > 100 {
+		return util.NewMessageError("staging percentage must be between 0 and 100, got "+strconv.Itoa(percentage), "ERR_UPDATE_INFO_INVALID_STAGING_PERCENTAGE")
+	}
+
+	if percentage == 100 {
+		t.StagingPercentage = nil
+	} else {
+		t.StagingPercentage = &percentage
+	}
+	return nil
+}
+
+// ReadUpdateInfo reads update info, unknown fields (e.g. releaseNotes) are ignored
+func ReadUpdateInfo(file string) (*UpdateInfo, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var info UpdateInfo
+	err = yaml.Unmarshal(data, &info)
+	if err != nil {
+		return nil, util.NewMessageError("cannot parse update info "+file+": "+err.Error(), "ERR_UPDATE_INFO_INVALID_FORMAT")
+	}
+	return &info, nil
+}
+
+func createUpdateFileInfo(file string) (*UpdateFileInfo, error) {
+	hash, size, err := computeUpdateFileHash(file)
+	if err != nil {
+		return nil, err
+	}
+
+	blockMapSize, err := blockmap.GetAppendedBlockMapSize(file)
+	if err != nil {
+		return nil, err
+	}
+	return &UpdateFileInfo{Url: filepath.Base(file), Sha512: hash, Size: size, BlockMapSize: int64(blockMapSize)}, nil
+}
+
+func computeUpdateFileHash(file string) (string, int64, error) {
+	reader, err := os.Open(file)
+	if err != nil {
+		return "", 0, errors.WithStack(err)
+	}
+	defer util.Close(reader)
+
+	hash := sha512.New()
+	size, err := io.Copy(hash, reader)
+	if err != nil {
+		return "", 0, errors.WithStack(err)
+	}
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil)), size, nil
+}
@@ -0,0 +1,193 @@
+package publisher
+
+import (
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/util"
+)
+
+type UpdateInfoOptions struct {
+	Files    []string
+	Version  string
+	Channel  string
+	Platform string
+	Arch     string
+	// percentage of users to get the update (staged rollout), all users if not set
+	StagingPercentage int
+	// dir of the first file by default
+	OutDir string
+}
+
+type UpdateInfoResult struct {
+	File string      `json:"file"`
+	Info *UpdateInfo `json:"info"`
+}
+
+// ConfigureUpdateInfoCommand registers update-info command - electron-builder doesn't compute hashes of artifacts itself, and published metadata can be checked before upload
+func ConfigureUpdateInfoCommand(app *kingpin.Application) {
+	command := app.Command("update-info", "Generate or validate update info (latest.yml, latest-mac.yml, latest-linux.yml) checked by electron-updater.")
+	configureGenerateUpdateInfoCommand(command)
+	configureValidateUpdateInfoCommand(command)
+}
+
+func configureGenerateUpdateInfoCommand(updateInfoCommand *kingpin.CmdClause) {
+	command := updateInfoCommand.Command("generate", "Compute sha512 and size of artifacts and write update info. Result is written to stdout as JSON.")
+
+	options := &UpdateInfoOptions{}
+	command.Flag("file", "The artifact (block map is detected if appended to the file, .blockmap files are not listed), can be specified several times.").Short('f').Required().ExistingFilesVar(&options.Files)
+	command.Flag("app-version", "The app version.").Required().StringVar(&options.Version)
+	command.Flag("channel", "The update channel.").Default("latest").StringVar(&options.Channel)
+	command.Flag("platform", "The platform.").Default("win").EnumVar(&options.Platform, "win", "mac", "linux")
+	command.Flag("arch", "The arch (Linux).").StringVar(&options.Arch)
+	command.Flag("staging-percentage", "The percentage of users to get the update (staged rollout), all users by default.").IntVar(&options.StagingPercentage)
+	command.Flag("output", "The output dir, dir of the first artifact by default.").Short('o').StringVar(&options.OutDir)
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		result, err := GenerateUpdateInfo(options)
+		if err != nil {
+			return err
+		}
+		return util.WriteJsonToStdOut(result)
+	})
+}
+
+func configureValidateUpdateInfoCommand(updateInfoCommand *kingpin.CmdClause) {
+	command := updateInfoCommand.Command("validate", "Check that update info matches the artifacts (sha512, size, appended block map) before publishing.")
+
+	file := command.Flag("update-info", "The update info file.").Short('i').Required().ExistingFile()
+	files := command.Flag("file", "The artifact, can be specified several times.").Short('f').Required().ExistingFiles()
+	version := command.Flag("app-version", "The expected app version.").String()
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		info, err := ReadUpdateInfo(*file)
+		if err != nil {
+			return err
+		}
+
+		problems, err := ValidateUpdateInfo(info, *files, *version)
+		if err != nil {
+			return err
+		}
+		if len(problems) != 0 {
+			return util.NewMessageError(filepath.Base(*file)+" doesn't match artifacts:\n  "+strings.Join(problems, "\n  "), "ERR_UPDATE_INFO_MISMATCH")
+		}
+		return nil
+	})
+}
+
+func GenerateUpdateInfo(options *UpdateInfoOptions) (*UpdateInfoResult, error) {
+	info, err := CreateUpdateInfo(options.Files, options.Version, options.Platform)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.StagingPercentage != 0 {
+		err = info.SetStagingPercentage(options.StagingPercentage)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	outDir := options.OutDir
+	if len(outDir) == 0 {
+		outDir = filepath.Dir(options.Files[0])
+	}
+
+	file := filepath.Join(outDir, GetChannelFileName(options.Channel, options.Platform, options.Arch))
+	err = WriteUpdateInfo(info, file)
+	if err != nil {
+		return nil, err
+	}
+	return &UpdateInfoResult{File: file, Info: info}, nil
+}
+
+// ValidateUpdateInfo returns description of each problem (sorted), artifact is matched to the file entry by name
+func ValidateUpdateInfo(info *UpdateInfo, files []string, expectedVersion string) ([]string, error) {
+	var problems []string
+	if len(info.Version) == 0 {
+		problems = append(problems, "version is not specified")
+	} else if len(expectedVersion) != 0 && info.Version != expectedVersion {
+		problems = append(problems, "version "+info.Version+" doesn't match expected "+expectedVersion)
+	}
+	if len(info.Files) == 0 {
+		problems = append(problems, "files are not specified")
+	}
+	if info.StagingPercentage != nil && (*info.StagingPercentage < 0 || *info.StagingPercentage > 100) {
+		problems = append(problems, "staging percentage "+strconv.Itoa(*info.StagingPercentage)+" is not between 0 and 100")
+	}
+	if len(info.ReleaseDate) != 0 {
+		_, err := time.Parse(time.RFC3339, info.ReleaseDate)
+		if err != nil {
+			problems = append(problems, "release date "+info.ReleaseDate+" is not in ISO 8601 format")
+		}
+	}
+
+	artifacts := make(map[string]string)
+	for _, file := range files {
+		if !strings.HasSuffix(file, ".blockmap") {
+			artifacts[filepath.Base(file)] = file
+		}
+	}
+
+	listed := make(map[string]*UpdateFileInfo)
+	for index := range info.Files {
+		item := &info.Files[index]
+		name := getUpdateFileName(item.Url)
+		listed[name] = item
+
+		file, ok := artifacts[name]
+		if !ok {
+			problems = append(problems, item.Url+": artifact not found")
+			continue
+		}
+
+		actual, err := createUpdateFileInfo(file)
+		if err != nil {
+			return nil, err
+		}
+		if actual.Size != item.Size {
+			problems = append(problems, item.Url+": size "+strconv.FormatInt(item.Size, 10)+" doesn't match artifact size "+strconv.FormatInt(actual.Size, 10))
+		}
+		if actual.Sha512 != item.Sha512 {
+			problems = append(problems, item.Url+": sha512 doesn't match artifact")
+		}
+		if actual.BlockMapSize != item.BlockMapSize {
+			problems = append(problems, item.Url+": block map size "+strconv.FormatInt(item.BlockMapSize, 10)+" doesn't match appended block map size "+strconv.FormatInt(actual.BlockMapSize, 10))
+		}
+	}
+
+	for name := range artifacts {
+		if listed[name] == nil {
+			problems = append(problems, name+": artifact is not listed")
+		}
+	}
+
+	// legacy fields must point to the listed file
+	if len(info.Path) != 0 {
+		item := listed[getUpdateFileName(info.Path)]
+		if item == nil {
+			problems = append(problems, "path "+info.Path+" is not listed in files")
+		} else if info.Sha512 != item.Sha512 {
+			problems = append(problems, "sha512 doesn't match sha512 of "+info.Path)
+		}
+	}
+
+	sort.Strings(problems)
+	return problems, nil
+}
+
+// url is relative to the update info file, may be escaped
+func getUpdateFileName(fileUrl string) string {
+	name, err := url.PathUnescape(path.Base(fileUrl))
+	if err != nil {
+		return path.Base(fileUrl)
+	}
+	return name
+}
@@ -0,0 +1,67 @@
+package publisher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/blockmap"
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+)
+
+func TestGenerateAndValidateUpdateInfo(t *testing.T) {
+	log.InitLogger()
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "update-info")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	appImage := filepath.Join(dir, "App-1.0.0.AppImage")
+	g.Expect(ioutil.WriteFile(appImage, []byte(strings.Repeat("hello world. ", 4096)), 0755)).To(Succeed())
+	blockMapInfo, err := blockmap.BuildBlockMap(appImage, blockmap.DefaultChunkerConfiguration, blockmap.DEFLATE, "")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	archive := filepath.Join(dir, "App-1.0.0.tar.gz")
+	g.Expect(ioutil.WriteFile(archive, []byte("archive"), 0644)).To(Succeed())
+	archiveBlockMap := archive + ".blockmap"
+	g.Expect(ioutil.WriteFile(archiveBlockMap, []byte("blockmap"), 0644)).To(Succeed())
+
+	files := []string{appImage, archive, archiveBlockMap}
+	result, err := GenerateUpdateInfo(&UpdateInfoOptions{Files: files, Version: "1.0.0", Channel: "beta", Platform: "linux", Arch: "arm64", StagingPercentage: 10})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.File).To(Equal(filepath.Join(dir, "beta-linux-arm64.yml")))
+
+	info, err := ReadUpdateInfo(result.File)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(info.Files).To(HaveLen(2))
+	g.Expect(info.Files[0].BlockMapSize).To(Equal(int64(*blockMapInfo.BlockMapSize)))
+	g.Expect(info.Files[0].Size).To(Equal(int64(blockMapInfo.Size)))
+	g.Expect(info.Files[0].Sha512).To(Equal(blockMapInfo.Sha512))
+	g.Expect(info.Files[1].BlockMapSize).To(BeZero())
+	g.Expect(*info.StagingPercentage).To(Equal(10))
+
+	problems, err := ValidateUpdateInfo(info, files, "1.0.0")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(problems).To(BeEmpty())
+
+	// artifact is rebuilt after update info generation
+	g.Expect(ioutil.WriteFile(archive, []byte("rebuilt archive"), 0644)).To(Succeed())
+	info.Path = "App-1.0.0.deb"
+	problems, err = ValidateUpdateInfo(info, append(files, filepath.Join(dir, "App-1.0.0.snap")), "1.0.1")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(problems).To(Equal([]string{
+		"App-1.0.0.snap: artifact is not listed",
+		"App-1.0.0.tar.gz: sha512 doesn't match artifact",
+		"App-1.0.0.tar.gz: size 7 doesn't match artifact size 15",
+		"path App-1.0.0.deb is not listed in files",
+		"version 1.0.0 doesn't match expected 1.0.1",
+	}))
+
+	g.Expect(info.SetStagingPercentage(100)).To(Succeed())
+	g.Expect(info.StagingPercentage).To(BeNil())
+	g.Expect(info.SetStagingPercentage(101)).NotTo(Succeed())
+}
@@ -0,0 +1,156 @@
+package publisher
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"go.uber.org/zap"
+)
+
+type VerificationOptions struct {
+	files []string
+	// each file is fetched from every base URL (region endpoint or CDN edge) as base URL + "/" + file name
+	baseUrls []string
+	// replication is eventually consistent, so, mismatch is retried until timeout
+	timeout       time.Duration
+	retryInterval time.Duration
+}
+
+// Catch partial or inconsistent uploads before users do - published files are fetched from the verification URLs and compared with local ones.
+func ConfigureVerifyPublishCommand(app *kingpin.Application) {
+	command := app.Command("verify-publish", "Verify that published files are replicated - fetch from each base URL and compare sha512 with the local files.")
+
+	options := &VerificationOptions{retryInterval: 5 * time.Second}
+	command.Flag("file", "The published file.").Short('f').Required().ExistingFilesVar(&options.files)
+	command.Flag("base-url", "The base URL to fetch published files from (e.g. region endpoint or CDN edge).").Short('u').Required().StringsVar(&options.baseUrls)
+	command.Flag("timeout", "How long to wait for replication.").Default("2m").DurationVar(&options.timeout)
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		return VerifyPublish(options)
+	})
+}
+
+func VerifyPublish(options *VerificationOptions) error {
+	expectedHashes := make([]string, len(options.files))
+	err := util.MapAsync(len(options.files), func(taskIndex int) (func() error, error) {
+		return func() error {
+			hash, err := hashFile(options.files[taskIndex])
+			expectedHashes[taskIndex] = hash
+			return err
+		}, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	requestContext, cancel := util.CreateContextWithTimeout(options.timeout)
+	defer cancel()
+
+	httpClient := createHttpClient()
+	var mutex sync.Mutex
+	var mismatches []string
+	taskCount := len(options.files) * len(options.baseUrls)
+	err = util.MapAsync(taskCount, func(taskIndex int) (func() error, error) {
+		fileIndex := taskIndex % len(options.files)
+		url := strings.TrimSuffix(options.baseUrls[taskIndex/len(options.files)], "/") + "/" + filepath.Base(options.files[fileIndex])
+		return func() error {
+			mismatch := waitForReplication(requestContext, httpClient, url, expectedHashes[fileIndex], options.retryInterval)
+			if mismatch != "" {
+				mutex.Lock()
+				mismatches = append(mismatches, mismatch)
+				mutex.Unlock()
+			}
+			return nil
+		}, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(mismatches) != 0 {
+		sort.Strings(mismatches)
+		return util.NewMessageError("published files are not replicated:\n  "+strings.Join(mismatches, "\n  "), "ERR_PUBLISH_VERIFICATION_FAILED")
+	}
+	return nil
+}
+
+// returns description of mismatch or empty string if the published file matches
+// (the last mismatch is reported if the request is cancelled by timeout, not the cancellation error)
+func waitForReplication(requestContext context.Context, httpClient *http.Client, url string, expectedHash string, retryInterval time.Duration) string {
+	var lastMismatch string
+	for {
+		actualHash, err := hashUrl(requestContext, httpClient, url)
+		var mismatch string
+		switch {
+		case err != nil && requestContext.Err() != nil && lastMismatch != "":
+			return lastMismatch
+		case err != nil:
+			mismatch = url + ": " + err.Error()
+		case actualHash != expectedHash:
+			mismatch = url + ": sha512 mismatch (expected " + expectedHash[:16] + "..., got " + actualHash[:16] + "...)"
+		default:
+			return ""
+		}
+
+		lastMismatch = mismatch
+		log.Debug("published file doesn't match, retry", zap.String("mismatch", mismatch))
+		select {
+		case <-requestContext.Done():
+			return mismatch
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+func hashUrl(requestContext context.Context, httpClient *http.Client, url string) (string, error) {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	response, err := httpClient.Do(request.WithContext(requestContext))
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer util.Close(response.Body)
+
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", response.Status)
+	}
+
+	hash := sha512.New()
+	_, err = io.Copy(hash, response.Body)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func hashFile(file string) (string, error) {
+	reader, err := os.Open(file)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer util.Close(reader)
+
+	hash := sha512.New()
+	_, err = io.Copy(hash, reader)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
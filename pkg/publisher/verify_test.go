@@ -0,0 +1,59 @@
+package publisher
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	. "github.com/onsi/gomega"
+)
+
+func TestVerifyPublish(t *testing.T) {
+	log.InitLogger()
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "verify")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "latest.yml")
+	g.Expect(ioutil.WriteFile(file, []byte("version: 2.0.0\n"), 0644)).To(Succeed())
+
+	// the second region is replicated only after the first request
+	var requestCount int32
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/us/latest.yml":
+			_, _ = writer.Write([]byte("version: 2.0.0\n"))
+		case "/eu/latest.yml":
+			if atomic.AddInt32(&requestCount, 1) == 1 {
+				_, _ = writer.Write([]byte("version: 1.0.0\n"))
+			} else {
+				_, _ = writer.Write([]byte("version: 2.0.0\n"))
+			}
+		default:
+			writer.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	options := &VerificationOptions{files: []string{file}, baseUrls: []string{server.URL + "/us", server.URL + "/eu/"}, timeout: 10 * time.Second, retryInterval: 10 * time.Millisecond}
+	g.Expect(VerifyPublish(options)).To(Succeed())
+	g.Expect(atomic.LoadInt32(&requestCount)).To(BeNumerically("==", 2))
+
+	options.baseUrls = []string{server.URL + "/asia"}
+	// enough for the first request, the last mismatch is reported on timeout
+	options.timeout = time.Second
+	err = VerifyPublish(options)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.(util.MessageError).ErrorCode()).To(Equal("ERR_PUBLISH_VERIFICATION_FAILED"))
+	g.Expect(err.Error()).To(ContainSubstring("/asia/latest.yml: unexpected status 404"))
+	g.Expect(err.Error()).NotTo(ContainSubstring("context deadline exceeded"))
+}
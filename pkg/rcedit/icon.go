@@ -0,0 +1,105 @@
+package rcedit
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+)
+
+type iconImage struct {
+	// ICONDIR entry without image offset (the first 12 bytes are the same in GRPICONDIR entry)
+	header []byte
+	data   []byte
+}
+
+func readIcoFile(file string) ([]*iconImage, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	invalid := func(message string) error {
+		return util.NewMessageError("cannot set icon "+file+": "+message, "ERR_RCEDIT_INVALID_ICON")
+	}
+	if len(data) < 6 || binary.LittleEndian.Uint16(data) != 0 || binary.LittleEndian.Uint16(data[2:]) != 1 {
+		return nil, invalid("not an .ico file")
+	}
+
+	count := int(binary.LittleEndian.Uint16(data[4:]))
+	if count == 0 {
+		return nil, invalid("no images")
+	}
+	if 6+count*16 > len(data) {
+		return nil, invalid("icon directory is truncated")
+	}
+
+	result := make([]*iconImage, 0, count)
+	for i := 0; i < count; i++ {
+		entry := data[6+i*16:]
+		size := binary.LittleEndian.Uint32(entry[8:])
+		offset := binary.LittleEndian.Uint32(entry[12:])
+		if uint64(offset)+uint64(size) > uint64(len(data)) {
+			return nil, invalid("image data is truncated")
+		}
+		result = append(result, &iconImage{header: entry[:12], data: data[offset : offset+size]})
+	}
+	return result, nil
+}
+
+// setIcon replaces the first icon group (the app icon) and icons referenced by it. Icon IDs not used by other groups are reused.
+func setIcon(resources *resourceSet, images []*iconImage) {
+	groupName := resourceId{id: 1}
+	language := uint16(defaultLanguage)
+	groups := resources.find(rtGroupIcon)
+	if len(groups) != 0 {
+		group := groups[0]
+		groupName, language = group.nameId, group.language
+		for _, id := range getGroupIconIds(group.data) {
+			for _, icon := range resources.find(rtIcon) {
+				if !icon.nameId.isName() && icon.nameId.id == id && icon.language == group.language {
+					resources.remove(icon)
+				}
+			}
+		}
+		resources.remove(group)
+	}
+
+	usedIds := make(map[uint16]bool)
+	for _, icon := range resources.find(rtIcon) {
+		if !icon.nameId.isName() {
+			usedIds[icon.nameId.id] = true
+		}
+	}
+
+	group := make([]byte, 6, 6+len(images)*14)
+	binary.LittleEndian.PutUint16(group[2:], 1)
+	binary.LittleEndian.PutUint16(group[4:], uint16(len(images)))
+	nextId := uint16(1)
+	for _, image := range images {
+		for usedIds[nextId] {
+			nextId++
+		}
+		usedIds[nextId] = true
+
+		resources.set(&resource{typeId: resourceId{id: rtIcon}, nameId: resourceId{id: nextId}, language: language, data: image.data})
+		entry := make([]byte, 14)
+		copy(entry, image.header)
+		binary.LittleEndian.PutUint16(entry[12:], nextId)
+		group = append(group, entry...)
+	}
+	resources.set(&resource{typeId: resourceId{id: rtGroupIcon}, nameId: groupName, language: language, data: group})
+}
+
+func getGroupIconIds(data []byte) []uint16 {
+	if len(data) < 6 {
+		return nil
+	}
+	count := int(binary.LittleEndian.Uint16(data[4:]))
+	var result []uint16
+	for i := 0; i < count && 6+i*14+14 <= len(data); i++ {
+		result = append(result, binary.LittleEndian.Uint16(data[6+i*14+12:]))
+	}
+	return result
+}
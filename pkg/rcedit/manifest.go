@@ -0,0 +1,77 @@
+package rcedit
+
+import (
+	"regexp"
+	"strings"
+)
+
+const defaultManifest = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<assembly xmlns="urn:schemas-microsoft-com:asm.v1" manifestVersion="1.0">
+</assembly>
+`
+
+var (
+	executionLevelRegExp      = regexp.MustCompile(`(<(?:\w+:)?requestedExecutionLevel\b[^>]*?\blevel\s*=\s*)(["'])[^"']*(["'])`)
+	assemblyEndRegExp         = regexp.MustCompile(`</(?:\w+:)?assembly>`)
+	windowsSettingsEndRegExp  = regexp.MustCompile(`</(?:\w+:)?windowsSettings>`)
+	windowsSettingsNamespaces = map[string]string{
+		"dpiAware":     "http://schemas.microsoft.com/SMI/2005/WindowsSettings",
+		"dpiAwareness": "http://schemas.microsoft.com/SMI/2016/WindowsSettings",
+	}
+)
+
+// dpiAware (Windows Vista+) and dpiAwareness (Windows 10 1607+, dpiAware is ignored if specified) values
+var dpiAwarenessValues = map[string][2]string{
+	"unaware":      {"false", "unaware"},
+	"system":       {"true", "system"},
+	"permonitor":   {"true/pm", "permonitor"},
+	"permonitorv2": {"true/pm", "permonitorv2,permonitor"},
+}
+
+func setRequestedExecutionLevel(manifest string, level string) string {
+	if executionLevelRegExp.MatchString(manifest) {
+		return executionLevelRegExp.ReplaceAllString(manifest, "${1}${2}"+level+"${3}")
+	}
+	return insertBeforeAssemblyEnd(manifest, `  <trustInfo xmlns="urn:schemas-microsoft-com:asm.v3">
+    <security>
+      <requestedPrivileges>
+        <requestedExecutionLevel level="`+level+`" uiAccess="false"/>
+      </requestedPrivileges>
+    </security>
+  </trustInfo>
+`)
+}
+
+func setDpiAwareness(manifest string, awareness string) string {
+	values := dpiAwarenessValues[awareness]
+	var missing []string
+	for index, name := range []string{"dpiAware", "dpiAwareness"} {
+		element := regexp.MustCompile(`(<(?:\w+:)?` + name + `\b[^>]*>)[^<]*(</(?:\w+:)?` + name + `>)`)
+		if element.MatchString(manifest) {
+			manifest = element.ReplaceAllString(manifest, "${1}"+values[index]+"${2}")
+		} else {
+			missing = append(missing, `<`+name+` xmlns="`+windowsSettingsNamespaces[name]+`">`+values[index]+`</`+name+`>`)
+		}
+	}
+	if len(missing) == 0 {
+		return manifest
+	}
+
+	if location := windowsSettingsEndRegExp.FindStringIndex(manifest); location != nil {
+		return manifest[:location[0]] + "  " + strings.Join(missing, "\n      ") + "\n    " + manifest[location[0]:]
+	}
+	return insertBeforeAssemblyEnd(manifest, `  <application xmlns="urn:schemas-microsoft-com:asm.v3">
+    <windowsSettings>
+      `+strings.Join(missing, "\n      ")+`
+    </windowsSettings>
+  </application>
+`)
+}
+
+func insertBeforeAssemblyEnd(manifest string, data string) string {
+	location := assemblyEndRegExp.FindStringIndex(manifest)
+	if location == nil {
+		return manifest
+	}
+	return manifest[:location[0]] + data + manifest[location[0]:]
+}
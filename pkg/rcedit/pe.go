@@ -0,0 +1,287 @@
+package rcedit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+
+	"github.com/develar/app-builder/pkg/codesign"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+)
+
+const (
+	directoryEntryResource  = 2
+	directoryEntrySecurity  = 4
+	directoryEntryBaseReloc = 5
+
+	sectionHeaderSize = 40
+
+	imageScnCntInitializedData = 0x00000040
+)
+
+type peSection struct {
+	headerOffset int
+
+	name            string
+	virtualSize     uint32
+	virtualAddress  uint32
+	sizeOfRawData   uint32
+	rawDataPointer  uint32
+	characteristics uint32
+}
+
+type peFile struct {
+	data []byte
+
+	optionalHeaderOffset int
+	directoriesOffset    int
+	numberOfDirectories  int
+	sectionAlignment     uint32
+	fileAlignment        uint32
+
+	sections []*peSection
+}
+
+func unsupportedPe(message string) error {
+	return util.NewMessageError("cannot edit resources: "+message, "ERR_RCEDIT_UNSUPPORTED_FILE")
+}
+
+func parsePe(data []byte) (*peFile, error) {
+	if len(data) < 64 || data[0] != 'M' || data[1] != 'Z' {
+		return nil, unsupportedPe("not a PE file (MZ signature is not found)")
+	}
+
+	peOffset := int(binary.LittleEndian.Uint32(data[0x3c:]))
+	if peOffset+24 > len(data) || string(data[peOffset:peOffset+4]) != "PE\x00\x00" {
+		return nil, unsupportedPe("not a PE file (PE signature is not found)")
+	}
+
+	numberOfSections := int(binary.LittleEndian.Uint16(data[peOffset+6:]))
+	sizeOfOptionalHeader := int(binary.LittleEndian.Uint16(data[peOffset+20:]))
+	result := &peFile{data: data, optionalHeaderOffset: peOffset + 24}
+
+	optionalHeader := result.optionalHeaderOffset
+	if optionalHeader+sizeOfOptionalHeader+numberOfSections*sectionHeaderSize > len(data) {
+		return nil, unsupportedPe("PE headers are truncated")
+	}
+
+	var numberOfDirectoriesOffset int
+	switch binary.LittleEndian.Uint16(data[optionalHeader:]) {
+	case 0x10b:
+		numberOfDirectoriesOffset = optionalHeader + 92
+	case 0x20b:
+		numberOfDirectoriesOffset = optionalHeader + 108
+	default:
+		return nil, unsupportedPe("unsupported PE optional header")
+	}
+	result.directoriesOffset = numberOfDirectoriesOffset + 4
+	result.numberOfDirectories = int(binary.LittleEndian.Uint32(data[numberOfDirectoriesOffset:]))
+	if result.numberOfDirectories <= directoryEntryBaseReloc {
+		return nil, unsupportedPe("PE file has no resource data directory")
+	}
+	result.sectionAlignment = binary.LittleEndian.Uint32(data[optionalHeader+32:])
+	result.fileAlignment = binary.LittleEndian.Uint32(data[optionalHeader+36:])
+
+	sectionsOffset := optionalHeader + sizeOfOptionalHeader
+	for i := 0; i < numberOfSections; i++ {
+		header := data[sectionsOffset+i*sectionHeaderSize:]
+		result.sections = append(result.sections, &peSection{
+			headerOffset:    sectionsOffset + i*sectionHeaderSize,
+			name:            strings.TrimRight(string(header[:8]), "\x00"),
+			virtualSize:     binary.LittleEndian.Uint32(header[8:]),
+			virtualAddress:  binary.LittleEndian.Uint32(header[12:]),
+			sizeOfRawData:   binary.LittleEndian.Uint32(header[16:]),
+			rawDataPointer:  binary.LittleEndian.Uint32(header[20:]),
+			characteristics: binary.LittleEndian.Uint32(header[36:]),
+		})
+	}
+	return result, nil
+}
+
+func (t *peFile) getDirectory(index int) (uint32, uint32) {
+	offset := t.directoriesOffset + index*8
+	return binary.LittleEndian.Uint32(t.data[offset:]), binary.LittleEndian.Uint32(t.data[offset+4:])
+}
+
+func (t *peFile) setDirectory(index int, address uint32, size uint32) {
+	offset := t.directoriesOffset + index*8
+	binary.LittleEndian.PutUint32(t.data[offset:], address)
+	binary.LittleEndian.PutUint32(t.data[offset+4:], size)
+}
+
+func (t *peFile) findSection(rva uint32) *peSection {
+	for _, section := range t.sections {
+		size := section.virtualSize
+		if size == 0 {
+			size = section.sizeOfRawData
+		}
+		if rva >= section.virtualAddress && rva < section.virtualAddress+size {
+			return section
+		}
+	}
+	return nil
+}
+
+// readRva returns data of the given RVA (resource data can be located in any section, not only in .rsrc)
+func (t *peFile) readRva(rva uint32, size uint32) ([]byte, error) {
+	section := t.findSection(rva)
+	if section == nil {
+		return nil, errors.Errorf("RVA %#x is not mapped to any section", rva)
+	}
+
+	offset := uint64(section.rawDataPointer) + uint64(rva-section.virtualAddress)
+	if offset+uint64(size) > uint64(section.rawDataPointer)+uint64(section.sizeOfRawData) || offset+uint64(size) > uint64(len(t.data)) {
+		return nil, errors.Errorf("data at RVA %#x (size %d) is out of section %s", rva, size, section.name)
+	}
+	return t.data[offset : offset+uint64(size)], nil
+}
+
+func (t *peFile) readResources() (*resourceSet, error) {
+	rva, size := t.getDirectory(directoryEntryResource)
+	if rva == 0 || size == 0 {
+		return &resourceSet{}, nil
+	}
+	return parseResources(t, rva)
+}
+
+// replaceResources returns new file data with the resource section replaced.
+// Resource section is resized in place, sections after it are moved (only .reloc is allowed there because its data doesn't depend on own address).
+// Signature is removed (it is invalidated by the change anyway), overlay data (e.g. NSIS installer data) is preserved.
+func (t *peFile) replaceResources(resources *resourceSet) ([]byte, error) {
+	rva, _ := t.getDirectory(directoryEntryResource)
+	var rsrc *peSection
+	if rva != 0 {
+		rsrc = t.findSection(rva)
+		if rsrc == nil || rsrc.virtualAddress != rva {
+			return nil, unsupportedPe("resource directory is not located at the start of a section")
+		}
+	} else {
+		for _, section := range t.sections {
+			if section.name == ".rsrc" {
+				rsrc = section
+				break
+			}
+		}
+		if rsrc == nil {
+			return nil, unsupportedPe("PE file has no resource section")
+		}
+	}
+
+	var moved []*peSection
+	fileEnd := uint32(0)
+	for _, section := range t.sections {
+		if section.virtualAddress > rsrc.virtualAddress {
+			if section.name != ".reloc" {
+				return nil, unsupportedPe("section " + section.name + " is located after the resource section")
+			}
+			moved = append(moved, section)
+		}
+		if end := section.rawDataPointer + section.sizeOfRawData; end > fileEnd {
+			fileEnd = end
+		}
+	}
+	for _, section := range t.sections {
+		if section.sizeOfRawData != 0 && section.rawDataPointer > rsrc.rawDataPointer && section.virtualAddress < rsrc.virtualAddress {
+			return nil, unsupportedPe("data of section " + section.name + " is located after data of the resource section")
+		}
+	}
+
+	// the certificate table is located at the end of the file after the overlay
+	contentEnd := uint32(len(t.data))
+	certificateOffset, certificateSize := t.getDirectory(directoryEntrySecurity)
+	if certificateSize != 0 && certificateOffset < contentEnd {
+		contentEnd = certificateOffset
+	}
+	var overlay []byte
+	if contentEnd > fileEnd {
+		overlay = t.data[fileEnd:contentEnd]
+	}
+
+	rsrcData := resources.build(rsrc.virtualAddress)
+	result := make([]byte, rsrc.rawDataPointer, int(rsrc.rawDataPointer)+len(rsrcData)+len(overlay)+64*1024)
+	copy(result, t.data[:rsrc.rawDataPointer])
+	result = append(result, rsrcData...)
+	result = padTo(result, t.fileAlignment)
+
+	rsrc.virtualSize = uint32(len(rsrcData))
+	rsrc.sizeOfRawData = uint32(len(result)) - rsrc.rawDataPointer
+	virtualEnd := alignUp(rsrc.virtualAddress+rsrc.virtualSize, t.sectionAlignment)
+
+	baseRelocRva, baseRelocSize := t.getDirectory(directoryEntryBaseReloc)
+	for _, section := range moved {
+		oldAddress := section.virtualAddress
+		raw, err := t.readRaw(section)
+		if err != nil {
+			return nil, err
+		}
+
+		section.virtualAddress = virtualEnd
+		section.rawDataPointer = uint32(len(result))
+		result = padTo(append(result, raw...), t.fileAlignment)
+		section.sizeOfRawData = uint32(len(result)) - section.rawDataPointer
+		virtualEnd = alignUp(section.virtualAddress+section.virtualSize, t.sectionAlignment)
+
+		if baseRelocRva >= oldAddress && baseRelocRva < oldAddress+section.virtualSize {
+			baseRelocRva = baseRelocRva - oldAddress + section.virtualAddress
+		}
+	}
+	result = append(result, overlay...)
+
+	t.data = result
+	t.setDirectory(directoryEntryResource, rsrc.virtualAddress, rsrc.virtualSize)
+	t.setDirectory(directoryEntrySecurity, 0, 0)
+	if baseRelocSize != 0 {
+		t.setDirectory(directoryEntryBaseReloc, baseRelocRva, baseRelocSize)
+	}
+
+	sizeOfInitializedData := uint32(0)
+	for _, section := range t.sections {
+		header := result[section.headerOffset:]
+		binary.LittleEndian.PutUint32(header[8:], section.virtualSize)
+		binary.LittleEndian.PutUint32(header[12:], section.virtualAddress)
+		binary.LittleEndian.PutUint32(header[16:], section.sizeOfRawData)
+		binary.LittleEndian.PutUint32(header[20:], section.rawDataPointer)
+		if section.characteristics&imageScnCntInitializedData != 0 {
+			sizeOfInitializedData += section.sizeOfRawData
+		}
+	}
+
+	optionalHeader := result[t.optionalHeaderOffset:]
+	binary.LittleEndian.PutUint32(optionalHeader[8:], sizeOfInitializedData)
+	sizeOfImage := uint32(0)
+	for _, section := range t.sections {
+		if end := alignUp(section.virtualAddress+section.virtualSize, t.sectionAlignment); end > sizeOfImage {
+			sizeOfImage = end
+		}
+	}
+	binary.LittleEndian.PutUint32(optionalHeader[56:], sizeOfImage)
+
+	checksumOffset := t.optionalHeaderOffset + 64
+	checksum, err := codesign.ComputePeChecksum(bytes.NewReader(result), int64(checksumOffset))
+	if err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint32(result[checksumOffset:], checksum)
+	return result, nil
+}
+
+func (t *peFile) readRaw(section *peSection) ([]byte, error) {
+	end := uint64(section.rawDataPointer) + uint64(section.sizeOfRawData)
+	if end > uint64(len(t.data)) {
+		return nil, unsupportedPe("data of section " + section.name + " is truncated")
+	}
+	return t.data[section.rawDataPointer:end], nil
+}
+
+func alignUp(value uint32, alignment uint32) uint32 {
+	if alignment == 0 {
+		return value
+	}
+	return (value + alignment - 1) / alignment * alignment
+}
+
+func padTo(data []byte, alignment uint32) []byte {
+	size := alignUp(uint32(len(data)), alignment)
+	return append(data, make([]byte, int(size)-len(data))...)
+}
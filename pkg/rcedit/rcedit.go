@@ -1,19 +1,44 @@
 package rcedit
 
 import (
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sort"
 
 	"github.com/alecthomas/kingpin"
 	"github.com/develar/app-builder/pkg/download"
+	"github.com/develar/app-builder/pkg/log"
 	"github.com/develar/app-builder/pkg/util"
 	"github.com/develar/app-builder/pkg/wine"
+	"github.com/develar/errors"
+	"go.uber.org/zap"
 )
 
+// Options of in-process resource editing (the same as rcedit options)
+type Options struct {
+	File string
+
+	// FileDescription, ProductName, CompanyName, LegalCopyright, LegalTrademarks, OriginalFilename, InternalName and so on
+	VersionStrings map[string]string
+	FileVersion    string
+	ProductVersion string
+
+	// .ico file to replace the app icon with
+	Icon string
+
+	// manifest to replace the existing one with, other manifest options are applied to it
+	ManifestFile string
+	// asInvoker, highestAvailable or requireAdministrator
+	RequestedExecutionLevel string
+	// unaware, system, permonitor or permonitorv2
+	DpiAwareness string
+}
+
 func ConfigureCommand(app *kingpin.Application) {
-	command := app.Command("rcedit", "")
+	command := app.Command("rcedit", "Edit resources of Windows executable (rcedit arguments). Supported arguments are applied in-process, Wine is not required.")
 	configuration := command.Flag("args", "").Required().String()
 
 	command.Action(func(context *kingpin.ParseContext) error {
@@ -22,10 +47,226 @@ func ConfigureCommand(app *kingpin.Application) {
 		if err != nil {
 			return err
 		}
+
+		options, err := parseRcEditArgs(rcEditArgs)
+		if err != nil {
+			return err
+		}
+		if options != nil {
+			return EditResources(options)
+		}
 		return editResources(rcEditArgs)
 	})
 }
 
+// parseRcEditArgs returns nil if args are not supported by in-process editing (e.g. --set-resource-string), rcedit is used in this case
+func parseRcEditArgs(args []string) (*Options, error) {
+	if len(args) < 2 {
+		return nil, nil
+	}
+
+	options := &Options{File: args[0], VersionStrings: make(map[string]string)}
+	for i := 1; i < len(args); {
+		name := args[i]
+		valueCount := 1
+		if name == "--set-version-string" {
+			valueCount = 2
+		}
+		if i+valueCount >= len(args) {
+			return nil, util.NewMessageError("value of rcedit argument "+name+" is not specified", "ERR_RCEDIT_INVALID_ARGS")
+		}
+
+		value := args[i+1]
+		switch name {
+		case "--set-version-string":
+			options.VersionStrings[value] = args[i+2]
+		case "--set-file-version":
+			options.FileVersion = value
+		case "--set-product-version":
+			options.ProductVersion = value
+		case "--set-icon":
+			options.Icon = value
+		case "--application-manifest":
+			options.ManifestFile = value
+		case "--set-requested-execution-level":
+			options.RequestedExecutionLevel = value
+		case "--set-dpi-awareness":
+			options.DpiAwareness = value
+		default:
+			return nil, nil
+		}
+		i += 1 + valueCount
+	}
+	return options, nil
+}
+
+// EditResources applies changes to the resource section of PE file. Signature of the file is removed (it becomes invalid anyway).
+func EditResources(options *Options) error {
+	err := validateOptions(options)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(options.File)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	data, err := ioutil.ReadFile(options.File)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	file, err := parsePe(data)
+	if err != nil {
+		return errors.WithMessage(err, options.File)
+	}
+	resources, err := file.readResources()
+	if err != nil {
+		return errors.WithMessage(err, options.File)
+	}
+
+	err = applyOptions(resources, options)
+	if err != nil {
+		return err
+	}
+
+	result, err := file.replaceResources(resources)
+	if err != nil {
+		return errors.WithMessage(err, options.File)
+	}
+
+	// write to temp file and rename, so, the file is not corrupted if write fails
+	tempFile := options.File + ".rcedit"
+	err = ioutil.WriteFile(tempFile, result, info.Mode())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = os.Rename(tempFile, options.File)
+	if err != nil {
+		_ = os.Remove(tempFile)
+		return errors.WithStack(err)
+	}
+
+	log.Debug("resources edited", zap.String("file", options.File), zap.Int("size", len(result)))
+	return nil
+}
+
+func validateOptions(options *Options) error {
+	switch options.RequestedExecutionLevel {
+	case "", "asInvoker", "highestAvailable", "requireAdministrator":
+	default:
+		return util.NewMessageError("invalid requested execution level "+options.RequestedExecutionLevel+" (expected asInvoker, highestAvailable or requireAdministrator)", "ERR_RCEDIT_INVALID_ARGS")
+	}
+	if _, ok := dpiAwarenessValues[options.DpiAwareness]; options.DpiAwareness != "" && !ok {
+		return util.NewMessageError("invalid DPI awareness "+options.DpiAwareness+" (expected unaware, system, permonitor or permonitorv2)", "ERR_RCEDIT_INVALID_ARGS")
+	}
+	for _, version := range []string{options.FileVersion, options.ProductVersion} {
+		if version == "" {
+			continue
+		}
+		if _, err := parseVersion(version); err != nil {
+			return util.NewMessageError(err.Error(), "ERR_RCEDIT_INVALID_ARGS")
+		}
+	}
+	return nil
+}
+
+func applyOptions(resources *resourceSet, options *Options) error {
+	if len(options.VersionStrings) != 0 || options.FileVersion != "" || options.ProductVersion != "" {
+		err := updateVersionInfo(resources, options)
+		if err != nil {
+			return err
+		}
+	}
+
+	if options.Icon != "" {
+		images, err := readIcoFile(options.Icon)
+		if err != nil {
+			return err
+		}
+		setIcon(resources, images)
+	}
+
+	if options.ManifestFile != "" || options.RequestedExecutionLevel != "" || options.DpiAwareness != "" {
+		err := updateManifest(resources, options)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func updateVersionInfo(resources *resourceSet, options *Options) error {
+	existing := resources.find(rtVersion)
+	if len(existing) == 0 {
+		existing = []*resource{{typeId: resourceId{id: rtVersion}, nameId: resourceId{id: 1}, language: defaultLanguage}}
+	}
+
+	keys := make([]string, 0, len(options.VersionStrings))
+	for key := range options.VersionStrings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// version info of every language is updated
+	for _, item := range existing {
+		var info *versionNode
+		if item.data == nil {
+			info = newVersionInfo()
+		} else {
+			var err error
+			info, err = parseVersionInfo(item.data)
+			if err != nil {
+				return util.NewMessageError(options.File+": "+err.Error(), "ERR_RCEDIT_UNSUPPORTED_FILE")
+			}
+		}
+
+		if options.FileVersion != "" {
+			version, _ := parseVersion(options.FileVersion)
+			info.setFixedVersion(0, version)
+			info.setString("FileVersion", options.FileVersion)
+		}
+		if options.ProductVersion != "" {
+			version, _ := parseVersion(options.ProductVersion)
+			info.setFixedVersion(1, version)
+			info.setString("ProductVersion", options.ProductVersion)
+		}
+		for _, key := range keys {
+			info.setString(key, options.VersionStrings[key])
+		}
+
+		resources.set(&resource{typeId: item.typeId, nameId: item.nameId, language: item.language, codePage: item.codePage, data: info.encode()})
+	}
+	return nil
+}
+
+func updateManifest(resources *resourceSet, options *Options) error {
+	var item *resource
+	if existing := resources.find(rtManifest); len(existing) != 0 {
+		item = existing[0]
+	} else {
+		item = &resource{typeId: resourceId{id: rtManifest}, nameId: resourceId{id: 1}, language: defaultLanguage, data: []byte(defaultManifest)}
+	}
+
+	manifest := string(item.data)
+	if options.ManifestFile != "" {
+		data, err := ioutil.ReadFile(options.ManifestFile)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		manifest = string(data)
+	}
+	if options.RequestedExecutionLevel != "" {
+		manifest = setRequestedExecutionLevel(manifest, options.RequestedExecutionLevel)
+	}
+	if options.DpiAwareness != "" {
+		manifest = setDpiAwareness(manifest, options.DpiAwareness)
+	}
+
+	resources.set(&resource{typeId: item.typeId, nameId: item.nameId, language: item.language, codePage: item.codePage, data: []byte(manifest)})
+	return nil
+}
+
 func editResources(args []string) error {
 	winCodeSignPath, err := download.DownloadWinCodeSign()
 	if err != nil {
@@ -0,0 +1,199 @@
+package rcedit
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+)
+
+const testManifest = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<assembly xmlns="urn:schemas-microsoft-com:asm.v1" manifestVersion="1.0">
+  <trustInfo xmlns="urn:schemas-microsoft-com:asm.v3">
+    <security>
+      <requestedPrivileges>
+        <requestedExecutionLevel level="asInvoker" uiAccess="false"/>
+      </requestedPrivileges>
+    </security>
+  </trustInfo>
+</assembly>
+`
+
+var testRelocations = []byte{0, 0x10, 0, 0, 12, 0, 0, 0, 0x10, 0xa0, 0, 0}
+
+// writeTestExe writes PE32+ file with .text, .rsrc and .reloc sections, overlay and fake certificate table
+func writeTestExe(g *GomegaWithT, file string, resources *resourceSet) {
+	rsrc := resources.build(0x2000)
+	rsrcRawSize := alignUp(uint32(len(rsrc)), 0x200)
+	relocAddress := alignUp(0x2000+uint32(len(rsrc)), 0x1000)
+
+	// capacity for overlay and certificate table, so, header slices remain valid after append
+	data := make([]byte, 0x600+rsrcRawSize+0x200, 0x600+rsrcRawSize+0x200+64)
+	binary.LittleEndian.PutUint16(data, 0x5a4d)
+	binary.LittleEndian.PutUint32(data[0x3c:], 64)
+	copy(data[64:], "PE\x00\x00")
+	binary.LittleEndian.PutUint16(data[68:], 0x8664)
+	binary.LittleEndian.PutUint16(data[70:], 3)
+	binary.LittleEndian.PutUint16(data[84:], 240)
+	binary.LittleEndian.PutUint16(data[86:], 0x22)
+
+	optionalHeader := data[88:]
+	binary.LittleEndian.PutUint16(optionalHeader, 0x20b)
+	binary.LittleEndian.PutUint32(optionalHeader[32:], 0x1000)
+	binary.LittleEndian.PutUint32(optionalHeader[36:], 0x200)
+	binary.LittleEndian.PutUint32(optionalHeader[56:], relocAddress+0x1000)
+	binary.LittleEndian.PutUint32(optionalHeader[60:], 0x400)
+	binary.LittleEndian.PutUint32(optionalHeader[108:], 16)
+	binary.LittleEndian.PutUint32(optionalHeader[112+directoryEntryResource*8:], 0x2000)
+	binary.LittleEndian.PutUint32(optionalHeader[112+directoryEntryResource*8+4:], uint32(len(rsrc)))
+	binary.LittleEndian.PutUint32(optionalHeader[112+directoryEntryBaseReloc*8:], relocAddress)
+	binary.LittleEndian.PutUint32(optionalHeader[112+directoryEntryBaseReloc*8+4:], uint32(len(testRelocations)))
+
+	writeSection := func(index int, name string, virtualAddress uint32, virtualSize uint32, rawPointer uint32, rawSize uint32) {
+		header := data[328+index*40:]
+		copy(header, name)
+		binary.LittleEndian.PutUint32(header[8:], virtualSize)
+		binary.LittleEndian.PutUint32(header[12:], virtualAddress)
+		binary.LittleEndian.PutUint32(header[16:], rawSize)
+		binary.LittleEndian.PutUint32(header[20:], rawPointer)
+		binary.LittleEndian.PutUint32(header[36:], imageScnCntInitializedData|0x40000000)
+	}
+	writeSection(0, ".text", 0x1000, 0x200, 0x400, 0x200)
+	copy(data[0x400:], "code")
+	writeSection(1, ".rsrc", 0x2000, uint32(len(rsrc)), 0x600, rsrcRawSize)
+	copy(data[0x600:], rsrc)
+	writeSection(2, ".reloc", relocAddress, uint32(len(testRelocations)), 0x600+rsrcRawSize, 0x200)
+	copy(data[0x600+rsrcRawSize:], testRelocations)
+
+	data = append(data, "OVERLAY"...)
+	certificateOffset := uint32(len(data))
+	data = append(data, 8, 0, 0, 0, 0, 2, 2, 0)
+	binary.LittleEndian.PutUint32(optionalHeader[112+directoryEntrySecurity*8:], certificateOffset)
+	binary.LittleEndian.PutUint32(optionalHeader[112+directoryEntrySecurity*8+4:], 8)
+	g.Expect(ioutil.WriteFile(file, data, 0755)).To(Succeed())
+}
+
+func readTestResources(g *GomegaWithT, file string) *resourceSet {
+	data, err := ioutil.ReadFile(file)
+	g.Expect(err).NotTo(HaveOccurred())
+	peFile, err := parsePe(data)
+	g.Expect(err).NotTo(HaveOccurred())
+	resources, err := peFile.readResources()
+	g.Expect(err).NotTo(HaveOccurred())
+	return resources
+}
+
+func TestEditResources(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "rcedit")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	versionInfo := newVersionInfo()
+	versionInfo.setString("ProductName", "Electron")
+	versionInfo.setString("CompanyName", "GitHub, Inc.")
+	group := make([]byte, 6+2*14)
+	binary.LittleEndian.PutUint16(group[2:], 1)
+	binary.LittleEndian.PutUint16(group[4:], 2)
+	binary.LittleEndian.PutUint16(group[6+12:], 1)
+	binary.LittleEndian.PutUint16(group[6+14+12:], 2)
+	resources := &resourceSet{items: []*resource{
+		{typeId: resourceId{id: rtVersion}, nameId: resourceId{id: 1}, language: defaultLanguage, data: versionInfo.encode()},
+		{typeId: resourceId{id: rtGroupIcon}, nameId: resourceId{name: "IDR_MAINFRAME"}, language: defaultLanguage, data: group},
+		{typeId: resourceId{id: rtIcon}, nameId: resourceId{id: 1}, language: defaultLanguage, data: []byte("old icon 1")},
+		{typeId: resourceId{id: rtIcon}, nameId: resourceId{id: 2}, language: defaultLanguage, data: []byte("old icon 2")},
+		{typeId: resourceId{id: rtIcon}, nameId: resourceId{id: 3}, language: defaultLanguage, data: []byte("other icon")},
+		{typeId: resourceId{id: rtManifest}, nameId: resourceId{id: 1}, language: defaultLanguage, data: []byte(testManifest)},
+	}}
+
+	file := filepath.Join(dir, "app.exe")
+	writeTestExe(g, file, resources)
+
+	options, err := parseRcEditArgs([]string{file, "--set-version-string", "LegalCopyright", "Copyright © 2026 Foo", "--set-version-string", "ProductName", "Foo",
+		"--set-file-version", "1.2.3", "--set-product-version", "1.2.3-beta.4", "--set-icon", filepath.Join("..", "..", "testData", "icon.ico"),
+		"--set-requested-execution-level", "requireAdministrator", "--set-dpi-awareness", "permonitorv2"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(EditResources(options)).To(Succeed())
+
+	// file is still valid PE, .reloc is moved after grown .rsrc
+	peFile, err := pe.Open(file)
+	g.Expect(err).NotTo(HaveOccurred())
+	defer peFile.Close()
+	optionalHeader := peFile.OptionalHeader.(*pe.OptionalHeader64)
+	rsrc := peFile.Section(".rsrc")
+	reloc := peFile.Section(".reloc")
+	g.Expect(optionalHeader.DataDirectory[directoryEntryResource].VirtualAddress).To(Equal(rsrc.VirtualAddress))
+	g.Expect(optionalHeader.DataDirectory[directoryEntrySecurity].Size).To(BeZero())
+	g.Expect(optionalHeader.DataDirectory[directoryEntryBaseReloc].VirtualAddress).To(Equal(reloc.VirtualAddress))
+	g.Expect(reloc.VirtualAddress).To(Equal(alignUp(rsrc.VirtualAddress+rsrc.VirtualSize, 0x1000)))
+	g.Expect(optionalHeader.SizeOfImage).To(Equal(reloc.VirtualAddress + 0x1000))
+	g.Expect(optionalHeader.CheckSum).NotTo(BeZero())
+	relocData, err := reloc.Data()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(relocData[:len(testRelocations)]).To(Equal(testRelocations))
+
+	data, err := ioutil.ReadFile(file)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(bytes.HasSuffix(data, []byte("OVERLAY"))).To(BeTrue())
+
+	resources = readTestResources(g, file)
+	version, err := parseVersionInfo(resources.find(rtVersion)[0].data)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(version.getString("ProductName")).To(Equal("Foo"))
+	g.Expect(version.getString("CompanyName")).To(Equal("GitHub, Inc."))
+	g.Expect(version.getString("LegalCopyright")).To(Equal("Copyright © 2026 Foo"))
+	g.Expect(version.getString("FileVersion")).To(Equal("1.2.3"))
+	g.Expect(version.getFixedVersion(0)).To(Equal("1.2.3.0"))
+	g.Expect(version.getFixedVersion(1)).To(Equal("1.2.3.0"))
+	g.Expect(version.getString("ProductVersion")).To(Equal("1.2.3-beta.4"))
+
+	images, err := readIcoFile(filepath.Join("..", "..", "testData", "icon.ico"))
+	g.Expect(err).NotTo(HaveOccurred())
+	groups := resources.find(rtGroupIcon)
+	g.Expect(groups).To(HaveLen(1))
+	g.Expect(groups[0].nameId.name).To(Equal("IDR_MAINFRAME"))
+	ids := getGroupIconIds(groups[0].data)
+	g.Expect(ids).To(HaveLen(len(images)))
+	// ID 3 is used by another icon
+	g.Expect(ids[:3]).To(Equal([]uint16{1, 2, 4}))
+	icons := resources.find(rtIcon)
+	g.Expect(icons).To(HaveLen(len(images) + 1))
+	for _, icon := range icons {
+		if icon.nameId.id == 3 {
+			g.Expect(string(icon.data)).To(Equal("other icon"))
+		}
+		if icon.nameId.id == 1 {
+			g.Expect(icon.data).To(Equal(images[0].data))
+		}
+	}
+
+	manifest := string(resources.find(rtManifest)[0].data)
+	g.Expect(manifest).To(ContainSubstring(`<requestedExecutionLevel level="requireAdministrator" uiAccess="false"/>`))
+	g.Expect(manifest).To(ContainSubstring(`<dpiAware xmlns="http://schemas.microsoft.com/SMI/2005/WindowsSettings">true/pm</dpiAware>`))
+	g.Expect(manifest).To(ContainSubstring(`<dpiAwareness xmlns="http://schemas.microsoft.com/SMI/2016/WindowsSettings">permonitorv2,permonitor</dpiAwareness>`))
+
+	// file is not changed if icon doesn't exist
+	g.Expect(EditResources(&Options{File: file, DpiAwareness: "system", Icon: filepath.Join(dir, "missing.ico")})).NotTo(Succeed())
+	g.Expect(readTestResources(g, file).find(rtManifest)[0].data).To(Equal([]byte(manifest)))
+
+	// existing elements are updated
+	g.Expect(EditResources(&Options{File: file, DpiAwareness: "system", RequestedExecutionLevel: "asInvoker"})).To(Succeed())
+	manifest = string(readTestResources(g, file).find(rtManifest)[0].data)
+	g.Expect(strings.Count(manifest, "<dpiAware ")).To(Equal(1))
+	g.Expect(manifest).To(ContainSubstring(">system</dpiAwareness>"))
+	g.Expect(manifest).To(ContainSubstring(`level="asInvoker"`))
+
+	// unsupported args are passed to rcedit
+	options, err = parseRcEditArgs([]string{file, "--set-resource-string", "1", "foo"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(options).To(BeNil())
+}
@@ -0,0 +1,312 @@
+package rcedit
+
+import (
+	"encoding/binary"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/develar/errors"
+)
+
+// resource types
+const (
+	rtIcon      = 3
+	rtGroupIcon = 14
+	rtVersion   = 16
+	rtManifest  = 24
+)
+
+// resourceId is either a numeric ID or a name (IDR_MAINFRAME)
+type resourceId struct {
+	id   uint16
+	name string
+}
+
+func (t resourceId) isName() bool {
+	return t.name != ""
+}
+
+func (t resourceId) less(other resourceId) bool {
+	// named entries are stored before ID entries
+	if t.isName() != other.isName() {
+		return t.isName()
+	}
+	if t.isName() {
+		return strings.ToUpper(t.name) < strings.ToUpper(other.name)
+	}
+	return t.id < other.id
+}
+
+type resource struct {
+	typeId   resourceId
+	nameId   resourceId
+	language uint16
+	codePage uint32
+	data     []byte
+}
+
+type resourceSet struct {
+	items []*resource
+}
+
+func (t *resourceSet) find(typeId uint16) []*resource {
+	var result []*resource
+	for _, item := range t.items {
+		if !item.typeId.isName() && item.typeId.id == typeId {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func (t *resourceSet) remove(item *resource) {
+	for index, existing := range t.items {
+		if existing == item {
+			t.items = append(t.items[:index], t.items[index+1:]...)
+			return
+		}
+	}
+}
+
+func (t *resourceSet) set(item *resource) {
+	for index, existing := range t.items {
+		if existing.typeId == item.typeId && existing.nameId == item.nameId && existing.language == item.language {
+			t.items[index] = item
+			return
+		}
+	}
+	t.items = append(t.items, item)
+}
+
+func parseResources(file *peFile, rva uint32) (*resourceSet, error) {
+	section := file.findSection(rva)
+	if section == nil {
+		return nil, unsupportedPe("resource directory is not mapped to any section")
+	}
+	// offsets in the resource directory are relative to the directory start
+	start := section.rawDataPointer + (rva - section.virtualAddress)
+	end := section.rawDataPointer + section.sizeOfRawData
+	if end > uint32(len(file.data)) || start >= end {
+		return nil, unsupportedPe("resource section is truncated")
+	}
+	data := file.data[start:end]
+
+	result := &resourceSet{}
+	err := walkResourceDirectory(data, 0, 0, make([]resourceId, 0, 3), func(path []resourceId, entryOffset uint32) error {
+		if entryOffset+16 > uint32(len(data)) {
+			return errors.New("resource data entry is out of section")
+		}
+		dataRva := binary.LittleEndian.Uint32(data[entryOffset:])
+		size := binary.LittleEndian.Uint32(data[entryOffset+4:])
+		content, err := file.readRva(dataRva, size)
+		if err != nil {
+			return err
+		}
+		result.items = append(result.items, &resource{
+			typeId:   path[0],
+			nameId:   path[1],
+			language: path[2].id,
+			codePage: binary.LittleEndian.Uint32(data[entryOffset+8:]),
+			data:     append([]byte(nil), content...),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, unsupportedPe("cannot read resources: " + err.Error())
+	}
+	return result, nil
+}
+
+func walkResourceDirectory(data []byte, offset uint32, level int, path []resourceId, consumer func(path []resourceId, entryOffset uint32) error) error {
+	if level > 2 || offset+16 > uint32(len(data)) {
+		return errors.New("invalid resource directory")
+	}
+
+	count := uint32(binary.LittleEndian.Uint16(data[offset+12:])) + uint32(binary.LittleEndian.Uint16(data[offset+14:]))
+	for i := uint32(0); i < count; i++ {
+		entry := offset + 16 + i*8
+		if entry+8 > uint32(len(data)) {
+			return errors.New("resource directory entry is out of section")
+		}
+
+		nameField := binary.LittleEndian.Uint32(data[entry:])
+		var id resourceId
+		if nameField&0x80000000 != 0 {
+			name, err := readResourceName(data, nameField&0x7fffffff)
+			if err != nil {
+				return err
+			}
+			id.name = name
+		} else {
+			id.id = uint16(nameField)
+		}
+
+		childPath := append(path, id)
+		target := binary.LittleEndian.Uint32(data[entry+4:])
+		var err error
+		if target&0x80000000 != 0 {
+			err = walkResourceDirectory(data, target&0x7fffffff, level+1, childPath, consumer)
+		} else if level == 2 {
+			err = consumer(childPath, target)
+		} else {
+			err = errors.New("resource data entry is not at the language level")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readResourceName(data []byte, offset uint32) (string, error) {
+	if offset+2 > uint32(len(data)) {
+		return "", errors.New("resource name is out of section")
+	}
+	length := uint32(binary.LittleEndian.Uint16(data[offset:]))
+	if offset+2+length*2 > uint32(len(data)) {
+		return "", errors.New("resource name is out of section")
+	}
+	chars := make([]uint16, length)
+	for i := range chars {
+		chars[i] = binary.LittleEndian.Uint16(data[offset+2+uint32(i)*2:])
+	}
+	return string(utf16.Decode(chars)), nil
+}
+
+type resourceDirectory struct {
+	ids      []resourceId
+	children []*resourceDirectory
+	// leaf entries (language level)
+	items []*resource
+
+	offset uint32
+}
+
+// build returns the resource section data: directories, names, data entries and then data (aligned to 8), as rc.exe does
+func (t *resourceSet) build(sectionRva uint32) []byte {
+	items := make([]*resource, len(t.items))
+	copy(items, t.items)
+	sort.SliceStable(items, func(i, j int) bool {
+		a, b := items[i], items[j]
+		if a.typeId != b.typeId {
+			return a.typeId.less(b.typeId)
+		}
+		if a.nameId != b.nameId {
+			return a.nameId.less(b.nameId)
+		}
+		return a.language < b.language
+	})
+
+	root := &resourceDirectory{}
+	for _, item := range items {
+		typeDirectory := root.child(item.typeId)
+		nameDirectory := typeDirectory.child(item.nameId)
+		nameDirectory.ids = append(nameDirectory.ids, resourceId{id: item.language})
+		nameDirectory.items = append(nameDirectory.items, item)
+	}
+
+	// directories level by level
+	levels := [][]*resourceDirectory{{root}}
+	for level := 0; level < 2; level++ {
+		var next []*resourceDirectory
+		for _, directory := range levels[level] {
+			next = append(next, directory.children...)
+		}
+		levels = append(levels, next)
+	}
+
+	size := uint32(0)
+	for _, level := range levels {
+		for _, directory := range level {
+			directory.offset = size
+			size += 16 + uint32(len(directory.ids))*8
+		}
+	}
+
+	nameOffsets := make(map[string]uint32)
+	var names []string
+	for _, level := range levels {
+		for _, directory := range level {
+			for _, id := range directory.ids {
+				if _, ok := nameOffsets[id.name]; id.isName() && !ok {
+					nameOffsets[id.name] = size
+					names = append(names, id.name)
+					size += 2 + uint32(len(utf16.Encode([]rune(id.name))))*2
+				}
+			}
+		}
+	}
+	size = alignUp(size, 4)
+
+	dataEntriesOffset := size
+	size += uint32(len(items)) * 16
+	dataOffsets := make([]uint32, len(items))
+	for index, item := range items {
+		size = alignUp(size, 8)
+		dataOffsets[index] = size
+		size += uint32(len(item.data))
+	}
+
+	result := make([]byte, size)
+	dataEntryIndex := uint32(0)
+	for _, level := range levels {
+		for _, directory := range level {
+			header := result[directory.offset:]
+			numberOfNamed := 0
+			for _, id := range directory.ids {
+				if id.isName() {
+					numberOfNamed++
+				}
+			}
+			binary.LittleEndian.PutUint16(header[12:], uint16(numberOfNamed))
+			binary.LittleEndian.PutUint16(header[14:], uint16(len(directory.ids)-numberOfNamed))
+
+			for index, id := range directory.ids {
+				entry := header[16+index*8:]
+				if id.isName() {
+					binary.LittleEndian.PutUint32(entry, 0x80000000|nameOffsets[id.name])
+				} else {
+					binary.LittleEndian.PutUint32(entry, uint32(id.id))
+				}
+
+				if directory.items == nil {
+					binary.LittleEndian.PutUint32(entry[4:], 0x80000000|directory.children[index].offset)
+				} else {
+					binary.LittleEndian.PutUint32(entry[4:], dataEntriesOffset+dataEntryIndex*16)
+					dataEntryIndex++
+				}
+			}
+		}
+	}
+
+	for _, name := range names {
+		chars := utf16.Encode([]rune(name))
+		offset := nameOffsets[name]
+		binary.LittleEndian.PutUint16(result[offset:], uint16(len(chars)))
+		for i, char := range chars {
+			binary.LittleEndian.PutUint16(result[offset+2+uint32(i)*2:], char)
+		}
+	}
+
+	// data entries are written in the same order as leaf directory entries (items are sorted the same way)
+	for index, item := range items {
+		entry := result[dataEntriesOffset+uint32(index)*16:]
+		binary.LittleEndian.PutUint32(entry, sectionRva+dataOffsets[index])
+		binary.LittleEndian.PutUint32(entry[4:], uint32(len(item.data)))
+		binary.LittleEndian.PutUint32(entry[8:], item.codePage)
+		copy(result[dataOffsets[index]:], item.data)
+	}
+	return result
+}
+
+func (t *resourceDirectory) child(id resourceId) *resourceDirectory {
+	// items are sorted, so, the same id can be only the last one
+	if n := len(t.ids); n != 0 && t.ids[n-1] == id {
+		return t.children[n-1]
+	}
+	result := &resourceDirectory{}
+	t.ids = append(t.ids, id)
+	t.children = append(t.children, result)
+	return result
+}
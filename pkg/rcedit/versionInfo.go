@@ -0,0 +1,250 @@
+package rcedit
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/develar/errors"
+)
+
+const (
+	fixedFileInfoSignature = 0xfeef04bd
+	// US English, Unicode
+	defaultLanguage      = 1033
+	defaultCodePage      = 1200
+	defaultStringTableId = "040904b0"
+)
+
+// versionNode is a node of VS_VERSIONINFO tree (VS_VERSIONINFO, StringFileInfo, StringTable, String, VarFileInfo, Var)
+type versionNode struct {
+	key    string
+	isText bool
+	value  []byte
+
+	children []*versionNode
+}
+
+func (t *versionNode) getChild(key string) *versionNode {
+	for _, child := range t.children {
+		if child.key == key {
+			return child
+		}
+	}
+	return nil
+}
+
+func parseVersionInfo(data []byte) (*versionNode, error) {
+	node, _, err := parseVersionNode(data, 0)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot parse version info")
+	}
+	if node.key != "VS_VERSION_INFO" || len(node.value) < 52 || binary.LittleEndian.Uint32(node.value) != fixedFileInfoSignature {
+		return nil, errors.New("cannot parse version info: VS_FIXEDFILEINFO is not found")
+	}
+	return node, nil
+}
+
+// parseVersionNode returns the node and offset of the next sibling
+func parseVersionNode(data []byte, offset int) (*versionNode, int, error) {
+	if offset+6 > len(data) {
+		return nil, 0, errors.New("node header is truncated")
+	}
+
+	length := int(binary.LittleEndian.Uint16(data[offset:]))
+	valueLength := int(binary.LittleEndian.Uint16(data[offset+2:]))
+	end := offset + length
+	if length < 6 || end > len(data) {
+		return nil, 0, errors.Errorf("invalid node length %d at %d", length, offset)
+	}
+
+	node := &versionNode{isText: binary.LittleEndian.Uint16(data[offset+4:]) == 1}
+	position := offset + 6
+	var chars []uint16
+	for ; position+1 < end; position += 2 {
+		char := binary.LittleEndian.Uint16(data[position:])
+		if char == 0 {
+			position += 2
+			break
+		}
+		chars = append(chars, char)
+	}
+	node.key = string(utf16.Decode(chars))
+	position = alignVersion(position)
+
+	if node.isText {
+		// some compilers store length in bytes instead of chars, value is limited by the node end in any case
+		valueLength *= 2
+	}
+	if position+valueLength > end {
+		valueLength = end - position
+	}
+	if valueLength > 0 {
+		node.value = append([]byte(nil), data[position:position+valueLength]...)
+		position = alignVersion(position + valueLength)
+	}
+
+	for position < end {
+		child, next, err := parseVersionNode(data, position)
+		if err != nil {
+			return nil, 0, err
+		}
+		node.children = append(node.children, child)
+		position = alignVersion(next)
+	}
+	return node, end, nil
+}
+
+func (t *versionNode) encode() []byte {
+	var result []byte
+	result = append(result, 0, 0, 0, 0, 0, 0)
+	valueLength := len(t.value)
+	wType := uint16(0)
+	if t.isText {
+		valueLength /= 2
+		wType = 1
+	}
+	binary.LittleEndian.PutUint16(result[2:], uint16(valueLength))
+	binary.LittleEndian.PutUint16(result[4:], wType)
+
+	result = appendUtf16(result, t.key)
+	result = padVersion(result)
+	if len(t.value) != 0 {
+		result = append(result, t.value...)
+	}
+	for _, child := range t.children {
+		result = padVersion(result)
+		result = append(result, child.encode()...)
+	}
+	binary.LittleEndian.PutUint16(result, uint16(len(result)))
+	return result
+}
+
+func newTextVersionNode(key string, value string) *versionNode {
+	return &versionNode{key: key, isText: true, value: appendUtf16(nil, value)}
+}
+
+// newVersionInfo returns VS_VERSIONINFO with empty string table for US English
+func newVersionInfo() *versionNode {
+	fixed := make([]byte, 52)
+	binary.LittleEndian.PutUint32(fixed, fixedFileInfoSignature)
+	binary.LittleEndian.PutUint32(fixed[4:], 0x00010000)
+	binary.LittleEndian.PutUint32(fixed[8*4:], 0x00040004)
+	// VFT_APP
+	binary.LittleEndian.PutUint32(fixed[9*4:], 1)
+	binary.LittleEndian.PutUint32(fixed[6*4:], 0x3f)
+
+	translation := make([]byte, 4)
+	binary.LittleEndian.PutUint16(translation, defaultLanguage)
+	binary.LittleEndian.PutUint16(translation[2:], defaultCodePage)
+	return &versionNode{
+		key:   "VS_VERSION_INFO",
+		value: fixed,
+		children: []*versionNode{
+			{key: "StringFileInfo", isText: true, children: []*versionNode{{key: defaultStringTableId, isText: true}}},
+			{key: "VarFileInfo", isText: true, children: []*versionNode{{key: "Translation", value: translation}}},
+		},
+	}
+}
+
+// setString sets the string in all string tables (the same as rcedit does)
+func (t *versionNode) setString(key string, value string) {
+	stringFileInfo := t.getChild("StringFileInfo")
+	if stringFileInfo == nil {
+		stringFileInfo = &versionNode{key: "StringFileInfo", isText: true}
+		t.children = append([]*versionNode{stringFileInfo}, t.children...)
+	}
+	if len(stringFileInfo.children) == 0 {
+		stringFileInfo.children = append(stringFileInfo.children, &versionNode{key: defaultStringTableId, isText: true})
+	}
+
+	for _, table := range stringFileInfo.children {
+		if existing := table.getChild(key); existing != nil {
+			existing.isText = true
+			existing.value = appendUtf16(nil, value)
+		} else {
+			table.children = append(table.children, newTextVersionNode(key, value))
+		}
+	}
+}
+
+func (t *versionNode) getString(key string) string {
+	stringFileInfo := t.getChild("StringFileInfo")
+	if stringFileInfo == nil {
+		return ""
+	}
+	for _, table := range stringFileInfo.children {
+		if item := table.getChild(key); item != nil {
+			return decodeUtf16(item.value)
+		}
+	}
+	return ""
+}
+
+// setFixedVersion sets FileVersion (index 0) or ProductVersion (index 1) of VS_FIXEDFILEINFO
+func (t *versionNode) setFixedVersion(index int, version [4]uint16) {
+	offset := 8 + index*8
+	binary.LittleEndian.PutUint32(t.value[offset:], uint32(version[0])<<16|uint32(version[1]))
+	binary.LittleEndian.PutUint32(t.value[offset+4:], uint32(version[2])<<16|uint32(version[3]))
+}
+
+func (t *versionNode) getFixedVersion(index int) string {
+	offset := 8 + index*8
+	ms := binary.LittleEndian.Uint32(t.value[offset:])
+	ls := binary.LittleEndian.Uint32(t.value[offset+4:])
+	return fmt.Sprintf("%d.%d.%d.%d", ms>>16, ms&0xffff, ls>>16, ls&0xffff)
+}
+
+// parseVersion parses up to 4 numeric components, suffix is ignored (1.2.3-beta.1 is 1.2.3.0)
+func parseVersion(version string) ([4]uint16, error) {
+	var result [4]uint16
+	end := strings.IndexAny(version, "-+ ")
+	if end >= 0 {
+		version = version[:end]
+	}
+
+	parts := strings.Split(version, ".")
+	if len(parts) > 4 {
+		return result, errors.Errorf("invalid version %s: more than 4 components", version)
+	}
+	for index, part := range parts {
+		value, err := strconv.ParseUint(part, 10, 16)
+		if err != nil {
+			return result, errors.Errorf("invalid version %s: component %q is not a number in range 0-65535", version, part)
+		}
+		result[index] = uint16(value)
+	}
+	return result, nil
+}
+
+func appendUtf16(data []byte, value string) []byte {
+	for _, char := range utf16.Encode([]rune(value)) {
+		data = append(data, byte(char), byte(char>>8))
+	}
+	return append(data, 0, 0)
+}
+
+func decodeUtf16(data []byte) string {
+	chars := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		char := binary.LittleEndian.Uint16(data[i:])
+		if char == 0 {
+			break
+		}
+		chars = append(chars, char)
+	}
+	return string(utf16.Decode(chars))
+}
+
+func alignVersion(offset int) int {
+	return (offset + 3) &^ 3
+}
+
+func padVersion(data []byte) []byte {
+	for len(data)%4 != 0 {
+		data = append(data, 0)
+	}
+	return data
+}
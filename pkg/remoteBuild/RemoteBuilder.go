@@ -169,40 +169,68 @@ type File struct {
 	File string `json:"file"`
 }
 
-// compress and upload in the same time, directly to remote without intermediate local file
+// upload uploads payload using the best protocol supported by agent: chunked resumable upload or streaming (old agents)
 func (t *RemoteBuilder) upload(buildRequest string, filesToPack []string, buildResourceDir string, client *http.Client) (*http.Response, error) {
-	zstd, err := download.GetZstd()
+	capabilities, err := getCapabilities(client, t.endpoint)
 	if err != nil {
 		return nil, err
 	}
+	if !capabilities.isCompressionSupported(compressionZstd) {
+		return nil, util.NewMessageError("build agent doesn't support zstd compression of payload", "ERR_REMOTE_BUILD_UNSUPPORTED")
+	}
+	if !capabilities.ChunkedUpload {
+		return t.uploadStream(buildRequest, filesToPack, buildResourceDir, client)
+	}
 
 	zstdCompressionLevel := getZstdCompressionLevel(t.endpoint)
+	log.Info("compressing payload for remote builder")
+	payload, err := packPayload(filesToPack, buildResourceDir, zstdCompressionLevel)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(payload)
 
-	//noinspection SpellCheckingInspection
-	tarArgs := []string{"a", "dummy", "-ttar", "-so"}
+	// not canceled on return - response body (build events) is read by caller
+	ctx := util.RootContext()
+	uploader := &chunkedUploader{client: client, endpoint: t.endpoint, chunkSize: capabilities.getChunkSize()}
+	uploadId, err := uploader.upload(ctx, payload)
+	if err != nil {
+		return nil, err
+	}
 
-	cwd, err := os.Getwd()
-	if err == nil {
-		for _, value := range filesToPack {
-			d := value
-			if !filepath.IsAbs(value) {
-				d = filepath.Join(cwd, value)
-			}
-			tarArgs = append(tarArgs, filepath.Clean(d))
-		}
-	} else {
-		tarArgs = append(tarArgs, filesToPack...)
+	url := t.endpoint + "/v2/build"
+	req, err := http.NewRequest(http.MethodPost, url, nil)
+	if err != nil {
+		return nil, err
 	}
 
-	if buildResourceDir != "" {
-		fileInfo, err := os.Stat(buildResourceDir)
-		if err == nil && fileInfo.IsDir() {
-			tarArgs = append(tarArgs, buildResourceDir)
-		}
+	req.Header.Set("x-build-request", buildRequest)
+	req.Header.Set("x-upload-id", uploadId)
+	req.Header.Set("x-payload-compression", compressionZstd)
+	// only for stats purpose, not required for build
+	req.Header.Set("x-zstd-compression-level", zstdCompressionLevel)
+
+	response, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		_ = response.Body.Close()
+		return nil, fmt.Errorf("cannot get %s: http error %d", url, response.StatusCode)
+	}
+	return response, nil
+}
+
+// compress and upload in the same time, directly to remote without intermediate local file
+func (t *RemoteBuilder) uploadStream(buildRequest string, filesToPack []string, buildResourceDir string, client *http.Client) (*http.Response, error) {
+	zstd, err := download.GetZstd()
+	if err != nil {
+		return nil, err
 	}
 
-	tarCommand := exec.Command(util.Get7zPath(), tarArgs...)
+	zstdCompressionLevel := getZstdCompressionLevel(t.endpoint)
 
+	tarCommand := exec.Command(util.Get7zPath(), createTarArgs(filesToPack, buildResourceDir)...)
 	tarCommand.Stderr = os.Stderr
 	tarOutput, err := tarCommand.StdoutPipe()
 	if err != nil {
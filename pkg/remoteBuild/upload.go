@@ -0,0 +1,301 @@
+package remoteBuild
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/develar/app-builder/pkg/download"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/dustin/go-humanize"
+	"github.com/json-iterator/go"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultChunkSize = 8 * 1024 * 1024
+	chunkRetries     = 5
+
+	compressionZstd = "zstd"
+)
+
+var chunkRetryDelay = 2 * time.Second
+
+// Capabilities of the build agent (GET /v2/capabilities), old agents don't support it and accept only streamed payload
+type Capabilities struct {
+	ProtocolVersion int      `json:"protocolVersion"`
+	Compression     []string `json:"compression"`
+	// payload can be uploaded in chunks (PATCH /v2/upload/<id>) and upload can be resumed
+	ChunkedUpload bool  `json:"chunkedUpload"`
+	MaxChunkSize  int64 `json:"maxChunkSize"`
+}
+
+func getCapabilities(client *http.Client, endpoint string) (*Capabilities, error) {
+	url := endpoint + "/v2/capabilities"
+	response, err := client.Get(url)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer util.Close(response.Body)
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		data, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		var result Capabilities
+		err = jsoniter.Unmarshal(data, &result)
+		if err != nil {
+			return nil, errors.WithMessage(err, "cannot parse capabilities of build agent")
+		}
+		return &result, nil
+	case http.StatusNotFound:
+		log.Debug("build agent doesn't support capabilities negotiation, payload is streamed")
+		return &Capabilities{}, nil
+	default:
+		return nil, errors.Errorf("cannot get %s: http error %d", url, response.StatusCode)
+	}
+}
+
+// BUILD_SERVICE_UPLOAD_CHUNK_SIZE env to set chunk size (e.g. 2MB for slow links), limited by max chunk size of agent
+func (t *Capabilities) getChunkSize() int64 {
+	value := os.Getenv("BUILD_SERVICE_UPLOAD_CHUNK_SIZE")
+	if value != "" {
+		size, err := humanize.ParseBytes(value)
+		if err == nil && size > 0 {
+			return t.limitChunkSize(int64(size))
+		}
+		log.Warn("BUILD_SERVICE_UPLOAD_CHUNK_SIZE is invalid, default is used", zap.String("value", value))
+	}
+	return t.limitChunkSize(defaultChunkSize)
+}
+
+func (t *Capabilities) limitChunkSize(size int64) int64 {
+	if t.MaxChunkSize > 0 && size > t.MaxChunkSize {
+		return t.MaxChunkSize
+	}
+	return size
+}
+
+func (t *Capabilities) isCompressionSupported(compression string) bool {
+	// old agents support only zstd
+	return len(t.Compression) == 0 || util.ContainsString(t.Compression, compression)
+}
+
+func createTarArgs(filesToPack []string, buildResourceDir string) []string {
+	//noinspection SpellCheckingInspection
+	tarArgs := []string{"a", "dummy", "-ttar", "-so"}
+
+	cwd, err := os.Getwd()
+	if err == nil {
+		for _, value := range filesToPack {
+			d := value
+			if !filepath.IsAbs(value) {
+				d = filepath.Join(cwd, value)
+			}
+			tarArgs = append(tarArgs, filepath.Clean(d))
+		}
+	} else {
+		tarArgs = append(tarArgs, filesToPack...)
+	}
+
+	if buildResourceDir != "" {
+		fileInfo, err := os.Stat(buildResourceDir)
+		if err == nil && fileInfo.IsDir() {
+			tarArgs = append(tarArgs, buildResourceDir)
+		}
+	}
+	return tarArgs
+}
+
+// packPayload writes zstd-compressed tar of the files to temp file, so, payload can be uploaded in chunks and upload can be resumed
+func packPayload(filesToPack []string, buildResourceDir string, compressionLevel string) (string, error) {
+	zstd, err := download.GetZstd()
+	if err != nil {
+		return "", err
+	}
+
+	outFile, err := util.CreateTempFile("remote-build-*.tar.zst")
+	if err != nil {
+		return "", err
+	}
+	defer util.Close(outFile)
+
+	tarCommand := exec.Command(util.Get7zPath(), createTarArgs(filesToPack, buildResourceDir)...)
+	tarCommand.Stderr = os.Stderr
+
+	compressCommand := exec.Command(zstd, "-"+compressionLevel, "--long", "-T0")
+	compressCommand.Stderr = os.Stderr
+	compressCommand.Stdout = outFile
+
+	start := time.Now()
+	err = util.RunPipedCommands(tarCommand, compressCommand)
+	if err != nil {
+		_ = os.Remove(outFile.Name())
+		return "", err
+	}
+
+	if log.IsDebugEnabled() {
+		info, err := outFile.Stat()
+		if err == nil {
+			log.Debug("payload compressed", zap.String("size", humanize.Bytes(uint64(info.Size()))), zap.Duration("duration", time.Since(start).Round(time.Millisecond)))
+		}
+	}
+	return outFile.Name(), nil
+}
+
+// chunkedUploader uploads payload in chunks, upload ID is sha256 of payload, so, upload of the same payload (e.g. after failed run) is resumed from the offset received by agent
+type chunkedUploader struct {
+	client    *http.Client
+	endpoint  string
+	chunkSize int64
+}
+
+func computeUploadId(file string) (string, int64, error) {
+	reader, err := os.Open(file)
+	if err != nil {
+		return "", 0, errors.WithStack(err)
+	}
+	defer util.Close(reader)
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, reader)
+	if err != nil {
+		return "", 0, errors.WithStack(err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+func (t *chunkedUploader) upload(ctx context.Context, file string) (string, error) {
+	uploadId, size, err := computeUploadId(file)
+	if err != nil {
+		return "", err
+	}
+
+	reader, err := os.Open(file)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer util.Close(reader)
+
+	url := t.endpoint + "/v2/upload/" + uploadId
+	offset, err := t.getOffset(ctx, url)
+	if err != nil {
+		return "", err
+	}
+	if offset > 0 {
+		log.Info("resuming upload to remote builder", zap.String("uploaded", humanize.Bytes(uint64(offset))), zap.String("size", humanize.Bytes(uint64(size))))
+	}
+
+	start := time.Now()
+	delay := chunkRetryDelay
+	attempt := 0
+	for offset < size {
+		chunkLength := t.chunkSize
+		if offset+chunkLength > size {
+			chunkLength = size - offset
+		}
+
+		newOffset, err := t.uploadChunk(ctx, url, io.NewSectionReader(reader, offset, chunkLength), offset, chunkLength, size)
+		if err == nil && (newOffset <= offset || newOffset > size) {
+			// otherwise the same chunk is uploaded forever
+			err = errors.Errorf("agent reported invalid offset %d after chunk upload (offset %d, size %d)", newOffset, offset, size)
+		}
+		if err == nil {
+			offset = newOffset
+			attempt = 0
+			delay = chunkRetryDelay
+			continue
+		}
+
+		if attempt >= chunkRetries || ctx.Err() != nil {
+			return "", err
+		}
+		attempt++
+		log.Warn("cannot upload chunk, retrying", zap.Int64("offset", offset), zap.Int("attempt", attempt), zap.Duration("delay", delay), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return "", err
+		case <-time.After(delay):
+		}
+		delay *= 2
+
+		// agent could receive part of the chunk before connection was lost
+		receivedOffset, offsetErr := t.getOffset(ctx, url)
+		if offsetErr == nil {
+			offset = receivedOffset
+		}
+	}
+
+	log.Info("uploaded to remote builder", zap.String("size", humanize.Bytes(uint64(size))), zap.Duration("duration", time.Since(start).Round(time.Millisecond)))
+	return uploadId, nil
+}
+
+// getOffset returns size of data received by agent (0 if upload is unknown)
+func (t *chunkedUploader) getOffset(ctx context.Context, url string) (int64, error) {
+	request, err := http.NewRequest(http.MethodHead, url, nil)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	response, err := t.client.Do(request.WithContext(ctx))
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	util.Close(response.Body)
+
+	switch response.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return parseOffset(response)
+	case http.StatusNotFound:
+		return 0, nil
+	default:
+		return 0, errors.Errorf("cannot get upload offset %s: http error %d", url, response.StatusCode)
+	}
+}
+
+func (t *chunkedUploader) uploadChunk(ctx context.Context, url string, chunk io.Reader, offset int64, length int64, size int64) (int64, error) {
+	request, err := http.NewRequest(http.MethodPatch, url, chunk)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	request.ContentLength = length
+	request.Header.Set("Content-Type", "application/offset+octet-stream")
+	request.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	request.Header.Set("Upload-Length", strconv.FormatInt(size, 10))
+	request.Header.Set("x-payload-compression", compressionZstd)
+
+	response, err := t.client.Do(request.WithContext(ctx))
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	util.Close(response.Body)
+
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusNoContent {
+		// 409 - offset doesn't match, actual offset is requested before retry
+		return 0, fmt.Errorf("cannot upload chunk %s (offset %d): http error %d", url, offset, response.StatusCode)
+	}
+	return parseOffset(response)
+}
+
+func parseOffset(response *http.Response) (int64, error) {
+	value := response.Header.Get("Upload-Offset")
+	result, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || result < 0 {
+		return 0, errors.Errorf("invalid Upload-Offset header: %q", value)
+	}
+	return result, nil
+}
@@ -0,0 +1,121 @@
+package remoteBuild
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+)
+
+// fakeAgent accepts chunks in order, the second chunk request fails once after agent received half of it
+type fakeAgent struct {
+	mutex    sync.Mutex
+	uploads  map[string][]byte
+	requests []string
+	isFailed bool
+}
+
+func (t *fakeAgent) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.requests = append(t.requests, request.Method+" "+request.Header.Get("Upload-Offset"))
+	if request.URL.Path == "/v2/capabilities" {
+		_, _ = writer.Write([]byte(`{"protocolVersion": 2, "compression": ["zstd"], "chunkedUpload": true, "maxChunkSize": 1024}`))
+		return
+	}
+
+	id := strings.TrimPrefix(request.URL.Path, "/v2/upload/")
+	data, isExisting := t.uploads[id]
+	switch request.Method {
+	case http.MethodHead:
+		if !isExisting {
+			writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+	case http.MethodPatch:
+		offset, _ := strconv.Atoi(request.Header.Get("Upload-Offset"))
+		if offset != len(data) {
+			writer.WriteHeader(http.StatusConflict)
+			return
+		}
+		chunk, _ := ioutil.ReadAll(request.Body)
+		if offset > 0 && !t.isFailed {
+			t.isFailed = true
+			t.uploads[id] = append(data, chunk[:len(chunk)/2]...)
+			writer.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		data = append(data, chunk...)
+		t.uploads[id] = data
+	}
+	writer.Header().Set("Upload-Offset", strconv.Itoa(len(data)))
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func TestChunkedUpload(t *testing.T) {
+	log.InitLogger()
+	g := NewGomegaWithT(t)
+
+	defer func(delay time.Duration) { chunkRetryDelay = delay }(chunkRetryDelay)
+	chunkRetryDelay = time.Millisecond
+
+	dir, err := ioutil.TempDir("", "remote-build")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	payload := make([]byte, 2500)
+	rand.New(rand.NewSource(42)).Read(payload)
+	file := filepath.Join(dir, "payload.tar.zst")
+	g.Expect(ioutil.WriteFile(file, payload, 0644)).To(Succeed())
+
+	agent := &fakeAgent{uploads: make(map[string][]byte)}
+	server := httptest.NewServer(agent)
+	defer server.Close()
+
+	capabilities, err := getCapabilities(server.Client(), server.URL)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(capabilities.ChunkedUpload).To(BeTrue())
+	g.Expect(capabilities.isCompressionSupported(compressionZstd)).To(BeTrue())
+	// limited by agent
+	g.Expect(capabilities.getChunkSize()).To(Equal(int64(1024)))
+
+	uploader := &chunkedUploader{client: server.Client(), endpoint: server.URL, chunkSize: capabilities.getChunkSize()}
+	uploadId, err := uploader.upload(context.Background(), file)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(uploadId).To(HaveLen(64))
+	g.Expect(bytes.Equal(agent.uploads[uploadId], payload)).To(BeTrue())
+	// failed chunk is resumed from the offset received by agent (1024 + 512)
+	g.Expect(agent.requests).To(Equal([]string{"GET ", "HEAD ", "PATCH 0", "PATCH 1024", "HEAD ", "PATCH 1536"}))
+
+	// already uploaded payload is not uploaded again
+	agent.requests = nil
+	_, err = uploader.upload(context.Background(), file)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(agent.requests).To(Equal([]string{"HEAD "}))
+}
+
+func TestLegacyCapabilities(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	capabilities, err := getCapabilities(server.Client(), server.URL)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(capabilities.ChunkedUpload).To(BeFalse())
+	g.Expect(capabilities.isCompressionSupported(compressionZstd)).To(BeTrue())
+	g.Expect((&Capabilities{Compression: []string{"gzip"}}).isCompressionSupported(compressionZstd)).To(BeFalse())
+}
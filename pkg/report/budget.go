@@ -0,0 +1,206 @@
+package report
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/develar/app-builder/pkg/asar"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/dustin/go-humanize"
+)
+
+// budget key for the total size of all artifacts
+const totalBudget = "total"
+
+// SizeBudget is a map of target (or total) to max size of artifact (sum of all artifacts for total)
+type SizeBudget map[string]int64
+
+type SizeBudgetResult struct {
+	Violations []*BudgetViolation `json:"violations"`
+	// the largest packages and files of the app (computed only if budget is exceeded)
+	Contributors []*Contributor `json:"contributors,omitempty"`
+}
+
+type BudgetViolation struct {
+	// target or total
+	Target string `json:"target"`
+	Arch   string `json:"arch,omitempty"`
+	File   string `json:"file,omitempty"`
+	Size   int64  `json:"size"`
+	Budget int64  `json:"budget"`
+}
+
+type Contributor struct {
+	// package name for files in node_modules, path otherwise
+	Name string `json:"name"`
+	// package or file
+	Kind string `json:"kind"`
+	// asar, unpacked (app.asar.unpacked), app (not packed into asar) or resources
+	Locations []string `json:"locations"`
+	Size      int64    `json:"size"`
+	FileCount int      `json:"fileCount"`
+}
+
+// ParseSizeBudget parses budgets in form TARGET=SIZE or SIZE (total), e.g. nsis=100MB or 300MiB
+func ParseSizeBudget(values []string) (SizeBudget, error) {
+	result := make(SizeBudget, len(values))
+	for _, value := range values {
+		target, size := totalBudget, value
+		index := strings.IndexByte(value, '=')
+		if index >= 0 {
+			target, size = value[:index], value[index+1:]
+		}
+
+		parsed, err := humanize.ParseBytes(size)
+		if err != nil || parsed == 0 || target == "" {
+			return nil, util.NewMessageError("size budget "+value+" is invalid (expected TARGET=SIZE or SIZE, e.g. nsis=100MB)", "ERR_SIZE_BUDGET_INVALID_VALUE")
+		}
+		result[target] = int64(parsed)
+	}
+	return result, nil
+}
+
+// checkSizeBudget returns violations in the order of artifacts, total is the last
+func checkSizeBudget(artifacts []*Artifact, budget SizeBudget) []*BudgetViolation {
+	var result []*BudgetViolation
+	var totalSize int64
+	for _, artifact := range artifacts {
+		totalSize += artifact.Size
+		limit, ok := budget[artifact.Target]
+		if ok && artifact.Size > limit {
+			result = append(result, &BudgetViolation{Target: artifact.Target, Arch: artifact.Arch, File: artifact.File, Size: artifact.Size, Budget: limit})
+		}
+	}
+
+	limit, ok := budget[totalBudget]
+	if ok && totalSize > limit {
+		result = append(result, &BudgetViolation{Target: totalBudget, Size: totalSize, Budget: limit})
+	}
+	return result
+}
+
+// computeContributors returns top largest packages and files of the resources dir (dir with app.asar), content of app.asar is read from the header
+func computeContributors(resourcesDir string, top int) ([]*Contributor, error) {
+	contributors := make(map[string]*Contributor)
+	add := func(p string, location string, size int64) {
+		name, kind := getContributorName(p)
+		contributor := contributors[name]
+		if contributor == nil {
+			contributor = &Contributor{Name: name, Kind: kind}
+			contributors[name] = contributor
+		}
+		if !containsString(contributor.Locations, location) {
+			contributor.Locations = append(contributor.Locations, location)
+			sort.Strings(contributor.Locations)
+		}
+		contributor.Size += size
+		contributor.FileCount++
+	}
+
+	asarFile := filepath.Join(resourcesDir, "app.asar")
+	_, err := os.Stat(asarFile)
+	if err == nil {
+		archive, err := asar.OpenArchive(asarFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range archive.List(nil) {
+			if item.Type != "file" {
+				continue
+			}
+			location := "asar"
+			if item.Unpacked {
+				location = "unpacked"
+			}
+			add(item.Path, location, item.Size)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, errors.WithStack(err)
+	}
+
+	err = filepath.Walk(resourcesDir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relativePath, err := filepath.Rel(resourcesDir, file)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		relativePath = filepath.ToSlash(relativePath)
+		if relativePath == "app.asar.unpacked" {
+			// already counted (header contains size of unpacked files)
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() || relativePath == "app.asar" {
+			return nil
+		}
+
+		if strings.HasPrefix(relativePath, "app/") {
+			add(relativePath[len("app/"):], "app", info.Size())
+		} else {
+			add("resources/"+relativePath, "resources", info.Size())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	result := make([]*Contributor, 0, len(contributors))
+	for _, contributor := range contributors {
+		result = append(result, contributor)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Size == result[j].Size {
+			return result[i].Name < result[j].Name
+		}
+		return result[i].Size > result[j].Size
+	})
+	if top > 0 && len(result) > top {
+		result = result[:top]
+	}
+	return result, nil
+}
+
+// file in node_modules is attributed to the innermost package (e.g. @scope/name), other files to itself
+func getContributorName(p string) (string, string) {
+	segments := strings.Split(p, "/")
+	for i := len(segments) - 2; i >= 0; i-- {
+		if segments[i] != "node_modules" {
+			continue
+		}
+		name := segments[i+1]
+		if strings.HasPrefix(name, "@") && i+2 < len(segments)-1 {
+			name += "/" + segments[i+2]
+		}
+		return name, "package"
+	}
+	return p, "file"
+}
+
+func createBudgetError(result *SizeBudgetResult) error {
+	var s strings.Builder
+	s.WriteString("size budget is exceeded:")
+	for _, violation := range result.Violations {
+		s.WriteString("\n  " + violation.Target)
+		if violation.Arch != "" {
+			s.WriteString(" (" + violation.Arch + ")")
+		}
+		if violation.File != "" {
+			s.WriteString(" " + violation.File)
+		}
+		s.WriteString(": " + humanize.Bytes(uint64(violation.Size)) + " > " + humanize.Bytes(uint64(violation.Budget)) +
+			" (+" + humanize.Bytes(uint64(violation.Size-violation.Budget)) + ")")
+	}
+	if len(result.Contributors) != 0 {
+		s.WriteString("\nlargest contributors (uncompressed):")
+		for _, contributor := range result.Contributors {
+			s.WriteString("\n  " + humanize.Bytes(uint64(contributor.Size)) + "  " + contributor.Name + " (" + strings.Join(contributor.Locations, ", ") + ")")
+		}
+	}
+	return util.NewMessageError(s.String(), "ERR_SIZE_BUDGET_EXCEEDED")
+}
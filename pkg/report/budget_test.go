@@ -0,0 +1,89 @@
+package report
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/asar"
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+)
+
+func TestParseSizeBudget(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	budget, err := ParseSizeBudget([]string{"300MiB", "nsis=100MB"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(budget).To(Equal(SizeBudget{"total": 300 * 1024 * 1024, "nsis": 100 * 1000 * 1000}))
+
+	_, err = ParseSizeBudget([]string{"nsis=big"})
+	g.Expect(err).To(MatchError(ContainSubstring("size budget nsis=big is invalid")))
+	_, err = ParseSizeBudget([]string{"=10MB"})
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestSizeBudget(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "report")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	writeFile := func(file string, size int) {
+		g.Expect(os.MkdirAll(filepath.Dir(file), 0755)).To(Succeed())
+		g.Expect(ioutil.WriteFile(file, make([]byte, size), 0644)).To(Succeed())
+	}
+
+	appDir := filepath.Join(dir, "app")
+	writeFile(filepath.Join(appDir, "main.js"), 100)
+	writeFile(filepath.Join(appDir, "node_modules", "big", "index.js"), 5000)
+	writeFile(filepath.Join(appDir, "node_modules", "big", "node_modules", "nested", "index.js"), 700)
+	writeFile(filepath.Join(appDir, "node_modules", "@scope", "native", "index.js"), 300)
+	writeFile(filepath.Join(appDir, "node_modules", "@scope", "native", "build", "addon.node"), 2000)
+	resourcesDir := filepath.Join(dir, "resources")
+	_, err = asar.Pack(asar.PackOptions{Dir: appDir, Output: filepath.Join(resourcesDir, "app.asar"), Unpack: []string{"*.node"}})
+	g.Expect(err).NotTo(HaveOccurred())
+	writeFile(filepath.Join(resourcesDir, "locales", "en.pak"), 1000)
+
+	outDir := filepath.Join(dir, "out")
+	writeFile(filepath.Join(outDir, "App Setup.exe"), 150)
+	writeFile(filepath.Join(outDir, "App.dmg"), 100)
+
+	report := &Report{
+		ProductName: "App",
+		Version:     "1.0.0",
+		Artifacts: []*Artifact{
+			{Target: "nsis", Arch: "x64", File: "App Setup.exe"},
+			{Target: "dmg", Arch: "x64", File: "App.dmg"},
+		},
+	}
+	output := filepath.Join(dir, "report.html")
+	options := &ReportOptions{outDir: outDir, output: output, sizeBudget: SizeBudget{"nsis": 120, "dmg": 120, "total": 200}, resourcesDir: resourcesDir, contributorCount: 3}
+	err = Generate(report, options)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.(interface{ ErrorCode() string }).ErrorCode()).To(Equal("ERR_SIZE_BUDGET_EXCEEDED"))
+	g.Expect(err.Error()).To(Equal(`size budget is exceeded:
+  nsis (x64) App Setup.exe: 150 B > 120 B (+30 B)
+  total: 250 B > 200 B (+50 B)
+largest contributors (uncompressed):
+  5.0 kB  big (asar)
+  2.3 kB  @scope/native (asar, unpacked)
+  1.0 kB  resources/locales/en.pak (resources)`))
+
+	g.Expect(report.SizeBudget.Contributors[1]).To(Equal(&Contributor{Name: "@scope/native", Kind: "package", Locations: []string{"asar", "unpacked"}, Size: 2300, FileCount: 2}))
+
+	// report is written in any case
+	data, err := ioutil.ReadFile(output)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(data)).To(ContainSubstring(`<tr><td>nsis</td><td>x64</td><td>App Setup.exe</td><td class="number increase">150 B</td><td class="number">120 B</td></tr>`))
+	g.Expect(string(data)).To(ContainSubstring(`<tr><td><code>big</code></td><td>package</td><td>asar</td><td class="number">1</td><td class="number">5.0 kB</td></tr>`))
+
+	// within budget
+	report.SizeBudget = nil
+	options.sizeBudget = SizeBudget{"nsis": 150, "total": 300}
+	g.Expect(Generate(report, options)).To(Succeed())
+	g.Expect(report.SizeBudget).To(BeNil())
+}
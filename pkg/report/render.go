@@ -0,0 +1,311 @@
+package report
+
+import (
+	"bytes"
+	"html/template"
+	"strings"
+	"time"
+
+	"github.com/develar/errors"
+	"github.com/dustin/go-humanize"
+	"github.com/json-iterator/go"
+)
+
+type reportView struct {
+	*Report
+
+	Targets   []string
+	TotalSize string
+	// empty if no previous report
+	TotalDelta      *sizeDelta
+	PreviousVersion string
+
+	Artifacts []*artifactView
+	// artifacts of the previous build that are not produced anymore
+	Removed []*Artifact
+	Timings []*timingView
+
+	Violations   []*violationView
+	Contributors []*contributorView
+
+	Data template.JS
+}
+
+type artifactView struct {
+	*Artifact
+	SizeText string
+	Delta    *sizeDelta
+}
+
+type sizeDelta struct {
+	Text string
+	// increase, decrease, same or new (CSS class)
+	Kind string
+}
+
+type violationView struct {
+	*BudgetViolation
+	SizeText   string
+	BudgetText string
+}
+
+type contributorView struct {
+	*Contributor
+	SizeText  string
+	Locations string
+}
+
+type timingView struct {
+	Name     string
+	Duration string
+	Percent  int64
+}
+
+func renderReport(report *Report, previous *Report) ([]byte, error) {
+	// JSON is HTML-escaped by the standard library compatible config, so, it cannot close the script element
+	data, err := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(report)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	view := &reportView{
+		Report:  report,
+		Targets: collectTargets(report.Artifacts),
+		Timings: createTimingViews(report.Timings),
+		Data:    template.JS(data),
+	}
+
+	var previousArtifacts map[string]*Artifact
+	if previous != nil {
+		view.PreviousVersion = previous.Version
+		previousArtifacts = make(map[string]*Artifact, len(previous.Artifacts))
+		for _, artifact := range previous.Artifacts {
+			previousArtifacts[artifactKey(artifact, previous.Version)] = artifact
+		}
+	}
+
+	var totalSize int64
+	var previousTotalSize int64
+	for _, artifact := range report.Artifacts {
+		totalSize += artifact.Size
+		row := &artifactView{Artifact: artifact, SizeText: humanize.Bytes(uint64(artifact.Size))}
+		if previousArtifacts != nil {
+			key := artifactKey(artifact, report.Version)
+			previousArtifact := previousArtifacts[key]
+			if previousArtifact == nil {
+				row.Delta = &sizeDelta{Text: "new", Kind: "new"}
+			} else {
+				row.Delta = computeDelta(artifact.Size, previousArtifact.Size)
+				delete(previousArtifacts, key)
+			}
+		}
+		view.Artifacts = append(view.Artifacts, row)
+	}
+	view.TotalSize = humanize.Bytes(uint64(totalSize))
+
+	if previous != nil {
+		for _, artifact := range previous.Artifacts {
+			previousTotalSize += artifact.Size
+			if previousArtifacts[artifactKey(artifact, previous.Version)] != nil {
+				view.Removed = append(view.Removed, artifact)
+			}
+		}
+		view.TotalDelta = computeDelta(totalSize, previousTotalSize)
+	}
+
+	if report.SizeBudget != nil {
+		for _, violation := range report.SizeBudget.Violations {
+			view.Violations = append(view.Violations, &violationView{BudgetViolation: violation, SizeText: humanize.Bytes(uint64(violation.Size)), BudgetText: humanize.Bytes(uint64(violation.Budget))})
+		}
+		for _, contributor := range report.SizeBudget.Contributors {
+			view.Contributors = append(view.Contributors, &contributorView{Contributor: contributor, SizeText: humanize.Bytes(uint64(contributor.Size)), Locations: strings.Join(contributor.Locations, ", ")})
+		}
+	}
+
+	var buffer bytes.Buffer
+	err = reportTemplate.Execute(&buffer, view)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return buffer.Bytes(), nil
+}
+
+// file name usually contains version, so, version is replaced to match artifacts of different builds
+func artifactKey(artifact *Artifact, version string) string {
+	file := artifact.File
+	if version != "" {
+		file = strings.Replace(file, version, "${version}", -1)
+	}
+	return artifact.Target + "|" + artifact.Arch + "|" + file
+}
+
+func computeDelta(size int64, previousSize int64) *sizeDelta {
+	switch {
+	case size > previousSize:
+		return &sizeDelta{Text: "+" + humanize.Bytes(uint64(size-previousSize)), Kind: "increase"}
+	case size < previousSize:
+		return &sizeDelta{Text: "−" + humanize.Bytes(uint64(previousSize-size)), Kind: "decrease"}
+	default:
+		return &sizeDelta{Text: "0", Kind: "same"}
+	}
+}
+
+// target with archs in the order of appearance, e.g. "nsis (x64, ia32)"
+func collectTargets(artifacts []*Artifact) []string {
+	var names []string
+	archs := make(map[string][]string)
+	for _, artifact := range artifacts {
+		list, isAdded := archs[artifact.Target]
+		if !isAdded {
+			names = append(names, artifact.Target)
+		}
+		if artifact.Arch != "" && !containsString(list, artifact.Arch) {
+			list = append(list, artifact.Arch)
+		}
+		archs[artifact.Target] = list
+	}
+
+	result := make([]string, len(names))
+	for i, name := range names {
+		if len(archs[name]) == 0 {
+			result[i] = name
+		} else {
+			result[i] = name + " (" + strings.Join(archs[name], ", ") + ")"
+		}
+	}
+	return result
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func createTimingViews(timings []*Timing) []*timingView {
+	var max int64
+	for _, timing := range timings {
+		if timing.Duration > max {
+			max = timing.Duration
+		}
+	}
+
+	result := make([]*timingView, len(timings))
+	for i, timing := range timings {
+		percent := int64(0)
+		if max > 0 {
+			percent = timing.Duration * 100 / max
+		}
+		result[i] = &timingView{
+			Name:     timing.Name,
+			Duration: (time.Duration(timing.Duration) * time.Millisecond).String(),
+			Percent:  percent,
+		}
+	}
+	return result
+}
+
+// self-contained (inline CSS, no scripts) to be attached to CI run as is
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.ProductName}} {{.Version}} build report</title>
+<style>
+body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em; color: #24292e; }
+h1 { font-size: 1.6em; margin-bottom: 0.2em; }
+h2 { font-size: 1.2em; margin-top: 2em; border-bottom: 1px solid #e1e4e8; padding-bottom: 0.3em; }
+.meta { color: #586069; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 0.4em 0.8em; border-bottom: 1px solid #eaecef; vertical-align: top; }
+th { background: #f6f8fa; }
+td.number { text-align: right; white-space: nowrap; }
+code { font-family: SFMono-Regular, Consolas, Menlo, monospace; font-size: 0.85em; word-break: break-all; }
+.increase { color: #cb2431; }
+.decrease { color: #22863a; }
+.same { color: #586069; }
+.new { color: #0366d6; }
+.bar { background: #0366d6; height: 0.8em; min-width: 1px; }
+.warning { color: #b08800; }
+</style>
+</head>
+<body>
+<h1>{{.ProductName}} {{.Version}}</h1>
+<p class="meta">Generated at {{.GeneratedAt}}. Total size: {{.TotalSize}}{{if .TotalDelta}} (<span class="{{.TotalDelta.Kind}}">{{.TotalDelta.Text}}</span> vs {{.PreviousVersion}}){{end}}.</p>
+
+<h2>Targets</h2>
+<ul>
+{{- range .Targets}}
+<li>{{.}}</li>
+{{- end}}
+</ul>
+
+<h2>Artifacts</h2>
+<table>
+<tr><th>File</th><th>Target</th><th>Arch</th><th>Size</th>{{if .TotalDelta}}<th>Delta</th>{{end}}<th>SHA-256</th></tr>
+{{- range .Artifacts}}
+<tr>
+<td>{{if .Url}}<a href="{{.Url}}">{{.File}}</a>{{else}}{{.File}}{{end}}</td>
+<td>{{.Target}}</td>
+<td>{{.Arch}}</td>
+<td class="number">{{.SizeText}}</td>
+{{- if $.TotalDelta}}
+<td class="number {{.Delta.Kind}}">{{.Delta.Text}}</td>
+{{- end}}
+<td><code>{{.Sha256}}</code></td>
+</tr>
+{{- end}}
+</table>
+{{- if .Removed}}
+<p>Not produced anymore (compared to {{.PreviousVersion}}):</p>
+<ul>
+{{- range .Removed}}
+<li>{{.File}} ({{.Target}}{{if .Arch}}, {{.Arch}}{{end}})</li>
+{{- end}}
+</ul>
+{{- end}}
+{{- if .Violations}}
+
+<h2>Size budget exceeded</h2>
+<table>
+<tr><th>Target</th><th>Arch</th><th>File</th><th>Size</th><th>Budget</th></tr>
+{{- range .Violations}}
+<tr><td>{{.Target}}</td><td>{{.Arch}}</td><td>{{.File}}</td><td class="number increase">{{.SizeText}}</td><td class="number">{{.BudgetText}}</td></tr>
+{{- end}}
+</table>
+{{- if .Contributors}}
+<p>The largest contributors (uncompressed):</p>
+<table>
+<tr><th>Name</th><th>Kind</th><th>Location</th><th>Files</th><th>Size</th></tr>
+{{- range .Contributors}}
+<tr><td><code>{{.Name}}</code></td><td>{{.Kind}}</td><td>{{.Locations}}</td><td class="number">{{.FileCount}}</td><td class="number">{{.SizeText}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+{{- end}}
+{{- if .Timings}}
+
+<h2>Timings</h2>
+<table>
+<tr><th>Step</th><th>Duration</th><th style="width: 50%"></th></tr>
+{{- range .Timings}}
+<tr><td>{{.Name}}</td><td class="number">{{.Duration}}</td><td><div class="bar" style="width: {{.Percent}}%"></div></td></tr>
+{{- end}}
+</table>
+{{- end}}
+{{- if .Warnings}}
+
+<h2>Warnings</h2>
+<ul>
+{{- range .Warnings}}
+<li class="warning">{{.}}</li>
+{{- end}}
+</ul>
+{{- end}}
+<script type="application/json" id="report-data">{{.Data}}</script>
+</body>
+</html>
+`))
@@ -0,0 +1,190 @@
+package report
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/json-iterator/go"
+)
+
+const (
+	dataScriptStart = `<script type="application/json" id="report-data">`
+	dataScriptEnd   = `</script>`
+)
+
+// Report is embedded into HTML, so, the previous report file is enough to compute size deltas
+type Report struct {
+	ProductName string `json:"productName"`
+	Version     string `json:"version"`
+	GeneratedAt string `json:"generatedAt,omitempty"`
+
+	Artifacts []*Artifact `json:"artifacts"`
+	Timings   []*Timing   `json:"timings,omitempty"`
+	Warnings  []string    `json:"warnings,omitempty"`
+
+	// set only if size budget is exceeded
+	SizeBudget *SizeBudgetResult `json:"sizeBudget,omitempty"`
+}
+
+type Artifact struct {
+	Target string `json:"target"`
+	Arch   string `json:"arch,omitempty"`
+	// relative to the output dir
+	File string `json:"file"`
+	// download link, base URL + file if not specified
+	Url string `json:"url,omitempty"`
+
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+type Timing struct {
+	Name string `json:"name"`
+	// ms
+	Duration int64 `json:"duration"`
+}
+
+type ReportOptions struct {
+	outDir   string
+	output   string
+	previous string
+	baseUrl  string
+
+	sizeBudget SizeBudget
+	// dir with app.asar to compute the largest contributors if size budget is exceeded
+	resourcesDir     string
+	contributorCount int
+}
+
+func ConfigureCommand(app *kingpin.Application) {
+	command := app.Command("build-report", "Generate self-contained HTML build report (build info is read from stdin as JSON: productName, version, artifacts, timings, warnings).")
+
+	options := &ReportOptions{}
+	command.Flag("out-dir", "The output dir, artifact files are relative to it.").Required().ExistingDirVar(&options.outDir)
+	command.Flag("output", "The HTML report file.").Short('o').Required().StringVar(&options.output)
+	command.Flag("previous", "The HTML report of the previous build to compute size deltas.").StringVar(&options.previous)
+	command.Flag("base-url", "The base URL of published artifacts to link them.").StringVar(&options.baseUrl)
+	sizeBudget := command.Flag("size-budget", "Fail if artifact of the target is larger than the budget (TARGET=SIZE, e.g. nsis=100MB) or all artifacts are larger (SIZE), can be specified several times. "+
+		"Report is written in any case.").Strings()
+	command.Flag("resources-dir", "The resources dir of the app (with app.asar) to report the largest packages and files if size budget is exceeded.").ExistingDirVar(&options.resourcesDir)
+	command.Flag("top", "The number of the largest contributors to report.").Default("10").IntVar(&options.contributorCount)
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		var err error
+		options.sizeBudget, err = ParseSizeBudget(*sizeBudget)
+		if err != nil {
+			return err
+		}
+
+		var report Report
+		err = jsoniter.NewDecoder(os.Stdin).Decode(&report)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return Generate(&report, options)
+	})
+}
+
+// Generate writes the report, ERR_SIZE_BUDGET_EXCEEDED is returned after that if size budget is exceeded
+func Generate(report *Report, options *ReportOptions) error {
+	err := computeArtifactInfo(report.Artifacts, options.outDir, options.baseUrl)
+	if err != nil {
+		return err
+	}
+
+	violations := checkSizeBudget(report.Artifacts, options.sizeBudget)
+	if len(violations) != 0 {
+		report.SizeBudget = &SizeBudgetResult{Violations: violations}
+		if options.resourcesDir != "" {
+			report.SizeBudget.Contributors, err = computeContributors(options.resourcesDir, options.contributorCount)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if report.GeneratedAt == "" {
+		report.GeneratedAt = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	var previous *Report
+	if options.previous != "" {
+		previous, err = ReadReport(options.previous)
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := renderReport(report, previous)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(options.output, data, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if report.SizeBudget != nil {
+		return createBudgetError(report.SizeBudget)
+	}
+	return nil
+}
+
+func computeArtifactInfo(artifacts []*Artifact, outDir string, baseUrl string) error {
+	return util.MapAsync(len(artifacts), func(taskIndex int) (func() error, error) {
+		artifact := artifacts[taskIndex]
+		if artifact.Url == "" && baseUrl != "" {
+			artifact.Url = strings.TrimSuffix(baseUrl, "/") + "/" + path.Base(filepath.ToSlash(artifact.File))
+		}
+		return func() error {
+			file, err := os.Open(filepath.Join(outDir, artifact.File))
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			defer util.Close(file)
+
+			hash := sha256.New()
+			artifact.Size, err = io.Copy(hash, file)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			artifact.Sha256 = hex.EncodeToString(hash.Sum(nil))
+			return nil
+		}, nil
+	})
+}
+
+// ReadReport reads report data embedded into HTML report
+func ReadReport(file string) (*Report, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	start := bytes.Index(data, []byte(dataScriptStart))
+	if start < 0 {
+		return nil, util.NewMessageError(file+" is not a build report", "ERR_REPORT_INVALID_PREVIOUS")
+	}
+	data = data[start+len(dataScriptStart):]
+	end := bytes.Index(data, []byte(dataScriptEnd))
+	if end < 0 {
+		return nil, util.NewMessageError(file+" is not a build report", "ERR_REPORT_INVALID_PREVIOUS")
+	}
+
+	var result Report
+	err = jsoniter.Unmarshal(data[:end], &result)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot parse report data of "+file)
+	}
+	return &result, nil
+}
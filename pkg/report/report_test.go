@@ -0,0 +1,82 @@
+package report
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+)
+
+func TestGenerate(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "report")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	writeFile := func(name string, size int) {
+		g.Expect(ioutil.WriteFile(filepath.Join(dir, name), make([]byte, size), 0644)).To(Succeed())
+	}
+	writeFile("App Setup 1.0.0.exe", 100)
+	writeFile("App-1.0.0.dmg", 200)
+	writeFile("App-1.0.0.AppImage", 300)
+
+	previousFile := filepath.Join(dir, "previous.html")
+	err = Generate(&Report{
+		ProductName: "App",
+		Version:     "1.0.0",
+		Artifacts: []*Artifact{
+			{Target: "nsis", Arch: "x64", File: "App Setup 1.0.0.exe"},
+			{Target: "dmg", Arch: "x64", File: "App-1.0.0.dmg"},
+			{Target: "AppImage", Arch: "x64", File: "App-1.0.0.AppImage"},
+		},
+	}, &ReportOptions{outDir: dir, output: previousFile})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	writeFile("App Setup 1.1.0.exe", 150)
+	writeFile("App-1.1.0.dmg", 120)
+	writeFile("App-1.1.0-arm64.dmg", 110)
+
+	output := filepath.Join(dir, "report.html")
+	report := &Report{
+		ProductName: "App",
+		Version:     "1.1.0",
+		Artifacts: []*Artifact{
+			{Target: "nsis", Arch: "x64", File: "App Setup 1.1.0.exe"},
+			{Target: "dmg", Arch: "x64", File: "App-1.1.0.dmg"},
+			{Target: "dmg", Arch: "arm64", File: "App-1.1.0-arm64.dmg"},
+		},
+		Timings:  []*Timing{{Name: "pack", Duration: 2000}, {Name: "sign", Duration: 500}},
+		Warnings: []string{"<script>alert(1)</script>"},
+	}
+	err = Generate(report, &ReportOptions{outDir: dir, output: output, previous: previousFile, baseUrl: "https://example.com/download/"})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(report.Artifacts[0].Size).To(Equal(int64(150)))
+	g.Expect(report.Artifacts[0].Sha256).To(HaveLen(64))
+	g.Expect(report.Artifacts[0].Url).To(Equal("https://example.com/download/App Setup 1.1.0.exe"))
+
+	data, err := ioutil.ReadFile(output)
+	g.Expect(err).NotTo(HaveOccurred())
+	html := string(data)
+	g.Expect(html).To(ContainSubstring("<li>dmg (x64, arm64)</li>"))
+	g.Expect(html).To(ContainSubstring(`<td class="number increase">&#43;50 B</td>`))
+	g.Expect(html).To(ContainSubstring(`<td class="number decrease">−80 B</td>`))
+	g.Expect(html).To(ContainSubstring(`<td class="number new">new</td>`))
+	g.Expect(html).To(ContainSubstring("<li>App-1.0.0.AppImage (AppImage, x64)</li>"))
+	g.Expect(html).To(ContainSubstring(`<div class="bar" style="width: 25%"></div>`))
+	g.Expect(html).To(ContainSubstring("&lt;script&gt;alert(1)&lt;/script&gt;"))
+	g.Expect(html).NotTo(ContainSubstring("<script>alert(1)"))
+
+	// report of this build is used as the previous for the next one
+	readReport, err := ReadReport(output)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(readReport.Version).To(Equal("1.1.0"))
+	g.Expect(readReport.Warnings).To(Equal(report.Warnings))
+	g.Expect(readReport.Artifacts).To(HaveLen(3))
+	g.Expect(readReport.Artifacts[2].Size).To(Equal(int64(110)))
+}
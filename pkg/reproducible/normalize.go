@@ -0,0 +1,72 @@
+package reproducible
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/errors"
+)
+
+// asar, zip and 7z are created by electron-builder (7za and asar module) from the staged app dir - entry times are taken from the file system,
+// so, times are normalized in place before archiving. Ordering and ownership are not stored by these formats in a build-specific way (7za and asar sort entries).
+func ConfigureNormalizeCommand(app *kingpin.Application) {
+	command := app.Command("reproducible-normalize", "Set modification time of all files in the dir to SOURCE_DATE_EPOCH (or 1980-01-01) before archiving (asar, zip, 7z).")
+	dir := command.Flag("dir", "").Required().ExistingDir()
+	format := command.Flag("format", "The archive format the dir is prepared for, used in the report.").Default("dir").String()
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		t, err := GetTime()
+		if err != nil {
+			return err
+		}
+
+		count, err := NormalizeDir(*dir, t)
+		if err != nil {
+			return err
+		}
+
+		report := NewReport(*dir, *format, t)
+		report.Add("mtime", count)
+		return report.Write()
+	})
+}
+
+// NormalizeDir sets access and modification time of all files and dirs to t, returns the number of changed entries.
+// Symbolic links are skipped - time of link itself cannot be changed (no lutimes in Go).
+func NormalizeDir(dir string, t time.Time) (int, error) {
+	count := 0
+	// dir times are set after walk, in reverse order - child is processed before parent
+	var dirs []string
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		if info.ModTime().Equal(t) {
+			return nil
+		}
+
+		count++
+		if info.IsDir() {
+			dirs = append(dirs, file)
+			return nil
+		}
+		return os.Chtimes(file, t, t)
+	})
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		err = os.Chtimes(dirs[i], t, t)
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+	}
+	return count, nil
+}
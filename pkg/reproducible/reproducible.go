@@ -0,0 +1,160 @@
+package reproducible
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/errors"
+	"github.com/json-iterator/go"
+	"go.uber.org/zap"
+)
+
+// if set, packagers normalize timestamps, file ordering, ownership and archive metadata - two builds of the same input are byte-identical.
+// Env is used instead of only flag to apply the mode to child app-builder processes (as for fake services).
+const EnvName = "APP_BUILDER_REPRODUCIBLE"
+
+// normalization reports are appended to the file (JSON array)
+const ReportEnvName = "APP_BUILDER_REPRODUCIBLE_REPORT"
+
+// 1980-01-01 - the minimal time that can be stored in zip (MS-DOS date), used if SOURCE_DATE_EPOCH is not set
+const defaultEpoch = 315532800
+
+type Report struct {
+	Output string `json:"output"`
+	Format string `json:"format"`
+	// unix time used for all timestamps
+	Time int64 `json:"time"`
+	// what was normalized to the number of affected entries
+	Normalized map[string]int `json:"normalized"`
+	// metadata that is not normalized by design (e.g. encryption salt)
+	NotNormalized []string `json:"notNormalized,omitempty"`
+}
+
+var mutex sync.Mutex
+
+func ConfigureFlag(app *kingpin.Application) {
+	var isEnabled bool
+	app.Flag("reproducible", "Normalize timestamps (SOURCE_DATE_EPOCH or 1980-01-01), file ordering, ownership and archive metadata to produce byte-identical output. Also enabled if SOURCE_DATE_EPOCH is set.").
+		PreAction(func(context *kingpin.ParseContext) error {
+			if !isEnabled {
+				return nil
+			}
+			return errors.WithStack(os.Setenv(EnvName, "true"))
+		}).
+		BoolVar(&isEnabled)
+
+	var reportFile string
+	app.Flag("reproducible-report", "Append normalization report of reproducible mode to the specified JSON file.").
+		PlaceHolder("FILE").
+		PreAction(func(context *kingpin.ParseContext) error {
+			absoluteFile, err := filepath.Abs(reportFile)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			return errors.WithStack(os.Setenv(ReportEnvName, absoluteFile))
+		}).
+		StringVar(&reportFile)
+}
+
+func IsEnabled() bool {
+	value := os.Getenv(EnvName)
+	if value == "true" || value == "1" {
+		return true
+	}
+	return len(os.Getenv("SOURCE_DATE_EPOCH")) != 0
+}
+
+// GetTime returns time to use for all timestamps in reproducible mode - SOURCE_DATE_EPOCH or 1980-01-01.
+func GetTime() (time.Time, error) {
+	sourceDateEpoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if len(sourceDateEpoch) == 0 {
+		return time.Unix(defaultEpoch, 0).UTC(), nil
+	}
+
+	result, err := strconv.ParseInt(sourceDateEpoch, 10, 64)
+	if err != nil || result < 0 {
+		return time.Time{}, errors.Errorf("invalid SOURCE_DATE_EPOCH %q: non-negative unix time is expected", sourceDateEpoch)
+	}
+	return time.Unix(result, 0).UTC(), nil
+}
+
+// GetBuildTime returns GetTime in reproducible mode and the current time otherwise.
+func GetBuildTime() (time.Time, error) {
+	if IsEnabled() {
+		return GetTime()
+	}
+	return time.Now(), nil
+}
+
+func NewReport(output string, format string, t time.Time) *Report {
+	return &Report{Output: output, Format: format, Time: t.Unix(), Normalized: make(map[string]int)}
+}
+
+func (t *Report) Add(kind string, count int) {
+	t.Normalized[kind] += count
+}
+
+// Write logs the report and appends it to the report file if specified. Existing reports are preserved, so, several commands of pipeline are reported to the same file.
+func (t *Report) Write() error {
+	kinds := make([]string, 0, len(t.Normalized))
+	for kind := range t.Normalized {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	fields := []zap.Field{zap.String("output", t.Output), zap.String("format", t.Format), zap.Int64("time", t.Time)}
+	for _, kind := range kinds {
+		fields = append(fields, zap.Int(kind, t.Normalized[kind]))
+	}
+	if len(t.NotNormalized) != 0 {
+		fields = append(fields, zap.Strings("notNormalized", t.NotNormalized))
+	}
+	log.Info("reproducible output", fields...)
+
+	file := os.Getenv(ReportEnvName)
+	if len(file) == 0 {
+		return nil
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	reports, err := ReadReports(file)
+	if err != nil {
+		return err
+	}
+	reports = append(reports, t)
+
+	// standard library config sorts map keys - stable output
+	data, err := jsoniter.ConfigCompatibleWithStandardLibrary.MarshalIndent(reports, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(ioutil.WriteFile(file, data, 0644))
+}
+
+func ReadReports(file string) ([]*Report, error) {
+	var result []*Report
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return result, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+	if len(data) == 0 {
+		return result, nil
+	}
+
+	err = jsoniter.Unmarshal(data, &result)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot parse reproducible report "+file)
+	}
+	return result, nil
+}
@@ -0,0 +1,73 @@
+package reproducible
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+)
+
+func TestGetTime(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	g.Expect(os.Unsetenv("SOURCE_DATE_EPOCH")).To(Succeed())
+	g.Expect(os.Unsetenv(EnvName)).To(Succeed())
+	g.Expect(IsEnabled()).To(BeFalse())
+
+	g.Expect(os.Setenv(EnvName, "true")).To(Succeed())
+	defer os.Unsetenv(EnvName)
+	g.Expect(IsEnabled()).To(BeTrue())
+	g.Expect(GetTime()).To(Equal(time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)))
+	g.Expect(GetBuildTime()).To(Equal(time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)))
+
+	g.Expect(os.Setenv("SOURCE_DATE_EPOCH", "1600000000")).To(Succeed())
+	defer os.Unsetenv("SOURCE_DATE_EPOCH")
+	g.Expect(GetTime()).To(Equal(time.Unix(1600000000, 0).UTC()))
+
+	g.Expect(os.Setenv("SOURCE_DATE_EPOCH", "yesterday")).To(Succeed())
+	_, err := GetTime()
+	g.Expect(err).To(MatchError(ContainSubstring("invalid SOURCE_DATE_EPOCH")))
+}
+
+func TestNormalizeDirAndReport(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "reproducible")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	appDir := filepath.Join(dir, "app")
+	g.Expect(os.MkdirAll(filepath.Join(appDir, "sub"), 0755)).To(Succeed())
+	g.Expect(ioutil.WriteFile(filepath.Join(appDir, "sub", "a.txt"), []byte("a"), 0644)).To(Succeed())
+	g.Expect(os.Symlink("sub/a.txt", filepath.Join(appDir, "link"))).To(Succeed())
+
+	epoch := time.Unix(315532800, 0)
+	g.Expect(NormalizeDir(appDir, epoch)).To(Equal(3))
+	for _, name := range []string{"", "sub", "sub/a.txt"} {
+		info, err := os.Stat(filepath.Join(appDir, name))
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(info.ModTime().Equal(epoch)).To(BeTrue(), name)
+	}
+	// already normalized
+	g.Expect(NormalizeDir(appDir, epoch)).To(Equal(0))
+
+	reportFile := filepath.Join(dir, "report.json")
+	g.Expect(os.Setenv(ReportEnvName, reportFile)).To(Succeed())
+	defer os.Unsetenv(ReportEnvName)
+
+	for _, format := range []string{"zip", "7z"} {
+		report := NewReport(appDir, format, epoch)
+		report.Add("mtime", 3)
+		g.Expect(report.Write()).To(Succeed())
+	}
+
+	reports, err := ReadReports(reportFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(reports).To(HaveLen(2))
+	g.Expect(*reports[1]).To(Equal(Report{Output: appDir, Format: "7z", Time: 315532800, Normalized: map[string]int{"mtime": 3}}))
+}
@@ -0,0 +1,277 @@
+package reputation
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/credentials"
+	"github.com/develar/app-builder/pkg/fakes"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/json-iterator/go"
+	"go.uber.org/zap"
+)
+
+const WebhookTokenCredentialName = "reputation-webhook-token"
+
+type FileHash struct {
+	Name   string `json:"name"`
+	Sha256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+type Result struct {
+	Service string `json:"service"`
+	File    string `json:"file"`
+	Sha256  string `json:"sha256"`
+	// known - service has seen the file, unknown - never seen (expected for a new build), submitted - accepted by webhook,
+	// analyzed - file is uploaded and analysis is completed, error - request failed
+	Status string `json:"status"`
+	// service specific response (e.g. VirusTotal last analysis stats)
+	Response interface{} `json:"response,omitempty"`
+	// number of engines that detect the file as malicious (VirusTotal)
+	Detections int    `json:"detections,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Service submits hashes of files (not files) to reputation service
+type Service interface {
+	Name() string
+	Submit(requestContext context.Context, files []*FileHash) ([]*Result, error)
+}
+
+type PrewarmOptions struct {
+	files    []string
+	services []string
+	// JSON report, stdout if not specified
+	report string
+
+	webhookUrl string
+}
+
+// New signing certificate has no reputation - SmartScreen and AV warnings are expected for the first downloads.
+// Hashes of final installers are submitted right after build, response is recorded to warn team before release.
+func ConfigurePrewarmCommand(app *kingpin.Application) {
+	command := app.Command("reputation-prewarm", "Submit hashes (not files) of final installers to reputation services and record the response. "+
+		"VirusTotal API key is taken from "+credentials.ToEnvName(VirusTotalApiKeyCredentialName)+" env or credentials helper.")
+
+	options := &PrewarmOptions{}
+	command.Flag("file", "The installer file.").Short('f').Required().ExistingFilesVar(&options.files)
+	command.Flag("service", "The reputation service.").Required().EnumsVar(&options.services, "virustotal", "webhook")
+	command.Flag("webhook-url", "The URL to POST hashes to (JSON, Authorization: Bearer "+credentials.ToEnvName(WebhookTokenCredentialName)+" if set).").StringVar(&options.webhookUrl)
+	command.Flag("report", "The JSON report file (stdout if not specified).").StringVar(&options.report)
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		return Prewarm(options)
+	})
+}
+
+// Prewarm never fails because of service response - reputation is an early warning, not a gate
+func Prewarm(options *PrewarmOptions) error {
+	services, err := createServices(options)
+	if err != nil {
+		return err
+	}
+
+	files, err := computeHashes(options.files)
+	if err != nil {
+		return err
+	}
+
+	var results []*Result
+	if fakes.IsEnabled() {
+		for _, service := range services {
+			err = fakes.Record(fakes.ServiceReputation, "Submit", map[string]interface{}{
+				"service": service.Name(),
+				"files":   files,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		requestContext, cancel := util.CreateContextWithTimeout(5 * time.Minute)
+		defer cancel()
+
+		for _, service := range services {
+			serviceResults, err := service.Submit(requestContext, files)
+			if err != nil {
+				log.Warn("cannot submit hashes to reputation service", zap.String("service", service.Name()), zap.Error(err))
+				for _, file := range files {
+					serviceResults = append(serviceResults, &Result{Service: service.Name(), File: file.Name, Sha256: file.Sha256, Status: "error", Error: err.Error()})
+				}
+			}
+			results = append(results, serviceResults...)
+		}
+		logResults(results)
+	}
+	return writeReport(results, options.report)
+}
+
+func createServices(options *PrewarmOptions) ([]Service, error) {
+	var result []Service
+	for _, name := range options.services {
+		switch name {
+		case "virustotal":
+			result = append(result, &virusTotal{apiUrl: virusTotalApiUrl})
+		case "webhook":
+			if options.webhookUrl == "" {
+				return nil, util.NewMessageError("webhook URL must be specified", "ERR_REPUTATION_INVALID_OPTIONS")
+			}
+			result = append(result, &webhook{url: options.webhookUrl})
+		}
+	}
+	return result, nil
+}
+
+func computeHashes(files []string) ([]*FileHash, error) {
+	result := make([]*FileHash, len(files))
+	err := util.MapAsync(len(files), func(taskIndex int) (func() error, error) {
+		file := files[taskIndex]
+		return func() error {
+			reader, err := os.Open(file)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			defer util.Close(reader)
+
+			hash := sha256.New()
+			size, err := io.Copy(hash, reader)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			result[taskIndex] = &FileHash{Name: filepath.Base(file), Sha256: hex.EncodeToString(hash.Sum(nil)), Size: size}
+			return nil
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func logResults(results []*Result) {
+	for _, result := range results {
+		fields := []zap.Field{zap.String("service", result.Service), zap.String("file", result.File), zap.String("status", result.Status)}
+		if result.Status == "error" {
+			log.Warn("reputation check failed", append(fields, zap.String("error", result.Error))...)
+		} else {
+			log.Info("reputation", fields...)
+		}
+	}
+}
+
+func writeReport(results []*Result, file string) error {
+	if results == nil {
+		results = []*Result{}
+	}
+
+	data, err := jsoniter.ConfigCompatibleWithStandardLibrary.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if file == "" {
+		_, err = os.Stdout.Write(data)
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(ioutil.WriteFile(file, data, 0644))
+}
+
+// webhook receives {"files": [{"name", "sha256", "size"}]} and may respond with any JSON, it is recorded as is
+type webhook struct {
+	url string
+}
+
+func (t *webhook) Name() string {
+	return "webhook"
+}
+
+func (t *webhook) Submit(requestContext context.Context, files []*FileHash) ([]*Result, error) {
+	body, err := jsoniter.Marshal(map[string]interface{}{"files": files})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	headers := map[string]string{"Content-Type": "application/json"}
+	token, err := credentials.Get(WebhookTokenCredentialName)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		headers["Authorization"] = "Bearer " + token
+	}
+
+	statusCode, responseBody, err := doRequest(requestContext, http.MethodPost, t.url, body, headers)
+	if err != nil {
+		return nil, err
+	}
+	if statusCode < 200 || statusCode >= 300 {
+		return nil, errors.Errorf("webhook responded with %d: %s", statusCode, strings.TrimSpace(string(responseBody)))
+	}
+
+	var response interface{}
+	if len(bytes.TrimSpace(responseBody)) != 0 {
+		err = jsoniter.Unmarshal(responseBody, &response)
+		if err != nil {
+			response = string(responseBody)
+		}
+	}
+
+	result := make([]*Result, len(files))
+	for i, file := range files {
+		result[i] = &Result{Service: t.Name(), File: file.Name, Sha256: file.Sha256, Status: "submitted", Response: response}
+	}
+	return result, nil
+}
+
+func doRequest(requestContext context.Context, method string, url string, body []byte, headers map[string]string) (int, []byte, error) {
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	return doStreamRequest(requestContext, method, url, bodyReader, headers)
+}
+
+// doStreamRequest is the same as doRequest, but body is not buffered (uploaded file)
+func doStreamRequest(requestContext context.Context, method string, url string, bodyReader io.Reader, headers map[string]string) (int, []byte, error) {
+	request, err := http.NewRequest(method, url, bodyReader)
+	if err != nil {
+		return 0, nil, errors.WithStack(err)
+	}
+
+	request = request.WithContext(requestContext)
+	request.Header.Set("Accept", "application/json")
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: util.ProxyFromEnvironmentAndNpm,
+		},
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return 0, nil, errors.WithStack(err)
+	}
+	defer util.Close(response.Body)
+
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return 0, nil, errors.WithStack(err)
+	}
+	return response.StatusCode, responseBody, nil
+}
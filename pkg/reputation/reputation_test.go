@@ -0,0 +1,184 @@
+package reputation
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/json-iterator/go"
+	. "github.com/onsi/gomega"
+)
+
+func TestPrewarm(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "reputation")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	knownFile := filepath.Join(dir, "known.exe")
+	g.Expect(ioutil.WriteFile(knownFile, []byte("known"), 0644)).To(Succeed())
+	newFile := filepath.Join(dir, "new.exe")
+	g.Expect(ioutil.WriteFile(newFile, []byte("new"), 0644)).To(Succeed())
+
+	files, err := computeHashes([]string{knownFile})
+	g.Expect(err).NotTo(HaveOccurred())
+	knownHash := files[0].Sha256
+
+	var webhookBody string
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch {
+		case request.URL.Path == "/vt/files/"+knownHash:
+			g.Expect(request.Header.Get("x-apikey")).To(Equal("key"))
+			_, _ = writer.Write([]byte(`{"data": {"attributes": {"last_analysis_stats": {"malicious": 1, "undetected": 60}, "reputation": -3, "times_submitted": 2}}}`))
+		case strings.HasPrefix(request.URL.Path, "/vt/files/"):
+			writer.WriteHeader(http.StatusNotFound)
+		case request.URL.Path == "/webhook":
+			g.Expect(request.Header.Get("Authorization")).To(Equal("Bearer token"))
+			body, _ := ioutil.ReadAll(request.Body)
+			webhookBody = string(body)
+			_, _ = writer.Write([]byte(`{"queued": true}`))
+		default:
+			writer.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	virusTotalApiUrl = server.URL + "/vt"
+	_ = os.Setenv("APP_BUILDER_VIRUSTOTAL_API_KEY", "key")
+	_ = os.Setenv("APP_BUILDER_REPUTATION_WEBHOOK_TOKEN", "token")
+	defer os.Unsetenv("APP_BUILDER_VIRUSTOTAL_API_KEY")
+	defer os.Unsetenv("APP_BUILDER_REPUTATION_WEBHOOK_TOKEN")
+
+	reportFile := filepath.Join(dir, "report.json")
+	err = Prewarm(&PrewarmOptions{
+		files:      []string{knownFile, newFile},
+		services:   []string{"virustotal", "webhook"},
+		webhookUrl: server.URL + "/webhook",
+		report:     reportFile,
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(webhookBody).To(ContainSubstring(`"name":"new.exe"`))
+
+	data, err := ioutil.ReadFile(reportFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	var results []*Result
+	g.Expect(jsoniter.Unmarshal(data, &results)).To(Succeed())
+	g.Expect(results).To(HaveLen(4))
+	g.Expect(results[0].Status).To(Equal("known"))
+	g.Expect(results[0].Response).To(HaveKeyWithValue("reputation", BeNumerically("==", -3)))
+	g.Expect(results[1].Status).To(Equal("unknown"))
+	g.Expect(results[2].Status).To(Equal("submitted"))
+	g.Expect(results[3].Response).To(Equal(map[string]interface{}{"queued": true}))
+
+	// service failure is recorded, not returned
+	err = Prewarm(&PrewarmOptions{
+		files:      []string{newFile},
+		services:   []string{"webhook"},
+		webhookUrl: server.URL + "/unknown",
+		report:     reportFile,
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	data, err = ioutil.ReadFile(reportFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(data)).To(ContainSubstring(`"status": "error"`))
+}
+
+func TestScan(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "reputation")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	knownFile := filepath.Join(dir, "known.exe")
+	g.Expect(ioutil.WriteFile(knownFile, []byte("known"), 0644)).To(Succeed())
+	newFile := filepath.Join(dir, "new.msi")
+	g.Expect(ioutil.WriteFile(newFile, []byte("new"), 0644)).To(Succeed())
+	dmgFile := filepath.Join(dir, "app.dmg")
+	g.Expect(ioutil.WriteFile(dmgFile, []byte("dmg"), 0644)).To(Succeed())
+
+	files, err := computeHashes([]string{knownFile})
+	g.Expect(err).NotTo(HaveOccurred())
+	knownHash := files[0].Sha256
+
+	var uploadedName string
+	var uploadedContent string
+	analysisRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		g.Expect(request.Header.Get("x-apikey")).To(Equal("key"))
+		switch {
+		case request.URL.Path == "/vt/files/"+knownHash:
+			_, _ = writer.Write([]byte(`{"data": {"attributes": {"last_analysis_stats": {"malicious": 2, "undetected": 60}}}}`))
+		case strings.HasPrefix(request.URL.Path, "/vt/files/"):
+			g.Expect(request.URL.Path).NotTo(HaveSuffix("app.dmg"))
+			writer.WriteHeader(http.StatusNotFound)
+		case request.URL.Path == "/vt/files" && request.Method == http.MethodPost:
+			file, header, err := request.FormFile("file")
+			g.Expect(err).NotTo(HaveOccurred())
+			content, _ := ioutil.ReadAll(file)
+			uploadedName = header.Filename
+			uploadedContent = string(content)
+			_, _ = writer.Write([]byte(`{"data": {"type": "analysis", "id": "a1"}}`))
+		case request.URL.Path == "/vt/analyses/a1":
+			analysisRequests++
+			if analysisRequests == 1 {
+				_, _ = writer.Write([]byte(`{"data": {"attributes": {"status": "queued"}}}`))
+			} else {
+				_, _ = writer.Write([]byte(`{"data": {"attributes": {"status": "completed", "stats": {"malicious": 0, "undetected": 70}}}}`))
+			}
+		default:
+			writer.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	virusTotalApiUrl = server.URL + "/vt"
+	virusTotalPollInterval = time.Millisecond
+	_ = os.Setenv("APP_BUILDER_VIRUSTOTAL_API_KEY", "key")
+	defer os.Unsetenv("APP_BUILDER_VIRUSTOTAL_API_KEY")
+
+	reportFile := filepath.Join(dir, "report.json")
+	options := &ScanOptions{files: []string{knownFile, newFile, dmgFile}, isUpload: true, maxDetections: 1, timeout: time.Minute, report: reportFile}
+	err = Scan(options)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.(interface{ ErrorCode() string }).ErrorCode()).To(Equal("ERR_VIRUSTOTAL_DETECTIONS_EXCEEDED"))
+	g.Expect(err.Error()).To(ContainSubstring("known.exe: 2 engines"))
+	g.Expect(uploadedName).To(Equal("new.msi"))
+	g.Expect(uploadedContent).To(Equal("new"))
+
+	// report is written in any case
+	data, err := ioutil.ReadFile(reportFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	var results []*Result
+	g.Expect(jsoniter.Unmarshal(data, &results)).To(Succeed())
+	g.Expect(results).To(HaveLen(2))
+	g.Expect(results[0].Detections).To(Equal(2))
+	g.Expect(results[1].Status).To(Equal("analyzed"))
+	g.Expect(analysisRequests).To(Equal(2))
+
+	// hashes only, within threshold, but unknown file is not analyzed
+	options.isUpload = false
+	options.maxDetections = 2
+	err = Scan(options)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.(interface{ ErrorCode() string }).ErrorCode()).To(Equal("ERR_VIRUSTOTAL_SCAN_FAILED"))
+	g.Expect(err.Error()).To(ContainSubstring("new.msi: unknown to VirusTotal"))
+	data, err = ioutil.ReadFile(reportFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(data)).To(ContainSubstring(`"status": "unknown"`))
+
+	// report only
+	options.maxDetections = -1
+	g.Expect(Scan(options)).To(Succeed())
+
+	g.Expect(checkDetections([]*Result{{File: "a.exe", Status: "error", Error: "timeout"}}, 0)).To(MatchError(ContainSubstring("a.exe: timeout")))
+}
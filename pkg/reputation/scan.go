@@ -0,0 +1,135 @@
+package reputation
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/credentials"
+	"github.com/develar/app-builder/pkg/fakes"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"go.uber.org/zap"
+)
+
+// installers and binaries scanned by AV on Windows, other artifacts (dmg, AppImage, blockmap, yml) are skipped
+var windowsArtifactExtensions = []string{".exe", ".msi", ".msix", ".msixbundle", ".appx", ".appxbundle", ".dll", ".nupkg"}
+
+type ScanOptions struct {
+	files []string
+	// upload files unknown to VirusTotal (only hashes are sent by default)
+	isUpload bool
+	// build fails if more engines detect any file, -1 - report only
+	maxDetections int
+	timeout       time.Duration
+	// JSON report, stdout if not specified
+	report string
+}
+
+// ConfigureScanCommand registers reputation-scan - unlike prewarm, it is a release gate if --max-detections is specified
+func ConfigureScanCommand(app *kingpin.Application) {
+	command := app.Command("reputation-scan", "Check produced Windows artifacts on VirusTotal before release: hashes are looked up (files are uploaded only with --upload) and detections are reported. "+
+		"VirusTotal API key is taken from "+credentials.ToEnvName(VirusTotalApiKeyCredentialName)+" env or credentials helper.")
+
+	options := &ScanOptions{}
+	command.Flag("file", "The artifact file (not Windows artifacts are skipped).").Short('f').Required().ExistingFilesVar(&options.files)
+	command.Flag("upload", "Upload files unknown to VirusTotal and wait for analysis (the files become available to VirusTotal partners).").BoolVar(&options.isUpload)
+	command.Flag("max-detections", "Fail if the number of engines detecting any file as malicious is greater (or file cannot be checked, unknown file is checked only with --upload). By default detections are only reported.").Default("-1").IntVar(&options.maxDetections)
+	command.Flag("timeout", "The timeout of the scan (including waiting for analysis of uploaded files).").Default("20m").DurationVar(&options.timeout)
+	command.Flag("report", "The JSON report file (stdout if not specified).").StringVar(&options.report)
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		return Scan(options)
+	})
+}
+
+func Scan(options *ScanOptions) error {
+	var files []string
+	for _, file := range options.files {
+		if isWindowsArtifact(file) {
+			files = append(files, file)
+		} else {
+			log.Debug("not a Windows artifact, skipped", zap.String("file", file))
+		}
+	}
+
+	hashes, err := computeHashes(files)
+	if err != nil {
+		return err
+	}
+
+	if fakes.IsEnabled() {
+		err = fakes.Record(fakes.ServiceReputation, "Scan", map[string]interface{}{
+			"files":  hashes,
+			"upload": options.isUpload,
+		})
+		if err != nil {
+			return err
+		}
+		return writeReport(nil, options.report)
+	}
+
+	var results []*Result
+	if len(hashes) != 0 {
+		apiKey, err := credentials.GetRequired(VirusTotalApiKeyCredentialName)
+		if err != nil {
+			return err
+		}
+
+		requestContext, cancel := util.CreateContextWithTimeout(options.timeout)
+		defer cancel()
+
+		service := &virusTotal{apiUrl: virusTotalApiUrl}
+		for i, fileHash := range hashes {
+			result := service.lookup(requestContext, fileHash, apiKey)
+			if result.Status == "unknown" {
+				if options.isUpload {
+					result = service.upload(requestContext, files[i], fileHash, apiKey)
+				} else {
+					log.Info("file is unknown to VirusTotal, use --upload to scan it", zap.String("file", fileHash.Name))
+				}
+			}
+			results = append(results, result)
+		}
+		logResults(results)
+	}
+
+	// report is written in any case
+	err = writeReport(results, options.report)
+	if err != nil {
+		return err
+	}
+	if options.maxDetections < 0 {
+		return nil
+	}
+	return checkDetections(results, options.maxDetections)
+}
+
+func isWindowsArtifact(file string) bool {
+	return util.ContainsString(windowsArtifactExtensions, strings.ToLower(filepath.Ext(file)))
+}
+
+// file that cannot be checked fails the gate - release must not pass because VirusTotal is not available or file was not analyzed (unknown and not uploaded)
+func checkDetections(results []*Result, maxDetections int) error {
+	var detected []string
+	var failed []string
+	for _, result := range results {
+		if result.Status == "error" {
+			failed = append(failed, "  "+result.File+": "+result.Error)
+		} else if result.Status == "unknown" {
+			failed = append(failed, "  "+result.File+": unknown to VirusTotal (use --upload to analyze it)")
+		} else if result.Detections > maxDetections {
+			detected = append(detected, "  "+result.File+": "+strconv.Itoa(result.Detections)+" engines")
+		}
+	}
+
+	if len(detected) != 0 {
+		return util.NewMessageError("files are detected as malicious by more than "+strconv.Itoa(maxDetections)+" VirusTotal engines:\n"+strings.Join(detected, "\n"), "ERR_VIRUSTOTAL_DETECTIONS_EXCEEDED")
+	}
+	if len(failed) != 0 {
+		return util.NewMessageError("files cannot be checked on VirusTotal:\n"+strings.Join(failed, "\n"), "ERR_VIRUSTOTAL_SCAN_FAILED")
+	}
+	return nil
+}
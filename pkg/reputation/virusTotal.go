@@ -0,0 +1,230 @@
+package reputation
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/develar/app-builder/pkg/credentials"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/json-iterator/go"
+	"go.uber.org/zap"
+)
+
+const VirusTotalApiKeyCredentialName = "virustotal-api-key"
+
+// overridden in tests
+var virusTotalApiUrl = "https://www.virustotal.com/api/v3"
+
+// public API quota is 4 requests per minute
+var virusTotalPollInterval = 30 * time.Second
+
+// larger files are uploaded to the special upload URL (up to 650 MB)
+const virusTotalMaxDirectUploadSize = 32 * 1024 * 1024
+
+// https://docs.virustotal.com/reference/file-info - lookup by hash, file is not uploaded
+type virusTotal struct {
+	apiUrl string
+}
+
+type virusTotalFileReport struct {
+	Data struct {
+		Attributes struct {
+			LastAnalysisStats map[string]int `json:"last_analysis_stats"`
+			Reputation        int            `json:"reputation"`
+			TimesSubmitted    int            `json:"times_submitted"`
+		} `json:"attributes"`
+	} `json:"data"`
+}
+
+func (t *virusTotal) Name() string {
+	return "virustotal"
+}
+
+func (t *virusTotal) Submit(requestContext context.Context, files []*FileHash) ([]*Result, error) {
+	apiKey, err := credentials.GetRequired(VirusTotalApiKeyCredentialName)
+	if err != nil {
+		return nil, err
+	}
+
+	// public API quota is 4 requests per minute, so, sequentially
+	result := make([]*Result, 0, len(files))
+	for _, file := range files {
+		result = append(result, t.lookup(requestContext, file, apiKey))
+	}
+	return result, nil
+}
+
+func (t *virusTotal) lookup(requestContext context.Context, file *FileHash, apiKey string) *Result {
+	result := &Result{Service: t.Name(), File: file.Name, Sha256: file.Sha256}
+	statusCode, body, err := doRequest(requestContext, http.MethodGet, t.apiUrl+"/files/"+file.Sha256, nil, map[string]string{"x-apikey": apiKey})
+	if err != nil {
+		result.Status = "error"
+		result.Error = err.Error()
+		return result
+	}
+
+	switch statusCode {
+	case http.StatusOK:
+		var report virusTotalFileReport
+		err = jsoniter.Unmarshal(body, &report)
+		if err != nil {
+			result.Status = "error"
+			result.Error = errors.WithMessage(err, "cannot parse VirusTotal response").Error()
+			return result
+		}
+
+		attributes := report.Data.Attributes
+		result.Status = "known"
+		result.Detections = attributes.LastAnalysisStats["malicious"]
+		result.Response = map[string]interface{}{
+			"lastAnalysisStats": attributes.LastAnalysisStats,
+			"reputation":        attributes.Reputation,
+			"timesSubmitted":    attributes.TimesSubmitted,
+		}
+		if attributes.LastAnalysisStats["malicious"] > 0 || attributes.LastAnalysisStats["suspicious"] > 0 {
+			log.Warn("file is flagged by VirusTotal engines", zap.String("file", file.Name), zap.String("stats", formatStats(attributes.LastAnalysisStats)))
+		}
+	case http.StatusNotFound:
+		// never seen - expected for a new build
+		result.Status = "unknown"
+	default:
+		result.Status = "error"
+		result.Error = fmt.Sprintf("VirusTotal responded with %d: %s", statusCode, strings.TrimSpace(string(body)))
+	}
+	return result
+}
+
+func formatStats(stats map[string]int) string {
+	return fmt.Sprintf("%d malicious, %d suspicious, %d harmless, %d undetected", stats["malicious"], stats["suspicious"], stats["harmless"], stats["undetected"])
+}
+
+type virusTotalAnalysis struct {
+	Data struct {
+		Id         string `json:"id"`
+		Attributes struct {
+			// queued, in-progress or completed
+			Status string         `json:"status"`
+			Stats  map[string]int `json:"stats"`
+		} `json:"attributes"`
+	} `json:"data"`
+}
+
+// https://docs.virustotal.com/reference/files-scan - the file itself is uploaded, so, only if user opted in
+func (t *virusTotal) upload(requestContext context.Context, file string, fileHash *FileHash, apiKey string) *Result {
+	result := &Result{Service: t.Name(), File: fileHash.Name, Sha256: fileHash.Sha256}
+	analysisId, err := t.uploadFile(requestContext, file, fileHash, apiKey)
+	if err == nil {
+		log.Info("file is uploaded to VirusTotal, waiting for analysis", zap.String("file", fileHash.Name))
+		err = t.waitForAnalysis(requestContext, analysisId, apiKey, result)
+	}
+	if err != nil {
+		result.Status = "error"
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func (t *virusTotal) uploadFile(requestContext context.Context, file string, fileHash *FileHash, apiKey string) (string, error) {
+	headers := map[string]string{"x-apikey": apiKey}
+	uploadUrl := t.apiUrl + "/files"
+	if fileHash.Size > virusTotalMaxDirectUploadSize {
+		statusCode, body, err := doRequest(requestContext, http.MethodGet, t.apiUrl+"/files/upload_url", nil, headers)
+		if err != nil {
+			return "", err
+		}
+		if statusCode != http.StatusOK {
+			return "", errors.Errorf("VirusTotal responded with %d: %s", statusCode, strings.TrimSpace(string(body)))
+		}
+		var response struct {
+			Data string `json:"data"`
+		}
+		err = jsoniter.Unmarshal(body, &response)
+		if err != nil {
+			return "", errors.WithMessage(err, "cannot parse VirusTotal response")
+		}
+		uploadUrl = response.Data
+	}
+
+	reader, writer := io.Pipe()
+	multipartWriter := multipart.NewWriter(writer)
+	go func() {
+		writer.CloseWithError(writeMultipartFile(multipartWriter, file, fileHash.Name))
+	}()
+
+	headers["Content-Type"] = multipartWriter.FormDataContentType()
+	statusCode, body, err := doStreamRequest(requestContext, http.MethodPost, uploadUrl, reader, headers)
+	// unblock writer if request failed before body was read
+	_ = reader.Close()
+	if err != nil {
+		return "", err
+	}
+	if statusCode != http.StatusOK {
+		return "", errors.Errorf("VirusTotal responded with %d: %s", statusCode, strings.TrimSpace(string(body)))
+	}
+
+	var analysis virusTotalAnalysis
+	err = jsoniter.Unmarshal(body, &analysis)
+	if err != nil {
+		return "", errors.WithMessage(err, "cannot parse VirusTotal response")
+	}
+	return analysis.Data.Id, nil
+}
+
+func writeMultipartFile(multipartWriter *multipart.Writer, file string, name string) error {
+	reader, err := os.Open(file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(reader)
+
+	part, err := multipartWriter.CreateFormFile("file", name)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = io.Copy(part, reader)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(multipartWriter.Close())
+}
+
+func (t *virusTotal) waitForAnalysis(requestContext context.Context, analysisId string, apiKey string, result *Result) error {
+	for {
+		select {
+		case <-requestContext.Done():
+			return errors.New("analysis is not completed in time")
+		case <-time.After(virusTotalPollInterval):
+		}
+
+		statusCode, body, err := doRequest(requestContext, http.MethodGet, t.apiUrl+"/analyses/"+analysisId, nil, map[string]string{"x-apikey": apiKey})
+		if err != nil {
+			return err
+		}
+		if statusCode != http.StatusOK {
+			return errors.Errorf("VirusTotal responded with %d: %s", statusCode, strings.TrimSpace(string(body)))
+		}
+
+		var analysis virusTotalAnalysis
+		err = jsoniter.Unmarshal(body, &analysis)
+		if err != nil {
+			return errors.WithMessage(err, "cannot parse VirusTotal response")
+		}
+
+		attributes := analysis.Data.Attributes
+		if attributes.Status == "completed" {
+			result.Status = "analyzed"
+			result.Detections = attributes.Stats["malicious"]
+			result.Response = map[string]interface{}{"lastAnalysisStats": attributes.Stats}
+			return nil
+		}
+		log.Debug("VirusTotal analysis is not completed", zap.String("file", result.File), zap.String("status", attributes.Status))
+	}
+}
@@ -0,0 +1,147 @@
+package sbom
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/develar/errors"
+	"github.com/json-iterator/go"
+)
+
+type cycloneDxBom struct {
+	BomFormat    string                 `json:"bomFormat"`
+	SpecVersion  string                 `json:"specVersion"`
+	SerialNumber string                 `json:"serialNumber"`
+	Version      int                    `json:"version"`
+	Metadata     *cycloneDxMetadata     `json:"metadata"`
+	Components   []*cycloneDxComponent  `json:"components"`
+	Dependencies []*cycloneDxDependency `json:"dependencies"`
+}
+
+type cycloneDxMetadata struct {
+	Timestamp string              `json:"timestamp"`
+	Tools     *cycloneDxTools     `json:"tools"`
+	Component *cycloneDxComponent `json:"component"`
+}
+
+type cycloneDxTools struct {
+	Components []*cycloneDxComponent `json:"components"`
+}
+
+type cycloneDxComponent struct {
+	Type               string                        `json:"type"`
+	BomRef             string                        `json:"bom-ref,omitempty"`
+	Name               string                        `json:"name"`
+	Version            string                        `json:"version,omitempty"`
+	Scope              string                        `json:"scope,omitempty"`
+	Hashes             []*cycloneDxHash              `json:"hashes,omitempty"`
+	Licenses           []*cycloneDxLicenseChoice     `json:"licenses,omitempty"`
+	Purl               string                        `json:"purl,omitempty"`
+	ExternalReferences []*cycloneDxExternalReference `json:"externalReferences,omitempty"`
+}
+
+type cycloneDxHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type cycloneDxLicenseChoice struct {
+	Expression string `json:"expression"`
+}
+
+type cycloneDxExternalReference struct {
+	Type string `json:"type"`
+	Url  string `json:"url"`
+}
+
+type cycloneDxDependency struct {
+	Ref       string   `json:"ref"`
+	DependsOn []string `json:"dependsOn"`
+}
+
+// RenderCycloneDx returns CycloneDX 1.5 JSON: downloaded tools are components with excluded scope (not distributed with the app)
+func RenderCycloneDx(sbom *Sbom) ([]byte, error) {
+	documentId, err := computeDocumentId(sbom)
+	if err != nil {
+		return nil, err
+	}
+
+	appRef := "app:" + sbom.App.Name
+	app := createCycloneDxComponent(sbom.App, appRef)
+	bom := &cycloneDxBom{
+		BomFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + documentId,
+		Version:      1,
+		Metadata: &cycloneDxMetadata{
+			Timestamp: sbom.Time.UTC().Format(time.RFC3339),
+			Tools:     &cycloneDxTools{Components: []*cycloneDxComponent{{Type: "application", Name: "app-builder", Version: AppVersion}}},
+			Component: app,
+		},
+		Components: []*cycloneDxComponent{},
+	}
+
+	appDependency := &cycloneDxDependency{Ref: appRef, DependsOn: []string{}}
+	refs := make(map[string]bool)
+	for _, component := range sbom.Components {
+		ref := createCycloneDxRef(component, refs)
+		bom.Components = append(bom.Components, createCycloneDxComponent(component, ref))
+		if component.Kind != KindTool {
+			appDependency.DependsOn = append(appDependency.DependsOn, ref)
+		}
+	}
+	bom.Dependencies = []*cycloneDxDependency{appDependency}
+
+	result, err := jsoniter.ConfigCompatibleWithStandardLibrary.MarshalIndent(bom, "", "  ")
+	return result, errors.WithStack(err)
+}
+
+func createCycloneDxComponent(component *Component, ref string) *cycloneDxComponent {
+	result := &cycloneDxComponent{BomRef: ref, Name: component.Name, Version: component.Version, Purl: component.Purl}
+	switch component.Kind {
+	case KindApp:
+		result.Type = "application"
+	case KindFramework:
+		result.Type = "framework"
+	case KindFile:
+		result.Type = "file"
+	case KindTool:
+		result.Type = "application"
+		result.Scope = "excluded"
+	default:
+		result.Type = "library"
+	}
+
+	for _, hash := range []struct{ alg, value string }{{"SHA-1", component.Sha1}, {"SHA-256", component.Sha256}, {"SHA-512", component.Sha512}} {
+		if hash.value != "" {
+			result.Hashes = append(result.Hashes, &cycloneDxHash{Alg: hash.alg, Content: hash.value})
+		}
+	}
+	if component.License != "" {
+		result.Licenses = []*cycloneDxLicenseChoice{{Expression: component.License}}
+	}
+	if component.DownloadUrl != "" {
+		result.ExternalReferences = []*cycloneDxExternalReference{{Type: "distribution", Url: component.DownloadUrl}}
+	}
+	return result
+}
+
+// purl for packages, kind and path (or name) otherwise
+func createCycloneDxRef(component *Component, refs map[string]bool) string {
+	base := component.Purl
+	if base == "" {
+		name := component.Path
+		if name == "" {
+			name = component.Name
+		}
+		base = component.Kind + ":" + name
+	}
+
+	// the same package with different content in several dirs
+	result := base
+	for i := 2; refs[result]; i++ {
+		result = base + "#" + strconv.Itoa(i)
+	}
+	refs[result] = true
+	return result
+}
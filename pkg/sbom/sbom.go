@@ -0,0 +1,554 @@
+package sbom
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/asar"
+	"github.com/develar/app-builder/pkg/download"
+	"github.com/develar/app-builder/pkg/reproducible"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+	"github.com/json-iterator/go"
+	"howett.net/plist"
+)
+
+// AppVersion is the version of app-builder (SBOM creator)
+var AppVersion = "dev"
+
+const (
+	KindApp       = "app"
+	KindLibrary   = "library"
+	KindFramework = "framework"
+	KindFile      = "file"
+	KindTool      = "tool"
+
+	FormatSpdx      = "spdx"
+	FormatCycloneDx = "cyclonedx"
+)
+
+var spdxExpressionRegExp = regexp.MustCompile(`^[A-Za-z0-9.+\-() ]+$`)
+
+type Component struct {
+	// app, library (node module), framework (Electron), file (native binary) or tool (downloaded build tool, not distributed)
+	Kind    string `json:"kind"`
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	// SPDX expression from package.json, empty if not specified or not an expression
+	License string `json:"license,omitempty"`
+	Purl    string `json:"purl,omitempty"`
+	// path in the app (package dir or file), slash-separated
+	Path        string `json:"path,omitempty"`
+	DownloadUrl string `json:"downloadUrl,omitempty"`
+
+	// hex, sha256 of package is computed from sorted relative paths and sha256 of its files
+	Sha256 string `json:"sha256,omitempty"`
+	// files only (required by SPDX)
+	Sha1   string `json:"sha1,omitempty"`
+	Sha512 string `json:"sha512,omitempty"`
+}
+
+type Sbom struct {
+	App        *Component
+	Components []*Component
+	Time       time.Time
+}
+
+type Options struct {
+	// dir with app.asar or app dir
+	ResourcesDir string
+
+	Name            string
+	Version         string
+	ElectronVersion string
+	// see download.ProvenanceFileEnvName
+	ProvenanceFile string
+}
+
+type Report struct {
+	Output         string `json:"output"`
+	Format         string `json:"format"`
+	Libraries      int    `json:"libraries"`
+	NativeBinaries int    `json:"nativeBinaries"`
+	Tools          int    `json:"tools"`
+}
+
+func ConfigureCommand(app *kingpin.Application) {
+	command := app.Command("sbom", "Generate Software Bill of Materials of the packaged app (node modules with versions, licenses and hashes, Electron, native binaries and downloaded tools) "+
+		"as SPDX or CycloneDX JSON. Report is written to stdout as JSON.")
+
+	options := &Options{}
+	command.Flag("resources-dir", "The resources dir of the packaged app (with app.asar or app dir).").Required().ExistingDirVar(&options.ResourcesDir)
+	command.Flag("name", "The app name (default: name from package.json of the app).").StringVar(&options.Name)
+	command.Flag("app-version", "The app version (default: version from package.json of the app).").StringVar(&options.Version)
+	command.Flag("electron-version", "The Electron version (default: detected by the version file or Electron Framework Info.plist).").StringVar(&options.ElectronVersion)
+	command.Flag("provenance", "The file with provenance of downloaded tools (default: "+download.ProvenanceFileEnvName+" env).").Envar(download.ProvenanceFileEnvName).StringVar(&options.ProvenanceFile)
+	format := command.Flag("format", "The SBOM format.").Default(FormatSpdx).Enum(FormatSpdx, FormatCycloneDx)
+	output := command.Flag("output", "The output file.").Short('o').Required().String()
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		result, err := Collect(options)
+		if err != nil {
+			return err
+		}
+
+		var data []byte
+		if *format == FormatCycloneDx {
+			data, err = RenderCycloneDx(result)
+		} else {
+			data, err = RenderSpdx(result)
+		}
+		if err != nil {
+			return err
+		}
+
+		err = fsutil.EnsureDir(filepath.Dir(*output))
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(*output, data, 0644)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		report := &Report{Output: *output, Format: *format}
+		for _, component := range result.Components {
+			switch component.Kind {
+			case KindLibrary:
+				report.Libraries++
+			case KindFile:
+				report.NativeBinaries++
+			case KindTool:
+				report.Tools++
+			}
+		}
+		return util.WriteJsonToStdOut(report)
+	})
+}
+
+type appFile struct {
+	path string
+	size int64
+}
+
+// appSource is app.asar (including unpacked files) or app dir
+type appSource interface {
+	files() ([]*appFile, error)
+	read(p string) ([]byte, error)
+}
+
+type asarSource struct {
+	archive *asar.Archive
+}
+
+func (t *asarSource) files() ([]*appFile, error) {
+	var result []*appFile
+	for _, item := range t.archive.List(nil) {
+		if item.Type == "file" {
+			result = append(result, &appFile{path: item.Path, size: item.Size})
+		}
+	}
+	return result, nil
+}
+
+func (t *asarSource) read(p string) ([]byte, error) {
+	return t.archive.ReadFile(p)
+}
+
+type dirSource struct {
+	dir string
+	// relative paths to skip (with content)
+	excluded []string
+}
+
+func (t *dirSource) files() ([]*appFile, error) {
+	var result []*appFile
+	err := filepath.Walk(t.dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relativePath, err := filepath.Rel(t.dir, file)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		relativePath = filepath.ToSlash(relativePath)
+		if util.ContainsString(t.excluded, relativePath) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			result = append(result, &appFile{path: relativePath, size: info.Size()})
+		}
+		return nil
+	})
+	return result, errors.WithStack(err)
+}
+
+func (t *dirSource) read(p string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(t.dir, filepath.FromSlash(p)))
+	return data, errors.WithStack(err)
+}
+
+type packageJson struct {
+	Name     string      `json:"name"`
+	Version  string      `json:"version"`
+	License  interface{} `json:"license"`
+	Licenses interface{} `json:"licenses"`
+}
+
+// Collect reads packages and native binaries of the app, Electron version and provenance of downloaded tools
+func Collect(options *Options) (*Sbom, error) {
+	source, err := openAppSource(options.ResourcesDir)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Sbom{}
+	result.Time, err = reproducible.GetBuildTime()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := source.files()
+	if err != nil {
+		return nil, err
+	}
+
+	packages, err := collectPackages(source, files)
+	if err != nil {
+		return nil, err
+	}
+
+	result.App = packages[""]
+	if result.App == nil {
+		result.App = &Component{}
+	}
+	delete(packages, "")
+	result.App.Kind = KindApp
+	result.App.Path = ""
+	result.App.Purl = ""
+	if options.Name != "" {
+		result.App.Name = options.Name
+	}
+	if options.Version != "" {
+		result.App.Version = options.Version
+	}
+	if result.App.Name == "" {
+		return nil, util.NewMessageError("app name is not specified and package.json of the app doesn't contain it", "ERR_SBOM_NAME_MISSING")
+	}
+
+	for _, component := range packages {
+		result.Components = append(result.Components, component)
+	}
+
+	nativeFiles, err := collectNativeFiles(source, files)
+	if err != nil {
+		return nil, err
+	}
+	result.Components = append(result.Components, nativeFiles...)
+
+	// other resources (e.g. bundled executables and libraries)
+	resources := &dirSource{dir: options.ResourcesDir, excluded: []string{"app.asar", "app.asar.unpacked", "app"}}
+	resourceFiles, err := resources.files()
+	if err != nil {
+		return nil, err
+	}
+	nativeFiles, err = collectNativeFiles(resources, resourceFiles)
+	if err != nil {
+		return nil, err
+	}
+	for _, component := range nativeFiles {
+		component.Path = "resources/" + component.Path
+		component.Name = component.Path
+	}
+	result.Components = append(result.Components, nativeFiles...)
+
+	electronVersion := options.ElectronVersion
+	if electronVersion == "" {
+		electronVersion = detectElectronVersion(options.ResourcesDir)
+	}
+	if electronVersion != "" {
+		electronVersion = strings.TrimPrefix(electronVersion, "v")
+		result.Components = append(result.Components, &Component{Kind: KindFramework, Name: "electron", Version: electronVersion, License: "MIT", Purl: "pkg:npm/electron@" + electronVersion})
+	}
+
+	if options.ProvenanceFile != "" {
+		tools, err := collectTools(options.ProvenanceFile)
+		if err != nil {
+			return nil, err
+		}
+		result.Components = append(result.Components, tools...)
+	}
+
+	sortComponents(result.Components)
+	result.Components = removeDuplicates(result.Components)
+	return result, nil
+}
+
+func openAppSource(resourcesDir string) (appSource, error) {
+	asarFile := filepath.Join(resourcesDir, "app.asar")
+	_, err := os.Stat(asarFile)
+	if err == nil {
+		archive, err := asar.OpenArchive(asarFile)
+		if err != nil {
+			return nil, err
+		}
+		return &asarSource{archive: archive}, nil
+	} else if !os.IsNotExist(err) {
+		return nil, errors.WithStack(err)
+	}
+
+	appDir := filepath.Join(resourcesDir, "app")
+	info, err := os.Stat(appDir)
+	if err == nil && info.IsDir() {
+		return &dirSource{dir: appDir}, nil
+	}
+	return nil, util.NewMessageError("neither app.asar nor app dir is found in "+resourcesDir, "ERR_SBOM_APP_NOT_FOUND")
+}
+
+// collectPackages returns map of package dir ("" for the app) to component, file in node_modules belongs to the innermost package
+func collectPackages(source appSource, files []*appFile) (map[string]*Component, error) {
+	packageFiles := make(map[string][]string)
+	for _, file := range files {
+		dir := getPackageDir(file.path)
+		packageFiles[dir] = append(packageFiles[dir], file.path)
+	}
+
+	result := make(map[string]*Component)
+	for dir, list := range packageFiles {
+		packageJsonFile := path.Join(dir, "package.json")
+		if !util.ContainsString(list, packageJsonFile) {
+			// not a package (e.g. node_modules/.bin)
+			continue
+		}
+
+		data, err := source.read(packageJsonFile)
+		if err != nil {
+			return nil, err
+		}
+		var info packageJson
+		err = jsoniter.Unmarshal(data, &info)
+		if err != nil {
+			return nil, errors.WithMessage(err, "cannot parse "+packageJsonFile)
+		}
+		if info.Name == "" && dir != "" {
+			continue
+		}
+
+		component := &Component{Kind: KindLibrary, Name: info.Name, Version: info.Version, License: getLicense(&info), Path: dir}
+		if info.Version != "" {
+			component.Purl = createNpmPurl(info.Name, info.Version)
+		}
+		component.Sha256, err = computePackageHash(source, dir, list)
+		if err != nil {
+			return nil, err
+		}
+		result[dir] = component
+	}
+	return result, nil
+}
+
+// getPackageDir returns dir of the innermost package (node_modules/name or node_modules/@scope/name) of the file, empty if file is not in node_modules
+func getPackageDir(file string) string {
+	segments := strings.Split(file, "/")
+	for i := len(segments) - 2; i >= 0; i-- {
+		if segments[i] != "node_modules" {
+			continue
+		}
+		end := i + 2
+		if strings.HasPrefix(segments[i+1], "@") && end < len(segments) {
+			end++
+		}
+		return strings.Join(segments[:end], "/")
+	}
+	return ""
+}
+
+// sha256 of "<relative path>\x00<sha256 of content>\n" of sorted package files (nested packages are not included)
+func computePackageHash(source appSource, dir string, files []string) (string, error) {
+	sort.Strings(files)
+	hash := sha256.New()
+	for _, file := range files {
+		data, err := source.read(file)
+		if err != nil {
+			return "", err
+		}
+		fileHash := sha256.Sum256(data)
+		relativePath := file
+		if dir != "" {
+			relativePath = file[len(dir)+1:]
+		}
+		hash.Write([]byte(relativePath + "\x00" + hex.EncodeToString(fileHash[:]) + "\n"))
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func collectNativeFiles(source appSource, files []*appFile) ([]*Component, error) {
+	var result []*Component
+	for _, file := range files {
+		name := path.Base(file.path)
+		isNative := asar.IsNativeFileName(name)
+		if !isNative && !(asar.IsExecutableCandidate(name) && file.size >= 8) {
+			continue
+		}
+
+		data, err := source.read(file.path)
+		if err != nil {
+			return nil, err
+		}
+		if !isNative && !asar.IsNativeExecutableMagic(data) {
+			continue
+		}
+
+		sha256Hash := sha256.Sum256(data)
+		sha1Hash := sha1.Sum(data)
+		result = append(result, &Component{Kind: KindFile, Name: file.path, Path: file.path, Sha256: hex.EncodeToString(sha256Hash[:]), Sha1: hex.EncodeToString(sha1Hash[:])})
+	}
+	return result, nil
+}
+
+// version file is in the app dir on Windows and Linux, version of Electron Framework on macOS (resources dir is <app>.app/Contents/Resources)
+func detectElectronVersion(resourcesDir string) string {
+	data, err := ioutil.ReadFile(filepath.Join(filepath.Dir(resourcesDir), "version"))
+	if err == nil {
+		return strings.TrimSpace(string(data))
+	}
+
+	data, err = ioutil.ReadFile(filepath.Join(filepath.Dir(resourcesDir), "Frameworks", "Electron Framework.framework", "Resources", "Info.plist"))
+	if err != nil {
+		return ""
+	}
+	var info struct {
+		Version string `plist:"CFBundleVersion"`
+	}
+	_, err = plist.Unmarshal(data, &info)
+	if err != nil {
+		return ""
+	}
+	return info.Version
+}
+
+func collectTools(provenanceFile string) ([]*Component, error) {
+	records, err := download.ReadProvenance(provenanceFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*Component
+	for _, record := range records {
+		component := &Component{Kind: KindTool, Name: record.Name, DownloadUrl: record.Url}
+		if record.Sha512 != "" {
+			data, err := base64.StdEncoding.DecodeString(record.Sha512)
+			if err == nil {
+				component.Sha512 = hex.EncodeToString(data)
+			}
+		} else if record.File != "" {
+			// downloaded file is verified by the downloader (e.g. Electron by SHASUMS256.txt), hash of the cached file is reported
+			info, err := os.Stat(record.File)
+			if err == nil && info.Mode().IsRegular() {
+				data, err := ioutil.ReadFile(record.File)
+				if err != nil {
+					return nil, errors.WithStack(err)
+				}
+				hash := sha256.Sum256(data)
+				component.Sha256 = hex.EncodeToString(hash[:])
+			}
+		}
+		result = append(result, component)
+	}
+	return result, nil
+}
+
+// license field is SPDX expression, object (type) or deprecated licenses array
+func getLicense(info *packageJson) string {
+	var result []string
+	for _, value := range []interface{}{info.License, info.Licenses} {
+		switch v := value.(type) {
+		case string:
+			result = append(result, v)
+		case map[string]interface{}:
+			if licenseType, ok := v["type"].(string); ok {
+				result = append(result, licenseType)
+			}
+		case []interface{}:
+			for _, item := range v {
+				if m, ok := item.(map[string]interface{}); ok {
+					if licenseType, ok := m["type"].(string); ok {
+						result = append(result, licenseType)
+					}
+				}
+			}
+		}
+	}
+
+	expression := strings.TrimSpace(strings.Join(result, " OR "))
+	if !spdxExpressionRegExp.MatchString(expression) || strings.Contains(expression, "SEE LICENSE") || strings.EqualFold(expression, "UNLICENSED") {
+		return ""
+	}
+	return expression
+}
+
+func createNpmPurl(name string, version string) string {
+	// @ of scope is encoded
+	if strings.HasPrefix(name, "@") {
+		name = "%40" + name[1:]
+	}
+	return "pkg:npm/" + name + "@" + url.PathEscape(version)
+}
+
+// by kind (framework, library, file, tool) and name, then path
+func sortComponents(components []*Component) {
+	kinds := []string{KindFramework, KindLibrary, KindFile, KindTool}
+	sort.SliceStable(components, func(i, j int) bool {
+		a, b := components[i], components[j]
+		if a.Kind != b.Kind {
+			return indexOf(kinds, a.Kind) < indexOf(kinds, b.Kind)
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Path < b.Path
+	})
+}
+
+// the same package (name, version and content) in several dirs is reported once
+func removeDuplicates(components []*Component) []*Component {
+	result := components[:0]
+	keys := make(map[string]bool)
+	for _, component := range components {
+		if component.Kind == KindLibrary {
+			key := component.Purl + "|" + component.Sha256
+			if keys[key] {
+				continue
+			}
+			keys[key] = true
+		}
+		result = append(result, component)
+	}
+	return result
+}
+
+func indexOf(list []string, value string) int {
+	for i, item := range list {
+		if item == value {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,163 @@
+package sbom
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/asar"
+	"github.com/develar/app-builder/pkg/download"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/json-iterator/go"
+	. "github.com/onsi/gomega"
+)
+
+func TestSbom(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "sbom")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	writeFile := func(file string, data string) {
+		g.Expect(os.MkdirAll(filepath.Dir(file), 0755)).To(Succeed())
+		g.Expect(ioutil.WriteFile(file, []byte(data), 0644)).To(Succeed())
+	}
+
+	appDir := filepath.Join(dir, "app")
+	writeFile(filepath.Join(appDir, "package.json"), `{"name": "foo", "version": "1.2.3", "license": "MIT"}`)
+	writeFile(filepath.Join(appDir, "main.js"), "require('lodash')")
+	writeFile(filepath.Join(appDir, "node_modules", "lodash", "package.json"), `{"name": "lodash", "version": "4.17.21", "license": "MIT"}`)
+	writeFile(filepath.Join(appDir, "node_modules", "lodash", "index.js"), "module.exports = {}")
+	writeFile(filepath.Join(appDir, "node_modules", "@scope", "native", "package.json"), `{"name": "@scope/native", "version": "1.0.0", "license": {"type": "Apache-2.0"}}`)
+	writeFile(filepath.Join(appDir, "node_modules", "@scope", "native", "build", "addon.node"), "\x7fELF native addon")
+	// the same lodash nested in other package is reported once
+	writeFile(filepath.Join(appDir, "node_modules", "@scope", "native", "node_modules", "lodash", "package.json"), `{"name": "lodash", "version": "4.17.21", "license": "MIT"}`)
+	writeFile(filepath.Join(appDir, "node_modules", "@scope", "native", "node_modules", "lodash", "index.js"), "module.exports = {}")
+	writeFile(filepath.Join(appDir, "node_modules", "private", "package.json"), `{"name": "private", "version": "0.1.0", "license": "SEE LICENSE IN LICENSE.txt"}`)
+
+	resourcesDir := filepath.Join(dir, "unpacked", "resources")
+	_, err = asar.Pack(asar.PackOptions{Dir: appDir, Output: filepath.Join(resourcesDir, "app.asar"), Unpack: []string{"*.node"}})
+	g.Expect(err).NotTo(HaveOccurred())
+	writeFile(filepath.Join(resourcesDir, "helper.exe"), "MZ\x90\x00\x03\x00\x00\x00")
+	writeFile(filepath.Join(resourcesDir, "readme.txt"), "not a binary")
+	writeFile(filepath.Join(dir, "unpacked", "version"), "v30.1.0\n")
+
+	provenanceFile := filepath.Join(dir, "provenance.jsonl")
+	writeFile(provenanceFile, `{"name":"nsis-3.0.4.1","url":"https://example.com/nsis-3.0.4.1.7z","sha512":"AAEC"}
+{"name":"nsis-3.0.4.1","url":"https://example.com/nsis-3.0.4.1.7z","sha512":"AAEC"}
+`)
+
+	result, err := Collect(&Options{ResourcesDir: resourcesDir, ProvenanceFile: provenanceFile})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.App.Name).To(Equal("foo"))
+	g.Expect(result.App.Version).To(Equal("1.2.3"))
+
+	var names []string
+	for _, component := range result.Components {
+		names = append(names, component.Kind+" "+component.Name)
+	}
+	g.Expect(names).To(Equal([]string{
+		"framework electron",
+		"library @scope/native",
+		"library lodash",
+		"library private",
+		"file node_modules/@scope/native/build/addon.node",
+		"file resources/helper.exe",
+		"tool nsis-3.0.4.1",
+	}))
+
+	native := result.Components[1]
+	g.Expect(native.Purl).To(Equal("pkg:npm/%40scope/native@1.0.0"))
+	g.Expect(native.License).To(Equal("Apache-2.0"))
+	g.Expect(native.Path).To(Equal("node_modules/@scope/native"))
+	g.Expect(native.Sha256).To(HaveLen(64))
+	g.Expect(result.Components[0].Version).To(Equal("30.1.0"))
+	g.Expect(result.Components[3].License).To(BeEmpty())
+	g.Expect(result.Components[4].Sha1).To(HaveLen(40))
+	g.Expect(result.Components[6].Sha512).To(Equal("000102"))
+
+	// name and version are overridable, the app is required
+	result, err = Collect(&Options{ResourcesDir: resourcesDir, Name: "Bar", Version: "2.0.0", ElectronVersion: "29.0.0"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.App.Name).To(Equal("Bar"))
+	g.Expect(result.Components[0].Version).To(Equal("29.0.0"))
+	g.Expect(result.Components[len(result.Components)-1].Kind).To(Equal(KindFile))
+
+	_, err = Collect(&Options{ResourcesDir: filepath.Join(dir, "unpacked")})
+	g.Expect(err).To(MatchError(ContainSubstring("neither app.asar nor app dir is found")))
+}
+
+func TestRender(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	sbom := &Sbom{
+		App: &Component{Kind: KindApp, Name: "foo", Version: "1.2.3", License: "MIT"},
+		Components: []*Component{
+			{Kind: KindFramework, Name: "electron", Version: "30.1.0", License: "MIT", Purl: "pkg:npm/electron@30.1.0"},
+			{Kind: KindLibrary, Name: "@scope/native", Version: "1.0.0", Purl: "pkg:npm/%40scope/native@1.0.0", Path: "node_modules/@scope/native", Sha256: "aa"},
+			{Kind: KindLibrary, Name: "@scope/native", Version: "1.0.0", Purl: "pkg:npm/%40scope/native@1.0.0", Path: "node_modules/a/node_modules/@scope/native", Sha256: "bb"},
+			{Kind: KindFile, Name: "node_modules/@scope/native/build/addon.node", Path: "node_modules/@scope/native/build/addon.node", Sha256: "cc", Sha1: "dd"},
+			{Kind: KindTool, Name: "nsis", DownloadUrl: "https://example.com/nsis.7z", Sha512: "ee"},
+		},
+	}
+
+	data, err := RenderSpdx(sbom)
+	g.Expect(err).NotTo(HaveOccurred())
+	var spdx spdxDocument
+	g.Expect(jsoniter.Unmarshal(data, &spdx)).To(Succeed())
+	g.Expect(spdx.DocumentNamespace).To(HavePrefix("https://spdx.org/spdxdocs/foo-1.2.3-"))
+	var ids []string
+	for _, item := range spdx.Packages {
+		ids = append(ids, item.SpdxId)
+	}
+	g.Expect(ids).To(Equal([]string{"SPDXRef-App", "SPDXRef-Package-electron-30.1.0", "SPDXRef-Package-scope-native-1.0.0", "SPDXRef-Package-scope-native-1.0.0-2", "SPDXRef-Tool-nsis"}))
+	g.Expect(spdx.Packages[4].DownloadLocation).To(Equal("https://example.com/nsis.7z"))
+	g.Expect(spdx.Files).To(HaveLen(1))
+	g.Expect(spdx.Files[0].FileName).To(Equal("./node_modules/@scope/native/build/addon.node"))
+	g.Expect(spdx.Relationships).To(HaveLen(6))
+	g.Expect(*spdx.Relationships[0]).To(Equal(spdxRelationship{SpdxElementId: "SPDXRef-DOCUMENT", RelationshipType: "DESCRIBES", RelatedSpdxElement: "SPDXRef-App"}))
+	g.Expect(*spdx.Relationships[5]).To(Equal(spdxRelationship{SpdxElementId: "SPDXRef-Tool-nsis", RelationshipType: "BUILD_TOOL_OF", RelatedSpdxElement: "SPDXRef-App"}))
+
+	// reproducible
+	again, err := RenderSpdx(sbom)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(again).To(Equal(data))
+
+	data, err = RenderCycloneDx(sbom)
+	g.Expect(err).NotTo(HaveOccurred())
+	var bom cycloneDxBom
+	g.Expect(jsoniter.Unmarshal(data, &bom)).To(Succeed())
+	g.Expect(bom.Metadata.Component.BomRef).To(Equal("app:foo"))
+	g.Expect(bom.Components).To(HaveLen(5))
+	g.Expect(bom.Components[2].BomRef).To(Equal("pkg:npm/%40scope/native@1.0.0#2"))
+	g.Expect(bom.Components[3].Type).To(Equal("file"))
+	g.Expect(bom.Components[4].Scope).To(Equal("excluded"))
+	g.Expect(bom.Components[4].ExternalReferences[0].Url).To(Equal("https://example.com/nsis.7z"))
+	g.Expect(bom.Dependencies[0].DependsOn).To(Equal([]string{"pkg:npm/electron@30.1.0", "pkg:npm/%40scope/native@1.0.0", "pkg:npm/%40scope/native@1.0.0#2", "file:node_modules/@scope/native/build/addon.node"}))
+}
+
+func TestProvenance(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "sbom")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "provenance.jsonl")
+	g.Expect(os.Setenv(download.ProvenanceFileEnvName, file)).To(Succeed())
+	defer os.Unsetenv(download.ProvenanceFileEnvName)
+
+	download.RecordProvenance(&download.Provenance{Name: "a", Url: "https://example.com/a.zip"})
+	download.RecordProvenance(&download.Provenance{Name: "b", Url: "https://example.com/b.zip", File: filepath.Join(dir, "missing.zip")})
+	download.RecordProvenance(&download.Provenance{Name: "a", Url: "https://example.com/a.zip"})
+
+	tools, err := collectTools(file)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(tools).To(Equal([]*Component{
+		{Kind: KindTool, Name: "a", DownloadUrl: "https://example.com/a.zip"},
+		{Kind: KindTool, Name: "b", DownloadUrl: "https://example.com/b.zip"},
+	}))
+}
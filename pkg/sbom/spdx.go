@@ -0,0 +1,193 @@
+package sbom
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/develar/errors"
+	"github.com/json-iterator/go"
+)
+
+var spdxIdRegExp = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+type spdxDocument struct {
+	SpdxVersion       string              `json:"spdxVersion"`
+	DataLicense       string              `json:"dataLicense"`
+	SpdxId            string              `json:"SPDXID"`
+	Name              string              `json:"name"`
+	DocumentNamespace string              `json:"documentNamespace"`
+	CreationInfo      *spdxCreationInfo   `json:"creationInfo"`
+	Packages          []*spdxPackage      `json:"packages"`
+	Files             []*spdxFile         `json:"files,omitempty"`
+	Relationships     []*spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name                  string             `json:"name"`
+	SpdxId                string             `json:"SPDXID"`
+	VersionInfo           string             `json:"versionInfo,omitempty"`
+	DownloadLocation      string             `json:"downloadLocation"`
+	FilesAnalyzed         bool               `json:"filesAnalyzed"`
+	LicenseConcluded      string             `json:"licenseConcluded"`
+	LicenseDeclared       string             `json:"licenseDeclared"`
+	CopyrightText         string             `json:"copyrightText"`
+	Checksums             []*spdxChecksum    `json:"checksums,omitempty"`
+	ExternalRefs          []*spdxExternalRef `json:"externalRefs,omitempty"`
+	PrimaryPackagePurpose string             `json:"primaryPackagePurpose"`
+}
+
+type spdxFile struct {
+	FileName         string          `json:"fileName"`
+	SpdxId           string          `json:"SPDXID"`
+	Checksums        []*spdxChecksum `json:"checksums"`
+	LicenseConcluded string          `json:"licenseConcluded"`
+	CopyrightText    string          `json:"copyrightText"`
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SpdxElementId      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSpdxElement string `json:"relatedSpdxElement"`
+}
+
+// RenderSpdx returns SPDX 2.3 JSON document: app and libraries are packages (app CONTAINS library), native binaries are files, downloaded tools are packages (tool BUILD_TOOL_OF app)
+func RenderSpdx(sbom *Sbom) ([]byte, error) {
+	documentId, err := computeDocumentId(sbom)
+	if err != nil {
+		return nil, err
+	}
+
+	appId := "SPDXRef-App"
+	document := &spdxDocument{
+		SpdxVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SpdxId:            "SPDXRef-DOCUMENT",
+		Name:              getDocumentName(sbom),
+		DocumentNamespace: "https://spdx.org/spdxdocs/" + spdxIdRegExp.ReplaceAllString(getDocumentName(sbom), "-") + "-" + documentId,
+		CreationInfo: &spdxCreationInfo{
+			Created:  sbom.Time.UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: app-builder-" + AppVersion},
+		},
+		Packages:      []*spdxPackage{createSpdxPackage(sbom.App, appId)},
+		Relationships: []*spdxRelationship{{SpdxElementId: "SPDXRef-DOCUMENT", RelationshipType: "DESCRIBES", RelatedSpdxElement: appId}},
+	}
+
+	ids := make(map[string]bool)
+	for _, component := range sbom.Components {
+		id := createSpdxId(component, ids)
+		switch component.Kind {
+		case KindFile:
+			document.Files = append(document.Files, &spdxFile{
+				FileName:         "./" + component.Path,
+				SpdxId:           id,
+				Checksums:        []*spdxChecksum{{Algorithm: "SHA1", ChecksumValue: component.Sha1}, {Algorithm: "SHA256", ChecksumValue: component.Sha256}},
+				LicenseConcluded: "NOASSERTION",
+				CopyrightText:    "NOASSERTION",
+			})
+			document.Relationships = append(document.Relationships, &spdxRelationship{SpdxElementId: appId, RelationshipType: "CONTAINS", RelatedSpdxElement: id})
+		case KindTool:
+			document.Packages = append(document.Packages, createSpdxPackage(component, id))
+			document.Relationships = append(document.Relationships, &spdxRelationship{SpdxElementId: id, RelationshipType: "BUILD_TOOL_OF", RelatedSpdxElement: appId})
+		default:
+			document.Packages = append(document.Packages, createSpdxPackage(component, id))
+			document.Relationships = append(document.Relationships, &spdxRelationship{SpdxElementId: appId, RelationshipType: "CONTAINS", RelatedSpdxElement: id})
+		}
+	}
+
+	result, err := jsoniter.ConfigCompatibleWithStandardLibrary.MarshalIndent(document, "", "  ")
+	return result, errors.WithStack(err)
+}
+
+func createSpdxPackage(component *Component, id string) *spdxPackage {
+	result := &spdxPackage{
+		Name:             component.Name,
+		SpdxId:           id,
+		VersionInfo:      component.Version,
+		DownloadLocation: "NOASSERTION",
+		LicenseConcluded: "NOASSERTION",
+		LicenseDeclared:  "NOASSERTION",
+		CopyrightText:    "NOASSERTION",
+	}
+	if component.License != "" {
+		result.LicenseDeclared = component.License
+	}
+	if component.DownloadUrl != "" {
+		result.DownloadLocation = component.DownloadUrl
+	}
+	if component.Purl != "" {
+		result.ExternalRefs = []*spdxExternalRef{{ReferenceCategory: "PACKAGE-MANAGER", ReferenceType: "purl", ReferenceLocator: component.Purl}}
+	}
+	if component.Sha256 != "" {
+		result.Checksums = append(result.Checksums, &spdxChecksum{Algorithm: "SHA256", ChecksumValue: component.Sha256})
+	}
+	if component.Sha512 != "" {
+		result.Checksums = append(result.Checksums, &spdxChecksum{Algorithm: "SHA512", ChecksumValue: component.Sha512})
+	}
+
+	switch component.Kind {
+	case KindApp, KindTool:
+		result.PrimaryPackagePurpose = "APPLICATION"
+	case KindFramework:
+		result.PrimaryPackagePurpose = "FRAMEWORK"
+	default:
+		result.PrimaryPackagePurpose = "LIBRARY"
+	}
+	return result
+}
+
+// SPDX id allows only letters, digits, . and -
+func createSpdxId(component *Component, ids map[string]bool) string {
+	name := component.Name
+	if component.Version != "" {
+		name += "-" + component.Version
+	}
+
+	prefix := map[string]string{KindLibrary: "Package", KindFramework: "Package", KindFile: "File", KindTool: "Tool"}[component.Kind]
+	base := "SPDXRef-" + prefix + "-" + strings.Trim(spdxIdRegExp.ReplaceAllString(name, "-"), "-")
+	result := base
+	for i := 2; ids[result]; i++ {
+		result = fmt.Sprintf("%s-%d", base, i)
+	}
+	ids[result] = true
+	return result
+}
+
+func getDocumentName(sbom *Sbom) string {
+	if sbom.App.Version == "" {
+		return sbom.App.Name
+	}
+	return sbom.App.Name + "-" + sbom.App.Version
+}
+
+// computeDocumentId returns UUID computed from the content, so, document is reproducible
+func computeDocumentId(sbom *Sbom) (string, error) {
+	data, err := jsoniter.ConfigFastest.Marshal([]interface{}{sbom.App, sbom.Components})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	hash := sha256.Sum256(data)
+	// version 5 and RFC 4122 variant bits
+	hash[6] = (hash[6] & 0x0f) | 0x50
+	hash[8] = (hash[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", hash[0:4], hash[4:6], hash[6:8], hash[8:10], hash[10:16]), nil
+}
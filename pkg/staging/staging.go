@@ -0,0 +1,168 @@
+package staging
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/fs"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+	"go.uber.org/zap"
+)
+
+// Staging is a temporary output dir. Artifacts are written to it and moved to the output dir only if the whole build succeeds,
+// so, consumers watching output dir never pick up half-written files.
+// Staging dir is created next to the output dir (not inside) to be on the same volume - rename is atomic only within one volume.
+type Staging struct {
+	OutDir string `json:"outDir"`
+	Dir    string `json:"stagingDir"`
+}
+
+type CommitResult struct {
+	// names of moved entries (relative to the output dir)
+	Files []string `json:"files"`
+}
+
+func ConfigureCommand(app *kingpin.Application) {
+	command := app.Command("staging", "write build artifacts to a temporary dir and move them to the output dir only on success")
+
+	beginCommand := command.Command("begin", "create staging dir for the output dir")
+	beginOutDir := beginCommand.Flag("out", "output directory").Required().String()
+	beginCommand.Action(func(context *kingpin.ParseContext) error {
+		staging, err := Begin(*beginOutDir)
+		if err != nil {
+			return err
+		}
+		return util.WriteJsonToStdOut(staging)
+	})
+
+	commitCommand := command.Command("commit", "move staged artifacts to the output dir, existing files with the same name are replaced")
+	commitOutDir := commitCommand.Flag("out", "output directory").Required().String()
+	commitStagingDir := commitCommand.Flag("staging-dir", "staging directory").Required().ExistingDir()
+	commitCommand.Action(func(context *kingpin.ParseContext) error {
+		result, err := (&Staging{OutDir: *commitOutDir, Dir: *commitStagingDir}).Commit()
+		if err != nil {
+			return err
+		}
+		return util.WriteJsonToStdOut(result)
+	})
+
+	abortCommand := command.Command("abort", "remove staging dir, output dir is not modified")
+	abortStagingDir := abortCommand.Flag("staging-dir", "staging directory").Required().String()
+	abortCommand.Action(func(context *kingpin.ParseContext) error {
+		return (&Staging{Dir: *abortStagingDir}).Abort()
+	})
+}
+
+func Begin(outDir string) (*Staging, error) {
+	outDir, err := filepath.Abs(outDir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	err = fsutil.EnsureDir(outDir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	dir, err := ioutil.TempDir(filepath.Dir(outDir), "."+filepath.Base(outDir)+".staging-")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// TempDir creates dir with 0700
+	err = fs.SetNormalDirPermissions(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug("staging dir created", zap.String("outDir", outDir), zap.String("stagingDir", dir))
+	return &Staging{OutDir: outDir, Dir: dir}, nil
+}
+
+// Commit moves each top-level entry of the staging dir to the output dir and removes staging dir.
+// Each file appears in the output dir atomically (rename), replaced dirs (e.g. win-unpacked) are swapped with the new ones.
+func (t *Staging) Commit() (*CommitResult, error) {
+	entries, err := ioutil.ReadDir(t.Dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	err = fsutil.EnsureDir(t.OutDir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	result := &CommitResult{Files: make([]string, 0, len(entries))}
+	for _, entry := range entries {
+		err = t.moveEntry(entry.Name())
+		if err != nil {
+			return result, err
+		}
+		result.Files = append(result.Files, entry.Name())
+	}
+
+	err = os.RemoveAll(t.Dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return result, nil
+}
+
+func (t *Staging) Abort() error {
+	log.Debug("staging aborted", zap.String("stagingDir", t.Dir))
+	return errors.WithStack(os.RemoveAll(t.Dir))
+}
+
+func (t *Staging) moveEntry(name string) error {
+	from := filepath.Join(t.Dir, name)
+	to := filepath.Join(t.OutDir, name)
+
+	_, err := os.Lstat(to)
+	if err == nil {
+		// keep old entry until new one is in place, to restore it if move fails
+		replaced := filepath.Join(t.Dir, ".replaced-"+name)
+		err = os.Rename(to, replaced)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		err = moveFile(from, to)
+		if err != nil {
+			restoreErr := os.Rename(replaced, to)
+			if restoreErr != nil {
+				log.Warn("cannot restore replaced file", zap.String("file", to), zap.Error(restoreErr))
+			}
+			return err
+		}
+		return errors.WithStack(os.RemoveAll(replaced))
+	} else if !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+
+	return moveFile(from, to)
+}
+
+func moveFile(from string, to string) error {
+	err := os.Rename(from, to)
+	if err == nil {
+		return nil
+	}
+
+	// output dir is on another volume (e.g. mount point) - copy to a temp name in the output dir first to still make it appear atomically
+	log.Debug("cannot rename, copy is used", zap.String("from", from), zap.String("to", to), zap.Error(err))
+	temp := filepath.Join(filepath.Dir(to), "."+filepath.Base(to)+".staging")
+	err = fs.CopyDirOrFile(from, temp)
+	if err == nil {
+		err = os.Rename(temp, to)
+	}
+	if err != nil {
+		_ = os.RemoveAll(temp)
+		return errors.WithStack(err)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package staging
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+)
+
+func TestCommit(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	tempDir, err := ioutil.TempDir("", "staging")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer func() {
+		_ = os.RemoveAll(tempDir)
+	}()
+
+	outDir := filepath.Join(tempDir, "dist")
+	g.Expect(os.MkdirAll(filepath.Join(outDir, "win-unpacked"), 0777)).NotTo(HaveOccurred())
+	g.Expect(ioutil.WriteFile(filepath.Join(outDir, "win-unpacked", "old.exe"), []byte("old"), 0666)).NotTo(HaveOccurred())
+	g.Expect(ioutil.WriteFile(filepath.Join(outDir, "keep.txt"), []byte("keep"), 0666)).NotTo(HaveOccurred())
+
+	staging, err := Begin(outDir)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(filepath.Dir(staging.Dir)).To(Equal(tempDir))
+
+	g.Expect(os.MkdirAll(filepath.Join(staging.Dir, "win-unpacked"), 0777)).NotTo(HaveOccurred())
+	g.Expect(ioutil.WriteFile(filepath.Join(staging.Dir, "win-unpacked", "new.exe"), []byte("new"), 0666)).NotTo(HaveOccurred())
+	g.Expect(ioutil.WriteFile(filepath.Join(staging.Dir, "App Setup.exe"), []byte("setup"), 0666)).NotTo(HaveOccurred())
+
+	// nothing is visible before commit
+	_, err = os.Stat(filepath.Join(outDir, "App Setup.exe"))
+	g.Expect(os.IsNotExist(err)).To(BeTrue())
+
+	result, err := staging.Commit()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.Files).To(ConsistOf("App Setup.exe", "win-unpacked"))
+
+	files, err := ioutil.ReadDir(filepath.Join(outDir, "win-unpacked"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(len(files)).To(Equal(1))
+	g.Expect(files[0].Name()).To(Equal("new.exe"))
+
+	_, err = os.Stat(filepath.Join(outDir, "keep.txt"))
+	g.Expect(err).NotTo(HaveOccurred())
+	_, err = os.Stat(staging.Dir)
+	g.Expect(os.IsNotExist(err)).To(BeTrue())
+}
+
+func TestAbort(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	tempDir, err := ioutil.TempDir("", "staging")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer func() {
+		_ = os.RemoveAll(tempDir)
+	}()
+
+	outDir := filepath.Join(tempDir, "dist")
+	staging, err := Begin(outDir)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(ioutil.WriteFile(filepath.Join(staging.Dir, "half-written.dmg"), []byte("x"), 0666)).NotTo(HaveOccurred())
+
+	g.Expect(staging.Abort()).NotTo(HaveOccurred())
+	files, err := ioutil.ReadDir(outDir)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(files).To(BeEmpty())
+}
@@ -0,0 +1,178 @@
+package universal
+
+import (
+	"debug/macho"
+	"encoding/binary"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/codesign"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+)
+
+const (
+	fatHeaderSize  = 8
+	fatArchSize    = 20
+	maxFatFileSize = 1<<32 - 1
+
+	// 16 KB pages on Apple Silicon, 4 KB on Intel (the same alignment as lipo uses)
+	alignArm64   = 14
+	alignDefault = 12
+)
+
+// slice is an architecture of Mach-O file: the whole thin file or a part of universal file
+type slice struct {
+	file   string
+	cpu    macho.Cpu
+	subCpu uint32
+	offset int64
+	size   int64
+}
+
+func configureLipoCommand(universalCommand *kingpin.CmdClause) {
+	command := universalCommand.Command("lipo", "Create universal Mach-O file from thin or universal files (the same as lipo -create).")
+	output := command.Flag("output", "The output file.").Short('o').Required().String()
+	files := command.Arg("file", "The input file.").Required().ExistingFiles()
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		var slices []*slice
+		for _, file := range *files {
+			fileSlices, err := readSlices(file)
+			if err != nil {
+				return err
+			}
+			if fileSlices == nil {
+				return util.NewMessageError(file+" is not a Mach-O file", "ERR_UNIVERSAL_NOT_MACHO")
+			}
+			slices = append(slices, fileSlices...)
+		}
+		return writeFat(*output, slices, 0755)
+	})
+}
+
+// readSlices returns nil if file is not a Mach-O file
+func readSlices(file string) ([]*slice, error) {
+	reader, err := os.Open(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer util.Close(reader)
+
+	var header [12]byte
+	_, err = io.ReadFull(reader, header[:])
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+
+	switch codesign.GetMachOKind(header[:]) {
+	case codesign.MachOThin:
+		info, err := reader.Stat()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		// 0xfeedface and 0xfeedfacf - big endian, 0xcefaedfe and 0xcffaedfe - little endian
+		var byteOrder binary.ByteOrder = binary.LittleEndian
+		if header[0] == 0xfe {
+			byteOrder = binary.BigEndian
+		}
+		return []*slice{{file: file, cpu: macho.Cpu(byteOrder.Uint32(header[4:])), subCpu: byteOrder.Uint32(header[8:]), size: info.Size()}}, nil
+
+	case codesign.MachOFat:
+		fatFile, err := macho.NewFatFile(reader)
+		if err != nil {
+			return nil, errors.WithMessage(err, "invalid universal file "+file)
+		}
+
+		var result []*slice
+		for _, arch := range fatFile.Arches {
+			result = append(result, &slice{file: file, cpu: arch.Cpu, subCpu: arch.SubCpu, offset: int64(arch.Offset), size: int64(arch.Size)})
+		}
+		return result, nil
+	}
+	return nil, nil
+}
+
+// writeFat writes universal file. Slices are ordered by CPU type (x64 before arm64, as lipo does), the same CPU type must not be specified twice.
+func writeFat(output string, slices []*slice, mode os.FileMode) error {
+	slices = append([]*slice(nil), slices...)
+	sort.SliceStable(slices, func(i, j int) bool {
+		return slices[i].cpu < slices[j].cpu
+	})
+	for i := 1; i < len(slices); i++ {
+		if slices[i].cpu == slices[i-1].cpu {
+			return util.NewMessageError("both "+slices[i-1].file+" and "+slices[i].file+" contain "+slices[i].cpu.String(), "ERR_UNIVERSAL_ARCH_CONFLICT")
+		}
+	}
+
+	header := make([]byte, fatHeaderSize+fatArchSize*len(slices))
+	binary.BigEndian.PutUint32(header, macho.MagicFat)
+	binary.BigEndian.PutUint32(header[4:], uint32(len(slices)))
+	offsets := make([]int64, len(slices))
+	offset := int64(len(header))
+	for index, item := range slices {
+		align := uint32(alignDefault)
+		if item.cpu == macho.CpuArm64 {
+			align = alignArm64
+		}
+		offset = (offset + 1<<align - 1) &^ (1<<align - 1)
+		offsets[index] = offset
+
+		archHeader := header[fatHeaderSize+fatArchSize*index:]
+		binary.BigEndian.PutUint32(archHeader, uint32(item.cpu))
+		binary.BigEndian.PutUint32(archHeader[4:], item.subCpu)
+		binary.BigEndian.PutUint32(archHeader[8:], uint32(offset))
+		binary.BigEndian.PutUint32(archHeader[12:], uint32(item.size))
+		binary.BigEndian.PutUint32(archHeader[16:], align)
+		offset += item.size
+	}
+	if offset > maxFatFileSize {
+		return errors.Errorf("universal file %s is too large (%d bytes), 64-bit universal files are not supported", output, offset)
+	}
+
+	file, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = doWriteFat(file, header, slices, offsets)
+	return fsutil.CloseAndCheckError(err, file)
+}
+
+func doWriteFat(file *os.File, header []byte, slices []*slice, offsets []int64) error {
+	_, err := file.Write(header)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for index, item := range slices {
+		_, err = file.Seek(offsets[index], io.SeekStart)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		err = copySlice(file, item)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copySlice(writer io.Writer, item *slice) error {
+	reader, err := os.Open(item.file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(reader)
+
+	_, err = io.Copy(writer, io.NewSectionReader(reader, item.offset, item.size))
+	return errors.WithStack(err)
+}
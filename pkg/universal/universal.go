@@ -0,0 +1,622 @@
+package universal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"debug/macho"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/asar"
+	"github.com/develar/app-builder/pkg/fs"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+	"github.com/json-iterator/go"
+	"go.uber.org/zap"
+	"howett.net/plist"
+)
+
+const (
+	AsarShared = "shared"
+	AsarSplit  = "split"
+
+	maxReportedMismatches = 20
+)
+
+type MergeOptions struct {
+	X64    string
+	Arm64  string
+	Output string
+
+	// non-binary files (glob) allowed to differ, x64 version is used
+	AllowDiff []string
+	// files (glob) allowed to exist only in one of the apps
+	SingleArchFiles []string
+	// x64-only binaries (glob) expected to be the same in both apps (e.g. a tool that is run using Rosetta)
+	X64ArchFiles []string
+}
+
+type AsarMerge struct {
+	Path string `json:"path"`
+	// shared - packed files are identical and the archive is used for both architectures,
+	// split - archive of each architecture is kept as <name>-<arch>.asar and the shim archive loads the one of the current architecture
+	Mode string `json:"mode"`
+	// packed files that differ (split mode)
+	Differ []string `json:"differ,omitempty"`
+}
+
+type MergeReport struct {
+	// Mach-O files merged into universal
+	Merged []string `json:"merged"`
+	// identical files are copied once
+	CopiedCount int `json:"copiedCount"`
+	// allowed to differ, x64 version is used
+	Differ []string     `json:"differ,omitempty"`
+	Asar   []*AsarMerge `json:"asar,omitempty"`
+}
+
+type fileInfo struct {
+	x64   os.FileInfo
+	arm64 os.FileInfo
+}
+
+type merger struct {
+	options *MergeOptions
+
+	allowDiff       []*asar.Pattern
+	singleArchFiles []*asar.Pattern
+	x64ArchFiles    []*asar.Pattern
+
+	report *MergeReport
+
+	mutex      sync.Mutex
+	mismatches []string
+	// children of the dir that exists only in one of the apps are not reported
+	lastMissingDir string
+}
+
+func ConfigureCommand(app *kingpin.Application) {
+	command := app.Command("universal", "Universal (x64 and arm64) macOS app.")
+	configureAppCommand(command)
+	configureLipoCommand(command)
+}
+
+func configureAppCommand(universalCommand *kingpin.CmdClause) {
+	command := universalCommand.Command("app", "Merge x64 and arm64 builds of the app into universal app: Mach-O files are merged, other files must be identical. "+
+		"Report is written to stdout as JSON. The universal app must be signed after merging.")
+	options := MergeOptions{}
+	command.Flag("x64", "The x64 .app bundle.").Required().ExistingDirVar(&options.X64)
+	command.Flag("arm64", "The arm64 .app bundle.").Required().ExistingDirVar(&options.Arm64)
+	command.Flag("output", "The output .app bundle (must not exist).").Short('o').Required().StringVar(&options.Output)
+	command.Flag("allow-diff", "Non-binary files (glob) allowed to differ (x64 version is used), can be specified several times.").StringsVar(&options.AllowDiff)
+	command.Flag("single-arch-files", "Files (glob) allowed to exist only in one of the apps, can be specified several times.").StringsVar(&options.SingleArchFiles)
+	command.Flag("x64-arch-files", "x64-only binaries (glob) expected to be the same in both apps, can be specified several times.").StringsVar(&options.X64ArchFiles)
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		report, err := MergeApp(options)
+		if err != nil {
+			return err
+		}
+		return util.WriteJsonToStdOut(report)
+	})
+}
+
+func MergeApp(options MergeOptions) (*MergeReport, error) {
+	_, err := os.Lstat(options.Output)
+	if err == nil {
+		return nil, util.NewMessageError("output "+options.Output+" already exists", "ERR_UNIVERSAL_OUTPUT_EXISTS")
+	}
+	if !os.IsNotExist(err) {
+		return nil, errors.WithStack(err)
+	}
+
+	t := &merger{
+		options:         &options,
+		allowDiff:       asar.NewPatterns(options.AllowDiff),
+		singleArchFiles: asar.NewPatterns(options.SingleArchFiles),
+		x64ArchFiles:    asar.NewPatterns(options.X64ArchFiles),
+		report:          &MergeReport{Merged: make([]string, 0)},
+	}
+
+	files, err := t.collectFiles()
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	// parent is before children
+	sort.Strings(paths)
+
+	err = fsutil.EnsureDir(options.Output)
+	if err != nil {
+		return nil, err
+	}
+
+	isAsarChanged, err := t.mergeAsarFiles(paths, files)
+	if err != nil {
+		return nil, err
+	}
+
+	var regularFiles []string
+	for _, p := range paths {
+		item := files[p]
+		if item == nil {
+			// handled as part of asar
+			continue
+		}
+
+		err = t.mergeEntry(p, item, &regularFiles)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = util.MapAsync(len(regularFiles), func(taskIndex int) (func() error, error) {
+		p := regularFiles[taskIndex]
+		return func() error {
+			return t.mergeFile(p)
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(t.mismatches) != 0 {
+		sort.Strings(t.mismatches)
+		mismatches := t.mismatches
+		if len(mismatches) > maxReportedMismatches {
+			mismatches = append(mismatches[:maxReportedMismatches:maxReportedMismatches], "...")
+		}
+		return nil, util.NewMessageError("x64 and arm64 apps cannot be merged:\n  "+strings.Join(mismatches, "\n  "), "ERR_UNIVERSAL_FILE_MISMATCH")
+	}
+
+	if isAsarChanged {
+		err = updateAsarIntegrity(options.Output)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Strings(t.report.Merged)
+	sort.Strings(t.report.Differ)
+	return t.report, nil
+}
+
+func (t *merger) collectFiles() (map[string]*fileInfo, error) {
+	result := make(map[string]*fileInfo)
+	for index, dir := range []string{t.options.X64, t.options.Arm64} {
+		dir = filepath.Clean(dir)
+		err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if file == dir {
+				return nil
+			}
+
+			p := filepath.ToSlash(file[len(dir)+1:])
+			item := result[p]
+			if item == nil {
+				item = &fileInfo{}
+				result[p] = item
+			}
+			if index == 0 {
+				item.x64 = info
+			} else {
+				item.arm64 = info
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return result, nil
+}
+
+func (t *merger) addMismatch(p string, reason string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.mismatches = append(t.mismatches, p+": "+reason)
+}
+
+func (t *merger) x64File(p string) string {
+	return filepath.Join(t.options.X64, filepath.FromSlash(p))
+}
+
+func (t *merger) arm64File(p string) string {
+	return filepath.Join(t.options.Arm64, filepath.FromSlash(p))
+}
+
+func (t *merger) outputFile(p string) string {
+	return filepath.Join(t.options.Output, filepath.FromSlash(p))
+}
+
+// mergeEntry creates dirs and symlinks, regular files present in both apps are added to the list to be merged in parallel
+func (t *merger) mergeEntry(p string, item *fileInfo, regularFiles *[]string) error {
+	if item.x64 == nil || item.arm64 == nil {
+		if _, err := os.Lstat(t.outputFile(p)); err == nil {
+			// parent dir is already copied
+			return nil
+		}
+
+		if !matchAny(t.singleArchFiles, p) {
+			if len(t.lastMissingDir) != 0 && strings.HasPrefix(p, t.lastMissingDir+"/") {
+				return nil
+			}
+			t.lastMissingDir = p
+
+			if item.x64 == nil {
+				t.addMismatch(p, "exists only in arm64 app")
+			} else {
+				t.addMismatch(p, "exists only in x64 app")
+			}
+			return nil
+		}
+
+		from := t.x64File(p)
+		if item.x64 == nil {
+			from = t.arm64File(p)
+		}
+		return fs.CopyDirOrFile(from, t.outputFile(p))
+	}
+
+	x64Type := item.x64.Mode() & os.ModeType
+	if x64Type != item.arm64.Mode()&os.ModeType {
+		t.addMismatch(p, "file type is different")
+		return nil
+	}
+
+	switch {
+	case item.x64.IsDir():
+		return errors.WithStack(os.MkdirAll(t.outputFile(p), 0755))
+
+	case x64Type&os.ModeSymlink != 0:
+		x64Link, err := os.Readlink(t.x64File(p))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		arm64Link, err := os.Readlink(t.arm64File(p))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if x64Link != arm64Link {
+			t.addMismatch(p, "symlink target is different ("+x64Link+" and "+arm64Link+")")
+			return nil
+		}
+		return errors.WithStack(os.Symlink(x64Link, t.outputFile(p)))
+
+	case item.x64.Mode().IsRegular():
+		*regularFiles = append(*regularFiles, p)
+	}
+	return nil
+}
+
+func (t *merger) mergeFile(p string) error {
+	x64File := t.x64File(p)
+	arm64File := t.arm64File(p)
+	info, err := os.Stat(x64File)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	x64Slices, err := readSlices(x64File)
+	if err != nil {
+		return err
+	}
+
+	isSame, err := isSameContent(x64File, arm64File)
+	if err != nil {
+		return err
+	}
+
+	if isSame {
+		if x64Slices != nil && !containsCpu(x64Slices, macho.CpuArm64) && !matchAny(t.x64ArchFiles, p) {
+			t.addMismatch(p, "the same x64-only binary in both apps (x64 native module in arm64 build?), use x64-arch-files if it is expected")
+			return nil
+		}
+		t.incrementCopiedCount()
+		return fs.CopyFileAndRestoreNormalPermissions(x64File, t.outputFile(p), info.Mode())
+	}
+
+	arm64Slices, err := readSlices(arm64File)
+	if err != nil {
+		return err
+	}
+
+	if x64Slices != nil && arm64Slices != nil {
+		err = writeFat(t.outputFile(p), append(x64Slices, arm64Slices...), info.Mode())
+		if err != nil {
+			return err
+		}
+
+		t.mutex.Lock()
+		t.report.Merged = append(t.report.Merged, p)
+		t.mutex.Unlock()
+		return nil
+	}
+
+	if x64Slices != nil || arm64Slices != nil {
+		t.addMismatch(p, "Mach-O file only in one of the apps")
+		return nil
+	}
+
+	isAllowed := matchAny(t.allowDiff, p)
+	if !isAllowed && path.Base(p) == "Info.plist" {
+		isAllowed, err = isSamePlistExceptAsarIntegrity(x64File, arm64File)
+		if err != nil {
+			return err
+		}
+	}
+	if !isAllowed {
+		t.addMismatch(p, "content is different, use allow-diff if it is expected")
+		return nil
+	}
+
+	t.mutex.Lock()
+	t.report.Differ = append(t.report.Differ, p)
+	t.mutex.Unlock()
+	return fs.CopyFileAndRestoreNormalPermissions(x64File, t.outputFile(p), info.Mode())
+}
+
+func (t *merger) incrementCopiedCount() {
+	t.mutex.Lock()
+	t.report.CopiedCount++
+	t.mutex.Unlock()
+}
+
+// mergeAsarFiles handles archives that differ: if packed files are identical, x64 archive is used (unpacked files are merged as regular files),
+// otherwise archives of both architectures are kept and shim archive is created. Returns true if any archive is changed.
+func (t *merger) mergeAsarFiles(paths []string, files map[string]*fileInfo) (bool, error) {
+	isChanged := false
+	for _, p := range paths {
+		item := files[p]
+		if item == nil || item.x64 == nil || item.arm64 == nil || !item.x64.Mode().IsRegular() || !strings.HasSuffix(p, ".asar") {
+			continue
+		}
+
+		isSame, err := isSameContent(t.x64File(p), t.arm64File(p))
+		if err != nil {
+			return false, err
+		}
+		if isSame {
+			continue
+		}
+
+		isChanged = true
+		x64Archive, err := asar.OpenArchive(t.x64File(p))
+		if err != nil {
+			return false, err
+		}
+		arm64Archive, err := asar.OpenArchive(t.arm64File(p))
+		if err != nil {
+			return false, err
+		}
+
+		differ, err := asar.DiffPacked(x64Archive, arm64Archive)
+		if err != nil {
+			return false, err
+		}
+
+		if len(differ) == 0 {
+			t.report.Asar = append(t.report.Asar, &AsarMerge{Path: p, Mode: AsarShared})
+			err = fs.CopyDirOrFile(t.x64File(p), t.outputFile(p))
+			if err != nil {
+				return false, err
+			}
+			files[p] = nil
+			continue
+		}
+
+		log.Info("asar archives differ, archive of each architecture is used", zap.String("file", p), zap.Int("differentFileCount", len(differ)))
+		t.report.Asar = append(t.report.Asar, &AsarMerge{Path: p, Mode: AsarSplit, Differ: differ})
+		err = t.splitAsar(p, x64Archive)
+		if err != nil {
+			return false, err
+		}
+
+		// archive and unpacked files are handled
+		files[p] = nil
+		unpackedDir := p + ".unpacked"
+		for _, otherPath := range paths {
+			if otherPath == unpackedDir || strings.HasPrefix(otherPath, unpackedDir+"/") {
+				files[otherPath] = nil
+			}
+		}
+	}
+	return isChanged, nil
+}
+
+func (t *merger) splitAsar(p string, x64Archive *asar.Archive) error {
+	name := strings.TrimSuffix(path.Base(p), ".asar")
+	for _, arch := range []string{"x64", "arm64"} {
+		from := t.x64File(p)
+		if arch == "arm64" {
+			from = t.arm64File(p)
+		}
+		to := t.outputFile(path.Join(path.Dir(p), name+"-"+arch+".asar"))
+
+		err := fs.CopyDirOrFile(from, to)
+		if err != nil {
+			return err
+		}
+
+		_, err = os.Stat(from + ".unpacked")
+		if err == nil {
+			err = fs.CopyDirOrFile(from+".unpacked", to+".unpacked")
+		} else if os.IsNotExist(err) {
+			err = nil
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return createShimAsar(t.outputFile(p), name, x64Archive)
+}
+
+// createShimAsar creates archive that loads the archive of the current architecture, app name and version are taken from the x64 archive (used by Electron as app name)
+func createShimAsar(file string, name string, x64Archive *asar.Archive) error {
+	packageData, err := x64Archive.ReadFile("package.json")
+	if err != nil {
+		return err
+	}
+
+	var packageInfo map[string]interface{}
+	err = jsoniter.Unmarshal(packageData, &packageInfo)
+	if err != nil {
+		return errors.WithMessage(err, "cannot parse package.json of "+x64Archive.File)
+	}
+
+	shimPackage := map[string]interface{}{"main": "index.js"}
+	for _, key := range []string{"name", "productName", "version", "desktopName"} {
+		if value, ok := packageInfo[key]; ok {
+			shimPackage[key] = value
+		}
+	}
+	shimPackageData, err := jsoniter.ConfigCompatibleWithStandardLibrary.MarshalIndent(shimPackage, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	tempDir, err := util.CreateTempDir("universal-shim")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(tempDir)
+	}()
+
+	err = ioutil.WriteFile(filepath.Join(tempDir, "package.json"), shimPackageData, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	script := "// loads the archive of the current architecture\n" +
+		"process._archPath = require.resolve(process.arch === 'arm64' ? '../" + name + "-arm64.asar' : '../" + name + "-x64.asar')\n" +
+		"require(process._archPath)\n"
+	err = ioutil.WriteFile(filepath.Join(tempDir, "index.js"), []byte(script), 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = asar.Pack(asar.PackOptions{Dir: tempDir, Output: file})
+	return err
+}
+
+// updateAsarIntegrity sets ElectronAsarIntegrity for archives in Resources if Info.plist of the app contains it
+func updateAsarIntegrity(appDir string) error {
+	plistFile := filepath.Join(appDir, "Contents", "Info.plist")
+	data, err := ioutil.ReadFile(plistFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.WithStack(err)
+	}
+
+	var info map[string]interface{}
+	_, err = plist.Unmarshal(data, &info)
+	if err != nil {
+		return errors.WithMessage(err, "cannot decode plist "+plistFile)
+	}
+	if _, ok := info["ElectronAsarIntegrity"]; !ok {
+		return nil
+	}
+
+	archives, err := filepath.Glob(filepath.Join(appDir, "Contents", "Resources", "*.asar"))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	result, err := asar.ComputeIntegrity(archives, filepath.Join(appDir, "Contents"), false)
+	if err != nil {
+		return err
+	}
+	return asar.SetPlistIntegrity(plistFile, result.Plist)
+}
+
+// ElectronAsarIntegrity differs if unpacked native modules differ (header contains size and hash of unpacked files), it is updated after merge
+func isSamePlistExceptAsarIntegrity(x64File string, arm64File string) (bool, error) {
+	var infos [2]map[string]interface{}
+	for index, file := range []string{x64File, arm64File} {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return false, errors.WithStack(err)
+		}
+		_, err = plist.Unmarshal(data, &infos[index])
+		if err != nil {
+			// not a valid plist - compared as a regular file
+			return false, nil
+		}
+		delete(infos[index], "ElectronAsarIntegrity")
+	}
+	return reflect.DeepEqual(infos[0], infos[1]), nil
+}
+
+func isSameContent(file1 string, file2 string) (bool, error) {
+	info1, err := os.Stat(file1)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	info2, err := os.Stat(file2)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	if info1.Size() != info2.Size() {
+		return false, nil
+	}
+
+	hash1, err := computeHash(file1)
+	if err != nil {
+		return false, err
+	}
+	hash2, err := computeHash(file2)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(hash1, hash2), nil
+}
+
+func computeHash(file string) ([]byte, error) {
+	reader, err := os.Open(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer util.Close(reader)
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, reader)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return hash.Sum(nil), nil
+}
+
+func containsCpu(slices []*slice, cpu macho.Cpu) bool {
+	for _, item := range slices {
+		if item.cpu == cpu {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []*asar.Pattern, p string) bool {
+	for _, pattern := range patterns {
+		if pattern.Match(p) {
+			return true
+		}
+	}
+	return false
+}
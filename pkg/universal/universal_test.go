@@ -0,0 +1,170 @@
+package universal
+
+import (
+	"debug/macho"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/develar/app-builder/pkg/asar"
+	"github.com/develar/app-builder/pkg/log"
+	. "github.com/onsi/gomega"
+	"howett.net/plist"
+)
+
+func createMachO(cpu macho.Cpu, content string) string {
+	header := make([]byte, 32)
+	binary.LittleEndian.PutUint32(header, macho.Magic64)
+	binary.LittleEndian.PutUint32(header[4:], uint32(cpu))
+	binary.LittleEndian.PutUint32(header[12:], uint32(macho.TypeExec))
+	return string(header) + content
+}
+
+func writeFile(g *GomegaWithT, file string, data string) {
+	g.Expect(os.MkdirAll(filepath.Dir(file), 0755)).To(Succeed())
+	g.Expect(ioutil.WriteFile(file, []byte(data), 0755)).To(Succeed())
+}
+
+// app with asar archive (native module is unpacked)
+func createTestApp(g *GomegaWithT, dir string, arch string, cpu macho.Cpu, mainScript string) string {
+	appDir := filepath.Join(dir, arch, "Test.app")
+	contentsDir := filepath.Join(appDir, "Contents")
+	writeFile(g, filepath.Join(contentsDir, "Info.plist"), `<?xml version="1.0" encoding="UTF-8"?><plist version="1.0"><dict>`+
+		`<key>CFBundleExecutable</key><string>Test</string><key>ElectronAsarIntegrity</key><dict/></dict></plist>`)
+	writeFile(g, filepath.Join(contentsDir, "MacOS", "Test"), createMachO(cpu, "main"))
+	writeFile(g, filepath.Join(contentsDir, "Resources", "icon.icns"), "icon")
+	writeFile(g, filepath.Join(contentsDir, "Frameworks", "Foo.framework", "Versions", "A", "Foo"), createMachO(cpu, "foo"))
+	g.Expect(os.Symlink("A", filepath.Join(contentsDir, "Frameworks", "Foo.framework", "Versions", "Current"))).To(Succeed())
+
+	sourceDir := filepath.Join(dir, arch, "source")
+	writeFile(g, filepath.Join(sourceDir, "package.json"), `{"name": "test", "productName": "Test", "version": "1.0.0", "main": "main.js"}`)
+	writeFile(g, filepath.Join(sourceDir, "main.js"), mainScript)
+	writeFile(g, filepath.Join(sourceDir, "node_modules", "foo", "foo.node"), createMachO(cpu, "native"))
+	_, err := asar.Pack(asar.PackOptions{Dir: sourceDir, Output: filepath.Join(contentsDir, "Resources", "app.asar"), Unpack: []string{"*.node"}})
+	g.Expect(err).NotTo(HaveOccurred())
+	return appDir
+}
+
+func expectUniversal(g *GomegaWithT, file string) {
+	fatFile, err := macho.OpenFat(file)
+	g.Expect(err).NotTo(HaveOccurred())
+	defer fatFile.Close()
+	g.Expect(fatFile.Arches).To(HaveLen(2))
+	g.Expect(fatFile.Arches[0].Cpu).To(Equal(macho.CpuAmd64))
+	g.Expect(fatFile.Arches[0].Offset % (1 << alignDefault)).To(BeZero())
+	g.Expect(fatFile.Arches[1].Cpu).To(Equal(macho.CpuArm64))
+	g.Expect(fatFile.Arches[1].Offset % (1 << alignArm64)).To(BeZero())
+}
+
+func TestMergeApp(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "universal")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	x64App := createTestApp(g, dir, "x64", macho.CpuAmd64, "console.log('main')")
+	arm64App := createTestApp(g, dir, "arm64", macho.CpuArm64, "console.log('main')")
+	output := filepath.Join(dir, "universal", "Test.app")
+
+	report, err := MergeApp(MergeOptions{X64: x64App, Arm64: arm64App, Output: output})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(report.Merged).To(Equal([]string{
+		"Contents/Frameworks/Foo.framework/Versions/A/Foo",
+		"Contents/MacOS/Test",
+		"Contents/Resources/app.asar.unpacked/node_modules/foo/foo.node",
+	}))
+	g.Expect(report.Asar).To(Equal([]*AsarMerge{{Path: "Contents/Resources/app.asar", Mode: AsarShared}}))
+	expectUniversal(g, filepath.Join(output, "Contents", "MacOS", "Test"))
+	expectUniversal(g, filepath.Join(output, "Contents", "Resources", "app.asar.unpacked", "node_modules", "foo", "foo.node"))
+	link, err := os.Readlink(filepath.Join(output, "Contents", "Frameworks", "Foo.framework", "Versions", "Current"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(link).To(Equal("A"))
+
+	// the second run must not overwrite the output
+	_, err = MergeApp(MergeOptions{X64: x64App, Arm64: arm64App, Output: output})
+	g.Expect(err.(interface{ ErrorCode() string }).ErrorCode()).To(Equal("ERR_UNIVERSAL_OUTPUT_EXISTS"))
+}
+
+func TestMergeAppSplitAsar(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "universal")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	x64App := createTestApp(g, dir, "x64", macho.CpuAmd64, "console.log('x64')")
+	arm64App := createTestApp(g, dir, "arm64", macho.CpuArm64, "console.log('arm64')")
+	output := filepath.Join(dir, "Test.app")
+
+	report, err := MergeApp(MergeOptions{X64: x64App, Arm64: arm64App, Output: output})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(report.Asar).To(Equal([]*AsarMerge{{Path: "Contents/Resources/app.asar", Mode: AsarSplit, Differ: []string{"main.js"}}}))
+
+	resourceDir := filepath.Join(output, "Contents", "Resources")
+	for _, arch := range []string{"x64", "arm64"} {
+		g.Expect(filepath.Join(resourceDir, "app-"+arch+".asar")).To(BeAnExistingFile())
+		g.Expect(filepath.Join(resourceDir, "app-"+arch+".asar.unpacked", "node_modules", "foo", "foo.node")).To(BeAnExistingFile())
+	}
+	g.Expect(filepath.Join(resourceDir, "app.asar.unpacked")).NotTo(BeAnExistingFile())
+
+	shim, err := asar.OpenArchive(filepath.Join(resourceDir, "app.asar"))
+	g.Expect(err).NotTo(HaveOccurred())
+	packageData, err := shim.ReadFile("package.json")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(packageData)).To(MatchJSON(`{"name": "test", "productName": "Test", "version": "1.0.0", "main": "index.js"}`))
+	script, err := shim.ReadFile("index.js")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(script)).To(ContainSubstring("'../app-arm64.asar'"))
+
+	data, err := ioutil.ReadFile(filepath.Join(output, "Contents", "Info.plist"))
+	g.Expect(err).NotTo(HaveOccurred())
+	var info map[string]interface{}
+	_, err = plist.Unmarshal(data, &info)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(info["ElectronAsarIntegrity"]).To(HaveKey("Resources/app.asar"))
+	g.Expect(info["ElectronAsarIntegrity"]).To(HaveKey("Resources/app-x64.asar"))
+	g.Expect(info["ElectronAsarIntegrity"]).To(HaveKey("Resources/app-arm64.asar"))
+}
+
+func TestMergeAppMismatch(t *testing.T) {
+	g := NewGomegaWithT(t)
+	log.InitLogger()
+
+	dir, err := ioutil.TempDir("", "universal")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	x64App := createTestApp(g, dir, "x64", macho.CpuAmd64, "")
+	arm64App := createTestApp(g, dir, "arm64", macho.CpuArm64, "")
+	writeFile(g, filepath.Join(x64App, "Contents", "Resources", "config.json"), "x64")
+	writeFile(g, filepath.Join(arm64App, "Contents", "Resources", "config.json"), "arm64")
+	for _, app := range []string{x64App, arm64App} {
+		writeFile(g, filepath.Join(app, "Contents", "Resources", "tool"), createMachO(macho.CpuAmd64, "tool"))
+	}
+	writeFile(g, filepath.Join(x64App, "Contents", "Resources", "x64", "readme"), "")
+
+	_, err = MergeApp(MergeOptions{X64: x64App, Arm64: arm64App, Output: filepath.Join(dir, "out1", "Test.app")})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.(interface{ ErrorCode() string }).ErrorCode()).To(Equal("ERR_UNIVERSAL_FILE_MISMATCH"))
+	g.Expect(err.Error()).To(ContainSubstring("Contents/Resources/config.json: content is different"))
+	g.Expect(err.Error()).To(ContainSubstring("Contents/Resources/tool: the same x64-only binary"))
+	g.Expect(err.Error()).To(ContainSubstring("Contents/Resources/x64: exists only in x64 app"))
+	g.Expect(err.Error()).NotTo(ContainSubstring("readme"))
+
+	report, err := MergeApp(MergeOptions{
+		X64:             x64App,
+		Arm64:           arm64App,
+		Output:          filepath.Join(dir, "out2", "Test.app"),
+		AllowDiff:       []string{"config.json"},
+		X64ArchFiles:    []string{"Contents/Resources/tool"},
+		SingleArchFiles: []string{"Contents/Resources/x64"},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(report.Differ).To(Equal([]string{"Contents/Resources/config.json"}))
+	g.Expect(filepath.Join(dir, "out2", "Test.app", "Contents", "Resources", "x64", "readme")).To(BeAnExistingFile())
+}
@@ -3,6 +3,7 @@ package util
 import (
 	"runtime"
 
+	"github.com/develar/app-builder/pkg/crash"
 	"github.com/develar/app-builder/pkg/log"
 	"github.com/develar/errors"
 	"go.uber.org/zap"
@@ -57,6 +58,8 @@ func MapAsyncConcurrency(taskCount int, concurrency int, taskProducer func(taskI
 
 		go func(task func() error) {
 			defer markDone()
+			// panic in goroutine cannot be recovered by main
+			defer crash.HandlePanic()
 
 			// select waits on multiple channels, if quitChannel is closed, read will succeed without blocking
 			// the default case in a select is run if no other case is ready
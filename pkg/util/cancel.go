@@ -3,7 +3,9 @@ package util
 import (
 	"context"
 	"os"
+	"os/exec"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
@@ -11,22 +13,180 @@ import (
 	"go.uber.org/zap"
 )
 
+var (
+	rootContext      context.Context
+	cancelRoot       context.CancelFunc
+	initCancelSignal sync.Once
+
+	cancelMutex   sync.Mutex
+	isCanceled    bool
+	cleanups      = make(map[int]func())
+	lastCleanupId int
+	processes     = make(map[*os.Process]bool)
+)
+
+// HandleCancelSignals installs SIGINT/SIGTERM handler: root context is canceled, running child processes are killed,
+// registered cleanups (partially written files) are performed and process exits with 128 + signal number (second signal exits immediately).
+func HandleCancelSignals() {
+	initCancelSignal.Do(func() {
+		rootContext, cancelRoot = context.WithCancel(context.Background())
+		signals := make(chan os.Signal, 2)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		go onCancelSignal(signals)
+	})
+}
+
+// RootContext is canceled on SIGINT/SIGTERM, contexts of all long operations (downloads, publishing, pipeline tasks) must be derived from it
+func RootContext() context.Context {
+	HandleCancelSignals()
+	return rootContext
+}
+
 func CreateContext() (context.Context, context.CancelFunc) {
-	c, cancel := context.WithCancel(context.Background())
-	go onCancelSignal(cancel)
-	return c, cancel
+	return context.WithCancel(RootContext())
 }
 
 func CreateContextWithTimeout(timeout time.Duration) (context.Context, context.CancelFunc) {
-	c, cancel := context.WithTimeout(context.Background(), timeout)
-	go onCancelSignal(cancel)
-	return c, cancel
+	return context.WithTimeout(RootContext(), timeout)
 }
 
-func onCancelSignal(cancel context.CancelFunc) {
-	defer cancel()
-	signals := make(chan os.Signal, 2)
-	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+func onCancelSignal(signals chan os.Signal) {
 	sig := <-signals
+	exitCode := 130
+	if sig == syscall.SIGTERM {
+		exitCode = 143
+	}
+
+	go func() {
+		<-signals
+		os.Exit(exitCode)
+	}()
+
 	log.Info("canceling", zap.String("signal", sig.String()))
+	cancelMutex.Lock()
+	isCanceled = true
+	cancelMutex.Unlock()
+
+	// before context cancel, because processes started using exec.CommandContext are killed without a chance to clean up
+	stopProcesses()
+	cancelRoot()
+
+	cancelMutex.Lock()
+	// in reverse order of registration (e.g. temp file inside temp dir is removed first)
+	for id := lastCleanupId; id > 0; id-- {
+		cleanup := cleanups[id]
+		if cleanup != nil {
+			cleanup()
+		}
+	}
+	cancelMutex.Unlock()
+	CleanupTemp()
+
+	_ = log.LOG.Sync()
+	os.Exit(exitCode)
+}
+
+// stopProcesses terminates child processes gracefully (child app-builder performs own cleanup), not exited in 5 seconds are killed
+func stopProcesses() {
+	cancelMutex.Lock()
+	for process := range processes {
+		// not supported on Windows
+		if process.Signal(syscall.SIGTERM) != nil {
+			_ = process.Kill()
+		}
+	}
+	cancelMutex.Unlock()
+
+	// process is untracked when Wait returns
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		cancelMutex.Lock()
+		count := len(processes)
+		cancelMutex.Unlock()
+		if count == 0 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	cancelMutex.Lock()
+	for process := range processes {
+		err := process.Kill()
+		if err != nil {
+			log.Debug("cannot kill child process", zap.Int("pid", process.Pid), zap.Error(err))
+		}
+	}
+	cancelMutex.Unlock()
+}
+
+// WaitIfCanceled blocks if process is being canceled (the cancel handler exits after cleanup), so, error caused by cancel doesn't exit before cleanup
+func WaitIfCanceled() {
+	cancelMutex.Lock()
+	canceled := isCanceled
+	cancelMutex.Unlock()
+	if canceled {
+		select {}
+	}
+}
+
+// OnCancel registers function to be called if process is canceled, returned function unregisters it and must be called when operation is completed
+func OnCancel(cleanup func()) func() {
+	cancelMutex.Lock()
+	defer cancelMutex.Unlock()
+
+	HandleCancelSignals()
+	lastCleanupId++
+	id := lastCleanupId
+	cleanups[id] = cleanup
+	return func() {
+		cancelMutex.Lock()
+		delete(cleanups, id)
+		cancelMutex.Unlock()
+	}
+}
+
+// RemoveOnCancel removes files or dirs (not renamed yet to the final location) if process is canceled, so, partially written entry doesn't remain in the cache
+func RemoveOnCancel(files ...string) func() {
+	return OnCancel(func() {
+		for _, file := range files {
+			err := os.RemoveAll(file)
+			if err != nil && !os.IsNotExist(err) {
+				log.Debug("cannot remove on cancel", zap.String("file", file), zap.Error(err))
+			}
+		}
+	})
+}
+
+// trackProcess registers started process to kill it on cancel
+func trackProcess(process *os.Process) {
+	cancelMutex.Lock()
+	defer cancelMutex.Unlock()
+
+	if isCanceled {
+		// started concurrently with cancel
+		_ = process.Kill()
+		return
+	}
+	processes[process] = true
+}
+
+func untrackProcess(process *os.Process) {
+	if process == nil {
+		return
+	}
+
+	cancelMutex.Lock()
+	delete(processes, process)
+	cancelMutex.Unlock()
+}
+
+// runCommand is a command.Run() that kills the command on cancel
+func runCommand(command *exec.Cmd) error {
+	err := command.Start()
+	if err != nil {
+		return err
+	}
+
+	trackProcess(command.Process)
+	defer untrackProcess(command.Process)
+	return command.Wait()
 }
@@ -0,0 +1,190 @@
+package util
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// error categories - stable identifiers to map failure to documentation link and retry decision (specific code, e.g. ERR_SIGN_TIMESTAMP_FAILED, can be added any time)
+const (
+	ErrorCategoryDownloadChecksumMismatch = "DOWNLOAD_CHECKSUM_MISMATCH"
+	ErrorCategoryDownloadFailed           = "DOWNLOAD_FAILED"
+	ErrorCategoryNetwork                  = "NETWORK"
+	ErrorCategoryToolMissing              = "TOOL_MISSING"
+	ErrorCategoryToolFailed               = "TOOL_FAILED"
+	ErrorCategorySigningTimestampFailed   = "SIGNING_TIMESTAMP_FAILED"
+	ErrorCategorySigningFailed            = "SIGNING_FAILED"
+	ErrorCategoryNotarizationFailed       = "NOTARIZATION_FAILED"
+	ErrorCategoryPublishFailed            = "PUBLISH_FAILED"
+	ErrorCategoryCredentials              = "CREDENTIALS"
+	ErrorCategoryInvalidConfiguration     = "INVALID_CONFIGURATION"
+	ErrorCategoryInvalidInput             = "INVALID_INPUT"
+	ErrorCategoryFileSystem               = "FILE_SYSTEM"
+	ErrorCategoryBuildFailed              = "BUILD_FAILED"
+	ErrorCategoryInternal                 = "INTERNAL"
+)
+
+// ErrorInfo is emitted for the failed command (log entry fields), so, caller doesn't need to match error message
+type ErrorInfo struct {
+	// specific code (ERR_*)
+	Code     string `json:"code"`
+	Category string `json:"category"`
+	// the same operation may succeed if repeated (network errors, timestamp server not available)
+	IsRetryable bool   `json:"retryable"`
+	Message     string `json:"message"`
+}
+
+var errorCodeCategories = map[string]string{
+	"ERR_DOWNLOAD_CHECKSUM_MISMATCH":           ErrorCategoryDownloadChecksumMismatch,
+	"ERR_ELECTRON_CHECKSUM_MISMATCH":           ErrorCategoryDownloadChecksumMismatch,
+	"ERR_ELECTRON_CHECKSUM_MISSING":            ErrorCategoryDownloadChecksumMismatch,
+	"ERR_CHECKSUM_PIN_MISMATCH":                ErrorCategoryDownloadChecksumMismatch,
+	"ERR_DIFFERENTIAL_BLOCK_CHECKSUM_MISMATCH": ErrorCategoryDownloadChecksumMismatch,
+	"ERR_DOWNLOAD_FAILED":                      ErrorCategoryDownloadFailed,
+	"ERR_DOWNLOAD_TIMEOUT":                     ErrorCategoryDownloadFailed,
+	"ERR_DIFFERENTIAL_RANGE_NOT_SUPPORTED":     ErrorCategoryDownloadFailed,
+	"ERR_CACHE_DECRYPTION_FAILED":              ErrorCategoryDownloadFailed,
+	"ERR_NETWORK":                              ErrorCategoryNetwork,
+
+	"ERR_TOOL_NOT_FOUND":                ErrorCategoryToolMissing,
+	"ERR_WINE_NOT_INSTALLED":            ErrorCategoryToolMissing,
+	"ERR_WINE_VERSION_INCOMPATIBLE":     ErrorCategoryToolMissing,
+	"ERR_SNAPCRAFT_NOT_INSTALLED":       ErrorCategoryToolMissing,
+	"ERR_SNAPCRAFT_OUTDATED":            ErrorCategoryToolMissing,
+	"ERR_ICON_SVG_RASTERIZER_NOT_FOUND": ErrorCategoryToolMissing,
+	"ERR_ICON_AVIF_DECODER_NOT_FOUND":   ErrorCategoryToolMissing,
+	"ERR_NSIS_PLUGIN_NOT_FOUND":         ErrorCategoryToolMissing,
+	"ERR_EXEC_FAILED":                   ErrorCategoryToolFailed,
+	"ERR_NATIVE_REBUILD_FAILED":         ErrorCategoryToolFailed,
+	"ERR_SNAP_SMOKE_TEST_FAILED":        ErrorCategoryToolFailed,
+
+	"ERR_SIGN_TIMESTAMP_FAILED":        ErrorCategorySigningTimestampFailed,
+	"ERR_SIGN_INVALID_CERTIFICATE":     ErrorCategorySigningFailed,
+	"ERR_SIGN_PUBLISHER_MISMATCH":      ErrorCategorySigningFailed,
+	"ERR_SIGN_IDENTITY_NOT_FOUND":      ErrorCategorySigningFailed,
+	"ERR_SIGN_INVALID_PACKAGE":         ErrorCategorySigningFailed,
+	"ERR_SIGN_UNSUPPORTED_FORMAT":      ErrorCategorySigningFailed,
+	"ERR_CODESIGN_VERIFY_FAILED":       ErrorCategorySigningFailed,
+	"ERR_KEYCHAIN_FAILED":              ErrorCategorySigningFailed,
+	"ERR_PROVISIONING_PROFILE_INVALID": ErrorCategorySigningFailed,
+	"ERR_MSIX_NO_CERTIFICATE":          ErrorCategorySigningFailed,
+	"ERR_MSIX_PUBLISHER_MISMATCH":      ErrorCategorySigningFailed,
+	"ERR_NOTARIZE_REJECTED":            ErrorCategoryNotarizationFailed,
+	"ERR_NOTARIZE_TIMEOUT":             ErrorCategoryNotarizationFailed,
+	"ERR_NOTARIZE_INVALID_KEY":         ErrorCategoryCredentials,
+	"ERR_STAPLE_TICKET_NOT_FOUND":      ErrorCategoryNotarizationFailed,
+	"ERR_STAPLE_NOT_SIGNED":            ErrorCategoryNotarizationFailed,
+
+	"ERR_PUBLISH_VERIFICATION_FAILED": ErrorCategoryPublishFailed,
+	"ERR_CDN_INVALIDATION_FAILED":     ErrorCategoryPublishFailed,
+	"ERR_CREDENTIALS_NOT_SET":         ErrorCategoryCredentials,
+	"ERR_CREDENTIALS_HELPER_FAILED":   ErrorCategoryCredentials,
+
+	"ERR_FILE_NOT_FOUND":     ErrorCategoryFileSystem,
+	"ERR_PERMISSION_DENIED":  ErrorCategoryFileSystem,
+	"ERR_NO_SPACE_LEFT":      ErrorCategoryFileSystem,
+	"ERR_FILE_SYSTEM":        ErrorCategoryFileSystem,
+	"ERR_NSIS_OUTPUT_LOCKED": ErrorCategoryFileSystem,
+	"ERR_INTERNAL":           ErrorCategoryInternal,
+
+	"ERR_INVALID_COMMAND_LINE": ErrorCategoryInvalidInput,
+}
+
+var retryableCodes = map[string]bool{
+	"ERR_DOWNLOAD_CHECKSUM_MISMATCH":           true,
+	"ERR_DIFFERENTIAL_BLOCK_CHECKSUM_MISMATCH": true,
+	"ERR_DOWNLOAD_FAILED":                      true,
+	"ERR_DOWNLOAD_TIMEOUT":                     true,
+	"ERR_NETWORK":                              true,
+	"ERR_SIGN_TIMESTAMP_FAILED":                true,
+	"ERR_NOTARIZE_TIMEOUT":                     true,
+	"ERR_CDN_INVALIDATION_FAILED":              true,
+	"ERR_NSIS_OUTPUT_LOCKED":                   true,
+}
+
+// GetErrorCategory returns category of the specific code, not explicitly mapped codes are categorized by name
+func GetErrorCategory(code string) string {
+	category, ok := errorCodeCategories[code]
+	if ok {
+		return category
+	}
+
+	switch {
+	case strings.HasSuffix(code, "_NOT_INSTALLED"):
+		return ErrorCategoryToolMissing
+	case strings.Contains(code, "_INVALID_") || strings.Contains(code, "_UNSUPPORTED") || strings.HasSuffix(code, "_MISSING") || strings.HasSuffix(code, "_CONFLICT") || strings.HasSuffix(code, "_COLLISION"):
+		return ErrorCategoryInvalidConfiguration
+	case strings.HasSuffix(code, "_NOT_FOUND") || strings.HasSuffix(code, "_MISMATCH") || strings.HasSuffix(code, "_TOO_LARGE") || strings.HasSuffix(code, "_TOO_LONG"):
+		return ErrorCategoryInvalidInput
+	default:
+		return ErrorCategoryBuildFailed
+	}
+}
+
+// NewCommandLineError converts kingpin parse error (unknown flag or command, unexpected argument, missing required flag) - kingpin doesn't provide error type
+func NewCommandLineError(err error) error {
+	return NewMessageError(err.Error(), "ERR_INVALID_COMMAND_LINE")
+}
+
+// GetErrorInfo walks the cause chain: error that provides ErrorCode() (MessageError) wins, otherwise code is computed by type of the root cause
+func GetErrorInfo(err error) *ErrorInfo {
+	code := getErrorCode(err)
+	return &ErrorInfo{
+		Code:        code,
+		Category:    GetErrorCategory(code),
+		IsRetryable: retryableCodes[code],
+		Message:     err.Error(),
+	}
+}
+
+func getErrorCode(err error) string {
+	for err != nil {
+		switch t := err.(type) {
+		case MessageError:
+			return t.ErrorCode()
+		case *ExecError:
+			if execError, ok := t.Cause.(*exec.Error); ok && execError.Err == exec.ErrNotFound {
+				return "ERR_TOOL_NOT_FOUND"
+			}
+			return "ERR_EXEC_FAILED"
+		case *exec.Error:
+			if t.Err == exec.ErrNotFound {
+				return "ERR_TOOL_NOT_FOUND"
+			}
+		case net.Error:
+			return "ERR_NETWORK"
+		case *os.PathError, *os.LinkError, *os.SyscallError:
+			switch {
+			case os.IsNotExist(t):
+				return "ERR_FILE_NOT_FOUND"
+			case os.IsPermission(t):
+				return "ERR_PERMISSION_DENIED"
+			case underlyingError(t) == syscall.ENOSPC:
+				return "ERR_NO_SPACE_LEFT"
+			}
+			return "ERR_FILE_SYSTEM"
+		}
+
+		cause, ok := err.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+		err = cause.Cause()
+	}
+	return "ERR_INTERNAL"
+}
+
+func underlyingError(err error) error {
+	switch t := err.(type) {
+	case *os.PathError:
+		return t.Err
+	case *os.LinkError:
+		return t.Err
+	case *os.SyscallError:
+		return t.Err
+	}
+	return err
+}
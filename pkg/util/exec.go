@@ -18,7 +18,7 @@ func ExecuteAndPipeStdOutAndStdErr(command *exec.Cmd) error {
 	// not an error - command error output printed to out stdout (like logging)
 	command.Stdout = os.Stderr
 	command.Stderr = os.Stderr
-	err := command.Run()
+	err := runCommand(command)
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -51,7 +51,7 @@ func Execute(command *exec.Cmd) ([]byte, error) {
 	var errorOutput bytes.Buffer
 	command.Stderr = &errorOutput
 
-	err := command.Run()
+	err := runCommand(command)
 	if err != nil {
 		return output.Bytes(), &ExecError{
 			Cause:            err,
@@ -0,0 +1,188 @@
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/errors"
+	"go.uber.org/zap"
+)
+
+// TempDirEnvName overrides the base temp dir (system temp dir by default)
+const TempDirEnvName = "APP_BUILDER_TMP_DIR"
+
+// every run allocates temp files and dirs inside own root <base>/app-builder-run-<time>-<pid>, root is removed on exit, so, leftovers are only possible if process was killed
+const runTempDirPrefix = "app-builder-run-"
+
+var (
+	tempMutex   sync.Mutex
+	runTempDir  string
+	allocations []string
+)
+
+func GetBaseTempDir() string {
+	result := os.Getenv(TempDirEnvName)
+	if len(result) == 0 {
+		return os.TempDir()
+	}
+	return result
+}
+
+// GetRunTempDir returns temp root of the current run (created on first call)
+func GetRunTempDir() (string, error) {
+	tempMutex.Lock()
+	defer tempMutex.Unlock()
+	return getRunTempDir()
+}
+
+func getRunTempDir() (string, error) {
+	if len(runTempDir) != 0 {
+		return runTempDir, nil
+	}
+
+	baseDir := GetBaseTempDir()
+	err := os.MkdirAll(baseDir, 0755)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	dir, err := ioutil.TempDir(baseDir, fmt.Sprintf("%s%s-%d-", runTempDirPrefix, time.Now().UTC().Format("20060102T150405"), os.Getpid()))
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	runTempDir = dir
+	log.Debug("run temp dir", zap.String("dir", dir))
+	return dir, nil
+}
+
+// CreateTempDir creates dir in the run temp root (pattern as for ioutil.TempDir)
+func CreateTempDir(pattern string) (string, error) {
+	tempMutex.Lock()
+	defer tempMutex.Unlock()
+
+	root, err := getRunTempDir()
+	if err != nil {
+		return "", err
+	}
+
+	result, err := ioutil.TempDir(root, pattern)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	allocations = append(allocations, result)
+	return result, nil
+}
+
+// CreateTempFile creates file in the run temp root (pattern as for ioutil.TempFile), caller must close the file
+func CreateTempFile(pattern string) (*os.File, error) {
+	tempMutex.Lock()
+	defer tempMutex.Unlock()
+
+	root, err := getRunTempDir()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := ioutil.TempFile(root, pattern)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	allocations = append(allocations, result.Name())
+	return result, nil
+}
+
+// CleanupTemp removes the run temp root with all allocations, called on exit, panic and cancel (after registered cleanups). Safe to call several times.
+func CleanupTemp() {
+	tempMutex.Lock()
+	defer tempMutex.Unlock()
+
+	if len(runTempDir) == 0 {
+		return
+	}
+
+	if log.IsDebugEnabled() {
+		log.Debug("remove run temp dir", zap.String("dir", runTempDir), zap.Int("allocations", len(allocations)))
+	}
+
+	err := os.RemoveAll(runTempDir)
+	if err != nil {
+		log.Warn("cannot remove temp dir", zap.String("dir", runTempDir), zap.Error(err))
+	}
+
+	runTempDir = ""
+	allocations = nil
+}
+
+func ConfigureCleanupStaleTempCommand(app *kingpin.Application) {
+	command := app.Command("cleanup-stale-temp", "Remove temp dirs left by previous crashed or killed runs. Removed dirs are written to stdout as JSON.")
+	dir := command.Flag("dir", "The base temp dir (default: "+TempDirEnvName+" or the system temp dir).").String()
+	olderThan := command.Flag("older-than", "Remove dirs not modified for the specified number of days.").Default("2").Uint()
+	isDryRun := command.Flag("dry-run", "Do not remove, only list.").Bool()
+
+	command.Action(func(context *kingpin.ParseContext) error {
+		baseDir := *dir
+		if len(baseDir) == 0 {
+			baseDir = GetBaseTempDir()
+		}
+
+		result, err := CleanupStaleTemp(baseDir, time.Duration(*olderThan)*24*time.Hour, *isDryRun)
+		if err != nil {
+			return err
+		}
+		if result == nil {
+			result = []StaleTempDir{}
+		}
+		return WriteJsonToStdOut(result)
+	})
+}
+
+type StaleTempDir struct {
+	Dir     string    `json:"dir"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// CleanupStaleTemp removes run temp roots of previous runs (crashed or killed) last modified before maxAge. If isDryRun, only lists.
+func CleanupStaleTemp(baseDir string, maxAge time.Duration, isDryRun bool) ([]StaleTempDir, error) {
+	names, err := ioutil.ReadDir(baseDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+
+	tempMutex.Lock()
+	currentRunDir := runTempDir
+	tempMutex.Unlock()
+
+	threshold := time.Now().Add(-maxAge)
+	var result []StaleTempDir
+	for _, info := range names {
+		if !info.IsDir() || !strings.HasPrefix(info.Name(), runTempDirPrefix) {
+			continue
+		}
+
+		dir := filepath.Join(baseDir, info.Name())
+		if dir == currentRunDir || !info.ModTime().Before(threshold) {
+			continue
+		}
+
+		if !isDryRun {
+			err = os.RemoveAll(dir)
+			if err != nil {
+				log.Warn("cannot remove stale temp dir", zap.String("dir", dir), zap.Error(err))
+				continue
+			}
+		}
+		result = append(result, StaleTempDir{Dir: dir, ModTime: info.ModTime()})
+	}
+	return result, nil
+}
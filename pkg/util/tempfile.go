@@ -40,15 +40,19 @@ func nextPrefix() string {
 // TempFile creates a new temporary file in the directory dir
 // with a name beginning with prefix, opens the file for reading
 // and writing, and returns the resulting *os.File.
-// If dir is the empty string, TempFile uses the default directory
-// for temporary files (see os.TempDir).
+// If dir is the empty string, TempFile uses the temp root
+// of the current run (see GetRunTempDir).
 // Multiple programs calling TempFile simultaneously
 // will not choose the same file. The caller can use f.Name()
 // to find the pathname of the file. It is the caller's responsibility
 // to remove the file when no longer needed.
 func TempFile(dir, suffix string) (string, error) {
 	if dir == "" {
-		dir = os.TempDir()
+		var err error
+		dir, err = GetRunTempDir()
+		if err != nil {
+			return "", err
+		}
 	}
 
 	nConflict := 0
@@ -71,13 +75,17 @@ func TempFile(dir, suffix string) (string, error) {
 // TempDir creates a new temporary directory in the directory dir
 // with a name beginning with prefix and returns the path of the
 // new directory. If dir is the empty string, TempDir uses the
-// default directory for temporary files (see os.TempDir).
+// temp root of the current run (see GetRunTempDir).
 // Multiple programs calling TempDir simultaneously
 // will not choose the same directory. It is the caller's responsibility
 // to remove the directory when no longer needed.
 func TempDir(dir, suffix string) (name string, err error) {
 	if dir == "" {
-		dir = os.TempDir()
+		var err error
+		dir, err = GetRunTempDir()
+		if err != nil {
+			return "", err
+		}
 	}
 
 	nConflict := 0
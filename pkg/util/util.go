@@ -70,11 +70,13 @@ func StartPipedCommands(producer *exec.Cmd, consumer *exec.Cmd) error {
 	if err != nil {
 		return errors.WithStack(err)
 	}
+	trackProcess(producer.Process)
 
 	err = consumer.Start()
 	if err != nil {
 		return errors.WithStack(err)
 	}
+	trackProcess(consumer.Process)
 
 	return nil
 }
@@ -94,6 +96,9 @@ func RunPipedCommands(producer *exec.Cmd, consumer *exec.Cmd) error {
 }
 
 func WaitPipedCommand(producer *exec.Cmd, consumer *exec.Cmd) error {
+	defer untrackProcess(consumer.Process)
+	defer untrackProcess(producer.Process)
+
 	err := producer.Wait()
 	if err != nil {
 		return errors.WithStack(err)
@@ -108,6 +113,10 @@ func WaitPipedCommand(producer *exec.Cmd, consumer *exec.Cmd) error {
 }
 
 func LogErrorAndExit(err error) {
+	WaitIfCanceled()
+
+	errorInfo := GetErrorInfo(err)
+	errorFields := []zap.Field{zap.String("code", errorInfo.Code), zap.String("category", errorInfo.Category), zap.Bool("retryable", errorInfo.IsRetryable)}
 	if execError, ok := err.(*ExecError); ok {
 		message := execError.Message
 		if len(message) == 0 {
@@ -116,12 +125,15 @@ func LogErrorAndExit(err error) {
 
 		fields := execError.ExtraFields
 		fields = append(fields, CreateExecErrorLogEntry(execError)...)
-		log.LOG.Error(message, fields...)
+		log.LOG.Error(message, append(fields, errorFields...)...)
 		_ = log.LOG.Sync()
+		CleanupTemp()
 		// electron-builder in this case doesn't report app-builder error
 		os.Exit(2)
 	} else {
-		log.LOG.Fatal(fmt.Sprintf("%+v", err))
+		// fatal exits immediately
+		CleanupTemp()
+		log.LOG.Fatal(fmt.Sprintf("%+v", err), errorFields...)
 	}
 }
 
@@ -0,0 +1,292 @@
+package vcdiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/adler32"
+	"io"
+
+	"github.com/develar/errors"
+)
+
+// Decode applies delta to the source and writes the target. Deltas produced by xdelta3 without secondary compression (-S none) are supported.
+func Decode(source io.ReaderAt, delta io.Reader, out io.Writer) error {
+	reader := newByteReader(delta)
+
+	header := make([]byte, len(magic)+1)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return errors.WithMessage(err, "cannot read VCDIFF header")
+	}
+	if !bytes.Equal(header[:len(magic)], magic) {
+		return errors.New("not a VCDIFF file")
+	}
+
+	headerIndicator := header[len(magic)]
+	if headerIndicator&(headerSecondaryCompression|headerCodeTable) != 0 {
+		return errors.New("VCDIFF secondary compression and custom code tables are not supported")
+	}
+	if headerIndicator&headerAppHeader != 0 {
+		length, err := readInt(reader)
+		if err != nil {
+			return err
+		}
+		_, err = reader.Discard(int(length))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	var cache addressCache
+	for {
+		windowIndicator, err := reader.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		target, err := decodeWindow(windowIndicator, reader, source, &cache)
+		if err != nil {
+			return err
+		}
+
+		_, err = out.Write(target)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+}
+
+func decodeWindow(windowIndicator byte, reader io.Reader, source io.ReaderAt, cache *addressCache) ([]byte, error) {
+	byteReader := reader.(io.ByteReader)
+	if windowIndicator&windowTarget != 0 {
+		return nil, errors.New("VCDIFF target window as a source is not supported")
+	}
+
+	var segmentLength, segmentPosition uint64
+	var err error
+	if windowIndicator&windowSource != 0 {
+		segmentLength, err = readInt(byteReader)
+		if err != nil {
+			return nil, err
+		}
+		segmentPosition, err = readInt(byteReader)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// length of the delta encoding, not required - every section has own length
+	_, err = readInt(byteReader)
+	if err != nil {
+		return nil, err
+	}
+
+	var lengths [4]uint64
+	lengths[0], err = readInt(byteReader)
+	if err != nil {
+		return nil, err
+	}
+
+	deltaIndicator, err := byteReader.ReadByte()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if deltaIndicator != 0 {
+		return nil, errors.New("VCDIFF secondary compression is not supported")
+	}
+
+	for i := 1; i < len(lengths); i++ {
+		lengths[i], err = readInt(byteReader)
+		if err != nil {
+			return nil, err
+		}
+	}
+	targetLength := lengths[0]
+
+	var checksum []byte
+	if windowIndicator&windowAdler32 != 0 {
+		checksum = make([]byte, 4)
+		_, err = io.ReadFull(reader, checksum)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	sections := make([]byte, lengths[1]+lengths[2]+lengths[3])
+	_, err = io.ReadFull(reader, sections)
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot read VCDIFF window")
+	}
+
+	decoder := &windowDecoder{
+		data:            sections[:lengths[1]],
+		instructions:    sections[lengths[1] : lengths[1]+lengths[2]],
+		addresses:       bytes.NewReader(sections[lengths[1]+lengths[2]:]),
+		source:          source,
+		segmentLength:   segmentLength,
+		segmentPosition: segmentPosition,
+		cache:           cache,
+		target:          make([]byte, 0, targetLength),
+	}
+	cache.reset()
+	err = decoder.run()
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(len(decoder.target)) != targetLength {
+		return nil, errors.Errorf("VCDIFF window length mismatch: expected %d, got %d", targetLength, len(decoder.target))
+	}
+	if checksum != nil && adler32.Checksum(decoder.target) != binary.BigEndian.Uint32(checksum) {
+		return nil, errors.New("VCDIFF window checksum mismatch")
+	}
+	return decoder.target, nil
+}
+
+type windowDecoder struct {
+	data         []byte
+	instructions []byte
+	addresses    *bytes.Reader
+
+	source          io.ReaderAt
+	segmentLength   uint64
+	segmentPosition uint64
+
+	cache  *addressCache
+	target []byte
+}
+
+func (t *windowDecoder) run() error {
+	instructionReader := bytes.NewReader(t.instructions)
+	for {
+		code, err := instructionReader.ReadByte()
+		if err == io.EOF {
+			break
+		}
+
+		for _, item := range defaultCodeTable[code] {
+			if item.kind == instructionNoop {
+				continue
+			}
+
+			size := uint64(item.size)
+			if size == 0 {
+				size, err = readInt(instructionReader)
+				if err != nil {
+					return err
+				}
+			}
+
+			err = t.execute(item, size)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(t.data) != 0 || t.addresses.Len() != 0 {
+		return errors.New("VCDIFF window has unused data")
+	}
+	return nil
+}
+
+func (t *windowDecoder) execute(item instruction, size uint64) error {
+	switch item.kind {
+	case instructionAdd:
+		if uint64(len(t.data)) < size {
+			return errors.New("VCDIFF data section is too short")
+		}
+		t.target = append(t.target, t.data[:size]...)
+		t.data = t.data[size:]
+
+	case instructionRun:
+		if len(t.data) == 0 {
+			return errors.New("VCDIFF data section is too short")
+		}
+		value := t.data[0]
+		t.data = t.data[1:]
+		for i := uint64(0); i < size; i++ {
+			t.target = append(t.target, value)
+		}
+
+	case instructionCopy:
+		here := t.segmentLength + uint64(len(t.target))
+		address, err := t.decodeAddress(item.mode, here)
+		if err != nil {
+			return err
+		}
+		if address >= here {
+			return errors.Errorf("VCDIFF copy address %d is out of range", address)
+		}
+		return t.copy(address, size)
+	}
+	return nil
+}
+
+func (t *windowDecoder) copy(address uint64, size uint64) error {
+	if address < t.segmentLength {
+		sourceSize := size
+		if address+sourceSize > t.segmentLength {
+			sourceSize = t.segmentLength - address
+		}
+
+		start := len(t.target)
+		t.target = append(t.target, make([]byte, sourceSize)...)
+		_, err := t.source.ReadAt(t.target[start:], int64(t.segmentPosition+address))
+		if err != nil {
+			return errors.WithMessage(err, "cannot read VCDIFF source")
+		}
+
+		size -= sourceSize
+		address = t.segmentLength
+	}
+
+	// overlapped copy from the target is allowed (e.g. to repeat pattern), so, byte by byte
+	position := address - t.segmentLength
+	for i := uint64(0); i < size; i++ {
+		t.target = append(t.target, t.target[position+i])
+	}
+	return nil
+}
+
+func (t *windowDecoder) decodeAddress(mode byte, here uint64) (uint64, error) {
+	var result uint64
+	switch {
+	case mode == modeSelf:
+		value, err := readInt(t.addresses)
+		if err != nil {
+			return 0, err
+		}
+		result = value
+
+	case mode == modeHere:
+		value, err := readInt(t.addresses)
+		if err != nil {
+			return 0, err
+		}
+		if value > here {
+			return 0, errors.New("VCDIFF invalid HERE address")
+		}
+		result = here - value
+
+	case int(mode) < 2+nearCacheSize:
+		value, err := readInt(t.addresses)
+		if err != nil {
+			return 0, err
+		}
+		result = t.cache.near[mode-2] + value
+
+	default:
+		value, err := t.addresses.ReadByte()
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		result = t.cache.same[int(mode-2-nearCacheSize)*256+int(value)]
+	}
+
+	t.cache.update(result)
+	return result, nil
+}
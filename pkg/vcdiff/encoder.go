@@ -0,0 +1,252 @@
+package vcdiff
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/develar/errors"
+)
+
+const (
+	// source is indexed by blocks of this size, it is also the minimal length of a copy
+	matchBlockSize = 32
+	// the same as default window of xdelta3
+	targetWindowSize = 8 * 1024 * 1024
+	// shorter runs are added as is
+	minRunSize = 16
+
+	hashPrime = 0x100000001B3
+)
+
+type operation struct {
+	kind instructionType
+	// position in the target window
+	start int
+	size  int
+	// copy
+	sourcePosition int
+}
+
+type sourceIndex struct {
+	data []byte
+	// position + 1 of the first block with the hash, 0 - not set
+	table []uint32
+	shift uint
+	// hashPrime^(matchBlockSize-1) to remove the first byte from the rolling hash
+	power uint64
+}
+
+// Encode writes delta between source and target in VCDIFF format, source is kept in memory (for snap - less than 1 GB)
+func Encode(source []byte, target io.Reader, out io.Writer) error {
+	if int64(len(source)) > int64(^uint32(0)) {
+		return errors.New("source is too large")
+	}
+
+	index := newSourceIndex(source)
+	_, err := out.Write(append(magic, 0))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	window := make([]byte, targetWindowSize)
+	for {
+		n, err := io.ReadFull(target, window)
+		if n > 0 {
+			_, writeErr := out.Write(index.encodeWindow(window[:n]))
+			if writeErr != nil {
+				return errors.WithStack(writeErr)
+			}
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+}
+
+func newSourceIndex(source []byte) *sourceIndex {
+	blockCount := len(source) / matchBlockSize
+	bits := uint(10)
+	for 1<<bits < blockCount {
+		bits++
+	}
+
+	power := uint64(1)
+	for i := 0; i < matchBlockSize-1; i++ {
+		power *= hashPrime
+	}
+
+	result := &sourceIndex{data: source, table: make([]uint32, 1<<bits), shift: 64 - bits, power: power}
+	for position := 0; position+matchBlockSize <= len(source); position += matchBlockSize {
+		slot := result.slot(hashBlock(source[position : position+matchBlockSize]))
+		// the first block wins - earlier location, the same as in the previous revision more likely
+		if result.table[slot] == 0 {
+			result.table[slot] = uint32(position + 1)
+		}
+	}
+	return result
+}
+
+func hashBlock(data []byte) uint64 {
+	var result uint64
+	for _, b := range data {
+		result = result*hashPrime + uint64(b)
+	}
+	return result
+}
+
+func (t *sourceIndex) slot(hash uint64) uint64 {
+	return (hash * 0x9E3779B97F4A7C15) >> t.shift
+}
+
+// findMatches splits window into copies from the source and adds (runs) of not matched data
+func (t *sourceIndex) findMatches(window []byte) []operation {
+	var result []operation
+	pending := 0
+	position := 0
+	var hash uint64
+	if len(window) >= matchBlockSize {
+		hash = hashBlock(window[:matchBlockSize])
+	}
+
+	for position+matchBlockSize <= len(window) {
+		candidate := int(t.table[t.slot(hash)]) - 1
+		if candidate >= 0 && bytes.Equal(t.data[candidate:candidate+matchBlockSize], window[position:position+matchBlockSize]) {
+			start := position
+			sourceStart := candidate
+			for sourceStart > 0 && start > pending && t.data[sourceStart-1] == window[start-1] {
+				start--
+				sourceStart--
+			}
+
+			end := position + matchBlockSize
+			sourceEnd := candidate + matchBlockSize
+			for end < len(window) && sourceEnd < len(t.data) && window[end] == t.data[sourceEnd] {
+				end++
+				sourceEnd++
+			}
+
+			result = appendAdd(result, window, pending, start)
+			result = append(result, operation{kind: instructionCopy, start: start, size: end - start, sourcePosition: sourceStart})
+			pending = end
+			position = end
+			if position+matchBlockSize <= len(window) {
+				hash = hashBlock(window[position : position+matchBlockSize])
+			}
+			continue
+		}
+
+		if position+matchBlockSize < len(window) {
+			hash = (hash-uint64(window[position])*t.power)*hashPrime + uint64(window[position+matchBlockSize])
+		}
+		position++
+	}
+	return appendAdd(result, window, pending, len(window))
+}
+
+// appendAdd adds data from start to end, long runs of the same byte (e.g. padding) are encoded as RUN
+func appendAdd(result []operation, window []byte, start int, end int) []operation {
+	addStart := start
+	for i := start; i < end; {
+		runEnd := i + 1
+		for runEnd < end && window[runEnd] == window[i] {
+			runEnd++
+		}
+
+		if runEnd-i >= minRunSize {
+			if i > addStart {
+				result = append(result, operation{kind: instructionAdd, start: addStart, size: i - addStart})
+			}
+			result = append(result, operation{kind: instructionRun, start: i, size: runEnd - i})
+			addStart = runEnd
+		}
+		i = runEnd
+	}
+
+	if end > addStart {
+		result = append(result, operation{kind: instructionAdd, start: addStart, size: end - addStart})
+	}
+	return result
+}
+
+func (t *sourceIndex) encodeWindow(window []byte) []byte {
+	operations := t.findMatches(window)
+
+	// source segment - range of the source used by copies of the window
+	segmentStart, segmentEnd := -1, 0
+	for _, item := range operations {
+		if item.kind != instructionCopy {
+			continue
+		}
+		if segmentStart == -1 || item.sourcePosition < segmentStart {
+			segmentStart = item.sourcePosition
+		}
+		if item.sourcePosition+item.size > segmentEnd {
+			segmentEnd = item.sourcePosition + item.size
+		}
+	}
+	segmentLength := 0
+	if segmentStart != -1 {
+		segmentLength = segmentEnd - segmentStart
+	}
+
+	var data, instructions, addresses []byte
+	for _, item := range operations {
+		switch item.kind {
+		case instructionAdd:
+			if item.size <= 17 {
+				instructions = append(instructions, byte(1+item.size))
+			} else {
+				instructions = appendInt(append(instructions, 1), uint64(item.size))
+			}
+			data = append(data, window[item.start:item.start+item.size]...)
+
+		case instructionRun:
+			instructions = appendInt(append(instructions, 0), uint64(item.size))
+			data = append(data, window[item.start])
+
+		case instructionCopy:
+			address := uint64(item.sourcePosition - segmentStart)
+			here := uint64(segmentLength + item.start)
+			mode := byte(modeSelf)
+			value := address
+			if intSize(here-address) < intSize(address) {
+				mode = modeHere
+				value = here - address
+			}
+
+			code := 19 + 16*mode
+			if item.size <= 18 {
+				instructions = append(instructions, code+byte(item.size-3))
+			} else {
+				instructions = appendInt(append(instructions, code), uint64(item.size))
+			}
+			addresses = appendInt(addresses, value)
+		}
+	}
+
+	var body []byte
+	body = appendInt(body, uint64(len(window)))
+	// delta indicator - no secondary compression
+	body = append(body, 0)
+	body = appendInt(body, uint64(len(data)))
+	body = appendInt(body, uint64(len(instructions)))
+	body = appendInt(body, uint64(len(addresses)))
+	body = append(body, data...)
+	body = append(body, instructions...)
+	body = append(body, addresses...)
+
+	var result []byte
+	if segmentStart == -1 {
+		result = append(result, 0)
+	} else {
+		result = append(result, windowSource)
+		result = appendInt(result, uint64(segmentLength))
+		result = appendInt(result, uint64(segmentStart))
+	}
+	result = appendInt(result, uint64(len(body)))
+	return append(result, body...)
+}
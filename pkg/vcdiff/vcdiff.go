@@ -0,0 +1,149 @@
+// Package vcdiff implements VCDIFF (RFC 3284) delta encoding - the format of xdelta3, used by the snap store for deltas between revisions.
+// Secondary compression and custom code tables are not used by the encoder and not supported by the decoder.
+package vcdiff
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/develar/errors"
+)
+
+var magic = []byte{0xD6, 0xC3, 0xC4, 0x00}
+
+const (
+	// Hdr_Indicator
+	headerSecondaryCompression = 0x01
+	headerCodeTable            = 0x02
+	headerAppHeader            = 0x04
+
+	// Win_Indicator
+	windowSource = 0x01
+	windowTarget = 0x02
+	// xdelta3 extension: adler32 of the target window
+	windowAdler32 = 0x04
+)
+
+type instructionType byte
+
+const (
+	instructionNoop instructionType = iota
+	instructionAdd
+	instructionRun
+	instructionCopy
+)
+
+const (
+	nearCacheSize = 4
+	sameCacheSize = 3
+
+	modeSelf = 0
+	modeHere = 1
+)
+
+type instruction struct {
+	kind instructionType
+	// 0 - size is encoded separately
+	size byte
+	mode byte
+}
+
+type codeTableEntry [2]instruction
+
+// defaultCodeTable is the code table of RFC 3284 section 5.6
+var defaultCodeTable = createDefaultCodeTable()
+
+func createDefaultCodeTable() [256]codeTableEntry {
+	var result [256]codeTableEntry
+	index := 0
+	add := func(first instruction, second instruction) {
+		result[index] = codeTableEntry{first, second}
+		index++
+	}
+
+	add(instruction{kind: instructionRun}, instruction{})
+	for size := 0; size <= 17; size++ {
+		add(instruction{kind: instructionAdd, size: byte(size)}, instruction{})
+	}
+	for mode := 0; mode < 9; mode++ {
+		add(instruction{kind: instructionCopy, mode: byte(mode)}, instruction{})
+		for size := 4; size <= 18; size++ {
+			add(instruction{kind: instructionCopy, size: byte(size), mode: byte(mode)}, instruction{})
+		}
+	}
+	for mode := 0; mode < 6; mode++ {
+		for addSize := 1; addSize <= 4; addSize++ {
+			for copySize := 4; copySize <= 6; copySize++ {
+				add(instruction{kind: instructionAdd, size: byte(addSize)}, instruction{kind: instructionCopy, size: byte(copySize), mode: byte(mode)})
+			}
+		}
+	}
+	for mode := 6; mode < 9; mode++ {
+		for addSize := 1; addSize <= 4; addSize++ {
+			add(instruction{kind: instructionAdd, size: byte(addSize)}, instruction{kind: instructionCopy, size: 4, mode: byte(mode)})
+		}
+	}
+	for mode := 0; mode < 9; mode++ {
+		add(instruction{kind: instructionCopy, size: 4, mode: byte(mode)}, instruction{kind: instructionAdd, size: 1})
+	}
+	return result
+}
+
+// addressCache is updated by decoder after each COPY, encoder uses only self and here modes
+type addressCache struct {
+	near     [nearCacheSize]uint64
+	nextSlot int
+	same     [sameCacheSize * 256]uint64
+}
+
+func (t *addressCache) reset() {
+	*t = addressCache{}
+}
+
+func (t *addressCache) update(address uint64) {
+	t.near[t.nextSlot] = address
+	t.nextSlot = (t.nextSlot + 1) % nearCacheSize
+	t.same[address%(sameCacheSize*256)] = address
+}
+
+// appendInt appends integer in VCDIFF encoding: base 128, most significant digit first, high bit is set for all bytes except the last
+func appendInt(buffer []byte, value uint64) []byte {
+	var data [10]byte
+	index := len(data) - 1
+	data[index] = byte(value & 0x7F)
+	for value >>= 7; value != 0; value >>= 7 {
+		index--
+		data[index] = byte(value&0x7F) | 0x80
+	}
+	return append(buffer, data[index:]...)
+}
+
+func intSize(value uint64) int {
+	result := 1
+	for value >>= 7; value != 0; value >>= 7 {
+		result++
+	}
+	return result
+}
+
+func readInt(reader io.ByteReader) (uint64, error) {
+	var result uint64
+	for i := 0; i < 10; i++ {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		result = result<<7 | uint64(b&0x7F)
+		if b&0x80 == 0 {
+			return result, nil
+		}
+	}
+	return 0, errors.New("invalid VCDIFF integer")
+}
+
+func newByteReader(reader io.Reader) *bufio.Reader {
+	if result, ok := reader.(*bufio.Reader); ok {
+		return result
+	}
+	return bufio.NewReaderSize(reader, 64*1024)
+}
@@ -0,0 +1,72 @@
+package vcdiff
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestRoundTrip(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	random := rand.New(rand.NewSource(42))
+	source := make([]byte, 10*1024*1024)
+	random.Read(source)
+
+	// more than one window: moved, inserted and removed data, run of zeros (padding)
+	var target []byte
+	target = append(target, source[1024*1024:5*1024*1024]...)
+	inserted := make([]byte, 1000)
+	random.Read(inserted)
+	target = append(target, inserted...)
+	target = append(target, make([]byte, 5000)...)
+	target = append(target, source[:1024*1024]...)
+	target = append(target, source[6*1024*1024+17:]...)
+	target = append(target, "tail"...)
+
+	delta := encodeDelta(g, source, target)
+	g.Expect(delta.Len()).To(BeNumerically("<", 16*1024))
+	g.Expect(decodeDelta(g, source, delta)).To(Equal(target))
+}
+
+func TestEdgeCases(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	for _, item := range []struct{ source, target string }{
+		{"", ""},
+		{"", "new file without source"},
+		{"the same content, the same content", "the same content, the same content"},
+		{"short", "shorter"},
+	} {
+		delta := encodeDelta(g, []byte(item.source), []byte(item.target))
+		g.Expect(string(decodeDelta(g, []byte(item.source), delta))).To(Equal(item.target))
+	}
+}
+
+func TestInt(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	// example from RFC 3284 section 2
+	g.Expect(appendInt(nil, 123456789)).To(Equal([]byte{0xBA, 0xEF, 0x9A, 0x15}))
+	for _, value := range []uint64{0, 127, 128, 1 << 32, 1<<64 - 1} {
+		data := appendInt(nil, value)
+		g.Expect(data).To(HaveLen(intSize(value)))
+		result, err := readInt(bytes.NewReader(data))
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(result).To(Equal(value))
+	}
+}
+
+func encodeDelta(g *GomegaWithT, source []byte, target []byte) *bytes.Buffer {
+	delta := &bytes.Buffer{}
+	g.Expect(Encode(source, bytes.NewReader(target), delta)).To(Succeed())
+	return delta
+}
+
+func decodeDelta(g *GomegaWithT, source []byte, delta *bytes.Buffer) []byte {
+	result := &bytes.Buffer{}
+	g.Expect(Decode(bytes.NewReader(source), delta, result)).To(Succeed())
+	return result.Bytes()
+}
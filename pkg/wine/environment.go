@@ -0,0 +1,404 @@
+package wine
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/develar/app-builder/pkg/download"
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/json-iterator/go"
+	"go.uber.org/zap"
+)
+
+// AppVersion is set by main, every app-builder version uses own WINEPREFIX, so, prefix is not shared with a possibly incompatible setup
+var AppVersion = ""
+
+const (
+	ComponentWindowsVersion = "win10"
+	ComponentNoMenuBuilder  = "noMenuBuilder"
+	ComponentNoCrashDialog  = "noCrashDialog"
+
+	prefixStateFile = "app-builder-prefix.json"
+)
+
+var DefaultComponents = []string{ComponentWindowsVersion, ComponentNoMenuBuilder, ComponentNoCrashDialog}
+
+// registry changes to apply to a new prefix, mono and gecko are disabled by WINEDLLOVERRIDES on init (no installer prompt)
+var componentRegistryArgs = map[string][][]string{
+	ComponentWindowsVersion: {{"HKCU\\Software\\Wine", "/v", "Version", "/d", "win10", "/f"}},
+	ComponentNoMenuBuilder:  {{"HKCU\\Software\\Wine\\DllOverrides", "/v", "winemenubuilder.exe", "/d", "", "/f"}},
+	ComponentNoCrashDialog:  {{"HKCU\\Software\\Wine\\WineDbg", "/v", "ShowCrashDialog", "/t", "REG_DWORD", "/d", "0", "/f"}},
+}
+
+type wineBuild struct {
+	name     string
+	checksum string
+	// executable name in the bin dir
+	executable string
+}
+
+// pinned portable Wine builds, on Linux system wine is used (distributions build wine against system libraries)
+//noinspection SpellCheckingInspection
+var (
+	wineBuildMac = wineBuild{name: "wine-2.0.3-mac-10.13", checksum: "dlEVCf0YKP5IEiOKPNE48Q8NKXbXVdhuaI9hG2oyDEay2c+93PE5qls7XUbIYq4Xi1gRK8fkWeCtzN2oLpVQtg==", executable: "wine"}
+	// macOS Catalina doesn't support 32-bit executables
+	wineBuildMacCatalina = wineBuild{name: "wine-4.0.1-mac", checksum: "aCUQOyuPGlEvLMp0lPzb54D96+8IcLwmKTMElrZZqVWtEL1LQC7L9XpPv4RqaLX3BOeSifneEi4j9DpYdC1DCA==", executable: "wine64"}
+)
+
+type EnvironmentOptions struct {
+	// win32 or win64, empty to use the default of wine build
+	Arch       string
+	Components []string
+	// use wine from PATH instead of the pinned build (USE_SYSTEM_WINE=true)
+	IsSystem bool
+}
+
+// Environment is an isolated WINEPREFIX with the wine build used to create it
+type Environment struct {
+	Executable string `json:"executable"`
+	// dir of the portable build, empty for system wine
+	WineDir    string   `json:"wineDir,omitempty"`
+	Version    string   `json:"version"`
+	Prefix     string   `json:"prefix"`
+	Arch       string   `json:"arch,omitempty"`
+	Components []string `json:"components"`
+}
+
+type prefixState struct {
+	AppVersion  string   `json:"appVersion"`
+	WineVersion string   `json:"wineVersion"`
+	Arch        string   `json:"arch,omitempty"`
+	Components  []string `json:"components"`
+}
+
+// ELECTRON_BUILDER_WINE_DIR env to use custom portable wine build (the same layout as the artifact: bin/wine, lib)
+func resolveWine(options *EnvironmentOptions) (string, string, error) {
+	custom := strings.TrimSpace(os.Getenv("ELECTRON_BUILDER_WINE_DIR"))
+	if custom != "" {
+		executable := filepath.Join(custom, "bin", "wine64")
+		if _, err := os.Stat(executable); err != nil || options.Arch == "win32" {
+			executable = filepath.Join(custom, "bin", "wine")
+		}
+		return executable, custom, nil
+	}
+
+	if options.IsSystem || util.GetCurrentOs() != util.MAC {
+		executable, err := exec.LookPath("wine")
+		if err != nil {
+			return "", "", util.NewMessageError("wine is required, please see https://electron.build/multi-platform-build#linux", "ERR_WINE_NOT_INSTALLED")
+		}
+		return executable, "", nil
+	}
+
+	build := wineBuildMac
+	catalina, err := isMacOsCatalina()
+	if err != nil {
+		log.Warn("cannot detect macOS version", zap.Error(err))
+	}
+	if catalina {
+		build = wineBuildMacCatalina
+	}
+
+	dir, err := download.DownloadArtifact(build.name, download.GetGithubBaseUrl()+build.name+"/"+build.name+".7z", build.checksum)
+	if err != nil {
+		return "", "", err
+	}
+	return filepath.Join(dir, "bin", build.executable), dir, nil
+}
+
+// PrepareEnvironment resolves wine and initializes WINEPREFIX (once per app-builder version, wine version and arch), missing components are installed into existing prefix.
+func PrepareEnvironment(options *EnvironmentOptions) (*Environment, error) {
+	executable, wineDir, err := resolveWine(options)
+	if err != nil {
+		return nil, err
+	}
+
+	environment := &Environment{Executable: executable, WineDir: wineDir, Arch: options.Arch, Components: options.Components}
+	if environment.Components == nil {
+		environment.Components = DefaultComponents
+	}
+	for _, component := range environment.Components {
+		if _, ok := componentRegistryArgs[component]; !ok {
+			return nil, util.NewMessageError("unknown wine component "+strconv.Quote(component), "ERR_WINE_COMPONENT_UNSUPPORTED")
+		}
+	}
+
+	environment.Version, err = getWineVersion(executable, wineDir)
+	if err != nil {
+		return nil, err
+	}
+	if wineDir == "" {
+		err = doCheckWineVersion(environment.Version)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	prefixRoot, err := GetPrefixRoot()
+	if err != nil {
+		return nil, err
+	}
+	arch := environment.Arch
+	if arch == "" {
+		arch = "default"
+	}
+	environment.Prefix = filepath.Join(prefixRoot, AppVersion+"-"+environment.Version+"-"+arch)
+
+	err = environment.initPrefix()
+	if err != nil {
+		return nil, err
+	}
+	return environment, nil
+}
+
+// GetPrefixRoot returns dir of all prefixes created by app-builder
+func GetPrefixRoot() (string, error) {
+	dir, err := download.GetCacheDirectoryForArtifactCustom("wine-prefix")
+	if err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+func getWineVersion(executable string, wineDir string) (string, error) {
+	ctx, cancel := util.CreateContextWithTimeout(2 * time.Minute)
+	defer cancel()
+
+	command := exec.CommandContext(ctx, executable, "--version")
+	command.Env = createEnv(wineDir, "")
+	output, err := command.Output()
+	if err != nil {
+		log.Debug("wine version check result", zap.Error(err))
+		return "", util.NewMessageError("cannot get wine version ("+executable+"), please see https://electron.build/multi-platform-build#linux", "ERR_WINE_NOT_INSTALLED")
+	}
+
+	result := strings.TrimPrefix(strings.TrimSpace(string(output)), "wine-")
+	// "5.0 (Staging)" -> "5.0"
+	if spaceIndex := strings.IndexRune(result, ' '); spaceIndex > 0 {
+		result = result[:spaceIndex]
+	}
+	return result, nil
+}
+
+func readPrefixState(prefix string) *prefixState {
+	data, err := ioutil.ReadFile(filepath.Join(prefix, prefixStateFile))
+	if err != nil {
+		return nil
+	}
+
+	var result prefixState
+	err = jsoniter.Unmarshal(data, &result)
+	if err != nil {
+		log.Warn("cannot read wine prefix state, prefix will be recreated", zap.String("prefix", prefix), zap.Error(err))
+		return nil
+	}
+	return &result
+}
+
+func (t *Environment) initPrefix() error {
+	ctx, cancel := util.CreateContextWithTimeout(10 * time.Minute)
+	defer cancel()
+
+	err := os.MkdirAll(filepath.Dir(t.Prefix), 0755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// concurrent build must not remove or modify prefix while it is initialized or used for state check
+	unlock, err := lockPrefix(t.Prefix)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	state := readPrefixState(t.Prefix)
+	if state == nil {
+		// prefix is created in a temp dir and renamed, so, interrupted build doesn't leave half-initialized prefix
+		tempPrefix := t.Prefix + ".tmp-" + strconv.Itoa(os.Getpid())
+		err = os.RemoveAll(t.Prefix)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer util.OnCancel(func() {
+			_ = os.RemoveAll(tempPrefix)
+		})()
+
+		log.Info("initializing wine prefix", zap.String("prefix", t.Prefix), zap.String("wine", t.Version))
+		state = &prefixState{AppVersion: AppVersion, WineVersion: t.Version, Arch: t.Arch}
+		err = t.installComponents(ctx, tempPrefix, state, true)
+		if err != nil {
+			_ = os.RemoveAll(tempPrefix)
+			return err
+		}
+
+		err = os.Rename(tempPrefix, t.Prefix)
+		if err != nil {
+			_ = os.RemoveAll(tempPrefix)
+			return errors.WithStack(err)
+		}
+		return nil
+	}
+
+	return t.installComponents(ctx, t.Prefix, state, false)
+}
+
+// installComponents runs wineboot for a new prefix and applies missing components, state is written after success only
+func (t *Environment) installComponents(ctx context.Context, prefix string, state *prefixState, isNew bool) error {
+	var missing []string
+	for _, component := range t.Components {
+		if !util.ContainsString(state.Components, component) {
+			missing = append(missing, component)
+		}
+	}
+	if !isNew && len(missing) == 0 {
+		return nil
+	}
+
+	if isNew {
+		command := t.command(ctx, prefix, "wineboot", "--init")
+		if t.Arch != "" {
+			command.Env = append(command.Env, "WINEARCH="+t.Arch)
+		}
+		_, err := util.Execute(command)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, component := range missing {
+		log.Debug("installing wine component", zap.String("component", component), zap.String("prefix", prefix))
+		for _, args := range componentRegistryArgs[component] {
+			_, err := util.Execute(t.command(ctx, prefix, append([]string{"reg", "add"}, args...)...))
+			if err != nil {
+				return err
+			}
+		}
+		state.Components = append(state.Components, component)
+	}
+
+	t.waitServer(ctx, prefix)
+
+	data, err := jsoniter.ConfigCompatibleWithStandardLibrary.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(ioutil.WriteFile(filepath.Join(prefix, prefixStateFile), data, 0644))
+}
+
+// waitServer waits until wineserver flushes registry to disk, otherwise renamed or reused prefix can miss changes
+func (t *Environment) waitServer(ctx context.Context, prefix string) {
+	server := filepath.Join(filepath.Dir(t.Executable), "wineserver")
+	if _, err := os.Stat(server); err != nil {
+		server, err = exec.LookPath("wineserver")
+		if err != nil {
+			log.Debug("wineserver not found, skip waiting")
+			return
+		}
+	}
+
+	command := exec.CommandContext(ctx, server, "-w")
+	command.Env = createEnv(t.WineDir, prefix)
+	_, err := util.Execute(command)
+	if err != nil {
+		log.Debug("cannot wait for wineserver", zap.Error(err))
+	}
+}
+
+// Command returns wine command to run the executable in the prepared prefix
+func (t *Environment) Command(ctx context.Context, args ...string) *exec.Cmd {
+	return t.command(ctx, t.Prefix, args...)
+}
+
+func (t *Environment) command(ctx context.Context, prefix string, args ...string) *exec.Cmd {
+	command := exec.CommandContext(ctx, t.Executable, args...)
+	command.Env = createEnv(t.WineDir, prefix)
+	return command
+}
+
+// Env returns environment variables to run wine in the prepared prefix
+func (t *Environment) Env() []string {
+	return createEnv(t.WineDir, t.Prefix)
+}
+
+//noinspection SpellCheckingInspection
+func createEnv(wineDir string, prefix string) []string {
+	var env []string
+	for _, item := range os.Environ() {
+		// set explicitly, user env must not change the prefix
+		if !strings.HasPrefix(item, "WINEPREFIX=") && !strings.HasPrefix(item, "WINEARCH=") && !strings.HasPrefix(item, "WINEDEBUG=") && !strings.HasPrefix(item, "WINEDLLOVERRIDES=") {
+			env = append(env, item)
+		}
+	}
+
+	env = append(env,
+		"WINEDEBUG=-all,err+all",
+		// mscoree and mshtml - don't prompt to install mono and gecko
+		"WINEDLLOVERRIDES=winemenubuilder.exe=d;mscoree,mshtml=",
+	)
+	if prefix != "" {
+		env = append(env, "WINEPREFIX="+prefix)
+	}
+	if wineDir != "" {
+		env = append(env, "PATH="+filepath.Join(wineDir, "bin")+string(os.PathListSeparator)+os.Getenv("PATH"))
+		if runtime.GOOS == "darwin" {
+			env = append(env, "DYLD_FALLBACK_LIBRARY_PATH="+filepath.Join(wineDir, "lib")+":"+os.Getenv("DYLD_FALLBACK_LIBRARY_PATH"))
+		}
+	}
+	return env
+}
+
+// RemovePrefixes removes prefixes of other app-builder versions (or all if isAll), prefixes of the current version are kept because can be in use
+func RemovePrefixes(isAll bool) ([]string, error) {
+	root, err := GetPrefixRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+
+	var result []string
+	for _, file := range files {
+		if !file.IsDir() || (!isAll && strings.HasPrefix(file.Name(), AppVersion+"-")) {
+			continue
+		}
+
+		dir := filepath.Join(root, file.Name())
+		err = removePrefix(dir)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, dir)
+	}
+	return result, nil
+}
+
+// prefix is not removed while it is initialized by another process
+func removePrefix(prefix string) error {
+	unlock, err := lockPrefix(prefix)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	err = os.RemoveAll(prefix)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_ = os.Remove(prefix + ".lock")
+	return nil
+}
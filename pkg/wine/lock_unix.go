@@ -0,0 +1,45 @@
+// +build !windows
+
+package wine
+
+import (
+	"os"
+
+	"github.com/develar/app-builder/pkg/log"
+	"github.com/develar/errors"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// lockPrefix takes exclusive advisory lock of the prefix (released by the kernel if process is killed), returned function releases it
+func lockPrefix(prefix string) (func(), error) {
+	file, err := os.OpenFile(prefix+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	fd := int(file.Fd())
+	err = flock(fd, unix.LOCK_EX|unix.LOCK_NB)
+	if err == unix.EWOULDBLOCK {
+		log.Info("waiting for wine prefix used by another process", zap.String("prefix", prefix))
+		err = flock(fd, unix.LOCK_EX)
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, errors.WithStack(err)
+	}
+
+	return func() {
+		_ = flock(fd, unix.LOCK_UN)
+		_ = file.Close()
+	}, nil
+}
+
+func flock(fd int, how int) error {
+	for {
+		err := unix.Flock(fd, how)
+		if err != unix.EINTR {
+			return err
+		}
+	}
+}
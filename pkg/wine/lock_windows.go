@@ -0,0 +1,6 @@
+package wine
+
+// lockPrefix is not required - wine is not used on Windows
+func lockPrefix(prefix string) (func(), error) {
+	return func() {}, nil
+}
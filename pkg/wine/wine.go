@@ -1,17 +1,13 @@
 package wine
 
 import (
-	"context"
 	"errors"
-	"fmt"
-	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/alecthomas/kingpin"
-	"github.com/develar/app-builder/pkg/download"
 	"github.com/develar/app-builder/pkg/log"
 	"github.com/develar/app-builder/pkg/util"
 	"github.com/json-iterator/go"
@@ -44,6 +40,58 @@ func ConfigureCommand(app *kingpin.Application) {
 
 		return ExecWine(*ia32Name, *x64Name, parsedArgs)
 	})
+
+	configureEnvironmentCommand(app)
+}
+
+func configureEnvironmentCommand(app *kingpin.Application) {
+	command := app.Command("wine-env", "Manage isolated WINEPREFIX used for Windows cross-builds.")
+
+	configureOptions := func(command *kingpin.CmdClause) *EnvironmentOptions {
+		options := &EnvironmentOptions{}
+		command.Flag("arch", "The WINEARCH of the prefix (default of wine build if not set).").EnumVar(&options.Arch, "win32", "win64")
+		command.Flag("component", "The component to install into the prefix (default: "+strings.Join(DefaultComponents, ", ")+").").
+			EnumsVar(&options.Components, ComponentWindowsVersion, ComponentNoMenuBuilder, ComponentNoCrashDialog)
+		command.Flag("system", "Use wine from PATH instead of the pinned build.").Envar("USE_SYSTEM_WINE").BoolVar(&options.IsSystem)
+		return options
+	}
+
+	prepareCommand := command.Command("prepare", "Download wine, initialize the prefix and write environment info to stdout as JSON.")
+	prepareOptions := configureOptions(prepareCommand)
+	prepareCommand.Action(func(context *kingpin.ParseContext) error {
+		environment, err := PrepareEnvironment(prepareOptions)
+		if err != nil {
+			return err
+		}
+		return util.WriteJsonToStdOut(environment)
+	})
+
+	execCommand := command.Command("exec", "Run the Windows executable in the prefix.")
+	execOptions := configureOptions(execCommand)
+	execArgs := execCommand.Arg("args", "The executable and args.").Required().Strings()
+	execCommand.Action(func(context *kingpin.ParseContext) error {
+		environment, err := PrepareEnvironment(execOptions)
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := util.CreateContext()
+		defer cancel()
+		return util.ExecuteAndPipeStdOutAndStdErr(environment.Command(ctx, *execArgs...))
+	})
+
+	pruneCommand := command.Command("prune", "Remove prefixes created by other app-builder versions.")
+	isAll := pruneCommand.Flag("all", "Remove prefixes of the current version too.").Bool()
+	pruneCommand.Action(func(context *kingpin.ParseContext) error {
+		removed, err := RemovePrefixes(*isAll)
+		if err != nil {
+			return err
+		}
+		if removed == nil {
+			removed = []string{}
+		}
+		return util.WriteJsonToStdOut(removed)
+	})
 }
 
 func isMacOsCatalina() (bool, error) {
@@ -55,118 +103,46 @@ func isMacOsCatalina() (bool, error) {
 	return version.Compare(strings.TrimSpace(string(osRelease)), "19.0.0", ">="), nil
 }
 
-//noinspection GoUnusedParameter
+// ExecWine runs the executable in the app-builder WINEPREFIX (ia32 executable, x64 one if wine cannot run 32-bit applications)
 func ExecWine(ia32Name string, ia64Name string, args []string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
-	defer cancel()
-
 	useSystemWine := util.IsEnvTrue("USE_SYSTEM_WINE")
 	if useSystemWine {
 		log.Debug("using system wine is forced")
 	}
 
-	if util.GetCurrentOs() == util.MAC {
-		return executeMacOsWine(useSystemWine, ctx, args, ia32Name, ia64Name)
-	}
-
-	err := checkWineVersion()
-	if err != nil {
-		return err
-	}
-
-	args = append([]string{ia32Name}, args...)
-	_, err = util.Execute(exec.CommandContext(ctx, "wine", args...))
+	environment, err := PrepareEnvironment(&EnvironmentOptions{IsSystem: useSystemWine})
 	if err != nil {
 		return err
 	}
 
-	return nil
-}
-
-func executeMacOsWine(useSystemWine bool, ctx context.Context, args []string, ia32Name string, ia64Name string) error {
-	catalina, err := isMacOsCatalina()
-	if err != nil {
-		log.Warn("cannot detect macOS version", zap.Error(err))
+	executable := ia32Name
+	is64Only := filepath.Base(environment.Executable) == "wine64"
+	if !is64Only && util.GetCurrentOs() == util.MAC {
+		is64Only, err = isMacOsCatalina()
+		if err != nil {
+			log.Warn("cannot detect macOS version", zap.Error(err))
+		}
 	}
-
-	if catalina {
+	if is64Only {
 		if len(ia64Name) == 0 {
 			return errors.New("macOS Catalina doesn't support 32-bit executables and as result Wine cannot run Windows 32-bit applications too")
 		}
-
-		args = append([]string{ia64Name}, args...)
-	} else {
-		args = append([]string{ia32Name}, args...)
-	}
-
-	if useSystemWine {
-		command := exec.CommandContext(ctx, "wine", args...)
-		env := os.Environ()
-		env = append(env,
-			fmt.Sprintf("WINEDEBUG=%s", "-all,err+all"),
-			fmt.Sprintf("WINEDLLOVERRIDES=%s", "winemenubuilder.exe=d"),
-		)
-		command.Env = env
-
-		if _, err := util.Execute(command); err != nil {
-			return err
-		}
-
-		return nil
+		executable = ia64Name
 	}
 
-	var wineDir string
-	var wineExecutable string
-	if catalina {
-		dirName := "wine-4.0.1-mac"
-		//noinspection SpellCheckingInspection
-		checksum := "aCUQOyuPGlEvLMp0lPzb54D96+8IcLwmKTMElrZZqVWtEL1LQC7L9XpPv4RqaLX3BOeSifneEi4j9DpYdC1DCA=="
-		wineDir, err = download.DownloadArtifact(dirName, download.GetGithubBaseUrl()+dirName+"/"+dirName+".7z", checksum)
-		if err != nil {
-			return err
-		}
-
-		wineExecutable = "wine64"
-	} else {
-		dirName := "wine-2.0.3-mac-10.13"
-		//noinspection SpellCheckingInspection
-		checksum := "dlEVCf0YKP5IEiOKPNE48Q8NKXbXVdhuaI9hG2oyDEay2c+93PE5qls7XUbIYq4Xi1gRK8fkWeCtzN2oLpVQtg=="
-		wineDir, err = download.DownloadArtifact(dirName, download.GetGithubBaseUrl()+dirName+"/"+dirName+".7z", checksum)
-		if err != nil {
-			return err
-		}
+	ctx, cancel := util.CreateContextWithTimeout(2 * time.Minute)
+	defer cancel()
+	_, err = util.Execute(environment.Command(ctx, append([]string{executable}, args...)...))
+	return err
+}
 
-		wineExecutable = "wine"
-	}
-	command := exec.CommandContext(ctx, filepath.Join(wineDir, "bin", wineExecutable), args...)
-	env := os.Environ()
-	//noinspection SpellCheckingInspection
-	env = append(env,
-		fmt.Sprintf("WINEDEBUG=%s", "-all,err+all"),
-		fmt.Sprintf("WINEDLLOVERRIDES=%s", "winemenubuilder.exe=d"),
-		"WINEPREFIX=" + filepath.Join(wineDir, "wine-home"),
-		fmt.Sprintf("DYLD_FALLBACK_LIBRARY_PATH=%s", filepath.Join(wineDir, "lib")+":"+os.Getenv("DYLD_FALLBACK_LIBRARY_PATH")),
-	)
-
-	//if catalina && len(ia64Name) == 0 {
-	//	//noinspection SpellCheckingInspection
-	//	env = append(env,
-	//		"WINEARCH=win32",
-	//		"WINEPREFIX="+filepath.Join(wineDir, "wine-home-ia32"),
-	//	)
-	//} else {
-	env = append(env, "WINEPREFIX="+filepath.Join(wineDir, "wine-home"))
-	//}
-	command.Env = env
-	_, err = util.Execute(command)
-	if err != nil {
-		return err
-	}
-	return nil
+// CheckSystemWine checks that wine 1.8+ is installed (used on Linux, on macOS wine is downloaded unless USE_SYSTEM_WINE is set)
+func CheckSystemWine() error {
+	return checkWineVersion()
 }
 
 func checkWineVersion() error {
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	ctx, cancel := util.CreateContextWithTimeout(2 * time.Minute)
 	defer cancel()
 
 	wineVersionResult, err := exec.CommandContext(ctx, "wine", "--version").Output()
@@ -1,11 +1,27 @@
 package wine
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/develar/app-builder/pkg/log"
 	. "github.com/onsi/gomega"
 )
 
+// fake wine logs invocations with prefix, wineboot creates drive_c
+const fakeWine = `#!/bin/sh
+echo "$WINEPREFIX|$WINEARCH|$WINEDLLOVERRIDES|$*" >> "$FAKE_DIR/wine.log"
+case "$1" in
+  --version) echo "wine-5.0.3 (Staging)" ;;
+  wineboot) mkdir -p "$WINEPREFIX/drive_c" ;;
+esac
+`
+
 func TestCheckWineVersion(t *testing.T) {
 	g := NewGomegaWithT(t)
 
@@ -34,3 +50,89 @@ func TestCheckWineVersionReal(t *testing.T) {
 	err := checkWineVersion()
 	g.Expect(err).To(HaveOccurred())
 }
+
+func TestPrepareEnvironment(t *testing.T) {
+	log.InitLogger()
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "wine")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	binDir := filepath.Join(dir, "wine", "bin")
+	g.Expect(os.MkdirAll(binDir, 0755)).To(Succeed())
+	g.Expect(ioutil.WriteFile(filepath.Join(binDir, "wine"), []byte(fakeWine), 0755)).To(Succeed())
+	g.Expect(ioutil.WriteFile(filepath.Join(binDir, "wineserver"), []byte("#!/bin/sh\n"), 0755)).To(Succeed())
+	for name, value := range map[string]string{"ELECTRON_BUILDER_WINE_DIR": filepath.Join(dir, "wine"), "ELECTRON_BUILDER_CACHE": filepath.Join(dir, "cache"), "FAKE_DIR": dir, "WINEPREFIX": "/user/prefix"} {
+		defer os.Unsetenv(name)
+		g.Expect(os.Setenv(name, value)).To(Succeed())
+	}
+	defer func(version string) { AppVersion = version }(AppVersion)
+	AppVersion = "1.0.0"
+
+	environment, err := PrepareEnvironment(&EnvironmentOptions{Arch: "win64", Components: []string{ComponentNoMenuBuilder}})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(environment.Version).To(Equal("5.0.3"))
+	g.Expect(environment.Prefix).To(Equal(filepath.Join(dir, "cache", "wine-prefix", "1.0.0-5.0.3-win64")))
+	g.Expect(filepath.Join(environment.Prefix, "drive_c")).To(BeADirectory())
+	g.Expect(filepath.Join(environment.Prefix, prefixStateFile)).To(BeAnExistingFile())
+
+	// prefix is initialized in a temp dir
+	data, err := ioutil.ReadFile(filepath.Join(dir, "wine.log"))
+	g.Expect(err).NotTo(HaveOccurred())
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	g.Expect(lines).To(HaveLen(3))
+	g.Expect(lines[0]).To(HavePrefix("||"))
+	g.Expect(lines[1]).To(MatchRegexp(`^.+1\.0\.0-5\.0\.3-win64\.tmp-\d+\|win64\|winemenubuilder.exe=d;mscoree,mshtml=\|wineboot --init$`))
+	g.Expect(lines[2]).To(HaveSuffix("|reg add HKCU\\Software\\Wine\\DllOverrides /v winemenubuilder.exe /d  /f"))
+
+	// existing prefix is reused, only missing component is installed
+	g.Expect(os.Remove(filepath.Join(dir, "wine.log"))).To(Succeed())
+	environment, err = PrepareEnvironment(&EnvironmentOptions{Arch: "win64", Components: []string{ComponentNoMenuBuilder, ComponentNoCrashDialog}})
+	g.Expect(err).NotTo(HaveOccurred())
+	data, err = ioutil.ReadFile(filepath.Join(dir, "wine.log"))
+	g.Expect(err).NotTo(HaveOccurred())
+	lines = strings.Split(strings.TrimSpace(string(data)), "\n")
+	g.Expect(lines).To(HaveLen(2))
+	g.Expect(lines[1]).To(Equal(environment.Prefix + "||winemenubuilder.exe=d;mscoree,mshtml=|reg add HKCU\\Software\\Wine\\WineDbg /v ShowCrashDialog /t REG_DWORD /d 0 /f"))
+	g.Expect(readPrefixState(environment.Prefix).Components).To(Equal([]string{ComponentNoMenuBuilder, ComponentNoCrashDialog}))
+
+	// user WINEPREFIX doesn't affect the command
+	g.Expect(environment.Command(context.Background(), "app.exe").Run()).To(Succeed())
+	data, err = ioutil.ReadFile(filepath.Join(dir, "wine.log"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(data)).To(HaveSuffix(environment.Prefix + "||winemenubuilder.exe=d;mscoree,mshtml=|app.exe\n"))
+
+	_, err = PrepareEnvironment(&EnvironmentOptions{Components: []string{"dotnet48"}})
+	g.Expect(err).To(HaveOccurred())
+
+	// prefixes of other versions are removed
+	AppVersion = "2.0.0"
+	removed, err := RemovePrefixes(false)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(removed).To(Equal([]string{environment.Prefix}))
+	g.Expect(environment.Prefix + ".lock").NotTo(BeAnExistingFile())
+}
+
+func TestLockPrefix(t *testing.T) {
+	log.InitLogger()
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "wine")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	prefix := filepath.Join(dir, "prefix")
+	unlock, err := lockPrefix(prefix)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	removed := make(chan error, 1)
+	go func() {
+		removed <- removePrefix(prefix)
+	}()
+	g.Consistently(removed, 100*time.Millisecond).ShouldNot(Receive())
+
+	unlock()
+	g.Eventually(removed).Should(Receive(BeNil()))
+	g.Expect(prefix + ".lock").NotTo(BeAnExistingFile())
+}
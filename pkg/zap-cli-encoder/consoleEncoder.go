@@ -57,6 +57,11 @@ func (t *consoleEncoder) EncodeEntry(entry zapcore.Entry, fields []zapcore.Field
 	levelColor, levelIndicator := getLevelColorAndIndicator(&entry)
 	line := linePool.Get()
 
+	// timestamp is written only if configured (--log-timestamps)
+	if t.encoderConfig.EncodeTime != nil {
+		t.encoderConfig.EncodeTime(entry.Time, &bufferArrayEncoder{buffer: line})
+	}
+
 	// <space><space><indicator char><space>
 	if t.colored {
 		_, _ = fmt.Fprintf(line, "\x1b[%dm%s\x1b[0m", levelColor, levelIndicator)
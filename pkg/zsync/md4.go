@@ -0,0 +1,67 @@
+package zsync
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// MD4 (RFC 1320) is required by zsync format for strong block checksums. It is not used for security purposes.
+func md4Sum(data []byte) [16]byte {
+	a, b, c, d := uint32(0x67452301), uint32(0xefcdab89), uint32(0x98badcfe), uint32(0x10325476)
+
+	length := len(data)
+	padded := make([]byte, 0, length+72)
+	padded = append(padded, data...)
+	padded = append(padded, 0x80)
+	for len(padded)%64 != 56 {
+		padded = append(padded, 0)
+	}
+	var lengthBits [8]byte
+	binary.LittleEndian.PutUint64(lengthBits[:], uint64(length)<<3)
+	padded = append(padded, lengthBits[:]...)
+
+	var x [16]uint32
+	for offset := 0; offset < len(padded); offset += 64 {
+		for i := range x {
+			x[i] = binary.LittleEndian.Uint32(padded[offset+i*4:])
+		}
+
+		aa, bb, cc, dd := a, b, c, d
+
+		// round 1
+		for _, i := range [4]int{0, 4, 8, 12} {
+			a = bits.RotateLeft32(a+((b&c)|(^b&d))+x[i], 3)
+			d = bits.RotateLeft32(d+((a&b)|(^a&c))+x[i+1], 7)
+			c = bits.RotateLeft32(c+((d&a)|(^d&b))+x[i+2], 11)
+			b = bits.RotateLeft32(b+((c&d)|(^c&a))+x[i+3], 19)
+		}
+
+		// round 2
+		for _, i := range [4]int{0, 1, 2, 3} {
+			a = bits.RotateLeft32(a+((b&c)|(b&d)|(c&d))+x[i]+0x5a827999, 3)
+			d = bits.RotateLeft32(d+((a&b)|(a&c)|(b&c))+x[i+4]+0x5a827999, 5)
+			c = bits.RotateLeft32(c+((d&a)|(d&b)|(a&b))+x[i+8]+0x5a827999, 9)
+			b = bits.RotateLeft32(b+((c&d)|(c&a)|(d&a))+x[i+12]+0x5a827999, 13)
+		}
+
+		// round 3
+		for _, i := range [4]int{0, 2, 1, 3} {
+			a = bits.RotateLeft32(a+(b^c^d)+x[i]+0x6ed9eba1, 3)
+			d = bits.RotateLeft32(d+(a^b^c)+x[i+8]+0x6ed9eba1, 9)
+			c = bits.RotateLeft32(c+(d^a^b)+x[i+4]+0x6ed9eba1, 11)
+			b = bits.RotateLeft32(b+(c^d^a)+x[i+12]+0x6ed9eba1, 15)
+		}
+
+		a += aa
+		b += bb
+		c += cc
+		d += dd
+	}
+
+	var result [16]byte
+	binary.LittleEndian.PutUint32(result[0:], a)
+	binary.LittleEndian.PutUint32(result[4:], b)
+	binary.LittleEndian.PutUint32(result[8:], c)
+	binary.LittleEndian.PutUint32(result[12:], d)
+	return result
+}
@@ -0,0 +1,152 @@
+package zsync
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/develar/app-builder/pkg/util"
+	"github.com/develar/errors"
+	"github.com/develar/go-fs-util"
+)
+
+// the same as zsyncmake, AppImageUpdate checks major version only
+const version = "0.6.2"
+
+type Options struct {
+	// URL of the target file (relative to the .zsync file location), file name by default
+	Url string
+	// zsyncmake uses 2048 for files smaller than 100 MB and 4096 for others, if not specified
+	BlockSize int
+}
+
+// Make writes zsync control file (https://zsync.moria.org.uk) for the file, the same as `zsyncmake -u url -o outFile file`.
+func Make(file string, outFile string, options Options) error {
+	inputFile, err := os.Open(file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer util.Close(inputFile)
+
+	fileInfo, err := inputFile.Stat()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	length := fileInfo.Size()
+	blockSize := options.BlockSize
+	if blockSize <= 0 {
+		blockSize = 2048
+		if length >= 100*1024*1024 {
+			blockSize = 4096
+		}
+	}
+
+	url := options.Url
+	if len(url) == 0 {
+		url = filepath.Base(file)
+	}
+
+	seqMatches, rsumLength, checksumLength := computeHashLengths(length, blockSize)
+
+	// block sums are written after the header that contains SHA-1 of the whole file, so, sums are collected in memory (20 bytes per block at most)
+	blockCount := (length + int64(blockSize) - 1) / int64(blockSize)
+	sums := make([]byte, 0, blockCount*int64(rsumLength+checksumLength))
+	fileHash := sha1.New()
+	buffer := make([]byte, blockSize)
+	reader := bufio.NewReaderSize(inputFile, 1024*1024)
+	for {
+		n, err := io.ReadFull(reader, buffer)
+		if n == 0 && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return errors.WithStack(err)
+		}
+
+		_, _ = fileHash.Write(buffer[:n])
+		// short last block is padded with zeros
+		for i := n; i < blockSize; i++ {
+			buffer[i] = 0
+		}
+
+		var rsum [4]byte
+		a, b := computeRsum(buffer)
+		binary.BigEndian.PutUint16(rsum[0:], a)
+		binary.BigEndian.PutUint16(rsum[2:], b)
+		checksum := md4Sum(buffer)
+		sums = append(sums, rsum[4-rsumLength:]...)
+		sums = append(sums, checksum[:checksumLength]...)
+
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+
+	out, err := os.Create(outFile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	writer := bufio.NewWriter(out)
+	_, err = fmt.Fprintf(writer, "zsync: %s\nFilename: %s\nMTime: %s\nBlocksize: %d\nLength: %d\nHash-Lengths: %d,%d,%d\nURL: %s\nSHA-1: %s\n\n",
+		version, filepath.Base(file), fileInfo.ModTime().UTC().Format(time.RFC1123Z), blockSize, length, seqMatches, rsumLength, checksumLength, url, hex.EncodeToString(fileHash.Sum(nil)))
+	if err == nil {
+		_, err = writer.Write(sums)
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	return errors.WithStack(fsutil.CloseAndCheckError(err, out))
+}
+
+// rolling checksum of zsync (rsync-like, 16-bit arithmetic)
+func computeRsum(data []byte) (uint16, uint16) {
+	var a, b uint16
+	length := len(data)
+	for _, c := range data {
+		a += uint16(c)
+		b += uint16(length) * uint16(c)
+		length--
+	}
+	return a, b
+}
+
+// the same as zsyncmake - the minimal hash lengths to keep probability of false match negligible
+func computeHashLengths(length int64, blockSize int) (int, int, int) {
+	seqMatches := 1
+	if length > int64(blockSize) {
+		seqMatches = 2
+	}
+
+	if length == 0 {
+		length = 1
+	}
+
+	logLength := math.Log(float64(length))
+	rsumLength := int(math.Ceil(((logLength+math.Log(float64(blockSize)))/math.Log(2) - 8.6) / float64(seqMatches) / 8))
+	if rsumLength > 4 {
+		rsumLength = 4
+	} else if rsumLength < 2 {
+		rsumLength = 2
+	}
+
+	// integer division as in zsyncmake
+	blockCountLog := math.Log(float64(1 + length/int64(blockSize)))
+	checksumLength := int(math.Ceil((20 + (logLength+blockCountLog)/math.Log(2)) / float64(seqMatches) / 8))
+	minChecksumLength := int((7.9 + (20 + blockCountLog/math.Log(2))) / 8)
+	if checksumLength < minChecksumLength {
+		checksumLength = minChecksumLength
+	}
+	if checksumLength > 16 {
+		checksumLength = 16
+	}
+	return seqMatches, rsumLength, checksumLength
+}
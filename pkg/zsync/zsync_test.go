@@ -0,0 +1,60 @@
+package zsync
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestMd4(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	// RFC 1320 test suite
+	for input, expected := range map[string]string{
+		"":    "31d6cfe0d16ae931b73c59d7e0c089c0",
+		"abc": "a448017aaf21d8525fc10ae87aa6729d",
+		"12345678901234567890123456789012345678901234567890123456789012345678901234567890": "e33b4ddc9c38f2199c3e7b164fcc0536",
+	} {
+		sum := md4Sum([]byte(input))
+		g.Expect(hex.EncodeToString(sum[:])).To(Equal(expected))
+	}
+}
+
+func TestHashLengths(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	seqMatches, rsumLength, checksumLength := computeHashLengths(100*1000*1000, 4096)
+	g.Expect([]int{seqMatches, rsumLength, checksumLength}).To(Equal([]int{2, 2, 5}))
+
+	seqMatches, rsumLength, checksumLength = computeHashLengths(1000, 2048)
+	g.Expect([]int{seqMatches, rsumLength, checksumLength}).To(Equal([]int{1, 2, 4}))
+}
+
+func TestMake(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir, err := ioutil.TempDir("", "zsync")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "app.AppImage")
+	g.Expect(ioutil.WriteFile(file, []byte(strings.Repeat("hello world. ", 1000)), 0644)).NotTo(HaveOccurred())
+	g.Expect(Make(file, file+".zsync", Options{})).NotTo(HaveOccurred())
+
+	data, err := ioutil.ReadFile(file + ".zsync")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	headerEnd := bytes.Index(data, []byte("\n\n"))
+	g.Expect(headerEnd).To(BeNumerically(">", 0))
+	header := string(data[:headerEnd])
+	g.Expect(header).To(HavePrefix("zsync: 0.6.2\nFilename: app.AppImage\nMTime: "))
+	g.Expect(header).To(ContainSubstring("\nBlocksize: 2048\nLength: 13000\nHash-Lengths: 2,2,3\nURL: app.AppImage\nSHA-1: 46573dfbbfa5ccce3bdb535174becafe47807cfa"))
+	// 7 blocks, 2 bytes rsum and 3 bytes checksum per block
+	g.Expect(len(data) - headerEnd - 2).To(Equal(7 * 5))
+}